@@ -36,6 +36,7 @@ in
     golangci-lint
     gosec
     jq
+    k6
     openssl
     just
     docker
@@ -90,6 +91,8 @@ in
     (cd services/receipts-log && go test -v -coverprofile=../../coverage/receipts.out -covermode=atomic ./...)
     echo "Testing issuance-gateway..."
     (cd services/issuance-gateway && go test -v -coverprofile=../../coverage/issuance.out -covermode=atomic ./...)
+    echo "Testing common..."
+    (cd services/common && go test -v -coverprofile=../../coverage/common.out -covermode=atomic ./...)
     echo "✅ All tests completed successfully with coverage"
   '';
   scripts."ci:lint".exec = ''
@@ -151,6 +154,7 @@ in
     cd ../registry && go test -v ./... && echo "✅ Registry tests passed"  
     cd ../receipts-log && go test -v ./... && echo "✅ Receipts-log tests passed"
     cd ../issuance-gateway && go test -v ./... && echo "✅ Issuance gateway tests passed"
+    cd ../common && go test -v ./... && echo "✅ Common package tests passed"
   '';
   scripts."test:coverage".exec = ''
     echo "Running tests with coverage..."
@@ -161,6 +165,12 @@ in
     cd ../issuance-gateway && go test -coverprofile=../../coverage/issuance.out -covermode=atomic ./...
     echo "Coverage reports generated in coverage/"
   '';
+  scripts."bench:go".exec = ''
+    scripts/bench.sh "$@"
+  '';
+  scripts."load:k6".exec = ''
+    k6 run tests/load/hot-paths.js "$@"
+  '';
   scripts."test:integration".exec = ''
     echo "Running integration tests..."
     devenv up --detach
@@ -503,7 +513,8 @@ EOF
     
     # Build and push container
     echo "📦 Building container..."
-    gcloud builds submit --tag gcr.io/$PROJECT_ID/$SERVICE_NAME ./services/verifier
+    gcloud builds submit ./services --config ./services/cloudbuild.yaml \
+      --substitutions _SERVICE=verifier,_IMAGE=$SERVICE_NAME
     
     # Deploy to Cloud Run with SecretSpec-consistent secrets
     echo "🌐 Deploying to Cloud Run with secrets from Secret Manager..."
@@ -0,0 +1,29 @@
+#!/usr/bin/env bash
+# bench.sh - Run the Go benchmarks for the hot paths and record them as the
+# baseline for a release, comparing with the previous baseline when
+# benchstat is installed.
+#
+#   scripts/bench.sh v0.4.0
+#
+# Baselines live in tests/load/baselines/<release>.txt; commit the new one
+# with the release.
+set -euo pipefail
+
+release="${1:?usage: scripts/bench.sh <release>}"
+root="$(cd "$(dirname "$0")/.." && pwd)"
+baselines="$root/tests/load/baselines"
+out="$baselines/$release.txt"
+previous="$(ls "$baselines"/*.txt 2>/dev/null | grep -v "/$release.txt$" | sort -V | tail -n 1 || true)"
+
+mkdir -p "$baselines"
+: > "$out"
+for service in issuance-gateway verifier receipts-log; do
+  echo "Benchmarking $service..."
+  (cd "$root/services/$service" && go test -run '^$' -bench . -benchmem -count 6 .) | tee -a "$out"
+done
+echo "✅ Baseline written to $out"
+
+if [ -n "$previous" ] && command -v benchstat >/dev/null; then
+  echo "Comparing with $(basename "$previous" .txt)..."
+  benchstat "$previous" "$out"
+fi
@@ -1,5 +1,11 @@
 export type RequestPackOptions = { policyId: string; purpose: string };
-export type VerifyResult = { badge: string; predicates: string[]; freshness: string };
+export type PredicateResult = { id: string; passed: boolean; required: boolean; reason: string; credential?: number };
+export type Badge = { label: string; policyId: string; predicates: string[]; satisfied: boolean; verifiedAt: string; expiresAt: string; jws: string };
+export type ConsentReceipt = { "@context": string; id: string; holder?: string; rp: string; rpId?: string; purpose?: string; policyId: string; timestamp: string; requested: string[]; disclosed: string[]; predicatesProven: string[]; issuers: string[] };
+export type ReceiptAnchor = { hash: string; accepted: boolean; anchored: boolean };
+export type FreshnessDiagnostic = { code: "stale_credential" | "old_verification" | "clock_skew"; message: string; limit: string; actual?: string };
+export type CredentialResult = { index: number; format: string; type?: string; issuer: string; keyBound: boolean; freshness: "ok" | "stale" | "suspended" | "unknown"; freshnessDiagnostics?: FreshnessDiagnostic[]; disclosed: string[]; satisfies: string[] };
+export type VerifyResult = { badge: Badge; predicates: string[]; freshness: "ok" | "stale" | "suspended" | "unknown"; freshnessDiagnostics?: FreshnessDiagnostic[]; issuer?: string; keyBound: boolean; satisfied: boolean; results?: PredicateResult[]; credentials: CredentialResult[]; receipt: ConsentReceipt; receiptAnchor?: ReceiptAnchor };
 
 export async function listPacks(base = "http://localhost:8081"): Promise<{id:string;version:string;name:string}[]> {
   const res = await fetch(`${base}/packs`);
@@ -10,10 +16,65 @@ export async function requestPack(opts: RequestPackOptions): Promise<string> {
   return `cachet://present?policyId=${encodeURIComponent(opts.policyId)}&purpose=${encodeURIComponent(opts.purpose)}`;
 }
 
-export async function verifyPresentation(bundle: any, policyId: string, base = "http://localhost:8081"): Promise<VerifyResult> {
+// Relying party API key issued by the verifier's admin API
+function rpHeaders(apiKey?: string): Record<string, string> {
+  const headers: Record<string, string> = { 'content-type': 'application/json' };
+  if (apiKey) headers['x-api-key'] = apiKey;
+  return headers;
+}
+
+export type VerificationSession = { sessionId: string; nonce: string; audience: string; policyId: string; rpId?: string; createdAt: string; expiresAt: string; redirectUri?: string; callbackUrl?: string; requestUri?: string; authorizationRequest?: string };
+export type SessionState = "pending" | "received" | "verified" | "failed" | "expired";
+export type SessionStatus = { sessionId: string; state: SessionState; policyId: string; expiresAt: string; updatedAt: string };
+export type SessionLink = { sessionId: string; deepLink: string; qrPayload: string; requestUri: string; statusUri: string; eventsUri: string; expiresAt: string };
+
+export async function createVerificationSession(policyId: string, base = "http://localhost:8081", apiKey?: string): Promise<VerificationSession> {
+  const res = await fetch(`${base}/verification-sessions`, {
+    method: 'POST', headers: rpHeaders(apiKey),
+    body: JSON.stringify({ policyId })
+  });
+  return res.json();
+}
+
+export async function verifyPresentation(bundle: any, session: VerificationSession, base = "http://localhost:8081", apiKey?: string): Promise<VerifyResult> {
   const res = await fetch(`${base}/presentations/verify`, {
-    method: 'POST', headers: { 'content-type': 'application/json' },
-    body: JSON.stringify({ policyId, bundle })
+    method: 'POST', headers: rpHeaders(apiKey),
+    body: JSON.stringify({ policyId: session.policyId, sessionId: session.sessionId, bundle })
   });
   return res.json();
 }
+
+export async function getSessionLink(sessionId: string, base = "http://localhost:8081"): Promise<SessionLink> {
+  const res = await fetch(`${base}/verification-sessions/${encodeURIComponent(sessionId)}/link`);
+  return res.json();
+}
+
+export async function getSessionStatus(sessionId: string, base = "http://localhost:8081"): Promise<SessionStatus> {
+  const res = await fetch(`${base}/verification-sessions/${encodeURIComponent(sessionId)}`);
+  return res.json();
+}
+
+// watchSession calls onState on every state change until the session settles;
+// the returned function stops watching early
+export function watchSession(sessionId: string, onState: (status: SessionStatus) => void, base = "http://localhost:8081"): () => void {
+  const source = new EventSource(`${base}/verification-sessions/${encodeURIComponent(sessionId)}/events`);
+  source.addEventListener('state', (event) => {
+    const status: SessionStatus = JSON.parse((event as MessageEvent).data);
+    onState(status);
+    if (status.state !== 'pending' && status.state !== 'received') source.close();
+  });
+  return () => source.close();
+}
+
+// verifyCallbackSignature checks a Cachet-Signature header against the raw
+// callback body, rejecting deliveries older than toleranceSeconds
+export async function verifyCallbackSignature(secret: string, body: string, header: string, toleranceSeconds = 300): Promise<boolean> {
+  const parts = Object.fromEntries(header.split(',').map((part) => part.split('=', 2) as [string, string]));
+  const timestamp = Number(parts['t']);
+  if (!parts['v1'] || !Number.isFinite(timestamp) || Math.abs(Date.now() / 1000 - timestamp) > toleranceSeconds) return false;
+  const enc = new TextEncoder();
+  const key = await crypto.subtle.importKey('raw', enc.encode(secret), { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+  const mac = new Uint8Array(await crypto.subtle.sign('HMAC', key, enc.encode(`${parts['t']}.${body}`)));
+  const expected = Array.from(mac, (b) => b.toString(16).padStart(2, '0')).join('');
+  return expected === parts['v1'];
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+)
+
+// requestTimeout bounds each admin API call
+const requestTimeout = 30 * time.Second
+
+// apiError is an admin API call answered with an error status
+type apiError struct {
+	Service string
+	Status  int
+	Code    string
+	Detail  string
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%s answered %d %s", e.Service, e.Status, http.StatusText(e.Status))
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// isStatus reports whether err is an API error with the given status
+func isStatus(err error, status int) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Status == status
+}
+
+// client calls the admin APIs of a profile's services
+type client struct {
+	profile *Profile
+	http    *http.Client
+}
+
+// call sends body as JSON to a service and decodes the JSON answer into out,
+// when it is not nil. Errors carry the service's problem details.
+func (c *client) call(ctx context.Context, service, method, path string, body, out any) error {
+	base, err := c.profile.baseURL(service)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(apiversion.Header, "1")
+	if token := c.profile.token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling %s: %w", service, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return fmt.Errorf("reading %s response: %w", service, err)
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &apiError{Service: service, Status: resp.StatusCode}
+		var details problem.Details
+		if json.Unmarshal(data, &details) == nil && details.Status != 0 {
+			apiErr.Code, apiErr.Detail = details.Code, details.Detail
+		} else {
+			apiErr.Detail = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", service, err)
+	}
+	return nil
+}
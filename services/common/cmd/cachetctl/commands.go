@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"gopkg.in/yaml.v3"
+)
+
+// command is one operational task, named by its group and verb
+type command struct {
+	name    string // e.g. "packs push"
+	args    string // positional arguments, for usage
+	summary string
+	run     func(ctx context.Context, c *cli, args []string) error
+}
+
+// commands lists every task, in the order usage shows them
+var commands = []command{
+	{"packs list", "[--status STATUS]", "List the registry's packs, published ones unless --status is given", packsList},
+	{"packs push", "FILE", "Create a pack draft from a JSON or YAML pack document", packsPush},
+	{"packs submit", "ID@VERSION", "Submit a draft for review", packsSubmit},
+	{"packs review", "--approve|--reject [--comment TEXT] ID@VERSION", "Approve or reject a pack in review", packsReview},
+	{"packs publish", "ID@VERSION", "Publish an approved pack, which the registry signs", packsPublish},
+	{"keys rotate", "[--did NAME] JWK_FILE", "Add a public key to a hosted DID, retiring its active keys; the platform DID without --did", keysRotate},
+	{"keys revoke", "[--did NAME] KEY_ID", "Revoke a hosted DID's key, so credentials it signed stop verifying", keysRevoke},
+	{"secrets rotate", "", "Rewrap the connector hub's secrets under its newest key encryption key", secretsRotate},
+	{"credentials revoke", "VOUCH_ID REVOCATION_FILE", "Revoke a vouch credential with the voucher's signed revocation", credentialsRevoke},
+	{"log sth", "", "Show the receipts log's signed tree head", logSTH},
+	{"log proof", "RECEIPT_HASH", "Show the receipts log's inclusion proof for a receipt hash", logProof},
+	{"log verify", "[--key PEM_FILE] RECEIPT_HASH", "Check the receipts log's tree head is signed by its key and includes a receipt hash", logVerify},
+	{"webhooks dead-letters", "[--service SERVICE]", "List dead-lettered webhooks of the issuance gateway and connector hub", webhooksDeadLetters},
+	{"webhooks replay", "--service SERVICE ID", "Queue a dead-lettered webhook for delivery again", webhooksReplay},
+	{"seed demo", "", "Create demo data: a trusted issuer and pack draft, a relying party and a partner", seedDemo},
+	{"profiles list", "", "List the profiles of the profiles file", profilesList},
+}
+
+// findCommand returns the command named by the first two arguments
+func findCommand(args []string) (command, []string, bool) {
+	if len(args) < 2 {
+		return command{}, nil, false
+	}
+	name := args[0] + " " + args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, args[2:], true
+		}
+	}
+	return command{}, nil, false
+}
+
+// usage describes the commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: cachetctl [--config FILE] [--profile NAME] GROUP COMMAND [ARGS]")
+	fmt.Fprintln(w)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\n      %s\n", cmd.name, cmd.args, cmd.summary)
+	}
+}
+
+// parseArgs parses a command's flags and checks it got n positional
+// arguments
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", fs.Name(), n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// readDocument reads a JSON or YAML file, by extension
+func readDocument(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// packPath is the registry path of a pack version
+func packPath(ref string) (string, error) {
+	if id, version, ok := strings.Cut(ref, "@"); !ok || id == "" || version == "" {
+		return "", fmt.Errorf("pack reference %q must be id@version", ref)
+	}
+	return "/packs/" + url.PathEscape(ref), nil
+}
+
+func packsList(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("packs list", flag.ContinueOnError)
+	status := fs.String("status", "", "draft, in_review, approved, published, retired or all")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	path := "/packs"
+	if *status != "" {
+		path += "?status=" + url.QueryEscape(*status)
+	}
+	return c.show(ctx, serviceRegistry, http.MethodGet, path, nil)
+}
+
+func packsPush(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("packs push", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	pack, err := readDocument(args[0])
+	if err != nil {
+		return err
+	}
+	return c.show(ctx, serviceRegistry, http.MethodPost, "/packs", pack)
+}
+
+// packsTransition moves a pack to status
+func packsTransition(ctx context.Context, c *cli, name, status string, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet(name, flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	path, err := packPath(args[0])
+	if err != nil {
+		return err
+	}
+	return c.show(ctx, serviceRegistry, http.MethodPut, path, map[string]string{"status": status})
+}
+
+func packsSubmit(ctx context.Context, c *cli, args []string) error {
+	return packsTransition(ctx, c, "packs submit", "in_review", args)
+}
+
+func packsPublish(ctx context.Context, c *cli, args []string) error {
+	return packsTransition(ctx, c, "packs publish", "published", args)
+}
+
+func packsReview(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("packs review", flag.ContinueOnError)
+	approve := fs.Bool("approve", false, "approve the pack")
+	reject := fs.Bool("reject", false, "send the pack back to draft")
+	comment := fs.String("comment", "", "comment, required to reject")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *approve == *reject {
+		return errors.New("packs review takes one of --approve and --reject")
+	}
+	path, err := packPath(args[0])
+	if err != nil {
+		return err
+	}
+	decision := "approve"
+	if *reject {
+		decision = "reject"
+	}
+	return c.show(ctx, serviceRegistry, http.MethodPost, path+"/review", map[string]string{"decision": decision, "comment": *comment})
+}
+
+// didKeysPath is the registry path of a hosted DID's keys, the platform
+// DID's when name is empty
+func didKeysPath(name string) string {
+	if name == "" {
+		return "/did/keys"
+	}
+	return "/dids/" + url.PathEscape(name) + "/keys"
+}
+
+func keysRotate(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	did := fs.String("did", "", "hosted DID name; the platform DID without it")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	jwk, err := readDocument(args[0])
+	if err != nil {
+		return err
+	}
+	return c.show(ctx, serviceRegistry, http.MethodPost, didKeysPath(*did), map[string]any{"publicKeyJwk": jwk, "rotate": true})
+}
+
+func keysRevoke(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ContinueOnError)
+	did := fs.String("did", "", "hosted DID name; the platform DID without it")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	path := didKeysPath(*did) + "/" + url.PathEscape(args[0])
+	return c.show(ctx, serviceRegistry, http.MethodPut, path, map[string]string{"status": "revoked"})
+}
+
+func secretsRotate(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("secrets rotate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	return c.show(ctx, serviceConnectorHub, http.MethodPost, "/secrets/rotate", nil)
+}
+
+func credentialsRevoke(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("credentials revoke", flag.ContinueOnError), args, 2)
+	if err != nil {
+		return err
+	}
+	revocation, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	path := "/vouches/" + url.PathEscape(args[0]) + "/revoke"
+	return c.show(ctx, serviceVouching, http.MethodPost, path, map[string]string{"revocation": strings.TrimSpace(string(revocation))})
+}
+
+func logSTH(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("log sth", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	return c.show(ctx, serviceReceiptsLog, http.MethodGet, "/log/sth", nil)
+}
+
+func logProof(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("log proof", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	return c.show(ctx, serviceReceiptsLog, http.MethodGet, "/log/proof?hash="+url.QueryEscape(args[0]), nil)
+}
+
+func logVerify(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("log verify", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "PEM file of the receipts log's public key, instead of the profile's receiptsLogKey")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		*keyFile = c.profile.ReceiptsLogKey
+	}
+	if *keyFile == "" {
+		return errors.New("log verify needs the receipts log's public key: --key or the profile's receiptsLogKey")
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := logproof.ParsePublicKey(data)
+	if err != nil {
+		return err
+	}
+
+	var head logproof.TreeHead
+	if err := c.call(ctx, serviceReceiptsLog, http.MethodGet, "/log/sth", nil, &head); err != nil {
+		return err
+	}
+	// The proof is asked for the tree the STH signs, however the log grew since
+	var proof logproof.InclusionProof
+	path := fmt.Sprintf("/log/proof?hash=%s&treeSize=%d", url.QueryEscape(args[0]), head.TreeSize)
+	if err := c.call(ctx, serviceReceiptsLog, http.MethodGet, path, nil, &proof); err != nil {
+		return err
+	}
+	if err := logproof.VerifyReceipt(key, head, args[0], proof); err != nil {
+		return fmt.Errorf("receipt %s: %w", args[0], err)
+	}
+	return c.print(map[string]any{"hash": args[0], "verified": true, "leafIndex": proof.LeafIndex, "treeHead": head})
+}
+
+// deadLetterServices are the services keeping dead-lettered webhooks, with
+// the path replaying one
+var deadLetterServices = map[string]string{
+	serviceIssuanceGateway: "/webhooks/dead-letters/%s/retry",
+	serviceConnectorHub:    "/webhooks/dead-letters/%s/redrive",
+}
+
+func webhooksDeadLetters(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("webhooks dead-letters", flag.ContinueOnError)
+	service := fs.String("service", "", "issuance-gateway or connector-hub; both without it")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	services := []string{serviceIssuanceGateway, serviceConnectorHub}
+	if *service != "" {
+		if _, ok := deadLetterServices[*service]; !ok {
+			return fmt.Errorf("%s keeps no dead-lettered webhooks", *service)
+		}
+		services = []string{*service}
+	}
+	listed := map[string]any{}
+	for _, name := range services {
+		if _, err := c.profile.baseURL(name); err != nil && *service == "" {
+			continue // not part of this environment
+		}
+		var letters any
+		if err := c.call(ctx, name, http.MethodGet, "/webhooks/dead-letters", nil, &letters); err != nil {
+			return err
+		}
+		listed[name] = letters
+	}
+	return c.print(listed)
+}
+
+func webhooksReplay(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("webhooks replay", flag.ContinueOnError)
+	service := fs.String("service", "", "issuance-gateway or connector-hub")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	path, ok := deadLetterServices[*service]
+	if !ok {
+		return errors.New("webhooks replay needs --service issuance-gateway or --service connector-hub")
+	}
+	return c.show(ctx, *service, http.MethodPost, fmt.Sprintf(path, url.PathEscape(args[0])), nil)
+}
+
+// Demo data created by seed demo
+const (
+	demoIssuerDID = "did:web:demo.cachet.id"
+	demoPackRef   = "pack.demo.adult@0.1.0"
+	demoPartnerID = "demo.example"
+)
+
+// seedDemo creates demo data in the services the profile names, skipping
+// what already exists so it can be run again
+func seedDemo(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("seed demo", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	seeded := map[string]any{}
+	if _, err := c.profile.baseURL(serviceRegistry); err == nil {
+		issuer := map[string]any{"did": demoIssuerDID, "name": "Cachet demo issuer", "credentialTypes": []string{"IdentityCredential"}}
+		if err := c.seed(ctx, serviceRegistry, "/trust/issuers", issuer, seeded, "trustedIssuer"); err != nil {
+			return err
+		}
+		id, version, _ := strings.Cut(demoPackRef, "@")
+		pack := map[string]any{
+			"id": id, "version": version, "name": "Demo adult check", "jurisdictions": []string{"UK"},
+			"rules": []map[string]string{{"id": "age.ge.18", "expr": "age >= 18"}},
+		}
+		if err := c.seed(ctx, serviceRegistry, "/packs", pack, seeded, "packDraft"); err != nil {
+			return err
+		}
+	}
+	if _, err := c.profile.baseURL(serviceVerifier); err == nil {
+		// Relying parties have no natural key, so each run registers one
+		var rp any
+		if err := c.call(ctx, serviceVerifier, http.MethodPost, "/admin/relying-parties", map[string]string{"name": "Demo shop"}, &rp); err != nil {
+			return err
+		}
+		seeded["relyingParty"] = rp
+	}
+	if _, err := c.profile.baseURL(serviceConnectorHub); err == nil {
+		var listing struct {
+			Connectors []struct {
+				ID string `json:"id"`
+			} `json:"connectors"`
+		}
+		if err := c.call(ctx, serviceConnectorHub, http.MethodGet, "/connectors", nil, &listing); err != nil {
+			return err
+		}
+		if len(listing.Connectors) > 0 {
+			partner := map[string]any{"id": demoPartnerID, "name": "Demo marketplace", "connectors": []string{listing.Connectors[0].ID}}
+			if err := c.seed(ctx, serviceConnectorHub, "/partners", partner, seeded, "partner"); err != nil {
+				return err
+			}
+		}
+	}
+	if len(seeded) == 0 {
+		return errors.New("the profile names none of the registry, verifier and connector hub")
+	}
+	return c.print(seeded)
+}
+
+// seed creates a demo resource, noting it as already there on a conflict
+func (c *cli) seed(ctx context.Context, service, path string, body any, seeded map[string]any, key string) error {
+	var created any
+	err := c.call(ctx, service, http.MethodPost, path, body, &created)
+	switch {
+	case isStatus(err, http.StatusConflict):
+		seeded[key] = "already present"
+	case err != nil:
+		return err
+	default:
+		seeded[key] = created
+	}
+	return nil
+}
+
+func profilesList(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("profiles list", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	for _, name := range c.profiles.names() {
+		marker := " "
+		if name == c.profile.Name {
+			marker = "*"
+		}
+		fmt.Fprintf(c.out, "%s %s\n", marker, name)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Command cachetctl runs operational tasks against the admin APIs of a
+// Cachet deployment: publishing packs, rotating and revoking keys, revoking
+// credentials, inspecting the receipts log, replaying dead-lettered webhooks
+// and seeding demo data.
+//
+// Environments are profiles in a YAML file, cachet/cachetctl.yaml in the
+// user's configuration directory unless --config or CACHETCTL_CONFIG names
+// another:
+//
+//	current: staging
+//	profiles:
+//	  staging:
+//	    registry: https://registry.staging.cachet.id
+//	    verifier: https://verifier.staging.cachet.id
+//	    issuanceGateway: https://issuer.staging.cachet.id
+//	    receiptsLog: https://receipts.staging.cachet.id
+//	    receiptsLogKey: /etc/cachet/receipts-log.pem
+//	    vouching: https://vouch.staging.cachet.id
+//	    connectorHub: https://hub.staging.cachet.id
+//	    tokenEnv: CACHET_STAGING_OPERATOR_TOKEN
+//	  acme-local:
+//	    registry: http://localhost:8082
+//	    tenant: acme
+//	    token: local-operator-token
+//
+// --profile or CACHETCTL_PROFILE selects a profile other than the current
+// one. Answers are printed as indented JSON, for piping to jq.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+// cli runs commands against the services of one profile
+type cli struct {
+	client
+	profiles *configFile
+	out      io.Writer
+}
+
+// show calls a service and prints its answer
+func (c *cli) show(ctx context.Context, service, method, path string, body any) error {
+	var answer any
+	if err := c.call(ctx, service, method, path, body, &answer); err != nil {
+		return err
+	}
+	return c.print(answer)
+}
+
+// print writes v as indented JSON
+func (c *cli) print(v any) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// run parses the global flags, loads the selected profile and runs the
+// command named by the remaining arguments
+func run(ctx context.Context, args []string, out, errOut io.Writer) error {
+	fs := flag.NewFlagSet("cachetctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configPath := fs.String("config", os.Getenv("CACHETCTL_CONFIG"), "profiles file")
+	profileName := fs.String("profile", os.Getenv("CACHETCTL_PROFILE"), "profile to use")
+	if err := fs.Parse(args); err != nil {
+		usage(errOut)
+		return err
+	}
+	if fs.NArg() == 0 || fs.Arg(0) == "help" {
+		usage(out)
+		return nil
+	}
+	cmd, cmdArgs, ok := findCommand(fs.Args())
+	if !ok {
+		usage(errOut)
+		return errors.New("unknown command")
+	}
+
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+	profiles, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	profile, err := profiles.profile(*profileName)
+	if err != nil {
+		return err
+	}
+	c := &cli{
+		client:   client{profile: profile, http: &http.Client{}},
+		profiles: profiles,
+		out:      out,
+	}
+	return cmd.run(ctx, c, cmdArgs)
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "cachetctl:", err)
+		os.Exit(1)
+	}
+}
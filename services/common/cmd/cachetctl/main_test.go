@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorded is a request a fake service received
+type recorded struct {
+	Method, Path, Auth string
+	Body               map[string]any
+}
+
+// fakeService records requests and answers them with handler
+func fakeService(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *[]recorded) {
+	t.Helper()
+	var requests []recorded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := recorded{Method: r.Method, Path: r.URL.RequestURI(), Auth: r.Header.Get("Authorization")}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > 0 {
+			require.NoError(t, json.Unmarshal(body, &req.Body))
+		}
+		requests = append(requests, req)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// writeProfiles writes a profiles file and returns its path
+func writeProfiles(t *testing.T, profiles string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cachetctl.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(profiles), 0o600))
+	return path
+}
+
+// runCLI runs cachetctl, returning what it printed
+func runCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	err := run(context.Background(), args, &out, &errOut)
+	return out.String(), err
+}
+
+func TestRun_PacksLifecycle(t *testing.T) {
+	registry, requests := fakeService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"pack.demo","version":"1.0.0","status":"published"}`))
+	})
+	t.Setenv("CACHET_TEST_TOKEN", "operator-secret")
+	config := writeProfiles(t, `
+current: local
+profiles:
+  local:
+    registry: `+registry.URL+`/
+    tenant: acme
+    tokenEnv: CACHET_TEST_TOKEN
+    token: ignored-when-the-env-is-set
+`)
+	packFile := filepath.Join(t.TempDir(), "pack.yaml")
+	require.NoError(t, os.WriteFile(packFile, []byte("id: pack.demo\nversion: 1.0.0\nrules:\n  - {id: age.ge.18, expr: age >= 18}\n"), 0o600))
+
+	_, err := runCLI(t, "--config", config, "packs", "push", packFile)
+	require.NoError(t, err)
+	_, err = runCLI(t, "--config", config, "packs", "review", "--approve", "pack.demo@1.0.0")
+	require.NoError(t, err)
+	out, err := runCLI(t, "--config", config, "packs", "publish", "pack.demo@1.0.0")
+	require.NoError(t, err)
+	assert.Contains(t, out, `"status": "published"`)
+
+	require.Len(t, *requests, 3)
+	push, review, publish := (*requests)[0], (*requests)[1], (*requests)[2]
+	assert.Equal(t, recorded{Method: http.MethodPost, Path: "/t/acme/packs", Auth: "Bearer operator-secret", Body: map[string]any{
+		"id": "pack.demo", "version": "1.0.0", "rules": []any{map[string]any{"id": "age.ge.18", "expr": "age >= 18"}},
+	}}, push)
+	assert.Equal(t, "/t/acme/packs/pack.demo@1.0.0/review", review.Path)
+	assert.Equal(t, "approve", review.Body["decision"])
+	assert.Equal(t, http.MethodPut, publish.Method)
+	assert.Equal(t, map[string]any{"status": "published"}, publish.Body)
+
+	_, err = runCLI(t, "--config", config, "packs", "review", "pack.demo@1.0.0")
+	assert.ErrorContains(t, err, "one of --approve and --reject")
+	_, err = runCLI(t, "--config", config, "packs", "publish", "pack.demo")
+	assert.ErrorContains(t, err, "must be id@version")
+}
+
+func TestRun_Profiles(t *testing.T) {
+	hub, requests := fakeService(t, func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, http.StatusNotFound, "not_found", "Dead-lettered delivery not found")
+	})
+	config := writeProfiles(t, `
+current: staging
+profiles:
+  staging:
+    registry: https://registry.staging.example
+  local:
+    connectorHub: `+hub.URL+`
+    token: local-token
+`)
+
+	out, err := runCLI(t, "--config", config, "profiles", "list")
+	require.NoError(t, err)
+	assert.Equal(t, "  local\n* staging\n", out)
+
+	_, err = runCLI(t, "--config", config, "secrets", "rotate")
+	assert.ErrorContains(t, err, "profile staging has no connector-hub URL")
+
+	t.Setenv("CACHETCTL_PROFILE", "local")
+	_, err = runCLI(t, "--config", config, "webhooks", "replay", "--service", "connector-hub", "dl-1")
+	assert.EqualError(t, err, "connector-hub answered 404 Not Found (not_found): Dead-lettered delivery not found")
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/webhooks/dead-letters/dl-1/redrive", (*requests)[0].Path)
+	assert.Equal(t, "Bearer local-token", (*requests)[0].Auth)
+
+	_, err = runCLI(t, "--config", config, "--profile", "prod", "log", "sth")
+	assert.ErrorContains(t, err, `unknown profile "prod" (have local, staging)`)
+	_, err = runCLI(t, "--config", filepath.Join(t.TempDir(), "missing.yaml"), "log", "sth")
+	assert.ErrorContains(t, err, "no profiles file")
+	_, err = runCLI(t, "--config", config, "packs", "frobnicate")
+	assert.EqualError(t, err, "unknown command")
+}
+
+func TestRun_SeedDemo(t *testing.T) {
+	registry, registryRequests := fakeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/trust/issuers" {
+			problem.Write(w, r, http.StatusConflict, "conflict", "Issuer already registered")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"pack.demo.adult","status":"draft"}`))
+	})
+	hub, hubRequests := fakeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"connectors":[{"id":"marketplace.generic"}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"demo.example"}`))
+	})
+	config := writeProfiles(t, "profiles:\n  local:\n    registry: "+registry.URL+"\n    connectorHub: "+hub.URL+"\n")
+
+	out, err := runCLI(t, "--config", config, "seed", "demo")
+	require.NoError(t, err)
+	var seeded map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out), &seeded))
+	assert.Equal(t, "already present", seeded["trustedIssuer"])
+	assert.Equal(t, map[string]any{"id": "pack.demo.adult", "status": "draft"}, seeded["packDraft"])
+	assert.NotContains(t, seeded, "relyingParty", "the profile has no verifier")
+	assert.Len(t, *registryRequests, 2)
+	require.Len(t, *hubRequests, 2)
+	assert.Equal(t, []any{"marketplace.generic"}, (*hubRequests)[1].Body["connectors"])
+	assert.True(t, strings.HasPrefix((*hubRequests)[1].Path, "/partners"))
+}
+
+func TestRun_LogVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "receipts-log.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	// A log of two receipt hashes
+	first, second := "urn:sha256:"+strings.Repeat("a", 64), "urn:sha256:"+strings.Repeat("b", 64)
+	root := logproof.NodeHash(logproof.LeafHash([]byte(first)), logproof.LeafHash([]byte(second)))
+	head := logproof.TreeHead{TreeSize: 2, RootHash: hex.EncodeToString(root), Timestamp: "2026-05-04T10:00:00Z"}
+	head.Signature = base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, head.SignedData()))
+	receipts, requests := fakeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/log/sth" {
+			json.NewEncoder(w).Encode(head)
+			return
+		}
+		json.NewEncoder(w).Encode(logproof.InclusionProof{
+			LeafIndex: 1, TreeSize: 2, Hashes: []string{hex.EncodeToString(logproof.LeafHash([]byte(first)))},
+		})
+	})
+	config := writeProfiles(t, "profiles:\n  local:\n    receiptsLog: "+receipts.URL+"\n    receiptsLogKey: "+keyFile+"\n")
+
+	out, err := runCLI(t, "--config", config, "log", "verify", second)
+	require.NoError(t, err)
+	assert.Contains(t, out, `"verified": true`)
+	assert.Equal(t, "/log/proof?hash="+url.QueryEscape(second)+"&treeSize=2", (*requests)[1].Path)
+
+	// The log's proof for the second hash does not prove the first
+	_, err = runCLI(t, "--config", config, "log", "verify", first)
+	assert.ErrorIs(t, err, logproof.ErrInvalidProof)
+
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err = x509.MarshalPKIXPublicKey(otherKey)
+	require.NoError(t, err)
+	otherFile := filepath.Join(t.TempDir(), "other.pem")
+	require.NoError(t, os.WriteFile(otherFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	_, err = runCLI(t, "--config", config, "log", "verify", "--key", otherFile, second)
+	assert.ErrorIs(t, err, logproof.ErrInvalidSignature)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Services a profile may name, as used by --service and in errors
+const (
+	serviceRegistry        = "registry"
+	serviceVerifier        = "verifier"
+	serviceIssuanceGateway = "issuance-gateway"
+	serviceReceiptsLog     = "receipts-log"
+	serviceVouching        = "vouching-service"
+	serviceConnectorHub    = "connector-hub"
+)
+
+// Profile is one environment cachetctl manages: where its services are
+// served and the operator token their admin APIs accept
+type Profile struct {
+	Name            string `yaml:"-"`
+	Registry        string `yaml:"registry"`
+	Verifier        string `yaml:"verifier"`
+	IssuanceGateway string `yaml:"issuanceGateway"`
+	ReceiptsLog     string `yaml:"receiptsLog"`
+	Vouching        string `yaml:"vouching"`
+	ConnectorHub    string `yaml:"connectorHub"`
+	// ReceiptsLogKey is the PEM file of the receipts log's public key, which
+	// log verify checks tree heads against
+	ReceiptsLogKey string `yaml:"receiptsLogKey"`
+	// Tenant, when set, has every call made under its /t/{id} prefix
+	Tenant string `yaml:"tenant"`
+	// TokenEnv names the environment variable holding the operator token;
+	// Token holds it inline, for local environments only
+	TokenEnv string `yaml:"tokenEnv"`
+	Token    string `yaml:"token"`
+}
+
+// configFile is the profiles file, by default cachet/cachetctl.yaml in the
+// user's configuration directory
+type configFile struct {
+	// Current is the profile used without --profile or CACHETCTL_PROFILE
+	Current  string              `yaml:"current"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// defaultConfigPath is where the profiles file is read from without
+// --config or CACHETCTL_CONFIG
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "cachetctl.yaml"
+	}
+	return filepath.Join(dir, "cachet", "cachetctl.yaml")
+}
+
+// loadConfig reads the profiles file
+func loadConfig(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no profiles file at %s; see cachetctl help", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles: %w", err)
+	}
+	var file configFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decoding profiles %s: %w", path, err)
+	}
+	for name, profile := range file.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("profile %q is empty", name)
+		}
+		profile.Name = name
+	}
+	return &file, nil
+}
+
+// profile returns the named profile, or the current one when name is empty
+func (f *configFile) profile(name string) (*Profile, error) {
+	if name == "" {
+		name = f.Current
+	}
+	if name == "" {
+		if len(f.Profiles) != 1 {
+			return nil, errors.New("no profile selected: pass --profile or set current in the profiles file")
+		}
+		for only := range f.Profiles {
+			name = only
+		}
+	}
+	profile, ok := f.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q (have %s)", name, strings.Join(f.names(), ", "))
+	}
+	return profile, nil
+}
+
+// names lists the profiles by name
+func (f *configFile) names() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// baseURL returns where the profile serves a service
+func (p *Profile) baseURL(service string) (string, error) {
+	var url string
+	switch service {
+	case serviceRegistry:
+		url = p.Registry
+	case serviceVerifier:
+		url = p.Verifier
+	case serviceIssuanceGateway:
+		url = p.IssuanceGateway
+	case serviceReceiptsLog:
+		url = p.ReceiptsLog
+	case serviceVouching:
+		url = p.Vouching
+	case serviceConnectorHub:
+		url = p.ConnectorHub
+	default:
+		return "", fmt.Errorf("unknown service %q", service)
+	}
+	if url == "" {
+		return "", fmt.Errorf("profile %s has no %s URL", p.Name, service)
+	}
+	url = strings.TrimSuffix(url, "/")
+	if p.Tenant != "" {
+		url += "/t/" + p.Tenant
+	}
+	return url, nil
+}
+
+// token returns the operator token, preferring the environment
+func (p *Profile) token() string {
+	if p.TokenEnv != "" {
+		if token := os.Getenv(p.TokenEnv); token != "" {
+			return token
+		}
+	}
+	return p.Token
+}
@@ -0,0 +1,265 @@
+// Package apiversion versions the Cachet HTTP APIs, so breaking changes to
+// request and response schemas can roll out without breaking deployed
+// wallets.
+//
+// Services serve their APIs under a /v{n} path prefix, as in /v1/credential.
+// The unversioned paths wallets were first built against remain as aliases
+// of the first version, and are deprecated: their responses carry a
+// Deprecation header (RFC 9745) and a Link to the versioned path as the
+// successor-version, plus a Sunset header (RFC 8594) once the deployment
+// sets API_LEGACY_SUNSET, after which they are refused with 410 Gone. A
+// caller that cannot change the paths it calls names the version in the
+// Cachet-API-Version header instead, as Cachet's own clients do so they
+// work across a rolling deployment. Every versioned response names the
+// version that served it in the same header.
+//
+// The Policy's middleware strips the version prefix, as the tenant
+// directory strips /t/{id}, so routes are declared once; a handler whose
+// schemas change between versions branches on FromContext. Superseded
+// versions are announced as deprecated the way the legacy paths are.
+// Operational endpoints and /.well-known documents are not versioned, nor
+// are the paths a service declares Unversioned, such as webhooks and DID
+// documents, which are fixed by the platforms and specifications calling
+// them or embedded in credentials already issued.
+package apiversion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// Header names the API version, on requests to negotiate it and on
+// responses to report the version served
+const Header = "Cachet-API-Version"
+
+// Problem codes of the requests the policy refuses
+const (
+	CodeUnsupportedVersion = "unsupported_api_version"
+	CodeVersionMismatch    = "api_version_mismatch"
+	CodeLegacySunset       = "legacy_api_sunset"
+)
+
+// Version is a major version of the APIs
+type Version struct {
+	Number int
+	// Deprecated is when a newer version superseded it; zero while current
+	Deprecated time.Time
+}
+
+// Versions are the versions served, oldest first; the last is current
+var Versions = []Version{{Number: 1}}
+
+// LegacyDeprecated is when the unversioned paths were deprecated in favour
+// of /v1
+var LegacyDeprecated = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+
+// unversioned are the path prefixes every service serves as they are,
+// without a version
+var unversioned = []string{"/.well-known/", "/health", "/livez", "/readyz", "/debug/", "/metrics"}
+
+// Config is the versioning configuration services embed in their own
+type Config struct {
+	LegacySunset string `env:"API_LEGACY_SUNSET" doc:"Date, as 2027-06-30, from which the unversioned legacy paths are refused in favour of /v1, announced in Sunset headers until then; they are served indefinitely without it"`
+}
+
+// Validate checks the sunset is a date
+func (c Config) Validate() error {
+	if _, err := c.sunset(); err != nil {
+		return errors.New("API_LEGACY_SUNSET must be a date such as 2027-06-30")
+	}
+	return nil
+}
+
+func (c Config) sunset() (time.Time, error) {
+	if c.LegacySunset == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.DateOnly, c.LegacySunset)
+}
+
+// Policy negotiates the version of each request. The zero Policy serves
+// the legacy paths without a sunset.
+type Policy struct {
+	sunset atomic.Pointer[time.Time]
+	// fixed are the path patterns the service serves unversioned
+	fixed []string
+}
+
+// Set replaces the configuration; services set it once at startup, after
+// validating it
+func (p *Policy) Set(c Config) {
+	sunset, _ := c.sunset()
+	p.sunset.Store(&sunset)
+}
+
+// Unversioned declares path patterns, as for path.Match, the service
+// serves as they are; services declare them before serving
+func (p *Policy) Unversioned(patterns ...string) {
+	p.fixed = append(p.fixed, patterns...)
+}
+
+// Path returns the path of a route under the current version, for links
+// the services hand out
+func Path(route string) string {
+	return Prefix(Versions[len(Versions)-1].Number) + route
+}
+
+// Prefix returns the path prefix of a version
+func Prefix(version int) string {
+	return "/v" + strconv.Itoa(version)
+}
+
+type contextKey struct{}
+
+// FromContext returns the version a request negotiated, the first version
+// for legacy paths and requests that were not negotiated
+func FromContext(ctx context.Context) int {
+	if version, ok := ctx.Value(contextKey{}).(int); ok {
+		return version
+	}
+	return Versions[0].Number
+}
+
+// Middleware resolves each request's version from its path prefix or
+// header, strips the prefix so routes match unversioned, and stamps the
+// version and any deprecation on the response
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.isUnversioned(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requested, err := headerVersion(r)
+		if err != nil {
+			problem.New(http.StatusBadRequest, CodeUnsupportedVersion, err.Error()).With("supported", supported()).Write(w, r)
+			return
+		}
+		number, rest, versioned := cutPrefix(r.URL.Path)
+		switch {
+		case !versioned && requested == nil:
+			if !p.serveLegacy(w, r) {
+				return
+			}
+			number = Versions[0].Number
+		case !versioned:
+			number = requested.Number
+		case find(number) == nil:
+			problem.New(http.StatusNotFound, CodeUnsupportedVersion, fmt.Sprintf("API version %d is not served", number)).With("supported", supported()).Write(w, r)
+			return
+		case requested != nil && requested.Number != number:
+			problem.Write(w, r, http.StatusBadRequest, CodeVersionMismatch, fmt.Sprintf("The path names API version %d but %s names %d", number, Header, requested.Number))
+			return
+		default:
+			r = r.Clone(r.Context())
+			r.URL.Path = rest
+			r.URL.RawPath = ""
+		}
+		version := find(number)
+		w.Header().Set(Header, strconv.Itoa(number))
+		if (versioned || requested != nil) && !version.Deprecated.IsZero() {
+			deprecate(w, r, version.Deprecated, Path(r.URL.Path))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, number)))
+	})
+}
+
+// serveLegacy announces a legacy path's deprecation, or refuses it after
+// its sunset; it reports whether the request may be served
+func (p *Policy) serveLegacy(w http.ResponseWriter, r *http.Request) bool {
+	successor := Path(r.URL.Path)
+	deprecate(w, r, LegacyDeprecated, successor)
+	var sunset time.Time
+	if s := p.sunset.Load(); s != nil {
+		sunset = *s
+	}
+	if sunset.IsZero() {
+		return true
+	}
+	w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	if time.Now().Before(sunset) {
+		return true
+	}
+	problem.New(http.StatusGone, CodeLegacySunset, "Unversioned paths are no longer served; call "+Prefix(Versions[0].Number)+" instead").
+		With("successor", tenant.Prefix(r.Context())+successor).Write(w, r)
+	return false
+}
+
+// deprecate stamps the deprecation headers on a response, linking to the
+// successor path under the request's tenant
+func deprecate(w http.ResponseWriter, r *http.Request, since time.Time, successor string) {
+	w.Header().Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+	w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, tenant.Prefix(r.Context()), successor))
+}
+
+// headerVersion returns the version the request's header names, nil when
+// it names none
+func headerVersion(r *http.Request) (*Version, error) {
+	raw := r.Header.Get(Header)
+	if raw == "" {
+		return nil, nil
+	}
+	number, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(raw), "v"))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a version number such as 1", Header)
+	}
+	version := find(number)
+	if version == nil {
+		return nil, fmt.Errorf("API version %d is not served", number)
+	}
+	return version, nil
+}
+
+// cutPrefix splits a /v{n} prefix from a path
+func cutPrefix(path string) (int, string, bool) {
+	rest, ok := strings.CutPrefix(path, "/v")
+	if !ok {
+		return 0, path, false
+	}
+	digits, rest, _ := strings.Cut(rest, "/")
+	number, err := strconv.Atoi(digits)
+	if err != nil || number <= 0 || digits[0] == '0' {
+		return 0, path, false
+	}
+	return number, "/" + rest, true
+}
+
+func find(number int) *Version {
+	for i := range Versions {
+		if Versions[i].Number == number {
+			return &Versions[i]
+		}
+	}
+	return nil
+}
+
+func supported() []int {
+	numbers := make([]int, len(Versions))
+	for i, version := range Versions {
+		numbers[i] = version.Number
+	}
+	return numbers
+}
+
+func (p *Policy) isUnversioned(urlPath string) bool {
+	for _, prefix := range unversioned {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range p.fixed {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
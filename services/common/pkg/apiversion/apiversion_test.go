@@ -0,0 +1,147 @@
+package apiversion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through the policy, answering with the version and
+// path the handler saw
+func serve(p *Policy, path, header string) *httptest.ResponseRecorder {
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(FromContext(r.Context())) + " " + r.URL.Path))
+	}))
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if header != "" {
+		req.Header.Set(Header, header)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestPolicy_StripsVersionPrefix(t *testing.T) {
+	var p Policy
+	for path, want := range map[string]string{
+		"/v1/credential":         "1 /credential",
+		"/v1/packs/pack.a/x":     "1 /packs/pack.a/x",
+		"/v1":                    "1 /",
+		"/verification-sessions": "1 /verification-sessions",
+	} {
+		w := serve(&p, path, "")
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, want, w.Body.String(), path)
+		assert.Equal(t, "1", w.Header().Get(Header), path)
+	}
+
+	w := serve(&p, "/v1/credential", "")
+	assert.Empty(t, w.Header().Get("Deprecation"), "the current version is not deprecated")
+}
+
+func TestPolicy_DeprecatesLegacyPaths(t *testing.T) {
+	var p Policy
+	w := serve(&p, "/credential", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1 /credential", w.Body.String())
+	assert.Equal(t, "@"+strconv.FormatInt(LegacyDeprecated.Unix(), 10), w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/credential>; rel="successor-version"`, w.Header().Get("Link"))
+	assert.Empty(t, w.Header().Get("Sunset"))
+
+	// Naming the version in the header is not deprecated
+	w = serve(&p, "/credential", "1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Deprecation"))
+	assert.Equal(t, "1", w.Header().Get(Header))
+
+	// Operational, well-known and declared paths are not versioned
+	p.Unversioned("/webhooks/veriff", "/dids/*/did.json")
+	for _, path := range []string{"/health", "/readyz", "/metrics", "/.well-known/did.json", "/webhooks/veriff", "/dids/acme/did.json"} {
+		w = serve(&p, path, "")
+		assert.Empty(t, w.Header().Get("Deprecation"), path)
+		assert.Empty(t, w.Header().Get(Header), path)
+	}
+}
+
+func TestPolicy_Sunset(t *testing.T) {
+	var p Policy
+	p.Set(Config{LegacySunset: time.Now().AddDate(1, 0, 0).Format(time.DateOnly)})
+	w := serve(&p, "/credential", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Sunset"))
+
+	p.Set(Config{LegacySunset: "2020-01-01"})
+	w = serve(&p, "/credential", "")
+	require.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, "Wed, 01 Jan 2020 00:00:00 GMT", w.Header().Get("Sunset"))
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, CodeLegacySunset, body["code"])
+	assert.Equal(t, "/v1/credential", body["successor"])
+
+	assert.Equal(t, http.StatusOK, serve(&p, "/v1/credential", "").Code, "versioned paths outlive the sunset")
+	assert.Equal(t, http.StatusOK, serve(&p, "/credential", "1").Code)
+}
+
+func TestPolicy_RefusesUnknownVersions(t *testing.T) {
+	var p Policy
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		status int
+		code   string
+	}{
+		{"unserved path version", "/v9/credential", "", http.StatusNotFound, CodeUnsupportedVersion},
+		{"unserved header version", "/credential", "9", http.StatusBadRequest, CodeUnsupportedVersion},
+		{"malformed header", "/credential", "latest", http.StatusBadRequest, CodeUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(&p, tt.path, tt.header)
+			require.Equal(t, tt.status, w.Code)
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.code, body["code"])
+		})
+	}
+}
+
+func TestPolicy_DeprecatesSupersededVersions(t *testing.T) {
+	superseded := time.Date(2027, time.March, 1, 0, 0, 0, 0, time.UTC)
+	saved := Versions
+	Versions = []Version{{Number: 1, Deprecated: superseded}, {Number: 2}}
+	t.Cleanup(func() { Versions = saved })
+
+	var p Policy
+	w := serve(&p, "/v1/credential", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "@"+strconv.FormatInt(superseded.Unix(), 10), w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v2/credential>; rel="successor-version"`, w.Header().Get("Link"))
+
+	w = serve(&p, "/v2/credential", "")
+	assert.Equal(t, "2 /credential", w.Body.String())
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	// Legacy paths stay aliases of the first version
+	w = serve(&p, "/credential", "")
+	assert.Equal(t, "1 /credential", w.Body.String())
+	assert.Equal(t, "@"+strconv.FormatInt(LegacyDeprecated.Unix(), 10), w.Header().Get("Deprecation"))
+	assert.Equal(t, []string{`</v2/credential>; rel="successor-version"`}, w.Header().Values("Link"))
+
+	w = serve(&p, "/v1/credential", "2")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), CodeVersionMismatch)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{LegacySunset: "2027-06-30"}.Validate())
+	assert.Error(t, Config{LegacySunset: "next summer"}.Validate())
+}
@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+)
+
+// ReceiptsLog anchors batch hashes in the receipts-log
+type ReceiptsLog struct {
+	client *http.Client
+	url    string
+}
+
+// NewReceiptsLog anchors in the receipts-log at serviceURL, authenticating
+// with auth when it is set
+func NewReceiptsLog(serviceURL string, auth *serviceauth.Authenticator) *ReceiptsLog {
+	client := deadline.NewClient("receipts-log")
+	client.Transport = auth.Transport("receipts-log", client.Transport)
+	return &ReceiptsLog{client: client, url: strings.TrimSuffix(serviceURL, "/")}
+}
+
+// Anchor submits a batch hash
+func (a *ReceiptsLog) Anchor(ctx context.Context, hash string) error {
+	body, err := json.Marshal(map[string]string{"batchHash": hash})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+"/audit/batches", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("receipts-log returned %d", resp.StatusCode)
+	}
+	return nil
+}
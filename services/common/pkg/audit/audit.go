@@ -0,0 +1,318 @@
+// Package audit keeps a tamper-evident trail of the security events of a
+// Cachet service: authentication failures, admin actions, revocations and
+// key rotations.
+//
+// Each Event names the hash of the one before it, so removing or altering
+// an event breaks the chain from there on. The Logger periodically seals the
+// events recorded since the last Batch, hashing them together with the
+// previous batch's hash, and anchors the batch hash in the receipts-log,
+// outside the reach of whoever runs the service. An operator who rewrites
+// the trail, chain and batches alike, is still caught by comparing the
+// batch hashes with those anchored. Verify checks a trail.
+//
+// Recording never fails a request: a store error is logged and the event
+// is lost, which Verify does not notice, so operators alert on the log.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// Types of security events
+const (
+	TypeAuthFailure = "auth.failure"
+	TypeAdminAction = "admin.action"
+	TypeRevocation  = "revocation"
+	TypeKeyRotation = "key.rotation"
+)
+
+// Event is a security event in a service's trail
+type Event struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Type    string    `json:"type"`
+	// Action names what happened, as relying_party.registered
+	Action string `json:"action"`
+	// Actor is who acted, when known; Target what they acted on
+	Actor     string `json:"actor,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Prev is the hash of the previous event, empty for the first
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// digest is the hash of the event's content and its link to the previous
+// event
+func (e Event) digest() string {
+	e.Hash = ""
+	encoded, _ := json.Marshal(e)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// Batch seals the events First to Last of a trail
+type Batch struct {
+	Seq   int64 `json:"seq"`
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+	// Prev is the hash of the previous batch, empty for the first
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash"`
+	SealedAt time.Time `json:"sealedAt"`
+	// AnchoredAt is when the receipts-log accepted the hash; zero until then
+	AnchoredAt time.Time `json:"anchoredAt,omitempty"`
+}
+
+// batchDigest hashes a batch's events onto the previous batch's hash, as
+// the urn:sha256 digests the receipts-log keeps
+func batchDigest(prev string, events []Event) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	for _, event := range events {
+		h.Write([]byte(event.Hash))
+	}
+	return "urn:sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Anchor keeps batch hashes out of the service's reach
+type Anchor interface {
+	Anchor(ctx context.Context, hash string) error
+}
+
+// Config is the security audit configuration services embed in their own
+type Config struct {
+	Path          string        `env:"SECURITY_AUDIT_PATH" doc:"File the security audit trail is appended to when the service has no database; kept in memory without either"`
+	BatchInterval time.Duration `env:"SECURITY_AUDIT_BATCH_INTERVAL" default:"5m" doc:"How often the security events recorded since the last batch are sealed and their hash anchored"`
+	AnchorURL     string        `env:"SECURITY_AUDIT_ANCHOR_URL" doc:"Base URL of the receipts-log batch hashes are anchored in; batches are only sealed when unset"`
+}
+
+// Validate checks the batch interval
+func (c Config) Validate() error {
+	if c.BatchInterval <= 0 {
+		return errors.New("SECURITY_AUDIT_BATCH_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// Open returns the configured logger for service, keeping the trail in db
+// when the service has one, and anchoring batches as service through auth
+// when it is set
+func Open(service string, c Config, auth *serviceauth.Authenticator, db *store.DB) (*Logger, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var trail Store = NewMemory()
+	switch {
+	case db != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		postgres, err := OpenPostgres(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		trail = postgres
+	case c.Path != "":
+		file, err := OpenFile(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		trail = file
+	}
+	var anchor Anchor
+	if c.AnchorURL != "" {
+		anchor = NewReceiptsLog(c.AnchorURL, auth)
+	}
+	l, err := New(service, trail, anchor)
+	if err != nil {
+		return nil, err
+	}
+	l.interval = c.BatchInterval
+	return l, nil
+}
+
+// Logger records a service's security events. A nil Logger records
+// nothing.
+type Logger struct {
+	service  string
+	store    Store
+	anchor   Anchor // nil only seals
+	interval time.Duration
+}
+
+// New returns a logger appending service's events to store and anchoring
+// batches with anchor when it is set. It reads the head of the trail, to
+// check the store answers and to log where the trail resumes.
+func New(service string, store Store, anchor Anchor) (*Logger, error) {
+	last, sealed, err := store.Head(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("reading the security audit trail: %w", err)
+	}
+	if last.Seq > 0 {
+		log.Info().Int64("event", last.Seq).Int64("batch", sealed.Seq).Msg("Resuming the security audit trail")
+	}
+	return &Logger{service: service, store: store, anchor: anchor, interval: 5 * time.Minute}, nil
+}
+
+// Record appends an event to the trail, stamping it with the service,
+// time, and the tenant and request ID of ctx
+func (l *Logger) Record(ctx context.Context, event Event) {
+	if l == nil {
+		return
+	}
+	event.Service = l.service
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Tenant == "" {
+		event.Tenant = tenant.FromContext(ctx).ID
+	}
+	event.RequestID = middleware.GetReqID(ctx)
+
+	// The request may be over, but the event must still be kept
+	if _, err := l.store.Append(context.WithoutCancel(ctx), event); err != nil {
+		log.Error().Err(err).Str("type", event.Type).Str("action", event.Action).Msg("Failed to record security audit event")
+	}
+}
+
+// AuthFailure records a request refused for want of valid credentials,
+// with the realm that refused it
+func (l *Logger) AuthFailure(r *http.Request, realm string) {
+	l.Record(r.Context(), Event{
+		Type:   TypeAuthFailure,
+		Action: r.Method + " " + r.URL.Path,
+		Actor:  r.RemoteAddr,
+		Detail: realm,
+	})
+}
+
+// Seal batches the events recorded since the last batch, returning false
+// when there were none
+func (l *Logger) Seal(ctx context.Context) (Batch, bool, error) {
+	if l == nil {
+		return Batch{}, false, nil
+	}
+	batch, sealed, err := l.store.Seal(ctx, time.Now().UTC())
+	if err != nil {
+		return Batch{}, false, fmt.Errorf("sealing security audit batch: %w", err)
+	}
+	return batch, sealed, nil
+}
+
+// Anchor anchors the batches sealed but not yet anchored, oldest first,
+// returning how many were
+func (l *Logger) Anchor(ctx context.Context) (int, error) {
+	if l == nil || l.anchor == nil {
+		return 0, nil
+	}
+	batches, err := l.store.Batches(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("reading security audit batches: %w", err)
+	}
+	anchored := 0
+	for _, batch := range batches {
+		if !batch.AnchoredAt.IsZero() {
+			continue
+		}
+		if err := l.anchor.Anchor(ctx, batch.Hash); err != nil {
+			return anchored, fmt.Errorf("anchoring security audit batch %d: %w", batch.Seq, err)
+		}
+		if err := l.store.Anchored(ctx, batch.Seq, time.Now().UTC()); err != nil {
+			return anchored, fmt.Errorf("marking security audit batch %d anchored: %w", batch.Seq, err)
+		}
+		anchored++
+	}
+	return anchored, nil
+}
+
+// Run seals and anchors batches at the configured interval, for ever;
+// batches that could not be anchored are retried on the next round
+func (l *Logger) Run() {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.flush()
+	}
+}
+
+func (l *Logger) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	batch, sealed, err := l.Seal(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to seal security audit batch")
+		return
+	}
+	if sealed {
+		log.Info().Int64("batch", batch.Seq).Int64("first", batch.First).Int64("last", batch.Last).Str("hash", batch.Hash).Msg("Security audit batch sealed")
+	}
+	if _, err := l.Anchor(ctx); err != nil {
+		log.Warn().Err(err).Msg("Security audit batches left unanchored")
+	}
+}
+
+// Verify checks the logger's trail is unbroken
+func (l *Logger) Verify(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	events, err := l.store.Events(ctx, 0)
+	if err != nil {
+		return err
+	}
+	batches, err := l.store.Batches(ctx)
+	if err != nil {
+		return err
+	}
+	return Verify(events, batches)
+}
+
+// ErrTampered reports a trail whose events or batches do not hash as
+// recorded
+var ErrTampered = errors.New("security audit trail tampered with")
+
+// Verify checks every event hashes as recorded and links to the one before
+// it, and every batch hashes the events it seals onto the batch before it.
+// Events recorded since the last batch are only checked against the chain.
+func Verify(events []Event, batches []Batch) error {
+	prev := ""
+	for i, event := range events {
+		if event.Seq != int64(i+1) {
+			return fmt.Errorf("%w: event %d is missing", ErrTampered, i+1)
+		}
+		if event.Prev != prev || event.digest() != event.Hash {
+			return fmt.Errorf("%w: event %d does not match its hash", ErrTampered, event.Seq)
+		}
+		prev = event.Hash
+	}
+	prevBatch := Batch{}
+	for _, batch := range batches {
+		if batch.Seq != prevBatch.Seq+1 || batch.First != prevBatch.Last+1 || batch.Last < batch.First || batch.Last > int64(len(events)) {
+			return fmt.Errorf("%w: batch %d does not follow batch %d", ErrTampered, batch.Seq, prevBatch.Seq)
+		}
+		if batch.Prev != prevBatch.Hash || batchDigest(batch.Prev, events[batch.First-1:batch.Last]) != batch.Hash {
+			return fmt.Errorf("%w: batch %d does not match its events", ErrTampered, batch.Seq)
+		}
+		prevBatch = batch
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// anchors records the batch hashes it is given, failing while fail is set
+type anchors struct {
+	hashes []string
+	fail   bool
+}
+
+func (a *anchors) Anchor(ctx context.Context, hash string) error {
+	if a.fail {
+		return errors.New("receipts-log unavailable")
+	}
+	a.hashes = append(a.hashes, hash)
+	return nil
+}
+
+// recordN records n admin actions
+func recordN(l *Logger, n int) {
+	for i := 0; i < n; i++ {
+		l.Record(context.Background(), Event{Type: TypeAdminAction, Action: "relying_party.registered", Actor: "operator"})
+	}
+}
+
+func TestLogger_ChainsEvents(t *testing.T) {
+	store := NewMemory()
+	l, err := New("verifier", store, nil)
+	require.NoError(t, err)
+	ctx := tenant.NewContext(context.Background(), tenant.Tenant{ID: "acme"})
+	l.Record(ctx, Event{Type: TypeKeyRotation, Action: "signing_key.rotated", Target: "key-2"})
+	recordN(l, 2)
+
+	events, err := store.Events(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, "verifier", events[0].Service)
+	assert.Equal(t, "acme", events[0].Tenant)
+	assert.False(t, events[0].Time.IsZero())
+	assert.Empty(t, events[0].Prev)
+	for i, event := range events {
+		assert.Equal(t, int64(i+1), event.Seq)
+		if i > 0 {
+			assert.Equal(t, events[i-1].Hash, event.Prev)
+		}
+	}
+	assert.NoError(t, l.Verify(ctx))
+
+	var nilLogger *Logger
+	nilLogger.Record(ctx, Event{Type: TypeAuthFailure})
+	_, sealed, err := nilLogger.Seal(ctx)
+	assert.NoError(t, err)
+	assert.False(t, sealed)
+}
+
+func TestLogger_SealsAndAnchorsBatches(t *testing.T) {
+	ctx := context.Background()
+	anchor := &anchors{}
+	l, err := New("registry", NewMemory(), anchor)
+	require.NoError(t, err)
+
+	_, sealed, err := l.Seal(ctx)
+	require.NoError(t, err)
+	assert.False(t, sealed, "nothing to seal")
+
+	recordN(l, 3)
+	first, sealed, err := l.Seal(ctx)
+	require.NoError(t, err)
+	require.True(t, sealed)
+	assert.Equal(t, Batch{Seq: 1, First: 1, Last: 3, Hash: first.Hash, SealedAt: first.SealedAt}, first)
+	assert.Regexp(t, `^urn:sha256:[0-9a-f]{64}$`, first.Hash)
+
+	// Batches the receipts-log refuses are anchored on the next round
+	anchor.fail = true
+	_, err = l.Anchor(ctx)
+	assert.Error(t, err)
+	anchor.fail = false
+
+	recordN(l, 1)
+	second, _, err := l.Seal(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, second.Prev)
+	assert.Equal(t, int64(4), second.First)
+
+	anchored, err := l.Anchor(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, anchored)
+	assert.Equal(t, []string{first.Hash, second.Hash}, anchor.hashes)
+	anchored, err = l.Anchor(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, anchored)
+	assert.NoError(t, l.Verify(ctx))
+}
+
+// headOnly fails every read of a store but its head
+type headOnly struct {
+	Store
+}
+
+func (headOnly) Events(ctx context.Context, after int64) ([]Event, error) {
+	return nil, errors.New("the whole trail was read")
+}
+
+func (headOnly) Batches(ctx context.Context) ([]Batch, error) {
+	return nil, errors.New("the whole trail was read")
+}
+
+func TestLogger_ReplicasShareOneChain(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	first, err := New("verifier", store, nil)
+	require.NoError(t, err)
+	recordN(first, 2)
+
+	// A replica starting later reads the head of the trail only, and
+	// extends the chain rather than forking it
+	second, err := New("verifier", headOnly{store}, nil)
+	require.NoError(t, err)
+	recordN(second, 1)
+	recordN(first, 1)
+	batch, sealed, err := second.Seal(ctx)
+	require.NoError(t, err)
+	require.True(t, sealed)
+	assert.Equal(t, int64(4), batch.Last)
+	_, sealed, err = first.Seal(ctx)
+	require.NoError(t, err)
+	assert.False(t, sealed, "the other replica's batch holds every event")
+	assert.NoError(t, first.Verify(ctx))
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	l, err := New("connector-hub", store, nil)
+	require.NoError(t, err)
+	recordN(l, 4)
+	_, _, err = l.Seal(ctx)
+	require.NoError(t, err)
+	recordN(l, 2)
+	events, _ := store.Events(ctx, 0)
+	batches, _ := store.Batches(ctx)
+	require.NoError(t, Verify(events, batches))
+
+	tests := []struct {
+		name   string
+		tamper func(events []Event, batches []Batch) ([]Event, []Batch)
+	}{
+		{"altered event", func(events []Event, batches []Batch) ([]Event, []Batch) {
+			events[1].Actor = "someone else"
+			return events, batches
+		}},
+		{"removed event", func(events []Event, batches []Batch) ([]Event, []Batch) {
+			return append(events[:2], events[3:]...), batches
+		}},
+		{"truncated trail", func(events []Event, batches []Batch) ([]Event, []Batch) {
+			return events[:2], batches
+		}},
+		{"rehashed event", func(events []Event, batches []Batch) ([]Event, []Batch) {
+			// Rewriting the chain from the altered event on still breaks
+			// the sealed batch
+			events[2].Actor = "someone else"
+			for i := 2; i < len(events); i++ {
+				events[i].Prev = events[i-1].Hash
+				events[i].Hash = events[i].digest()
+			}
+			return events, batches
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := append([]Event{}, events...)
+			batches := append([]Batch{}, batches...)
+			assert.ErrorIs(t, Verify(tt.tamper(events, batches)), ErrTampered)
+		})
+	}
+}
+
+func TestFile_ResumesTrail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "security-audit.jsonl")
+	file, err := OpenFile(path)
+	require.NoError(t, err)
+	l, err := New("issuance-gateway", file, &anchors{})
+	require.NoError(t, err)
+	recordN(l, 2)
+	batch, _, err := l.Seal(ctx)
+	require.NoError(t, err)
+	_, err = l.Anchor(ctx)
+	require.NoError(t, err)
+	recordN(l, 1)
+	require.NoError(t, file.Close())
+
+	file, err = OpenFile(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+	l, err = New("issuance-gateway", file, nil)
+	require.NoError(t, err)
+	recordN(l, 1)
+	require.NoError(t, l.Verify(ctx))
+
+	events, _ := file.Events(ctx, 0)
+	require.Len(t, events, 4)
+	batches, _ := file.Batches(ctx)
+	require.Len(t, batches, 1)
+	assert.Equal(t, batch.Hash, batches[0].Hash)
+	assert.False(t, batches[0].AnchoredAt.IsZero())
+	next, _, err := l.Seal(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Seq: 2, First: 3, Last: 4, Prev: batch.Hash, Hash: next.Hash, SealedAt: next.SealedAt}, next)
+}
+
+func TestReceiptsLog_Anchor(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/audit/batches" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Write([]byte(`{"accepted":true}`))
+	}))
+	defer server.Close()
+
+	require.NoError(t, NewReceiptsLog(server.URL+"/", nil).Anchor(context.Background(), "urn:sha256:abc"))
+	assert.Equal(t, map[string]string{"batchHash": "urn:sha256:abc"}, got)
+	assert.Error(t, NewReceiptsLog(server.URL+"/missing", nil).Anchor(context.Background(), "urn:sha256:abc"))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{BatchInterval: 5 * time.Minute}.Validate())
+	assert.Error(t, Config{}.Validate())
+}
@@ -0,0 +1,206 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+)
+
+// postgresSchema creates the trail's tables in the service's schema. They
+// are the audit package's, not the service's, so they are created here
+// rather than by the service's migrations.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS security_audit_events (
+	seq      bigint PRIMARY KEY,
+	hash     text   NOT NULL,
+	document jsonb  NOT NULL
+);
+CREATE TABLE IF NOT EXISTS security_audit_batches (
+	seq         bigint      PRIMARY KEY,
+	document    jsonb       NOT NULL,
+	anchored_at timestamptz
+);`
+
+// Postgres keeps the trail in the service's database, shared by its
+// replicas. Appending and sealing each run in a transaction holding a lock
+// on the trail, so the database hands out every seq once and links each
+// event and batch to the latest one, whichever replica wrote it.
+type Postgres struct {
+	db *sql.DB
+}
+
+// OpenPostgres keeps the trail in db, creating its tables if needed
+func OpenPostgres(ctx context.Context, db *store.DB) (*Postgres, error) {
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		return nil, fmt.Errorf("creating the security audit tables: %w", err)
+	}
+	return &Postgres{db: db.DB}, nil
+}
+
+// locked runs fn in a transaction holding the trail's lock
+func (p *Postgres) locked(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('cachet-security-audit:' || current_schema()))`); err != nil {
+		return fmt.Errorf("locking the security audit trail: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// querier is what Postgres reads the trail through, in a transaction or not
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (p *Postgres) Append(ctx context.Context, event Event) (Event, error) {
+	err := p.locked(ctx, func(tx *sql.Tx) error {
+		last, err := lastEvent(ctx, tx)
+		if err != nil {
+			return err
+		}
+		event = chain(last, event)
+		document, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO security_audit_events (seq, hash, document) VALUES ($1, $2, $3)`, event.Seq, event.Hash, document)
+		return err
+	})
+	if err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+func (p *Postgres) Head(ctx context.Context) (Event, Batch, error) {
+	last, err := lastEvent(ctx, p.db)
+	if err != nil {
+		return Event{}, Batch{}, err
+	}
+	sealed, err := lastBatch(ctx, p.db)
+	if err != nil {
+		return Event{}, Batch{}, err
+	}
+	return last, sealed, nil
+}
+
+func lastEvent(ctx context.Context, q querier) (Event, error) {
+	var document []byte
+	err := q.QueryRowContext(ctx, `SELECT document FROM security_audit_events ORDER BY seq DESC LIMIT 1`).Scan(&document)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Event{}, nil
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	var event Event
+	if err := json.Unmarshal(document, &event); err != nil {
+		return Event{}, fmt.Errorf("decoding security audit event: %w", err)
+	}
+	return event, nil
+}
+
+func lastBatch(ctx context.Context, q querier) (Batch, error) {
+	batches, err := queryBatches(ctx, q, `SELECT document, anchored_at FROM security_audit_batches ORDER BY seq DESC LIMIT 1`)
+	if err != nil || len(batches) == 0 {
+		return Batch{}, err
+	}
+	return batches[0], nil
+}
+
+func (p *Postgres) Events(ctx context.Context, after int64) ([]Event, error) {
+	return queryEvents(ctx, p.db, after)
+}
+
+func queryEvents(ctx context.Context, q querier, after int64) ([]Event, error) {
+	rows, err := q.QueryContext(ctx, `SELECT document FROM security_audit_events WHERE seq > $1 ORDER BY seq`, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		var document []byte
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		var event Event
+		if err := json.Unmarshal(document, &event); err != nil {
+			return nil, fmt.Errorf("decoding security audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (p *Postgres) Seal(ctx context.Context, at time.Time) (Batch, bool, error) {
+	var batch Batch
+	var ok bool
+	err := p.locked(ctx, func(tx *sql.Tx) error {
+		sealed, err := lastBatch(ctx, tx)
+		if err != nil {
+			return err
+		}
+		events, err := queryEvents(ctx, tx, sealed.Last)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		batch, ok = seal(sealed, events, at), true
+		document, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO security_audit_batches (seq, document) VALUES ($1, $2)`, batch.Seq, document)
+		return err
+	})
+	if err != nil {
+		return Batch{}, false, err
+	}
+	return batch, ok, nil
+}
+
+func (p *Postgres) Anchored(ctx context.Context, seq int64, at time.Time) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE security_audit_batches SET anchored_at = $2 WHERE seq = $1`, seq, at)
+	return err
+}
+
+func (p *Postgres) Batches(ctx context.Context) ([]Batch, error) {
+	return queryBatches(ctx, p.db, `SELECT document, anchored_at FROM security_audit_batches ORDER BY seq`)
+}
+
+func queryBatches(ctx context.Context, q querier, query string) ([]Batch, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batches []Batch
+	for rows.Next() {
+		var document []byte
+		var anchoredAt sql.NullTime
+		if err := rows.Scan(&document, &anchoredAt); err != nil {
+			return nil, err
+		}
+		var batch Batch
+		if err := json.Unmarshal(document, &batch); err != nil {
+			return nil, fmt.Errorf("decoding security audit batch: %w", err)
+		}
+		if anchoredAt.Valid {
+			batch.AnchoredAt = anchoredAt.Time
+		}
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
@@ -0,0 +1,257 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Store keeps a service's trail. The store, not the Logger, numbers and
+// links what is appended to it, each as one step, so loggers sharing a
+// store, as the replicas of a service do, extend one chain rather than
+// forking it.
+type Store interface {
+	// Append chains an event onto the latest, numbering, linking and
+	// hashing it, and returns it as recorded
+	Append(ctx context.Context, event Event) (Event, error)
+	// Head returns the latest event and batch, zero when there are none
+	Head(ctx context.Context) (Event, Batch, error)
+	// Events returns the events after seq, oldest first
+	Events(ctx context.Context, after int64) ([]Event, error)
+	// Seal batches the events after the latest batch onto it, returning
+	// false when there are none
+	Seal(ctx context.Context, at time.Time) (Batch, bool, error)
+	// Anchored marks batch seq as anchored at
+	Anchored(ctx context.Context, seq int64, at time.Time) error
+	// Batches returns every batch, oldest first
+	Batches(ctx context.Context) ([]Batch, error)
+}
+
+// chain numbers event after last, and links and hashes it onto it
+func chain(last, event Event) Event {
+	event.Seq = last.Seq + 1
+	event.Prev = last.Hash
+	event.Hash = event.digest()
+	return event
+}
+
+// seal batches events, the ones recorded since the sealed batch, onto it
+func seal(sealed Batch, events []Event, at time.Time) Batch {
+	return Batch{
+		Seq:      sealed.Seq + 1,
+		First:    sealed.Last + 1,
+		Last:     events[len(events)-1].Seq,
+		Prev:     sealed.Hash,
+		Hash:     batchDigest(sealed.Hash, events),
+		SealedAt: at,
+	}
+}
+
+// Memory keeps the trail within the process, for development and tests;
+// the replicas of a service share their trail in Postgres
+type Memory struct {
+	mu      sync.Mutex
+	events  []Event
+	batches []Batch
+}
+
+// NewMemory returns an empty in-process store
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Append(ctx context.Context, event Event) (Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event = chain(m.last(), event)
+	m.events = append(m.events, event)
+	return event, nil
+}
+
+func (m *Memory) Head(ctx context.Context) (Event, Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last(), m.sealed(), nil
+}
+
+// last is the latest event; callers hold the lock
+func (m *Memory) last() Event {
+	if len(m.events) == 0 {
+		return Event{}
+	}
+	return m.events[len(m.events)-1]
+}
+
+// sealed is the latest batch; callers hold the lock
+func (m *Memory) sealed() Batch {
+	if len(m.batches) == 0 {
+		return Batch{}
+	}
+	return m.batches[len(m.batches)-1]
+}
+
+// unsealed is the batch of the events since the latest batch, if any;
+// callers hold the lock
+func (m *Memory) unsealed(at time.Time) (Batch, bool) {
+	sealed := m.sealed()
+	if int64(len(m.events)) == sealed.Last {
+		return Batch{}, false
+	}
+	return seal(sealed, m.events[sealed.Last:], at), true
+}
+
+func (m *Memory) Events(ctx context.Context, after int64) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []Event{}
+	for _, event := range m.events {
+		if event.Seq > after {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *Memory) Seal(ctx context.Context, at time.Time) (Batch, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.unsealed(at)
+	if ok {
+		m.batches = append(m.batches, batch)
+	}
+	return batch, ok, nil
+}
+
+func (m *Memory) Anchored(ctx context.Context, seq int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.anchored(seq, at)
+	return nil
+}
+
+func (m *Memory) anchored(seq int64, at time.Time) {
+	for i := range m.batches {
+		if m.batches[i].Seq == seq {
+			m.batches[i].AnchoredAt = at
+		}
+	}
+}
+
+func (m *Memory) Batches(ctx context.Context) ([]Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Batch{}, m.batches...), nil
+}
+
+// record is a line of a trail file: an event, a batch or a batch's anchoring
+type record struct {
+	Event    *Event          `json:"event,omitempty"`
+	Batch    *Batch          `json:"batch,omitempty"`
+	Anchored *anchoredRecord `json:"anchored,omitempty"`
+}
+
+type anchoredRecord struct {
+	Seq int64     `json:"seq"`
+	At  time.Time `json:"at"`
+}
+
+// File appends the trail to a file as JSON lines, so it survives restarts;
+// it is kept in memory too, so it serves a single instance only
+type File struct {
+	Memory
+	file *os.File
+}
+
+// OpenFile loads an existing trail file and appends to it
+func OpenFile(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening security audit trail: %w", err)
+	}
+
+	store := &File{file: file}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading security audit trail: %w", err)
+		}
+		switch {
+		case rec.Event != nil:
+			store.events = append(store.events, *rec.Event)
+		case rec.Batch != nil:
+			store.batches = append(store.batches, *rec.Batch)
+		case rec.Anchored != nil:
+			store.anchored(rec.Anchored.Seq, rec.Anchored.At)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading security audit trail: %w", err)
+	}
+	return store, nil
+}
+
+// write appends a record to the file; callers hold the lock
+func (f *File) write(ctx context.Context, rec record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing security audit trail: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("syncing security audit trail: %w", err)
+	}
+	return nil
+}
+
+func (f *File) Append(ctx context.Context, event Event) (Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event = chain(f.last(), event)
+	if err := f.write(ctx, record{Event: &event}); err != nil {
+		return Event{}, err
+	}
+	f.events = append(f.events, event)
+	return event, nil
+}
+
+func (f *File) Seal(ctx context.Context, at time.Time) (Batch, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	batch, ok := f.unsealed(at)
+	if !ok {
+		return Batch{}, false, nil
+	}
+	if err := f.write(ctx, record{Batch: &batch}); err != nil {
+		return Batch{}, false, err
+	}
+	f.batches = append(f.batches, batch)
+	return batch, true, nil
+}
+
+func (f *File) Anchored(ctx context.Context, seq int64, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.write(ctx, record{Anchored: &anchoredRecord{Seq: seq, At: at}}); err != nil {
+		return err
+	}
+	f.anchored(seq, at)
+	return nil
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,527 @@
+// Package bbs implements BBS signatures over BLS12-381 (the
+// BLS12-381-SHA-256 ciphersuite of draft-irtf-cfrg-bbs-signatures): an issuer
+// signs a list of messages once, and the holder derives from the signature
+// as many proofs as they like, each disclosing any subset of the messages.
+// Proofs are zero-knowledge and unlinkable: two proofs of one signature
+// cannot be told apart from proofs of two signatures.
+package bbs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+	"github.com/cloudflare/circl/expander"
+)
+
+// apiID separates the hashes of this ciphersuite's signature API
+const apiID = "BBS_BLS12381G1_XMD:SHA-256_SSWU_RO_H2G_HM2S_"
+
+// Encoded sizes
+const (
+	scalarSize    = bls12381.ScalarSize
+	pointG1Size   = bls12381.G1SizeCompressed
+	PublicKeySize = bls12381.G2SizeCompressed
+	SignatureSize = pointG1Size + scalarSize
+	// proofBaseSize is a proof disclosing every message
+	proofBaseSize = 3*pointG1Size + 4*scalarSize
+)
+
+// Errors returned on malformed input and failed verification
+var (
+	ErrInvalidSignature = errors.New("bbs: invalid signature")
+	ErrInvalidProof     = errors.New("bbs: invalid proof")
+	ErrInvalidKey       = errors.New("bbs: invalid key")
+)
+
+// PrivateKey is an issuer's BBS signing key
+type PrivateKey struct {
+	sk     bls12381.Scalar
+	public PublicKey
+}
+
+// PublicKey verifies the signatures, and the proofs derived from them, of
+// the matching private key
+type PublicKey struct {
+	w bls12381.G2
+}
+
+// GenerateKey draws a signing key from rand, crypto/rand when nil
+func GenerateKey(random io.Reader) (*PrivateKey, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	key := &PrivateKey{}
+	for key.sk.IsZero() == 1 {
+		if err := key.sk.Random(random); err != nil {
+			return nil, err
+		}
+	}
+	key.public.w.ScalarMult(&key.sk, bls12381.G2Generator())
+	return key, nil
+}
+
+// KeyGen derives a signing key from at least 32 bytes of secret key
+// material, bound to keyInfo, as the draft's KeyGen does with its default
+// key_dst
+func KeyGen(keyMaterial, keyInfo []byte) (*PrivateKey, error) {
+	if len(keyMaterial) < 32 || len(keyInfo) > 65535 {
+		return nil, ErrInvalidKey
+	}
+	var input bytes.Buffer
+	input.Write(keyMaterial)
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(keyInfo)))
+	input.Write(length[:])
+	input.Write(keyInfo)
+	key := &PrivateKey{}
+	hashToScalar(&key.sk, input.Bytes(), []byte(apiID+"KEYGEN_DST_"))
+	if key.sk.IsZero() == 1 {
+		return nil, ErrInvalidKey
+	}
+	key.public.w.ScalarMult(&key.sk, bls12381.G2Generator())
+	return key, nil
+}
+
+// ParsePrivateKey decodes a key encoded by Bytes
+func ParsePrivateKey(data []byte) (*PrivateKey, error) {
+	key := &PrivateKey{}
+	if len(data) != scalarSize || key.sk.UnmarshalBinary(data) != nil || key.sk.IsZero() == 1 {
+		return nil, ErrInvalidKey
+	}
+	key.public.w.ScalarMult(&key.sk, bls12381.G2Generator())
+	return key, nil
+}
+
+// Bytes encodes the secret scalar, big-endian
+func (k *PrivateKey) Bytes() []byte {
+	b, _ := k.sk.MarshalBinary()
+	return b
+}
+
+// Public returns the key's public key
+func (k *PrivateKey) Public() *PublicKey {
+	public := k.public
+	return &public
+}
+
+// ParsePublicKey decodes a compressed G2 point
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	key := &PublicKey{}
+	if err := key.w.SetBytes(data); err != nil || !key.w.IsOnG2() || key.w.IsIdentity() {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// Bytes encodes the key as a compressed G2 point
+func (k *PublicKey) Bytes() []byte {
+	return k.w.BytesCompressed()
+}
+
+// Equal reports whether two public keys are the same
+func (k *PublicKey) Equal(other crypto.PublicKey) bool {
+	o, ok := other.(*PublicKey)
+	return ok && k.w.IsEqual(&o.w)
+}
+
+// Sign signs messages, bound to header, which every proof derived from the
+// signature discloses
+func Sign(key *PrivateKey, header []byte, messages [][]byte) ([]byte, error) {
+	gens := generators(len(messages) + 1)
+	scalars := messageScalars(messages)
+	domain := calculateDomain(&key.public, gens[0], gens[1:], header)
+
+	var e bls12381.Scalar
+	hashToScalar(&e, serialize(&key.sk, scalars, &domain), nil)
+	b := commitment(gens, &domain, scalars, nil)
+
+	// A = B * 1/(SK + e)
+	var exponent bls12381.Scalar
+	exponent.Add(&key.sk, &e)
+	if exponent.IsZero() == 1 {
+		return nil, errors.New("bbs: degenerate signature")
+	}
+	exponent.Inv(&exponent)
+	var a bls12381.G1
+	a.ScalarMult(&exponent, b)
+	if a.IsIdentity() {
+		return nil, errors.New("bbs: degenerate signature")
+	}
+	eBytes, _ := e.MarshalBinary()
+	return append(a.BytesCompressed(), eBytes...), nil
+}
+
+// Verify checks a signature over messages and header
+func Verify(key *PublicKey, signature, header []byte, messages [][]byte) error {
+	a, e, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+	gens := generators(len(messages) + 1)
+	domain := calculateDomain(key, gens[0], gens[1:], header)
+	b := commitment(gens, &domain, messageScalars(messages), nil)
+
+	// e(A, W + BP2 * e) * e(B, -BP2) == 1
+	var we bls12381.G2
+	we.ScalarMult(e, bls12381.G2Generator())
+	we.Add(&we, &key.w)
+	if !bls12381.ProdPairFrac([]*bls12381.G1{a, b}, []*bls12381.G2{&we, bls12381.G2Generator()}, []int{1, -1}).IsIdentity() {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ProofGen derives from a signature over messages a proof disclosing only
+// the messages at the disclosed indexes. presentationHeader binds the proof
+// to its use, e.g. a verifier's nonce, and must be presented with it.
+func ProofGen(key *PublicKey, signature, header, presentationHeader []byte, messages [][]byte, disclosed []int) ([]byte, error) {
+	return proofGen(key, signature, header, presentationHeader, messages, disclosed, randomScalars)
+}
+
+// randomScalars draws count non-zero scalars from crypto/rand
+func randomScalars(count int) ([]bls12381.Scalar, error) {
+	random := make([]bls12381.Scalar, count)
+	for i := range random {
+		for random[i].IsZero() == 1 {
+			if err := random[i].Random(rand.Reader); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return random, nil
+}
+
+// proofGen is ProofGen with the source of its random scalars, which the
+// draft's test vectors replace with a seeded one
+func proofGen(key *PublicKey, signature, header, presentationHeader []byte, messages [][]byte, disclosed []int, scalarsOf func(count int) ([]bls12381.Scalar, error)) ([]byte, error) {
+	a, e, err := decodeSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	disclosed, err = normalizeIndexes(disclosed, len(messages))
+	if err != nil {
+		return nil, err
+	}
+	undisclosed := complement(disclosed, len(messages))
+	gens := generators(len(messages) + 1)
+	scalars := messageScalars(messages)
+	domain := calculateDomain(key, gens[0], gens[1:], header)
+
+	// r1, r2, e~, r1~, r3~ and one m~ per undisclosed message
+	random, err := scalarsOf(5 + len(undisclosed))
+	if err != nil {
+		return nil, err
+	}
+	r1, r2, eTilde, r1Tilde, r3Tilde, mTilde := &random[0], &random[1], &random[2], &random[3], &random[4], random[5:]
+
+	b := commitment(gens, &domain, scalars, nil)
+	var d, aBar, bBar, t1, t2, tmp bls12381.G1
+	d.ScalarMult(r2, b)
+	var r1r2 bls12381.Scalar
+	r1r2.Mul(r1, r2)
+	aBar.ScalarMult(&r1r2, a)
+	// Bbar = D * r1 - Abar * e
+	bBar.ScalarMult(r1, &d)
+	tmp.ScalarMult(e, &aBar)
+	tmp.Neg()
+	bBar.Add(&bBar, &tmp)
+	// T1 = Abar * e~ + D * r1~
+	t1.ScalarMult(eTilde, &aBar)
+	tmp.ScalarMult(r1Tilde, &d)
+	t1.Add(&t1, &tmp)
+	// T2 = D * r3~ + sum of H_j * m~_j over the undisclosed messages
+	t2.ScalarMult(r3Tilde, &d)
+	for i, j := range undisclosed {
+		tmp.ScalarMult(&mTilde[i], gens[1+j])
+		t2.Add(&t2, &tmp)
+	}
+
+	c := challenge(&aBar, &bBar, &d, &t1, &t2, disclosed, scalars, &domain, presentationHeader)
+
+	// e^ = e~ + e * c, r1^ = r1~ - r1 * c, r3^ = r3~ - c / r2, m^_j = m~_j + m_j * c
+	var eHat, r1Hat, r3Hat, r3 bls12381.Scalar
+	eHat.Mul(e, &c)
+	eHat.Add(&eHat, eTilde)
+	r1Hat.Mul(r1, &c)
+	r1Hat.Sub(r1Tilde, &r1Hat)
+	r3.Inv(r2)
+	r3Hat.Mul(&r3, &c)
+	r3Hat.Sub(r3Tilde, &r3Hat)
+
+	var proof bytes.Buffer
+	for _, point := range []*bls12381.G1{&aBar, &bBar, &d} {
+		proof.Write(point.BytesCompressed())
+	}
+	for _, s := range []*bls12381.Scalar{&eHat, &r1Hat, &r3Hat} {
+		writeScalar(&proof, s)
+	}
+	for i, j := range undisclosed {
+		var mHat bls12381.Scalar
+		mHat.Mul(&scalars[j], &c)
+		mHat.Add(&mHat, &mTilde[i])
+		writeScalar(&proof, &mHat)
+	}
+	writeScalar(&proof, &c)
+	return proof.Bytes(), nil
+}
+
+// ProofVerify checks a proof disclosing the given messages, keyed by their
+// index among the signed ones, of a signature bound to header. It returns
+// how many messages were signed.
+func ProofVerify(key *PublicKey, proof, header, presentationHeader []byte, disclosed map[int][]byte) (int, error) {
+	if len(proof) < proofBaseSize || (len(proof)-proofBaseSize)%scalarSize != 0 {
+		return 0, ErrInvalidProof
+	}
+	count := len(disclosed) + (len(proof)-proofBaseSize)/scalarSize
+	indexes := make([]int, 0, len(disclosed))
+	for i := range disclosed {
+		indexes = append(indexes, i)
+	}
+	indexes, err := normalizeIndexes(indexes, count)
+	if err != nil || len(indexes) != len(disclosed) {
+		return 0, ErrInvalidProof
+	}
+	undisclosed := complement(indexes, count)
+
+	points := make([]bls12381.G1, 3)
+	for i := range points {
+		if err := points[i].SetBytes(proof[i*pointG1Size : (i+1)*pointG1Size]); err != nil || !points[i].IsOnG1() {
+			return 0, ErrInvalidProof
+		}
+	}
+	aBar, bBar, d := &points[0], &points[1], &points[2]
+	if aBar.IsIdentity() || d.IsIdentity() {
+		return 0, ErrInvalidProof
+	}
+	rest := proof[3*pointG1Size:]
+	scalars := make([]bls12381.Scalar, len(rest)/scalarSize)
+	for i := range scalars {
+		if err := scalars[i].UnmarshalBinary(rest[i*scalarSize : (i+1)*scalarSize]); err != nil {
+			return 0, ErrInvalidProof
+		}
+	}
+	eHat, r1Hat, r3Hat, mHat, c := &scalars[0], &scalars[1], &scalars[2], scalars[3:len(scalars)-1], &scalars[len(scalars)-1]
+
+	gens := generators(count + 1)
+	messages := make([]bls12381.Scalar, count)
+	for i, message := range disclosed {
+		hashToScalar(&messages[i], message, []byte(apiID+"MAP_MSG_TO_SCALAR_AS_HASH_"))
+	}
+	domain := calculateDomain(key, gens[0], gens[1:], header)
+
+	// T1 = Bbar * c + Abar * e^ + D * r1^
+	var t1, t2, tmp bls12381.G1
+	t1.ScalarMult(c, bBar)
+	tmp.ScalarMult(eHat, aBar)
+	t1.Add(&t1, &tmp)
+	tmp.ScalarMult(r1Hat, d)
+	t1.Add(&t1, &tmp)
+	// T2 = Bv * c + D * r3^ + sum of H_j * m^_j over the undisclosed messages,
+	// Bv committing to the disclosed messages only
+	bv := commitment(gens, &domain, messages, indexes)
+	t2.ScalarMult(c, bv)
+	tmp.ScalarMult(r3Hat, d)
+	t2.Add(&t2, &tmp)
+	for i, j := range undisclosed {
+		tmp.ScalarMult(&mHat[i], gens[1+j])
+		t2.Add(&t2, &tmp)
+	}
+
+	expected := challenge(aBar, bBar, d, &t1, &t2, indexes, messages, &domain, presentationHeader)
+	if expected.IsEqual(c) != 1 {
+		return 0, ErrInvalidProof
+	}
+	// e(Abar, W) * e(Bbar, -BP2) == 1
+	if !bls12381.ProdPairFrac([]*bls12381.G1{aBar, bBar}, []*bls12381.G2{&key.w, bls12381.G2Generator()}, []int{1, -1}).IsIdentity() {
+		return 0, ErrInvalidProof
+	}
+	return count, nil
+}
+
+func decodeSignature(signature []byte) (*bls12381.G1, *bls12381.Scalar, error) {
+	if len(signature) != SignatureSize {
+		return nil, nil, ErrInvalidSignature
+	}
+	a := &bls12381.G1{}
+	if err := a.SetBytes(signature[:pointG1Size]); err != nil || !a.IsOnG1() || a.IsIdentity() {
+		return nil, nil, ErrInvalidSignature
+	}
+	e := &bls12381.Scalar{}
+	if err := e.UnmarshalBinary(signature[pointG1Size:]); err != nil || e.IsZero() == 1 {
+		return nil, nil, ErrInvalidSignature
+	}
+	return a, e, nil
+}
+
+// normalizeIndexes sorts message indexes, refusing duplicates and indexes
+// out of range
+func normalizeIndexes(indexes []int, count int) ([]int, error) {
+	sorted := append([]int(nil), indexes...)
+	sort.Ints(sorted)
+	for i, index := range sorted {
+		if index < 0 || index >= count || (i > 0 && sorted[i-1] == index) {
+			return nil, fmt.Errorf("bbs: invalid message index %d", index)
+		}
+	}
+	return sorted, nil
+}
+
+// complement lists the indexes below count not in the sorted indexes
+func complement(indexes []int, count int) []int {
+	rest := make([]int, 0, count-len(indexes))
+	for i, next := 0, 0; i < count; i++ {
+		if next < len(indexes) && indexes[next] == i {
+			next++
+			continue
+		}
+		rest = append(rest, i)
+	}
+	return rest
+}
+
+// commitment is P1 + Q1 * domain + sum of H_i * m_i, over every message or
+// only the listed ones
+func commitment(gens []*bls12381.G1, domain *bls12381.Scalar, messages []bls12381.Scalar, only []int) *bls12381.G1 {
+	b := &bls12381.G1{}
+	var tmp bls12381.G1
+	*b = *basePoint()
+	tmp.ScalarMult(domain, gens[0])
+	b.Add(b, &tmp)
+	add := func(i int) {
+		tmp.ScalarMult(&messages[i], gens[1+i])
+		b.Add(b, &tmp)
+	}
+	if only == nil {
+		for i := range messages {
+			add(i)
+		}
+	} else {
+		for _, i := range only {
+			add(i)
+		}
+	}
+	return b
+}
+
+func messageScalars(messages [][]byte) []bls12381.Scalar {
+	scalars := make([]bls12381.Scalar, len(messages))
+	for i, message := range messages {
+		hashToScalar(&scalars[i], message, []byte(apiID+"MAP_MSG_TO_SCALAR_AS_HASH_"))
+	}
+	return scalars
+}
+
+// calculateDomain binds a signature to the public key, generators and header
+func calculateDomain(key *PublicKey, q1 *bls12381.G1, h []*bls12381.G1, header []byte) bls12381.Scalar {
+	var input bytes.Buffer
+	input.Write(key.Bytes())
+	writeUint64(&input, uint64(len(h)))
+	input.Write(q1.BytesCompressed())
+	for _, point := range h {
+		input.Write(point.BytesCompressed())
+	}
+	input.WriteString(apiID)
+	writeUint64(&input, uint64(len(header)))
+	input.Write(header)
+	var domain bls12381.Scalar
+	hashToScalar(&domain, input.Bytes(), nil)
+	return domain
+}
+
+// challenge is the Fiat-Shamir challenge of a proof
+func challenge(aBar, bBar, d, t1, t2 *bls12381.G1, disclosed []int, messages []bls12381.Scalar, domain *bls12381.Scalar, presentationHeader []byte) bls12381.Scalar {
+	var input bytes.Buffer
+	writeUint64(&input, uint64(len(disclosed)))
+	for _, i := range disclosed {
+		writeUint64(&input, uint64(i))
+		writeScalar(&input, &messages[i])
+	}
+	for _, point := range []*bls12381.G1{aBar, bBar, d, t1, t2} {
+		input.Write(point.BytesCompressed())
+	}
+	writeScalar(&input, domain)
+	writeUint64(&input, uint64(len(presentationHeader)))
+	input.Write(presentationHeader)
+	var c bls12381.Scalar
+	hashToScalar(&c, input.Bytes(), nil)
+	return c
+}
+
+// serialize encodes the secret key, messages and domain a signature's e is
+// derived from
+func serialize(sk *bls12381.Scalar, messages []bls12381.Scalar, domain *bls12381.Scalar) []byte {
+	var out bytes.Buffer
+	writeScalar(&out, sk)
+	for i := range messages {
+		writeScalar(&out, &messages[i])
+	}
+	writeScalar(&out, domain)
+	return out.Bytes()
+}
+
+// hashToScalar maps bytes to a scalar with expand_message_xmd, under the
+// ciphersuite's default tag when dst is nil
+func hashToScalar(out *bls12381.Scalar, message, dst []byte) {
+	if dst == nil {
+		dst = []byte(apiID + "H2S_")
+	}
+	out.SetBytes(expander.NewExpanderMD(crypto.SHA256, dst).Expand(message, 48))
+}
+
+var (
+	generatorsMu    sync.Mutex
+	generatorsCache []*bls12381.G1
+	basePointOnce   sync.Once
+	basePointValue  bls12381.G1
+)
+
+// generators returns the first count message generators, Q1 then H_1...
+func generators(count int) []*bls12381.G1 {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+	if len(generatorsCache) < count {
+		generatorsCache = createGenerators(count, "MESSAGE_GENERATOR_SEED")
+	}
+	return generatorsCache[:count]
+}
+
+// basePoint is P1, the generator every commitment starts from
+func basePoint() *bls12381.G1 {
+	basePointOnce.Do(func() { basePointValue = *createGenerators(1, "BP_MESSAGE_GENERATOR_SEED")[0] })
+	return &basePointValue
+}
+
+func createGenerators(count int, seed string) []*bls12381.G1 {
+	seedDST := []byte(apiID + "SIG_GENERATOR_SEED_")
+	generatorDST := []byte(apiID + "SIG_GENERATOR_DST_")
+	xmd := expander.NewExpanderMD(crypto.SHA256, seedDST)
+	v := xmd.Expand([]byte(apiID+seed), 48)
+	points := make([]*bls12381.G1, count)
+	for i := range points {
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], uint64(i+1))
+		v = xmd.Expand(append(v, counter[:]...), 48)
+		points[i] = &bls12381.G1{}
+		points[i].Hash(v, generatorDST)
+	}
+	return points
+}
+
+func writeScalar(w *bytes.Buffer, s *bls12381.Scalar) {
+	b, _ := s.MarshalBinary()
+	w.Write(b)
+}
+
+func writeUint64(w *bytes.Buffer, n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	w.Write(b[:])
+}
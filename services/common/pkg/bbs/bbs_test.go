@@ -0,0 +1,152 @@
+package bbs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMessages() [][]byte {
+	return [][]byte{[]byte("given_name Ada"), []byte("age 36"), []byte("age_over_18 true"), []byte("age_over_21 true")}
+}
+
+func TestSignVerify(t *testing.T) {
+	key, err := GenerateKey(nil)
+	require.NoError(t, err)
+	signature, err := Sign(key, []byte("header"), testMessages())
+	require.NoError(t, err)
+	assert.Len(t, signature, SignatureSize)
+	assert.NoError(t, Verify(key.Public(), signature, []byte("header"), testMessages()))
+
+	tampered := testMessages()
+	tampered[1] = []byte("age 17")
+	assert.ErrorIs(t, Verify(key.Public(), signature, []byte("header"), tampered), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(key.Public(), signature, []byte("other"), testMessages()), ErrInvalidSignature)
+	other, err := GenerateKey(nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, Verify(other.Public(), signature, []byte("header"), testMessages()), ErrInvalidSignature)
+}
+
+func TestProof_DisclosesOnlyChosenMessages(t *testing.T) {
+	key, err := GenerateKey(nil)
+	require.NoError(t, err)
+	messages := testMessages()
+	signature, err := Sign(key, []byte("header"), messages)
+	require.NoError(t, err)
+
+	proof, err := ProofGen(key.Public(), signature, []byte("header"), []byte("nonce-1"), messages, []int{2})
+	require.NoError(t, err)
+	count, err := ProofVerify(key.Public(), proof, []byte("header"), []byte("nonce-1"), map[int][]byte{2: messages[2]})
+	require.NoError(t, err)
+	assert.Equal(t, len(messages), count)
+
+	// Another presentation of the same signature shares nothing with it
+	again, err := ProofGen(key.Public(), signature, []byte("header"), []byte("nonce-1"), messages, []int{2})
+	require.NoError(t, err)
+	assert.NotEqual(t, proof[:SignatureSize], again[:SignatureSize])
+
+	tests := []struct {
+		name      string
+		ph        string
+		disclosed map[int][]byte
+	}{
+		{"other nonce", "nonce-2", map[int][]byte{2: messages[2]}},
+		{"changed message", "nonce-1", map[int][]byte{2: []byte("age_over_18 false")}},
+		{"moved message", "nonce-1", map[int][]byte{3: messages[2]}},
+		{"undisclosed message claimed", "nonce-1", map[int][]byte{1: messages[1], 2: messages[2]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ProofVerify(key.Public(), proof, []byte("header"), []byte(tt.ph), tt.disclosed)
+			assert.ErrorIs(t, err, ErrInvalidProof)
+		})
+	}
+
+	_, err = ProofGen(key.Public(), signature, []byte("header"), nil, messages, []int{4})
+	assert.Error(t, err)
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key, err := GenerateKey(nil)
+	require.NoError(t, err)
+	parsed, err := ParsePrivateKey(key.Bytes())
+	require.NoError(t, err)
+	assert.True(t, parsed.Public().Equal(key.Public()))
+	public, err := ParsePublicKey(key.Public().Bytes())
+	require.NoError(t, err)
+	assert.True(t, public.Equal(key.Public()))
+	_, err = ParsePublicKey(make([]byte, PublicKeySize))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestKeyGen(t *testing.T) {
+	material := []byte("this-IS-just-an-Test-IKM-to-generate-$e(r@T#-key")
+	key, err := KeyGen(material, []byte("key-info"))
+	require.NoError(t, err)
+	again, err := KeyGen(material, []byte("key-info"))
+	require.NoError(t, err)
+	assert.Equal(t, key.Bytes(), again.Bytes())
+	other, err := KeyGen(material, []byte("other-info"))
+	require.NoError(t, err)
+	assert.NotEqual(t, key.Bytes(), other.Bytes(), "key_info separates the keys of one material")
+
+	_, err = KeyGen(material[:31], nil)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestProofGen_DeterministicUnderSeededScalars(t *testing.T) {
+	key, err := KeyGen([]byte("this-IS-just-an-Test-IKM-to-generate-$e(r@T#-key"), nil)
+	require.NoError(t, err)
+	messages := testMessages()
+	signature, err := Sign(key, []byte("header"), messages)
+	require.NoError(t, err)
+	again, err := Sign(key, []byte("header"), messages)
+	require.NoError(t, err)
+	assert.Equal(t, signature, again, "signing is deterministic")
+
+	seeded := seededRandomScalars([]byte("seed"), []byte(apiID+"MOCK_RANDOM_SCALARS_DST_"))
+	proof, err := proofGen(key.Public(), signature, []byte("header"), []byte("nonce"), messages, []int{0, 2}, seeded)
+	require.NoError(t, err)
+	same, err := proofGen(key.Public(), signature, []byte("header"), []byte("nonce"), messages, []int{0, 2}, seeded)
+	require.NoError(t, err)
+	assert.Equal(t, proof, same)
+	_, err = ProofVerify(key.Public(), proof, []byte("header"), []byte("nonce"), map[int][]byte{0: messages[0], 2: messages[2]})
+	assert.NoError(t, err)
+}
+
+func TestDeriveCredential(t *testing.T) {
+	key, err := GenerateKey(nil)
+	require.NoError(t, err)
+	credential := map[string]interface{}{
+		"@context": []string{"https://www.w3.org/2018/credentials/v1"},
+		"id":       "urn:uuid:1",
+		"type":     []string{"VerifiableCredential", "AgeOverCredential"},
+		"issuer":   "did:web:cachet.id",
+		"credentialSubject": map[string]interface{}{
+			"id":          "did:example:holder",
+			"age_over_18": true,
+			"age_over_21": false,
+		},
+	}
+	proof, err := SignCredential(key, credential, Proof{VerificationMethod: "did:web:cachet.id#bbs", Created: "2026-05-04T00:00:00Z"})
+	require.NoError(t, err)
+	credential["proof"] = proof
+	require.NoError(t, VerifySignedCredential(key.Public(), credential))
+
+	derived, err := DeriveCredential(key.Public(), credential, []string{"/issuer", "/type", "/credentialSubject/age_over_18"}, []byte("nonce"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"age_over_18": true}, derived["credentialSubject"])
+	assert.NotContains(t, derived, "id")
+	require.NoError(t, VerifyDerivedCredential(key.Public(), derived, []byte("nonce")))
+	assert.ErrorIs(t, VerifyDerivedCredential(key.Public(), derived, []byte("replayed")), ErrInvalidProof)
+
+	// Claims cannot be changed, nor added, after the fact
+	derived["credentialSubject"] = map[string]interface{}{"age_over_18": true, "age_over_21": true}
+	assert.Error(t, VerifyDerivedCredential(key.Public(), derived, []byte("nonce")))
+	derived["credentialSubject"] = map[string]interface{}{"age_over_21": true}
+	assert.ErrorIs(t, VerifyDerivedCredential(key.Public(), derived, []byte("nonce")), ErrInvalidProof)
+
+	_, err = DeriveCredential(key.Public(), credential, []string{"/credentialSubject/birthdate"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,265 @@
+package bbs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Data integrity proofs of BBS-signed credentials (ldp_vc). A credential is
+// signed as a list of statements, one per top-level property and one per
+// claim of its credentialSubject, so the holder discloses any of them.
+// Statements are JSON pointers to canonical JSON values, sorted by pointer.
+const (
+	ProofType = "DataIntegrityProof"
+	// Cryptosuite signs JSON statements rather than the RDF of bbs-2023
+	Cryptosuite  = "cachet-bbs-2024"
+	ProofPurpose = "assertionMethod"
+)
+
+// subjectProperty holds the claims signed one by one
+const subjectProperty = "credentialSubject"
+
+// Proof is the proof property of a BBS-signed or derived credential
+type Proof struct {
+	Type               string `json:"type"`
+	Cryptosuite        string `json:"cryptosuite"`
+	Created            string `json:"created,omitempty"`
+	VerificationMethod string `json:"verificationMethod"`
+	ProofPurpose       string `json:"proofPurpose"`
+	// ProofValue is the base64url signature, or the proof derived from it
+	ProofValue string `json:"proofValue"`
+	// Disclosed is, in a derived proof, the index among the signed
+	// statements of each statement the credential discloses
+	Disclosed []int `json:"disclosed,omitempty"`
+}
+
+// header binds the signature to the proof's options
+func (p Proof) header() []byte {
+	options, _ := json.Marshal(Proof{
+		Type:               p.Type,
+		Cryptosuite:        p.Cryptosuite,
+		Created:            p.Created,
+		VerificationMethod: p.VerificationMethod,
+		ProofPurpose:       p.ProofPurpose,
+	})
+	return options
+}
+
+// statement is one signed property of a credential
+type statement struct {
+	pointer string
+	value   interface{}
+	message []byte
+}
+
+// statements flattens a credential, without its proof, into its statements
+func statements(credential map[string]interface{}) ([]statement, error) {
+	var out []statement
+	add := func(pointer string, value interface{}) error {
+		canonical, err := canonicalJSON(value)
+		if err != nil {
+			return fmt.Errorf("bbs: encoding %s: %w", pointer, err)
+		}
+		var normalized interface{}
+		_ = json.Unmarshal(canonical, &normalized)
+		out = append(out, statement{pointer: pointer, value: normalized, message: []byte(pointer + " " + string(canonical))})
+		return nil
+	}
+	for name, value := range credential {
+		if name == "proof" {
+			continue
+		}
+		if subject, ok := value.(map[string]interface{}); ok && name == subjectProperty {
+			for claim, claimValue := range subject {
+				if err := add("/"+subjectProperty+"/"+escapePointer(claim), claimValue); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := add("/"+escapePointer(name), value); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].pointer < out[j].pointer })
+	return out, nil
+}
+
+// canonicalJSON encodes a value as JSON with sorted object keys, however it
+// was decoded
+func canonicalJSON(value interface{}) ([]byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
+
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+func messages(all []statement) [][]byte {
+	out := make([][]byte, len(all))
+	for i, s := range all {
+		out[i] = s.message
+	}
+	return out
+}
+
+// SignCredential signs every statement of a credential. options names the
+// verification method and creation time; the returned proof is to be set
+// as the credential's proof property.
+func SignCredential(key *PrivateKey, credential map[string]interface{}, options Proof) (Proof, error) {
+	all, err := statements(credential)
+	if err != nil {
+		return Proof{}, err
+	}
+	proof := Proof{
+		Type:               ProofType,
+		Cryptosuite:        Cryptosuite,
+		Created:            options.Created,
+		VerificationMethod: options.VerificationMethod,
+		ProofPurpose:       ProofPurpose,
+	}
+	signature, err := Sign(key, proof.header(), messages(all))
+	if err != nil {
+		return Proof{}, err
+	}
+	proof.ProofValue = base64.RawURLEncoding.EncodeToString(signature)
+	return proof, nil
+}
+
+// ProofOf reads the proof property of a credential
+func ProofOf(credential map[string]interface{}) (Proof, error) {
+	raw, err := json.Marshal(credential["proof"])
+	if err != nil {
+		return Proof{}, err
+	}
+	var proof Proof
+	if err := json.Unmarshal(raw, &proof); err != nil {
+		return Proof{}, fmt.Errorf("bbs: malformed proof: %w", err)
+	}
+	if proof.Type != ProofType || proof.Cryptosuite != Cryptosuite {
+		return Proof{}, fmt.Errorf("bbs: unsupported proof %s/%s", proof.Type, proof.Cryptosuite)
+	}
+	return proof, nil
+}
+
+// VerifySignedCredential checks the issuer's signature over a credential as
+// issued
+func VerifySignedCredential(key *PublicKey, credential map[string]interface{}) error {
+	proof, err := ProofOf(credential)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(proof.ProofValue)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	all, err := statements(credential)
+	if err != nil {
+		return err
+	}
+	return Verify(key, signature, proof.header(), messages(all))
+}
+
+// DeriveCredential derives from a signed credential one disclosing only the
+// statements under the given JSON pointers, e.g. /issuer or
+// /credentialSubject/age_over_18, with a proof bound to presentationHeader
+func DeriveCredential(key *PublicKey, credential map[string]interface{}, disclose []string, presentationHeader []byte) (map[string]interface{}, error) {
+	proof, err := ProofOf(credential)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(proof.ProofValue)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	all, err := statements(credential)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(disclose))
+	for _, pointer := range disclose {
+		wanted[pointer] = true
+	}
+
+	derived := map[string]interface{}{}
+	var indexes []int
+	for i, s := range all {
+		if !wanted[s.pointer] {
+			continue
+		}
+		delete(wanted, s.pointer)
+		indexes = append(indexes, i)
+		setStatement(derived, s)
+	}
+	for pointer := range wanted {
+		return nil, fmt.Errorf("bbs: the credential has no %s", pointer)
+	}
+
+	value, err := ProofGen(key, signature, proof.header(), presentationHeader, messages(all), indexes)
+	if err != nil {
+		return nil, err
+	}
+	proof.ProofValue = base64.RawURLEncoding.EncodeToString(value)
+	proof.Disclosed = indexes
+	derived["proof"] = proof
+	return derived, nil
+}
+
+// VerifyDerivedCredential checks a derived credential's proof, bound to
+// presentationHeader, against the issuer's key
+func VerifyDerivedCredential(key *PublicKey, credential map[string]interface{}, presentationHeader []byte) error {
+	proof, err := ProofOf(credential)
+	if err != nil {
+		return err
+	}
+	value, err := base64.RawURLEncoding.DecodeString(proof.ProofValue)
+	if err != nil {
+		return ErrInvalidProof
+	}
+	disclosed, err := statements(credential)
+	if err != nil {
+		return err
+	}
+	if len(disclosed) != len(proof.Disclosed) {
+		return errors.New("bbs: disclosed statements do not match the proof")
+	}
+	// Statements keep their signed order, so the sorted statements pair
+	// with the ascending indexes
+	byIndex := make(map[int][]byte, len(disclosed))
+	for i, s := range disclosed {
+		index := proof.Disclosed[i]
+		if i > 0 && index <= proof.Disclosed[i-1] {
+			return ErrInvalidProof
+		}
+		byIndex[index] = s.message
+	}
+	_, err = ProofVerify(key, value, proof.header(), presentationHeader, byIndex)
+	return err
+}
+
+// setStatement puts a disclosed statement back in its place
+func setStatement(credential map[string]interface{}, s statement) {
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	if claim, ok := strings.CutPrefix(s.pointer, "/"+subjectProperty+"/"); ok {
+		subject, _ := credential[subjectProperty].(map[string]interface{})
+		if subject == nil {
+			subject = map[string]interface{}{}
+			credential[subjectProperty] = subject
+		}
+		subject[unescape.Replace(claim)] = s.value
+		return
+	}
+	credential[unescape.Replace(strings.TrimPrefix(s.pointer, "/"))] = s.value
+}
@@ -0,0 +1,242 @@
+package bbs
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+	"github.com/cloudflare/circl/expander"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// katDir holds the test vectors of draft-irtf-cfrg-bbs-signatures for this
+// ciphersuite, as published in fixtures/fixture_data/bls12-381-sha-256 of
+// the draft's repository. The files are checked in unmodified, so updating
+// to a new draft is a copy. Missing vectors fail the tests rather than skip
+// them, so the suite never passes without checking the ciphersuite.
+const katDir = "testdata/bls12-381-sha-256"
+
+// hexBytes is a byte string the fixtures encode in hex
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	*h = decoded
+	return err
+}
+
+type fixtureResult struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+}
+
+// readFixture decodes a fixture file, failing the test when the vectors
+// have not been checked in
+func readFixture(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(katDir, name))
+	if os.IsNotExist(err) {
+		t.Fatalf("%s is missing; copy the draft's bls12-381-sha-256 fixtures into %s", name, katDir)
+	}
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v), name)
+}
+
+// fixtureFiles lists the fixtures of a kind, e.g. every signature case
+func fixtureFiles(t *testing.T, kind string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(katDir, kind, "*.json"))
+	require.NoError(t, err)
+	if len(files) == 0 {
+		t.Fatalf("no %s fixtures; copy the draft's bls12-381-sha-256 fixtures into %s", kind, katDir)
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i], _ = filepath.Rel(katDir, file)
+	}
+	return names
+}
+
+func scalarHex(s *bls12381.Scalar) string {
+	b, _ := s.MarshalBinary()
+	return hex.EncodeToString(b)
+}
+
+// seededRandomScalars is the draft's mocked random scalars, which its proof
+// vectors are generated with in place of a random source
+func seededRandomScalars(seed, dst []byte) func(count int) ([]bls12381.Scalar, error) {
+	return func(count int) ([]bls12381.Scalar, error) {
+		const expandLen = 48
+		v := expander.NewExpanderMD(crypto.SHA256, dst).Expand(seed, uint(expandLen*count))
+		scalars := make([]bls12381.Scalar, count)
+		for i := range scalars {
+			scalars[i].SetBytes(v[i*expandLen : (i+1)*expandLen])
+		}
+		return scalars, nil
+	}
+}
+
+type mockedRngFixture struct {
+	Seed          hexBytes `json:"seed"`
+	DST           hexBytes `json:"dst"`
+	Count         int      `json:"count"`
+	MockedScalars []string `json:"mockedScalars"`
+}
+
+func TestKAT_KeyGen(t *testing.T) {
+	var fixture struct {
+		KeyMaterial hexBytes `json:"keyMaterial"`
+		KeyInfo     hexBytes `json:"keyInfo"`
+		KeyDST      hexBytes `json:"keyDst"`
+		KeyPair     struct {
+			SecretKey hexBytes `json:"secretKey"`
+			PublicKey hexBytes `json:"publicKey"`
+		} `json:"keyPair"`
+	}
+	readFixture(t, "keypair.json", &fixture)
+	require.Equal(t, apiID+"KEYGEN_DST_", string(fixture.KeyDST), "KeyGen only uses the default key_dst")
+
+	key, err := KeyGen(fixture.KeyMaterial, fixture.KeyInfo)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(fixture.KeyPair.SecretKey), hex.EncodeToString(key.Bytes()))
+	assert.Equal(t, hex.EncodeToString(fixture.KeyPair.PublicKey), hex.EncodeToString(key.Public().Bytes()))
+}
+
+func TestKAT_Generators(t *testing.T) {
+	var fixture struct {
+		P1            hexBytes   `json:"P1"`
+		Q1            hexBytes   `json:"Q1"`
+		MsgGenerators []hexBytes `json:"MsgGenerators"`
+	}
+	readFixture(t, "generators.json", &fixture)
+	require.NotEmpty(t, fixture.MsgGenerators)
+
+	assert.Equal(t, hex.EncodeToString(fixture.P1), hex.EncodeToString(basePoint().BytesCompressed()))
+	gens := generators(len(fixture.MsgGenerators) + 1)
+	assert.Equal(t, hex.EncodeToString(fixture.Q1), hex.EncodeToString(gens[0].BytesCompressed()))
+	for i, h := range fixture.MsgGenerators {
+		assert.Equal(t, hex.EncodeToString(h), hex.EncodeToString(gens[1+i].BytesCompressed()), "H_%d", i+1)
+	}
+}
+
+func TestKAT_HashToScalar(t *testing.T) {
+	var mapFixture struct {
+		DST   hexBytes `json:"dst"`
+		Cases []struct {
+			Message hexBytes `json:"message"`
+			Scalar  string   `json:"scalar"`
+		} `json:"cases"`
+	}
+	readFixture(t, "MapMessageToScalarAsHash.json", &mapFixture)
+	require.Equal(t, apiID+"MAP_MSG_TO_SCALAR_AS_HASH_", string(mapFixture.DST))
+	require.NotEmpty(t, mapFixture.Cases)
+	for i, c := range mapFixture.Cases {
+		scalars := messageScalars([][]byte{c.Message})
+		assert.Equal(t, c.Scalar, scalarHex(&scalars[0]), "case %d", i)
+	}
+
+	var h2s struct {
+		Message hexBytes `json:"message"`
+		DST     hexBytes `json:"dst"`
+		Scalar  string   `json:"scalar"`
+	}
+	readFixture(t, "h2s.json", &h2s)
+	var scalar bls12381.Scalar
+	hashToScalar(&scalar, h2s.Message, h2s.DST)
+	assert.Equal(t, h2s.Scalar, scalarHex(&scalar))
+
+	var rng mockedRngFixture
+	readFixture(t, "mockedRng.json", &rng)
+	require.Len(t, rng.MockedScalars, rng.Count)
+	scalars, err := seededRandomScalars(rng.Seed, rng.DST)(rng.Count)
+	require.NoError(t, err)
+	for i := range scalars {
+		assert.Equal(t, rng.MockedScalars[i], scalarHex(&scalars[i]), "scalar %d", i)
+	}
+}
+
+func TestKAT_Signatures(t *testing.T) {
+	for _, name := range fixtureFiles(t, "signature") {
+		t.Run(name, func(t *testing.T) {
+			var fixture struct {
+				SignerKeyPair struct {
+					SecretKey hexBytes `json:"secretKey"`
+					PublicKey hexBytes `json:"publicKey"`
+				} `json:"signerKeyPair"`
+				Header    hexBytes      `json:"header"`
+				Messages  []hexBytes    `json:"messages"`
+				Signature hexBytes      `json:"signature"`
+				Result    fixtureResult `json:"result"`
+			}
+			readFixture(t, name, &fixture)
+			messages := make([][]byte, len(fixture.Messages))
+			for i, m := range fixture.Messages {
+				messages[i] = m
+			}
+			public, err := ParsePublicKey(fixture.SignerKeyPair.PublicKey)
+			require.NoError(t, err)
+
+			err = Verify(public, fixture.Signature, fixture.Header, messages)
+			if !fixture.Result.Valid {
+				assert.Error(t, err, fixture.Result.Reason)
+				return
+			}
+			require.NoError(t, err)
+			key, err := ParsePrivateKey(fixture.SignerKeyPair.SecretKey)
+			require.NoError(t, err)
+			signature, err := Sign(key, fixture.Header, messages)
+			require.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(fixture.Signature), hex.EncodeToString(signature), "signing is deterministic")
+		})
+	}
+}
+
+func TestKAT_Proofs(t *testing.T) {
+	var rng mockedRngFixture
+	readFixture(t, "mockedRng.json", &rng)
+	for _, name := range fixtureFiles(t, "proof") {
+		t.Run(name, func(t *testing.T) {
+			var fixture struct {
+				SignerPublicKey    hexBytes      `json:"signerPublicKey"`
+				Signature          hexBytes      `json:"signature"`
+				Header             hexBytes      `json:"header"`
+				PresentationHeader hexBytes      `json:"presentationHeader"`
+				Messages           []hexBytes    `json:"messages"`
+				DisclosedIndexes   []int         `json:"disclosedIndexes"`
+				Proof              hexBytes      `json:"proof"`
+				Result             fixtureResult `json:"result"`
+			}
+			readFixture(t, name, &fixture)
+			public, err := ParsePublicKey(fixture.SignerPublicKey)
+			require.NoError(t, err)
+			messages := make([][]byte, len(fixture.Messages))
+			for i, m := range fixture.Messages {
+				messages[i] = m
+			}
+			disclosed := map[int][]byte{}
+			for _, i := range fixture.DisclosedIndexes {
+				disclosed[i] = messages[i]
+			}
+
+			count, err := ProofVerify(public, fixture.Proof, fixture.Header, fixture.PresentationHeader, disclosed)
+			if !fixture.Result.Valid {
+				assert.Error(t, err, fixture.Result.Reason)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, len(messages), count)
+			proof, err := proofGen(public, fixture.Signature, fixture.Header, fixture.PresentationHeader, messages, fixture.DisclosedIndexes, seededRandomScalars(rng.Seed, rng.DST))
+			require.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(fixture.Proof), hex.EncodeToString(proof), "proofs are deterministic under the mocked random scalars")
+		})
+	}
+}
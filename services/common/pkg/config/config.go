@@ -0,0 +1,345 @@
+// Package config loads a Cachet service's settings into a typed struct at
+// startup.
+//
+// Each field names its environment variable in an `env` tag and may carry
+// `default`, `required:"true"`, `oneof:"a,b"`, `secret:"true"` and `doc`
+// tags. Values come, in order of precedence, from the environment, from the
+// YAML or JSON file named by CONFIG_FILE, and from defaults. A value of the
+// form sm://projects/P/secrets/S[/versions/V] is read from Secret Manager.
+// Load reports every invalid or missing value at once so a misconfigured
+// deployment fails with one readable message, and Markdown documents the
+// struct from the same tags.
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileVariable names the optional file holding configuration values, keyed
+// by variable name
+const FileVariable = "CONFIG_FILE"
+
+// Environments a service can run in
+const (
+	Development = "development"
+	Staging     = "staging"
+	Production  = "production"
+)
+
+// Base is the configuration every service shares. Services embed it and set
+// their own default port before loading.
+type Base struct {
+	Port        int    `env:"PORT" doc:"Port the HTTP server listens on"`
+	Environment string `env:"ENVIRONMENT" default:"production" oneof:"development,staging,production" doc:"Deployment environment; development logs to the console in a human-readable format"`
+}
+
+// Development reports whether the service runs on a developer's machine
+func (b Base) Development() bool {
+	return b.Environment == Development
+}
+
+// Addr is the address the HTTP server listens on
+func (b Base) Addr() string {
+	return ":" + strconv.Itoa(b.Port)
+}
+
+// Validate checks the port is usable
+func (b Base) Validate() error {
+	if b.Port < 1 || b.Port > 65535 {
+		return fmt.Errorf("PORT: %d is not a TCP port", b.Port)
+	}
+	return nil
+}
+
+// Validator is implemented by configuration structs that check values
+// against each other once every field is loaded. Methods promoted from
+// embedded structs count, so a service whose Config declares its own
+// Validate calls Base.Validate from it.
+type Validator interface {
+	Validate() error
+}
+
+// Error lists every problem found while loading a configuration
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid configuration: " + e.Problems[0]
+	}
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Loader reads configuration from its sources
+type Loader struct {
+	// LookupEnv reads environment variables; os.LookupEnv by default
+	LookupEnv func(key string) (string, bool)
+	// Secrets resolves sm:// references; Secret Manager by default
+	Secrets SecretResolver
+}
+
+// Load fills v, a pointer to a configuration struct, from the process
+// environment, CONFIG_FILE and Secret Manager. Fields already set in v are
+// kept unless a source sets them, so callers can pass per-service defaults.
+func Load(v interface{}) error {
+	return Loader{}.Load(context.Background(), v)
+}
+
+// Load fills v from the loader's sources
+func (l Loader) Load(ctx context.Context, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Load needs a pointer to a struct, got %T", v)
+	}
+	lookupEnv := l.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	secrets := l.Secrets
+	if secrets == nil {
+		secrets = NewSecretManager()
+	}
+
+	fields := collect(rv.Elem())
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.env] = true
+	}
+
+	var problems []string
+	file := map[string]string{}
+	if path, ok := lookupEnv(FileVariable); ok && path != "" {
+		var err error
+		if file, err = readFile(path); err != nil {
+			return &Error{Problems: []string{fmt.Sprintf("%s: %v", FileVariable, err)}}
+		}
+		var unknown []string
+		for key := range file {
+			if !known[key] {
+				unknown = append(unknown, key)
+			}
+		}
+		sort.Strings(unknown)
+		for _, key := range unknown {
+			problems = append(problems, fmt.Sprintf("%s: unknown variable in %s", key, path))
+		}
+	}
+
+	for _, f := range fields {
+		raw, ok := lookupEnv(f.env)
+		if !ok {
+			raw, ok = file[f.env]
+		}
+		if ok && IsSecretRef(raw) {
+			secret, err := secrets.Resolve(ctx, raw)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", f.env, err))
+				continue
+			}
+			raw = secret
+		}
+		if !ok || raw == "" {
+			switch {
+			case !f.value.IsZero():
+				continue
+			case f.def != "":
+				raw = f.def
+			case f.required:
+				problems = append(problems, f.env+" is required")
+				continue
+			default:
+				continue
+			}
+		}
+		if len(f.oneof) > 0 && !contains(f.oneof, raw) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not one of %s", f.env, raw, strings.Join(f.oneof, ", ")))
+			continue
+		}
+		if err := set(f.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.env, err))
+		}
+	}
+	if validator, ok := v.(Validator); ok && len(problems) == 0 {
+		if err := validator.Validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// Lookup reads a variable named by a service's own configuration files,
+// such as the one holding an OAuth client secret, from the process
+// environment. Like a field's value, it may be an sm:// reference; an unset
+// variable reads as "".
+func Lookup(name string) (string, error) {
+	return Loader{}.Lookup(context.Background(), name)
+}
+
+// Lookup reads the variable name from the loader's environment, resolving
+// an sm:// reference
+func (l Loader) Lookup(ctx context.Context, name string) (string, error) {
+	lookupEnv := l.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	raw, _ := lookupEnv(name)
+	if !IsSecretRef(raw) {
+		return raw, nil
+	}
+	secrets := l.Secrets
+	if secrets == nil {
+		secrets = NewSecretManager()
+	}
+	secret, err := secrets.Resolve(ctx, raw)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return secret, nil
+}
+
+// field is a configurable struct field and its tags
+type field struct {
+	env      string
+	def      string
+	doc      string
+	required bool
+	secret   bool
+	oneof    []string
+	value    reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// collect lists the struct's tagged fields, embedded and nested structs
+// included, in declaration order
+func collect(v reflect.Value) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		env, ok := sf.Tag.Lookup("env")
+		if !ok {
+			if sf.Type.Kind() == reflect.Struct {
+				fields = append(fields, collect(v.Field(i))...)
+			}
+			continue
+		}
+		f := field{
+			env:      env,
+			def:      sf.Tag.Get("default"),
+			doc:      sf.Tag.Get("doc"),
+			required: sf.Tag.Get("required") == "true",
+			secret:   sf.Tag.Get("secret") == "true",
+			value:    v.Field(i),
+		}
+		if oneof := sf.Tag.Get("oneof"); oneof != "" {
+			f.oneof = strings.Split(oneof, ",")
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// set parses raw into v according to its type
+func set(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s or 5m", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// readFile reads a flat YAML or JSON map of variable names to values
+func readFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	values := make(map[string]string, len(doc))
+	for key, value := range doc {
+		switch value := value.(type) {
+		case nil:
+			values[key] = ""
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, errors.New(key + ": nested values are not supported")
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
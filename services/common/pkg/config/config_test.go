@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Base
+	Token    string        `env:"API_TOKEN" required:"true" secret:"true" doc:"Token callers present"`
+	Timeout  time.Duration `env:"TIMEOUT" default:"5s" doc:"How long to wait"`
+	FailOpen bool          `env:"FAIL_OPEN" doc:"Accept when unsure"`
+	Origins  []string      `env:"ORIGINS" doc:"Allowed origins"`
+	Mode     string        `env:"MODE" oneof:"strict,lenient" doc:"Checking mode"`
+}
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+var noSecrets = SecretResolverFunc(func(ctx context.Context, ref string) (string, error) {
+	return "", errors.New("no secrets in this test")
+})
+
+func TestLoad_Environment(t *testing.T) {
+	cfg := testConfig{Base: Base{Port: 8081}}
+	err := Loader{LookupEnv: env(map[string]string{
+		"API_TOKEN": "s3cret",
+		"FAIL_OPEN": "true",
+		"ORIGINS":   "https://a.example, https://b.example",
+	}), Secrets: noSecrets}.Load(context.Background(), &cfg)
+	require.NoError(t, err)
+	assert.Equal(t, testConfig{
+		Base:     Base{Port: 8081, Environment: Production},
+		Token:    "s3cret",
+		Timeout:  5 * time.Second,
+		FailOpen: true,
+		Origins:  []string{"https://a.example", "https://b.example"},
+	}, cfg)
+	assert.Equal(t, ":8081", cfg.Addr())
+	assert.False(t, cfg.Development())
+}
+
+func TestLoad_ReportsEveryProblem(t *testing.T) {
+	cfg := testConfig{Base: Base{Port: 8081}}
+	err := Loader{LookupEnv: env(map[string]string{
+		"PORT":        "http",
+		"ENVIRONMENT": "prod",
+		"TIMEOUT":     "5",
+		"MODE":        "paranoid",
+	}), Secrets: noSecrets}.Load(context.Background(), &cfg)
+
+	var configErr *Error
+	require.ErrorAs(t, err, &configErr)
+	assert.Equal(t, []string{
+		`PORT: "http" is not an integer`,
+		`ENVIRONMENT: "prod" is not one of development, staging, production`,
+		"API_TOKEN is required",
+		`TIMEOUT: "5" is not a duration such as 30s or 5m`,
+		`MODE: "paranoid" is not one of strict, lenient`,
+	}, configErr.Problems)
+	assert.Contains(t, err.Error(), "invalid configuration:\n  - PORT")
+}
+
+func TestLoad_Validates(t *testing.T) {
+	cfg := testConfig{}
+	err := Loader{LookupEnv: env(map[string]string{"API_TOKEN": "s3cret"}), Secrets: noSecrets}.Load(context.Background(), &cfg)
+	assert.EqualError(t, err, "invalid configuration: PORT: 0 is not a TCP port")
+}
+
+func TestLoad_FileUnderEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("PORT: 9000\nAPI_TOKEN: from-file\nORIGINS:\n  - https://a.example\n  - https://b.example\n"), 0o600))
+
+	cfg := testConfig{Base: Base{Port: 8081}}
+	err := Loader{LookupEnv: env(map[string]string{
+		FileVariable: path,
+		"API_TOKEN":  "from-env",
+	}), Secrets: noSecrets}.Load(context.Background(), &cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 9000, cfg.Port)
+	assert.Equal(t, "from-env", cfg.Token)
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.Origins)
+}
+
+func TestLoad_FileRejectsUnknownVariables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"API_TOKEN": "t", "API_TOKNE": "t"}`), 0o600))
+
+	cfg := testConfig{Base: Base{Port: 8081}}
+	err := Loader{LookupEnv: env(map[string]string{FileVariable: path}), Secrets: noSecrets}.Load(context.Background(), &cfg)
+	assert.EqualError(t, err, "invalid configuration: API_TOKNE: unknown variable in "+path)
+}
+
+func TestLoad_ResolvesSecrets(t *testing.T) {
+	var resolved []string
+	secrets := SecretResolverFunc(func(ctx context.Context, ref string) (string, error) {
+		resolved = append(resolved, ref)
+		return "from-secret-manager", nil
+	})
+	cfg := testConfig{Base: Base{Port: 8081}}
+	err := Loader{LookupEnv: env(map[string]string{
+		"API_TOKEN": "sm://projects/cachet/secrets/api-token",
+	}), Secrets: secrets}.Load(context.Background(), &cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "from-secret-manager", cfg.Token)
+	assert.Equal(t, []string{"sm://projects/cachet/secrets/api-token"}, resolved)
+}
+
+func TestLoader_Lookup(t *testing.T) {
+	loader := Loader{LookupEnv: env(map[string]string{
+		"PLAIN":  "value",
+		"SECRET": "sm://projects/cachet/secrets/client-secret",
+	}), Secrets: SecretResolverFunc(func(ctx context.Context, ref string) (string, error) {
+		return "from-secret-manager", nil
+	})}
+	for name, want := range map[string]string{"PLAIN": "value", "SECRET": "from-secret-manager", "UNSET": ""} {
+		got, err := loader.Lookup(context.Background(), name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+
+	loader.Secrets = noSecrets
+	_, err := loader.Lookup(context.Background(), "SECRET")
+	assert.ErrorContains(t, err, "SECRET")
+}
+
+func TestSecretManager_Resolve(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer ya29.token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/v1/projects/cachet/secrets/api-token/versions/latest:access":
+			w.Write([]byte(`{"payload": {"data": "czNjcmV0"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sm := NewSecretManager()
+	sm.endpoint, sm.tokens = server.URL+"/v1/", gcpauth.NewTokenSource(server.URL+"/token", server.Client())
+
+	secret, err := sm.Resolve(context.Background(), "sm://projects/cachet/secrets/api-token")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+
+	_, err = sm.Resolve(context.Background(), "sm://projects/cachet/secrets/missing/versions/2")
+	assert.ErrorContains(t, err, "Secret Manager answered 404")
+	_, err = sm.Resolve(context.Background(), "sm://api-token")
+	assert.ErrorContains(t, err, "is not of the form")
+}
+
+func TestMarkdown(t *testing.T) {
+	doc := Markdown("test-service", testConfig{Base: Base{Port: 8081}})
+	assert.Contains(t, doc, "# test-service configuration")
+	assert.Contains(t, doc, "| `PORT` | integer | `8081` | Port the HTTP server listens on |")
+	assert.Contains(t, doc, "| `ENVIRONMENT` | string | `production` |")
+	assert.Contains(t, doc, "| `API_TOKEN` | string | required | Token callers present (secret: prefer an `sm://` reference) |")
+	assert.Contains(t, doc, "| `TIMEOUT` | duration | `5s` | How long to wait |")
+	assert.Contains(t, doc, "| `MODE` | string |  | Checking mode; one of `strict`, `lenient` |")
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Markdown documents the configuration struct v, with the defaults it
+// already holds, as a Markdown page for the named service
+func Markdown(service string, v interface{}) string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s configuration\n\n", service)
+	b.WriteString("<!-- Generated from the Config struct tags by `UPDATE_CONFIG_DOCS=1 go test -run TestConfigDocs`; do not edit. -->\n\n")
+	b.WriteString("Values are read, in order of precedence, from the environment, from the YAML or JSON file named by `CONFIG_FILE` (a map of variable names to values), and from the defaults below. ")
+	b.WriteString("Any value may instead be a Secret Manager reference, `sm://projects/P/secrets/S[/versions/V]`, resolved at startup. ")
+	b.WriteString("The service refuses to start, listing every problem, when a value is missing or invalid.\n\n")
+	b.WriteString("| Variable | Type | Default | Description |\n")
+	b.WriteString("|----------|------|---------|-------------|\n")
+	for _, f := range collect(rv) {
+		def := f.def
+		if !f.value.IsZero() {
+			def = fmt.Sprint(f.value.Interface())
+			if items, ok := f.value.Interface().([]string); ok {
+				def = strings.Join(items, ",")
+			}
+		}
+		switch {
+		case def != "":
+			def = "`" + def + "`"
+		case f.required:
+			def = "required"
+		}
+		doc := f.doc
+		if len(f.oneof) > 0 {
+			doc += "; one of `" + strings.Join(f.oneof, "`, `") + "`"
+		}
+		if f.secret {
+			doc += " (secret: prefer an `sm://` reference)"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", f.env, typeName(f.value.Type()), def, doc)
+	}
+	return b.String()
+}
+
+func typeName(t reflect.Type) string {
+	if t == durationType {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "list"
+	}
+	return t.Kind().String()
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+)
+
+// SecretPrefix marks a value as a Secret Manager reference
+const SecretPrefix = "sm://"
+
+const secretManagerEndpoint = "https://secretmanager.googleapis.com/v1/"
+
+// IsSecretRef reports whether value names a secret rather than holding one
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+// SecretResolver reads the secret an sm:// reference names
+type SecretResolver interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretResolverFunc adapts a function to a SecretResolver
+type SecretResolverFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretResolverFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// SecretManager resolves references with the Secret Manager REST API,
+// authenticated as the service account the metadata server vouches for
+type SecretManager struct {
+	endpoint string
+	tokens   *gcpauth.TokenSource
+	client   *http.Client
+}
+
+// NewSecretManager returns a resolver for the service's own project
+func NewSecretManager() *SecretManager {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &SecretManager{
+		endpoint: secretManagerEndpoint,
+		tokens:   gcpauth.NewTokenSource(gcpauth.MetadataTokenURL, client),
+		client:   client,
+	}
+}
+
+// secretVersion turns sm://projects/P/secrets/S[/versions/V] into the
+// resource name of the version, the latest when none is given
+func secretVersion(ref string) (string, error) {
+	name := strings.TrimPrefix(ref, SecretPrefix)
+	parts := strings.Split(name, "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets":
+		name += "/versions/latest"
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "secrets" && parts[4] == "versions":
+	default:
+		return "", fmt.Errorf("%q is not of the form %sprojects/P/secrets/S[/versions/V]", ref, SecretPrefix)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("%q has an empty segment", ref)
+		}
+	}
+	return name, nil
+}
+
+// Resolve accesses the secret version. The payload is never logged.
+func (m *SecretManager) Resolve(ctx context.Context, ref string) (string, error) {
+	name, err := secretVersion(ref)
+	if err != nil {
+		return "", err
+	}
+	token, err := m.tokens.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetching Secret Manager access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.endpoint+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("accessing %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("accessing %s: Secret Manager answered %d", name, resp.StatusCode)
+	}
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("accessing %s: %w", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(body.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("accessing %s: %w", name, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,125 @@
+// Package cors lets browsers call Cachet APIs from other origins, such as
+// relying parties' web integrations and the wallet's web companion.
+//
+// A Policy answers preflight requests and stamps the CORS headers on the
+// responses to origins its configuration allows. It is strict by default:
+// with no allowed origins nothing is added, so browsers keep enforcing the
+// same-origin policy.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the CORS configuration services embed in their own
+type Config struct {
+	AllowedOrigins   []string      `env:"CORS_ALLOWED_ORIGINS" doc:"Comma-separated origins browsers may call from, such as https://rp.example or https://*.example.com; * allows any origin; cross-origin calls are refused without any"`
+	AllowedMethods   []string      `env:"CORS_ALLOWED_METHODS" default:"GET,POST" doc:"Methods cross-origin requests may use"`
+	AllowedHeaders   []string      `env:"CORS_ALLOWED_HEADERS" default:"Authorization,Content-Type,Cachet-API-Version" doc:"Request headers cross-origin requests may send"`
+	ExposedHeaders   []string      `env:"CORS_EXPOSED_HEADERS" default:"X-Request-Id,Cachet-API-Version,Deprecation,Sunset,Link" doc:"Response headers cross-origin callers may read"`
+	AllowCredentials bool          `env:"CORS_ALLOW_CREDENTIALS" doc:"Let browsers send cookies and client certificates; not allowed with *"`
+	MaxAge           time.Duration `env:"CORS_MAX_AGE" default:"10m" doc:"How long browsers may cache a preflight answer"`
+}
+
+// Validate checks the origins are origins and that credentials are not
+// offered to any origin
+func (c Config) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return errors.New("CORS_ALLOW_CREDENTIALS cannot be used with CORS_ALLOWED_ORIGINS=*")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %q is not an origin such as https://rp.example", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("CORS_MAX_AGE cannot be negative")
+	}
+	return nil
+}
+
+// allows reports whether requests from origin may be answered
+func (c Config) allows(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.TrimSuffix(allowed, "/")
+		switch {
+		case allowed == "*" || strings.EqualFold(allowed, origin):
+			return true
+		case strings.Contains(allowed, "://*."):
+			scheme, suffix, _ := strings.Cut(allowed, "://*")
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) &&
+				len(origin) > len(scheme)+3+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Policy applies a CORS configuration. The zero Policy refuses every
+// cross-origin request.
+type Policy struct {
+	config atomic.Pointer[Config]
+}
+
+// Set replaces the configuration; services set it once at startup
+func (p *Policy) Set(c Config) {
+	p.config.Store(&c)
+}
+
+// Middleware answers preflights and adds CORS headers for allowed origins.
+// Requests from other origins are served without them, so browsers refuse
+// to hand the response to the calling page.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := p.config.Load()
+		origin := r.Header.Get("Origin")
+		if c == nil || len(c.AllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allows(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(c.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
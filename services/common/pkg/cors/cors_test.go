@@ -0,0 +1,92 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var strict = Config{
+	AllowedOrigins: []string{"https://rp.example", "https://*.wallet.example"},
+	AllowedMethods: []string{"GET", "POST"},
+	AllowedHeaders: []string{"Authorization", "Content-Type"},
+	ExposedHeaders: []string{"X-Request-Id"},
+	MaxAge:         10 * time.Minute,
+}
+
+func serve(p *Policy, method, origin string, preflight bool) *httptest.ResponseRecorder {
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest(method, "/presentations/verify", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if preflight {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestPolicy_StrictByDefault(t *testing.T) {
+	var p Policy
+	w := serve(&p, http.MethodOptions, "https://rp.example", true)
+	assert.Equal(t, http.StatusTeapot, w.Code, "preflights reach the router")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	p.Set(Config{})
+	w = serve(&p, http.MethodGet, "https://rp.example", false)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestPolicy_AllowedOrigin(t *testing.T) {
+	var p Policy
+	p.Set(strict)
+
+	w := serve(&p, http.MethodOptions, "https://rp.example", true)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://rp.example", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = serve(&p, http.MethodPost, "https://app.wallet.example", false)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "https://app.wallet.example", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Request-Id", w.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+}
+
+func TestPolicy_RefusedOrigin(t *testing.T) {
+	var p Policy
+	p.Set(strict)
+
+	for _, origin := range []string{"https://evil.example", "http://rp.example", "https://wallet.example", "https://evilwallet.example"} {
+		w := serve(&p, http.MethodOptions, origin, true)
+		assert.Equal(t, http.StatusNoContent, w.Code, origin)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), origin)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"), origin)
+	}
+	w := serve(&p, http.MethodGet, "https://evil.example", false)
+	assert.Equal(t, http.StatusTeapot, w.Code, "served, but the browser withholds the response")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = serve(&p, http.MethodGet, "", false)
+	assert.Empty(t, w.Header().Get("Vary"), "same-origin and non-browser requests are untouched")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, strict.Validate())
+	assert.NoError(t, Config{AllowedOrigins: []string{"*"}}.Validate())
+	assert.EqualError(t, Config{AllowedOrigins: []string{"*"}, AllowCredentials: true}.Validate(),
+		"CORS_ALLOW_CREDENTIALS cannot be used with CORS_ALLOWED_ORIGINS=*")
+	for _, origin := range []string{"rp.example", "https://rp.example/callback", "ftp://rp.example", "https://"} {
+		assert.ErrorContains(t, Config{AllowedOrigins: []string{origin}}.Validate(), "is not an origin", origin)
+	}
+}
@@ -0,0 +1,142 @@
+// Package deadline propagates per-request time budgets across Cachet services.
+//
+// Inbound requests get a context deadline derived from the service's configured
+// budget, tightened by any budget the caller forwarded. Outbound HTTP calls and
+// other dependency calls (database, KMS) made with that context carry the
+// remaining budget along, and deadline expiries are counted per dependency.
+package deadline
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+)
+
+// BudgetHeader carries the caller's remaining budget in milliseconds
+const BudgetHeader = "X-Request-Budget-Ms"
+
+// DefaultBudget stays below the services' 15s write timeout so handlers fail
+// before the connection is torn down
+const DefaultBudget = 10 * time.Second
+
+// DependencyInbound labels requests that arrived with no budget left
+const DependencyInbound = "inbound"
+
+// DependencyHandler labels requests whose own handler overran the budget
+const DependencyHandler = "handler"
+
+var exceeded = expvar.NewMap("deadline_exceeded_total")
+
+// BudgetFromEnv reads REQUEST_BUDGET (a Go duration), falling back to DefaultBudget
+func BudgetFromEnv() time.Duration {
+	if v := os.Getenv("REQUEST_BUDGET"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return DefaultBudget
+}
+
+// Middleware bounds every request by budget, or by the caller's forwarded
+// budget when it is tighter. Requests arriving with an exhausted budget are
+// rejected outright; handlers that overrun receive a 503.
+func Middleware(budget time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			effective := budget
+			if v := r.Header.Get(BudgetHeader); v != "" {
+				if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+					if ms <= 0 {
+						Record(DependencyInbound)
+						http.Error(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+						return
+					}
+					if forwarded := time.Duration(ms) * time.Millisecond; forwarded < effective {
+						effective = forwarded
+					}
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), effective)
+			defer cancel()
+
+			http.TimeoutHandler(next, effective, "Request deadline exceeded").ServeHTTP(w, r.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				Record(DependencyHandler)
+			}
+		})
+	}
+}
+
+// Transport forwards the remaining budget to downstream services and counts
+// calls to Dependency that ran out of time
+type Transport struct {
+	Dependency string
+	Base       http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	if dl, ok := ctx.Deadline(); ok {
+		remaining := time.Until(dl)
+		if remaining <= 0 {
+			Record(t.Dependency)
+			return nil, context.DeadlineExceeded
+		}
+		req = req.Clone(ctx)
+		req.Header.Set(BudgetHeader, strconv.FormatInt(remaining.Milliseconds(), 10))
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)) {
+		Record(t.Dependency)
+	}
+	return resp, err
+}
+
+// NewClient returns an HTTP client for calls to the named dependency, which
+// also forward the trace context. Callers must build requests with the
+// inbound request context.
+func NewClient(dependency string) *http.Client {
+	return &http.Client{Transport: &Transport{Dependency: dependency, Base: tracing.Transport(dependency, http.DefaultTransport)}}
+}
+
+// Call runs a non-HTTP dependency operation (database, KMS) under ctx,
+// refusing to start once the budget is spent and counting expiries
+func Call(ctx context.Context, dependency string, fn func(context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			Record(dependency)
+		}
+		return err
+	}
+	err := fn(ctx)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		Record(dependency)
+	}
+	return err
+}
+
+// Record counts a deadline expiry against a dependency
+func Record(dependency string) {
+	exceeded.Add(dependency, 1)
+}
+
+// Exceeded returns the number of deadline expiries recorded for a dependency
+func Exceeded(dependency string) int64 {
+	if v, ok := exceeded.Get(dependency).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware_TightensToForwardedBudget(t *testing.T) {
+	var remaining time.Duration
+	handler := Middleware(10 * time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dl, ok := r.Context().Deadline()
+		require.True(t, ok)
+		remaining = time.Until(dl)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(BudgetHeader, "500")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.LessOrEqual(t, remaining, 500*time.Millisecond)
+}
+
+func TestMiddleware_RejectsExhaustedBudget(t *testing.T) {
+	before := Exceeded(DependencyInbound)
+	handler := Middleware(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler must not run")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(BudgetHeader, "0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, before+1, Exceeded(DependencyInbound))
+}
+
+func TestMiddleware_OverrunningHandler(t *testing.T) {
+	before := Exceeded(DependencyHandler)
+	handler := Middleware(20 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, before+1, Exceeded(DependencyHandler))
+}
+
+func TestTransport_ForwardsRemainingBudget(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(BudgetHeader)
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := NewClient("registry").Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	ms, err := strconv.Atoi(forwarded)
+	require.NoError(t, err)
+	assert.Greater(t, ms, 0)
+	assert.LessOrEqual(t, ms, 2000)
+}
+
+func TestTransport_CountsSlowDependency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	before := Exceeded("slow-upstream")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+	require.NoError(t, err)
+
+	_, err = NewClient("slow-upstream").Do(req)
+	assert.Error(t, err)
+	assert.Equal(t, before+1, Exceeded("slow-upstream"))
+}
+
+func TestCall_RefusesSpentBudget(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	called := false
+	err := Call(ctx, "database", func(context.Context) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, called)
+}
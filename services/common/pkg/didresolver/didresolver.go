@@ -0,0 +1,305 @@
+// Package didresolver resolves DIDs to DID documents for Cachet services.
+//
+// Resolution is pluggable per DID method; did:web and did:jwk are registered
+// by default. Resolved documents are cached for a TTL. Once an entry expires
+// it is still served for up to MaxStale while a single background refresh
+// runs, so a transient outage at the DID host does not break verification.
+// The cache holds at most MaxEntries documents, evicting the least recently
+// used, and drops documents past MaxStale as new ones are stored.
+package didresolver
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+)
+
+// Defaults for New
+const (
+	DefaultTTL        = 10 * time.Minute
+	DefaultMaxStale   = 24 * time.Hour
+	DefaultMaxEntries = 10000
+	// refreshTimeout bounds background revalidation, which outlives the request
+	refreshTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnsupportedMethod = errors.New("unsupported DID method")
+	ErrKeyNotFound       = errors.New("verification method not found")
+)
+
+// resolutions counts cache outcomes: hit, stale, miss and error
+var resolutions = expvar.NewMap("did_resolutions_total")
+
+// Method resolves DIDs of one method, e.g. "web" for did:web
+type Method interface {
+	Resolve(ctx context.Context, did string) (Document, error)
+}
+
+// MethodFunc adapts a function to the Method interface
+type MethodFunc func(ctx context.Context, did string) (Document, error)
+
+func (f MethodFunc) Resolve(ctx context.Context, did string) (Document, error) {
+	return f(ctx, did)
+}
+
+// VerificationMethod is a key listed in a DID document
+type VerificationMethod struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Controller   string `json:"controller"`
+	PublicKeyJwk *JWK   `json:"publicKeyJwk,omitempty"`
+}
+
+// Document is the subset of a DID document Cachet services rely on.
+// Verification relationships are normalised to method IDs; methods embedded
+// in a relationship are moved into VerificationMethod.
+type Document struct {
+	ID                 string               `json:"id"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod,omitempty"`
+	Authentication     []string             `json:"authentication,omitempty"`
+	AssertionMethod    []string             `json:"assertionMethod,omitempty"`
+}
+
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ID                 string               `json:"id"`
+		VerificationMethod []VerificationMethod `json:"verificationMethod"`
+		Authentication     []json.RawMessage    `json:"authentication"`
+		AssertionMethod    []json.RawMessage    `json:"assertionMethod"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	d.ID, d.VerificationMethod = raw.ID, raw.VerificationMethod
+	var err error
+	if d.Authentication, err = d.relationship(raw.Authentication); err != nil {
+		return fmt.Errorf("authentication: %w", err)
+	}
+	if d.AssertionMethod, err = d.relationship(raw.AssertionMethod); err != nil {
+		return fmt.Errorf("assertionMethod: %w", err)
+	}
+	return nil
+}
+
+func (d *Document) relationship(entries []json.RawMessage) ([]string, error) {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var id string
+		if err := json.Unmarshal(entry, &id); err == nil {
+			ids = append(ids, d.absolute(id))
+			continue
+		}
+		var method VerificationMethod
+		if err := json.Unmarshal(entry, &method); err != nil {
+			return nil, err
+		}
+		method.ID = d.absolute(method.ID)
+		d.VerificationMethod = append(d.VerificationMethod, method)
+		ids = append(ids, method.ID)
+	}
+	return ids, nil
+}
+
+// absolute expands a relative DID URL such as #key-1
+func (d *Document) absolute(id string) string {
+	if strings.HasPrefix(id, "#") {
+		return d.ID + id
+	}
+	return id
+}
+
+// AssertionKey finds the assertionMethod key matching kid, which may be a full
+// DID URL, a fragment or the JWK kid. An empty kid matches the only key.
+func (d Document) AssertionKey(kid string) (JWK, error) {
+	var candidates []JWK
+	for _, method := range d.VerificationMethod {
+		if method.PublicKeyJwk == nil || !containsString(d.AssertionMethod, d.absolute(method.ID)) {
+			continue
+		}
+		id := d.absolute(method.ID)
+		if kid != "" && (id == kid || id == d.ID+"#"+kid || method.PublicKeyJwk.Kid == kid) {
+			return *method.PublicKeyJwk, nil
+		}
+		candidates = append(candidates, *method.PublicKeyJwk)
+	}
+	if kid == "" && len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	return JWK{}, fmt.Errorf("%w: %s#%s", ErrKeyNotFound, d.ID, kid)
+}
+
+type cacheEntry struct {
+	did        string
+	doc        Document
+	fetchedAt  time.Time
+	refreshing bool
+	element    *list.Element // in Resolver.recent
+}
+
+// Resolver resolves DIDs through the registered methods with caching
+type Resolver struct {
+	TTL        time.Duration
+	MaxStale   time.Duration // how long past TTL a document may still be served
+	MaxEntries int           // how many documents are cached; 0 is unbounded
+	now        func() time.Time
+
+	mu      sync.Mutex
+	methods map[string]Method
+	cache   map[string]*cacheEntry
+	recent  *list.List // of *cacheEntry, most recently used first
+	sweptAt time.Time
+}
+
+// New creates a resolver for did:web and did:jwk with the default TTLs and
+// cache size
+func New() *Resolver {
+	r := &Resolver{
+		TTL:        DefaultTTL,
+		MaxStale:   DefaultMaxStale,
+		MaxEntries: DefaultMaxEntries,
+		now:        time.Now,
+		methods:    make(map[string]Method),
+		cache:      make(map[string]*cacheEntry),
+		recent:     list.New(),
+	}
+	r.Register("web", NewWebMethod(deadline.NewClient("did-web")))
+	r.Register("jwk", MethodFunc(ResolveJWK))
+	return r
+}
+
+// Register installs or replaces the resolver for a DID method
+func (r *Resolver) Register(method string, m Method) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.methods[method] = m
+}
+
+func methodName(did string) (string, error) {
+	parts := strings.SplitN(did, ":", 3)
+	if len(parts) != 3 || parts[0] != "did" || parts[1] == "" || parts[2] == "" {
+		return "", fmt.Errorf("invalid DID %q", did)
+	}
+	return parts[1], nil
+}
+
+// Resolve returns the DID document for did, from the cache when fresh enough
+func (r *Resolver) Resolve(ctx context.Context, did string) (Document, error) {
+	name, err := methodName(did)
+	if err != nil {
+		return Document{}, err
+	}
+	r.mu.Lock()
+	method, ok := r.methods[name]
+	entry := r.cache[did]
+	now := r.now()
+	switch {
+	case !ok:
+		r.mu.Unlock()
+		return Document{}, fmt.Errorf("%w: did:%s", ErrUnsupportedMethod, name)
+	case entry != nil && now.Sub(entry.fetchedAt) < r.TTL:
+		r.recent.MoveToFront(entry.element)
+		r.mu.Unlock()
+		resolutions.Add("hit", 1)
+		return entry.doc, nil
+	case entry != nil && now.Sub(entry.fetchedAt) < r.TTL+r.MaxStale:
+		// Serve the stale document and revalidate in the background
+		if !entry.refreshing {
+			entry.refreshing = true
+			go r.refresh(did, method)
+		}
+		r.recent.MoveToFront(entry.element)
+		r.mu.Unlock()
+		resolutions.Add("stale", 1)
+		return entry.doc, nil
+	}
+	r.mu.Unlock()
+
+	resolutions.Add("miss", 1)
+	doc, err := method.Resolve(ctx, did)
+	if err != nil {
+		resolutions.Add("error", 1)
+		return Document{}, err
+	}
+	r.store(did, doc)
+	return doc, nil
+}
+
+func (r *Resolver) refresh(did string, method Method) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	doc, err := method.Resolve(ctx, did)
+	if err != nil {
+		resolutions.Add("error", 1)
+		r.mu.Lock()
+		if entry := r.cache[did]; entry != nil {
+			entry.refreshing = false
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.store(did, doc)
+}
+
+// store caches a document as the most recently used, then drops what the
+// cache no longer has room or use for
+func (r *Resolver) store(did string, doc Document) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if entry := r.cache[did]; entry != nil {
+		r.recent.Remove(entry.element)
+	}
+	entry := &cacheEntry{did: did, doc: doc, fetchedAt: now}
+	entry.element = r.recent.PushFront(entry)
+	r.cache[did] = entry
+
+	r.sweep(now)
+	for r.MaxEntries > 0 && r.recent.Len() > r.MaxEntries {
+		r.evict(r.recent.Back().Value.(*cacheEntry))
+	}
+}
+
+// sweep drops the documents too old to be served, at most once per TTL
+func (r *Resolver) sweep(now time.Time) {
+	if now.Sub(r.sweptAt) < r.TTL {
+		return
+	}
+	r.sweptAt = now
+	for _, entry := range r.cache {
+		if now.Sub(entry.fetchedAt) >= r.TTL+r.MaxStale {
+			r.evict(entry)
+		}
+	}
+}
+
+func (r *Resolver) evict(entry *cacheEntry) {
+	r.recent.Remove(entry.element)
+	delete(r.cache, entry.did)
+}
+
+// ResolveKey resolves did and returns the assertionMethod key matching kid
+func (r *Resolver) ResolveKey(ctx context.Context, did, kid string) (JWK, error) {
+	doc, err := r.Resolve(ctx, did)
+	if err != nil {
+		return JWK{}, err
+	}
+	return doc.AssertionKey(kid)
+}
+
+func containsString(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
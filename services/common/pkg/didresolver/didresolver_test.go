@@ -0,0 +1,236 @@
+package didresolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ecJWK(t *testing.T) (*ecdsa.PrivateKey, JWK) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key, JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// countingMethod resolves to doc, or fails while failing is set
+type countingMethod struct {
+	mu      sync.Mutex
+	calls   int
+	failing bool
+	doc     Document
+	done    chan struct{}
+}
+
+func (m *countingMethod) Resolve(ctx context.Context, did string) (Document, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.done != nil {
+		defer func() { m.done <- struct{}{} }()
+	}
+	if m.failing {
+		return Document{}, errors.New("host unreachable")
+	}
+	return m.doc, nil
+}
+
+func TestWebURL(t *testing.T) {
+	u, err := WebURL("did:web:cachet.id")
+	require.NoError(t, err)
+	assert.Equal(t, "https://cachet.id/.well-known/did.json", u)
+
+	u, err = WebURL("did:web:example.com%3A8443:issuers:alpha")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com:8443/issuers/alpha/did.json", u)
+
+	_, err = WebURL("did:key:z6Mk")
+	assert.Error(t, err)
+}
+
+func TestWebMethod(t *testing.T) {
+	key, jwk := ecJWK(t)
+	var did string
+	host := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/.well-known/did.json", r.URL.Path)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": did,
+			"verificationMethod": []map[string]interface{}{{
+				"id": "#key-1", "type": "JsonWebKey2020", "controller": did, "publicKeyJwk": jwk,
+			}},
+			// An embedded authentication key is not usable for assertions
+			"authentication":  []interface{}{map[string]interface{}{"id": "#auth", "type": "JsonWebKey2020", "controller": did, "publicKeyJwk": jwk}},
+			"assertionMethod": []string{"#key-1"},
+		})
+	}))
+	defer host.Close()
+	did = "did:web:" + strings.ReplaceAll(strings.TrimPrefix(host.URL, "https://"), ":", "%3A")
+
+	resolver := New()
+	resolver.Register("web", NewWebMethod(host.Client()))
+
+	found, err := resolver.ResolveKey(context.Background(), did, "key-1")
+	require.NoError(t, err)
+	public, err := found.PublicKey()
+	require.NoError(t, err)
+	assert.True(t, key.PublicKey.Equal(public))
+
+	_, err = resolver.ResolveKey(context.Background(), did, "auth")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestResolveJWK(t *testing.T) {
+	_, jwk := ecJWK(t)
+	encoded, err := json.Marshal(jwk)
+	require.NoError(t, err)
+	did := "did:jwk:" + base64.RawURLEncoding.EncodeToString(encoded)
+
+	key, err := New().ResolveKey(context.Background(), did, did+"#0")
+	require.NoError(t, err)
+	assert.Equal(t, jwk, key)
+
+	_, err = ResolveJWK(context.Background(), "did:jwk:"+base64.RawURLEncoding.EncodeToString([]byte(`{"kty":"EC","crv":"P-256","x":"AA","y":"AA","d":"AA"}`)))
+	assert.Error(t, err)
+}
+
+func TestResolve_UnsupportedMethod(t *testing.T) {
+	_, err := New().Resolve(context.Background(), "did:example:123")
+	assert.ErrorIs(t, err, ErrUnsupportedMethod)
+
+	_, err = New().Resolve(context.Background(), "not-a-did")
+	assert.Error(t, err)
+}
+
+func TestResolve_StaleWhileRevalidate(t *testing.T) {
+	method := &countingMethod{doc: Document{ID: "did:test:a"}, done: make(chan struct{}, 1)}
+	resolver := New()
+	resolver.Register("test", method)
+	var clock atomic.Int64
+	start := time.Now()
+	resolver.now = func() time.Time { return start.Add(time.Duration(clock.Load())) }
+
+	_, err := resolver.Resolve(context.Background(), "did:test:a")
+	require.NoError(t, err)
+	<-method.done
+
+	// Fresh: served from the cache
+	_, err = resolver.Resolve(context.Background(), "did:test:a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, method.calls)
+
+	// Stale while the host is down: the cached document is still served
+	method.mu.Lock()
+	method.failing = true
+	method.mu.Unlock()
+	clock.Store(int64(resolver.TTL + time.Minute))
+	doc, err := resolver.Resolve(context.Background(), "did:test:a")
+	require.NoError(t, err)
+	assert.Equal(t, "did:test:a", doc.ID)
+	<-method.done
+
+	// Past MaxStale the failure surfaces
+	clock.Store(int64(resolver.TTL + resolver.MaxStale))
+	_, err = resolver.Resolve(context.Background(), "did:test:a")
+	assert.Error(t, err)
+	<-method.done
+	method.mu.Lock()
+	assert.Equal(t, 3, method.calls)
+	method.mu.Unlock()
+}
+
+func TestResolve_CacheBounded(t *testing.T) {
+	resolver := New()
+	resolver.Register("test", MethodFunc(func(ctx context.Context, did string) (Document, error) {
+		return Document{ID: did}, nil
+	}))
+	resolver.MaxEntries = 2
+	var clock atomic.Int64
+	start := time.Now()
+	resolver.now = func() time.Time { return start.Add(time.Duration(clock.Load())) }
+	resolve := func(did string) {
+		t.Helper()
+		_, err := resolver.Resolve(context.Background(), did)
+		require.NoError(t, err)
+	}
+	cached := func() []string {
+		resolver.mu.Lock()
+		defer resolver.mu.Unlock()
+		var dids []string
+		for did := range resolver.cache {
+			dids = append(dids, did)
+		}
+		return dids
+	}
+
+	// Past MaxEntries the least recently used document is evicted
+	resolve("did:test:a")
+	resolve("did:test:b")
+	resolve("did:test:a")
+	resolve("did:test:c")
+	assert.ElementsMatch(t, []string{"did:test:a", "did:test:c"}, cached())
+
+	// Documents too old to be served are dropped as new ones are stored
+	resolver.MaxEntries = 0
+	clock.Store(int64(resolver.TTL + resolver.MaxStale))
+	resolve("did:test:d")
+	assert.Equal(t, []string{"did:test:d"}, cached())
+}
+
+func TestJWK_BBSPublicKey(t *testing.T) {
+	key, err := bbs.GenerateKey(nil)
+	require.NoError(t, err)
+	jwk := JWK{Kty: "OKP", Crv: CurveBLS12381G2, X: base64.RawURLEncoding.EncodeToString(key.Public().Bytes())}
+	public, err := jwk.PublicKey()
+	require.NoError(t, err)
+	assert.True(t, key.Public().Equal(public))
+
+	jwk.X = base64.RawURLEncoding.EncodeToString([]byte("not a point"))
+	_, err = jwk.PublicKey()
+	assert.Error(t, err)
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// The example of RFC 7638 section 3.1
+	rsaKey := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Kid: "2011-04-29",
+		Alg: "RS256",
+	}
+	thumbprint, err := rsaKey.Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+
+	// Only the required members count
+	_, ecKey := ecJWK(t)
+	thumbprint, err = ecKey.Thumbprint()
+	require.NoError(t, err)
+	ecKey.Kid, ecKey.Use, ecKey.Alg = "another-kid", "sig", "ES256"
+	again, err := ecKey.Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, thumbprint, again)
+
+	_, err = JWK{Kty: "oct"}.Thumbprint()
+	assert.Error(t, err)
+}
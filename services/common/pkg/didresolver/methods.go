@@ -0,0 +1,111 @@
+package didresolver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxDocumentSize bounds a fetched DID document
+const maxDocumentSize = 1 << 20
+
+// WebURL maps a did:web identifier to its document URL
+func WebURL(did string) (string, error) {
+	id, ok := strings.CutPrefix(did, "did:web:")
+	if !ok || id == "" {
+		return "", fmt.Errorf("not a did:web identifier: %q", did)
+	}
+	segments := strings.Split(id, ":")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", fmt.Errorf("invalid did:web identifier: %w", err)
+		}
+		segments[i] = decoded
+	}
+	if len(segments) == 1 {
+		return "https://" + segments[0] + "/.well-known/did.json", nil
+	}
+	return "https://" + strings.Join(segments, "/") + "/did.json", nil
+}
+
+// WebMethod resolves did:web by fetching the document over HTTPS
+type WebMethod struct {
+	Client *http.Client
+}
+
+func NewWebMethod(client *http.Client) *WebMethod {
+	return &WebMethod{Client: client}
+}
+
+func (m *WebMethod) Resolve(ctx context.Context, did string) (Document, error) {
+	docURL, err := WebURL(did)
+	if err != nil {
+		return Document{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return Document{}, err
+	}
+	req.Header.Set("Accept", "application/did+json, application/json")
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return Document{}, fmt.Errorf("fetching DID document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Document{}, fmt.Errorf("fetching DID document: status %d", resp.StatusCode)
+	}
+
+	var doc Document
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentSize)).Decode(&doc); err != nil {
+		return Document{}, fmt.Errorf("decoding DID document: %w", err)
+	}
+	if doc.ID != did {
+		return Document{}, fmt.Errorf("DID document id %q does not match %q", doc.ID, did)
+	}
+	return doc, nil
+}
+
+// ResolveJWK expands a did:jwk, whose identifier is the base64url-encoded
+// public JWK, into a single-key document
+func ResolveJWK(_ context.Context, did string) (Document, error) {
+	encoded, ok := strings.CutPrefix(did, "did:jwk:")
+	if !ok || encoded == "" {
+		return Document{}, fmt.Errorf("not a did:jwk identifier: %q", did)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Document{}, fmt.Errorf("invalid did:jwk encoding: %w", err)
+	}
+	var key JWK
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return Document{}, fmt.Errorf("invalid did:jwk key: %w", err)
+	}
+	var private struct {
+		D string `json:"d"`
+	}
+	if json.Unmarshal(raw, &private) == nil && private.D != "" {
+		return Document{}, fmt.Errorf("did:jwk must not contain a private key")
+	}
+	if _, err := key.PublicKey(); err != nil {
+		return Document{}, fmt.Errorf("invalid did:jwk key: %w", err)
+	}
+
+	id := did + "#0"
+	doc := Document{
+		ID:                 did,
+		VerificationMethod: []VerificationMethod{{ID: id, Type: "JsonWebKey2020", Controller: did, PublicKeyJwk: &key}},
+	}
+	// Keys marked for encryption cannot sign
+	if key.Use != "enc" {
+		doc.Authentication = []string{id}
+		doc.AssertionMethod = []string{id}
+	}
+	return doc, nil
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Handler consumes an event. Returning an error has it delivered again
+// later, to this or another instance of the group.
+type Handler func(ctx context.Context, event Event) error
+
+// Bus publishes events and delivers them to consumer groups
+type Bus interface {
+	// Publish sends an event to every group taking its type
+	Publish(ctx context.Context, event Event) error
+	// Subscribe joins group, taking events of the given types, or of every
+	// type when none are given. Instances of a service subscribe under the
+	// same group so each event is handled once per service.
+	Subscribe(group string, types []string, handler Handler) error
+	// Close stops delivering events and waits for handlers in progress
+	Close() error
+}
+
+// ErrClosed is returned when publishing to or subscribing on a closed bus
+var ErrClosed = errors.New("event bus is closed")
+
+// Config is the event bus configuration services embed in their own
+type Config struct {
+	URL string `env:"EVENT_BUS_URL" doc:"Event bus services notify each other on: pubsub://PROJECT/TOPIC for Google Pub/Sub (PUBSUB_EMULATOR_HOST selects the emulator), or memory:// within the process; events are neither published nor consumed without it"`
+}
+
+// groupPattern keeps group names usable in Pub/Sub subscription names
+var groupPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+
+// Validate checks the bus URL names a driver and its target
+func (c Config) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("EVENT_BUS_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return nil
+	case "pubsub":
+		if u.Host == "" || strings.Trim(u.Path, "/") == "" || strings.Contains(strings.Trim(u.Path, "/"), "/") {
+			return fmt.Errorf("EVENT_BUS_URL: %q is not of the form pubsub://PROJECT/TOPIC", c.URL)
+		}
+		return nil
+	}
+	return fmt.Errorf("EVENT_BUS_URL: unknown scheme %q, use pubsub:// or memory://", u.Scheme)
+}
+
+// Open connects to the configured bus. It returns nil when none is
+// configured, and services then publish nothing.
+func Open(c Config) (Bus, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, nil
+	}
+	u, _ := url.Parse(c.URL)
+	if u.Scheme == "memory" {
+		return NewMemory(), nil
+	}
+	bus := NewPubSub(u.Host, strings.Trim(u.Path, "/"))
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		bus.endpoint, bus.tokens = "http://"+host+"/v1/", nil
+	}
+	return bus, nil
+}
+
+// checkSubscription checks a group name, and turns types into a set
+func checkSubscription(group string, types []string) (map[string]bool, error) {
+	if !groupPattern.MatchString(group) {
+		return nil, fmt.Errorf("consumer group %q must be lowercase letters, digits and dashes", group)
+	}
+	set := make(map[string]bool, len(types))
+	for _, eventType := range types {
+		set[eventType] = true
+	}
+	return set, nil
+}
+
+// takes reports whether a subscription to types takes events of eventType
+func takes(types map[string]bool, eventType string) bool {
+	return len(types) == 0 || types[eventType]
+}
@@ -0,0 +1,267 @@
+// Package events carries notifications between Cachet services.
+//
+// Services publish what happened to them (a credential issued, revoked or
+// expiring soon, a verification completed, a vouch given or withdrawn, a
+// subject flagged by a partner) as typed events on a Bus, and other
+// services consume them in consumer groups: every group sees each event,
+// and within a group each event is handled by one instance.
+// Delivery is at least once, so handlers must tolerate redeliveries, which
+// keep the event's ID.
+//
+// Events are encoded deterministically, so the same event always has the
+// same bytes and can be hashed, signed or compared across services.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	TypeCredentialIssued      = "credential.issued"
+	TypeCredentialRevoked     = "credential.revoked"
+	TypeCredentialSuspended   = "credential.suspended"
+	TypeCredentialReinstated  = "credential.reinstated"
+	TypeCredentialExpiring    = "credential.expiring"
+	TypeVerificationCompleted = "verification.completed"
+	TypeVouchCreated          = "vouch.created"
+	TypeVouchRevoked          = "vouch.revoked"
+	TypeSubjectFlagged        = "subject.flagged"
+	TypeSubjectFlagCleared    = "subject.flag_cleared"
+)
+
+// Event is the envelope every event travels in
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Source is the service that published the event
+	Source string `json:"source"`
+	// Subject is what the event is about: a credential, a verification
+	// session or a vouch
+	Subject string          `json:"subject"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Data is the typed payload of an event
+type Data interface {
+	EventType() string
+}
+
+// CredentialIssued is the data of a credential.issued event
+type CredentialIssued struct {
+	CredentialID string   `json:"credentialId"`
+	Types        []string `json:"types"`
+	Format       string   `json:"format,omitempty"`
+	// Issuer is the DID that signed the credential, when the gateway did
+	Issuer string `json:"issuer,omitempty"`
+	// JourneyID is the issuance journey, for identity credentials
+	JourneyID string `json:"journeyId,omitempty"`
+	// VouchID is the vouch attested, for vouch credentials
+	VouchID         string `json:"vouchId,omitempty"`
+	StatusListIndex string `json:"statusListIndex,omitempty"`
+}
+
+func (CredentialIssued) EventType() string { return TypeCredentialIssued }
+
+// CredentialRevoked is the data of a credential.revoked event
+type CredentialRevoked struct {
+	CredentialID    string `json:"credentialId"`
+	StatusListIndex string `json:"statusListIndex,omitempty"`
+	// Reason is why the issuer revoked it, such as the subject's erasure
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+func (CredentialRevoked) EventType() string { return TypeCredentialRevoked }
+
+// CredentialSuspended is the data of a credential.suspended event: the
+// credential is on hold, such as during a fraud investigation, until it is
+// reinstated or revoked
+type CredentialSuspended struct {
+	CredentialID    string    `json:"credentialId"`
+	StatusListIndex string    `json:"statusListIndex,omitempty"`
+	Reason          string    `json:"reason"`
+	SuspendedAt     time.Time `json:"suspendedAt"`
+}
+
+func (CredentialSuspended) EventType() string { return TypeCredentialSuspended }
+
+// CredentialReinstated is the data of a credential.reinstated event, ending
+// a suspension
+type CredentialReinstated struct {
+	CredentialID    string    `json:"credentialId"`
+	StatusListIndex string    `json:"statusListIndex,omitempty"`
+	ReinstatedAt    time.Time `json:"reinstatedAt"`
+}
+
+func (CredentialReinstated) EventType() string { return TypeCredentialReinstated }
+
+// CredentialExpiring is the data of a credential.expiring event: the
+// credential expires soon, and its holder can renew it in one tap by
+// redeeming the renewal offer with the key the credential is bound to
+type CredentialExpiring struct {
+	CredentialID   string `json:"credentialId"`
+	CredentialType string `json:"credentialType"`
+	// HolderJKT is the thumbprint of the holder's wallet key, which the
+	// renewal must be proven with
+	HolderJKT string    `json:"holderJkt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// RenewBy is the last moment the credential can be renewed
+	RenewBy time.Time `json:"renewBy"`
+	// OfferURI is the openid-credential-offer:// deep link of the renewal
+	// offer
+	OfferURI string `json:"offerUri"`
+}
+
+func (CredentialExpiring) EventType() string { return TypeCredentialExpiring }
+
+// VerificationCompleted is the data of a verification.completed event
+type VerificationCompleted struct {
+	SessionID string `json:"sessionId"`
+	PolicyID  string `json:"policyId"`
+	RPID      string `json:"rpId,omitempty"`
+	// Status is verified or failed
+	Status    string `json:"status"`
+	Satisfied bool   `json:"satisfied"`
+	Error     string `json:"error,omitempty"`
+	// ReceiptHash is the urn:sha256 digest of the consent receipt, for the
+	// receipts-log to anchor, and ReceiptHolder the urn:sha256 digest of
+	// the holder's DID, which lets the log tombstone a holder's receipts
+	ReceiptHash   string       `json:"receiptHash,omitempty"`
+	ReceiptHolder string       `json:"receiptHolder,omitempty"`
+	Badge         *BadgeIssued `json:"badge,omitempty"`
+}
+
+// BadgeIssued is the signed badge a verification earned
+type BadgeIssued struct {
+	Label     string    `json:"label"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	JWS       string    `json:"jws"`
+}
+
+func (VerificationCompleted) EventType() string { return TypeVerificationCompleted }
+
+// VouchCreated is the data of a vouch.created event
+type VouchCreated struct {
+	VouchID   string `json:"vouchId"`
+	Voucher   string `json:"voucher"`
+	Subject   string `json:"subject"`
+	VouchType string `json:"vouchType"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func (VouchCreated) EventType() string { return TypeVouchCreated }
+
+// VouchRevoked is the data of a vouch.revoked event
+type VouchRevoked struct {
+	VouchID   string    `json:"vouchId"`
+	Voucher   string    `json:"voucher"`
+	Subject   string    `json:"subject"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+func (VouchRevoked) EventType() string { return TypeVouchRevoked }
+
+// SubjectFlagged is the data of a subject.flagged event: a partner
+// platform reported a dispute or suspected fraud about a linked subject
+type SubjectFlagged struct {
+	FlagID  string `json:"flagId"`
+	Subject string `json:"subject"`
+	Partner string `json:"partner"`
+	// Kind is dispute or fraud, and Severity low, medium or high
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	// Suspend asks for the subject's credentials to be held while the flag
+	// stands
+	Suspend   bool      `json:"suspend,omitempty"`
+	FlaggedAt time.Time `json:"flaggedAt"`
+}
+
+func (SubjectFlagged) EventType() string { return TypeSubjectFlagged }
+
+// SubjectFlagCleared is the data of a subject.flag_cleared event: the flag
+// no longer counts against the subject
+type SubjectFlagCleared struct {
+	FlagID  string `json:"flagId"`
+	Subject string `json:"subject"`
+	// Outcome is dismissed, by an operator, or withdrawn, by the partner
+	Outcome   string    `json:"outcome"`
+	ClearedAt time.Time `json:"clearedAt"`
+}
+
+func (SubjectFlagCleared) EventType() string { return TypeSubjectFlagCleared }
+
+// New wraps data in an event published by source about subject
+func New(source, subject string, data Data, now time.Time) (Event, error) {
+	encoded, err := canonical(data)
+	if err != nil {
+		return Event{}, fmt.Errorf("encoding %s data: %w", data.EventType(), err)
+	}
+	return Event{
+		ID:      "evt-" + uuid.NewString(),
+		Type:    data.EventType(),
+		Source:  source,
+		Subject: subject,
+		Time:    now.UTC().Truncate(time.Millisecond),
+		Data:    encoded,
+	}, nil
+}
+
+// Decode reads the event's data into data, which must be of the event's
+// type
+func (e Event) Decode(data Data) error {
+	if data.EventType() != e.Type {
+		return fmt.Errorf("event %s is a %s, not a %s", e.ID, e.Type, data.EventType())
+	}
+	if err := json.Unmarshal(e.Data, data); err != nil {
+		return fmt.Errorf("decoding %s data of %s: %w", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+// Marshal encodes an event deterministically: object members sorted by
+// name, no insignificant whitespace and times in UTC
+func Marshal(e Event) ([]byte, error) {
+	e.Time = e.Time.UTC()
+	return canonical(e)
+}
+
+// Unmarshal decodes an event encoded by Marshal
+func Unmarshal(encoded []byte) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(encoded, &e); err != nil {
+		return Event{}, fmt.Errorf("decoding event: %w", err)
+	}
+	if e.ID == "" || e.Type == "" {
+		return Event{}, fmt.Errorf("decoding event: id and type are required")
+	}
+	return e, nil
+}
+
+// canonical encodes value as JSON and re-encodes it through generic maps,
+// which encoding/json writes with sorted keys; numbers keep their text
+func canonical(value any) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var generic any
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,235 @@
+package events
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal_Deterministic(t *testing.T) {
+	at := time.Date(2025, 9, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	event, err := New("verifier", "session-1", VerificationCompleted{
+		SessionID:   "session-1",
+		PolicyID:    "safe-seller",
+		Status:      "verified",
+		Satisfied:   true,
+		ReceiptHash: "urn:sha256:ab<>",
+	}, at)
+	require.NoError(t, err)
+	event.ID = "evt-1"
+
+	encoded, err := Marshal(event)
+	require.NoError(t, err)
+	assert.Equal(t, `{"data":{"policyId":"safe-seller","receiptHash":"urn:sha256:ab<>","satisfied":true,"sessionId":"session-1","status":"verified"},"id":"evt-1","source":"verifier","subject":"session-1","time":"2025-09-01T10:00:00Z","type":"verification.completed"}`, string(encoded))
+
+	// Data in another member order encodes the same
+	event.Data = json.RawMessage(`{"status":"verified","sessionId":"session-1","satisfied":true,"receiptHash":"urn:sha256:ab<>","policyId":"safe-seller"}`)
+	again, err := Marshal(event)
+	require.NoError(t, err)
+	assert.Equal(t, encoded, again)
+
+	decoded, err := Unmarshal(encoded)
+	require.NoError(t, err)
+	var data VerificationCompleted
+	require.NoError(t, decoded.Decode(&data))
+	assert.Equal(t, "safe-seller", data.PolicyID)
+	assert.ErrorContains(t, decoded.Decode(&VouchCreated{}), "is a verification.completed, not a vouch.created")
+
+	_, err = Unmarshal([]byte(`{"type":"vouch.created"}`))
+	assert.ErrorContains(t, err, "id and type are required")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for url, want := range map[string]string{
+		"":                        "",
+		"memory://":               "",
+		"pubsub://cachet/events":  "",
+		"pubsub://cachet":         "is not of the form pubsub://PROJECT/TOPIC",
+		"pubsub://cachet/a/b":     "is not of the form pubsub://PROJECT/TOPIC",
+		"nats://localhost:4222":   `unknown scheme "nats"`,
+		"https://events.internal": `unknown scheme "https"`,
+	} {
+		err := Config{URL: url}.Validate()
+		if want == "" {
+			assert.NoError(t, err, url)
+		} else {
+			assert.ErrorContains(t, err, want, url)
+		}
+	}
+	bus, err := Open(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, bus)
+}
+
+func vouchCreated(t *testing.T, id string) Event {
+	event, err := New("vouching-service", id, VouchCreated{VouchID: id, Voucher: "did:example:a", Subject: "did:example:b", VouchType: "knows"}, time.Now())
+	require.NoError(t, err)
+	return event
+}
+
+func TestMemory_ConsumerGroups(t *testing.T) {
+	bus := NewMemory()
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	record := func(name string) Handler {
+		return func(ctx context.Context, event Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name] = append(handled[name], event.Subject)
+			return nil
+		}
+	}
+	// Two instances of the hub share a group; the log has its own
+	require.NoError(t, bus.Subscribe("connector-hub", []string{TypeVouchCreated}, record("hub-1")))
+	require.NoError(t, bus.Subscribe("connector-hub", []string{TypeVouchCreated}, record("hub-2")))
+	require.NoError(t, bus.Subscribe("receipts-log", []string{TypeVerificationCompleted}, record("log")))
+	assert.ErrorContains(t, bus.Subscribe("connector-hub", nil, record("hub-3")), "already takes other event types")
+	assert.ErrorContains(t, bus.Subscribe("Connector Hub", nil, record("hub-3")), "lowercase letters")
+
+	for _, id := range []string{"vouch-1", "vouch-2", "vouch-3", "vouch-4"} {
+		require.NoError(t, bus.Publish(context.Background(), vouchCreated(t, id)))
+	}
+	require.NoError(t, bus.Close())
+
+	assert.Len(t, append(handled["hub-1"], handled["hub-2"]...), 4)
+	assert.ElementsMatch(t, []string{"vouch-1", "vouch-2", "vouch-3", "vouch-4"}, append(handled["hub-1"], handled["hub-2"]...))
+	assert.Empty(t, handled["log"])
+	assert.ErrorIs(t, bus.Publish(context.Background(), vouchCreated(t, "vouch-5")), ErrClosed)
+}
+
+func TestMemory_Redelivers(t *testing.T) {
+	bus := NewMemory()
+	bus.backoff = time.Millisecond
+	attempts := 0
+	require.NoError(t, bus.Subscribe("receipts-log", nil, func(ctx context.Context, event Event) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("database unavailable")
+		}
+		return nil
+	}))
+	require.NoError(t, bus.Publish(context.Background(), vouchCreated(t, "vouch-1")))
+	require.NoError(t, bus.Close())
+	assert.Equal(t, 3, attempts)
+}
+
+// fakePubSub serves the slice of the Pub/Sub REST API the driver uses
+type fakePubSub struct {
+	mu            sync.Mutex
+	subscriptions map[string]string // name to filter
+	published     []pubsubMessage
+	acked, nacked []string
+	delivered     bool
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.URL.Path == "/token":
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600}`))
+		return
+	case r.Header.Get("Authorization") != "Bearer ya29.token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.URL.Path == "/v1/projects/cachet/topics/events:publish":
+		var publish struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		encoded, _ := json.Marshal(body)
+		json.Unmarshal(encoded, &publish)
+		f.published = append(f.published, publish.Messages...)
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	case r.Method == http.MethodPut:
+		if _, ok := f.subscriptions[r.URL.Path]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		filter, _ := body["filter"].(string)
+		f.subscriptions[r.URL.Path] = filter
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/v1/projects/cachet/subscriptions/events-receipts-log:pull":
+		if f.delivered || len(f.published) == 0 {
+			w.Write([]byte(`{}`))
+			return
+		}
+		f.delivered = true
+		not, _ := json.Marshal(pubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(`"not an event"`)), MessageID: "2"})
+		json.NewEncoder(w).Encode(map[string]any{"receivedMessages": []map[string]any{
+			{"ackId": "ack-1", "message": f.published[0]},
+			{"ackId": "ack-2", "message": json.RawMessage(not)},
+			{"ackId": "ack-3", "message": f.published[len(f.published)-1]},
+		}})
+	case r.URL.Path == "/v1/projects/cachet/subscriptions/events-receipts-log:acknowledge":
+		for _, id := range body["ackIds"].([]any) {
+			f.acked = append(f.acked, id.(string))
+		}
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/v1/projects/cachet/subscriptions/events-receipts-log:modifyAckDeadline":
+		for _, id := range body["ackIds"].([]any) {
+			f.nacked = append(f.nacked, id.(string))
+		}
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	fake := &fakePubSub{subscriptions: map[string]string{"/v1/projects/cachet/subscriptions/events-connector-hub": ""}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	bus := NewPubSub("cachet", "events")
+	bus.endpoint, bus.tokens, bus.idleWait = server.URL+"/v1/", gcpauth.NewTokenSource(server.URL+"/token", server.Client()), 10*time.Millisecond
+
+	completed, err := New("verifier", "session-1", VerificationCompleted{SessionID: "session-1", Status: "verified", ReceiptHash: "urn:sha256:ab"}, time.Now())
+	require.NoError(t, err)
+	failed, err := New("verifier", "session-2", VerificationCompleted{SessionID: "session-2", Status: "failed"}, time.Now())
+	require.NoError(t, err)
+
+	handled := make(chan Event, 2)
+	require.NoError(t, bus.Subscribe("receipts-log", []string{TypeVerificationCompleted, TypeCredentialIssued}, func(ctx context.Context, event Event) error {
+		handled <- event
+		if event.Subject == "session-2" {
+			return errors.New("try again")
+		}
+		return nil
+	}))
+	// Existing subscriptions are reused
+	require.NoError(t, bus.Subscribe("connector-hub", nil, func(ctx context.Context, event Event) error { return nil }))
+
+	require.NoError(t, bus.Publish(context.Background(), completed))
+	require.NoError(t, bus.Publish(context.Background(), failed))
+	for _, want := range []string{"session-1", "session-2"} {
+		select {
+		case event := <-handled:
+			assert.Equal(t, want, event.Subject)
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+	require.NoError(t, bus.Close())
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, `attributes.type = "credential.issued" OR attributes.type = "verification.completed"`, fake.subscriptions["/v1/projects/cachet/subscriptions/events-receipts-log"])
+	require.Len(t, fake.published, 2)
+	assert.Equal(t, map[string]string{"id": completed.ID, "type": TypeVerificationCompleted, "source": "verifier"}, fake.published[0].Attributes)
+	encoded, _ := Marshal(completed)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(encoded), fake.published[0].Data)
+	// The undecodable message is dropped, the failed one handed back
+	assert.Equal(t, []string{"ack-1", "ack-2"}, fake.acked)
+	assert.Equal(t, []string{"ack-3"}, fake.nacked)
+}
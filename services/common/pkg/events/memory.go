@@ -0,0 +1,137 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// memoryBuffer is how many events a group may fall behind by before
+	// publishing fails
+	memoryBuffer = 1024
+	// memoryAttempts bounds the deliveries of an event a handler keeps
+	// failing, after which it is dropped
+	memoryAttempts = 5
+)
+
+// Memory is a Bus within one process, for tests and single-process
+// development. Events are lost on restart.
+type Memory struct {
+	// backoff is the wait before the first redelivery, doubling after each
+	backoff time.Duration
+
+	mu     sync.RWMutex
+	groups map[string]*memoryGroup
+	closed bool
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type memoryGroup struct {
+	types map[string]bool
+	queue chan Event
+}
+
+// NewMemory returns an empty in-memory bus
+func NewMemory() *Memory {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Memory{
+		backoff: 100 * time.Millisecond,
+		groups:  make(map[string]*memoryGroup),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Publish queues the event for every group taking its type, without
+// waiting for it to be handled
+func (m *Memory) Publish(ctx context.Context, event Event) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	for name, group := range m.groups {
+		if !takes(group.types, event.Type) {
+			continue
+		}
+		select {
+		case group.queue <- event:
+		default:
+			return fmt.Errorf("consumer group %s is %d events behind", name, memoryBuffer)
+		}
+	}
+	return nil
+}
+
+// Subscribe adds a consumer to group. Consumers of a group compete for its
+// events, so they must take the same types.
+func (m *Memory) Subscribe(group string, types []string, handler Handler) error {
+	set, err := checkSubscription(group, types)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	g, ok := m.groups[group]
+	switch {
+	case !ok:
+		g = &memoryGroup{types: set, queue: make(chan Event, memoryBuffer)}
+		m.groups[group] = g
+	case !maps.Equal(g.types, set):
+		return fmt.Errorf("consumer group %s already takes other event types", group)
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for event := range g.queue {
+			m.deliver(group, handler, event)
+		}
+	}()
+	return nil
+}
+
+// deliver hands the event to the handler until it succeeds or attempts run
+// out
+func (m *Memory) deliver(group string, handler Handler, event Event) {
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		err := handler(m.ctx, event)
+		if err == nil {
+			return
+		}
+		if attempt == memoryAttempts || m.ctx.Err() != nil {
+			log.Error().Err(err).Str("group", group).Str("event_id", event.ID).Str("type", event.Type).Int("attempts", attempt).Msg("Dropping event its consumer keeps failing")
+			return
+		}
+		log.Warn().Err(err).Str("group", group).Str("event_id", event.ID).Str("type", event.Type).Msg("Event consumer failed; redelivering")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Close stops taking events and waits for the queued ones to be handled
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	for _, group := range m.groups {
+		close(group.queue)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	m.cancel()
+	return nil
+}
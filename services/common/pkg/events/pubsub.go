@@ -0,0 +1,274 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pubsubEndpoint = "https://pubsub.googleapis.com/v1/"
+	// pubsubAckDeadline is how long a handler has before Pub/Sub hands the
+	// event to another instance
+	pubsubAckDeadline = 60 * time.Second
+	pubsubMaxMessages = 10
+	pubsubMaxBackoff  = 30 * time.Second
+)
+
+// PubSub is a Bus on a Google Pub/Sub topic, spoken to over its REST API
+// as the service account the metadata server vouches for. Each consumer
+// group is a subscription to the topic named <topic>-<group>, created on
+// first use; its retry and dead-letter policies are the subscription's.
+type PubSub struct {
+	project string
+	topic   string
+	// endpoint and tokens are the API and where its access tokens come
+	// from; without tokens, as for the emulator, calls are anonymous
+	endpoint string
+	tokens   *gcpauth.TokenSource
+	client   *http.Client
+	// idleWait paces pulls that returned nothing
+	idleWait time.Duration
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewPubSub publishes to topic in project
+func NewPubSub(project, topic string) *PubSub {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &http.Client{Timeout: 90 * time.Second}
+	return &PubSub{
+		project:  project,
+		topic:    topic,
+		endpoint: pubsubEndpoint,
+		tokens:   gcpauth.NewTokenSource(gcpauth.MetadataTokenURL, client),
+		client:   client,
+		idleWait: time.Second,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (p *PubSub) topicName() string {
+	return "projects/" + p.project + "/topics/" + p.topic
+}
+
+func (p *PubSub) subscriptionName(group string) string {
+	return "projects/" + p.project + "/subscriptions/" + p.topic + "-" + group
+}
+
+type pubsubMessage struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	MessageID  string            `json:"messageId,omitempty"`
+}
+
+// Publish sends the event, with its type, source and id as attributes for
+// subscription filters
+func (p *PubSub) Publish(ctx context.Context, event Event) error {
+	if p.ctx.Err() != nil {
+		return ErrClosed
+	}
+	encoded, err := Marshal(event)
+	if err != nil {
+		return err
+	}
+	body := map[string]any{"messages": []pubsubMessage{{
+		Data:       base64.StdEncoding.EncodeToString(encoded),
+		Attributes: map[string]string{"id": event.ID, "type": event.Type, "source": event.Source},
+	}}}
+	if err := p.call(ctx, http.MethodPost, p.topicName()+":publish", body, nil); err != nil {
+		return fmt.Errorf("publishing %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// Subscribe creates the group's subscription if need be and pulls from it
+// until the bus is closed
+func (p *PubSub) Subscribe(group string, types []string, handler Handler) error {
+	set, err := checkSubscription(group, types)
+	if err != nil {
+		return err
+	}
+	if p.ctx.Err() != nil {
+		return ErrClosed
+	}
+	subscription := p.subscriptionName(group)
+	create := map[string]any{
+		"topic":              p.topicName(),
+		"ackDeadlineSeconds": int(pubsubAckDeadline / time.Second),
+	}
+	if len(types) > 0 {
+		sorted := append([]string(nil), types...)
+		sort.Strings(sorted)
+		filters := make([]string, len(sorted))
+		for i, eventType := range sorted {
+			filters[i] = fmt.Sprintf("attributes.type = %q", eventType)
+		}
+		create["filter"] = strings.Join(filters, " OR ")
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
+	defer cancel()
+	if err := p.call(ctx, http.MethodPut, subscription, create, nil); err != nil && !isStatus(err, http.StatusConflict) {
+		return fmt.Errorf("creating subscription %s: %w", subscription, err)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.pull(group, subscription, set, handler)
+	}()
+	return nil
+}
+
+// pull receives and handles the subscription's messages, acknowledging
+// the handled ones and handing the failed ones back at once
+func (p *PubSub) pull(group, subscription string, types map[string]bool, handler Handler) {
+	backoff := time.Second
+	for p.ctx.Err() == nil {
+		var pulled struct {
+			ReceivedMessages []struct {
+				AckID   string        `json:"ackId"`
+				Message pubsubMessage `json:"message"`
+			} `json:"receivedMessages"`
+		}
+		if err := p.call(p.ctx, http.MethodPost, subscription+":pull", map[string]any{"maxMessages": pubsubMaxMessages}, &pulled); err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			log.Warn().Err(err).Str("group", group).Dur("retry_in", backoff).Msg("Failed to pull events")
+			p.wait(backoff)
+			backoff = min(backoff*2, pubsubMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+		if len(pulled.ReceivedMessages) == 0 {
+			p.wait(p.idleWait)
+			continue
+		}
+		var acks, nacks []string
+		for _, received := range pulled.ReceivedMessages {
+			if p.handle(group, types, handler, received.Message) {
+				acks = append(acks, received.AckID)
+			} else {
+				nacks = append(nacks, received.AckID)
+			}
+		}
+		// Acknowledgements outlive Close, so handled events are not redelivered
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if len(acks) > 0 {
+			if err := p.call(ctx, http.MethodPost, subscription+":acknowledge", map[string]any{"ackIds": acks}, nil); err != nil {
+				log.Warn().Err(err).Str("group", group).Msg("Failed to acknowledge events; they will be redelivered")
+			}
+		}
+		if len(nacks) > 0 {
+			if err := p.call(ctx, http.MethodPost, subscription+":modifyAckDeadline", map[string]any{"ackIds": nacks, "ackDeadlineSeconds": 0}, nil); err != nil {
+				log.Warn().Err(err).Str("group", group).Msg("Failed to hand back events")
+			}
+		}
+		cancel()
+	}
+}
+
+// handle decodes and handles one message, reporting whether it is done
+// with. Messages that are not events are logged and dropped.
+func (p *PubSub) handle(group string, types map[string]bool, handler Handler, message pubsubMessage) bool {
+	encoded, err := base64.StdEncoding.DecodeString(message.Data)
+	if err != nil {
+		log.Error().Err(err).Str("group", group).Str("message_id", message.MessageID).Msg("Dropping message that is not base64")
+		return true
+	}
+	event, err := Unmarshal(encoded)
+	if err != nil {
+		log.Error().Err(err).Str("group", group).Str("message_id", message.MessageID).Msg("Dropping message that is not an event")
+		return true
+	}
+	// The subscription may predate the group's current types
+	if !takes(types, event.Type) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, pubsubAckDeadline)
+	defer cancel()
+	if err := handler(ctx, event); err != nil {
+		log.Warn().Err(err).Str("group", group).Str("event_id", event.ID).Str("type", event.Type).Msg("Event consumer failed; redelivering")
+		return false
+	}
+	return true
+}
+
+func (p *PubSub) wait(d time.Duration) {
+	select {
+	case <-p.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// Close stops pulling and waits for handlers in progress
+func (p *PubSub) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		p.wg.Wait()
+	})
+	return nil
+}
+
+// statusError is a Pub/Sub answer other than 200
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Pub/Sub answered %d: %s", e.status, e.body)
+}
+
+func isStatus(err error, status int) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && statusErr.status == status
+}
+
+// call sends body to the resource and decodes the answer into out, if any
+func (p *PubSub) call(ctx context.Context, method, resource string, body, out any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+resource, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.tokens != nil {
+		token, err := p.tokens.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("fetching Pub/Sub access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(detail))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,77 @@
+// Package gcpauth authenticates calls to Google Cloud APIs as the service
+// account the metadata server vouches for on Cloud Run and GCE.
+package gcpauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetadataTokenURL hands out the service account's access tokens
+const MetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// refreshMargin is how long before a token expires it is fetched again, so
+// a call never goes out with a token that lapses on the way
+const refreshMargin = time.Minute
+
+// TokenSource fetches the service account's access tokens and caches each
+// until shortly before its expires_in runs out
+type TokenSource struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// NewTokenSource fetches tokens from tokenURL, MetadataTokenURL outside of
+// tests, for the given OAuth scopes, or the account's default ones without
+func NewTokenSource(tokenURL string, client *http.Client, scopes ...string) *TokenSource {
+	if len(scopes) > 0 {
+		tokenURL += "?" + url.Values{"scopes": {strings.Join(scopes, ",")}}.Encode()
+	}
+	return &TokenSource{url: tokenURL, client: client, now: time.Now}
+}
+
+// Token returns an access token valid for at least another minute
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && s.now().Add(refreshMargin).Before(s.expiresAt) {
+		return s.accessToken, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server answered %d", resp.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", errors.New("metadata server returned no access token")
+	}
+	s.accessToken, s.expiresAt = body.AccessToken, s.now().Add(time.Duration(body.ExpiresIn)*time.Second)
+	return s.accessToken, nil
+}
@@ -0,0 +1,60 @@
+package gcpauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSource_RefreshesBeforeExpiry(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		assert.Equal(t, "https://www.googleapis.com/auth/pubsub", r.URL.Query().Get("scopes"))
+		fetches++
+		fmt.Fprintf(w, `{"access_token": "ya29.token-%d", "expires_in": 3600}`, fetches)
+	}))
+	defer server.Close()
+	now := time.Now()
+	tokens := NewTokenSource(server.URL, server.Client(), "https://www.googleapis.com/auth/pubsub")
+	tokens.now = func() time.Time { return now }
+
+	token, err := tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token-1", token)
+
+	// Cached while the token has more than a minute to live
+	now = now.Add(58 * time.Minute)
+	token, err = tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token-1", token)
+	assert.Equal(t, 1, fetches)
+
+	now = now.Add(time.Minute + time.Second)
+	token, err = tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token-2", token)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestTokenSource_Errors(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"expires_in": 3600}`))
+	}))
+	defer server.Close()
+	tokens := NewTokenSource(server.URL, server.Client())
+
+	_, err := tokens.Token(context.Background())
+	assert.ErrorContains(t, err, "metadata server answered 500")
+	status = http.StatusOK
+	_, err = tokens.Token(context.Background())
+	assert.ErrorContains(t, err, "no access token")
+}
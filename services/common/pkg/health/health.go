@@ -0,0 +1,224 @@
+// Package health serves the probes that tell platforms whether a Cachet
+// service is alive and ready for traffic.
+//
+// A Monitor runs the service's dependency checks: required ones, such as
+// its database, take the service out of rotation when they fail, while
+// observed ones, such as the reachability of services it calls, only mark
+// it degraded so one failing service does not take its callers down too.
+// /livez answers as long as the process serves requests, /readyz reports
+// every check as JSON, and /health gives the same verdict as /readyz as a
+// plain "ok" for probes that only look at the status code.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultTimeout bounds each check so a stalled dependency fails its check
+// rather than hanging the probe
+const DefaultTimeout = 2 * time.Second
+
+// Statuses of a check and of the service
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded" // an observed dependency is failing
+	StatusDown     = "down"     // a required dependency is failing
+)
+
+// Checker reports whether a dependency is usable
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckFunc adapts a function to a Checker
+type CheckFunc func(ctx context.Context) error
+
+func (f CheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type check struct {
+	name     string
+	checker  Checker
+	required bool
+}
+
+// Monitor runs a service's dependency checks
+type Monitor struct {
+	service string
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []check
+}
+
+// New returns a monitor for service with no checks, which is always ready
+func New(service string) *Monitor {
+	return &Monitor{service: service, timeout: DefaultTimeout}
+}
+
+// Require adds a check the service cannot serve without. Adding a check
+// under a name already in use replaces it.
+func (m *Monitor) Require(name string, checker Checker) {
+	m.add(check{name: name, checker: checker, required: true})
+}
+
+// Observe adds a check that is reported, and marks the service degraded
+// when it fails, without taking the service out of rotation
+func (m *Monitor) Observe(name string, checker Checker) {
+	m.add(check{name: name, checker: checker})
+}
+
+func (m *Monitor) add(c check) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.checks {
+		if m.checks[i].name == c.name {
+			m.checks[i] = c
+			return
+		}
+	}
+	m.checks = append(m.checks, c)
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Status    string `json:"status"`
+	Required  bool   `json:"required"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// Report is the outcome of every check, served by /readyz
+type Report struct {
+	Service string            `json:"service"`
+	Status  string            `json:"status"`
+	Checks  map[string]Result `json:"checks"`
+}
+
+// Failing names the checks that failed with the given requirement, sorted
+func (r Report) Failing(required bool) []string {
+	var names []string
+	for name, result := range r.Checks {
+		if result.Status != StatusOK && result.Required == required {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs every check concurrently, each bounded by DefaultTimeout
+func (m *Monitor) Run(ctx context.Context) Report {
+	m.mu.RLock()
+	checks := append([]check(nil), m.checks...)
+	m.mu.RUnlock()
+
+	report := Report{Service: m.service, Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			results[i] = m.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		result := results[i]
+		report.Checks[c.name] = result
+		switch {
+		case result.Status == StatusOK:
+		case c.required:
+			report.Status = StatusDown
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func (m *Monitor) run(ctx context.Context, c check) Result {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	started := time.Now()
+	err := c.checker.Check(ctx)
+	result := Result{Status: StatusOK, Required: c.required, LatencyMs: time.Since(started).Milliseconds()}
+	if err != nil {
+		result.Status, result.Error = StatusDown, err.Error()
+		log.Warn().Err(err).Str("check", c.name).Bool("required", c.required).Msg("Health check failed")
+	}
+	return result
+}
+
+// Live answers GET /livez: the process is up and serving requests
+func (m *Monitor) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"service": m.service, "status": StatusOK})
+}
+
+// Ready answers GET /readyz with the report of every check, and 503 when a
+// required check fails
+func (m *Monitor) Ready(w http.ResponseWriter, r *http.Request) {
+	report := m.Run(r.Context())
+	status := http.StatusOK
+	if report.Status == StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+// Health answers GET /health with "ok", or a 503 problem naming the
+// required checks that failed
+func (m *Monitor) Health(w http.ResponseWriter, r *http.Request) {
+	report := m.Run(r.Context())
+	if report.Status == StatusDown {
+		problem.Error(w, r, strings.Join(report.Failing(true), ", ")+" unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("ok")); err != nil {
+		log.Error().Err(err).Msg("Failed to write health check response")
+	}
+}
+
+// HTTP checks that GET url answers with a 2xx status, for services this one
+// calls
+func HTTP(url string) Checker {
+	client := &http.Client{Timeout: DefaultTimeout}
+	return CheckFunc(func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode health response")
+	}
+}
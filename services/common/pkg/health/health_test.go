@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	up   = CheckFunc(func(context.Context) error { return nil })
+	down = CheckFunc(func(context.Context) error { return errors.New("connection refused") })
+)
+
+func serve(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func readReport(t *testing.T, w *httptest.ResponseRecorder) Report {
+	t.Helper()
+	var report Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	return report
+}
+
+func TestMonitor_NoChecks(t *testing.T) {
+	m := New("test-service")
+	assert.Equal(t, http.StatusOK, serve(m.Live, "/livez").Code)
+	w := serve(m.Ready, "/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, Report{Service: "test-service", Status: StatusOK, Checks: map[string]Result{}}, readReport(t, w))
+	w = serve(m.Health, "/health")
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestMonitor_ObservedFailureDegrades(t *testing.T) {
+	m := New("test-service")
+	m.Require("database", up)
+	m.Observe("registry", down)
+
+	w := serve(m.Ready, "/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := readReport(t, w)
+	assert.Equal(t, StatusDegraded, report.Status)
+	assert.Equal(t, StatusOK, report.Checks["database"].Status)
+	assert.Equal(t, Result{Status: StatusDown, Error: "connection refused"}, report.Checks["registry"])
+	assert.Equal(t, []string{"registry"}, report.Failing(false))
+	assert.Equal(t, http.StatusOK, serve(m.Health, "/health").Code)
+}
+
+func TestMonitor_RequiredFailureTakesServiceDown(t *testing.T) {
+	m := New("test-service")
+	m.Require("database", up)
+	m.Require("database", down) // replaces the first
+	m.Require("kms", down)
+
+	w := serve(m.Ready, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	report := readReport(t, w)
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Len(t, report.Checks, 2)
+
+	w = serve(m.Health, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "database, kms unavailable")
+	assert.Equal(t, http.StatusOK, serve(m.Live, "/livez").Code, "a failing dependency does not make the process dead")
+}
+
+func TestMonitor_TimesOutStalledChecks(t *testing.T) {
+	m := New("test-service")
+	m.timeout = 10 * time.Millisecond
+	m.Require("database", CheckFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	report := m.Run(context.Background())
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Contains(t, report.Checks["database"].Error, "deadline exceeded")
+}
+
+func TestHTTP(t *testing.T) {
+	status := http.StatusOK
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer downstream.Close()
+
+	check := HTTP(downstream.URL + "/health")
+	assert.NoError(t, check.Check(context.Background()))
+	status = http.StatusServiceUnavailable
+	assert.ErrorContains(t, check.Check(context.Background()), "answered 503")
+}
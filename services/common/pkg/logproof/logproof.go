@@ -0,0 +1,265 @@
+// Package logproof verifies what the receipts log proves about itself: its
+// signed tree heads (STHs), that a receipt hash is included in the tree an
+// STH commits to, and that a later STH extends an earlier one. The log is an
+// RFC 9162 Merkle tree of SHA-256 hashes whose leaves are the logged hashes,
+// e.g. urn:sha256:… receipt digests, as strings.
+//
+// It is shared by the verifier, which checks the anchors of the receipts it
+// issues, by cachetctl and by wallets checking their receipts.
+package logproof
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidSignature = errors.New("logproof: invalid tree head signature")
+	ErrInvalidProof     = errors.New("logproof: invalid proof")
+)
+
+// checkpointOrigin names the log in the data an STH signs
+const checkpointOrigin = "cachet-receipts-log"
+
+// TreeHead is a signed tree head, as served at /log/sth
+type TreeHead struct {
+	TreeSize uint64 `json:"treeSize"`
+	// RootHash is the hex Merkle tree hash of the first TreeSize leaves
+	RootHash  string `json:"rootHash"`
+	Timestamp string `json:"timestamp"`
+	// Signature is the base64url signature of SignedData by the log's key
+	Signature string `json:"signature,omitempty"`
+}
+
+// SignedData is what the log signs for a tree head: its origin, size, root
+// hash and timestamp, one per line
+func (h TreeHead) SignedData() []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n%s\n", checkpointOrigin, h.TreeSize, h.RootHash, h.Timestamp))
+}
+
+// InclusionProof is the audit path of one leaf, as served at /log/proof
+type InclusionProof struct {
+	LeafIndex uint64 `json:"leafIndex"`
+	TreeSize  uint64 `json:"treeSize"`
+	// Hashes are the hex sibling hashes from the leaf up to the root
+	Hashes []string `json:"hashes"`
+}
+
+// ConsistencyProof proves the tree of SecondSize leaves extends the tree of
+// FirstSize leaves
+type ConsistencyProof struct {
+	FirstSize  uint64   `json:"firstSize"`
+	SecondSize uint64   `json:"secondSize"`
+	Hashes     []string `json:"hashes"`
+}
+
+// ParsePublicKey reads the log's PEM-encoded PKIX public key, Ed25519 or
+// ECDSA
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("logproof: no PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("logproof: %w", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("logproof: unsupported %T log key", key)
+}
+
+// VerifyTreeHead checks an STH is signed by the log's key
+func VerifyTreeHead(key crypto.PublicKey, head TreeHead) error {
+	signature, err := base64.RawURLEncoding.DecodeString(head.Signature)
+	if err != nil || len(signature) == 0 {
+		return ErrInvalidSignature
+	}
+	data := head.SignedData()
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("logproof: unsupported %T log key", key)
+	}
+	return nil
+}
+
+// VerifyReceipt checks a hash is logged: the STH is the log's and the
+// inclusion proof leads from the hash to its root
+func VerifyReceipt(key crypto.PublicKey, head TreeHead, hash string, proof InclusionProof) error {
+	if err := VerifyTreeHead(key, head); err != nil {
+		return err
+	}
+	if proof.TreeSize != head.TreeSize {
+		return fmt.Errorf("%w: proof is for a tree of %d leaves, the tree head of %d", ErrInvalidProof, proof.TreeSize, head.TreeSize)
+	}
+	root, err := decodeHash(head.RootHash)
+	if err != nil {
+		return err
+	}
+	path, err := decodeHashes(proof.Hashes)
+	if err != nil {
+		return err
+	}
+	return VerifyInclusion(LeafHash([]byte(hash)), proof.LeafIndex, proof.TreeSize, path, root)
+}
+
+// VerifyExtension checks both STHs are the log's and the newer one extends
+// the older, so the log has not rewritten what it showed before
+func VerifyExtension(key crypto.PublicKey, older, newer TreeHead, proof ConsistencyProof) error {
+	for _, head := range []TreeHead{older, newer} {
+		if err := VerifyTreeHead(key, head); err != nil {
+			return err
+		}
+	}
+	if proof.FirstSize != older.TreeSize || proof.SecondSize != newer.TreeSize {
+		return fmt.Errorf("%w: proof is from %d to %d leaves, the tree heads from %d to %d", ErrInvalidProof, proof.FirstSize, proof.SecondSize, older.TreeSize, newer.TreeSize)
+	}
+	first, err := decodeHash(older.RootHash)
+	if err != nil {
+		return err
+	}
+	second, err := decodeHash(newer.RootHash)
+	if err != nil {
+		return err
+	}
+	path, err := decodeHashes(proof.Hashes)
+	if err != nil {
+		return err
+	}
+	return VerifyConsistency(proof.FirstSize, proof.SecondSize, path, first, second)
+}
+
+// LeafHash is the Merkle tree hash of a leaf
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// NodeHash is the Merkle tree hash of an interior node
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// VerifyInclusion checks the audit path of the leaf at index leads to the
+// root of a tree of size leaves (RFC 9162, section 2.1.3.2)
+func VerifyInclusion(leafHash []byte, index, size uint64, path [][]byte, root []byte) error {
+	if index >= size {
+		return fmt.Errorf("%w: leaf %d is outside a tree of %d leaves", ErrInvalidProof, index, size)
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return fmt.Errorf("%w: audit path is too long", ErrInvalidProof)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+	if sn != 0 {
+		return fmt.Errorf("%w: audit path is too short", ErrInvalidProof)
+	}
+	if !bytes.Equal(r, root) {
+		return fmt.Errorf("%w: audit path does not lead to the root", ErrInvalidProof)
+	}
+	return nil
+}
+
+// VerifyConsistency checks the tree of second leaves, with root second,
+// extends the tree of first leaves, with root first (RFC 9162, section
+// 2.1.4.2)
+func VerifyConsistency(firstSize, secondSize uint64, path [][]byte, first, second []byte) error {
+	switch {
+	case firstSize == 0 || firstSize > secondSize:
+		return fmt.Errorf("%w: no consistency between trees of %d and %d leaves", ErrInvalidProof, firstSize, secondSize)
+	case firstSize == secondSize:
+		if len(path) != 0 || !bytes.Equal(first, second) {
+			return fmt.Errorf("%w: trees of the same size differ", ErrInvalidProof)
+		}
+		return nil
+	case len(path) == 0:
+		return fmt.Errorf("%w: consistency path is empty", ErrInvalidProof)
+	}
+	if firstSize&(firstSize-1) == 0 {
+		// The first tree is a complete subtree, whose root starts the path
+		path = append([][]byte{first}, path...)
+	}
+	fn, sn := firstSize-1, secondSize-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return fmt.Errorf("%w: consistency path is too long", ErrInvalidProof)
+		}
+		if fn&1 == 1 || fn == sn {
+			fr, sr = NodeHash(c, fr), NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+	if sn != 0 {
+		return fmt.Errorf("%w: consistency path is too short", ErrInvalidProof)
+	}
+	if !bytes.Equal(fr, first) || !bytes.Equal(sr, second) {
+		return fmt.Errorf("%w: consistency path does not lead to the roots", ErrInvalidProof)
+	}
+	return nil
+}
+
+func decodeHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("%w: %q is not a hex SHA-256 hash", ErrInvalidProof, s)
+	}
+	return hash, nil
+}
+
+func decodeHashes(hashes []string) ([][]byte, error) {
+	out := make([][]byte, len(hashes))
+	for i, s := range hashes {
+		hash, err := decodeHash(s)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = hash
+	}
+	return out, nil
+}
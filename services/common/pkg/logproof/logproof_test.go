@@ -0,0 +1,192 @@
+package logproof
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The reference tree below follows the recursive definitions of RFC 6962,
+// section 2.1
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		leaves[i] = []byte("urn:sha256:" + hex.EncodeToString(sum[:]))
+	}
+	return leaves
+}
+
+// split is the largest power of two smaller than n
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	if len(leaves) == 1 {
+		return LeafHash(leaves[0])
+	}
+	k := split(len(leaves))
+	return NodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), treeHash(leaves[k:]))
+	}
+	return append(auditPath(m-k, leaves[k:]), treeHash(leaves[:k]))
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{treeHash(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), treeHash(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), treeHash(leaves[:k]))
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	leaves := testLeaves(17)
+	for size := 1; size <= len(leaves); size++ {
+		root := treeHash(leaves[:size])
+		for index := 0; index < size; index++ {
+			path := auditPath(index, leaves[:size])
+			leaf := LeafHash(leaves[index])
+			require.NoError(t, VerifyInclusion(leaf, uint64(index), uint64(size), path, root), "leaf %d of %d", index, size)
+
+			assert.ErrorIs(t, VerifyInclusion(LeafHash([]byte("other")), uint64(index), uint64(size), path, root), ErrInvalidProof)
+			if size > 1 {
+				assert.ErrorIs(t, VerifyInclusion(leaf, uint64((index+1)%size), uint64(size), path, root), ErrInvalidProof)
+				assert.ErrorIs(t, VerifyInclusion(leaf, uint64(index), uint64(size), path[:len(path)-1], root), ErrInvalidProof)
+			}
+			assert.ErrorIs(t, VerifyInclusion(leaf, uint64(index), uint64(size), append(path, root), root), ErrInvalidProof)
+		}
+		assert.ErrorIs(t, VerifyInclusion(LeafHash(leaves[0]), uint64(size), uint64(size), nil, root), ErrInvalidProof)
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	leaves := testLeaves(17)
+	for second := 1; second <= len(leaves); second++ {
+		secondRoot := treeHash(leaves[:second])
+		for first := 1; first <= second; first++ {
+			firstRoot := treeHash(leaves[:first])
+			path := subproof(first, leaves[:second], true)
+			require.NoError(t, VerifyConsistency(uint64(first), uint64(second), path, firstRoot, secondRoot), "%d to %d", first, second)
+
+			if first < second {
+				assert.ErrorIs(t, VerifyConsistency(uint64(first), uint64(second), path, LeafHash([]byte("other")), secondRoot), ErrInvalidProof)
+				assert.ErrorIs(t, VerifyConsistency(uint64(first), uint64(second), path, firstRoot, LeafHash([]byte("other"))), ErrInvalidProof)
+				assert.ErrorIs(t, VerifyConsistency(uint64(first), uint64(second), path[:len(path)-1], firstRoot, secondRoot), ErrInvalidProof)
+			}
+		}
+	}
+	assert.ErrorIs(t, VerifyConsistency(0, 3, nil, nil, treeHash(leaves[:3])), ErrInvalidProof)
+	assert.ErrorIs(t, VerifyConsistency(4, 3, nil, treeHash(leaves[:4]), treeHash(leaves[:3])), ErrInvalidProof)
+}
+
+// signedHead is the log's STH of the first size leaves
+func signedHead(t *testing.T, key ed25519.PrivateKey, leaves [][]byte) TreeHead {
+	t.Helper()
+	head := TreeHead{TreeSize: uint64(len(leaves)), RootHash: hex.EncodeToString(treeHash(leaves)), Timestamp: "2026-05-04T10:00:00Z"}
+	head.Signature = base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, head.SignedData()))
+	return head
+}
+
+func hexHashes(hashes [][]byte) []string {
+	out := make([]string, len(hashes))
+	for i, hash := range hashes {
+		out[i] = hex.EncodeToString(hash)
+	}
+	return out
+}
+
+func TestVerifyReceipt(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	leaves := testLeaves(6)
+	head := signedHead(t, private, leaves)
+	proof := InclusionProof{LeafIndex: 4, TreeSize: 6, Hashes: hexHashes(auditPath(4, leaves))}
+
+	require.NoError(t, VerifyReceipt(public, head, string(leaves[4]), proof))
+	assert.ErrorIs(t, VerifyReceipt(public, head, string(leaves[3]), proof), ErrInvalidProof)
+
+	forged := head
+	forged.TreeSize = 7
+	assert.ErrorIs(t, VerifyReceipt(public, forged, string(leaves[4]), proof), ErrInvalidSignature)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyReceipt(otherKey, head, string(leaves[4]), proof), ErrInvalidSignature)
+
+	stale := proof
+	stale.TreeSize = 5
+	assert.ErrorIs(t, VerifyReceipt(public, head, string(leaves[4]), stale), ErrInvalidProof)
+	malformed := proof
+	malformed.Hashes = []string{"not hex"}
+	assert.ErrorIs(t, VerifyReceipt(public, head, string(leaves[4]), malformed), ErrInvalidProof)
+}
+
+func TestVerifyExtension(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	leaves := testLeaves(11)
+	older, newer := signedHead(t, private, leaves[:7]), signedHead(t, private, leaves)
+	proof := ConsistencyProof{FirstSize: 7, SecondSize: 11, Hashes: hexHashes(subproof(7, leaves, true))}
+	require.NoError(t, VerifyExtension(public, older, newer, proof))
+
+	// A log that rewrote its history cannot prove the extension
+	rewritten := append(testLeaves(7)[:6:6], []byte("urn:sha256:rewritten"))
+	assert.ErrorIs(t, VerifyExtension(public, signedHead(t, private, rewritten), newer, proof), ErrInvalidProof)
+	assert.ErrorIs(t, VerifyExtension(public, newer, older, proof), ErrInvalidProof)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+	key, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+
+	// ECDSA tree heads carry ASN.1 signatures over the SHA-256 of their data
+	head := TreeHead{TreeSize: 1, RootHash: hex.EncodeToString(treeHash(testLeaves(1))), Timestamp: "2026-05-04T10:00:00Z"}
+	digest := sha256.Sum256(head.SignedData())
+	signature, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	require.NoError(t, err)
+	head.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	assert.NoError(t, VerifyTreeHead(key, head))
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+}
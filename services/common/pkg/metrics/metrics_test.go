@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware_CountsRequestsByRoute(t *testing.T) {
+	m := New("test-service")
+	router := chi.NewRouter()
+	router.Use(m.Middleware)
+	router.Get("/vouches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	router.Get("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, path := range []string{"/vouches/vouch-1", "/vouches/vouch-2", "/health", "/wp-admin"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues("/vouches/{id}", "GET", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("/health", "GET", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues(unmatchedRoute, "GET", "404")))
+	assert.Equal(t, 3, testutil.CollectAndCount(m.requests), "one series per route and status")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.inFlight))
+}
+
+func TestHandler_ServesRegistry(t *testing.T) {
+	m := New("test-service")
+	issued := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachet_test_issued_total",
+		Help: "Things issued.",
+	}, []string{"tier"})
+	m.MustRegister(issued)
+	issued.WithLabelValues("gold").Inc()
+
+	router := chi.NewRouter()
+	router.Use(m.Middleware)
+	router.Method(http.MethodGet, "/metrics", m.Handler())
+	router.Get("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `cachet_test_issued_total{tier="gold"} 1`)
+	assert.Contains(t, body, `cachet_http_requests_total{code="200",method="GET",route="/ping",service="test-service"} 1`)
+	assert.Contains(t, body, `cachet_http_requests_in_flight{service="test-service"} 1`, "the scrape itself is in flight")
+	assert.Contains(t, body, "go_goroutines")
+}
@@ -0,0 +1,139 @@
+// Package notify tells Cachet users what happened to them: a vouch asked
+// of them, a credential about to expire, a verification completed, an
+// operator's review concluded.
+//
+// A Notifier renders a topic's template for each channel (email through
+// SMTP, SMS through Twilio, push through Firebase Cloud Messaging) and
+// sends it to the addresses the user gave, on the channels their
+// preferences pick for the topic. Users who set no preferences are not
+// notified.
+package notify
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+)
+
+// Topics users are notified about
+const (
+	// TopicVouchRequest tells a contact a subject asked them for a vouch
+	TopicVouchRequest = "vouch_request"
+	// TopicVouchRequestAnswered tells the subject their request was
+	// answered with a vouch, or declined
+	TopicVouchRequestAnswered = "vouch_request_answered"
+	// TopicCredentialExpiring reminds the holder to renew a credential
+	TopicCredentialExpiring = "credential_expiring"
+	// TopicVerificationCompleted reports the outcome of a verification
+	TopicVerificationCompleted = "verification_completed"
+	// TopicReviewOutcome reports an operator's review of the user, such as
+	// of a partner's flag or a suspicious vouch cluster
+	TopicReviewOutcome = "review_outcome"
+)
+
+// Topics are every topic, for validating preferences
+var Topics = []string{TopicVouchRequest, TopicVouchRequestAnswered, TopicCredentialExpiring, TopicVerificationCompleted, TopicReviewOutcome}
+
+// Channel names
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// Channels are every channel, for validating preferences
+var Channels = []string{ChannelEmail, ChannelSMS, ChannelPush}
+
+// ErrUndeliverable means a channel refused a message for good, such as an
+// invalid address; retrying will not help
+var ErrUndeliverable = errors.New("notification undeliverable")
+
+var sent = expvar.NewMap("notifications_total")
+
+// Message is a notification rendered for one channel. Push notifications
+// show the subject as their title; SMS has none.
+type Message struct {
+	Topic   string
+	Subject string
+	Body    string
+}
+
+// Channel delivers messages to addresses of one kind: email addresses,
+// E.164 phone numbers or FCM registration tokens
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, address string, message Message) error
+}
+
+// Delivery is what became of a notification on one channel
+type Delivery struct {
+	Channel string `json:"channel"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Notifier sends users the notifications they asked for
+type Notifier struct {
+	channels    map[string]Channel
+	templates   Templates
+	preferences Store
+}
+
+// New returns a notifier sending on channels, with the users' preferences
+// from store. Channels without an implementation are skipped.
+func New(store Store, templates Templates, channels ...Channel) *Notifier {
+	n := &Notifier{channels: make(map[string]Channel), templates: templates, preferences: store}
+	for _, channel := range channels {
+		n.channels[channel.Name()] = channel
+	}
+	return n
+}
+
+// Preferences is the store of the users' preferences
+func (n *Notifier) Preferences() Store {
+	return n.preferences
+}
+
+// Channels returns the names of the channels the notifier can send on
+func (n *Notifier) Channels() []string {
+	names := make([]string, 0, len(n.channels))
+	for name := range n.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Notify renders topic with data and sends it to user on every channel
+// their preferences pick for it. It fails only when the preferences cannot
+// be read; each channel's outcome is in the deliveries.
+func (n *Notifier) Notify(ctx context.Context, user, topic string, data any) ([]Delivery, error) {
+	prefs, err := n.preferences.Get(ctx, user)
+	if errors.Is(err, ErrNoPreferences) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the notification preferences of %s: %w", user, err)
+	}
+	var deliveries []Delivery
+	for _, name := range prefs.ChannelsFor(topic) {
+		channel, ok := n.channels[name]
+		if !ok {
+			continue
+		}
+		delivery := Delivery{Channel: name}
+		message, err := n.templates.Render(topic, name, data)
+		if err == nil {
+			err = channel.Send(ctx, prefs.Address(name), message)
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+			sent.Add(name+".failed", 1)
+		} else {
+			sent.Add(name+".sent", 1)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrNoPreferences means a user set no notification preferences
+var ErrNoPreferences = errors.New("no notification preferences")
+
+// phonePattern matches E.164 phone numbers
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// Preferences are where and about what a user wants to be notified
+type Preferences struct {
+	User string `json:"user"`
+	// Email, Phone (E.164) and PushToken (an FCM registration token) are
+	// the user's addresses on each channel
+	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	PushToken string `json:"pushToken,omitempty"`
+	// Topics picks the channels for each topic, none muting it; topics it
+	// omits go to every channel the user has an address on
+	Topics    map[string][]string `json:"topics,omitempty"`
+	UpdatedAt time.Time           `json:"updatedAt"`
+}
+
+// Validate checks the addresses are well formed and Topics names known
+// topics and channels the user has an address on
+func (p Preferences) Validate() error {
+	if p.Email != "" {
+		if addr, err := mail.ParseAddress(p.Email); err != nil || addr.Address != p.Email {
+			return errors.New("email must be a plain email address")
+		}
+	}
+	if p.Phone != "" && !phonePattern.MatchString(p.Phone) {
+		return errors.New("phone must be an E.164 number, such as +447700900123")
+	}
+	if len(p.PushToken) > 4096 {
+		return errors.New("pushToken is too long")
+	}
+	for topic, channels := range p.Topics {
+		if !contains(Topics, topic) {
+			return fmt.Errorf("unknown topic %q", topic)
+		}
+		for _, channel := range channels {
+			if !contains(Channels, channel) {
+				return fmt.Errorf("topics.%s: unknown channel %q", topic, channel)
+			}
+			if p.Address(channel) == "" {
+				return fmt.Errorf("topics.%s: no address for %s", topic, channel)
+			}
+		}
+	}
+	return nil
+}
+
+// Address is the user's address on channel, empty when they gave none
+func (p Preferences) Address(channel string) string {
+	switch channel {
+	case ChannelEmail:
+		return p.Email
+	case ChannelSMS:
+		return p.Phone
+	case ChannelPush:
+		return p.PushToken
+	}
+	return ""
+}
+
+// ChannelsFor returns the channels the user is notified about topic on
+func (p Preferences) ChannelsFor(topic string) []string {
+	if channels, ok := p.Topics[topic]; ok {
+		return channels
+	}
+	var channels []string
+	for _, channel := range Channels {
+		if p.Address(channel) != "" {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists users' preferences
+type Store interface {
+	// Get returns the user's preferences, or ErrNoPreferences
+	Get(ctx context.Context, user string) (Preferences, error)
+	Put(ctx context.Context, prefs Preferences) error
+	// Delete forgets the user's preferences, such as on erasure
+	Delete(ctx context.Context, user string) error
+}
+
+// MemoryStore keeps preferences in memory (production should use a
+// database, so users need not set them again after a restart)
+type MemoryStore struct {
+	mu    sync.RWMutex
+	prefs map[string]Preferences
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{prefs: make(map[string]Preferences)}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, user string) (Preferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	prefs, ok := m.prefs[user]
+	if !ok {
+		return Preferences{}, ErrNoPreferences
+	}
+	return prefs, nil
+}
+
+func (m *MemoryStore) Put(ctx context.Context, prefs Preferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefs[prefs.User] = prefs
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.prefs, user)
+	return nil
+}
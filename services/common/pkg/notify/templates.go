@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// anyChannel keys the template a topic uses on channels it has none for
+const anyChannel = "*"
+
+// Template is a notification's text, as text/template sources executed
+// with the data the service passes to Notify
+type Template struct {
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body"`
+}
+
+// defaultTemplates are the built-in texts, by topic and channel. The data
+// each topic is rendered with:
+//
+//   - vouch_request: Type, Message (optional) and Link, the deep link
+//     answering the request
+//   - vouch_request_answered: Type and Status, completed or declined
+//   - credential_expiring: Credential, ExpiresAt and Link, renewing it
+//   - verification_completed: Verifier and Status, verified or failed
+//   - review_outcome: Item, what was reviewed, Outcome and Note (optional)
+var defaultTemplates = map[string]map[string]Template{
+	TopicVouchRequest: {
+		anyChannel: {
+			Subject: "You were asked for a vouch",
+			Body:    "Someone asked you to vouch for them: {{.Type}}.{{with .Message}} They wrote: {{.}}{{end}} Answer in your Cachet wallet: {{.Link}}",
+		},
+	},
+	TopicVouchRequestAnswered: {
+		anyChannel: {
+			Subject: "Your vouch request was {{.Status}}",
+			Body:    "Your request for a vouch ({{.Type}}) was {{.Status}}.",
+		},
+	},
+	TopicCredentialExpiring: {
+		anyChannel: {
+			Subject: "Your {{.Credential}} expires soon",
+			Body:    "Your {{.Credential}} expires on {{.ExpiresAt}}. Renew it in your Cachet wallet: {{.Link}}",
+		},
+	},
+	TopicVerificationCompleted: {
+		anyChannel: {
+			Subject: "Verification {{.Status}}",
+			Body:    "Your verification with {{.Verifier}} is complete: {{.Status}}.",
+		},
+	},
+	TopicReviewOutcome: {
+		anyChannel: {
+			Subject: "Review of your {{.Item}}: {{.Outcome}}",
+			Body:    "Cachet reviewed your {{.Item}}: {{.Outcome}}.{{with .Note}} {{.}}{{end}}",
+		},
+	},
+}
+
+type compiled struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Templates are the parsed texts of every topic
+type Templates struct {
+	set map[string]map[string]compiled
+}
+
+// DefaultTemplates returns the built-in texts
+func DefaultTemplates() Templates {
+	templates, err := ParseTemplates(nil)
+	if err != nil {
+		panic(err) // the built-in templates parse
+	}
+	return templates
+}
+
+// ParseTemplates parses the texts of overrides, by topic then channel name
+// or "*" for any channel, over the built-in ones
+func ParseTemplates(overrides map[string]map[string]Template) (Templates, error) {
+	templates := Templates{set: make(map[string]map[string]compiled)}
+	for _, source := range []map[string]map[string]Template{defaultTemplates, overrides} {
+		for topic, byChannel := range source {
+			if !contains(Topics, topic) {
+				return Templates{}, fmt.Errorf("unknown topic %q", topic)
+			}
+			if templates.set[topic] == nil {
+				templates.set[topic] = make(map[string]compiled)
+			}
+			for channel, text := range byChannel {
+				if channel != anyChannel && !contains(Channels, channel) {
+					return Templates{}, fmt.Errorf("%s: unknown channel %q", topic, channel)
+				}
+				name := topic + "." + channel
+				if strings.TrimSpace(text.Body) == "" {
+					return Templates{}, fmt.Errorf("%s: body is required", name)
+				}
+				subject, err := template.New(name + ".subject").Parse(text.Subject)
+				if err != nil {
+					return Templates{}, err
+				}
+				body, err := template.New(name + ".body").Parse(text.Body)
+				if err != nil {
+					return Templates{}, err
+				}
+				templates.set[topic][channel] = compiled{subject: subject, body: body}
+			}
+		}
+	}
+	return templates, nil
+}
+
+// LoadTemplates reads overrides of the built-in texts from a JSON file of
+// the form {"topic": {"channel": {"subject": "...", "body": "..."}}}; an
+// empty path keeps the built-in ones
+func LoadTemplates(path string) (Templates, error) {
+	if path == "" {
+		return DefaultTemplates(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Templates{}, fmt.Errorf("reading notification templates: %w", err)
+	}
+	var overrides map[string]map[string]Template
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return Templates{}, fmt.Errorf("decoding notification templates: %w", err)
+	}
+	templates, err := ParseTemplates(overrides)
+	if err != nil {
+		return Templates{}, fmt.Errorf("invalid notification templates: %w", err)
+	}
+	return templates, nil
+}
+
+// Render executes topic's template for channel with data
+func (t Templates) Render(topic, channel string, data any) (Message, error) {
+	byChannel := t.set[topic]
+	text, ok := byChannel[channel]
+	if !ok {
+		text, ok = byChannel[anyChannel]
+	}
+	if !ok {
+		return Message{}, fmt.Errorf("no %s template for %s", topic, channel)
+	}
+	var subject, body strings.Builder
+	if err := text.subject.Execute(&subject, data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s: %w", topic, err)
+	}
+	if err := text.body.Execute(&body, data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s: %w", topic, err)
+	}
+	return Message{Topic: topic, Subject: strings.TrimSpace(subject.String()), Body: strings.TrimSpace(body.String())}, nil
+}
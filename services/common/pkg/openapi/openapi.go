@@ -0,0 +1,341 @@
+// Package openapi checks the traffic of services against the OpenAPI
+// documents describing them.
+//
+// Each service embeds its document and puts a Validator's Middleware in
+// front of its routes. Requests to documented operations are checked
+// against the document's parameters and request bodies before they reach a
+// handler, and refused with a problem listing every mismatch. Requests the
+// document does not describe pass through untouched, so the document can
+// cover the API gradually.
+//
+// In development the responses are checked as well, and mismatches logged,
+// so drift between the code and the document shows up while working on it.
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/rs/zerolog/log"
+)
+
+// CodeInvalidRequest is the problem code of requests the document refuses
+const CodeInvalidRequest = "invalid_request"
+
+// MaxBodySize bounds the request bodies read for validation
+const MaxBodySize = 8 << 20
+
+// Validator checks requests, and optionally responses, against an OpenAPI
+// document
+type Validator struct {
+	// ValidateResponses checks responses against the document too and logs
+	// the mismatches; meant for development. Set it before serving.
+	ValidateResponses bool
+	// Refuse writes the problem refused requests are answered with, for
+	// services whose clients expect errors in another shape; it defaults to
+	// writing the problem as is
+	Refuse func(w http.ResponseWriter, r *http.Request, details *problem.Details)
+
+	router routers.Router
+}
+
+// FieldError is one way a request departs from the document
+type FieldError struct {
+	// In is where the offending value is: body, path, query, header or
+	// cookie
+	In string `json:"in"`
+	// Name is the parameter's name, for parameters
+	Name string `json:"name,omitempty"`
+	// Pointer is the JSON pointer to the offending value, for bodies
+	Pointer string `json:"pointer,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// New loads and checks a YAML or JSON OpenAPI 3 document
+func New(spec []byte) (*Validator, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("loading OpenAPI document: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	// The servers list where the API is deployed; requests are matched on
+	// their path alone, wherever the service runs
+	doc.Servers = nil
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("routing OpenAPI document: %w", err)
+	}
+	return &Validator{router: router}, nil
+}
+
+// formContentType is the media type of HTML forms and OAuth requests
+const formContentType = "application/x-www-form-urlencoded"
+
+func init() {
+	// Absent form fields are decoded as nulls, which fail every schema
+	// that does not allow them, so they are dropped as for JSON bodies
+	decode := openapi3filter.RegisteredBodyDecoder(formContentType)
+	openapi3filter.RegisterBodyDecoder(formContentType, func(body io.Reader, header http.Header, schema *openapi3.SchemaRef, encoding openapi3filter.EncodingFn) (any, error) {
+		value, err := decode(body, header, schema, encoding)
+		return withoutNulls(value), err
+	})
+}
+
+// requestOptions leaves authentication to the handlers and requests as
+// they were sent
+var requestOptions = &openapi3filter.Options{
+	MultiError:          true,
+	SkipSettingDefaults: true,
+	AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+}
+
+// Middleware refuses requests to documented operations that do not match
+// the document. A nil Validator lets every request through.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := v.router.FindRoute(r)
+		if err != nil {
+			// Undocumented; the router answers unknown routes and methods
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize)); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					v.refuse(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, fmt.Sprintf("Request body exceeds %d bytes", MaxBodySize)))
+					return
+				}
+				v.refuse(w, r, problem.New(http.StatusBadRequest, CodeInvalidRequest, "Could not read the request body"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    asHandlersRead(r, route, body),
+			PathParams: params,
+			Route:      route,
+			Options:    requestOptions,
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			fields := FieldErrors(err)
+			v.refuse(w, r, problem.New(http.StatusBadRequest, CodeInvalidRequest, describe(fields)).With("errors", fields))
+			return
+		}
+		if !v.ValidateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		v.checkResponse(r.Context(), input, recorder)
+	})
+}
+
+func (v *Validator) refuse(w http.ResponseWriter, r *http.Request, details *problem.Details) {
+	if v.Refuse != nil {
+		v.Refuse(w, r, details)
+		return
+	}
+	details.Write(w, r)
+}
+
+// asHandlersRead adapts a copy of the request to the way the handlers read
+// requests: empty query parameters and null JSON members are absent, and
+// bodies sent without a Content-Type have the operation's only media type
+func asHandlersRead(r *http.Request, route *routers.Route, body []byte) *http.Request {
+	r = r.Clone(r.Context())
+	query := r.URL.Query()
+	for name, values := range query {
+		if len(values) == 1 && values[0] == "" {
+			query.Del(name)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+	if requestBody := route.Operation.RequestBody; r.Header.Get("Content-Type") == "" && requestBody != nil && requestBody.Value != nil && len(requestBody.Value.Content) == 1 {
+		for mediaType := range requestBody.Value.Content {
+			r.Header.Set("Content-Type", mediaType)
+		}
+	}
+	if body == nil {
+		return r
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var document any
+		if decoder.Decode(&document) == nil {
+			if stripped, err := json.Marshal(withoutNulls(document)); err == nil {
+				body = stripped
+			}
+		}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r
+}
+
+// withoutNulls drops null members from JSON objects, which encoding/json
+// leaves unset
+func withoutNulls(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, member := range v {
+			if member == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = withoutNulls(member)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = withoutNulls(item)
+		}
+	}
+	return value
+}
+
+// checkResponse logs how a response departs from the document
+func (v *Validator) checkResponse(ctx context.Context, input *openapi3filter.RequestValidationInput, recorder *responseRecorder) {
+	err := openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 recorder.status,
+		Header:                 recorder.Header(),
+		Body:                   io.NopCloser(&recorder.body),
+		Options:                &openapi3filter.Options{MultiError: true},
+	})
+	if err != nil {
+		log.Warn().Err(err).
+			Str("method", input.Request.Method).
+			Str("route", input.Route.Path).
+			Int("status", recorder.status).
+			Msg("Response does not match the OpenAPI document")
+	}
+}
+
+// FieldErrors breaks a validation error down into the mismatches it
+// reports
+func FieldErrors(err error) []FieldError {
+	if multi, ok := err.(openapi3.MultiError); ok {
+		var fields []FieldError
+		for _, e := range multi {
+			fields = append(fields, FieldErrors(e)...)
+		}
+		return fields
+	}
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return []FieldError{{In: "request", Detail: err.Error()}}
+	}
+	field := FieldError{In: "body"}
+	if p := reqErr.Parameter; p != nil {
+		field = FieldError{In: p.In, Name: p.Name}
+	}
+	if reqErr.Err == nil {
+		field.Detail = reqErr.Reason
+		return []FieldError{field}
+	}
+	var schemaErr *openapi3.SchemaError
+	if _, ok := reqErr.Err.(openapi3.MultiError); !ok && !errors.As(reqErr.Err, &schemaErr) {
+		field.Detail = reqErr.Err.Error()
+		if reqErr.Reason != "" && reqErr.Reason != field.Detail {
+			field.Detail = reqErr.Reason + ": " + field.Detail
+		}
+		return []FieldError{field}
+	}
+	return schemaFields(field, nil, reqErr.Err)
+}
+
+// schemaFields reports the values failing a schema, looking into allOf
+// branches for the failures they hold
+func schemaFields(field FieldError, path []string, err error) []FieldError {
+	if multi, ok := err.(openapi3.MultiError); ok {
+		var fields []FieldError
+		for _, e := range multi {
+			fields = append(fields, schemaFields(field, path, e)...)
+		}
+		return fields
+	}
+	var schemaErr *openapi3.SchemaError
+	if !errors.As(err, &schemaErr) {
+		field.Detail = err.Error()
+		return []FieldError{field}
+	}
+	path = append(path[:len(path):len(path)], schemaErr.JSONPointer()...)
+	if schemaErr.SchemaField == "allOf" && schemaErr.Origin != nil {
+		return schemaFields(field, path, schemaErr.Origin)
+	}
+	if len(path) > 0 && field.Name == "" {
+		field.Pointer = "/" + strings.Join(path, "/")
+	}
+	field.Detail = schemaErr.Reason
+	return []FieldError{field}
+}
+
+// describe sums the mismatches up for the problem's detail
+func describe(fields []FieldError) string {
+	if len(fields) == 1 {
+		f := fields[0]
+		switch {
+		case f.Name != "":
+			return fmt.Sprintf("Invalid %s parameter %q: %s", f.In, f.Name, f.Detail)
+		case f.Pointer != "":
+			return fmt.Sprintf("Invalid request body at %s: %s", f.Pointer, f.Detail)
+		case f.In == "body":
+			return "Invalid request body: " + f.Detail
+		}
+		return "Invalid request: " + f.Detail
+	}
+	return fmt.Sprintf("The request does not match the API in %d ways", len(fields))
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps event streams flowing
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
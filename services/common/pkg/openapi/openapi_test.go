@@ -0,0 +1,163 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const spec = `
+openapi: 3.0.3
+info: {title: Test, version: 0.1.0}
+servers: [{url: https://api.cachet.id}]
+paths:
+  /sessions:
+    post:
+      security: [{apiKey: []}]
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [policyId]
+              properties:
+                policyId: {type: string}
+                ttl: {type: integer, minimum: 1}
+      responses:
+        '201':
+          description: created
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [sessionId]
+                properties:
+                  sessionId: {type: string}
+  /sessions/{id}:
+    get:
+      parameters:
+        - {name: id, in: path, required: true, schema: {type: string, pattern: '^[a-f0-9]+$'}}
+        - {name: wait, in: query, schema: {type: boolean}}
+      responses:
+        '200': {description: session}
+components:
+  securitySchemes:
+    apiKey: {type: http, scheme: bearer}
+`
+
+func serve(t *testing.T, v *Validator, r *http.Request, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	v.Middleware(handler).ServeHTTP(w, r)
+	return w
+}
+
+func created(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"sessionId": "s1"}`))
+}
+
+func TestNew_RejectsInvalidDocuments(t *testing.T) {
+	_, err := New([]byte("openapi: 3.0.3\npaths: {}\n"))
+	assert.ErrorContains(t, err, "invalid OpenAPI document")
+	_, err = New([]byte("{"))
+	assert.ErrorContains(t, err, "loading OpenAPI document")
+}
+
+func TestMiddleware_PassesValidRequests(t *testing.T) {
+	v, err := New([]byte(spec))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"policyId": "pack.age@1", "ttl": 60}`))
+	r.Header.Set("Content-Type", "application/json")
+	var body string
+	w := serve(t, v, r, func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+		created(w, r)
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"policyId": "pack.age@1", "ttl": 60}`, body, "handlers read the body validated")
+
+	r = httptest.NewRequest(http.MethodGet, "/undocumented", nil)
+	w = serve(t, v, r, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
+
+func TestMiddleware_RefusesInvalidBodies(t *testing.T) {
+	v, err := New([]byte(spec))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"ttl": 0}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serve(t, v, r, func(w http.ResponseWriter, r *http.Request) { t.Fatal("handler reached") })
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+	var details struct {
+		Code   string       `json:"code"`
+		Detail string       `json:"detail"`
+		Errors []FieldError `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Equal(t, CodeInvalidRequest, details.Code)
+	assert.Equal(t, "The request does not match the API in 2 ways", details.Detail)
+	assert.ElementsMatch(t, []FieldError{
+		{In: "body", Pointer: "/policyId", Detail: `property "policyId" is missing`},
+		{In: "body", Pointer: "/ttl", Detail: "number must be at least 1"},
+	}, details.Errors)
+}
+
+func TestMiddleware_RefusesInvalidParameters(t *testing.T) {
+	v, err := New([]byte(spec))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/sessions/abc?wait=soon", nil)
+	w := serve(t, v, r, func(w http.ResponseWriter, r *http.Request) { t.Fatal("handler reached") })
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Invalid query parameter \"wait\"`)
+	assert.Contains(t, w.Body.String(), `"name":"wait"`)
+}
+
+func TestMiddleware_NilValidator(t *testing.T) {
+	var v *Validator
+	r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{}`))
+	w := serve(t, v, r, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
+
+func TestMiddleware_ValidateResponses(t *testing.T) {
+	v, err := New([]byte(spec))
+	require.NoError(t, err)
+	v.ValidateResponses = true
+	var logs bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&logs)
+
+	r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"policyId": "pack.age@1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serve(t, v, r, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "s1"}`))
+	})
+	// Mismatched responses are logged, not altered
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"id": "s1"}`, w.Body.String())
+	assert.Contains(t, logs.String(), "Response does not match the OpenAPI document")
+	assert.Contains(t, logs.String(), `"route":"/sessions"`)
+}
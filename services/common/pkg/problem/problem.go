@@ -0,0 +1,198 @@
+// Package problem writes error responses as RFC 7807 problem details.
+//
+// Every error a Cachet service returns is an application/problem+json body
+// carrying a type URI and a machine-readable code that clients branch on,
+// the human-readable detail, and the ID of the request so operators can find
+// it in the logs. Error mirrors http.Error for failures that need no code of
+// their own; Write and New give the code explicitly and let handlers add
+// extension members.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// ContentType is the media type of problem details (RFC 7807 §3)
+const ContentType = "application/problem+json"
+
+// TypeBase prefixes a problem's code to form its type URI
+const TypeBase = "https://cachet.id/problems/"
+
+// Codes for failures that have no more specific code, by status
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeGone             = "gone"
+	CodeTooLarge         = "payload_too_large"
+	CodeUnprocessable    = "unprocessable_entity"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal_error"
+	CodeBadGateway       = "bad_gateway"
+	CodeUnavailable      = "service_unavailable"
+	CodeTimeout          = "gateway_timeout"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusGone:                  CodeGone,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnprocessableEntity:   CodeUnprocessable,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusBadGateway:            CodeBadGateway,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// CodeForStatus is the code of a failure with the given status that has no
+// more specific code
+func CodeForStatus(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Details is a problem details object. Extensions are marshalled as
+// top-level members beside the standard ones, which they cannot replace.
+type Details struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Code       string
+	RequestID  string
+	Extensions map[string]any
+}
+
+// New describes a failure with the given status and code
+func New(status int, code, detail string) *Details {
+	return &Details{
+		Type:   TypeBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// With adds an extension member
+func (d *Details) With(key string, value any) *Details {
+	if d.Extensions == nil {
+		d.Extensions = make(map[string]any)
+	}
+	d.Extensions[key] = value
+	return d
+}
+
+// MarshalJSON flattens the extensions into the problem object
+func (d Details) MarshalJSON() ([]byte, error) {
+	members := make(map[string]any, len(d.Extensions)+7)
+	for key, value := range d.Extensions {
+		members[key] = value
+	}
+	members["type"] = d.Type
+	members["title"] = d.Title
+	members["status"] = d.Status
+	members["code"] = d.Code
+	if d.Detail != "" {
+		members["detail"] = d.Detail
+	}
+	if d.Instance != "" {
+		members["instance"] = d.Instance
+	}
+	if d.RequestID != "" {
+		members["requestId"] = d.RequestID
+	}
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON reads a problem object, keeping unknown members as
+// extensions
+func (d *Details) UnmarshalJSON(data []byte) error {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	*d = Details{}
+	fields := map[string]any{
+		"type":      &d.Type,
+		"title":     &d.Title,
+		"status":    &d.Status,
+		"detail":    &d.Detail,
+		"instance":  &d.Instance,
+		"code":      &d.Code,
+		"requestId": &d.RequestID,
+	}
+	for key, raw := range members {
+		if field, ok := fields[key]; ok {
+			if err := json.Unmarshal(raw, field); err != nil {
+				return err
+			}
+			continue
+		}
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		d.With(key, value)
+	}
+	return nil
+}
+
+// Write sends the problem as the response to r, stamped with the request's
+// path and the ID the RequestID middleware gave it
+func (d *Details) Write(w http.ResponseWriter, r *http.Request) {
+	if d.Instance == "" {
+		d.Instance = r.URL.Path
+	}
+	if d.RequestID == "" {
+		d.RequestID = middleware.GetReqID(r.Context())
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(d.Status)
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		log.Error().Err(err).Str("code", d.Code).Msg("Failed to encode problem details")
+	}
+}
+
+// Write responds to r with a problem of the given status and code
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	New(status, code, detail).Write(w, r)
+}
+
+// Error replaces http.Error: it responds to r with a problem coded after
+// status
+func Error(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	Write(w, r, status, CodeForStatus(status), detail)
+}
+
+// NotFound answers requests for routes that do not exist, for chi's
+// Router.NotFound
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, "No route matches "+r.URL.Path, http.StatusNotFound)
+}
+
+// MethodNotAllowed answers requests using a method the route does not
+// serve, for chi's Router.MethodNotAllowed
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,77 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Get("/packs/{ref}", func(w http.ResponseWriter, r *http.Request) {
+		New(http.StatusUnprocessableEntity, "profile_violation", "the presentation breaks the eudi profile").
+			With("violations", []string{"alg"}).
+			With("status", 200). // cannot replace a standard member
+			Write(w, r)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/packs/pack.a@1", nil))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	var problem Details
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, TypeBase+"profile_violation", problem.Type)
+	assert.Equal(t, "Unprocessable Entity", problem.Title)
+	assert.Equal(t, http.StatusUnprocessableEntity, problem.Status)
+	assert.Equal(t, "profile_violation", problem.Code)
+	assert.Equal(t, "the presentation breaks the eudi profile", problem.Detail)
+	assert.Equal(t, "/packs/pack.a@1", problem.Instance)
+	assert.NotEmpty(t, problem.RequestID)
+	assert.Equal(t, map[string]any{"violations": []any{"alg"}}, problem.Extensions)
+}
+
+func TestNotFound(t *testing.T) {
+	router := chi.NewRouter()
+	router.NotFound(NotFound)
+	router.MethodNotAllowed(MethodNotAllowed)
+	router.Get("/packs", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nonexistent", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/packs", nil))
+	var problem Details
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, CodeMethodNotAllowed, problem.Code)
+}
+
+func TestError_CodesByStatus(t *testing.T) {
+	for status, code := range map[int]string{
+		http.StatusNotFound:            CodeNotFound,
+		http.StatusServiceUnavailable:  CodeUnavailable,
+		http.StatusTeapot:              CodeBadRequest,
+		http.StatusNotImplemented:      CodeInternal,
+		http.StatusRequestTimeout:      CodeBadRequest,
+		http.StatusInternalServerError: CodeInternal,
+	} {
+		w := httptest.NewRecorder()
+		Error(w, httptest.NewRequest(http.MethodGet, "/", nil), "went wrong", status)
+		var problem Details
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+		assert.Equal(t, status, w.Code)
+		assert.Equal(t, code, problem.Code, status)
+		assert.Empty(t, problem.RequestID, "no RequestID middleware")
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often Memory forgets the buckets of idle clients
+const sweepInterval = 10 * time.Minute
+
+// bucket is a client's bucket as of updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket refills, after which it can be forgotten
+}
+
+// Memory keeps buckets within the process, so each instance of a service
+// limits clients on its own
+type Memory struct {
+	mu         sync.Mutex
+	buckets    map[string]bucket
+	sweptUntil time.Time
+}
+
+// NewMemory returns an empty in-process store
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]bucket)}
+}
+
+// Take draws one request from the bucket named key
+func (m *Memory) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.After(m.sweptUntil) {
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.sweptUntil = now.Add(sweepInterval)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = bucket{tokens: float64(limit.Burst), updated: now}
+	}
+	tokens, result := limit.take(b.tokens, b.updated, now)
+	m.buckets[key] = bucket{tokens: tokens, updated: now, full: now.Add(result.Reset)}
+	return result, nil
+}
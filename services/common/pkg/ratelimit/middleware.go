@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// KeyFunc names the bucket a request draws from; an empty key lets the
+// request through unlimited
+type KeyFunc func(r *http.Request) string
+
+// Authenticator names the client a credential presented to the service
+// belongs to, and reports false for credentials the service does not accept
+type Authenticator func(r *http.Request, credential string) (client string, ok bool)
+
+// peerKey holds the address of the connection a request came in on
+type peerKey struct{}
+
+// Peer records the connection's peer address before chi's RealIP replaces
+// it with addresses the caller can name itself. Services mount it first.
+func Peer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr)))
+	})
+}
+
+// ByIP keys requests by the caller's IP as seen by the outermost of the
+// proxies trusted proxies in front of the service, each of which appends
+// the address it was called from to X-Forwarded-For; without proxies, or
+// when they appended fewer entries, it is the connection's peer. Entries
+// ahead of theirs, and headers such as True-Client-IP, are the caller's
+// own say and ignored.
+func ByIP(proxies int) KeyFunc {
+	return func(r *http.Request) string {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if proxies > 0 && len(hops) >= proxies {
+			return "ip:" + hops[len(hops)-proxies]
+		}
+		peer, ok := r.Context().Value(peerKey{}).(string)
+		if !ok {
+			peer = r.RemoteAddr
+		}
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			host = peer
+		}
+		return "ip:" + host
+	}
+}
+
+// ByAPIKey keys requests by the client whose API key or bearer token
+// authenticate accepts, or returns "" for anonymous requests and
+// credentials it rejects, so callers cannot draw from a fresh bucket with
+// every credential they make up. Clients are hashed so no credential is
+// written to the store.
+func ByAPIKey(authenticate Authenticator) KeyFunc {
+	return func(r *http.Request) string {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			if scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " "); strings.EqualFold(scheme, "Bearer") || strings.EqualFold(scheme, "DPoP") {
+				key = token
+			}
+		}
+		if key == "" || authenticate == nil {
+			return ""
+		}
+		client, ok := authenticate(r, key)
+		if !ok {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(client))
+		return "key:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// ByClient keys requests by authenticated client, or by IP for anyone
+// else, within the request's tenant, so one tenant's clients cannot
+// exhaust another's allowance
+func ByClient(authenticate Authenticator, proxies int) KeyFunc {
+	byAPIKey, byIP := ByAPIKey(authenticate), ByIP(proxies)
+	return func(r *http.Request) string {
+		client := byAPIKey(r)
+		if client == "" {
+			client = byIP(r)
+		}
+		return "t:" + tenant.FromContext(r.Context()).ID + ":" + client
+	}
+}
+
+// limiter is a Limiter's configuration
+type limiter struct {
+	store Store
+	limit Limit
+	key   KeyFunc
+}
+
+// Limiter applies a rate limit to the routes it is mounted on. The zero
+// Limiter lets every request through.
+type Limiter struct {
+	config atomic.Pointer[limiter]
+}
+
+// Set limits requests to limit, drawing from store by key, or by the
+// connection's peer IP when key is nil; services set it once at startup. A
+// nil store disables limiting.
+func (l *Limiter) Set(store Store, limit Limit, key KeyFunc) {
+	if store == nil || limit.Rate <= 0 || limit.Burst <= 0 {
+		l.config.Store(nil)
+		return
+	}
+	if key == nil {
+		key = ByClient(nil, 0)
+	}
+	l.config.Store(&limiter{store: store, limit: limit, key: key})
+}
+
+// Middleware draws each request from its client's bucket, refusing it with
+// 429 and Retry-After once the bucket is empty. The RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers report the bucket either
+// way. Requests are let through when the store cannot be reached, so an
+// outage of the store does not take the API down with it.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := l.config.Load()
+		if c == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := c.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result, err := c.store.Take(r.Context(), key, c.limit, time.Now())
+		if err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("Rate limit store unavailable, letting the request through")
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		h.Set("RateLimit-Reset", seconds(result.Reset))
+		if !result.Allowed {
+			h.Set("Retry-After", seconds(result.RetryAfter))
+			log.Warn().Str("path", r.URL.Path).Msg("Client rate limited")
+			problem.Write(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "Rate limit of "+c.limit.String()+" exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds renders d as whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
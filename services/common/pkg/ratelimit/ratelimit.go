@@ -0,0 +1,151 @@
+// Package ratelimit limits how often clients may call Cachet's public APIs.
+//
+// Each client draws from a token bucket holding Burst requests and refilled
+// at Rate per Period. Buckets live in a Store: Memory keeps them within one
+// instance, Redis shares them across every instance of a service. A Limiter
+// mounts the limit on routes, keying buckets by the API keys and tokens the
+// service accepts, or by the IP its trusted proxies saw for anyone else,
+// within each tenant, and answers with the RateLimit-* headers so
+// well-behaved clients can pace themselves.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate
+// requests per Period
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// PerMinute allows n requests a minute, all of them at once if need be
+func PerMinute(n int) Limit {
+	return Limit{Rate: n, Period: time.Minute, Burst: n}
+}
+
+// String describes the limit, as refusals do
+func (l Limit) String() string {
+	if l.Period == time.Minute {
+		return fmt.Sprintf("%d requests per minute", l.Rate)
+	}
+	return fmt.Sprintf("%d requests per %s", l.Rate, l.Period)
+}
+
+// interval is how long the bucket takes to regain one request
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+// result describes a bucket holding tokens after a request was allowed or not
+func (l Limit) result(allowed bool, tokens float64) Result {
+	interval := float64(l.interval())
+	r := Result{
+		Allowed:   allowed,
+		Limit:     l.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration(math.Ceil((float64(l.Burst) - tokens) * interval)),
+	}
+	if !allowed {
+		r.RetryAfter = time.Duration(math.Ceil((1 - tokens) * interval))
+	}
+	return r
+}
+
+// take refills a bucket last updated at updated and takes one request from
+// it, returning the tokens left
+func (l Limit) take(tokens float64, updated, now time.Time) (float64, Result) {
+	if elapsed := now.Sub(updated); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+float64(elapsed)/float64(l.interval()))
+	}
+	if tokens < 1 {
+		return tokens, l.result(false, tokens)
+	}
+	tokens--
+	return tokens, l.result(true, tokens)
+}
+
+// Result is the state of a client's bucket after a request
+type Result struct {
+	Allowed bool
+	// Limit is the bucket's size and Remaining the requests left in it
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long a refused client should wait
+	RetryAfter time.Duration
+}
+
+// Store keeps the clients' buckets
+type Store interface {
+	// Take draws one request from the bucket named key
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Config is the rate limiting configuration services embed in their own
+type Config struct {
+	URL            string `env:"RATE_LIMIT_URL" default:"memory://" doc:"Where rate limit buckets are kept: redis://[:PASSWORD@]HOST:PORT[/DB] (or rediss://) shares them between instances, memory:// keeps them per instance"`
+	PerMinute      int    `env:"RATE_LIMIT_PER_MINUTE" default:"600" doc:"Requests a client may make a minute on the public endpoints, per API key or else per IP, in each tenant; 0 disables rate limiting"`
+	Burst          int    `env:"RATE_LIMIT_BURST" doc:"Requests a client may make at once; defaults to RATE_LIMIT_PER_MINUTE"`
+	TrustedProxies int    `env:"RATE_LIMIT_TRUSTED_PROXIES" default:"1" doc:"How many proxies in front of the service append the address they were called from to X-Forwarded-For; anonymous callers are limited by the address the outermost of them saw, or by the connection's peer when 0"`
+}
+
+// Validate checks the store URL and the limit
+func (c Config) Validate() error {
+	if c.PerMinute < 0 {
+		return errors.New("RATE_LIMIT_PER_MINUTE cannot be negative")
+	}
+	if c.Burst < 0 {
+		return errors.New("RATE_LIMIT_BURST cannot be negative")
+	}
+	if c.TrustedProxies < 0 {
+		return errors.New("RATE_LIMIT_TRUSTED_PROXIES cannot be negative")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("RATE_LIMIT_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return nil
+	case "redis", "rediss":
+		if u.Host == "" {
+			return fmt.Errorf("RATE_LIMIT_URL: %q names no Redis host", c.URL)
+		}
+		return nil
+	}
+	return fmt.Errorf("RATE_LIMIT_URL: unknown scheme %q, use redis://, rediss:// or memory://", u.Scheme)
+}
+
+// Limit returns the configured limit
+func (c Config) Limit() Limit {
+	limit := PerMinute(c.PerMinute)
+	if c.Burst > 0 {
+		limit.Burst = c.Burst
+	}
+	return limit
+}
+
+// Open returns the configured store, keeping the buckets of service apart
+// from other services' in a shared Redis. It returns nil when rate limiting
+// is disabled.
+func Open(c Config, service string) (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.PerMinute == 0 {
+		return nil, nil
+	}
+	if u, _ := url.Parse(c.URL); u.Scheme == "memory" {
+		return NewMemory(), nil
+	}
+	return DialRedis(c.URL, "ratelimit:"+service+":"), nil
+}
@@ -0,0 +1,236 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stores returns every store implementation, Redis backed by miniredis
+func stores(t *testing.T) map[string]Store {
+	mr := miniredis.RunT(t)
+	redisStore := DialRedis("redis://"+mr.Addr(), "ratelimit:test:")
+	t.Cleanup(func() { redisStore.Close() })
+	return map[string]Store{"memory": NewMemory(), "redis": redisStore}
+}
+
+func TestStore_TokenBucket(t *testing.T) {
+	limit := Limit{Rate: 60, Period: time.Minute, Burst: 3}
+	start := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			take := func(key string, at time.Time) Result {
+				t.Helper()
+				result, err := store.Take(ctx, key, limit, at)
+				require.NoError(t, err)
+				return result
+			}
+
+			for remaining := 2; remaining >= 0; remaining-- {
+				result := take("client", start)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, 3, result.Limit)
+				assert.Equal(t, remaining, result.Remaining)
+			}
+			refused := take("client", start)
+			assert.False(t, refused.Allowed)
+			assert.Equal(t, time.Second, refused.RetryAfter)
+			assert.Equal(t, 3*time.Second, refused.Reset)
+			assert.True(t, take("other", start).Allowed, "clients have their own buckets")
+
+			// One request a second comes back
+			result := take("client", start.Add(1500*time.Millisecond))
+			assert.True(t, result.Allowed)
+			assert.Equal(t, 0, result.Remaining)
+			assert.False(t, take("client", start.Add(1500*time.Millisecond)).Allowed)
+
+			// The bucket never holds more than its burst
+			result = take("client", start.Add(time.Hour))
+			assert.True(t, result.Allowed)
+			assert.Equal(t, 2, result.Remaining)
+		})
+	}
+}
+
+func TestRedis_ExpiresFullBuckets(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := DialRedis("redis://"+mr.Addr(), "ratelimit:verifier:")
+	defer store.Close()
+
+	_, err := store.Take(context.Background(), "t:default:ip:192.0.2.1", Limit{Rate: 60, Period: time.Minute, Burst: 10}, time.Now())
+	require.NoError(t, err)
+	key := "ratelimit:verifier:t:default:ip:192.0.2.1"
+	assert.True(t, mr.Exists(key))
+	mr.FastForward(2 * time.Second)
+	assert.False(t, mr.Exists(key), "a bucket is dropped once it has refilled")
+}
+
+// failingStore cannot be reached
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, Limit, time.Time) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+func serve(l *Limiter, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", nil)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	var l Limiter
+	w := serve(&l, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusTeapot, w.Code, "the zero limiter lets requests through")
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+	l.Set(NewMemory(), Limit{Rate: 2, Period: time.Minute, Burst: 2}, nil)
+	w = serve(&l, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+
+	serve(&l, "192.0.2.1:5678", nil)
+	w = serve(&l, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"rate_limited"`)
+	assert.Contains(t, w.Body.String(), "Rate limit of 2 requests per minute exceeded")
+
+	// An API key the service accepts has an allowance of its own, wherever
+	// it calls from
+	l.Set(NewMemory(), Limit{Rate: 2, Period: time.Minute, Burst: 2}, ByClient(acceptRPKey, 0))
+	serve(&l, "192.0.2.1:1234", nil)
+	serve(&l, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusTooManyRequests, serve(&l, "192.0.2.1:1234", nil).Code)
+	w = serve(&l, "192.0.2.1:1234", http.Header{"X-Api-Key": {"rp-key"}})
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, http.StatusTeapot, serve(&l, "198.51.100.7:1234", nil).Code)
+
+	// Made-up tokens draw from the caller's IP bucket, however many it makes
+	for _, token := range []string{"forged-1", "forged-2"} {
+		w = serve(&l, "203.0.113.5:1234", http.Header{"Authorization": {"Bearer " + token}})
+		assert.Equal(t, http.StatusTeapot, w.Code)
+	}
+	w = serve(&l, "203.0.113.5:1234", http.Header{"Authorization": {"Bearer forged-3"}})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	l.Set(failingStore{}, PerMinute(1), nil)
+	assert.Equal(t, http.StatusTeapot, serve(&l, "192.0.2.1:1234", nil).Code, "an unreachable store fails open")
+
+	l.Set(nil, PerMinute(1), nil)
+	assert.Empty(t, serve(&l, "192.0.2.1:1234", nil).Header().Get("RateLimit-Limit"))
+}
+
+// acceptRPKey accepts the relying party key rp-key
+func acceptRPKey(r *http.Request, credential string) (string, bool) {
+	return "rp-1", credential == "rp-key"
+}
+
+func TestByClient(t *testing.T) {
+	byClient := ByClient(acceptRPKey, 0)
+	req := httptest.NewRequest(http.MethodGet, "/packs", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "t:default:ip:192.0.2.1", byClient(req))
+
+	req.Header.Set("Authorization", "Bearer rp-key")
+	key := byClient(req)
+	assert.Regexp(t, `^t:default:key:[0-9a-f]{32}$`, key)
+	assert.NotContains(t, key, "rp-key")
+	req.Header.Set("Authorization", "DPoP rp-key")
+	assert.Equal(t, key, byClient(req), "the scheme does not matter")
+
+	req = req.WithContext(tenant.NewContext(req.Context(), tenant.Tenant{ID: "acme"}))
+	assert.Regexp(t, `^t:acme:key:`, byClient(req))
+
+	// Credentials the service rejects are keyed by IP
+	req.Header.Set("Authorization", "Bearer "+strings.Repeat("x", 40))
+	assert.Equal(t, "t:acme:ip:192.0.2.1", byClient(req))
+	assert.Equal(t, "t:acme:ip:192.0.2.1", ByClient(nil, 0)(req), "without an authenticator every caller is anonymous")
+}
+
+func TestByIP_TrustedProxies(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/packs", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	assert.Equal(t, "ip:10.0.0.2", ByIP(1)(req), "the peer without forwarding headers")
+
+	// The front end appends the address it was called from
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	assert.Equal(t, "ip:203.0.113.9", ByIP(1)(req))
+	assert.Equal(t, "ip:10.0.0.2", ByIP(0)(req), "forwarding headers are ignored without trusted proxies")
+
+	// Addresses the caller prepends, or names in other headers, are ignored
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 198.51.100.2, 203.0.113.9")
+	req.Header.Set("True-Client-IP", "198.51.100.3")
+	req.Header.Add("X-Real-IP", "198.51.100.4")
+	assert.Equal(t, "ip:203.0.113.9", ByIP(1)(req))
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	assert.Equal(t, "ip:203.0.113.9", ByIP(2)(req), "behind a load balancer and the front end")
+
+	// Once chi's RealIP has replaced the peer, the recorded one is used
+	var keyed string
+	handler := Peer(middleware.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyed = ByIP(0)(r)
+	})))
+	req = httptest.NewRequest(http.MethodGet, "/packs", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "ip:192.0.2.1", keyed)
+}
+
+func TestConfig(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		err    string
+	}{
+		{Config{URL: "memory://", PerMinute: 600}, ""},
+		{Config{URL: "redis://:secret@redis.internal:6379/2", PerMinute: 600}, ""},
+		{Config{URL: "rediss://redis.internal:6380", PerMinute: 600, Burst: 50}, ""},
+		{Config{URL: "redis:///0", PerMinute: 600}, "names no Redis host"},
+		{Config{URL: "memcached://cache:11211", PerMinute: 600}, "unknown scheme"},
+		{Config{URL: "memory://", PerMinute: -1}, "RATE_LIMIT_PER_MINUTE cannot be negative"},
+		{Config{URL: "memory://", PerMinute: 600, Burst: -1}, "RATE_LIMIT_BURST cannot be negative"},
+		{Config{URL: "memory://", PerMinute: 600, TrustedProxies: -1}, "RATE_LIMIT_TRUSTED_PROXIES cannot be negative"},
+	} {
+		err := c.config.Validate()
+		if c.err == "" {
+			assert.NoError(t, err, c.config.URL)
+		} else {
+			assert.ErrorContains(t, err, c.err)
+		}
+	}
+
+	assert.Equal(t, Limit{Rate: 600, Period: time.Minute, Burst: 50}, Config{PerMinute: 600, Burst: 50}.Limit())
+
+	store, err := Open(Config{URL: "memory://"}, "verifier")
+	require.NoError(t, err)
+	assert.Nil(t, store, "limiting is off without a rate")
+	store, err = Open(Config{URL: "memory://", PerMinute: 600}, "verifier")
+	require.NoError(t, err)
+	assert.IsType(t, &Memory{}, store)
+	store, err = Open(Config{URL: "redis://redis.internal:6379", PerMinute: 600}, "verifier")
+	require.NoError(t, err)
+	assert.Equal(t, "ratelimit:verifier:", store.(*Redis).prefix)
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// takeScript refills and draws from a bucket atomically. Buckets are hashes
+// of their tokens and the time, in microseconds, they were last updated;
+// they expire once full, as a missing bucket is a full one. The tokens are
+// returned as a string since Redis truncates Lua numbers to integers.
+var takeScript = redis.NewScript(1, `
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+if now > updated then
+  tokens = math.min(burst, tokens + (now - updated) / interval)
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) * interval / 1000) + 1)
+return {allowed, tostring(tokens)}
+`)
+
+// Redis keeps buckets in Redis, shared by every instance of a service
+type Redis struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedis keeps buckets through pool, under keys starting with prefix
+func NewRedis(pool *redis.Pool, prefix string) *Redis {
+	return &Redis{pool: pool, prefix: prefix}
+}
+
+// DialRedis keeps buckets in the Redis at rawURL, connecting on first use
+func DialRedis(rawURL, prefix string) *Redis {
+	return NewRedis(&redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialURLContext(ctx, rawURL,
+				redis.DialConnectTimeout(2*time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second))
+		},
+	}, prefix)
+}
+
+// Take draws one request from the bucket named key
+func (s *Redis) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("connecting to redis: %w", err)
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(takeScript.DoContext(ctx, conn, s.prefix+key,
+		limit.Burst, limit.interval().Microseconds(), now.UnixMicro()))
+	if err != nil {
+		return Result{}, fmt.Errorf("taking from rate limit bucket: %w", err)
+	}
+	var allowed int
+	var tokens string
+	if _, err := redis.Scan(reply, &allowed, &tokens); err != nil {
+		return Result{}, fmt.Errorf("reading rate limit bucket: %w", err)
+	}
+	left, err := strconv.ParseFloat(tokens, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("reading rate limit bucket: %w", err)
+	}
+	return limit.result(allowed == 1, left), nil
+}
+
+// Close releases the pooled connections
+func (s *Redis) Close() error {
+	return s.pool.Close()
+}
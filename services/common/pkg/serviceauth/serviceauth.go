@@ -0,0 +1,302 @@
+// Package serviceauth authenticates calls between Cachet services.
+//
+// A calling service attaches a short-lived JWT naming itself as issuer and
+// the service it calls as audience, signed with its own ES256 key. Each
+// service holds the public keys of its peers, filed under their names, and
+// accepts a token only under the keys of the service it names, so no service
+// can speak for another. Internal endpoints sit behind Require, which
+// rejects requests without a valid token from an allowed caller, so only
+// Cachet services can reach them. The token travels in its own header so it
+// never clashes with the Authorization header callers use on behalf of users
+// or operators.
+//
+// Keys are rotated by appending the new public key to the service's file in
+// every peer directory before the service switches to it.
+package serviceauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Header carries the caller's service token
+const Header = "X-Cachet-Service-Token"
+
+// CodeUnauthorized is the problem code of calls without a valid service token
+const CodeUnauthorized = "service_unauthorized"
+
+// TokenLifetime bounds how long a stolen token can be replayed
+const TokenLifetime = 5 * time.Minute
+
+// Config is the service authentication configuration services embed in
+// their own
+type Config struct {
+	Key      string `env:"SERVICE_AUTH_KEY" doc:"PEM file holding the P-256 private key the service signs its service-to-service tokens with; required outside development, where internal endpoints accept any caller without it"`
+	PeerKeys string `env:"SERVICE_AUTH_PEER_KEYS" doc:"Directory of <service>.pem files, each holding the PEM public keys of the named Cachet service, whose tokens internal endpoints accept"`
+}
+
+// Validate checks the service can sign its tokens, which it must outside
+// development
+func (c Config) Validate(development bool) error {
+	if c.Key == "" && !development {
+		return errors.New("SERVICE_AUTH_KEY is required outside development, as internal endpoints would otherwise serve any caller")
+	}
+	if c.PeerKeys != "" {
+		if info, err := os.Stat(c.PeerKeys); err != nil {
+			return fmt.Errorf("SERVICE_AUTH_PEER_KEYS: %w", err)
+		} else if !info.IsDir() {
+			return errors.New("SERVICE_AUTH_PEER_KEYS must be a directory")
+		}
+	}
+	return nil
+}
+
+var (
+	// ErrMissingToken is returned for requests without a service token
+	ErrMissingToken = errors.New("no service token")
+	// ErrCallerNotAllowed is returned for valid tokens from services the
+	// endpoint does not serve
+	ErrCallerNotAllowed = errors.New("caller is not allowed")
+)
+
+// Authenticator signs the service's outgoing calls and checks incoming ones
+type Authenticator struct {
+	service string
+	signer  *signing.Signer
+	peers   map[string][]jwt.VerificationKey
+	now     func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+}
+
+// New authenticates service with the configured keys. It returns nil when
+// none are configured, which Validate only allows in development; a nil
+// Authenticator signs nothing and lets every call through. Without peer
+// keys the service can call others but its internal endpoints serve no one.
+func New(service string, config Config) (*Authenticator, error) {
+	if config.Key == "" && config.PeerKeys == "" {
+		return nil, nil
+	}
+	a := &Authenticator{
+		service: service,
+		peers:   make(map[string][]jwt.VerificationKey),
+		now:     time.Now,
+		tokens:  make(map[string]cachedToken),
+	}
+	if config.Key != "" {
+		signer, err := signing.Load(config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("SERVICE_AUTH_KEY: %w", err)
+		}
+		a.signer = signer
+	}
+	if config.PeerKeys != "" {
+		files, err := filepath.Glob(filepath.Join(config.PeerKeys, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("SERVICE_AUTH_PEER_KEYS: %w", err)
+		}
+		for _, file := range files {
+			keys, err := loadPublicKeys(file)
+			if err != nil {
+				return nil, fmt.Errorf("SERVICE_AUTH_PEER_KEYS: %w", err)
+			}
+			a.peers[strings.TrimSuffix(filepath.Base(file), ".pem")] = keys
+		}
+	}
+	return a, nil
+}
+
+// loadPublicKeys reads the PEM-encoded P-256 public keys in file, several
+// while a service rotates its key
+func loadPublicKeys(file string) ([]jwt.VerificationKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwt.VerificationKey
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %w", file, len(keys), err)
+		}
+		key, ok := parsed.(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: key %d is not a P-256 key", file, len(keys))
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no PEM public key", file)
+	}
+	return keys, nil
+}
+
+// Service names the service the authenticator speaks for
+func (a *Authenticator) Service() string {
+	return a.service
+}
+
+// Token returns a token for calling audience, reused until shortly before
+// it expires
+func (a *Authenticator) Token(audience string) (string, error) {
+	if a.signer == nil {
+		return "", errors.New("SERVICE_AUTH_KEY is unset")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if cached, ok := a.tokens[audience]; ok && now.Add(time.Minute).Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+	expiresAt := now.Add(TokenLifetime)
+	signed, err := a.signer.Sign(claims{jwt.RegisteredClaims{
+		Issuer:    a.service,
+		Subject:   a.service,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}})
+	if err != nil {
+		return "", err
+	}
+	a.tokens[audience] = cachedToken{token: signed, expiresAt: expiresAt}
+	return signed, nil
+}
+
+// Verify checks a token was issued by another Cachet service for this one,
+// signed with one of that service's keys, and returns the caller's name
+func (a *Authenticator) Verify(token string) (string, error) {
+	if token == "" {
+		return "", ErrMissingToken
+	}
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(t *jwt.Token) (interface{}, error) {
+		keys, ok := a.peers[c.Issuer]
+		if !ok {
+			return nil, fmt.Errorf("unknown service %q", c.Issuer)
+		}
+		return jwt.VerificationKeySet{Keys: keys}, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithAudience(a.service),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(a.now),
+	)
+	if err != nil {
+		return "", err
+	}
+	if c.Issuer == "" || c.Issuer != c.Subject {
+		return "", errors.New("token does not name its issuing service")
+	}
+	if c.ExpiresAt.Sub(c.IssuedAt.Time) > TokenLifetime {
+		return "", errors.New("token outlives the service token lifetime")
+	}
+	return c.Issuer, nil
+}
+
+// Transport attaches a token for audience to every request sent through
+// base. A nil Authenticator returns base unchanged.
+func (a *Authenticator) Transport(audience string, base http.RoundTripper) http.RoundTripper {
+	if a == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		token, err := a.Token(audience)
+		if err != nil {
+			return nil, fmt.Errorf("signing service token for %s: %w", audience, err)
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set(Header, token)
+		return base.RoundTrip(req)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type callerKey struct{}
+
+// Caller returns the service that made the request, when it was
+// authenticated
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// Authenticate checks the request's service token and returns the caller
+func (a *Authenticator) Authenticate(r *http.Request, callers ...string) (string, error) {
+	caller, err := a.Verify(r.Header.Get(Header))
+	if err != nil {
+		return "", err
+	}
+	if len(callers) > 0 && !contains(callers, caller) {
+		return "", fmt.Errorf("%w: %s", ErrCallerNotAllowed, caller)
+	}
+	return caller, nil
+}
+
+// Require guards internal endpoints: requests need a valid token from one
+// of callers, or from any Cachet service when none are given. A nil
+// Authenticator lets every request through, for development.
+func (a *Authenticator) Require(callers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller, err := a.Authenticate(r, callers...)
+			if err != nil {
+				log.Warn().Err(err).Str("path", r.URL.Path).Msg("Rejected internal call")
+				problem.Write(w, r, http.StatusUnauthorized, CodeUnauthorized, "This endpoint only serves Cachet services")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
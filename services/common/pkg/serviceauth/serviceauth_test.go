@@ -0,0 +1,196 @@
+package serviceauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deployment holds each service's key and the directory of their public
+// keys every service reads
+type deployment struct {
+	dir   string
+	peers string
+	keys  map[string]*ecdsa.PrivateKey
+}
+
+func newDeployment(t *testing.T, services ...string) *deployment {
+	t.Helper()
+	d := &deployment{dir: t.TempDir(), keys: make(map[string]*ecdsa.PrivateKey)}
+	d.peers = filepath.Join(d.dir, "peers")
+	require.NoError(t, os.Mkdir(d.peers, 0o700))
+	for _, service := range services {
+		d.rotate(t, service)
+	}
+	return d
+}
+
+// rotate gives service a new key, appending its public half to the key
+// the service's peers already trust
+func (d *deployment) rotate(t *testing.T, service string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	d.keys[service] = key
+	private, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(d.dir, service+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: private}), 0o600))
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	f, err := os.OpenFile(filepath.Join(d.peers, service+".pem"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+}
+
+func (d *deployment) config(service string) Config {
+	return Config{Key: filepath.Join(d.dir, service+".key"), PeerKeys: d.peers}
+}
+
+func (d *deployment) authenticator(t *testing.T, service string) *Authenticator {
+	t.Helper()
+	a, err := New(service, d.config(service))
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	return a
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate(true))
+	assert.ErrorContains(t, Config{}.Validate(false), "SERVICE_AUTH_KEY is required outside development")
+	assert.ErrorContains(t, Config{Key: "service.key", PeerKeys: filepath.Join(t.TempDir(), "missing")}.Validate(false), "SERVICE_AUTH_PEER_KEYS")
+}
+
+func TestNew(t *testing.T) {
+	a, err := New("verifier", Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, a, "no keys, no authentication")
+
+	d := newDeployment(t, "verifier")
+	_, err = New("verifier", Config{Key: filepath.Join(d.dir, "missing.key")})
+	assert.ErrorContains(t, err, "SERVICE_AUTH_KEY")
+
+	require.NoError(t, os.WriteFile(filepath.Join(d.peers, "registry.pem"), []byte("not a key"), 0o600))
+	_, err = New("verifier", d.config("verifier"))
+	assert.ErrorContains(t, err, "registry.pem holds no PEM public key")
+}
+
+func TestVerify(t *testing.T) {
+	d := newDeployment(t, "verifier", "receipts-log", "registry", "issuance-gateway")
+	verifier := d.authenticator(t, "verifier")
+	receipts := d.authenticator(t, "receipts-log")
+
+	token, err := verifier.Token("receipts-log")
+	require.NoError(t, err)
+	again, err := verifier.Token("receipts-log")
+	require.NoError(t, err)
+	assert.Equal(t, token, again, "tokens are reused until they near expiry")
+
+	caller, err := receipts.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "verifier", caller)
+
+	registry := d.authenticator(t, "registry")
+	_, err = registry.Verify(token)
+	assert.ErrorContains(t, err, "audience", "tokens only serve the service they were minted for")
+
+	// The gateway cannot speak for the verifier: its key is not the verifier's
+	impostor, err := New("verifier", Config{Key: d.config("issuance-gateway").Key})
+	require.NoError(t, err)
+	forged, err := impostor.Token("receipts-log")
+	require.NoError(t, err)
+	_, err = receipts.Verify(forged)
+	assert.Error(t, err)
+
+	stranger, err := New("billing", Config{Key: d.config("issuance-gateway").Key})
+	require.NoError(t, err)
+	forged, err = stranger.Token("receipts-log")
+	require.NoError(t, err)
+	_, err = receipts.Verify(forged)
+	assert.ErrorContains(t, err, `unknown service "billing"`)
+
+	_, err = receipts.Verify("")
+	assert.ErrorIs(t, err, ErrMissingToken)
+}
+
+func TestVerify_Rotation(t *testing.T) {
+	d := newDeployment(t, "verifier", "receipts-log")
+	old := d.authenticator(t, "verifier")
+	d.rotate(t, "verifier")
+	receipts := d.authenticator(t, "receipts-log")
+
+	for _, a := range []*Authenticator{old, d.authenticator(t, "verifier")} {
+		token, err := a.Token("receipts-log")
+		require.NoError(t, err)
+		caller, err := receipts.Verify(token)
+		require.NoError(t, err, "both keys verify while the verifier rotates")
+		assert.Equal(t, "verifier", caller)
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	d := newDeployment(t, "verifier", "receipts-log")
+	verifier := d.authenticator(t, "verifier")
+	receipts := d.authenticator(t, "receipts-log")
+	token, err := verifier.Token("receipts-log")
+	require.NoError(t, err)
+
+	receipts.now = func() time.Time { return time.Now().Add(TokenLifetime + time.Minute) }
+	_, err = receipts.Verify(token)
+	assert.ErrorContains(t, err, "expired")
+}
+
+func TestRequire(t *testing.T) {
+	d := newDeployment(t, "verifier", "issuance-gateway", "receipts-log")
+	verifier := d.authenticator(t, "verifier")
+	gateway := d.authenticator(t, "issuance-gateway")
+	receipts := d.authenticator(t, "receipts-log")
+
+	var seen string
+	handler := receipts.Require("verifier")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = Caller(r.Context())
+	}))
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+
+	call := func(a *Authenticator) int {
+		client := &http.Client{Transport: a.Transport("receipts-log", nil)}
+		resp, err := client.Post(backend.URL, "application/json", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, call(verifier))
+	assert.Equal(t, "verifier", seen)
+	assert.Equal(t, http.StatusUnauthorized, call(gateway), "only the listed callers are served")
+	assert.Equal(t, http.StatusUnauthorized, call(nil), "unauthenticated calls are rejected")
+
+	lonely, err := New("receipts-log", Config{Key: d.config("receipts-log").Key})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	token, err := verifier.Token("receipts-log")
+	require.NoError(t, err)
+	req.Header.Set(Header, token)
+	lonely.Require()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "without peer keys no caller is served")
+
+	var open *Authenticator
+	w = httptest.NewRecorder()
+	open.Require("verifier")(handler).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the inner handler still guards")
+	w = httptest.NewRecorder()
+	open.Require()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "without keys every call is let through")
+}
@@ -0,0 +1,138 @@
+// Package signing signs the JWS a service issues with its ES256 key, named
+// by the key's RFC 7638 thumbprint so verifiers find it in the JWKS or DID
+// document the service publishes.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signer produces ES256 JWS signatures with one P-256 key
+type Signer struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+}
+
+// New signs with key, which must be on P-256
+func New(key *ecdsa.PrivateKey) (*Signer, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, errors.New("signing key is not on P-256")
+	}
+	s := &Signer{key: key}
+	keyID, err := s.PublicJWK().Thumbprint()
+	if err != nil {
+		return nil, fmt.Errorf("deriving key ID: %w", err)
+	}
+	s.keyID = keyID
+	return s, nil
+}
+
+// Load signs with the PEM-encoded P-256 private key, SEC 1 or PKCS #8, in
+// the file at path, so signatures keep verifying under the same kid across
+// restarts
+func Load(path string) (*Signer, error) {
+	key, err := LoadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(key)
+}
+
+// LoadKey reads a PEM-encoded P-256 private key, SEC 1 or PKCS #8
+func LoadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		parsed, perr := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if perr != nil {
+			return nil, fmt.Errorf("parsing signing key: %w", perr)
+		}
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, errors.New("signing key is not an EC key")
+		}
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("signing key is not on P-256")
+	}
+	return key, nil
+}
+
+// Generate signs with a fresh key. Its signatures stop verifying once the
+// process exits, so it suits development and tests only.
+func Generate() (*Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating signing key: %w", err)
+	}
+	return New(key)
+}
+
+// KeyID is the thumbprint the signer names its key by in kid headers
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// PublicKey returns the verification key
+func (s *Signer) PublicKey() *ecdsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+// PublicJWK returns the verification key in JWK form
+func (s *Signer) PublicJWK() didresolver.JWK {
+	size := (s.key.Curve.Params().BitSize + 7) / 8
+	return didresolver.JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(s.key.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(s.key.Y.FillBytes(make([]byte, size))),
+		Kid: s.keyID,
+		Use: "sig",
+		Alg: "ES256",
+	}
+}
+
+// Token prepares an unsigned JWS over claims naming the signer's key, with
+// the given typ header, or JWT when typ is empty, for callers that add
+// headers of their own before SignToken
+func (s *Signer) Token(typ string, claims jwt.Claims) *jwt.Token {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.keyID
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	return token
+}
+
+// SignToken returns token as a compact JWS
+func (s *Signer) SignToken(token *jwt.Token) (string, error) {
+	return token.SignedString(s.key)
+}
+
+// Sign returns a compact JWS over claims with typ JWT
+func (s *Signer) Sign(claims jwt.Claims) (string, error) {
+	return s.SignToken(s.Token("", claims))
+}
+
+// SignTyped returns a compact JWS over claims with the given typ header
+func (s *Signer) SignTyped(typ string, claims jwt.Claims) (string, error) {
+	return s.SignToken(s.Token(typ, claims))
+}
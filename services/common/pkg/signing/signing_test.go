@@ -0,0 +1,68 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	signer, err := Generate()
+	require.NoError(t, err)
+
+	thumbprint, err := signer.PublicJWK().Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, thumbprint, signer.KeyID())
+	assert.Equal(t, signer.KeyID(), signer.PublicJWK().Kid)
+
+	jws, err := signer.SignTyped("test+jwt", jwt.MapClaims{"sub": "alice"})
+	require.NoError(t, err)
+	token, err := jwt.Parse(jws, func(token *jwt.Token) (interface{}, error) {
+		return signer.PublicJWK().PublicKey()
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	require.NoError(t, err)
+	assert.Equal(t, signer.KeyID(), token.Header["kid"])
+	assert.Equal(t, "test+jwt", token.Header["typ"])
+
+	jws, err = signer.Sign(jwt.MapClaims{"sub": "alice"})
+	require.NoError(t, err)
+	token, _, err = jwt.NewParser().ParseUnverified(jws, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "JWT", token.Header["typ"])
+}
+
+func TestLoad(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	first, err := Load(path)
+	require.NoError(t, err)
+	second, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, first.KeyID(), second.KeyID(), "a loaded key keeps its kid across restarts")
+	assert.True(t, key.PublicKey.Equal(first.PublicKey()))
+
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0o600))
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "not PEM")
+}
+
+func TestNew_RejectsOtherCurves(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = New(key)
+	assert.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// MigrationsDir is where Migrate looks for migrations, the layout
+// `//go:embed migrations` produces
+const MigrationsDir = "migrations"
+
+var migrationFile = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.sql$`)
+
+// Migration is one numbered SQL script
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// LoadMigrations reads the NNNN_name.sql files in the migrations directory
+// of fsys, in version order. Other files are ignored; two files with one
+// version are an error.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, MigrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("migration %s: version must be a positive number", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+		script, err := fs.ReadFile(fsys, path.Join(MigrationsDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: match[2], SQL: string(script)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the migrations in fsys the schema has not seen yet,
+// recording each in schema_migrations, and returns the ones it applied. It
+// runs in one transaction under an advisory lock on the schema, so
+// instances starting together apply each migration once and a failed
+// migration leaves the schema as it was.
+// Migrations therefore cannot use statements Postgres refuses inside a
+// transaction, such as CREATE INDEX CONCURRENTLY.
+func (db *DB) Migrate(ctx context.Context, fsys fs.FS) ([]Migration, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "cachet-migrate:"+db.schema); err != nil {
+		return nil, fmt.Errorf("locking schema %s: %w", db.schema, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer     PRIMARY KEY,
+			name       text        NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+			return nil, fmt.Errorf("applying migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+			return nil, err
+		}
+		pending = append(pending, migration)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
@@ -0,0 +1,172 @@
+// Package store opens the Postgres database Cachet services share.
+//
+// Every service keeps its tables in a schema of its own: connections are
+// opened with the service's schema as their search_path, so unqualified
+// table names resolve there and services cannot trip over each other's
+// tables. The schema is created on open and brought up to date by Migrate
+// from SQL files embedded in the service binary.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Pool defaults, sized for a Cloud Run instance serving a few dozen
+// concurrent requests
+const (
+	DefaultMaxOpenConns    = 10
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = 30 * time.Minute
+)
+
+// healthTimeout bounds Check so a stalled database fails the health check
+// rather than hanging it
+const healthTimeout = 2 * time.Second
+
+// uniqueViolation is the Postgres SQLSTATE for a duplicate key
+const uniqueViolation = "23505"
+
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Config says where the database is, which schema the service owns and how
+// large its connection pool may grow
+type Config struct {
+	URL             string
+	Schema          string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Validate rejects configs without a URL, with a schema name that would
+// need quoting, or with a pool that cannot hold a connection
+func (c Config) Validate() error {
+	switch {
+	case c.URL == "":
+		return errors.New("database URL is required")
+	case !schemaName.MatchString(c.Schema):
+		return fmt.Errorf("schema %q must be a lower case SQL identifier", c.Schema)
+	case c.MaxOpenConns <= 0:
+		return errors.New("max open connections must be positive")
+	case c.MaxIdleConns < 0 || c.MaxIdleConns > c.MaxOpenConns:
+		return errors.New("max idle connections must be between 0 and max open connections")
+	case c.ConnMaxLifetime < 0:
+		return errors.New("connection max lifetime must not be negative")
+	}
+	return nil
+}
+
+// ConfigFromEnv reads DATABASE_URL, DATABASE_MAX_CONNS,
+// DATABASE_MAX_IDLE_CONNS and DATABASE_CONN_MAX_LIFETIME (a Go duration)
+// for a service owning schema. It returns nil when DATABASE_URL is unset.
+func ConfigFromEnv(schema string) (*Config, error) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		return nil, nil
+	}
+	config := Config{
+		URL:             url,
+		Schema:          schema,
+		MaxOpenConns:    DefaultMaxOpenConns,
+		MaxIdleConns:    DefaultMaxIdleConns,
+		ConnMaxLifetime: DefaultConnMaxLifetime,
+	}
+	if v := os.Getenv("DATABASE_MAX_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("DATABASE_MAX_CONNS: %w", err)
+		}
+		config.MaxOpenConns = n
+		if config.MaxIdleConns > n {
+			config.MaxIdleConns = n
+		}
+	}
+	if v := os.Getenv("DATABASE_MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("DATABASE_MAX_IDLE_CONNS: %w", err)
+		}
+		config.MaxIdleConns = n
+	}
+	if v := os.Getenv("DATABASE_CONN_MAX_LIFETIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("DATABASE_CONN_MAX_LIFETIME: %w", err)
+		}
+		config.ConnMaxLifetime = d
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid database config: %w", err)
+	}
+	return &config, nil
+}
+
+// DB is a connection pool scoped to one service's schema
+type DB struct {
+	*sql.DB
+	schema string
+}
+
+// Open connects to the database, creates the service's schema if needed and
+// scopes every pooled connection to it
+func Open(ctx context.Context, config Config) (*DB, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid database config: %w", err)
+	}
+	connConfig, err := pgx.ParseConfig(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing database URL: %w", err)
+	}
+	connConfig.RuntimeParams["search_path"] = config.Schema
+
+	db := stdlib.OpenDB(*connConfig)
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+config.Schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema %s: %w", config.Schema, err)
+	}
+	return &DB{DB: db, schema: config.Schema}, nil
+}
+
+// Schema is the schema the pool's connections are scoped to
+func (db *DB) Schema() string {
+	return db.schema
+}
+
+// Checker is what a service's health check asks about its database
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Check reports whether the database answers, for health checks
+func (db *DB) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database unavailable: %w", err)
+	}
+	return nil
+}
+
+// IsUniqueViolation reports whether err is a duplicate key error
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	config, err := ConfigFromEnv("registry")
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	t.Setenv("DATABASE_URL", "postgres://cachet@localhost/cachet")
+	config, err = ConfigFromEnv("registry")
+	require.NoError(t, err)
+	assert.Equal(t, "registry", config.Schema)
+	assert.Equal(t, DefaultMaxOpenConns, config.MaxOpenConns)
+	assert.Equal(t, DefaultMaxIdleConns, config.MaxIdleConns)
+	assert.Equal(t, DefaultConnMaxLifetime, config.ConnMaxLifetime)
+
+	// A small pool keeps no more idle connections than it may open
+	t.Setenv("DATABASE_MAX_CONNS", "2")
+	t.Setenv("DATABASE_CONN_MAX_LIFETIME", "5m")
+	config, err = ConfigFromEnv("registry")
+	require.NoError(t, err)
+	assert.Equal(t, 2, config.MaxOpenConns)
+	assert.Equal(t, 2, config.MaxIdleConns)
+	assert.Equal(t, 5*time.Minute, config.ConnMaxLifetime)
+
+	for name, env := range map[string][2]string{
+		"not a number":   {"DATABASE_MAX_CONNS", "many"},
+		"empty pool":     {"DATABASE_MAX_CONNS", "0"},
+		"too many idle":  {"DATABASE_MAX_IDLE_CONNS", "3"},
+		"not a duration": {"DATABASE_CONN_MAX_LIFETIME", "forever"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			_, err := ConfigFromEnv("registry")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConfig_ValidateSchema(t *testing.T) {
+	config := Config{URL: "postgres://localhost/cachet", MaxOpenConns: 1}
+	for _, schema := range []string{"registry", "receipts_log", "_private"} {
+		config.Schema = schema
+		assert.NoError(t, config.Validate(), schema)
+	}
+	for _, schema := range []string{"", "Registry", "receipts-log", "1registry", "public; DROP TABLE packs"} {
+		config.Schema = schema
+		assert.Error(t, config.Validate(), schema)
+	}
+}
+
+func TestOpen_RejectsInvalidConfig(t *testing.T) {
+	_, err := Open(context.Background(), Config{URL: "postgres://localhost/cachet", Schema: "Bad Schema", MaxOpenConns: 1})
+	assert.ErrorContains(t, err, "invalid database config")
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"migrations/0002_add_index.sql": {Data: []byte("CREATE INDEX things_name_idx ON things (name);")},
+		"migrations/0001_initial.sql":   {Data: []byte("CREATE TABLE things (name text);")},
+		"migrations/README.md":          {Data: []byte("not a migration")},
+		"schema.sql":                    {Data: []byte("outside the migrations directory")},
+	})
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "initial", SQL: "CREATE TABLE things (name text);"}, migrations[0])
+	assert.Equal(t, 2, migrations[1].Version)
+	assert.Equal(t, "add_index", migrations[1].Name)
+}
+
+func TestLoadMigrations_Rejected(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"shared version": {
+			"migrations/0001_initial.sql": {Data: []byte("SELECT 1;")},
+			"migrations/1_again.sql":      {Data: []byte("SELECT 1;")},
+		},
+		"version zero": {"migrations/0000_initial.sql": {Data: []byte("SELECT 1;")}},
+		"no directory": {"0001_initial.sql": {Data: []byte("SELECT 1;")}},
+	} {
+		_, err := LoadMigrations(fsys)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,334 @@
+// Package tenant lets one Cachet deployment serve several brands or issuers.
+//
+// The tenants are listed in a YAML file shared by the services of a
+// deployment, named by TENANTS_CONFIG. Each entry has an id, the hostnames
+// it is served on and its quota, followed by a section per service holding
+// that service's own settings, such as the issuance gateway's signing key:
+//
+//	tenants:
+//	  - id: acme
+//	    name: Acme ID
+//	    hosts: [id.acme.example]
+//	    quota: {requestsPerMinute: 600}
+//	    issuer: {did: "did:web:id.acme.example"}
+//
+// A Directory resolves each request to a tenant, by hostname or by a
+// /t/{id} path prefix, and puts it in the request context, where handlers
+// and stores read it with FromContext. Requests matching no tenant belong to
+// the default tenant, so a deployment without a tenants file behaves as a
+// single-tenant one.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultID is the tenant requests belong to when no other one matches
+const DefaultID = "default"
+
+// PathPrefix is the path segment requests name a tenant under, as in
+// /t/acme/packs
+const PathPrefix = "/t/"
+
+// Problem codes of the requests the directory refuses
+const (
+	CodeUnknownTenant = "unknown_tenant"
+	CodeQuotaExceeded = "tenant_quota_exceeded"
+)
+
+// idPattern keeps tenant ids usable in paths, hostnames and database keys
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is a brand or issuer served by the deployment
+type Tenant struct {
+	ID    string   `yaml:"id"`
+	Name  string   `yaml:"name"`
+	Hosts []string `yaml:"hosts"`
+	Quota Quota    `yaml:"quota"`
+}
+
+// Quota bounds the requests a tenant may make of each instance of a service
+type Quota struct {
+	// RequestsPerMinute is counted per instance; zero leaves it unbounded
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+}
+
+// Config is the tenancy configuration services embed in their own
+type Config struct {
+	File string `env:"TENANTS_CONFIG" doc:"YAML file listing the tenants the deployment serves, with their hostnames, quotas and per-service settings; every request belongs to the default tenant without it"`
+}
+
+// Validate checks the tenants file can be read
+func (c Config) Validate() error {
+	if c.File == "" {
+		return nil
+	}
+	if _, err := os.Stat(c.File); err != nil {
+		return fmt.Errorf("TENANTS_CONFIG: %w", err)
+	}
+	return nil
+}
+
+// Entry is a tenant of the tenants file with the settings a service reads
+// from it. S is a struct whose fields name the service's sections.
+type Entry[S any] struct {
+	Tenant   `yaml:",inline"`
+	Settings S `yaml:",inline"`
+}
+
+// Load reads and checks the tenants file, returning its entries with the
+// service's settings. Without a file there are none.
+func Load[S any](c Config) ([]Entry[S], error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading tenants: %w", err)
+	}
+	var file struct {
+		Tenants []Entry[S] `yaml:"tenants"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decoding tenants: %w", err)
+	}
+	if _, err := newIndex(Tenants(file.Tenants)); err != nil {
+		return nil, fmt.Errorf("invalid tenants: %w", err)
+	}
+	return file.Tenants, nil
+}
+
+// Tenants returns the tenants of a file's entries
+func Tenants[S any](entries []Entry[S]) []Tenant {
+	tenants := make([]Tenant, len(entries))
+	for i, entry := range entries {
+		tenants[i] = entry.Tenant
+	}
+	return tenants
+}
+
+// Directory resolves requests to the tenants of a deployment and holds
+// them to their quotas. The zero Directory serves the default tenant alone.
+type Directory struct {
+	index atomic.Pointer[index]
+
+	mu      sync.Mutex
+	windows map[string]*window
+	now     func() time.Time // time.Now when nil
+}
+
+// index finds tenants by id and hostname
+type index struct {
+	tenants  map[string]*Tenant
+	hosts    map[string]*Tenant
+	fallback *Tenant
+}
+
+// window counts a tenant's requests in the current minute
+type window struct {
+	start time.Time
+	count int
+}
+
+// newIndex checks tenants and indexes them by id and hostname. The default
+// tenant is added unless listed, without a quota.
+func newIndex(tenants []Tenant) (*index, error) {
+	x := &index{
+		tenants: make(map[string]*Tenant, len(tenants)+1),
+		hosts:   map[string]*Tenant{},
+	}
+	for i := range tenants {
+		t := &tenants[i]
+		switch {
+		case !idPattern.MatchString(t.ID):
+			return nil, fmt.Errorf("tenant id %q must be lowercase letters, digits and dashes", t.ID)
+		case x.tenants[t.ID] != nil:
+			return nil, fmt.Errorf("tenant %q is listed twice", t.ID)
+		case t.Quota.RequestsPerMinute < 0:
+			return nil, fmt.Errorf("tenant %q: quota.requestsPerMinute must not be negative", t.ID)
+		}
+		x.tenants[t.ID] = t
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if other := x.hosts[host]; other != nil {
+				return nil, fmt.Errorf("host %q is served for both %q and %q", host, other.ID, t.ID)
+			}
+			x.hosts[host] = t
+		}
+	}
+	if x.tenants[DefaultID] == nil {
+		x.tenants[DefaultID] = &Tenant{ID: DefaultID}
+	}
+	x.fallback = x.tenants[DefaultID]
+	return x, nil
+}
+
+// Set replaces the tenants served; services set them once at startup
+func (d *Directory) Set(tenants []Tenant) error {
+	x, err := newIndex(append([]Tenant(nil), tenants...))
+	if err != nil {
+		return err
+	}
+	d.index.Store(x)
+	return nil
+}
+
+// current returns the tenants served
+func (d *Directory) current() *index {
+	if x := d.index.Load(); x != nil {
+		return x
+	}
+	x, _ := newIndex(nil)
+	d.index.CompareAndSwap(nil, x)
+	return d.index.Load()
+}
+
+// Get returns the tenant with the given id
+func (d *Directory) Get(id string) (Tenant, bool) {
+	t, ok := d.current().tenants[id]
+	if !ok {
+		return Tenant{}, false
+	}
+	return *t, true
+}
+
+// All returns every tenant, the default one included, by id
+func (d *Directory) All() []Tenant {
+	x := d.current()
+	all := make([]Tenant, 0, len(x.tenants))
+	for _, t := range x.tenants {
+		all = append(all, *t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// Resolve finds the tenant of a request: the one serving its host, else
+// the one named by its /t/{id} prefix, else the default tenant. It returns
+// the path prefix the tenant was named by, and false when the prefix names
+// no tenant.
+func (d *Directory) Resolve(r *http.Request) (Tenant, string, bool) {
+	x := d.current()
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t := x.hosts[strings.ToLower(host)]; t != nil {
+		return *t, "", true
+	}
+	if rest, ok := strings.CutPrefix(r.URL.Path, PathPrefix); ok {
+		id, _, _ := strings.Cut(rest, "/")
+		t := x.tenants[id]
+		if t == nil {
+			return Tenant{}, "", false
+		}
+		return *t, PathPrefix + id, true
+	}
+	return *x.fallback, "", true
+}
+
+// Middleware puts each request's tenant in its context, strips the tenant's
+// path prefix so routes match as for the default tenant, and refuses
+// requests for unknown tenants and beyond a tenant's quota
+func (d *Directory) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, prefix, ok := d.Resolve(r)
+		if !ok {
+			problem.Write(w, r, http.StatusNotFound, CodeUnknownTenant, "No tenant is served under this path")
+			return
+		}
+		if retry, ok := d.admit(t); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			problem.Write(w, r, http.StatusTooManyRequests, CodeQuotaExceeded, fmt.Sprintf("Tenant %s is over its quota of %d requests per minute", t.ID, t.Quota.RequestsPerMinute))
+			return
+		}
+		if prefix != "" {
+			r = r.Clone(r.Context())
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r.WithContext(newContext(r.Context(), t, prefix)))
+	})
+}
+
+// admit counts a request against the tenant's quota, returning how long
+// until the next one is admitted when it is over
+func (d *Directory) admit(t Tenant) (time.Duration, bool) {
+	if t.Quota.RequestsPerMinute == 0 {
+		return 0, true
+	}
+	now := time.Now()
+	if d.now != nil {
+		now = d.now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.windows == nil {
+		d.windows = map[string]*window{}
+	}
+	w := d.windows[t.ID]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		w = &window{start: now}
+		d.windows[t.ID] = w
+	}
+	if w.count >= t.Quota.RequestsPerMinute {
+		return w.start.Add(time.Minute).Sub(now), false
+	}
+	w.count++
+	return 0, true
+}
+
+type contextKey struct{}
+
+// resolved is the tenant a request resolved to and how it was named
+type resolved struct {
+	tenant Tenant
+	prefix string
+}
+
+// NewContext returns a context belonging to t, for work done on a tenant's
+// behalf outside a request, such as seeding its storage
+func NewContext(ctx context.Context, t Tenant) context.Context {
+	return newContext(ctx, t, "")
+}
+
+func newContext(ctx context.Context, t Tenant, prefix string) context.Context {
+	return context.WithValue(ctx, contextKey{}, resolved{tenant: t, prefix: prefix})
+}
+
+// FromContext returns the tenant a context belongs to, the default tenant
+// when it was not resolved
+func FromContext(ctx context.Context) Tenant {
+	if r, ok := ctx.Value(contextKey{}).(resolved); ok {
+		return r.tenant
+	}
+	return Tenant{ID: DefaultID}
+}
+
+// Prefix returns the /t/{id} path prefix the request named its tenant by,
+// for links back to the service; it is empty when the tenant was resolved
+// by hostname or is the default one
+func Prefix(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey{}).(resolved); ok {
+		return r.prefix
+	}
+	return ""
+}
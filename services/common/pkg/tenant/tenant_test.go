@@ -0,0 +1,120 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tenantsFile = `
+tenants:
+  - id: acme
+    name: Acme ID
+    hosts: [ID.acme.example]
+    quota: {requestsPerMinute: 2}
+    issuer:
+      did: did:web:id.acme.example
+  - id: globex
+    hosts: [verify.globex.example]
+    verifier:
+      packs: [pack.safe.seller]
+`
+
+type issuerSettings struct {
+	Issuer struct {
+		DID string `yaml:"did"`
+	} `yaml:"issuer"`
+}
+
+// serve runs a request through the directory, answering with the tenant
+// and path the handler saw
+func serve(d *Directory, host, path string) *httptest.ResponseRecorder {
+	handler := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(FromContext(r.Context()).ID + " " + Prefix(r.Context()) + " " + r.URL.Path))
+	}))
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(tenantsFile), 0o600))
+
+	entries, err := Load[issuerSettings](Config{File: path})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "acme", entries[0].ID)
+	assert.Equal(t, 2, entries[0].Quota.RequestsPerMinute)
+	assert.Equal(t, "did:web:id.acme.example", entries[0].Settings.Issuer.DID)
+	assert.Empty(t, entries[1].Settings.Issuer.DID)
+
+	entries, err = Load[issuerSettings](Config{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.ErrorContains(t, Config{File: filepath.Join(t.TempDir(), "missing.yaml")}.Validate(), "TENANTS_CONFIG")
+}
+
+func TestDirectory_Set(t *testing.T) {
+	var d Directory
+	assert.ErrorContains(t, d.Set([]Tenant{{ID: "Acme"}}), "lowercase letters")
+	assert.ErrorContains(t, d.Set([]Tenant{{ID: "acme"}, {ID: "acme"}}), "listed twice")
+	assert.ErrorContains(t, d.Set([]Tenant{{ID: "acme", Hosts: []string{"a.example"}}, {ID: "globex", Hosts: []string{"A.example"}}}), `host "a.example" is served for both`)
+	assert.ErrorContains(t, d.Set([]Tenant{{ID: "acme", Quota: Quota{RequestsPerMinute: -1}}}), "must not be negative")
+
+	require.NoError(t, d.Set([]Tenant{{ID: "acme"}}))
+	var ids []string
+	for _, tenant := range d.All() {
+		ids = append(ids, tenant.ID)
+	}
+	assert.Equal(t, []string{"acme", DefaultID}, ids)
+}
+
+func TestDirectory_Resolve(t *testing.T) {
+	var d Directory
+	assert.Equal(t, "default  /packs", serve(&d, "verifier.cachet.id", "/packs").Body.String(), "the zero directory serves the default tenant")
+
+	require.NoError(t, d.Set([]Tenant{
+		{ID: "acme", Hosts: []string{"id.acme.example"}},
+		{ID: "globex"},
+	}))
+	assert.Equal(t, "acme  /credential", serve(&d, "ID.acme.example:8443", "/credential").Body.String())
+	assert.Equal(t, "globex /t/globex /packs", serve(&d, "verifier.cachet.id", "/t/globex/packs").Body.String())
+	assert.Equal(t, "globex /t/globex /", serve(&d, "verifier.cachet.id", "/t/globex").Body.String())
+	// A tenant's hostname wins over a prefix naming another tenant
+	assert.Equal(t, "acme  /t/globex/packs", serve(&d, "id.acme.example", "/t/globex/packs").Body.String())
+	assert.Equal(t, "default  /health", serve(&d, "verifier.cachet.id", "/health").Body.String())
+
+	w := serve(&d, "verifier.cachet.id", "/t/initech/packs")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), CodeUnknownTenant)
+}
+
+func TestDirectory_Quota(t *testing.T) {
+	var d Directory
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+	require.NoError(t, d.Set([]Tenant{{ID: "acme", Quota: Quota{RequestsPerMinute: 2}}}))
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, serve(&d, "", "/t/acme/packs").Code)
+	}
+	now = now.Add(20 * time.Second)
+	w := serve(&d, "", "/t/acme/packs")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "40", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), CodeQuotaExceeded)
+	// Other tenants are not held to it
+	assert.Equal(t, http.StatusOK, serve(&d, "", "/packs").Code)
+
+	now = now.Add(40 * time.Second)
+	assert.Equal(t, http.StatusOK, serve(&d, "", "/t/acme/packs").Code)
+}
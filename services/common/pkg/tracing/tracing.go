@@ -0,0 +1,99 @@
+// Package tracing instruments Cachet services with OpenTelemetry so a single
+// issuance or verification can be followed across services.
+//
+// Every service traces the requests it serves with Middleware and forwards
+// the W3C trace context on the calls it makes through deadline.NewClient.
+// Spans are exported over OTLP/HTTP when an OTLP endpoint is configured with
+// the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables; without one the service
+// records nothing but still passes its callers' trace context on.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// probePaths are left untraced; probes would otherwise drown out real traffic
+var probePaths = map[string]bool{"/health": true, "/livez": true, "/readyz": true}
+
+// Enabled reports whether an OTLP endpoint is configured and the SDK is not
+// disabled with OTEL_SDK_DISABLED
+func Enabled() bool {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init installs the W3C trace context propagator and, when Enabled, a
+// tracer provider exporting spans for service over OTLP/HTTP. The exporter,
+// sampler and resource read the standard OTEL_* variables, and
+// OTEL_SERVICE_NAME overrides service. Spans are exported in batches, so
+// those still buffered when the process is killed are lost.
+func Init(ctx context.Context, service string) (bool, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return false, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return false, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return false, err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	return true, nil
+}
+
+// Middleware starts a server span for every request but health probes,
+// continuing the caller's trace when it sent one. Spans are named after the
+// chi route that served the request, so /vouches/{id} is one operation
+// rather than one per vouch.
+func Middleware(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				if route := rctx.RoutePattern(); route != "" {
+					span := trace.SpanFromContext(r.Context())
+					span.SetName(r.Method + " " + route)
+					span.SetAttributes(semconv.HTTPRoute(route))
+				}
+			}
+		})
+		return otelhttp.NewHandler(named, service,
+			otelhttp.WithFilter(func(r *http.Request) bool { return !probePaths[r.URL.Path] }),
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }),
+		)
+	}
+}
+
+// Transport wraps base so calls to dependency run in a client span and carry
+// the trace context downstream
+func Transport(dependency string, base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method + " " + dependency }),
+	)
+}
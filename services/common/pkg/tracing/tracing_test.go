@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record installs a tracer provider keeping every span in memory
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	assert.False(t, Enabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://collector:4318/v1/traces")
+	assert.True(t, Enabled())
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	assert.False(t, Enabled())
+}
+
+func TestMiddleware_NamesSpansAfterRoutes(t *testing.T) {
+	recorder := record(t)
+	router := chi.NewRouter()
+	router.Use(Middleware("test-service"))
+	router.Get("/health", func(w http.ResponseWriter, r *http.Request) {})
+	router.Get("/vouches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	// The caller's trace continues through the service
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/vouches/vouch-1", nil)
+	otel.GetTextMapPropagator().Inject(trace.ContextWithRemoteSpanContext(context.Background(), parent), propagation.HeaderCarrier(req.Header))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1, "health checks are not traced")
+	span := spans[0]
+	assert.Equal(t, "GET /vouches/{id}", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, parent.TraceID(), span.SpanContext().TraceID())
+	assert.Equal(t, parent.SpanID(), span.Parent().SpanID())
+}
+
+func TestTransport_PropagatesTraceContext(t *testing.T) {
+	recorder := record(t)
+	var traceparent string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "issue")
+	client := &http.Client{Transport: Transport("registry", http.DefaultTransport)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downstream.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	call := spans[0]
+	assert.Equal(t, "GET registry", call.Name())
+	assert.Equal(t, trace.SpanKindClient, call.SpanKind())
+	assert.Equal(t, span.SpanContext().TraceID(), call.SpanContext().TraceID())
+	assert.Contains(t, traceparent, call.SpanContext().TraceID().String())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditPartnerOnboarded = "partner.onboarded"
+	AuditKeyCreated       = "key.created"
+	AuditKeyRevoked       = "key.revoked"
+	// AuditAccessDenied is a caller reaching outside its tenant scope
+	AuditAccessDenied = "access.denied"
+)
+
+const defaultAuditLimit = 100
+
+// AuditEvent records partner onboarding, key changes and cross-tenant
+// access attempts, for security review
+type AuditEvent struct {
+	Seq       int64     `json:"seq"`
+	Type      string    `json:"type"`
+	Partner   string    `json:"partner,omitempty"`
+	KeyID     string    `json:"keyId,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// auditLog keeps audit events in memory, in append order (production
+// should ship them to durable, append-only storage)
+type auditLog struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+func (a *auditLog) Append(event AuditEvent) AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	event.Seq = int64(len(a.events)) + 1
+	a.events = append(a.events, event)
+	return event
+}
+
+// Query returns the latest events matching partner and type when set,
+// newest first
+func (a *auditLog) Query(partner, eventType string, limit int) []AuditEvent {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := []AuditEvent{}
+	for i := len(a.events) - 1; i >= 0 && len(out) < limit; i-- {
+		event := a.events[i]
+		if (partner == "" || event.Partner == partner) && (eventType == "" || event.Type == eventType) {
+			out = append(out, event)
+		}
+	}
+	return out
+}
+
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultAuditLimit
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": s.audit.Query(query.Get("partner"), query.Get("type"), limit)})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	badgeTokenType = "cachet-badge+jwt"
+	// badgeTokenTTL keeps badge tokens short-lived: partners re-fetch them
+	// rather than storing anything about the subject
+	badgeTokenTTL = 5 * time.Minute
+	// badgeCacheAge is how long browsers and CDNs may cache a badge
+	badgeCacheAge = 60
+)
+
+// Badge states, as reported in badge.status_changed events
+const (
+	BadgeStatusActive    = "active"
+	BadgeStatusSuspended = "suspended"
+	BadgeStatusRevoked   = "revoked"
+	BadgeStatusExpired   = "expired"
+)
+
+func validBadgeStatus(status string) bool {
+	switch status {
+	case BadgeStatusActive, BadgeStatusSuspended, BadgeStatusRevoked, BadgeStatusExpired:
+		return true
+	}
+	return false
+}
+
+// BadgeState is a subject's current standing for one badge, e.g. the
+// Safe Seller pack
+type BadgeState struct {
+	Badge     string     `json:"badge"`
+	Label     string     `json:"label,omitempty"` // e.g. Verified Seller
+	Status    string     `json:"status"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// current reports whether the badge is active and unexpired at now
+func (b BadgeState) current(now time.Time) bool {
+	return b.Status == BadgeStatusActive && (b.ExpiresAt == nil || now.Before(*b.ExpiresAt))
+}
+
+// parseBadgeChange reads the data of a badge.status_changed event
+func parseBadgeChange(data json.RawMessage) (BadgeState, error) {
+	var state BadgeState
+	if len(data) == 0 {
+		return BadgeState{}, errors.New("badge.status_changed needs data with badge and status")
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return BadgeState{}, fmt.Errorf("badge.status_changed data: %w", err)
+	}
+	if state.Badge == "" || !validBadgeStatus(state.Status) {
+		return BadgeState{}, errors.New("badge.status_changed needs a badge and a status of active, suspended, revoked or expired")
+	}
+	return state, nil
+}
+
+// badgeStore holds subjects' badge states in memory (production should use
+// a shared database)
+type badgeStore struct {
+	mu     sync.RWMutex
+	states map[string]map[string]BadgeState // subject -> badge -> state
+}
+
+func newBadgeStore() *badgeStore {
+	return &badgeStore{states: make(map[string]map[string]BadgeState)}
+}
+
+// Record keeps the latest state of a subject's badge; out-of-order updates
+// older than the stored one are ignored
+func (b *badgeStore) Record(subject string, state BadgeState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	badges, ok := b.states[subject]
+	if !ok {
+		badges = make(map[string]BadgeState)
+		b.states[subject] = badges
+	}
+	if stored, ok := badges[state.Badge]; ok && stored.UpdatedAt.After(state.UpdatedAt) {
+		return
+	}
+	badges[state.Badge] = state
+}
+
+// List returns a subject's badges, by badge
+func (b *badgeStore) List(subject string) []BadgeState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := []BadgeState{}
+	for _, state := range b.states[subject] {
+		out = append(out, state)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Badge < out[j].Badge })
+	return out
+}
+
+// BadgeClaims are the claims of a badge token. The audience is the partner
+// the token was issued for, so it cannot be shown on another site.
+type BadgeClaims struct {
+	Verified bool         `json:"verified"`
+	Badges   []BadgeClaim `json:"badges"`
+	jwt.RegisteredClaims
+}
+
+// BadgeClaim is one badge in a badge token
+type BadgeClaim struct {
+	Badge  string `json:"badge"`
+	Status string `json:"status"`
+}
+
+// BadgeResponse is the JSON rendering of a subject's badge for a partner
+type BadgeResponse struct {
+	Subject   string       `json:"subject"`
+	Partner   string       `json:"partner"`
+	Verified  bool         `json:"verified"`
+	Badges    []BadgeState `json:"badges"`
+	Token     string       `json:"token"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+// partnerSubject resolves the subject a partner asks about, by DID or by
+// the partner's own account id. Partners only see subjects linked to them.
+func (s *Server) partnerSubject(ctx context.Context, partner, subject string) (string, bool, error) {
+	connections, err := s.connections.List(ctx, partnerScope(partner), ConnectionFilter{})
+	if err != nil {
+		return "", false, err
+	}
+	for _, conn := range connections {
+		if conn.Status == ConnectionStatusActive && (conn.Subject == subject || conn.ExternalAccount == subject) {
+			return conn.Subject, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// handleGetBadge lets a partner site show a subject's current badge: as
+// JSON with a signed, short-lived badge token, or as an SVG to embed.
+// ?badge= narrows it to one badge.
+func (s *Server) handleGetBadge(w http.ResponseWriter, r *http.Request) {
+	partner := chi.URLParam(r, "id")
+	subject, ok, err := s.partnerSubject(r.Context(), partner, chi.URLParam(r, "subject"))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Subject not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	badges := s.badges.List(subject)
+	if only := r.URL.Query().Get("badge"); only != "" {
+		filtered := []BadgeState{}
+		for _, badge := range badges {
+			if badge.Badge == only {
+				filtered = append(filtered, badge)
+			}
+		}
+		badges = filtered
+	}
+	// A standing flag that suspends holds every active badge
+	suspended := s.flags.Suspends(subject)
+	for i := range badges {
+		if badges[i].Status == BadgeStatusActive && !badges[i].current(now) {
+			badges[i].Status = BadgeStatusExpired
+		}
+		if badges[i].Status == BadgeStatusActive && suspended {
+			badges[i].Status = BadgeStatusSuspended
+		}
+	}
+	verified := false
+	for _, badge := range badges {
+		verified = verified || badge.current(now)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", badgeCacheAge))
+	w.Header().Set("Vary", "Accept")
+	if wantsSVG(r) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(renderBadgeSVG(badgeLabel(badges, now), verified))); err != nil {
+			log.Error().Err(err).Msg("Failed to write badge")
+		}
+		return
+	}
+
+	claims := BadgeClaims{
+		Verified: verified,
+		Badges:   make([]BadgeClaim, 0, len(badges)),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    hubIssuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{partner},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(badgeTokenTTL)),
+		},
+	}
+	for _, badge := range badges {
+		claims.Badges = append(claims.Badges, BadgeClaim{Badge: badge.Badge, Status: badge.Status})
+	}
+	token, err := s.signer.SignTyped(badgeTokenType, claims)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, BadgeResponse{
+		Subject:   subject,
+		Partner:   partner,
+		Verified:  verified,
+		Badges:    badges,
+		Token:     token,
+		ExpiresAt: now.Add(badgeTokenTTL),
+	})
+}
+
+// wantsSVG picks the rendering: ?format=svg, or an Accept header preferring
+// SVG as <img> tags send
+func wantsSVG(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "svg":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "image/svg+xml") && !strings.Contains(accept, "application/json")
+}
+
+// badgeLabel names the subject's standing, from the first current badge
+func badgeLabel(badges []BadgeState, now time.Time) string {
+	for _, badge := range badges {
+		if badge.current(now) {
+			if badge.Label != "" {
+				return "Cachet " + badge.Label
+			}
+			return "Cachet Verified"
+		}
+	}
+	return "Not verified"
+}
+
+// renderBadgeSVG draws a flat, two-part badge
+func renderBadgeSVG(label string, verified bool) string {
+	color := "#9f9f9f"
+	mark := "–"
+	if verified {
+		color, mark = "#2e7d32", "✓"
+	}
+	// Roughly 7px per character at 11px Verdana
+	width := 30 + 7*len([]rune(label))
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s">`+
+		`<title>%s</title>`+
+		`<rect width="20" height="20" fill="#555"/>`+
+		`<rect x="20" width="%d" height="20" fill="%s"/>`+
+		`<g fill="#fff" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="10" y="14" text-anchor="middle">%s</text>`+
+		`<text x="26" y="14">%s</text>`+
+		`</g></svg>`,
+		width, html.EscapeString(label), html.EscapeString(label), width-20, color, mark, html.EscapeString(label))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getBadge(t *testing.T, server *Server, partner, subject, query string, header map[string]string) *BadgeResponse {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodGet, "/partners/"+partner+"/subjects/"+url.PathEscape(subject)+"/badge"+query, nil, header)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	var badge BadgeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &badge))
+	return &badge
+}
+
+func TestBadges_Embed(t *testing.T) {
+	server, _, _ := newWebhookTestServer(t)
+
+	// Linked, but no badge yet
+	badge := getBadge(t, server, "market.fake", "did:key:z6MkSeller", "", nil)
+	assert.False(t, badge.Verified)
+	assert.Empty(t, badge.Badges)
+
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+
+	// Partners may ask by their own account id
+	badge = getBadge(t, server, "market.fake", "seller-did:key:z6MkSeller", "", nil)
+	assert.True(t, badge.Verified)
+	assert.Equal(t, "did:key:z6MkSeller", badge.Subject)
+	require.Len(t, badge.Badges, 1)
+	assert.Equal(t, "pack.safe.seller", badge.Badges[0].Badge)
+
+	// The token is short-lived, for this partner, and verifies with the JWKS
+	w := hubRequest(t, server, http.MethodGet, "/.well-known/jwks.json", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var claims BadgeClaims
+	token, err := jwt.ParseWithClaims(badge.Token, &claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, badgeTokenType, token.Header["typ"])
+		assert.Contains(t, w.Body.String(), token.Header["kid"])
+		return server.signer.PublicKey(), nil
+	}, jwt.WithAudience("market.fake"), jwt.WithIssuer(hubIssuer), jwt.WithValidMethods([]string{"ES256"}))
+	require.NoError(t, err)
+	require.True(t, token.Valid)
+	assert.Equal(t, "did:key:z6MkSeller", claims.Subject)
+	assert.True(t, claims.Verified)
+	assert.Equal(t, []BadgeClaim{{Badge: "pack.safe.seller", Status: BadgeStatusActive}}, claims.Badges)
+	assert.WithinDuration(t, time.Now().Add(badgeTokenTTL), claims.ExpiresAt.Time, 5*time.Second)
+
+	// Suspension shows straight away
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: json.RawMessage(`{"badge":"pack.safe.seller","status":"suspended"}`)})
+	badge = getBadge(t, server, "market.fake", "did:key:z6MkSeller", "?badge=pack.safe.seller", nil)
+	assert.False(t, badge.Verified)
+	assert.Equal(t, BadgeStatusSuspended, badge.Badges[0].Status)
+	assert.Empty(t, getBadge(t, server, "market.fake", "did:key:z6MkSeller", "?badge=pack.other", nil).Badges)
+
+	// Badges past their expiry are reported expired
+	expired := `{"badge":"pack.safe.seller","status":"active","expiresAt":"` + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + `"}`
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: json.RawMessage(expired)})
+	badge = getBadge(t, server, "market.fake", "did:key:z6MkSeller", "", nil)
+	assert.False(t, badge.Verified)
+	assert.Equal(t, BadgeStatusExpired, badge.Badges[0].Status)
+}
+
+func TestBadges_SVG(t *testing.T) {
+	server, _, _ := newWebhookTestServer(t)
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+
+	for name, tc := range map[string]struct {
+		query  string
+		header map[string]string
+	}{
+		"format":     {"?format=svg", nil},
+		"img Accept": {"", map[string]string{"Accept": "image/avif,image/webp,image/svg+xml,*/*"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := hubRequest(t, server, http.MethodGet, "/partners/market.fake/subjects/did:key:z6MkSeller/badge"+tc.query, nil, tc.header)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+			assert.True(t, strings.HasPrefix(w.Body.String(), "<svg"))
+			assert.Contains(t, w.Body.String(), "Cachet Verified Seller")
+			assert.Contains(t, w.Header().Get("Cache-Control"), "max-age=60")
+		})
+	}
+
+	// Labels are escaped
+	assert.Contains(t, renderBadgeSVG(`<script>"`, false), "&lt;script&gt;&#34;")
+}
+
+func TestBadges_OnlyLinkedSubjects(t *testing.T) {
+	server, _, _ := newWebhookTestServer(t)
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkStranger", Data: safeSellerActive})
+
+	for name, path := range map[string]string{
+		"not linked":    "/partners/market.fake/subjects/did:key:z6MkStranger/badge",
+		"other partner": "/partners/gig.other/subjects/did:key:z6MkSeller/badge",
+	} {
+		w := hubRequest(t, server, http.MethodGet, path, nil, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code, name)
+	}
+}
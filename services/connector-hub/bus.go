@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// subscriberBuffer is how many events a subscriber may fall behind by
+	// before further events are dropped for it
+	subscriberBuffer   = 256
+	forwardAttempts    = 3
+	forwardBaseBackoff = time.Second
+	forwardTimeout     = 10 * time.Second
+)
+
+var busEvents = expvar.NewMap("event_bus_total")
+
+// EventHandler consumes events from the bus
+type EventHandler func(ctx context.Context, event CachetEvent) error
+
+type subscription struct {
+	name    string
+	types   map[string]bool // empty takes every type
+	handler EventHandler
+	queue   chan CachetEvent
+}
+
+// eventBus fans normalized events out to the services interested in them.
+// Each subscriber has its own queue and goroutine, so a slow one neither
+// delays callbacks nor the others; a subscriber that falls too far behind
+// misses events and can backfill them from GET /inbound-events.
+type eventBus struct {
+	mu            sync.RWMutex
+	subscriptions []*subscription
+	wg            sync.WaitGroup
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+// Subscribe registers a handler for the given event types, or all types
+func (b *eventBus) Subscribe(name string, types []string, handler EventHandler) {
+	sub := &subscription{
+		name:    name,
+		types:   make(map[string]bool, len(types)),
+		handler: handler,
+		queue:   make(chan CachetEvent, subscriberBuffer),
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+	b.mu.Lock()
+	b.subscriptions = append(b.subscriptions, sub)
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for event := range sub.queue {
+			if err := sub.handler(context.Background(), event); err != nil {
+				busEvents.Add("failed", 1)
+				log.Error().Err(err).Str("subscriber", sub.name).Str("event_id", event.ID).Str("type", event.Type).Msg("Event subscriber failed")
+				continue
+			}
+			busEvents.Add("handled", 1)
+		}
+	}()
+}
+
+// Publish queues an event for every subscriber taking its type, without
+// blocking
+func (b *eventBus) Publish(event CachetEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subscriptions {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+			busEvents.Add("published", 1)
+		default:
+			busEvents.Add("dropped", 1)
+			log.Warn().Str("subscriber", sub.name).Str("event_id", event.ID).Msg("Event subscriber is behind; event dropped")
+		}
+	}
+}
+
+// Close stops taking events and waits for subscribers to drain their queues
+func (b *eventBus) Close() {
+	b.mu.Lock()
+	for _, sub := range b.subscriptions {
+		close(sub.queue)
+	}
+	b.subscriptions = nil
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// EventSubscriber is a service events are forwarded to, from the
+// EVENT_SUBSCRIBERS_CONFIG file, e.g.
+//
+//	subscribers:
+//	  - name: trust-signals
+//	    url: http://trust-signals.internal/events
+//	    events: [account.flagged, dispute.opened]
+//	    tokenEnv: TRUST_SIGNALS_TOKEN
+//
+// An empty events list takes every event. The token, read from the
+// environment or the sm:// reference there, is sent as a bearer token.
+type EventSubscriber struct {
+	Name     string   `yaml:"name"`
+	URL      string   `yaml:"url"`
+	Events   []string `yaml:"events"`
+	TokenEnv string   `yaml:"tokenEnv"`
+	token    string
+}
+
+// LoadEventSubscribers reads the EVENT_SUBSCRIBERS_CONFIG file at path;
+// without one events are only stored
+func LoadEventSubscribers(path string) ([]EventSubscriber, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	subscribers, err := parseEventSubscribers(raw, config.Lookup)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return subscribers, nil
+}
+
+func parseEventSubscribers(raw []byte, lookup func(string) (string, error)) ([]EventSubscriber, error) {
+	var config struct {
+		Subscribers []EventSubscriber `yaml:"subscribers"`
+	}
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i := range config.Subscribers {
+		sub := &config.Subscribers[i]
+		if sub.Name == "" || names[sub.Name] {
+			return nil, fmt.Errorf("subscriber %d: name %q is empty or repeated", i, sub.Name)
+		}
+		names[sub.Name] = true
+		if u, err := url.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("subscriber %s: url must be an absolute http(s) URL", sub.Name)
+		}
+		for _, eventType := range sub.Events {
+			switch eventType {
+			case EventListingCreated, EventAccountFlagged, EventDisputeOpened:
+			default:
+				return nil, fmt.Errorf("subscriber %s: unknown event type %q", sub.Name, eventType)
+			}
+		}
+		if sub.TokenEnv != "" {
+			token, err := lookup(sub.TokenEnv)
+			if err != nil {
+				return nil, fmt.Errorf("subscriber %s: %w", sub.Name, err)
+			}
+			if sub.token = token; token == "" {
+				return nil, fmt.Errorf("subscriber %s: %s is unset", sub.Name, sub.TokenEnv)
+			}
+		}
+	}
+	return config.Subscribers, nil
+}
+
+// forwarder POSTs events to a subscribing service, retrying a few times
+// with backoff before giving up on an event
+func forwarder(client *http.Client, sub EventSubscriber) EventHandler {
+	return func(ctx context.Context, event CachetEvent) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		backoff := forwardBaseBackoff
+		for attempt := 1; ; attempt++ {
+			err = forwardEvent(ctx, client, sub, event, body)
+			if err == nil || attempt == forwardAttempts {
+				return err
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func forwardEvent(ctx context.Context, client *http.Client, sub EventSubscriber, event CachetEvent, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, event.ID)
+	req.Header.Set(WebhookEventHeader, event.Type)
+	if sub.token != "" {
+		req.Header.Set("Authorization", "Bearer "+sub.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("subscriber returned " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+)
+
+// Config is the connector hub's configuration, documented in CONFIG.md.
+// The secrets named inside the OAuth platforms, event subscribers and
+// plugins files are read from the variables those files name. The database
+// keeps its own variables, read by the store package.
+type Config struct {
+	config.Base
+	OperatorToken    string        `env:"OPERATOR_API_TOKEN" secret:"true" doc:"Token operators present to onboard partners and manage webhooks; those APIs are disabled without it"`
+	LinkTTL          time.Duration `env:"SUBJECT_LINK_TTL" doc:"How long a subject link lasts once the holder confirms it; they link again after it expires"`
+	FlagSuspend      string        `env:"FLAG_SUSPEND_SEVERITY" doc:"Severity (low, medium or high) from which a partner's flag suspends the subject's badges until it is dismissed or withdrawn; flags never suspend when unset"`
+	OAuthPlatforms   string        `env:"OAUTH_PLATFORMS_CONFIG" doc:"YAML file of the platforms users link their accounts from over OAuth; no platform is linked over OAuth without it"`
+	EventSubscribers string        `env:"EVENT_SUBSCRIBERS_CONFIG" doc:"YAML file of the services platform events are forwarded to; events are only stored without it"`
+	Plugins          string        `env:"CONNECTOR_PLUGINS_CONFIG" doc:"YAML file of the out-of-tree connector plugins to run; none are started without it"`
+	Secrets          SecretsConfig
+	Marketplace      MarketplaceConfig
+	ServiceAuth      serviceauth.Config
+	CORS             cors.Config
+	APIVersion       apiversion.Config
+	SecurityAudit    audit.Config
+	Events           events.Config
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{
+		Base:        config.Base{Port: 8090},
+		LinkTTL:     defaultLinkTTL,
+		Marketplace: MarketplaceConfig{Pack: defaultSafeSellerPack},
+	}
+}
+
+// Validate checks the port, service authentication, subject link lifetime,
+// flag suspension severity, secrets keys, marketplace connector, CORS
+// origins, legacy API sunset, security audit and event bus are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if c.LinkTTL <= 0 {
+		return errors.New("SUBJECT_LINK_TTL must be positive")
+	}
+	if c.FlagSuspend != "" && flagSeverityRank[c.FlagSuspend] == 0 {
+		return errors.New("FLAG_SUSPEND_SEVERITY must be low, medium or high")
+	}
+	if err := c.Secrets.Validate(); err != nil {
+		return err
+	}
+	if err := c.Marketplace.Validate(); err != nil {
+		return err
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if err := c.APIVersion.Validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityAudit.Validate(); err != nil {
+		return err
+	}
+	return c.Events.Validate()
+}
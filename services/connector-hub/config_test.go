@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConfigDocs keeps CONFIG.md in step with the Config struct; run it
+// with UPDATE_CONFIG_DOCS=1 to regenerate the page
+func TestConfigDocs(t *testing.T) {
+	doc := config.Markdown("connector-hub", defaultConfig())
+	if os.Getenv("UPDATE_CONFIG_DOCS") != "" {
+		require.NoError(t, os.WriteFile("CONFIG.md", []byte(doc), 0o644))
+	}
+	current, err := os.ReadFile("CONFIG.md")
+	require.NoError(t, err)
+	assert.Equal(t, doc, string(current), "CONFIG.md is stale; regenerate it with UPDATE_CONFIG_DOCS=1 go test -run TestConfigDocs")
+}
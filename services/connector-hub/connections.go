@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Connection states. A connection is pending while the user consents on
+// the platform, active once linked, failed if the platform refused, and
+// revoked when either side unlinks it.
+const (
+	ConnectionStatusPending = "pending"
+	ConnectionStatusActive  = "active"
+	ConnectionStatusFailed  = "failed"
+	ConnectionStatusRevoked = "revoked"
+)
+
+// maxEventBody caps platform callbacks
+const maxEventBody = 1 << 20
+
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// Connection links a Cachet subject to their account on a platform
+type Connection struct {
+	ID              string    `json:"id"`
+	Connector       string    `json:"connector"`
+	Partner         string    `json:"partner,omitempty"` // the tenant owning it; empty for the hub's own
+	Subject         string    `json:"subject"`
+	Status          string    `json:"status"`
+	ExternalAccount string    `json:"externalAccount,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+func validConnectionStatus(status string) bool {
+	switch status {
+	case ConnectionStatusPending, ConnectionStatusActive, ConnectionStatusFailed, ConnectionStatusRevoked:
+		return true
+	}
+	return false
+}
+
+// ConnectionFilter narrows a connection listing
+type ConnectionFilter struct {
+	Connector string
+	Subject   string
+}
+
+// ConnectionStore persists connections. Every access is limited to a
+// tenant scope: listings only hold connections within it, other records
+// are not found, and filters or new connections outside it are refused
+// with ErrOutOfScope.
+type ConnectionStore interface {
+	List(ctx context.Context, scope TenantScope, filter ConnectionFilter) ([]Connection, error)
+	Get(ctx context.Context, scope TenantScope, id string) (Connection, error)
+	Create(ctx context.Context, scope TenantScope, conn Connection) error
+	// Update applies fn to the stored connection atomically; fn's error aborts it
+	Update(ctx context.Context, scope TenantScope, id string, fn func(*Connection) error) (Connection, error)
+}
+
+// memoryConnectionStore keeps connections in memory (production should use
+// a shared database, so connections survive restarts)
+type memoryConnectionStore struct {
+	mu          sync.RWMutex
+	connections map[string]Connection
+}
+
+func newMemoryConnectionStore() *memoryConnectionStore {
+	return &memoryConnectionStore{connections: make(map[string]Connection)}
+}
+
+// List filters by connector and subject when set, oldest first
+func (m *memoryConnectionStore) List(ctx context.Context, scope TenantScope, filter ConnectionFilter) ([]Connection, error) {
+	if filter.Connector != "" && !scope.allowsConnector(filter.Connector) {
+		return nil, fmt.Errorf("%w: connector %s", ErrOutOfScope, filter.Connector)
+	}
+	if filter.Subject != "" && !scope.allowsSubject(filter.Subject) {
+		return nil, fmt.Errorf("%w: subject", ErrOutOfScope)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Connection{}
+	for _, conn := range m.connections {
+		if scope.covers(conn) && (filter.Connector == "" || conn.Connector == filter.Connector) &&
+			(filter.Subject == "" || conn.Subject == filter.Subject) {
+			out = append(out, conn)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+func (m *memoryConnectionStore) Get(ctx context.Context, scope TenantScope, id string) (Connection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	conn, ok := m.connections[id]
+	if !ok {
+		return Connection{}, ErrConnectionNotFound
+	}
+	if !scope.covers(conn) {
+		return Connection{}, errCrossTenant
+	}
+	return conn, nil
+}
+
+func (m *memoryConnectionStore) Create(ctx context.Context, scope TenantScope, conn Connection) error {
+	if !scope.covers(conn) {
+		return fmt.Errorf("%w: connection for %s on %s", ErrOutOfScope, conn.Partner, conn.Connector)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections[conn.ID] = conn
+	return nil
+}
+
+func (m *memoryConnectionStore) Update(ctx context.Context, scope TenantScope, id string, fn func(*Connection) error) (Connection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn, ok := m.connections[id]
+	if !ok {
+		return Connection{}, ErrConnectionNotFound
+	}
+	if !scope.covers(conn) {
+		return Connection{}, errCrossTenant
+	}
+	if err := fn(&conn); err != nil {
+		return Connection{}, err
+	}
+	m.connections[id] = conn
+	return conn, nil
+}
+
+// newID returns a random identifier with a type prefix, e.g. conn_3f9a...
+func newID(prefix string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return prefix + "_" + hex.EncodeToString(b)
+}
+
+// writeHubError answers a failed connector or connection call
+func writeHubError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrConnectorNotFound):
+		http.Error(w, "Connector not found", http.StatusNotFound)
+	case errors.Is(err, ErrConnectionNotFound):
+		http.Error(w, "Connection not found", http.StatusNotFound)
+	case errors.Is(err, ErrOutOfScope):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidEvent):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrEventSignature):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, ErrPluginUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Error().Err(err).Msg("Connector request failed")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleListConnectors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"connectors": s.connectors.List()})
+}
+
+func (s *Server) handleGetConnector(w http.ResponseWriter, r *http.Request) {
+	connector, err := s.connectors.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, connector.Describe())
+}
+
+// ConnectRequest is the body of POST /connectors/{id}/connections.
+// Partner defaults to the caller's; operators may name any partner.
+type ConnectRequest struct {
+	Subject     string `json:"subject"`
+	Partner     string `json:"partner,omitempty"`
+	RedirectURI string `json:"redirectUri,omitempty"` // where the platform returns the user
+}
+
+// ConnectResponse is a new connection and, while it is pending, the URL to
+// send the user to
+type ConnectResponse struct {
+	Connection       Connection `json:"connection"`
+	AuthorizationURL string     `json:"authorizationUrl,omitempty"`
+}
+
+// handleCreateConnection starts linking a subject's platform account: the
+// connector either returns a consent URL, leaving the connection pending
+// until the platform calls back, or links the account outright
+func (s *Server) handleCreateConnection(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	connector, err := s.connectors.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	var req ConnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Subject) == "" {
+		http.Error(w, "subject is required", http.StatusBadRequest)
+		return
+	}
+	if req.RedirectURI != "" {
+		if u, err := url.Parse(req.RedirectURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			http.Error(w, "redirectUri must be an absolute https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	partner := req.Partner
+	if partner == "" {
+		partner = scope.Partner
+	}
+	if partner != "" {
+		if _, err := s.partners.Get(r.Context(), partner); err != nil {
+			http.Error(w, "unknown partner "+partner, http.StatusBadRequest)
+			return
+		}
+	}
+
+	info := connector.Describe()
+	now := time.Now().UTC()
+	conn := Connection{
+		ID:        newID("conn"),
+		Connector: info.ID,
+		Partner:   partner,
+		Subject:   req.Subject,
+		Status:    ConnectionStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// Checked before the connector is asked, so a refused partner never
+	// reaches the platform
+	if !scope.covers(conn) {
+		s.writeTenantError(w, r, fmt.Errorf("%w: connection for %s on %s", ErrOutOfScope, conn.Partner, conn.Connector))
+		return
+	}
+	authorization, err := connector.Authorize(r.Context(), conn, req.RedirectURI)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	if authorization.URL == "" {
+		conn.Status, conn.ExternalAccount = ConnectionStatusActive, authorization.ExternalAccount
+	}
+	if err := s.connections.Create(r.Context(), scope, conn); err != nil {
+		s.writeTenantError(w, r, err)
+		return
+	}
+	log.Info().Str("connector", conn.Connector).Str("partner", conn.Partner).Str("connection_id", conn.ID).Str("status", conn.Status).Msg("Connection initiated")
+	w.Header().Set("Location", "/connections/"+conn.ID)
+	writeJSON(w, http.StatusCreated, ConnectResponse{Connection: conn, AuthorizationURL: authorization.URL})
+}
+
+func (s *Server) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	connections, err := s.connections.List(r.Context(), scopeFromContext(r.Context()), ConnectionFilter{
+		Connector: query.Get("connector"),
+		Subject:   query.Get("subject"),
+	})
+	if err != nil {
+		s.writeTenantError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"connections": connections})
+}
+
+func (s *Server) handleGetConnection(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.connections.Get(r.Context(), scopeFromContext(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeTenantError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, conn)
+}
+
+// handleRequestVerification asks a connection's connector to verify its
+// subject against a pack
+func (s *Server) handleRequestVerification(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.connections.Get(r.Context(), scopeFromContext(r.Context()), chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeTenantError(w, r, err)
+		return
+	}
+	if conn.Status != ConnectionStatusActive {
+		http.Error(w, "connection is "+conn.Status+", not active", http.StatusConflict)
+		return
+	}
+	var req VerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Pack == "" {
+		http.Error(w, "pack is required", http.StatusBadRequest)
+		return
+	}
+	connector, err := s.connectors.Get(conn.Connector)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	session, err := connector.RequestVerification(r.Context(), conn, req)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	log.Info().Str("connection_id", conn.ID).Str("pack", req.Pack).Str("session_id", session.ID).Msg("Verification requested")
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// handlePlatformCallback receives a platform's callback for a connector,
+// which authenticates and interprets it. Results naming a connection update
+// it; events about unknown connections are acknowledged and dropped, so
+// platforms do not retry them.
+func (s *Server) handlePlatformCallback(w http.ResponseWriter, r *http.Request) {
+	connector, err := s.connectors.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	event := PlatformEvent{
+		Connector:  connector.Describe().ID,
+		Header:     r.Header.Clone(),
+		Body:       body,
+		ReceivedAt: time.Now().UTC(),
+	}
+	result, err := connector.HandleEvent(r.Context(), event)
+	if err != nil {
+		if errors.Is(err, ErrEventSignature) {
+			log.Warn().Str("connector", event.Connector).Msg("Platform callback failed authentication")
+		}
+		writeHubError(w, err)
+		return
+	}
+	normalized, err := s.normalizeEvent(r.Context(), connector, event)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+
+	if result.ConnectionID != "" {
+		if result.Status != "" && !validConnectionStatus(result.Status) {
+			writeHubError(w, errors.New("connector "+event.Connector+" returned connection status "+result.Status))
+			return
+		}
+		_, err := s.connections.Update(r.Context(), hubScope, result.ConnectionID, func(conn *Connection) error {
+			if conn.Connector != event.Connector {
+				return ErrConnectionNotFound
+			}
+			if result.Status != "" {
+				conn.Status = result.Status
+			}
+			if result.ExternalAccount != "" {
+				conn.ExternalAccount = result.ExternalAccount
+			}
+			conn.UpdatedAt = event.ReceivedAt
+			return nil
+		})
+		if errors.Is(err, ErrConnectionNotFound) {
+			log.Warn().Str("connector", event.Connector).Str("connection_id", result.ConnectionID).Msg("Platform callback for an unknown connection")
+		} else if err != nil {
+			writeHubError(w, err)
+			return
+		}
+	}
+	// Platforms retry callbacks that fail here; replayed events are dropped
+	if _, err := s.recordEvents(r.Context(), normalized); err != nil {
+		writeHubError(w, err)
+		return
+	}
+	response := callbackResponse{EventResult: result}
+	for _, e := range normalized {
+		response.Events = append(response.Events, e.ID)
+	}
+	log.Info().Str("connector", event.Connector).Str("type", result.Type).Str("connection_id", result.ConnectionID).Int("event_count", len(normalized)).Msg("Platform callback handled")
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// callbackResponse acknowledges a platform callback with the connector's
+// reading of it and the canonical events it was normalized to
+type callbackResponse struct {
+	EventResult
+	Events []string `json:"events,omitempty"`
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/connector-hub/pluginsdk"
+)
+
+var (
+	ErrConnectorNotFound = errors.New("connector not found")
+	ErrConnectorExists   = errors.New("connector already installed")
+	// ErrInvalidEvent means a platform callback could not be parsed
+	ErrInvalidEvent = pluginsdk.ErrInvalidEvent
+	// ErrEventSignature means a platform callback failed authentication
+	ErrEventSignature = pluginsdk.ErrEventSignature
+	// ErrUnsupported means a connector does not offer the operation. These
+	// three are shared with pluginsdk so plugin connectors' errors match.
+	ErrUnsupported = pluginsdk.ErrUnsupported
+)
+
+// connectorIDPattern keeps connector ids usable in paths, e.g. marketplace.generic
+var connectorIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,62}$`)
+
+// Connector capabilities, as advertised by Describe
+const (
+	CapabilityConnect      = "connect"      // links a platform account to a Cachet subject
+	CapabilityEvents       = "events"       // receives platform callbacks
+	CapabilityVerification = "verification" // requests verifications on the platform's behalf
+)
+
+// ConnectorInfo describes an installed connector
+type ConnectorInfo struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Platform     string   `json:"platform"` // e.g. marketplace, gig, payments
+	Capabilities []string `json:"capabilities"`
+	// Packs are the trust packs the connector requests verifications for
+	Packs []string `json:"packs,omitempty"`
+}
+
+// Authorization is how a connection proceeds: with a URL the user is sent
+// to the platform to consent, else the connection is active straight away
+type Authorization struct {
+	URL             string `json:"url,omitempty"`
+	ExternalAccount string `json:"externalAccount,omitempty"`
+}
+
+// PlatformEvent is a callback a platform sent the hub, as received. The
+// connector authenticates it; the hub only routes it.
+type PlatformEvent struct {
+	Connector  string
+	Header     http.Header
+	Body       []byte
+	ReceivedAt time.Time
+}
+
+// EventResult is what a connector made of a platform event. A non-empty
+// ConnectionID applies Status and ExternalAccount to that connection.
+type EventResult struct {
+	Type            string `json:"type"`
+	ConnectionID    string `json:"connectionId,omitempty"`
+	Status          string `json:"status,omitempty"`
+	ExternalAccount string `json:"externalAccount,omitempty"`
+}
+
+// VerificationRequest asks for a subject to be verified against a pack
+type VerificationRequest struct {
+	Pack string `json:"pack"`
+}
+
+// VerificationSession is a verification a connector started
+type VerificationSession struct {
+	ID     string `json:"id"`
+	Pack   string `json:"pack"`
+	URL    string `json:"url,omitempty"` // where the subject completes it
+	Status string `json:"status"`
+}
+
+// Connector integrates one third-party platform with Cachet. Connectors
+// return ErrUnsupported for capabilities they do not advertise.
+type Connector interface {
+	// Describe identifies the connector and its capabilities
+	Describe() ConnectorInfo
+	// Authorize starts linking a platform account to conn's subject
+	Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error)
+	// HandleEvent authenticates and interprets a platform callback, returning
+	// ErrEventSignature or ErrInvalidEvent for callbacks it refuses
+	HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error)
+	// RequestVerification starts verifying conn's subject
+	RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error)
+}
+
+// connectorRegistry holds the installed connectors by id
+type connectorRegistry struct {
+	mu         sync.RWMutex
+	connectors map[string]Connector
+}
+
+func newConnectorRegistry() *connectorRegistry {
+	return &connectorRegistry{connectors: make(map[string]Connector)}
+}
+
+// Install adds a connector; ids are unique
+func (c *connectorRegistry) Install(connector Connector) error {
+	info := connector.Describe()
+	if !connectorIDPattern.MatchString(info.ID) {
+		return fmt.Errorf("connector id %q is invalid", info.ID)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.connectors[info.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrConnectorExists, info.ID)
+	}
+	c.connectors[info.ID] = connector
+	return nil
+}
+
+func (c *connectorRegistry) Get(id string) (Connector, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	connector, ok := c.connectors[id]
+	if !ok {
+		return nil, ErrConnectorNotFound
+	}
+	return connector, nil
+}
+
+// List describes the installed connectors, by id
+func (c *connectorRegistry) List() []ConnectorInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	infos := make([]ConnectorInfo, 0, len(c.connectors))
+	for _, connector := range c.connectors {
+		infos = append(infos, connector.Describe())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConnector links accounts through a consent URL when consent is set,
+// and accepts callbacks carrying its shared secret
+type fakeConnector struct {
+	id      string
+	consent bool
+}
+
+func (f *fakeConnector) Describe() ConnectorInfo {
+	return ConnectorInfo{ID: f.id, Name: "Fake Market", Platform: "marketplace", Capabilities: []string{CapabilityConnect, CapabilityEvents}}
+}
+
+func (f *fakeConnector) Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error) {
+	if f.consent {
+		return Authorization{URL: "https://market.example/consent?state=" + conn.ID}, nil
+	}
+	return Authorization{ExternalAccount: "seller-" + conn.Subject}, nil
+}
+
+func (f *fakeConnector) HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error) {
+	if event.Header.Get("X-Fake-Secret") != "s3cret" {
+		return EventResult{}, ErrEventSignature
+	}
+	var body struct {
+		Type    string `json:"type"`
+		State   string `json:"state"`
+		Account string `json:"account"`
+	}
+	if err := json.Unmarshal(event.Body, &body); err != nil || body.Type == "" {
+		return EventResult{}, ErrInvalidEvent
+	}
+	result := EventResult{Type: body.Type, ConnectionID: body.State, ExternalAccount: body.Account}
+	if body.Type == "consent.granted" {
+		result.Status = ConnectionStatusActive
+	}
+	return result, nil
+}
+
+func (f *fakeConnector) RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error) {
+	return VerificationSession{}, ErrUnsupported
+}
+
+func hubRequest(t *testing.T, server *Server, method, path string, body interface{}, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if raw, ok := body.([]byte); ok {
+		reader = bytes.NewReader(raw)
+	} else if body != nil {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHealthCheck(t *testing.T) {
+	server := NewServer()
+	w := hubRequest(t, server, http.MethodGet, "/health", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestConnectorRegistry(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "gig.fake"}))
+	assert.ErrorIs(t, server.connectors.Install(&fakeConnector{id: "market.fake"}), ErrConnectorExists)
+	assert.Error(t, server.connectors.Install(&fakeConnector{id: "Market Fake"}))
+
+	w := hubRequest(t, server, http.MethodGet, "/connectors", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Connectors []ConnectorInfo `json:"connectors"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Connectors, 2)
+	assert.Equal(t, "gig.fake", resp.Connectors[0].ID)
+
+	assert.Equal(t, http.StatusOK, hubRequest(t, server, http.MethodGet, "/connectors/market.fake", nil, nil).Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/connectors/unknown", nil, nil).Code)
+}
+
+func TestConnections_ConsentFlow(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake", consent: true}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/connections", ConnectRequest{Subject: "did:key:alice", RedirectURI: "https://wallet.cachet.id/linked"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, ConnectionStatusPending, created.Connection.Status)
+	assert.Equal(t, "https://market.example/consent?state="+created.Connection.ID, created.AuthorizationURL)
+	assert.Equal(t, "/connections/"+created.Connection.ID, w.Header().Get("Location"))
+
+	// Callbacks are authenticated by the connector
+	callback := map[string]string{"type": "consent.granted", "state": created.Connection.ID, "account": "seller-42"}
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", []byte("{"), map[string]string{"X-Fake-Secret": "s3cret"}).Code)
+	w = hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, map[string]string{"X-Fake-Secret": "s3cret"})
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	w = hubRequest(t, server, http.MethodGet, "/connections/"+created.Connection.ID, nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	var conn Connection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &conn))
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+	assert.Equal(t, "seller-42", conn.ExternalAccount)
+
+	// Events about unknown connections are acknowledged so platforms stop retrying
+	callback["state"] = "conn_unknown"
+	assert.Equal(t, http.StatusAccepted, hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, map[string]string{"X-Fake-Secret": "s3cret"}).Code)
+	assert.Equal(t, http.StatusNotImplemented, hubRequest(t, server, http.MethodPost, "/connections/"+conn.ID+"/verifications", VerificationRequest{Pack: "pack.safe.seller"}, partner).Code)
+}
+
+func TestConnections_ImmediateLinkAndValidation(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/connections", ConnectRequest{Subject: "did:key:bob"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, ConnectionStatusActive, created.Connection.Status)
+	assert.Equal(t, "seller-did:key:bob", created.Connection.ExternalAccount)
+	assert.Empty(t, created.AuthorizationURL)
+
+	w = hubRequest(t, server, http.MethodGet, "/connections?subject=did:key:bob", nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Connections []Connection `json:"connections"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed.Connections, 1)
+
+	for name, tc := range map[string]struct {
+		path string
+		body interface{}
+		code int
+	}{
+		"no subject":        {"/connectors/market.fake/connections", ConnectRequest{}, http.StatusBadRequest},
+		"http redirect":     {"/connectors/market.fake/connections", ConnectRequest{Subject: "s", RedirectURI: "http://wallet.example"}, http.StatusBadRequest},
+		"unknown connector": {"/connectors/unknown/connections", ConnectRequest{Subject: "s"}, http.StatusNotFound},
+		"unknown callback":  {"/connectors/unknown/callbacks", map[string]string{}, http.StatusNotFound},
+		"no pack":           {"/connections/" + created.Connection.ID + "/verifications", VerificationRequest{}, http.StatusBadRequest},
+	} {
+		assert.Equal(t, tc.code, hubRequest(t, server, http.MethodPost, tc.path, tc.body, partner).Code, name)
+	}
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/connections/conn_missing", nil, partner).Code)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Canonical Cachet events, whatever the platform called them
+const (
+	EventListingCreated = "listing.created"
+	EventAccountFlagged = "account.flagged"
+	EventDisputeOpened  = "dispute.opened"
+)
+
+// Account flag severities
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+var ErrEventNotFound = errors.New("event not found")
+
+// ListingCreated is the data of a listing.created event
+type ListingCreated struct {
+	ListingID string `json:"listingId"`
+	Title     string `json:"title,omitempty"`
+	Category  string `json:"category,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AccountFlagged is the data of an account.flagged event: the platform's
+// trust and safety team flagged the subject's account
+type AccountFlagged struct {
+	Reason   string `json:"reason"`
+	Severity string `json:"severity"`
+}
+
+// DisputeOpened is the data of a dispute.opened event: a counterparty
+// disputed one of the subject's transactions
+type DisputeOpened struct {
+	DisputeID string `json:"disputeId"`
+	OrderID   string `json:"orderId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// Amount is in minor units of Currency, e.g. cents
+	Amount   int64  `json:"amount,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// CachetEvent is a platform event in Cachet's canonical schema. Connectors
+// fill in the type, the platform's ids and the data; the hub resolves the
+// connection and subject.
+type CachetEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Connector string `json:"connector"`
+	// PlatformEventID is the platform's id for the event; replays of an id
+	// are dropped
+	PlatformEventID string          `json:"platformEventId"`
+	ConnectionID    string          `json:"connectionId,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	ExternalAccount string          `json:"externalAccount,omitempty"`
+	OccurredAt      time.Time       `json:"occurredAt"`
+	ReceivedAt      time.Time       `json:"receivedAt"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// EventNormalizer is implemented by connectors whose platforms send
+// business events, mapping a platform callback to canonical events. It is
+// called after HandleEvent accepted the callback, and returns
+// ErrInvalidEvent for payloads it cannot map.
+type EventNormalizer interface {
+	NormalizeEvent(ctx context.Context, event PlatformEvent) ([]CachetEvent, error)
+}
+
+// NewCachetEvent builds a canonical event with its typed data, for
+// connectors' parsers
+func NewCachetEvent(eventType, platformEventID string, occurredAt time.Time, data interface{}) (CachetEvent, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return CachetEvent{}, err
+	}
+	return CachetEvent{Type: eventType, PlatformEventID: platformEventID, OccurredAt: occurredAt, Data: raw}, nil
+}
+
+// validateCachetEvent checks a normalized event against its type's schema
+func validateCachetEvent(event CachetEvent) error {
+	if event.PlatformEventID == "" {
+		return fmt.Errorf("%w: %s event has no platform event id", ErrInvalidEvent, event.Type)
+	}
+	if event.OccurredAt.IsZero() {
+		return fmt.Errorf("%w: %s event has no time", ErrInvalidEvent, event.Type)
+	}
+	var missing string
+	switch event.Type {
+	case EventListingCreated:
+		var data ListingCreated
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+		if data.ListingID == "" {
+			missing = "listingId"
+		}
+	case EventAccountFlagged:
+		var data AccountFlagged
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+		switch {
+		case data.Reason == "":
+			missing = "reason"
+		case data.Severity != SeverityLow && data.Severity != SeverityMedium && data.Severity != SeverityHigh:
+			return fmt.Errorf("%w: account.flagged severity %q", ErrInvalidEvent, data.Severity)
+		}
+	case EventDisputeOpened:
+		var data DisputeOpened
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+		if data.DisputeID == "" {
+			missing = "disputeId"
+		}
+	default:
+		return fmt.Errorf("%w: unknown event type %q", ErrInvalidEvent, event.Type)
+	}
+	if missing != "" {
+		return fmt.Errorf("%w: %s event has no %s", ErrInvalidEvent, event.Type, missing)
+	}
+	return nil
+}
+
+// EventFilter narrows a listing of stored events; zero fields match all
+type EventFilter struct {
+	Type      string
+	Connector string
+	Subject   string
+	Limit     int
+}
+
+// EventStore persists normalized events
+type EventStore interface {
+	// Append stores an event, returning false for a replay of an event
+	// already stored from the same connector
+	Append(ctx context.Context, event CachetEvent) (bool, error)
+	Get(ctx context.Context, id string) (CachetEvent, error)
+	// List returns matching events, newest first
+	List(ctx context.Context, filter EventFilter) ([]CachetEvent, error)
+}
+
+// memoryEventStore keeps events in memory (production should use a shared
+// database, so services can backfill after a restart)
+type memoryEventStore struct {
+	mu       sync.RWMutex
+	events   []CachetEvent
+	byID     map[string]int
+	platform map[string]bool // connector + platform event id
+}
+
+func newMemoryEventStore() *memoryEventStore {
+	return &memoryEventStore{byID: make(map[string]int), platform: make(map[string]bool)}
+}
+
+func (m *memoryEventStore) Append(ctx context.Context, event CachetEvent) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := event.Connector + "\x00" + event.PlatformEventID
+	if m.platform[key] {
+		return false, nil
+	}
+	m.platform[key] = true
+	m.byID[event.ID] = len(m.events)
+	m.events = append(m.events, event)
+	return true, nil
+}
+
+func (m *memoryEventStore) Get(ctx context.Context, id string) (CachetEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, ok := m.byID[id]
+	if !ok {
+		return CachetEvent{}, ErrEventNotFound
+	}
+	return m.events[i], nil
+}
+
+func (m *memoryEventStore) List(ctx context.Context, filter EventFilter) ([]CachetEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []CachetEvent{}
+	for _, event := range m.events {
+		if (filter.Type == "" || event.Type == filter.Type) &&
+			(filter.Connector == "" || event.Connector == filter.Connector) &&
+			(filter.Subject == "" || event.Subject == filter.Subject) {
+			out = append(out, event)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ReceivedAt.After(out[j].ReceivedAt) })
+	if filter.Limit > 0 && len(out) > filter.Limit {
+		out = out[:filter.Limit]
+	}
+	return out, nil
+}
+
+// normalizeEvent maps an accepted platform callback to canonical events,
+// when the connector parses its platform's business events. Events are
+// resolved to the connection they concern, by id or platform account.
+func (s *Server) normalizeEvent(ctx context.Context, connector Connector, event PlatformEvent) ([]CachetEvent, error) {
+	normalizer, ok := connector.(EventNormalizer)
+	if !ok {
+		return nil, nil
+	}
+	events, err := normalizer.NormalizeEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		if err := validateCachetEvent(events[i]); err != nil {
+			return nil, err
+		}
+		events[i].ID = newID("evt")
+		events[i].Connector = event.Connector
+		events[i].ReceivedAt = event.ReceivedAt
+		events[i].OccurredAt = events[i].OccurredAt.UTC()
+		conn, err := s.eventConnection(ctx, events[i])
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			events[i].ConnectionID, events[i].Subject = conn.ID, conn.Subject
+			if events[i].ExternalAccount == "" {
+				events[i].ExternalAccount = conn.ExternalAccount
+			}
+		}
+	}
+	return events, nil
+}
+
+// eventConnection finds the connection an event concerns; events about
+// accounts not linked to Cachet are kept without a subject
+func (s *Server) eventConnection(ctx context.Context, event CachetEvent) (*Connection, error) {
+	if event.ConnectionID != "" {
+		conn, err := s.connections.Get(ctx, hubScope, event.ConnectionID)
+		if errors.Is(err, ErrConnectionNotFound) || (err == nil && conn.Connector != event.Connector) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &conn, nil
+	}
+	if event.ExternalAccount == "" {
+		return nil, nil
+	}
+	connections, err := s.connections.List(ctx, hubScope, ConnectionFilter{Connector: event.Connector})
+	if err != nil {
+		return nil, err
+	}
+	for i := len(connections) - 1; i >= 0; i-- { // the latest link wins
+		if connections[i].ExternalAccount == event.ExternalAccount && connections[i].Status == ConnectionStatusActive {
+			return &connections[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// recordEvents persists normalized events and puts new ones on the bus;
+// replays are dropped
+func (s *Server) recordEvents(ctx context.Context, events []CachetEvent) (int, error) {
+	recorded := 0
+	for _, event := range events {
+		fresh, err := s.events.Append(ctx, event)
+		if err != nil {
+			return recorded, err
+		}
+		if !fresh {
+			continue
+		}
+		recorded++
+		s.bus.Publish(event)
+	}
+	return recorded, nil
+}
+
+func (s *Server) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := EventFilter{
+		Type:      query.Get("type"),
+		Connector: query.Get("connector"),
+		Subject:   query.Get("subject"),
+		Limit:     100,
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+	events, err := s.events.List(r.Context(), filter)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
+
+func (s *Server) handleGetEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := s.events.Get(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrEventNotFound) {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, event)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// normalizingConnector is a fakeConnector whose platform sends business
+// events in its own shape:
+//
+//	{"type": "item_listed"|"seller_warned"|"claim_filed", "eventId", "account", "ts", ...}
+type normalizingConnector struct {
+	fakeConnector
+}
+
+func (n *normalizingConnector) NormalizeEvent(ctx context.Context, event PlatformEvent) ([]CachetEvent, error) {
+	var body struct {
+		Type    string `json:"type"`
+		EventID string `json:"eventId"`
+		Account string `json:"account"`
+		TS      int64  `json:"ts"`
+		Item    string `json:"item"`
+		Title   string `json:"title"`
+		Level   int    `json:"level"`
+		Claim   string `json:"claim"`
+	}
+	if err := json.Unmarshal(event.Body, &body); err != nil {
+		return nil, ErrInvalidEvent
+	}
+	var normalized CachetEvent
+	var err error
+	at := time.Unix(body.TS, 0)
+	switch body.Type {
+	case "item_listed":
+		normalized, err = NewCachetEvent(EventListingCreated, body.EventID, at, ListingCreated{ListingID: body.Item, Title: body.Title})
+	case "seller_warned":
+		severity := map[int]string{1: SeverityLow, 2: SeverityMedium, 3: SeverityHigh}[body.Level]
+		normalized, err = NewCachetEvent(EventAccountFlagged, body.EventID, at, AccountFlagged{Reason: "platform_warning", Severity: severity})
+	case "claim_filed":
+		normalized, err = NewCachetEvent(EventDisputeOpened, body.EventID, at, DisputeOpened{DisputeID: body.Claim})
+	default:
+		return nil, nil // consent callbacks carry no business event
+	}
+	normalized.ExternalAccount = body.Account
+	return []CachetEvent{normalized}, err
+}
+
+var fakeSecretHeader = map[string]string{"X-Fake-Secret": "s3cret"}
+
+func newEventsTestServer(t *testing.T) (*Server, Connection) {
+	t.Helper()
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	t.Cleanup(server.bus.Close)
+	require.NoError(t, server.connectors.Install(&normalizingConnector{fakeConnector{id: "market.fake"}}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/connections", ConnectRequest{Subject: "did:key:z6MkSeller"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return server, created.Connection
+}
+
+func TestEvents_NormalizeAndPublish(t *testing.T) {
+	server, conn := newEventsTestServer(t)
+	flagged := make(chan CachetEvent, 4)
+	server.bus.Subscribe("trust-signals", []string{EventAccountFlagged}, func(ctx context.Context, event CachetEvent) error {
+		flagged <- event
+		return nil
+	})
+
+	callback := map[string]interface{}{"type": "seller_warned", "eventId": "w-1", "account": conn.ExternalAccount, "ts": 1767225600, "level": 3}
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, fakeSecretHeader)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var response callbackResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Events, 1)
+
+	select {
+	case event := <-flagged:
+		assert.Equal(t, response.Events[0], event.ID)
+		assert.Equal(t, EventAccountFlagged, event.Type)
+		assert.Equal(t, "market.fake", event.Connector)
+		assert.Equal(t, conn.ID, event.ConnectionID)
+		assert.Equal(t, "did:key:z6MkSeller", event.Subject)
+		assert.Equal(t, time.Unix(1767225600, 0).UTC(), event.OccurredAt)
+		assert.JSONEq(t, `{"reason":"platform_warning","severity":"high"}`, string(event.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscriber did not receive the event")
+	}
+
+	// A replayed callback is acknowledged but not republished
+	w = hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, fakeSecretHeader)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	// Listings go to storage only: nobody subscribed to them
+	listed := map[string]interface{}{"type": "item_listed", "eventId": "l-1", "account": conn.ExternalAccount, "ts": 1767225700, "item": "sku-9", "title": "Bike"}
+	require.Equal(t, http.StatusAccepted, hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", listed, fakeSecretHeader).Code)
+	// Events from accounts not linked to Cachet are kept without a subject
+	claim := map[string]interface{}{"type": "claim_filed", "eventId": "c-1", "account": "seller-unlinked", "ts": 1767225800, "claim": "d-77"}
+	require.Equal(t, http.StatusAccepted, hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", claim, fakeSecretHeader).Code)
+
+	server.bus.Close()
+	assert.Len(t, flagged, 0, "the replay was not republished")
+
+	w = hubRequest(t, server, http.MethodGet, "/inbound-events?subject=did:key:z6MkSeller", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listedEvents struct {
+		Events []CachetEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listedEvents))
+	require.Len(t, listedEvents.Events, 2)
+	w = hubRequest(t, server, http.MethodGet, "/inbound-events?type=dispute.opened", nil, operatorHeader)
+	var disputes struct {
+		Events []CachetEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &disputes))
+	require.Len(t, disputes.Events, 1)
+	assert.Empty(t, disputes.Events[0].Subject)
+	assert.Equal(t, "seller-unlinked", disputes.Events[0].ExternalAccount)
+
+	w = hubRequest(t, server, http.MethodGet, "/inbound-events/"+response.Events[0], nil, operatorHeader)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/inbound-events/evt_missing", nil, operatorHeader).Code)
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodGet, "/inbound-events", nil, nil).Code)
+}
+
+func TestEvents_InvalidNormalization(t *testing.T) {
+	server, conn := newEventsTestServer(t)
+
+	for name, callback := range map[string]map[string]interface{}{
+		"no platform event id": {"type": "item_listed", "account": conn.ExternalAccount, "ts": 1767225600, "item": "sku-1"},
+		"no listing id":        {"type": "item_listed", "eventId": "l-2", "account": conn.ExternalAccount, "ts": 1767225600},
+		"unknown severity":     {"type": "seller_warned", "eventId": "w-2", "account": conn.ExternalAccount, "ts": 1767225600, "level": 9},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/callbacks", callback, fakeSecretHeader)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+	events, err := server.events.List(context.Background(), EventFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestEvents_Forwarder(t *testing.T) {
+	var received []*http.Request
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received, bodies = append(received, r), append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	subscribers, err := parseEventSubscribers([]byte(`
+subscribers:
+  - name: trust-signals
+    url: `+ts.URL+`/events
+    events: [account.flagged]
+    tokenEnv: TRUST_SIGNALS_TOKEN
+`), func(name string) (string, error) {
+		return map[string]string{"TRUST_SIGNALS_TOKEN": "bus-token"}[name], nil
+	})
+	require.NoError(t, err)
+	require.Len(t, subscribers, 1)
+
+	event := CachetEvent{ID: "evt_1", Type: EventAccountFlagged, Connector: "market.fake", Data: json.RawMessage(`{}`)}
+	require.NoError(t, forwarder(ts.Client(), subscribers[0])(context.Background(), event))
+	require.Len(t, received, 1)
+	assert.Equal(t, "Bearer bus-token", received[0].Header.Get("Authorization"))
+	assert.Equal(t, EventAccountFlagged, received[0].Header.Get(WebhookEventHeader))
+	var forwarded CachetEvent
+	require.NoError(t, json.Unmarshal(bodies[0], &forwarded))
+	assert.Equal(t, "evt_1", forwarded.ID)
+
+	for name, raw := range map[string]string{
+		"no name":       "subscribers: [{url: 'https://a/e'}]",
+		"bad url":       "subscribers: [{name: a, url: 'ftp://a/e'}]",
+		"unknown event": "subscribers: [{name: a, url: 'https://a/e', events: [listing.deleted]}]",
+		"unset token":   "subscribers: [{name: a, url: 'https://a/e', tokenEnv: A_TOKEN}]",
+		"repeated name": "subscribers: [{name: a, url: 'https://a/e'}, {name: a, url: 'https://b/e'}]",
+	} {
+		_, err := parseEventSubscribers([]byte(raw), func(string) (string, error) { return "", nil })
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// flagListType and flagContestType are the typs of the holder-signed
+	// tokens a subject lists and contests their flags with
+	flagListType    = "cachet-flags+jwt"
+	flagContestType = "cachet-flag-contest+jwt"
+
+	// maxFlagText caps a flag's reason and a subject's statement
+	maxFlagText = 2000
+	// flagPublishTimeout bounds how long the hub waits on the event bus
+	flagPublishTimeout = 5 * time.Second
+)
+
+// Flag kinds: a dispute over a transaction, or suspected fraud
+const (
+	FlagKindDispute = "dispute"
+	FlagKindFraud   = "fraud"
+)
+
+// Flag severities, from least to most serious
+const (
+	FlagSeverityLow    = "low"
+	FlagSeverityMedium = "medium"
+	FlagSeverityHigh   = "high"
+)
+
+var flagSeverityRank = map[string]int{FlagSeverityLow: 1, FlagSeverityMedium: 2, FlagSeverityHigh: 3}
+
+// Flag states. A flag is open once a partner raises it, contested when the
+// subject disputes it, and upheld or dismissed by an operator's review; the
+// partner may withdraw it at any time. Open, contested and upheld flags
+// stand against the subject.
+const (
+	FlagStatusOpen      = "open"
+	FlagStatusContested = "contested"
+	FlagStatusUpheld    = "upheld"
+	FlagStatusDismissed = "dismissed"
+	FlagStatusWithdrawn = "withdrawn"
+)
+
+var (
+	ErrFlagNotFound = errors.New("flag not found")
+	// ErrFlagClosed means a flag was already resolved or withdrawn, or is
+	// past the state an action applies to
+	ErrFlagClosed = errors.New("flag closed")
+
+	subjectFlags = expvar.NewMap("subject_flags_total")
+)
+
+// SubjectFlag is a dispute or fraud report a partner raised about a subject
+// linked to it. The subject sees their flags and may contest them.
+type SubjectFlag struct {
+	ID       string `json:"id"`
+	Partner  string `json:"partner"`
+	Subject  string `json:"subject"`
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Reason   string `json:"reason"`
+	// Reference is the partner's own id for the case; raising a flag with
+	// the same reference again returns the first one
+	Reference string `json:"reference,omitempty"`
+	Status    string `json:"status"`
+	// Suspends holds the subject's badges while the flag stands
+	Suspends   bool         `json:"suspends"`
+	Contest    *FlagContest `json:"contest,omitempty"`
+	Resolution string       `json:"resolution,omitempty"` // the operator's note
+	CreatedAt  time.Time    `json:"createdAt"`
+	ResolvedAt *time.Time   `json:"resolvedAt,omitempty"`
+}
+
+// FlagContest is the subject's side of a contested flag
+type FlagContest struct {
+	Statement   string    `json:"statement"`
+	ContestedAt time.Time `json:"contestedAt"`
+}
+
+// stands reports whether the flag counts against the subject
+func (f SubjectFlag) stands() bool {
+	return f.Status == FlagStatusOpen || f.Status == FlagStatusContested || f.Status == FlagStatusUpheld
+}
+
+// coversFlag reports whether a flag is within the scope
+func (t TenantScope) coversFlag(flag SubjectFlag) bool {
+	return t.hub || (t.Partner != "" && flag.Partner == t.Partner && t.allowsSubject(flag.Subject))
+}
+
+// FlagFilter narrows a flag listing
+type FlagFilter struct {
+	Partner string
+	Subject string
+	Status  string
+}
+
+// flagStore holds flags in memory (production should use a shared
+// database, so flags survive restarts)
+type flagStore struct {
+	mu    sync.Mutex
+	flags map[string]SubjectFlag
+}
+
+func newFlagStore() *flagStore {
+	return &flagStore{flags: make(map[string]SubjectFlag)}
+}
+
+// Create stores a flag, unless the partner already raised one with its
+// reference: that one is returned instead, and false
+func (f *flagStore) Create(flag SubjectFlag) (SubjectFlag, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if flag.Reference != "" {
+		for _, existing := range f.flags {
+			if existing.Partner == flag.Partner && existing.Reference == flag.Reference {
+				return existing, false
+			}
+		}
+	}
+	f.flags[flag.ID] = flag
+	return flag, true
+}
+
+func (f *flagStore) Get(id string) (SubjectFlag, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flag, ok := f.flags[id]
+	if !ok {
+		return SubjectFlag{}, ErrFlagNotFound
+	}
+	return flag, nil
+}
+
+// Update applies fn to a flag atomically; fn's error aborts it
+func (f *flagStore) Update(id string, fn func(*SubjectFlag) error) (SubjectFlag, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flag, ok := f.flags[id]
+	if !ok {
+		return SubjectFlag{}, ErrFlagNotFound
+	}
+	if err := fn(&flag); err != nil {
+		return SubjectFlag{}, err
+	}
+	f.flags[id] = flag
+	return flag, nil
+}
+
+// List returns the flags matching filter, newest first
+func (f *flagStore) List(filter FlagFilter) []SubjectFlag {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []SubjectFlag{}
+	for _, flag := range f.flags {
+		if (filter.Partner == "" || flag.Partner == filter.Partner) &&
+			(filter.Subject == "" || flag.Subject == filter.Subject) &&
+			(filter.Status == "" || flag.Status == filter.Status) {
+			out = append(out, flag)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Suspends reports whether a standing flag holds the subject's badges
+func (f *flagStore) Suspends(subject string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, flag := range f.flags {
+		if flag.Subject == subject && flag.Suspends && flag.stands() {
+			return true
+		}
+	}
+	return false
+}
+
+// publishFlag announces a flag raised or cleared to the other Cachet
+// services, which weigh it in trust scores. Failures are logged: the flag
+// stands at the hub whether or not others hear of it.
+func (s *Server) publishFlag(ctx context.Context, flagID string, data events.Data) {
+	if s.cachetEvents == nil {
+		return
+	}
+	event, err := events.New("connector-hub", flagID, data, time.Now())
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flagPublishTimeout)
+		err = s.cachetEvents.Publish(ctx, event)
+		cancel()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("flag_id", flagID).Str("type", data.EventType()).Msg("Failed to publish flag event")
+	}
+}
+
+// clearFlag announces that a flag no longer counts against its subject
+func (s *Server) clearFlag(ctx context.Context, flag SubjectFlag) {
+	s.publishFlag(ctx, flag.ID, events.SubjectFlagCleared{
+		FlagID:    flag.ID,
+		Subject:   flag.Subject,
+		Outcome:   flag.Status,
+		ClearedAt: *flag.ResolvedAt,
+	})
+}
+
+// writeFlagError answers a failed call on a flag
+func (s *Server) writeFlagError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrFlagNotFound):
+		http.Error(w, "Flag not found", http.StatusNotFound)
+	case errors.Is(err, ErrFlagClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrLinkSignature):
+		http.Error(w, "Invalid holder signature", http.StatusUnauthorized)
+	default:
+		s.writeTenantError(w, r, err)
+	}
+}
+
+// RaiseFlagRequest is the body of POST /partners/{id}/flags. Subject is
+// the subject's DID or the partner's account id for them.
+type RaiseFlagRequest struct {
+	Subject   string `json:"subject"`
+	Kind      string `json:"kind"`
+	Severity  string `json:"severity"`
+	Reason    string `json:"reason"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// handleRaiseFlag records a partner's dispute or fraud report about a
+// subject linked to it. Flags at or above the configured severity hold the
+// subject's badges until the flag is dismissed or withdrawn.
+func (s *Server) handleRaiseFlag(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	partner := chi.URLParam(r, "id")
+	if !scope.hub && scope.Partner != partner {
+		s.writeTenantError(w, r, fmt.Errorf("%w: flags of partner %s", ErrOutOfScope, partner))
+		return
+	}
+	if _, err := s.partners.Get(r.Context(), partner); err != nil {
+		http.Error(w, "Partner not found", http.StatusNotFound)
+		return
+	}
+	var req RaiseFlagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Kind != FlagKindDispute && req.Kind != FlagKindFraud:
+		http.Error(w, "kind must be dispute or fraud", http.StatusBadRequest)
+		return
+	case flagSeverityRank[req.Severity] == 0:
+		http.Error(w, "severity must be low, medium or high", http.StatusBadRequest)
+		return
+	case strings.TrimSpace(req.Reason) == "" || len(req.Reason) > maxFlagText:
+		http.Error(w, fmt.Sprintf("reason is required, up to %d bytes", maxFlagText), http.StatusBadRequest)
+		return
+	}
+	subject, ok, err := s.partnerSubject(r.Context(), partner, req.Subject)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Subject not linked to the partner", http.StatusNotFound)
+		return
+	}
+	if !scope.allowsSubject(subject) {
+		s.writeTenantError(w, r, fmt.Errorf("%w: subject %s", ErrOutOfScope, subject))
+		return
+	}
+
+	flag, created := s.flags.Create(SubjectFlag{
+		ID:        newID("flg"),
+		Partner:   partner,
+		Subject:   subject,
+		Kind:      req.Kind,
+		Severity:  req.Severity,
+		Reason:    req.Reason,
+		Reference: req.Reference,
+		Status:    FlagStatusOpen,
+		Suspends:  s.flagSuspend != "" && flagSeverityRank[req.Severity] >= flagSeverityRank[s.flagSuspend],
+		CreatedAt: time.Now().UTC(),
+	})
+	w.Header().Set("Location", "/flags/"+flag.ID)
+	if !created {
+		writeJSON(w, http.StatusOK, flag)
+		return
+	}
+	s.publishFlag(r.Context(), flag.ID, events.SubjectFlagged{
+		FlagID:    flag.ID,
+		Subject:   flag.Subject,
+		Partner:   flag.Partner,
+		Kind:      flag.Kind,
+		Severity:  flag.Severity,
+		Suspend:   flag.Suspends,
+		FlaggedAt: flag.CreatedAt,
+	})
+	subjectFlags.Add("raised", 1)
+	log.Info().Str("flag_id", flag.ID).Str("partner", partner).Str("kind", flag.Kind).Str("severity", flag.Severity).Bool("suspends", flag.Suspends).Msg("Subject flagged")
+	writeJSON(w, http.StatusCreated, flag)
+}
+
+// handleListFlags lists the flags within the caller's scope: a partner's
+// own, or every partner's for operators, who may narrow it with ?partner=
+func (s *Server) handleListFlags(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	query := r.URL.Query()
+	filter := FlagFilter{Partner: scope.Partner, Subject: query.Get("subject"), Status: query.Get("status")}
+	if scope.hub {
+		filter.Partner = query.Get("partner")
+	}
+	flags := []SubjectFlag{}
+	for _, flag := range s.flags.List(filter) {
+		if scope.coversFlag(flag) {
+			flags = append(flags, flag)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flags": flags})
+}
+
+// handleGetFlag returns a flag within the caller's scope
+func (s *Server) handleGetFlag(w http.ResponseWriter, r *http.Request) {
+	flag, err := s.flags.Get(chi.URLParam(r, "id"))
+	if err == nil && !scopeFromContext(r.Context()).coversFlag(flag) {
+		err = fmt.Errorf("%w: %w", ErrFlagNotFound, ErrOutOfScope)
+	}
+	if err != nil {
+		s.writeFlagError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, flag)
+}
+
+// handleWithdrawFlag drops a flag at the partner's request, such as once a
+// dispute is settled
+func (s *Server) handleWithdrawFlag(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	now := time.Now().UTC()
+	flag, err := s.flags.Update(chi.URLParam(r, "id"), func(flag *SubjectFlag) error {
+		if !scope.coversFlag(*flag) {
+			return fmt.Errorf("%w: %w", ErrFlagNotFound, ErrOutOfScope)
+		}
+		if !flag.stands() {
+			return fmt.Errorf("%w: the flag is %s", ErrFlagClosed, flag.Status)
+		}
+		flag.Status, flag.ResolvedAt = FlagStatusWithdrawn, &now
+		return nil
+	})
+	if err != nil {
+		s.writeFlagError(w, r, err)
+		return
+	}
+	s.clearFlag(r.Context(), flag)
+	subjectFlags.Add("withdrawn", 1)
+	log.Info().Str("flag_id", flag.ID).Str("partner", flag.Partner).Msg("Flag withdrawn by the partner")
+	writeJSON(w, http.StatusOK, flag)
+}
+
+// ResolveFlagRequest is the body of POST /flags/{id}/resolve
+type ResolveFlagRequest struct {
+	// Outcome is upheld, which keeps the flag standing, or dismissed
+	Outcome string `json:"outcome"`
+	Note    string `json:"note,omitempty"`
+}
+
+// handleResolveFlag records an operator's review of an open or contested
+// flag. A dismissed flag stops counting against the subject.
+func (s *Server) handleResolveFlag(w http.ResponseWriter, r *http.Request) {
+	var req ResolveFlagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Outcome != FlagStatusUpheld && req.Outcome != FlagStatusDismissed {
+		http.Error(w, "outcome must be upheld or dismissed", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	flag, err := s.flags.Update(chi.URLParam(r, "id"), func(flag *SubjectFlag) error {
+		if flag.Status != FlagStatusOpen && flag.Status != FlagStatusContested {
+			return fmt.Errorf("%w: the flag is %s", ErrFlagClosed, flag.Status)
+		}
+		flag.Status, flag.Resolution, flag.ResolvedAt = req.Outcome, req.Note, &now
+		return nil
+	})
+	if err != nil {
+		s.writeFlagError(w, r, err)
+		return
+	}
+	if flag.Status == FlagStatusDismissed {
+		s.clearFlag(r.Context(), flag)
+	}
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeAdminAction, Action: "flag." + flag.Status, Actor: "operator", Target: flag.ID})
+	subjectFlags.Add(flag.Status, 1)
+	log.Info().Str("flag_id", flag.ID).Str("outcome", flag.Status).Msg("Flag resolved")
+	writeJSON(w, http.StatusOK, flag)
+}
+
+// handleListSubjectFlags shows a subject every flag raised about them. The
+// subject authenticates with a bearer JWS of typ cachet-flags+jwt whose
+// iss and sub are their DID, aud the hub, and iat recent.
+func (s *Server) handleListSubjectFlags(w http.ResponseWriter, r *http.Request) {
+	subject := chi.URLParam(r, "id")
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	holder, err := "", ErrLinkSignature
+	if strings.EqualFold(scheme, "Bearer") && token != "" {
+		holder, err = s.verifyHolderAnswer(r.Context(), token, flagListType, subject, &jwt.RegisteredClaims{})
+	}
+	if err == nil && holder != subject {
+		err = fmt.Errorf("%w: only the subject may list their flags", ErrLinkSignature)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subject"`)
+		s.writeFlagError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flags": s.flags.List(FlagFilter{Subject: subject})})
+}
+
+// flagContestClaims are the payload of a subject's contest: iss is their
+// DID, sub the flag, aud the hub, and statement their side of it
+type flagContestClaims struct {
+	jwt.RegisteredClaims
+	Statement string `json:"statement"`
+}
+
+// ContestFlagRequest is the body of POST /flags/{id}/contest: a compact JWS
+// with typ cachet-flag-contest+jwt, signed as a link confirmation is
+type ContestFlagRequest struct {
+	Contest string `json:"contest"`
+}
+
+// handleContestFlag records the flagged subject's dispute of an open flag,
+// which then awaits an operator's review. The flag keeps counting until it
+// is dismissed.
+func (s *Server) handleContestFlag(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req ContestFlagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Contest == "" {
+		http.Error(w, "contest is required", http.StatusBadRequest)
+		return
+	}
+	var claims flagContestClaims
+	holder, err := s.verifyHolderAnswer(r.Context(), req.Contest, flagContestType, id, &claims)
+	if err != nil {
+		s.writeFlagError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(claims.Statement) == "" || len(claims.Statement) > maxFlagText {
+		http.Error(w, fmt.Sprintf("statement is required, up to %d bytes", maxFlagText), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	flag, err := s.flags.Update(id, func(flag *SubjectFlag) error {
+		if flag.Subject != holder {
+			return fmt.Errorf("%w: only the flagged subject may contest", ErrLinkSignature)
+		}
+		if flag.Status != FlagStatusOpen {
+			return fmt.Errorf("%w: the flag is %s", ErrFlagClosed, flag.Status)
+		}
+		flag.Status = FlagStatusContested
+		flag.Contest = &FlagContest{Statement: claims.Statement, ContestedAt: now}
+		return nil
+	})
+	if err != nil {
+		s.writeFlagError(w, r, err)
+		return
+	}
+	subjectFlags.Add("contested", 1)
+	log.Info().Str("flag_id", flag.ID).Str("partner", flag.Partner).Msg("Flag contested by the subject")
+	writeJSON(w, http.StatusOK, flag)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flagEvents collects the flag events the hub publishes
+type flagEvents struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func watchFlagEvents(t *testing.T, server *Server) *flagEvents {
+	t.Helper()
+	bus := events.NewMemory()
+	t.Cleanup(func() { _ = bus.Close() })
+	server.cachetEvents = bus
+	seen := &flagEvents{}
+	require.NoError(t, bus.Subscribe("test", []string{events.TypeSubjectFlagged, events.TypeSubjectFlagCleared}, func(ctx context.Context, event events.Event) error {
+		seen.mu.Lock()
+		defer seen.mu.Unlock()
+		seen.events = append(seen.events, event)
+		return nil
+	}))
+	return seen
+}
+
+func (f *flagEvents) types() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	types := []string{}
+	for _, event := range f.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// linkedHolder links account to a new wallet holder
+func linkedHolder(t *testing.T, server *Server, account string, partner map[string]string) walletHolder {
+	t.Helper()
+	holder := newWalletHolder(t)
+	link, request := startLink(t, server, account, partner)
+	w := confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return holder
+}
+
+func raiseFlag(t *testing.T, server *Server, partner string, req RaiseFlagRequest, header map[string]string) (int, SubjectFlag) {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodPost, "/partners/"+partner+"/flags", req, header)
+	var flag SubjectFlag
+	if w.Code == http.StatusOK || w.Code == http.StatusCreated {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&flag))
+	}
+	return w.Code, flag
+}
+
+func badgeVerified(t *testing.T, server *Server, subject string) bool {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodGet, "/partners/market.fake/subjects/"+subject+"/badge", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var badge BadgeResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&badge))
+	return badge.Verified
+}
+
+func TestFlags_RaiseSuspendAndWithdraw(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	server.flagSuspend = FlagSeverityHigh
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	other := onboardPartner(t, server, "market.other", CreateKeyRequest{})
+	seen := watchFlagEvents(t, server)
+	holder := linkedHolder(t, server, "seller-42", partner)
+	server.badges.Record(holder.did, BadgeState{Badge: "pack.safe.seller", Status: BadgeStatusActive, UpdatedAt: time.Now().UTC()})
+	require.True(t, badgeVerified(t, server, holder.did))
+
+	// A low-severity dispute counts against the subject without holding badges
+	code, dispute := raiseFlag(t, server, "market.fake", RaiseFlagRequest{
+		Subject: holder.did, Kind: FlagKindDispute, Severity: FlagSeverityLow, Reason: "Item not as described",
+	}, partner)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, FlagStatusOpen, dispute.Status)
+	assert.False(t, dispute.Suspends)
+	assert.True(t, badgeVerified(t, server, holder.did))
+
+	// Partners may name the subject by their own account id
+	fraud := RaiseFlagRequest{Subject: "seller-42", Kind: FlagKindFraud, Severity: FlagSeverityHigh, Reason: "Chargeback ring", Reference: "case-7"}
+	code, flag := raiseFlag(t, server, "market.fake", fraud, partner)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, holder.did, flag.Subject)
+	assert.True(t, flag.Suspends)
+	assert.False(t, badgeVerified(t, server, holder.did), "a suspending flag holds the badge")
+	code, again := raiseFlag(t, server, "market.fake", fraud, partner)
+	assert.Equal(t, http.StatusOK, code, "the same reference is the same flag")
+	assert.Equal(t, flag.ID, again.ID)
+
+	// Only subjects linked to the caller can be flagged, and only as itself
+	code, _ = raiseFlag(t, server, "market.fake", RaiseFlagRequest{Subject: "did:key:z6MkStranger", Kind: FlagKindFraud, Severity: FlagSeverityLow, Reason: "Spam"}, partner)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = raiseFlag(t, server, "market.other", RaiseFlagRequest{Subject: holder.did, Kind: FlagKindFraud, Severity: FlagSeverityLow, Reason: "Spam"}, other)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = raiseFlag(t, server, "market.fake", fraud, other)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = raiseFlag(t, server, "market.fake", RaiseFlagRequest{Subject: holder.did, Kind: "rumour", Severity: FlagSeverityLow, Reason: "Spam"}, partner)
+	assert.Equal(t, http.StatusBadRequest, code)
+	w := hubRequest(t, server, http.MethodGet, "/flags/"+flag.ID, nil, other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = hubRequest(t, server, http.MethodGet, "/flags?status=open", nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Flags []SubjectFlag `json:"flags"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listed))
+	assert.Len(t, listed.Flags, 2)
+
+	// Withdrawing the flag releases the badge
+	w = hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/withdraw", nil, partner)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, badgeVerified(t, server, holder.did))
+	w = hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/withdraw", nil, partner)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	require.Eventually(t, func() bool { return len(seen.types()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{events.TypeSubjectFlagged, events.TypeSubjectFlagged, events.TypeSubjectFlagCleared}, seen.types())
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	for _, event := range seen.events {
+		if event.Type != events.TypeSubjectFlagCleared {
+			continue
+		}
+		var cleared events.SubjectFlagCleared
+		require.NoError(t, event.Decode(&cleared))
+		assert.Equal(t, flag.ID, cleared.FlagID)
+		assert.Equal(t, holder.did, cleared.Subject)
+		assert.Equal(t, FlagStatusWithdrawn, cleared.Outcome)
+	}
+}
+
+func TestFlags_SubjectListsAndContests(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	seen := watchFlagEvents(t, server)
+	holder := linkedHolder(t, server, "seller-42", partner)
+	stranger := newWalletHolder(t)
+	code, flag := raiseFlag(t, server, "market.fake", RaiseFlagRequest{
+		Subject: holder.did, Kind: FlagKindDispute, Severity: FlagSeverityMedium, Reason: "Item never arrived",
+	}, partner)
+	require.Equal(t, http.StatusCreated, code)
+
+	list := func(token string) (int, []SubjectFlag) {
+		w := hubRequest(t, server, http.MethodGet, "/subjects/"+holder.did+"/flags", nil, map[string]string{"Authorization": "Bearer " + token})
+		var body struct {
+			Flags []SubjectFlag `json:"flags"`
+		}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		}
+		return w.Code, body.Flags
+	}
+	code, flags := list(holder.sign(t, flagListType, holder.did, "", nil))
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, flags, 1)
+	assert.Equal(t, "Item never arrived", flags[0].Reason)
+	code, _ = list(stranger.sign(t, flagListType, holder.did, "", nil))
+	assert.Equal(t, http.StatusUnauthorized, code, "only the subject sees their flags")
+	code, _ = list(holder.sign(t, linkUnlinkType, holder.did, "", nil))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	contest := func(signer walletHolder, statement string) int {
+		token := signer.sign(t, flagContestType, flag.ID, "", func(claims jwt.MapClaims) { claims["statement"] = statement })
+		return hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/contest", ContestFlagRequest{Contest: token}, nil).Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, contest(stranger, "Not me"))
+	assert.Equal(t, http.StatusBadRequest, contest(holder, ""))
+	require.Equal(t, http.StatusOK, contest(holder, "Tracking shows it was delivered"))
+	assert.Equal(t, http.StatusConflict, contest(holder, "Again"))
+	code, flags = list(holder.sign(t, flagListType, holder.did, "", nil))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, FlagStatusContested, flags[0].Status)
+	assert.Equal(t, "Tracking shows it was delivered", flags[0].Contest.Statement)
+
+	// Operators review contested flags; partners cannot
+	resolve := ResolveFlagRequest{Outcome: FlagStatusDismissed, Note: "Delivery confirmed"}
+	w := hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/resolve", resolve, partner)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/resolve", resolve, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resolved SubjectFlag
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resolved))
+	assert.Equal(t, FlagStatusDismissed, resolved.Status)
+	assert.Equal(t, "Delivery confirmed", resolved.Resolution)
+	w = hubRequest(t, server, http.MethodPost, "/flags/"+flag.ID+"/resolve", ResolveFlagRequest{Outcome: FlagStatusUpheld}, operatorHeader)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	require.Eventually(t, func() bool { return len(seen.types()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{events.TypeSubjectFlagged, events.TypeSubjectFlagCleared}, seen.types())
+}
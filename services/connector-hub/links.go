@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// linkRequestType is the typ of the hub-signed request in a link's deep
+	// link; linkConfirmationType and linkUnlinkType are the holder-signed
+	// answers, and linkTokenType the hub's signed confirmation for partners
+	linkRequestType      = "cachet-link-request+jwt"
+	linkConfirmationType = "cachet-link+jwt"
+	linkUnlinkType       = "cachet-unlink+jwt"
+	linkTokenType        = "cachet-link-confirmation+jwt"
+
+	// linkChallengeTTL is how long the holder has to confirm a link
+	linkChallengeTTL = 10 * time.Minute
+	// linkClockSkew tolerates holders' clocks running ahead
+	linkClockSkew = 2 * time.Minute
+	// linkDeepLinkScheme is the wallet's deep link for confirming a link
+	linkDeepLinkScheme = "cachet://link"
+	// defaultLinkTTL is how long a confirmed link lasts
+	defaultLinkTTL    = 365 * 24 * time.Hour
+	linkSweepInterval = time.Minute
+)
+
+// Subject link states. A link is pending until the holder confirms it from
+// their wallet, then linked until it expires or either side unlinks it.
+const (
+	LinkStatusPending  = "pending"
+	LinkStatusLinked   = "linked"
+	LinkStatusExpired  = "expired"
+	LinkStatusUnlinked = "unlinked"
+)
+
+var (
+	ErrLinkNotFound = errors.New("subject link not found")
+	// ErrLinkClosed means a link is no longer pending, or no longer linked
+	ErrLinkClosed = errors.New("subject link closed")
+	// ErrLinkSignature means a holder's answer did not verify
+	ErrLinkSignature = errors.New("invalid link signature")
+
+	subjectLinks = expvar.NewMap("subject_links_total")
+)
+
+// linkSigningMethods are the algorithms holders may sign link answers with
+var linkSigningMethods = []string{"ES256", "ES384", "EdDSA"}
+
+// SubjectLink maps a user of a partner's platform to the Cachet subject
+// that proved, from their wallet, that they control it. Confirming a link
+// activates a connection between the two, which webhooks and badges follow.
+type SubjectLink struct {
+	ID              string `json:"id"`
+	Connector       string `json:"connector"`
+	Partner         string `json:"partner"`
+	ExternalAccount string `json:"externalAccount"` // the user's id on the platform
+	Subject         string `json:"subject,omitempty"`
+	Status          string `json:"status"`
+	ConnectionID    string `json:"connectionId,omitempty"`
+	// Confirmation is the hub's signed statement of the link, for partners
+	// to keep or pass on
+	Confirmation string     `json:"confirmation,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"` // the challenge's while pending, then the link's
+	LinkedAt     *time.Time `json:"linkedAt,omitempty"`
+	UnlinkedAt   *time.Time `json:"unlinkedAt,omitempty"`
+
+	challenge string
+}
+
+// statusAt is the link's state at now, which expires it once past ExpiresAt
+func (l SubjectLink) statusAt(now time.Time) string {
+	if (l.Status == LinkStatusPending || l.Status == LinkStatusLinked) && !now.Before(l.ExpiresAt) {
+		return LinkStatusExpired
+	}
+	return l.Status
+}
+
+// coversLink reports whether a link is within the scope; a pending link
+// has no subject yet to narrow it by
+func (t TenantScope) coversLink(link SubjectLink) bool {
+	return t.hub || (t.Partner != "" && link.Partner == t.Partner && t.allowsConnector(link.Connector) &&
+		(link.Subject == "" || t.allowsSubject(link.Subject)))
+}
+
+// linkStore holds subject links in memory (production should use a shared
+// database, so links survive restarts)
+type linkStore struct {
+	mu    sync.Mutex
+	links map[string]SubjectLink
+}
+
+func newLinkStore() *linkStore {
+	return &linkStore{links: make(map[string]SubjectLink)}
+}
+
+func (l *linkStore) Create(link SubjectLink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.links[link.ID] = link
+}
+
+// Get returns a link as it stands at now
+func (l *linkStore) Get(id string, now time.Time) (SubjectLink, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	link, ok := l.links[id]
+	if !ok {
+		return SubjectLink{}, ErrLinkNotFound
+	}
+	link.Status = link.statusAt(now)
+	return link, nil
+}
+
+// Update applies fn to a link atomically; fn's error aborts it
+func (l *linkStore) Update(id string, now time.Time, fn func(*SubjectLink) error) (SubjectLink, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	link, ok := l.links[id]
+	if !ok {
+		return SubjectLink{}, ErrLinkNotFound
+	}
+	link.Status = link.statusAt(now)
+	if err := fn(&link); err != nil {
+		return SubjectLink{}, err
+	}
+	l.links[id] = link
+	return link, nil
+}
+
+// Linked returns the live links of a partner's platform account, newest first
+func (l *linkStore) Linked(partner, connector, account string, now time.Time) []SubjectLink {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []SubjectLink{}
+	for _, link := range l.links {
+		if link.Partner == partner && link.Connector == connector && link.ExternalAccount == account &&
+			link.statusAt(now) == LinkStatusLinked {
+			out = append(out, link)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LinkedAt.After(*out[j].LinkedAt) })
+	return out
+}
+
+// Expire marks the links past their expiry and returns those that were linked
+func (l *linkStore) Expire(now time.Time) []SubjectLink {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expired []SubjectLink
+	for id, link := range l.links {
+		status := link.statusAt(now)
+		if status == link.Status {
+			continue
+		}
+		if link.Status == LinkStatusLinked {
+			expired = append(expired, link)
+		}
+		link.Status = status
+		l.links[id] = link
+	}
+	return expired
+}
+
+// linkRequestClaims are the payload of the request in a link's deep link.
+// The holder's wallet verifies it with the hub's JWKS, shows which partner
+// asks, and answers at the hub its issuer names.
+type linkRequestClaims struct {
+	jwt.RegisteredClaims
+	Nonce     string `json:"nonce"`
+	Connector string `json:"connector"`
+	Partner   string `json:"partner"`
+}
+
+// linkAnswerClaims are the payload of a holder's confirmation or unlink:
+// iss is the subject's DID, sub the link, aud the hub, and nonce the link
+// request's when confirming
+type linkAnswerClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// linkTokenClaims are the payload of the hub's confirmation of a link, for
+// the partner it names in aud
+type linkTokenClaims struct {
+	jwt.RegisteredClaims
+	Connector       string `json:"connector"`
+	ExternalAccount string `json:"external_account"`
+}
+
+// verifyHolderAnswer checks a JWS of type typ about sub, such as a link,
+// that the holder signed with a key their DID document lists for
+// assertions, named in kid, and returns the holder's DID
+func (s *Server) verifyHolderAnswer(ctx context.Context, signed, typ, sub string, claims jwt.Claims) (string, error) {
+	_, err := jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		if got, _ := token.Header["typ"].(string); got != typ {
+			return nil, fmt.Errorf("unexpected typ %q", got)
+		}
+		kid, _ := token.Header["kid"].(string)
+		did, _, _ := strings.Cut(kid, "#")
+		issuer, _ := token.Claims.GetIssuer()
+		if kid == "" || did != issuer {
+			return nil, errors.New("kid must be a key of the issuer's DID")
+		}
+		jwk, err := s.dids.ResolveKey(ctx, issuer, kid)
+		if err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	}, jwt.WithValidMethods(linkSigningMethods), jwt.WithAudience(hubIssuer), jwt.WithSubject(sub),
+		jwt.WithIssuedAt(), jwt.WithLeeway(linkClockSkew))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLinkSignature, err)
+	}
+	issuedAt, _ := claims.GetIssuedAt()
+	if issuedAt == nil || time.Now().Sub(issuedAt.Time) > linkChallengeTTL {
+		return "", fmt.Errorf("%w: iat is missing or too old", ErrLinkSignature)
+	}
+	return claims.GetIssuer()
+}
+
+// closeLink ends a link and revokes its connection
+func (s *Server) closeLink(ctx context.Context, link SubjectLink) {
+	if link.ConnectionID == "" {
+		return
+	}
+	_, err := s.connections.Update(ctx, hubScope, link.ConnectionID, func(conn *Connection) error {
+		conn.Status, conn.UpdatedAt = ConnectionStatusRevoked, time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Str("link_id", link.ID).Str("connection_id", link.ConnectionID).Msg("Failed to revoke a link's connection")
+	}
+}
+
+// expireLinks revokes the connections of links past their expiry
+func (s *Server) expireLinks(ctx context.Context, now time.Time) {
+	for _, link := range s.links.Expire(now) {
+		s.closeLink(ctx, link)
+		subjectLinks.Add("expired", 1)
+		log.Info().Str("link_id", link.ID).Str("connector", link.Connector).Str("partner", link.Partner).Msg("Subject link expired")
+	}
+}
+
+func (s *Server) runLinkSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		s.expireLinks(ctx, time.Now())
+		cancel()
+	}
+}
+
+// writeLinkError answers a failed call on a subject link
+func (s *Server) writeLinkError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrLinkNotFound):
+		http.Error(w, "Subject link not found", http.StatusNotFound)
+	case errors.Is(err, ErrLinkClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrLinkSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		s.writeTenantError(w, r, err)
+	}
+}
+
+// StartLinkRequest is the body of POST /connectors/{id}/links. Partner
+// defaults to the caller's; operators must name one.
+type StartLinkRequest struct {
+	ExternalAccount string `json:"externalAccount"`
+	Partner         string `json:"partner,omitempty"`
+}
+
+// StartLinkResponse is a pending link and the deep link the partner shows
+// its user, as a link or a QR code
+type StartLinkResponse struct {
+	Link     SubjectLink `json:"link"`
+	DeepLink string      `json:"deepLink"`
+}
+
+// handleStartLink starts linking a partner's platform account to whichever
+// Cachet subject confirms it from their wallet
+func (s *Server) handleStartLink(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	connector, err := s.connectors.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	var req StartLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.ExternalAccount) == "" {
+		http.Error(w, "externalAccount is required", http.StatusBadRequest)
+		return
+	}
+	partnerID := req.Partner
+	if partnerID == "" {
+		partnerID = scope.Partner
+	}
+	partner, err := s.partners.Get(r.Context(), partnerID)
+	if err != nil {
+		http.Error(w, "partner must name an onboarded partner", http.StatusBadRequest)
+		return
+	}
+	challenge, err := randomToken()
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	link := SubjectLink{
+		ID:              newID("lnk"),
+		Connector:       connector.Describe().ID,
+		Partner:         partner.ID,
+		ExternalAccount: req.ExternalAccount,
+		Status:          LinkStatusPending,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(linkChallengeTTL),
+		challenge:       challenge,
+	}
+	if !scope.coversLink(link) {
+		s.writeTenantError(w, r, fmt.Errorf("%w: link for %s on %s", ErrOutOfScope, link.Partner, link.Connector))
+		return
+	}
+	request, err := s.signer.SignTyped(linkRequestType, linkRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    hubIssuer,
+			Subject:   link.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+		},
+		Nonce:     challenge,
+		Connector: link.Connector,
+		Partner:   partner.Name,
+	})
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	s.links.Create(link)
+	subjectLinks.Add("started", 1)
+	log.Info().Str("link_id", link.ID).Str("connector", link.Connector).Str("partner", link.Partner).Msg("Subject link started")
+	w.Header().Set("Location", "/links/"+link.ID)
+	writeJSON(w, http.StatusCreated, StartLinkResponse{Link: link, DeepLink: linkDeepLinkScheme + "?request=" + url.QueryEscape(request)})
+}
+
+// ConfirmLinkRequest is the body of POST /links/{id}/confirm: a compact
+// JWS with typ cachet-link+jwt, a kid naming the holder's DID key, and
+// claims iss (the holder's DID), sub (the link), aud (the hub), nonce (the
+// link request's) and iat
+type ConfirmLinkRequest struct {
+	Confirmation string `json:"confirmation"`
+}
+
+// handleConfirmLink links the account to the holder who signed the link
+// request's challenge. The account's earlier link, if any, is replaced.
+func (s *Server) handleConfirmLink(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req ConfirmLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Confirmation == "" {
+		http.Error(w, "confirmation is required", http.StatusBadRequest)
+		return
+	}
+	var claims linkAnswerClaims
+	subject, err := s.verifyHolderAnswer(r.Context(), req.Confirmation, linkConfirmationType, id, &claims)
+	if err != nil {
+		log.Warn().Err(err).Str("link_id", id).Msg("Link confirmation failed verification")
+		s.writeLinkError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	var pending SubjectLink
+	link, err := s.links.Update(id, now, func(link *SubjectLink) error {
+		if link.Status != LinkStatusPending {
+			return fmt.Errorf("%w: the link is %s", ErrLinkClosed, link.Status)
+		}
+		if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(link.challenge)) != 1 {
+			return fmt.Errorf("%w: nonce does not match the link request", ErrLinkSignature)
+		}
+		pending = *link
+		link.Status, link.Subject, link.challenge = LinkStatusLinked, subject, ""
+		link.LinkedAt, link.ExpiresAt = &now, now.Add(s.linkTTL)
+		link.ConnectionID = newID("conn")
+		token, err := s.signer.SignTyped(linkTokenType, linkTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    hubIssuer,
+				Subject:   subject,
+				Audience:  jwt.ClaimStrings{link.Partner},
+				ID:        link.ID,
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+			},
+			Connector:       link.Connector,
+			ExternalAccount: link.ExternalAccount,
+		})
+		link.Confirmation = token
+		return err
+	})
+	if err != nil {
+		s.writeLinkError(w, r, err)
+		return
+	}
+	conn := Connection{
+		ID:              link.ConnectionID,
+		Connector:       link.Connector,
+		Partner:         link.Partner,
+		Subject:         link.Subject,
+		Status:          ConnectionStatusActive,
+		ExternalAccount: link.ExternalAccount,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := s.connections.Create(r.Context(), hubScope, conn); err != nil {
+		// Without its connection the link is not live: reopen it, so the
+		// holder can confirm again and the earlier link stays in place
+		if _, rollbackErr := s.links.Update(link.ID, now, func(link *SubjectLink) error {
+			*link = pending
+			return nil
+		}); rollbackErr != nil {
+			log.Error().Err(rollbackErr).Str("link_id", link.ID).Msg("Failed to reopen a link whose connection was not created")
+		}
+		writeHubError(w, err)
+		return
+	}
+	for _, earlier := range s.links.Linked(link.Partner, link.Connector, link.ExternalAccount, now) {
+		if earlier.ID == link.ID {
+			continue
+		}
+		if _, err := s.links.Update(earlier.ID, now, unlink(now)); err == nil {
+			s.closeLink(r.Context(), earlier)
+		}
+	}
+	subjectLinks.Add("linked", 1)
+	log.Info().Str("link_id", link.ID).Str("connector", link.Connector).Str("partner", link.Partner).Str("connection_id", conn.ID).Msg("Subject linked")
+	writeJSON(w, http.StatusOK, link)
+}
+
+// unlink ends a live link
+func unlink(now time.Time) func(*SubjectLink) error {
+	return func(link *SubjectLink) error {
+		if link.Status != LinkStatusLinked && link.Status != LinkStatusPending {
+			return fmt.Errorf("%w: the link is %s", ErrLinkClosed, link.Status)
+		}
+		link.Status, link.UnlinkedAt, link.challenge = LinkStatusUnlinked, &now, ""
+		return nil
+	}
+}
+
+// handleGetLink returns a link within the caller's scope
+func (s *Server) handleGetLink(w http.ResponseWriter, r *http.Request) {
+	link, err := s.links.Get(chi.URLParam(r, "id"), time.Now())
+	if err == nil && !scopeFromContext(r.Context()).coversLink(link) {
+		err = fmt.Errorf("%w: %w", ErrLinkNotFound, ErrOutOfScope)
+	}
+	if err != nil {
+		s.writeLinkError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, link)
+}
+
+// handleLookupLink finds the subject a partner's platform account is linked
+// to, for connectors mapping their users to Cachet subjects
+func (s *Server) handleLookupLink(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	connector := chi.URLParam(r, "id")
+	partner := r.URL.Query().Get("partner")
+	if partner == "" {
+		partner = scope.Partner
+	}
+	linked := s.links.Linked(partner, connector, chi.URLParam(r, "account"), time.Now())
+	if len(linked) == 0 {
+		http.Error(w, "The account is not linked", http.StatusNotFound)
+		return
+	}
+	if !scope.coversLink(linked[0]) {
+		s.writeLinkError(w, r, fmt.Errorf("%w: %w", ErrLinkNotFound, ErrOutOfScope))
+		return
+	}
+	writeJSON(w, http.StatusOK, linked[0])
+}
+
+// handleDeleteLink unlinks an account at the partner's request, revoking
+// the link's connection
+func (s *Server) handleDeleteLink(w http.ResponseWriter, r *http.Request) {
+	scope := scopeFromContext(r.Context())
+	now := time.Now().UTC()
+	link, err := s.links.Update(chi.URLParam(r, "id"), now, func(link *SubjectLink) error {
+		if !scope.coversLink(*link) {
+			return fmt.Errorf("%w: %w", ErrLinkNotFound, ErrOutOfScope)
+		}
+		return unlink(now)(link)
+	})
+	if err != nil {
+		s.writeLinkError(w, r, err)
+		return
+	}
+	s.closeLink(r.Context(), link)
+	subjectLinks.Add("unlinked", 1)
+	log.Info().Str("link_id", link.ID).Str("partner", link.Partner).Msg("Subject unlinked by the partner")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlinkRequest is the body of POST /links/{id}/unlink: a compact JWS with
+// typ cachet-unlink+jwt, signed as a confirmation is, without a nonce
+type UnlinkRequest struct {
+	Unlink string `json:"unlink"`
+}
+
+// handleHolderUnlink unlinks an account at the linked holder's request
+func (s *Server) handleHolderUnlink(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req UnlinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Unlink == "" {
+		http.Error(w, "unlink is required", http.StatusBadRequest)
+		return
+	}
+	var claims linkAnswerClaims
+	subject, err := s.verifyHolderAnswer(r.Context(), req.Unlink, linkUnlinkType, id, &claims)
+	if err != nil {
+		s.writeLinkError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	link, err := s.links.Update(id, now, func(link *SubjectLink) error {
+		if link.Status != LinkStatusLinked {
+			return fmt.Errorf("%w: the link is %s", ErrLinkClosed, link.Status)
+		}
+		if link.Subject != subject {
+			return fmt.Errorf("%w: only the linked holder may unlink", ErrLinkSignature)
+		}
+		return unlink(now)(link)
+	})
+	if err != nil {
+		s.writeLinkError(w, r, err)
+		return
+	}
+	s.closeLink(r.Context(), link)
+	subjectLinks.Add("unlinked", 1)
+	log.Info().Str("link_id", link.ID).Str("partner", link.Partner).Msg("Subject unlinked by the holder")
+	w.WriteHeader(http.StatusNoContent)
+}
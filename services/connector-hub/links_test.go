@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// walletHolder is a holder whose DID is a did:jwk of their wallet key
+type walletHolder struct {
+	key *ecdsa.PrivateKey
+	did string
+}
+
+func newWalletHolder(t *testing.T) walletHolder {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwk, err := json.Marshal(map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	require.NoError(t, err)
+	return walletHolder{key: key, did: "did:jwk:" + base64.RawURLEncoding.EncodeToString(jwk)}
+}
+
+// sign answers link with a JWS of type typ; edit adjusts the claims
+func (h walletHolder) sign(t *testing.T, typ, link, nonce string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	claims := jwt.MapClaims{"iss": h.did, "sub": link, "aud": hubIssuer, "iat": time.Now().Unix()}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = typ
+	token.Header["kid"] = h.did + "#0"
+	signed, err := token.SignedString(h.key)
+	require.NoError(t, err)
+	return signed
+}
+
+// startLink starts linking a market.fake account and returns the link and
+// the request the wallet reads from its deep link
+func startLink(t *testing.T, server *Server, account string, header map[string]string) (SubjectLink, linkRequestClaims) {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/links", StartLinkRequest{ExternalAccount: account}, header)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var resp StartLinkResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, LinkStatusPending, resp.Link.Status)
+
+	deepLink, err := url.Parse(resp.DeepLink)
+	require.NoError(t, err)
+	assert.Equal(t, "cachet://link", deepLink.Scheme+"://"+deepLink.Host)
+	var request linkRequestClaims
+	token, err := jwt.ParseWithClaims(deepLink.Query().Get("request"), &request, func(*jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, linkRequestType, token.Header["typ"])
+	assert.Equal(t, resp.Link.ID, request.Subject)
+	assert.Equal(t, "market.fake", request.Connector)
+	require.NotEmpty(t, request.Nonce)
+	return resp.Link, request
+}
+
+func confirmLink(t *testing.T, server *Server, link, confirmation string) *httptest.ResponseRecorder {
+	t.Helper()
+	return hubRequest(t, server, http.MethodPost, "/links/"+link+"/confirm", ConfirmLinkRequest{Confirmation: confirmation}, nil)
+}
+
+func TestSubjectLink_ConfirmAndLookUp(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	holder := newWalletHolder(t)
+
+	link, request := startLink(t, server, "seller-42", partner)
+	w := hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, partner)
+	assert.Equal(t, http.StatusNotFound, w.Code, "not linked until the holder confirms")
+
+	// Only the holder's signature over the request's nonce links the account
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, "another-nonce", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkUnlinkType, link.ID, request.Nonce, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, func(claims jwt.MapClaims) {
+		claims["aud"] = "did:web:elsewhere.example"
+	}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var linked SubjectLink
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&linked))
+	assert.Equal(t, LinkStatusLinked, linked.Status)
+	assert.Equal(t, holder.did, linked.Subject)
+	assert.WithinDuration(t, time.Now().Add(defaultLinkTTL), linked.ExpiresAt, time.Minute)
+
+	// The hub's signed confirmation names the partner, account and subject
+	var confirmation linkTokenClaims
+	token, err := jwt.ParseWithClaims(linked.Confirmation, &confirmation, func(*jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	}, jwt.WithAudience("market.fake"))
+	require.NoError(t, err)
+	assert.Equal(t, linkTokenType, token.Header["typ"])
+	assert.Equal(t, holder.did, confirmation.Subject)
+	assert.Equal(t, "seller-42", confirmation.ExternalAccount)
+
+	// Confirming twice does not relink
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	var found SubjectLink
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, link.ID, found.ID)
+	assert.Equal(t, holder.did, found.Subject)
+
+	// The link is a connection partners' webhooks and badges follow
+	conn, err := server.connections.Get(context.Background(), hubScope, found.ConnectionID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+	assert.Equal(t, "seller-42", conn.ExternalAccount)
+	assert.Equal(t, "market.fake", conn.Partner)
+}
+
+func TestSubjectLink_TenantScope(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.other"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	other := onboardPartner(t, server, "market.other", CreateKeyRequest{})
+	holder := newWalletHolder(t)
+
+	link, request := startLink(t, server, "seller-42", partner)
+	require.Equal(t, http.StatusOK, confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil)).Code)
+
+	w := hubRequest(t, server, http.MethodGet, "/links/"+link.ID, nil, other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = hubRequest(t, server, http.MethodDelete, "/links/"+link.ID, nil, other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/connectors/market.fake/links", StartLinkRequest{ExternalAccount: "seller-42", Partner: "market.fake"}, other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Operators name the partner
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42?partner=market.fake", nil, operatorHeader)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/connectors/market.fake/links", StartLinkRequest{ExternalAccount: "seller-43"}, operatorHeader)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSubjectLink_Unlink(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	holder, stranger := newWalletHolder(t), newWalletHolder(t)
+	link := func() SubjectLink {
+		link, request := startLink(t, server, "seller-42", partner)
+		w := confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+		return link
+	}
+	connection := func(id string) Connection {
+		conn, err := server.connections.Get(context.Background(), hubScope, id)
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Linking the account again replaces its earlier link
+	first := link()
+	second := link()
+	w := hubRequest(t, server, http.MethodGet, "/links/"+first.ID, nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"unlinked"`)
+	assert.Equal(t, ConnectionStatusRevoked, connection(first.ConnectionID).Status)
+
+	// The holder ends it from their wallet; nobody else can
+	unlink := func(signer walletHolder) int {
+		return hubRequest(t, server, http.MethodPost, "/links/"+second.ID+"/unlink", UnlinkRequest{Unlink: signer.sign(t, linkUnlinkType, second.ID, "", nil)}, nil).Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, unlink(stranger))
+	assert.Equal(t, http.StatusNoContent, unlink(holder))
+	assert.Equal(t, http.StatusConflict, unlink(holder))
+	assert.Equal(t, ConnectionStatusRevoked, connection(second.ConnectionID).Status)
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, partner)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// As does the partner
+	third := link()
+	w = hubRequest(t, server, http.MethodDelete, "/links/"+third.ID, nil, partner)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, ConnectionStatusRevoked, connection(third.ConnectionID).Status)
+}
+
+// failingConnections refuses to create connections while fail is set
+type failingConnections struct {
+	ConnectionStore
+	fail bool
+}
+
+func (f *failingConnections) Create(ctx context.Context, scope TenantScope, conn Connection) error {
+	if f.fail {
+		return errors.New("database unavailable")
+	}
+	return f.ConnectionStore.Create(ctx, scope, conn)
+}
+
+func TestSubjectLink_ConfirmWithoutConnection(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	connections := &failingConnections{ConnectionStore: server.connections}
+	server.connections = connections
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	holder := newWalletHolder(t)
+
+	first, request := startLink(t, server, "seller-42", partner)
+	w := confirmLink(t, server, first.ID, holder.sign(t, linkConfirmationType, first.ID, request.Nonce, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+
+	// A link whose connection is not created stays pending, and the
+	// account's earlier link stays in place
+	connections.fail = true
+	second, request := startLink(t, server, "seller-42", partner)
+	confirmation := holder.sign(t, linkConfirmationType, second.ID, request.Nonce, nil)
+	w = confirmLink(t, server, second.ID, confirmation)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w = hubRequest(t, server, http.MethodGet, "/links/"+second.ID, nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	var reopened SubjectLink
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&reopened))
+	assert.Equal(t, LinkStatusPending, reopened.Status)
+	assert.Empty(t, reopened.Subject)
+	assert.Empty(t, reopened.ConnectionID)
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, partner)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), first.ID)
+	conn, err := server.connections.Get(context.Background(), hubScope, first.ConnectionID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+
+	// The holder's confirmation goes through once the store recovers
+	connections.fail = false
+	w = confirmLink(t, server, second.ID, confirmation)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	conn, err = server.connections.Get(context.Background(), hubScope, first.ConnectionID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusRevoked, conn.Status)
+}
+
+func TestSubjectLink_Expiry(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	holder := newWalletHolder(t)
+	server.linkTTL = time.Hour
+
+	// An unconfirmed link expires with its challenge
+	stale, request := startLink(t, server, "seller-41", partner)
+	server.expireLinks(context.Background(), time.Now().Add(linkChallengeTTL))
+	w := confirmLink(t, server, stale.ID, holder.sign(t, linkConfirmationType, stale.ID, request.Nonce, nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), LinkStatusExpired), w.Body.String())
+
+	link, request := startLink(t, server, "seller-42", partner)
+	w = confirmLink(t, server, link.ID, holder.sign(t, linkConfirmationType, link.ID, request.Nonce, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+
+	server.expireLinks(context.Background(), time.Now().Add(time.Hour))
+	w = hubRequest(t, server, http.MethodGet, "/links/"+link.ID, nil, partner)
+	assert.Contains(t, w.Body.String(), `"status":"expired"`)
+	conn, err := server.connections.Get(context.Background(), hubScope, link.ConnectionID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusRevoked, conn.Status)
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/links/seller-42", nil, partner)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
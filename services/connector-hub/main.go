@@ -1,36 +1,140 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
-	"github.com/rs/zerolog/log"
+	"context"
 	"net/http"
 	"os"
-	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	r := chi.NewRouter()
-	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		if _, err := w.Write([]byte("ok")); err != nil {
-			log.Error().Err(err).Msg("Failed to write health check response")
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	// Configure structured logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if cfg.Development() {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+
+	exporting, err := tracing.Init(context.Background(), "connector-hub")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+
+	server := NewServer()
+	secrets, err := LoadSecretBox(cfg.Secrets)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load the connector secrets key")
+	}
+	server.secrets = secrets
+	if _, ok := secrets.kek.(*cloudKMS); ok {
+		server.health.Require("kms", secrets)
+	}
+	server.operatorToken = cfg.OperatorToken
+	server.linkTTL = cfg.LinkTTL
+	server.flagSuspend = cfg.FlagSuspend
+	server.openapi.ValidateResponses = cfg.Development()
+	server.cors.Set(cfg.CORS)
+	server.versions.Set(cfg.APIVersion)
+	auth, err := serviceauth.New("connector-hub", cfg.ServiceAuth)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
+	}
+	db, err := OpenDatabaseFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the database")
+	}
+	if db != nil {
+		server.health.Require("database", db)
+		server.partners = newPartnerRegistry(newPostgresPartnerStore(db.DB))
+		log.Info().Str("schema", db.Schema()).Msg("Keeping partners and their API keys in Postgres")
+	} else {
+		log.Warn().Msg("DATABASE_URL is unset, so partners and their API keys are kept in memory and lost on restart")
+	}
+	if server.security, err = audit.Open("connector-hub", cfg.SecurityAudit, auth, db); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the security audit trail")
+	}
+	if cfg.SecurityAudit.AnchorURL == "" {
+		log.Warn().Msg("SECURITY_AUDIT_ANCHOR_URL is unset, so security audit batches are sealed but not anchored")
+	}
+	if server.operatorToken == "" {
+		log.Warn().Msg("OPERATOR_API_TOKEN is unset; partner onboarding and webhook APIs are disabled")
+	}
+
+	subscribers, err := LoadEventSubscribers(cfg.EventSubscribers)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load event subscribers")
+	}
+	forwardClient := &http.Client{Timeout: forwardTimeout, Transport: tracing.Transport("event-subscriber", http.DefaultTransport)}
+	for _, sub := range subscribers {
+		server.bus.Subscribe(sub.Name, sub.Events, forwarder(forwardClient, sub))
+		log.Info().Str("subscriber", sub.Name).Strs("events", sub.Events).Msg("Event subscriber registered")
+	}
+
+	oauthConfig, err := LoadOAuthConfig(cfg.OAuthPlatforms)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load OAuth platforms")
+	}
+	if oauthConfig != nil {
+		server.oauth = newOAuthClient(oauthConfig, newMemoryTokenStore(), server.secrets)
+		log.Info().Int("platform_count", len(oauthConfig.Platforms)).Msg("OAuth account linking enabled")
+	}
+
+	bus, err := events.Open(cfg.Events)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the event bus")
+	}
+	server.cachetEvents = bus
+	if cfg.Marketplace.Enabled() {
+		connector := newMarketplaceConnector(cfg.Marketplace)
+		if bus != nil {
+			connector.viaEvents = true
+			if err := bus.Subscribe("connector-hub", []string{events.TypeVerificationCompleted}, connector.ConsumeVerification); err != nil {
+				log.Fatal().Err(err).Msg("Failed to subscribe to verification events")
+			}
 		}
-	})
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8090"
+		if err := server.connectors.Install(connector); err != nil {
+			log.Fatal().Err(err).Msg("Failed to install the marketplace connector")
+		}
+		log.Info().Str("connector", marketplaceConnectorID).Str("pack", cfg.Marketplace.Pack).Msg("Marketplace connector installed")
 	}
-	log.Info().Str("port", port).Msg("Starting connector-hub")
 
-	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	plugins, err := LoadPluginsConfig(cfg.Plugins)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load connector plugins")
+	}
+	if plugins != nil {
+		server.plugins = newPluginSupervisor(*plugins)
+		if err := server.plugins.Start(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start connector plugins")
+		}
+		for _, p := range server.plugins.plugins {
+			if err := server.connectors.Install(p); err != nil {
+				server.plugins.Stop()
+				log.Fatal().Err(err).Msg("Failed to install a connector plugin")
+			}
+		}
+		log.Info().Int("plugin_count", len(plugins.Plugins)).Msg("Connector plugins started")
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal().Err(err).Msg("Server failed to start")
+	log.Info().Int("port", cfg.Port).Msg("Starting connector-hub")
+	if err := server.Start(cfg.Addr()); err != nil {
+		if server.plugins != nil {
+			server.plugins.Stop()
+		}
+		log.Fatal().Err(err).Msg("Failed to start server")
 	}
 }
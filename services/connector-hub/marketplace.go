@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	marketplaceConnectorID = "marketplace.generic"
+	// MarketplaceSignatureHeader carries "sha256=<hex HMAC-SHA256 of the
+	// body>" on the marketplace's webhooks
+	MarketplaceSignatureHeader = "X-Marketplace-Signature"
+	defaultSafeSellerPack      = "pack.safe.seller"
+	// verifierCallbackTolerance bounds how old a signed verifier callback
+	// may be, so captured ones cannot be replayed later
+	verifierCallbackTolerance = 5 * time.Minute
+
+	marketplaceEventSellerOnboarded    = "seller.onboarded"
+	verifierEventVerificationCompleted = "verification.completed"
+	verifierOutcomeVerified            = "verified"
+)
+
+// Badge states pushed to the marketplace
+const (
+	MarketplaceBadgePending = "pending"
+	MarketplaceBadgeActive  = BadgeStatusActive
+	MarketplaceBadgeFailed  = "failed"
+)
+
+// MarketplaceConfig configures the reference marketplace connector, which
+// is installed when MARKETPLACE_API_URL is set
+type MarketplaceConfig struct {
+	MarketplaceURL        string `env:"MARKETPLACE_URL" doc:"Marketplace hosting the linking page sellers are sent to"`
+	APIURL                string `env:"MARKETPLACE_API_URL" doc:"Marketplace API badges are pushed to; the marketplace connector is installed only when set"`
+	APIToken              string `env:"MARKETPLACE_API_TOKEN" secret:"true" doc:"Bearer token for the marketplace API"`
+	WebhookSecret         string `env:"MARKETPLACE_WEBHOOK_SECRET" secret:"true" doc:"Secret the marketplace signs its webhooks with"`
+	Pack                  string `env:"MARKETPLACE_PACK" doc:"Pack marketplace sellers are verified against"`
+	VerifierURL           string `env:"VERIFIER_URL" doc:"Cachet verifier marketplace sellers are verified by"`
+	VerifierAPIKey        string `env:"VERIFIER_API_KEY" secret:"true" doc:"The hub's relying party API key at the verifier"`
+	VerifierWebhookSecret string `env:"VERIFIER_WEBHOOK_SECRET" secret:"true" doc:"Secret the verifier signs its callbacks to the hub with"`
+	HubURL                string `env:"HUB_PUBLIC_URL" doc:"Public URL the verifier reaches the hub's callbacks at"`
+}
+
+// Enabled reports whether the marketplace connector is installed
+func (c MarketplaceConfig) Enabled() bool {
+	return c.APIURL != ""
+}
+
+// Validate checks the URLs are https URLs and the secrets are set, when
+// the connector is installed
+func (c MarketplaceConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"MARKETPLACE_URL", c.MarketplaceURL},
+		{"MARKETPLACE_API_URL", c.APIURL},
+		{"VERIFIER_URL", c.VerifierURL},
+		{"HUB_PUBLIC_URL", c.HubURL},
+	} {
+		if u, err := url.Parse(setting.value); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s must be an absolute https URL", setting.name)
+		}
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"MARKETPLACE_API_TOKEN", c.APIToken},
+		{"MARKETPLACE_WEBHOOK_SECRET", c.WebhookSecret},
+		{"VERIFIER_API_KEY", c.VerifierAPIKey},
+		{"VERIFIER_WEBHOOK_SECRET", c.VerifierWebhookSecret},
+	} {
+		if setting.value == "" {
+			return fmt.Errorf("%s is required with MARKETPLACE_API_URL", setting.name)
+		}
+	}
+	return nil
+}
+
+// marketplaceSession ties a verifier session to the seller it verifies
+type marketplaceSession struct {
+	ConnectionID string
+	Seller       string
+}
+
+// marketplaceConnector is the reference "Safe Seller" connector for a
+// generic marketplace. It runs the whole loop:
+//
+//  1. the hub sends the seller to the marketplace's linking page, which
+//     posts a signed seller.onboarded webhook once the seller consents;
+//  2. the connector opens a verification session for the Safe Seller pack
+//     against the verifier and pushes it to the marketplace as pending;
+//  3. the verifier posts the signed outcome to the connector's callbacks,
+//     or publishes it on the event bus when the hub is on one;
+//  4. the connector pushes the resulting badge to the marketplace API.
+//
+// Both kinds of callbacks arrive at /connectors/marketplace.generic/callbacks
+// and are told apart by their signature header.
+type marketplaceConnector struct {
+	config    MarketplaceConfig
+	apiClient *http.Client
+	verifier  *http.Client
+	now       func() time.Time
+	// viaEvents takes outcomes from the event bus instead of asking the
+	// verifier for callbacks
+	viaEvents bool
+
+	// sessions maps open verifier sessions to sellers in memory
+	// (production should keep them in a shared store)
+	mu       sync.Mutex
+	sessions map[string]marketplaceSession
+}
+
+func newMarketplaceConnector(config MarketplaceConfig) *marketplaceConnector {
+	config.APIURL = strings.TrimSuffix(config.APIURL, "/")
+	config.VerifierURL = strings.TrimSuffix(config.VerifierURL, "/")
+	config.HubURL = strings.TrimSuffix(config.HubURL, "/")
+	return &marketplaceConnector{
+		config:    config,
+		apiClient: deadline.NewClient("marketplace"),
+		verifier:  deadline.NewClient("verifier"),
+		now:       time.Now,
+		sessions:  make(map[string]marketplaceSession),
+	}
+}
+
+func (m *marketplaceConnector) Describe() ConnectorInfo {
+	return ConnectorInfo{
+		ID:           marketplaceConnectorID,
+		Name:         "Generic Marketplace",
+		Description:  "Reference Safe Seller connector: verifies onboarding sellers and pushes their badge to the marketplace",
+		Platform:     "marketplace",
+		Capabilities: []string{CapabilityConnect, CapabilityEvents, CapabilityVerification},
+		Packs:        []string{m.config.Pack},
+	}
+}
+
+// Authorize sends the seller to the marketplace's linking page; the
+// connection is named in state and comes back in seller.onboarded
+func (m *marketplaceConnector) Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error) {
+	query := url.Values{"state": {conn.ID}}
+	if redirectURI != "" {
+		query.Set("redirect_uri", redirectURI)
+	}
+	return Authorization{URL: m.config.MarketplaceURL + "/cachet/link?" + query.Encode()}, nil
+}
+
+// SellerOnboarded is the marketplace's webhook once a seller finished
+// onboarding and consented to linking their account
+type SellerOnboarded struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	State  string `json:"state"` // the connection being linked
+	Seller struct {
+		ID string `json:"id"`
+	} `json:"seller"`
+}
+
+// verifierCallback is the verifier's verification.completed callback
+type verifierCallback struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Outcome struct {
+		SessionID string `json:"sessionId"`
+		Status    string `json:"status"`
+		Error     string `json:"error,omitempty"`
+		Result    *struct {
+			Satisfied bool `json:"satisfied"`
+			Badge     struct {
+				Label     string    `json:"label"`
+				ExpiresAt time.Time `json:"expiresAt"`
+				JWS       string    `json:"jws"`
+			} `json:"badge"`
+		} `json:"result,omitempty"`
+	} `json:"outcome"`
+}
+
+func (m *marketplaceConnector) HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error) {
+	if event.Header.Get(WebhookSignatureHeader) != "" {
+		return m.handleVerifierCallback(ctx, event)
+	}
+	if !validMarketplaceSignature([]byte(m.config.WebhookSecret), event.Body, event.Header.Get(MarketplaceSignatureHeader)) {
+		return EventResult{}, ErrEventSignature
+	}
+	var onboarded SellerOnboarded
+	if err := json.Unmarshal(event.Body, &onboarded); err != nil || onboarded.Type == "" {
+		return EventResult{}, ErrInvalidEvent
+	}
+	if onboarded.Type != marketplaceEventSellerOnboarded {
+		return EventResult{Type: onboarded.Type}, nil
+	}
+	if onboarded.State == "" || onboarded.Seller.ID == "" {
+		return EventResult{}, fmt.Errorf("%w: seller.onboarded needs state and seller.id", ErrInvalidEvent)
+	}
+	// Marketplaces retry webhooks until acknowledged, so a failure here is
+	// returned and the whole step is retried
+	if _, err := m.startVerification(ctx, onboarded.State, onboarded.Seller.ID); err != nil {
+		return EventResult{}, err
+	}
+	return EventResult{
+		Type:            onboarded.Type,
+		ConnectionID:    onboarded.State,
+		Status:          ConnectionStatusActive,
+		ExternalAccount: onboarded.Seller.ID,
+	}, nil
+}
+
+// RequestVerification verifies a linked seller again, e.g. once their
+// badge expired
+func (m *marketplaceConnector) RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error) {
+	if req.Pack != m.config.Pack {
+		return VerificationSession{}, fmt.Errorf("%w: pack %s", ErrUnsupported, req.Pack)
+	}
+	if conn.ExternalAccount == "" {
+		return VerificationSession{}, fmt.Errorf("%w: connection %s has no seller", ErrUnsupported, conn.ID)
+	}
+	return m.startVerification(ctx, conn.ID, conn.ExternalAccount)
+}
+
+// startVerification opens a verifier session whose outcome is called back
+// to the hub, or published on the event bus, and shows the seller as
+// pending on the marketplace
+func (m *marketplaceConnector) startVerification(ctx context.Context, connectionID, seller string) (VerificationSession, error) {
+	request := map[string]string{"policyId": m.config.Pack}
+	if !m.viaEvents {
+		request["callbackUrl"] = m.config.HubURL + "/connectors/" + marketplaceConnectorID + "/callbacks"
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return VerificationSession{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.config.VerifierURL+"/verification-sessions", bytes.NewReader(body))
+	if err != nil {
+		return VerificationSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", m.config.VerifierAPIKey)
+	req.Header.Set(apiversion.Header, "1")
+	resp, err := m.verifier.Do(req)
+	if err != nil {
+		return VerificationSession{}, fmt.Errorf("creating verification session: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return VerificationSession{}, fmt.Errorf("creating verification session: verifier answered %d", resp.StatusCode)
+	}
+	var created struct {
+		SessionID            string `json:"sessionId"`
+		AuthorizationRequest string `json:"authorizationRequest"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.SessionID == "" {
+		return VerificationSession{}, fmt.Errorf("creating verification session: unreadable response")
+	}
+
+	m.mu.Lock()
+	m.sessions[created.SessionID] = marketplaceSession{ConnectionID: connectionID, Seller: seller}
+	m.mu.Unlock()
+	session := VerificationSession{ID: created.SessionID, Pack: m.config.Pack, URL: created.AuthorizationRequest, Status: MarketplaceBadgePending}
+	if err := m.pushBadge(ctx, seller, MarketplaceBadge{
+		Badge:           m.config.Pack,
+		Status:          MarketplaceBadgePending,
+		VerificationURL: session.URL,
+	}); err != nil {
+		return VerificationSession{}, err
+	}
+	log.Info().Str("connection_id", connectionID).Str("session_id", session.ID).Msg("Seller verification started")
+	return session, nil
+}
+
+// handleVerifierCallback reads a verifier outcome and pushes the badge it
+// earned to the marketplace
+func (m *marketplaceConnector) handleVerifierCallback(ctx context.Context, event PlatformEvent) (EventResult, error) {
+	if err := verifyCachetSignature([]byte(m.config.VerifierWebhookSecret), event.Body, event.Header.Get(WebhookSignatureHeader), m.now()); err != nil {
+		return EventResult{}, err
+	}
+	var callback verifierCallback
+	if err := json.Unmarshal(event.Body, &callback); err != nil || callback.Outcome.SessionID == "" {
+		return EventResult{}, ErrInvalidEvent
+	}
+	if callback.Type != verifierEventVerificationCompleted {
+		return EventResult{Type: callback.Type}, nil
+	}
+	completed := events.VerificationCompleted{SessionID: callback.Outcome.SessionID, Status: callback.Outcome.Status}
+	if result := callback.Outcome.Result; result != nil {
+		completed.Satisfied = result.Satisfied
+		completed.Badge = &events.BadgeIssued{Label: result.Badge.Label, ExpiresAt: result.Badge.ExpiresAt, JWS: result.Badge.JWS}
+	}
+	// The verifier retries callbacks that fail, pushing the badge again
+	connectionID, err := m.completeVerification(ctx, completed)
+	if err != nil {
+		return EventResult{}, err
+	}
+	return EventResult{Type: callback.Type, ConnectionID: connectionID}, nil
+}
+
+// ConsumeVerification takes the outcomes of the connector's sessions from
+// the verifier's verification.completed events, when the hub is on the
+// event bus. Failures have the event delivered again, pushing the badge
+// again.
+func (m *marketplaceConnector) ConsumeVerification(ctx context.Context, event events.Event) error {
+	if event.Source != "verifier" {
+		return nil
+	}
+	var completed events.VerificationCompleted
+	if err := event.Decode(&completed); err != nil {
+		log.Error().Err(err).Msg("Dropping unreadable verification event")
+		return nil
+	}
+	if completed.PolicyID != m.config.Pack {
+		return nil
+	}
+	_, err := m.completeVerification(ctx, completed)
+	return err
+}
+
+// completeVerification pushes the badge a session earned to the
+// marketplace, and returns the session's connection. Outcomes of unknown
+// sessions are ignored.
+func (m *marketplaceConnector) completeVerification(ctx context.Context, completed events.VerificationCompleted) (string, error) {
+	m.mu.Lock()
+	session, ok := m.sessions[completed.SessionID]
+	m.mu.Unlock()
+	if !ok {
+		// Already handled, or started by another hub instance
+		log.Warn().Str("session_id", completed.SessionID).Msg("Verifier outcome for an unknown session")
+		return "", nil
+	}
+
+	badge := MarketplaceBadge{Badge: m.config.Pack, Status: MarketplaceBadgeFailed, SessionID: completed.SessionID}
+	if result := completed.Badge; completed.Status == verifierOutcomeVerified && result != nil && completed.Satisfied {
+		badge.Status, badge.Label, badge.Credential = MarketplaceBadgeActive, result.Label, result.JWS
+		if !result.ExpiresAt.IsZero() {
+			badge.ExpiresAt = &result.ExpiresAt
+		}
+	}
+	if err := m.pushBadge(ctx, session.Seller, badge); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	delete(m.sessions, completed.SessionID)
+	m.mu.Unlock()
+	log.Info().Str("connection_id", session.ConnectionID).Str("session_id", completed.SessionID).Str("status", badge.Status).Msg("Seller badge pushed to the marketplace")
+	return session.ConnectionID, nil
+}
+
+// MarketplaceBadge is PUT to the marketplace API at /sellers/{id}/cachet-badge
+type MarketplaceBadge struct {
+	Badge           string     `json:"badge"`
+	Status          string     `json:"status"` // pending, active or failed
+	Label           string     `json:"label,omitempty"`
+	VerificationURL string     `json:"verificationUrl,omitempty"` // while pending, where the seller presents their credentials
+	SessionID       string     `json:"sessionId,omitempty"`
+	Credential      string     `json:"credential,omitempty"` // the verifier's signed badge, for the marketplace to check
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+func (m *marketplaceConnector) pushBadge(ctx context.Context, seller string, badge MarketplaceBadge) error {
+	badge.UpdatedAt = m.now().UTC()
+	body, err := json.Marshal(badge)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, m.config.APIURL+"/sellers/"+url.PathEscape(seller)+"/cachet-badge", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.config.APIToken)
+	resp, err := m.apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushing badge to the marketplace: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushing badge to the marketplace: answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// validMarketplaceSignature checks "sha256=<hex HMAC-SHA256 of body>"
+func validMarketplaceSignature(secret, body []byte, header string) bool {
+	signature, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// verifyCachetSignature checks a Cachet-Signature header, as SignWebhook
+// makes them, and that it is recent
+func verifyCachetSignature(secret, body []byte, header string, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return ErrEventSignature
+	}
+	at := time.Unix(unix, 0)
+	if now.Sub(at) > verifierCallbackTolerance || at.Sub(now) > verifierCallbackTolerance {
+		return fmt.Errorf("%w: signed %s ago", ErrEventSignature, now.Sub(at).Round(time.Second))
+	}
+	if !hmac.Equal([]byte(SignWebhook(secret, body, at)), []byte("t="+timestamp+",v1="+signature)) {
+		return ErrEventSignature
+	}
+	return nil
+}
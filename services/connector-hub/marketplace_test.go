@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testMarketplaceSecret = "market-secret"
+	testVerifierSecret    = "whsec_verifier"
+)
+
+// fakeMarketplace plays the marketplace API, recording the badges pushed
+// to it, and the verifier's session API
+type fakeMarketplace struct {
+	mu       sync.Mutex
+	status   int
+	badges   map[string][]MarketplaceBadge // by seller
+	sessions []map[string]string
+}
+
+func (f *fakeMarketplace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/verifier/verification-sessions":
+		if r.Header.Get("X-API-Key") != "cvk_hub" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.sessions = append(f.sessions, req)
+		id := "sess-" + string(rune('0'+len(f.sessions)))
+		writeJSON(w, http.StatusCreated, map[string]string{"sessionId": id, "authorizationRequest": "openid4vp://?request_uri=" + id})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/api/sellers/"):
+		if r.Header.Get("Authorization") != "Bearer market-api-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if f.status != http.StatusOK {
+			w.WriteHeader(f.status)
+			return
+		}
+		seller := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/sellers/"), "/cachet-badge")
+		var badge MarketplaceBadge
+		_ = json.NewDecoder(r.Body).Decode(&badge)
+		f.badges[seller] = append(f.badges[seller], badge)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeMarketplace) lastBadge(t *testing.T, seller string) MarketplaceBadge {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.NotEmpty(t, f.badges[seller])
+	return f.badges[seller][len(f.badges[seller])-1]
+}
+
+func newMarketplaceTestServer(t *testing.T) (*Server, *marketplaceConnector, *fakeMarketplace) {
+	t.Helper()
+	fake := &fakeMarketplace{status: http.StatusOK, badges: map[string][]MarketplaceBadge{}}
+	ts := httptest.NewTLSServer(fake)
+	t.Cleanup(ts.Close)
+
+	connector := newMarketplaceConnector(MarketplaceConfig{
+		MarketplaceURL:        "https://market.example",
+		APIURL:                ts.URL + "/api",
+		APIToken:              "market-api-token",
+		WebhookSecret:         testMarketplaceSecret,
+		Pack:                  defaultSafeSellerPack,
+		VerifierURL:           ts.URL + "/verifier",
+		VerifierAPIKey:        "cvk_hub",
+		VerifierWebhookSecret: testVerifierSecret,
+		HubURL:                "https://hub.cachet.test",
+	})
+	connector.apiClient, connector.verifier = ts.Client(), ts.Client()
+	server := NewServer()
+	require.NoError(t, server.connectors.Install(connector))
+	return server, connector, fake
+}
+
+func marketplaceWebhook(t *testing.T, server *Server, body interface{}) int {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, []byte(testMarketplaceSecret))
+	mac.Write(raw)
+	header := map[string]string{MarketplaceSignatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil))}
+	return hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/callbacks", raw, header).Code
+}
+
+func verifierOutcome(t *testing.T, server *Server, sessionID, status string, at time.Time) int {
+	t.Helper()
+	outcome := map[string]interface{}{"sessionId": sessionID, "status": status}
+	if status == verifierOutcomeVerified {
+		outcome["result"] = map[string]interface{}{
+			"satisfied": true,
+			"badge":     map[string]interface{}{"label": "Verified Seller", "expiresAt": "2027-01-01T00:00:00Z", "jws": "eyJ.badge.sig"},
+		}
+	}
+	raw, err := json.Marshal(map[string]interface{}{"id": "cb-1", "type": "verification.completed", "outcome": outcome})
+	require.NoError(t, err)
+	header := map[string]string{WebhookSignatureHeader: SignWebhook([]byte(testVerifierSecret), raw, at)}
+	return hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/callbacks", raw, header).Code
+}
+
+func TestMarketplace_SafeSellerLoop(t *testing.T) {
+	server, _, fake := newMarketplaceTestServer(t)
+	partner := onboardPartner(t, server, "market.example", CreateKeyRequest{})
+
+	// The seller is sent to the marketplace to link their account
+	w := hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/connections", ConnectRequest{Subject: "did:key:z6MkSeller"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	consent, err := url.Parse(created.AuthorizationURL)
+	require.NoError(t, err)
+	assert.Equal(t, "market.example", consent.Host)
+	assert.Equal(t, created.Connection.ID, consent.Query().Get("state"))
+
+	// Onboarding links the account and starts verifying the seller
+	onboarded := map[string]interface{}{"type": "seller.onboarded", "id": "wh-1", "state": created.Connection.ID, "seller": map[string]string{"id": "seller-42"}}
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/callbacks", onboarded, nil).Code)
+	require.Equal(t, http.StatusAccepted, marketplaceWebhook(t, server, onboarded))
+	conn, err := server.connections.Get(context.Background(), hubScope, created.Connection.ID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+	assert.Equal(t, "seller-42", conn.ExternalAccount)
+
+	require.Len(t, fake.sessions, 1)
+	assert.Equal(t, defaultSafeSellerPack, fake.sessions[0]["policyId"])
+	assert.Equal(t, "https://hub.cachet.test/connectors/marketplace.generic/callbacks", fake.sessions[0]["callbackUrl"])
+	pending := fake.lastBadge(t, "seller-42")
+	assert.Equal(t, MarketplaceBadgePending, pending.Status)
+	assert.Equal(t, "openid4vp://?request_uri=sess-1", pending.VerificationURL)
+
+	// Stale or forged verifier callbacks are refused
+	now := time.Now()
+	assert.Equal(t, http.StatusUnauthorized, verifierOutcome(t, server, "sess-1", verifierOutcomeVerified, now.Add(-time.Hour)))
+
+	// The outcome is pushed to the marketplace as the seller's badge; a
+	// marketplace outage fails the callback so the verifier retries it
+	fake.mu.Lock()
+	fake.status = http.StatusServiceUnavailable
+	fake.mu.Unlock()
+	assert.Equal(t, http.StatusInternalServerError, verifierOutcome(t, server, "sess-1", verifierOutcomeVerified, now))
+	fake.mu.Lock()
+	fake.status = http.StatusOK
+	fake.mu.Unlock()
+	require.Equal(t, http.StatusAccepted, verifierOutcome(t, server, "sess-1", verifierOutcomeVerified, now))
+	badge := fake.lastBadge(t, "seller-42")
+	assert.Equal(t, MarketplaceBadgeActive, badge.Status)
+	assert.Equal(t, "Verified Seller", badge.Label)
+	assert.Equal(t, "eyJ.badge.sig", badge.Credential)
+	assert.Equal(t, "sess-1", badge.SessionID)
+	require.NotNil(t, badge.ExpiresAt)
+
+	// A redelivered outcome is acknowledged without pushing again
+	pushes := len(fake.badges["seller-42"])
+	require.Equal(t, http.StatusAccepted, verifierOutcome(t, server, "sess-1", verifierOutcomeVerified, now))
+	assert.Len(t, fake.badges["seller-42"], pushes)
+}
+
+func TestMarketplace_Reverification(t *testing.T) {
+	server, _, fake := newMarketplaceTestServer(t)
+	partner := onboardPartner(t, server, "market.example", CreateKeyRequest{})
+	w := hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/connections", ConnectRequest{Subject: "did:key:z6MkSeller"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, http.StatusAccepted, marketplaceWebhook(t, server, map[string]interface{}{"type": "seller.onboarded", "state": created.Connection.ID, "seller": map[string]string{"id": "seller-7"}}))
+
+	// Other marketplace events are acknowledged and ignored
+	assert.Equal(t, http.StatusAccepted, marketplaceWebhook(t, server, map[string]interface{}{"type": "seller.updated"}))
+	assert.Equal(t, http.StatusBadRequest, marketplaceWebhook(t, server, map[string]interface{}{"type": "seller.onboarded"}))
+
+	// Linked sellers can be verified again; failing removes the badge
+	path := "/connections/" + created.Connection.ID + "/verifications"
+	assert.Equal(t, http.StatusNotImplemented, hubRequest(t, server, http.MethodPost, path, VerificationRequest{Pack: "pack.other"}, partner).Code)
+	w = hubRequest(t, server, http.MethodPost, path, VerificationRequest{Pack: defaultSafeSellerPack}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "sess-2", session.ID)
+	assert.Equal(t, MarketplaceBadgePending, session.Status)
+
+	require.Equal(t, http.StatusAccepted, verifierOutcome(t, server, "sess-2", "failed", time.Now()))
+	badge := fake.lastBadge(t, "seller-7")
+	assert.Equal(t, MarketplaceBadgeFailed, badge.Status)
+	assert.Empty(t, badge.Credential)
+}
+
+func TestMarketplace_OutcomesFromEventBus(t *testing.T) {
+	server, connector, fake := newMarketplaceTestServer(t)
+	connector.viaEvents = true
+	bus := events.NewMemory()
+	require.NoError(t, bus.Subscribe("connector-hub", []string{events.TypeVerificationCompleted}, connector.ConsumeVerification))
+	partner := onboardPartner(t, server, "market.example", CreateKeyRequest{})
+	w := hubRequest(t, server, http.MethodPost, "/connectors/marketplace.generic/connections", ConnectRequest{Subject: "did:key:z6MkSeller"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created ConnectResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, http.StatusAccepted, marketplaceWebhook(t, server, map[string]interface{}{"type": "seller.onboarded", "state": created.Connection.ID, "seller": map[string]string{"id": "seller-9"}}))
+
+	// No callback is asked for; the outcome comes from the verifier's event
+	require.Len(t, fake.sessions, 1)
+	assert.NotContains(t, fake.sessions[0], "callbackUrl")
+	publish := func(source string, completed events.VerificationCompleted) {
+		event, err := events.New(source, completed.SessionID, completed, time.Now())
+		require.NoError(t, err)
+		require.NoError(t, bus.Publish(context.Background(), event))
+	}
+	expiresAt := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	verified := events.VerificationCompleted{
+		SessionID: "sess-1",
+		PolicyID:  defaultSafeSellerPack,
+		Status:    verifierOutcomeVerified,
+		Satisfied: true,
+		Badge:     &events.BadgeIssued{Label: "Verified Seller", ExpiresAt: expiresAt, JWS: "eyJ.badge.sig"},
+	}
+	// Events from other services or for other packs are ignored
+	publish("vouching-service", verified)
+	other := verified
+	other.PolicyID = "pack.other"
+	publish("verifier", other)
+	publish("verifier", verified)
+	require.NoError(t, bus.Close())
+
+	fake.mu.Lock()
+	pushes := len(fake.badges["seller-9"])
+	fake.mu.Unlock()
+	assert.Equal(t, 2, pushes)
+	badge := fake.lastBadge(t, "seller-9")
+	assert.Equal(t, MarketplaceBadgeActive, badge.Status)
+	assert.Equal(t, "eyJ.badge.sig", badge.Credential)
+	require.NotNil(t, badge.ExpiresAt)
+	assert.Equal(t, expiresAt, badge.ExpiresAt.UTC())
+}
+
+func TestMarketplaceConfig(t *testing.T) {
+	env := map[string]string{"ENVIRONMENT": "development"}
+	load := func() (Config, error) {
+		cfg := defaultConfig()
+		err := config.Loader{LookupEnv: func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}}.Load(context.Background(), &cfg)
+		return cfg, err
+	}
+	cfg, err := load()
+	require.NoError(t, err)
+	assert.False(t, cfg.Marketplace.Enabled())
+
+	for name, value := range map[string]string{
+		"MARKETPLACE_URL":            "https://market.example",
+		"MARKETPLACE_API_URL":        "https://api.market.example/v1/",
+		"MARKETPLACE_API_TOKEN":      "token",
+		"MARKETPLACE_WEBHOOK_SECRET": "secret",
+		"VERIFIER_URL":               "https://verifier.cachet.id",
+		"VERIFIER_API_KEY":           "cvk_hub",
+		"VERIFIER_WEBHOOK_SECRET":    "whsec_x",
+		"HUB_PUBLIC_URL":             "https://hub.cachet.id",
+	} {
+		env[name] = value
+	}
+	cfg, err = load()
+	require.NoError(t, err)
+	assert.True(t, cfg.Marketplace.Enabled())
+	assert.Equal(t, defaultSafeSellerPack, cfg.Marketplace.Pack)
+	assert.Equal(t, "https://api.market.example/v1", newMarketplaceConnector(cfg.Marketplace).config.APIURL)
+
+	env["VERIFIER_URL"] = "http://verifier.internal"
+	_, err = load()
+	assert.ErrorContains(t, err, "VERIFIER_URL")
+	env["VERIFIER_URL"] = "https://verifier.cachet.id"
+	env["MARKETPLACE_WEBHOOK_SECRET"] = ""
+	_, err = load()
+	assert.ErrorContains(t, err, "MARKETPLACE_WEBHOOK_SECRET")
+}
@@ -0,0 +1,17 @@
+-- Partners, the hub's tenants, and their API keys, kept only by the
+-- SHA-256 hashes of their secrets
+CREATE TABLE IF NOT EXISTS partners (
+	id         text        PRIMARY KEY,
+	created_at timestamptz NOT NULL,
+	document   jsonb       NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS partner_keys (
+	id           text        PRIMARY KEY,
+	partner      text        NOT NULL REFERENCES partners (id),
+	hash         text        NOT NULL UNIQUE,
+	created_at   timestamptz NOT NULL,
+	last_used_at timestamptz,
+	document     jsonb       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS partner_keys_partner_idx ON partner_keys (partner, created_at);
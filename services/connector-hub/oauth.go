@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// authorizationTTL bounds how long a user has to consent on the platform
+	authorizationTTL = 10 * time.Minute
+	// refreshAhead is how long before expiry tokens are refreshed
+	refreshAhead = 5 * time.Minute
+	// tokenRefreshInterval is how often expiring tokens are looked for
+	tokenRefreshInterval = time.Minute
+)
+
+var (
+	ErrPlatformNotFound = errors.New("no OAuth platform configured with that name")
+	// ErrGrantRevoked means the platform no longer honours a connection's
+	// refresh token: the user unlinked Cachet on the platform's side
+	ErrGrantRevoked = errors.New("platform grant revoked")
+)
+
+// OAuthConfig is the OAUTH_PLATFORMS_CONFIG file, e.g.
+//
+//	publicUrl: https://hub.cachet.id
+//	returnUrls: [https://wallet.cachet.id/]
+//	platforms:
+//	  - name: marketplace.generic
+//	    authorizeUrl: https://market.example/oauth/authorize
+//	    tokenUrl: https://market.example/oauth/token
+//	    clientId: cachet
+//	    clientSecretEnv: MARKETPLACE_CLIENT_SECRET
+//	    scopes: [profile, listings.read]
+//
+// Platforms redirect users back to {publicUrl}/connections/{name}/callback.
+// Client secrets are read from the environment, never from the file, and
+// may be sm:// references.
+type OAuthConfig struct {
+	PublicURL string `yaml:"publicUrl"`
+	// ReturnURLs are the prefixes users may be sent back to once linked
+	ReturnURLs []string        `yaml:"returnUrls"`
+	Platforms  []OAuthPlatform `yaml:"platforms"`
+}
+
+// OAuthPlatform is a platform users link their accounts from
+type OAuthPlatform struct {
+	Name            string   `yaml:"name"`
+	AuthorizeURL    string   `yaml:"authorizeUrl"`
+	TokenURL        string   `yaml:"tokenUrl"`
+	ClientID        string   `yaml:"clientId"`
+	ClientSecretEnv string   `yaml:"clientSecretEnv"`
+	Scopes          []string `yaml:"scopes"`
+	clientSecret    string
+}
+
+// LoadOAuthConfig reads the OAUTH_PLATFORMS_CONFIG file at path; nil means
+// no platform is linked over OAuth
+func LoadOAuthConfig(path string) (*OAuthConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := parseOAuthConfig(raw, config.Lookup)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return platforms, nil
+}
+
+func parseOAuthConfig(raw []byte, lookup func(string) (string, error)) (*OAuthConfig, error) {
+	var config OAuthConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if !isHTTPSURL(config.PublicURL) {
+		return nil, errors.New("publicUrl must be an https URL")
+	}
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+	for _, prefix := range config.ReturnURLs {
+		if !isHTTPSURL(prefix) {
+			return nil, fmt.Errorf("return URL %q must be an https URL", prefix)
+		}
+	}
+	if len(config.Platforms) == 0 {
+		return nil, errors.New("no platforms configured")
+	}
+	names := map[string]bool{}
+	for i := range config.Platforms {
+		platform := &config.Platforms[i]
+		if !connectorIDPattern.MatchString(platform.Name) || names[platform.Name] {
+			return nil, fmt.Errorf("platform %d: name %q is invalid or repeated", i, platform.Name)
+		}
+		names[platform.Name] = true
+		if !isHTTPSURL(platform.AuthorizeURL) || !isHTTPSURL(platform.TokenURL) {
+			return nil, fmt.Errorf("platform %s: authorizeUrl and tokenUrl must be https URLs", platform.Name)
+		}
+		if platform.ClientID == "" {
+			return nil, fmt.Errorf("platform %s: clientId is required", platform.Name)
+		}
+		if platform.ClientSecretEnv != "" {
+			secret, err := lookup(platform.ClientSecretEnv)
+			if err != nil {
+				return nil, fmt.Errorf("platform %s: %w", platform.Name, err)
+			}
+			if platform.clientSecret = secret; secret == "" {
+				return nil, fmt.Errorf("platform %s: %s is unset", platform.Name, platform.ClientSecretEnv)
+			}
+		}
+	}
+	return &config, nil
+}
+
+func isHTTPSURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// pendingAuthorization is an authorization request awaiting the platform's
+// redirect, keyed by its state
+type pendingAuthorization struct {
+	platform     string
+	connectionID string
+	verifier     string // PKCE code verifier
+	returnTo     string
+	expiresAt    time.Time
+}
+
+// oauthClient links platform accounts with the authorization code flow and
+// PKCE, and keeps the resulting tokens sealed and fresh
+type oauthClient struct {
+	config     *OAuthConfig
+	platforms  map[string]*OAuthPlatform
+	httpClient *http.Client
+	tokens     TokenStore
+	secrets    *secretBox
+	now        func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]pendingAuthorization // in memory: a restart only voids consents in flight
+}
+
+func newOAuthClient(config *OAuthConfig, tokens TokenStore, secrets *secretBox) *oauthClient {
+	platforms := make(map[string]*OAuthPlatform, len(config.Platforms))
+	for i := range config.Platforms {
+		platforms[config.Platforms[i].Name] = &config.Platforms[i]
+	}
+	return &oauthClient{
+		config:     config,
+		platforms:  platforms,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		tokens:     tokens,
+		secrets:    secrets,
+		now:        time.Now,
+		pending:    make(map[string]pendingAuthorization),
+	}
+}
+
+func (o *oauthClient) callbackURL(platform string) string {
+	return o.config.PublicURL + "/connections/" + platform + "/callback"
+}
+
+func (o *oauthClient) allowedReturn(returnTo string) bool {
+	if !isHTTPSURL(returnTo) {
+		return false
+	}
+	for _, prefix := range o.config.ReturnURLs {
+		if strings.HasPrefix(returnTo, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// begin records a pending authorization and returns the platform URL to
+// send the user to
+func (o *oauthClient) begin(platform *OAuthPlatform, connectionID, returnTo string) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	now := o.now()
+	o.mu.Lock()
+	for key, pending := range o.pending {
+		if now.After(pending.expiresAt) {
+			delete(o.pending, key)
+		}
+	}
+	o.pending[state] = pendingAuthorization{
+		platform:     platform.Name,
+		connectionID: connectionID,
+		verifier:     verifier,
+		returnTo:     returnTo,
+		expiresAt:    now.Add(authorizationTTL),
+	}
+	o.mu.Unlock()
+
+	u, err := url.Parse(platform.AuthorizeURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", platform.ClientID)
+	query.Set("redirect_uri", o.callbackURL(platform.Name))
+	query.Set("state", state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if len(platform.Scopes) > 0 {
+		query.Set("scope", strings.Join(platform.Scopes, " "))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// claim takes the pending authorization for state; each is usable once
+func (o *oauthClient) claim(platform, state string) (pendingAuthorization, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending, ok := o.pending[state]
+	if !ok || pending.platform != platform {
+		return pendingAuthorization{}, false
+	}
+	delete(o.pending, state)
+	return pending, o.now().Before(pending.expiresAt)
+}
+
+// tokenResponse is a token endpoint's answer (RFC 6749 section 5)
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+// requestToken calls the platform's token endpoint with client_secret_basic
+func (o *oauthClient) requestToken(ctx context.Context, platform *OAuthPlatform, form url.Values) (OAuthToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, platform.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(platform.ClientID), url.QueryEscape(platform.clientSecret))
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return OAuthToken{}, fmt.Errorf("%s token endpoint: %w", platform.Name, err)
+	}
+	defer resp.Body.Close()
+	var body tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return OAuthToken{}, fmt.Errorf("%s token endpoint: %w", platform.Name, err)
+	}
+	if body.Error == "invalid_grant" {
+		return OAuthToken{}, ErrGrantRevoked
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return OAuthToken{}, fmt.Errorf("%s token endpoint answered %d %s", platform.Name, resp.StatusCode, body.Error)
+	}
+	token := OAuthToken{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		TokenType:    body.TokenType,
+		Scope:        body.Scope,
+	}
+	if body.ExpiresIn > 0 {
+		token.ExpiresAt = o.now().UTC().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// exchange redeems an authorization code, proving possession of the PKCE
+// verifier, and stores the sealed tokens
+func (o *oauthClient) exchange(ctx context.Context, platform *OAuthPlatform, pending pendingAuthorization, code string) error {
+	token, err := o.requestToken(ctx, platform, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.callbackURL(platform.Name)},
+		"code_verifier": {pending.verifier},
+	})
+	if err != nil {
+		return err
+	}
+	return o.store(ctx, pending.connectionID, platform.Name, token)
+}
+
+func (o *oauthClient) store(ctx context.Context, connectionID, platform string, token OAuthToken) error {
+	sealed, err := sealToken(ctx, o.secrets, connectionID, platform, token, o.now().UTC())
+	if err != nil {
+		return err
+	}
+	return o.tokens.Put(ctx, sealed)
+}
+
+// refresh trades a connection's refresh token for a new access token. The
+// old refresh token is kept when the platform does not rotate it.
+func (o *oauthClient) refresh(ctx context.Context, sealed SealedToken) (OAuthToken, error) {
+	platform, ok := o.platforms[sealed.Platform]
+	if !ok {
+		return OAuthToken{}, fmt.Errorf("%w: %s", ErrPlatformNotFound, sealed.Platform)
+	}
+	current, err := openToken(ctx, o.secrets, sealed)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if current.RefreshToken == "" {
+		return OAuthToken{}, ErrGrantRevoked
+	}
+	token, err := o.requestToken(ctx, platform, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {current.RefreshToken},
+	})
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = current.RefreshToken
+	}
+	if err := o.store(ctx, sealed.ConnectionID, sealed.Platform, token); err != nil {
+		return OAuthToken{}, err
+	}
+	return token, nil
+}
+
+// AccessToken returns a usable access token for a connection, refreshing
+// it first when it is about to expire. Connectors call the platform's API
+// with it.
+func (o *oauthClient) AccessToken(ctx context.Context, connectionID string) (string, error) {
+	sealed, err := o.tokens.Get(ctx, connectionID)
+	if err != nil {
+		return "", err
+	}
+	if sealed.Refreshable && !sealed.ExpiresAt.IsZero() && o.now().Add(refreshAhead).After(sealed.ExpiresAt) {
+		token, err := o.refresh(ctx, sealed)
+		if err != nil {
+			return "", err
+		}
+		return token.AccessToken, nil
+	}
+	token, err := openToken(ctx, o.secrets, sealed)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// revokeConnection marks a connection revoked once the platform refuses its
+// grant, and forgets the tokens
+func (s *Server) revokeConnection(ctx context.Context, connectionID string) {
+	if err := s.oauth.tokens.Delete(ctx, connectionID); err != nil {
+		log.Error().Err(err).Str("connection_id", connectionID).Msg("Failed to delete platform token")
+	}
+	if _, err := s.connections.Update(ctx, hubScope, connectionID, func(conn *Connection) error {
+		conn.Status, conn.UpdatedAt = ConnectionStatusRevoked, s.oauth.now().UTC()
+		return nil
+	}); err != nil {
+		log.Error().Err(err).Str("connection_id", connectionID).Msg("Failed to revoke connection")
+	}
+}
+
+// refreshExpiringTokens refreshes every token expiring within refreshAhead,
+// so connectors rarely wait on a refresh. Connections whose grant the
+// platform revoked are revoked too.
+func (s *Server) refreshExpiringTokens(ctx context.Context) {
+	expiring, err := s.oauth.tokens.ExpiringBefore(ctx, s.oauth.now().Add(refreshAhead))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list expiring platform tokens")
+		return
+	}
+	for _, sealed := range expiring {
+		_, err := s.oauth.refresh(ctx, sealed)
+		switch {
+		case errors.Is(err, ErrGrantRevoked):
+			log.Info().Str("connection_id", sealed.ConnectionID).Str("platform", sealed.Platform).Msg("Platform grant revoked")
+			s.revokeConnection(ctx, sealed.ConnectionID)
+		case err != nil:
+			// Retried on the next pass, while the access token may still work
+			log.Warn().Err(err).Str("connection_id", sealed.ConnectionID).Msg("Platform token refresh failed")
+		default:
+			log.Debug().Str("connection_id", sealed.ConnectionID).Msg("Platform token refreshed")
+		}
+	}
+}
+
+func (s *Server) runTokenRefresher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.refreshExpiringTokens(context.Background())
+	}
+}
+
+// oauthPlatform resolves the platform a linking route names, answering 404
+// when OAuth is not configured for it. The path parameter is {id} since the
+// routes share their prefix with /connections/{id}.
+func (s *Server) oauthPlatform(w http.ResponseWriter, r *http.Request) (*OAuthPlatform, bool) {
+	if s.oauth == nil {
+		http.Error(w, "OAuth linking is not configured; set OAUTH_PLATFORMS_CONFIG", http.StatusNotFound)
+		return nil, false
+	}
+	platform, ok := s.oauth.platforms[chi.URLParam(r, "id")]
+	if !ok {
+		http.Error(w, "Platform not found", http.StatusNotFound)
+		return nil, false
+	}
+	return platform, true
+}
+
+// handleOAuthAuthorize starts linking a subject's platform account: it
+// opens a pending connection and redirects the user to the platform's
+// consent page, with a single-use state and a PKCE challenge
+func (s *Server) handleOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	platform, ok := s.oauthPlatform(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	subject := strings.TrimSpace(query.Get("subject"))
+	if subject == "" {
+		http.Error(w, "subject is required", http.StatusBadRequest)
+		return
+	}
+	returnTo := query.Get("return_to")
+	if returnTo != "" && !s.oauth.allowedReturn(returnTo) {
+		http.Error(w, "return_to is not an allowed return URL", http.StatusBadRequest)
+		return
+	}
+	// The partner sending the user here owns the connection
+	partner := query.Get("partner")
+	if partner != "" {
+		onboarded, err := s.partners.Get(r.Context(), partner)
+		if err != nil || !contains(onboarded.Connectors, platform.Name) {
+			http.Error(w, "partner is unknown or may not use "+platform.Name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := s.oauth.now().UTC()
+	conn := Connection{
+		ID:        newID("conn"),
+		Connector: platform.Name,
+		Partner:   partner,
+		Subject:   subject,
+		Status:    ConnectionStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.connections.Create(r.Context(), hubScope, conn); err != nil {
+		writeHubError(w, err)
+		return
+	}
+	location, err := s.oauth.begin(platform, conn.ID, returnTo)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	log.Info().Str("platform", platform.Name).Str("connection_id", conn.ID).Msg("Platform authorization started")
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// handleOAuthCallback completes linking when the platform redirects the
+// user back: the state must match a pending authorization, and the code is
+// redeemed with its PKCE verifier. The user is sent on to return_to with
+// the outcome, or shown the connection.
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	platform, ok := s.oauthPlatform(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	pending, ok := s.oauth.claim(platform.Name, query.Get("state"))
+	if !ok {
+		http.Error(w, "Unknown or expired authorization state", http.StatusBadRequest)
+		return
+	}
+
+	status := ConnectionStatusActive
+	var failure string
+	switch {
+	case query.Get("error") != "":
+		status, failure = ConnectionStatusFailed, query.Get("error")
+	case query.Get("code") == "":
+		status, failure = ConnectionStatusFailed, "invalid_request"
+	default:
+		if err := s.oauth.exchange(r.Context(), platform, pending, query.Get("code")); err != nil {
+			log.Warn().Err(err).Str("platform", platform.Name).Str("connection_id", pending.connectionID).Msg("Authorization code exchange failed")
+			status, failure = ConnectionStatusFailed, "token_exchange_failed"
+		}
+	}
+	conn, err := s.connections.Update(r.Context(), hubScope, pending.connectionID, func(conn *Connection) error {
+		conn.Status, conn.UpdatedAt = status, s.oauth.now().UTC()
+		return nil
+	})
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	log.Info().Str("platform", platform.Name).Str("connection_id", conn.ID).Str("status", conn.Status).Str("error", failure).Msg("Platform authorization completed")
+
+	if pending.returnTo == "" {
+		writeJSON(w, http.StatusOK, conn)
+		return
+	}
+	u, _ := url.Parse(pending.returnTo) // checked when the authorization began
+	back := u.Query()
+	back.Set("connection", conn.ID)
+	back.Set("status", conn.Status)
+	if failure != "" {
+		back.Set("error", failure)
+	}
+	u.RawQuery = back.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is a platform's authorization server: it issues codes bound
+// to a PKCE challenge and rotates tokens on refresh
+type fakeProvider struct {
+	mu         sync.Mutex
+	challenges map[string]string // code -> code_challenge
+	issued     int
+	revoked    bool
+}
+
+func newFakeProvider(t *testing.T) (*fakeProvider, *httptest.Server) {
+	provider := &fakeProvider{challenges: make(map[string]string)}
+	ts := httptest.NewTLSServer(http.HandlerFunc(provider.token))
+	t.Cleanup(ts.Close)
+	return provider, ts
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, secret, ok := r.BasicAuth(); !ok || id != "cachet" || secret != "client-secret" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		challenge, ok := p.challenges[r.PostFormValue("code")]
+		delete(p.challenges, r.PostFormValue("code"))
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+	case "refresh_token":
+		if p.revoked {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	p.issued++
+	body := map[string]interface{}{
+		"access_token": "access-" + string(rune('0'+p.issued)),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	if r.PostFormValue("grant_type") == "authorization_code" {
+		body["refresh_token"] = "refresh-secret"
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func newOAuthTestServer(t *testing.T) (*Server, *fakeProvider) {
+	t.Helper()
+	provider, ts := newFakeProvider(t)
+	config, err := parseOAuthConfig([]byte(`
+publicUrl: https://hub.cachet.test/
+returnUrls: [https://wallet.cachet.test/]
+platforms:
+  - name: marketplace.generic
+    authorizeUrl: https://market.example/oauth/authorize?prompt=consent
+    tokenUrl: `+ts.URL+`/token
+    clientId: cachet
+    clientSecretEnv: MARKETPLACE_CLIENT_SECRET
+    scopes: [profile, listings.read]
+`), func(name string) (string, error) {
+		if name == "MARKETPLACE_CLIENT_SECRET" {
+			return "client-secret", nil
+		}
+		return "", nil
+	})
+	require.NoError(t, err)
+	keyring, err := newLocalKeyring(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+
+	server := NewServer()
+	server.secrets = newSecretBox(keyring)
+	server.oauth = newOAuthClient(config, newMemoryTokenStore(), server.secrets)
+	server.oauth.httpClient = ts.Client()
+	return server, provider
+}
+
+// authorize starts linking and returns the platform's consent URL
+func authorize(t *testing.T, server *Server, provider *fakeProvider, query string) *url.URL {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/authorize?"+query, nil, nil)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	provider.mu.Lock()
+	provider.challenges["code-1"] = location.Query().Get("code_challenge")
+	provider.mu.Unlock()
+	return location
+}
+
+func TestOAuth_LinkAccount(t *testing.T) {
+	server, provider := newOAuthTestServer(t)
+
+	location := authorize(t, server, provider, "subject=did:key:z6MkSeller")
+	assert.Equal(t, "market.example", location.Host)
+	query := location.Query()
+	assert.Equal(t, "consent", query.Get("prompt"), "the platform's own parameters are kept")
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "cachet", query.Get("client_id"))
+	assert.Equal(t, "https://hub.cachet.test/connections/marketplace.generic/callback", query.Get("redirect_uri"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, "profile listings.read", query.Get("scope"))
+	state := query.Get("state")
+	require.NotEmpty(t, state)
+
+	w := hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+state, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var conn Connection
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&conn))
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+	assert.Equal(t, "did:key:z6MkSeller", conn.Subject)
+
+	// Tokens are sealed at rest
+	sealed, err := server.oauth.tokens.Get(context.Background(), conn.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed.Secret.Ciphertext), "refresh-secret")
+	assert.True(t, sealed.Refreshable)
+	token, err := server.oauth.AccessToken(context.Background(), conn.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+
+	// A sealed token is bound to its connection
+	sealed.ConnectionID = "conn_other"
+	_, err = openToken(context.Background(), server.oauth.secrets, sealed)
+	assert.Error(t, err)
+
+	// The state is single-use
+	w = hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+state, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOAuth_CallbackFailures(t *testing.T) {
+	server, provider := newOAuthTestServer(t)
+
+	// The user declines on the platform and is sent back to the wallet
+	location := authorize(t, server, provider, "subject=did:key:z6MkA&return_to="+url.QueryEscape("https://wallet.cachet.test/linked?tab=accounts"))
+	w := hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?error=access_denied&state="+location.Query().Get("state"), nil, nil)
+	require.Equal(t, http.StatusFound, w.Code)
+	back, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "wallet.cachet.test", back.Host)
+	assert.Equal(t, "accounts", back.Query().Get("tab"))
+	assert.Equal(t, ConnectionStatusFailed, back.Query().Get("status"))
+	assert.Equal(t, "access_denied", back.Query().Get("error"))
+	conn, err := server.connections.Get(context.Background(), hubScope, back.Query().Get("connection"))
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusFailed, conn.Status)
+
+	// A code redeemed without the matching verifier is refused by the platform
+	location = authorize(t, server, provider, "subject=did:key:z6MkA")
+	provider.mu.Lock()
+	provider.challenges["code-1"] = "not-the-challenge"
+	provider.mu.Unlock()
+	w = hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+location.Query().Get("state"), nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&conn))
+	assert.Equal(t, ConnectionStatusFailed, conn.Status)
+
+	// States expire
+	location = authorize(t, server, provider, "subject=did:key:z6MkA")
+	server.oauth.now = func() time.Time { return time.Now().Add(authorizationTTL + time.Minute) }
+	w = hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+location.Query().Get("state"), nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOAuth_AuthorizeValidation(t *testing.T) {
+	server, _ := newOAuthTestServer(t)
+
+	for name, tc := range map[string]struct {
+		path string
+		code int
+	}{
+		"unknown platform":  {"/connections/gig.other/authorize?subject=did:key:z6MkA", http.StatusNotFound},
+		"no subject":        {"/connections/marketplace.generic/authorize", http.StatusBadRequest},
+		"foreign return_to": {"/connections/marketplace.generic/authorize?subject=did:key:z6MkA&return_to=" + url.QueryEscape("https://evil.example/"), http.StatusBadRequest},
+		"plain-http return": {"/connections/marketplace.generic/authorize?subject=did:key:z6MkA&return_to=" + url.QueryEscape("http://wallet.cachet.test/"), http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := hubRequest(t, server, http.MethodGet, tc.path, nil, nil)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+
+	// Without OAUTH_PLATFORMS_CONFIG linking is off
+	w := hubRequest(t, NewServer(), http.MethodGet, "/connections/marketplace.generic/authorize?subject=did:key:z6MkA", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestOAuth_Refresh(t *testing.T) {
+	server, provider := newOAuthTestServer(t)
+	location := authorize(t, server, provider, "subject=did:key:z6MkA")
+	w := hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+location.Query().Get("state"), nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var conn Connection
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&conn))
+	ctx := context.Background()
+
+	// Near expiry the token is refreshed, keeping the unrotated refresh token
+	server.oauth.now = func() time.Time { return time.Now().Add(58 * time.Minute) }
+	token, err := server.oauth.AccessToken(ctx, conn.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "access-2", token)
+	sealed, err := server.oauth.tokens.Get(ctx, conn.ID)
+	require.NoError(t, err)
+	assert.True(t, sealed.Refreshable)
+
+	// The refresher picks up expiring tokens; a refused grant revokes the connection
+	server.oauth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	provider.mu.Lock()
+	provider.revoked = true
+	provider.mu.Unlock()
+	server.refreshExpiringTokens(ctx)
+	conn, err = server.connections.Get(ctx, hubScope, conn.ID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusRevoked, conn.Status)
+	_, err = server.oauth.tokens.Get(ctx, conn.ID)
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+}
+
+func TestParseOAuthConfig(t *testing.T) {
+	lookup := func(string) (string, error) { return "", nil }
+	for name, raw := range map[string]string{
+		"http public url": "publicUrl: http://hub\nplatforms: [{name: a, authorizeUrl: 'https://a/x', tokenUrl: 'https://a/t', clientId: c}]",
+		"no platforms":    "publicUrl: https://hub",
+		"http token url":  "publicUrl: https://hub\nplatforms: [{name: a, authorizeUrl: 'https://a/x', tokenUrl: 'http://a/t', clientId: c}]",
+		"repeated name":   "publicUrl: https://hub\nplatforms: [{name: a, authorizeUrl: 'https://a/x', tokenUrl: 'https://a/t', clientId: c}, {name: a, authorizeUrl: 'https://a/x', tokenUrl: 'https://a/t', clientId: c}]",
+		"unset secret":    "publicUrl: https://hub\nplatforms: [{name: a, authorizeUrl: 'https://a/x', tokenUrl: 'https://a/t', clientId: c, clientSecretEnv: A_SECRET}]",
+		"bad return url":  "publicUrl: https://hub\nreturnUrls: ['javascript:alert(1)']\nplatforms: [{name: a, authorizeUrl: 'https://a/x', tokenUrl: 'https://a/t', clientId: c}]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseOAuthConfig([]byte(raw), lookup)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+)
+
+// postgresPartnerStore keeps partners and their hashed API keys in
+// Postgres, so every replica authenticates the same keys
+type postgresPartnerStore struct {
+	db *sql.DB
+}
+
+func newPostgresPartnerStore(db *sql.DB) *postgresPartnerStore {
+	return &postgresPartnerStore{db: db}
+}
+
+func (p *postgresPartnerStore) CreatePartner(ctx context.Context, partner Partner) error {
+	document, err := json.Marshal(partner)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, `INSERT INTO partners (id, created_at, document) VALUES ($1, $2, $3)`, partner.ID, partner.CreatedAt, document)
+	if store.IsUniqueViolation(err) {
+		return ErrPartnerExists
+	}
+	return err
+}
+
+func (p *postgresPartnerStore) GetPartner(ctx context.Context, id string) (Partner, error) {
+	var partner Partner
+	err := scanDocument(p.db.QueryRowContext(ctx, `SELECT document FROM partners WHERE id = $1`, id), &partner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Partner{}, ErrPartnerNotFound
+	}
+	return partner, err
+}
+
+func (p *postgresPartnerStore) ListPartners(ctx context.Context) ([]Partner, error) {
+	return queryDocuments[Partner](ctx, p.db, `SELECT document FROM partners ORDER BY id`)
+}
+
+// CreateKey inserts the key only while its partner exists, in one
+// statement
+func (p *postgresPartnerStore) CreateKey(ctx context.Context, key PartnerKey, hash string) error {
+	document, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	result, err := p.db.ExecContext(ctx,
+		`INSERT INTO partner_keys (id, partner, hash, created_at, document)
+		 SELECT $1, id, $3, $4, $5 FROM partners WHERE id = $2`,
+		key.ID, key.Partner, hash, key.CreatedAt, document)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrPartnerNotFound
+	}
+	return nil
+}
+
+func (p *postgresPartnerStore) Keys(ctx context.Context, partner string) ([]PartnerKey, error) {
+	keys, err := queryKeys(ctx, p.db, `SELECT document, last_used_at FROM partner_keys WHERE partner = $1 ORDER BY created_at, id`, partner)
+	if keys == nil && err == nil {
+		keys = []PartnerKey{}
+	}
+	return keys, err
+}
+
+func (p *postgresPartnerStore) RevokeKey(ctx context.Context, partner, id string) error {
+	result, err := p.db.ExecContext(ctx, `DELETE FROM partner_keys WHERE id = $1 AND partner = $2`, id, partner)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrPartnerKeyNotFound
+	}
+	return nil
+}
+
+func (p *postgresPartnerStore) UseKey(ctx context.Context, hash string, at time.Time) (PartnerKey, error) {
+	keys, err := queryKeys(ctx, p.db, `UPDATE partner_keys SET last_used_at = $2 WHERE hash = $1 RETURNING document, last_used_at`, hash, at.UTC())
+	if err != nil {
+		return PartnerKey{}, err
+	}
+	if len(keys) == 0 {
+		return PartnerKey{}, ErrPartnerKeyNotFound
+	}
+	return keys[0], nil
+}
+
+// queryKeys decodes the keys of query, whose rows are a key's document and
+// when it was last used, kept apart as it changes on every call
+func queryKeys(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]PartnerKey, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []PartnerKey
+	for rows.Next() {
+		var document []byte
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&document, &lastUsed); err != nil {
+			return nil, err
+		}
+		var key PartnerKey
+		if err := json.Unmarshal(document, &key); err != nil {
+			return nil, fmt.Errorf("decoding partner key: %w", err)
+		}
+		if lastUsed.Valid {
+			used := lastUsed.Time.UTC()
+			key.LastUsedAt = &used
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func queryDocuments[T any](ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]T, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []T{}
+	for rows.Next() {
+		var entry T
+		if err := scanDocument(rows, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDocument(row rowScanner, v interface{}) error {
+	var document []byte
+	if err := row.Scan(&document); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(document, v); err != nil {
+		return fmt.Errorf("decoding %T: %w", v, err)
+	}
+	return nil
+}
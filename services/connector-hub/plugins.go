@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/connector-hub/pluginsdk"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPluginUnavailable means a plugin connector's process is down and
+// being restarted
+var ErrPluginUnavailable = errors.New("connector plugin unavailable")
+
+const (
+	defaultPluginHealthInterval = 10 * time.Second
+	pluginStartTimeout          = 30 * time.Second
+	pluginMinBackoff            = time.Second
+	pluginMaxBackoff            = time.Minute
+)
+
+// PluginConfig is an out-of-tree connector from the CONNECTOR_PLUGINS_CONFIG
+// file, e.g.
+//
+//	healthInterval: 10s
+//	plugins:
+//	  - id: gig.acme
+//	    command: /opt/cachet/plugins/acme-connector
+//	    args: [--region, eu]
+//	    env: [ACME_API_TOKEN]
+//	    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//
+// The id must match what the plugin describes itself as. Plugins only get
+// the hub's environment variables named in env, sm:// references resolved;
+// sha256, when set, pins the binary.
+type PluginConfig struct {
+	ID      string   `yaml:"id"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Env     []string `yaml:"env"`
+	SHA256  string   `yaml:"sha256"`
+}
+
+// PluginsConfig is the CONNECTOR_PLUGINS_CONFIG file
+type PluginsConfig struct {
+	// HealthInterval is how often plugins are pinged; a plugin that fails a
+	// ping or exits is restarted
+	HealthInterval time.Duration  `yaml:"healthInterval"`
+	Plugins        []PluginConfig `yaml:"plugins"`
+}
+
+// LoadPluginsConfig reads the CONNECTOR_PLUGINS_CONFIG file at path;
+// without one no plugins are started
+func LoadPluginsConfig(path string) (*PluginsConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := parsePluginsConfig(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plugins, nil
+}
+
+func parsePluginsConfig(raw []byte) (*PluginsConfig, error) {
+	var config PluginsConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if config.HealthInterval == 0 {
+		config.HealthInterval = defaultPluginHealthInterval
+	}
+	if config.HealthInterval < time.Second {
+		return nil, errors.New("healthInterval must be at least 1s")
+	}
+	ids := map[string]bool{}
+	for i, p := range config.Plugins {
+		if !connectorIDPattern.MatchString(p.ID) || ids[p.ID] {
+			return nil, fmt.Errorf("plugin %d: id %q is invalid or repeated", i, p.ID)
+		}
+		ids[p.ID] = true
+		if p.Command == "" {
+			return nil, fmt.Errorf("plugin %s: command is required", p.ID)
+		}
+		if p.SHA256 != "" {
+			if sum, err := hex.DecodeString(p.SHA256); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("plugin %s: sha256 must be a hex SHA-256 digest", p.ID)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// PluginStatus is a plugin connector's process state, for operators
+type PluginStatus struct {
+	ID        string     `json:"id"`
+	Command   string     `json:"command"`
+	Healthy   bool       `json:"healthy"`
+	PID       int        `json:"pid,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Restarts  int        `json:"restarts"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// pluginConnector is a Connector served by an external plugin process. It
+// answers ErrPluginUnavailable while the process is down.
+type pluginConnector struct {
+	config PluginConfig
+
+	mu      sync.RWMutex
+	client  *plugin.Client
+	impl    pluginsdk.Connector
+	info    ConnectorInfo // as last described, so it outlives a crash
+	status  PluginStatus
+	backoff time.Duration
+}
+
+func newPluginConnector(config PluginConfig) *pluginConnector {
+	return &pluginConnector{
+		config:  config,
+		info:    ConnectorInfo{ID: config.ID},
+		status:  PluginStatus{ID: config.ID, Command: config.Command},
+		backoff: pluginMinBackoff,
+	}
+}
+
+// start launches the plugin process and checks it describes itself as the
+// configured connector
+func (p *pluginConnector) start() error {
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	for _, name := range p.config.Env {
+		value, err := config.Lookup(name)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", p.config.ID, err)
+		}
+		if value != "" {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	clientConfig := &plugin.ClientConfig{
+		HandshakeConfig:  pluginsdk.Handshake,
+		Plugins:          pluginsdk.PluginMap,
+		Cmd:              cmd,
+		SkipHostEnv:      true,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolNetRPC},
+		StartTimeout:     pluginStartTimeout,
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:       "plugin." + p.config.ID,
+			Level:      hclog.Warn,
+			Output:     os.Stderr,
+			JSONFormat: true,
+		}),
+	}
+	if p.config.SHA256 != "" {
+		sum, _ := hex.DecodeString(p.config.SHA256) // checked when loaded
+		clientConfig.SecureConfig = &plugin.SecureConfig{Checksum: sum, Hash: sha256.New()}
+	}
+	client := plugin.NewClient(clientConfig)
+
+	impl, err := dispenseConnector(client)
+	if err == nil {
+		if info := impl.Describe(); info.ID != p.config.ID {
+			err = fmt.Errorf("plugin describes itself as %q, configured as %q", info.ID, p.config.ID)
+		} else {
+			p.mu.Lock()
+			p.info = ConnectorInfo(info)
+			p.mu.Unlock()
+		}
+	}
+	if err != nil {
+		client.Kill()
+		p.fail(err)
+		return err
+	}
+
+	started := time.Now().UTC()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client, p.impl = client, impl
+	p.status.Healthy, p.status.StartedAt, p.status.LastError = true, &started, ""
+	if reattach := client.ReattachConfig(); reattach != nil {
+		p.status.PID = reattach.Pid
+	}
+	p.backoff = pluginMinBackoff
+	return nil
+}
+
+func dispenseConnector(client *plugin.Client) (pluginsdk.Connector, error) {
+	protocol, err := client.Client()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := protocol.Dispense(pluginsdk.PluginName)
+	if err != nil {
+		return nil, err
+	}
+	impl, ok := raw.(pluginsdk.Connector)
+	if !ok {
+		return nil, errors.New("plugin does not serve a connector")
+	}
+	return impl, nil
+}
+
+// fail marks the plugin down and stops its process, if any
+func (p *pluginConnector) fail(err error) {
+	p.mu.Lock()
+	client := p.client
+	p.client, p.impl = nil, nil
+	p.status.Healthy, p.status.PID, p.status.LastError = false, 0, err.Error()
+	p.mu.Unlock()
+	if client != nil {
+		client.Kill()
+	}
+}
+
+// check pings the plugin process
+func (p *pluginConnector) check() error {
+	p.mu.RLock()
+	client := p.client
+	p.mu.RUnlock()
+	if client == nil {
+		return errors.New("plugin is not running")
+	}
+	if client.Exited() {
+		return errors.New("plugin process exited")
+	}
+	protocol, err := client.Client()
+	if err != nil {
+		return err
+	}
+	return protocol.Ping()
+}
+
+// supervise checks the plugin every interval until stop closes, restarting
+// it with exponential backoff when it fails
+func (p *pluginConnector) supervise(interval time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			p.Stop()
+			return
+		case <-timer.C:
+		}
+		next := interval
+		if err := p.check(); err != nil {
+			if p.Status().Healthy {
+				log.Warn().Err(err).Str("connector", p.config.ID).Msg("Connector plugin failed its health check; restarting")
+				p.fail(err)
+			}
+			if err := p.start(); err != nil {
+				log.Error().Err(err).Str("connector", p.config.ID).Msg("Failed to restart connector plugin")
+				p.mu.Lock()
+				next = p.backoff
+				p.backoff = min(2*p.backoff, pluginMaxBackoff)
+				p.mu.Unlock()
+			} else {
+				p.mu.Lock()
+				p.status.Restarts++
+				p.mu.Unlock()
+				log.Info().Str("connector", p.config.ID).Msg("Connector plugin restarted")
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// Stop kills the plugin process
+func (p *pluginConnector) Stop() {
+	p.mu.Lock()
+	client := p.client
+	p.client, p.impl = nil, nil
+	p.status.Healthy, p.status.PID = false, 0
+	p.mu.Unlock()
+	if client != nil {
+		client.Kill()
+	}
+}
+
+func (p *pluginConnector) Status() PluginStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.status
+}
+
+func (p *pluginConnector) connector() (pluginsdk.Connector, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.impl == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPluginUnavailable, p.config.ID)
+	}
+	return p.impl, nil
+}
+
+func (p *pluginConnector) Describe() ConnectorInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.info
+}
+
+func (p *pluginConnector) Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error) {
+	impl, err := p.connector()
+	if err != nil {
+		return Authorization{}, err
+	}
+	authorization, err := impl.Authorize(ctx, pluginsdk.Connection(conn), redirectURI)
+	return Authorization(authorization), err
+}
+
+func (p *pluginConnector) HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error) {
+	impl, err := p.connector()
+	if err != nil {
+		return EventResult{}, err
+	}
+	result, err := impl.HandleEvent(ctx, pluginsdk.PlatformEvent(event))
+	return EventResult(result), err
+}
+
+func (p *pluginConnector) RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error) {
+	impl, err := p.connector()
+	if err != nil {
+		return VerificationSession{}, err
+	}
+	session, err := impl.RequestVerification(ctx, pluginsdk.Connection(conn), pluginsdk.VerificationRequest(req))
+	return VerificationSession(session), err
+}
+
+// pluginSupervisor runs the plugin connectors' processes
+type pluginSupervisor struct {
+	interval time.Duration
+	plugins  []*pluginConnector
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newPluginSupervisor(config PluginsConfig) *pluginSupervisor {
+	s := &pluginSupervisor{interval: config.HealthInterval, stop: make(chan struct{})}
+	for _, p := range config.Plugins {
+		s.plugins = append(s.plugins, newPluginConnector(p))
+	}
+	return s
+}
+
+// Start launches every plugin and supervises them; a plugin that cannot
+// start at all is a configuration error, so the others are stopped
+func (s *pluginSupervisor) Start() error {
+	for i, p := range s.plugins {
+		if err := p.start(); err != nil {
+			for _, started := range s.plugins[:i] {
+				started.Stop()
+			}
+			return fmt.Errorf("plugin %s: %w", p.config.ID, err)
+		}
+	}
+	for _, p := range s.plugins {
+		s.wg.Add(1)
+		go func(p *pluginConnector) {
+			defer s.wg.Done()
+			p.supervise(s.interval, s.stop)
+		}(p)
+	}
+	return nil
+}
+
+// Stop ends supervision and kills the plugin processes
+func (s *pluginSupervisor) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Status lists the plugins' process states, by id
+func (s *pluginSupervisor) Status() []PluginStatus {
+	statuses := make([]PluginStatus, 0, len(s.plugins))
+	for _, p := range s.plugins {
+		statuses = append(statuses, p.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+func (s *Server) handleListPlugins(w http.ResponseWriter, r *http.Request) {
+	statuses := []PluginStatus{}
+	if s.plugins != nil {
+		statuses = s.plugins.Status()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"plugins": statuses})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/connector-hub/pluginsdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPluginEnv makes the test binary serve testPlugin instead of running
+// the tests, so it can stand in for a partner's plugin binary
+const testPluginEnv = "CACHET_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if id := os.Getenv(testPluginEnv); id != "" {
+		pluginsdk.Serve(testPlugin{id: id})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testPlugin is an out-of-tree connector: it links accounts after consent
+// and takes callbacks signed "ok"; a "crash" callback kills it
+type testPlugin struct {
+	id string
+}
+
+func (p testPlugin) Describe() pluginsdk.ConnectorInfo {
+	return pluginsdk.ConnectorInfo{ID: p.id, Name: "Acme Gigs", Platform: "gig", Capabilities: []string{CapabilityConnect, CapabilityEvents}}
+}
+
+func (p testPlugin) Authorize(ctx context.Context, conn pluginsdk.Connection, redirectURI string) (pluginsdk.Authorization, error) {
+	return pluginsdk.Authorization{URL: "https://gigs.example/consent?state=" + conn.ID + "&partner=" + conn.Partner}, nil
+}
+
+func (p testPlugin) HandleEvent(ctx context.Context, event pluginsdk.PlatformEvent) (pluginsdk.EventResult, error) {
+	if event.Header.Get("X-Acme-Signature") != "ok" {
+		return pluginsdk.EventResult{}, pluginsdk.ErrEventSignature
+	}
+	var body struct {
+		Type  string `json:"type"`
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(event.Body, &body); err != nil {
+		return pluginsdk.EventResult{}, fmt.Errorf("%w: %v", pluginsdk.ErrInvalidEvent, err)
+	}
+	if body.Type == "crash" {
+		os.Exit(1)
+	}
+	return pluginsdk.EventResult{Type: body.Type, ConnectionID: body.State, Status: ConnectionStatusActive, ExternalAccount: "worker-9"}, nil
+}
+
+func (p testPlugin) RequestVerification(ctx context.Context, conn pluginsdk.Connection, req pluginsdk.VerificationRequest) (pluginsdk.VerificationSession, error) {
+	return pluginsdk.VerificationSession{}, pluginsdk.ErrUnsupported
+}
+
+func newPluginTestServer(t *testing.T, id string) (*Server, *pluginSupervisor) {
+	t.Helper()
+	t.Setenv(testPluginEnv, id)
+	supervisor := newPluginSupervisor(PluginsConfig{
+		HealthInterval: 50 * time.Millisecond,
+		Plugins:        []PluginConfig{{ID: "gig.acme", Command: os.Args[0], Env: []string{testPluginEnv}}},
+	})
+	server := NewServer()
+	server.plugins = supervisor
+	return server, supervisor
+}
+
+func pluginCallback(t *testing.T, server *Server, body map[string]string) int {
+	t.Helper()
+	return hubRequest(t, server, http.MethodPost, "/connectors/gig.acme/callbacks", body, map[string]string{"X-Acme-Signature": "ok"}).Code
+}
+
+func TestPlugins_ServeAndRestart(t *testing.T) {
+	server, supervisor := newPluginTestServer(t, "gig.acme")
+	require.NoError(t, supervisor.Start())
+	t.Cleanup(supervisor.Stop)
+	for _, p := range supervisor.plugins {
+		require.NoError(t, server.connectors.Install(p))
+	}
+	partner := onboardPartner(t, server, "gigs.example", CreateKeyRequest{})
+
+	// The plugin's description and calls reach it through the hub
+	w := hubRequest(t, server, http.MethodGet, "/connectors/gig.acme", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var info ConnectorInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "Acme Gigs", info.Name)
+
+	created := connect(t, server, "gig.acme", ConnectRequest{Subject: "did:key:z6MkWorker"}, partner)
+	require.Equal(t, http.StatusCreated, created.Code)
+	connID := created.Connection.ID
+	assert.Equal(t, ConnectionStatusPending, created.Connection.Status)
+
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodPost, "/connectors/gig.acme/callbacks", map[string]string{"type": "linked"}, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, hubRequest(t, server, http.MethodPost, "/connectors/gig.acme/callbacks", "not an object", map[string]string{"X-Acme-Signature": "ok"}).Code)
+	require.Equal(t, http.StatusAccepted, pluginCallback(t, server, map[string]string{"type": "linked", "state": connID}))
+	conn, err := server.connections.Get(context.Background(), hubScope, connID)
+	require.NoError(t, err)
+	assert.Equal(t, ConnectionStatusActive, conn.Status)
+	assert.Equal(t, "worker-9", conn.ExternalAccount)
+
+	path := "/connections/" + connID + "/verifications"
+	assert.Equal(t, http.StatusNotImplemented, hubRequest(t, server, http.MethodPost, path, VerificationRequest{Pack: "pack.gig"}, partner).Code)
+
+	// A crashed plugin is unavailable until the supervisor restarts it
+	before := supervisor.Status()[0]
+	require.True(t, before.Healthy)
+	assert.NotEqual(t, http.StatusAccepted, pluginCallback(t, server, map[string]string{"type": "crash"}))
+	require.Eventually(t, func() bool {
+		status := supervisor.Status()[0]
+		return status.Healthy && status.Restarts == 1
+	}, 10*time.Second, 20*time.Millisecond)
+	after := supervisor.Status()[0]
+	assert.NotEqual(t, before.PID, after.PID)
+	require.Equal(t, http.StatusAccepted, pluginCallback(t, server, map[string]string{"type": "linked", "state": connID}))
+
+	server.operatorToken = testOperatorToken
+	w = hubRequest(t, server, http.MethodGet, "/plugins", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Plugins []PluginStatus `json:"plugins"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Plugins, 1)
+	assert.Equal(t, "gig.acme", listed.Plugins[0].ID)
+	assert.True(t, listed.Plugins[0].Healthy)
+	assert.Equal(t, 1, listed.Plugins[0].Restarts)
+}
+
+func TestPlugins_Unavailable(t *testing.T) {
+	server, supervisor := newPluginTestServer(t, "gig.other")
+
+	// A plugin describing itself as another connector is refused
+	err := supervisor.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"gig.other"`)
+
+	// Calls to a plugin that is down answer 503
+	require.NoError(t, server.connectors.Install(supervisor.plugins[0]))
+	partner := onboardPartner(t, server, "gigs.example", CreateKeyRequest{})
+	created := connect(t, server, "gig.acme", ConnectRequest{Subject: "did:key:z6MkWorker"}, partner)
+	assert.Equal(t, http.StatusServiceUnavailable, created.Code)
+	status := supervisor.Status()[0]
+	assert.False(t, status.Healthy)
+	assert.NotEmpty(t, status.LastError)
+}
+
+func TestParsePluginsConfig(t *testing.T) {
+	config, err := parsePluginsConfig([]byte(`
+plugins:
+  - id: gig.acme
+    command: /opt/cachet/plugins/acme
+    env: [ACME_API_TOKEN]
+    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+`))
+	require.NoError(t, err)
+	assert.Equal(t, defaultPluginHealthInterval, config.HealthInterval)
+	assert.Equal(t, []string{"ACME_API_TOKEN"}, config.Plugins[0].Env)
+
+	for name, raw := range map[string]string{
+		"missing command": "plugins: [{id: gig.acme}]",
+		"invalid id":      "plugins: [{id: Gig Acme, command: /bin/acme}]",
+		"repeated id":     "plugins: [{id: gig.acme, command: /bin/a}, {id: gig.acme, command: /bin/b}]",
+		"bad checksum":    "plugins: [{id: gig.acme, command: /bin/acme, sha256: abc}]",
+		"fast health":     "healthInterval: 10ms\nplugins: []",
+	} {
+		_, err := parsePluginsConfig([]byte(raw))
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,122 @@
+// Package pluginsdk lets partners write connector-hub connectors in their
+// own repositories.
+//
+// A connector plugin is a standalone binary whose main calls Serve with its
+// Connector. connector-hub starts the binaries declared in its
+// CONNECTOR_PLUGINS_CONFIG, talks to them over hashicorp/go-plugin, checks
+// their health and restarts them when they crash. A plugin only sees the
+// environment variables its config entry passes through.
+package pluginsdk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+)
+
+// PluginName is the name connectors are dispensed under
+const PluginName = "connector"
+
+// Handshake keeps the hub from starting binaries that are not connector
+// plugins, and plugins from being run by hand. ProtocolVersion changes
+// whenever the Connector interface does.
+var Handshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "CACHET_CONNECTOR_PLUGIN",
+	MagicCookieValue: "b1f3c2a0-cachet-connector",
+}
+
+// PluginMap is the plugin set the hub dispenses connectors from
+var PluginMap = map[string]plugin.Plugin{PluginName: &ConnectorPlugin{}}
+
+var (
+	// ErrInvalidEvent means a platform callback could not be parsed
+	ErrInvalidEvent = errors.New("invalid platform event")
+	// ErrEventSignature means a platform callback failed authentication
+	ErrEventSignature = errors.New("platform event signature invalid")
+	// ErrUnsupported means a connector does not offer the operation
+	ErrUnsupported = errors.New("not supported by this connector")
+)
+
+// ConnectorInfo describes a connector
+type ConnectorInfo struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Platform     string   `json:"platform"` // e.g. marketplace, gig, payments
+	Capabilities []string `json:"capabilities"`
+	// Packs are the trust packs the connector requests verifications for
+	Packs []string `json:"packs,omitempty"`
+}
+
+// Connection links a subject to a platform account through a connector
+type Connection struct {
+	ID              string    `json:"id"`
+	Connector       string    `json:"connector"`
+	Partner         string    `json:"partner,omitempty"`
+	Subject         string    `json:"subject"`
+	Status          string    `json:"status"`
+	ExternalAccount string    `json:"externalAccount,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// Authorization is how a connection proceeds: with a URL the user is sent
+// to the platform to consent, else the connection is active straight away
+type Authorization struct {
+	URL             string `json:"url,omitempty"`
+	ExternalAccount string `json:"externalAccount,omitempty"`
+}
+
+// PlatformEvent is a callback a platform sent the hub, as received
+type PlatformEvent struct {
+	Connector  string
+	Header     http.Header
+	Body       []byte
+	ReceivedAt time.Time
+}
+
+// EventResult is what a connector made of a platform event. A non-empty
+// ConnectionID applies Status and ExternalAccount to that connection.
+type EventResult struct {
+	Type            string `json:"type"`
+	ConnectionID    string `json:"connectionId,omitempty"`
+	Status          string `json:"status,omitempty"`
+	ExternalAccount string `json:"externalAccount,omitempty"`
+}
+
+// VerificationRequest asks for a subject to be verified against a pack
+type VerificationRequest struct {
+	Pack string `json:"pack"`
+}
+
+// VerificationSession is a verification a connector started
+type VerificationSession struct {
+	ID     string `json:"id"`
+	Pack   string `json:"pack"`
+	URL    string `json:"url,omitempty"` // where the subject completes it
+	Status string `json:"status"`
+}
+
+// Connector is what a plugin implements; it mirrors the hub's in-tree
+// connector interface. Connectors return ErrUnsupported for capabilities
+// they do not advertise, and ErrEventSignature or ErrInvalidEvent for
+// callbacks they refuse. Contexts carry the hub's deadline for the call.
+type Connector interface {
+	Describe() ConnectorInfo
+	Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error)
+	HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error)
+	RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error)
+}
+
+// Serve runs connector as a plugin; a plugin binary's main calls it and
+// nothing else. It returns when the hub stops the plugin.
+func Serve(connector Connector) {
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         map[string]plugin.Plugin{PluginName: &ConnectorPlugin{Impl: connector}},
+	})
+}
@@ -0,0 +1,199 @@
+package pluginsdk
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+)
+
+// ConnectorPlugin carries a Connector over go-plugin's net/rpc transport:
+// Impl is served on the plugin side, and the hub gets a Connector back
+type ConnectorPlugin struct {
+	Impl Connector
+}
+
+func (p *ConnectorPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &rpcServer{impl: p.Impl}, nil
+}
+
+func (p *ConnectorPlugin) Client(_ *plugin.MuxBroker, client *rpc.Client) (interface{}, error) {
+	return &rpcClient{client: client}, nil
+}
+
+// Error kinds, so the hub's sentinels survive the process boundary
+const (
+	errorInvalidEvent   = "invalid_event"
+	errorEventSignature = "event_signature"
+	errorUnsupported    = "unsupported"
+)
+
+// RemoteError is an error a plugin returned
+type RemoteError struct {
+	Kind    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Unwrap lets errors.Is match the sentinel the plugin returned
+func (e *RemoteError) Unwrap() error {
+	switch e.Kind {
+	case errorInvalidEvent:
+		return ErrInvalidEvent
+	case errorEventSignature:
+		return ErrEventSignature
+	case errorUnsupported:
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func remoteError(err error) *RemoteError {
+	if err == nil {
+		return nil
+	}
+	remote := &RemoteError{Message: err.Error()}
+	switch {
+	case errors.Is(err, ErrInvalidEvent):
+		remote.Kind = errorInvalidEvent
+	case errors.Is(err, ErrEventSignature):
+		remote.Kind = errorEventSignature
+	case errors.Is(err, ErrUnsupported):
+		remote.Kind = errorUnsupported
+	}
+	return remote
+}
+
+// net/rpc carries no context, so calls carry the hub's deadline instead
+type (
+	AuthorizeArgs struct {
+		Deadline    time.Time
+		Connection  Connection
+		RedirectURI string
+	}
+	AuthorizeReply struct {
+		Authorization Authorization
+		Err           *RemoteError
+	}
+	HandleEventArgs struct {
+		Deadline time.Time
+		Event    PlatformEvent
+	}
+	HandleEventReply struct {
+		Result EventResult
+		Err    *RemoteError
+	}
+	RequestVerificationArgs struct {
+		Deadline   time.Time
+		Connection Connection
+		Request    VerificationRequest
+	}
+	RequestVerificationReply struct {
+		Session VerificationSession
+		Err     *RemoteError
+	}
+)
+
+type rpcServer struct {
+	impl Connector
+}
+
+func callContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+func (s *rpcServer) Describe(_ struct{}, reply *ConnectorInfo) error {
+	*reply = s.impl.Describe()
+	return nil
+}
+
+func (s *rpcServer) Authorize(args AuthorizeArgs, reply *AuthorizeReply) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	authorization, err := s.impl.Authorize(ctx, args.Connection, args.RedirectURI)
+	*reply = AuthorizeReply{Authorization: authorization, Err: remoteError(err)}
+	return nil
+}
+
+func (s *rpcServer) HandleEvent(args HandleEventArgs, reply *HandleEventReply) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	result, err := s.impl.HandleEvent(ctx, args.Event)
+	*reply = HandleEventReply{Result: result, Err: remoteError(err)}
+	return nil
+}
+
+func (s *rpcServer) RequestVerification(args RequestVerificationArgs, reply *RequestVerificationReply) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	session, err := s.impl.RequestVerification(ctx, args.Connection, args.Request)
+	*reply = RequestVerificationReply{Session: session, Err: remoteError(err)}
+	return nil
+}
+
+type rpcClient struct {
+	client *rpc.Client
+}
+
+// call gives up when ctx ends; the plugin still finishes the call on its side
+func (c *rpcClient) call(ctx context.Context, method string, args, reply interface{}) error {
+	call := c.client.Go("Plugin."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Describe has no context in the interface; it answers from the plugin's
+// memory, so an unreachable plugin yields an empty ConnectorInfo
+func (c *rpcClient) Describe() ConnectorInfo {
+	var info ConnectorInfo
+	_ = c.client.Call("Plugin.Describe", struct{}{}, &info)
+	return info
+}
+
+func (c *rpcClient) Authorize(ctx context.Context, conn Connection, redirectURI string) (Authorization, error) {
+	deadline, _ := ctx.Deadline()
+	var reply AuthorizeReply
+	if err := c.call(ctx, "Authorize", AuthorizeArgs{Deadline: deadline, Connection: conn, RedirectURI: redirectURI}, &reply); err != nil {
+		return Authorization{}, err
+	}
+	if reply.Err != nil {
+		return Authorization{}, reply.Err
+	}
+	return reply.Authorization, nil
+}
+
+func (c *rpcClient) HandleEvent(ctx context.Context, event PlatformEvent) (EventResult, error) {
+	deadline, _ := ctx.Deadline()
+	var reply HandleEventReply
+	if err := c.call(ctx, "HandleEvent", HandleEventArgs{Deadline: deadline, Event: event}, &reply); err != nil {
+		return EventResult{}, err
+	}
+	if reply.Err != nil {
+		return EventResult{}, reply.Err
+	}
+	return reply.Result, nil
+}
+
+func (c *rpcClient) RequestVerification(ctx context.Context, conn Connection, req VerificationRequest) (VerificationSession, error) {
+	deadline, _ := ctx.Deadline()
+	var reply RequestVerificationReply
+	if err := c.call(ctx, "RequestVerification", RequestVerificationArgs{Deadline: deadline, Connection: conn, Request: req}, &reply); err != nil {
+		return VerificationSession{}, err
+	}
+	if reply.Err != nil {
+		return VerificationSession{}, reply.Err
+	}
+	return reply.Session, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+// databaseSchema is the Postgres schema the hub keeps its tables in
+const databaseSchema = "connector_hub"
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// OpenDatabaseFromEnv connects to the shared database and migrates the
+// hub's schema. It returns nil when DATABASE_URL is unset.
+func OpenDatabaseFromEnv() (*store.DB, error) {
+	config, err := store.ConfigFromEnv(databaseSchema)
+	if err != nil || config == nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := store.Open(ctx, *config)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.Migrate(ctx, migrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, migration := range applied {
+		log.Info().Str("schema", db.Schema()).Int("version", migration.Version).Str("name", migration.Name).Msg("Applied database migration")
+	}
+	return db, nil
+}
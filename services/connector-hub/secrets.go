@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+	"github.com/rs/zerolog/log"
+)
+
+const kmsEndpoint = "https://cloudkms.googleapis.com/v1/"
+
+var ErrUnknownKeyVersion = errors.New("secret was sealed with an unknown key")
+
+// SealedSecret is a connector credential encrypted at rest with envelope
+// encryption: a fresh data key seals the plaintext with AES-256-GCM, and
+// the key encryption key (Cloud KMS in production) wraps the data key.
+// Rotating the KEK only rewraps the data key.
+type SealedSecret struct {
+	KeyVersion string `json:"keyVersion"` // the KEK version that wrapped the data key
+	WrappedKey []byte `json:"wrappedKey"`
+	Ciphertext []byte `json:"ciphertext"` // nonce, then AES-GCM sealed plaintext
+}
+
+// KeyEncrypter wraps data keys with a key encryption key that never leaves
+// it. WrapKey uses the current (primary) version.
+type KeyEncrypter interface {
+	WrapKey(ctx context.Context, dataKey []byte) (wrapped []byte, keyVersion string, err error)
+	UnwrapKey(ctx context.Context, keyVersion string, wrapped []byte) ([]byte, error)
+}
+
+// secretBox seals connector credentials: OAuth tokens and partner webhook
+// secrets. Each secret is bound to what it belongs to by its associated
+// data, so a ciphertext cannot be moved onto another connection.
+type secretBox struct {
+	kek KeyEncrypter
+}
+
+func newSecretBox(kek KeyEncrypter) *secretBox {
+	return &secretBox{kek: kek}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmSeal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("sealed data is truncated")
+	}
+	return aead.Open(nil, sealed[:size], sealed[size:], aad)
+}
+
+// wipe clears a data key once used
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+func (b *secretBox) Seal(ctx context.Context, aad string, plaintext []byte) (SealedSecret, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return SealedSecret{}, err
+	}
+	defer wipe(dataKey)
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return SealedSecret{}, err
+	}
+	ciphertext, err := gcmSeal(aead, plaintext, []byte(aad))
+	if err != nil {
+		return SealedSecret{}, err
+	}
+	wrapped, version, err := b.kek.WrapKey(ctx, dataKey)
+	if err != nil {
+		return SealedSecret{}, fmt.Errorf("wrapping data key: %w", err)
+	}
+	return SealedSecret{KeyVersion: version, WrappedKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+func (b *secretBox) Open(ctx context.Context, aad string, sealed SealedSecret) ([]byte, error) {
+	dataKey, err := b.kek.UnwrapKey(ctx, sealed.KeyVersion, sealed.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	defer wipe(dataKey)
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcmOpen(aead, sealed.Ciphertext, []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("opening secret: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rewrap wraps a secret's data key with the current KEK version, leaving
+// the ciphertext as it is
+func (b *secretBox) Rewrap(ctx context.Context, sealed SealedSecret) (SealedSecret, error) {
+	dataKey, err := b.kek.UnwrapKey(ctx, sealed.KeyVersion, sealed.WrappedKey)
+	if err != nil {
+		return SealedSecret{}, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	defer wipe(dataKey)
+	wrapped, version, err := b.kek.WrapKey(ctx, dataKey)
+	if err != nil {
+		return SealedSecret{}, fmt.Errorf("wrapping data key: %w", err)
+	}
+	return SealedSecret{KeyVersion: version, WrappedKey: wrapped, Ciphertext: sealed.Ciphertext}, nil
+}
+
+// Check wraps a throwaway data key, for health checks: secrets cannot be
+// sealed or opened while the KEK is unreachable
+func (b *secretBox) Check(ctx context.Context) error {
+	if _, _, err := b.kek.WrapKey(ctx, make([]byte, 32)); err != nil {
+		return fmt.Errorf("key encryption key unavailable: %w", err)
+	}
+	return nil
+}
+
+// SecretsConfig selects the key encryption key sealing connector secrets:
+// a Cloud KMS key, or keys held in the configuration for development.
+// Without either an ephemeral key is used and sealed secrets do not survive
+// a restart.
+type SecretsConfig struct {
+	KMSKey string   `env:"CONNECTOR_KMS_KEY" doc:"Cloud KMS key (projects/.../locations/.../keyRings/.../cryptoKeys/...) wrapping the data keys that seal connector secrets"`
+	Keys   []string `env:"CONNECTOR_SECRET_KEYS" secret:"true" doc:"Comma-separated base64 32-byte keys wrapping data keys when CONNECTOR_KMS_KEY is unset, the first being primary; sealed secrets do not survive a restart without either"`
+}
+
+// Validate checks the KMS key is a Cloud KMS key name and the local keys
+// are base64 32-byte keys
+func (c SecretsConfig) Validate() error {
+	if c.KMSKey != "" {
+		if !strings.HasPrefix(c.KMSKey, "projects/") || !strings.Contains(c.KMSKey, "/cryptoKeys/") {
+			return fmt.Errorf("CONNECTOR_KMS_KEY: %q is not a Cloud KMS key name", c.KMSKey)
+		}
+		return nil
+	}
+	_, err := c.localKeys()
+	return err
+}
+
+// localKeys decodes CONNECTOR_SECRET_KEYS
+func (c SecretsConfig) localKeys() ([][]byte, error) {
+	keys := make([][]byte, len(c.Keys))
+	for i, encoded := range c.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("CONNECTOR_SECRET_KEYS: key %d: %w", i, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("CONNECTOR_SECRET_KEYS: key %d must be 32 bytes, got %d", i, len(key))
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// LoadSecretBox wraps data keys with the key encryption key c selects
+func LoadSecretBox(c SecretsConfig) (*secretBox, error) {
+	if c.KMSKey != "" {
+		return newSecretBox(newCloudKMS(c.KMSKey)), nil
+	}
+	if len(c.Keys) == 0 {
+		log.Warn().Msg("Neither CONNECTOR_KMS_KEY nor CONNECTOR_SECRET_KEYS is set; connector secrets are sealed with an ephemeral key")
+		return newSecretBox(ephemeralKeyring()), nil
+	}
+	keys, err := c.localKeys()
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := newLocalKeyring(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("CONNECTOR_SECRET_KEYS: %w", err)
+	}
+	return newSecretBox(keyring), nil
+}
+
+// localKeyring wraps data keys with keys held in memory, for development
+// and tests. The first key is primary; the others still unwrap, so keys
+// can be rotated by prepending a new one and rewrapping.
+type localKeyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func newLocalKeyring(keys ...[]byte) (*localKeyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	keyring := &localKeyring{keys: make(map[string]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %d must be 32 bytes, got %d", i, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		version := "local:" + hex.EncodeToString(sum[:4])
+		keyring.keys[version] = aead
+		if i == 0 {
+			keyring.primary = version
+		}
+	}
+	return keyring, nil
+}
+
+func ephemeralKeyring() *localKeyring {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	keyring, _ := newLocalKeyring(key)
+	return keyring
+}
+
+func (l *localKeyring) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	wrapped, err := gcmSeal(l.keys[l.primary], dataKey, []byte(l.primary))
+	return wrapped, l.primary, err
+}
+
+func (l *localKeyring) UnwrapKey(ctx context.Context, keyVersion string, wrapped []byte) ([]byte, error) {
+	aead, ok := l.keys[keyVersion]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyVersion, keyVersion)
+	}
+	return gcmOpen(aead, wrapped, []byte(keyVersion))
+}
+
+// cloudKMS wraps data keys with a Cloud KMS symmetric key over its REST
+// API. KMS picks the primary version on encrypt and finds the version from
+// the ciphertext on decrypt, so rotating the key in KMS needs no change
+// here; rewrapping moves old secrets onto the new version.
+type cloudKMS struct {
+	keyName  string
+	endpoint string
+	tokens   *gcpauth.TokenSource
+	client   *http.Client
+}
+
+func newCloudKMS(keyName string) *cloudKMS {
+	client := deadline.NewClient("kms")
+	return &cloudKMS{
+		keyName:  keyName,
+		endpoint: kmsEndpoint,
+		tokens:   gcpauth.NewTokenSource(gcpauth.MetadataTokenURL, client),
+		client:   client,
+	}
+}
+
+// call POSTs to a KMS method of the key. Request and response bodies carry
+// key material, so neither is ever logged.
+func (k *cloudKMS) call(ctx context.Context, method string, in, out interface{}) error {
+	token, err := k.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching KMS access token: %w", err)
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint+k.keyName+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("KMS %s answered %d", method, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *cloudKMS) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	var out struct {
+		Name       string `json:"name"` // the key version used
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := k.call(ctx, "encrypt", map[string][]byte{"plaintext": dataKey}, &out); err != nil {
+		return nil, "", err
+	}
+	return out.Ciphertext, out.Name, nil
+}
+
+func (k *cloudKMS) UnwrapKey(ctx context.Context, keyVersion string, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	if err := k.call(ctx, "decrypt", map[string][]byte{"ciphertext": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// SecretRotation reports a rewrap of every stored secret onto the current
+// KEK version
+type SecretRotation struct {
+	Rewrapped int `json:"rewrapped"`
+	// Skipped secrets were replaced or removed while being rewrapped
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// KeyVersions counts stored secrets by KEK version afterwards
+	KeyVersions map[string]int `json:"keyVersions"`
+}
+
+// rotateSecrets rewraps the data keys of every stored credential. Run it
+// after rotating the KMS key (or prepending a CONNECTOR_SECRET_KEYS key) so
+// old key versions can be disabled.
+func (s *Server) rotateSecrets(ctx context.Context) (SecretRotation, error) {
+	report := SecretRotation{}
+	for id, sealed := range s.endpoints.Secrets() {
+		rewrapped, err := s.secrets.Rewrap(ctx, sealed)
+		if err != nil {
+			report.Failed++
+			log.Error().Err(err).Str("endpoint_id", id).Msg("Failed to rewrap webhook secret")
+			continue
+		}
+		if s.endpoints.ReplaceSecret(id, sealed, rewrapped) {
+			report.Rewrapped++
+		} else {
+			report.Skipped++
+		}
+	}
+	if s.oauth != nil {
+		tokens, err := s.oauth.tokens.List(ctx)
+		if err != nil {
+			return report, err
+		}
+		for _, sealed := range tokens {
+			rewrapped, err := s.secrets.Rewrap(ctx, sealed.Secret)
+			if err != nil {
+				report.Failed++
+				log.Error().Err(err).Str("connection_id", sealed.ConnectionID).Msg("Failed to rewrap platform token")
+				continue
+			}
+			replaced := false
+			err = s.oauth.tokens.Update(ctx, sealed.ConnectionID, func(token *SealedToken) error {
+				// A refresh in the meantime sealed a new token already
+				if bytes.Equal(token.Secret.WrappedKey, sealed.Secret.WrappedKey) {
+					token.Secret, replaced = rewrapped, true
+				}
+				return nil
+			})
+			switch {
+			case errors.Is(err, ErrTokenNotFound) || (err == nil && !replaced):
+				report.Skipped++
+			case err != nil:
+				return report, err
+			default:
+				report.Rewrapped++
+			}
+		}
+	}
+	versions, err := s.secretKeyVersions(ctx)
+	report.KeyVersions = versions
+	return report, err
+}
+
+// secretKeyVersions counts stored secrets by the KEK version wrapping them
+func (s *Server) secretKeyVersions(ctx context.Context) (map[string]int, error) {
+	versions := map[string]int{}
+	for _, sealed := range s.endpoints.Secrets() {
+		versions[sealed.KeyVersion]++
+	}
+	if s.oauth != nil {
+		tokens, err := s.oauth.tokens.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, sealed := range tokens {
+			versions[sealed.Secret.KeyVersion]++
+		}
+	}
+	return versions, nil
+}
+
+// handleSecretsStatus shows which KEK versions stored secrets depend on,
+// never the secrets themselves
+func (s *Server) handleSecretsStatus(w http.ResponseWriter, r *http.Request) {
+	versions, err := s.secretKeyVersions(r.Context())
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keyVersions": versions})
+}
+
+func (s *Server) handleRotateSecrets(w http.ResponseWriter, r *http.Request) {
+	report, err := s.rotateSecrets(r.Context())
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{
+		Type:   audit.TypeKeyRotation,
+		Action: "kek.rewrapped",
+		Actor:  "operator",
+		Detail: fmt.Sprintf("rewrapped=%d skipped=%d failed=%d", report.Rewrapped, report.Skipped, report.Failed),
+	})
+	log.Info().Int("rewrapped", report.Rewrapped).Int("skipped", report.Skipped).Int("failed", report.Failed).Msg("Connector secrets rewrapped")
+	status := http.StatusOK
+	if report.Failed > 0 {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/gcpauth"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, fills ...byte) *localKeyring {
+	t.Helper()
+	keys := make([][]byte, len(fills))
+	for i, fill := range fills {
+		keys[i] = bytes.Repeat([]byte{fill}, 32)
+	}
+	keyring, err := newLocalKeyring(keys...)
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestSecretBox_SealOpen(t *testing.T) {
+	ctx := context.Background()
+	box := newSecretBox(testKeyring(t, 1))
+
+	sealed, err := box.Seal(ctx, "webhook-secret:whe_1", []byte("whsec_plain"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed.Ciphertext), "whsec_plain")
+	assert.True(t, strings.HasPrefix(sealed.KeyVersion, "local:"))
+
+	plaintext, err := box.Open(ctx, "webhook-secret:whe_1", sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "whsec_plain", string(plaintext))
+
+	// Each secret has its own data key
+	again, err := box.Seal(ctx, "webhook-secret:whe_1", []byte("whsec_plain"))
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed.WrappedKey, again.WrappedKey)
+
+	// Bound to what it belongs to
+	_, err = box.Open(ctx, "webhook-secret:whe_2", sealed)
+	assert.Error(t, err)
+	// Unreadable once its key is gone
+	_, err = newSecretBox(testKeyring(t, 2)).Open(ctx, "webhook-secret:whe_1", sealed)
+	assert.ErrorIs(t, err, ErrUnknownKeyVersion)
+
+	_, err = newLocalKeyring([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestLoadSecretBox(t *testing.T) {
+	secrets := SecretsConfig{Keys: []string{"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=", "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI="}}
+	require.NoError(t, secrets.Validate())
+	box, err := LoadSecretBox(secrets)
+	require.NoError(t, err)
+	assert.Equal(t, testKeyring(t, 1).primary, box.kek.(*localKeyring).primary)
+	assert.Len(t, box.kek.(*localKeyring).keys, 2)
+
+	assert.Error(t, SecretsConfig{Keys: []string{"not base64"}}.Validate())
+	assert.Error(t, SecretsConfig{Keys: []string{"c2hvcnQ="}}.Validate())
+
+	secrets = SecretsConfig{KMSKey: "projects/cachet/locations/global/keyRings/hub/cryptoKeys/connector-secrets"}
+	require.NoError(t, secrets.Validate())
+	box, err = LoadSecretBox(secrets)
+	require.NoError(t, err)
+	assert.IsType(t, &cloudKMS{}, box.kek)
+	assert.Error(t, SecretsConfig{KMSKey: "connector-secrets"}.Validate())
+}
+
+// fakeKMS plays the metadata server and the Cloud KMS encrypt and decrypt
+// methods of one key, whose primary version can be changed
+type fakeKMS struct {
+	mu          sync.Mutex
+	primary     int
+	wrapped     map[string][]byte // ciphertext -> plaintext
+	tokenFetch  int
+	lastBearers []string
+}
+
+const fakeKMSKey = "projects/cachet/locations/global/keyRings/hub/cryptoKeys/connector-secrets"
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.tokenFetch++
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "kms-token", "expires_in": 3600})
+		return
+	}
+	f.lastBearers = append(f.lastBearers, r.Header.Get("Authorization"))
+	var in map[string][]byte
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path {
+	case "/" + fakeKMSKey + ":encrypt":
+		version := fmt.Sprintf("%s/cryptoKeyVersions/%d", fakeKMSKey, f.primary)
+		ciphertext := []byte(fmt.Sprintf("%d:%x", f.primary, in["plaintext"]))
+		f.wrapped[string(ciphertext)] = in["plaintext"]
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": version, "ciphertext": ciphertext})
+	case "/" + fakeKMSKey + ":decrypt":
+		plaintext, ok := f.wrapped[string(in["ciphertext"])]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"plaintext": plaintext})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCloudKMS_EnvelopeAndRotation(t *testing.T) {
+	fake := &fakeKMS{primary: 1, wrapped: map[string][]byte{}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	kms := newCloudKMS(fakeKMSKey)
+	kms.endpoint, kms.tokens, kms.client = ts.URL+"/", gcpauth.NewTokenSource(ts.URL+"/token", ts.Client()), ts.Client()
+	ctx := context.Background()
+	box := newSecretBox(kms)
+
+	sealed, err := box.Seal(ctx, "oauth-token:conn_1", []byte("refresh-secret"))
+	require.NoError(t, err)
+	assert.Equal(t, fakeKMSKey+"/cryptoKeyVersions/1", sealed.KeyVersion)
+	assert.NotContains(t, string(sealed.Ciphertext), "refresh-secret")
+
+	// The key is rotated in KMS: rewrapping moves the data key onto the new
+	// version and leaves the ciphertext alone
+	fake.mu.Lock()
+	fake.primary = 2
+	fake.mu.Unlock()
+	rewrapped, err := box.Rewrap(ctx, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, fakeKMSKey+"/cryptoKeyVersions/2", rewrapped.KeyVersion)
+	assert.Equal(t, sealed.Ciphertext, rewrapped.Ciphertext)
+	plaintext, err := box.Open(ctx, "oauth-token:conn_1", rewrapped)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-secret", string(plaintext))
+
+	// The access token is fetched once and sent on every call
+	assert.Equal(t, 1, fake.tokenFetch)
+	for _, bearer := range fake.lastBearers {
+		assert.Equal(t, "Bearer kms-token", bearer)
+	}
+}
+
+func TestSecretBox_Check(t *testing.T) {
+	fake := &fakeKMS{primary: 1, wrapped: map[string][]byte{}}
+	ts := httptest.NewServer(fake)
+	kms := newCloudKMS(fakeKMSKey)
+	kms.endpoint, kms.tokens, kms.client = ts.URL+"/", gcpauth.NewTokenSource(ts.URL+"/token", ts.Client()), ts.Client()
+	server := NewServer()
+	server.secrets = newSecretBox(kms)
+	server.health.Require("kms", server.secrets)
+
+	w := hubRequest(t, server, http.MethodGet, "/readyz", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	ts.Close()
+	w = hubRequest(t, server, http.MethodGet, "/readyz", nil, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "key encryption key unavailable")
+	assert.Equal(t, http.StatusServiceUnavailable, hubRequest(t, server, http.MethodGet, "/health", nil, nil).Code)
+}
+
+// linkAccount links did:key:z6MkSeller through the fake provider
+func linkAccount(t *testing.T, server *Server, provider *fakeProvider) Connection {
+	t.Helper()
+	state := authorize(t, server, provider, "subject=did:key:z6MkSeller").Query().Get("state")
+	w := hubRequest(t, server, http.MethodGet, "/connections/marketplace.generic/callback?code=code-1&state="+state, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var conn Connection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &conn))
+	return conn
+}
+
+func TestSecrets_RotateAndNeverExposed(t *testing.T) {
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previous })
+
+	server, provider := newOAuthTestServer(t)
+	server.operatorToken = testOperatorToken
+	onboardPartner(t, server, "marketplace.generic", CreateKeyRequest{})
+	conn := linkAccount(t, server, provider)
+	w := hubRequest(t, server, http.MethodPost, "/webhooks/endpoints", RegisterEndpointRequest{
+		Partner: "marketplace.generic",
+		URL:     "https://partner.example/cachet",
+		Events:  []string{EventBadgeStatusChanged},
+	}, operatorHeader)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var endpoint WebhookEndpoint
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoint))
+	oldVersion := server.secrets.kek.(*localKeyring).primary
+
+	// A new primary key is prepended; the old one still unwraps
+	server.secrets.kek = testKeyring(t, 8, 7)
+	newVersion := server.secrets.kek.(*localKeyring).primary
+	w = hubRequest(t, server, http.MethodGet, "/secrets", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"keyVersions":{%q:2}}`, oldVersion), w.Body.String())
+
+	w = hubRequest(t, server, http.MethodPost, "/secrets/rotate", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var report SecretRotation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.Rewrapped)
+	assert.Equal(t, map[string]int{newVersion: 2}, report.KeyVersions)
+
+	// Once rewrapped, the old key can be retired
+	server.secrets.kek = testKeyring(t, 8)
+	token, err := server.oauth.AccessToken(context.Background(), conn.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+	secret, ok := server.endpoints.Secret(endpoint.ID)
+	require.True(t, ok)
+	plaintext, err := server.secrets.Open(context.Background(), webhookSecretAAD(endpoint.ID), secret)
+	require.NoError(t, err)
+	assert.Equal(t, endpoint.Secret, string(plaintext))
+
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodPost, "/secrets/rotate", nil, nil).Code)
+
+	// Nothing the API answers afterwards, nor anything logged, shows a secret
+	for _, path := range []string{"/webhooks/endpoints", "/webhooks/endpoints/" + endpoint.ID, "/connections/" + conn.ID, "/secrets"} {
+		w = hubRequest(t, server, http.MethodGet, path, nil, operatorHeader)
+		for _, secret := range []string{endpoint.Secret, "access-1", "refresh-secret"} {
+			assert.NotContains(t, w.Body.String(), secret, path)
+		}
+	}
+	for _, secret := range []string{endpoint.Secret, "access-1", "refresh-secret"} {
+		assert.NotContains(t, logs.String(), secret)
+	}
+	assert.Equal(t, "OAuthToken{redacted}", fmt.Sprint(OAuthToken{AccessToken: "access-1"}))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+type Server struct {
+	router *chi.Mux
+	// connectors are the platform integrations installed in the hub
+	connectors  *connectorRegistry
+	connections ConnectionStore
+	// partners are the hub's tenants, with their scoped API keys; audit
+	// records their onboarding and cross-tenant access attempts
+	partners *partnerRegistry
+	audit    *auditLog
+	// security keeps the tamper-evident trail of auth failures, operator
+	// actions, key revocations and KEK rotations; nil records nothing
+	security *audit.Logger
+	// oauth links platform accounts over OAuth 2.0; nil unless
+	// OAUTH_PLATFORMS_CONFIG is set
+	oauth *oauthClient
+	// secrets seals connector credentials at rest
+	secrets *secretBox
+	// endpoints and deliveries carry status changes out to partners;
+	// transforms reshape them per connector
+	endpoints     *endpointStore
+	deliveries    *deliveryQueue
+	transforms    *transformStore
+	webhookClient *http.Client
+	operatorToken string // Bearer token for the operator APIs; empty disables them
+	// events holds normalized platform events; bus forwards them to the
+	// services subscribed in EVENT_SUBSCRIBERS_CONFIG
+	events EventStore
+	bus    *eventBus
+	// links map partners' platform accounts to the subjects that confirmed
+	// them from their wallets, for linkTTL; dids resolves the holders' keys
+	links   *linkStore
+	linkTTL time.Duration
+	dids    *didresolver.Resolver
+	// flags are partners' dispute and fraud reports about linked subjects;
+	// those at flagSuspend severity or above hold the subjects' badges, and
+	// cachetEvents announces them to the other services, nil without a bus
+	flags        *flagStore
+	flagSuspend  string
+	cachetEvents events.Bus
+	// badges are subjects' current badge states, which partners embed;
+	// signer signs the badge tokens
+	badges *badgeStore
+	signer *signing.Signer
+	// plugins runs the out-of-tree connectors from CONNECTOR_PLUGINS_CONFIG;
+	// nil without one
+	plugins *pluginSupervisor
+	// health checks the database, and Cloud KMS when it wraps the secrets'
+	// data keys
+	health  *health.Monitor
+	metrics *metrics.Metrics
+	// cors lets the configured origins call the API from browsers
+	cors cors.Policy
+	// versions serves the API under /v1 and its legacy unversioned aliases
+	versions apiversion.Policy
+	// openapi refuses requests that do not match the API document
+	openapi *openapi.Validator
+}
+
+func NewServer() *Server {
+	s := &Server{
+		router:      chi.NewRouter(),
+		connectors:  newConnectorRegistry(),
+		connections: newMemoryConnectionStore(),
+		partners:    newPartnerRegistry(newMemoryPartnerStore()),
+		audit:       newAuditLog(),
+
+		secrets:       newSecretBox(ephemeralKeyring()),
+		endpoints:     newEndpointStore(),
+		deliveries:    newDeliveryQueue(),
+		transforms:    newTransformStore(),
+		webhookClient: &http.Client{Timeout: deliveryTimeout},
+
+		events: newMemoryEventStore(),
+		bus:    newEventBus(),
+
+		links:   newLinkStore(),
+		linkTTL: defaultLinkTTL,
+		dids:    didresolver.New(),
+
+		flags: newFlagStore(),
+
+		badges: newBadgeStore(),
+		signer: newSigner(),
+
+		health:  health.New("connector-hub"),
+		metrics: metrics.New("connector-hub"),
+	}
+	validator, err := openapi.New(openapiDocument)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
+	}
+	s.openapi = validator
+	s.setupMiddleware()
+	s.setupRoutes()
+	return s
+}
+
+func (s *Server) setupMiddleware() {
+	s.router.Use(tracing.Middleware("connector-hub"))
+	s.router.Use(s.metrics.Middleware)
+	s.router.Use(middleware.RequestID)
+	s.router.Use(middleware.RealIP)
+	s.router.Use(middleware.Logger)
+	s.router.Use(middleware.Recoverer)
+	s.router.Use(s.cors.Middleware)
+	s.router.Use(s.versions.Middleware)
+	s.router.Use(s.openapi.Middleware)
+	s.router.Use(deadline.Middleware(deadline.BudgetFromEnv()))
+}
+
+func (s *Server) setupRoutes() {
+	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
+	s.router.Get("/health", s.health.Health)
+	s.router.Get("/livez", s.health.Live)
+	s.router.Get("/readyz", s.health.Ready)
+	s.router.Handle("/metrics", s.metrics.Handler())
+	s.router.Get("/.well-known/jwks.json", s.handleJWKS)
+
+	// Platforms' callbacks and partners' embedded badges stay at the
+	// unversioned URLs they were given
+	s.versions.Unversioned("/connectors/*/callbacks", "/connections/*/callback", "/partners/*/subjects/*/badge")
+
+	s.router.Get("/connectors", s.handleListConnectors)
+	s.router.Get("/connectors/{id}", s.handleGetConnector)
+	// Platforms call back here; connectors authenticate their callbacks
+	s.router.Post("/connectors/{id}/callbacks", s.handlePlatformCallback)
+
+	// Connections, scoped to the partner's tenant by its API key
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireTenant)
+		r.Post("/connectors/{id}/connections", s.handleCreateConnection)
+		r.Get("/connections", s.handleListConnections)
+		r.Get("/connections/{id}", s.handleGetConnection)
+		r.Post("/connections/{id}/verifications", s.handleRequestVerification)
+
+		// Subject links: partners start them, and connectors look up the
+		// subject an account is linked to
+		r.Post("/connectors/{id}/links", s.handleStartLink)
+		r.Get("/connectors/{id}/links/{account}", s.handleLookupLink)
+		r.Get("/links/{id}", s.handleGetLink)
+		r.Delete("/links/{id}", s.handleDeleteLink)
+
+		// Partners flag disputes and suspected fraud by linked subjects
+		r.Post("/partners/{id}/flags", s.handleRaiseFlag)
+		r.Get("/flags", s.handleListFlags)
+		r.Get("/flags/{id}", s.handleGetFlag)
+		r.Post("/flags/{id}/withdraw", s.handleWithdrawFlag)
+	})
+
+	// Holders confirm and end links from their wallets, signing with their DID key
+	s.router.Post("/links/{id}/confirm", s.handleConfirmLink)
+	s.router.Post("/links/{id}/unlink", s.handleHolderUnlink)
+	// and see and contest the flags raised about them the same way
+	s.router.Get("/subjects/{id}/flags", s.handleListSubjectFlags)
+	s.router.Post("/flags/{id}/contest", s.handleContestFlag)
+
+	// Account linking over OAuth 2.0, for the platforms in OAUTH_PLATFORMS_CONFIG
+	s.router.Get("/connections/{id}/authorize", s.handleOAuthAuthorize)
+	s.router.Get("/connections/{id}/callback", s.handleOAuthCallback)
+
+	// Partner sites embed their linked subjects' badges
+	s.router.Get("/partners/{id}/subjects/{subject}/badge", s.handleGetBadge)
+
+	// Operator APIs
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireOperator)
+
+		// Partner onboarding, API keys and the audit trail
+		r.Post("/partners", s.handleOnboardPartner)
+		r.Get("/partners", s.handleListPartners)
+		r.Get("/partners/{id}", s.handleGetPartner)
+		r.Post("/partners/{id}/keys", s.handleCreatePartnerKey)
+		r.Get("/partners/{id}/keys", s.handleListPartnerKeys)
+		r.Delete("/partners/{id}/keys/{keyId}", s.handleRevokePartnerKey)
+		r.Get("/audit", s.handleListAudit)
+
+		// Partner webhooks; Cachet services publish to /events
+		r.Post("/events", s.handlePublishEvent)
+		r.Post("/webhooks/endpoints", s.handleRegisterEndpoint)
+		r.Get("/webhooks/endpoints", s.handleListEndpoints)
+		r.Get("/webhooks/endpoints/{id}", s.handleGetEndpoint)
+		r.Delete("/webhooks/endpoints/{id}", s.handleDeleteEndpoint)
+		r.Get("/webhooks/deliveries", s.handleListDeliveries)
+		r.Get("/webhooks/deliveries/{id}", s.handleGetDelivery)
+		r.Get("/webhooks/dead-letters", s.handleListDeadLetters)
+		r.Post("/webhooks/dead-letters/{id}/redrive", s.handleRedrive)
+
+		// Review of partners' flags, contested or not
+		r.Post("/flags/{id}/resolve", s.handleResolveFlag)
+
+		// Per-connector payload transformations, and dry runs of them
+		r.Put("/connectors/{id}/transformation", s.handlePutTransformation)
+		r.Get("/connectors/{id}/transformation", s.handleGetTransformation)
+		r.Delete("/connectors/{id}/transformation", s.handleDeleteTransformation)
+		r.Post("/connectors/{id}/transformation/test", s.handleTestTransformation)
+
+		// Normalized platform events, for services to backfill from
+		r.Get("/inbound-events", s.handleListEvents)
+		r.Get("/inbound-events/{id}", s.handleGetEvent)
+
+		// Key encryption key versions in use, and rewrapping after rotation
+		r.Get("/secrets", s.handleSecretsStatus)
+		r.Post("/secrets/rotate", s.handleRotateSecrets)
+
+		// Plugin connectors' process health
+		r.Get("/plugins", s.handleListPlugins)
+	})
+}
+
+// authorizeOperator checks the bearer token for the operator APIs, which
+// are closed unless OPERATOR_API_TOKEN is configured
+func (s *Server) authorizeOperator(r *http.Request) bool {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return s.operatorToken != "" && scheme == "Bearer" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1
+}
+
+// requireOperator guards the operator routes
+func (s *Server) requireOperator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorizeOperator(r) {
+			s.security.AuthFailure(r, "operator")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) Start(addr string) error {
+	log.Info().Str("addr", addr).Int("connector_count", len(s.connectors.List())).Msg("Connector hub starting")
+	if s.oauth != nil {
+		go s.runTokenRefresher(tokenRefreshInterval)
+	}
+	go s.runDeliveryWorker(deliveryWorkerInterval)
+	go s.runLinkSweeper(linkSweepInterval)
+	go s.security.Run()
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      s.router,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
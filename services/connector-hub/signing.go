@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/rs/zerolog/log"
+)
+
+const hubIssuer = "did:web:hub.cachet.id"
+
+// newSigner signs with a key generated at startup (in production, load from
+// secure storage)
+func newSigner() *signing.Signer {
+	signer, err := signing.Generate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate hub signing key")
+	}
+	return signer
+}
+
+// handleJWKS publishes the key partners verify badge tokens with
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []didresolver.JWK{s.signer.PublicJWK()},
+	})
+}
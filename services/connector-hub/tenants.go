@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// partnerKeyPrefix marks connector-hub API keys so leaked keys are easy to
+// grep for
+const partnerKeyPrefix = "chk_"
+
+var (
+	ErrPartnerNotFound    = errors.New("partner not found")
+	ErrPartnerExists      = errors.New("partner already exists")
+	ErrPartnerKeyNotFound = errors.New("API key not found")
+	// ErrOutOfScope rejects access to data outside the caller's tenant, or
+	// outside the connectors and subjects its API key is scoped to
+	ErrOutOfScope = errors.New("outside the caller's tenant scope")
+	// errCrossTenant is what stores answer for another tenant's record: to
+	// the caller it is simply not found
+	errCrossTenant = fmt.Errorf("%w: %w", ErrConnectionNotFound, ErrOutOfScope)
+)
+
+// Partner is a tenant of the hub: a platform or site linking its users'
+// accounts to Cachet. Its data is isolated from every other partner's.
+type Partner struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Connectors []string  `json:"connectors"` // the connectors and OAuth platforms it may use
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// PartnerKey is an API key of a partner, scoped to some of its connectors
+// and, optionally, to a set of subjects
+type PartnerKey struct {
+	ID         string     `json:"id"`
+	Partner    string     `json:"partner"`
+	Name       string     `json:"name,omitempty"`
+	Connectors []string   `json:"connectors"`
+	Subjects   []string   `json:"subjects,omitempty"` // empty allows every subject
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// TenantScope is what a caller may see of the hub's data. A partner sees
+// its own tenant, narrowed by its API key to some connectors and subjects;
+// the hub itself (operators, platform callbacks, workers) sees every
+// tenant. The zero scope sees nothing.
+type TenantScope struct {
+	Partner    string
+	KeyID      string
+	Connectors []string // empty allows every connector
+	Subjects   []string // empty allows every subject
+	hub        bool
+}
+
+// hubScope is the hub's own, unrestricted view
+var hubScope = TenantScope{hub: true}
+
+// partnerScope is a partner's whole tenant, as its public badge route sees it
+func partnerScope(partner string) TenantScope {
+	return TenantScope{Partner: partner}
+}
+
+func (t TenantScope) allowsConnector(id string) bool {
+	return t.hub || (t.Partner != "" && (len(t.Connectors) == 0 || contains(t.Connectors, id)))
+}
+
+func (t TenantScope) allowsSubject(subject string) bool {
+	return t.hub || (t.Partner != "" && (len(t.Subjects) == 0 || contains(t.Subjects, subject)))
+}
+
+// covers reports whether a connection is within the scope
+func (t TenantScope) covers(conn Connection) bool {
+	return t.hub || (t.Partner != "" && conn.Partner == t.Partner &&
+		t.allowsConnector(conn.Connector) && t.allowsSubject(conn.Subject))
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// PartnerStore keeps the hub's partners and their API keys, which it only
+// knows by the hashes of their secrets
+type PartnerStore interface {
+	// CreatePartner returns ErrPartnerExists for a partner already onboarded
+	CreatePartner(ctx context.Context, partner Partner) error
+	GetPartner(ctx context.Context, id string) (Partner, error)
+	// ListPartners returns every partner, by ID
+	ListPartners(ctx context.Context) ([]Partner, error)
+	// CreateKey stores an API key under the hash of its secret, returning
+	// ErrPartnerNotFound when its partner is not onboarded
+	CreateKey(ctx context.Context, key PartnerKey, hash string) error
+	// Keys lists a partner's API keys, oldest first
+	Keys(ctx context.Context, partner string) ([]PartnerKey, error)
+	RevokeKey(ctx context.Context, partner, id string) error
+	// UseKey returns the API key whose secret has the hash, noting it was
+	// used at t
+	UseKey(ctx context.Context, hash string, at time.Time) (PartnerKey, error)
+}
+
+type partnerKeyEntry struct {
+	key  PartnerKey
+	hash string
+}
+
+// memoryPartnerStore keeps partners and their hashed API keys in memory
+// (production should use a shared database, so keys survive restarts)
+type memoryPartnerStore struct {
+	mu       sync.Mutex
+	partners map[string]Partner
+	keys     map[string]*partnerKeyEntry // by key ID
+	byHash   map[string]*partnerKeyEntry
+}
+
+func newMemoryPartnerStore() *memoryPartnerStore {
+	return &memoryPartnerStore{
+		partners: make(map[string]Partner),
+		keys:     make(map[string]*partnerKeyEntry),
+		byHash:   make(map[string]*partnerKeyEntry),
+	}
+}
+
+func (m *memoryPartnerStore) CreatePartner(_ context.Context, partner Partner) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.partners[partner.ID]; ok {
+		return ErrPartnerExists
+	}
+	m.partners[partner.ID] = partner
+	return nil
+}
+
+func (m *memoryPartnerStore) GetPartner(_ context.Context, id string) (Partner, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	partner, ok := m.partners[id]
+	if !ok {
+		return Partner{}, ErrPartnerNotFound
+	}
+	return partner, nil
+}
+
+func (m *memoryPartnerStore) ListPartners(context.Context) ([]Partner, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Partner, 0, len(m.partners))
+	for _, partner := range m.partners {
+		out = append(out, partner)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *memoryPartnerStore) CreateKey(_ context.Context, key PartnerKey, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.partners[key.Partner]; !ok {
+		return ErrPartnerNotFound
+	}
+	entry := &partnerKeyEntry{key: key, hash: hash}
+	m.keys[key.ID] = entry
+	m.byHash[hash] = entry
+	return nil
+}
+
+func (m *memoryPartnerStore) Keys(_ context.Context, partner string) ([]PartnerKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []PartnerKey{}
+	for _, entry := range m.keys {
+		if entry.key.Partner == partner {
+			out = append(out, entry.key)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+func (m *memoryPartnerStore) RevokeKey(_ context.Context, partner, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.keys[id]
+	if !ok || entry.key.Partner != partner {
+		return ErrPartnerKeyNotFound
+	}
+	delete(m.keys, id)
+	delete(m.byHash, entry.hash)
+	return nil
+}
+
+func (m *memoryPartnerStore) UseKey(_ context.Context, hash string, at time.Time) (PartnerKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.byHash[hash]
+	if !ok {
+		return PartnerKey{}, ErrPartnerKeyNotFound
+	}
+	used := at.UTC()
+	entry.key.LastUsedAt = &used
+	return entry.key, nil
+}
+
+// partnerRegistry onboards partners and issues and checks their API keys,
+// keeping them in its store
+type partnerRegistry struct {
+	store PartnerStore
+}
+
+func newPartnerRegistry(store PartnerStore) *partnerRegistry {
+	return &partnerRegistry{store: store}
+}
+
+func hashPartnerKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *partnerRegistry) Create(ctx context.Context, partner Partner) error {
+	return p.store.CreatePartner(ctx, partner)
+}
+
+func (p *partnerRegistry) Get(ctx context.Context, id string) (Partner, error) {
+	return p.store.GetPartner(ctx, id)
+}
+
+func (p *partnerRegistry) List(ctx context.Context) ([]Partner, error) {
+	return p.store.ListPartners(ctx)
+}
+
+// CreateKey issues an API key for a partner and returns it; only its hash
+// is kept
+func (p *partnerRegistry) CreateKey(ctx context.Context, key PartnerKey) (PartnerKey, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return PartnerKey{}, "", err
+	}
+	secret := partnerKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	key.ID = newID("key")
+	if err := p.store.CreateKey(ctx, key, hashPartnerKey(secret)); err != nil {
+		return PartnerKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// Keys lists a partner's API keys, oldest first
+func (p *partnerRegistry) Keys(ctx context.Context, partner string) ([]PartnerKey, error) {
+	return p.store.Keys(ctx, partner)
+}
+
+// RevokeKey deletes one of a partner's API keys
+func (p *partnerRegistry) RevokeKey(ctx context.Context, partner, id string) error {
+	return p.store.RevokeKey(ctx, partner, id)
+}
+
+// Authenticate returns the scope of the API key, noting its use; unknown
+// keys get ErrPartnerKeyNotFound
+func (p *partnerRegistry) Authenticate(ctx context.Context, secret string, now time.Time) (TenantScope, error) {
+	if !strings.HasPrefix(secret, partnerKeyPrefix) {
+		return TenantScope{}, ErrPartnerKeyNotFound
+	}
+	key, err := p.store.UseKey(ctx, hashPartnerKey(secret), now)
+	if err != nil {
+		return TenantScope{}, err
+	}
+	return TenantScope{
+		Partner:    key.Partner,
+		KeyID:      key.ID,
+		Connectors: key.Connectors,
+		Subjects:   key.Subjects,
+	}, nil
+}
+
+type scopeContextKey struct{}
+
+// scopeFromContext returns the caller's scope; requests that were not
+// authenticated have the zero scope, which sees nothing
+func scopeFromContext(ctx context.Context) TenantScope {
+	scope, _ := ctx.Value(scopeContextKey{}).(TenantScope)
+	return scope
+}
+
+// requireTenant guards the partner APIs: a partner API key scopes the
+// request to its tenant, and the operator token acts across tenants
+func (s *Server) requireTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := hubScope
+		if !s.authorizeOperator(r) {
+			_, secret, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			var err error
+			scope, err = s.partners.Authenticate(r.Context(), secret, time.Now())
+			if err != nil && !errors.Is(err, ErrPartnerKeyNotFound) {
+				log.Error().Err(err).Msg("Failed to check a partner API key")
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				log.Warn().Str("path", r.URL.Path).Msg("Request without a valid partner API key")
+				s.security.AuthFailure(r, "connector-hub")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="connector-hub"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeContextKey{}, scope)))
+	})
+}
+
+// writeTenantError answers a failed call on a tenant's data, auditing
+// attempts to reach outside the caller's scope. Another tenant's records
+// are reported as not found, so their IDs cannot be probed.
+func (s *Server) writeTenantError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrOutOfScope) {
+		scope := scopeFromContext(r.Context())
+		s.audit.Append(AuditEvent{
+			Type:      AuditAccessDenied,
+			Partner:   scope.Partner,
+			KeyID:     scope.KeyID,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Detail:    err.Error(),
+			Timestamp: time.Now().UTC(),
+		})
+		log.Warn().Str("partner", scope.Partner).Str("key_id", scope.KeyID).Str("method", r.Method).Str("path", r.URL.Path).Msg("Cross-tenant access rejected")
+	}
+	writeHubError(w, err)
+}
+
+// knownConnector reports whether id names an installed connector or an
+// OAuth platform
+func (s *Server) knownConnector(id string) bool {
+	if _, err := s.connectors.Get(id); err == nil {
+		return true
+	}
+	if s.oauth != nil {
+		_, ok := s.oauth.platforms[id]
+		return ok
+	}
+	return false
+}
+
+// OnboardPartnerRequest is the body of POST /partners
+type OnboardPartnerRequest struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Connectors []string `json:"connectors"`
+}
+
+func (s *Server) handleOnboardPartner(w http.ResponseWriter, r *http.Request) {
+	var req OnboardPartnerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !connectorIDPattern.MatchString(req.ID) {
+		http.Error(w, "id must be a lowercase dotted name, e.g. market.example", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Connectors) == 0 {
+		http.Error(w, "connectors must list at least one connector", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.Connectors {
+		if !s.knownConnector(id) {
+			http.Error(w, "unknown connector "+id, http.StatusBadRequest)
+			return
+		}
+	}
+	partner := Partner{ID: req.ID, Name: req.Name, Connectors: req.Connectors, CreatedAt: time.Now().UTC()}
+	if err := s.partners.Create(r.Context(), partner); err != nil {
+		if !errors.Is(err, ErrPartnerExists) {
+			log.Error().Err(err).Str("partner", partner.ID).Msg("Failed to onboard partner")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.audit.Append(AuditEvent{Type: AuditPartnerOnboarded, Partner: partner.ID, Method: r.Method, Path: r.URL.Path, Timestamp: partner.CreatedAt})
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeAdminAction, Action: "partner.onboarded", Actor: "operator", Target: partner.ID})
+	log.Info().Str("partner", partner.ID).Strs("connectors", partner.Connectors).Msg("Partner onboarded")
+	w.Header().Set("Location", "/partners/"+partner.ID)
+	writeJSON(w, http.StatusCreated, partner)
+}
+
+func (s *Server) handleListPartners(w http.ResponseWriter, r *http.Request) {
+	partners, err := s.partners.List(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list partners")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"partners": partners})
+}
+
+// partnerFromPath returns the partner the path names, answering the
+// request itself when there is none
+func (s *Server) partnerFromPath(w http.ResponseWriter, r *http.Request) (Partner, bool) {
+	partner, err := s.partners.Get(r.Context(), chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, ErrPartnerNotFound):
+		http.Error(w, "Partner not found", http.StatusNotFound)
+		return Partner{}, false
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to read partner")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return Partner{}, false
+	}
+	return partner, true
+}
+
+func (s *Server) handleGetPartner(w http.ResponseWriter, r *http.Request) {
+	partner, ok := s.partnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, partner)
+}
+
+// CreateKeyRequest is the body of POST /partners/{id}/keys. Connectors
+// default to all of the partner's.
+type CreateKeyRequest struct {
+	Name       string   `json:"name,omitempty"`
+	Connectors []string `json:"connectors,omitempty"`
+	Subjects   []string `json:"subjects,omitempty"`
+}
+
+// CreateKeyResponse carries the API key, which is only ever shown once
+type CreateKeyResponse struct {
+	PartnerKey
+	APIKey string `json:"apiKey"`
+}
+
+func (s *Server) handleCreatePartnerKey(w http.ResponseWriter, r *http.Request) {
+	partner, ok := s.partnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req CreateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	connectors := req.Connectors
+	if len(connectors) == 0 {
+		connectors = partner.Connectors
+	}
+	for _, id := range connectors {
+		if !contains(partner.Connectors, id) {
+			http.Error(w, "connector "+id+" is not one of the partner's", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, subject := range req.Subjects {
+		if strings.TrimSpace(subject) == "" {
+			http.Error(w, "subjects must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, secret, err := s.partners.CreateKey(r.Context(), PartnerKey{
+		Partner:    partner.ID,
+		Name:       req.Name,
+		Connectors: connectors,
+		Subjects:   req.Subjects,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("partner", partner.ID).Msg("Failed to create partner API key")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.audit.Append(AuditEvent{Type: AuditKeyCreated, Partner: partner.ID, KeyID: key.ID, Method: r.Method, Path: r.URL.Path, Timestamp: key.CreatedAt})
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeAdminAction, Action: "partner_key.created", Actor: "operator", Target: partner.ID + "/" + key.ID})
+	log.Info().Str("partner", partner.ID).Str("key_id", key.ID).Strs("connectors", key.Connectors).Int("subject_count", len(key.Subjects)).Msg("Partner API key created")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, CreateKeyResponse{PartnerKey: key, APIKey: secret})
+}
+
+func (s *Server) handleListPartnerKeys(w http.ResponseWriter, r *http.Request) {
+	partner, ok := s.partnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	keys, err := s.partners.Keys(r.Context(), partner.ID)
+	if err != nil {
+		log.Error().Err(err).Str("partner", partner.ID).Msg("Failed to list partner API keys")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func (s *Server) handleRevokePartnerKey(w http.ResponseWriter, r *http.Request) {
+	partner, keyID := chi.URLParam(r, "id"), chi.URLParam(r, "keyId")
+	if err := s.partners.RevokeKey(r.Context(), partner, keyID); err != nil {
+		if !errors.Is(err, ErrPartnerKeyNotFound) {
+			log.Error().Err(err).Str("partner", partner).Str("key_id", keyID).Msg("Failed to revoke partner API key")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	s.audit.Append(AuditEvent{Type: AuditKeyRevoked, Partner: partner, KeyID: keyID, Method: r.Method, Path: r.URL.Path, Timestamp: time.Now().UTC()})
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeRevocation, Action: "partner_key.revoked", Actor: "operator", Target: partner + "/" + keyID})
+	log.Info().Str("partner", partner).Str("key_id", keyID).Msg("Partner API key revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
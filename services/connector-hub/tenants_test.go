@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// onboardPartner onboards a partner for every installed connector unless
+// already onboarded, and returns a header carrying a new API key for it
+func onboardPartner(t *testing.T, server *Server, id string, key CreateKeyRequest) map[string]string {
+	t.Helper()
+	if server.operatorToken == "" {
+		server.operatorToken = testOperatorToken
+	}
+	if _, err := server.partners.Get(context.Background(), id); err != nil {
+		connectors := []string{}
+		for _, connector := range server.connectors.List() {
+			connectors = append(connectors, connector.ID)
+		}
+		if server.oauth != nil {
+			for name := range server.oauth.platforms {
+				connectors = append(connectors, name)
+			}
+		}
+		w := hubRequest(t, server, http.MethodPost, "/partners", OnboardPartnerRequest{ID: id, Name: id, Connectors: connectors}, operatorHeader)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	w := hubRequest(t, server, http.MethodPost, "/partners/"+id+"/keys", key, operatorHeader)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created CreateKeyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.True(t, strings.HasPrefix(created.APIKey, partnerKeyPrefix))
+	return map[string]string{"Authorization": "Bearer " + created.APIKey}
+}
+
+// connect links a subject and reports the status and the new connection
+func connect(t *testing.T, server *Server, connector string, req ConnectRequest, header map[string]string) *connectResult {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodPost, "/connectors/"+connector+"/connections", req, header)
+	result := &connectResult{Code: w.Code}
+	if w.Code == http.StatusCreated {
+		var created ConnectResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		result.Connection = created.Connection
+	}
+	return result
+}
+
+type connectResult struct {
+	Code       int
+	Connection Connection
+}
+
+func listConnections(t *testing.T, server *Server, query string, header map[string]string) []Connection {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodGet, "/connections"+query, nil, header)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed struct {
+		Connections []Connection `json:"connections"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	return listed.Connections
+}
+
+func deniedAudit(t *testing.T, server *Server, partner string) []AuditEvent {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodGet, "/audit?type="+AuditAccessDenied+"&partner="+partner, nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var audit struct {
+		Events []AuditEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &audit))
+	return audit.Events
+}
+
+func TestTenants_Isolation(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "gig.fake"}))
+	market := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	w := hubRequest(t, server, http.MethodPost, "/partners", OnboardPartnerRequest{ID: "gig.other", Name: "Gig Other", Connectors: []string{"gig.fake"}}, operatorHeader)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	gig := onboardPartner(t, server, "gig.other", CreateKeyRequest{})
+
+	alice := connect(t, server, "market.fake", ConnectRequest{Subject: "did:key:alice"}, market)
+	require.Equal(t, http.StatusCreated, alice.Code)
+	assert.Equal(t, "market.fake", alice.Connection.Partner)
+	bob := connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:bob"}, gig)
+	require.Equal(t, http.StatusCreated, bob.Code)
+
+	// Each partner sees its own connections only
+	assert.Equal(t, []Connection{alice.Connection}, listConnections(t, server, "", market))
+	assert.Empty(t, listConnections(t, server, "?subject=did:key:alice", gig))
+	assert.Equal(t, []Connection{bob.Connection}, listConnections(t, server, "", gig))
+	// Operators see every tenant
+	assert.Len(t, listConnections(t, server, "", operatorHeader), 2)
+
+	// Another tenant's connection does not exist for the caller
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/connections/"+alice.Connection.ID, nil, gig).Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodPost, "/connections/"+alice.Connection.ID+"/verifications", VerificationRequest{Pack: "pack.safe.seller"}, gig).Code)
+	// Nor can a partner link through a connector it was not granted, or for
+	// another partner
+	assert.Equal(t, http.StatusForbidden, connect(t, server, "market.fake", ConnectRequest{Subject: "did:key:bob"}, gig).Code)
+	assert.Equal(t, http.StatusForbidden, connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:bob", Partner: "market.fake"}, gig).Code)
+	assert.Equal(t, http.StatusForbidden, hubRequest(t, server, http.MethodGet, "/connections?connector=market.fake", nil, gig).Code)
+	// Badges only show subjects linked to the partner asking
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/partners/gig.other/subjects/did:key:alice/badge", nil, nil).Code)
+
+	// Each attempt was audited against the partner that made it
+	denied := deniedAudit(t, server, "gig.other")
+	require.Len(t, denied, 5)
+	assert.Equal(t, http.MethodGet, denied[len(denied)-1].Method)
+	assert.Equal(t, "/connections/"+alice.Connection.ID, denied[len(denied)-1].Path)
+	assert.NotEmpty(t, denied[0].KeyID)
+	assert.Empty(t, deniedAudit(t, server, "market.fake"))
+
+	// Operators may link on a partner's behalf
+	carol := connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:carol", Partner: "gig.other"}, operatorHeader)
+	require.Equal(t, http.StatusCreated, carol.Code)
+	assert.Len(t, listConnections(t, server, "", gig), 2)
+	assert.Equal(t, http.StatusBadRequest, connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:carol", Partner: "gig.unknown"}, operatorHeader).Code)
+}
+
+func TestTenants_ScopedKeys(t *testing.T) {
+	server := NewServer()
+	trail := audit.NewMemory()
+	var err error
+	server.security, err = audit.New("connector-hub", trail, nil)
+	require.NoError(t, err)
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "gig.fake"}))
+	full := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	scoped := onboardPartner(t, server, "market.fake", CreateKeyRequest{Name: "storefront", Connectors: []string{"market.fake"}, Subjects: []string{"did:key:alice"}})
+
+	require.Equal(t, http.StatusCreated, connect(t, server, "market.fake", ConnectRequest{Subject: "did:key:alice"}, scoped).Code)
+	bob := connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:bob"}, full)
+	require.Equal(t, http.StatusCreated, bob.Code)
+
+	// The scoped key reaches neither other subjects nor other connectors
+	assert.Equal(t, http.StatusForbidden, connect(t, server, "market.fake", ConnectRequest{Subject: "did:key:bob"}, scoped).Code)
+	assert.Equal(t, http.StatusForbidden, connect(t, server, "gig.fake", ConnectRequest{Subject: "did:key:alice"}, scoped).Code)
+	assert.Equal(t, http.StatusForbidden, hubRequest(t, server, http.MethodGet, "/connections?subject=did:key:bob", nil, scoped).Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodGet, "/connections/"+bob.Connection.ID, nil, scoped).Code)
+	assert.Len(t, listConnections(t, server, "", scoped), 1)
+	assert.Len(t, listConnections(t, server, "", full), 2)
+	assert.Len(t, deniedAudit(t, server, "market.fake"), 4)
+
+	// Keys are listed without their secret, and stop working once revoked
+	w := hubRequest(t, server, http.MethodGet, "/partners/market.fake/keys", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var keys struct {
+		Keys []PartnerKey `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	require.Len(t, keys.Keys, 2)
+	assert.NotContains(t, w.Body.String(), strings.TrimPrefix(scoped["Authorization"], "Bearer "))
+	assert.Equal(t, []string{"did:key:alice"}, keys.Keys[1].Subjects)
+	assert.NotNil(t, keys.Keys[1].LastUsedAt)
+
+	w = hubRequest(t, server, http.MethodDelete, "/partners/market.fake/keys/"+keys.Keys[1].ID, nil, operatorHeader)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodGet, "/connections", nil, scoped).Code)
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodGet, "/connections", nil, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodGet, "/connections", nil, map[string]string{"Authorization": "Bearer chk_forged"}).Code)
+	assert.Equal(t, http.StatusOK, hubRequest(t, server, http.MethodGet, "/connections", nil, full).Code)
+
+	w = hubRequest(t, server, http.MethodGet, "/audit?partner=market.fake", nil, operatorHeader)
+	var partnerAudit struct {
+		Events []AuditEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &partnerAudit))
+	assert.Equal(t, AuditKeyRevoked, partnerAudit.Events[0].Type)
+
+	// The security audit trail keeps the onboarding, keys and refusals
+	events, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Type+" "+event.Action)
+	}
+	assert.Equal(t, []string{
+		"admin.action partner.onboarded",
+		"admin.action partner_key.created",
+		"admin.action partner_key.created",
+		"revocation partner_key.revoked",
+		"auth.failure GET /connections",
+		"auth.failure GET /connections",
+		"auth.failure GET /connections",
+	}, actions)
+	assert.Equal(t, "market.fake/"+keys.Keys[1].ID, events[3].Target)
+}
+
+func TestTenants_OnboardingValidation(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "gig.fake"}))
+
+	for name, req := range map[string]OnboardPartnerRequest{
+		"bad id":            {ID: "Market Fake", Name: "Market", Connectors: []string{"market.fake"}},
+		"no name":           {ID: "market.fake", Connectors: []string{"market.fake"}},
+		"no connectors":     {ID: "market.fake", Name: "Market"},
+		"unknown connector": {ID: "market.fake", Name: "Market", Connectors: []string{"market.unknown"}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, hubRequest(t, server, http.MethodPost, "/partners", req, operatorHeader).Code, name)
+	}
+	valid := OnboardPartnerRequest{ID: "market.fake", Name: "Market", Connectors: []string{"market.fake"}}
+	assert.Equal(t, http.StatusUnauthorized, hubRequest(t, server, http.MethodPost, "/partners", valid, nil).Code)
+	require.Equal(t, http.StatusCreated, hubRequest(t, server, http.MethodPost, "/partners", valid, operatorHeader).Code)
+	assert.Equal(t, http.StatusConflict, hubRequest(t, server, http.MethodPost, "/partners", valid, operatorHeader).Code)
+
+	// Keys are scoped within the partner's connectors
+	assert.Equal(t, http.StatusBadRequest, hubRequest(t, server, http.MethodPost, "/partners/market.fake/keys", CreateKeyRequest{Connectors: []string{"gig.fake"}}, operatorHeader).Code)
+	assert.Equal(t, http.StatusBadRequest, hubRequest(t, server, http.MethodPost, "/partners/market.fake/keys", CreateKeyRequest{Subjects: []string{" "}}, operatorHeader).Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodPost, "/partners/gig.fake/keys", CreateKeyRequest{}, operatorHeader).Code)
+	assert.Equal(t, http.StatusNotFound, hubRequest(t, server, http.MethodDelete, "/partners/market.fake/keys/key_missing", nil, operatorHeader).Code)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrTokenNotFound = errors.New("no platform token for the connection")
+
+// OAuthToken is a platform's grant for one connection. It only exists in
+// memory; at rest it is sealed in the hub's secret box.
+type OAuthToken struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	TokenType    string    `json:"tokenType,omitempty"`
+	Scope        string    `json:"scope,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt,omitempty"` // zero when the platform gave no lifetime
+}
+
+// String keeps tokens out of logs and error messages
+func (t OAuthToken) String() string {
+	return "OAuthToken{redacted}"
+}
+
+// GoString keeps tokens out of %#v
+func (t OAuthToken) GoString() string {
+	return t.String()
+}
+
+// SealedToken is an OAuthToken encrypted for storage. ExpiresAt stays in
+// the clear so expiring tokens can be found without decrypting them all.
+type SealedToken struct {
+	ConnectionID string       `json:"connectionId"`
+	Platform     string       `json:"platform"`
+	Secret       SealedSecret `json:"secret"` // the token as JSON
+	ExpiresAt    time.Time    `json:"expiresAt"`
+	Refreshable  bool         `json:"refreshable"`
+	UpdatedAt    time.Time    `json:"updatedAt"`
+}
+
+// TokenStore persists sealed platform tokens, one per connection
+type TokenStore interface {
+	Get(ctx context.Context, connectionID string) (SealedToken, error)
+	Put(ctx context.Context, token SealedToken) error
+	Delete(ctx context.Context, connectionID string) error
+	// Update applies fn to the stored token atomically; fn's error aborts it
+	Update(ctx context.Context, connectionID string, fn func(*SealedToken) error) error
+	// List returns every token, for key rotation
+	List(ctx context.Context) ([]SealedToken, error)
+	// ExpiringBefore lists refreshable tokens expiring before t
+	ExpiringBefore(ctx context.Context, t time.Time) ([]SealedToken, error)
+}
+
+// memoryTokenStore keeps sealed tokens in memory (production should use a
+// shared database, so linked accounts survive restarts)
+type memoryTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]SealedToken
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{tokens: make(map[string]SealedToken)}
+}
+
+func (m *memoryTokenStore) Get(ctx context.Context, connectionID string) (SealedToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	token, ok := m.tokens[connectionID]
+	if !ok {
+		return SealedToken{}, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (m *memoryTokenStore) Put(ctx context.Context, token SealedToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[token.ConnectionID] = token
+	return nil
+}
+
+func (m *memoryTokenStore) Delete(ctx context.Context, connectionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, connectionID)
+	return nil
+}
+
+func (m *memoryTokenStore) Update(ctx context.Context, connectionID string, fn func(*SealedToken) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[connectionID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	if err := fn(&token); err != nil {
+		return err
+	}
+	m.tokens[connectionID] = token
+	return nil
+}
+
+func (m *memoryTokenStore) List(ctx context.Context) ([]SealedToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]SealedToken, 0, len(m.tokens))
+	for _, token := range m.tokens {
+		out = append(out, token)
+	}
+	return out, nil
+}
+
+func (m *memoryTokenStore) ExpiringBefore(ctx context.Context, t time.Time) ([]SealedToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []SealedToken
+	for _, token := range m.tokens {
+		if token.Refreshable && !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(t) {
+			out = append(out, token)
+		}
+	}
+	return out, nil
+}
+
+// tokenAAD binds a sealed token to its connection
+func tokenAAD(connectionID string) string {
+	return "oauth-token:" + connectionID
+}
+
+// sealToken encrypts a platform's grant for storage
+func sealToken(ctx context.Context, box *secretBox, connectionID, platform string, token OAuthToken, now time.Time) (SealedToken, error) {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return SealedToken{}, err
+	}
+	defer wipe(plaintext)
+	secret, err := box.Seal(ctx, tokenAAD(connectionID), plaintext)
+	if err != nil {
+		return SealedToken{}, err
+	}
+	return SealedToken{
+		ConnectionID: connectionID,
+		Platform:     platform,
+		Secret:       secret,
+		ExpiresAt:    token.ExpiresAt,
+		Refreshable:  token.RefreshToken != "",
+		UpdatedAt:    now,
+	}, nil
+}
+
+func openToken(ctx context.Context, box *secretBox, sealed SealedToken) (OAuthToken, error) {
+	plaintext, err := box.Open(ctx, tokenAAD(sealed.ConnectionID), sealed.Secret)
+	if err != nil {
+		return OAuthToken{}, fmt.Errorf("opening token for %s: %w", sealed.ConnectionID, err)
+	}
+	defer wipe(plaintext)
+	var token OAuthToken
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return OAuthToken{}, err
+	}
+	return token, nil
+}
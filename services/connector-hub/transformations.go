@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// maxTransformTemplate caps a transformation's template
+const maxTransformTemplate = 64 << 10
+
+// ErrTransform means a transformation could not render an event
+var ErrTransform = errors.New("transformation failed")
+
+// errOutputLimit stops a template writing more than a webhook body may hold
+var errOutputLimit = errors.New("output exceeds 1 MiB")
+
+// Transformation reshapes the webhook events of a connector's connections
+// into the partner's own payload before they are signed and delivered.
+// Template is a Go text/template executed against the event as it would be
+// sent, by its JSON field names ({{.subject}}, {{.data.status}}); its
+// output must be JSON. The json function renders any value as JSON, null
+// for absent fields.
+type Transformation struct {
+	Connector string    `json:"connector"`
+	Template  string    `json:"template"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	tmpl *template.Template
+}
+
+// parseTransformation compiles a template for connector
+func parseTransformation(connector, text string) (Transformation, error) {
+	if strings.TrimSpace(text) == "" {
+		return Transformation{}, fmt.Errorf("%w: template is required", ErrTransform)
+	}
+	if len(text) > maxTransformTemplate {
+		return Transformation{}, fmt.Errorf("%w: template exceeds 64 KiB", ErrTransform)
+	}
+	tmpl, err := template.New(connector).Funcs(template.FuncMap{"json": templateJSON}).Parse(text)
+	if err != nil {
+		return Transformation{}, fmt.Errorf("%w: %v", ErrTransform, err)
+	}
+	return Transformation{Connector: connector, Template: text, tmpl: tmpl}, nil
+}
+
+func templateJSON(value interface{}) (string, error) {
+	raw, err := json.Marshal(value)
+	return string(raw), err
+}
+
+// Apply renders a canonical webhook payload into the partner's shape
+func (t Transformation) Apply(payload json.RawMessage) (json.RawMessage, error) {
+	var event interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTransform, err)
+	}
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&limitedWriter{w: &out, remaining: maxEventBody}, event); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTransform, err)
+	}
+	if !json.Valid(out.Bytes()) {
+		return nil, fmt.Errorf("%w: output is not JSON", ErrTransform)
+	}
+	return out.Bytes(), nil
+}
+
+// limitedWriter fails writes past its remaining bytes
+type limitedWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.remaining {
+		return 0, errOutputLimit
+	}
+	l.remaining -= len(p)
+	return l.w.Write(p)
+}
+
+// transformStore holds connectors' transformations in memory (production
+// should use a shared database)
+type transformStore struct {
+	mu         sync.RWMutex
+	transforms map[string]Transformation
+}
+
+func newTransformStore() *transformStore {
+	return &transformStore{transforms: make(map[string]Transformation)}
+}
+
+func (t *transformStore) Put(transform Transformation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transforms[transform.Connector] = transform
+}
+
+func (t *transformStore) Get(connector string) (Transformation, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	transform, ok := t.transforms[connector]
+	return transform, ok
+}
+
+func (t *transformStore) Delete(connector string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.transforms[connector]
+	delete(t.transforms, connector)
+	return ok
+}
+
+// samplePayload is the event transformations are tried against when no
+// event is given
+func samplePayload(connector string) json.RawMessage {
+	payload, _ := json.Marshal(WebhookEvent{
+		ID:              "evt_sample",
+		Type:            EventBadgeStatusChanged,
+		CreatedAt:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Subject:         "did:key:z6MkSample",
+		Connection:      "conn_sample",
+		ExternalAccount: connector + "-account",
+		Data:            json.RawMessage(`{"badge":"pack.safe.seller","label":"Verified Seller","status":"active"}`),
+	})
+	return payload
+}
+
+// TransformationRequest is the body of PUT /connectors/{id}/transformation
+type TransformationRequest struct {
+	Template string `json:"template"`
+}
+
+// handlePutTransformation sets a connector's transformation once it renders
+// the sample event; later deliveries, retries included, are sent through it
+func (s *Server) handlePutTransformation(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := s.connectors.Get(id); err != nil {
+		writeHubError(w, err)
+		return
+	}
+	var req TransformationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEventBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	transform, err := parseTransformation(id, req.Template)
+	if err == nil {
+		_, err = transform.Apply(samplePayload(id))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	transform.UpdatedAt = time.Now().UTC()
+	s.transforms.Put(transform)
+	log.Info().Str("connector", id).Msg("Webhook transformation set")
+	writeJSON(w, http.StatusOK, transform)
+}
+
+func (s *Server) handleGetTransformation(w http.ResponseWriter, r *http.Request) {
+	transform, ok := s.transforms.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Transformation not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, transform)
+}
+
+// handleDeleteTransformation sends the connector's events in the canonical
+// shape again
+func (s *Server) handleDeleteTransformation(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !s.transforms.Delete(id) {
+		http.Error(w, "Transformation not found", http.StatusNotFound)
+		return
+	}
+	log.Info().Str("connector", id).Msg("Webhook transformation removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TransformationTestRequest is the body of POST
+// /connectors/{id}/transformation/test. Template defaults to the
+// connector's transformation and Event to a sample badge event.
+type TransformationTestRequest struct {
+	Template string          `json:"template,omitempty"`
+	Event    json.RawMessage `json:"event,omitempty"`
+}
+
+// handleTestTransformation renders an event as the partner would receive
+// it, without storing or delivering anything
+func (s *Server) handleTestTransformation(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := s.connectors.Get(id); err != nil {
+		writeHubError(w, err)
+		return
+	}
+	var req TransformationTestRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEventBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	transform, ok := s.transforms.Get(id)
+	if req.Template != "" {
+		var err error
+		if transform, err = parseTransformation(id, req.Template); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	} else if !ok {
+		http.Error(w, "template is required: the connector has no transformation", http.StatusBadRequest)
+		return
+	}
+	event := req.Event
+	if len(event) == 0 {
+		event = samplePayload(id)
+	}
+	payload, err := transform.Apply(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"payload": payload})
+}
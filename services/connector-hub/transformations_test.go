@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const partnerTemplate = `{"user": {{json .externalAccount}}, "event": "cachet.{{.type}}", "verified": {{if eq .data.status "active"}}true{{else}}false{{end}}}`
+
+func TestTransformation_ReshapesDeliveries(t *testing.T) {
+	server, receiver, endpoint := newWebhookTestServer(t)
+
+	w := hubRequest(t, server, http.MethodPut, "/connectors/market.fake/transformation", TransformationRequest{Template: partnerTemplate}, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/transformation", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stored Transformation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stored))
+	assert.Equal(t, partnerTemplate, stored.Template)
+
+	queued := publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+	require.Len(t, queued, 1)
+	assert.Equal(t, "market.fake", queued[0].Connector)
+	now := time.Now().UTC()
+	server.drainDeliveries(context.Background(), now)
+	require.Len(t, receiver.bodies, 1)
+	body := receiver.bodies[0]
+	assert.JSONEq(t, `{"user":"seller-did:key:z6MkSeller","event":"cachet.badge.status_changed","verified":true}`, string(body))
+	// The partner checks the signature over what it received
+	assert.Equal(t, SignWebhook([]byte(endpoint.Secret), body, now), receiver.received[0].Header.Get(WebhookSignatureHeader))
+
+	// Without it, partners get the canonical event again
+	w = hubRequest(t, server, http.MethodDelete, "/connectors/market.fake/transformation", nil, operatorHeader)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+	server.drainDeliveries(context.Background(), time.Now().UTC())
+	require.Len(t, receiver.bodies, 2)
+	var event WebhookEvent
+	require.NoError(t, json.Unmarshal(receiver.bodies[1], &event))
+	assert.Equal(t, "did:key:z6MkSeller", event.Subject)
+}
+
+func TestTransformation_RejectsBrokenTemplates(t *testing.T) {
+	server, _, _ := newWebhookTestServer(t)
+
+	for _, template := range []string{"", `{"user": {{.externalAccount}`, `{"user": {{.externalAccount}}}`, `{{template "missing"}}`} {
+		w := hubRequest(t, server, http.MethodPut, "/connectors/market.fake/transformation", TransformationRequest{Template: template}, operatorHeader)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, template)
+	}
+	w := hubRequest(t, server, http.MethodPut, "/connectors/market.unknown/transformation", TransformationRequest{Template: partnerTemplate}, operatorHeader)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = hubRequest(t, server, http.MethodPut, "/connectors/market.fake/transformation", TransformationRequest{Template: partnerTemplate}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = hubRequest(t, server, http.MethodGet, "/connectors/market.fake/transformation", nil, operatorHeader)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTransformation_DryRun(t *testing.T) {
+	server, receiver, _ := newWebhookTestServer(t)
+	dryRun := func(req TransformationTestRequest) (int, json.RawMessage) {
+		w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/transformation/test", req, operatorHeader)
+		var body struct {
+			Payload json.RawMessage `json:"payload"`
+		}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		}
+		return w.Code, body.Payload
+	}
+
+	code, payload := dryRun(TransformationTestRequest{Template: partnerTemplate})
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"user":"market.fake-account","event":"cachet.badge.status_changed","verified":true}`, string(payload))
+
+	code, _ = dryRun(TransformationTestRequest{})
+	assert.Equal(t, http.StatusBadRequest, code, "no template and none stored")
+
+	// The stored transformation, on an event of the caller's
+	require.Equal(t, http.StatusOK, hubRequest(t, server, http.MethodPut, "/connectors/market.fake/transformation", TransformationRequest{Template: partnerTemplate}, operatorHeader).Code)
+	code, payload = dryRun(TransformationTestRequest{Event: json.RawMessage(`{"type":"verification.status_changed","data":{"status":"failed"}}`)})
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"user":null,"event":"cachet.verification.status_changed","verified":false}`, string(payload))
+	code, _ = dryRun(TransformationTestRequest{Event: json.RawMessage(`{"type":"verification.status_changed","data":"failed"}`)})
+	assert.Equal(t, http.StatusUnprocessableEntity, code, "data the template cannot read")
+
+	assert.Empty(t, receiver.bodies, "dry runs deliver nothing")
+	assert.Empty(t, server.deliveries.List("", ""))
+}
+
+func TestTransformation_FailureDeadLettersUntilFixed(t *testing.T) {
+	server, receiver, _ := newWebhookTestServer(t)
+	// A template that renders badge statuses unquoted, which PUT would refuse
+	server.transforms.Put(mustParseTransformation(t, "market.fake", `{"state": {{.data.status}}}`))
+
+	queued := publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+	require.Len(t, queued, 1)
+	now := time.Now().UTC()
+	server.drainDeliveries(context.Background(), now)
+	assert.Empty(t, receiver.bodies)
+	delivery, err := server.deliveries.Get(queued[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDeadLettered, delivery.Status, "a template error does not recover by retrying")
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Contains(t, delivery.LastError, ErrTransform.Error())
+
+	// Once the template is fixed, the redriven delivery goes through it
+	fixed := TransformationRequest{Template: `{"state": {{json .data.status}}}`}
+	require.Equal(t, http.StatusOK, hubRequest(t, server, http.MethodPut, "/connectors/market.fake/transformation", fixed, operatorHeader).Code)
+	require.Equal(t, http.StatusAccepted, hubRequest(t, server, http.MethodPost, "/webhooks/dead-letters/"+queued[0].ID+"/redrive", nil, operatorHeader).Code)
+	server.drainDeliveries(context.Background(), time.Now().UTC())
+	require.Len(t, receiver.bodies, 1)
+	assert.JSONEq(t, `{"state":"active"}`, string(receiver.bodies[0]))
+}
+
+func mustParseTransformation(t *testing.T, connector, text string) Transformation {
+	t.Helper()
+	transform, err := parseTransformation(connector, text)
+	require.NoError(t, err)
+	return transform
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deliveryMaxAttempts    = 8
+	deliveryBaseBackoff    = 2 * time.Second
+	deliveryMaxBackoff     = 10 * time.Minute
+	deliveryWorkerInterval = time.Second
+	deliveryTimeout        = 10 * time.Second
+	// deliveryRetention is how long delivered events stay queryable
+	deliveryRetention = 72 * time.Hour
+
+	// WebhookSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC-SHA256>"
+	// over "<t>.<body>", the scheme the verifier signs its callbacks with
+	WebhookSignatureHeader = "Cachet-Signature"
+	WebhookIDHeader        = "Cachet-Webhook-Id"
+	WebhookEventHeader     = "Cachet-Event"
+
+	EventBadgeStatusChanged        = "badge.status_changed"
+	EventVerificationStatusChanged = "verification.status_changed"
+)
+
+// Delivery states
+const (
+	DeliveryStatusPending      = "pending"
+	DeliveryStatusDelivered    = "delivered"
+	DeliveryStatusDeadLettered = "dead_lettered"
+)
+
+var (
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+	webhookDeliveries = expvar.NewMap("partner_webhooks_total")
+)
+
+func validEventType(eventType string) bool {
+	switch eventType {
+	case EventBadgeStatusChanged, EventVerificationStatusChanged:
+		return true
+	}
+	return false
+}
+
+// WebhookEndpoint is where a partner platform receives events about the
+// subjects linked to it. The secret is only shown when it is registered;
+// it is stored sealed.
+type WebhookEndpoint struct {
+	ID        string    `json:"id"`
+	Partner   string    `json:"partner"` // the onboarded partner it belongs to
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// subscribes reports whether the endpoint takes events of the given type
+func (e WebhookEndpoint) subscribes(eventType string) bool {
+	for _, subscribed := range e.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSecretAAD binds a sealed signing secret to its endpoint
+func webhookSecretAAD(endpointID string) string {
+	return "webhook-secret:" + endpointID
+}
+
+// storedEndpoint is an endpoint as stored: its signing secret is sealed
+type storedEndpoint struct {
+	endpoint WebhookEndpoint
+	secret   SealedSecret
+}
+
+// endpointStore holds partner endpoints in memory (production should use a
+// shared database)
+type endpointStore struct {
+	mu        sync.RWMutex
+	endpoints map[string]storedEndpoint
+}
+
+func newEndpointStore() *endpointStore {
+	return &endpointStore{endpoints: make(map[string]storedEndpoint)}
+}
+
+// Put stores an endpoint without its plaintext secret
+func (e *endpointStore) Put(endpoint WebhookEndpoint, secret SealedSecret) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	endpoint.Secret = ""
+	e.endpoints[endpoint.ID] = storedEndpoint{endpoint: endpoint, secret: secret}
+}
+
+func (e *endpointStore) Get(id string) (WebhookEndpoint, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	stored, ok := e.endpoints[id]
+	return stored.endpoint, ok
+}
+
+// Secret returns an endpoint's sealed signing secret
+func (e *endpointStore) Secret(id string) (SealedSecret, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	stored, ok := e.endpoints[id]
+	return stored.secret, ok
+}
+
+// ReplaceSecret swaps an endpoint's sealed secret if it is still old, so
+// a rewrap never overwrites a newer secret
+func (e *endpointStore) ReplaceSecret(id string, old, secret SealedSecret) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stored, ok := e.endpoints[id]
+	if !ok || !bytes.Equal(stored.secret.WrappedKey, old.WrappedKey) {
+		return false
+	}
+	stored.secret = secret
+	e.endpoints[id] = stored
+	return true
+}
+
+// Secrets lists every endpoint's sealed secret, by endpoint id
+func (e *endpointStore) Secrets() map[string]SealedSecret {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	out := make(map[string]SealedSecret, len(e.endpoints))
+	for id, stored := range e.endpoints {
+		out[id] = stored.secret
+	}
+	return out
+}
+
+func (e *endpointStore) Delete(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.endpoints[id]
+	delete(e.endpoints, id)
+	return ok
+}
+
+// List returns a partner's endpoints, or every endpoint, oldest first
+func (e *endpointStore) List(partner string) []WebhookEndpoint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	out := []WebhookEndpoint{}
+	for _, stored := range e.endpoints {
+		if partner == "" || stored.endpoint.Partner == partner {
+			out = append(out, stored.endpoint)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// WebhookEvent is the body POSTed to a partner's endpoint. Partners match
+// it to their user by connection or externalAccount; the subject's DID is
+// included for partners that store it.
+type WebhookEvent struct {
+	ID              string          `json:"id"`
+	Type            string          `json:"type"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	Subject         string          `json:"subject"`
+	Connection      string          `json:"connection"`
+	ExternalAccount string          `json:"externalAccount,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// WebhookDelivery is one event on its way to one endpoint. Payload is the
+// canonical event; the connector's transformation, if any, reshapes it when
+// it is sent.
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpointId"`
+	Partner        string          `json:"partner"`
+	Connector      string          `json:"connector,omitempty"`
+	EventID        string          `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	NextAttempt    time.Time       `json:"nextAttempt,omitempty"`
+	LastAttemptAt  time.Time       `json:"lastAttemptAt,omitempty"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	DeliveredAt    time.Time       `json:"deliveredAt,omitempty"`
+
+	inFlight bool
+}
+
+// deliveryQueue holds deliveries in memory (production should use a durable
+// queue so deliveries survive restarts). Delivered entries are kept for
+// deliveryRetention so partners can check on them.
+type deliveryQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]*WebhookDelivery
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{deliveries: make(map[string]*WebhookDelivery)}
+}
+
+func (q *deliveryQueue) Enqueue(delivery WebhookDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deliveries[delivery.ID] = &delivery
+}
+
+// Claim returns the oldest pending delivery that is due and marks it in flight
+func (q *deliveryQueue) Claim(now time.Time) (WebhookDelivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *WebhookDelivery
+	for _, delivery := range q.deliveries {
+		if delivery.inFlight || delivery.Status != DeliveryStatusPending || delivery.NextAttempt.After(now) {
+			continue
+		}
+		if next == nil || delivery.CreatedAt.Before(next.CreatedAt) {
+			next = delivery
+		}
+	}
+	if next == nil {
+		return WebhookDelivery{}, false
+	}
+	next.inFlight = true
+	return *next, true
+}
+
+// Succeed marks a delivery delivered
+func (q *deliveryQueue) Succeed(id string, statusCode int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if delivery, ok := q.deliveries[id]; ok {
+		delivery.inFlight = false
+		delivery.Attempts++
+		delivery.Status = DeliveryStatusDelivered
+		delivery.LastAttemptAt, delivery.DeliveredAt = now, now
+		delivery.LastStatusCode, delivery.LastError = statusCode, ""
+		delivery.NextAttempt = time.Time{}
+	}
+}
+
+// Fail schedules a retry with exponential backoff, or dead-letters the
+// delivery once attempts are exhausted. final dead-letters it straight away.
+func (q *deliveryQueue) Fail(id string, statusCode int, cause error, final bool, now time.Time) (WebhookDelivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delivery, ok := q.deliveries[id]
+	if !ok {
+		return WebhookDelivery{}, false
+	}
+	delivery.inFlight = false
+	delivery.Attempts++
+	delivery.LastAttemptAt = now
+	delivery.LastStatusCode, delivery.LastError = statusCode, cause.Error()
+	if final || delivery.Attempts >= deliveryMaxAttempts {
+		delivery.Status = DeliveryStatusDeadLettered
+		delivery.NextAttempt = time.Time{}
+	} else {
+		delivery.NextAttempt = now.Add(deliveryBackoff(delivery.Attempts))
+	}
+	return *delivery, true
+}
+
+// Redrive gives a dead-lettered delivery a fresh set of attempts
+func (q *deliveryQueue) Redrive(id string, now time.Time) (WebhookDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delivery, ok := q.deliveries[id]
+	if !ok || delivery.Status != DeliveryStatusDeadLettered {
+		return WebhookDelivery{}, ErrDeliveryNotFound
+	}
+	delivery.Status = DeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = now
+	return *delivery, nil
+}
+
+func (q *deliveryQueue) Get(id string) (WebhookDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delivery, ok := q.deliveries[id]
+	if !ok {
+		return WebhookDelivery{}, ErrDeliveryNotFound
+	}
+	return *delivery, nil
+}
+
+// List filters deliveries by endpoint and status when set, newest first
+func (q *deliveryQueue) List(endpointID, status string) []WebhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []WebhookDelivery{}
+	for _, delivery := range q.deliveries {
+		if (endpointID == "" || delivery.EndpointID == endpointID) && (status == "" || delivery.Status == status) {
+			out = append(out, *delivery)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Prune forgets deliveries delivered before cutoff
+func (q *deliveryQueue) Prune(cutoff time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, delivery := range q.deliveries {
+		if delivery.Status == DeliveryStatusDelivered && delivery.DeliveredAt.Before(cutoff) {
+			delete(q.deliveries, id)
+		}
+	}
+}
+
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := deliveryBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > deliveryMaxBackoff {
+		return deliveryMaxBackoff
+	}
+	return backoff
+}
+
+// SignWebhook computes the Cachet-Signature header value for body
+func SignWebhook(secret, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// StatusChange is the body of POST /events: Cachet services report a
+// subject's badge or verification status changing
+type StatusChange struct {
+	Type    string          `json:"type"`
+	Subject string          `json:"subject"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// publish fans a status change out to the partners the subject is linked
+// with, one delivery per subscribed endpoint. Partners only hear about
+// subjects with an active connection to them.
+func (s *Server) publish(ctx context.Context, change StatusChange, now time.Time) ([]WebhookDelivery, error) {
+	connections, err := s.connections.List(ctx, hubScope, ConnectionFilter{Subject: change.Subject})
+	if err != nil {
+		return nil, err
+	}
+	queued := []WebhookDelivery{}
+	for _, conn := range connections {
+		// The hub's own connections have no partner to tell
+		if conn.Status != ConnectionStatusActive || conn.Partner == "" {
+			continue
+		}
+		event := WebhookEvent{
+			ID:              newID("evt"),
+			Type:            change.Type,
+			CreatedAt:       now,
+			Subject:         conn.Subject,
+			Connection:      conn.ID,
+			ExternalAccount: conn.ExternalAccount,
+			Data:            change.Data,
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range s.endpoints.List(conn.Partner) {
+			if !endpoint.subscribes(change.Type) {
+				continue
+			}
+			delivery := WebhookDelivery{
+				ID:          newID("dlv"),
+				EndpointID:  endpoint.ID,
+				Partner:     endpoint.Partner,
+				Connector:   conn.Connector,
+				EventID:     event.ID,
+				EventType:   event.Type,
+				Payload:     payload,
+				Status:      DeliveryStatusPending,
+				CreatedAt:   now,
+				NextAttempt: now,
+			}
+			s.deliveries.Enqueue(delivery)
+			webhookDeliveries.Add("queued", 1)
+			queued = append(queued, delivery)
+		}
+	}
+	return queued, nil
+}
+
+// errEndpointGone dead-letters deliveries whose endpoint was removed
+var errEndpointGone = errors.New("endpoint was removed")
+
+// deliverWebhook POSTs one signed delivery; any 2xx acknowledges it. The
+// endpoint and transformation are looked up at send time, so rotated
+// secrets, removed endpoints and fixed templates take effect on retries.
+func (s *Server) deliverWebhook(ctx context.Context, delivery WebhookDelivery, now time.Time) (int, error) {
+	endpoint, ok := s.endpoints.Get(delivery.EndpointID)
+	if !ok {
+		return 0, errEndpointGone
+	}
+	body := delivery.Payload
+	if transform, ok := s.transforms.Get(delivery.Connector); ok {
+		var err error
+		if body, err = transform.Apply(body); err != nil {
+			return 0, err
+		}
+	}
+	sealed, _ := s.endpoints.Secret(delivery.EndpointID)
+	secret, err := s.secrets.Open(ctx, webhookSecretAAD(endpoint.ID), sealed)
+	if err != nil {
+		return 0, err
+	}
+	defer wipe(secret)
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookEventHeader, delivery.EventType)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, body, now))
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// drainDeliveries attempts every delivery that is due
+func (s *Server) drainDeliveries(ctx context.Context, now time.Time) {
+	for {
+		delivery, ok := s.deliveries.Claim(now)
+		if !ok {
+			break
+		}
+		statusCode, err := s.deliverWebhook(ctx, delivery, now)
+		if err == nil {
+			s.deliveries.Succeed(delivery.ID, statusCode, now)
+			webhookDeliveries.Add("delivered", 1)
+			log.Info().Str("delivery_id", delivery.ID).Str("partner", delivery.Partner).Str("type", delivery.EventType).Msg("Webhook delivered")
+			continue
+		}
+		// Neither a removed endpoint nor a failing template recovers by retrying
+		final := errors.Is(err, errEndpointGone) || errors.Is(err, ErrTransform)
+		failed, _ := s.deliveries.Fail(delivery.ID, statusCode, err, final, now)
+		if failed.Status == DeliveryStatusDeadLettered {
+			webhookDeliveries.Add("dead_lettered", 1)
+			log.Error().Err(err).Str("delivery_id", delivery.ID).Str("partner", delivery.Partner).Int("attempts", failed.Attempts).Msg("Webhook dead-lettered")
+			continue
+		}
+		webhookDeliveries.Add("retried", 1)
+		log.Warn().Err(err).Str("delivery_id", delivery.ID).Time("next_attempt", failed.NextAttempt).Msg("Webhook queued for retry")
+	}
+	s.deliveries.Prune(now.Add(-deliveryRetention))
+}
+
+func (s *Server) runDeliveryWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		s.drainDeliveries(ctx, time.Now().UTC())
+		cancel()
+	}
+}
+
+// RegisterEndpointRequest is the body of POST /webhooks/endpoints
+type RegisterEndpointRequest struct {
+	Partner string   `json:"partner"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+}
+
+func (s *Server) handleRegisterEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req RegisterEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.partners.Get(r.Context(), req.Partner); err != nil {
+		http.Error(w, "partner must name an onboarded partner", http.StatusBadRequest)
+		return
+	}
+	if !isHTTPSURL(req.URL) {
+		http.Error(w, "url must be an absolute https URL", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		http.Error(w, "events is required", http.StatusBadRequest)
+		return
+	}
+	for _, eventType := range req.Events {
+		if !validEventType(eventType) {
+			http.Error(w, "unknown event type "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+	secret, err := randomToken()
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	endpoint := WebhookEndpoint{
+		ID:        newID("whe"),
+		Partner:   req.Partner,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    "whsec_" + secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	sealed, err := s.secrets.Seal(r.Context(), webhookSecretAAD(endpoint.ID), []byte(endpoint.Secret))
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	s.endpoints.Put(endpoint, sealed)
+	log.Info().Str("endpoint_id", endpoint.ID).Str("partner", endpoint.Partner).Msg("Webhook endpoint registered")
+	w.Header().Set("Location", "/webhooks/endpoints/"+endpoint.ID)
+	writeJSON(w, http.StatusCreated, endpoint)
+}
+
+func (s *Server) handleListEndpoints(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"endpoints": s.endpoints.List(r.URL.Query().Get("partner"))})
+}
+
+func (s *Server) handleGetEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := s.endpoints.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Webhook endpoint not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, endpoint)
+}
+
+// handleDeleteEndpoint removes an endpoint; its outstanding deliveries are
+// dead-lettered on their next attempt
+func (s *Server) handleDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	if !s.endpoints.Delete(chi.URLParam(r, "id")) {
+		http.Error(w, "Webhook endpoint not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePublishEvent takes a status change from another Cachet service and
+// queues its deliveries
+func (s *Server) handlePublishEvent(w http.ResponseWriter, r *http.Request) {
+	var change StatusChange
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEventBody)).Decode(&change); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validEventType(change.Type) {
+		http.Error(w, "unknown event type "+change.Type, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(change.Subject) == "" {
+		http.Error(w, "subject is required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if change.Type == EventBadgeStatusChanged {
+		// Badge changes also keep the state partners embed current
+		state, err := parseBadgeChange(change.Data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state.UpdatedAt = now
+		s.badges.Record(change.Subject, state)
+	}
+	queued, err := s.publish(r.Context(), change, now)
+	if err != nil {
+		writeHubError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"deliveries": queued})
+}
+
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", DeliveryStatusPending, DeliveryStatusDelivered, DeliveryStatusDeadLettered:
+	default:
+		http.Error(w, "unknown status "+status, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": s.deliveries.List(query.Get("endpoint"), status)})
+}
+
+func (s *Server) handleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, err := s.deliveries.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Webhook delivery not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": s.deliveries.List(r.URL.Query().Get("endpoint"), DeliveryStatusDeadLettered)})
+}
+
+// handleRedrive requeues a dead-lettered delivery once its partner is
+// receiving again
+func (s *Server) handleRedrive(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if delivery, err := s.deliveries.Get(id); err == nil {
+		if _, ok := s.endpoints.Get(delivery.EndpointID); !ok {
+			http.Error(w, "The delivery's endpoint was removed", http.StatusConflict)
+			return
+		}
+	}
+	delivery, err := s.deliveries.Redrive(id, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "Dead-lettered delivery not found", http.StatusNotFound)
+		return
+	}
+	log.Info().Str("delivery_id", delivery.ID).Str("partner", delivery.Partner).Msg("Dead-lettered webhook redriven")
+	writeJSON(w, http.StatusAccepted, delivery)
+}
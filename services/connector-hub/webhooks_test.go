@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOperatorToken = "operator-secret"
+
+var operatorHeader = map[string]string{"Authorization": "Bearer " + testOperatorToken}
+
+var safeSellerActive = json.RawMessage(`{"badge":"pack.safe.seller","label":"Verified Seller","status":"active"}`)
+
+// partnerReceiver records the webhooks a partner receives, answering with
+// status until it is changed
+type partnerReceiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (p *partnerReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.received = append(p.received, r)
+	p.bodies = append(p.bodies, body)
+	w.WriteHeader(p.status)
+}
+
+func (p *partnerReceiver) setStatus(status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+// newWebhookTestServer returns a hub with a linked subject and a partner
+// endpoint for the fake connector, and the partner's receiver
+func newWebhookTestServer(t *testing.T) (*Server, *partnerReceiver, WebhookEndpoint) {
+	t.Helper()
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	require.NoError(t, server.connectors.Install(&fakeConnector{id: "market.fake"}))
+
+	receiver := &partnerReceiver{status: http.StatusOK}
+	ts := httptest.NewTLSServer(receiver)
+	t.Cleanup(ts.Close)
+	server.webhookClient = ts.Client()
+
+	partner := onboardPartner(t, server, "market.fake", CreateKeyRequest{})
+	w := hubRequest(t, server, http.MethodPost, "/connectors/market.fake/connections", map[string]string{"subject": "did:key:z6MkSeller"}, partner)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = hubRequest(t, server, http.MethodPost, "/webhooks/endpoints", RegisterEndpointRequest{
+		Partner: "market.fake",
+		URL:     ts.URL + "/cachet",
+		Events:  []string{EventBadgeStatusChanged},
+	}, operatorHeader)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var endpoint WebhookEndpoint
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&endpoint))
+	require.True(t, strings.HasPrefix(endpoint.Secret, "whsec_"))
+	return server, receiver, endpoint
+}
+
+func publishChange(t *testing.T, server *Server, change StatusChange) []WebhookDelivery {
+	t.Helper()
+	w := hubRequest(t, server, http.MethodPost, "/events", change, operatorHeader)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var body struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	return body.Deliveries
+}
+
+func TestWebhooks_SignedDelivery(t *testing.T) {
+	server, receiver, endpoint := newWebhookTestServer(t)
+
+	queued := publishChange(t, server, StatusChange{
+		Type:    EventBadgeStatusChanged,
+		Subject: "did:key:z6MkSeller",
+		Data:    json.RawMessage(`{"badge":"pack.safe.seller","status":"active"}`),
+	})
+	require.Len(t, queued, 1)
+	// Not subscribed, or not linked: nothing is queued
+	assert.Empty(t, publishChange(t, server, StatusChange{Type: EventVerificationStatusChanged, Subject: "did:key:z6MkSeller"}))
+	assert.Empty(t, publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkStranger", Data: safeSellerActive}))
+
+	now := time.Now().UTC()
+	server.drainDeliveries(context.Background(), now)
+	require.Len(t, receiver.received, 1)
+	req, body := receiver.received[0], receiver.bodies[0]
+	assert.Equal(t, "/cachet", req.URL.Path)
+	assert.Equal(t, queued[0].ID, req.Header.Get(WebhookIDHeader))
+	assert.Equal(t, EventBadgeStatusChanged, req.Header.Get(WebhookEventHeader))
+	assert.Equal(t, SignWebhook([]byte(endpoint.Secret), body, now), req.Header.Get(WebhookSignatureHeader))
+	assert.True(t, strings.HasPrefix(req.Header.Get(WebhookSignatureHeader), "t="+strconv.FormatInt(now.Unix(), 10)+",v1="))
+
+	var event WebhookEvent
+	require.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, "did:key:z6MkSeller", event.Subject)
+	assert.Equal(t, "seller-did:key:z6MkSeller", event.ExternalAccount)
+	assert.JSONEq(t, `{"badge":"pack.safe.seller","status":"active"}`, string(event.Data))
+
+	w := hubRequest(t, server, http.MethodGet, "/webhooks/deliveries/"+queued[0].ID, nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var delivery WebhookDelivery
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&delivery))
+	assert.Equal(t, DeliveryStatusDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.LastStatusCode)
+
+	// Secrets are only shown at registration
+	w = hubRequest(t, server, http.MethodGet, "/webhooks/endpoints/"+endpoint.ID, nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), endpoint.Secret)
+}
+
+func TestWebhooks_RetryDeadLetterRedrive(t *testing.T) {
+	server, receiver, _ := newWebhookTestServer(t)
+	receiver.setStatus(http.StatusServiceUnavailable)
+	queued := publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+	require.Len(t, queued, 1)
+	ctx := context.Background()
+
+	// Retries back off exponentially
+	now := time.Now().UTC()
+	server.drainDeliveries(ctx, now)
+	delivery, err := server.deliveries.Get(queued[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusPending, delivery.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	assert.Equal(t, now.Add(deliveryBaseBackoff), delivery.NextAttempt)
+	server.drainDeliveries(ctx, now.Add(time.Second))
+	assert.Len(t, receiver.received, 1, "not due yet")
+
+	for i := 1; i < deliveryMaxAttempts; i++ {
+		now = now.Add(deliveryMaxBackoff)
+		server.drainDeliveries(ctx, now)
+	}
+	assert.Len(t, receiver.received, deliveryMaxAttempts)
+
+	w := hubRequest(t, server, http.MethodGet, "/webhooks/dead-letters", nil, operatorHeader)
+	require.Equal(t, http.StatusOK, w.Code)
+	var dead struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&dead))
+	require.Len(t, dead.Deliveries, 1)
+	assert.Equal(t, deliveryMaxAttempts, dead.Deliveries[0].Attempts)
+	assert.Equal(t, "endpoint returned 503", dead.Deliveries[0].LastError)
+
+	// Once the partner is back, the delivery is redriven
+	receiver.setStatus(http.StatusNoContent)
+	w = hubRequest(t, server, http.MethodPost, "/webhooks/dead-letters/"+queued[0].ID+"/redrive", nil, operatorHeader)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	server.drainDeliveries(ctx, time.Now().UTC())
+	delivery, err = server.deliveries.Get(queued[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDelivered, delivery.Status)
+
+	// Only dead letters are redriven
+	w = hubRequest(t, server, http.MethodPost, "/webhooks/dead-letters/"+queued[0].ID+"/redrive", nil, operatorHeader)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebhooks_RemovedEndpoint(t *testing.T) {
+	server, receiver, endpoint := newWebhookTestServer(t)
+	queued := publishChange(t, server, StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive})
+	require.Len(t, queued, 1)
+
+	w := hubRequest(t, server, http.MethodDelete, "/webhooks/endpoints/"+endpoint.ID, nil, operatorHeader)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	server.drainDeliveries(context.Background(), time.Now().UTC())
+	assert.Empty(t, receiver.received)
+
+	delivery, err := server.deliveries.Get(queued[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryStatusDeadLettered, delivery.Status, "dead-lettered without retrying")
+	w = hubRequest(t, server, http.MethodPost, "/webhooks/dead-letters/"+queued[0].ID+"/redrive", nil, operatorHeader)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestWebhooks_Validation(t *testing.T) {
+	server, _, _ := newWebhookTestServer(t)
+
+	w := hubRequest(t, server, http.MethodGet, "/webhooks/endpoints", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/events", StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: safeSellerActive}, map[string]string{"Authorization": "Bearer wrong"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	for name, req := range map[string]RegisterEndpointRequest{
+		"plain http":    {Partner: "market.fake", URL: "http://partner.example/hook", Events: []string{EventBadgeStatusChanged}},
+		"no events":     {Partner: "market.fake", URL: "https://partner.example/hook"},
+		"unknown event": {Partner: "market.fake", URL: "https://partner.example/hook", Events: []string{"badge.deleted"}},
+		"bad partner":   {Partner: "Market Fake", URL: "https://partner.example/hook", Events: []string{EventBadgeStatusChanged}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := hubRequest(t, server, http.MethodPost, "/webhooks/endpoints", req, operatorHeader)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+
+	w = hubRequest(t, server, http.MethodPost, "/events", StatusChange{Type: "badge.deleted", Subject: "did:key:z6MkSeller"}, operatorHeader)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/events", StatusChange{Type: EventBadgeStatusChanged, Data: safeSellerActive}, operatorHeader)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = hubRequest(t, server, http.MethodPost, "/events", StatusChange{Type: EventBadgeStatusChanged, Subject: "did:key:z6MkSeller", Data: json.RawMessage(`{"badge":"pack.safe.seller","status":"pending"}`)}, operatorHeader)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = hubRequest(t, server, http.MethodGet, "/webhooks/deliveries?status=lost", nil, operatorHeader)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, deliveryBackoff(1))
+	assert.Equal(t, 16*time.Second, deliveryBackoff(4))
+	assert.Equal(t, deliveryMaxBackoff, deliveryBackoff(20))
+	assert.Equal(t, deliveryMaxBackoff, deliveryBackoff(70))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OAuth attestation-based client authentication headers
+const (
+	clientAttestationHeader    = "OAuth-Client-Attestation"
+	clientAttestationPoPHeader = "OAuth-Client-Attestation-PoP"
+	attestationPoPLifetime     = 5 * time.Minute
+)
+
+var ErrAttestationInvalid = errors.New("invalid wallet attestation")
+
+// AttestationVerifier validates wallet attestations issued by a wallet
+// provider after a Play Integrity or App Attest check. The attestation JWT
+// carries an x5c chain that must lead to one of the configured roots.
+type AttestationVerifier struct {
+	roots         *x509.CertPool
+	allowedAppIDs []string
+	audience      string
+	replay        *replayCache
+}
+
+type walletAttestationClaims struct {
+	AppID string `json:"app_id"`
+	Cnf   struct {
+		JWK JWK `json:"jwk"`
+	} `json:"cnf"`
+	jwt.RegisteredClaims
+}
+
+func NewAttestationVerifier(roots *x509.CertPool, allowedAppIDs []string, audience string) *AttestationVerifier {
+	return &AttestationVerifier{
+		roots:         roots,
+		allowedAppIDs: allowedAppIDs,
+		audience:      audience,
+		replay:        newReplayCache(attestationPoPLifetime),
+	}
+}
+
+// AttestationConfig requires wallets to attest themselves, chaining to the
+// configured roots, before they are issued tokens
+type AttestationConfig struct {
+	Roots    string   `env:"WALLET_ATTESTATION_ROOTS" doc:"PEM bundle of the roots wallet attestations chain to; token requests need no wallet attestation without it"`
+	AppIDs   []string `env:"WALLET_ATTESTATION_APP_IDS" doc:"Comma-separated wallet app identifiers attestations may name; any attested app is accepted without them"`
+	Audience string   `env:"ISSUER_IDENTIFIER" doc:"Audience attestation proofs of possession are addressed to"`
+}
+
+// loadAttestationVerifier enables attestation when c names a PEM bundle of
+// trusted roots
+func loadAttestationVerifier(c AttestationConfig) (*AttestationVerifier, error) {
+	if c.Roots == "" {
+		return nil, nil
+	}
+	pemData, err := os.ReadFile(c.Roots)
+	if err != nil {
+		return nil, fmt.Errorf("reading attestation roots: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", c.Roots)
+	}
+	return NewAttestationVerifier(roots, c.AppIDs, c.Audience), nil
+}
+
+// Verify checks the attestation and its proof of possession for clientID,
+// returning the attested app identifier
+func (v *AttestationVerifier) Verify(r *http.Request, clientID string) (string, error) {
+	attestation := r.Header.Get(clientAttestationHeader)
+	pop := r.Header.Get(clientAttestationPoPHeader)
+	if attestation == "" || pop == "" {
+		return "", fmt.Errorf("%w: attestation headers missing", ErrAttestationInvalid)
+	}
+
+	claims := &walletAttestationClaims{}
+	token, err := jwt.ParseWithClaims(attestation, claims, v.chainKey,
+		jwt.WithValidMethods([]string{"ES256", "ES384", "RS256", "PS256"}),
+		jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return "", fmt.Errorf("%w: %v", ErrAttestationInvalid, err)
+	}
+	if claims.Subject != clientID {
+		return "", fmt.Errorf("%w: attestation subject does not match client_id", ErrAttestationInvalid)
+	}
+	if len(v.allowedAppIDs) > 0 && !containsString(v.allowedAppIDs, claims.AppID) {
+		return "", fmt.Errorf("%w: app %q is not an attested wallet build", ErrAttestationInvalid, claims.AppID)
+	}
+
+	instanceKey, err := claims.Cnf.JWK.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("%w: cnf key: %v", ErrAttestationInvalid, err)
+	}
+	popClaims := &jwt.RegisteredClaims{}
+	popToken, err := jwt.ParseWithClaims(pop, popClaims, func(*jwt.Token) (interface{}, error) {
+		return instanceKey, nil
+	}, jwt.WithValidMethods(dpopSigningMethods), jwt.WithIssuer(clientID), jwt.WithAudience(v.audience), jwt.WithIssuedAt())
+	if err != nil || !popToken.Valid {
+		return "", fmt.Errorf("%w: proof of possession: %v", ErrAttestationInvalid, err)
+	}
+	now := time.Now()
+	if popClaims.ID == "" || popClaims.IssuedAt == nil || now.Sub(popClaims.IssuedAt.Time) > attestationPoPLifetime {
+		return "", fmt.Errorf("%w: proof of possession is stale or lacks jti", ErrAttestationInvalid)
+	}
+	if !v.replay.remember(popClaims.ID, now) {
+		return "", fmt.Errorf("%w: proof of possession replayed", ErrAttestationInvalid)
+	}
+
+	return claims.AppID, nil
+}
+
+// chainKey verifies the x5c chain in the attestation header against the
+// configured roots and returns the leaf key
+func (v *AttestationVerifier) chainKey(token *jwt.Token) (interface{}, error) {
+	chain, ok := token.Header["x5c"].([]interface{})
+	if !ok || len(chain) == 0 {
+		return nil, errors.New("x5c header missing")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, entry := range chain {
+		encoded, _ := entry.(string)
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decoding x5c: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing x5c: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("untrusted attestation chain: %w", err)
+	}
+	return certs[0].PublicKey, nil
+}
+
+func containsString(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
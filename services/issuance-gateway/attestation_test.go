@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type attestationFixture struct {
+	roots     *x509.CertPool
+	leafKey   *ecdsa.PrivateKey
+	leafDER   []byte
+	walletKey *ecdsa.PrivateKey
+}
+
+func newAttestationFixture(t *testing.T) attestationFixture {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Cachet Wallet Provider Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Wallet Attestation Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, root, &leafKey.PublicKey, rootKey)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return attestationFixture{roots: roots, leafKey: leafKey, leafDER: leafDER, walletKey: newWalletKey(t)}
+}
+
+func (f attestationFixture) headers(t *testing.T, clientID, appID string) map[string]string {
+	t.Helper()
+	attestation := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":    "https://wallet-provider.cachet.id",
+		"sub":    clientID,
+		"app_id": appID,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"cnf":    map[string]interface{}{"jwk": walletJWK(f.walletKey)},
+	})
+	attestation.Header["x5c"] = []string{base64.StdEncoding.EncodeToString(f.leafDER)}
+	signedAttestation, err := attestation.SignedString(f.leafKey)
+	require.NoError(t, err)
+
+	pop := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": clientID,
+		"aud": "did:web:cachet.id",
+		"jti": uuid.NewString(),
+		"iat": time.Now().Unix(),
+	})
+	signedPoP, err := pop.SignedString(f.walletKey)
+	require.NoError(t, err)
+
+	return map[string]string{
+		clientAttestationHeader:    signedAttestation,
+		clientAttestationPoPHeader: signedPoP,
+	}
+}
+
+func TestAttestation_AttestedWalletObtainsToken(t *testing.T) {
+	fixture := newAttestationFixture(t)
+	server := NewServer()
+	server.attestation = NewAttestationVerifier(fixture.roots, []string{"id.cachet.wallet"}, "did:web:cachet.id")
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "wallet-instance-1",
+	}, fixture.headers(t, "wallet-instance-1", "id.cachet.wallet"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAttestation_RejectsUnattestedClients(t *testing.T) {
+	fixture := newAttestationFixture(t)
+	server := NewServer()
+	server.attestation = NewAttestationVerifier(fixture.roots, []string{"id.cachet.wallet"}, "did:web:cachet.id")
+	tokenReq := TokenRequest{GrantType: "client_credentials", ClientID: "wallet-instance-1"}
+
+	// No attestation at all
+	w := postJSON(t, server, "/oauth/token", tokenReq, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Attestation for an unapproved build
+	w = postJSON(t, server, "/oauth/token", tokenReq, fixture.headers(t, "wallet-instance-1", "com.example.repackaged"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Attestation issued to another client
+	w = postJSON(t, server, "/oauth/token", tokenReq, fixture.headers(t, "wallet-instance-2", "id.cachet.wallet"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Chain that does not lead to a configured root
+	other := newAttestationFixture(t)
+	w = postJSON(t, server, "/oauth/token", tokenReq, other.headers(t, "wallet-instance-1", "id.cachet.wallet"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAttestation_RejectsReplayedPoP(t *testing.T) {
+	fixture := newAttestationFixture(t)
+	server := NewServer()
+	server.attestation = NewAttestationVerifier(fixture.roots, nil, "did:web:cachet.id")
+	tokenReq := TokenRequest{GrantType: "client_credentials", ClientID: "wallet-instance-1"}
+
+	headers := fixture.headers(t, "wallet-instance-1", "id.cachet.wallet")
+	assert.Equal(t, http.StatusOK, postJSON(t, server, "/oauth/token", tokenReq, headers).Code)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, server, "/oauth/token", tokenReq, headers).Code)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// Audit event types
+const (
+	AuditTokenGranted      = "token.granted"
+	AuditTokenRefreshed    = "token.refreshed"
+	AuditWebhookReceived   = "webhook.received"
+	AuditCredentialIssued  = "credential.issued"
+	AuditCredentialRefused = "credential.refused"
+
+	// Operators' holds on issued credentials
+	AuditCredentialSuspended  = "credential.suspended"
+	AuditCredentialReinstated = "credential.reinstated"
+
+	// Subjects found on a sanctions or PEP list when rescreened
+	AuditScreeningHit = "screening.hit"
+
+	// Wallets' reports on the credentials they received
+	AuditCredentialAccepted = "credential.accepted"
+	AuditCredentialDeleted  = "credential.deleted"
+	AuditCredentialFailure  = "credential.failure"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+// AuditEvent records who did what during issuance, for compliance review.
+// It never carries personal data from the identity session.
+type AuditEvent struct {
+	Seq             int64     `json:"seq"`
+	Tenant          string    `json:"tenant"`
+	Type            string    `json:"type"`
+	Actor           string    `json:"actor"`
+	SessionID       string    `json:"sessionId,omitempty"`
+	JourneyID       string    `json:"journeyId,omitempty"`
+	CredentialType  string    `json:"credentialType,omitempty"`
+	CredentialID    string    `json:"credentialId,omitempty"`
+	QualityTier     string    `json:"qualityTier,omitempty"`
+	StatusListIndex string    `json:"statusListIndex,omitempty"`
+	Outcome         string    `json:"outcome"`
+	Detail          string    `json:"detail,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// AuditFilter narrows an audit query. After is an exclusive Seq cursor.
+type AuditFilter struct {
+	Tenant         string
+	Type           string
+	Actor          string
+	SessionID      string
+	CredentialType string
+	CredentialID   string
+	Since          time.Time
+	Until          time.Time
+	After          int64
+	Limit          int
+}
+
+func (f AuditFilter) matches(e AuditEvent) bool {
+	return e.Seq > f.After &&
+		(f.Tenant == "" || e.Tenant == f.Tenant) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.SessionID == "" || e.SessionID == f.SessionID) &&
+		(f.CredentialType == "" || e.CredentialType == f.CredentialType) &&
+		(f.CredentialID == "" || e.CredentialID == f.CredentialID) &&
+		(f.Since.IsZero() || !e.Timestamp.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Timestamp.Before(f.Until))
+}
+
+// AuditStore persists audit events in append order
+type AuditStore interface {
+	Append(ctx context.Context, event AuditEvent) (AuditEvent, error)
+	Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+}
+
+// memoryAuditStore keeps events in memory (production should use the
+// file store or a database)
+type memoryAuditStore struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{}
+}
+
+func (m *memoryAuditStore) Append(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return AuditEvent{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.Seq = int64(len(m.events)) + 1
+	m.events = append(m.events, event)
+	return event, nil
+}
+
+func (m *memoryAuditStore) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out []AuditEvent
+	for _, event := range m.events {
+		if !filter.matches(event) {
+			continue
+		}
+		out = append(out, event)
+		if filter.Limit > 0 && len(out) == filter.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// fileAuditStore appends events as JSON lines so the trail survives restarts
+type fileAuditStore struct {
+	memoryAuditStore
+	file *os.File
+}
+
+// OpenFileAuditStore loads an existing audit file and appends to it
+func OpenFileAuditStore(path string) (*fileAuditStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+
+	store := &fileAuditStore{file: file}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading audit log: %w", err)
+		}
+		store.events = append(store.events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	return store, nil
+}
+
+func (f *fileAuditStore) Append(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return AuditEvent{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	event.Seq = int64(len(f.events)) + 1
+	line, err := json.Marshal(event)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return AuditEvent{}, fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return AuditEvent{}, fmt.Errorf("syncing audit log: %w", err)
+	}
+	f.events = append(f.events, event)
+	return event, nil
+}
+
+// loadAuditStore uses the file store at path, when set
+func loadAuditStore(path string) (AuditStore, error) {
+	if path == "" {
+		return newMemoryAuditStore(), nil
+	}
+	return OpenFileAuditStore(path)
+}
+
+// recordAudit appends an audit event for the tenant of ctx. Failures are
+// logged rather than surfaced so the audit trail never blocks issuance.
+func (s *Server) recordAudit(ctx context.Context, event AuditEvent) {
+	event.Tenant = tenant.FromContext(ctx).ID
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	if event.Outcome == "" {
+		event.Outcome = "success"
+	}
+	s.metrics.ObserveAudit(event)
+	if _, err := s.auditLog.Append(ctx, event); err != nil {
+		log.Error().Err(err).Str("type", event.Type).Msg("Failed to record audit event")
+	}
+}
+
+func (s *Server) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "audit")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="audit"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Tenant:         tenant.FromContext(r.Context()).ID,
+		Type:           query.Get("type"),
+		Actor:          query.Get("actor"),
+		SessionID:      query.Get("session_id"),
+		CredentialType: query.Get("credential_type"),
+		Limit:          defaultAuditPageSize,
+	}
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			problem.Error(w, r, "Invalid since timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			problem.Error(w, r, "Invalid until timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if filter.After, err = strconv.ParseInt(v, 10, 64); err != nil || filter.After < 0 {
+			problem.Error(w, r, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			problem.Error(w, r, fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := s.auditLog.Query(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query audit events")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"events": events}
+	if len(events) == filter.Limit {
+		resp["next_cursor"] = strconv.FormatInt(events[len(events)-1].Seq, 10)
+	}
+	if events == nil {
+		resp["events"] = []AuditEvent{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// postgresAuditStore keeps the audit trail in Postgres
+type postgresAuditStore struct {
+	db *sql.DB
+}
+
+func newPostgresAuditStore(db *sql.DB) *postgresAuditStore {
+	return &postgresAuditStore{db: db}
+}
+
+func (p *postgresAuditStore) Append(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	event.Seq = 0
+	document, err := json.Marshal(event)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	err = p.db.QueryRowContext(ctx,
+		`INSERT INTO audit_events (type, actor, session_id, credential_type, recorded_at, document, tenant)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING seq`,
+		event.Type, event.Actor, event.SessionID, event.CredentialType, event.Timestamp, document, event.Tenant).Scan(&event.Seq)
+	return event, err
+}
+
+func (p *postgresAuditStore) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	since := sql.NullTime{Time: filter.Since, Valid: !filter.Since.IsZero()}
+	until := sql.NullTime{Time: filter.Until, Valid: !filter.Until.IsZero()}
+	limit := sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT seq, document FROM audit_events
+		 WHERE seq > $1 AND ($2 = '' OR type = $2) AND ($3 = '' OR actor = $3)
+		   AND ($4 = '' OR session_id = $4) AND ($5 = '' OR credential_type = $5)
+		   AND ($6::timestamptz IS NULL OR recorded_at >= $6) AND ($7::timestamptz IS NULL OR recorded_at < $7)
+		   AND ($9 = '' OR tenant = $9) AND ($10 = '' OR document->>'credentialId' = $10)
+		 ORDER BY seq LIMIT $8`,
+		filter.After, filter.Type, filter.Actor, filter.SessionID, filter.CredentialType, since, until, limit, filter.Tenant, filter.CredentialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []AuditEvent
+	for rows.Next() {
+		var seq int64
+		var document []byte
+		if err := rows.Scan(&seq, &document); err != nil {
+			return nil, err
+		}
+		var event AuditEvent
+		if err := json.Unmarshal(document, &event); err != nil {
+			return nil, fmt.Errorf("decoding audit event: %w", err)
+		}
+		event.Seq = seq
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type auditPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"next_cursor"`
+}
+
+func getAudit(t *testing.T, server *Server, query, token string) (*httptest.ResponseRecorder, auditPage) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/audit/events"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	var page auditPage
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	}
+	return w, page
+}
+
+func TestAudit_RecordsIssuanceFlow(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "audit-secret"
+
+	approveBoundSession(t, server, "audited-session", nil)
+	tokenResp := issueSessionToken(t, server, "audited-session", "credential_issuance", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, page := getAudit(t, server, "", "audit-secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, page.Events, 3)
+	assert.Equal(t, AuditWebhookReceived, page.Events[0].Type)
+	assert.Equal(t, VerificationLevelGold, page.Events[0].QualityTier)
+	assert.Equal(t, AuditTokenGranted, page.Events[1].Type)
+
+	issued := page.Events[2]
+	assert.Equal(t, AuditCredentialIssued, issued.Type)
+	assert.Equal(t, "test-wallet", issued.Actor)
+	assert.Equal(t, CredentialTypeIdentity, issued.CredentialType)
+	assert.Equal(t, "audited-session", issued.SessionID)
+	assert.Equal(t, "0", issued.StatusListIndex)
+	assert.NotContains(t, w.Body.String(), "Alice")
+
+	_, page = getAudit(t, server, "?type="+AuditCredentialIssued, "audit-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, issued.CredentialID, page.Events[0].CredentialID)
+}
+
+func TestAudit_PaginationAndAuth(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "audit-secret"
+	for i := 0; i < 3; i++ {
+		issueToken(t, server)
+	}
+
+	w, _ := getAudit(t, server, "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = getAudit(t, server, "", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	_, page := getAudit(t, server, "?limit=2", "audit-secret")
+	require.Len(t, page.Events, 2)
+	require.NotEmpty(t, page.NextCursor)
+
+	_, page = getAudit(t, server, "?limit=2&cursor="+page.NextCursor, "audit-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, int64(3), page.Events[0].Seq)
+	assert.Empty(t, page.NextCursor)
+
+	w, _ = getAudit(t, server, "?limit=0", "audit-secret")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAudit_DisabledWithoutToken(t *testing.T) {
+	server := NewServer()
+	w, _ := getAudit(t, server, "", "anything")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestFileAuditStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ctx := context.Background()
+
+	store, err := OpenFileAuditStore(path)
+	require.NoError(t, err)
+	_, err = store.Append(ctx, AuditEvent{Type: AuditTokenGranted, Actor: "wallet-a"})
+	require.NoError(t, err)
+	_, err = store.Append(ctx, AuditEvent{Type: AuditCredentialIssued, Actor: "wallet-a"})
+	require.NoError(t, err)
+	require.NoError(t, store.file.Close())
+
+	reopened, err := OpenFileAuditStore(path)
+	require.NoError(t, err)
+	defer reopened.file.Close()
+
+	event, err := reopened.Append(ctx, AuditEvent{Type: AuditTokenGranted, Actor: "wallet-b"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), event.Seq)
+
+	events, err := reopened.Query(ctx, AuditFilter{Actor: "wallet-a"})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
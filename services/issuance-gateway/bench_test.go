@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+// quietLogs silences request and application logs for a benchmark, so
+// writing them neither floods the output nor skews the timings. Call it
+// before NewServer, which wires the request logger into the router.
+func quietLogs(b *testing.B) {
+	b.Helper()
+	requestLogger, level := middleware.DefaultLogger, zerolog.GlobalLevel()
+	middleware.DefaultLogger = middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: stdlog.New(io.Discard, "", 0)})
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	b.Cleanup(func() {
+		middleware.DefaultLogger = requestLogger
+		zerolog.SetGlobalLevel(level)
+	})
+}
+
+// BenchmarkTokenEndpoint measures issuing an access and refresh token pair
+func BenchmarkTokenEndpoint(b *testing.B) {
+	quietLogs(b)
+	server := NewServer()
+	req := TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "test-wallet", Scope: "credential_issuance"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if w := postJSON(b, server, "/oauth/token", req, nil); w.Code != http.StatusOK {
+			b.Fatalf("token answered %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+// BenchmarkTokenEndpointParallel measures token issuance under concurrent
+// requests, where the gateway's shared stores contend
+func BenchmarkTokenEndpointParallel(b *testing.B) {
+	quietLogs(b)
+	server := NewServer()
+	req := TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "test-wallet", Scope: "credential_issuance"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if w := postJSON(b, server, "/oauth/token", req, nil); w.Code != http.StatusOK {
+				b.Errorf("token answered %d: %s", w.Code, w.Body)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkCredentialEndpoint measures issuing an identity credential for
+// a verified session. A session yields one credential, so each iteration
+// verifies one and obtains its token outside the timer.
+func BenchmarkCredentialEndpoint(b *testing.B) {
+	quietLogs(b)
+	server := NewServer()
+	req := CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", "IdentityCredential"}, Proof: walletProof(b)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sessionID := fmt.Sprintf("bench-session-%d", i)
+		approveBoundSession(b, server, sessionID, nil)
+		w := postJSON(b, server, "/oauth/token", TokenRequest{
+			GrantType: GrantTypeClientCredentials,
+			ClientID:  "test-wallet",
+			Scope:     "credential_issuance",
+			SessionID: sessionID,
+		}, nil)
+		var token TokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+			b.Fatal(err)
+		}
+		headers := map[string]string{"Authorization": "Bearer " + token.AccessToken}
+		b.StartTimer()
+
+		if w := postJSON(b, server, "/credential", req, headers); w.Code != http.StatusOK {
+			b.Fatalf("credential answered %d: %s", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// Config is the issuance gateway's configuration, documented in CONFIG.md.
+// The database keeps its own variables, read by its loader.
+type Config struct {
+	config.Base
+	OperatorToken        string        `env:"OPERATOR_API_TOKEN" secret:"true" doc:"Token operators present for the audit trail, dead-letter and data subject APIs; those APIs are disabled without it"`
+	ReceiptsLogURL       string        `env:"RECEIPTS_LOG_URL" doc:"Receipts log whose holder receipts are exported and tombstoned with data subjects, and which anchors issued credentials with CREDENTIAL_TIMESTAMP_ANCHOR; receipts are left alone without it"`
+	RegistryURL          string        `env:"REGISTRY_URL" doc:"Registry hosting the credential schemas subjects are validated against; subjects are not validated without it"`
+	IntrospectionClients []string      `env:"INTROSPECTION_CLIENTS" secret:"true" doc:"Comma-separated id:secret pairs of the resource servers allowed to introspect tokens; introspection is open without any"`
+	SessionRetention     time.Duration `env:"SESSION_RETENTION" doc:"How long verified sessions are kept for issuance before they are purged"`
+	AuditLogPath         string        `env:"AUDIT_LOG_PATH" doc:"File the audit trail is appended to when DATABASE_URL is unset; it is kept in memory without either"`
+	WebhookQueuePath     string        `env:"WEBHOOK_QUEUE_PATH" doc:"File journaling undelivered webhooks so they survive a restart; they are kept in memory without it"`
+	Attestation          AttestationConfig
+	Vouching             VouchingConfig
+	Quality              QualityConfig
+	ServiceAuth          serviceauth.Config
+	Renewal              RenewalConfig
+	Timestamp            TimestampConfig
+	Screening            ScreeningConfig
+	ScoreDrift           DriftConfig
+	CORS                 cors.Config
+	APIVersion           apiversion.Config
+	SecurityAudit        audit.Config
+	RateLimit            ratelimit.Config
+	Events               events.Config
+	Tenants              tenant.Config
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{
+		Base:             config.Base{Port: 8090},
+		SessionRetention: defaultSessionRetention,
+		Attestation:      AttestationConfig{Audience: issuerDID},
+	}
+}
+
+// Validate checks the port, service authentication, registry, introspection
+// clients, session retention, vouching service, quality scoring, credential
+// renewal policy, credential timestamping, screening provider, score drift
+// detector, CORS origins, legacy API sunset, security audit, rate limit,
+// event bus and tenants file are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if c.RegistryURL != "" {
+		if u, err := url.Parse(c.RegistryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("REGISTRY_URL must be an http(s) URL")
+		}
+	}
+	if _, err := introspectionClients(c.IntrospectionClients); err != nil {
+		return err
+	}
+	if c.SessionRetention <= 0 {
+		return errors.New("SESSION_RETENTION must be positive")
+	}
+	if err := c.Vouching.Validate(); err != nil {
+		return err
+	}
+	if err := c.Quality.Validate(); err != nil {
+		return err
+	}
+	if err := c.Renewal.Validate(); err != nil {
+		return err
+	}
+	if err := c.Timestamp.Validate(); err != nil {
+		return err
+	}
+	if c.Timestamp.Anchor && c.ReceiptsLogURL == "" {
+		return errors.New("CREDENTIAL_TIMESTAMP_ANCHOR requires RECEIPTS_LOG_URL")
+	}
+	if err := c.Screening.Validate(); err != nil {
+		return err
+	}
+	if err := c.ScoreDrift.Validate(); err != nil {
+		return err
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if err := c.APIVersion.Validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityAudit.Validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Events.Validate(); err != nil {
+		return err
+	}
+	return c.Tenants.Validate()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// Credential configuration identifiers advertised in issuer metadata
+const (
+	CredentialTypeIdentity = "IdentityCredential"
+	CredentialTypeAgeOver  = "AgeOverCredential"
+	// CredentialTypeVouch is a vouch from another holder, issued by the
+	// vouching-service and delivered through the gateway
+	CredentialTypeVouch = "VouchCredential"
+)
+
+// OAuth scopes that authorize credential issuance. Connectors are granted a
+// per-type scope; the Cachet wallet requests the umbrella scope.
+const (
+	ScopeIdentityCredential = "identity_credential"
+	ScopeAgeCredential      = "age_credential"
+	ScopeVouchCredential    = "vouch_credential"
+	ScopeCredentialIssuance = "credential_issuance"
+)
+
+// ageOverThresholds are the ages attested by AgeOverCredential
+var ageOverThresholds = []int{18, 21}
+
+// CredentialConfiguration describes one kind of credential the gateway can issue
+type CredentialConfiguration struct {
+	ID      string   `json:"id"`
+	Format  string   `json:"format"`
+	Types   []string `json:"types"`
+	Claims  []string `json:"claims"`
+	Scope   string   `json:"scope"`
+	Context string   `json:"-"`
+	// SchemaVersion is the registry schema the subject must match
+	SchemaVersion string `json:"-"`
+	// Holder-bound credentials carry the wallet key proven with one of the
+	// proof types in their cnf claim
+	BindingMethods []string                     `json:"cryptographic_binding_methods_supported,omitempty"`
+	ProofTypes     map[string]ProofTypeMetadata `json:"proof_types_supported,omitempty"`
+	// ClaimSensitivity decides which claims are plain, selectively
+	// disclosable or kept out of the credential for the wallet's vault
+	ClaimSensitivity map[string]ClaimSensitivity `json:"claim_sensitivity,omitempty"`
+	// Cryptosuites are the data integrity proofs the credential can be
+	// issued with as ldp_vc, for unlinkable presentations
+	Cryptosuites []string `json:"ldp_vc_cryptosuites_supported,omitempty"`
+
+	// Validity is how long the credential is valid for, by the quality
+	// tier of the verification behind it
+	Validity *CredentialValidity `json:"credential_validity,omitempty"`
+
+	buildSubject func(session VeriffSession, validation ValidationResult) map[string]interface{}
+	// capExpiry shortens the validity where the claims stop holding earlier
+	capExpiry func(session VeriffSession, issuedAt, expiry time.Time) time.Time
+	// renewable credentials can be renewed without a new identity session,
+	// their expiry not depending on the purged session
+	renewable bool
+}
+
+var credentialConfigurations = map[string]CredentialConfiguration{
+	CredentialTypeIdentity: {
+		ID:             CredentialTypeIdentity,
+		Format:         "jwt_vc",
+		Types:          []string{"VerifiableCredential", CredentialTypeIdentity},
+		Claims:         []string{"personalData", "verificationLevel", "verified", "verificationMethod", "verificationMetrics", "evidence"},
+		Scope:          ScopeIdentityCredential,
+		Context:        "https://cachet.id/contexts/identity/v1",
+		SchemaVersion:  "1.0.0",
+		BindingMethods: []string{"jwk"},
+		ProofTypes:     jwtProofTypes,
+		ClaimSensitivity: map[string]ClaimSensitivity{
+			"personalData":        SensitivitySensitive,
+			"verificationLevel":   SensitivityPublic,
+			"verified":            SensitivityPublic,
+			"verificationMethod":  SensitivityPublic,
+			"verificationMetrics": SensitivityPublic,
+			// The identity provider's session identifies the holder there
+			"evidence": SensitivityHighlySensitive,
+		},
+		Cryptosuites: []string{bbs.Cryptosuite},
+		Validity:     tieredValidity,
+		buildSubject: identitySubject,
+		renewable:    true,
+	},
+	CredentialTypeAgeOver: {
+		ID:             CredentialTypeAgeOver,
+		Format:         "jwt_vc",
+		Types:          []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Claims:         []string{"age_over_18", "age_over_21"},
+		Scope:          ScopeAgeCredential,
+		Context:        "https://cachet.id/contexts/age/v1",
+		SchemaVersion:  "1.0.0",
+		BindingMethods: []string{"jwk"},
+		ProofTypes:     jwtProofTypes,
+		// Each predicate is shown alone, so proving 18+ does not tell 21+
+		ClaimSensitivity: map[string]ClaimSensitivity{
+			"age_over_18":       SensitivitySensitive,
+			"age_over_21":       SensitivitySensitive,
+			"verificationLevel": SensitivityPublic,
+		},
+		Cryptosuites: []string{bbs.Cryptosuite},
+		Validity:     tieredValidity,
+		buildSubject: ageOverSubject,
+		capExpiry:    ageOverExpiry,
+	},
+	// Vouch credentials are built and signed by the vouching-service, so
+	// they have no subject builder here
+	CredentialTypeVouch: {
+		ID:     CredentialTypeVouch,
+		Format: "vc+sd-jwt",
+		Types:  []string{CredentialTypeVouch},
+		Claims: []string{"vouch_type", "voucher", "statement", "vouched_at", "vouch"},
+		Scope:  ScopeVouchCredential,
+		// As the vouching-service discloses them
+		ClaimSensitivity: map[string]ClaimSensitivity{
+			"vouch_type": SensitivityPublic,
+			"voucher":    SensitivitySensitive,
+			"statement":  SensitivitySensitive,
+			"vouched_at": SensitivitySensitive,
+			"vouch":      SensitivitySensitive,
+		},
+	},
+}
+
+// configurationForTypes picks the configuration matching the requested types,
+// defaulting to the identity credential for backwards compatibility
+func configurationForTypes(types []string) CredentialConfiguration {
+	for _, t := range types {
+		if config, ok := credentialConfigurations[t]; ok {
+			return config
+		}
+	}
+	return credentialConfigurations[CredentialTypeIdentity]
+}
+
+// unknownScopes returns the requested scopes that do not map to any
+// credential configuration
+func unknownScopes(scope string) []string {
+	var unknown []string
+	for _, requested := range strings.Fields(scope) {
+		if requested == ScopeCredentialIssuance {
+			continue
+		}
+		known := false
+		for _, config := range credentialConfigurations {
+			if config.Scope == requested {
+				known = true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, requested)
+		}
+	}
+	return unknown
+}
+
+// grantedBy reports whether a token's space-delimited scope authorizes
+// issuing this configuration
+func (c CredentialConfiguration) grantedBy(scope string) bool {
+	for _, granted := range strings.Fields(scope) {
+		if granted == c.Scope || granted == ScopeCredentialIssuance {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultValidity is how long credentials are valid for when their
+// configuration or tier sets no period
+const defaultValidity = 90 * 24 * time.Hour
+
+// tieredValidity trusts stronger verifications for longer
+var tieredValidity = &CredentialValidity{
+	Default: defaultValidity,
+	Tiers: map[string]time.Duration{
+		VerificationLevelGold:     365 * 24 * time.Hour,
+		VerificationLevelPremium:  180 * 24 * time.Hour,
+		VerificationLevelStandard: 90 * 24 * time.Hour,
+		VerificationLevelBasic:    30 * 24 * time.Hour,
+	},
+}
+
+// CredentialValidity maps quality tiers to validity periods. Issuer
+// metadata gives the periods in seconds.
+type CredentialValidity struct {
+	Default time.Duration
+	Tiers   map[string]time.Duration
+}
+
+// For returns the validity period of a credential of the tier
+func (v *CredentialValidity) For(tier string) time.Duration {
+	if v == nil {
+		return defaultValidity
+	}
+	if period, ok := v.Tiers[tier]; ok {
+		return period
+	}
+	if v.Default > 0 {
+		return v.Default
+	}
+	return defaultValidity
+}
+
+type credentialValidityJSON struct {
+	Default int64            `json:"default"`
+	Tiers   map[string]int64 `json:"tiers,omitempty"`
+}
+
+func (v CredentialValidity) MarshalJSON() ([]byte, error) {
+	out := credentialValidityJSON{Default: int64(v.Default / time.Second)}
+	if len(v.Tiers) > 0 {
+		out.Tiers = make(map[string]int64, len(v.Tiers))
+		for tier, period := range v.Tiers {
+			out.Tiers[tier] = int64(period / time.Second)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (v *CredentialValidity) UnmarshalJSON(data []byte) error {
+	var in credentialValidityJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	v.Default = time.Duration(in.Default) * time.Second
+	v.Tiers = make(map[string]time.Duration, len(in.Tiers))
+	for tier, seconds := range in.Tiers {
+		v.Tiers[tier] = time.Duration(seconds) * time.Second
+	}
+	return nil
+}
+
+// expiresAt is when a credential of the tier issued at issuedAt expires
+func (c CredentialConfiguration) expiresAt(session VeriffSession, tier string, issuedAt time.Time) time.Time {
+	expiry := issuedAt.Add(c.Validity.For(tier))
+	if c.capExpiry != nil {
+		return c.capExpiry(session, issuedAt, expiry)
+	}
+	return expiry
+}
+
+func identitySubject(session VeriffSession, validation ValidationResult) map[string]interface{} {
+	return map[string]interface{}{
+		"id": "did:example:holder", // This would come from the authenticated session
+
+		// Personal data (selective disclosure ready)
+		"personalData": map[string]interface{}{
+			"age":          calculateAge(session.Person.DateOfBirth),
+			"nationality":  session.Document.Country,
+			"documentType": session.Document.Type,
+		},
+
+		// Verification evidence
+		"verificationLevel":  validation.QualityLevel,
+		"verified":           true,
+		"verificationMethod": "veriff",
+
+		// Quality metrics (for transparency, not selective disclosure)
+		"verificationMetrics": map[string]interface{}{
+			"overallConfidence":    validation.Confidence,
+			"livenessScore":        session.Verification.LivenessScore,
+			"documentAuthenticity": session.Document.Authenticity,
+			"riskScore":            session.Verification.RiskScore,
+			"sessionTimestamp":     session.Verification.Timestamp,
+			"qualityVersion":       validation.QualityVersion,
+			"scoreBreakdown":       validation.Score,
+		},
+
+		// Evidence for audit trail
+		"evidence": []map[string]interface{}{
+			{
+				"type":      "VeriffVerification",
+				"sessionId": session.SessionID,
+				"verifier":  "did:veriff:production",
+				"status":    session.Status,
+			},
+		},
+	}
+}
+
+// ageOverSubject discloses only boolean age predicates: no name, date of
+// birth, document data or session identifiers
+func ageOverSubject(session VeriffSession, validation ValidationResult) map[string]interface{} {
+	age := calculateAge(session.Person.DateOfBirth)
+	subject := map[string]interface{}{
+		"id":                "did:example:holder", // This would come from the authenticated session
+		"verificationLevel": validation.QualityLevel,
+	}
+	for _, threshold := range ageOverThresholds {
+		subject[ageOverClaim(threshold)] = age >= threshold
+	}
+	return subject
+}
+
+// ageOverExpiry caps validity at the next threshold birthday so a false
+// predicate never outlives the date it becomes true
+func ageOverExpiry(session VeriffSession, issuedAt, expiry time.Time) time.Time {
+	dob, err := time.Parse("2006-01-02", session.Person.DateOfBirth)
+	if err != nil {
+		return expiry
+	}
+	for _, threshold := range ageOverThresholds {
+		birthday := dob.AddDate(threshold, 0, 0)
+		if birthday.After(issuedAt) && birthday.Before(expiry) {
+			return birthday
+		}
+	}
+	return expiry
+}
+
+func ageOverClaim(threshold int) string {
+	return fmt.Sprintf("age_over_%d", threshold)
+}
+
+// handleIssuerMetadata serves the OpenID4VCI credential issuer metadata of
+// the request's tenant
+func (s *Server) handleIssuerMetadata(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Issuer metadata requested")
+
+	issuer := s.issuer(r.Context())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"credential_issuer":                   issuer.did,
+		"credential_endpoint":                 tenant.Prefix(r.Context()) + apiversion.Path("/credential"),
+		"notification_endpoint":               tenant.Prefix(r.Context()) + apiversion.Path("/notification"),
+		"credential_configurations_supported": issuer.configurations(),
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgeOverCredential_MinimalDisclosure(t *testing.T) {
+	server := NewServer()
+
+	approveBoundSession(t, server, "age-session", nil)
+	tokenResp := issueSessionToken(t, server, "age-session", ScopeAgeCredential, nil)
+
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var credResp struct {
+		Credential  VerifiableCredential `json:"credential"`
+		Disclosures []string             `json:"disclosures"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+
+	// Each predicate is disclosed on its own
+	subject := credResp.Credential.CredentialSubject
+	assert.NotContains(t, subject, "age_over_18")
+	require.Len(t, credResp.Disclosures, 2)
+	disclosed := disclose(t, subject, credResp.Disclosures)
+	assert.Equal(t, true, disclosed["age_over_18"])
+	assert.Equal(t, true, disclosed["age_over_21"])
+	assert.NotContains(t, subject, "personalData")
+	assert.NotContains(t, subject, "evidence")
+	assert.Contains(t, credResp.Credential.Type, CredentialTypeAgeOver)
+	assert.NotContains(t, w.Body.String(), "1992-03-10")
+	assert.NotContains(t, w.Body.String(), "Alice")
+}
+
+func TestAgeOverExpiry_CappedAtThresholdBirthday(t *testing.T) {
+	issuedAt := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	var session VeriffSession
+	session.Person.DateOfBirth = "2004-10-01" // turns 21 a month after issuance
+
+	config := credentialConfigurations[CredentialTypeAgeOver]
+	expiry := config.expiresAt(session, VerificationLevelGold, issuedAt)
+	assert.Equal(t, time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC), expiry)
+
+	session.Person.DateOfBirth = "1990-01-01"
+	assert.Equal(t, issuedAt.Add(365*24*time.Hour), config.expiresAt(session, VerificationLevelGold, issuedAt))
+}
+
+func TestAgeOn_LeapDayBirthdays(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		dob  string
+		at   time.Time
+		want int
+	}{
+		// Born on 29 February: a year older on 1 March of common years
+		{"2008-02-29", day(2026, 2, 28), 17},
+		{"2008-02-29", day(2026, 3, 1), 18},
+		{"2004-02-29", day(2025, 2, 28), 20},
+		{"2004-02-29", day(2025, 3, 1), 21},
+		// and on 29 February of leap years
+		{"2000-02-29", day(2016, 2, 28), 15},
+		{"2000-02-29", day(2016, 2, 29), 16},
+		// Day of year differs by one across leap and common years
+		{"2000-03-01", day(2018, 3, 1), 18},
+		{"2000-03-01", day(2018, 2, 28), 17},
+		{"2001-03-01", day(2020, 2, 29), 18},
+		{"2001-03-01", day(2020, 3, 1), 19},
+		{"2000-12-31", day(2018, 12, 31), 18},
+		{"not-a-date", day(2018, 12, 31), 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ageOn(tt.dob, tt.at), "%s on %s", tt.dob, tt.at.Format("2006-01-02"))
+	}
+}
+
+func TestAgeOver_PredicateFlipsAtExpiry(t *testing.T) {
+	var session VeriffSession
+	session.Person.DateOfBirth = "2008-02-29"
+	issuedAt := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	// The credential saying age_over_18 is false lapses the moment it
+	// would become true
+	expiry := ageOverExpiry(session, issuedAt, issuedAt.Add(365*24*time.Hour))
+	assert.Equal(t, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), expiry)
+	assert.Equal(t, 17, ageOn(session.Person.DateOfBirth, expiry.Add(-time.Nanosecond)))
+	assert.Equal(t, 18, ageOn(session.Person.DateOfBirth, expiry))
+}
+
+func TestCredentialValidity_ByTier(t *testing.T) {
+	issuedAt := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	config := credentialConfigurations[CredentialTypeIdentity]
+	tests := []struct {
+		tier string
+		want time.Duration
+	}{
+		{VerificationLevelGold, 365 * 24 * time.Hour},
+		{VerificationLevelPremium, 180 * 24 * time.Hour},
+		{VerificationLevelStandard, 90 * 24 * time.Hour},
+		{VerificationLevelBasic, 30 * 24 * time.Hour},
+		{"", defaultValidity},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, issuedAt.Add(tt.want), config.expiresAt(VeriffSession{}, tt.tier, issuedAt), tt.tier)
+	}
+
+	// Configurations without periods keep the default
+	assert.Equal(t, defaultValidity, (*CredentialValidity)(nil).For(VerificationLevelGold))
+}
+
+func TestIssuerMetadata(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/openid-credential-issuer", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var metadata struct {
+		Configurations map[string]CredentialConfiguration `json:"credential_configurations_supported"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+	assert.Contains(t, metadata.Configurations, CredentialTypeIdentity)
+	assert.Equal(t, []string{"age_over_18", "age_over_21"}, metadata.Configurations[CredentialTypeAgeOver].Claims)
+
+	// Holder-bound credentials advertise the proofs of the wallet key
+	identity := metadata.Configurations[CredentialTypeIdentity]
+	assert.Equal(t, []string{"jwk"}, identity.BindingMethods)
+	assert.Contains(t, identity.ProofTypes[proofTypeJWT].SigningAlgorithms, "ES256")
+	assert.Empty(t, metadata.Configurations[CredentialTypeVouch].ProofTypes)
+	assert.Equal(t, SensitivitySensitive, identity.ClaimSensitivity["personalData"])
+	assert.Equal(t, SensitivityHighlySensitive, identity.ClaimSensitivity["evidence"])
+	require.NotNil(t, identity.Validity)
+	assert.Equal(t, 365*24*time.Hour, identity.Validity.Tiers[VerificationLevelGold])
+	assert.Equal(t, 30*24*time.Hour, identity.Validity.Tiers[VerificationLevelBasic])
+	assert.Nil(t, metadata.Configurations[CredentialTypeVouch].Validity)
+}
+
+func TestCredentialScope_RestrictsTypes(t *testing.T) {
+	server := NewServer()
+
+	approveBoundSession(t, server, "scoped-session", nil)
+	tokenResp := issueSessionToken(t, server, "scoped-session", ScopeAgeCredential, nil)
+	auth := map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken}
+
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, auth)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_scope")
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), ScopeIdentityCredential)
+
+	// The rejected request leaves the journey open for the permitted type
+	w = postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, auth)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCredentialScope_UnknownScopeRejected(t *testing.T) {
+	server := NewServer()
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+		Scope:     "identity_credential admin",
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_scope")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// issuerDID identifies the gateway as credential issuer. Under did:web it
+// resolves to https://cachet.id/.well-known/did.json.
+const issuerDID = "did:web:cachet.id"
+
+// PublishedJWK is a verification key as served in the JWKS and DID document
+type PublishedJWK struct {
+	JWK
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// VerificationMethod is a DID document key entry (JsonWebKey2020)
+type VerificationMethod struct {
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	Controller   string       `json:"controller"`
+	PublicKeyJwk PublishedJWK `json:"publicKeyJwk"`
+}
+
+// DIDDocument is the did:web document for the issuer
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	AssertionMethod    []string             `json:"assertionMethod"`
+	Authentication     []string             `json:"authentication"`
+}
+
+func rsaPublicJWK(key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// signingKeyID derives the kid of an RSA signing key from its RFC 7638 thumbprint
+func signingKeyID(key *rsa.PublicKey) string {
+	kid, _ := rsaPublicJWK(key).Thumbprint()
+	return kid
+}
+
+// publishedKeys lists the issuer's active signing keys: the RSA key of its
+// tokens and the BBS key of its ldp_vc credentials. Both the JWKS and the
+// DID document are generated from it so their key material never diverges.
+func publishedKeys(issuer *tenantIssuer) []PublishedJWK {
+	key := &issuer.signingKey.PublicKey
+	return []PublishedJWK{{
+		JWK: rsaPublicJWK(key),
+		Use: "sig",
+		Alg: "RS256",
+		Kid: signingKeyID(key),
+	}, {
+		JWK: bbsPublicJWK(issuer.bbsKey.Public()),
+		Use: "sig",
+		Alg: bbsAlgorithm,
+		Kid: bbsKeyID(issuer.bbsKey.Public()),
+	}}
+}
+
+func didDocument(issuer *tenantIssuer) DIDDocument {
+	doc := DIDDocument{
+		Context: []string{
+			"https://www.w3.org/ns/did/v1",
+			"https://w3id.org/security/suites/jws-2020/v1",
+		},
+		ID:                 issuer.did,
+		VerificationMethod: []VerificationMethod{},
+		AssertionMethod:    []string{},
+		Authentication:     []string{},
+	}
+	for _, key := range publishedKeys(issuer) {
+		id := issuer.did + "#" + key.Kid
+		doc.VerificationMethod = append(doc.VerificationMethod, VerificationMethod{
+			ID:           id,
+			Type:         "JsonWebKey2020",
+			Controller:   issuer.did,
+			PublicKeyJwk: key,
+		})
+		doc.AssertionMethod = append(doc.AssertionMethod, id)
+		if key.Alg != bbsAlgorithm {
+			// The BBS key only ever signs credentials
+			doc.Authentication = append(doc.Authentication, id)
+		}
+	}
+	return doc
+}
+
+// handleJWKS serves the signing keys of the request's tenant
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("JWKS requested")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": publishedKeys(s.issuer(r.Context()))})
+}
+
+// handleDIDDocument serves the did:web document of the request's tenant
+func (s *Server) handleDIDDocument(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("DID document requested")
+	writeJSON(w, http.StatusOK, didDocument(s.issuer(r.Context())))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getWellKnown(t *testing.T, server *Server, path string, out interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), out))
+}
+
+func TestDIDDocument_MatchesJWKS(t *testing.T) {
+	server := NewServer()
+
+	var doc DIDDocument
+	getWellKnown(t, server, "/.well-known/did.json", &doc)
+	var jwks struct {
+		Keys []PublishedJWK `json:"keys"`
+	}
+	getWellKnown(t, server, "/.well-known/jwks.json", &jwks)
+
+	assert.Equal(t, issuerDID, doc.ID)
+	require.Len(t, jwks.Keys, 2)
+	require.Len(t, doc.VerificationMethod, 2)
+	for i, method := range doc.VerificationMethod {
+		assert.Equal(t, issuerDID+"#"+jwks.Keys[i].Kid, method.ID)
+		assert.Equal(t, issuerDID, method.Controller)
+		assert.Equal(t, jwks.Keys[i], method.PublicKeyJwk)
+	}
+	assert.Equal(t, []string{doc.VerificationMethod[0].ID, doc.VerificationMethod[1].ID}, doc.AssertionMethod)
+	// The BBS key signs credentials, never authenticates
+	assert.Equal(t, bbsAlgorithm, jwks.Keys[1].Alg)
+	assert.Equal(t, []string{doc.VerificationMethod[0].ID}, doc.Authentication)
+}
+
+func TestDIDDocument_VerifiesIssuedTokens(t *testing.T) {
+	server := NewServer()
+	var doc DIDDocument
+	getWellKnown(t, server, "/.well-known/did.json", &doc)
+
+	tokenResp := issueToken(t, server)
+	token, err := jwt.Parse(tokenResp.AccessToken, func(token *jwt.Token) (interface{}, error) {
+		for _, method := range doc.VerificationMethod {
+			if method.PublicKeyJwk.Kid == token.Header["kid"] {
+				return method.PublicKeyJwk.PublicKey()
+			}
+		}
+		return nil, assert.AnError
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	require.NoError(t, err)
+	assert.True(t, token.Valid)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP (RFC 9449) proof-of-possession for access tokens
+const (
+	dpopHeader        = "DPoP"
+	dpopProofType     = "dpop+jwt"
+	dpopProofLifetime = 5 * time.Minute
+	dpopClockSkew     = 30 * time.Second
+)
+
+var (
+	ErrDPoPInvalid  = errors.New("invalid DPoP proof")
+	ErrDPoPReplayed = errors.New("DPoP proof replayed")
+)
+
+var dpopSigningMethods = []string{"ES256", "ES384", "ES512", "RS256", "PS256"}
+
+// jwkPrivateMembers are the JWK members of private and symmetric keys
+// (RFC 7518 §6.2.2, §6.3.2 and §6.4)
+var jwkPrivateMembers = []string{"d", "p", "q", "dp", "dq", "qi", "oth", "k"}
+
+// JWK is a wallet or issuer public key in JWK form; its thumbprint names
+// the wallet key DPoP and holder binding tie tokens and credentials to
+type JWK = didresolver.JWK
+
+type dpopClaims struct {
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	ATH string `json:"ath,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// replayCache remembers one-time identifiers (proof jti values) for a
+// fixed window. Every entry lives ttl, so the order they were remembered in
+// is the order they expire in, and expiring them only looks at the oldest.
+type replayCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	seen  map[string]time.Time
+	order []replayEntry // oldest first
+}
+
+type replayEntry struct {
+	id     string
+	expiry time.Time
+}
+
+func newReplayCache(ttl time.Duration) *replayCache {
+	return &replayCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// remember records id, reporting false if it was already seen
+func (c *replayCache) remember(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expired := 0
+	for _, entry := range c.order {
+		if !now.After(entry.expiry) {
+			break
+		}
+		if c.seen[entry.id].Equal(entry.expiry) {
+			delete(c.seen, entry.id)
+		}
+		expired++
+	}
+	c.order = c.order[expired:]
+	// Concurrent callers may remember slightly out of order, so an entry
+	// can outlive its expiry behind a younger one
+	if expiry, ok := c.seen[id]; ok && !now.After(expiry) {
+		return false
+	}
+	expiry := now.Add(c.ttl)
+	c.seen[id] = expiry
+	c.order = append(c.order, replayEntry{id: id, expiry: expiry})
+	return true
+}
+
+// verifyDPoPProof validates a DPoP proof for the request and returns the
+// thumbprint of the key it was signed with. accessToken is empty at the token
+// endpoint and set at resource endpoints, where the proof must carry its hash.
+func (s *Server) verifyDPoPProof(r *http.Request, proof, accessToken string) (string, error) {
+	var jwk JWK
+	token, err := jwt.ParseWithClaims(proof, &dpopClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("unexpected typ %q", typ)
+		}
+		// RFC 9449 §4.3: the jwk must not contain a private key
+		header, _ := t.Header["jwk"].(map[string]interface{})
+		for _, member := range jwkPrivateMembers {
+			if _, ok := header[member]; ok {
+				return nil, fmt.Errorf("jwk carries private key member %q", member)
+			}
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	}, jwt.WithValidMethods(dpopSigningMethods), jwt.WithIssuedAt(), jwt.WithLeeway(dpopClockSkew))
+	if err != nil || !token.Valid {
+		return "", fmt.Errorf("%w: %v", ErrDPoPInvalid, err)
+	}
+
+	claims := token.Claims.(*dpopClaims)
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return "", fmt.Errorf("%w: missing jti or iat", ErrDPoPInvalid)
+	}
+	now := time.Now()
+	if now.Sub(claims.IssuedAt.Time) > dpopProofLifetime {
+		return "", fmt.Errorf("%w: proof too old", ErrDPoPInvalid)
+	}
+	if !strings.EqualFold(claims.HTM, r.Method) {
+		return "", fmt.Errorf("%w: htm mismatch", ErrDPoPInvalid)
+	}
+	if claims.HTU != requestURI(r) {
+		return "", fmt.Errorf("%w: htu mismatch", ErrDPoPInvalid)
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: ath mismatch", ErrDPoPInvalid)
+		}
+	}
+	if !s.dpopReplay.remember(claims.ID, now) {
+		return "", ErrDPoPReplayed
+	}
+
+	return jwk.Thumbprint()
+}
+
+// requestPathKey holds the path a request was sent to
+type requestPathKey struct{}
+
+// recordRequestPath keeps the path the wallet called before the tenant and
+// version middleware strip their prefixes from it, since DPoP proofs name
+// the full path in htu
+func recordRequestPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestPathKey{}, r.URL.EscapedPath())))
+	})
+}
+
+// requestURI reconstructs the htu value for a request, without query or
+// fragment, from the path the wallet called
+func requestURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	path, ok := r.Context().Value(requestPathKey{}).(string)
+	if !ok {
+		path = r.URL.EscapedPath()
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// tokenKeyThumbprint returns the cnf.jkt the access token is bound to, if any
+func tokenKeyThumbprint(token *jwt.Token) string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
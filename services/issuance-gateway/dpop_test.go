@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newWalletKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func walletJWK(key *ecdsa.PrivateKey) JWK {
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, method, uri, accessToken string) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"jti": uuid.NewString(),
+		"htm": method,
+		"htu": uri,
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopProofType
+	token.Header["jwk"] = walletJWK(key)
+	proof, err := token.SignedString(key)
+	require.NoError(t, err)
+	return proof
+}
+
+func issueDPoPToken(t *testing.T, server *Server, key *ecdsa.PrivateKey) TokenResponse {
+	t.Helper()
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+		Scope:     "credential_issuance",
+	}, map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/oauth/token", "")})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestDPoP_TokenBoundToKey(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+
+	resp := issueDPoPToken(t, server, key)
+	assert.Equal(t, "DPoP", resp.TokenType)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(resp.AccessToken, jwt.MapClaims{})
+	require.NoError(t, err)
+	expected, err := walletJWK(key).Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, expected, tokenKeyThumbprint(parsed))
+}
+
+func TestDPoP_CredentialRequiresMatchingProof(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	approveBoundSession(t, server, "dpop-session", key)
+	token := issueSessionToken(t, server, "dpop-session", "credential_issuance", key).AccessToken
+	credReq := CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", CredentialTypeIdentity}, Proof: credentialProof(t, key, issuerDID)}
+	credURI := "http://example.com/credential"
+
+	// Replaying the token as a bearer token is rejected
+	w := postJSON(t, server, "/credential", credReq, map[string]string{"Authorization": "Bearer " + token})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A proof signed by another key is rejected
+	w = postJSON(t, server, "/credential", credReq, map[string]string{
+		"Authorization": "DPoP " + token,
+		dpopHeader:      dpopProof(t, newWalletKey(t), http.MethodPost, credURI, token),
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	proof := dpopProof(t, key, http.MethodPost, credURI, token)
+	headers := map[string]string{"Authorization": "DPoP " + token, dpopHeader: proof}
+	w = postJSON(t, server, "/credential", credReq, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The same proof cannot be replayed
+	w = postJSON(t, server, "/credential", credReq, headers)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDPoP_RejectsProofForOtherURI(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+	}, map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/credential", "")})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDPoP_RejectsPrivateKeyInHeader(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": uuid.NewString(),
+		"htm": http.MethodPost,
+		"htu": "http://example.com/oauth/token",
+		"iat": time.Now().Unix(),
+	})
+	token.Header["typ"] = dpopProofType
+	jwk := walletJWK(key)
+	token.Header["jwk"] = map[string]string{
+		"kty": jwk.Kty, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y,
+		"d": base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+	}
+	proof, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+	}, map[string]string{dpopHeader: proof})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidDPoPProof, decodeError(t, w).Code)
+}
+
+func TestReplayCache_ExpiresOldestFirst(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	start := time.Now()
+
+	assert.True(t, cache.remember("a", start))
+	assert.True(t, cache.remember("b", start.Add(30*time.Second)))
+	assert.False(t, cache.remember("a", start.Add(time.Minute)), "seen within the window")
+
+	// Only the expired head of the queue is swept
+	assert.True(t, cache.remember("c", start.Add(61*time.Second)))
+	assert.NotContains(t, cache.seen, "a")
+	assert.Contains(t, cache.seen, "b")
+	assert.Len(t, cache.order, 2)
+
+	// An identifier may be used again once its window has passed
+	assert.True(t, cache.remember("a", start.Add(62*time.Second)))
+	assert.False(t, cache.remember("b", start.Add(90*time.Second)))
+	assert.True(t, cache.remember("b", start.Add(91*time.Second)))
+	assert.Equal(t, []string{"c", "a", "b"}, func() []string {
+		var ids []string
+		for _, entry := range cache.order {
+			ids = append(ids, entry.id)
+		}
+		return ids
+	}())
+}
+
+func TestDPoP_ProofNamesPathCalled(t *testing.T) {
+	server := newTenantServer(t)
+	tests := []struct {
+		path  string
+		scope string
+	}{
+		{"/oauth/token", "credential_issuance"},
+		{"/v1/oauth/token", "credential_issuance"},
+		{"/t/acme/v1/oauth/token", ScopeAgeCredential},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			key := newWalletKey(t)
+			request := func(htu string) int {
+				return postJSON(t, server, tt.path, TokenRequest{
+					GrantType: GrantTypeClientCredentials,
+					ClientID:  "test-wallet",
+					Scope:     tt.scope,
+				}, map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, htu, "")}).Code
+			}
+			assert.Equal(t, http.StatusOK, request("http://example.com"+tt.path))
+			if tt.path != "/oauth/token" {
+				// The path the route is declared under is not the one called
+				assert.Equal(t, http.StatusBadRequest, request("http://example.com/oauth/token"))
+			}
+		})
+	}
+
+	// Access tokens are proven at the versioned credential endpoint too
+	key := newWalletKey(t)
+	approveBoundSession(t, server, "versioned-session", key)
+	token := issueSessionToken(t, server, "versioned-session", "credential_issuance", key).AccessToken
+	w := postJSON(t, server, "/v1/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  credentialProof(t, key, issuerDID),
+	}, map[string]string{
+		"Authorization": "DPoP " + token,
+		dpopHeader:      dpopProof(t, key, http.MethodPost, "http://example.com/v1/credential", token),
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
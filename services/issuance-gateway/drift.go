@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// driftBins is how many equal-width bins a score distribution is cut into
+const driftBins = 10
+
+// driftEpsilon stands in for an empty bin's share, so the stability index
+// stays finite
+const driftEpsilon = 1e-4
+
+// DriftConfig tunes the detector comparing the distribution of Veriff
+// scores week over week
+type DriftConfig struct {
+	Window     time.Duration `env:"SCORE_DRIFT_WINDOW" default:"168h" doc:"Period whose Veriff score distribution is compared with the one before; a week by default"`
+	Threshold  float64       `env:"SCORE_DRIFT_THRESHOLD" default:"0.2" doc:"Population stability index above which a score's distribution is reported as drifted; 0.1 is a moderate shift, 0.25 a major one"`
+	MinSamples int           `env:"SCORE_DRIFT_MIN_SAMPLES" default:"100" doc:"Sessions each period needs before their distributions are compared"`
+	Interval   time.Duration `env:"SCORE_DRIFT_INTERVAL" default:"1h" doc:"How often the current period is compared with the one before"`
+}
+
+// Validate checks the durations, threshold and sample size are positive
+func (c DriftConfig) Validate() error {
+	if c.Window <= 0 || c.Interval <= 0 {
+		return errors.New("SCORE_DRIFT_WINDOW and SCORE_DRIFT_INTERVAL must be positive")
+	}
+	if c.Threshold <= 0 {
+		return errors.New("SCORE_DRIFT_THRESHOLD must be positive")
+	}
+	if c.MinSamples <= 0 {
+		return errors.New("SCORE_DRIFT_MIN_SAMPLES must be positive")
+	}
+	return nil
+}
+
+// defaultDriftConfig matches the configuration defaults
+func defaultDriftConfig() DriftConfig {
+	return DriftConfig{Window: 7 * 24 * time.Hour, Threshold: 0.2, MinSamples: 100, Interval: time.Hour}
+}
+
+// scoreHistogram counts a score's observations in equal-width bins over [0, 1]
+type scoreHistogram [driftBins]int
+
+func (h *scoreHistogram) add(v float64) {
+	bin := int(clampScore(v) * driftBins)
+	if bin == driftBins {
+		bin--
+	}
+	h[bin]++
+}
+
+func (h scoreHistogram) total() int {
+	n := 0
+	for _, c := range h {
+		n += c
+	}
+	return n
+}
+
+// stabilityIndex is the population stability index of the current
+// distribution against the baseline: zero when they match, growing as they
+// part
+func stabilityIndex(baseline, current scoreHistogram) float64 {
+	nb, nc := float64(baseline.total()), float64(current.total())
+	psi := 0.0
+	for i := range baseline {
+		b := math.Max(float64(baseline[i])/nb, driftEpsilon)
+		c := math.Max(float64(current[i])/nc, driftEpsilon)
+		psi += (c - b) * math.Log(c/b)
+	}
+	return psi
+}
+
+// ScoreDrift is a score whose distribution this period shifted from the
+// period before
+type ScoreDrift struct {
+	Metric   string
+	Index    float64
+	Baseline int
+	Current  int
+}
+
+// scoreDrift keeps the distribution of each Veriff score over the current
+// period and the one before
+type scoreDrift struct {
+	mu          sync.Mutex
+	cfg         DriftConfig
+	periodStart time.Time
+	current     map[string]*scoreHistogram
+	baseline    map[string]*scoreHistogram
+	alerted     map[string]bool // metrics already reported this period
+}
+
+func newScoreDrift(cfg DriftConfig) *scoreDrift {
+	return &scoreDrift{
+		cfg:      cfg,
+		current:  make(map[string]*scoreHistogram),
+		baseline: make(map[string]*scoreHistogram),
+		alerted:  make(map[string]bool),
+	}
+}
+
+// Observe adds a session's scores to the current period
+func (d *scoreDrift) Observe(scores map[string]float64, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rollLocked(now)
+	for metric, v := range scores {
+		h, ok := d.current[metric]
+		if !ok {
+			h = &scoreHistogram{}
+			d.current[metric] = h
+		}
+		h.add(v)
+	}
+}
+
+// Check compares each score's distribution so far this period with the
+// period before. It returns every index it could compute, and the drifts
+// past the threshold not yet reported this period.
+func (d *scoreDrift) Check(now time.Time) (map[string]float64, []ScoreDrift) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rollLocked(now)
+	indexes := make(map[string]float64)
+	var drifts []ScoreDrift
+	for metric, current := range d.current {
+		baseline, ok := d.baseline[metric]
+		if !ok || baseline.total() < d.cfg.MinSamples || current.total() < d.cfg.MinSamples {
+			continue
+		}
+		index := stabilityIndex(*baseline, *current)
+		indexes[metric] = index
+		if index > d.cfg.Threshold && !d.alerted[metric] {
+			d.alerted[metric] = true
+			drifts = append(drifts, ScoreDrift{Metric: metric, Index: index, Baseline: baseline.total(), Current: current.total()})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Metric < drifts[j].Metric })
+	return indexes, drifts
+}
+
+// rollLocked starts a new period once the current one is over. The period
+// just over becomes the baseline, unless no session came in a whole period
+// since, which leaves nothing to compare with.
+func (d *scoreDrift) rollLocked(now time.Time) {
+	if d.periodStart.IsZero() {
+		d.periodStart = now
+		return
+	}
+	elapsed := now.Sub(d.periodStart)
+	if elapsed < d.cfg.Window {
+		return
+	}
+	periods := elapsed / d.cfg.Window
+	if periods == 1 {
+		d.baseline = d.current
+	} else {
+		d.baseline = make(map[string]*scoreHistogram)
+	}
+	d.current = make(map[string]*scoreHistogram)
+	d.alerted = make(map[string]bool)
+	d.periodStart = d.periodStart.Add(periods * d.cfg.Window)
+}
+
+// observeScores feeds a Veriff session's scores to the histograms and the
+// drift detector
+func (s *Server) observeScores(session VeriffSession, score QualityScore) {
+	scores := sessionMetrics(session)
+	if score.Overall > 0 {
+		scores[metricQualityScore] = score.Overall
+	}
+	s.metrics.ObserveScores(scores)
+	s.drift.Observe(scores, time.Now())
+}
+
+// checkScoreDrift exports each score's stability index and alerts on the
+// scores that drifted
+func (s *Server) checkScoreDrift(now time.Time) []ScoreDrift {
+	indexes, drifts := s.drift.Check(now)
+	for metric, index := range indexes {
+		s.metrics.drift.WithLabelValues(metric).Set(index)
+	}
+	for _, drift := range drifts {
+		s.metrics.driftAlerts.WithLabelValues(drift.Metric).Inc()
+		log.Warn().
+			Str("metric", drift.Metric).
+			Float64("stability_index", drift.Index).
+			Int("baseline_sessions", drift.Baseline).
+			Int("current_sessions", drift.Current).
+			Msg("Veriff score distribution drifted from the previous period; check for a provider model change or a fraud wave")
+	}
+	return drifts
+}
+
+// detectScoreDrift compares the score distributions every interval
+func (s *Server) detectScoreDrift(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkScoreDrift(time.Now())
+	}
+}
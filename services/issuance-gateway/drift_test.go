@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// observeWeek has n sessions score around center, spread over ±0.05
+func observeWeek(d *scoreDrift, start time.Time, n int, center float64) {
+	for i := 0; i < n; i++ {
+		v := center - 0.05 + 0.1*float64(i)/float64(n)
+		d.Observe(map[string]float64{MetricLiveness: v, MetricDocumentAuthenticity: 0.95}, start.Add(time.Duration(i)*time.Minute))
+	}
+}
+
+func TestScoreDrift_DetectsShiftedDistribution(t *testing.T) {
+	cfg := DriftConfig{Window: 7 * 24 * time.Hour, Threshold: 0.2, MinSamples: 50, Interval: time.Hour}
+	d := newScoreDrift(cfg)
+	week := time.Date(2026, 5, 4, 0, 0, 0, 0, time.UTC)
+	observeWeek(d, week, 100, 0.9)
+
+	// Nothing to compare with in the first week
+	indexes, drifts := d.Check(week.Add(3 * 24 * time.Hour))
+	assert.Empty(t, indexes)
+	assert.Empty(t, drifts)
+
+	// A steady week does not alert
+	observeWeek(d, week.Add(cfg.Window), 100, 0.9)
+	indexes, drifts = d.Check(week.Add(cfg.Window + 3*24*time.Hour))
+	assert.Less(t, indexes[MetricLiveness], 0.01)
+	assert.Empty(t, drifts)
+
+	// Liveness scores dropping the week after does, once
+	next := week.Add(2 * cfg.Window)
+	observeWeek(d, next, 100, 0.6)
+	indexes, drifts = d.Check(next.Add(3 * 24 * time.Hour))
+	require.Len(t, drifts, 1)
+	assert.Equal(t, MetricLiveness, drifts[0].Metric)
+	assert.Greater(t, drifts[0].Index, cfg.Threshold)
+	assert.Equal(t, 100, drifts[0].Baseline)
+	assert.Less(t, indexes[MetricDocumentAuthenticity], 0.01)
+	_, drifts = d.Check(next.Add(4 * 24 * time.Hour))
+	assert.Empty(t, drifts)
+
+	// After a week without sessions there is no baseline
+	indexes, _ = d.Check(next.Add(3 * cfg.Window))
+	assert.Empty(t, indexes)
+}
+
+func TestScoreDrift_NeedsEnoughSessions(t *testing.T) {
+	cfg := DriftConfig{Window: 7 * 24 * time.Hour, Threshold: 0.2, MinSamples: 50, Interval: time.Hour}
+	d := newScoreDrift(cfg)
+	week := time.Date(2026, 5, 4, 0, 0, 0, 0, time.UTC)
+	observeWeek(d, week, 100, 0.9)
+	observeWeek(d, week.Add(cfg.Window), 10, 0.3)
+	indexes, drifts := d.Check(week.Add(cfg.Window + time.Hour))
+	assert.Empty(t, indexes)
+	assert.Empty(t, drifts)
+}
+
+func TestServer_AlertsOnScoreDrift(t *testing.T) {
+	server := NewServer()
+	server.drift = newScoreDrift(DriftConfig{Window: 7 * 24 * time.Hour, Threshold: 0.2, MinSamples: 50, Interval: time.Hour})
+	week := time.Date(2026, 5, 4, 0, 0, 0, 0, time.UTC)
+	observeWeek(server.drift, week, 100, 0.9)
+	observeWeek(server.drift, week.Add(7*24*time.Hour), 100, 0.5)
+
+	drifts := server.checkScoreDrift(week.Add(8 * 24 * time.Hour))
+	require.Len(t, drifts, 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(server.metrics.driftAlerts.WithLabelValues(MetricLiveness)))
+	assert.Equal(t, drifts[0].Index, testutil.ToFloat64(server.metrics.drift.WithLabelValues(MetricLiveness)))
+}
+
+func TestDriftConfig_Validate(t *testing.T) {
+	assert.NoError(t, defaultDriftConfig().Validate())
+	for _, cfg := range []DriftConfig{
+		{Window: 0, Threshold: 0.2, MinSamples: 100, Interval: time.Hour},
+		{Window: time.Hour, Threshold: 0, MinSamples: 100, Interval: time.Hour},
+		{Window: time.Hour, Threshold: 0.2, MinSamples: 0, Interval: time.Hour},
+		{Window: time.Hour, Threshold: 0.2, MinSamples: 100},
+	} {
+		assert.Error(t, cfg.Validate())
+	}
+}
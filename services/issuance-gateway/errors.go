@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+)
+
+// OAuth 2.0 error codes (RFC 6749 §5.2, RFC 6750 §3.1, RFC 9449 §7) and
+// OpenID4VCI credential endpoint error codes
+const (
+	ErrCodeInvalidRequest           = "invalid_request"
+	ErrCodeInvalidClient            = "invalid_client"
+	ErrCodeInvalidGrant             = "invalid_grant"
+	ErrCodeUnsupportedGrantType     = "unsupported_grant_type"
+	ErrCodeInvalidScope             = "invalid_scope"
+	ErrCodeInvalidToken             = "invalid_token"
+	ErrCodeInvalidDPoPProof         = "invalid_dpop_proof"
+	ErrCodeInvalidCredentialRequest = "invalid_credential_request"
+	ErrCodeInvalidProof             = "invalid_proof"
+	// ErrCodeUnsupportedCredentialType refuses credentials the tenant does
+	// not offer
+	ErrCodeUnsupportedCredentialType = "unsupported_credential_type"
+	// ErrCodeUnsupportedCredentialFormat refuses a format the credential
+	// is not issued in
+	ErrCodeUnsupportedCredentialFormat = "unsupported_credential_format"
+	ErrCodeServerError                 = "server_error"
+)
+
+// writeOAuthError writes a problem coded with the OAuth error code, which
+// it also carries in the error member OAuth clients read (RFC 6749 §5.2).
+// Token responses must not be cached (RFC 6749 §5.1), and the same applies
+// to their errors.
+func writeOAuthError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	problem.New(status, code, message).With("error", code).Write(w, r)
+}
+
+// refuseOAuth answers requests the OpenAPI document refuses like the OAuth
+// errors the handlers write
+func refuseOAuth(w http.ResponseWriter, r *http.Request, details *problem.Details) {
+	w.Header().Set("Cache-Control", "no-store")
+	details.With("error", details.Code).Write(w, r)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) problem.Details {
+	t.Helper()
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+	var resp problem.Details
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotEmpty(t, resp.Detail)
+	return resp
+}
+
+func TestOAuthErrors_TokenEndpoint(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("{"))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	resp := decodeError(t, w)
+	assert.Equal(t, ErrCodeInvalidRequest, resp.Code)
+	assert.Equal(t, ErrCodeInvalidRequest, resp.Extensions["error"], "OAuth clients read the error member")
+	assert.Equal(t, problem.TypeBase+ErrCodeInvalidRequest, resp.Type)
+	assert.Equal(t, "/oauth/token", resp.Instance)
+	assert.NotEmpty(t, resp.RequestID)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	cases := []struct {
+		name   string
+		req    TokenRequest
+		status int
+		code   string
+	}{
+		{"unsupported grant", TokenRequest{GrantType: "password", ClientID: "w"}, http.StatusBadRequest, ErrCodeUnsupportedGrantType},
+		{"unknown scope", TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "w", Scope: "root"}, http.StatusBadRequest, ErrCodeInvalidScope},
+		{"unverified session", TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "w", SessionID: "unknown"}, http.StatusBadRequest, ErrCodeInvalidGrant},
+		{"bad refresh token", TokenRequest{GrantType: GrantTypeRefreshToken, RefreshToken: "nope"}, http.StatusBadRequest, ErrCodeInvalidGrant},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postJSON(t, server, "/oauth/token", tc.req, nil)
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.code, decodeError(t, w).Code)
+		})
+	}
+}
+
+func TestOAuthErrors_CredentialEndpoint(t *testing.T) {
+	server := NewServer()
+	credReq := CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", CredentialTypeIdentity}}
+
+	w := postJSON(t, server, "/credential", credReq, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, ErrCodeInvalidToken, decodeError(t, w).Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	w = postJSON(t, server, "/credential", credReq, map[string]string{"Authorization": "Bearer not-a-jwt"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, ErrCodeInvalidToken, decodeError(t, w).Code)
+
+	w = postJSON(t, server, "/credential", credReq, map[string]string{"Authorization": "Bearer " + issueToken(t, server).AccessToken})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidCredentialRequest, decodeError(t, w).Code)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+// publishTimeout bounds how long issuance waits on the event bus
+const publishTimeout = 5 * time.Second
+
+// publishIssued announces an issued credential on the event bus. Failures
+// are logged: the holder has the credential whether or not others hear of
+// it.
+func (s *Server) publishIssued(ctx context.Context, issued events.CredentialIssued) {
+	s.publish(ctx, issued.CredentialID, issued)
+}
+
+// publish announces a change to a credential on the event bus, logging
+// failures
+func (s *Server) publish(ctx context.Context, credentialID string, data events.Data) {
+	if s.events == nil {
+		return
+	}
+	event, err := events.New("issuance-gateway", credentialID, data, time.Now())
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), publishTimeout)
+		err = s.events.Publish(ctx, event)
+		cancel()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("credential_id", credentialID).Str("type", data.EventType()).Msg("Failed to publish credential event")
+	}
+}
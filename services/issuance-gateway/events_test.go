@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialIssuance_PublishesEvent(t *testing.T) {
+	bus := events.NewMemory()
+	var published []events.Event
+	require.NoError(t, bus.Subscribe("connector-hub", []string{events.TypeCredentialIssued}, func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	}))
+	server := NewServer()
+	server.events = bus
+
+	approveBoundSession(t, server, "published-session", nil)
+	tokenResp := issueSessionToken(t, server, "published-session", "credential_issuance", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp CredentialResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NoError(t, bus.Close())
+
+	require.Len(t, published, 1)
+	assert.Equal(t, "issuance-gateway", published[0].Source)
+	var issued events.CredentialIssued
+	require.NoError(t, published[0].Decode(&issued))
+	credential, _ := resp.Credential.(map[string]interface{})
+	assert.Equal(t, credential["id"], issued.CredentialID)
+	assert.Equal(t, issued.CredentialID, published[0].Subject)
+	assert.Equal(t, issuerDID, issued.Issuer)
+	assert.Equal(t, "jwt_vc", issued.Format)
+	assert.Contains(t, issued.Types, CredentialTypeIdentity)
+	assert.NotEmpty(t, issued.JourneyID)
+	assert.NotEmpty(t, issued.StatusListIndex)
+}
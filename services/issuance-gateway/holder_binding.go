@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OpenID4VCI proofs of possession of the key a credential is bound to
+// (OpenID4VCI §7.2.1)
+const (
+	proofTypeJWT            = "jwt"
+	credentialProofJWTType  = "openid4vci-proof+jwt"
+	credentialProofLifetime = 5 * time.Minute
+)
+
+var ErrProofInvalid = errors.New("invalid credential proof")
+
+// CredentialProof is the wallet's proof of possession of the key the
+// credential is to be bound to
+type CredentialProof struct {
+	ProofType string `json:"proof_type"`
+	JWT       string `json:"jwt"`
+}
+
+// Confirmation is the cnf claim of a holder-bound credential: the wallet
+// key its key binding JWTs are checked against
+type Confirmation struct {
+	JWK JWK `json:"jwk"`
+}
+
+// ProofTypeMetadata advertises a proof type in the issuer metadata
+type ProofTypeMetadata struct {
+	SigningAlgorithms []string `json:"proof_signing_alg_values_supported"`
+}
+
+// jwtProofTypes is what holder-bound configurations accept as proofs
+var jwtProofTypes = map[string]ProofTypeMetadata{
+	proofTypeJWT: {SigningAlgorithms: dpopSigningMethods},
+}
+
+// verifyCredentialProof validates the wallet's proof for a credential of
+// the issuer with identifier audience and returns the key it proves
+// possession of
+func verifyCredentialProof(proof *CredentialProof, audience string, now time.Time) (JWK, error) {
+	if proof == nil || proof.JWT == "" {
+		return JWK{}, fmt.Errorf("%w: missing proof of the wallet key", ErrProofInvalid)
+	}
+	if proof.ProofType != proofTypeJWT {
+		return JWK{}, fmt.Errorf("%w: unsupported proof_type %q", ErrProofInvalid, proof.ProofType)
+	}
+	var jwk JWK
+	token, err := jwt.ParseWithClaims(proof.JWT, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != credentialProofJWTType {
+			return nil, fmt.Errorf("unexpected typ %q", typ)
+		}
+		header, _ := t.Header["jwk"].(map[string]interface{})
+		if _, private := header["d"]; private || header == nil {
+			return nil, errors.New("jwk must be a public key")
+		}
+		raw, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	},
+		jwt.WithValidMethods(dpopSigningMethods),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(dpopClockSkew),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil || !token.Valid {
+		return JWK{}, fmt.Errorf("%w: %v", ErrProofInvalid, err)
+	}
+	claims := token.Claims.(*jwt.RegisteredClaims)
+	if claims.IssuedAt == nil || now.Sub(claims.IssuedAt.Time) > credentialProofLifetime {
+		return JWK{}, fmt.Errorf("%w: missing or stale iat", ErrProofInvalid)
+	}
+	return jwk, nil
+}
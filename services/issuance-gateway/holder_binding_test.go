@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// credentialProof is the wallet's proof of possession of key for a
+// credential of the issuer audience
+func credentialProof(t testing.TB, key *ecdsa.PrivateKey, audience string) *CredentialProof {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": audience,
+		"iat": time.Now().Unix(),
+	})
+	token.Header["typ"] = credentialProofJWTType
+	token.Header["jwk"] = walletJWK(key)
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return &CredentialProof{ProofType: proofTypeJWT, JWT: signed}
+}
+
+// walletProof proves possession of a fresh wallet key to the default issuer
+func walletProof(t testing.TB) *CredentialProof {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return credentialProof(t, key, issuerDID)
+}
+
+func TestCredentialIssuance_BindsWalletKey(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	credential := issueBoundIdentity(t, server, key, "bound-session")
+	require.NotNil(t, credential.Cnf)
+	assert.Equal(t, walletJWK(key), credential.Cnf.JWK)
+
+	// Renewal is left to the wallet holding the bound key
+	w := renew(t, server, newWalletKey(t), credential)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	w = renew(t, server, key, credential)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, credential.Cnf, resp.Credential.Cnf)
+}
+
+func TestCredentialIssuance_InvalidProof(t *testing.T) {
+	key := newWalletKey(t)
+	sign := func(typ string, claims jwt.MapClaims, jwk interface{}) *CredentialProof {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = typ
+		token.Header["jwk"] = jwk
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return &CredentialProof{ProofType: proofTypeJWT, JWT: signed}
+	}
+	fresh := jwt.MapClaims{"aud": issuerDID, "iat": time.Now().Unix()}
+	private := map[string]interface{}{"kty": "EC", "crv": "P-256", "x": walletJWK(key).X, "y": walletJWK(key).Y, "d": "secret"}
+
+	tests := []struct {
+		name  string
+		proof *CredentialProof
+	}{
+		{"missing", nil},
+		{"unsupported proof type", &CredentialProof{ProofType: "cwt", JWT: credentialProof(t, key, issuerDID).JWT}},
+		{"DPoP proof", sign(dpopProofType, fresh, walletJWK(key))},
+		{"another issuer", credentialProof(t, key, "did:web:elsewhere.example")},
+		{"stale", sign(credentialProofJWTType, jwt.MapClaims{"aud": issuerDID, "iat": time.Now().Add(-time.Hour).Unix()}, walletJWK(key))},
+		{"no iat", sign(credentialProofJWTType, jwt.MapClaims{"aud": issuerDID}, walletJWK(key))},
+		{"private key", sign(credentialProofJWTType, fresh, private)},
+		{"another key", sign(credentialProofJWTType, fresh, walletJWK(newWalletKey(t)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			approveBoundSession(t, server, "proof-session", nil)
+			token := issueSessionToken(t, server, "proof-session", "credential_issuance", nil)
+			w := postJSON(t, server, "/credential", CredentialRequest{
+				Format: "jwt_vc",
+				Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+				Proof:  tt.proof,
+			}, map[string]string{"Authorization": "Bearer " + token.AccessToken})
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			assert.Equal(t, ErrCodeInvalidProof, decodeError(t, w).Code)
+		})
+	}
+}
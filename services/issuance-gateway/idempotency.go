@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyTTL           = 24 * time.Hour
+)
+
+// idempotencyOutcome is the result of reserving an idempotency key
+type idempotencyOutcome int
+
+const (
+	idempotencyNew      idempotencyOutcome = iota // first use; caller must Complete or Release
+	idempotencyReplay                             // a stored response is available
+	idempotencyInFlight                           // an earlier request with the key is still running
+	idempotencyMismatch                           // the key was used with a different request body
+)
+
+type idempotentResponse struct {
+	requestDigest string
+	status        int
+	body          []byte
+	completed     bool
+	expiresAt     time.Time
+}
+
+// idempotencyCache stores credential responses per client and key so mobile
+// retries receive the identical credential (production should use Redis)
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotentResponse
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotentResponse)}
+}
+
+// Reserve claims key for a request with the given body digest, or returns the
+// stored response when the key has already completed
+func (c *idempotencyCache) Reserve(key, digest string, now time.Time) (idempotencyOutcome, *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	entry, ok := c.entries[key]
+	switch {
+	case !ok:
+		c.entries[key] = &idempotentResponse{requestDigest: digest, expiresAt: now.Add(c.ttl)}
+		return idempotencyNew, nil
+	case entry.requestDigest != digest:
+		return idempotencyMismatch, nil
+	case !entry.completed:
+		return idempotencyInFlight, nil
+	}
+	return idempotencyReplay, entry
+}
+
+// Complete stores the response for a reserved key
+func (c *idempotencyCache) Complete(key string, status int, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.status = status
+		entry.body = body
+		entry.completed = true
+	}
+}
+
+// Release drops a reservation that never completed, so a failed request
+// can be retried with the same key
+func (c *idempotencyCache) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && !entry.completed {
+		delete(c.entries, key)
+	}
+}
+
+// Forget drops a completed response no retry needs any more
+func (c *idempotencyCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && entry.completed {
+		delete(c.entries, key)
+	}
+}
+
+func requestDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// replayIdempotentResponse writes a stored response back to the client
+func replayIdempotentResponse(w http.ResponseWriter, key string, stored *idempotentResponse) {
+	log.Info().Str("idempotency_key", key).Msg("Replaying stored credential response")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.status)
+	if _, err := w.Write(stored.body); err != nil {
+		log.Error().Err(err).Msg("Failed to write replayed response")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency_RetryReturnsSameCredential(t *testing.T) {
+	server := NewServer()
+
+	approveBoundSession(t, server, "retry-session", nil)
+	tokenResp := issueSessionToken(t, server, "retry-session", "credential_issuance", nil)
+
+	credReq := CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", CredentialTypeIdentity}, Proof: walletProof(t)}
+	headers := map[string]string{
+		"Authorization":      "Bearer " + tokenResp.AccessToken,
+		idempotencyKeyHeader: "retry-1",
+	}
+
+	first := postJSON(t, server, "/credential", credReq, headers)
+	require.Equal(t, http.StatusOK, first.Code)
+
+	second := postJSON(t, server, "/credential", credReq, headers)
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get(idempotentReplayedHeader))
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+
+	// Reusing the key for a different request is rejected
+	credReq.Types = []string{"VerifiableCredential", CredentialTypeAgeOver}
+	w := postJSON(t, server, "/credential", credReq, headers)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// Without the key a retry finds the session's credential already issued
+	delete(headers, idempotencyKeyHeader)
+	credReq.Types = []string{"VerifiableCredential", CredentialTypeIdentity}
+	w = postJSON(t, server, "/credential", credReq, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIdempotency_FailedRequestReleasesKey(t *testing.T) {
+	server := NewServer()
+	approveBoundSession(t, server, "retried-session", nil)
+	tokenResp := issueSessionToken(t, server, "retried-session", "credential_issuance", nil)
+	headers := map[string]string{
+		"Authorization":      "Bearer " + tokenResp.AccessToken,
+		idempotencyKeyHeader: "early-retry",
+	}
+	credReq := CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", CredentialTypeIdentity}}
+
+	// No proof of the wallet key, so the first attempt fails and is not cached
+	w := postJSON(t, server, "/credential", credReq, headers)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	credReq.Proof = walletProof(t)
+	w = postJSON(t, server, "/credential", credReq, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(idempotentReplayedHeader))
+}
+
+func TestIdempotencyCache_Expiry(t *testing.T) {
+	cache := newIdempotencyCache(time.Hour)
+	now := time.Now()
+
+	outcome, _ := cache.Reserve("client:key", "digest", now)
+	require.Equal(t, idempotencyNew, outcome)
+	outcome, _ = cache.Reserve("client:key", "digest", now)
+	assert.Equal(t, idempotencyInFlight, outcome)
+
+	cache.Complete("client:key", http.StatusOK, []byte(`{}`))
+	outcome, stored := cache.Reserve("client:key", "digest", now)
+	require.Equal(t, idempotencyReplay, outcome)
+	assert.Equal(t, http.StatusOK, stored.status)
+
+	outcome, _ = cache.Reserve("client:key", "digest", now.Add(2*time.Hour))
+	assert.Equal(t, idempotencyNew, outcome)
+}
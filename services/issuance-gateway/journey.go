@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// IssuanceState is a step of the issuance journey
+type IssuanceState string
+
+const (
+	StateOfferCreated     IssuanceState = "offer_created"
+	StateIDVPending       IssuanceState = "idv_pending"
+	StateReviewPending    IssuanceState = "review_pending"
+	StateVerified         IssuanceState = "verified"
+	StateTokenIssued      IssuanceState = "token_issued"
+	StateCredentialIssued IssuanceState = "credential_issued"
+	StateNotified         IssuanceState = "notified"
+	StateFailed           IssuanceState = "failed"
+)
+
+var (
+	ErrJourneyNotFound   = errors.New("issuance journey not found")
+	ErrJourneyExists     = errors.New("issuance journey already exists for session")
+	ErrInvalidTransition = errors.New("invalid issuance state transition")
+	ErrTokenNotBound     = errors.New("access token not bound to the journey's session and wallet")
+)
+
+// allowedTransitions lists the states reachable from each state. Any
+// non-terminal state may also move to failed.
+var allowedTransitions = map[IssuanceState][]IssuanceState{
+	StateOfferCreated:     {StateIDVPending, StateReviewPending, StateVerified, StateFailed},
+	StateIDVPending:       {StateReviewPending, StateVerified, StateFailed},
+	StateReviewPending:    {StateVerified, StateFailed},
+	StateVerified:         {StateTokenIssued, StateFailed},
+	StateTokenIssued:      {StateCredentialIssued, StateFailed},
+	StateCredentialIssued: {StateNotified, StateFailed},
+	StateNotified:         {},
+	StateFailed:           {},
+}
+
+// stateTimeouts bounds how long a journey may sit in a state before it is
+// considered stuck. States without an entry never time out.
+var stateTimeouts = map[IssuanceState]time.Duration{
+	StateOfferCreated:  30 * time.Minute,
+	StateIDVPending:    time.Hour,
+	StateReviewPending: 24 * time.Hour,
+	StateVerified:      24 * time.Hour,
+	StateTokenIssued:   time.Hour,
+}
+
+// IsTerminal reports whether no further transitions are possible
+func (s IssuanceState) IsTerminal() bool {
+	return len(allowedTransitions[s]) == 0
+}
+
+// CanTransitionTo reports whether moving from s to next is allowed
+func (s IssuanceState) CanTransitionTo(next IssuanceState) bool {
+	for _, allowed := range allowedTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+type StateTransition struct {
+	From   IssuanceState `json:"from,omitempty"`
+	To     IssuanceState `json:"to"`
+	At     time.Time     `json:"at"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// IssuanceJourney tracks a single holder from offer to issued credential
+type IssuanceJourney struct {
+	ID            string            `json:"id"`
+	Tenant        string            `json:"tenant"`
+	SessionID     string            `json:"session_id"`
+	ClientID      string            `json:"client_id,omitempty"`
+	JKT           string            `json:"jkt,omitempty"`
+	CredentialID  string            `json:"credential_id,omitempty"`
+	State         IssuanceState     `json:"state"`
+	FailureReason string            `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	Deadline      *time.Time        `json:"deadline,omitempty"`
+	Transitions   []StateTransition `json:"transitions"`
+}
+
+// IsStuck reports whether the journey has outlived its current state's timeout
+func (j *IssuanceJourney) IsStuck(now time.Time) bool {
+	return j.Deadline != nil && now.After(*j.Deadline)
+}
+
+// JourneyFilter narrows journey listings
+type JourneyFilter struct {
+	Tenant    string
+	State     IssuanceState
+	SessionID string
+	StuckAt   *time.Time
+}
+
+// JourneyStore persists journeys and their transition history
+type JourneyStore interface {
+	// Create saves a new journey unless its session already has one, which
+	// it returns with ErrJourneyExists, so concurrent starts for a session
+	// leave a single journey
+	Create(ctx context.Context, journey IssuanceJourney) (IssuanceJourney, error)
+	Save(ctx context.Context, journey IssuanceJourney) error
+	Get(ctx context.Context, id string) (IssuanceJourney, error)
+	FindBySession(ctx context.Context, sessionID string) (IssuanceJourney, error)
+	List(ctx context.Context, filter JourneyFilter) ([]IssuanceJourney, error)
+}
+
+// memoryJourneyStore keeps journeys in memory, for development and tests;
+// deployments with DATABASE_URL set keep them in Postgres
+// (postgresJourneyStore)
+type memoryJourneyStore struct {
+	mu        sync.RWMutex
+	journeys  map[string]IssuanceJourney
+	bySession map[string]string
+}
+
+func newMemoryJourneyStore() *memoryJourneyStore {
+	return &memoryJourneyStore{
+		journeys:  make(map[string]IssuanceJourney),
+		bySession: make(map[string]string),
+	}
+}
+
+func (m *memoryJourneyStore) Create(ctx context.Context, journey IssuanceJourney) (IssuanceJourney, error) {
+	if err := ctx.Err(); err != nil {
+		return IssuanceJourney{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.bySession[journey.SessionID]; ok && journey.SessionID != "" {
+		return m.journeys[id], ErrJourneyExists
+	}
+	m.save(journey)
+	return journey, nil
+}
+
+func (m *memoryJourneyStore) Save(ctx context.Context, journey IssuanceJourney) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.save(journey)
+	return nil
+}
+
+// save stores a journey; callers hold the lock
+func (m *memoryJourneyStore) save(journey IssuanceJourney) {
+	journey.Transitions = append([]StateTransition(nil), journey.Transitions...)
+	m.journeys[journey.ID] = journey
+	if journey.SessionID != "" {
+		m.bySession[journey.SessionID] = journey.ID
+	}
+}
+
+func (m *memoryJourneyStore) Get(ctx context.Context, id string) (IssuanceJourney, error) {
+	if err := ctx.Err(); err != nil {
+		return IssuanceJourney{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	journey, ok := m.journeys[id]
+	if !ok {
+		return IssuanceJourney{}, ErrJourneyNotFound
+	}
+	return journey, nil
+}
+
+func (m *memoryJourneyStore) FindBySession(ctx context.Context, sessionID string) (IssuanceJourney, error) {
+	m.mu.RLock()
+	id, ok := m.bySession[sessionID]
+	m.mu.RUnlock()
+	if !ok {
+		return IssuanceJourney{}, ErrJourneyNotFound
+	}
+	return m.Get(ctx, id)
+}
+
+func (m *memoryJourneyStore) List(ctx context.Context, filter JourneyFilter) ([]IssuanceJourney, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	journeys := make([]IssuanceJourney, 0, len(m.journeys))
+	for _, j := range m.journeys {
+		if filter.Tenant != "" && j.Tenant != filter.Tenant {
+			continue
+		}
+		if filter.State != "" && j.State != filter.State {
+			continue
+		}
+		if filter.SessionID != "" && j.SessionID != filter.SessionID {
+			continue
+		}
+		if filter.StuckAt != nil && !j.IsStuck(*filter.StuckAt) {
+			continue
+		}
+		journeys = append(journeys, j)
+	}
+	sort.Slice(journeys, func(a, b int) bool {
+		return journeys[a].CreatedAt.Before(journeys[b].CreatedAt)
+	})
+	return journeys, nil
+}
+
+// IssuanceStateMachine validates and records journey transitions
+type IssuanceStateMachine struct {
+	mu    sync.Mutex
+	store JourneyStore
+	now   func() time.Time
+}
+
+func NewIssuanceStateMachine(store JourneyStore) *IssuanceStateMachine {
+	return &IssuanceStateMachine{store: store, now: time.Now}
+}
+
+// Start creates a journey in the offer_created state, for the tenant ctx
+// belongs to. A session has one journey: starting another returns the
+// existing one with ErrJourneyExists. The mutate callback, when set, may
+// record the wallet the session is bound to.
+func (m *IssuanceStateMachine) Start(ctx context.Context, id, sessionID string, mutate func(*IssuanceJourney)) (IssuanceJourney, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	journey := IssuanceJourney{
+		ID:        id,
+		Tenant:    tenant.FromContext(ctx).ID,
+		SessionID: sessionID,
+		State:     StateOfferCreated,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Transitions: []StateTransition{
+			{To: StateOfferCreated, At: now},
+		},
+	}
+	journey.Deadline = deadlineFor(StateOfferCreated, now)
+	if mutate != nil {
+		mutate(&journey)
+	}
+	return m.store.Create(ctx, journey)
+}
+
+// Transition moves a journey to the next state, rejecting moves the state
+// graph does not allow. The mutate callback may update journey fields as part
+// of the same persisted step.
+func (m *IssuanceStateMachine) Transition(ctx context.Context, id string, to IssuanceState, reason string, mutate func(*IssuanceJourney)) (IssuanceJourney, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	journey, err := m.store.Get(ctx, id)
+	if err != nil {
+		return IssuanceJourney{}, err
+	}
+	if !journey.State.CanTransitionTo(to) {
+		return journey, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, journey.State, to)
+	}
+
+	now := m.now()
+	journey.Transitions = append(journey.Transitions, StateTransition{
+		From:   journey.State,
+		To:     to,
+		At:     now,
+		Reason: reason,
+	})
+	journey.State = to
+	journey.UpdatedAt = now
+	journey.Deadline = deadlineFor(to, now)
+	if to == StateFailed {
+		journey.FailureReason = reason
+	}
+	if mutate != nil {
+		mutate(&journey)
+	}
+
+	if err := m.store.Save(ctx, journey); err != nil {
+		return IssuanceJourney{}, err
+	}
+	return journey, nil
+}
+
+// ForSession returns the journey tracking a Veriff session, creating one if
+// the session was started outside an offer.
+func (m *IssuanceStateMachine) ForSession(ctx context.Context, newID func() string, sessionID string) (IssuanceJourney, error) {
+	journey, err := m.store.FindBySession(ctx, sessionID)
+	if err == nil {
+		return journey, nil
+	}
+	if !errors.Is(err, ErrJourneyNotFound) {
+		return IssuanceJourney{}, err
+	}
+	journey, err = m.Start(ctx, newID(), sessionID, nil)
+	if errors.Is(err, ErrJourneyExists) {
+		// Started concurrently, by a redelivered webhook or another instance
+		return journey, nil
+	}
+	return journey, err
+}
+
+// ExpireStuck fails every journey whose current state has timed out
+func (m *IssuanceStateMachine) ExpireStuck(ctx context.Context) ([]IssuanceJourney, error) {
+	now := m.now()
+	stuck, err := m.store.List(ctx, JourneyFilter{StuckAt: &now})
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]IssuanceJourney, 0, len(stuck))
+	for _, j := range stuck {
+		reason := fmt.Sprintf("timed out in state %s", j.State)
+		failed, err := m.Transition(ctx, j.ID, StateFailed, reason, nil)
+		if err != nil {
+			// Raced with a concurrent transition; the next sweep will re-evaluate
+			continue
+		}
+		expired = append(expired, failed)
+	}
+	return expired, nil
+}
+
+// ownsJourney reports whether a journey belongs to the tenant of ctx
+func ownsJourney(ctx context.Context, journey IssuanceJourney) bool {
+	return journey.Tenant == tenant.FromContext(ctx).ID
+}
+
+func deadlineFor(state IssuanceState, from time.Time) *time.Time {
+	timeout, ok := stateTimeouts[state]
+	if !ok {
+		return nil
+	}
+	deadline := from.Add(timeout)
+	return &deadline
+}
+
+// journeyForToken resolves the journey a credential request belongs to: the
+// one of the session the token is bound to, which must be in token_issued
+// and was issued the token by the same client and key. Tokens bound to no
+// session resolve to none.
+func (s *Server) journeyForToken(ctx context.Context, token *jwt.Token) (IssuanceJourney, error) {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	sessionID, _ := claims["session_id"].(string)
+	if sessionID == "" {
+		return IssuanceJourney{}, ErrTokenNotBound
+	}
+	journey, err := s.journeys.store.FindBySession(ctx, sessionID)
+	if err != nil {
+		return IssuanceJourney{}, err
+	}
+	if !ownsJourney(ctx, journey) {
+		return IssuanceJourney{}, ErrJourneyNotFound
+	}
+	if journey.State != StateTokenIssued {
+		return IssuanceJourney{}, fmt.Errorf("%w: journey is %s", ErrInvalidTransition, journey.State)
+	}
+	clientID, _ := claims["client_id"].(string)
+	if clientID != journey.ClientID || tokenKeyThumbprint(token) != journey.JKT {
+		return IssuanceJourney{}, ErrTokenNotBound
+	}
+	return journey, nil
+}
+
+// redeemableBy reports whether a wallet may obtain a token for the journey's
+// session: one presenting the client_id and DPoP key recorded on the journey
+// when it was started. A journey recording neither is redeemed only through
+// a credential offer, whose pre-authorized code stands for the binding.
+func (j IssuanceJourney) redeemableBy(clientID, jkt string, offered bool) bool {
+	if j.ClientID == "" && j.JKT == "" {
+		return offered
+	}
+	return (j.ClientID == "" || j.ClientID == clientID) && (j.JKT == "" || j.JKT == jkt)
+}
+
+// advanceJourney records a webhook-driven transition, logging rather than
+// failing on out-of-order events since Veriff may redeliver. Store errors are
+// returned so the webhook event can be retried.
+func (s *Server) advanceJourney(ctx context.Context, journey IssuanceJourney, to IssuanceState, reason string) error {
+	_, err := s.journeys.Transition(ctx, journey.ID, to, reason, nil)
+	if errors.Is(err, ErrInvalidTransition) {
+		log.Warn().
+			Err(err).
+			Str("journey_id", journey.ID).
+			Str("session_id", journey.SessionID).
+			Msg("Ignoring issuance journey transition")
+		return nil
+	}
+	return err
+}
+
+func (s *Server) failJourney(ctx context.Context, id, reason string) {
+	if _, err := s.journeys.Transition(ctx, id, StateFailed, reason, nil); err != nil {
+		log.Warn().Err(err).Str("journey_id", id).Msg("Failed to mark issuance journey as failed")
+	}
+}
+
+func (s *Server) reapStuckJourneys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		expired, err := s.journeys.ExpireStuck(ctx)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to expire stuck issuance journeys")
+			continue
+		}
+		for _, j := range expired {
+			log.Warn().
+				Str("journey_id", j.ID).
+				Str("session_id", j.SessionID).
+				Str("reason", j.FailureReason).
+				Msg("Issuance journey timed out")
+		}
+	}
+}
+
+// authorizeJourneyOperator refuses callers without the operator token:
+// journeys name the identity sessions of every holder
+func (s *Server) authorizeJourneyOperator(w http.ResponseWriter, r *http.Request) bool {
+	if s.authorizeOperator(r) {
+		return true
+	}
+	s.security.AuthFailure(r, "operator")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+	problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+type CreateJourneyRequest struct {
+	SessionID string `json:"session_id"`
+	// ClientID and JKT bind the session to the wallet that may obtain a
+	// token for it with the client_credentials grant
+	ClientID string `json:"client_id,omitempty"`
+	JKT      string `json:"jkt,omitempty"`
+}
+
+func (s *Server) handleCreateJourney(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeJourneyOperator(w, r) {
+		return
+	}
+	var req CreateJourneyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	journey, err := s.journeys.Start(r.Context(), uuid.New().String(), req.SessionID, func(j *IssuanceJourney) {
+		j.ClientID = req.ClientID
+		j.JKT = req.JKT
+	})
+	if errors.Is(err, ErrJourneyExists) {
+		problem.Error(w, r, "Journey already exists for session", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create issuance journey")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().
+		Str("journey_id", journey.ID).
+		Str("session_id", journey.SessionID).
+		Msg("Issuance journey created")
+
+	writeJSON(w, http.StatusCreated, journey)
+}
+
+func (s *Server) handleListJourneys(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeJourneyOperator(w, r) {
+		return
+	}
+	filter := JourneyFilter{
+		Tenant:    tenant.FromContext(r.Context()).ID,
+		State:     IssuanceState(r.URL.Query().Get("state")),
+		SessionID: r.URL.Query().Get("session_id"),
+	}
+	if filter.State != "" {
+		if _, ok := allowedTransitions[filter.State]; !ok {
+			problem.Error(w, r, "Unknown state", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Query().Get("stuck") == "true" {
+		now := s.journeys.now()
+		filter.StuckAt = &now
+	}
+
+	journeys, err := s.journeys.store.List(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list issuance journeys")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"journeys": journeys})
+}
+
+func (s *Server) handleGetJourney(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeJourneyOperator(w, r) {
+		return
+	}
+	journey, err := s.journeys.store.Get(r.Context(), chi.URLParam(r, "id"))
+	if err == nil && !ownsJourney(r.Context(), journey) {
+		err = ErrJourneyNotFound
+	}
+	if errors.Is(err, ErrJourneyNotFound) {
+		problem.Error(w, r, "Journey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load issuance journey")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, journey)
+}
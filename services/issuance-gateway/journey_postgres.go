@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// postgresJourneyStore keeps issuance journeys in Postgres
+type postgresJourneyStore struct {
+	db *sql.DB
+}
+
+func newPostgresJourneyStore(db *sql.DB) *postgresJourneyStore {
+	return &postgresJourneyStore{db: db}
+}
+
+// Create inserts the journey under a transaction-scoped advisory lock on its
+// session, so instances starting a journey for one session at once insert
+// it once
+func (p *postgresJourneyStore) Create(ctx context.Context, journey IssuanceJourney) (IssuanceJourney, error) {
+	document, err := json.Marshal(journey)
+	if err != nil {
+		return IssuanceJourney{}, err
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return IssuanceJourney{}, err
+	}
+	defer tx.Rollback()
+	if journey.SessionID != "" {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "journey:"+journey.SessionID); err != nil {
+			return IssuanceJourney{}, fmt.Errorf("locking session %s: %w", journey.SessionID, err)
+		}
+		existing, err := scanJourney(tx.QueryRowContext(ctx,
+			`SELECT document FROM journeys WHERE session_id = $1 ORDER BY created_at DESC LIMIT 1`, journey.SessionID))
+		if err == nil {
+			return existing, ErrJourneyExists
+		}
+		if !errors.Is(err, ErrJourneyNotFound) {
+			return IssuanceJourney{}, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO journeys (id, session_id, state, deadline, created_at, document, tenant) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		journey.ID, journey.SessionID, string(journey.State), journey.Deadline, journey.CreatedAt, document, journey.Tenant); err != nil {
+		return IssuanceJourney{}, err
+	}
+	return journey, tx.Commit()
+}
+
+func (p *postgresJourneyStore) Save(ctx context.Context, journey IssuanceJourney) error {
+	document, err := json.Marshal(journey)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO journeys (id, session_id, state, deadline, created_at, document, tenant) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (id) DO UPDATE SET session_id = $2, state = $3, deadline = $4, document = $6`,
+		journey.ID, journey.SessionID, string(journey.State), journey.Deadline, journey.CreatedAt, document, journey.Tenant)
+	return err
+}
+
+func (p *postgresJourneyStore) Get(ctx context.Context, id string) (IssuanceJourney, error) {
+	return scanJourney(p.db.QueryRowContext(ctx, `SELECT document FROM journeys WHERE id = $1`, id))
+}
+
+func (p *postgresJourneyStore) FindBySession(ctx context.Context, sessionID string) (IssuanceJourney, error) {
+	return scanJourney(p.db.QueryRowContext(ctx,
+		`SELECT document FROM journeys WHERE session_id = $1 ORDER BY created_at DESC LIMIT 1`, sessionID))
+}
+
+func (p *postgresJourneyStore) List(ctx context.Context, filter JourneyFilter) ([]IssuanceJourney, error) {
+	var stuckAt sql.NullTime
+	if filter.StuckAt != nil {
+		stuckAt = sql.NullTime{Time: *filter.StuckAt, Valid: true}
+	}
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT document FROM journeys
+		 WHERE ($1 = '' OR state = $1) AND ($2 = '' OR session_id = $2) AND ($3::timestamptz IS NULL OR deadline < $3)
+		   AND ($4 = '' OR tenant = $4)
+		 ORDER BY created_at`,
+		string(filter.State), filter.SessionID, stuckAt, filter.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	journeys := []IssuanceJourney{}
+	for rows.Next() {
+		journey, err := scanJourney(rows)
+		if err != nil {
+			return nil, err
+		}
+		journeys = append(journeys, journey)
+	}
+	return journeys, rows.Err()
+}
+
+func scanJourney(row rowScanner) (IssuanceJourney, error) {
+	var document []byte
+	if err := row.Scan(&document); errors.Is(err, sql.ErrNoRows) {
+		return IssuanceJourney{}, ErrJourneyNotFound
+	} else if err != nil {
+		return IssuanceJourney{}, err
+	}
+	var journey IssuanceJourney
+	if err := json.Unmarshal(document, &journey); err != nil {
+		return IssuanceJourney{}, fmt.Errorf("decoding issuance journey: %w", err)
+	}
+	return journey, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postJSON(t testing.TB, server *Server, path string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func approvedSession(sessionID string) map[string]interface{} {
+	return map[string]interface{}{
+		"session_id": sessionID,
+		"status":     "approved",
+		"person": map[string]interface{}{
+			"firstName":   "Alice",
+			"lastName":    "Johnson",
+			"dateOfBirth": "1992-03-10",
+			"confidence":  0.97,
+		},
+		"document": map[string]interface{}{
+			"number":       "AB123456C",
+			"type":         "PASSPORT",
+			"country":      "GB",
+			"authenticity": 0.99,
+		},
+		"verification": map[string]interface{}{
+			"liveness_score":     0.94,
+			"overall_confidence": 0.98,
+			"risk_score":         0.02,
+		},
+	}
+}
+
+// bindSession starts the journey of a Veriff session bound to the test
+// wallet and, when key is set, to its DPoP key, before Veriff reports on it
+func bindSession(t testing.TB, server *Server, sessionID string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	_, err := server.journeys.Start(context.Background(), "journey-"+sessionID, sessionID, func(j *IssuanceJourney) {
+		j.ClientID = "test-wallet"
+		if key != nil {
+			j.JKT, _ = walletJWK(key).Thumbprint()
+		}
+	})
+	require.NoError(t, err)
+}
+
+// approveBoundSession approves a Veriff session bound to the test wallet
+func approveBoundSession(t testing.TB, server *Server, sessionID string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	bindSession(t, server, sessionID, key)
+	w := postJSON(t, server, "/webhooks/veriff", approvedSession(sessionID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+// issueSessionToken obtains the test wallet's token for an approved session,
+// bound to key when it is set
+func issueSessionToken(t *testing.T, server *Server, sessionID, scope string, key *ecdsa.PrivateKey) TokenResponse {
+	t.Helper()
+	var headers map[string]string
+	if key != nil {
+		headers = map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/oauth/token", "")}
+	}
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "test-wallet",
+		Scope:     scope,
+		SessionID: sessionID,
+	}, headers)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestStateMachine_RejectsInvalidTransition(t *testing.T) {
+	machine := NewIssuanceStateMachine(newMemoryJourneyStore())
+
+	journey, err := machine.Start(context.Background(), "j-1", "session-1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, StateOfferCreated, journey.State)
+
+	_, err = machine.Transition(context.Background(), journey.ID, StateCredentialIssued, "skip ahead", nil)
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+
+	journey, err = machine.Transition(context.Background(), journey.ID, StateVerified, "approved", nil)
+	require.NoError(t, err)
+	assert.Equal(t, StateVerified, journey.State)
+	assert.Len(t, journey.Transitions, 2)
+	assert.Equal(t, StateOfferCreated, journey.Transitions[1].From)
+}
+
+func TestStateMachine_ExpireStuck(t *testing.T) {
+	machine := NewIssuanceStateMachine(newMemoryJourneyStore())
+	start := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	machine.now = func() time.Time { return start }
+
+	_, err := machine.Start(context.Background(), "j-1", "session-1", nil)
+	require.NoError(t, err)
+
+	machine.now = func() time.Time { return start.Add(31 * time.Minute) }
+	expired, err := machine.ExpireStuck(context.Background())
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, StateFailed, expired[0].State)
+	assert.Contains(t, expired[0].FailureReason, "offer_created")
+	assert.True(t, expired[0].State.IsTerminal())
+}
+
+func TestJourney_SessionBoundIssuance(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+
+	w := postJSON(t, server, "/issuance/journeys", CreateJourneyRequest{SessionID: "session-bound", ClientID: "test-wallet"}, operatorHeaders)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = postJSON(t, server, "/webhooks/veriff", approvedSession("session-bound"), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+		Scope:     "credential_issuance",
+		SessionID: "session-bound",
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokenResp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokenResp))
+
+	w = postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", "IdentityCredential"},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = operatorRequest(t, server, http.MethodGet, "/issuance/journeys?session_id=session-bound", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var listing struct {
+		Journeys []IssuanceJourney `json:"journeys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	require.Len(t, listing.Journeys, 1)
+	journey := listing.Journeys[0]
+	assert.Equal(t, StateCredentialIssued, journey.State)
+	assert.Equal(t, "test-wallet", journey.ClientID)
+	assert.NotEmpty(t, journey.CredentialID)
+
+	w = operatorRequest(t, server, http.MethodGet, "/issuance/journeys/"+journey.ID, "operator-secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Journeys name every holder's session, so only operators see them
+	for _, path := range []string{"/issuance/journeys", "/issuance/journeys/" + journey.ID} {
+		w = operatorRequest(t, server, http.MethodGet, path, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+		w = operatorRequest(t, server, http.MethodGet, path, "wrong-secret")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+	}
+	w = postJSON(t, server, "/issuance/journeys", CreateJourneyRequest{SessionID: "anonymous-session"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestJourney_TokenRejectedForUnverifiedSession(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+
+	w := postJSON(t, server, "/issuance/journeys", CreateJourneyRequest{SessionID: "pending-session"}, operatorHeaders)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: "client_credentials",
+		ClientID:  "test-wallet",
+		SessionID: "pending-session",
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestJourney_TokenBoundToJourneyWallet(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	tokenRequest := func(sessionID, clientID string, key *ecdsa.PrivateKey) *httptest.ResponseRecorder {
+		headers := map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/oauth/token", "")}
+		return postJSON(t, server, "/oauth/token", TokenRequest{
+			GrantType: GrantTypeClientCredentials,
+			ClientID:  clientID,
+			Scope:     "credential_issuance",
+			SessionID: sessionID,
+		}, headers)
+	}
+
+	// A session no wallet was bound to is redeemed only through an offer
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", approvedSession("unbound-session"), nil).Code)
+	w := tokenRequest("unbound-session", "test-wallet", key)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidGrant, decodeError(t, w).Code)
+
+	// Another client or another key cannot claim a bound session
+	approveBoundSession(t, server, "bound-session", key)
+	assert.Equal(t, http.StatusBadRequest, tokenRequest("bound-session", "other-wallet", key).Code)
+	assert.Equal(t, http.StatusBadRequest, tokenRequest("bound-session", "test-wallet", newWalletKey(t)).Code)
+	journey, err := server.journeys.store.FindBySession(context.Background(), "bound-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateVerified, journey.State)
+	assert.Equal(t, http.StatusOK, tokenRequest("bound-session", "test-wallet", key).Code)
+
+	// A token bound to no session issues no credential, even with a
+	// verified session waiting
+	approveBoundSession(t, server, "waiting-session", nil)
+	token := issueToken(t, server)
+	w = postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + token.AccessToken})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	journey, err = server.journeys.store.FindBySession(context.Background(), "waiting-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateVerified, journey.State)
+}
+
+func TestJourney_DeclinedSessionFails(t *testing.T) {
+	server := NewServer()
+
+	session := approvedSession("declined-session")
+	session["status"] = "declined"
+	w := postJSON(t, server, "/webhooks/veriff", session, nil)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	journey, err := server.journeys.store.FindBySession(context.Background(), "declined-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateFailed, journey.State)
+	assert.Equal(t, "Veriff session declined", journey.FailureReason)
+}
+
+func TestJourney_OneJourneyPerSession(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+
+	const creates = 8
+	codes := make(chan int, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postJSON(t, server, "/issuance/journeys", CreateJourneyRequest{SessionID: "raced-session"}, operatorHeaders).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusCreated: 1, http.StatusConflict: creates - 1}, counts)
+
+	// The store refuses a second journey whoever asks
+	journeys, err := server.journeys.store.List(context.Background(), JourneyFilter{SessionID: "raced-session"})
+	require.NoError(t, err)
+	require.Len(t, journeys, 1)
+	existing, err := server.journeys.Start(context.Background(), "another-id", "raced-session", nil)
+	assert.ErrorIs(t, err, ErrJourneyExists)
+	assert.Equal(t, journeys[0].ID, existing.ID)
+	journey, err := server.journeys.ForSession(context.Background(), func() string { return "yet-another-id" }, "raced-session")
+	require.NoError(t, err)
+	assert.Equal(t, journeys[0].ID, journey.ID)
+}
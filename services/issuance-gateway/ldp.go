@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+)
+
+// FormatLDPVC is a W3C credential secured with a data integrity proof. The
+// gateway signs it with BBS, so the holder derives a fresh, unlinkable proof
+// for each presentation disclosing only the claims it needs, such as
+// age_over_18 without the date of birth behind it.
+const FormatLDPVC = "ldp_vc"
+
+// bbsAlgorithm is the alg of the BBS key in the JWKS
+const bbsAlgorithm = "BBS"
+
+func bbsPublicJWK(key *bbs.PublicKey) JWK {
+	return JWK{
+		Kty: "OKP",
+		Crv: didresolver.CurveBLS12381G2,
+		X:   base64.RawURLEncoding.EncodeToString(key.Bytes()),
+	}
+}
+
+// bbsKeyID derives the kid of a BBS key from its RFC 7638 thumbprint
+func bbsKeyID(key *bbs.PublicKey) string {
+	kid, _ := bbsPublicJWK(key).Thumbprint()
+	return kid
+}
+
+// issuesLDP reports whether the configuration is issued as ldp_vc
+func (c CredentialConfiguration) issuesLDP() bool {
+	return len(c.Cryptosuites) > 0
+}
+
+// ldpSubject keeps the highly sensitive claims out of an ldp_vc subject for
+// the wallet's vault. Every other claim is signed as a statement of its own,
+// so it needs no disclosure digest to be withheld.
+func (c CredentialConfiguration) ldpSubject(subject map[string]interface{}) disclosedSubject {
+	disclosed := disclosedSubject{Subject: make(map[string]interface{})}
+	for name, value := range subject {
+		if name != "id" && c.sensitivity(name) == SensitivityHighlySensitive {
+			if disclosed.Vault == nil {
+				disclosed.Vault = make(map[string]interface{})
+			}
+			disclosed.Vault[name] = value
+			continue
+		}
+		disclosed.Subject[name] = value
+	}
+	return disclosed
+}
+
+// signLDP signs the credential with the issuer's BBS key, as its last step.
+// Verifiers require the expiry of every presentation, so it is rounded down
+// to the day, which every credential issued that day shares.
+func (i *tenantIssuer) signLDP(vc *VerifiableCredential, now time.Time) error {
+	if expiry, err := time.Parse(time.RFC3339, vc.ExpirationDate); err == nil {
+		vc.ExpirationDate = expiry.UTC().Truncate(24 * time.Hour).Format(time.RFC3339)
+	}
+	raw, err := json.Marshal(vc)
+	if err != nil {
+		return err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return err
+	}
+	proof, err := bbs.SignCredential(i.bbsKey, document, bbs.Proof{
+		VerificationMethod: i.did + "#" + bbsKeyID(i.bbsKey.Public()),
+		Created:            now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	vc.Proof = &proof
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishedBBSKey is the BBS key of the gateway's JWKS
+func publishedBBSKey(t *testing.T, server *Server) *bbs.PublicKey {
+	t.Helper()
+	var jwks struct {
+		Keys []didresolver.JWK `json:"keys"`
+	}
+	getWellKnown(t, server, "/.well-known/jwks.json", &jwks)
+	for _, jwk := range jwks.Keys {
+		if jwk.Alg == bbsAlgorithm {
+			key, err := jwk.PublicKey()
+			require.NoError(t, err)
+			return key.(*bbs.PublicKey)
+		}
+	}
+	t.Fatal("no BBS key published")
+	return nil
+}
+
+func TestCredentialIssuance_LDPWithBBS(t *testing.T) {
+	server := NewServer()
+	approveBoundSession(t, server, "ldp-session", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: FormatLDPVC,
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + issueSessionToken(t, server, "ldp-session", "credential_issuance", nil).AccessToken})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Credential  map[string]interface{} `json:"credential"`
+		Format      string                 `json:"format"`
+		Disclosures []string               `json:"disclosures"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, FormatLDPVC, resp.Format)
+
+	// Every claim is signed as is: BBS discloses them one by one
+	subject := resp.Credential["credentialSubject"].(map[string]interface{})
+	assert.Equal(t, true, subject["age_over_18"])
+	assert.Equal(t, true, subject["age_over_21"])
+	assert.NotContains(t, subject, "_sd")
+	assert.Contains(t, resp.Credential["expirationDate"], "T00:00:00Z")
+	assert.Empty(t, resp.Disclosures)
+	proof, err := bbs.ProofOf(resp.Credential)
+	require.NoError(t, err)
+	key := publishedBBSKey(t, server)
+	assert.Equal(t, issuerDID+"#"+bbsKeyID(key), proof.VerificationMethod)
+	require.NoError(t, bbs.VerifySignedCredential(key, resp.Credential))
+
+	// The wallet proves the holder is over 18 and nothing else
+	derived, err := bbs.DeriveCredential(key, resp.Credential, []string{"/issuer", "/type", "/credentialSubject/age_over_18"}, []byte("verifier-nonce"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"age_over_18": true}, derived["credentialSubject"])
+	assert.NoError(t, bbs.VerifyDerivedCredential(key, derived, []byte("verifier-nonce")))
+}
+
+func TestCredentialIssuance_LDPNotOffered(t *testing.T) {
+	server := NewServer()
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format:  FormatLDPVC,
+		Types:   []string{CredentialTypeVouch},
+		VouchID: "vouch-1",
+	}, map[string]string{"Authorization": "Bearer " + issueToken(t, server).AccessToken})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeUnsupportedCredentialFormat)
+}
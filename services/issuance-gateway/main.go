@@ -1,26 +1,162 @@
 package main
 
 import (
+	"context"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"os"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 )
 
 func main() {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
 	// Configure structured logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if os.Getenv("ENVIRONMENT") == "development" {
+	if cfg.Development() {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8090"
+	exporting, err := tracing.Init(context.Background(), "issuance-gateway")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
 	}
 
 	server := NewServer()
-	log.Info().Str("port", port).Msg("Starting issuance gateway service")
-	if err := server.Start(":" + port); err != nil {
+
+	attestation, err := loadAttestationVerifier(cfg.Attestation)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load wallet attestation roots")
+	}
+	if attestation != nil {
+		log.Info().Msg("Wallet attestation required for token issuance")
+	}
+	server.attestation = attestation
+	server.introspectionClients, _ = introspectionClients(cfg.IntrospectionClients) // checked when loaded
+	if cfg.RegistryURL != "" {
+		server.schemas = NewSchemaValidator(cfg.RegistryURL)
+	}
+	server.vouching = loadVouchingClient(cfg.Vouching)
+	auth, err := serviceauth.New("issuance-gateway", cfg.ServiceAuth)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
+	}
+	if server.vouching != nil {
+		server.vouching.client.Transport = auth.Transport("vouching-service", server.vouching.client.Transport)
+	}
+	if server.schemas != nil {
+		server.health.Observe("registry", health.HTTP(server.schemas.registryURL+"/health"))
+	} else {
+		log.Warn().Msg("REGISTRY_URL is unset, so credential subjects are not validated against their schemas")
+	}
+	if server.vouching != nil {
+		server.health.Observe("vouching-service", health.HTTP(server.vouching.url+"/health"))
+	}
+	if cfg.ReceiptsLogURL != "" {
+		server.receipts = newReceiptsLogClient(cfg.ReceiptsLogURL, auth)
+		server.health.Observe("receipts-log", health.HTTP(server.receipts.url+"/health"))
+	}
+
+	switch {
+	case cfg.Timestamp.TSAURL != "":
+		server.timestamps = newTSAClient(cfg.Timestamp.TSAURL)
+		log.Info().Str("tsa", cfg.Timestamp.TSAURL).Msg("Timestamping issued credentials with an RFC 3161 TSA")
+	case cfg.Timestamp.Anchor:
+		server.timestamps = server.receipts
+		log.Info().Msg("Anchoring issued credentials in the receipts log")
+	}
+
+	if cfg.Screening.URL != "" {
+		server.screening = newScreeningClient(cfg.Screening.URL, cfg.Screening.Token)
+		server.screeningInterval = cfg.Screening.Interval
+		log.Info().Dur("interval", cfg.Screening.Interval).Msg("Rescreening the subjects of issued credentials against sanctions and PEP lists")
+	}
+
+	db, err := OpenDatabaseFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the database")
+	}
+	if db != nil {
+		server.health.Require("database", db)
+		server.auditLog = newPostgresAuditStore(db.DB)
+		server.journeys = NewIssuanceStateMachine(newPostgresJourneyStore(db.DB))
+		server.statusList = newStatusListAllocator(defaultStatusListURL, newPostgresStatusListStore(db.DB))
+		log.Info().Str("schema", db.Schema()).Msg("Keeping the audit trail, issuance journeys and status lists in Postgres")
+	} else {
+		auditLog, err := loadAuditStore(cfg.AuditLogPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open audit log")
+		}
+		server.auditLog = auditLog
+		log.Warn().Msg("DATABASE_URL is unset, so issuance journeys and status lists are kept in memory and lost on restart")
+	}
+	server.operatorToken = cfg.OperatorToken
+	server.renewal = cfg.Renewal
+	server.drift = newScoreDrift(cfg.ScoreDrift)
+	server.openapi.ValidateResponses = cfg.Development()
+	server.cors.Set(cfg.CORS)
+	server.versions.Set(cfg.APIVersion)
+	if server.security, err = audit.Open("issuance-gateway", cfg.SecurityAudit, auth, db); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the security audit trail")
+	}
+	if cfg.SecurityAudit.AnchorURL == "" {
+		log.Warn().Msg("SECURITY_AUDIT_ANCHOR_URL is unset, so security audit batches are sealed but not anchored")
+	}
+	limits, err := ratelimit.Open(cfg.RateLimit, "issuance-gateway")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid rate limit configuration")
+	}
+	server.rateLimit.Set(limits, cfg.RateLimit.Limit(), ratelimit.ByClient(server.rateLimitClient, cfg.RateLimit.TrustedProxies))
+	if server.events, err = events.Open(cfg.Events); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the event bus")
+	}
+	tenants, err := tenant.Load[tenantSettings](cfg.Tenants)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load tenants")
+	}
+	if err := server.setTenants(tenants); err != nil {
+		log.Fatal().Err(err).Msg("Invalid tenant issuer settings")
+	}
+	if len(tenants) > 0 {
+		log.Info().Int("tenants", len(tenants)).Msg("Issuing for the tenants of TENANTS_CONFIG")
+	}
+
+	webhookQueue, err := loadWebhookQueue(cfg.WebhookQueuePath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open webhook queue")
+	}
+	server.webhookQueue = webhookQueue
+
+	quality, err := LoadQualityThresholds(context.Background(), cfg.Quality)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load quality thresholds")
+	}
+	log.Info().Str("quality_version", quality.QualityVersion).Msg("Quality thresholds loaded")
+	server.quality = quality
+
+	scoring, err := NewScoringEngine(cfg.Quality.Scoring, cfg.Quality.ModelURL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure quality scoring")
+	}
+	server.scoring = scoring
+	server.verifiedSessions.retention = cfg.SessionRetention
+
+	log.Info().Int("port", cfg.Port).Msg("Starting issuance gateway service")
+	if err := server.Start(cfg.Addr()); err != nil {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
 }
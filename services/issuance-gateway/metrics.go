@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// noTierLabel counts credentials issued without a quality tier, such as
+// vouch credentials
+const noTierLabel = "none"
+
+// metricQualityScore labels the scoring strategy's overall score beside
+// the session metrics Veriff reported
+const metricQualityScore = "quality_score"
+
+// gatewayMetrics adds issuance counters, Veriff score histograms and their
+// drift to the service's Prometheus registry
+type gatewayMetrics struct {
+	*metrics.Metrics
+	issued      *prometheus.CounterVec
+	scores      *prometheus.HistogramVec
+	drift       *prometheus.GaugeVec
+	driftAlerts *prometheus.CounterVec
+}
+
+func newGatewayMetrics() *gatewayMetrics {
+	m := &gatewayMetrics{
+		Metrics: metrics.New("issuance-gateway"),
+		issued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cachet_issuance_credentials_issued_total",
+			Help: "Credentials issued, by credential configuration and quality tier.",
+		}, []string{"credential_type", "tier"}),
+		scores: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cachet_issuance_veriff_score",
+			Help:    "Scores of the Veriff sessions received, by metric.",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		}, []string{"metric"}),
+		drift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cachet_issuance_veriff_score_drift",
+			Help: "Population stability index of each Veriff score this period against the period before.",
+		}, []string{"metric"}),
+		driftAlerts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cachet_issuance_veriff_score_drift_alerts_total",
+			Help: "Veriff scores whose distribution drifted past SCORE_DRIFT_THRESHOLD, by metric.",
+		}, []string{"metric"}),
+	}
+	m.MustRegister(m.issued, m.scores, m.drift, m.driftAlerts)
+	return m
+}
+
+// ObserveAudit counts the issuances among audit events
+func (m *gatewayMetrics) ObserveAudit(event AuditEvent) {
+	if event.Type != AuditCredentialIssued {
+		return
+	}
+	tier := event.QualityTier
+	if tier == "" {
+		tier = noTierLabel
+	}
+	m.issued.WithLabelValues(event.CredentialType, tier).Inc()
+}
+
+// ObserveScores records a Veriff session's scores
+func (m *gatewayMetrics) ObserveScores(scores map[string]float64) {
+	for metric, v := range scores {
+		m.scores.WithLabelValues(metric).Observe(v)
+	}
+}
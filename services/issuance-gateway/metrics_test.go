@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_CountsCredentialsIssuedByTier(t *testing.T) {
+	server := NewServer()
+	approveBoundSession(t, server, "metered-session", nil)
+	tokenResp := issueSessionToken(t, server, "metered-session", "credential_issuance", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `tier="`+VerificationLevelGold+`"} 1`)
+	assert.Contains(t, body, `cachet_http_requests_total{code="200",method="POST",route="/credential",service="issuance-gateway"} 1`)
+	assert.Equal(t, 1, testutil.CollectAndCount(server.metrics.issued))
+
+	// The session's scores fill the histograms
+	assert.Contains(t, body, `cachet_issuance_veriff_score_count{metric="`+MetricLiveness+`"} 1`)
+	assert.Contains(t, body, `cachet_issuance_veriff_score_count{metric="`+metricQualityScore+`"} 1`)
+}
+
+func TestGatewayMetrics_UntieredCredentials(t *testing.T) {
+	m := newGatewayMetrics()
+	m.ObserveAudit(AuditEvent{Type: AuditTokenGranted})
+	m.ObserveAudit(AuditEvent{Type: AuditCredentialIssued, CredentialType: CredentialTypeVouch})
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.issued.WithLabelValues(CredentialTypeVouch, noTierLabel)))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.issued))
+}
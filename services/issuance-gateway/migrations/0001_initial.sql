@@ -0,0 +1,24 @@
+-- The append-only issuance audit trail. The event is kept as JSON next to
+-- the columns audit queries filter on.
+CREATE TABLE IF NOT EXISTS audit_events (
+	seq             bigserial   PRIMARY KEY,
+	type            text        NOT NULL,
+	actor           text        NOT NULL,
+	session_id      text        NOT NULL DEFAULT '',
+	credential_type text        NOT NULL DEFAULT '',
+	recorded_at     timestamptz NOT NULL,
+	document        jsonb       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_session_idx ON audit_events (session_id);
+
+-- Issuance journeys with their transition history
+CREATE TABLE IF NOT EXISTS journeys (
+	id         text        PRIMARY KEY,
+	session_id text        NOT NULL DEFAULT '',
+	state      text        NOT NULL,
+	deadline   timestamptz,
+	created_at timestamptz NOT NULL,
+	document   jsonb       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS journeys_session_idx ON journeys (session_id);
+CREATE INDEX IF NOT EXISTS journeys_state_idx ON journeys (state);
@@ -0,0 +1,9 @@
+-- Journeys and audit events belong to the tenant they were started or
+-- recorded for; rows from before tenancy belong to the default tenant.
+ALTER TABLE journeys ADD COLUMN IF NOT EXISTS tenant text NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS journeys_tenant_idx ON journeys (tenant);
+UPDATE journeys SET document = jsonb_set(document, '{tenant}', to_jsonb(tenant)) WHERE NOT document ? 'tenant';
+
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS tenant text NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS audit_events_tenant_idx ON audit_events (tenant, seq);
+UPDATE audit_events SET document = jsonb_set(document, '{tenant}', to_jsonb(tenant)) WHERE NOT document ? 'tenant';
@@ -0,0 +1,14 @@
+-- The StatusList2021 lists credentials are allocated an index in, by URL:
+-- next is the index the next credential gets, so none is handed out twice.
+CREATE TABLE IF NOT EXISTS status_lists (
+	url  text   PRIMARY KEY,
+	next bigint NOT NULL
+);
+
+-- The indexes whose revocation or suspension bit is set
+CREATE TABLE IF NOT EXISTS status_list_bits (
+	url        text   NOT NULL REFERENCES status_lists (url),
+	purpose    text   NOT NULL,
+	list_index bigint NOT NULL,
+	PRIMARY KEY (url, purpose, list_index)
+);
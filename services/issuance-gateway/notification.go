@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Notification events wallets report about the credentials they received
+// (OpenID4VCI §11)
+const (
+	NotificationCredentialAccepted = "credential_accepted"
+	NotificationCredentialDeleted  = "credential_deleted"
+	NotificationCredentialFailure  = "credential_failure"
+)
+
+// Notification endpoint error codes (OpenID4VCI §11.3)
+const (
+	ErrCodeInvalidNotificationID      = "invalid_notification_id"
+	ErrCodeInvalidNotificationRequest = "invalid_notification_request"
+)
+
+// notificationAuditTypes maps notification events to the audit events
+// recording them
+var notificationAuditTypes = map[string]string{
+	NotificationCredentialAccepted: AuditCredentialAccepted,
+	NotificationCredentialDeleted:  AuditCredentialDeleted,
+	NotificationCredentialFailure:  AuditCredentialFailure,
+}
+
+// notificationLifetime is how long a wallet has to report on a credential,
+// as long as the credential response can be replayed
+const notificationLifetime = idempotencyTTL
+
+// NotificationRequest is the body of POST /notification
+type NotificationRequest struct {
+	NotificationID   string `json:"notification_id"`
+	Event            string `json:"event"`
+	EventDescription string `json:"event_description,omitempty"`
+}
+
+// issuanceTransaction is what the gateway keeps of an issuance until the
+// wallet reports on the credential it received
+type issuanceTransaction struct {
+	Tenant         string
+	ClientID       string
+	SessionID      string
+	JourneyID      string // empty for vouch credentials
+	CredentialType string
+	CredentialID   string
+	// IdempotencyKey holds the credential response for replays, which are
+	// pointless once the wallet has reported
+	IdempotencyKey string
+	ExpiresAt      time.Time
+}
+
+// notificationStore holds the issuance transactions awaiting a
+// notification (production should use Redis)
+type notificationStore struct {
+	mu           sync.Mutex
+	transactions map[string]issuanceTransaction
+}
+
+func newNotificationStore() *notificationStore {
+	return &notificationStore{transactions: make(map[string]issuanceTransaction)}
+}
+
+// Issue records a transaction and returns the notification ID the wallet
+// reports on it with
+func (ns *notificationStore) Issue(tx issuanceTransaction, now time.Time) string {
+	id := uuid.NewString()
+	tx.ExpiresAt = now.Add(notificationLifetime)
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.transactions[id] = tx
+	return id
+}
+
+// Complete removes and returns the client's transaction with the
+// notification ID; a wallet reports on a credential once
+func (ns *notificationStore) Complete(tenantID, clientID, id string, now time.Time) (issuanceTransaction, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	tx, ok := ns.transactions[id]
+	if !ok || tx.Tenant != tenantID || tx.ClientID != clientID || now.After(tx.ExpiresAt) {
+		return issuanceTransaction{}, false
+	}
+	delete(ns.transactions, id)
+	return tx, true
+}
+
+// PurgeExpired drops the transactions no wallet reported on in time, and
+// returns how many there were
+func (ns *notificationStore) PurgeExpired(now time.Time) int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	purged := 0
+	for id, tx := range ns.transactions {
+		if now.After(tx.ExpiresAt) {
+			delete(ns.transactions, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// issuanceNotification records a credential the wallet is to report on,
+// returning the notification ID for its credential response
+func (s *Server) issuanceNotification(r *http.Request, tx issuanceTransaction) string {
+	tx.Tenant = tenant.FromContext(r.Context()).ID
+	return s.notifications.Issue(tx, time.Now())
+}
+
+// handleNotification takes the wallet's report on a credential it received,
+// with the access token it was issued with: the report is audited, the
+// journey completed or failed, and the issuance transaction cleaned up
+func (s *Server) handleNotification(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.authenticateAccessToken(w, r)
+	if !ok {
+		return
+	}
+	var req NotificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NotificationID == "" {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidNotificationRequest, "Invalid request body")
+		return
+	}
+	auditType, known := notificationAuditTypes[req.Event]
+	if !known {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidNotificationRequest, "Unknown event: "+req.Event)
+		return
+	}
+
+	ctx := r.Context()
+	clientID, _ := token.Claims.(jwt.MapClaims)["client_id"].(string)
+	tx, ok := s.notifications.Complete(tenant.FromContext(ctx).ID, clientID, req.NotificationID, time.Now())
+	if !ok {
+		log.Error().Str("notification_id", req.NotificationID).Str("client_id", clientID).Msg("Notification for an unknown issuance")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidNotificationID, "Unknown notification_id")
+		return
+	}
+	if tx.IdempotencyKey != "" {
+		s.idempotency.Forget(tx.IdempotencyKey)
+	}
+
+	var outcome string
+	if req.Event == NotificationCredentialFailure {
+		outcome = "failed"
+	}
+	if tx.JourneyID != "" {
+		if outcome == "failed" {
+			s.failJourney(ctx, tx.JourneyID, "wallet reported credential_failure: "+req.EventDescription)
+		} else if _, err := s.journeys.Transition(ctx, tx.JourneyID, StateNotified, "wallet reported "+req.Event, nil); err != nil {
+			log.Error().Err(err).Str("journey_id", tx.JourneyID).Msg("Failed to record wallet notification")
+		}
+	}
+
+	s.recordAudit(ctx, AuditEvent{
+		Type:           auditType,
+		Actor:          clientID,
+		SessionID:      tx.SessionID,
+		JourneyID:      tx.JourneyID,
+		CredentialType: tx.CredentialType,
+		CredentialID:   tx.CredentialID,
+		Outcome:        outcome,
+		Detail:         req.EventDescription,
+	})
+	log.Info().
+		Str("credential_id", tx.CredentialID).
+		Str("event", req.Event).
+		Msg("Wallet notification received")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueNotifiable issues the age credential to a verified session, with an
+// idempotency key, returning the access token and credential response
+func issueNotifiable(t *testing.T, server *Server, sessionID string) (string, CredentialResponse) {
+	t.Helper()
+	approveBoundSession(t, server, sessionID, nil)
+	tokenResp := issueSessionToken(t, server, sessionID, ScopeAgeCredential, nil)
+
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken, idempotencyKeyHeader: sessionID})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp CredentialResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	require.NotEmpty(t, credResp.NotificationID)
+	return tokenResp.AccessToken, credResp
+}
+
+func TestNotification_CredentialAccepted(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	accessToken, credResp := issueNotifiable(t, server, "accepted-session")
+	auth := map[string]string{"Authorization": "Bearer " + accessToken}
+
+	w := postJSON(t, server, "/notification", NotificationRequest{
+		NotificationID: credResp.NotificationID,
+		Event:          NotificationCredentialAccepted,
+	}, auth)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	journey, err := server.journeys.store.FindBySession(context.Background(), "accepted-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateNotified, journey.State)
+	_, page := getAudit(t, server, "?type="+AuditCredentialAccepted, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, journey.ID, page.Events[0].JourneyID)
+	assert.Equal(t, "test-wallet", page.Events[0].Actor)
+
+	// The issuance transaction is gone: its stored response and the
+	// notification ID alike
+	assert.Empty(t, server.idempotency.entries)
+	w = postJSON(t, server, "/notification", NotificationRequest{
+		NotificationID: credResp.NotificationID,
+		Event:          NotificationCredentialDeleted,
+	}, auth)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidNotificationID, decodeError(t, w).Code)
+}
+
+func TestNotification_CredentialFailure(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	accessToken, credResp := issueNotifiable(t, server, "failed-session")
+
+	w := postJSON(t, server, "/notification", NotificationRequest{
+		NotificationID:   credResp.NotificationID,
+		Event:            NotificationCredentialFailure,
+		EventDescription: "secure storage unavailable",
+	}, map[string]string{"Authorization": "Bearer " + accessToken})
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	journey, err := server.journeys.store.FindBySession(context.Background(), "failed-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateFailed, journey.State)
+	assert.Contains(t, journey.FailureReason, "secure storage unavailable")
+	_, page := getAudit(t, server, "?type="+AuditCredentialFailure, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, "failed", page.Events[0].Outcome)
+}
+
+func TestNotification_Refused(t *testing.T) {
+	server := NewServer()
+	_, credResp := issueNotifiable(t, server, "refused-session")
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "other-wallet",
+		Scope:     ScopeAgeCredential,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var other TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &other))
+
+	tests := []struct {
+		name    string
+		req     NotificationRequest
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{"no access token", NotificationRequest{NotificationID: credResp.NotificationID, Event: NotificationCredentialAccepted}, nil, http.StatusUnauthorized, ErrCodeInvalidToken},
+		{"another client", NotificationRequest{NotificationID: credResp.NotificationID, Event: NotificationCredentialAccepted}, map[string]string{"Authorization": "Bearer " + other.AccessToken}, http.StatusBadRequest, ErrCodeInvalidNotificationID},
+		{"unknown notification", NotificationRequest{NotificationID: "unknown", Event: NotificationCredentialAccepted}, map[string]string{"Authorization": "Bearer " + other.AccessToken}, http.StatusBadRequest, ErrCodeInvalidNotificationID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, server, "/notification", tt.req, tt.headers)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Equal(t, tt.code, decodeError(t, w).Code)
+		})
+	}
+
+	// The transaction outlives refused reports
+	assert.Len(t, server.notifications.transactions, 1)
+}
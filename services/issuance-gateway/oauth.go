@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// OAuth grant types accepted at the token endpoint
+const (
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeRefreshToken      = "refresh_token"
+	// GrantTypePreAuthorizedCode redeems a credential offer's code
+	GrantTypePreAuthorizedCode = "urn:ietf:params:oauth:grant-type:pre-authorized_code"
+)
+
+const (
+	accessTokenLifetime  = time.Hour
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+var ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+
+// RefreshTokenInfo is the server-side record behind an opaque refresh token
+type RefreshTokenInfo struct {
+	Tenant      string // tenant the tokens were issued by
+	ClientID    string
+	Scope       string
+	SessionID   string
+	JKT         string // DPoP key thumbprint; refreshes must prove the same key
+	WalletAppID string
+	// Renews is the credential the tokens of a renewal offer may renew
+	Renews    string
+	ExpiresAt time.Time
+}
+
+// refreshTokenStore holds outstanding refresh tokens (production should use Redis)
+type refreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshTokenInfo
+}
+
+func newRefreshTokenStore() *refreshTokenStore {
+	return &refreshTokenStore{tokens: make(map[string]RefreshTokenInfo)}
+}
+
+// Issue creates a new opaque refresh token for info
+func (rs *refreshTokenStore) Issue(info RefreshTokenInfo) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generating refresh token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.tokens[token] = info
+	return token, nil
+}
+
+// Redeem consumes a refresh token. Tokens are single use: every refresh
+// rotates to a new token, so a replayed token is rejected.
+func (rs *refreshTokenStore) Redeem(token string, now time.Time) (RefreshTokenInfo, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	info, ok := rs.tokens[token]
+	if !ok {
+		return RefreshTokenInfo{}, ErrRefreshTokenInvalid
+	}
+	delete(rs.tokens, token)
+	if now.After(info.ExpiresAt) {
+		return RefreshTokenInfo{}, fmt.Errorf("%w: expired", ErrRefreshTokenInvalid)
+	}
+	return info, nil
+}
+
+// Lookup returns the record for an outstanding refresh token without consuming it
+func (rs *refreshTokenStore) Lookup(token string, now time.Time) (RefreshTokenInfo, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	info, ok := rs.tokens[token]
+	if !ok || now.After(info.ExpiresAt) {
+		return RefreshTokenInfo{}, false
+	}
+	return info, true
+}
+
+// RevokeSession drops every refresh token bound to an identity session and
+// returns how many there were
+func (rs *refreshTokenStore) RevokeSession(sessionID string) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	revoked := 0
+	for token, info := range rs.tokens {
+		if info.SessionID == sessionID {
+			delete(rs.tokens, token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// accessTokenStore records the access tokens the gateway has issued, keyed
+// by jti (production should use Redis). Token requests are served
+// concurrently, so every access goes through mu.
+type accessTokenStore struct {
+	mu         sync.Mutex
+	tokens     map[string]TokenInfo
+	sweptUntil time.Time
+}
+
+func newAccessTokenStore() *accessTokenStore {
+	return &accessTokenStore{tokens: make(map[string]TokenInfo)}
+}
+
+// Record stores info for the token with the given jti. Expired tokens are
+// swept at most once per token lifetime, keeping issuance constant time
+// while bounding the store.
+func (as *accessTokenStore) Record(tokenID string, info TokenInfo, now time.Time) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if now.After(as.sweptUntil) {
+		for id, recorded := range as.tokens {
+			if now.After(recorded.ExpiresAt) {
+				delete(as.tokens, id)
+			}
+		}
+		as.sweptUntil = now.Add(accessTokenLifetime)
+	}
+	as.tokens[tokenID] = info
+}
+
+// Lookup returns the record of an unexpired access token
+func (as *accessTokenStore) Lookup(tokenID string, now time.Time) (TokenInfo, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	info, ok := as.tokens[tokenID]
+	if !ok || now.After(info.ExpiresAt) {
+		return TokenInfo{}, false
+	}
+	return info, true
+}
+
+// issueTokens signs an access token for grant and pairs it with a fresh
+// refresh token carrying the same binding
+func (s *Server) issueTokens(grant RefreshTokenInfo) (TokenResponse, error) {
+	tokenID := uuid.New().String()
+	now := time.Now()
+	expiresAt := now.Add(accessTokenLifetime)
+
+	claims := jwt.MapClaims{
+		"sub":       grant.ClientID,
+		"client_id": grant.ClientID,
+		"scope":     grant.Scope,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		"jti":       tokenID,
+	}
+	if grant.SessionID != "" {
+		claims["session_id"] = grant.SessionID
+	}
+	if grant.JKT != "" {
+		claims["cnf"] = map[string]interface{}{"jkt": grant.JKT}
+	}
+	if grant.WalletAppID != "" {
+		claims["wallet_app_id"] = grant.WalletAppID
+	}
+	if grant.Renews != "" {
+		claims["renews"] = grant.Renews
+	}
+
+	signingKey := s.issuerOf(grant.Tenant).signingKey
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = signingKeyID(&signingKey.PublicKey)
+	accessToken, err := token.SignedString(signingKey)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("signing access token: %w", err)
+	}
+
+	grant.ExpiresAt = now.Add(refreshTokenLifetime)
+	refreshToken, err := s.refreshTokens.Issue(grant)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	s.accessTokens.Record(tokenID, TokenInfo{
+		ClientID:  grant.ClientID,
+		Scope:     grant.Scope,
+		ExpiresAt: expiresAt,
+		JKT:       grant.JKT,
+	}, now)
+
+	tokenType := "Bearer"
+	if grant.JKT != "" {
+		tokenType = "DPoP"
+	}
+	return TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    tokenType,
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        grant.Scope,
+	}, nil
+}
+
+// handleRefreshTokenGrant exchanges a refresh token for a new token pair
+func (s *Server) handleRefreshTokenGrant(w http.ResponseWriter, r *http.Request, req TokenRequest) {
+	grant, err := s.refreshTokens.Redeem(req.RefreshToken, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("client_id", req.ClientID).Msg("Refresh token rejected")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Invalid refresh token")
+		return
+	}
+	if (req.ClientID != "" && req.ClientID != grant.ClientID) || grant.Tenant != tenant.FromContext(r.Context()).ID {
+		log.Error().Str("client_id", req.ClientID).Msg("Refresh token presented by another client")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Invalid refresh token")
+		return
+	}
+
+	// Refresh tokens for DPoP-bound access tokens are bound to the same key
+	if grant.JKT != "" {
+		jkt, err := s.verifyDPoPProof(r, r.Header.Get(dpopHeader), "")
+		if err != nil || jkt != grant.JKT {
+			log.Error().Err(err).Str("client_id", grant.ClientID).Msg("DPoP proof does not match refresh token")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidDPoPProof, "Invalid DPoP proof")
+			return
+		}
+	}
+
+	// A refresh may narrow the scope but never widen it
+	if req.Scope != "" {
+		granted := strings.Fields(grant.Scope)
+		for _, scope := range strings.Fields(req.Scope) {
+			if !containsString(granted, scope) {
+				log.Error().Str("scope", scope).Msg("Refresh requested scope beyond original grant")
+				writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidScope, "Requested scope exceeds original grant")
+				return
+			}
+		}
+		grant.Scope = req.Scope
+	}
+
+	resp, err := s.issueTokens(grant)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to refresh access token")
+		writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+		return
+	}
+
+	s.recordAudit(r.Context(), AuditEvent{
+		Type:      AuditTokenRefreshed,
+		Actor:     grant.ClientID,
+		SessionID: grant.SessionID,
+		Detail:    "scope=" + grant.Scope,
+	})
+
+	log.Info().
+		Str("client_id", grant.ClientID).
+		Str("scope", grant.Scope).
+		Msg("Access token refreshed")
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// IntrospectionResponse is the RFC 7662 token introspection response
+type IntrospectionResponse struct {
+	Active    bool                   `json:"active"`
+	Scope     string                 `json:"scope,omitempty"`
+	ClientID  string                 `json:"client_id,omitempty"`
+	TokenType string                 `json:"token_type,omitempty"`
+	Exp       int64                  `json:"exp,omitempty"`
+	Iat       int64                  `json:"iat,omitempty"`
+	Sub       string                 `json:"sub,omitempty"`
+	Jti       string                 `json:"jti,omitempty"`
+	Cnf       map[string]interface{} `json:"cnf,omitempty"`
+	SessionID string                 `json:"session_id,omitempty"`
+}
+
+// introspectionClients maps the resource servers allowed to introspect, from
+// INTROSPECTION_CLIENTS' id:secret pairs, to their secrets
+func introspectionClients(pairs []string) (map[string]string, error) {
+	clients := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, errors.New("INTROSPECTION_CLIENTS must hold id:secret pairs")
+		}
+		clients[id] = secret
+	}
+	return clients, nil
+}
+
+// authenticateIntrospectionClient checks HTTP Basic credentials against the
+// configured resource servers. Introspection is open when none are configured.
+func (s *Server) authenticateIntrospectionClient(r *http.Request) bool {
+	if len(s.introspectionClients) == 0 {
+		return true
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, known := s.introspectionClients[id]
+	return known && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// handleIntrospect implements RFC 7662 so resource servers such as the
+// verifier and connector-hub can validate gateway-issued tokens
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticateIntrospectionClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		writeOAuthError(w, r, http.StatusUnauthorized, ErrCodeInvalidClient, "Introspection client authentication failed")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "Missing token parameter")
+		return
+	}
+
+	// Try the hinted token type first, falling back to the other per RFC 7662 §2.1
+	var resp IntrospectionResponse
+	if r.PostFormValue("token_type_hint") == GrantTypeRefreshToken {
+		resp = s.introspectRefreshToken(r.Context(), token)
+		if !resp.Active {
+			resp = s.introspectAccessToken(r.Context(), token)
+		}
+	} else {
+		resp = s.introspectAccessToken(r.Context(), token)
+		if !resp.Active {
+			resp = s.introspectRefreshToken(r.Context(), token)
+		}
+	}
+
+	log.Debug().
+		Bool("active", resp.Active).
+		Str("client_id", resp.ClientID).
+		Msg("Token introspected")
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// introspectAccessToken reports on an access token of the request's tenant;
+// other tenants' tokens are inactive
+func (s *Server) introspectAccessToken(ctx context.Context, tokenString string) IntrospectionResponse {
+	signingKey := s.issuer(ctx).signingKey
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return &signingKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return IntrospectionResponse{Active: false}
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	resp := IntrospectionResponse{Active: true, TokenType: "Bearer"}
+	resp.Scope, _ = claims["scope"].(string)
+	resp.ClientID, _ = claims["client_id"].(string)
+	resp.Sub, _ = claims["sub"].(string)
+	resp.Jti, _ = claims["jti"].(string)
+	resp.SessionID, _ = claims["session_id"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.Exp = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		resp.Iat = iat.Unix()
+	}
+	if jkt := tokenKeyThumbprint(token); jkt != "" {
+		resp.TokenType = "DPoP"
+		resp.Cnf = map[string]interface{}{"jkt": jkt}
+	}
+	return resp
+}
+
+func (s *Server) introspectRefreshToken(ctx context.Context, token string) IntrospectionResponse {
+	info, ok := s.refreshTokens.Lookup(token, time.Now())
+	if !ok || info.Tenant != tenant.FromContext(ctx).ID {
+		return IntrospectionResponse{Active: false}
+	}
+	resp := IntrospectionResponse{
+		Active:    true,
+		Scope:     info.Scope,
+		ClientID:  info.ClientID,
+		TokenType: GrantTypeRefreshToken,
+		Exp:       info.ExpiresAt.Unix(),
+		Sub:       info.ClientID,
+		SessionID: info.SessionID,
+	}
+	if info.JKT != "" {
+		resp.Cnf = map[string]interface{}{"jkt": info.JKT}
+	}
+	return resp
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func introspect(t *testing.T, server *Server, token string, auth func(*http.Request)) (*httptest.ResponseRecorder, IntrospectionResponse) {
+	t.Helper()
+	form := url.Values{"token": {token}}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if auth != nil {
+		auth(req)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	var resp IntrospectionResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w, resp
+}
+
+func issueToken(t *testing.T, server *Server) TokenResponse {
+	t.Helper()
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "test-wallet",
+		Scope:     "credential_issuance",
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestRefreshToken_RotatesOnUse(t *testing.T) {
+	server := NewServer()
+	initial := issueToken(t, server)
+	require.NotEmpty(t, initial.RefreshToken)
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		ClientID:     "test-wallet",
+		RefreshToken: initial.RefreshToken,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var refreshed TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.NotEqual(t, initial.AccessToken, refreshed.AccessToken)
+	assert.NotEqual(t, initial.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, "credential_issuance", refreshed.Scope)
+
+	// The consumed refresh token cannot be replayed
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		RefreshToken: initial.RefreshToken,
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRefreshToken_RejectsWiderScopeAndOtherClient(t *testing.T) {
+	server := NewServer()
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		ClientID:     "other-wallet",
+		RefreshToken: issueToken(t, server).RefreshToken,
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		Scope:        "credential_issuance admin",
+		RefreshToken: issueToken(t, server).RefreshToken,
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRefreshToken_DPoPBoundRequiresSameKey(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	initial := issueDPoPToken(t, server, key)
+	tokenURI := "http://example.com/oauth/token"
+
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		RefreshToken: initial.RefreshToken,
+	}, map[string]string{dpopHeader: dpopProof(t, newWalletKey(t), http.MethodPost, tokenURI, "")})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The failed attempt consumed the token, so the holder must start over
+	second := issueDPoPToken(t, server, key)
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:    GrantTypeRefreshToken,
+		RefreshToken: second.RefreshToken,
+	}, map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, tokenURI, "")})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var refreshed TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.Equal(t, "DPoP", refreshed.TokenType)
+}
+
+func TestIssueTokens_Concurrent(t *testing.T) {
+	server := NewServer()
+
+	const requests = 16
+	tokens := make([]TokenResponse, requests)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := postJSON(t, server, "/oauth/token", TokenRequest{
+				GrantType: GrantTypeClientCredentials,
+				ClientID:  "test-wallet",
+				Scope:     "credential_issuance",
+			}, nil)
+			if assert.Equal(t, http.StatusOK, w.Code) {
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens[i]))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, token := range tokens {
+		_, resp := introspect(t, server, token.AccessToken, nil)
+		require.True(t, resp.Active)
+		_, recorded := server.accessTokens.Lookup(resp.Jti, time.Now())
+		assert.True(t, recorded, "token %s recorded", resp.Jti)
+	}
+}
+
+func TestAccessTokenStore_SweepsExpiredTokens(t *testing.T) {
+	store := newAccessTokenStore()
+	now := time.Now()
+	store.Record("old", TokenInfo{ExpiresAt: now.Add(time.Minute)}, now)
+
+	_, ok := store.Lookup("old", now.Add(2*time.Minute))
+	assert.False(t, ok, "expired tokens are not returned")
+
+	later := now.Add(accessTokenLifetime + time.Minute)
+	store.Record("new", TokenInfo{ExpiresAt: later.Add(accessTokenLifetime)}, later)
+	assert.NotContains(t, store.tokens, "old")
+	_, ok = store.Lookup("new", later)
+	assert.True(t, ok)
+}
+
+func TestIntrospect_AccessAndRefreshTokens(t *testing.T) {
+	server := NewServer()
+	tokens := issueToken(t, server)
+
+	w, resp := introspect(t, server, tokens.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, resp.Active)
+	assert.Equal(t, "test-wallet", resp.ClientID)
+	assert.Equal(t, "credential_issuance", resp.Scope)
+	assert.Equal(t, "Bearer", resp.TokenType)
+	assert.NotEmpty(t, resp.Jti)
+	assert.Greater(t, resp.Exp, resp.Iat)
+
+	_, resp = introspect(t, server, tokens.RefreshToken, nil)
+	assert.True(t, resp.Active)
+	assert.Equal(t, GrantTypeRefreshToken, resp.TokenType)
+
+	_, resp = introspect(t, server, "not-a-token", nil)
+	assert.False(t, resp.Active)
+	assert.Empty(t, resp.ClientID)
+}
+
+func TestIntrospect_RequiresConfiguredClientCredentials(t *testing.T) {
+	server := NewServer()
+	server.introspectionClients = map[string]string{"verifier": "s3cret"}
+	token := issueToken(t, server).AccessToken
+
+	w, _ := introspect(t, server, token, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w, _ = introspect(t, server, token, func(r *http.Request) { r.SetBasicAuth("verifier", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w, resp := introspect(t, server, token, func(r *http.Request) { r.SetBasicAuth("verifier", "s3cret") })
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, resp.Active)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"rsc.io/qr"
+)
+
+// AuditOfferCreated records a credential offer made to a verified subject
+const AuditOfferCreated = "offer.created"
+
+// credentialOfferScheme is the scheme wallets register to receive offers
+const credentialOfferScheme = "openid-credential-offer://"
+
+// defaultOfferLifetime is how long an offer can be redeemed unless its
+// creator asks otherwise; offers never outlive the verified session's own
+// deadline
+const defaultOfferLifetime = 10 * time.Minute
+
+// Problem codes of offers that can no longer be shown
+const (
+	codeOfferExpired  = "offer_expired"
+	codeOfferRedeemed = "offer_redeemed"
+)
+
+var (
+	ErrOfferNotFound = errors.New("credential offer not found")
+	ErrOfferExpired  = errors.New("credential offer expired")
+	ErrOfferRedeemed = errors.New("credential offer already redeemed")
+)
+
+// CreateOfferRequest is the body of POST /credential-offers. The offer
+// defaults to every credential configuration the tenant offers.
+type CreateOfferRequest struct {
+	SessionID                  string   `json:"session_id"`
+	CredentialConfigurationIDs []string `json:"credential_configuration_ids,omitempty"`
+	// ExpiresIn is the offer's lifetime in seconds
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// CredentialOffer offers a verified subject's credentials to the wallet
+// that scans it, or the renewal of a credential to the wallet holding it.
+// Its pre-authorized code is redeemed once, at the token endpoint, before
+// ExpiresAt.
+type CredentialOffer struct {
+	ID                         string     `json:"id"`
+	Tenant                     string     `json:"tenant"`
+	SessionID                  string     `json:"session_id,omitempty"`
+	CredentialConfigurationIDs []string   `json:"credential_configuration_ids"`
+	CreatedAt                  time.Time  `json:"created_at"`
+	ExpiresAt                  time.Time  `json:"expires_at"`
+	RedeemedAt                 *time.Time `json:"redeemed_at,omitempty"`
+	// Renews is the credential a renewal offer renews, in place of a session
+	Renews string `json:"renews,omitempty"`
+	// URI is the openid-credential-offer:// deep link carrying the offer
+	URI string `json:"uri,omitempty"`
+
+	code string
+}
+
+// CredentialOfferQR is an offer's deep link and its QR code, as a data URI
+// pages can show as they are
+type CredentialOfferQR struct {
+	ID        string    `json:"id"`
+	URI       string    `json:"uri"`
+	Format    string    `json:"format"`
+	Image     string    `json:"image"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// credentialOfferStore holds outstanding offers (production should use Redis)
+type credentialOfferStore struct {
+	mu     sync.Mutex
+	offers map[string]CredentialOffer
+	byCode map[string]string
+}
+
+func newCredentialOfferStore() *credentialOfferStore {
+	return &credentialOfferStore{offers: make(map[string]CredentialOffer), byCode: make(map[string]string)}
+}
+
+// Create stores an offer under a new pre-authorized code
+func (os *credentialOfferStore) Create(offer CredentialOffer) (CredentialOffer, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return CredentialOffer{}, fmt.Errorf("generating pre-authorized code: %w", err)
+	}
+	offer.code = base64.RawURLEncoding.EncodeToString(raw)
+
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	os.offers[offer.ID] = offer
+	os.byCode[offer.code] = offer.ID
+	return offer, nil
+}
+
+// Get returns the tenant's offer
+func (os *credentialOfferStore) Get(tenantID, id string) (CredentialOffer, error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	offer, ok := os.offers[id]
+	if !ok || offer.Tenant != tenantID {
+		return CredentialOffer{}, ErrOfferNotFound
+	}
+	return offer, nil
+}
+
+// Redeem consumes the pre-authorized code of one of the tenant's offers.
+// Codes are single use, so a replayed or leaked QR code is refused.
+func (os *credentialOfferStore) Redeem(tenantID, code string, now time.Time) (CredentialOffer, error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	offer, ok := os.offers[os.byCode[code]]
+	switch {
+	case !ok || offer.Tenant != tenantID:
+		return CredentialOffer{}, ErrOfferNotFound
+	case offer.RedeemedAt != nil:
+		return CredentialOffer{}, ErrOfferRedeemed
+	case now.After(offer.ExpiresAt):
+		return CredentialOffer{}, ErrOfferExpired
+	}
+	offer.RedeemedAt = &now
+	os.offers[offer.ID] = offer
+	return offer, nil
+}
+
+// PurgeExpired drops the offers that can no longer be redeemed, and
+// returns how many there were
+func (os *credentialOfferStore) PurgeExpired(now time.Time) int {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	purged := 0
+	for id, offer := range os.offers {
+		if now.After(offer.ExpiresAt) {
+			delete(os.offers, id)
+			delete(os.byCode, offer.code)
+			purged++
+		}
+	}
+	return purged
+}
+
+// scope is the token scope covering the offer's credentials
+func (o CredentialOffer) scope() string {
+	scopes := make([]string, 0, len(o.CredentialConfigurationIDs))
+	for _, id := range o.CredentialConfigurationIDs {
+		scopes = append(scopes, credentialConfigurations[id].Scope)
+	}
+	return strings.Join(scopes, " ")
+}
+
+// offerURI is the deep link carrying the offer by value, so wallets need
+// no further call to read it
+func offerURI(issuerDID string, offer CredentialOffer) (string, error) {
+	encoded, err := json.Marshal(map[string]interface{}{
+		"credential_issuer":            issuerDID,
+		"credential_configuration_ids": offer.CredentialConfigurationIDs,
+		"grants": map[string]interface{}{
+			GrantTypePreAuthorizedCode: map[string]string{"pre-authorized_code": offer.code},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return credentialOfferScheme + "?credential_offer=" + url.QueryEscape(string(encoded)), nil
+}
+
+// qrImage renders text as a QR code data URI, in png or svg
+func qrImage(text, format string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	if format == "svg" {
+		return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(qrSVG(code))), nil
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()), nil
+}
+
+// qrSVG draws a QR code one unit per module, with the four-module quiet
+// zone scanners expect
+func qrSVG(code *qr.Code) string {
+	const quiet = 4
+	side := code.Size + 2*quiet
+	var path strings.Builder
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		side, side, side, side, path.String())
+}
+
+func (s *Server) handleCreateOffer(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req CreateOfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	issuer := s.issuer(ctx)
+	configIDs := req.CredentialConfigurationIDs
+	if len(configIDs) == 0 {
+		configIDs = issuer.configurationIDs()
+	}
+	for _, id := range configIDs {
+		if _, known := credentialConfigurations[id]; !known || !issuer.offers(id) {
+			problem.Error(w, r, "Credential configuration not offered by this issuer: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+	lifetime := defaultOfferLifetime
+	if req.ExpiresIn != 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if lifetime <= 0 || lifetime > stateTimeouts[StateVerified] {
+		problem.Error(w, r, fmt.Sprintf("expires_in must be between 1 and %d seconds", int(stateTimeouts[StateVerified].Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	// The pre-authorized code stands for the identity verification, so
+	// only verified subjects are offered credentials
+	journey, err := s.journeys.store.FindBySession(ctx, req.SessionID)
+	if errors.Is(err, ErrJourneyNotFound) || (err == nil && !ownsJourney(ctx, journey)) {
+		problem.Error(w, r, "Issuance journey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find the issuance journey")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if journey.State != StateVerified {
+		problem.Error(w, r, "Identity session not verified", http.StatusConflict)
+		return
+	}
+
+	offer, err := s.createOffer(ctx, req.SessionID, configIDs, lifetime)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create credential offer")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAudit(ctx, AuditEvent{
+		Type:      AuditOfferCreated,
+		Actor:     "operator",
+		SessionID: offer.SessionID,
+		JourneyID: journey.ID,
+		Detail:    "offer=" + offer.ID + " configurations=" + strings.Join(offer.CredentialConfigurationIDs, ","),
+	})
+	s.security.Record(ctx, audit.Event{Type: audit.TypeAdminAction, Action: "credential_offer.created", Actor: "operator", Target: offer.ID})
+	log.Info().Str("offer_id", offer.ID).Str("journey_id", journey.ID).Time("expires_at", offer.ExpiresAt).Msg("Credential offer created")
+
+	w.Header().Set("Location", tenant.Prefix(ctx)+apiversion.Path("/credential-offers/"+offer.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, offer)
+}
+
+// createOffer offers a verified session's credentials for lifetime,
+// returning the offer with its deep link
+func (s *Server) createOffer(ctx context.Context, sessionID string, configIDs []string, lifetime time.Duration) (CredentialOffer, error) {
+	now := time.Now().UTC()
+	offer, err := s.offers.Create(CredentialOffer{
+		ID:                         uuid.NewString(),
+		Tenant:                     tenant.FromContext(ctx).ID,
+		SessionID:                  sessionID,
+		CredentialConfigurationIDs: configIDs,
+		CreatedAt:                  now,
+		ExpiresAt:                  now.Add(lifetime),
+	})
+	if err != nil {
+		return CredentialOffer{}, err
+	}
+	offer.URI, err = offerURI(s.issuer(ctx).did, offer)
+	if err != nil {
+		return CredentialOffer{}, err
+	}
+	return offer, nil
+}
+
+// handleGetOfferQR renders an outstanding offer for kiosks and onboarding
+// pages to display; offers redeemed or expired are gone
+func (s *Server) handleGetOfferQR(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		problem.Error(w, r, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	offer, err := s.offers.Get(tenant.FromContext(ctx).ID, chi.URLParam(r, "id"))
+	if err != nil {
+		problem.Error(w, r, "Credential offer not found", http.StatusNotFound)
+		return
+	}
+	if offer.RedeemedAt != nil {
+		problem.Write(w, r, http.StatusGone, codeOfferRedeemed, "The credential offer was already redeemed")
+		return
+	}
+	if time.Now().After(offer.ExpiresAt) {
+		problem.Write(w, r, http.StatusGone, codeOfferExpired, "The credential offer expired")
+		return
+	}
+
+	uri, err := offerURI(s.issuer(ctx).did, offer)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode credential offer")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	image, err := qrImage(uri, format)
+	if err != nil {
+		log.Error().Err(err).Str("offer_id", offer.ID).Msg("Failed to render credential offer QR code")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, CredentialOfferQR{ID: offer.ID, URI: uri, Format: format, Image: image, ExpiresAt: offer.ExpiresAt})
+}
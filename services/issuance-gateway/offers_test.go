@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var operatorHeaders = map[string]string{"Authorization": "Bearer operator-secret"}
+
+// createOffer offers the age credential to a newly verified session
+func createOffer(t *testing.T, server *Server, sessionID string) CredentialOffer {
+	t.Helper()
+	w := postJSON(t, server, "/webhooks/veriff", approvedSession(sessionID), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(t, server, "/credential-offers", CreateOfferRequest{
+		SessionID:                  sessionID,
+		CredentialConfigurationIDs: []string{CredentialTypeAgeOver},
+	}, operatorHeaders)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var offer CredentialOffer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &offer))
+	assert.Equal(t, "/v1/credential-offers/"+offer.ID, w.Header().Get("Location"))
+	return offer
+}
+
+// preAuthorizedCode reads the code out of an offer's deep link
+func preAuthorizedCode(t *testing.T, uri string) string {
+	t.Helper()
+	require.True(t, strings.HasPrefix(uri, "openid-credential-offer://?credential_offer="), uri)
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	var payload struct {
+		CredentialIssuer           string   `json:"credential_issuer"`
+		CredentialConfigurationIDs []string `json:"credential_configuration_ids"`
+		Grants                     map[string]struct {
+			PreAuthorizedCode string `json:"pre-authorized_code"`
+		} `json:"grants"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(parsed.Query().Get("credential_offer")), &payload))
+	assert.True(t, strings.HasPrefix(payload.CredentialIssuer, "did:"), payload.CredentialIssuer)
+	assert.Equal(t, []string{CredentialTypeAgeOver}, payload.CredentialConfigurationIDs)
+	return payload.Grants[GrantTypePreAuthorizedCode].PreAuthorizedCode
+}
+
+func TestCredentialOffer_RedeemedOnce(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	offer := createOffer(t, server, "offered-session")
+	assert.Equal(t, offer.CreatedAt.Add(defaultOfferLifetime), offer.ExpiresAt)
+	code := preAuthorizedCode(t, offer.URI)
+	require.NotEmpty(t, code)
+
+	// The QR code carries the same deep link, as a PNG or an SVG
+	w := operatorRequest(t, server, http.MethodGet, "/credential-offers/"+offer.ID+"/qr", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var qr CredentialOfferQR
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &qr))
+	assert.Equal(t, offer.URI, qr.URI)
+	assert.Equal(t, "png", qr.Format)
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(qr.Image, "data:image/png;base64,"))
+	require.NoError(t, err)
+	_, err = png.Decode(bytes.NewReader(raw))
+	require.NoError(t, err)
+
+	w = operatorRequest(t, server, http.MethodGet, "/credential-offers/"+offer.ID+"/qr?format=svg", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &qr))
+	raw, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(qr.Image, "data:image/svg+xml;base64,"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "<svg "), string(raw))
+
+	// The wallet redeems the code for a token scoped to the offer
+	redeem := TokenRequest{GrantType: GrantTypePreAuthorizedCode, ClientID: "test-wallet", PreAuthorizedCode: code}
+	w = postJSON(t, server, "/oauth/token", redeem, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tokenResp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokenResp))
+	assert.Equal(t, ScopeAgeCredential, tokenResp.Scope)
+	journey, err := server.journeys.store.FindBySession(context.Background(), "offered-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateTokenIssued, journey.State)
+
+	// and only once
+	w = postJSON(t, server, "/oauth/token", redeem, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeInvalidGrant)
+	w = operatorRequest(t, server, http.MethodGet, "/credential-offers/"+offer.ID+"/qr", "operator-secret")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), codeOfferRedeemed)
+}
+
+func TestCredentialOffer_Expires(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	offer := createOffer(t, server, "expiring-session")
+	code := preAuthorizedCode(t, offer.URI)
+
+	_, err := server.offers.Redeem(offer.Tenant, code, offer.ExpiresAt.Add(time.Second))
+	assert.ErrorIs(t, err, ErrOfferExpired)
+	stored := server.offers.offers[offer.ID]
+	stored.ExpiresAt = time.Now().Add(-time.Second)
+	server.offers.offers[offer.ID] = stored
+
+	w := operatorRequest(t, server, http.MethodGet, "/credential-offers/"+offer.ID+"/qr", "operator-secret")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), codeOfferExpired)
+	w = postJSON(t, server, "/oauth/token", TokenRequest{GrantType: GrantTypePreAuthorizedCode, ClientID: "test-wallet", PreAuthorizedCode: code}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, 1, server.offers.PurgeExpired(time.Now()))
+	w = operatorRequest(t, server, http.MethodGet, "/credential-offers/"+offer.ID+"/qr", "operator-secret")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCredentialOffer_Refused(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	w := postJSON(t, server, "/issuance/journeys", CreateJourneyRequest{SessionID: "pending-session"}, operatorHeaders)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = postJSON(t, server, "/webhooks/veriff", approvedSession("verified-session"), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	tests := []struct {
+		name    string
+		req     CreateOfferRequest
+		headers map[string]string
+		status  int
+	}{
+		{"no operator token", CreateOfferRequest{SessionID: "verified-session"}, nil, http.StatusUnauthorized},
+		{"no session", CreateOfferRequest{}, operatorHeaders, http.StatusBadRequest},
+		{"unknown session", CreateOfferRequest{SessionID: "unknown-session"}, operatorHeaders, http.StatusNotFound},
+		{"unverified session", CreateOfferRequest{SessionID: "pending-session"}, operatorHeaders, http.StatusConflict},
+		{"unknown credential", CreateOfferRequest{SessionID: "verified-session", CredentialConfigurationIDs: []string{"PassportCredential"}}, operatorHeaders, http.StatusBadRequest},
+		{"outliving the session", CreateOfferRequest{SessionID: "verified-session", ExpiresIn: 25 * 3600}, operatorHeaders, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, server, "/credential-offers", tt.req, tt.headers)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+		})
+	}
+
+	w = operatorRequest(t, server, http.MethodGet, "/credential-offers/unknown/qr?format=gif", "operator-secret")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = operatorRequest(t, server, http.MethodGet, "/credential-offers/unknown/qr", "operator-secret")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
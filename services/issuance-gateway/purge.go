@@ -0,0 +1,166 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons sensitive session data is purged
+const (
+	PurgeReasonIssued  = "issued"
+	PurgeReasonExpired = "retention_expired"
+	PurgeReasonDenied  = "review_denied"
+)
+
+// defaultSessionRetention matches how long a journey may wait in the
+// verified state for its credential
+const defaultSessionRetention = 24 * time.Hour
+
+var purgedSessions = expvar.NewMap("veriff_sessions_purged_total")
+
+// SessionQualityProfile is what remains of a Veriff session after purging:
+// the evidence quality behind the credential, with no personal data,
+// document images, biometrics or device identifiers
+type SessionQualityProfile struct {
+	SessionID            string    `json:"session_id"`
+	QualityLevel         string    `json:"quality_level"`
+	QualityVersion       string    `json:"quality_version,omitempty"`
+	Confidence           float64   `json:"confidence"`
+	LivenessScore        float64   `json:"liveness_score,omitempty"`
+	DocumentAuthenticity float64   `json:"document_authenticity,omitempty"`
+	RiskScore            float64   `json:"risk_score,omitempty"`
+	DocumentType         string    `json:"document_type,omitempty"`
+	VerifiedAt           time.Time `json:"verified_at"`
+	PurgedAt             time.Time `json:"purged_at"`
+	PurgeReason          string    `json:"purge_reason"`
+}
+
+type vaultEntry struct {
+	session    VeriffSession
+	validation ValidationResult
+	storedAt   time.Time
+}
+
+// sessionVault holds verified Veriff sessions, and those awaiting an
+// operator's review, until their credential is issued or the retention
+// period lapses (production should use an
+// encrypted store)
+type sessionVault struct {
+	mu        sync.Mutex
+	retention time.Duration
+	sessions  map[string]vaultEntry
+	profiles  map[string]SessionQualityProfile
+}
+
+func newSessionVault() *sessionVault {
+	return &sessionVault{
+		retention: defaultSessionRetention,
+		sessions:  make(map[string]vaultEntry),
+		profiles:  make(map[string]SessionQualityProfile),
+	}
+}
+
+func (v *sessionVault) Store(session VeriffSession, validation ValidationResult, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sessions[session.SessionID] = vaultEntry{session: session, validation: validation, storedAt: now}
+	delete(v.profiles, session.SessionID)
+}
+
+func (v *sessionVault) Get(sessionID string) (VeriffSession, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.sessions[sessionID]
+	return entry.session, ok
+}
+
+// Validation returns a held session's validation
+func (v *sessionVault) Validation(sessionID string) (ValidationResult, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.sessions[sessionID]
+	return entry.validation, ok
+}
+
+// Profile returns the quality profile retained for a purged session
+func (v *sessionVault) Profile(sessionID string) (SessionQualityProfile, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	profile, ok := v.profiles[sessionID]
+	return profile, ok
+}
+
+// Purge drops the full session, keeping only its quality profile
+func (v *sessionVault) Purge(sessionID, reason string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.purgeLocked(sessionID, reason, now)
+}
+
+// Erase drops everything held on a session, its quality profile included,
+// for the subject's erasure, reporting whether there was anything
+func (v *sessionVault) Erase(sessionID string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, held := v.sessions[sessionID]
+	_, profiled := v.profiles[sessionID]
+	delete(v.sessions, sessionID)
+	delete(v.profiles, sessionID)
+	return held || profiled
+}
+
+// PurgeExpired purges every session held longer than the retention period
+func (v *sessionVault) PurgeExpired(now time.Time) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	purged := 0
+	for id, entry := range v.sessions {
+		if now.Sub(entry.storedAt) >= v.retention && v.purgeLocked(id, PurgeReasonExpired, now) {
+			purged++
+		}
+	}
+	return purged
+}
+
+func (v *sessionVault) purgeLocked(sessionID, reason string, now time.Time) bool {
+	entry, ok := v.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	delete(v.sessions, sessionID)
+
+	v.profiles[sessionID] = SessionQualityProfile{
+		SessionID:            sessionID,
+		QualityLevel:         entry.validation.QualityLevel,
+		QualityVersion:       entry.validation.QualityVersion,
+		Confidence:           entry.validation.Confidence,
+		LivenessScore:        entry.session.Verification.LivenessScore,
+		DocumentAuthenticity: entry.session.Document.Authenticity,
+		RiskScore:            entry.session.Verification.RiskScore,
+		DocumentType:         entry.session.Document.Type,
+		VerifiedAt:           entry.storedAt,
+		PurgedAt:             now,
+		PurgeReason:          reason,
+	}
+	purgedSessions.Add(reason, 1)
+	return true
+}
+
+func (s *Server) reapSensitiveSessionData(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if purged := s.verifiedSessions.PurgeExpired(time.Now()); purged > 0 {
+			log.Info().Int("purged", purged).Msg("Purged sensitive data from expired Veriff sessions")
+		}
+		if purged := s.offers.PurgeExpired(time.Now()); purged > 0 {
+			log.Info().Int("purged", purged).Msg("Purged expired credential offers")
+		}
+		if purged := s.notifications.PurgeExpired(time.Now()); purged > 0 {
+			log.Info().Int("purged", purged).Msg("Purged issuance transactions no wallet reported on")
+		}
+	}
+}
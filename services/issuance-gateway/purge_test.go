@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func purgeCount(reason string) int64 {
+	if v, ok := purgedSessions.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestPurge_AfterIssuance(t *testing.T) {
+	server := NewServer()
+	before := purgeCount(PurgeReasonIssued)
+
+	session := approvedSession("purge-session")
+	session["media"] = []map[string]string{{"context": "document-front", "url": "https://veriff.example/media/1"}}
+	session["technicalData"] = map[string]string{"ip": "198.51.100.7", "deviceFingerprint": "fp-123"}
+	bindSession(t, server, "purge-session", nil)
+	w := postJSON(t, server, "/webhooks/veriff", session, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	stored, ok := server.verifiedSessions.Get("purge-session")
+	require.True(t, ok)
+	assert.Len(t, stored.Media, 1)
+
+	w = postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + issueSessionToken(t, server, "purge-session", "credential_issuance", nil).AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, ok = server.verifiedSessions.Get("purge-session")
+	assert.False(t, ok)
+
+	profile, ok := server.verifiedSessions.Profile("purge-session")
+	require.True(t, ok)
+	assert.Equal(t, VerificationLevelGold, profile.QualityLevel)
+	assert.Equal(t, PurgeReasonIssued, profile.PurgeReason)
+
+	encoded, err := json.Marshal(profile)
+	require.NoError(t, err)
+	for _, sensitive := range []string{"Alice", "1992-03-10", "AB123456C", "veriff.example", "fp-123", "198.51.100.7"} {
+		assert.NotContains(t, string(encoded), sensitive)
+	}
+	assert.Equal(t, before+1, purgeCount(PurgeReasonIssued))
+}
+
+func TestPurge_RetentionExpiry(t *testing.T) {
+	vault := newSessionVault()
+	vault.retention = time.Hour
+	now := time.Now()
+	before := purgeCount(PurgeReasonExpired)
+
+	var session VeriffSession
+	session.SessionID = "stale-session"
+	vault.Store(session, ValidationResult{QualityLevel: VerificationLevelStandard}, now)
+
+	assert.Equal(t, 0, vault.PurgeExpired(now.Add(59*time.Minute)))
+	assert.Equal(t, 1, vault.PurgeExpired(now.Add(time.Hour)))
+
+	_, ok := vault.Get("stale-session")
+	assert.False(t, ok)
+	profile, ok := vault.Profile("stale-session")
+	require.True(t, ok)
+	assert.Equal(t, PurgeReasonExpired, profile.PurgeReason)
+	assert.Equal(t, before+1, purgeCount(PurgeReasonExpired))
+}
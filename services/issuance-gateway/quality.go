@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+)
+
+// TierThreshold is the minimum evidence a session needs to reach a tier.
+// Zero values impose no requirement on that metric.
+type TierThreshold struct {
+	MinConfidence           float64 `json:"min_confidence"`
+	MinLiveness             float64 `json:"min_liveness,omitempty"`
+	MinDocumentAuthenticity float64 `json:"min_document_authenticity,omitempty"`
+}
+
+func (t TierThreshold) admits(confidence float64, session VeriffSession) bool {
+	return confidence >= t.MinConfidence &&
+		session.Verification.LivenessScore >= t.MinLiveness &&
+		session.Document.Authenticity >= t.MinDocumentAuthenticity
+}
+
+// QualityThresholds configures how Veriff sessions map to verification tiers.
+// QualityVersion is recorded with every validation so a credential's tier can
+// be traced back to the rules in force when it was issued.
+type QualityThresholds struct {
+	QualityVersion    string        `json:"quality_version"`
+	Gold              TierThreshold `json:"gold"`
+	Premium           TierThreshold `json:"premium"`
+	Standard          TierThreshold `json:"standard"`
+	MaxRiskScore      float64       `json:"max_risk_score"`
+	MinLivenessScore  float64       `json:"min_liveness_score"`
+	DefaultConfidence float64       `json:"default_confidence"`
+}
+
+// DefaultQualityThresholds returns the built-in tier rules
+func DefaultQualityThresholds() QualityThresholds {
+	return QualityThresholds{
+		QualityVersion:    "2025-09-default",
+		Gold:              TierThreshold{MinConfidence: 0.95, MinLiveness: 0.90, MinDocumentAuthenticity: 0.95},
+		Premium:           TierThreshold{MinConfidence: 0.90, MinLiveness: 0.85},
+		Standard:          TierThreshold{MinConfidence: 0.80},
+		MaxRiskScore:      0.3,
+		MinLivenessScore:  0.7,
+		DefaultConfidence: 0.85,
+	}
+}
+
+// Validate rejects threshold sets that are out of range or that would make a
+// higher tier easier to reach than a lower one
+func (q QualityThresholds) Validate() error {
+	if q.QualityVersion == "" {
+		return errors.New("quality_version is required")
+	}
+	scores := map[string]float64{
+		"max_risk_score":     q.MaxRiskScore,
+		"min_liveness_score": q.MinLivenessScore,
+		"default_confidence": q.DefaultConfidence,
+	}
+	for name, tier := range map[string]TierThreshold{"gold": q.Gold, "premium": q.Premium, "standard": q.Standard} {
+		scores[name+".min_confidence"] = tier.MinConfidence
+		scores[name+".min_liveness"] = tier.MinLiveness
+		scores[name+".min_document_authenticity"] = tier.MinDocumentAuthenticity
+	}
+	for name, v := range scores {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, v)
+		}
+	}
+	if !q.Gold.atLeast(q.Premium) || !q.Premium.atLeast(q.Standard) {
+		return errors.New("tier thresholds must not decrease from standard to premium to gold")
+	}
+	return nil
+}
+
+func (t TierThreshold) atLeast(other TierThreshold) bool {
+	return t.MinConfidence >= other.MinConfidence &&
+		t.MinLiveness >= other.MinLiveness &&
+		t.MinDocumentAuthenticity >= other.MinDocumentAuthenticity
+}
+
+// ParseQualityThresholds decodes a threshold document. Fields it omits keep
+// their default values.
+func ParseQualityThresholds(data []byte) (QualityThresholds, error) {
+	thresholds := DefaultQualityThresholds()
+	if err := json.Unmarshal(data, &thresholds); err != nil {
+		return QualityThresholds{}, fmt.Errorf("decoding quality thresholds: %w", err)
+	}
+	if err := thresholds.Validate(); err != nil {
+		return QualityThresholds{}, fmt.Errorf("invalid quality thresholds: %w", err)
+	}
+	return thresholds, nil
+}
+
+// QualityConfig selects the quality thresholds sessions are held to and the
+// strategy scoring them. Thresholds come from, in order of precedence,
+// inline JSON, a file or a registry-served document, falling back to the
+// built-in defaults.
+type QualityConfig struct {
+	Thresholds     string `env:"QUALITY_THRESHOLDS" doc:"Quality thresholds as inline JSON"`
+	ThresholdsFile string `env:"QUALITY_THRESHOLDS_FILE" doc:"JSON file of quality thresholds, when QUALITY_THRESHOLDS is unset"`
+	ThresholdsURL  string `env:"QUALITY_THRESHOLDS_URL" doc:"Registry-served quality thresholds document, when neither QUALITY_THRESHOLDS nor QUALITY_THRESHOLDS_FILE is set; the built-in thresholds apply without any"`
+	Scoring        string `env:"QUALITY_SCORING" default:"confidence" oneof:"confidence,weighted,rules,model" doc:"Strategy scoring verification sessions"`
+	ModelURL       string `env:"QUALITY_MODEL_URL" doc:"Scoring model QUALITY_SCORING=model calls"`
+}
+
+// Validate checks inline thresholds parse and the registry and model URLs
+// are http(s) URLs
+func (c QualityConfig) Validate() error {
+	if c.Thresholds != "" {
+		if _, err := ParseQualityThresholds([]byte(c.Thresholds)); err != nil {
+			return fmt.Errorf("QUALITY_THRESHOLDS: %w", err)
+		}
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"QUALITY_THRESHOLDS_URL", c.ThresholdsURL},
+		{"QUALITY_MODEL_URL", c.ModelURL},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if u, err := url.Parse(setting.value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http(s) URL", setting.name)
+		}
+	}
+	if c.Scoring == ScoringModel && c.ModelURL == "" {
+		return errors.New("QUALITY_SCORING=model requires QUALITY_MODEL_URL")
+	}
+	return nil
+}
+
+// LoadQualityThresholds reads the thresholds c selects
+func LoadQualityThresholds(ctx context.Context, c QualityConfig) (QualityThresholds, error) {
+	if c.Thresholds != "" {
+		return ParseQualityThresholds([]byte(c.Thresholds))
+	}
+	if c.ThresholdsFile != "" {
+		data, err := os.ReadFile(c.ThresholdsFile)
+		if err != nil {
+			return QualityThresholds{}, fmt.Errorf("reading quality thresholds: %w", err)
+		}
+		return ParseQualityThresholds(data)
+	}
+	if c.ThresholdsURL != "" {
+		return fetchQualityThresholds(ctx, deadline.NewClient("registry"), c.ThresholdsURL)
+	}
+	return DefaultQualityThresholds(), nil
+}
+
+func fetchQualityThresholds(ctx context.Context, client *http.Client, url string) (QualityThresholds, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return QualityThresholds{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return QualityThresholds{}, fmt.Errorf("fetching quality thresholds: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return QualityThresholds{}, fmt.Errorf("fetching quality thresholds: registry returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return QualityThresholds{}, fmt.Errorf("reading quality thresholds: %w", err)
+	}
+	return ParseQualityThresholds(data)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func premiumSession() VeriffSession {
+	var session VeriffSession
+	session.Status = "approved"
+	session.Verification.OverallConfidence = 0.92
+	session.Verification.LivenessScore = 0.88
+	session.Document.Authenticity = 0.90
+	return session
+}
+
+func TestQualityThresholds_DefaultsMatchBuiltInTiers(t *testing.T) {
+	result := validateVeriffSession(premiumSession(), DefaultQualityThresholds(), confidenceScore(premiumSession()))
+	assert.True(t, result.IsValid)
+	assert.Equal(t, VerificationLevelPremium, result.QualityLevel)
+	assert.Equal(t, "2025-09-default", result.QualityVersion)
+}
+
+func TestQualityThresholds_MarketOverride(t *testing.T) {
+	thresholds, err := ParseQualityThresholds([]byte(`{
+		"quality_version": "2025-10-de",
+		"premium": {"min_confidence": 0.93, "min_liveness": 0.85}
+	}`))
+	require.NoError(t, err)
+
+	// Unspecified fields keep their defaults
+	assert.Equal(t, 0.3, thresholds.MaxRiskScore)
+
+	result := validateVeriffSession(premiumSession(), thresholds, confidenceScore(premiumSession()))
+	assert.Equal(t, VerificationLevelStandard, result.QualityLevel)
+	assert.Equal(t, "2025-10-de", result.QualityVersion)
+}
+
+func TestQualityThresholds_RejectsInvalidConfig(t *testing.T) {
+	_, err := ParseQualityThresholds([]byte(`{"quality_version": ""}`))
+	assert.Error(t, err)
+
+	_, err = ParseQualityThresholds([]byte(`{"quality_version": "v2", "max_risk_score": 1.5}`))
+	assert.Error(t, err)
+
+	// Gold easier to reach than premium
+	_, err = ParseQualityThresholds([]byte(`{"quality_version": "v2", "gold": {"min_confidence": 0.5}}`))
+	assert.Error(t, err)
+}
+
+func TestLoadQualityThresholds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thresholds.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"quality_version": "file-v1"}`), 0o600))
+
+	thresholds, err := LoadQualityThresholds(context.Background(), QualityConfig{ThresholdsFile: path})
+	require.NoError(t, err)
+	assert.Equal(t, "file-v1", thresholds.QualityVersion)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"quality_version": "registry-v3"}`))
+	}))
+	defer registry.Close()
+	thresholds, err = LoadQualityThresholds(context.Background(), QualityConfig{ThresholdsURL: registry.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "registry-v3", thresholds.QualityVersion)
+
+	thresholds, err = LoadQualityThresholds(context.Background(), QualityConfig{Thresholds: `{"quality_version": "inline-v2"}`, ThresholdsURL: registry.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "inline-v2", thresholds.QualityVersion)
+}
+
+func TestQualityConfig_Validate(t *testing.T) {
+	assert.NoError(t, QualityConfig{Scoring: ScoringRules}.Validate())
+	assert.ErrorContains(t, QualityConfig{Thresholds: `{"max_risk_score": 1.5}`}.Validate(), "QUALITY_THRESHOLDS")
+	assert.ErrorContains(t, QualityConfig{ThresholdsURL: "registry.internal/thresholds"}.Validate(), "QUALITY_THRESHOLDS_URL")
+	assert.ErrorContains(t, QualityConfig{Scoring: ScoringModel}.Validate(), "QUALITY_MODEL_URL")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+)
+
+var ErrReceiptsLogUnavailable = errors.New("receipts-log unavailable")
+
+// receiptsLogClient reaches the receipts-log for the holders' consent
+// receipts, which it keeps under the digest of the holder's DID, and to
+// anchor the credentials issued
+type receiptsLogClient struct {
+	client *http.Client
+	url    string
+}
+
+// newReceiptsLogClient calls the receipts-log at serviceURL, authenticating
+// as the gateway with auth when it is set
+func newReceiptsLogClient(serviceURL string, auth *serviceauth.Authenticator) *receiptsLogClient {
+	client := deadline.NewClient("receipts-log")
+	client.Transport = auth.Transport("receipts-log", client.Transport)
+	return &receiptsLogClient{client: client, url: strings.TrimSuffix(serviceURL, "/")}
+}
+
+// holderDigest is the urn:sha256 digest of a holder's DID, as the verifier
+// submits it with the holder's receipts
+func holderDigest(did string) string {
+	sum := sha256.Sum256([]byte(did))
+	return "urn:sha256:" + hex.EncodeToString(sum[:])
+}
+
+// do sends a request for the receipts of the holder with DID and decodes
+// the answer into out
+func (c *receiptsLogClient) do(ctx context.Context, method, did string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+"/subjects/"+url.PathEscape(holderDigest(did))+"/receipts", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReceiptsLogUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: returned %d", ErrReceiptsLogUnavailable, resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(out); err != nil {
+		return fmt.Errorf("%w: decoding response: %v", ErrReceiptsLogUnavailable, err)
+	}
+	return nil
+}
+
+// Export returns the receipt hashes logged for the holder with DID
+func (c *receiptsLogClient) Export(ctx context.Context, did string) (json.RawMessage, error) {
+	var export json.RawMessage
+	err := c.do(ctx, http.MethodGet, did, &export)
+	return export, err
+}
+
+// Tombstone unlinks the receipts of the holder with DID from them and
+// returns how many there were
+func (c *receiptsLogClient) Tombstone(ctx context.Context, did string) (int, error) {
+	var tombstoned struct {
+		Tombstoned int `json:"tombstoned"`
+	}
+	err := c.do(ctx, http.MethodDelete, did, &tombstoned)
+	return tombstoned.Tombstoned, err
+}
+
+// Timestamp anchors the digest of an issued credential in the receipts
+// log, which holds it from the time it acknowledged it
+func (c *receiptsLogClient) Timestamp(ctx context.Context, digest string) (TimestampEvidence, error) {
+	body, err := json.Marshal(map[string]string{"credentialHash": digest})
+	if err != nil {
+		return TimestampEvidence{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/credentials/hash", bytes.NewReader(body))
+	if err != nil {
+		return TimestampEvidence{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return TimestampEvidence{}, fmt.Errorf("%w: %v", ErrReceiptsLogUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return TimestampEvidence{}, fmt.Errorf("%w: returned %d", ErrReceiptsLogUnavailable, resp.StatusCode)
+	}
+	var anchor struct {
+		Accepted bool   `json:"accepted"`
+		Hash     string `json:"hash"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&anchor); err != nil {
+		return TimestampEvidence{}, fmt.Errorf("%w: decoding response: %v", ErrReceiptsLogUnavailable, err)
+	}
+	if !anchor.Accepted || anchor.Hash != digest {
+		return TimestampEvidence{}, fmt.Errorf("%w: acknowledged %q instead of %q", ErrReceiptsLogUnavailable, anchor.Hash, digest)
+	}
+	return TimestampEvidence{
+		Type:      EvidenceReceiptsLogAnchor,
+		Digest:    digest,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Authority: c.url,
+	}, nil
+}
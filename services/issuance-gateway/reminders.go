@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// renewalReminders counts holders reminded of expiring credentials, and
+// the expiring credentials that could no longer be renewed
+var renewalReminders = expvar.NewMap("credential_renewal_reminders_total")
+
+// RenewalReminder is a credential about to expire and the offer renewing it
+type RenewalReminder struct {
+	CredentialID              string    `json:"credential_id"`
+	CredentialConfigurationID string    `json:"credential_configuration_id"`
+	ExpiresAt                 time.Time `json:"expires_at"`
+	// RenewBy is the last moment the credential can be renewed
+	RenewBy time.Time       `json:"renew_by"`
+	Offer   CredentialOffer `json:"offer"`
+}
+
+// renewBy is the last moment a credential can be renewed without a new
+// identity session, and whether that is still ahead: renewal then stops at
+// the grace period or the verification's maximum age, whichever is first,
+// and not at all for credentials revoked, suspended or whose verification
+// fell below the quality policy. It fails when the status lists cannot be
+// read.
+func (s *Server) renewBy(ctx context.Context, record issuedCredential, now time.Time) (time.Time, bool, error) {
+	if s.renewal.MaxAge == 0 {
+		return time.Time{}, false, nil
+	}
+	status, err := s.statusList.Status(ctx, record.StatusListIndex)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("reading the credential's status: %w", err)
+	}
+	if status != CredentialStatusActive {
+		return time.Time{}, false, nil
+	}
+	profile, ok := s.verifiedSessions.Profile(record.SessionID)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	validation := revalidateProfile(profile, s.quality)
+	if !validation.IsValid || tierRank[validation.QualityLevel] < tierRank[profile.QualityLevel] {
+		return time.Time{}, false, nil
+	}
+	deadline := record.ExpiresAt.Add(s.renewal.Grace)
+	if verified := profile.VerifiedAt.Add(s.renewal.MaxAge); verified.Before(deadline) {
+		deadline = verified
+	}
+	return deadline, now.Before(deadline), nil
+}
+
+// createRenewalOffer offers the renewal of a credential until renewBy. Its
+// pre-authorized code only redeems with the holder's key, so the offer can
+// travel through push services and partners.
+func (s *Server) createRenewalOffer(record issuedCredential, renewBy, now time.Time) (CredentialOffer, error) {
+	offer, err := s.offers.Create(CredentialOffer{
+		ID:                         uuid.NewString(),
+		Tenant:                     record.Tenant,
+		CredentialConfigurationIDs: []string{record.CredentialType},
+		CreatedAt:                  now.UTC(),
+		ExpiresAt:                  renewBy.UTC(),
+		Renews:                     record.CredentialID,
+	})
+	if err != nil {
+		return CredentialOffer{}, err
+	}
+	offer.URI, err = offerURI(s.issuerOf(record.Tenant).did, offer)
+	if err != nil {
+		return CredentialOffer{}, err
+	}
+	s.issued.Remind(record.CredentialID, offer.ID, now)
+	return offer, nil
+}
+
+// remindExpiring offers the renewal of every credential expiring within
+// the reminder period whose holder was not reminded yet, announcing each
+// as credential.expiring. It returns how many holders were reminded.
+func (s *Server) remindExpiring(ctx context.Context, now time.Time) int {
+	reminded := 0
+	for _, record := range s.issued.Expiring(now.Add(s.renewal.Reminder)) {
+		renewBy, ok, err := s.renewBy(ctx, record, now)
+		if err != nil {
+			log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to check whether the credential is renewable")
+			continue
+		}
+		if !ok {
+			// Holders verify again instead; they are not reminded twice
+			s.issued.Remind(record.CredentialID, "", now)
+			renewalReminders.Add("unrenewable", 1)
+			continue
+		}
+		offer, err := s.createRenewalOffer(record, renewBy, now)
+		if err != nil {
+			log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to create renewal offer")
+			continue
+		}
+		tenantCtx := tenant.NewContext(ctx, tenant.Tenant{ID: record.Tenant})
+		s.recordAudit(tenantCtx, AuditEvent{
+			Type:           AuditOfferCreated,
+			Actor:          "renewal-reminder",
+			SessionID:      record.SessionID,
+			JourneyID:      record.JourneyID,
+			CredentialType: record.CredentialType,
+			CredentialID:   record.CredentialID,
+			Detail:         "offer=" + offer.ID + " renews " + record.CredentialID,
+		})
+		s.publish(tenantCtx, record.CredentialID, events.CredentialExpiring{
+			CredentialID:   record.CredentialID,
+			CredentialType: record.CredentialType,
+			HolderJKT:      record.JKT,
+			ExpiresAt:      record.ExpiresAt.UTC(),
+			RenewBy:        offer.ExpiresAt,
+			OfferURI:       offer.URI,
+		})
+		renewalReminders.Add("sent", 1)
+		reminded++
+	}
+	return reminded
+}
+
+// remindRenewals reminds holders of expiring credentials every interval
+func (s *Server) remindRenewals(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if reminded := s.remindExpiring(context.Background(), time.Now()); reminded > 0 {
+			log.Info().Int("reminded", reminded).Msg("Reminded holders of expiring credentials")
+		}
+	}
+}
+
+// handleListRenewalReminders shows a wallet, proving its key with a DPoP
+// proof, the renewal offers of its credentials within the reminder period.
+// An offer redeemed without renewing, or expired, is replaced.
+func (s *Server) handleListRenewalReminders(w http.ResponseWriter, r *http.Request) {
+	jkt, err := s.verifyDPoPProof(r, r.Header.Get(dpopHeader), "")
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid DPoP proof at renewal reminders endpoint")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidDPoPProof, "Invalid DPoP proof")
+		return
+	}
+	tenantID := tenant.FromContext(r.Context()).ID
+	now := time.Now()
+	reminders := []RenewalReminder{}
+	if s.renewal.Reminder > 0 {
+		for _, record := range s.issued.ForKey(tenantID, jkt) {
+			if record.ExpiresAt.After(now.Add(s.renewal.Reminder)) {
+				continue
+			}
+			renewBy, ok, err := s.renewBy(r.Context(), record, now)
+			if err != nil {
+				log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to check whether the credential is renewable")
+				writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Credential status unavailable")
+				return
+			}
+			if !ok {
+				continue
+			}
+			offer, err := s.offers.Get(tenantID, record.ReminderOffer)
+			if err == nil && offer.RedeemedAt == nil && now.Before(offer.ExpiresAt) {
+				offer.URI, err = offerURI(s.issuerOf(tenantID).did, offer)
+			} else {
+				offer, err = s.createRenewalOffer(record, renewBy, now)
+			}
+			if err != nil {
+				log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to offer renewal")
+				writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+				return
+			}
+			reminders = append(reminders, RenewalReminder{
+				CredentialID:              record.CredentialID,
+				CredentialConfigurationID: record.CredentialType,
+				ExpiresAt:                 record.ExpiresAt.UTC(),
+				RenewBy:                   offer.ExpiresAt,
+				Offer:                     offer,
+			})
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reminders": reminders})
+}
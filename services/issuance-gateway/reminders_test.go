@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expireSoon moves a credential's expiry within the reminder period
+func expireSoon(server *Server, credentialID string) {
+	record := server.issued.credentials[credentialID]
+	record.ExpiresAt = time.Now().Add(server.renewal.Reminder / 2)
+	server.issued.credentials[credentialID] = record
+}
+
+// redeemRenewalOffer redeems a renewal offer's code with a DPoP proof of key
+func redeemRenewalOffer(t *testing.T, server *Server, key *ecdsa.PrivateKey, offerID string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:         GrantTypePreAuthorizedCode,
+		ClientID:          "test-wallet",
+		PreAuthorizedCode: server.offers.offers[offerID].code,
+	}, map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/oauth/token", "")})
+}
+
+// listReminders asks for the renewal reminders of the holder of key
+func listReminders(t *testing.T, server *Server, key *ecdsa.PrivateKey) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/credential/reminders", nil)
+	req.Header.Set(dpopHeader, dpopProof(t, key, http.MethodGet, "http://example.com/credential/reminders", ""))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRenewalReminder_OneTapRenewal(t *testing.T) {
+	bus := events.NewMemory()
+	var published []events.Event
+	require.NoError(t, bus.Subscribe("notifications", []string{events.TypeCredentialExpiring}, func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	}))
+	server := NewServer()
+	server.events = bus
+	key := newWalletKey(t)
+	credential := issueBoundIdentity(t, server, key, "reminded-session")
+	unexpiring := issueBoundIdentity(t, server, key, "unexpiring-session")
+
+	// Only credentials expiring within the reminder period are reminded, once
+	expireSoon(server, credential.ID)
+	assert.Equal(t, 1, server.remindExpiring(context.Background(), time.Now()))
+	assert.Equal(t, 0, server.remindExpiring(context.Background(), time.Now()))
+	require.NoError(t, bus.Close())
+	require.Len(t, published, 1)
+	var expiring events.CredentialExpiring
+	require.NoError(t, published[0].Decode(&expiring))
+	assert.Equal(t, credential.ID, expiring.CredentialID)
+	assert.Equal(t, CredentialTypeIdentity, expiring.CredentialType)
+	record := server.issued.credentials[credential.ID]
+	assert.Equal(t, record.JKT, expiring.HolderJKT)
+	// renewable until the grace period ends
+	assert.WithinDuration(t, record.ExpiresAt.Add(server.renewal.Grace), expiring.RenewBy, time.Second)
+	offer := server.offers.offers[record.ReminderOffer]
+	assert.Equal(t, credential.ID, offer.Renews)
+	assert.Empty(t, offer.SessionID)
+	assert.Contains(t, expiring.OfferURI, offer.code)
+	assert.Empty(t, server.issued.credentials[unexpiring.ID].ReminderOffer)
+
+	// The offer redeems only with the holder's key, for a token renewing that
+	// credential
+	w := redeemRenewalOffer(t, server, newWalletKey(t), offer.ID)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidGrant, decodeError(t, w).Code)
+
+	// A burned offer is replaced when the wallet asks for its reminders
+	w = listReminders(t, server, key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var list struct {
+		Reminders []RenewalReminder `json:"reminders"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Reminders, 1)
+	reminder := list.Reminders[0]
+	assert.Equal(t, credential.ID, reminder.CredentialID)
+	assert.NotEqual(t, offer.ID, reminder.Offer.ID)
+	assert.NotEmpty(t, reminder.Offer.URI)
+
+	w = redeemRenewalOffer(t, server, key, reminder.Offer.ID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tokenResp TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokenResp))
+	renewWithToken := func(credential VerifiableCredential) *httptest.ResponseRecorder {
+		return postJSON(t, server, "/credential/renew", RenewCredentialRequest{Credential: credential}, map[string]string{
+			"Authorization": "DPoP " + tokenResp.AccessToken,
+			dpopHeader:      dpopProof(t, key, http.MethodPost, "http://example.com/credential/renew", tokenResp.AccessToken),
+		})
+	}
+	w = renewWithToken(unexpiring)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	w = renewWithToken(credential)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Renewed credentials are no longer reminded
+	w = listReminders(t, server, key)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Empty(t, list.Reminders)
+}
+
+func TestRenewalReminder_Unrenewable(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	credential := issueBoundIdentity(t, server, key, "unrenewable-session")
+	expireSoon(server, credential.ID)
+	revokeCredential(t, server, credential.statusListIndex())
+
+	assert.Equal(t, 0, server.remindExpiring(context.Background(), time.Now()))
+	record := server.issued.credentials[credential.ID]
+	assert.False(t, record.RemindedAt.IsZero())
+	assert.Empty(t, record.ReminderOffer)
+	w := listReminders(t, server, key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"reminders":[]}`, w.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/credential/reminders", nil)
+	req.Header.Set(dpopHeader, "not-a-proof")
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidDPoPProof, decodeError(t, w).Code)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// revocationReasonSuperseded is why renewed credentials are revoked
+const revocationReasonSuperseded = "superseded"
+
+// RenewalConfig is the policy for renewing credentials without a new
+// identity session
+type RenewalConfig struct {
+	Grace            time.Duration `env:"CREDENTIAL_RENEWAL_GRACE" default:"720h" doc:"How long after it expired a credential can still be renewed; 0 renews only unexpired credentials"`
+	MaxAge           time.Duration `env:"CREDENTIAL_RENEWAL_MAX_AGE" default:"8760h" doc:"How long after the identity verification behind it a credential can be renewed; holders verify again after that; 0 disables renewal"`
+	Reminder         time.Duration `env:"CREDENTIAL_RENEWAL_REMINDER" default:"336h" doc:"How long before a renewable credential expires its holder is reminded to renew it, with a renewal offer their wallet redeems in one tap; 0 sends no reminders"`
+	ReminderInterval time.Duration `env:"CREDENTIAL_RENEWAL_REMINDER_INTERVAL" default:"1h" doc:"How often the gateway looks for credentials expiring within CREDENTIAL_RENEWAL_REMINDER"`
+}
+
+// Validate checks the durations are not negative, and the reminder
+// interval positive
+func (c RenewalConfig) Validate() error {
+	if c.Grace < 0 || c.MaxAge < 0 || c.Reminder < 0 {
+		return errors.New("CREDENTIAL_RENEWAL_GRACE, CREDENTIAL_RENEWAL_MAX_AGE and CREDENTIAL_RENEWAL_REMINDER must not be negative")
+	}
+	if c.ReminderInterval <= 0 {
+		return errors.New("CREDENTIAL_RENEWAL_REMINDER_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// defaultRenewalConfig matches the configuration defaults
+func defaultRenewalConfig() RenewalConfig {
+	return RenewalConfig{Grace: 30 * 24 * time.Hour, MaxAge: 365 * 24 * time.Hour, Reminder: 14 * 24 * time.Hour, ReminderInterval: time.Hour}
+}
+
+// RenewCredentialRequest is the body of POST /credential/renew; the DPoP
+// header carries a fresh proof of the holder key
+type RenewCredentialRequest struct {
+	Credential VerifiableCredential `json:"credential"`
+	Format     string               `json:"format,omitempty"`
+}
+
+var (
+	ErrCredentialUnknown = errors.New("credential not issued by this gateway")
+	ErrCredentialRenewed = errors.New("credential already renewed")
+)
+
+// issuedCredential is what the gateway keeps of a credential to renew it:
+// no claims, only the digest of the credential the holder presents again
+type issuedCredential struct {
+	Tenant          string
+	CredentialID    string
+	CredentialType  string
+	SessionID       string
+	JourneyID       string
+	Digest          string
+	JKT             string // holder key the credential was issued to, if bound
+	StatusListIndex string
+	ExpiresAt       time.Time
+	RenewedBy       string // the successor, once renewed
+	// ReminderOffer is the latest renewal offer the holder was reminded
+	// with, empty until the credential nears its expiry
+	ReminderOffer string
+	RemindedAt    time.Time
+}
+
+// issuedCredentialStore holds the renewable credentials issued (production
+// should use a durable database)
+type issuedCredentialStore struct {
+	mu          sync.Mutex
+	credentials map[string]issuedCredential
+}
+
+func newIssuedCredentialStore() *issuedCredentialStore {
+	return &issuedCredentialStore{credentials: make(map[string]issuedCredential)}
+}
+
+// Record keeps an issued credential
+func (cs *issuedCredentialStore) Record(credential issuedCredential) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.credentials[credential.CredentialID] = credential
+}
+
+// Get returns the tenant's credential with the ID
+func (cs *issuedCredentialStore) Get(tenantID, id string) (issuedCredential, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	credential, ok := cs.credentials[id]
+	if !ok || credential.Tenant != tenantID {
+		return issuedCredential{}, ErrCredentialUnknown
+	}
+	return credential, nil
+}
+
+// Renew marks a credential renewed by its successor; a credential is
+// renewed once
+func (cs *issuedCredentialStore) Renew(id, successor string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	credential, ok := cs.credentials[id]
+	if !ok {
+		return ErrCredentialUnknown
+	}
+	if credential.RenewedBy != "" {
+		return ErrCredentialRenewed
+	}
+	credential.RenewedBy = successor
+	cs.credentials[id] = credential
+	return nil
+}
+
+// Expiring returns the credentials bound to a holder key that expire by
+// before and whose holders were not reminded yet
+func (cs *issuedCredentialStore) Expiring(before time.Time) []issuedCredential {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var expiring []issuedCredential
+	for _, credential := range cs.credentials {
+		if credential.JKT != "" && credential.RenewedBy == "" && credential.RemindedAt.IsZero() && !credential.ExpiresAt.After(before) {
+			expiring = append(expiring, credential)
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].ExpiresAt.Before(expiring[j].ExpiresAt) })
+	return expiring
+}
+
+// ForKey returns the tenant's unrenewed credentials bound to the holder key
+// jkt
+func (cs *issuedCredentialStore) ForKey(tenantID, jkt string) []issuedCredential {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var held []issuedCredential
+	for _, credential := range cs.credentials {
+		if credential.Tenant == tenantID && credential.JKT == jkt && credential.RenewedBy == "" {
+			held = append(held, credential)
+		}
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].ExpiresAt.Before(held[j].ExpiresAt) })
+	return held
+}
+
+// Remind records that the holder was reminded with a renewal offer; an
+// empty offer marks a credential that can no longer be renewed
+func (cs *issuedCredentialStore) Remind(id, offerID string, at time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	credential, ok := cs.credentials[id]
+	if !ok {
+		return
+	}
+	credential.ReminderOffer, credential.RemindedAt = offerID, at
+	cs.credentials[id] = credential
+}
+
+// credentialDigest hashes a credential as it reads back from JSON, so the
+// credential issued and the one a holder presents hash alike
+func credentialDigest(vc VerifiableCredential) (string, error) {
+	encoded, err := json.Marshal(vc)
+	if err != nil {
+		return "", err
+	}
+	var decoded VerifiableCredential
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return "", err
+	}
+	if encoded, err = json.Marshal(decoded); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordIssued keeps a renewable credential issued to the key jkt
+func (s *Server) recordIssued(r *http.Request, config CredentialConfiguration, vc VerifiableCredential, journey IssuanceJourney, jkt string, expiresAt time.Time) {
+	if !config.renewable {
+		return
+	}
+	digest, err := credentialDigest(vc)
+	if err != nil {
+		log.Error().Err(err).Str("credential_id", vc.ID).Msg("Failed to record credential for renewal")
+		return
+	}
+	s.issued.Record(issuedCredential{
+		Tenant:          tenant.FromContext(r.Context()).ID,
+		CredentialID:    vc.ID,
+		CredentialType:  config.ID,
+		SessionID:       journey.SessionID,
+		JourneyID:       journey.ID,
+		Digest:          digest,
+		JKT:             jkt,
+		StatusListIndex: vc.statusListIndex(),
+		ExpiresAt:       expiresAt,
+	})
+}
+
+// tierRank orders verification tiers from basic up
+var tierRank = map[string]int{
+	VerificationLevelBasic:    1,
+	VerificationLevelStandard: 2,
+	VerificationLevelPremium:  3,
+	VerificationLevelGold:     4,
+}
+
+// revalidateProfile checks the quality profile of a purged session against
+// the thresholds in force, as its session was at issuance
+func revalidateProfile(profile SessionQualityProfile, thresholds QualityThresholds) ValidationResult {
+	session := VeriffSession{SessionID: profile.SessionID, Status: "approved"}
+	session.Verification.LivenessScore = profile.LivenessScore
+	session.Verification.RiskScore = profile.RiskScore
+	session.Document.Authenticity = profile.DocumentAuthenticity
+	session.Document.Type = profile.DocumentType
+	return validateVeriffSession(session, thresholds, QualityScore{Overall: profile.Confidence})
+}
+
+// handleRenewCredential issues the successor of a credential the holder
+// presents with a fresh proof of their key, without a new identity
+// session: the credential must be one the gateway issued, unrevoked,
+// unexpired or within the renewal grace, and its identity verification
+// recent enough and still up to the quality thresholds in force. The
+// successor carries the same claims under a new ID, status entry and
+// expiry, bound to the proof key; the credential it renews is revoked.
+// Wallets redeeming a renewal offer present its DPoP-bound access token
+// instead of a bare proof.
+func (s *Server) handleRenewCredential(w http.ResponseWriter, r *http.Request) {
+	var jkt, renews string
+	if r.Header.Get("Authorization") != "" {
+		token, ok := s.authenticateAccessToken(w, r)
+		if !ok {
+			return
+		}
+		jkt = tokenKeyThumbprint(token)
+		renews, _ = token.Claims.(jwt.MapClaims)["renews"].(string)
+		if jkt == "" || renews == "" {
+			writeOAuthError(w, r, http.StatusForbidden, ErrCodeInvalidToken, "The access token is not a renewal offer's")
+			return
+		}
+	} else {
+		var err error
+		jkt, err = s.verifyDPoPProof(r, r.Header.Get(dpopHeader), "")
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid DPoP proof at renewal endpoint")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidDPoPProof, "Invalid DPoP proof")
+			return
+		}
+	}
+	var req RenewCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Credential.ID == "" {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Invalid request body")
+		return
+	}
+	if renews != "" && renews != req.Credential.ID {
+		writeOAuthError(w, r, http.StatusForbidden, ErrCodeInvalidCredentialRequest, "The renewal offer is for another credential")
+		return
+	}
+
+	ctx := r.Context()
+	issuer := s.issuer(ctx)
+	record, err := s.issued.Get(tenant.FromContext(ctx).ID, req.Credential.ID)
+	if err == nil {
+		if digest, _ := credentialDigest(req.Credential); digest != record.Digest {
+			err = ErrCredentialUnknown
+		}
+	}
+	if err != nil {
+		log.Error().Str("credential_id", req.Credential.ID).Msg("Renewal of a credential the gateway did not issue")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Unknown credential")
+		return
+	}
+	config := credentialConfigurations[record.CredentialType]
+	if !issuer.offers(config.ID) {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeUnsupportedCredentialType, config.ID+" is not offered by this issuer")
+		return
+	}
+	if record.JKT != "" && record.JKT != jkt {
+		log.Error().Str("credential_id", record.CredentialID).Msg("Renewal proof signed by another key than the holder's")
+		writeOAuthError(w, r, http.StatusForbidden, ErrCodeInvalidCredentialRequest, "The key proof is not the credential holder's")
+		return
+	}
+
+	// Renewal stands in for a new identity session only while policy allows
+	now := time.Now()
+	refuse := func(message string) {
+		s.recordAudit(ctx, AuditEvent{
+			Type:           AuditCredentialRefused,
+			Actor:          jkt,
+			SessionID:      record.SessionID,
+			JourneyID:      record.JourneyID,
+			CredentialType: config.ID,
+			CredentialID:   record.CredentialID,
+			Outcome:        "denied",
+			Detail:         "renewal: " + message,
+		})
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, message)
+	}
+	if record.RenewedBy != "" {
+		writeOAuthError(w, r, http.StatusConflict, ErrCodeInvalidCredentialRequest, "Credential already renewed")
+		return
+	}
+	switch status, err := s.statusList.Status(ctx, record.StatusListIndex); {
+	case err != nil:
+		log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to read the credential's status")
+		writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Credential status unavailable")
+		return
+	case status == CredentialStatusRevoked:
+		refuse("The credential was revoked")
+		return
+	case status == CredentialStatusSuspended:
+		refuse("The credential is suspended")
+		return
+	}
+	if now.After(record.ExpiresAt.Add(s.renewal.Grace)) {
+		refuse("The credential expired too long ago to be renewed, verify your identity again")
+		return
+	}
+	profile, ok := s.verifiedSessions.Profile(record.SessionID)
+	if !ok || now.After(profile.VerifiedAt.Add(s.renewal.MaxAge)) {
+		refuse("The identity verification is too old to renew the credential, verify your identity again")
+		return
+	}
+	validation := revalidateProfile(profile, s.quality)
+	if !validation.IsValid || tierRank[validation.QualityLevel] < tierRank[profile.QualityLevel] {
+		refuse("The identity verification no longer meets the quality policy, verify your identity again")
+		return
+	}
+
+	status, err := s.statusList.Allocate(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to allocate a status list index")
+		writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Credential status unavailable")
+		return
+	}
+	successor := req.Credential
+	successor.ID = "urn:uuid:" + uuid.NewString()
+	if err := s.issued.Renew(record.CredentialID, successor.ID); err != nil {
+		writeOAuthError(w, r, http.StatusConflict, ErrCodeInvalidCredentialRequest, "Credential already renewed")
+		return
+	}
+	expiresAt := config.expiresAt(VeriffSession{}, profile.QualityLevel, now)
+	successor.Issuer = issuer.did
+	successor.IssuanceDate = now.Format(time.RFC3339)
+	successor.ExpirationDate = expiresAt.Format(time.RFC3339)
+	successor.CredentialStatus = status
+	successor.Evidence = nil
+	s.timestampCredential(ctx, &successor)
+	s.recordIssued(r, config, successor, IssuanceJourney{ID: record.JourneyID, SessionID: record.SessionID}, jkt, expiresAt)
+
+	// The successor supersedes the credential it renews
+	if revoked, err := s.statusList.Revoke(ctx, record.StatusListIndex); err != nil {
+		log.Error().Err(err).Str("credential_id", record.CredentialID).Msg("Failed to revoke the renewed credential")
+	} else if revoked {
+		s.publish(ctx, record.CredentialID, events.CredentialRevoked{
+			CredentialID:    record.CredentialID,
+			StatusListIndex: record.StatusListIndex,
+			Reason:          revocationReasonSuperseded,
+			RevokedAt:       now.UTC(),
+		})
+		s.security.Record(ctx, audit.Event{
+			Type:   audit.TypeRevocation,
+			Action: "credential.revoked",
+			Actor:  jkt,
+			Target: record.CredentialID,
+			Detail: revocationReasonSuperseded,
+		})
+	}
+
+	// Recorded as issued, so erasure and export find renewed credentials too
+	s.recordAudit(ctx, AuditEvent{
+		Type:            AuditCredentialIssued,
+		Actor:           jkt,
+		SessionID:       record.SessionID,
+		JourneyID:       record.JourneyID,
+		CredentialType:  config.ID,
+		CredentialID:    successor.ID,
+		QualityTier:     validation.QualityLevel,
+		StatusListIndex: successor.statusListIndex(),
+		Detail:          "renews " + record.CredentialID,
+	})
+	log.Info().
+		Str("credential_id", successor.ID).
+		Str("renews", record.CredentialID).
+		Msg("Credential renewed")
+	s.publishIssued(ctx, events.CredentialIssued{
+		CredentialID:    successor.ID,
+		Types:           config.Types,
+		Format:          config.Format,
+		Issuer:          issuer.did,
+		JourneyID:       record.JourneyID,
+		StatusListIndex: successor.statusListIndex(),
+	})
+
+	format := req.Format
+	if format == "" {
+		format = config.Format
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, CredentialResponse{Credential: successor, Format: format})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueBoundIdentity issues an identity credential bound to the wallet key
+func issueBoundIdentity(t *testing.T, server *Server, key *ecdsa.PrivateKey, sessionID string) VerifiableCredential {
+	t.Helper()
+	approveBoundSession(t, server, sessionID, key)
+	tokenResp := issueSessionToken(t, server, sessionID, ScopeIdentityCredential, key)
+
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  credentialProof(t, key, issuerDID),
+	}, map[string]string{
+		"Authorization": "DPoP " + tokenResp.AccessToken,
+		dpopHeader:      dpopProof(t, key, http.MethodPost, "http://example.com/credential", tokenResp.AccessToken),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	return credResp.Credential
+}
+
+func renew(t *testing.T, server *Server, key *ecdsa.PrivateKey, credential VerifiableCredential) *httptest.ResponseRecorder {
+	t.Helper()
+	return postJSON(t, server, "/credential/renew", RenewCredentialRequest{Credential: credential},
+		map[string]string{dpopHeader: dpopProof(t, key, http.MethodPost, "http://example.com/credential/renew", "")})
+}
+
+func TestRenewal_IssuesSuccessor(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	key := newWalletKey(t)
+	original := issueBoundIdentity(t, server, key, "renewed-session")
+
+	w := renew(t, server, key, original)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Credential VerifiableCredential `json:"credential"`
+		Format     string               `json:"format"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	successor := resp.Credential
+	assert.Equal(t, "jwt_vc", resp.Format)
+	assert.NotEqual(t, original.ID, successor.ID)
+	assert.Equal(t, original.CredentialSubject, successor.CredentialSubject)
+	assert.Equal(t, original.Issuer, successor.Issuer)
+	assert.NotEqual(t, original.statusListIndex(), successor.statusListIndex())
+	expiry, err := time.Parse(time.RFC3339, successor.ExpirationDate)
+	require.NoError(t, err)
+	// at the validity of the verification's gold tier
+	assert.WithinDuration(t, time.Now().Add(365*24*time.Hour), expiry, time.Minute)
+
+	// The original is superseded, and renewed once
+	assert.Equal(t, CredentialStatusRevoked, credentialStatus(t, server, original.statusListIndex()))
+	assert.Equal(t, CredentialStatusActive, credentialStatus(t, server, successor.statusListIndex()))
+	w = renew(t, server, key, original)
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	// The successor is issued as any credential, and renewable in turn
+	_, page := getAudit(t, server, "?type="+AuditCredentialIssued+"&session_id=renewed-session", "operator-secret")
+	require.Len(t, page.Events, 2)
+	assert.Equal(t, successor.ID, page.Events[1].CredentialID)
+	assert.Equal(t, "renews "+original.ID, page.Events[1].Detail)
+	w = renew(t, server, key, successor)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestRenewal_Refused(t *testing.T) {
+	key := newWalletKey(t)
+	tests := []struct {
+		name   string
+		setup  func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey
+		status int
+		code   string
+	}{
+		{"altered credential", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			credential.CredentialSubject["verificationLevel"] = "platinum"
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+		{"another holder key", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			return newWalletKey(t)
+		}, http.StatusForbidden, ErrCodeInvalidCredentialRequest},
+		{"revoked", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			revokeCredential(t, server, credential.statusListIndex())
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+		{"suspended", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			_, err := server.statusList.Suspend(context.Background(), credential.statusListIndex())
+			require.NoError(t, err)
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+		{"expired beyond the grace", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			record := server.issued.credentials[credential.ID]
+			record.ExpiresAt = time.Now().Add(-server.renewal.Grace - time.Hour)
+			server.issued.credentials[credential.ID] = record
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+		{"verification too old", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			server.renewal.MaxAge = 0
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+		{"tightened quality thresholds", func(server *Server, credential *VerifiableCredential) *ecdsa.PrivateKey {
+			server.quality.Gold.MinConfidence = 0.999
+			server.quality.Premium.MinConfidence = 0.999
+			return key
+		}, http.StatusBadRequest, ErrCodeInvalidCredentialRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			credential := issueBoundIdentity(t, server, key, "refused-session")
+			proofKey := tt.setup(server, &credential)
+			w := renew(t, server, proofKey, credential)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Equal(t, tt.code, decodeError(t, w).Code)
+		})
+	}
+
+	server := NewServer()
+	credential := issueBoundIdentity(t, server, key, "unproven-session")
+	w := postJSON(t, server, "/credential/renew", RenewCredentialRequest{Credential: credential}, map[string]string{dpopHeader: "not-a-proof"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidDPoPProof, decodeError(t, w).Code)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// AuditReviewDecided records an operator's decision on a borderline session
+const AuditReviewDecided = "review.decided"
+
+// Operator decisions on a session awaiting review
+const (
+	ReviewApprove   = "approve"
+	ReviewDeny      = "deny"
+	ReviewDowngrade = "downgrade"
+)
+
+// qualityRanks orders the verification levels an operator can downgrade
+// a session between
+var qualityRanks = map[string]int{
+	VerificationLevelBasic:    1,
+	VerificationLevelStandard: 2,
+	VerificationLevelPremium:  3,
+	VerificationLevelGold:     4,
+}
+
+// ReviewItem is a borderline session awaiting an operator's decision: the
+// evidence quality behind it, with no personal data
+type ReviewItem struct {
+	SessionID  string           `json:"session_id"`
+	JourneyID  string           `json:"journey_id"`
+	Reason     string           `json:"reason"`
+	QueuedAt   time.Time        `json:"queued_at"`
+	Deadline   *time.Time       `json:"deadline,omitempty"`
+	Validation ValidationResult `json:"validation"`
+	// The session's quality evidence, as its profile keeps it once purged
+	LivenessScore        float64 `json:"liveness_score,omitempty"`
+	DocumentAuthenticity float64 `json:"document_authenticity,omitempty"`
+	RiskScore            float64 `json:"risk_score,omitempty"`
+	DocumentType         string  `json:"document_type,omitempty"`
+}
+
+// ReviewList is the body of GET /reviews, oldest first
+type ReviewList struct {
+	Reviews []ReviewItem `json:"reviews"`
+}
+
+// ReviewDecisionRequest is the body of POST /reviews/{id}
+type ReviewDecisionRequest struct {
+	Decision string `json:"decision"`
+	// Reason is why the operator decided so, kept in the audit trail
+	Reason string `json:"reason"`
+	// QualityLevel is the lower tier a downgraded session is verified at
+	QualityLevel string `json:"quality_level,omitempty"`
+}
+
+// ReviewDecisionResponse reports the journey after the decision. An
+// approved or downgraded session comes with the credential offer its
+// subject's wallet redeems.
+type ReviewDecisionResponse struct {
+	SessionID    string           `json:"session_id"`
+	JourneyID    string           `json:"journey_id"`
+	Decision     string           `json:"decision"`
+	State        IssuanceState    `json:"state"`
+	QualityLevel string           `json:"quality_level,omitempty"`
+	Offer        *CredentialOffer `json:"offer,omitempty"`
+}
+
+// queueForReview holds a borderline session for an operator to decide on,
+// rather than failing its journey. The session's personal data stays in
+// the vault, under its retention period, until the decision.
+func (s *Server) queueForReview(ctx context.Context, journey IssuanceJourney, session VeriffSession, validation ValidationResult) error {
+	if journey.State.CanTransitionTo(StateReviewPending) {
+		// A redelivered event must not replace a decided session
+		s.verifiedSessions.Store(session, validation, time.Now())
+	}
+	return s.advanceJourney(ctx, journey, StateReviewPending, validation.Reason)
+}
+
+func (s *Server) handleListReviews(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	journeys, err := s.journeys.store.List(r.Context(), JourneyFilter{
+		Tenant: tenant.FromContext(r.Context()).ID,
+		State:  StateReviewPending,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list sessions awaiting review")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	list := ReviewList{Reviews: []ReviewItem{}}
+	for _, journey := range journeys {
+		session, held := s.verifiedSessions.Get(journey.SessionID)
+		validation, _ := s.verifiedSessions.Validation(journey.SessionID)
+		if !held {
+			// Purged under its retention period; there is nothing to review
+			continue
+		}
+		list.Reviews = append(list.Reviews, ReviewItem{
+			SessionID:            journey.SessionID,
+			JourneyID:            journey.ID,
+			Reason:               validation.Reason,
+			QueuedAt:             journey.UpdatedAt,
+			Deadline:             journey.Deadline,
+			Validation:           validation,
+			LivenessScore:        session.Verification.LivenessScore,
+			DocumentAuthenticity: session.Document.Authenticity,
+			RiskScore:            session.Verification.RiskScore,
+			DocumentType:         session.Document.Type,
+		})
+	}
+	sort.Slice(list.Reviews, func(i, j int) bool { return list.Reviews[i].QueuedAt.Before(list.Reviews[j].QueuedAt) })
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleDecideReview applies an operator's decision to a session awaiting
+// review. Approving, at the session's tier or downgraded to a lower one,
+// verifies the journey and offers the subject their credentials; denying
+// fails it and purges the session's personal data.
+func (s *Server) handleDecideReview(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req ReviewDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Reason == "" {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch req.Decision {
+	case ReviewApprove, ReviewDeny:
+		if req.QualityLevel != "" {
+			problem.Error(w, r, "quality_level is only given to downgrade", http.StatusBadRequest)
+			return
+		}
+	case ReviewDowngrade:
+		if qualityRanks[req.QualityLevel] == 0 {
+			problem.Error(w, r, "quality_level must be basic, standard, premium or gold", http.StatusBadRequest)
+			return
+		}
+	default:
+		problem.Error(w, r, "decision must be approve, deny or downgrade", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	sessionID := chi.URLParam(r, "id")
+	journey, err := s.journeys.store.FindBySession(ctx, sessionID)
+	if errors.Is(err, ErrJourneyNotFound) || (err == nil && !ownsJourney(ctx, journey)) {
+		problem.Error(w, r, "Issuance journey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find the issuance journey")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if journey.State != StateReviewPending {
+		problem.Error(w, r, "Identity session not awaiting review", http.StatusConflict)
+		return
+	}
+	session, held := s.verifiedSessions.Get(sessionID)
+	validation, _ := s.verifiedSessions.Validation(sessionID)
+	if !held {
+		problem.Error(w, r, "Identity session data no longer held", http.StatusConflict)
+		return
+	}
+	if req.Decision == ReviewDowngrade && qualityRanks[req.QualityLevel] >= qualityRanks[validation.QualityLevel] {
+		problem.Error(w, r, "quality_level must be below the session's "+validation.QualityLevel+" tier", http.StatusBadRequest)
+		return
+	}
+
+	resp := ReviewDecisionResponse{SessionID: sessionID, JourneyID: journey.ID, Decision: req.Decision}
+	now := time.Now()
+	if req.Decision == ReviewDeny {
+		if journey, err = s.decideJourney(w, r, journey, StateFailed, "denied on review: "+req.Reason); err != nil {
+			return
+		}
+		s.verifiedSessions.Purge(sessionID, PurgeReasonDenied, now)
+	} else {
+		validation.IsValid = true
+		validation.Reason = ""
+		validation.Reviewed = true
+		if req.Decision == ReviewDowngrade {
+			validation.QualityLevel = req.QualityLevel
+		}
+		// The retention period restarts, as it does for any verified session
+		s.verifiedSessions.Store(session, validation, now)
+		reason := "approved on review: " + req.Reason
+		if req.Decision == ReviewDowngrade {
+			reason = "downgraded to " + req.QualityLevel + " on review: " + req.Reason
+		}
+		if journey, err = s.decideJourney(w, r, journey, StateVerified, reason); err != nil {
+			return
+		}
+		// The subject left long ago: their credentials are issued when
+		// their wallet redeems the offer, before the session's deadline
+		offer, err := s.createOffer(ctx, sessionID, s.issuer(ctx).configurationIDs(), stateTimeouts[StateVerified])
+		if err != nil {
+			log.Error().Err(err).Str("journey_id", journey.ID).Msg("Failed to offer the reviewed session's credentials")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		resp.QualityLevel = validation.QualityLevel
+		resp.Offer = &offer
+	}
+	resp.State = journey.State
+
+	s.recordAudit(ctx, AuditEvent{
+		Type:        AuditReviewDecided,
+		Actor:       "operator",
+		SessionID:   sessionID,
+		JourneyID:   journey.ID,
+		QualityTier: resp.QualityLevel,
+		Outcome:     req.Decision,
+		Detail:      req.Reason,
+	})
+	s.security.Record(ctx, audit.Event{Type: audit.TypeAdminAction, Action: "session_review." + req.Decision, Actor: "operator", Target: sessionID, Detail: req.Reason})
+	log.Info().Str("session_id", sessionID).Str("journey_id", journey.ID).Str("decision", req.Decision).Msg("Borderline identity session reviewed")
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// decideJourney moves a reviewed journey on, answering the request itself
+// when it fails; a journey that timed out meanwhile is a conflict
+func (s *Server) decideJourney(w http.ResponseWriter, r *http.Request, journey IssuanceJourney, to IssuanceState, reason string) (IssuanceJourney, error) {
+	decided, err := s.journeys.Transition(r.Context(), journey.ID, to, reason, nil)
+	switch {
+	case errors.Is(err, ErrInvalidTransition):
+		problem.Error(w, r, "Identity session not awaiting review", http.StatusConflict)
+	case err != nil:
+		log.Error().Err(err).Str("journey_id", journey.ID).Msg("Failed to apply the review decision")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+	}
+	return decided, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// borderlineSession is approved by Veriff but too risky to verify unreviewed
+func borderlineSession(sessionID string) map[string]interface{} {
+	session := approvedSession(sessionID)
+	session["verification"].(map[string]interface{})["risk_score"] = 0.5
+	return session
+}
+
+func reviewedServer(t *testing.T, sessionID string) *Server {
+	t.Helper()
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	w := postJSON(t, server, "/webhooks/veriff", borderlineSession(sessionID), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return server
+}
+
+func decideReview(t *testing.T, server *Server, sessionID string, req ReviewDecisionRequest) (int, ReviewDecisionResponse) {
+	t.Helper()
+	w := postJSON(t, server, "/reviews/"+sessionID, req, operatorHeaders)
+	var resp ReviewDecisionResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w.Code, resp
+}
+
+func TestReview_QueuesBorderlineSessions(t *testing.T) {
+	server := reviewedServer(t, "borderline-session")
+	journey, err := server.journeys.store.FindBySession(context.Background(), "borderline-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateReviewPending, journey.State)
+	_, page := getAudit(t, server, "?type="+AuditWebhookReceived, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, "pending_review", page.Events[0].Outcome)
+
+	// Veriff's own referrals join the queue
+	referred := approvedSession("referred-session")
+	referred["status"] = "review"
+	require.Equal(t, http.StatusAccepted, postJSON(t, server, "/webhooks/veriff", referred, nil).Code)
+
+	w := operatorRequest(t, server, http.MethodGet, "/reviews", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "Alice")
+	assert.NotContains(t, w.Body.String(), "AB123456C")
+	var list ReviewList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Reviews, 2)
+	assert.Equal(t, "borderline-session", list.Reviews[0].SessionID)
+	assert.Equal(t, "High risk score detected", list.Reviews[0].Reason)
+	assert.Equal(t, 0.5, list.Reviews[0].RiskScore)
+	assert.Equal(t, "PASSPORT", list.Reviews[0].DocumentType)
+	assert.NotNil(t, list.Reviews[0].Deadline)
+	assert.Equal(t, "referred-session", list.Reviews[1].SessionID)
+	assert.Equal(t, "Veriff referred the session for review", list.Reviews[1].Reason)
+	assert.NotEqual(t, "none", list.Reviews[1].Validation.QualityLevel)
+
+	// A session awaiting review cannot be redeemed
+	token := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "test-wallet",
+		SessionID: "borderline-session",
+	}, nil)
+	assert.NotEqual(t, http.StatusOK, token.Code)
+}
+
+func TestReview_ApprovalOffersCredentials(t *testing.T) {
+	server := reviewedServer(t, "approved-on-review")
+	trail := securityTrail(t, server)
+	code, resp := decideReview(t, server, "approved-on-review", ReviewDecisionRequest{Decision: ReviewApprove, Reason: "risk explained by travel"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StateVerified, resp.State)
+	require.NotNil(t, resp.Offer)
+	assert.Equal(t, resp.Offer.CreatedAt.Add(stateTimeouts[StateVerified]), resp.Offer.ExpiresAt)
+
+	// The subject's wallet redeems the offer for their credential
+	parsed, err := url.Parse(resp.Offer.URI)
+	require.NoError(t, err)
+	var payload struct {
+		Grants map[string]struct {
+			PreAuthorizedCode string `json:"pre-authorized_code"`
+		} `json:"grants"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(parsed.Query().Get("credential_offer")), &payload))
+	w := postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType:         GrantTypePreAuthorizedCode,
+		ClientID:          "test-wallet",
+		PreAuthorizedCode: payload.Grants[GrantTypePreAuthorizedCode].PreAuthorizedCode,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var token TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+	w = postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + token.AccessToken})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	_, page := getAudit(t, server, "?type="+AuditReviewDecided, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, ReviewApprove, page.Events[0].Outcome)
+	assert.Equal(t, "risk explained by travel", page.Events[0].Detail)
+	security, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, security, 1)
+	assert.Equal(t, "session_review.approve", security[0].Action)
+
+	// The decision is final
+	code, _ = decideReview(t, server, "approved-on-review", ReviewDecisionRequest{Decision: ReviewDeny, Reason: "second thoughts"})
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestReview_Downgrade(t *testing.T) {
+	server := reviewedServer(t, "downgraded-session")
+	validation, ok := server.verifiedSessions.Validation("downgraded-session")
+	require.True(t, ok)
+	code, _ := decideReview(t, server, "downgraded-session", ReviewDecisionRequest{Decision: ReviewDowngrade, Reason: "worn document", QualityLevel: validation.QualityLevel})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp := decideReview(t, server, "downgraded-session", ReviewDecisionRequest{Decision: ReviewDowngrade, Reason: "worn document", QualityLevel: VerificationLevelBasic})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, VerificationLevelBasic, resp.QualityLevel)
+	assert.NotNil(t, resp.Offer)
+	validation, ok = server.verifiedSessions.Validation("downgraded-session")
+	require.True(t, ok)
+	assert.True(t, validation.IsValid)
+	assert.Equal(t, VerificationLevelBasic, validation.QualityLevel)
+}
+
+func TestReview_DenyPurgesSession(t *testing.T) {
+	server := reviewedServer(t, "denied-session")
+	code, resp := decideReview(t, server, "denied-session", ReviewDecisionRequest{Decision: ReviewDeny, Reason: "document mismatch"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StateFailed, resp.State)
+	assert.Nil(t, resp.Offer)
+
+	_, held := server.verifiedSessions.Get("denied-session")
+	assert.False(t, held)
+	profile, ok := server.verifiedSessions.Profile("denied-session")
+	require.True(t, ok)
+	assert.Equal(t, PurgeReasonDenied, profile.PurgeReason)
+	journey, err := server.journeys.store.FindBySession(context.Background(), "denied-session")
+	require.NoError(t, err)
+	assert.Equal(t, "denied on review: document mismatch", journey.FailureReason)
+}
+
+func TestReview_Refused(t *testing.T) {
+	server := reviewedServer(t, "refused-session")
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", approvedSession("verified-session"), nil).Code)
+
+	w := operatorRequest(t, server, http.MethodGet, "/reviews", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	tests := []struct {
+		name      string
+		sessionID string
+		req       ReviewDecisionRequest
+		status    int
+	}{
+		{"no reason", "refused-session", ReviewDecisionRequest{Decision: ReviewApprove}, http.StatusBadRequest},
+		{"unknown decision", "refused-session", ReviewDecisionRequest{Decision: "escalate", Reason: "r"}, http.StatusBadRequest},
+		{"downgrade without tier", "refused-session", ReviewDecisionRequest{Decision: ReviewDowngrade, Reason: "r"}, http.StatusBadRequest},
+		{"approve with tier", "refused-session", ReviewDecisionRequest{Decision: ReviewApprove, Reason: "r", QualityLevel: VerificationLevelBasic}, http.StatusBadRequest},
+		{"unknown session", "unknown-session", ReviewDecisionRequest{Decision: ReviewApprove, Reason: "r"}, http.StatusNotFound},
+		{"not awaiting review", "verified-session", ReviewDecisionRequest{Decision: ReviewApprove, Reason: "r"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := decideReview(t, server, tt.sessionID, tt.req)
+			assert.Equal(t, tt.status, code)
+		})
+	}
+}
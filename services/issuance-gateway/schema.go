@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+)
+
+// credentialSchemaType is the W3C credentialSchema type for JSON Schemas
+const credentialSchemaType = "JsonSchema"
+
+var ErrSchemaRegistryUnavailable = errors.New("credential schema registry unavailable")
+
+// CredentialSchemaRef points holders at the schema a credential subject
+// was validated against, so wallets can validate it after receipt
+type CredentialSchemaRef struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// SchemaViolation mirrors the registry's validation failures
+type SchemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// SubjectInvalidError means a credential subject the gateway built does not
+// match the registry's schema for its type
+type SubjectInvalidError struct {
+	Schema     string
+	Violations []SchemaViolation
+}
+
+func (e *SubjectInvalidError) Error() string {
+	reasons := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		reasons = append(reasons, violation.Path+": "+violation.Message)
+	}
+	return fmt.Sprintf("credential subject does not match %s: %s", e.Schema, strings.Join(reasons, "; "))
+}
+
+// SchemaValidator validates credential subjects with the registry's
+// POST /schemas/{type}/{version}/validate before they are signed
+type SchemaValidator struct {
+	registryURL string
+	client      *http.Client
+}
+
+func NewSchemaValidator(registryURL string) *SchemaValidator {
+	return &SchemaValidator{
+		registryURL: strings.TrimSuffix(registryURL, "/"),
+		client:      deadline.NewClient("registry"),
+	}
+}
+
+// SchemaRef is the credentialSchema entry for a configuration
+func (v *SchemaValidator) SchemaRef(config CredentialConfiguration) *CredentialSchemaRef {
+	return &CredentialSchemaRef{
+		ID:   v.registryURL + "/schemas/" + config.ID + "/" + config.SchemaVersion,
+		Type: credentialSchemaType,
+	}
+}
+
+// Validate returns a *SubjectInvalidError when the subject does not match,
+// or ErrSchemaRegistryUnavailable when the registry cannot tell
+func (v *SchemaValidator) Validate(ctx context.Context, config CredentialConfiguration, subject map[string]interface{}) error {
+	schemaURL := v.SchemaRef(config).ID
+	body, err := json.Marshal(subject)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, schemaURL+"/validate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: registry returned %d for %s", ErrSchemaRegistryUnavailable, resp.StatusCode, schemaURL)
+	}
+	var result struct {
+		Valid      bool              `json:"valid"`
+		Violations []SchemaViolation `json:"violations"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("%w: decoding validation result: %v", ErrSchemaRegistryUnavailable, err)
+	}
+	if !result.Valid {
+		return &SubjectInvalidError{Schema: config.ID + "/" + config.SchemaVersion, Violations: result.Violations}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSchemaRegistry answers POST /schemas/{type}/{version}/validate with a
+// fixed verdict and records what it was asked
+type fakeSchemaRegistry struct {
+	mu         sync.Mutex
+	paths      []string
+	subjects   []map[string]interface{}
+	violations []SchemaViolation
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var subject map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&subject); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	f.paths = append(f.paths, r.URL.Path)
+	f.subjects = append(f.subjects, subject)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"valid":      len(f.violations) == 0,
+		"violations": f.violations,
+	})
+}
+
+func issueAgeCredential(t *testing.T, server *Server, sessionID string) *httptest.ResponseRecorder {
+	t.Helper()
+	approveBoundSession(t, server, sessionID, nil)
+	tokenResp := issueSessionToken(t, server, sessionID, ScopeAgeCredential, nil)
+
+	return postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeAgeOver},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken})
+}
+
+func TestCredentialIssuance_ValidatesSubjectSchema(t *testing.T) {
+	registry := &fakeSchemaRegistry{}
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	server := NewServer()
+	server.schemas = NewSchemaValidator(ts.URL + "/")
+
+	w := issueAgeCredential(t, server, "schema-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	assert.Equal(t, &CredentialSchemaRef{
+		ID:   ts.URL + "/schemas/AgeOverCredential/1.0.0",
+		Type: "JsonSchema",
+	}, credResp.Credential.CredentialSchema)
+
+	require.Equal(t, []string{"/schemas/AgeOverCredential/1.0.0/validate"}, registry.paths)
+	assert.Equal(t, true, registry.subjects[0]["age_over_18"])
+}
+
+func TestCredentialIssuance_RefusesSubjectOutsideSchema(t *testing.T) {
+	registry := &fakeSchemaRegistry{violations: []SchemaViolation{{Path: "/verificationLevel", Message: "value must be one of basic, standard, premium, gold"}}}
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	server := NewServer()
+	server.schemas = NewSchemaValidator(ts.URL)
+
+	w := issueAgeCredential(t, server, "invalid-subject-session")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeServerError)
+	assert.NotContains(t, w.Body.String(), "age_over_18", "no credential is returned")
+
+	journey, err := server.journeys.store.FindBySession(context.Background(), "invalid-subject-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateFailed, journey.State)
+}
+
+func TestCredentialIssuance_SchemaRegistryUnavailable(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	server := NewServer()
+	server.schemas = NewSchemaValidator(down.URL)
+
+	w := issueAgeCredential(t, server, "registry-down-session")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	down.Close()
+}
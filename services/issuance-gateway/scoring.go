@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/rs/zerolog/log"
+)
+
+// Scoring strategies selectable with QUALITY_SCORING
+const (
+	ScoringConfidence = "confidence"
+	ScoringWeighted   = "weighted"
+	ScoringRules      = "rules"
+	ScoringModel      = "model"
+)
+
+// Session metrics scoring strategies can draw on
+const (
+	MetricOverallConfidence    = "overall_confidence"
+	MetricPersonConfidence     = "person_confidence"
+	MetricLiveness             = "liveness"
+	MetricDocumentAuthenticity = "document_authenticity"
+	MetricRiskInverse          = "risk_inverse"
+)
+
+// ScoreFactor explains one input's contribution to a quality score
+type ScoreFactor struct {
+	Name         string  `json:"name"`
+	Value        float64 `json:"value"`
+	Weight       float64 `json:"weight,omitempty"`
+	Contribution float64 `json:"contribution"`
+	Note         string  `json:"note,omitempty"`
+}
+
+// QualityScore is a strategy's overall score with its breakdown. An Overall
+// of zero means the session carried no usable metrics.
+type QualityScore struct {
+	Strategy string        `json:"strategy"`
+	Overall  float64       `json:"overall"`
+	Factors  []ScoreFactor `json:"factors"`
+}
+
+// ScoringEngine turns Veriff session metrics into an overall quality score
+type ScoringEngine interface {
+	Score(ctx context.Context, session VeriffSession) (QualityScore, error)
+}
+
+// sessionMetrics returns the metrics Veriff reported, skipping absent ones
+func sessionMetrics(session VeriffSession) map[string]float64 {
+	metrics := make(map[string]float64)
+	add := func(name string, v float64) {
+		if v > 0 {
+			metrics[name] = v
+		}
+	}
+	add(MetricOverallConfidence, session.Verification.OverallConfidence)
+	add(MetricPersonConfidence, session.Person.Confidence)
+	add(MetricLiveness, session.Verification.LivenessScore)
+	add(MetricDocumentAuthenticity, session.Document.Authenticity)
+	if _, ok := metrics[MetricOverallConfidence]; ok {
+		metrics[MetricRiskInverse] = 1 - session.Verification.RiskScore
+	}
+	return metrics
+}
+
+// ConfidenceEngine uses Veriff's own confidence, falling back to the person
+// confidence. It is the default and matches the gateway's original behavior.
+type ConfidenceEngine struct{}
+
+func (ConfidenceEngine) Score(_ context.Context, session VeriffSession) (QualityScore, error) {
+	score := QualityScore{Strategy: ScoringConfidence}
+	switch {
+	case session.Verification.OverallConfidence > 0:
+		score.Overall = session.Verification.OverallConfidence
+		score.Factors = []ScoreFactor{{Name: MetricOverallConfidence, Value: score.Overall, Weight: 1, Contribution: score.Overall}}
+	case session.Person.Confidence > 0:
+		score.Overall = session.Person.Confidence
+		score.Factors = []ScoreFactor{{
+			Name: MetricPersonConfidence, Value: score.Overall, Weight: 1, Contribution: score.Overall,
+			Note: "overall confidence not reported",
+		}}
+	}
+	return score, nil
+}
+
+// WeightedEngine averages the reported metrics, renormalizing the weights
+// over the metrics actually present
+type WeightedEngine struct {
+	Weights map[string]float64
+}
+
+var defaultScoringWeights = map[string]float64{
+	MetricOverallConfidence:    0.4,
+	MetricLiveness:             0.25,
+	MetricDocumentAuthenticity: 0.25,
+	MetricRiskInverse:          0.1,
+}
+
+func (e WeightedEngine) Score(_ context.Context, session VeriffSession) (QualityScore, error) {
+	metrics := sessionMetrics(session)
+	var total float64
+	for name, weight := range e.Weights {
+		if _, ok := metrics[name]; ok {
+			total += weight
+		}
+	}
+
+	score := QualityScore{Strategy: ScoringWeighted}
+	if total == 0 {
+		return score, nil
+	}
+	for _, name := range sortedKeys(e.Weights) {
+		value, ok := metrics[name]
+		if !ok {
+			continue
+		}
+		weight := e.Weights[name] / total
+		score.Factors = append(score.Factors, ScoreFactor{Name: name, Value: value, Weight: weight, Contribution: value * weight})
+		score.Overall += value * weight
+	}
+	return score, nil
+}
+
+// ScoreRule adjusts a score when a metric falls below a floor
+type ScoreRule struct {
+	Metric     string  `json:"metric"`
+	Below      float64 `json:"below"`
+	Adjustment float64 `json:"adjustment"`
+	Note       string  `json:"note"`
+}
+
+// RuleBasedEngine starts from Veriff's confidence and applies penalties or
+// bonuses for individual metrics
+type RuleBasedEngine struct {
+	Rules []ScoreRule
+}
+
+var defaultScoreRules = []ScoreRule{
+	{Metric: MetricLiveness, Below: 0.85, Adjustment: -0.05, Note: "weak liveness evidence"},
+	{Metric: MetricDocumentAuthenticity, Below: 0.90, Adjustment: -0.05, Note: "document authenticity below 0.90"},
+	{Metric: MetricRiskInverse, Below: 0.90, Adjustment: -0.10, Note: "elevated risk score"},
+}
+
+func (e RuleBasedEngine) Score(ctx context.Context, session VeriffSession) (QualityScore, error) {
+	score, err := ConfidenceEngine{}.Score(ctx, session)
+	if err != nil || score.Overall == 0 {
+		score.Strategy = ScoringRules
+		return score, err
+	}
+	score.Strategy = ScoringRules
+
+	metrics := sessionMetrics(session)
+	for _, rule := range e.Rules {
+		value, ok := metrics[rule.Metric]
+		if !ok || value >= rule.Below {
+			continue
+		}
+		score.Overall += rule.Adjustment
+		score.Factors = append(score.Factors, ScoreFactor{Name: rule.Metric, Value: value, Contribution: rule.Adjustment, Note: rule.Note})
+	}
+	score.Overall = clampScore(score.Overall)
+	return score, nil
+}
+
+// ModelEngine delegates scoring to an ML model served over HTTP. The model
+// receives the session metrics and must return a QualityScore document.
+type ModelEngine struct {
+	URL    string
+	Client *http.Client
+}
+
+func (e ModelEngine) Score(ctx context.Context, session VeriffSession) (QualityScore, error) {
+	body, err := json.Marshal(map[string]interface{}{"metrics": sessionMetrics(session)})
+	if err != nil {
+		return QualityScore{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return QualityScore{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return QualityScore{}, fmt.Errorf("calling scoring model: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return QualityScore{}, fmt.Errorf("scoring model returned %d", resp.StatusCode)
+	}
+
+	var score QualityScore
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&score); err != nil {
+		return QualityScore{}, fmt.Errorf("decoding scoring model response: %w", err)
+	}
+	if score.Overall < 0 || score.Overall > 1 {
+		return QualityScore{}, fmt.Errorf("scoring model returned out-of-range score %v", score.Overall)
+	}
+	score.Strategy = ScoringModel
+	return score, nil
+}
+
+// NewScoringEngine builds the named strategy
+func NewScoringEngine(strategy, modelURL string) (ScoringEngine, error) {
+	switch strategy {
+	case "", ScoringConfidence:
+		return ConfidenceEngine{}, nil
+	case ScoringWeighted:
+		return WeightedEngine{Weights: defaultScoringWeights}, nil
+	case ScoringRules:
+		return RuleBasedEngine{Rules: defaultScoreRules}, nil
+	case ScoringModel:
+		if modelURL == "" {
+			return nil, errors.New("model scoring requires QUALITY_MODEL_URL")
+		}
+		return ModelEngine{URL: modelURL, Client: deadline.NewClient("quality-model")}, nil
+	}
+	return nil, fmt.Errorf("unknown scoring strategy %q", strategy)
+}
+
+// scoreSession runs the configured engine, falling back to Veriff's own
+// confidence when the engine fails so an unavailable model never blocks issuance
+func (s *Server) scoreSession(ctx context.Context, session VeriffSession) QualityScore {
+	score, err := s.scoring.Score(ctx, session)
+	if err == nil {
+		return score
+	}
+	log.Warn().Err(err).Str("session_id", session.SessionID).Msg("Quality scoring failed, using Veriff confidence")
+	score, _ = ConfidenceEngine{}.Score(ctx, session)
+	return score
+}
+
+func clampScore(v float64) float64 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 1:
+		return 1
+	}
+	return v
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
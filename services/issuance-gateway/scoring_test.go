@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func confidenceScore(session VeriffSession) QualityScore {
+	score, _ := ConfidenceEngine{}.Score(context.Background(), session)
+	return score
+}
+
+func TestWeightedEngine_RenormalizesMissingMetrics(t *testing.T) {
+	var session VeriffSession
+	session.Verification.LivenessScore = 0.8
+	session.Document.Authenticity = 1.0
+
+	score, err := WeightedEngine{Weights: defaultScoringWeights}.Score(context.Background(), session)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.9, score.Overall, 1e-9)
+	require.Len(t, score.Factors, 2)
+	assert.InDelta(t, 0.5, score.Factors[0].Weight, 1e-9)
+}
+
+func TestRuleBasedEngine_ExplainsPenalties(t *testing.T) {
+	session := premiumSession()
+	session.Verification.RiskScore = 0.2
+
+	score, err := RuleBasedEngine{Rules: defaultScoreRules}.Score(context.Background(), session)
+	require.NoError(t, err)
+	// 0.92 confidence, minus 0.10 for risk; liveness and authenticity meet their floors
+	assert.InDelta(t, 0.82, score.Overall, 1e-9)
+	require.Len(t, score.Factors, 2)
+	assert.Equal(t, MetricRiskInverse, score.Factors[1].Name)
+	assert.Equal(t, "elevated risk score", score.Factors[1].Note)
+}
+
+func TestModelEngine_FallsBackWhenUnavailable(t *testing.T) {
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Metrics map[string]float64 `json:"metrics"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		_ = json.NewEncoder(w).Encode(QualityScore{
+			Overall: 0.5,
+			Factors: []ScoreFactor{{Name: "model", Value: req.Metrics[MetricLiveness], Contribution: 0.5}},
+		})
+	}))
+
+	engine, err := NewScoringEngine(ScoringModel, model.URL)
+	require.NoError(t, err)
+	server := NewServer()
+	server.scoring = engine
+
+	score := server.scoreSession(context.Background(), premiumSession())
+	assert.Equal(t, ScoringModel, score.Strategy)
+	assert.Equal(t, 0.5, score.Overall)
+	assert.Equal(t, 0.88, score.Factors[0].Value)
+
+	model.Close()
+	score = server.scoreSession(context.Background(), premiumSession())
+	assert.Equal(t, ScoringConfidence, score.Strategy)
+	assert.Equal(t, 0.92, score.Overall)
+}
+
+func TestScoring_BreakdownEmbeddedInCredential(t *testing.T) {
+	server := NewServer()
+	server.scoring = WeightedEngine{Weights: defaultScoringWeights}
+
+	approveBoundSession(t, server, "scored-session", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + issueSessionToken(t, server, "scored-session", "credential_issuance", nil).AccessToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var credResp struct {
+		Credential struct {
+			CredentialSubject struct {
+				VerificationMetrics struct {
+					ScoreBreakdown QualityScore `json:"scoreBreakdown"`
+				} `json:"verificationMetrics"`
+			} `json:"credentialSubject"`
+		} `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	breakdown := credResp.Credential.CredentialSubject.VerificationMetrics.ScoreBreakdown
+	assert.Equal(t, ScoringWeighted, breakdown.Strategy)
+	assert.Len(t, breakdown.Factors, 4)
+}
+
+func TestNewScoringEngine_RejectsUnknownStrategy(t *testing.T) {
+	_, err := NewScoringEngine("astrology", "")
+	assert.Error(t, err)
+	_, err = NewScoringEngine(ScoringModel, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// Screening lists a subject can be found on
+const (
+	ScreeningListSanctions = "sanctions"
+	ScreeningListPEP       = "pep"
+)
+
+var ErrScreeningUnavailable = errors.New("screening provider unavailable")
+
+// ScreeningConfig selects the sanctions and PEP screening provider that
+// monitors the subjects of issued credentials against list updates. Veriff
+// screens at issuance only without it.
+type ScreeningConfig struct {
+	URL      string        `env:"SCREENING_URL" doc:"Sanctions and PEP screening provider the subjects of issued credentials are enrolled with and periodically rescreened by; their credentials are suspended pending review on a hit"`
+	Token    string        `env:"SCREENING_TOKEN" secret:"true" doc:"Bearer token for SCREENING_URL"`
+	Interval time.Duration `env:"SCREENING_INTERVAL" default:"24h" doc:"How often subjects are rescreened against the provider's list updates"`
+}
+
+// Validate checks the provider URL is an http(s) URL and the interval is
+// positive
+func (c ScreeningConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("SCREENING_URL must be an http(s) URL")
+	}
+	if c.Interval <= 0 {
+		return errors.New("SCREENING_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// ScreeningSubject is what the provider screens a subject on; the gateway
+// keeps only the provider's reference to it
+type ScreeningSubject struct {
+	FullName    string `json:"fullName"`
+	DateOfBirth string `json:"dateOfBirth,omitempty"`
+	Nationality string `json:"nationality,omitempty"`
+}
+
+// ScreeningHit is a subject the provider found on a list since the last
+// rescreening
+type ScreeningHit struct {
+	Subject  string  `json:"subject"`
+	List     string  `json:"list"`
+	ListName string  `json:"listName,omitempty"`
+	Score    float64 `json:"score,omitempty"`
+}
+
+// screeningProvider enrolls subjects and rescreens them against list updates
+type screeningProvider interface {
+	Enroll(ctx context.Context, subject ScreeningSubject) (string, error)
+	Rescreen(ctx context.Context, subjects []string, since time.Time) ([]ScreeningHit, error)
+	Unenroll(ctx context.Context, subject string) error
+}
+
+// screeningEnrollment ties the provider's reference to a subject to the
+// identity session their credentials were issued from
+type screeningEnrollment struct {
+	Tenant     string
+	SessionID  string
+	JourneyID  string
+	Reference  string
+	EnrolledAt time.Time
+}
+
+// screeningStore holds the enrolled subjects (production should use a
+// durable database)
+type screeningStore struct {
+	mu          sync.Mutex
+	enrollments map[string]screeningEnrollment // by reference
+	sessions    map[string]string              // reference by session
+	screenedAt  time.Time
+}
+
+func newScreeningStore() *screeningStore {
+	return &screeningStore{
+		enrollments: make(map[string]screeningEnrollment),
+		sessions:    make(map[string]string),
+	}
+}
+
+// Enroll keeps a subject's enrollment, reporting false when the session
+// was already enrolled
+func (s *screeningStore) Enroll(enrollment screeningEnrollment) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, enrolled := s.sessions[enrollment.SessionID]; enrolled {
+		return false
+	}
+	s.enrollments[enrollment.Reference] = enrollment
+	s.sessions[enrollment.SessionID] = enrollment.Reference
+	return true
+}
+
+// Reference returns the provider's reference to the session's subject,
+// when enrolled
+func (s *screeningStore) Reference(sessionID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reference, enrolled := s.sessions[sessionID]
+	return reference, enrolled
+}
+
+// Forget drops a session's enrollment
+func (s *screeningStore) Forget(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.enrollments, s.sessions[sessionID])
+	delete(s.sessions, sessionID)
+}
+
+// Due returns the enrollments to rescreen and when they were last screened
+func (s *screeningStore) Due() ([]screeningEnrollment, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrollments := make([]screeningEnrollment, 0, len(s.enrollments))
+	for _, enrollment := range s.enrollments {
+		enrollments = append(enrollments, enrollment)
+	}
+	return enrollments, s.screenedAt
+}
+
+// Screened records a completed rescreening, so the next one covers the list
+// updates since
+func (s *screeningStore) Screened(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.screenedAt = at
+}
+
+// enrollForScreening enrolls the subject of a verified session with the
+// screening provider, before the session's personal data is purged.
+// Failures are logged, not fatal: the credential is issued regardless.
+func (s *Server) enrollForScreening(ctx context.Context, journey IssuanceJourney, session VeriffSession) {
+	if s.screening == nil {
+		return
+	}
+	if _, enrolled := s.screenings.Reference(session.SessionID); enrolled {
+		return
+	}
+	reference, err := s.screening.Enroll(ctx, ScreeningSubject{
+		FullName:    strings.TrimSpace(session.Person.FirstName + " " + session.Person.LastName),
+		DateOfBirth: session.Person.DateOfBirth,
+		Nationality: session.Document.Country,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("session_id", session.SessionID).Msg("Failed to enroll the subject for rescreening")
+		return
+	}
+	s.screenings.Enroll(screeningEnrollment{
+		Tenant:     tenant.FromContext(ctx).ID,
+		SessionID:  session.SessionID,
+		JourneyID:  journey.ID,
+		Reference:  reference,
+		EnrolledAt: time.Now().UTC(),
+	})
+}
+
+// rescreen has the provider rescreen every enrolled subject against the
+// list updates since the last run, and suspends the credentials of the
+// subjects found on a list pending an operator's review. It returns how
+// many credentials it suspended; a failed run is retried from the same
+// list updates.
+func (s *Server) rescreen(ctx context.Context, now time.Time) (int, error) {
+	enrollments, since := s.screenings.Due()
+	if len(enrollments) == 0 {
+		s.screenings.Screened(now)
+		return 0, nil
+	}
+	byReference := make(map[string]screeningEnrollment, len(enrollments))
+	references := make([]string, 0, len(enrollments))
+	for _, enrollment := range enrollments {
+		byReference[enrollment.Reference] = enrollment
+		references = append(references, enrollment.Reference)
+	}
+	hits, err := s.screening.Rescreen(ctx, references, since)
+	if err != nil {
+		return 0, err
+	}
+
+	suspended := 0
+	for _, hit := range hits {
+		enrollment, ok := byReference[hit.Subject]
+		if !ok {
+			log.Warn().Str("subject", hit.Subject).Msg("Screening hit for a subject that is not enrolled")
+			continue
+		}
+		tenantCtx := tenant.NewContext(ctx, tenant.Tenant{ID: enrollment.Tenant})
+		reason := "screening hit on the " + hit.List + " list"
+		if hit.ListName != "" {
+			reason += " " + hit.ListName
+		}
+		s.recordAudit(tenantCtx, AuditEvent{
+			Type:      AuditScreeningHit,
+			Actor:     "screening",
+			SessionID: enrollment.SessionID,
+			JourneyID: enrollment.JourneyID,
+			Outcome:   "pending_review",
+			Detail:    reason,
+		})
+		credentials, err := s.issuedCredentials(tenantCtx, enrollment.SessionID)
+		if err != nil {
+			return suspended, fmt.Errorf("finding the credentials of session %s: %w", enrollment.SessionID, err)
+		}
+		for _, credential := range credentials {
+			status, err := s.statusList.Status(tenantCtx, credential.StatusListIndex)
+			if err != nil {
+				return suspended, fmt.Errorf("reading the status of credential %s: %w", credential.CredentialID, err)
+			}
+			if status == CredentialStatusRevoked {
+				continue
+			}
+			changed, err := s.suspendCredential(tenantCtx, credential, "screening", reason)
+			if err != nil {
+				return suspended, fmt.Errorf("suspending credential %s: %w", credential.CredentialID, err)
+			}
+			if changed {
+				suspended++
+			}
+		}
+		log.Warn().
+			Str("session_id", enrollment.SessionID).
+			Str("list", hit.List).
+			Msg("Subject found on a screening list, credentials suspended pending review")
+	}
+	s.screenings.Screened(now)
+	return suspended, nil
+}
+
+// rescreenSubjects rescreens the enrolled subjects every interval
+func (s *Server) rescreenSubjects(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		suspended, err := s.rescreen(ctx, time.Now().UTC())
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to rescreen subjects")
+			continue
+		}
+		if suspended > 0 {
+			log.Info().Int("suspended", suspended).Msg("Suspended credentials of rescreened subjects")
+		}
+	}
+}
+
+// screeningClient calls the screening provider's API
+type screeningClient struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func newScreeningClient(providerURL, token string) *screeningClient {
+	return &screeningClient{client: deadline.NewClient("screening"), url: strings.TrimSuffix(providerURL, "/"), token: token}
+}
+
+// Enroll has the provider monitor a subject, returning its reference
+func (c *screeningClient) Enroll(ctx context.Context, subject ScreeningSubject) (string, error) {
+	var enrolled struct {
+		ID string `json:"id"`
+	}
+	if err := c.post(ctx, "/subjects", subject, &enrolled); err != nil {
+		return "", err
+	}
+	if enrolled.ID == "" {
+		return "", fmt.Errorf("%w: no subject reference returned", ErrScreeningUnavailable)
+	}
+	return enrolled.ID, nil
+}
+
+// Rescreen returns the subjects found on a list updated since the time
+// given; a zero since rescreens against the lists in full
+func (c *screeningClient) Rescreen(ctx context.Context, subjects []string, since time.Time) ([]ScreeningHit, error) {
+	body := struct {
+		Subjects []string   `json:"subjects"`
+		Since    *time.Time `json:"since,omitempty"`
+	}{Subjects: subjects}
+	if !since.IsZero() {
+		body.Since = &since
+	}
+	var result struct {
+		Hits []ScreeningHit `json:"hits"`
+	}
+	if err := c.post(ctx, "/rescreen", body, &result); err != nil {
+		return nil, err
+	}
+	return result.Hits, nil
+}
+
+// Unenroll stops the provider monitoring a subject
+func (c *screeningClient) Unenroll(ctx context.Context, subject string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.url+"/subjects/"+url.PathEscape(subject), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrScreeningUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%w: returned %d", ErrScreeningUnavailable, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *screeningClient) post(ctx context.Context, path string, body, result interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrScreeningUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%w: %s returned %d", ErrScreeningUnavailable, path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result); err != nil {
+		return fmt.Errorf("%w: decoding %s: %v", ErrScreeningUnavailable, path, err)
+	}
+	return nil
+}
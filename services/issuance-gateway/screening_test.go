@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeScreeningProvider enrolls every subject as subject-N and reports the
+// hits it is given on the next rescreening
+type fakeScreeningProvider struct {
+	mu         sync.Mutex
+	enrolled   []ScreeningSubject
+	unenrolled []string
+	since      []string
+	hits       []ScreeningHit
+	down       bool
+}
+
+func (p *fakeScreeningProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer screening-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if p.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/subjects":
+		var subject ScreeningSubject
+		_ = json.NewDecoder(r.Body).Decode(&subject)
+		p.enrolled = append(p.enrolled, subject)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": fmt.Sprintf("subject-%d", len(p.enrolled))})
+	case r.Method == http.MethodPost && r.URL.Path == "/rescreen":
+		var body struct {
+			Since string `json:"since"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		p.since = append(p.since, body.Since)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"hits": p.hits})
+		p.hits = nil
+	case r.Method == http.MethodDelete:
+		p.unenrolled = append(p.unenrolled, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func screenedServer(t *testing.T) (*Server, *fakeScreeningProvider) {
+	t.Helper()
+	provider := &fakeScreeningProvider{}
+	host := httptest.NewServer(provider)
+	t.Cleanup(host.Close)
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	server.screening = newScreeningClient(host.URL, "screening-token")
+	return server, provider
+}
+
+func TestRescreening_SuspendsCredentialsOnHit(t *testing.T) {
+	server, provider := screenedServer(t)
+	trail := securityTrail(t, server)
+	w := issueAgeCredential(t, server, "screened-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	index := credResp.Credential.statusListIndex()
+
+	// The subject is enrolled before the session's personal data is purged
+	require.Len(t, provider.enrolled, 1)
+	assert.Equal(t, ScreeningSubject{FullName: "Alice Johnson", DateOfBirth: "1992-03-10", Nationality: "GB"}, provider.enrolled[0])
+
+	ctx := context.Background()
+	first := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	suspended, err := server.rescreen(ctx, first)
+	require.NoError(t, err)
+	assert.Zero(t, suspended)
+	assert.NotEqual(t, CredentialStatusSuspended, credentialStatus(t, server, index))
+
+	// A list update naming the subject suspends their credential
+	provider.hits = []ScreeningHit{{Subject: "subject-1", List: ScreeningListSanctions, ListName: "OFAC SDN"}}
+	suspended, err = server.rescreen(ctx, first.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, suspended)
+	assert.Equal(t, CredentialStatusSuspended, credentialStatus(t, server, index))
+	assert.Equal(t, []string{"", first.Format(time.RFC3339)}, provider.since)
+
+	_, page := getAudit(t, server, "?type="+AuditScreeningHit, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, "screened-session", page.Events[0].SessionID)
+	assert.Equal(t, "pending_review", page.Events[0].Outcome)
+	_, page = getAudit(t, server, "?type="+AuditCredentialSuspended, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, "screening", page.Events[0].Actor)
+	assert.Equal(t, "screening hit on the sanctions list OFAC SDN", page.Events[0].Detail)
+	security, err := trail.Events(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, security, 1)
+	assert.Equal(t, "credential.suspended", security[0].Action)
+
+	// An operator clears the hit by reinstating the credential
+	w = postJSON(t, server, "/credentials/"+credResp.Credential.ID+"/reinstate", nil, operatorHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotEqual(t, CredentialStatusSuspended, credentialStatus(t, server, index))
+}
+
+func TestRescreening_RetriesFailedRun(t *testing.T) {
+	server, provider := screenedServer(t)
+	require.Equal(t, http.StatusOK, issueAgeCredential(t, server, "retried-session").Code)
+	ctx := context.Background()
+	first := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	_, err := server.rescreen(ctx, first)
+	require.NoError(t, err)
+
+	provider.down = true
+	_, err = server.rescreen(ctx, first.Add(24*time.Hour))
+	assert.ErrorIs(t, err, ErrScreeningUnavailable)
+
+	// The next run covers the list updates the failed one missed
+	provider.down = false
+	_, err = server.rescreen(ctx, first.Add(48*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", first.Format(time.RFC3339)}, provider.since)
+}
+
+func TestSubjectErasure_UnenrollsFromScreening(t *testing.T) {
+	server, provider := screenedServer(t)
+	require.Equal(t, http.StatusOK, issueAgeCredential(t, server, "unenrolled-session").Code)
+
+	provider.down = true
+	w := operatorRequest(t, server, http.MethodDelete, "/subjects/unenrolled-session", "operator-secret")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, w.Body.String())
+
+	provider.down = false
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/unenrolled-session", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var erasure SubjectErasureResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.True(t, erasure.Receipt.ScreeningUnenrolled)
+	assert.Equal(t, []string{"/subjects/subject-1"}, provider.unenrolled)
+	_, enrolled := server.screenings.Reference("unenrolled-session")
+	assert.False(t, enrolled)
+}
+
+func TestScreeningConfig_Validate(t *testing.T) {
+	assert.NoError(t, ScreeningConfig{}.Validate())
+	assert.NoError(t, ScreeningConfig{URL: "https://screening.example", Interval: time.Hour}.Validate())
+	assert.Error(t, ScreeningConfig{URL: "screening.example", Interval: time.Hour}.Validate())
+	assert.Error(t, ScreeningConfig{URL: "https://screening.example"}.Validate())
+}
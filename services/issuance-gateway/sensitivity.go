@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ClaimSensitivity classifies a credential claim, deciding how it is
+// released to the holder
+type ClaimSensitivity string
+
+const (
+	// SensitivityPublic claims are always plain in the credential
+	SensitivityPublic ClaimSensitivity = "public"
+	// SensitivitySensitive claims are selectively disclosable: the
+	// credential carries their digest, the holder chooses whom to show them
+	SensitivitySensitive ClaimSensitivity = "sensitive"
+	// SensitivityHighlySensitive claims never enter the credential; they
+	// are released into the wallet's device vault only
+	SensitivityHighlySensitive ClaimSensitivity = "highly_sensitive"
+)
+
+// sdAlgorithm is the hash of the selective disclosure digests
+const sdAlgorithm = "sha-256"
+
+// sensitivity is the classification of a claim; unclassified claims are
+// treated as sensitive so they are never shown without the holder's consent
+func (c CredentialConfiguration) sensitivity(claim string) ClaimSensitivity {
+	if class, ok := c.ClaimSensitivity[claim]; ok {
+		return class
+	}
+	return SensitivitySensitive
+}
+
+// disclosedSubject is a credential subject split by claim sensitivity
+type disclosedSubject struct {
+	// Subject keeps the public claims and the digests of the sensitive ones
+	Subject map[string]interface{}
+	// Disclosures reveal the sensitive claims, at the holder's choice
+	Disclosures []string
+	// Vault holds the highly sensitive claims for the wallet's device vault
+	Vault map[string]interface{}
+}
+
+// discloseSubject applies the configuration's claim classification to a
+// subject. The subject id is always plain.
+func (c CredentialConfiguration) discloseSubject(subject map[string]interface{}) (disclosedSubject, error) {
+	disclosed := disclosedSubject{Subject: make(map[string]interface{})}
+	var digests []string
+	for name, value := range subject {
+		class := c.sensitivity(name)
+		if name == "id" {
+			class = SensitivityPublic
+		}
+		switch class {
+		case SensitivityPublic:
+			disclosed.Subject[name] = value
+		case SensitivityHighlySensitive:
+			if disclosed.Vault == nil {
+				disclosed.Vault = make(map[string]interface{})
+			}
+			disclosed.Vault[name] = value
+		default:
+			encoded, digest, err := sdDisclosure(name, value)
+			if err != nil {
+				return disclosedSubject{}, fmt.Errorf("disclosing %s: %w", name, err)
+			}
+			disclosed.Disclosures = append(disclosed.Disclosures, encoded)
+			digests = append(digests, digest)
+		}
+	}
+	if len(digests) > 0 {
+		// Sorted, so the digests do not reveal the claims' order
+		sort.Strings(digests)
+		disclosed.Subject["_sd"] = digests
+	}
+	return disclosed, nil
+}
+
+// sdDisclosure encodes an object claim disclosure and its digest
+func sdDisclosure(name string, value interface{}) (encoded, digest string, err error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", err
+	}
+	raw, err := json.Marshal([]interface{}{base64.RawURLEncoding.EncodeToString(salt), name, value})
+	if err != nil {
+		return "", "", err
+	}
+	encoded = base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(encoded))
+	return encoded, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
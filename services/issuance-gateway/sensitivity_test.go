@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// disclose returns the claims the disclosures reveal, checking the
+// subject's _sd array holds each one's digest
+func disclose(t *testing.T, subject map[string]interface{}, disclosures []string) map[string]interface{} {
+	t.Helper()
+	digests := map[string]bool{}
+	sd, _ := subject["_sd"].([]interface{})
+	for _, digest := range sd {
+		digests[digest.(string)] = true
+	}
+	claims := map[string]interface{}{}
+	for _, encoded := range disclosures {
+		sum := sha256.Sum256([]byte(encoded))
+		require.True(t, digests[base64.RawURLEncoding.EncodeToString(sum[:])], "disclosure digest not in _sd")
+		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		require.NoError(t, err)
+		var disclosure []interface{}
+		require.NoError(t, json.Unmarshal(raw, &disclosure))
+		require.Len(t, disclosure, 3)
+		claims[disclosure[1].(string)] = disclosure[2]
+	}
+	return claims
+}
+
+func TestCredentialIssuance_ClaimSensitivity(t *testing.T) {
+	server := NewServer()
+	approveBoundSession(t, server, "sensitivity-session", nil)
+	w := postJSON(t, server, "/credential", CredentialRequest{
+		Format: "jwt_vc",
+		Types:  []string{"VerifiableCredential", CredentialTypeIdentity},
+		Proof:  walletProof(t),
+	}, map[string]string{"Authorization": "Bearer " + issueSessionToken(t, server, "sensitivity-session", "credential_issuance", nil).AccessToken})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Credential struct {
+			SDAlg             string                 `json:"_sd_alg"`
+			CredentialSubject map[string]interface{} `json:"credentialSubject"`
+		} `json:"credential"`
+		Disclosures []string               `json:"disclosures"`
+		VaultClaims map[string]interface{} `json:"vault_claims"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	subject := resp.Credential.CredentialSubject
+
+	// Public claims are plain
+	assert.Equal(t, true, subject["verified"])
+	assert.Contains(t, subject, "verificationMetrics")
+
+	// Sensitive claims are only disclosed by the holder
+	assert.NotContains(t, subject, "personalData")
+	assert.Equal(t, sdAlgorithm, resp.Credential.SDAlg)
+	disclosed := disclose(t, subject, resp.Disclosures)
+	assert.Contains(t, disclosed, "personalData")
+
+	// Highly sensitive claims go to the wallet's vault, not the credential
+	assert.NotContains(t, subject, "evidence")
+	assert.NotContains(t, disclosed, "evidence")
+	assert.Contains(t, resp.VaultClaims, "evidence")
+}
+
+func TestCredentialConfigurations_ClassifyClaims(t *testing.T) {
+	for _, config := range credentialConfigurations {
+		for _, claim := range config.Claims {
+			assert.Contains(t, config.ClaimSensitivity, claim, "%s claim %s is not classified", config.ID, claim)
+		}
+	}
+
+	// Unclassified claims are not shown without the holder's consent
+	config := CredentialConfiguration{ClaimSensitivity: map[string]ClaimSensitivity{"plain": SensitivityPublic}}
+	disclosed, err := config.discloseSubject(map[string]interface{}{"id": "did:example:holder", "plain": 1, "unclassified": 2})
+	require.NoError(t, err)
+	assert.Equal(t, "did:example:holder", disclosed.Subject["id"])
+	assert.Equal(t, 1, disclosed.Subject["plain"])
+	assert.NotContains(t, disclosed.Subject, "unclassified")
+	assert.Len(t, disclosed.Disclosures, 1)
+	assert.Empty(t, disclosed.Vault)
+}
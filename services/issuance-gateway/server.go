@@ -1,14 +1,31 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/golang-jwt/jwt/v5"
@@ -18,27 +35,43 @@ import (
 
 // OpenID4VCI data structures
 type TokenRequest struct {
-	GrantType string `json:"grant_type"`
-	ClientID  string `json:"client_id"`
-	Scope     string `json:"scope"`
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	Scope        string `json:"scope"`
+	SessionID    string `json:"session_id,omitempty"` // Binds the token to a verified Veriff session
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// PreAuthorizedCode redeems a credential offer, standing for its
+	// verified session and credentials
+	PreAuthorizedCode string `json:"pre-authorized_code,omitempty"`
 }
 
 type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
-	Scope       string `json:"scope"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
 }
 
 type CredentialRequest struct {
-	Format string                 `json:"format"`
-	Types  []string               `json:"types"`
-	Proof  map[string]interface{} `json:"proof,omitempty"`
+	Format string   `json:"format,omitempty"`
+	Types  []string `json:"types"`
+	// Proof proves possession of the wallet key the credential is bound to
+	Proof *CredentialProof `json:"proof,omitempty"`
+	// VouchID names the vouch to deliver, for VouchCredential
+	VouchID string `json:"vouch_id,omitempty"`
 }
 
 type CredentialResponse struct {
 	Credential interface{} `json:"credential"`
 	Format     string      `json:"format"`
+	// NotificationID is what the wallet reports on the credential with
+	NotificationID string `json:"notification_id,omitempty"`
+	// Disclosures reveal the credential's selectively disclosable claims
+	Disclosures []string `json:"disclosures,omitempty"`
+	// VaultClaims are the highly sensitive claims, for the wallet's device
+	// vault only: they are not part of the credential
+	VaultClaims map[string]interface{} `json:"vault_claims,omitempty"`
 }
 
 // Veriff webhook data structures
@@ -63,6 +96,17 @@ type VeriffSession struct {
 		RiskScore         float64 `json:"risk_score,omitempty"`
 		Timestamp         string  `json:"timestamp,omitempty"`
 	} `json:"verification,omitempty"`
+	Media        []VeriffMedia `json:"media,omitempty"`         // Document images and selfie frames
+	FaceTemplate string        `json:"face_template,omitempty"` // Biometric template from the selfie
+	Technical    struct {
+		IP                string `json:"ip,omitempty"`
+		DeviceFingerprint string `json:"deviceFingerprint,omitempty"`
+	} `json:"technicalData,omitempty"`
+}
+
+type VeriffMedia struct {
+	Context string `json:"context"` // e.g. document-front, face
+	URL     string `json:"url"`
 }
 
 // Verifiable Credential structures (simplified SD-JWT VC)
@@ -74,20 +118,44 @@ type VerifiableCredential struct {
 	IssuanceDate      string                 `json:"issuanceDate"`
 	ExpirationDate    string                 `json:"expirationDate,omitempty"`
 	CredentialSubject map[string]interface{} `json:"credentialSubject"`
-	CredentialStatus  *CredentialStatus      `json:"credentialStatus,omitempty"`
+	// CredentialStatus holds the credential's revocation and suspension entries
+	CredentialStatus []CredentialStatus   `json:"credentialStatus,omitempty"`
+	CredentialSchema *CredentialSchemaRef `json:"credentialSchema,omitempty"`
+	// Evidence proves when the credential existed, when it is timestamped
+	Evidence []TimestampEvidence `json:"evidence,omitempty"`
+	// Cnf binds the credential to the holder's wallet key
+	Cnf *Confirmation `json:"cnf,omitempty"`
+	// SDAlg is the hash of the subject's selective disclosure digests
+	SDAlg string `json:"_sd_alg,omitempty"`
+	// Proof is the BBS data integrity proof of an ldp_vc credential
+	Proof *bbs.Proof `json:"proof,omitempty"`
+}
+
+// statusListIndex is the credential's index in the status lists
+func (vc VerifiableCredential) statusListIndex() string {
+	if len(vc.CredentialStatus) == 0 {
+		return ""
+	}
+	return vc.CredentialStatus[0].StatusListIndex
 }
 
 type CredentialStatus struct {
-	ID   string `json:"id"`
-	Type string `json:"type"`
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	StatusPurpose        string `json:"statusPurpose,omitempty"`
+	StatusListIndex      string `json:"statusListIndex,omitempty"`
+	StatusListCredential string `json:"statusListCredential,omitempty"`
 }
 
 // Quality validation structures
 type ValidationResult struct {
-	IsValid      bool    `json:"is_valid"`
-	Reason       string  `json:"reason,omitempty"`
-	QualityLevel string  `json:"quality_level"`
-	Confidence   float64 `json:"confidence"`
+	IsValid        bool          `json:"is_valid"`
+	Reason         string        `json:"reason,omitempty"`
+	QualityLevel   string        `json:"quality_level"`
+	Confidence     float64       `json:"confidence"`
+	QualityVersion string        `json:"quality_version,omitempty"` // Threshold set the tier was assigned under
+	Score          *QualityScore `json:"score,omitempty"`
+	Reviewed       bool          `json:"reviewed,omitempty"` // Decided by an operator, on review
 }
 
 // Verification level enumeration
@@ -101,14 +169,63 @@ const (
 type Server struct {
 	router           *chi.Mux
 	signingKey       *rsa.PrivateKey
-	accessTokens     map[string]TokenInfo     // In-memory token store (production should use Redis)
-	verifiedSessions map[string]VeriffSession // Store for verified Veriff sessions
+	bbsKey           *bbs.PrivateKey // signs ldp_vc credentials
+	accessTokens     *accessTokenStore
+	verifiedSessions *sessionVault // Store for verified Veriff sessions
+	journeys         *IssuanceStateMachine
+	dpopReplay       *replayCache
+	attestation      *AttestationVerifier // nil when wallet attestation is not required
+	schemas          *SchemaValidator     // nil skips credential subject validation
+	refreshTokens    *refreshTokenStore
+	offers           *credentialOfferStore
+	notifications    *notificationStore
+	issued           *issuedCredentialStore
+	renewal          RenewalConfig
+	drift            *scoreDrift           // compares Veriff score distributions week over week
+	timestamps       credentialTimestamper // nil issues credentials without a timestamp
+	screening        screeningProvider     // nil leaves screening to Veriff at issuance
+	screenings       *screeningStore
+	// screeningInterval is how often the enrolled subjects are rescreened
+	screeningInterval time.Duration
+	idempotency       *idempotencyCache
+	statusList        *statusListAllocator
+	auditLog          AuditStore
+	// security keeps the tamper-evident trail of auth failures and
+	// operator actions; nil records nothing
+	security      *audit.Logger
+	operatorToken string // Bearer token for operator APIs (audit, dead letters, subjects); empty disables them
+	webhookQueue  *webhookQueue
+	quality       QualityThresholds
+	scoring       ScoringEngine
+	vouching      *vouchingClient    // nil unless VOUCHING_SERVICE_URL is set
+	receipts      *receiptsLogClient // nil unless RECEIPTS_LOG_URL is set
+	health        *health.Monitor    // checks Postgres and the registry and vouching-service when they are configured
+	metrics       *gatewayMetrics
+	// Resource servers allowed to call /oauth/introspect, keyed by client id
+	introspectionClients map[string]string
+	// cors lets the configured origins call the API from browsers
+	cors cors.Policy
+	// versions serves the API under /v1 and its legacy unversioned aliases
+	versions apiversion.Policy
+	// rateLimit limits each client's calls to the public routes
+	rateLimit ratelimit.Limiter
+	// openapi refuses requests that do not match the API document
+	openapi *openapi.Validator
+	// events announces issued credentials to the other services; nil when
+	// no event bus is configured
+	events events.Bus
+	// tenants resolves requests to the brands the gateway issues for;
+	// issuers holds each one's DID, signing key and credential
+	// configurations, the default tenant using the gateway's own
+	tenants tenant.Directory
+	issuers map[string]*tenantIssuer
 }
 
 type TokenInfo struct {
 	ClientID  string
 	Scope     string
 	ExpiresAt time.Time
+	JKT       string // DPoP key thumbprint the token is bound to
 }
 
 func NewServer() *Server {
@@ -117,330 +234,723 @@ func NewServer() *Server {
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to generate RSA key")
 	}
+	bbsKey, err := bbs.GenerateKey(nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate BBS key")
+	}
 
 	s := &Server{
 		router:           chi.NewRouter(),
 		signingKey:       signingKey,
-		accessTokens:     make(map[string]TokenInfo),
-		verifiedSessions: make(map[string]VeriffSession),
+		bbsKey:           bbsKey,
+		accessTokens:     newAccessTokenStore(),
+		verifiedSessions: newSessionVault(),
+		journeys:         NewIssuanceStateMachine(newMemoryJourneyStore()),
+		dpopReplay:       newReplayCache(dpopProofLifetime + dpopClockSkew),
+		refreshTokens:    newRefreshTokenStore(),
+		offers:           newCredentialOfferStore(),
+		notifications:    newNotificationStore(),
+		issued:           newIssuedCredentialStore(),
+		screenings:       newScreeningStore(),
+		renewal:          defaultRenewalConfig(),
+		drift:            newScoreDrift(defaultDriftConfig()),
+		idempotency:      newIdempotencyCache(idempotencyTTL),
+		statusList:       newStatusListAllocator(defaultStatusListURL, newMemoryStatusListStore()),
+		auditLog:         newMemoryAuditStore(),
+		webhookQueue:     newWebhookQueue(),
+		quality:          DefaultQualityThresholds(),
+		scoring:          ConfidenceEngine{},
+		health:           health.New("issuance-gateway"),
+		metrics:          newGatewayMetrics(),
 	}
 
+	if s.openapi, err = openapi.New(openapiDocument); err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
+	}
+	s.openapi.Refuse = refuseOAuth
 	s.setupMiddleware()
 	s.setupRoutes()
 	return s
 }
 
 func (s *Server) setupMiddleware() {
+	s.router.Use(tracing.Middleware("issuance-gateway"))
+	s.router.Use(s.metrics.Middleware)
 	s.router.Use(middleware.RequestID)
+	s.router.Use(ratelimit.Peer)
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
+	s.router.Use(recordRequestPath)
+	s.router.Use(s.tenants.Middleware)
+	s.router.Use(s.cors.Middleware)
+	s.router.Use(s.versions.Middleware)
+	s.router.Use(s.openapi.Middleware)
+	s.router.Use(deadline.Middleware(deadline.BudgetFromEnv()))
 }
 
 func (s *Server) setupRoutes() {
+	s.router.NotFound(problem.NotFound)
+	s.router.MethodNotAllowed(problem.MethodNotAllowed)
 	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	s.router.Get("/health", s.handleHealth)
-
-	// OpenID4VCI endpoints
-	s.router.Post("/oauth/token", s.handleOAuthToken)
-	s.router.Post("/credential", s.handleCredentialIssuance)
+	s.router.Get("/health", s.health.Health)
+	s.router.Get("/livez", s.health.Live)
+	s.router.Get("/readyz", s.health.Ready)
+	s.router.Handle("/debug/vars", expvar.Handler())
+	s.router.Handle("/metrics", s.metrics.Handler())
+
+	// Public routes, limited per client; status lists stay at the URL
+	// credentials name them by
+	s.versions.Unversioned("/status/*", "/status/*/suspension")
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.rateLimit.Middleware)
+		r.Get("/.well-known/openid-credential-issuer", s.handleIssuerMetadata)
+		r.Get("/.well-known/jwks.json", s.handleJWKS)
+		r.Get("/.well-known/did.json", s.handleDIDDocument)
+		r.Get("/status/{list}", s.handleRevocationList)
+		r.Get("/status/{list}/suspension", s.handleSuspensionList)
+
+		// OpenID4VCI endpoints
+		r.Post("/oauth/token", s.handleOAuthToken)
+		r.Post("/oauth/introspect", s.handleIntrospect)
+		r.Post("/credential", s.handleCredentialIssuance)
+		r.Post("/credential/renew", s.handleRenewCredential)
+		r.Get("/credential/reminders", s.handleListRenewalReminders)
+		r.Post("/notification", s.handleNotification)
+	})
 
-	// Veriff webhook
+	// Veriff webhook, unversioned at the URL configured in Veriff
+	s.versions.Unversioned("/webhooks/veriff")
 	s.router.Post("/webhooks/veriff", s.handleVeriffWebhook)
+	s.router.Get("/webhooks/dead-letters", s.handleListDeadLetters)
+	s.router.Post("/webhooks/dead-letters/{id}/retry", s.handleRetryDeadLetter)
+
+	// Issuance journey state, for operators
+	s.router.Post("/issuance/journeys", s.handleCreateJourney)
+	s.router.Get("/issuance/journeys", s.handleListJourneys)
+	s.router.Get("/issuance/journeys/{id}", s.handleGetJourney)
+
+	// Compliance audit trail
+	s.router.Get("/audit/events", s.handleListAuditEvents)
+
+	// Data subjects' erasure and export, on their request
+	s.router.Delete("/subjects/{id}", s.handleEraseSubject)
+	s.router.Get("/subjects/{id}/export", s.handleExportSubject)
+
+	// Operator review of borderline identity sessions
+	s.router.Get("/reviews", s.handleListReviews)
+	s.router.Post("/reviews/{id}", s.handleDecideReview)
+
+	// Credential offers for kiosks and onboarding pages to display
+	s.router.Post("/credential-offers", s.handleCreateOffer)
+	s.router.Get("/credential-offers/{id}/qr", s.handleGetOfferQR)
+
+	// Holds on issued credentials, such as during a fraud investigation
+	s.router.Post("/credentials/{id}/suspend", s.handleSuspendCredential)
+	s.router.Post("/credentials/{id}/reinstate", s.handleReinstateCredential)
 }
 
-// validateVeriffSession performs quality validation on Veriff session data
-func validateVeriffSession(session VeriffSession) ValidationResult {
+// validateVeriffSession performs quality validation on Veriff session data,
+// mapping the session's quality score onto the configured tier thresholds
+func validateVeriffSession(session VeriffSession, thresholds QualityThresholds, score QualityScore) ValidationResult {
 	// Default to basic validation
 	if session.Status != "approved" {
 		return ValidationResult{
-			IsValid:      false,
-			Reason:       "Veriff session not approved",
-			QualityLevel: "none",
-			Confidence:   0.0,
+			IsValid:        false,
+			Reason:         "Veriff session not approved",
+			QualityLevel:   "none",
+			Confidence:     0.0,
+			QualityVersion: thresholds.QualityVersion,
 		}
 	}
 
-	// Calculate overall confidence and quality level
-	confidence := session.Verification.OverallConfidence
-	if confidence == 0.0 && session.Person.Confidence > 0 {
-		// Fallback to person confidence if overall not available
-		confidence = session.Person.Confidence
-	}
+	// Overall confidence comes from the scoring engine
+	confidence := score.Overall
 	if confidence == 0.0 {
 		// Default confidence for approved sessions without metrics
-		confidence = 0.85
+		confidence = thresholds.DefaultConfidence
 	}
 
 	// Quality level thresholds
 	var qualityLevel string
 	switch {
-	case confidence >= 0.95 && session.Verification.LivenessScore >= 0.90 && session.Document.Authenticity >= 0.95:
+	case thresholds.Gold.admits(confidence, session):
 		qualityLevel = VerificationLevelGold
-	case confidence >= 0.90 && session.Verification.LivenessScore >= 0.85:
+	case thresholds.Premium.admits(confidence, session):
 		qualityLevel = VerificationLevelPremium
-	case confidence >= 0.80:
+	case thresholds.Standard.admits(confidence, session):
 		qualityLevel = VerificationLevelStandard
 	default:
 		qualityLevel = VerificationLevelBasic
 	}
 
 	// Additional validation checks
-	if session.Verification.RiskScore > 0.3 { // High risk
+	if session.Verification.RiskScore > thresholds.MaxRiskScore { // High risk
 		return ValidationResult{
-			IsValid:      false,
-			Reason:       "High risk score detected",
-			QualityLevel: qualityLevel,
-			Confidence:   confidence,
+			IsValid:        false,
+			Reason:         "High risk score detected",
+			QualityLevel:   qualityLevel,
+			Confidence:     confidence,
+			QualityVersion: thresholds.QualityVersion,
+			Score:          &score,
 		}
 	}
 
-	if session.Verification.LivenessScore > 0 && session.Verification.LivenessScore < 0.7 {
+	if session.Verification.LivenessScore > 0 && session.Verification.LivenessScore < thresholds.MinLivenessScore {
 		return ValidationResult{
-			IsValid:      false,
-			Reason:       "Liveness check insufficient",
-			QualityLevel: qualityLevel,
-			Confidence:   confidence,
+			IsValid:        false,
+			Reason:         "Liveness check insufficient",
+			QualityLevel:   qualityLevel,
+			Confidence:     confidence,
+			QualityVersion: thresholds.QualityVersion,
+			Score:          &score,
 		}
 	}
 
 	return ValidationResult{
-		IsValid:      true,
-		QualityLevel: qualityLevel,
-		Confidence:   confidence,
+		IsValid:        true,
+		QualityLevel:   qualityLevel,
+		Confidence:     confidence,
+		QualityVersion: thresholds.QualityVersion,
+		Score:          &score,
 	}
 }
 
 // calculateAge calculates age from date of birth string (YYYY-MM-DD format)
 func calculateAge(dobStr string) int {
+	return ageOn(dobStr, time.Now())
+}
+
+// ageOn is the age at a time: the years whose birthday, dob.AddDate(n, 0,
+// 0), has passed. A 29 February birthday falls on 1 March in common years,
+// as in ageOverExpiry, so predicates flip exactly when their credential
+// expires.
+func ageOn(dobStr string, at time.Time) int {
 	dob, err := time.Parse("2006-01-02", dobStr)
 	if err != nil {
 		return 0
 	}
-	now := time.Now()
-	age := now.Year() - dob.Year()
-	if now.YearDay() < dob.YearDay() {
+	age := at.Year() - dob.Year()
+	if dob.AddDate(age, 0, 0).After(at) {
 		age--
 	}
 	return age
 }
 
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	log.Debug().Msg("Health check requested")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("ok")); err != nil {
-		log.Error().Err(err).Msg("Failed to write health check response")
-	}
-}
-
 func (s *Server) handleOAuthToken(w http.ResponseWriter, r *http.Request) {
 	var req TokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Error().Err(err).Msg("Failed to decode token request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request body")
 		return
 	}
 
 	// Validate grant type
-	if req.GrantType != "client_credentials" {
+	if req.GrantType == GrantTypeRefreshToken {
+		s.handleRefreshTokenGrant(w, r, req)
+		return
+	}
+	var renews string
+	if req.GrantType == GrantTypePreAuthorizedCode {
+		offer, err := s.offers.Redeem(tenant.FromContext(r.Context()).ID, req.PreAuthorizedCode, time.Now())
+		if err != nil {
+			log.Error().Err(err).Str("client_id", req.ClientID).Msg("Pre-authorized code rejected")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Invalid pre-authorized code")
+			return
+		}
+		// The offer stands for the session and scope the wallet would
+		// otherwise name
+		req.SessionID = offer.SessionID
+		req.Scope = offer.scope()
+		renews = offer.Renews
+	} else if req.GrantType != GrantTypeClientCredentials {
 		log.Error().Str("grant_type", req.GrantType).Msg("Invalid grant type")
-		http.Error(w, "Unsupported grant type", http.StatusBadRequest)
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeUnsupportedGrantType, "Unsupported grant type")
 		return
 	}
 
-	// Generate access token (JWT)
-	tokenID := uuid.New().String()
-	now := time.Now()
-	expiresAt := now.Add(time.Hour)
+	// Every requested scope must map to a credential type
+	if unknown := unknownScopes(req.Scope); len(unknown) > 0 {
+		log.Error().Strs("scopes", unknown).Str("client_id", req.ClientID).Msg("Unknown scope requested")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidScope, "Unknown scope: "+strings.Join(unknown, " "))
+		return
+	}
+	if unoffered := s.issuer(r.Context()).unofferedScopes(req.Scope); len(unoffered) > 0 {
+		log.Error().Strs("scopes", unoffered).Str("client_id", req.ClientID).Msg("Scope of a credential the tenant does not offer requested")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidScope, "Scope not offered by this issuer: "+strings.Join(unoffered, " "))
+		return
+	}
 
-	claims := jwt.MapClaims{
-		"sub":       req.ClientID,
-		"client_id": req.ClientID,
-		"scope":     req.Scope,
-		"iat":       now.Unix(),
-		"exp":       expiresAt.Unix(),
-		"jti":       tokenID,
+	// Only attested wallet builds may obtain tokens when attestation is configured
+	var attestedAppID string
+	if s.attestation != nil {
+		var err error
+		attestedAppID, err = s.attestation.Verify(r, req.ClientID)
+		if err != nil {
+			log.Error().Err(err).Str("client_id", req.ClientID).Msg("Wallet attestation rejected")
+			writeOAuthError(w, r, http.StatusUnauthorized, ErrCodeInvalidClient, "Wallet attestation required")
+			return
+		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	accessToken, err := token.SignedString(s.signingKey)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to sign access token")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// A session-bound token may only be issued once identity verification is complete
+	var journey IssuanceJourney
+	if req.SessionID != "" {
+		var err error
+		journey, err = s.journeys.store.FindBySession(r.Context(), req.SessionID)
+		if err != nil || journey.State != StateVerified || !ownsJourney(r.Context(), journey) {
+			log.Error().
+				Str("session_id", req.SessionID).
+				Str("state", string(journey.State)).
+				Msg("Token requested for session that is not verified")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Identity session not verified")
+			return
+		}
+	}
+
+	// Bind the token to the wallet key when a DPoP proof is presented
+	var jkt string
+	if proof := r.Header.Get(dpopHeader); proof != "" {
+		var err error
+		jkt, err = s.verifyDPoPProof(r, proof, "")
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid DPoP proof at token endpoint")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidDPoPProof, "Invalid DPoP proof")
+			return
+		}
+	}
+
+	// A session's token goes only to the wallet its journey is bound to
+	if req.SessionID != "" && !journey.redeemableBy(req.ClientID, jkt, req.GrantType == GrantTypePreAuthorizedCode) {
+		log.Error().
+			Str("session_id", req.SessionID).
+			Str("client_id", req.ClientID).
+			Msg("Token requested for a session bound to another wallet")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Identity session not bound to this client")
 		return
 	}
 
-	// Store token info
-	s.accessTokens[tokenID] = TokenInfo{
-		ClientID:  req.ClientID,
-		Scope:     req.Scope,
-		ExpiresAt: expiresAt,
+	// A renewal offer is redeemed only with the key its credential is bound to
+	if renews != "" {
+		record, err := s.issued.Get(tenant.FromContext(r.Context()).ID, renews)
+		if err != nil || jkt == "" || jkt != record.JKT {
+			log.Error().Str("client_id", req.ClientID).Str("credential_id", renews).Msg("Renewal offer redeemed without the holder's key")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "The renewal offer must be redeemed with the credential holder's key")
+			return
+		}
 	}
 
-	resp := TokenResponse{
-		AccessToken: accessToken,
-		TokenType:   "Bearer",
-		ExpiresIn:   3600,
+	resp, err := s.issueTokens(RefreshTokenInfo{
+		Tenant:      tenant.FromContext(r.Context()).ID,
+		ClientID:    req.ClientID,
 		Scope:       req.Scope,
+		SessionID:   req.SessionID,
+		JKT:         jkt,
+		WalletAppID: attestedAppID,
+		Renews:      renews,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue access token")
+		writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+		return
+	}
+
+	if req.SessionID != "" {
+		if _, err := s.journeys.Transition(r.Context(), journey.ID, StateTokenIssued, "access token issued", func(j *IssuanceJourney) {
+			j.ClientID = req.ClientID
+			j.JKT = jkt
+		}); err != nil {
+			log.Error().Err(err).Str("journey_id", journey.ID).Msg("Failed to record token issuance")
+			writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidGrant, "Identity session not verified")
+			return
+		}
 	}
 
+	s.recordAudit(r.Context(), AuditEvent{
+		Type:      AuditTokenGranted,
+		Actor:     req.ClientID,
+		SessionID: req.SessionID,
+		JourneyID: journey.ID,
+		Detail:    "scope=" + req.Scope,
+	})
+
 	log.Info().
 		Str("client_id", req.ClientID).
 		Str("scope", req.Scope).
 		Msg("Access token issued")
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Error().Err(err).Msg("Failed to encode token response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
 }
 
-func (s *Server) handleCredentialIssuance(w http.ResponseWriter, r *http.Request) {
+// authenticateAccessToken verifies the access token a request presents, and
+// its DPoP proof when the token is bound, answering the request itself when
+// they do not verify
+func (s *Server) authenticateAccessToken(w http.ResponseWriter, r *http.Request) (*jwt.Token, bool) {
 	// Extract and validate bearer token
 	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		http.Error(w, "Missing or invalid authorization header", http.StatusUnauthorized)
-		return
+	scheme, tokenString, _ := strings.Cut(authHeader, " ")
+	if (scheme != "Bearer" && scheme != "DPoP") || tokenString == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "Missing or invalid authorization header")
+		return nil, false
+	}
+
+	token, err := s.parseAccessToken(r.Context(), tokenString)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid access token")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "Invalid access token")
+		return nil, false
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	// DPoP-bound tokens must be presented with a proof from the bound key
+	if jkt := tokenKeyThumbprint(token); jkt != "" || scheme == "DPoP" {
+		proofJKT, err := s.verifyDPoPProof(r, r.Header.Get(dpopHeader), tokenString)
+		if scheme != "DPoP" || err != nil || proofJKT != jkt {
+			log.Error().Err(err).Str("scheme", scheme).Msg("DPoP proof does not match access token")
+			w.Header().Set("WWW-Authenticate", `DPoP error="invalid_token"`)
+			writeOAuthError(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "Invalid DPoP proof")
+			return nil, false
+		}
+	}
 
-	// Parse and validate JWT
+	return token, true
+}
+
+// parseAccessToken verifies an access token; only the tenant's own tokens
+// verify
+func (s *Server) parseAccessToken(ctx context.Context, tokenString string) (*jwt.Token, error) {
+	issuer := s.issuer(ctx)
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return &s.signingKey.PublicKey, nil
+		return &issuer.signingKey.PublicKey, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
 
-	if err != nil || !token.Valid {
-		log.Error().Err(err).Msg("Invalid access token")
-		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+// rateLimitClient names the client of a valid access token for the rate
+// limiter, which keys everyone else by IP
+func (s *Server) rateLimitClient(r *http.Request, credential string) (string, bool) {
+	token, err := s.parseAccessToken(r.Context(), credential)
+	if err != nil {
+		return "", false
+	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	return "token:" + jti, jti != ""
+}
+
+func (s *Server) handleCredentialIssuance(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.authenticateAccessToken(w, r)
+	if !ok {
 		return
 	}
+	issuer := s.issuer(r.Context())
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read credential request")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Invalid request body")
+		return
+	}
 	var req CredentialRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		log.Error().Err(err).Msg("Failed to decode credential request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Invalid request body")
 		return
 	}
 
+	clientID, _ := token.Claims.(jwt.MapClaims)["client_id"].(string)
+
+	// Retries carrying the same Idempotency-Key get the original credential
+	var idempotencyKey string
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		idempotencyKey = clientID + ":" + key
+		outcome, stored := s.idempotency.Reserve(idempotencyKey, requestDigest(body), time.Now())
+		switch outcome {
+		case idempotencyReplay:
+			replayIdempotentResponse(w, idempotencyKey, stored)
+			return
+		case idempotencyInFlight:
+			writeOAuthError(w, r, http.StatusConflict, ErrCodeInvalidRequest, "A request with this Idempotency-Key is in progress")
+			return
+		case idempotencyMismatch:
+			writeOAuthError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidRequest, "Idempotency-Key reused with a different request")
+			return
+		}
+		defer s.idempotency.Release(idempotencyKey)
+	}
+
 	log.Info().
 		Str("format", req.Format).
 		Interface("types", req.Types).
 		Msg("Credential issuance requested")
 
+	// The token's scope must cover the requested credential type
+	config := configurationForTypes(req.Types)
+	scope, _ := token.Claims.(jwt.MapClaims)["scope"].(string)
+	if !config.grantedBy(scope) {
+		log.Error().
+			Str("scope", scope).
+			Str("credential_configuration", config.ID).
+			Msg("Token scope does not cover requested credential type")
+		s.recordAudit(r.Context(), AuditEvent{
+			Type:           AuditCredentialRefused,
+			Actor:          clientID,
+			CredentialType: config.ID,
+			Outcome:        "denied",
+			Detail:         "insufficient scope",
+		})
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, config.Scope))
+		writeOAuthError(w, r, http.StatusForbidden, ErrCodeInvalidScope, "Token scope does not cover "+config.ID)
+		return
+	}
+
+	if !issuer.offers(config.ID) {
+		log.Error().Str("credential_configuration", config.ID).Str("tenant", tenant.FromContext(r.Context()).ID).Msg("Credential not offered by the tenant requested")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeUnsupportedCredentialType, config.ID+" is not offered by this issuer")
+		return
+	}
+
+	if req.Format == FormatLDPVC && !config.issuesLDP() {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeUnsupportedCredentialFormat, config.ID+" is not issued as "+FormatLDPVC)
+		return
+	}
+
+	if config.ID == CredentialTypeVouch {
+		s.issueVouchCredential(w, r, token, req, clientID, idempotencyKey)
+		return
+	}
+
 	// Create verifiable credential (simplified SD-JWT VC)
 	now := time.Now()
 	credentialID := fmt.Sprintf("urn:uuid:%s", uuid.New().String())
 
-	// Find the most recent verified session (in production, this would use session ID from token)
-	var veriffSession *VeriffSession
-	var sessionFound bool
-	for _, session := range s.verifiedSessions {
-		if session.Status == "approved" {
-			veriffSession = &session
-			sessionFound = true
-			break
-		}
+	// Resolve the journey this token was issued for
+	journey, err := s.journeyForToken(r.Context(), token)
+	if err != nil {
+		log.Error().Err(err).Msg("No verified Veriff session found for credential issuance")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "No verified identity session found")
+		return
 	}
-
-	if !sessionFound {
-		log.Error().Msg("No verified Veriff session found for credential issuance")
-		http.Error(w, "No verified identity session found", http.StatusBadRequest)
+	session, ok := s.verifiedSessions.Get(journey.SessionID)
+	if !ok {
+		log.Error().Str("session_id", journey.SessionID).Msg("Verified journey has no stored Veriff session")
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "No verified identity session found")
+		return
+	}
+	veriffSession := &session
+
+	// The credential is bound to the wallet key the proof is signed with,
+	// so only the wallet holding it can present the credential
+	holderKey, err := verifyCredentialProof(req.Proof, issuer.did, now)
+	var holderJKT string
+	if err == nil {
+		holderJKT, err = holderKey.Thumbprint()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("credential_configuration", config.ID).Msg("Invalid proof of the wallet key")
+		s.recordAudit(r.Context(), AuditEvent{
+			Type:           AuditCredentialRefused,
+			Actor:          clientID,
+			SessionID:      journey.SessionID,
+			JourneyID:      journey.ID,
+			CredentialType: config.ID,
+			Outcome:        "denied",
+			Detail:         "invalid proof",
+		})
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidProof, "Invalid proof of the wallet key")
 		return
 	}
 
 	// Validate session quality before issuance
-	validation := validateVeriffSession(*veriffSession)
+	validation := validateVeriffSession(*veriffSession, s.quality, s.scoreSession(r.Context(), *veriffSession))
+	if reviewed, ok := s.verifiedSessions.Validation(veriffSession.SessionID); ok && reviewed.Reviewed {
+		// An operator's decision stands over the automated checks
+		validation = reviewed
+	}
 	if !validation.IsValid {
 		log.Error().
 			Str("reason", validation.Reason).
 			Str("session_id", veriffSession.SessionID).
 			Msg("Veriff session failed quality validation")
-		http.Error(w, fmt.Sprintf("Session validation failed: %s", validation.Reason), http.StatusBadRequest)
+		s.failJourney(r.Context(), journey.ID, validation.Reason)
+		s.recordAudit(r.Context(), AuditEvent{
+			Type:           AuditCredentialRefused,
+			Actor:          clientID,
+			SessionID:      journey.SessionID,
+			JourneyID:      journey.ID,
+			CredentialType: config.ID,
+			QualityTier:    validation.QualityLevel,
+			Outcome:        "failed",
+			Detail:         validation.Reason,
+		})
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, fmt.Sprintf("Session validation failed: %s", validation.Reason))
 		return
 	}
 
-	// Calculate expiration (90 days from now for identity credentials)
-	expirationDate := now.Add(90 * 24 * time.Hour)
+	expirationDate := config.expiresAt(*veriffSession, validation.QualityLevel, now)
+	status, err := s.statusList.Allocate(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to allocate a status list index")
+		writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Credential status unavailable")
+		return
+	}
 
-	// Enhanced credential with quality metrics and selective disclosure support
 	vc := VerifiableCredential{
 		Context: []string{
 			"https://www.w3.org/2018/credentials/v1",
-			"https://cachet.id/contexts/identity/v1",
-		},
-		ID:             credentialID,
-		Type:           req.Types,
-		Issuer:         "did:web:cachet.id",
-		IssuanceDate:   now.Format(time.RFC3339),
-		ExpirationDate: expirationDate.Format(time.RFC3339),
-		CredentialSubject: map[string]interface{}{
-			"id": "did:example:holder", // This would come from the authenticated session
-
-			// Personal data (selective disclosure ready)
-			"personalData": map[string]interface{}{
-				"age":          calculateAge(veriffSession.Person.DateOfBirth),
-				"nationality":  veriffSession.Document.Country,
-				"documentType": veriffSession.Document.Type,
-			},
-
-			// Verification evidence
-			"verificationLevel":  validation.QualityLevel,
-			"verified":           true,
-			"verificationMethod": "veriff",
-
-			// Quality metrics (for transparency, not selective disclosure)
-			"verificationMetrics": map[string]interface{}{
-				"overallConfidence":    validation.Confidence,
-				"livenessScore":        veriffSession.Verification.LivenessScore,
-				"documentAuthenticity": veriffSession.Document.Authenticity,
-				"riskScore":            veriffSession.Verification.RiskScore,
-				"sessionTimestamp":     veriffSession.Verification.Timestamp,
-			},
-
-			// Evidence for audit trail
-			"evidence": []map[string]interface{}{
-				{
-					"type":      "VeriffVerification",
-					"sessionId": veriffSession.SessionID,
-					"verifier":  "did:veriff:production",
-					"status":    veriffSession.Status,
-				},
-			},
-		},
-		CredentialStatus: &CredentialStatus{
-			ID:   fmt.Sprintf("https://cachet.id/status/1#%s", uuid.New().String()),
-			Type: "StatusList2021Entry",
+			config.Context,
 		},
+		ID:                credentialID,
+		Type:              config.Types,
+		Issuer:            issuer.did,
+		IssuanceDate:      now.Format(time.RFC3339),
+		ExpirationDate:    expirationDate.Format(time.RFC3339),
+		CredentialSubject: config.buildSubject(*veriffSession, validation),
+		CredentialStatus:  status,
+		Cnf:               &Confirmation{JWK: holderKey},
 	}
 
+	// The registry's schema for the type must accept the subject before it is signed
+	if s.schemas != nil {
+		vc.CredentialSchema = s.schemas.SchemaRef(config)
+		if err := s.schemas.Validate(r.Context(), config, vc.CredentialSubject); err != nil {
+			var invalid *SubjectInvalidError
+			if !errors.As(err, &invalid) {
+				log.Error().Err(err).Str("credential_configuration", config.ID).Msg("Credential schema validation unavailable")
+				writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Credential schema registry unavailable")
+				return
+			}
+			log.Error().Err(err).Str("journey_id", journey.ID).Msg("Credential subject does not match its schema")
+			s.failJourney(r.Context(), journey.ID, "credential subject does not match its schema")
+			s.recordAudit(r.Context(), AuditEvent{
+				Type:           AuditCredentialRefused,
+				Actor:          clientID,
+				SessionID:      journey.SessionID,
+				JourneyID:      journey.ID,
+				CredentialType: config.ID,
+				QualityTier:    validation.QualityLevel,
+				Outcome:        "failed",
+				Detail:         invalid.Error(),
+			})
+			writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Credential subject does not match its schema")
+			return
+		}
+	}
+
+	// The subject's claims are released by their sensitivity
+	var disclosed disclosedSubject
+	if req.Format == FormatLDPVC {
+		disclosed = config.ldpSubject(vc.CredentialSubject)
+	} else if disclosed, err = config.discloseSubject(vc.CredentialSubject); err != nil {
+		log.Error().Err(err).Str("credential_configuration", config.ID).Msg("Failed to apply the claims' disclosure policy")
+		writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Failed to issue credential")
+		return
+	}
+	vc.CredentialSubject = disclosed.Subject
+	if len(disclosed.Disclosures) > 0 {
+		vc.SDAlg = sdAlgorithm
+	}
+
+	s.timestampCredential(r.Context(), &vc)
+	if req.Format == FormatLDPVC {
+		if err := issuer.signLDP(&vc, now); err != nil {
+			log.Error().Err(err).Str("credential_configuration", config.ID).Msg("Failed to sign the credential with BBS")
+			writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Failed to issue credential")
+			return
+		}
+	}
+
+	if _, err := s.journeys.Transition(r.Context(), journey.ID, StateCredentialIssued, "credential issued", func(j *IssuanceJourney) {
+		j.CredentialID = credentialID
+	}); err != nil {
+		log.Error().Err(err).Str("journey_id", journey.ID).Msg("Failed to record credential issuance")
+		writeOAuthError(w, r, http.StatusConflict, ErrCodeInvalidCredentialRequest, "Credential already issued for this session")
+		return
+	}
+
+	s.recordIssued(r, config, vc, journey, holderJKT, expirationDate)
+
+	// The holder's device feeds the vouching-service's collusion checks
+	// before the session's technical data is purged
+	s.reportDeviceSignal(r.Context(), token, *veriffSession)
+	s.enrollForScreening(r.Context(), journey, *veriffSession)
+
+	// The credential now carries everything the holder needs; keep only the quality profile
+	s.verifiedSessions.Purge(journey.SessionID, PurgeReasonIssued, time.Now())
+
 	resp := CredentialResponse{
-		Credential: vc,
-		Format:     req.Format,
+		Credential:  vc,
+		Format:      req.Format,
+		Disclosures: disclosed.Disclosures,
+		VaultClaims: disclosed.Vault,
+		NotificationID: s.issuanceNotification(r, issuanceTransaction{
+			ClientID:       clientID,
+			SessionID:      journey.SessionID,
+			JourneyID:      journey.ID,
+			CredentialType: config.ID,
+			CredentialID:   credentialID,
+			IdempotencyKey: idempotencyKey,
+		}),
 	}
 
+	s.recordAudit(r.Context(), AuditEvent{
+		Type:            AuditCredentialIssued,
+		Actor:           clientID,
+		SessionID:       journey.SessionID,
+		JourneyID:       journey.ID,
+		CredentialType:  config.ID,
+		CredentialID:    credentialID,
+		QualityTier:     validation.QualityLevel,
+		StatusListIndex: vc.statusListIndex(),
+	})
+
 	log.Info().
 		Str("credential_id", credentialID).
+		Str("credential_configuration", config.ID).
 		Msg("Credential issued successfully")
+	s.publishIssued(r.Context(), events.CredentialIssued{
+		CredentialID:    credentialID,
+		Types:           config.Types,
+		Format:          req.Format,
+		Issuer:          issuer.did,
+		JourneyID:       journey.ID,
+		StatusListIndex: vc.statusListIndex(),
+	})
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	encoded, err := json.Marshal(resp)
+	if err != nil {
 		log.Error().Err(err).Msg("Failed to encode credential response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
 		return
 	}
+	if idempotencyKey != "" {
+		s.idempotency.Complete(idempotencyKey, http.StatusOK, encoded)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(encoded); err != nil {
+		log.Error().Err(err).Msg("Failed to write credential response")
+	}
 }
 
 func (s *Server) handleVeriffWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read Veriff webhook")
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
 	var session VeriffSession
-	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+	if err := json.Unmarshal(body, &session); err != nil {
 		log.Error().Err(err).Msg("Failed to decode Veriff webhook")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
@@ -449,13 +959,54 @@ func (s *Server) handleVeriffWebhook(w http.ResponseWriter, r *http.Request) {
 		Str("status", session.Status).
 		Msg("Veriff webhook received")
 
+	// Persist the event before processing so a crash never loses it
+	event, err := s.webhookQueue.Enqueue(tenant.FromContext(r.Context()).ID, body, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("session_id", session.SessionID).Msg("Failed to enqueue Veriff webhook")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Process inline on the happy path; failures are retried by the worker
+	status, err := s.processVeriffEvent(r.Context(), session)
+	if err != nil {
+		s.failWebhookEvent(event.ID, err)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	s.ackWebhookEvent(event.ID)
+	w.WriteHeader(status)
+}
+
+// processVeriffEvent applies a Veriff decision to the session's journey and
+// returns the status to acknowledge the webhook with
+func (s *Server) processVeriffEvent(ctx context.Context, session VeriffSession) (int, error) {
+	journey, err := s.journeys.ForSession(ctx, uuid.NewString, session.SessionID)
+	if err != nil {
+		return 0, fmt.Errorf("loading issuance journey: %w", err)
+	}
+
+	event := AuditEvent{
+		Type:      AuditWebhookReceived,
+		Actor:     "veriff",
+		SessionID: session.SessionID,
+		JourneyID: journey.ID,
+		Detail:    "status=" + session.Status,
+	}
+
 	if session.Status == "approved" {
 		// Validate session quality before storing
-		validation := validateVeriffSession(session)
+		score := s.scoreSession(ctx, session)
+		s.observeScores(session, score)
+		validation := validateVeriffSession(session, s.quality, score)
+		event.QualityTier = validation.QualityLevel
 
 		if validation.IsValid {
 			// Store successful verification with validation results
-			s.verifiedSessions[session.SessionID] = session
+			s.verifiedSessions.Store(session, validation, time.Now())
+			if err := s.advanceJourney(ctx, journey, StateVerified, "Veriff session approved"); err != nil {
+				return 0, err
+			}
 
 			log.Info().
 				Str("session_id", session.SessionID).
@@ -471,23 +1022,84 @@ func (s *Server) handleVeriffWebhook(w http.ResponseWriter, r *http.Request) {
 				Str("reason", validation.Reason).
 				Str("quality_level", validation.QualityLevel).
 				Float64("confidence", validation.Confidence).
-				Msg("Veriff session approved but failed quality validation - not stored")
+				Msg("Veriff session approved but failed quality validation - queued for operator review")
+			if err := s.queueForReview(ctx, journey, session, validation); err != nil {
+				return 0, err
+			}
+			event.Outcome = "pending_review"
+			event.Detail += "; " + validation.Reason
 		}
 
-		w.WriteHeader(http.StatusOK)
-	} else {
-		log.Info().
-			Str("session_id", session.SessionID).
-			Str("status", session.Status).
-			Msg("Veriff session not approved")
+		s.recordAudit(ctx, event)
+		return http.StatusOK, nil
+	}
+
+	log.Info().
+		Str("session_id", session.SessionID).
+		Str("status", session.Status).
+		Msg("Veriff session not approved")
+
+	switch session.Status {
+	case "declined", "expired", "abandoned":
+		err = s.advanceJourney(ctx, journey, StateFailed, "Veriff session "+session.Status)
+	case "review":
+		// Veriff could not decide; an operator does, on the evidence quality
+		referred := session
+		referred.Status = "approved"
+		score := s.scoreSession(ctx, referred)
+		s.observeScores(referred, score)
+		validation := validateVeriffSession(referred, s.quality, score)
+		if validation.IsValid {
+			validation.IsValid = false
+			validation.Reason = "Veriff referred the session for review"
+		}
+		event.QualityTier = validation.QualityLevel
+		event.Outcome = "pending_review"
+		err = s.queueForReview(ctx, journey, session, validation)
+	default:
+		if journey.State == StateOfferCreated {
+			err = s.advanceJourney(ctx, journey, StateIDVPending, "Veriff session "+session.Status)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	s.recordAudit(ctx, event)
+	return http.StatusAccepted, nil // Acknowledge but don't process
+}
+
+// authorizeOperator checks the bearer token for operator APIs, which are
+// closed unless OPERATOR_API_TOKEN is configured
+func (s *Server) authorizeOperator(r *http.Request) bool {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return s.operatorToken != "" && scheme == "Bearer" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1
+}
 
-		w.WriteHeader(http.StatusAccepted) // Acknowledge but don't process
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
 	}
 }
 
 func (s *Server) Start(addr string) error {
 	log.Info().Str("addr", addr).Msg("Issuance gateway starting")
 
+	go s.reapStuckJourneys(time.Minute)
+	go s.reapSensitiveSessionData(time.Minute)
+	go s.runWebhookWorker(webhookWorkerInterval)
+	go s.detectScoreDrift(s.drift.cfg.Interval)
+	go s.security.Run()
+	if s.screening != nil {
+		go s.rescreenSubjects(s.screeningInterval)
+	}
+	if s.renewal.Reminder > 0 {
+		go s.remindRenewals(s.renewal.ReminderInterval)
+	}
+
 	server := &http.Server{
 		Addr:         addr,
 		Handler:      s.router,
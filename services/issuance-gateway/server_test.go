@@ -7,6 +7,8 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -124,7 +126,8 @@ func TestCredentialEndpoint_Success(t *testing.T) {
 		},
 	}
 
-	// Send Veriff webhook
+	// Send Veriff webhook for a session bound to the wallet
+	bindSession(t, server, veriffSession.SessionID, nil)
 	veriffBody, err := json.Marshal(veriffSession)
 	require.NoError(t, err)
 	veriffReq := httptest.NewRequest(http.MethodPost, "/webhooks/veriff", bytes.NewReader(veriffBody))
@@ -138,6 +141,7 @@ func TestCredentialEndpoint_Success(t *testing.T) {
 		GrantType: "client_credentials",
 		ClientID:  "test-wallet",
 		Scope:     "credential_issuance",
+		SessionID: veriffSession.SessionID,
 	}
 
 	tokenBody, _ := json.Marshal(tokenReq)
@@ -154,6 +158,7 @@ func TestCredentialEndpoint_Success(t *testing.T) {
 	credReq := CredentialRequest{
 		Format: "jwt_vc",
 		Types:  []string{"VerifiableCredential", "IdentityCredential"},
+		Proof:  walletProof(t),
 	}
 
 	credBody, err := json.Marshal(credReq)
@@ -299,3 +304,58 @@ func TestVeriffWebhook_InvalidStatus(t *testing.T) {
 
 	assert.Equal(t, http.StatusAccepted, w.Code) // Acknowledged but not processed
 }
+
+func TestRateLimit(t *testing.T) {
+	server := NewServer()
+	server.rateLimit.Set(ratelimit.NewMemory(), ratelimit.PerMinute(2), ratelimit.ByClient(server.rateLimitClient, 0))
+
+	tokens := issueToken(t, server)
+	w := postJSON(t, server, "/oauth/token", TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "test-wallet", Scope: "credential_issuance"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	w = postJSON(t, server, "/oauth/token", TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "test-wallet", Scope: "credential_issuance"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// A wallet presenting its access token draws from its own allowance
+	w = postJSON(t, server, "/credential", CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", "IdentityCredential"}},
+		map[string]string{"Authorization": "Bearer " + tokens.AccessToken})
+	assert.NotEqual(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+
+	// but tokens it did not issue do not
+	w = postJSON(t, server, "/credential", CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", "IdentityCredential"}},
+		map[string]string{"Authorization": "Bearer " + tokens.AccessToken + "x"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Identity provider webhooks and probes are not limited
+	assert.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", approvedSession("limited-session"), nil).Code)
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAPIVersions(t *testing.T) {
+	server := NewServer()
+	request := TokenRequest{GrantType: GrantTypeClientCredentials, ClientID: "test-wallet", Scope: "credential_issuance"}
+
+	w := postJSON(t, server, "/v1/oauth/token", request, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "1", w.Header().Get(apiversion.Header))
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	// Deployed wallets keep calling the unversioned paths, which point them
+	// at their successor
+	w = postJSON(t, server, "/oauth/token", request, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/oauth/token>; rel="successor-version"`, w.Header().Get("Link"))
+
+	// Veriff calls the webhook URL it was configured with
+	w = postJSON(t, server, "/webhooks/veriff", approvedSession("versioned-session"), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	assert.Equal(t, http.StatusNotFound, postJSON(t, server, "/v2/oauth/token", request, nil).Code)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultStatusListURL = "https://cachet.id/status/1"
+
+// StatusList2021 purposes; a credential has an entry in a list of each
+const (
+	statusPurposeRevocation = "revocation"
+	statusPurposeSuspension = "suspension"
+)
+
+// minStatusListBits is the smallest bitstring a status list is published
+// as, 16KB per StatusList2021, so a list does not narrow down which
+// credentials it holds
+const minStatusListBits = 16 * 1024 * 8
+
+// statusListLifetime is how long a published status list credential is
+// valid; verifiers fetch a fresh one well before it expires
+const statusListLifetime = 24 * time.Hour
+
+// ErrStatusIndexUnallocated is returned for a status list index no
+// credential was allocated
+var ErrStatusIndexUnallocated = errors.New("status list index not allocated")
+
+// StatusListStore keeps how many indexes each status list has handed out
+// and which of their bits are set, so indexes are never handed out twice
+// and revocations and suspensions survive restarts
+type StatusListStore interface {
+	// Allocate reserves the next index of the list
+	Allocate(ctx context.Context, list string) (int, error)
+	// Set sets or clears a purpose's bit of an allocated index, reporting
+	// whether it changed
+	Set(ctx context.Context, list, purpose string, index int, value bool) (bool, error)
+	// Get reports whether a purpose's bit of an index is set
+	Get(ctx context.Context, list, purpose string, index int) (bool, error)
+	// Bits returns how many indexes the list has handed out and which of
+	// them have the purpose's bit set
+	Bits(ctx context.Context, list, purpose string) (int, []int, error)
+}
+
+// memoryStatusListStore keeps the status lists in memory, for development
+// and tests; deployments with DATABASE_URL set keep them in Postgres
+// (postgresStatusListStore)
+type memoryStatusListStore struct {
+	mu   sync.Mutex
+	next map[string]int
+	bits map[string]map[int]bool // by list and purpose
+}
+
+func newMemoryStatusListStore() *memoryStatusListStore {
+	return &memoryStatusListStore{next: make(map[string]int), bits: make(map[string]map[int]bool)}
+}
+
+func (m *memoryStatusListStore) Allocate(ctx context.Context, list string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index := m.next[list]
+	m.next[list]++
+	return index, nil
+}
+
+func (m *memoryStatusListStore) Set(ctx context.Context, list, purpose string, index int, value bool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index < 0 || index >= m.next[list] {
+		return false, ErrStatusIndexUnallocated
+	}
+	key := list + " " + purpose
+	bits := m.bits[key]
+	if bits[index] == value {
+		return false, nil
+	}
+	if value {
+		if bits == nil {
+			bits = make(map[int]bool)
+			m.bits[key] = bits
+		}
+		bits[index] = true
+	} else {
+		delete(bits, index)
+	}
+	return true, nil
+}
+
+func (m *memoryStatusListStore) Get(ctx context.Context, list, purpose string, index int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bits[list+" "+purpose][index], nil
+}
+
+func (m *memoryStatusListStore) Bits(ctx context.Context, list, purpose string) (int, []int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := make([]int, 0, len(m.bits[list+" "+purpose]))
+	for index := range m.bits[list+" "+purpose] {
+		set = append(set, index)
+	}
+	return m.next[list], set, nil
+}
+
+// statusListAllocator hands out StatusList2021 indexes so every issued
+// credential can later be revoked or suspended, and keeps their bits in its
+// store. A credential has the same index in the revocation list and in the
+// suspension list beside it.
+type statusListAllocator struct {
+	listURL string
+	store   StatusListStore
+}
+
+func newStatusListAllocator(listURL string, store StatusListStore) *statusListAllocator {
+	return &statusListAllocator{listURL: listURL, store: store}
+}
+
+// Allocate reserves the next index in the lists, returning the credential's
+// revocation and suspension entries
+func (a *statusListAllocator) Allocate(ctx context.Context) ([]CredentialStatus, error) {
+	index, err := a.store.Allocate(ctx, a.listURL)
+	if err != nil {
+		return nil, err
+	}
+	return []CredentialStatus{
+		a.entry(statusPurposeRevocation, index),
+		a.entry(statusPurposeSuspension, index),
+	}, nil
+}
+
+func (a *statusListAllocator) entry(purpose string, index int) CredentialStatus {
+	listURL := a.purposeURL(purpose)
+	return CredentialStatus{
+		ID:                   listURL + "#" + strconv.Itoa(index),
+		Type:                 "StatusList2021Entry",
+		StatusPurpose:        purpose,
+		StatusListIndex:      strconv.Itoa(index),
+		StatusListCredential: listURL,
+	}
+}
+
+// purposeURL is the URL the list of a purpose is published at, the
+// suspension list beside the revocation list
+func (a *statusListAllocator) purposeURL(purpose string) string {
+	if purpose == statusPurposeSuspension {
+		return a.listURL + "/" + statusPurposeSuspension
+	}
+	return a.listURL
+}
+
+// set sets or clears a bit of an allocated index, reporting whether it
+// changed
+func (a *statusListAllocator) set(ctx context.Context, purpose, index string, value bool) (bool, error) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return false, ErrStatusIndexUnallocated
+	}
+	return a.store.Set(ctx, a.listURL, purpose, i, value)
+}
+
+func (a *statusListAllocator) get(ctx context.Context, purpose, index string) (bool, error) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return false, nil
+	}
+	return a.store.Get(ctx, a.listURL, purpose, i)
+}
+
+// Revoke sets the revocation bit of an allocated index, reporting whether
+// it was newly set. Revocation is final.
+func (a *statusListAllocator) Revoke(ctx context.Context, index string) (bool, error) {
+	return a.set(ctx, statusPurposeRevocation, index, true)
+}
+
+// Suspend sets the suspension bit of an allocated index, reporting whether
+// it was newly set
+func (a *statusListAllocator) Suspend(ctx context.Context, index string) (bool, error) {
+	return a.set(ctx, statusPurposeSuspension, index, true)
+}
+
+// Reinstate clears the suspension bit of an index, reporting whether it
+// was set
+func (a *statusListAllocator) Reinstate(ctx context.Context, index string) (bool, error) {
+	return a.set(ctx, statusPurposeSuspension, index, false)
+}
+
+// Status reports an index's status in the lists: revoked, suspended or
+// active. Credentials without an index are active.
+func (a *statusListAllocator) Status(ctx context.Context, index string) (string, error) {
+	revoked, err := a.get(ctx, statusPurposeRevocation, index)
+	if err != nil || revoked {
+		return CredentialStatusRevoked, err
+	}
+	suspended, err := a.get(ctx, statusPurposeSuspension, index)
+	if err != nil || suspended {
+		return CredentialStatusSuspended, err
+	}
+	return CredentialStatusActive, nil
+}
+
+// EncodedList returns a purpose's list as StatusList2021 encodes it: a
+// bitstring with the bit of index 0 first, at least minStatusListBits long,
+// GZIP-compressed and base64url-encoded
+func (a *statusListAllocator) EncodedList(ctx context.Context, purpose string) (string, error) {
+	allocated, set, err := a.store.Bits(ctx, a.listURL, purpose)
+	if err != nil {
+		return "", err
+	}
+	size := max(allocated, minStatusListBits)
+	bits := make([]byte, (size+7)/8)
+	for _, index := range set {
+		bits[index/8] |= 0x80 >> (index % 8)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(bits); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(compressed.Bytes()), nil
+}
+
+// statusListID is the last path segment of the list URL, which the list is
+// served under at /status/{list}
+func (a *statusListAllocator) statusListID() string {
+	parsed, err := url.Parse(a.listURL)
+	if err != nil {
+		return ""
+	}
+	return path.Base(parsed.Path)
+}
+
+// handleRevocationList serves the revocation status list
+func (s *Server) handleRevocationList(w http.ResponseWriter, r *http.Request) {
+	s.serveStatusList(w, r, statusPurposeRevocation)
+}
+
+// handleSuspensionList serves the suspension status list
+func (s *Server) handleSuspensionList(w http.ResponseWriter, r *http.Request) {
+	s.serveStatusList(w, r, statusPurposeSuspension)
+}
+
+// serveStatusList serves a purpose's list as a StatusList2021Credential
+// secured as a JWT, signed by the request's tenant so verifiers check it
+// against the issuer of the credentials pointing at it
+func (s *Server) serveStatusList(w http.ResponseWriter, r *http.Request, purpose string) {
+	if chi.URLParam(r, "list") != s.statusList.statusListID() {
+		problem.Error(w, r, "Status list not found", http.StatusNotFound)
+		return
+	}
+	encoded, err := s.statusList.EncodedList(r.Context(), purpose)
+	if err != nil {
+		log.Error().Err(err).Str("purpose", purpose).Msg("Failed to read the status list")
+		problem.Error(w, r, "Status list unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	issuer := s.issuer(r.Context())
+	now := time.Now().UTC()
+	listURL := s.statusList.purposeURL(purpose)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": issuer.did,
+		"sub": listURL,
+		"iat": now.Unix(),
+		"exp": now.Add(statusListLifetime).Unix(),
+		"vc": map[string]interface{}{
+			"@context":     []string{"https://www.w3.org/2018/credentials/v1", "https://w3id.org/vc/status-list/2021/v1"},
+			"id":           listURL,
+			"type":         []string{"VerifiableCredential", "StatusList2021Credential"},
+			"issuer":       issuer.did,
+			"issuanceDate": now.Format(time.RFC3339),
+			"credentialSubject": map[string]interface{}{
+				"id":            listURL + "#list",
+				"type":          "StatusList2021",
+				"statusPurpose": purpose,
+				"encodedList":   encoded,
+			},
+		},
+	})
+	token.Header["kid"] = signingKeyID(&issuer.signingKey.PublicKey)
+	signed, err := token.SignedString(issuer.signingKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign the status list")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vc+jwt")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if _, err := w.Write([]byte(signed)); err != nil {
+		log.Error().Err(err).Msg("Failed to write the status list")
+	}
+}
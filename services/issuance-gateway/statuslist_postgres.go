@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// postgresStatusListStore keeps the status lists in Postgres, so every
+// instance allocates from one counter and sees the same bits
+type postgresStatusListStore struct {
+	db *sql.DB
+}
+
+func newPostgresStatusListStore(db *sql.DB) *postgresStatusListStore {
+	return &postgresStatusListStore{db: db}
+}
+
+// Allocate increments the list's counter in a single statement, so
+// instances allocating at once get distinct indexes
+func (p *postgresStatusListStore) Allocate(ctx context.Context, list string) (int, error) {
+	var index int
+	err := p.db.QueryRowContext(ctx,
+		`INSERT INTO status_lists (url, next) VALUES ($1, 1)
+		 ON CONFLICT (url) DO UPDATE SET next = status_lists.next + 1
+		 RETURNING next - 1`, list).Scan(&index)
+	return index, err
+}
+
+func (p *postgresStatusListStore) Set(ctx context.Context, list, purpose string, index int, value bool) (bool, error) {
+	var next int
+	err := p.db.QueryRowContext(ctx, `SELECT next FROM status_lists WHERE url = $1`, list).Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrStatusIndexUnallocated
+	} else if err != nil {
+		return false, err
+	}
+	if index < 0 || index >= next {
+		return false, ErrStatusIndexUnallocated
+	}
+	var result sql.Result
+	if value {
+		result, err = p.db.ExecContext(ctx,
+			`INSERT INTO status_list_bits (url, purpose, list_index) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			list, purpose, index)
+	} else {
+		result, err = p.db.ExecContext(ctx,
+			`DELETE FROM status_list_bits WHERE url = $1 AND purpose = $2 AND list_index = $3`,
+			list, purpose, index)
+	}
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	return changed > 0, err
+}
+
+func (p *postgresStatusListStore) Get(ctx context.Context, list, purpose string, index int) (bool, error) {
+	var set bool
+	err := p.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM status_list_bits WHERE url = $1 AND purpose = $2 AND list_index = $3)`,
+		list, purpose, index).Scan(&set)
+	return set, err
+}
+
+func (p *postgresStatusListStore) Bits(ctx context.Context, list, purpose string) (int, []int, error) {
+	var next int
+	err := p.db.QueryRowContext(ctx, `SELECT next FROM status_lists WHERE url = $1`, list).Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, []int{}, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT list_index FROM status_list_bits WHERE url = $1 AND purpose = $2`, list, purpose)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	set := []int{}
+	for rows.Next() {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			return 0, nil, err
+		}
+		set = append(set, index)
+	}
+	return next, set, rows.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// credentialStatus reads an index's status in the server's lists
+func credentialStatus(t *testing.T, server *Server, index string) string {
+	t.Helper()
+	status, err := server.statusList.Status(context.Background(), index)
+	require.NoError(t, err)
+	return status
+}
+
+// revokeCredential sets an index's revocation bit
+func revokeCredential(t *testing.T, server *Server, index string) {
+	t.Helper()
+	revoked, err := server.statusList.Revoke(context.Background(), index)
+	require.NoError(t, err)
+	require.True(t, revoked)
+}
+
+func TestStatusListAllocator(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStatusListStore()
+	allocator := newStatusListAllocator(defaultStatusListURL, store)
+
+	entries, err := allocator.Allocate(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, defaultStatusListURL+"#0", entries[0].ID)
+	assert.Equal(t, defaultStatusListURL+"/suspension", entries[1].StatusListCredential)
+	index := entries[0].StatusListIndex
+
+	_, err = allocator.Revoke(ctx, "1")
+	assert.ErrorIs(t, err, ErrStatusIndexUnallocated)
+
+	suspended, err := allocator.Suspend(ctx, index)
+	require.NoError(t, err)
+	assert.True(t, suspended)
+	status, err := allocator.Status(ctx, index)
+	require.NoError(t, err)
+	assert.Equal(t, CredentialStatusSuspended, status)
+
+	revoked, err := allocator.Revoke(ctx, index)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = allocator.Revoke(ctx, index)
+	require.NoError(t, err)
+	assert.False(t, revoked, "revoking twice changes nothing")
+
+	// An allocator started again over the same store carries on where the
+	// last one stopped
+	restarted := newStatusListAllocator(defaultStatusListURL, store)
+	status, err = restarted.Status(ctx, index)
+	require.NoError(t, err)
+	assert.Equal(t, CredentialStatusRevoked, status)
+	entries, err = restarted.Allocate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "1", entries[0].StatusListIndex)
+}
+
+// getStatusList fetches a published status list and returns its decoded
+// bitstring
+func getStatusList(t *testing.T, server *Server, path, purpose string) []byte {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/vc+jwt", w.Header().Get("Content-Type"))
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(w.Body.String(), claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, signingKeyID(&server.signingKey.PublicKey), token.Header["kid"])
+		return &server.signingKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	require.NoError(t, err)
+	assert.Equal(t, issuerDID, claims["iss"])
+	vc := claims["vc"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"VerifiableCredential", "StatusList2021Credential"}, vc["type"])
+	subject := vc["credentialSubject"].(map[string]interface{})
+	assert.Equal(t, "StatusList2021", subject["type"])
+	assert.Equal(t, purpose, subject["statusPurpose"])
+
+	compressed, err := base64.RawURLEncoding.DecodeString(subject["encodedList"].(string))
+	require.NoError(t, err)
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	bits, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Len(t, bits, minStatusListBits/8)
+	return bits
+}
+
+func statusBit(bits []byte, index string) bool {
+	i, _ := strconv.Atoi(index)
+	return bits[i/8]&(0x80>>(i%8)) != 0
+}
+
+func TestStatusList_Published(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+	revoked := issueBoundIdentity(t, server, key, "revoked-session")
+	suspended := issueBoundIdentity(t, server, key, "suspended-session")
+	revokeCredential(t, server, revoked.statusListIndex())
+	_, err := server.statusList.Suspend(context.Background(), suspended.statusListIndex())
+	require.NoError(t, err)
+
+	bits := getStatusList(t, server, "/status/1", statusPurposeRevocation)
+	assert.True(t, statusBit(bits, revoked.statusListIndex()))
+	assert.False(t, statusBit(bits, suspended.statusListIndex()))
+
+	bits = getStatusList(t, server, "/status/1/suspension", statusPurposeSuspension)
+	assert.False(t, statusBit(bits, revoked.statusListIndex()))
+	assert.True(t, statusBit(bits, suspended.statusListIndex()))
+
+	req := httptest.NewRequest(http.MethodGet, "/status/2", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
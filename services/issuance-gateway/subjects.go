@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// AuditSubjectErased records a data subject's erasure
+const AuditSubjectErased = "subject.erased"
+
+// ErasureReceiptJWTType is the typ header of a signed erasure receipt
+const ErasureReceiptJWTType = "erasure-receipt+jwt"
+
+// revocationReasonErasure is why credentials are revoked with their subject
+const revocationReasonErasure = "subject_erasure"
+
+// didPattern matches the DIDs holders are known by, as the vouching-service
+// checks them
+var didPattern = regexp.MustCompile(`^did:[a-z0-9]+:[A-Za-z0-9._:%-]+$`)
+
+// ErasureReceipt records what was erased with a data subject, who is known
+// to the gateway by their identity session and to the other services by
+// their wallet's DID
+type ErasureReceipt struct {
+	ID       string    `json:"id"`
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	Holder   string    `json:"holder,omitempty"`
+	ErasedAt time.Time `json:"erasedAt"`
+	// RevokedCredentials are the credentials issued to the subject, whose
+	// status list bits are now set
+	RevokedCredentials []string `json:"revokedCredentials"`
+	// UnrevokedCredentials are the subject's credentials whose status list
+	// index the lists no longer hold, so they could not be revoked and the
+	// erasure is partial
+	UnrevokedCredentials []string `json:"unrevokedCredentials,omitempty"`
+	// SessionErased reports whether the vault still held the identity
+	// session or its quality profile
+	SessionErased        bool `json:"sessionErased"`
+	RefreshTokensRevoked int  `json:"refreshTokensRevoked"`
+	// VouchesErased and ReceiptsTombstoned count the holder's vouches and
+	// consent receipts, when the holder was named
+	VouchesErased      int `json:"vouchesErased"`
+	ReceiptsTombstoned int `json:"receiptsTombstoned"`
+	// ScreeningUnenrolled reports whether the screening provider was
+	// monitoring the subject
+	ScreeningUnenrolled bool `json:"screeningUnenrolled"`
+}
+
+// erasureReceiptClaims is the payload of a signed erasure receipt
+type erasureReceiptClaims struct {
+	jwt.RegisteredClaims
+	Erasure ErasureReceipt `json:"erasure"`
+}
+
+// SubjectErasureResponse carries the erasure receipt and its JWS, signed
+// with the tenant's issuer key so the subject can prove the erasure
+type SubjectErasureResponse struct {
+	Receipt ErasureReceipt `json:"receipt"`
+	JWS     string         `json:"jws"`
+}
+
+// ExportedCredential is a credential issued to the subject, as exported
+type ExportedCredential struct {
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	QualityTier     string    `json:"qualityTier,omitempty"`
+	StatusListIndex string    `json:"statusListIndex,omitempty"`
+	Revoked         bool      `json:"revoked"`
+	Suspended       bool      `json:"suspended"`
+	IssuedAt        time.Time `json:"issuedAt"`
+}
+
+// SubjectExport is everything held on a data subject, for portability.
+// Vouches and Receipts are as the vouching-service and receipts-log export
+// them, when the holder was named and the services are configured.
+type SubjectExport struct {
+	Subject        string                 `json:"subject"`
+	Holder         string                 `json:"holder,omitempty"`
+	Tenant         string                 `json:"tenant"`
+	ExportedAt     time.Time              `json:"exportedAt"`
+	Journey        IssuanceJourney        `json:"journey"`
+	Session        *VeriffSession         `json:"session,omitempty"`
+	QualityProfile *SessionQualityProfile `json:"qualityProfile,omitempty"`
+	Credentials    []ExportedCredential   `json:"credentials"`
+	AuditEvents    []AuditEvent           `json:"auditEvents"`
+	Vouches        json.RawMessage        `json:"vouches,omitempty"`
+	Receipts       json.RawMessage        `json:"receipts,omitempty"`
+}
+
+// subjectRequest resolves the subject of an erasure or export request: the
+// operator names the identity session, and the holder's DID when the
+// subject gave it. It answers the request itself and returns false when
+// the caller is not an operator or the tenant has no such subject.
+func (s *Server) subjectRequest(w http.ResponseWriter, r *http.Request) (IssuanceJourney, string, bool) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "subjects")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subjects"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return IssuanceJourney{}, "", false
+	}
+	holder := r.URL.Query().Get("holder")
+	if holder != "" && !didPattern.MatchString(holder) {
+		problem.Error(w, r, "holder must be a DID", http.StatusBadRequest)
+		return IssuanceJourney{}, "", false
+	}
+	journey, err := s.journeys.store.FindBySession(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrJourneyNotFound) || (err == nil && !ownsJourney(r.Context(), journey)) {
+		problem.Error(w, r, "Unknown subject", http.StatusNotFound)
+		return IssuanceJourney{}, "", false
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load the subject's journey")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return IssuanceJourney{}, "", false
+	}
+	return journey, holder, true
+}
+
+// issuedCredentials returns the credentials issued for an identity session
+func (s *Server) issuedCredentials(ctx context.Context, sessionID string) ([]AuditEvent, error) {
+	return s.auditLog.Query(ctx, AuditFilter{
+		Tenant:    tenant.FromContext(ctx).ID,
+		Type:      AuditCredentialIssued,
+		SessionID: sessionID,
+	})
+}
+
+// handleEraseSubject erases a data subject: it revokes the credentials
+// issued to them, drops their identity session from the vault along with
+// its quality profile and their refresh tokens, and, when the holder's DID
+// is given, has the vouching-service erase their vouches and the
+// receipts-log tombstone their consent receipts. The audit trail, which
+// carries no personal data, keeps a record of the erasure. Every step can
+// be repeated, so an erasure cut short by an unavailable service is
+// completed by asking again.
+func (s *Server) handleEraseSubject(w http.ResponseWriter, r *http.Request) {
+	journey, holder, ok := s.subjectRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	issuer := s.issuer(ctx)
+	now := time.Now().UTC()
+	receipt := ErasureReceipt{
+		ID:                 "urn:uuid:" + uuid.NewString(),
+		Issuer:             issuer.did,
+		Subject:            journey.SessionID,
+		Holder:             holder,
+		ErasedAt:           now.Truncate(time.Second),
+		RevokedCredentials: []string{},
+	}
+
+	issued, err := s.issuedCredentials(ctx, journey.SessionID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find the subject's credentials")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, credential := range issued {
+		changed, err := s.statusList.Revoke(ctx, credential.StatusListIndex)
+		if errors.Is(err, ErrStatusIndexUnallocated) {
+			log.Error().Str("credential_id", credential.CredentialID).Str("status_list_index", credential.StatusListIndex).Msg("The subject's credential has no index in the status lists and cannot be revoked")
+			receipt.UnrevokedCredentials = append(receipt.UnrevokedCredentials, credential.CredentialID)
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Str("credential_id", credential.CredentialID).Msg("Failed to revoke the subject's credential")
+			problem.Error(w, r, "Status lists unavailable, retry the erasure", http.StatusServiceUnavailable)
+			return
+		}
+		// Credentials revoked earlier, such as by a cut-short erasure, are
+		// recorded as revoked without being announced again
+		receipt.RevokedCredentials = append(receipt.RevokedCredentials, credential.CredentialID)
+		if !changed {
+			continue
+		}
+		revoked := events.CredentialRevoked{
+			CredentialID:    credential.CredentialID,
+			StatusListIndex: credential.StatusListIndex,
+			Reason:          revocationReasonErasure,
+			RevokedAt:       now,
+		}
+		s.publish(ctx, credential.CredentialID, revoked)
+		s.security.Record(ctx, audit.Event{
+			Type:   audit.TypeRevocation,
+			Action: "credential.revoked",
+			Actor:  "operator",
+			Target: credential.CredentialID,
+			Detail: revocationReasonErasure,
+		})
+	}
+	receipt.SessionErased = s.verifiedSessions.Erase(journey.SessionID)
+	receipt.RefreshTokensRevoked = s.refreshTokens.RevokeSession(journey.SessionID)
+
+	if holder != "" && s.vouching != nil {
+		if receipt.VouchesErased, err = s.vouching.EraseSubject(ctx, holder); err != nil {
+			log.Error().Err(err).Msg("Failed to erase the subject's vouches")
+			problem.Error(w, r, "Vouching service unavailable, retry the erasure", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if holder != "" && s.receipts != nil {
+		if receipt.ReceiptsTombstoned, err = s.receipts.Tombstone(ctx, holder); err != nil {
+			log.Error().Err(err).Msg("Failed to tombstone the subject's receipts")
+			problem.Error(w, r, "Receipts log unavailable, retry the erasure", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if reference, enrolled := s.screenings.Reference(journey.SessionID); enrolled && s.screening != nil {
+		if err := s.screening.Unenroll(ctx, reference); err != nil {
+			log.Error().Err(err).Msg("Failed to unenroll the subject from screening")
+			problem.Error(w, r, "Screening provider unavailable, retry the erasure", http.StatusServiceUnavailable)
+			return
+		}
+		s.screenings.Forget(journey.SessionID)
+		receipt.ScreeningUnenrolled = true
+	}
+
+	claims := erasureReceiptClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   issuer.did,
+			Subject:  journey.SessionID,
+			IssuedAt: jwt.NewNumericDate(now),
+			ID:       receipt.ID,
+		},
+		Erasure: receipt,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["typ"] = ErasureReceiptJWTType
+	token.Header["kid"] = signingKeyID(&issuer.signingKey.PublicKey)
+	signed, err := token.SignedString(issuer.signingKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign the erasure receipt")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAudit(ctx, AuditEvent{
+		Type:      AuditSubjectErased,
+		Actor:     "operator",
+		SessionID: journey.SessionID,
+		JourneyID: journey.ID,
+		Detail: fmt.Sprintf("receipt=%s credentials=%d unrevoked=%d vouches=%d receipts=%d",
+			receipt.ID, len(receipt.RevokedCredentials), len(receipt.UnrevokedCredentials), receipt.VouchesErased, receipt.ReceiptsTombstoned),
+	})
+	s.security.Record(ctx, audit.Event{Type: audit.TypeAdminAction, Action: "subject.erased", Actor: "operator", Target: journey.SessionID, Detail: receipt.ID})
+	log.Info().
+		Str("journey_id", journey.ID).
+		Str("receipt_id", receipt.ID).
+		Int("credentials", len(receipt.RevokedCredentials)).
+		Int("unrevoked", len(receipt.UnrevokedCredentials)).
+		Int("vouches", receipt.VouchesErased).
+		Int("receipts", receipt.ReceiptsTombstoned).
+		Msg("Data subject erased")
+	writeJSON(w, http.StatusOK, SubjectErasureResponse{Receipt: receipt, JWS: signed})
+}
+
+// handleExportSubject returns everything held on a data subject: their
+// issuance journey, identity session or what remains of it, credentials
+// and audit trail, and, when the holder's DID is given, their vouches and
+// consent receipt hashes
+func (s *Server) handleExportSubject(w http.ResponseWriter, r *http.Request) {
+	journey, holder, ok := s.subjectRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	export := SubjectExport{
+		Subject:     journey.SessionID,
+		Holder:      holder,
+		Tenant:      journey.Tenant,
+		ExportedAt:  time.Now().UTC(),
+		Journey:     journey,
+		Credentials: []ExportedCredential{},
+	}
+	if session, ok := s.verifiedSessions.Get(journey.SessionID); ok {
+		export.Session = &session
+	}
+	if profile, ok := s.verifiedSessions.Profile(journey.SessionID); ok {
+		export.QualityProfile = &profile
+	}
+
+	issued, err := s.issuedCredentials(ctx, journey.SessionID)
+	if err == nil {
+		export.AuditEvents, err = s.auditLog.Query(ctx, AuditFilter{Tenant: journey.Tenant, SessionID: journey.SessionID})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query the subject's audit trail")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, credential := range issued {
+		status, err := s.statusList.Status(ctx, credential.StatusListIndex)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read the status of the subject's credentials")
+			problem.Error(w, r, "Credential status unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		export.Credentials = append(export.Credentials, ExportedCredential{
+			ID:              credential.CredentialID,
+			Type:            credential.CredentialType,
+			QualityTier:     credential.QualityTier,
+			StatusListIndex: credential.StatusListIndex,
+			Revoked:         status == CredentialStatusRevoked,
+			Suspended:       status == CredentialStatusSuspended,
+			IssuedAt:        credential.Timestamp,
+		})
+	}
+	if export.AuditEvents == nil {
+		export.AuditEvents = []AuditEvent{}
+	}
+
+	if holder != "" && s.vouching != nil {
+		if export.Vouches, err = s.vouching.ExportSubject(ctx, holder); err != nil {
+			log.Error().Err(err).Msg("Failed to export the subject's vouches")
+			problem.Error(w, r, "Vouching service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if holder != "" && s.receipts != nil {
+		if export.Receipts, err = s.receipts.Export(ctx, holder); err != nil {
+			log.Error().Err(err).Msg("Failed to export the subject's receipts")
+			problem.Error(w, r, "Receipts log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, export)
+}
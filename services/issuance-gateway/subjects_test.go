@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHolder = "did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+
+// fakeSubjectServices plays the vouching-service and the receipts-log for
+// the holder's erasure and export, counting the erasures they were asked for
+func fakeSubjectServices(t *testing.T) (vouching, receipts *httptest.Server, erasures *int) {
+	t.Helper()
+	erasures = new(int)
+	vouching = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer vouching-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodGet && r.URL.Path == "/subjects/"+testHolder+"/export":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"subject": testHolder, "received": []string{"vouch-1"}})
+		case r.Method == http.MethodDelete && r.URL.Path == "/subjects/"+testHolder:
+			*erasures++
+			writeJSON(w, http.StatusOK, map[string]interface{}{"subject": testHolder, "erased": 2})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(vouching.Close)
+	receipts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/"+holderDigest(testHolder)+"/receipts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"receipts": []string{"urn:sha256:receipt"}})
+		case http.MethodDelete:
+			*erasures++
+			writeJSON(w, http.StatusOK, map[string]interface{}{"tombstoned": 3})
+		}
+	}))
+	t.Cleanup(receipts.Close)
+	return vouching, receipts, erasures
+}
+
+// securityTrail gives the server a security audit logger, returning the
+// store its events land in
+func securityTrail(t *testing.T, server *Server) *audit.Memory {
+	t.Helper()
+	store := audit.NewMemory()
+	var err error
+	server.security, err = audit.New("issuance-gateway", store, nil)
+	require.NoError(t, err)
+	return store
+}
+
+func TestSubjectErasure(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	trail := securityTrail(t, server)
+	w := issueAgeCredential(t, server, "erased-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/erased-session", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var erasure SubjectErasureResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.Equal(t, "erased-session", erasure.Receipt.Subject)
+	assert.Equal(t, []string{credResp.Credential.ID}, erasure.Receipt.RevokedCredentials)
+	assert.True(t, erasure.Receipt.SessionErased)
+
+	// The receipt is signed with the issuer key the DID document publishes
+	var doc DIDDocument
+	getWellKnown(t, server, "/.well-known/did.json", &doc)
+	var claims erasureReceiptClaims
+	token, err := jwt.ParseWithClaims(erasure.JWS, &claims, func(token *jwt.Token) (interface{}, error) {
+		return doc.VerificationMethod[0].PublicKeyJwk.PublicKey()
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	require.NoError(t, err)
+	assert.Equal(t, ErasureReceiptJWTType, token.Header["typ"])
+	assert.Equal(t, erasure.Receipt, claims.Erasure)
+	assert.Equal(t, doc.ID, claims.Issuer)
+
+	// The credential is revoked and the identity session gone
+	assert.Equal(t, CredentialStatusRevoked, credentialStatus(t, server, credResp.Credential.statusListIndex()))
+	_, ok := server.verifiedSessions.Get("erased-session")
+	assert.False(t, ok)
+	_, page := getAudit(t, server, "?type="+AuditSubjectErased, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, "erased-session", page.Events[0].SessionID)
+	security, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, security, 2)
+	assert.Equal(t, audit.TypeRevocation, security[0].Type)
+	assert.Equal(t, credResp.Credential.ID, security[0].Target)
+	assert.Equal(t, "subject.erased", security[1].Action)
+	assert.Equal(t, security[0].Hash, security[1].Prev)
+
+	// The export keeps the journey and credentials, without the session
+	w = operatorRequest(t, server, http.MethodGet, "/subjects/erased-session/export", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var export SubjectExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	assert.Nil(t, export.Session)
+	require.Len(t, export.Credentials, 1)
+	assert.True(t, export.Credentials[0].Revoked)
+
+	// Erasing again succeeds with nothing left in the vault
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/erased-session", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.False(t, erasure.Receipt.SessionErased)
+}
+
+func TestSubjectErasure_NamedHolder(t *testing.T) {
+	vouching, receipts, erasures := fakeSubjectServices(t)
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	server.vouching = newVouchingClient(vouching.URL, "vouching-token")
+	server.receipts = newReceiptsLogClient(receipts.URL, nil)
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", approvedSession("holder-session"), nil).Code)
+
+	w := operatorRequest(t, server, http.MethodGet, "/subjects/holder-session/export?holder="+testHolder, "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var export SubjectExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	require.NotNil(t, export.Session)
+	assert.JSONEq(t, `{"subject":"`+testHolder+`","received":["vouch-1"]}`, string(export.Vouches))
+	assert.JSONEq(t, `{"receipts":["urn:sha256:receipt"]}`, string(export.Receipts))
+
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/holder-session?holder="+testHolder, "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var erasure SubjectErasureResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.Equal(t, testHolder, erasure.Receipt.Holder)
+	assert.Equal(t, 2, erasure.Receipt.VouchesErased)
+	assert.Equal(t, 3, erasure.Receipt.ReceiptsTombstoned)
+	assert.Equal(t, 2, *erasures)
+
+	// An unavailable receipts-log leaves the erasure to be retried
+	receipts.Close()
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/holder-session?holder="+testHolder, "operator-secret")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+// unavailableStatusLists fails every status change, as a store whose
+// database is down
+type unavailableStatusLists struct {
+	StatusListStore
+}
+
+func (unavailableStatusLists) Set(ctx context.Context, list, purpose string, index int, value bool) (bool, error) {
+	return false, errors.New("database unavailable")
+}
+
+func TestSubjectErasure_RevocationFails(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	w := issueAgeCredential(t, server, "unrevoked-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	store := server.statusList.store
+
+	// Unavailable status lists fail the erasure, which is retried whole
+	server.statusList.store = unavailableStatusLists{store}
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/unrevoked-session", "operator-secret")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	_, ok := server.verifiedSessions.Profile("unrevoked-session")
+	assert.True(t, ok, "nothing is erased before the credentials are revoked")
+
+	// A credential whose index the lists lost is reported, not claimed revoked
+	server.statusList.store = newMemoryStatusListStore()
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/unrevoked-session", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var erasure SubjectErasureResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.Empty(t, erasure.Receipt.RevokedCredentials)
+	assert.Equal(t, []string{credResp.Credential.ID}, erasure.Receipt.UnrevokedCredentials)
+
+	// Once revoked, asking again records the credential as revoked
+	server.statusList.store = store
+	revokeCredential(t, server, credResp.Credential.statusListIndex())
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/unrevoked-session", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var repeated SubjectErasureResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &repeated))
+	assert.Equal(t, []string{credResp.Credential.ID}, repeated.Receipt.RevokedCredentials)
+	assert.Empty(t, repeated.Receipt.UnrevokedCredentials)
+}
+
+func TestSubjectErasure_Refused(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	trail := securityTrail(t, server)
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", approvedSession("kept-session"), nil).Code)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"no token", http.MethodDelete, "/subjects/kept-session", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/subjects/kept-session/export", "wrong", http.StatusUnauthorized},
+		{"unknown session", http.MethodDelete, "/subjects/unknown-session", "operator-secret", http.StatusNotFound},
+		{"holder not a DID", http.MethodDelete, "/subjects/kept-session?holder=alice", "operator-secret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, operatorRequest(t, server, tt.method, tt.path, tt.token).Code)
+		})
+	}
+	_, ok := server.verifiedSessions.Get("kept-session")
+	assert.True(t, ok)
+
+	// Refused tokens are kept in the security audit trail
+	security, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, security, 2)
+	assert.Equal(t, audit.TypeAuthFailure, security[0].Type)
+	assert.Equal(t, "DELETE /subjects/kept-session", security[0].Action)
+	assert.Equal(t, "subjects", security[1].Detail)
+}
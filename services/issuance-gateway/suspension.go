@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Credential statuses as the status lists report them
+const (
+	CredentialStatusActive    = "active"
+	CredentialStatusSuspended = "suspended"
+	CredentialStatusRevoked   = "revoked"
+)
+
+// SuspendCredentialRequest is the body of POST /credentials/{id}/suspend
+type SuspendCredentialRequest struct {
+	// Reason is why the credential is held, such as a fraud investigation
+	Reason string `json:"reason"`
+}
+
+// CredentialStatusResponse reports a credential's status after an
+// operator suspended or reinstated it
+type CredentialStatusResponse struct {
+	ID              string `json:"id"`
+	StatusListIndex string `json:"statusListIndex"`
+	Status          string `json:"status"`
+}
+
+// findIssuedCredential finds the issuance record of one of the tenant's
+// credentials
+func (s *Server) findIssuedCredential(ctx context.Context, id string) (AuditEvent, bool, error) {
+	issued, err := s.auditLog.Query(ctx, AuditFilter{
+		Tenant:       tenant.FromContext(ctx).ID,
+		Type:         AuditCredentialIssued,
+		CredentialID: id,
+		Limit:        1,
+	})
+	if err != nil || len(issued) == 0 {
+		return AuditEvent{}, false, err
+	}
+	return issued[0], true, nil
+}
+
+// credentialHoldRequest resolves the credential an operator suspends or
+// reinstates. It answers the request itself and returns false when the
+// caller is not an operator, the tenant issued no such credential or it
+// was revoked, which is final.
+func (s *Server) credentialHoldRequest(w http.ResponseWriter, r *http.Request) (AuditEvent, bool) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return AuditEvent{}, false
+	}
+	credential, found, err := s.findIssuedCredential(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find the issued credential")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return AuditEvent{}, false
+	}
+	if !found {
+		problem.Error(w, r, "Credential not found", http.StatusNotFound)
+		return AuditEvent{}, false
+	}
+	status, err := s.statusList.Status(r.Context(), credential.StatusListIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the credential's status")
+		problem.Error(w, r, "Credential status unavailable", http.StatusServiceUnavailable)
+		return AuditEvent{}, false
+	}
+	if status == CredentialStatusRevoked {
+		problem.Error(w, r, "Credential revoked", http.StatusConflict)
+		return AuditEvent{}, false
+	}
+	return credential, true
+}
+
+// handleSuspendCredential puts a credential on hold by setting its bit in
+// the suspension list: verifiers report it suspended rather than revoked
+// until an operator reinstates it. Suspending a suspended credential
+// changes nothing.
+func (s *Server) handleSuspendCredential(w http.ResponseWriter, r *http.Request) {
+	credential, ok := s.credentialHoldRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SuspendCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Reason == "" {
+		problem.Error(w, r, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.suspendCredential(r.Context(), credential, "operator", req.Reason); err != nil {
+		log.Error().Err(err).Msg("Failed to suspend the credential")
+		problem.Error(w, r, "Credential status unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, CredentialStatusResponse{
+		ID:              credential.CredentialID,
+		StatusListIndex: credential.StatusListIndex,
+		Status:          CredentialStatusSuspended,
+	})
+}
+
+// suspendCredential puts an issued credential on hold for reason,
+// reporting whether it was not already suspended
+func (s *Server) suspendCredential(ctx context.Context, credential AuditEvent, actor, reason string) (bool, error) {
+	if suspended, err := s.statusList.Suspend(ctx, credential.StatusListIndex); err != nil || !suspended {
+		return false, err
+	}
+	s.publish(ctx, credential.CredentialID, events.CredentialSuspended{
+		CredentialID:    credential.CredentialID,
+		StatusListIndex: credential.StatusListIndex,
+		Reason:          reason,
+		SuspendedAt:     time.Now().UTC(),
+	})
+	s.security.Record(ctx, audit.Event{
+		Type:   audit.TypeRevocation,
+		Action: "credential.suspended",
+		Actor:  actor,
+		Target: credential.CredentialID,
+		Detail: reason,
+	})
+	s.recordAudit(ctx, AuditEvent{
+		Type:            AuditCredentialSuspended,
+		Actor:           actor,
+		SessionID:       credential.SessionID,
+		JourneyID:       credential.JourneyID,
+		CredentialType:  credential.CredentialType,
+		CredentialID:    credential.CredentialID,
+		StatusListIndex: credential.StatusListIndex,
+		Detail:          reason,
+	})
+	log.Info().Str("credential_id", credential.CredentialID).Str("actor", actor).Msg("Credential suspended")
+	return true, nil
+}
+
+// handleReinstateCredential lifts a credential's suspension. Reinstating a
+// credential that is not suspended changes nothing.
+func (s *Server) handleReinstateCredential(w http.ResponseWriter, r *http.Request) {
+	credential, ok := s.credentialHoldRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	reinstated, err := s.statusList.Reinstate(ctx, credential.StatusListIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reinstate the credential")
+		problem.Error(w, r, "Credential status unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if reinstated {
+		s.publish(ctx, credential.CredentialID, events.CredentialReinstated{
+			CredentialID:    credential.CredentialID,
+			StatusListIndex: credential.StatusListIndex,
+			ReinstatedAt:    time.Now().UTC(),
+		})
+		s.security.Record(ctx, audit.Event{
+			Type:   audit.TypeRevocation,
+			Action: "credential.reinstated",
+			Actor:  "operator",
+			Target: credential.CredentialID,
+		})
+		s.recordAudit(ctx, AuditEvent{
+			Type:            AuditCredentialReinstated,
+			Actor:           "operator",
+			SessionID:       credential.SessionID,
+			JourneyID:       credential.JourneyID,
+			CredentialType:  credential.CredentialType,
+			CredentialID:    credential.CredentialID,
+			StatusListIndex: credential.StatusListIndex,
+		})
+		log.Info().Str("credential_id", credential.CredentialID).Msg("Credential reinstated")
+	}
+	writeJSON(w, http.StatusOK, CredentialStatusResponse{
+		ID:              credential.CredentialID,
+		StatusListIndex: credential.StatusListIndex,
+		Status:          CredentialStatusActive,
+	})
+}
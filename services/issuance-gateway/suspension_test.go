@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialSuspension(t *testing.T) {
+	bus := events.NewMemory()
+	var published []events.Event
+	require.NoError(t, bus.Subscribe("connector-hub", []string{events.TypeCredentialSuspended, events.TypeCredentialReinstated}, func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	}))
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	server.events = bus
+	trail := securityTrail(t, server)
+	w := issueAgeCredential(t, server, "suspended-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	credential := credResp.Credential
+	index := credential.statusListIndex()
+
+	// The credential has an entry in each list, at the same index
+	require.Len(t, credential.CredentialStatus, 2)
+	assert.Equal(t, statusPurposeRevocation, credential.CredentialStatus[0].StatusPurpose)
+	assert.Equal(t, statusPurposeSuspension, credential.CredentialStatus[1].StatusPurpose)
+	assert.Equal(t, defaultStatusListURL+"/suspension", credential.CredentialStatus[1].StatusListCredential)
+	assert.Equal(t, index, credential.CredentialStatus[1].StatusListIndex)
+
+	w = postJSON(t, server, "/credentials/"+credential.ID+"/suspend", SuspendCredentialRequest{Reason: "fraud investigation"}, operatorHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status CredentialStatusResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, CredentialStatusSuspended, status.Status)
+	assert.Equal(t, CredentialStatusSuspended, credentialStatus(t, server, index))
+
+	// Suspending again changes nothing
+	w = postJSON(t, server, "/credentials/"+credential.ID+"/suspend", SuspendCredentialRequest{Reason: "fraud investigation"}, operatorHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, page := getAudit(t, server, "?type="+AuditCredentialSuspended, "operator-secret")
+	require.Len(t, page.Events, 1)
+	assert.Equal(t, credential.ID, page.Events[0].CredentialID)
+	assert.Equal(t, "fraud investigation", page.Events[0].Detail)
+
+	w = operatorRequest(t, server, http.MethodGet, "/subjects/suspended-session/export", "operator-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var export SubjectExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	require.Len(t, export.Credentials, 1)
+	assert.True(t, export.Credentials[0].Suspended)
+	assert.False(t, export.Credentials[0].Revoked)
+
+	w = postJSON(t, server, "/credentials/"+credential.ID+"/reinstate", nil, operatorHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, CredentialStatusActive, status.Status)
+	assert.NotEqual(t, CredentialStatusSuspended, credentialStatus(t, server, index))
+	_, page = getAudit(t, server, "?type="+AuditCredentialReinstated, "operator-secret")
+	require.Len(t, page.Events, 1)
+
+	require.NoError(t, bus.Close())
+	require.Len(t, published, 2)
+	var suspended events.CredentialSuspended
+	require.NoError(t, published[0].Decode(&suspended))
+	assert.Equal(t, credential.ID, suspended.CredentialID)
+	assert.Equal(t, "fraud investigation", suspended.Reason)
+	assert.Equal(t, events.TypeCredentialReinstated, published[1].Type)
+	security, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, security, 2)
+	assert.Equal(t, "credential.suspended", security[0].Action)
+	assert.Equal(t, "credential.reinstated", security[1].Action)
+}
+
+func TestCredentialSuspension_Refused(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "operator-secret"
+	w := issueAgeCredential(t, server, "refused-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var credResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &credResp))
+	credential := credResp.Credential
+	w = issueAgeCredential(t, server, "revoked-session")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var revokedResp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &revokedResp))
+	revoked := revokedResp.Credential
+	revokeCredential(t, server, revoked.statusListIndex())
+
+	reason := SuspendCredentialRequest{Reason: "fraud investigation"}
+	tests := []struct {
+		name    string
+		path    string
+		req     interface{}
+		headers map[string]string
+		status  int
+	}{
+		{"no operator token", "/credentials/" + credential.ID + "/suspend", reason, nil, http.StatusUnauthorized},
+		{"no reason", "/credentials/" + credential.ID + "/suspend", SuspendCredentialRequest{}, operatorHeaders, http.StatusBadRequest},
+		{"unknown credential", "/credentials/urn:uuid:unknown/suspend", reason, operatorHeaders, http.StatusNotFound},
+		{"revoked credential", "/credentials/" + revoked.ID + "/suspend", reason, operatorHeaders, http.StatusConflict},
+		{"reinstating a revoked credential", "/credentials/" + revoked.ID + "/reinstate", nil, operatorHeaders, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, server, tt.path, tt.req, tt.headers)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+		})
+	}
+	assert.NotEqual(t, CredentialStatusSuspended, credentialStatus(t, server, credential.statusListIndex()))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// tenantSettings is the gateway's section of a tenant in TENANTS_CONFIG
+type tenantSettings struct {
+	Issuer struct {
+		// DID the tenant issues credentials as; required but for the
+		// default tenant, which keeps issuerDID
+		DID string `yaml:"did"`
+		// SigningKey is a PEM file holding the tenant's RSA key; a key is
+		// generated at startup without one
+		SigningKey string `yaml:"signingKey"`
+		// CredentialConfigurations the tenant offers; all of them without
+		CredentialConfigurations []string `yaml:"credentialConfigurations"`
+	} `yaml:"issuer"`
+}
+
+// tenantIssuer is the credential issuer a tenant presents to wallets: the
+// DID its credentials name, the key its tokens are signed with and the
+// credential configurations it offers
+type tenantIssuer struct {
+	did        string
+	signingKey *rsa.PrivateKey
+	// bbsKey signs the credentials issued as ldp_vc
+	bbsKey  *bbs.PrivateKey
+	offered map[string]bool // nil offers every configuration
+}
+
+// offers reports whether the issuer issues the configuration
+func (i *tenantIssuer) offers(configID string) bool {
+	return i.offered == nil || i.offered[configID]
+}
+
+// configurations returns the credential configurations the issuer offers
+func (i *tenantIssuer) configurations() map[string]CredentialConfiguration {
+	offered := make(map[string]CredentialConfiguration, len(credentialConfigurations))
+	for id, config := range credentialConfigurations {
+		if i.offers(id) {
+			offered[id] = config
+		}
+	}
+	return offered
+}
+
+// configurationIDs returns the ids of the configurations the issuer
+// offers, sorted
+func (i *tenantIssuer) configurationIDs() []string {
+	ids := make([]string, 0, len(credentialConfigurations))
+	for id := range i.configurations() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// unofferedScopes returns the requested scopes of configurations the issuer
+// does not offer
+func (i *tenantIssuer) unofferedScopes(scope string) []string {
+	var unoffered []string
+	for _, requested := range strings.Fields(scope) {
+		for id, config := range credentialConfigurations {
+			if config.Scope == requested && !i.offers(id) {
+				unoffered = append(unoffered, requested)
+				break
+			}
+		}
+	}
+	return unoffered
+}
+
+// issuer returns the issuer of the tenant a request belongs to
+func (s *Server) issuer(ctx context.Context) *tenantIssuer {
+	return s.issuerOf(tenant.FromContext(ctx).ID)
+}
+
+// issuerOf returns the issuer of a tenant, the gateway's own for the
+// default tenant and tenants the gateway has no settings for
+func (s *Server) issuerOf(tenantID string) *tenantIssuer {
+	if issuer, ok := s.issuers[tenantID]; ok {
+		return issuer
+	}
+	return &tenantIssuer{did: issuerDID, signingKey: s.signingKey, bbsKey: s.bbsKey}
+}
+
+// setTenants serves the tenants of TENANTS_CONFIG, each as its own issuer
+func (s *Server) setTenants(entries []tenant.Entry[tenantSettings]) error {
+	issuers := make(map[string]*tenantIssuer, len(entries))
+	for _, entry := range entries {
+		settings := entry.Settings.Issuer
+		issuer := &tenantIssuer{did: settings.DID, signingKey: s.signingKey, bbsKey: s.bbsKey}
+		if issuer.did == "" {
+			if entry.ID != tenant.DefaultID {
+				return fmt.Errorf("tenant %s: issuer.did is required", entry.ID)
+			}
+			issuer.did = issuerDID
+		}
+		switch {
+		case settings.SigningKey != "":
+			key, err := loadRSAKey(settings.SigningKey)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %w", entry.ID, err)
+			}
+			issuer.signingKey = key
+		case entry.ID != tenant.DefaultID:
+			// Tokens of one tenant must never verify under another
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				return fmt.Errorf("tenant %s: generating signing key: %w", entry.ID, err)
+			}
+			log.Warn().Str("tenant", entry.ID).Msg("Tenant has no issuer.signingKey, so its tokens do not survive restarts")
+			issuer.signingKey = key
+		}
+		if entry.ID != tenant.DefaultID {
+			// Nor may its credentials
+			key, err := bbs.GenerateKey(nil)
+			if err != nil {
+				return fmt.Errorf("tenant %s: generating BBS key: %w", entry.ID, err)
+			}
+			issuer.bbsKey = key
+		}
+		if len(settings.CredentialConfigurations) > 0 {
+			issuer.offered = map[string]bool{}
+			for _, id := range settings.CredentialConfigurations {
+				if _, ok := credentialConfigurations[id]; !ok {
+					return fmt.Errorf("tenant %s: unknown credential configuration %q", entry.ID, id)
+				}
+				issuer.offered[id] = true
+			}
+		}
+		issuers[entry.ID] = issuer
+	}
+	if err := s.tenants.Set(tenant.Tenants(entries)); err != nil {
+		return err
+	}
+	s.issuers = issuers
+	return nil
+}
+
+// loadRSAKey reads a PEM-encoded RSA private key, PKCS #1 or PKCS #8
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
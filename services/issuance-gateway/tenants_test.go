@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTenantServer serves the default tenant and acme, which issues only
+// age credentials under its own DID
+func newTenantServer(t *testing.T) *Server {
+	t.Helper()
+	server := NewServer()
+	acme := tenant.Entry[tenantSettings]{Tenant: tenant.Tenant{ID: "acme", Name: "Acme ID"}}
+	acme.Settings.Issuer.DID = "did:web:id.acme.example"
+	acme.Settings.Issuer.CredentialConfigurations = []string{CredentialTypeAgeOver}
+	require.NoError(t, server.setTenants([]tenant.Entry[tenantSettings]{acme}))
+	return server
+}
+
+func TestTenants_IssuerMetadata(t *testing.T) {
+	server := newTenantServer(t)
+
+	var metadata struct {
+		CredentialIssuer string                     `json:"credential_issuer"`
+		Endpoint         string                     `json:"credential_endpoint"`
+		Notification     string                     `json:"notification_endpoint"`
+		Configurations   map[string]json.RawMessage `json:"credential_configurations_supported"`
+	}
+	getWellKnown(t, server, "/t/acme/.well-known/openid-credential-issuer", &metadata)
+	assert.Equal(t, "did:web:id.acme.example", metadata.CredentialIssuer)
+	assert.Equal(t, "/t/acme/v1/credential", metadata.Endpoint)
+	assert.Equal(t, "/t/acme/v1/notification", metadata.Notification)
+	assert.Len(t, metadata.Configurations, 1)
+	assert.Contains(t, metadata.Configurations, CredentialTypeAgeOver)
+
+	var acmeDoc, defaultDoc DIDDocument
+	getWellKnown(t, server, "/t/acme/.well-known/did.json", &acmeDoc)
+	getWellKnown(t, server, "/.well-known/did.json", &defaultDoc)
+	assert.Equal(t, "did:web:id.acme.example", acmeDoc.ID)
+	assert.Equal(t, issuerDID, defaultDoc.ID)
+	assert.NotEqual(t, acmeDoc.VerificationMethod[0].PublicKeyJwk, defaultDoc.VerificationMethod[0].PublicKeyJwk, "tenants sign with their own keys")
+
+	assert.ErrorContains(t, server.setTenants([]tenant.Entry[tenantSettings]{{Tenant: tenant.Tenant{ID: "globex"}}}), "issuer.did is required")
+}
+
+func TestTenants_ScopedIssuance(t *testing.T) {
+	server := newTenantServer(t)
+	server.operatorToken = "operator-secret"
+
+	w := postJSON(t, server, "/t/acme/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "acme-wallet",
+		Scope:     ScopeIdentityCredential,
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeInvalidScope, decodeError(t, w).Code)
+
+	w = postJSON(t, server, "/t/acme/issuance/journeys", CreateJourneyRequest{SessionID: "acme-session", ClientID: "acme-wallet"}, operatorHeaders)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/t/acme/webhooks/veriff", approvedSession("acme-session"), nil).Code)
+	// The session is acme's: the default tenant cannot bind a token to it
+	w = postJSON(t, server, "/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "test-wallet",
+		Scope:     ScopeCredentialIssuance,
+		SessionID: "acme-session",
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON(t, server, "/t/acme/oauth/token", TokenRequest{
+		GrantType: GrantTypeClientCredentials,
+		ClientID:  "acme-wallet",
+		Scope:     ScopeCredentialIssuance,
+		SessionID: "acme-session",
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var token TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+	auth := map[string]string{"Authorization": "Bearer " + token.AccessToken}
+
+	// Acme's tokens do not verify under the default tenant's key
+	w = postJSON(t, server, "/credential", CredentialRequest{Format: "jwt_vc", Types: []string{CredentialTypeAgeOver}}, auth)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postJSON(t, server, "/t/acme/credential", CredentialRequest{Format: "jwt_vc", Types: []string{CredentialTypeIdentity}}, auth)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, ErrCodeUnsupportedCredentialType, decodeError(t, w).Code)
+
+	w = postJSON(t, server, "/t/acme/credential", CredentialRequest{Format: "jwt_vc", Types: []string{CredentialTypeAgeOver}, Proof: credentialProof(t, newWalletKey(t), "did:web:id.acme.example")}, auth)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "did:web:id.acme.example", resp.Credential.Issuer)
+
+	// Journeys are listed to their own tenant only
+	server.operatorToken = "operator-secret"
+	for path, want := range map[string]int{"/t/acme/issuance/journeys": 1, "/issuance/journeys": 0} {
+		w = operatorRequest(t, server, http.MethodGet, path, "operator-secret")
+		require.Equal(t, http.StatusOK, w.Code)
+		var listing struct {
+			Journeys []IssuanceJourney `json:"journeys"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+		require.Len(t, listing.Journeys, want, path)
+		if want > 0 {
+			assert.Equal(t, "acme", listing.Journeys[0].Tenant)
+			assert.Equal(t, StateCredentialIssued, listing.Journeys[0].State)
+		}
+	}
+}
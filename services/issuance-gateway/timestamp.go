@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/rs/zerolog/log"
+)
+
+// Evidence types of the timestamps embedded in issued credentials
+const (
+	EvidenceRFC3161Timestamp  = "RFC3161Timestamp"
+	EvidenceReceiptsLogAnchor = "ReceiptsLogAnchor"
+)
+
+var ErrTimestampUnavailable = errors.New("credential timestamping unavailable")
+
+// TimestampConfig selects how issued credentials are timestamped: by an
+// RFC 3161 time-stamping authority, or by anchoring their digest in the
+// receipts log. Credentials are not timestamped without either.
+type TimestampConfig struct {
+	TSAURL string `env:"CREDENTIAL_TIMESTAMP_TSA_URL" doc:"RFC 3161 time-stamping authority whose timestamp token each issued credential carries in its evidence"`
+	Anchor bool   `env:"CREDENTIAL_TIMESTAMP_ANCHOR" doc:"Anchor the digest of each issued credential in the receipts log (RECEIPTS_LOG_URL) and reference it in the credential's evidence, instead of a TSA"`
+}
+
+// Validate checks the TSA URL is an http(s) URL and at most one way of
+// timestamping is chosen
+func (c TimestampConfig) Validate() error {
+	if c.TSAURL != "" {
+		u, err := url.Parse(c.TSAURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("CREDENTIAL_TIMESTAMP_TSA_URL must be an http(s) URL")
+		}
+		if c.Anchor {
+			return errors.New("set CREDENTIAL_TIMESTAMP_TSA_URL or CREDENTIAL_TIMESTAMP_ANCHOR, not both")
+		}
+	}
+	return nil
+}
+
+// TimestampEvidence proves when a credential existed. Digest is the
+// urn:sha256 digest of the credential's JSON encoding without its
+// evidence; the timestamp token signs it, or the receipts log holds it.
+type TimestampEvidence struct {
+	Type      string    `json:"type"`
+	Digest    string    `json:"digest"`
+	Timestamp time.Time `json:"timestamp"`
+	// Authority is the TSA or receipts log that vouches for the time
+	Authority string `json:"authority"`
+	// TimestampToken is the TSA's DER TimeStampToken, base64 encoded
+	TimestampToken string `json:"timestampToken,omitempty"`
+}
+
+// credentialTimestamper proves when a credential digest existed
+type credentialTimestamper interface {
+	Timestamp(ctx context.Context, digest string) (TimestampEvidence, error)
+}
+
+// timestampCredential adds the proof of when the credential existed to its
+// evidence. Timestamping failures are logged, not fatal: the credential is
+// issued without the proof.
+func (s *Server) timestampCredential(ctx context.Context, vc *VerifiableCredential) {
+	if s.timestamps == nil {
+		return
+	}
+	unstamped := *vc
+	unstamped.Evidence = nil
+	digest, err := credentialDigest(unstamped)
+	if err != nil {
+		log.Error().Err(err).Str("credential_id", vc.ID).Msg("Failed to hash credential for timestamping")
+		return
+	}
+	evidence, err := s.timestamps.Timestamp(ctx, "urn:sha256:"+digest)
+	if err != nil {
+		log.Warn().Err(err).Str("credential_id", vc.ID).Msg("Failed to timestamp credential")
+		return
+	}
+	vc.Evidence = append(vc.Evidence, evidence)
+}
+
+// RFC 3161 object identifiers
+var (
+	oidSHA256      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignedData  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	tsaStatusNames = map[int]string{2: "rejection", 3: "waiting", 4: "revocationWarning", 5: "revocationNotification"}
+)
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// tsaRequest is an RFC 3161 TimeStampReq
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+// tsaResponse is an RFC 3161 TimeStampResp; the token is a CMS
+// ContentInfo holding SignedData
+type tsaResponse struct {
+	Status struct {
+		Status       int
+		StatusString []string `asn1:"optional"`
+	}
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsaContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type tsaSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,tag:0"`
+	}
+}
+
+// tsaTSTInfo is the start of the TSTInfo the TSA signs; the fields after
+// the nonce are not needed
+type tsaTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       struct {
+		Seconds int `asn1:"optional"`
+		Millis  int `asn1:"optional,tag:0"`
+		Micros  int `asn1:"optional,tag:1"`
+	} `asn1:"optional"`
+	Ordering bool     `asn1:"optional"`
+	Nonce    *big.Int `asn1:"optional"`
+}
+
+// tsaClient obtains RFC 3161 timestamps from a time-stamping authority
+type tsaClient struct {
+	client *http.Client
+	url    string
+}
+
+func newTSAClient(tsaURL string) *tsaClient {
+	return &tsaClient{client: deadline.NewClient("tsa"), url: tsaURL}
+}
+
+// Timestamp has the TSA sign the digest and the time, checking the token
+// answers this request; relying parties check the TSA's signature
+func (c *tsaClient) Timestamp(ctx context.Context, digest string) (TimestampEvidence, error) {
+	hashed, err := hex.DecodeString(strings.TrimPrefix(digest, "urn:sha256:"))
+	if err != nil {
+		return TimestampEvidence{}, fmt.Errorf("invalid digest %q: %w", digest, err)
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return TimestampEvidence{}, err
+	}
+	body, err := asn1.Marshal(tsaRequest{
+		Version: 1,
+		MessageImprint: tsaMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: hashed,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return TimestampEvidence{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return TimestampEvidence{}, err
+	}
+	req.Header.Set("Content-Type", "application/timestamp-query")
+	req.Header.Set("Accept", "application/timestamp-reply")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return TimestampEvidence{}, fmt.Errorf("%w: %v", ErrTimestampUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return TimestampEvidence{}, fmt.Errorf("%w: TSA returned %d", ErrTimestampUnavailable, resp.StatusCode)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return TimestampEvidence{}, fmt.Errorf("%w: %v", ErrTimestampUnavailable, err)
+	}
+
+	token, info, err := parseTSAResponse(reply)
+	if err != nil {
+		return TimestampEvidence{}, fmt.Errorf("%w: %v", ErrTimestampUnavailable, err)
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, hashed) {
+		return TimestampEvidence{}, fmt.Errorf("%w: the token timestamps another digest", ErrTimestampUnavailable)
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return TimestampEvidence{}, fmt.Errorf("%w: the token answers another request", ErrTimestampUnavailable)
+	}
+	return TimestampEvidence{
+		Type:           EvidenceRFC3161Timestamp,
+		Digest:         digest,
+		Timestamp:      info.GenTime.UTC(),
+		Authority:      c.url,
+		TimestampToken: base64.StdEncoding.EncodeToString(token),
+	}, nil
+}
+
+// parseTSAResponse returns the DER timestamp token of a granted
+// TimeStampResp and the TSTInfo it signs
+func parseTSAResponse(reply []byte) ([]byte, tsaTSTInfo, error) {
+	var resp tsaResponse
+	if _, err := asn1.Unmarshal(reply, &resp); err != nil {
+		return nil, tsaTSTInfo{}, fmt.Errorf("decoding TimeStampResp: %w", err)
+	}
+	// granted or grantedWithMods
+	if resp.Status.Status > 1 {
+		status, known := tsaStatusNames[resp.Status.Status]
+		if !known {
+			status = fmt.Sprintf("status %d", resp.Status.Status)
+		}
+		return nil, tsaTSTInfo{}, fmt.Errorf("TSA refused the request: %s %s", status, strings.Join(resp.Status.StatusString, "; "))
+	}
+	var content tsaContentInfo
+	if _, err := asn1.Unmarshal(resp.TimeStampToken.FullBytes, &content); err != nil {
+		return nil, tsaTSTInfo{}, fmt.Errorf("decoding TimeStampToken: %w", err)
+	}
+	if !content.ContentType.Equal(oidSignedData) {
+		return nil, tsaTSTInfo{}, fmt.Errorf("TimeStampToken holds %v, not SignedData", content.ContentType)
+	}
+	var signed tsaSignedData
+	if _, err := asn1.Unmarshal(content.Content.Bytes, &signed); err != nil {
+		return nil, tsaTSTInfo{}, fmt.Errorf("decoding SignedData: %w", err)
+	}
+	if !signed.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, tsaTSTInfo{}, fmt.Errorf("SignedData holds %v, not TSTInfo", signed.EncapContentInfo.EContentType)
+	}
+	var info tsaTSTInfo
+	if _, err := asn1.Unmarshal(signed.EncapContentInfo.EContent, &info); err != nil {
+		return nil, tsaTSTInfo{}, fmt.Errorf("decoding TSTInfo: %w", err)
+	}
+	return resp.TimeStampToken.FullBytes, info, nil
+}
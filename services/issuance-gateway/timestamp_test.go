@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var tsaGenTime = time.Date(2026, 3, 14, 9, 26, 53, 0, time.UTC)
+
+// tsaHost is a time-stamping authority granting every request, with an
+// unsigned token; tamper alters the TSTInfo before it is returned
+func tsaHost(t *testing.T, tamper func(info *tsaTSTInfo)) *httptest.Server {
+	t.Helper()
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/timestamp-query", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var req tsaRequest
+		_, err = asn1.Unmarshal(body, &req)
+		require.NoError(t, err)
+
+		info := tsaTSTInfo{
+			Version:        1,
+			Policy:         asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+			MessageImprint: req.MessageImprint,
+			SerialNumber:   big.NewInt(42),
+			GenTime:        tsaGenTime,
+			Nonce:          req.Nonce,
+		}
+		if tamper != nil {
+			tamper(&info)
+		}
+		encodedInfo, err := asn1.Marshal(struct {
+			Version        int
+			Policy         asn1.ObjectIdentifier
+			MessageImprint tsaMessageImprint
+			SerialNumber   *big.Int
+			GenTime        time.Time `asn1:"generalized"`
+			Nonce          *big.Int  `asn1:"optional"`
+		}{info.Version, info.Policy, info.MessageImprint, info.SerialNumber, info.GenTime, info.Nonce})
+		require.NoError(t, err)
+		signed, err := asn1.Marshal(struct {
+			Version          int
+			DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+			EncapContentInfo struct {
+				EContentType asn1.ObjectIdentifier
+				EContent     []byte `asn1:"explicit,tag:0"`
+			}
+			SignerInfos []asn1.RawValue `asn1:"set"`
+		}{
+			Version:          3,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+			EncapContentInfo: struct {
+				EContentType asn1.ObjectIdentifier
+				EContent     []byte `asn1:"explicit,tag:0"`
+			}{oidTSTInfo, encodedInfo},
+		})
+		require.NoError(t, err)
+		token, err := asn1.Marshal(struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue
+		}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed}})
+		require.NoError(t, err)
+		reply, err := asn1.Marshal(struct {
+			Status struct {
+				Status int
+			}
+			TimeStampToken asn1.RawValue
+		}{TimeStampToken: asn1.RawValue{FullBytes: token}})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		_, _ = w.Write(reply)
+	}))
+	t.Cleanup(host.Close)
+	return host
+}
+
+func TestCredentialTimestamp_RFC3161(t *testing.T) {
+	tsa := tsaHost(t, nil)
+	server := NewServer()
+	server.timestamps = newTSAClient(tsa.URL)
+	key := newWalletKey(t)
+	credential := issueBoundIdentity(t, server, key, "timestamped-session")
+
+	require.Len(t, credential.Evidence, 1)
+	evidence := credential.Evidence[0]
+	assert.Equal(t, EvidenceRFC3161Timestamp, evidence.Type)
+	assert.Equal(t, tsaGenTime, evidence.Timestamp)
+	assert.Equal(t, tsa.URL, evidence.Authority)
+
+	// The token timestamps the digest of the credential without its evidence
+	unstamped := credential
+	unstamped.Evidence = nil
+	digest, err := credentialDigest(unstamped)
+	require.NoError(t, err)
+	assert.Equal(t, "urn:sha256:"+digest, evidence.Digest)
+	token, err := base64.StdEncoding.DecodeString(evidence.TimestampToken)
+	require.NoError(t, err)
+	_, info, err := parseTSAResponse(mustMarshalGranted(t, token))
+	require.NoError(t, err)
+	assert.Equal(t, tsaGenTime, info.GenTime)
+
+	// A renewed credential is timestamped afresh
+	w := renew(t, server, key, credential)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Credential VerifiableCredential `json:"credential"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Credential.Evidence, 1)
+	assert.NotEqual(t, evidence.Digest, resp.Credential.Evidence[0].Digest)
+}
+
+// mustMarshalGranted wraps a timestamp token in a granted TimeStampResp
+func mustMarshalGranted(t *testing.T, token []byte) []byte {
+	t.Helper()
+	reply, err := asn1.Marshal(struct {
+		Status struct {
+			Status int
+		}
+		TimeStampToken asn1.RawValue
+	}{TimeStampToken: asn1.RawValue{FullBytes: token}})
+	require.NoError(t, err)
+	return reply
+}
+
+func TestCredentialTimestamp_Unusable(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(info *tsaTSTInfo)
+	}{
+		{"another digest", func(info *tsaTSTInfo) { info.MessageImprint.HashedMessage = make([]byte, 32) }},
+		{"another request", func(info *tsaTSTInfo) { info.Nonce = big.NewInt(7) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			server.timestamps = newTSAClient(tsaHost(t, tt.tamper).URL)
+			credential := issueBoundIdentity(t, server, newWalletKey(t), "untimestamped-session")
+			assert.Empty(t, credential.Evidence)
+		})
+	}
+
+	// The credential is issued without a proof when the TSA is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	server := NewServer()
+	server.timestamps = newTSAClient(down.URL)
+	credential := issueBoundIdentity(t, server, newWalletKey(t), "untimestamped-session")
+	assert.Empty(t, credential.Evidence)
+}
+
+func TestCredentialTimestamp_ReceiptsLogAnchor(t *testing.T) {
+	var anchored []string
+	receiptsLog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/credentials/hash", r.URL.Path)
+		var body struct {
+			CredentialHash string `json:"credentialHash"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		anchored = append(anchored, body.CredentialHash)
+		_ = json.NewEncoder(w).Encode(map[string]any{"accepted": true, "hash": body.CredentialHash, "anchored": false})
+	}))
+	defer receiptsLog.Close()
+	server := NewServer()
+	server.receipts = newReceiptsLogClient(receiptsLog.URL, nil)
+	server.timestamps = server.receipts
+
+	credential := issueBoundIdentity(t, server, newWalletKey(t), "anchored-session")
+	require.Len(t, credential.Evidence, 1)
+	evidence := credential.Evidence[0]
+	assert.Equal(t, EvidenceReceiptsLogAnchor, evidence.Type)
+	assert.Equal(t, receiptsLog.URL, evidence.Authority)
+	assert.Empty(t, evidence.TimestampToken)
+	assert.WithinDuration(t, time.Now(), evidence.Timestamp, time.Minute)
+	assert.Equal(t, []string{evidence.Digest}, anchored)
+}
+
+func TestTimestampConfig_Validate(t *testing.T) {
+	assert.NoError(t, TimestampConfig{}.Validate())
+	assert.NoError(t, TimestampConfig{TSAURL: "https://tsa.example"}.Validate())
+	assert.NoError(t, TimestampConfig{Anchor: true}.Validate())
+	assert.Error(t, TimestampConfig{TSAURL: "tsa.example"}.Validate())
+	assert.Error(t, TimestampConfig{TSAURL: "https://tsa.example", Anchor: true}.Validate())
+}
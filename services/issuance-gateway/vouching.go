@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrVouchNotFound = errors.New("vouch not found")
+	ErrVouchRevoked  = errors.New("vouch revoked")
+	// ErrVouchHolderMismatch means the wallet's key is not the vouch subject's
+	ErrVouchHolderMismatch = errors.New("wallet key does not match the vouch subject")
+	ErrVouchingUnavailable = errors.New("vouching-service unavailable")
+)
+
+// VouchCredential is a vouch packaged by the vouching-service as an SD-JWT
+// VC bound to the subject's key
+type VouchCredential struct {
+	CredentialID string `json:"credentialId"`
+	Format       string `json:"format"`
+	Credential   string `json:"credential"`
+}
+
+// vouchingClient fetches vouch credentials from the vouching-service, which
+// countersigns them; the gateway only delivers them to the subject's wallet
+type vouchingClient struct {
+	client *http.Client
+	url    string
+	token  string
+	// signalKey keys the hashes of the device signals reported for holders'
+	// collusion checks; empty disables reporting
+	signalKey []byte
+}
+
+// VouchingConfig names the vouching-service the gateway offers vouch
+// credentials from
+type VouchingConfig struct {
+	URL             string `env:"VOUCHING_SERVICE_URL" doc:"Vouching service whose vouch credentials are delivered to holders' wallets; vouch credentials are not offered without it"`
+	Token           string `env:"VOUCHING_SERVICE_TOKEN" secret:"true" doc:"The vouching service's CREDENTIAL_API_TOKEN"`
+	DeviceSignalKey string `env:"DEVICE_SIGNAL_KEY" secret:"true" doc:"Key, kept from the vouching service, hashing the device signals reported for holders' collusion checks; signals are not reported without it"`
+}
+
+// Validate checks the vouching service URL is an http(s) URL with a token
+func (c VouchingConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("VOUCHING_SERVICE_URL must be an http(s) URL")
+	}
+	if c.Token == "" {
+		return errors.New("VOUCHING_SERVICE_TOKEN is required with VOUCHING_SERVICE_URL")
+	}
+	return nil
+}
+
+// loadVouchingClient offers vouch credentials when the vouching service is
+// configured
+func loadVouchingClient(c VouchingConfig) *vouchingClient {
+	if c.URL == "" {
+		return nil
+	}
+	client := newVouchingClient(c.URL, c.Token)
+	client.signalKey = []byte(c.DeviceSignalKey)
+	return client
+}
+
+func newVouchingClient(serviceURL, token string) *vouchingClient {
+	return &vouchingClient{client: deadline.NewClient("vouching-service"), url: strings.TrimSuffix(serviceURL, "/"), token: token}
+}
+
+// IssueCredential asks for vouchID as a credential for the wallet key with
+// thumbprint holderJKT
+func (c *vouchingClient) IssueCredential(ctx context.Context, vouchID, holderJKT string) (VouchCredential, error) {
+	body, err := json.Marshal(map[string]string{"holderJkt": holderJKT})
+	if err != nil {
+		return VouchCredential{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/vouches/"+url.PathEscape(vouchID)+"/credential", bytes.NewReader(body))
+	if err != nil {
+		return VouchCredential{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return VouchCredential{}, fmt.Errorf("%w: %v", ErrVouchingUnavailable, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return VouchCredential{}, ErrVouchNotFound
+	case http.StatusGone:
+		return VouchCredential{}, ErrVouchRevoked
+	case http.StatusForbidden:
+		return VouchCredential{}, ErrVouchHolderMismatch
+	default:
+		return VouchCredential{}, fmt.Errorf("%w: returned %d", ErrVouchingUnavailable, resp.StatusCode)
+	}
+	var credential VouchCredential
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&credential); err != nil {
+		return VouchCredential{}, fmt.Errorf("%w: decoding credential: %v", ErrVouchingUnavailable, err)
+	}
+	return credential, nil
+}
+
+// DeviceSignal is the device and network a holder was verified from, as
+// keyed hashes the vouching-service can compare but not reverse
+type DeviceSignal struct {
+	HolderJKT string `json:"holderJkt"`
+	Device    string `json:"device,omitempty"`
+	Network   string `json:"network,omitempty"`
+}
+
+// deviceSignal hashes the session's device fingerprint and IP prefix (/24
+// for IPv4, /48 for IPv6) for the holder of holderJKT. It reports false
+// when reporting is off or the session has neither.
+func (c *vouchingClient) deviceSignal(session VeriffSession, holderJKT string) (DeviceSignal, bool) {
+	if len(c.signalKey) == 0 {
+		return DeviceSignal{}, false
+	}
+	hash := func(kind, value string) string {
+		mac := hmac.New(sha256.New, c.signalKey)
+		mac.Write([]byte(kind + ":" + value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	signal := DeviceSignal{HolderJKT: holderJKT}
+	if fingerprint := session.Technical.DeviceFingerprint; fingerprint != "" {
+		signal.Device = hash("device", fingerprint)
+	}
+	if addr, err := netip.ParseAddr(session.Technical.IP); err == nil {
+		bits := 48
+		if addr.Unmap().Is4() {
+			addr, bits = addr.Unmap(), 24
+		}
+		if prefix, err := addr.Prefix(bits); err == nil {
+			signal.Network = hash("network", prefix.String())
+		}
+	}
+	return signal, signal.Device != "" || signal.Network != ""
+}
+
+// ReportDeviceSignal passes a holder's device signal to the
+// vouching-service's collusion checks
+func (c *vouchingClient) ReportDeviceSignal(ctx context.Context, signal DeviceSignal) error {
+	body, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/device-signals", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVouchingUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%w: returned %d", ErrVouchingUnavailable, resp.StatusCode)
+	}
+	return nil
+}
+
+// reportDeviceSignal reports the device a DPoP-bound wallet's holder was
+// verified from. It is best effort: issuance never waits on collusion checks.
+func (s *Server) reportDeviceSignal(ctx context.Context, token *jwt.Token, session VeriffSession) {
+	jkt := tokenKeyThumbprint(token)
+	if s.vouching == nil || jkt == "" {
+		return
+	}
+	signal, ok := s.vouching.deviceSignal(session, jkt)
+	if !ok {
+		return
+	}
+	if err := s.vouching.ReportDeviceSignal(ctx, signal); err != nil {
+		log.Warn().Err(err).Msg("Failed to report device signal to the vouching-service")
+	}
+}
+
+// issueVouchCredential answers a credential request for a vouch. The wallet
+// proves it is the vouch subject with its DPoP key, which the vouching-service
+// checks against the subject's DID and binds the credential to.
+func (s *Server) issueVouchCredential(w http.ResponseWriter, r *http.Request, token *jwt.Token, req CredentialRequest, clientID, idempotencyKey string) {
+	config := credentialConfigurations[CredentialTypeVouch]
+	if s.vouching == nil {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Vouch credentials are not offered")
+		return
+	}
+	jkt := tokenKeyThumbprint(token)
+	if jkt == "" {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "Vouch credentials require a DPoP-bound access token")
+		return
+	}
+	if req.VouchID == "" {
+		writeOAuthError(w, r, http.StatusBadRequest, ErrCodeInvalidCredentialRequest, "vouch_id is required")
+		return
+	}
+
+	credential, err := s.vouching.IssueCredential(r.Context(), req.VouchID, jkt)
+	if err != nil {
+		refused := func(status int, message string) {
+			s.recordAudit(r.Context(), AuditEvent{
+				Type:           AuditCredentialRefused,
+				Actor:          clientID,
+				CredentialType: config.ID,
+				Outcome:        "denied",
+				Detail:         err.Error(),
+			})
+			writeOAuthError(w, r, status, ErrCodeInvalidCredentialRequest, message)
+		}
+		switch {
+		case errors.Is(err, ErrVouchNotFound):
+			refused(http.StatusBadRequest, "Unknown vouch")
+		case errors.Is(err, ErrVouchRevoked):
+			refused(http.StatusBadRequest, "The vouch was revoked")
+		case errors.Is(err, ErrVouchHolderMismatch):
+			refused(http.StatusForbidden, "The wallet key is not the vouch subject's")
+		default:
+			log.Error().Err(err).Str("vouch_id", req.VouchID).Msg("Failed to fetch vouch credential")
+			writeOAuthError(w, r, http.StatusServiceUnavailable, ErrCodeServerError, "Vouching service unavailable")
+		}
+		return
+	}
+
+	s.recordAudit(r.Context(), AuditEvent{
+		Type:           AuditCredentialIssued,
+		Actor:          clientID,
+		CredentialType: config.ID,
+		CredentialID:   credential.CredentialID,
+	})
+	log.Info().
+		Str("credential_id", credential.CredentialID).
+		Str("credential_configuration", config.ID).
+		Msg("Credential issued successfully")
+	s.publishIssued(r.Context(), events.CredentialIssued{
+		CredentialID: credential.CredentialID,
+		Types:        config.Types,
+		Format:       credential.Format,
+		VouchID:      req.VouchID,
+	})
+
+	encoded, err := json.Marshal(CredentialResponse{
+		Credential: credential.Credential,
+		Format:     credential.Format,
+		NotificationID: s.issuanceNotification(r, issuanceTransaction{
+			ClientID:       clientID,
+			CredentialType: config.ID,
+			CredentialID:   credential.CredentialID,
+			IdempotencyKey: idempotencyKey,
+		}),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode credential response")
+		writeOAuthError(w, r, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+		return
+	}
+	if idempotencyKey != "" {
+		s.idempotency.Complete(idempotencyKey, http.StatusOK, encoded)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(encoded); err != nil {
+		log.Error().Err(err).Msg("Failed to write credential response")
+	}
+}
+
+// ExportSubject returns the vouches the subject with DID gave and received,
+// as the vouching-service exports them
+func (c *vouchingClient) ExportSubject(ctx context.Context, did string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/subjects/"+url.PathEscape(did)+"/export", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVouchingUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: returned %d", ErrVouchingUnavailable, resp.StatusCode)
+	}
+	var export json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&export); err != nil {
+		return nil, fmt.Errorf("%w: decoding export: %v", ErrVouchingUnavailable, err)
+	}
+	return export, nil
+}
+
+// EraseSubject deletes every vouch the subject with DID gave or received
+// and returns how many there were
+func (c *vouchingClient) EraseSubject(ctx context.Context, did string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.url+"/subjects/"+url.PathEscape(did), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrVouchingUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: returned %d", ErrVouchingUnavailable, resp.StatusCode)
+	}
+	var erasure struct {
+		Erased int `json:"erased"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&erasure); err != nil {
+		return 0, fmt.Errorf("%w: decoding erasure: %v", ErrVouchingUnavailable, err)
+	}
+	return erasure.Erased, nil
+}
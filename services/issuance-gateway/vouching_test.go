@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVouching plays the vouching-service, issuing vouch-1 to subjectJKT
+func fakeVouching(t *testing.T, subjectJKT string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer vouching-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			HolderJKT string `json:"holderJkt"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch {
+		case r.URL.Path == "/vouches/vouch-revoked/credential":
+			w.WriteHeader(http.StatusGone)
+		case r.URL.Path != "/vouches/vouch-1/credential":
+			w.WriteHeader(http.StatusNotFound)
+		case req.HolderJKT != subjectJKT:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			writeJSON(w, http.StatusOK, VouchCredential{CredentialID: "urn:uuid:vouch-cred", Format: "vc+sd-jwt", Credential: "eyJ.vouch.sig~WyJzYWx0Il0~"})
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func requestVouchCredential(t *testing.T, server *Server, key *ecdsa.PrivateKey, vouchID string) *httptest.ResponseRecorder {
+	t.Helper()
+	token := issueDPoPToken(t, server, key).AccessToken
+	return postJSON(t, server, "/credential", CredentialRequest{Format: "vc+sd-jwt", Types: []string{CredentialTypeVouch}, VouchID: vouchID}, map[string]string{
+		"Authorization": "DPoP " + token,
+		dpopHeader:      dpopProof(t, key, http.MethodPost, "http://example.com/credential", token),
+	})
+}
+
+func TestVouchCredential_DeliveredToSubject(t *testing.T) {
+	subject := newWalletKey(t)
+	jkt, err := walletJWK(subject).Thumbprint()
+	require.NoError(t, err)
+	server := NewServer()
+	server.vouching = newVouchingClient(fakeVouching(t, jkt).URL+"/", "vouching-token")
+
+	w := requestVouchCredential(t, server, subject, "vouch-1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp CredentialResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "vc+sd-jwt", resp.Format)
+	assert.Equal(t, "eyJ.vouch.sig~WyJzYWx0Il0~", resp.Credential)
+
+	issued, err := server.auditLog.Query(context.Background(), AuditFilter{Type: AuditCredentialIssued, CredentialType: CredentialTypeVouch})
+	require.NoError(t, err)
+	require.Len(t, issued, 1)
+	assert.Equal(t, "urn:uuid:vouch-cred", issued[0].CredentialID)
+
+	// Another wallet cannot collect the subject's vouch, nor an unknown one
+	assert.Equal(t, http.StatusForbidden, requestVouchCredential(t, server, newWalletKey(t), "vouch-1").Code)
+	assert.Equal(t, http.StatusBadRequest, requestVouchCredential(t, server, subject, "vouch-2").Code)
+	w = requestVouchCredential(t, server, subject, "vouch-revoked")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "revoked")
+	refused, err := server.auditLog.Query(context.Background(), AuditFilter{Type: AuditCredentialRefused, CredentialType: CredentialTypeVouch})
+	require.NoError(t, err)
+	assert.Len(t, refused, 3)
+}
+
+func TestVouchCredential_Refused(t *testing.T) {
+	server := NewServer()
+	key := newWalletKey(t)
+
+	// Not offered without a vouching-service
+	assert.Equal(t, http.StatusBadRequest, requestVouchCredential(t, server, key, "vouch-1").Code)
+
+	// Holder binding needs a DPoP-bound token
+	jkt, err := walletJWK(key).Thumbprint()
+	require.NoError(t, err)
+	server.vouching = newVouchingClient(fakeVouching(t, jkt).URL, "vouching-token")
+	w := postJSON(t, server, "/oauth/token", TokenRequest{GrantType: "client_credentials", ClientID: "test-wallet", Scope: ScopeVouchCredential}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var bearer TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bearer))
+	w = postJSON(t, server, "/credential", CredentialRequest{Types: []string{CredentialTypeVouch}, VouchID: "vouch-1"}, map[string]string{"Authorization": "Bearer " + bearer.AccessToken})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "DPoP-bound")
+
+	assert.Equal(t, http.StatusBadRequest, requestVouchCredential(t, server, key, "").Code)
+
+	// A vouching-service outage is not the wallet's fault
+	server.vouching = newVouchingClient("http://127.0.0.1:1", "vouching-token")
+	assert.Equal(t, http.StatusServiceUnavailable, requestVouchCredential(t, server, key, "vouch-1").Code)
+}
+
+func TestVouching_ReportsDeviceSignal(t *testing.T) {
+	key := newWalletKey(t)
+	jkt, err := walletJWK(key).Thumbprint()
+	require.NoError(t, err)
+	var reported []DeviceSignal
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/device-signals", r.URL.Path)
+		require.Equal(t, "Bearer vouching-token", r.Header.Get("Authorization"))
+		var signal DeviceSignal
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&signal))
+		reported = append(reported, signal)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	server := NewServer()
+	server.vouching = newVouchingClient(ts.URL, "vouching-token")
+	server.vouching.signalKey = []byte("signal-key")
+	session := approvedSession("signal-session")
+	session["technicalData"] = map[string]string{"ip": "198.51.100.7", "deviceFingerprint": "fp-123"}
+	bindSession(t, server, "signal-session", key)
+	require.Equal(t, http.StatusOK, postJSON(t, server, "/webhooks/veriff", session, nil).Code)
+
+	token := issueSessionToken(t, server, "signal-session", "credential_issuance", key).AccessToken
+	w := postJSON(t, server, "/credential", CredentialRequest{Format: "jwt_vc", Types: []string{"VerifiableCredential", CredentialTypeIdentity}, Proof: credentialProof(t, key, issuerDID)}, map[string]string{
+		"Authorization": "DPoP " + token,
+		dpopHeader:      dpopProof(t, key, http.MethodPost, "http://example.com/credential", token),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Only keyed hashes leave the gateway, and neighbouring addresses share a network
+	require.Len(t, reported, 1)
+	assert.Equal(t, jkt, reported[0].HolderJKT)
+	assert.NotContains(t, reported[0].Device+reported[0].Network, "fp-123")
+	assert.NotContains(t, reported[0].Device+reported[0].Network, "198.51.100")
+	var neighbour VeriffSession
+	neighbour.Technical.IP = "198.51.100.200"
+	signal, ok := server.vouching.deviceSignal(neighbour, jkt)
+	require.True(t, ok)
+	assert.Equal(t, reported[0].Network, signal.Network)
+	assert.Empty(t, signal.Device)
+
+	// Without a key nothing is reported
+	server.vouching.signalKey = nil
+	_, ok = server.vouching.deviceSignal(neighbour, jkt)
+	assert.False(t, ok)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookMaxAttempts    = 8
+	webhookBaseBackoff    = 2 * time.Second
+	webhookMaxBackoff     = 10 * time.Minute
+	webhookWorkerInterval = time.Second
+)
+
+var (
+	ErrWebhookEventNotFound = errors.New("webhook event not found")
+
+	webhookEvents = expvar.NewMap("webhook_events_total")
+)
+
+// QueuedWebhook is a received Veriff webhook awaiting (re)processing
+type QueuedWebhook struct {
+	ID           string          `json:"id"`
+	Tenant       string          `json:"tenant,omitempty"` // tenant the webhook was delivered to
+	Payload      json.RawMessage `json:"payload"`
+	Attempts     int             `json:"attempts"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+	LastError    string          `json:"last_error,omitempty"`
+	DeadLettered bool            `json:"dead_lettered"`
+
+	inFlight bool
+}
+
+// journalEntry is one line of the queue's append-only journal
+type journalEntry struct {
+	Op    string         `json:"op"`
+	Event *QueuedWebhook `json:"event,omitempty"`
+	ID    string         `json:"id,omitempty"`
+}
+
+// webhookQueue is an embedded durable queue: every state change is appended
+// to a journal file that is replayed on startup, so events that were in
+// flight during a crash are processed again. Without a journal path the
+// queue is memory-only.
+type webhookQueue struct {
+	mu      sync.Mutex
+	events  map[string]*QueuedWebhook
+	journal *os.File
+}
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{events: make(map[string]*QueuedWebhook)}
+}
+
+// OpenWebhookQueue replays the journal at path and compacts it to the
+// outstanding events
+func OpenWebhookQueue(path string) (*webhookQueue, error) {
+	q := newWebhookQueue()
+	if data, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(data)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var entry journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				data.Close()
+				return nil, fmt.Errorf("reading webhook journal: %w", err)
+			}
+			q.apply(entry)
+		}
+		data.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading webhook journal: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("opening webhook journal: %w", err)
+	}
+
+	// Rewrite the journal with only the outstanding events
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("compacting webhook journal: %w", err)
+	}
+	for _, event := range q.events {
+		if err := writeJournalEntry(file, journalEntry{Op: "put", Event: event}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("compacting webhook journal: %w", err)
+	}
+
+	q.journal, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening webhook journal: %w", err)
+	}
+	return q, nil
+}
+
+// loadWebhookQueue uses a durable journal at path, when set
+func loadWebhookQueue(path string) (*webhookQueue, error) {
+	if path != "" {
+		return OpenWebhookQueue(path)
+	}
+	return newWebhookQueue(), nil
+}
+
+func (q *webhookQueue) apply(entry journalEntry) {
+	switch entry.Op {
+	case "put":
+		event := *entry.Event
+		q.events[event.ID] = &event
+	case "ack":
+		delete(q.events, entry.ID)
+	}
+}
+
+func writeJournalEntry(file *os.File, entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing webhook journal: %w", err)
+	}
+	return file.Sync()
+}
+
+// persistLocked journals an entry and applies it
+func (q *webhookQueue) persistLocked(entry journalEntry) error {
+	if q.journal != nil {
+		if err := writeJournalEntry(q.journal, entry); err != nil {
+			return err
+		}
+	}
+	if entry.Op == "ack" {
+		delete(q.events, entry.ID)
+	}
+	return nil
+}
+
+// Enqueue stores a new event delivered to a tenant, already claimed by the
+// caller
+func (q *webhookQueue) Enqueue(tenantID string, payload []byte, now time.Time) (QueuedWebhook, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	event := &QueuedWebhook{
+		ID:          uuid.NewString(),
+		Tenant:      tenantID,
+		Payload:     json.RawMessage(payload),
+		ReceivedAt:  now,
+		NextAttempt: now,
+		inFlight:    true,
+	}
+	if err := q.persistLocked(journalEntry{Op: "put", Event: event}); err != nil {
+		return QueuedWebhook{}, err
+	}
+	q.events[event.ID] = event
+	return *event, nil
+}
+
+// Claim returns the oldest event due for processing and marks it in flight
+func (q *webhookQueue) Claim(now time.Time) (QueuedWebhook, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next *QueuedWebhook
+	for _, event := range q.events {
+		if event.inFlight || event.DeadLettered || event.NextAttempt.After(now) {
+			continue
+		}
+		if next == nil || event.ReceivedAt.Before(next.ReceivedAt) {
+			next = event
+		}
+	}
+	if next == nil {
+		return QueuedWebhook{}, false
+	}
+	next.inFlight = true
+	return *next, true
+}
+
+// Ack removes a processed event
+func (q *webhookQueue) Ack(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.persistLocked(journalEntry{Op: "ack", ID: id})
+}
+
+// Fail records a processing failure, scheduling a retry with exponential
+// backoff or dead-lettering the event once attempts are exhausted
+func (q *webhookQueue) Fail(id string, cause error, now time.Time) (QueuedWebhook, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	event, ok := q.events[id]
+	if !ok {
+		return QueuedWebhook{}, ErrWebhookEventNotFound
+	}
+	event.inFlight = false
+	event.Attempts++
+	event.LastError = cause.Error()
+	if event.Attempts >= webhookMaxAttempts {
+		event.DeadLettered = true
+	} else {
+		event.NextAttempt = now.Add(webhookBackoff(event.Attempts))
+	}
+	return *event, q.persistLocked(journalEntry{Op: "put", Event: event})
+}
+
+// Requeue gives a dead-lettered event a fresh set of attempts
+func (q *webhookQueue) Requeue(id string, now time.Time) (QueuedWebhook, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	event, ok := q.events[id]
+	if !ok || !event.DeadLettered {
+		return QueuedWebhook{}, ErrWebhookEventNotFound
+	}
+	event.DeadLettered = false
+	event.Attempts = 0
+	event.NextAttempt = now
+	return *event, q.persistLocked(journalEntry{Op: "put", Event: event})
+}
+
+// DeadLetters lists events that exhausted their retries, oldest first
+func (q *webhookQueue) DeadLetters() []QueuedWebhook {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead := []QueuedWebhook{}
+	for _, event := range q.events {
+		if event.DeadLettered {
+			dead = append(dead, *event)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].ReceivedAt.Before(dead[j].ReceivedAt) })
+	return dead
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func (s *Server) ackWebhookEvent(id string) {
+	if err := s.webhookQueue.Ack(id); err != nil {
+		log.Error().Err(err).Str("event_id", id).Msg("Failed to acknowledge webhook event")
+		return
+	}
+	webhookEvents.Add("processed", 1)
+}
+
+func (s *Server) failWebhookEvent(id string, cause error) {
+	event, err := s.webhookQueue.Fail(id, cause, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("event_id", id).Msg("Failed to record webhook failure")
+		return
+	}
+	if event.DeadLettered {
+		webhookEvents.Add("dead_lettered", 1)
+		log.Error().Err(cause).Str("event_id", id).Int("attempts", event.Attempts).Msg("Webhook event dead-lettered")
+		return
+	}
+	webhookEvents.Add("retried", 1)
+	log.Warn().Err(cause).Str("event_id", id).Time("next_attempt", event.NextAttempt).Msg("Webhook event queued for retry")
+}
+
+// drainWebhookQueue processes every event that is due
+func (s *Server) drainWebhookQueue(ctx context.Context, now time.Time) {
+	for {
+		event, ok := s.webhookQueue.Claim(now)
+		if !ok {
+			return
+		}
+		var session VeriffSession
+		if err := json.Unmarshal(event.Payload, &session); err != nil {
+			s.failWebhookEvent(event.ID, err)
+			continue
+		}
+		// Retries act for the tenant the webhook was delivered to
+		owner, ok := s.tenants.Get(event.Tenant)
+		if !ok {
+			owner, _ = s.tenants.Get(tenant.DefaultID)
+		}
+		if _, err := s.processVeriffEvent(tenant.NewContext(ctx, owner), session); err != nil {
+			s.failWebhookEvent(event.ID, err)
+			continue
+		}
+		s.ackWebhookEvent(event.ID)
+	}
+}
+
+func (s *Server) runWebhookWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		s.drainWebhookQueue(ctx, time.Now())
+		cancel()
+	}
+}
+
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": s.webhookQueue.DeadLetters()})
+}
+
+func (s *Server) handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		s.security.AuthFailure(r, "operator")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operator"`)
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	event, err := s.webhookQueue.Requeue(chi.URLParam(r, "id"), time.Now())
+	if errors.Is(err, ErrWebhookEventNotFound) {
+		problem.Error(w, r, "Dead-lettered event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to requeue webhook event")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeAdminAction, Action: "webhook.requeued", Actor: "operator", Target: event.ID})
+	log.Info().Str("event_id", event.ID).Msg("Dead-lettered webhook requeued")
+	writeJSON(w, http.StatusAccepted, event)
+}
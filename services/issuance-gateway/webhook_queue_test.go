@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyJourneyStore fails saves until its failure budget is spent
+type flakyJourneyStore struct {
+	JourneyStore
+	mu       sync.Mutex
+	failures int
+}
+
+func (f *flakyJourneyStore) Save(ctx context.Context, journey IssuanceJourney) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("journey store unavailable")
+	}
+	return f.JourneyStore.Save(ctx, journey)
+}
+
+func operatorRequest(t *testing.T, server *Server, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebhookQueue_RetriesTransientFailures(t *testing.T) {
+	server := NewServer()
+	server.journeys = NewIssuanceStateMachine(&flakyJourneyStore{JourneyStore: newMemoryJourneyStore(), failures: 1})
+
+	w := postJSON(t, server, "/webhooks/veriff", approvedSession("retried-session"), nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// Not yet due: the first retry waits for the base backoff
+	_, due := server.webhookQueue.Claim(time.Now())
+	assert.False(t, due)
+
+	server.drainWebhookQueue(context.Background(), time.Now().Add(webhookBaseBackoff))
+	journey, err := server.journeys.ForSession(context.Background(), func() string { return "unused" }, "retried-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateVerified, journey.State)
+	assert.Empty(t, server.webhookQueue.DeadLetters())
+}
+
+func TestWebhookQueue_DeadLettersAndRetries(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = "ops-secret"
+	store := &flakyJourneyStore{JourneyStore: newMemoryJourneyStore(), failures: 1000}
+	server.journeys = NewIssuanceStateMachine(store)
+
+	w := postJSON(t, server, "/webhooks/veriff", approvedSession("doomed-session"), nil)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	for i := 1; i < webhookMaxAttempts; i++ {
+		server.drainWebhookQueue(context.Background(), time.Now().Add(webhookMaxBackoff))
+	}
+
+	w = operatorRequest(t, server, http.MethodGet, "/webhooks/dead-letters", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = operatorRequest(t, server, http.MethodGet, "/webhooks/dead-letters", "ops-secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Events []QueuedWebhook `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Events, 1)
+	dead := page.Events[0]
+	assert.Equal(t, webhookMaxAttempts, dead.Attempts)
+	assert.Contains(t, dead.LastError, "journey store unavailable")
+
+	w = operatorRequest(t, server, http.MethodPost, "/webhooks/dead-letters/missing/retry", "ops-secret")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	store.mu.Lock()
+	store.failures = 0
+	store.mu.Unlock()
+	w = operatorRequest(t, server, http.MethodPost, "/webhooks/dead-letters/"+dead.ID+"/retry", "ops-secret")
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	server.drainWebhookQueue(context.Background(), time.Now().Add(time.Second))
+	assert.Empty(t, server.webhookQueue.DeadLetters())
+	journey, err := server.journeys.ForSession(context.Background(), func() string { return "unused" }, "doomed-session")
+	require.NoError(t, err)
+	assert.Equal(t, StateVerified, journey.State)
+}
+
+func TestWebhookQueue_JournalSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	now := time.Now()
+
+	queue, err := OpenWebhookQueue(path)
+	require.NoError(t, err)
+	done, err := queue.Enqueue(tenant.DefaultID, []byte(`{"session_id":"done"}`), now)
+	require.NoError(t, err)
+	require.NoError(t, queue.Ack(done.ID))
+	// Simulate a crash while this event is being processed
+	pending, err := queue.Enqueue(tenant.DefaultID, []byte(`{"session_id":"pending"}`), now)
+	require.NoError(t, err)
+	require.NoError(t, queue.journal.Close())
+
+	reopened, err := OpenWebhookQueue(path)
+	require.NoError(t, err)
+	defer reopened.journal.Close()
+
+	event, ok := reopened.Claim(now)
+	require.True(t, ok)
+	assert.Equal(t, pending.ID, event.ID)
+	assert.JSONEq(t, `{"session_id":"pending"}`, string(event.Payload))
+	_, ok = reopened.Claim(now)
+	assert.False(t, ok)
+}
+
+func TestWebhookBackoff_IsCapped(t *testing.T) {
+	assert.Equal(t, webhookBaseBackoff, webhookBackoff(1))
+	assert.Equal(t, 4*webhookBaseBackoff, webhookBackoff(3))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(40))
+}
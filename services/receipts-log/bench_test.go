@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// benchReceiptLog returns a receipt log kept in memory, with logging off
+func benchReceiptLog(b *testing.B) *receiptLog {
+	b.Helper()
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return newReceiptLog(nil, key, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "receipts_total"}, []string{"anchored"}))
+}
+
+// BenchmarkRecord measures submitting a receipt hash
+func BenchmarkRecord(b *testing.B) {
+	hashes := benchReceiptLog(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hashes.Record(ctx, fmt.Sprintf("urn:sha256:%064x", i), ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkConsume measures recording the receipt of a verifier's
+// verification.completed event
+func BenchmarkConsume(b *testing.B) {
+	hashes := benchReceiptLog(b)
+	ctx := context.Background()
+	event, err := events.New("verifier", "session-1", events.VerificationCompleted{
+		SessionID:   "session-1",
+		Status:      "verified",
+		ReceiptHash: "urn:sha256:ab",
+	}, time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := hashes.Consume(ctx, event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
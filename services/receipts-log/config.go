@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+)
+
+// Config is the receipts log's configuration, documented in CONFIG.md. The database
+// keeps its own variables, read by the store package.
+type Config struct {
+	config.Base
+	SigningKey  string `env:"LOG_SIGNING_KEY" doc:"PEM file of the P-256 key signing the log's tree heads, whose public key verifiers check anchors with as RECEIPTS_LOG_PUBLIC_KEY; required outside development, where a key is generated at startup without one"`
+	ServiceAuth serviceauth.Config
+	RateLimit   ratelimit.Config
+	Events      events.Config
+}
+
+// Validate checks the port, signing key, service authentication, rate limit
+// and event bus are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if c.SigningKey == "" && !c.Development() {
+		return errors.New("LOG_SIGNING_KEY is required outside development, as tree heads signed with a generated key stop verifying at the next restart")
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	return c.Events.Validate()
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{Base: config.Base{Port: 8083}}
+}
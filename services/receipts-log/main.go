@@ -1,62 +1,311 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"embed"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
+// batch is a security audit batch hash a service anchors
+type batch struct {
+	BatchHash string `json:"batchHash"`
+}
+
+// credential is the digest of an issued credential the issuance-gateway
+// timestamps
+type credential struct {
+	CredentialHash string `json:"credentialHash"`
+}
+
 type submit struct {
 	ReceiptHash string `json:"receiptHash"`
+	// Holder is the urn:sha256 digest of the receipt holder's DID
+	Holder string `json:"holder,omitempty"`
+}
+
+// holderDigest matches the urn:sha256 digests holders, and audit batches,
+// are known by
+var holderDigest = regexp.MustCompile(`^urn:sha256:[0-9a-f]{64}$`)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// openDatabase connects to the shared database and migrates the
+// receipts_log schema; it returns nil when DATABASE_URL is unset
+func openDatabase() *store.DB {
+	config, err := store.ConfigFromEnv("receipts_log")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid database configuration")
+	}
+	if config == nil {
+		log.Warn().Msg("DATABASE_URL is unset, so the log is kept in memory and lost at the next restart")
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := store.Open(ctx, *config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the database")
+	}
+	applied, err := db.Migrate(ctx, migrations)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to migrate the database")
+	}
+	for _, migration := range applied {
+		log.Info().Str("schema", db.Schema()).Int("version", migration.Version).Str("name", migration.Name).Msg("Applied database migration")
+	}
+	return db
 }
 
 func main() {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	exporting, err := tracing.Init(context.Background(), "receipts-log")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+	auth, err := serviceauth.New("receipts-log", cfg.ServiceAuth)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
+	}
+	if auth == nil {
+		log.Warn().Msg("SERVICE_AUTH_KEY is unset, so any caller can submit receipt hashes")
+	}
+	var key *ecdsa.PrivateKey
+	if cfg.SigningKey != "" {
+		if key, err = signing.LoadKey(cfg.SigningKey); err != nil {
+			log.Fatal().Err(err).Msg("Invalid LOG_SIGNING_KEY")
+		}
+	} else {
+		log.Warn().Msg("LOG_SIGNING_KEY is unset, so tree heads are signed with a key generated at startup")
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate the log signing key")
+		}
+	}
+	db := openDatabase()
+	monitor := health.New("receipts-log")
+	if db != nil {
+		monitor.Require("database", db)
+	}
+	m := metrics.New("receipts-log")
+	receipts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachet_receipts_log_receipts_total",
+		Help: "Receipt hashes accepted, by whether they were anchored.",
+	}, []string{"anchored"})
+	m.MustRegister(receipts)
+	hashes := newReceiptLog(db, key, receipts)
+	bus, err := events.Open(cfg.Events)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the event bus")
+	}
+	if bus != nil {
+		// The verifier publishes receipt hashes with its verification events
+		if err := bus.Subscribe("receipts-log", []string{events.TypeVerificationCompleted}, hashes.Consume); err != nil {
+			log.Fatal().Err(err).Msg("Failed to subscribe to verification events")
+		}
+		defer bus.Close()
+	}
+	validator, err := openapi.New(openapiDocument)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
+	}
+	validator.ValidateResponses = cfg.Development()
+	limits, err := ratelimit.Open(cfg.RateLimit, "receipts-log")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid rate limit configuration")
+	}
+	// The log is public; receipt submission is closed to all but the verifier
+	var limiter ratelimit.Limiter
+	limiter.Set(limits, cfg.RateLimit.Limit(), ratelimit.ByIP(cfg.RateLimit.TrustedProxies))
 	r := chi.NewRouter()
+	r.Use(tracing.Middleware("receipts-log"))
+	r.Use(m.Middleware)
+	r.Use(middleware.RequestID)
+	r.Use(ratelimit.Peer)
+	r.Use(middleware.RealIP)
+	r.Use(deadline.Middleware(deadline.BudgetFromEnv()))
+	r.Use(validator.Middleware)
+	r.NotFound(problem.NotFound)
+	r.MethodNotAllowed(problem.MethodNotAllowed)
 	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		if _, err := w.Write([]byte("ok")); err != nil {
-			log.Error().Err(err).Msg("Failed to write health check response")
-		}
-	})
-	r.Post("/receipts/hash", func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/health", monitor.Health)
+	r.Get("/livez", monitor.Live)
+	r.Get("/readyz", monitor.Ready)
+	r.Handle("/metrics", m.Handler())
+	// Only the verifier submits receipts
+	r.With(auth.Require("verifier")).Post("/receipts/hash", func(w http.ResponseWriter, r *http.Request) {
 		var s submit
 		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
 			log.Error().Err(err).Msg("Failed to decode request")
-			w.WriteHeader(http.StatusBadRequest)
+			problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if s.Holder != "" && !holderDigest.MatchString(s.Holder) {
+			problem.Error(w, r, "holder must be a urn:sha256 digest", http.StatusBadRequest)
+			return
+		}
+		anchor, err := hashes.Record(r.Context(), s.ReceiptHash, s.Holder)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to store receipt hash")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(anchor); err != nil {
+			log.Error().Err(err).Msg("Failed to encode response")
+		}
+	})
+	// Every Cachet service anchors its security audit batches, so operators
+	// cannot rewrite the trail unnoticed
+	r.With(auth.Require()).Post("/audit/batches", func(w http.ResponseWriter, r *http.Request) {
+		var b batch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !holderDigest.MatchString(b.BatchHash) {
+			problem.Error(w, r, "batchHash must be a urn:sha256 digest", http.StatusBadRequest)
+			return
+		}
+		anchor, err := hashes.Record(r.Context(), b.BatchHash, "")
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to store audit batch hash")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		resp := map[string]any{"accepted": true, "hash": s.ReceiptHash, "anchored": false}
+		log.Info().Str("caller", serviceauth.Caller(r.Context())).Str("hash", b.BatchHash).Msg("Audit batch hash recorded")
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
+		if err := json.NewEncoder(w).Encode(anchor); err != nil {
 			log.Error().Err(err).Msg("Failed to encode response")
 		}
 	})
-	r.Get("/log/sth", func(w http.ResponseWriter, r *http.Request) {
-		resp := map[string]any{"treeSize": 0, "rootHash": "", "timestamp": "2025-08-31T11:41:30Z"}
+	// The issuance-gateway anchors the credentials it issues, so relying
+	// parties can prove when a credential existed
+	r.With(auth.Require("issuance-gateway")).Post("/credentials/hash", func(w http.ResponseWriter, r *http.Request) {
+		var c credential
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !holderDigest.MatchString(c.CredentialHash) {
+			problem.Error(w, r, "credentialHash must be a urn:sha256 digest", http.StatusBadRequest)
+			return
+		}
+		anchor, err := hashes.Record(r.Context(), c.CredentialHash, "")
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to store credential hash")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Info().Str("hash", c.CredentialHash).Msg("Credential hash recorded")
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
+		if err := json.NewEncoder(w).Encode(anchor); err != nil {
 			log.Error().Err(err).Msg("Failed to encode response")
 		}
 	})
-	r.Get("/log/proof", func(w http.ResponseWriter, r *http.Request) {
-		resp := map[string]any{"included": false}
+	// The issuance-gateway exports and erases holders' receipts for them
+	r.With(auth.Require("issuance-gateway")).Get("/subjects/{holder}/receipts", func(w http.ResponseWriter, r *http.Request) {
+		holder := chi.URLParam(r, "holder")
+		if !holderDigest.MatchString(holder) {
+			problem.Error(w, r, "holder must be a urn:sha256 digest", http.StatusBadRequest)
+			return
+		}
+		receipts, err := hashes.Holder(r.Context(), holder)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list holder receipts")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
+		if err := json.NewEncoder(w).Encode(map[string]any{"holder": holder, "receipts": receipts}); err != nil {
 			log.Error().Err(err).Msg("Failed to encode response")
 		}
 	})
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8083"
-	}
-	log.Info().Str("port", port).Msg("Starting receipts-log")
+	r.With(auth.Require("issuance-gateway")).Delete("/subjects/{holder}/receipts", func(w http.ResponseWriter, r *http.Request) {
+		holder := chi.URLParam(r, "holder")
+		if !holderDigest.MatchString(holder) {
+			problem.Error(w, r, "holder must be a urn:sha256 digest", http.StatusBadRequest)
+			return
+		}
+		tombstoned, err := hashes.Tombstone(r.Context(), holder, time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to tombstone holder receipts")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Info().Int("tombstoned", tombstoned).Msg("Holder receipts tombstoned")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"holder": holder, "tombstoned": tombstoned}); err != nil {
+			log.Error().Err(err).Msg("Failed to encode response")
+		}
+	})
+	r.With(limiter.Middleware).Get("/log/sth", func(w http.ResponseWriter, r *http.Request) {
+		head, err := hashes.TreeHead(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to sign the tree head")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(head); err != nil {
+			log.Error().Err(err).Msg("Failed to encode response")
+		}
+	})
+	r.With(limiter.Middleware).Get("/log/proof", func(w http.ResponseWriter, r *http.Request) {
+		hash := r.URL.Query().Get("hash")
+		size, ok := treeSize(r.URL.Query().Get("treeSize"))
+		if hash == "" || !ok {
+			problem.Error(w, r, "hash and an optional positive treeSize are expected", http.StatusBadRequest)
+			return
+		}
+		proof, err := hashes.Inclusion(r.Context(), hash, size)
+		writeProof(w, r, proof, err)
+	})
+	r.With(limiter.Middleware).Get("/log/consistency", func(w http.ResponseWriter, r *http.Request) {
+		first, ok := treeSize(r.URL.Query().Get("first"))
+		second, ok2 := treeSize(r.URL.Query().Get("second"))
+		if !ok || !ok2 || first == 0 || first > second {
+			problem.Error(w, r, "first and second must be tree sizes, first no larger than second", http.StatusBadRequest)
+			return
+		}
+		proof, err := hashes.Consistency(r.Context(), first, second)
+		writeProof(w, r, proof, err)
+	})
+	log.Info().Int("port", cfg.Port).Msg("Starting receipts-log")
 
 	server := &http.Server{
-		Addr:         ":" + port,
+		Addr:         cfg.Addr(),
 		Handler:      r,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
@@ -67,3 +316,32 @@ func main() {
 		log.Fatal().Err(err).Msg("Server failed to start")
 	}
 }
+
+// treeSize reads a tree size query parameter, 0 when it is absent
+func treeSize(value string) (uint64, bool) {
+	if value == "" {
+		return 0, true
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	return size, err == nil && size > 0
+}
+
+// writeProof answers with a proof about the log, or why there is none
+func writeProof(w http.ResponseWriter, r *http.Request, proof any, err error) {
+	switch {
+	case errors.Is(err, errNotLogged):
+		problem.Error(w, r, "The hash is not in the tree", http.StatusNotFound)
+		return
+	case errors.Is(err, errTreeSize):
+		problem.Error(w, r, "The log has not grown to that tree size", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to prove from the log")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(proof); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+)
+
+// merkleTree is the RFC 9162 Merkle tree over the log's leaves, which
+// logproof checks proofs against. The hashes of complete subtrees never
+// change as the log grows, so they are computed once.
+type merkleTree struct {
+	leaves   [][]byte // leaf hashes, in log order
+	complete map[[2]uint64][]byte
+}
+
+func newMerkleTree() *merkleTree {
+	return &merkleTree{complete: make(map[[2]uint64][]byte)}
+}
+
+// Size is the number of leaves
+func (t *merkleTree) Size() uint64 {
+	return uint64(len(t.leaves))
+}
+
+// Append adds a leaf for a logged hash
+func (t *merkleTree) Append(hash string) {
+	t.leaves = append(t.leaves, logproof.LeafHash([]byte(hash)))
+}
+
+// Root is the tree hash of the first size leaves (RFC 9162, section 2.1.1)
+func (t *merkleTree) Root(size uint64) []byte {
+	return t.hash(0, size)
+}
+
+// Inclusion is the audit path of the leaf at index in the tree of the first
+// size leaves (RFC 9162, section 2.1.3.1)
+func (t *merkleTree) Inclusion(index, size uint64) [][]byte {
+	return t.path(index, 0, size)
+}
+
+// Consistency proves the tree of second leaves extends the tree of first
+// leaves (RFC 9162, section 2.1.4.1)
+func (t *merkleTree) Consistency(first, second uint64) [][]byte {
+	if first == 0 || first == second {
+		return [][]byte{}
+	}
+	return t.subproof(first, 0, second, true)
+}
+
+// hash is the tree hash of the size leaves from start
+func (t *merkleTree) hash(start, size uint64) []byte {
+	switch size {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return t.leaves[start]
+	}
+	key := [2]uint64{start, size}
+	if hash, ok := t.complete[key]; ok {
+		return hash
+	}
+	k := split(size)
+	hash := logproof.NodeHash(t.hash(start, k), t.hash(start+k, size-k))
+	if size == k<<1 {
+		t.complete[key] = hash
+	}
+	return hash
+}
+
+func (t *merkleTree) path(index, start, size uint64) [][]byte {
+	if size <= 1 {
+		return [][]byte{}
+	}
+	k := split(size)
+	if index < k {
+		return append(t.path(index, start, k), t.hash(start+k, size-k))
+	}
+	return append(t.path(index-k, start+k, size-k), t.hash(start, k))
+}
+
+func (t *merkleTree) subproof(first, start, size uint64, whole bool) [][]byte {
+	if first == size {
+		if whole {
+			return [][]byte{}
+		}
+		return [][]byte{t.hash(start, size)}
+	}
+	k := split(size)
+	if first <= k {
+		return append(t.subproof(first, start, k, whole), t.hash(start+k, size-k))
+	}
+	return append(t.subproof(first-k, start+k, size-k, false), t.hash(start, k))
+}
+
+// split is the largest power of two below size, where a tree of size
+// leaves divides into its left and right subtrees
+func split(size uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < size {
+		k <<= 1
+	}
+	return k
+}
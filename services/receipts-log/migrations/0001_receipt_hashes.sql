@@ -0,0 +1,5 @@
+-- Receipt hashes submitted for anchoring, in arrival order
+CREATE TABLE IF NOT EXISTS receipt_hashes (
+	hash        text        PRIMARY KEY,
+	received_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+-- The urn:sha256 digest of each receipt's holder DID, so a holder's
+-- receipts can be exported or tombstoned when they ask to be erased.
+-- Tombstoned receipts stay in the log but lose their holder.
+ALTER TABLE receipt_hashes ADD COLUMN IF NOT EXISTS holder text;
+ALTER TABLE receipt_hashes ADD COLUMN IF NOT EXISTS tombstoned_at timestamptz;
+CREATE INDEX IF NOT EXISTS receipt_hashes_holder_idx ON receipt_hashes (holder) WHERE holder IS NOT NULL;
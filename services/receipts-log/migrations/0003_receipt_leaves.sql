@@ -0,0 +1,9 @@
+-- The position of each hash among the leaves of the log's Merkle tree, in
+-- arrival order. Hashes logged before the tree take theirs from when they
+-- were received.
+ALTER TABLE receipt_hashes ADD COLUMN IF NOT EXISTS leaf_index bigint;
+UPDATE receipt_hashes r SET leaf_index = o.leaf_index
+FROM (SELECT hash, row_number() OVER (ORDER BY received_at, hash) - 1 AS leaf_index FROM receipt_hashes) o
+WHERE r.hash = o.hash AND r.leaf_index IS NULL;
+ALTER TABLE receipt_hashes ALTER COLUMN leaf_index SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS receipt_hashes_leaf_idx ON receipt_hashes (leaf_index);
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// errNotLogged is returned for proofs of hashes the log does not hold
+	errNotLogged = errors.New("hash is not logged")
+	// errTreeSize is returned for proofs about trees the log has not grown
+	// to
+	errTreeSize = errors.New("tree size is beyond the log")
+)
+
+// receiptLog keeps the receipt hashes the verifier submits, directly or
+// through verification.completed events, with the other hashes services
+// anchor, as the leaves of a Merkle tree whose heads it signs
+type receiptLog struct {
+	db       *store.DB         // nil keeps the log in memory
+	key      *ecdsa.PrivateKey // signs tree heads
+	receipts *prometheus.CounterVec
+	now      func() time.Time
+
+	// The tree mirrors the leaves in the database, which other replicas
+	// append to, catching up before it answers
+	mu    sync.Mutex
+	tree  *merkleTree
+	index map[string]uint64 // leaf index of each logged hash
+}
+
+func newReceiptLog(db *store.DB, key *ecdsa.PrivateKey, receipts *prometheus.CounterVec) *receiptLog {
+	return &receiptLog{db: db, key: key, receipts: receipts, now: time.Now, tree: newMerkleTree(), index: make(map[string]uint64)}
+}
+
+// Anchor acknowledges a logged hash with the signed tree head it is in and
+// the proof of its inclusion
+type Anchor struct {
+	Hash           string                  `json:"hash"`
+	Accepted       bool                    `json:"accepted"`
+	Anchored       bool                    `json:"anchored"`
+	TreeHead       logproof.TreeHead       `json:"treeHead"`
+	InclusionProof logproof.InclusionProof `json:"inclusionProof"`
+}
+
+// Receipt is a logged receipt hash of a holder, as exported to them
+type Receipt struct {
+	Hash       string    `json:"hash"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Record appends a hash to the log, with the digest of its holder's DID
+// when known, and returns its anchor; recording one again keeps its leaf
+func (l *receiptLog) Record(ctx context.Context, hash, holder string) (Anchor, error) {
+	if l.db != nil {
+		if err := l.insert(ctx, hash, holder); err != nil {
+			return Anchor{}, fmt.Errorf("storing receipt hash: %w", err)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.db == nil {
+		if _, ok := l.index[hash]; !ok {
+			l.append(hash)
+		}
+	} else if err := l.catchUp(ctx); err != nil {
+		return Anchor{}, err
+	}
+	head, err := l.sign(l.tree.Size())
+	if err != nil {
+		return Anchor{}, err
+	}
+	proof, err := l.inclusion(hash, head.TreeSize)
+	if err != nil {
+		return Anchor{}, err
+	}
+	l.receipts.WithLabelValues(strconv.FormatBool(true)).Inc()
+	return Anchor{Hash: hash, Accepted: true, Anchored: true, TreeHead: head, InclusionProof: proof}, nil
+}
+
+// insert stores a hash as the next leaf, under a lock keeping the leaf
+// indexes of concurrent replicas without gaps or duplicates
+func (l *receiptLog) insert(ctx context.Context, hash, holder string) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('cachet-receipts-log:' || current_schema()))`); err != nil {
+		return fmt.Errorf("locking the log: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO receipt_hashes (hash, holder, leaf_index)
+		SELECT $1, NULLIF($2, ''), COALESCE(MAX(leaf_index) + 1, 0) FROM receipt_hashes
+		ON CONFLICT DO NOTHING`, hash, holder); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// catchUp appends the leaves other replicas logged since the tree last
+// read the database. The caller holds l.mu.
+func (l *receiptLog) catchUp(ctx context.Context) error {
+	rows, err := l.db.QueryContext(ctx, `SELECT hash FROM receipt_hashes WHERE leaf_index >= $1 ORDER BY leaf_index`, l.tree.Size())
+	if err != nil {
+		return fmt.Errorf("reading the log: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return fmt.Errorf("reading the log: %w", err)
+		}
+		l.append(hash)
+	}
+	return rows.Err()
+}
+
+func (l *receiptLog) append(hash string) {
+	l.index[hash] = l.tree.Size()
+	l.tree.Append(hash)
+}
+
+// current brings the tree up to date, for an answer about it. The caller
+// holds l.mu.
+func (l *receiptLog) current(ctx context.Context) error {
+	if l.db == nil {
+		return nil
+	}
+	return l.catchUp(ctx)
+}
+
+// TreeHead signs the head of the log as it stands
+func (l *receiptLog) TreeHead(ctx context.Context) (logproof.TreeHead, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.current(ctx); err != nil {
+		return logproof.TreeHead{}, err
+	}
+	return l.sign(l.tree.Size())
+}
+
+// Inclusion proves hash is among the leaves of the tree of size leaves, or
+// of the whole log when size is 0
+func (l *receiptLog) Inclusion(ctx context.Context, hash string, size uint64) (logproof.InclusionProof, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.current(ctx); err != nil {
+		return logproof.InclusionProof{}, err
+	}
+	if size == 0 {
+		size = l.tree.Size()
+	}
+	if size > l.tree.Size() {
+		return logproof.InclusionProof{}, errTreeSize
+	}
+	return l.inclusion(hash, size)
+}
+
+func (l *receiptLog) inclusion(hash string, size uint64) (logproof.InclusionProof, error) {
+	index, ok := l.index[hash]
+	if !ok || index >= size {
+		return logproof.InclusionProof{}, errNotLogged
+	}
+	return logproof.InclusionProof{LeafIndex: index, TreeSize: size, Hashes: encodeHashes(l.tree.Inclusion(index, size))}, nil
+}
+
+// Consistency proves the tree of second leaves extends the tree of first
+// leaves
+func (l *receiptLog) Consistency(ctx context.Context, first, second uint64) (logproof.ConsistencyProof, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.current(ctx); err != nil {
+		return logproof.ConsistencyProof{}, err
+	}
+	if second > l.tree.Size() {
+		return logproof.ConsistencyProof{}, errTreeSize
+	}
+	return logproof.ConsistencyProof{FirstSize: first, SecondSize: second, Hashes: encodeHashes(l.tree.Consistency(first, second))}, nil
+}
+
+// sign returns the tree head of the first size leaves, signed with the
+// log's key
+func (l *receiptLog) sign(size uint64) (logproof.TreeHead, error) {
+	head := logproof.TreeHead{
+		TreeSize:  size,
+		RootHash:  hex.EncodeToString(l.tree.Root(size)),
+		Timestamp: l.now().UTC().Format(time.RFC3339),
+	}
+	digest := sha256.Sum256(head.SignedData())
+	signature, err := ecdsa.SignASN1(rand.Reader, l.key, digest[:])
+	if err != nil {
+		return logproof.TreeHead{}, fmt.Errorf("signing the tree head: %w", err)
+	}
+	head.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	return head, nil
+}
+
+func encodeHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, hash := range hashes {
+		encoded[i] = hex.EncodeToString(hash)
+	}
+	return encoded
+}
+
+// Consume records the receipt hash of a verification.completed event.
+// Only the verifier's events are taken, as only it may submit hashes.
+func (l *receiptLog) Consume(ctx context.Context, event events.Event) error {
+	if event.Source != "verifier" {
+		log.Warn().Str("event_id", event.ID).Str("source", event.Source).Msg("Ignoring verification event from another service")
+		return nil
+	}
+	var completed events.VerificationCompleted
+	if err := event.Decode(&completed); err != nil {
+		// Redelivering it would not make it readable
+		log.Error().Err(err).Msg("Dropping unreadable verification event")
+		return nil
+	}
+	if completed.ReceiptHash == "" {
+		return nil
+	}
+	if _, err := l.Record(ctx, completed.ReceiptHash, completed.ReceiptHolder); err != nil {
+		return err
+	}
+	log.Info().Str("event_id", event.ID).Str("hash", completed.ReceiptHash).Msg("Receipt hash recorded")
+	return nil
+}
+
+// Holder returns the receipts logged for the holder whose DID has the
+// digest holder, oldest first
+func (l *receiptLog) Holder(ctx context.Context, holder string) ([]Receipt, error) {
+	receipts := []Receipt{}
+	if l.db == nil {
+		return receipts, nil
+	}
+	rows, err := l.db.QueryContext(ctx, `SELECT hash, received_at FROM receipt_hashes WHERE holder = $1 ORDER BY received_at`, holder)
+	if err != nil {
+		return nil, fmt.Errorf("listing holder receipts: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var receipt Receipt
+		if err := rows.Scan(&receipt.Hash, &receipt.ReceivedAt); err != nil {
+			return nil, fmt.Errorf("listing holder receipts: %w", err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// Tombstone unlinks the holder's receipts from them, for their erasure,
+// and returns how many there were. The hashes stay in the log, which is
+// append-only, but can no longer be traced to the holder.
+func (l *receiptLog) Tombstone(ctx context.Context, holder string, now time.Time) (int, error) {
+	if l.db == nil {
+		return 0, nil
+	}
+	result, err := l.db.ExecContext(ctx, `UPDATE receipt_hashes SET holder = NULL, tombstoned_at = $2 WHERE holder = $1`, holder, now)
+	if err != nil {
+		return 0, fmt.Errorf("tombstoning holder receipts: %w", err)
+	}
+	tombstoned, err := result.RowsAffected()
+	return int(tombstoned), err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLog returns a receipt log kept in memory, with its signing key
+func newTestLog(t *testing.T) (*receiptLog, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	receipts := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "receipts_total"}, []string{"anchored"})
+	return newReceiptLog(nil, key, receipts), key
+}
+
+func TestReceiptLog_ConsumesVerifierEvents(t *testing.T) {
+	hashes, _ := newTestLog(t)
+	bus := events.NewMemory()
+	require.NoError(t, bus.Subscribe("receipts-log", []string{events.TypeVerificationCompleted}, hashes.Consume))
+
+	for _, published := range []struct {
+		source string
+		data   events.VerificationCompleted
+	}{
+		{"verifier", events.VerificationCompleted{SessionID: "session-1", Status: "verified", ReceiptHash: "urn:sha256:ab"}},
+		// Failed verifications have no receipt
+		{"verifier", events.VerificationCompleted{SessionID: "session-2", Status: "failed"}},
+		// Only the verifier submits receipts
+		{"connector-hub", events.VerificationCompleted{SessionID: "session-3", Status: "verified", ReceiptHash: "urn:sha256:cd"}},
+	} {
+		event, err := events.New(published.source, published.data.SessionID, published.data, time.Now())
+		require.NoError(t, err)
+		require.NoError(t, bus.Publish(context.Background(), event))
+	}
+	require.NoError(t, bus.Close())
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hashes.receipts.WithLabelValues("true")))
+}
+
+func TestReceiptLog_Proofs(t *testing.T) {
+	hashes, key := newTestLog(t)
+	ctx := context.Background()
+
+	var heads []logproof.TreeHead
+	for i := 0; i < 13; i++ {
+		hash := fmt.Sprintf("urn:sha256:%064x", i)
+		anchor, err := hashes.Record(ctx, hash, "")
+		require.NoError(t, err)
+		assert.True(t, anchor.Anchored)
+		assert.Equal(t, uint64(i), anchor.InclusionProof.LeafIndex)
+		require.NoError(t, logproof.VerifyReceipt(&key.PublicKey, anchor.TreeHead, hash, anchor.InclusionProof), "anchor %d", i)
+		heads = append(heads, anchor.TreeHead)
+	}
+
+	// Recording a hash again keeps its leaf
+	again, err := hashes.Record(ctx, "urn:sha256:"+fmt.Sprintf("%064x", 3), "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), again.InclusionProof.LeafIndex)
+	assert.Equal(t, uint64(13), again.TreeHead.TreeSize)
+
+	// Every leaf is proven in every tree it belongs to
+	for _, head := range heads {
+		for i := uint64(0); i < head.TreeSize; i++ {
+			hash := fmt.Sprintf("urn:sha256:%064x", i)
+			proof, err := hashes.Inclusion(ctx, hash, head.TreeSize)
+			require.NoError(t, err)
+			assert.NoError(t, logproof.VerifyReceipt(&key.PublicKey, head, hash, proof), "leaf %d of %d", i, head.TreeSize)
+		}
+	}
+
+	// Every tree head extends the ones before
+	for _, older := range heads {
+		for _, newer := range heads[older.TreeSize-1:] {
+			proof, err := hashes.Consistency(ctx, older.TreeSize, newer.TreeSize)
+			require.NoError(t, err)
+			assert.NoError(t, logproof.VerifyExtension(&key.PublicKey, older, newer, proof), "%d to %d", older.TreeSize, newer.TreeSize)
+		}
+	}
+
+	head, err := hashes.TreeHead(ctx)
+	require.NoError(t, err)
+	assert.NoError(t, logproof.VerifyTreeHead(&key.PublicKey, head))
+	assert.Equal(t, heads[len(heads)-1].RootHash, head.RootHash)
+
+	_, err = hashes.Inclusion(ctx, "urn:sha256:"+fmt.Sprintf("%064x", 12), 12)
+	assert.ErrorIs(t, err, errNotLogged, "the leaf came after the tree")
+	_, err = hashes.Inclusion(ctx, "urn:sha256:ff", 0)
+	assert.ErrorIs(t, err, errNotLogged)
+	_, err = hashes.Inclusion(ctx, "urn:sha256:"+fmt.Sprintf("%064x", 0), 14)
+	assert.ErrorIs(t, err, errTreeSize)
+	_, err = hashes.Consistency(ctx, 1, 14)
+	assert.ErrorIs(t, err, errTreeSize)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin roles. Pack authors manage packs, pack reviewers approve them for
+// publication, trust admins manage the trust registry and federation; every
+// role may read the admin views (drafts, retired packs, federation status,
+// the audit log).
+const (
+	RolePackAuthor   = "pack-author"
+	RolePackReviewer = "pack-reviewer"
+	RoleTrustAdmin   = "trust-admin"
+	RoleReadOnly     = "read-only"
+)
+
+// How an admin caller authenticated
+const (
+	authMethodOperatorToken = "operator-token"
+	authMethodOIDC          = "oidc"
+)
+
+// operatorSubject names the break-glass OPERATOR_API_TOKEN in audit events
+const operatorSubject = "operator"
+
+var errNoCredentials = errors.New("no admin credentials")
+
+func validRole(role string) bool {
+	switch role {
+	case RolePackAuthor, RolePackReviewer, RoleTrustAdmin, RoleReadOnly:
+		return true
+	}
+	return false
+}
+
+// Principal is an authenticated admin caller
+type Principal struct {
+	Subject string
+	Roles   []string
+	Method  string
+}
+
+// HasRole reports whether the principal may act with role. Any role grants
+// read-only access.
+func (p Principal) HasRole(role string) bool {
+	if role == RoleReadOnly {
+		return len(p.Roles) > 0
+	}
+	return slices.Contains(p.Roles, role)
+}
+
+// authenticate accepts OPERATOR_API_TOKEN, which holds every role, or an
+// access token from the configured OIDC provider
+func (s *Server) authenticate(r *http.Request) (Principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != "Bearer" || token == "" {
+		return Principal{}, errNoCredentials
+	}
+	if s.operatorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1 {
+		return Principal{
+			Subject: operatorSubject,
+			Roles:   []string{RolePackAuthor, RolePackReviewer, RoleTrustAdmin, RoleReadOnly},
+			Method:  authMethodOperatorToken,
+		}, nil
+	}
+	if s.adminTokens == nil {
+		return Principal{}, errNoCredentials
+	}
+	return s.adminTokens.Verify(r.Context(), token)
+}
+
+type principalKey struct{}
+
+// principalFrom returns the admin caller requireRole authenticated
+func principalFrom(ctx context.Context) Principal {
+	principal, _ := ctx.Value(principalKey{}).(Principal)
+	return principal
+}
+
+// authorizeRole reports whether the request carries credentials with role,
+// for public routes that show more to admins
+func (s *Server) authorizeRole(r *http.Request, role string) bool {
+	principal, err := s.authenticate(r)
+	return err == nil && principal.HasRole(role)
+}
+
+// requireRole guards admin routes: 401 without valid credentials, 403
+// without the role. Every mutating call is audited, including refusals.
+func (s *Server) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := s.authenticate(r)
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				recorder := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+				defer func() { s.recordAdminCall(r, principal, recorder.Status()) }()
+				w = recorder
+			}
+			switch {
+			case err != nil:
+				if !errors.Is(err, errNoCredentials) {
+					log.Info().Err(err).Str("path", r.URL.Path).Msg("Admin token rejected")
+				}
+				s.security.AuthFailure(r, "admin")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			case !principal.HasRole(role):
+				s.security.Record(r.Context(), audit.Event{
+					Type:   audit.TypeAuthFailure,
+					Action: r.Method + " " + r.URL.Path,
+					Actor:  principal.Subject,
+					Detail: "missing role " + role,
+				})
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin", error="insufficient_scope"`)
+				problem.Error(w, r, "Forbidden: requires the "+role+" role", http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+			}
+		})
+	}
+}
+
+// recordAdminCall appends a mutating admin call to the audit log, even if
+// the caller has gone away. Failures are logged rather than surfaced; the
+// change has already been made.
+func (s *Server) recordAdminCall(r *http.Request, principal Principal, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	event := AdminAuditEvent{
+		Actor:      principal.Subject,
+		AuthMethod: principal.Method,
+		Roles:      principal.Roles,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		Outcome:    auditOutcome(status),
+		RequestID:  middleware.GetReqID(r.Context()),
+		Timestamp:  time.Now().UTC(),
+	}
+	log.Info().
+		Str("actor", event.Actor).
+		Str("auth_method", event.AuthMethod).
+		Str("method", event.Method).
+		Str("path", event.Path).
+		Int("status", event.Status).
+		Str("outcome", event.Outcome).
+		Str("request_id", event.RequestID).
+		Msg("Admin call")
+	if _, err := s.audit.Append(context.WithoutCancel(r.Context()), event); err != nil {
+		log.Error().Err(err).Str("path", event.Path).Msg("Failed to record admin audit event")
+	}
+	// Refused calls are already in the security audit trail as auth failures
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		s.security.Record(r.Context(), audit.Event{
+			Type:   audit.TypeAdminAction,
+			Action: event.Method + " " + event.Path,
+			Actor:  event.Actor,
+			Detail: event.Outcome,
+		})
+	}
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditOutcomeDenied
+	case status >= http.StatusBadRequest:
+		return auditOutcomeFailed
+	}
+	return auditOutcomeSuccess
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultRolesClaim is where admin tokens carry registry roles
+const defaultRolesClaim = "roles"
+
+// adminTokenLeeway tolerates clock skew with the OIDC provider
+const adminTokenLeeway = time.Minute
+
+// OIDCConfig configures admin access tokens issued by an OIDC provider
+type OIDCConfig struct {
+	Issuer   string
+	Audience string
+	// JWKSURL is discovered from the issuer's openid-configuration if empty
+	JWKSURL string
+	// RolesClaim is a claim name or a dotted path into nested claims, e.g.
+	// realm_access.roles for Keycloak
+	RolesClaim string
+}
+
+// LoadOIDCConfigFromEnv enables OIDC admin tokens when ADMIN_OIDC_ISSUER is
+// set; ADMIN_OIDC_AUDIENCE is then required
+func LoadOIDCConfigFromEnv() (*OIDCConfig, error) {
+	issuer := os.Getenv("ADMIN_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	config := &OIDCConfig{
+		Issuer:     issuer,
+		Audience:   os.Getenv("ADMIN_OIDC_AUDIENCE"),
+		JWKSURL:    os.Getenv("ADMIN_OIDC_JWKS_URL"),
+		RolesClaim: os.Getenv("ADMIN_OIDC_ROLES_CLAIM"),
+	}
+	if config.Audience == "" {
+		return nil, errors.New("ADMIN_OIDC_AUDIENCE is required with ADMIN_OIDC_ISSUER")
+	}
+	return config, nil
+}
+
+// adminTokenVerifier validates OIDC access tokens presented to the admin APIs
+type adminTokenVerifier struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu   sync.Mutex
+	keys *jwksKeys // nil until the JWKS URL is discovered
+}
+
+func newAdminTokenVerifier(config OIDCConfig) *adminTokenVerifier {
+	if config.RolesClaim == "" {
+		config.RolesClaim = defaultRolesClaim
+	}
+	v := &adminTokenVerifier{config: config, client: deadline.NewClient("oidc")}
+	if config.JWKSURL != "" {
+		v.keys = newJWKSKeys(config.JWKSURL, v.client)
+	}
+	return v
+}
+
+// Verify checks the token's signature, issuer, audience and lifetime, and
+// returns the principal it names
+func (v *adminTokenVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		keys, err := v.jwks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithAudience(v.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(adminTokenLeeway),
+	)
+	if err != nil {
+		return Principal{}, err
+	}
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return Principal{}, errors.New("token has no subject")
+	}
+	return Principal{Subject: subject, Roles: knownRoles(claimAt(claims, v.config.RolesClaim)), Method: authMethodOIDC}, nil
+}
+
+// jwks returns the provider's keys, discovering where they are published
+// on first use
+func (v *adminTokenVerifier) jwks(ctx context.Context) (*jwksKeys, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil {
+		return v.keys, nil
+	}
+	discoveryURL := strings.TrimSuffix(v.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery returned %d", resp.StatusCode)
+	}
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&metadata); err != nil || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document at %s has no jwks_uri", discoveryURL)
+	}
+	v.keys = newJWKSKeys(metadata.JWKSURI, v.client)
+	return v.keys, nil
+}
+
+// claimAt follows a dotted path into nested claims
+func claimAt(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// knownRoles reads a roles claim, a list or a space separated string, and
+// keeps the registry roles it names
+func knownRoles(claim interface{}) []string {
+	var names []string
+	switch value := claim.(type) {
+	case string:
+		names = strings.Fields(value)
+	case []interface{}:
+		for _, entry := range value {
+			if name, ok := entry.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	var roles []string
+	for _, name := range names {
+		if validRole(name) {
+			roles = append(roles, name)
+		}
+	}
+	return roles
+}
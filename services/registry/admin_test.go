@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOIDCAudience = "cachet-registry-admin"
+	testRolesClaim   = "realm_access.roles"
+)
+
+// testOIDCProvider serves OIDC discovery and a JWKS, and issues access tokens
+type testOIDCProvider struct {
+	issuer string
+	signer *signing.Signer
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	t.Helper()
+	provider := &testOIDCProvider{signer: newSigner()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"issuer": provider.issuer, "jwks_uri": provider.issuer + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []didresolver.JWK{provider.signer.PublicJWK()}})
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	provider.issuer = ts.URL
+	return provider
+}
+
+func (p *testOIDCProvider) token(t *testing.T, subject string, roles ...string) string {
+	t.Helper()
+	token, err := p.signer.Sign(jwt.MapClaims{
+		"iss":          p.issuer,
+		"aud":          testOIDCAudience,
+		"sub":          subject,
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string]interface{}{"roles": roles},
+	})
+	require.NoError(t, err)
+	return token
+}
+
+func newOIDCServer(provider *testOIDCProvider) *Server {
+	server := newAdminServer()
+	server.adminTokens = newAdminTokenVerifier(OIDCConfig{Issuer: provider.issuer, Audience: testOIDCAudience, RolesClaim: testRolesClaim})
+	return server
+}
+
+func auditEvents(t *testing.T, server *Server, query string) []AdminAuditEvent {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, "/admin/audit"+query, testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Events []AdminAuditEvent `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Events
+}
+
+func TestAdmin_RolesPerRoute(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	server := newOIDCServer(provider)
+	author := provider.token(t, "alice", RolePackAuthor, "offline_access")
+	trustAdmin := provider.token(t, "bob", RoleTrustAdmin)
+	reader := provider.token(t, "carol", RoleReadOnly)
+	issuer := TrustedIssuer{DID: "did:web:issuer.example", CredentialTypes: []string{"IdentityCredential"}}
+
+	assert.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", author, tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusForbidden, packRequest(t, server, http.MethodPost, "/trust/issuers", author, issuer).Code)
+
+	assert.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/trust/issuers", trustAdmin, issuer).Code)
+	assert.Equal(t, http.StatusForbidden, packRequest(t, server, http.MethodPost, "/packs", trustAdmin, tenantPack("2.0.0")).Code)
+
+	w := packRequest(t, server, http.MethodPost, "/packs", reader, tenantPack("2.0.0"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "insufficient_scope")
+
+	// Every role reads the admin views
+	for _, token := range []string{author, trustAdmin, reader} {
+		assert.Len(t, listPacks(t, server, "?status=draft", token), 1)
+		assert.Equal(t, http.StatusOK, packRequest(t, server, http.MethodGet, "/admin/audit", token, nil).Code)
+	}
+	// A token without registry roles is authenticated but not authorized
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodGet, "/packs?status=draft", provider.token(t, "dave"), nil).Code)
+	assert.Equal(t, http.StatusForbidden, packRequest(t, server, http.MethodGet, "/admin/audit", provider.token(t, "dave"), nil).Code)
+}
+
+func TestAdmin_RejectsInvalidTokens(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	other := newTestOIDCProvider(t)
+	server := newOIDCServer(provider)
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := provider.signer.Sign(claims)
+		require.NoError(t, err)
+		return token
+	}
+	valid := jwt.MapClaims{"iss": provider.issuer, "aud": testOIDCAudience, "sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{RolePackAuthor}}
+
+	for name, token := range map[string]string{
+		"other provider": other.token(t, "alice", RolePackAuthor),
+		"wrong audience": sign(jwt.MapClaims{"iss": provider.issuer, "aud": "another-api", "sub": "alice", "exp": valid["exp"], "roles": valid["roles"]}),
+		"wrong issuer":   sign(jwt.MapClaims{"iss": other.issuer, "aud": testOIDCAudience, "sub": "alice", "exp": valid["exp"], "roles": valid["roles"]}),
+		"expired":        sign(jwt.MapClaims{"iss": provider.issuer, "aud": testOIDCAudience, "sub": "alice", "exp": time.Now().Add(-time.Hour).Unix(), "roles": valid["roles"]}),
+		"no expiry":      sign(jwt.MapClaims{"iss": provider.issuer, "aud": testOIDCAudience, "sub": "alice", "roles": valid["roles"]}),
+		"no subject":     sign(jwt.MapClaims{"iss": provider.issuer, "aud": testOIDCAudience, "exp": valid["exp"], "roles": valid["roles"]}),
+		"not a jwt":      "operator-secrets",
+	} {
+		w := packRequest(t, server, http.MethodPost, "/packs", token, tenantPack("1.0.0"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+	}
+
+	// Roles at the top level need ADMIN_OIDC_ROLES_CLAIM=roles, the default
+	server.adminTokens = newAdminTokenVerifier(OIDCConfig{Issuer: provider.issuer, Audience: testOIDCAudience})
+	assert.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", sign(valid), tenantPack("1.0.0")).Code)
+}
+
+func TestAdmin_AuditsMutatingCalls(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	server := newOIDCServer(provider)
+	author := provider.token(t, "alice", RolePackAuthor)
+
+	packRequest(t, server, http.MethodPost, "/packs", author, tenantPack("1.0.0"))
+	packRequest(t, server, http.MethodPost, "/packs", author, tenantPack("1.0.0"))
+	packRequest(t, server, http.MethodDelete, "/trust/issuers/did:web:cachet.id", author, nil)
+	packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", "", PackUpdate{Status: PackStatusInReview})
+	packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusInReview})
+	listPacks(t, server, "?status=all", author)
+
+	events := auditEvents(t, server, "")
+	require.Len(t, events, 5, "reads are not audited")
+	assert.Equal(t, AdminAuditEvent{Actor: "alice", AuthMethod: authMethodOIDC, Roles: []string{RolePackAuthor}, Method: http.MethodPost, Path: "/packs", Status: http.StatusCreated, Outcome: auditOutcomeSuccess},
+		AdminAuditEvent{Actor: events[0].Actor, AuthMethod: events[0].AuthMethod, Roles: events[0].Roles, Method: events[0].Method, Path: events[0].Path, Status: events[0].Status, Outcome: events[0].Outcome})
+	assert.Equal(t, auditOutcomeFailed, events[1].Outcome)
+	assert.Equal(t, http.StatusConflict, events[1].Status)
+	assert.Equal(t, auditOutcomeDenied, events[2].Outcome)
+	assert.Equal(t, "/trust/issuers/did:web:cachet.id", events[2].Path)
+	assert.Equal(t, auditOutcomeDenied, events[3].Outcome)
+	assert.Empty(t, events[3].Actor)
+	assert.Equal(t, operatorSubject, events[4].Actor)
+	assert.Equal(t, authMethodOperatorToken, events[4].AuthMethod)
+	for i, event := range events {
+		assert.Equal(t, int64(i+1), event.Seq)
+		assert.False(t, event.Timestamp.IsZero())
+	}
+
+	assert.Len(t, auditEvents(t, server, "?actor=alice"), 3)
+	assert.Len(t, auditEvents(t, server, "?outcome=denied"), 2)
+	page := auditEvents(t, server, "?cursor=3&limit=1")
+	require.Len(t, page, 1)
+	assert.Equal(t, int64(4), page[0].Seq)
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodGet, "/admin/audit?limit=0", testOperatorToken, nil).Code)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+// Audit outcomes
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailed  = "failed"
+	auditOutcomeDenied  = "denied"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+// AdminAuditEvent records a mutating admin call: who made it, with which
+// credentials, and what the registry answered
+type AdminAuditEvent struct {
+	Seq        int64     `json:"seq"`
+	Actor      string    `json:"actor,omitempty"` // empty when unauthenticated
+	AuthMethod string    `json:"authMethod,omitempty"`
+	Roles      []string  `json:"roles,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Outcome    string    `json:"outcome"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// AuditFilter narrows an audit query. After is an exclusive Seq cursor.
+type AuditFilter struct {
+	Actor   string
+	Outcome string
+	Since   time.Time
+	After   int64
+	Limit   int
+}
+
+func (f AuditFilter) matches(e AdminAuditEvent) bool {
+	return e.Seq > f.After &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !e.Timestamp.Before(f.Since))
+}
+
+// AuditStore persists admin audit events in append order
+type AuditStore interface {
+	Append(ctx context.Context, event AdminAuditEvent) (AdminAuditEvent, error)
+	Query(ctx context.Context, filter AuditFilter) ([]AdminAuditEvent, error)
+}
+
+// memoryAuditStore keeps events in memory (production should use the
+// Postgres store so the trail survives restarts)
+type memoryAuditStore struct {
+	mu     sync.RWMutex
+	events []AdminAuditEvent
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{}
+}
+
+func (m *memoryAuditStore) Append(ctx context.Context, event AdminAuditEvent) (AdminAuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.Seq = int64(len(m.events)) + 1
+	m.events = append(m.events, event)
+	return event, nil
+}
+
+func (m *memoryAuditStore) Query(ctx context.Context, filter AuditFilter) ([]AdminAuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []AdminAuditEvent
+	for _, event := range m.events {
+		if !filter.matches(event) {
+			continue
+		}
+		out = append(out, event)
+		if filter.Limit > 0 && len(out) == filter.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// handleListAuditEvents pages through the admin audit log, oldest first
+func (s *Server) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:   query.Get("actor"),
+		Outcome: query.Get("outcome"),
+		Limit:   defaultAuditPageSize,
+	}
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			problem.Error(w, r, "Invalid since timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if filter.After, err = strconv.ParseInt(v, 10, 64); err != nil || filter.After < 0 {
+			problem.Error(w, r, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			problem.Error(w, r, fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := s.audit.Query(r.Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query admin audit events")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{"events": events}
+	if len(events) == filter.Limit {
+		resp["next_cursor"] = strconv.FormatInt(events[len(events)-1].Seq, 10)
+	}
+	if events == nil {
+		resp["events"] = []AdminAuditEvent{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// postgresAuditStore keeps the admin audit log in Postgres
+type postgresAuditStore struct {
+	db *sql.DB
+}
+
+// newPostgresAuditStore uses the tables of the registry migrations
+func newPostgresAuditStore(db *sql.DB) *postgresAuditStore {
+	return &postgresAuditStore{db: db}
+}
+
+func (p *postgresAuditStore) Append(ctx context.Context, event AdminAuditEvent) (AdminAuditEvent, error) {
+	event.Seq = 0
+	document, err := json.Marshal(event)
+	if err != nil {
+		return AdminAuditEvent{}, err
+	}
+	err = p.db.QueryRowContext(ctx,
+		`INSERT INTO admin_audit (actor, outcome, recorded_at, document) VALUES ($1, $2, $3, $4) RETURNING seq`,
+		event.Actor, event.Outcome, event.Timestamp, document).Scan(&event.Seq)
+	return event, err
+}
+
+func (p *postgresAuditStore) Query(ctx context.Context, filter AuditFilter) ([]AdminAuditEvent, error) {
+	limit := sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+	since := sql.NullTime{Time: filter.Since, Valid: !filter.Since.IsZero()}
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT seq, document FROM admin_audit
+		 WHERE seq > $1 AND ($2 = '' OR actor = $2) AND ($3 = '' OR outcome = $3) AND ($4::timestamptz IS NULL OR recorded_at >= $4)
+		 ORDER BY seq LIMIT $5`,
+		filter.After, filter.Actor, filter.Outcome, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []AdminAuditEvent
+	for rows.Next() {
+		var seq int64
+		var document []byte
+		if err := rows.Scan(&seq, &document); err != nil {
+			return nil, err
+		}
+		var event AdminAuditEvent
+		if err := json.Unmarshal(document, &event); err != nil {
+			return nil, fmt.Errorf("decoding audit event: %w", err)
+		}
+		event.Seq = seq
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
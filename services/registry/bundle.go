@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrBundleNotFound = errors.New("bundle version not found")
+
+// ConfigBundle is a versioned snapshot of registry data for wallet releases
+type ConfigBundle struct {
+	Version   int       `json:"version"`
+	Digest    string    `json:"digest"`
+	CreatedAt time.Time `json:"createdAt"`
+	BundleContents
+}
+
+// SectionDelta lists entries added or changed, and IDs removed, in one section
+type SectionDelta[T any] struct {
+	Upserted []T      `json:"upserted,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+// BundleDelta transforms bundle From into bundle To
+type BundleDelta struct {
+	From           int                              `json:"from"`
+	To             int                              `json:"to"`
+	Digest         string                           `json:"digest"`
+	Packs          SectionDelta[PackSummary]        `json:"packs"`
+	TrustedIssuers SectionDelta[TrustedIssuer]      `json:"trustedIssuers"`
+	StatusLists    SectionDelta[StatusListLocation] `json:"statusLists"`
+	IssuerMetadata map[string]interface{}           `json:"issuerMetadata,omitempty"`
+}
+
+// SignedBundle is the envelope served to wallets; the JWS payload carries the
+// bundle or delta under the "bundle" claim
+type SignedBundle struct {
+	Version int    `json:"version"`
+	Digest  string `json:"digest"`
+	JWS     string `json:"jws"`
+}
+
+// BundleStore keeps every compiled bundle so deltas can be served from any
+// prior version. Each tenant has its own sequence of versions, read from the
+// context.
+type BundleStore interface {
+	// Compile snapshots the catalog into a new bundle version, reusing the
+	// latest version when nothing has changed
+	Compile(ctx context.Context, contents BundleContents) (ConfigBundle, bool, error)
+	Get(ctx context.Context, version int) (ConfigBundle, error)
+	Latest(ctx context.Context) (ConfigBundle, error)
+	// Durable reports whether a version number names the same bundle across
+	// restarts and replicas, so clients may cache numbered versions forever
+	Durable() bool
+}
+
+// memoryBundleStore numbers versions per process, so they restart from 1
+// and differ between replicas; use it for development and tests only
+type memoryBundleStore struct {
+	mu       sync.RWMutex
+	versions map[string][]ConfigBundle // by tenant
+}
+
+func newMemoryBundleStore() *memoryBundleStore {
+	return &memoryBundleStore{versions: map[string][]ConfigBundle{}}
+}
+
+func (b *memoryBundleStore) Compile(ctx context.Context, contents BundleContents) (ConfigBundle, bool, error) {
+	digest, err := digestOf(contents)
+	if err != nil {
+		return ConfigBundle{}, false, err
+	}
+
+	tenantID := tenant.FromContext(ctx).ID
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	versions := b.versions[tenantID]
+	if n := len(versions); n > 0 && versions[n-1].Digest == digest {
+		return versions[n-1], false, nil
+	}
+
+	bundle := ConfigBundle{
+		Version:        len(versions) + 1,
+		Digest:         digest,
+		CreatedAt:      time.Now().UTC(),
+		BundleContents: contents,
+	}
+	b.versions[tenantID] = append(versions, bundle)
+	return bundle, true, nil
+}
+
+func (b *memoryBundleStore) Get(ctx context.Context, version int) (ConfigBundle, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	versions := b.versions[tenant.FromContext(ctx).ID]
+	if version < 1 || version > len(versions) {
+		return ConfigBundle{}, ErrBundleNotFound
+	}
+	return versions[version-1], nil
+}
+
+func (b *memoryBundleStore) Latest(ctx context.Context) (ConfigBundle, error) {
+	b.mu.RLock()
+	n := len(b.versions[tenant.FromContext(ctx).ID])
+	b.mu.RUnlock()
+	return b.Get(ctx, n)
+}
+
+func (b *memoryBundleStore) Durable() bool {
+	return false
+}
+
+func digestOf(contents BundleContents) (string, error) {
+	raw, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Diff computes the delta between two bundles
+func Diff(from, to ConfigBundle) BundleDelta {
+	delta := BundleDelta{
+		From:           from.Version,
+		To:             to.Version,
+		Digest:         to.Digest,
+		Packs:          diffSection(from.Packs, to.Packs, func(p PackSummary) string { return p.ID }),
+		TrustedIssuers: diffSection(from.TrustedIssuers, to.TrustedIssuers, func(i TrustedIssuer) string { return i.DID }),
+		StatusLists:    diffSection(from.StatusLists, to.StatusLists, func(l StatusListLocation) string { return l.ID }),
+	}
+	if !reflect.DeepEqual(from.IssuerMetadata, to.IssuerMetadata) {
+		delta.IssuerMetadata = to.IssuerMetadata
+	}
+	return delta
+}
+
+func diffSection[T any](from, to []T, key func(T) string) SectionDelta[T] {
+	previous := make(map[string]T, len(from))
+	for _, entry := range from {
+		previous[key(entry)] = entry
+	}
+
+	var delta SectionDelta[T]
+	for _, entry := range to {
+		old, ok := previous[key(entry)]
+		if !ok || !reflect.DeepEqual(old, entry) {
+			delta.Upserted = append(delta.Upserted, entry)
+		}
+		delete(previous, key(entry))
+	}
+	for _, entry := range from {
+		if _, removed := previous[key(entry)]; removed {
+			delta.Removed = append(delta.Removed, key(entry))
+		}
+	}
+	return delta
+}
+
+func (s *Server) signBundle(version int, digest string, payload interface{}) (SignedBundle, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return SignedBundle{}, err
+	}
+	var claim map[string]interface{}
+	if err := json.Unmarshal(raw, &claim); err != nil {
+		return SignedBundle{}, err
+	}
+
+	jws, err := s.signer.Sign(jwt.MapClaims{
+		"iss":    registryIssuer,
+		"iat":    time.Now().Unix(),
+		"bundle": claim,
+	})
+	if err != nil {
+		return SignedBundle{}, err
+	}
+	return SignedBundle{Version: version, Digest: digest, JWS: jws}, nil
+}
+
+func (s *Server) handleCompileBundle(w http.ResponseWriter, r *http.Request) {
+	packs, err := s.publishedPackSummaries(r)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	issuers, err := s.trust.ListIssuers(r.Context(), IssuerFilter{})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	bundle, created, err := s.bundles.Compile(r.Context(), s.catalog.Snapshot(packs, issuers))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compile config bundle")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	signed, err := s.signBundle(bundle.Version, bundle.Digest, bundle)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign config bundle")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		log.Info().Int("version", bundle.Version).Str("digest", bundle.Digest).Msg("Config bundle compiled")
+	}
+	writeJSON(w, status, signed)
+}
+
+// bundleCacheControl lets clients keep numbered bundles forever when the
+// store numbers them durably; "latest" moves with every compile, and
+// in-memory versions are renumbered on restart
+func (s *Server) bundleCacheControl(param string) string {
+	if param == "latest" || !s.bundles.Durable() {
+		return cacheRevalidate
+	}
+	return cacheImmutable
+}
+
+// handleGetBundle serves a signed bundle. Its ETag is the bundle digest, as
+// the envelope's signature differs on every request.
+func (s *Server) handleGetBundle(w http.ResponseWriter, r *http.Request) {
+	param := chi.URLParam(r, "version")
+	bundle, ok := s.lookupBundle(w, r, param)
+	if !ok {
+		return
+	}
+	validators := cacheValidators{ETag: `"` + bundle.Digest + `"`, LastModified: bundle.CreatedAt}
+	if notModified(w, r, validators, s.bundleCacheControl(param)) {
+		return
+	}
+
+	signed, err := s.signBundle(bundle.Version, bundle.Digest, bundle)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign config bundle")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, signed)
+}
+
+func (s *Server) handleGetBundleDelta(w http.ResponseWriter, r *http.Request) {
+	param := chi.URLParam(r, "version")
+	to, ok := s.lookupBundle(w, r, param)
+	if !ok {
+		return
+	}
+	fromVersion, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || fromVersion >= to.Version {
+		problem.Error(w, r, "from must be an earlier bundle version", http.StatusBadRequest)
+		return
+	}
+	from, err := s.bundles.Get(r.Context(), fromVersion)
+	if err != nil {
+		problem.Error(w, r, "Bundle version not found", http.StatusNotFound)
+		return
+	}
+
+	validators := cacheValidators{ETag: strongETag([]byte(from.Digest + ".." + to.Digest)), LastModified: to.CreatedAt}
+	if notModified(w, r, validators, s.bundleCacheControl(param)) {
+		return
+	}
+
+	delta := Diff(from, to)
+	signed, err := s.signBundle(to.Version, to.Digest, delta)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign config bundle delta")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, signed)
+}
+
+// lookupBundle resolves a version path parameter, accepting "latest"
+func (s *Server) lookupBundle(w http.ResponseWriter, r *http.Request, param string) (ConfigBundle, bool) {
+	var (
+		bundle ConfigBundle
+		err    error
+	)
+	if param == "latest" {
+		bundle, err = s.bundles.Latest(r.Context())
+	} else {
+		version, convErr := strconv.Atoi(param)
+		if convErr != nil {
+			problem.Error(w, r, "Invalid bundle version", http.StatusBadRequest)
+			return ConfigBundle{}, false
+		}
+		bundle, err = s.bundles.Get(r.Context(), version)
+	}
+	if err != nil {
+		problem.Error(w, r, "Bundle version not found", http.StatusNotFound)
+		return ConfigBundle{}, false
+	}
+	return bundle, true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(t *testing.T, server *Server, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+// compileBundle compiles the catalog into a bundle, as an operator
+func compileBundle(t *testing.T, server *Server) *httptest.ResponseRecorder {
+	t.Helper()
+	return packRequest(t, server, http.MethodPost, "/bundles", testOperatorToken, nil)
+}
+
+func decodeSignedBundle(t *testing.T, server *Server, w *httptest.ResponseRecorder) (SignedBundle, jwt.MapClaims) {
+	t.Helper()
+	var signed SignedBundle
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &signed))
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(signed.JWS, claims, func(token *jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	require.NoError(t, err)
+	return signed, claims
+}
+
+func TestCompileBundle_Versioning(t *testing.T) {
+	server := newAdminServer()
+
+	w := compileBundle(t, server)
+	require.Equal(t, http.StatusCreated, w.Code)
+	first, claims := decodeSignedBundle(t, server, w)
+	assert.Equal(t, 1, first.Version)
+	bundle := claims["bundle"].(map[string]interface{})
+	assert.Len(t, bundle["packs"], 2)
+	assert.Equal(t, first.Digest, bundle["digest"])
+
+	// Recompiling an unchanged catalog reuses the version
+	w = compileBundle(t, server)
+	require.Equal(t, http.StatusOK, w.Code)
+	again, _ := decodeSignedBundle(t, server, w)
+	assert.Equal(t, first.Version, again.Version)
+
+	w = doRequest(t, server, http.MethodGet, "/bundles/latest")
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCompileBundle_RequiresTrustAdmin(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	server := newOIDCServer(provider)
+
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/bundles", "", nil).Code)
+	w := packRequest(t, server, http.MethodPost, "/bundles", provider.token(t, "alice", RolePackAuthor), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "requires the "+RoleTrustAdmin+" role")
+	w = packRequest(t, server, http.MethodPost, "/bundles", provider.token(t, "bob", RoleTrustAdmin), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// Every compile attempt is audited, and bundles stay public to read
+	events := auditEvents(t, server, "?actor=bob")
+	require.Len(t, events, 1)
+	assert.Equal(t, http.MethodPost, events[0].Method)
+	assert.Equal(t, "/bundles", events[0].Path)
+	assert.Equal(t, http.StatusCreated, events[0].Status)
+	assert.Len(t, auditEvents(t, server, "?outcome=denied"), 2)
+	assert.Equal(t, http.StatusOK, doRequest(t, server, http.MethodGet, "/bundles/latest").Code)
+}
+
+func TestBundleDelta(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusCreated, compileBundle(t, server).Code)
+
+	ctx := context.Background()
+	_, err := server.packs.Update(ctx, "pack.childcare.readiness", "0.1.0", func(pack *StoredPack) error {
+		return transitionPack(pack, PackStatusRetired, time.Now())
+	})
+	require.NoError(t, err)
+	seller, err := server.packs.Get(ctx, "pack.safe.seller", "0.1.0")
+	require.NoError(t, err)
+	seller.Version = "0.2.0"
+	require.NoError(t, server.packs.Create(ctx, seller))
+	require.NoError(t, server.packs.Create(ctx, StoredPack{
+		PublishedPack: PublishedPack{PackSummary: PackSummary{ID: "pack.tenant.ready", Version: "0.1.0", Name: "Tenant Ready"}},
+		Status:        PackStatusPublished,
+	}))
+	require.Equal(t, http.StatusCreated, compileBundle(t, server).Code)
+
+	w := doRequest(t, server, http.MethodGet, "/bundles/2/delta?from=1")
+	require.Equal(t, http.StatusOK, w.Code)
+	signed, claims := decodeSignedBundle(t, server, w)
+	assert.Equal(t, 2, signed.Version)
+
+	raw, err := json.Marshal(claims["bundle"])
+	require.NoError(t, err)
+	var delta BundleDelta
+	require.NoError(t, json.Unmarshal(raw, &delta))
+	assert.Equal(t, []string{"pack.childcare.readiness"}, delta.Packs.Removed)
+	require.Len(t, delta.Packs.Upserted, 2)
+	assert.Empty(t, delta.TrustedIssuers.Upserted)
+	assert.Nil(t, delta.IssuerMetadata)
+}
+
+func TestBundleDelta_InvalidRange(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusCreated, compileBundle(t, server).Code)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(t, server, http.MethodGet, "/bundles/1/delta?from=1").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, server, http.MethodGet, "/bundles/7").Code)
+}
+
+func TestJWKS(t *testing.T) {
+	server := NewServer()
+
+	w := doRequest(t, server, http.MethodGet, "/.well-known/jwks.json")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, server.signer.KeyID(), jwks.Keys[0]["kid"])
+}
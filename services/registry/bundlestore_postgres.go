@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// postgresBundleStore keeps compiled bundles in Postgres, so versions
+// survive restarts and every replica serves the same bundle for a version
+type postgresBundleStore struct {
+	db *sql.DB
+}
+
+// newPostgresBundleStore uses the tables of the registry migrations
+func newPostgresBundleStore(db *sql.DB) *postgresBundleStore {
+	return &postgresBundleStore{db: db}
+}
+
+const selectBundle = `SELECT version, digest, contents, created_at FROM config_bundles`
+
+func scanBundle(row rowScanner) (ConfigBundle, error) {
+	var (
+		bundle   ConfigBundle
+		contents []byte
+	)
+	if err := row.Scan(&bundle.Version, &bundle.Digest, &contents, &bundle.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ConfigBundle{}, ErrBundleNotFound
+		}
+		return ConfigBundle{}, err
+	}
+	if err := json.Unmarshal(contents, &bundle.BundleContents); err != nil {
+		return ConfigBundle{}, fmt.Errorf("decoding config bundle %d: %w", bundle.Version, err)
+	}
+	bundle.CreatedAt = bundle.CreatedAt.UTC()
+	return bundle, nil
+}
+
+// Compile numbers the bundle under a transaction-scoped advisory lock on the
+// tenant, so replicas compiling at once never hand out the same version
+func (p *postgresBundleStore) Compile(ctx context.Context, contents BundleContents) (ConfigBundle, bool, error) {
+	digest, err := digestOf(contents)
+	if err != nil {
+		return ConfigBundle{}, false, err
+	}
+	raw, err := json.Marshal(contents)
+	if err != nil {
+		return ConfigBundle{}, false, err
+	}
+
+	tenantID := tenant.FromContext(ctx).ID
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ConfigBundle{}, false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "bundles:"+tenantID); err != nil {
+		return ConfigBundle{}, false, fmt.Errorf("locking bundles of tenant %s: %w", tenantID, err)
+	}
+	latest, err := scanBundle(tx.QueryRowContext(ctx, selectBundle+` WHERE tenant = $1 ORDER BY version DESC LIMIT 1`, tenantID))
+	switch {
+	case err == nil && latest.Digest == digest:
+		return latest, false, nil
+	case err != nil && !errors.Is(err, ErrBundleNotFound):
+		return ConfigBundle{}, false, err
+	}
+
+	bundle := ConfigBundle{
+		Version:        latest.Version + 1,
+		Digest:         digest,
+		CreatedAt:      time.Now().UTC(),
+		BundleContents: contents,
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO config_bundles (tenant, version, digest, contents, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		tenantID, bundle.Version, bundle.Digest, raw, bundle.CreatedAt); err != nil {
+		return ConfigBundle{}, false, err
+	}
+	return bundle, true, tx.Commit()
+}
+
+func (p *postgresBundleStore) Get(ctx context.Context, version int) (ConfigBundle, error) {
+	return scanBundle(p.db.QueryRowContext(ctx, selectBundle+` WHERE tenant = $1 AND version = $2`, tenant.FromContext(ctx).ID, version))
+}
+
+func (p *postgresBundleStore) Latest(ctx context.Context) (ConfigBundle, error) {
+	return scanBundle(p.db.QueryRowContext(ctx, selectBundle+` WHERE tenant = $1 ORDER BY version DESC LIMIT 1`, tenant.FromContext(ctx).ID))
+}
+
+func (p *postgresBundleStore) Durable() bool {
+	return true
+}
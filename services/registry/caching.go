@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+// Cache-Control policies for registry resources. Mutable resources are
+// always revalidated, which conditional requests make cheap.
+const (
+	cacheRevalidate = "no-cache"
+	cacheShort      = "public, max-age=300"
+	cacheImmutable  = "public, max-age=31536000, immutable"
+)
+
+// cacheValidators identify a representation for conditional requests
+type cacheValidators struct {
+	ETag         string    // strong and quoted
+	LastModified time.Time // zero when unknown
+}
+
+// strongETag is a digest of the exact bytes served
+func strongETag(body []byte) string {
+	digest := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(digest[:]) + `"`
+}
+
+// etagMatches applies If-None-Match's weak comparison (RFC 9110 §13.1.2)
+// to a list of entity tags or "*"
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (etag != "" && strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the validators and Cache-Control, then answers 304 Not
+// Modified when the client's copy is current. If-Modified-Since is only
+// consulted without If-None-Match, as RFC 9110 §13.2.2 requires.
+func notModified(w http.ResponseWriter, r *http.Request, validators cacheValidators, cacheControl string) bool {
+	header := w.Header()
+	if validators.ETag != "" {
+		header.Set("ETag", validators.ETag)
+	}
+	if !validators.LastModified.IsZero() {
+		header.Set("Last-Modified", validators.LastModified.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Cache-Control", cacheControl)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagMatches(ifNoneMatch, validators.ETag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || validators.LastModified.IsZero() || validators.LastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeCachedJSON serves body with a strong ETag over its encoding
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, body interface{}, lastModified time.Time, cacheControl string) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	raw = append(raw, '\n')
+	if notModified(w, r, cacheValidators{ETag: strongETag(raw), LastModified: lastModified}, cacheControl) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(raw); err != nil {
+		log.Error().Err(err).Msg("Failed to write response")
+	}
+}
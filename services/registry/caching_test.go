@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func conditionalGet(server *Server, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestETagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"a"`, `"a"`))
+	assert.True(t, etagMatches(`"b", W/"a"`, `"a"`), "If-None-Match uses weak comparison")
+	assert.True(t, etagMatches(`*`, `"a"`))
+	assert.False(t, etagMatches(`"b"`, `"a"`))
+	assert.False(t, etagMatches(`"a"`, ""))
+}
+
+func TestPacks_ConditionalRequests(t *testing.T) {
+	server := NewServer()
+
+	w := conditionalGet(server, "/packs", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, lastModified)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/packs", map[string]string{"If-Modified-Since": lastModified}).Code)
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/packs", map[string]string{"If-None-Match": `"other", ` + etag}).Code)
+	// If-None-Match wins over If-Modified-Since
+	w = conditionalGet(server, "/packs", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Retiring a pack drops it from the list without changing any listed pack
+	_, err := server.packs.Update(context.Background(), "pack.childcare.readiness", "0.1.0", func(pack *StoredPack) error {
+		return transitionPack(pack, PackStatusRetired, time.Now().Add(2*time.Second))
+	})
+	require.NoError(t, err)
+	w = conditionalGet(server, "/packs", map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, lastModified, w.Header().Get("Last-Modified"))
+	assert.Equal(t, http.StatusOK, conditionalGet(server, "/packs", map[string]string{"If-None-Match": etag}).Code)
+
+	w = conditionalGet(server, "/packs/pack.safe.seller@0.1.0", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/packs/pack.safe.seller@0.1.0", map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code)
+}
+
+func packChanges(t *testing.T, server *Server, since string) (PackChanges, *httptest.ResponseRecorder) {
+	t.Helper()
+	path := "/packs/changes"
+	if since != "" {
+		path += "?since=" + since
+	}
+	w := conditionalGet(server, path, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var changes PackChanges
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &changes))
+	return changes, w
+}
+
+func TestPackChanges(t *testing.T) {
+	server := newAdminServer()
+
+	// A first sync lists every published pack
+	changes, _ := packChanges(t, server, "")
+	assert.Len(t, changes.Published, 2)
+	assert.Empty(t, changes.Retired)
+	cursor := changes.Cursor.Format(time.RFC3339Nano)
+
+	changes, w := packChanges(t, server, cursor)
+	assert.Empty(t, changes.Published)
+	assert.Empty(t, changes.Retired)
+	assert.Equal(t, cursor, changes.Cursor.Format(time.RFC3339Nano), "the cursor stays put until a pack changes")
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/packs/changes?since="+cursor, map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code)
+
+	// Drafts are invisible; publishing and retiring are changes
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack("1.0.0")).Code)
+	changes, _ = packChanges(t, server, cursor)
+	assert.Empty(t, changes.Published)
+
+	approvePack(t, server, "pack.tenant.ready@1.0.0")
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.childcare.readiness@0.1.0", testOperatorToken, PackUpdate{Status: PackStatusRetired})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	changes, _ = packChanges(t, server, cursor)
+	require.Len(t, changes.Published, 1)
+	assert.Equal(t, "pack.tenant.ready", changes.Published[0].ID)
+	assert.Equal(t, []string{"pack.childcare.readiness@0.1.0"}, changes.Retired)
+	assert.True(t, changes.Cursor.After(mustParseTime(t, cursor)))
+
+	changes, _ = packChanges(t, server, changes.Cursor.Format(time.RFC3339Nano))
+	assert.Empty(t, changes.Published)
+	assert.Empty(t, changes.Retired)
+
+	assert.Equal(t, http.StatusBadRequest, conditionalGet(server, "/packs/changes?since=yesterday", nil).Code)
+}
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	require.NoError(t, err)
+	return parsed
+}
+
+// durableBundleStore numbers bundles like a store shared by every replica
+type durableBundleStore struct {
+	*memoryBundleStore
+}
+
+func (durableBundleStore) Durable() bool {
+	return true
+}
+
+func TestCaching_ImmutableResources(t *testing.T) {
+	server := newAdminServer()
+	server.bundles = durableBundleStore{newMemoryBundleStore()}
+	require.Equal(t, http.StatusCreated, compileBundle(t, server).Code)
+
+	w := conditionalGet(server, "/bundles/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cacheImmutable, w.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/bundles/1", map[string]string{"If-None-Match": etag}).Code)
+
+	w = conditionalGet(server, "/bundles/latest", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code, "latest has the same content as version 1")
+	assert.Equal(t, cacheRevalidate, w.Header().Get("Cache-Control"))
+
+	w = conditionalGet(server, "/schemas/AgeOverCredential/1.0.0", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cacheImmutable, w.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/schemas/AgeOverCredential/1.0.0", map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code)
+
+	for _, path := range []string{"/trust/issuers", "/trusted-issuers", "/.well-known/jwks.json", "/packs/pack.safe.seller@0.1.0/policy"} {
+		w = conditionalGet(server, path, nil)
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, http.StatusNotModified, conditionalGet(server, path, map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code, path)
+	}
+}
+
+func TestCaching_InMemoryBundlesRevalidate(t *testing.T) {
+	// In-memory versions are renumbered on restart and differ between
+	// replicas, so no numbered version may be cached forever
+	server := newAdminServer()
+	require.Equal(t, http.StatusCreated, compileBundle(t, server).Code)
+	for _, path := range []string{"/bundles/1", "/bundles/latest"} {
+		w := conditionalGet(server, path, nil)
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, cacheRevalidate, w.Header().Get("Cache-Control"), path)
+		assert.Equal(t, http.StatusNotModified, conditionalGet(server, path, map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code, path)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PackSummary is the registry's public view of a trust pack
+type PackSummary struct {
+	ID            string   `json:"id"`
+	Version       string   `json:"version"`
+	Name          string   `json:"name"`
+	Purpose       string   `json:"purpose,omitempty"`
+	Jurisdictions []string `json:"jurisdictions,omitempty"`
+	Categories    []string `json:"categories,omitempty"` // ids from the category taxonomy
+}
+
+// StatusListLocation points at a StatusList2021 credential
+type StatusListLocation struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Issuer string `json:"issuer"`
+}
+
+// Catalog is the set of registry resources distributed to wallets
+type Catalog struct {
+	mu             sync.RWMutex
+	issuerMetadata map[string]interface{}
+	statusLists    []StatusListLocation
+	policies       map[string][]byte // pack id@version -> YAML rules
+}
+
+func defaultCatalog() *Catalog {
+	policies, err := loadPackPolicies()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load pack policies")
+	}
+	return &Catalog{
+		policies: policies,
+		issuerMetadata: map[string]interface{}{
+			"credential_issuer":   "did:web:cachet.id",
+			"credential_endpoint": "https://issuance.cachet.id/credential",
+			"token_endpoint":      "https://issuance.cachet.id/oauth/token",
+		},
+		statusLists: []StatusListLocation{
+			{ID: "1", URL: "https://cachet.id/status/1", Issuer: "did:web:cachet.id"},
+		},
+	}
+}
+
+// builtinPacks are the packs the registry ships with (docs/PACKS), published
+// into an empty pack store at startup
+func builtinPacks() []PackSummary {
+	return []PackSummary{
+		{
+			ID:            "pack.childcare.readiness",
+			Version:       "0.1.0",
+			Name:          "Childcare Readiness",
+			Purpose:       "Assess suitability for paid childcare work in private homes",
+			Jurisdictions: []string{"EU"},
+			Categories:    []string{"care"},
+		},
+		{
+			ID:            "pack.safe.seller",
+			Version:       "0.1.0",
+			Name:          "Safe Seller",
+			Purpose:       "Reduce counterparty and fraud risk in peer-to-peer sales",
+			Jurisdictions: []string{"EU"},
+			Categories:    []string{"marketplace"},
+		},
+	}
+}
+
+// builtinTrustedIssuers are the issuers the registry ships with, added to
+// an empty trust registry at startup
+func builtinTrustedIssuers() []TrustedIssuer {
+	return []TrustedIssuer{
+		{
+			DID:             "did:web:cachet.id",
+			Name:            "Cachet",
+			CredentialTypes: []string{"IdentityCredential", "AgeOverCredential"},
+			Jurisdictions:   []string{"EU"},
+			Status:          TrustStatusActive,
+		},
+	}
+}
+
+// BundleContents is a point-in-time copy of the catalog, published packs and
+// trusted issuers
+type BundleContents struct {
+	Packs          []PackSummary          `json:"packs"`
+	TrustedIssuers []TrustedIssuer        `json:"trustedIssuers"`
+	IssuerMetadata map[string]interface{} `json:"issuerMetadata"`
+	StatusLists    []StatusListLocation   `json:"statusLists"`
+}
+
+// Snapshot copies the catalog with the given packs and issuers so bundles
+// are immutable once compiled
+func (c *Catalog) Snapshot(packs []PackSummary, issuers []TrustedIssuer) BundleContents {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	metadata := make(map[string]interface{}, len(c.issuerMetadata))
+	for k, v := range c.issuerMetadata {
+		metadata[k] = v
+	}
+	return BundleContents{
+		Packs:          append([]PackSummary(nil), packs...),
+		TrustedIssuers: append([]TrustedIssuer(nil), issuers...),
+		IssuerMetadata: metadata,
+		StatusLists:    append([]StatusListLocation(nil), c.statusLists...),
+	}
+}
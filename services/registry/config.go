@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// Config is the registry's configuration, documented in CONFIG.md. The
+// database, admin OIDC and federation keep their own variables, read by
+// their loaders.
+type Config struct {
+	config.Base
+	OperatorToken string `env:"OPERATOR_API_TOKEN" secret:"true" doc:"Token operators present to manage packs and trust registry entries"`
+	SigningKey    string `env:"REGISTRY_SIGNING_KEY" doc:"PEM file of the P-256 key signing manifests, bundles and packs, published under its RFC 7638 thumbprint as kid; required outside development, where a key is generated at startup without one"`
+	ServiceAuth   serviceauth.Config
+	CORS          cors.Config
+	APIVersion    apiversion.Config
+	SecurityAudit audit.Config
+	Tenants       tenant.Config
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{Base: config.Base{Port: 8082}}
+}
+
+// Validate checks the port, service authentication, signing key, CORS
+// origins, legacy API sunset, security audit and tenants file are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if c.SigningKey == "" && !c.Development() {
+		return errors.New("REGISTRY_SIGNING_KEY is required outside development, as signatures of a generated key stop verifying at the next restart")
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if err := c.APIVersion.Validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityAudit.Validate(); err != nil {
+		return err
+	}
+	return c.Tenants.Validate()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PackKindLibrary marks a shared predicate library: a pack other packs
+// depend on, which verifiers never request on its own
+const PackKindLibrary = "library"
+
+// ErrPackDependency means a pack's dependency graph does not resolve
+var ErrPackDependency = errors.New("pack dependencies do not resolve")
+
+// PackDependency requires another pack or library, e.g. the base identity
+// pack at ^1.0.0
+type PackDependency struct {
+	Pack    string `json:"pack"`    // id, without @version
+	Version string `json:"version"` // 1.2.0, ^1.2.0 or ~1.2.0
+}
+
+// ResolvedPolicy is a pack's rules merged with those of its whole dependency
+// graph, as verifiers evaluate them
+type ResolvedPolicy struct {
+	Rules     []PolicyRule     `json:"rules"`
+	Freshness *FreshnessPolicy `json:"freshness,omitempty"`
+	Match     []MatchRule      `json:"match,omitempty"`
+}
+
+// ResolvedPack is the flattened view of a pack served at
+// GET /packs/{ref}/resolved
+type ResolvedPack struct {
+	PackSummary
+	Kind     string   `json:"kind,omitempty"`
+	Includes []string `json:"includes"`
+	ResolvedPolicy
+}
+
+// validateDependencies checks a pack's kind and dependency declarations
+func validateDependencies(pack PublishedPack) error {
+	if pack.Kind != "" && pack.Kind != PackKindLibrary {
+		return fmt.Errorf("kind must be empty or %q", PackKindLibrary)
+	}
+	seen := map[string]bool{}
+	for _, dep := range pack.Dependencies {
+		if dep.Pack == "" || strings.ContainsAny(dep.Pack, "@/ ") {
+			return fmt.Errorf("dependency id %q is invalid", dep.Pack)
+		}
+		if dep.Pack == pack.ID {
+			return errors.New("a pack cannot depend on itself")
+		}
+		if seen[dep.Pack] {
+			return fmt.Errorf("duplicate dependency %q", dep.Pack)
+		}
+		seen[dep.Pack] = true
+		if _, err := parseConstraint(dep.Version); err != nil {
+			return fmt.Errorf("dependency %s: %w", dep.Pack, err)
+		}
+	}
+	return nil
+}
+
+// resolveDependencies pins each dependency to its highest published version
+// matching the constraint, and returns the whole graph as id@version in
+// evaluation order, dependencies first. Published packs carry their own
+// pinned graph, so two paths reaching different versions of a pack conflict.
+func resolveDependencies(ctx context.Context, store PackStore, pack PublishedPack) ([]string, error) {
+	var includes []string
+	pinned := map[string]string{pack.ID: pack.Version}
+	include := func(ref string) error {
+		id, version := splitPackRef(ref)
+		if existing, ok := pinned[id]; ok {
+			if existing != version {
+				return fmt.Errorf("%w: %s is required at both %s and %s", ErrPackDependency, id, existing, version)
+			}
+			return nil
+		}
+		pinned[id] = version
+		includes = append(includes, ref)
+		return nil
+	}
+	for _, dep := range pack.Dependencies {
+		constraint, err := parseConstraint(dep.Version)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s: %w", dep.Pack, err)
+		}
+		candidates, err := store.List(ctx, PackFilter{ID: dep.Pack, Status: PackStatusPublished})
+		if err != nil {
+			return nil, err
+		}
+		var match *StoredPack
+		for i := len(candidates) - 1; i >= 0; i-- { // highest version first
+			if version, err := parseSemver(candidates[i].Version); err == nil && constraint.allows(version) {
+				match = &candidates[i]
+				break
+			}
+		}
+		if match == nil {
+			return nil, fmt.Errorf("%w: no published version of %s matches %s", ErrPackDependency, dep.Pack, dep.Version)
+		}
+		if pack.Kind == PackKindLibrary && match.Kind != PackKindLibrary {
+			return nil, fmt.Errorf("%w: library %s can only depend on libraries, not %s", ErrPackDependency, pack.ID, match.Ref())
+		}
+		for _, ref := range append(append([]string(nil), match.Includes...), match.Ref()) {
+			if err := include(ref); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return includes, nil
+}
+
+// flattenPack merges the rules of every pack pack includes with its own.
+// Rule ids must be unique across the graph, so a verifier's result names
+// one rule; freshness limits take the strictest value.
+func flattenPack(ctx context.Context, store PackStore, pack PublishedPack) (ResolvedPolicy, error) {
+	resolved := ResolvedPolicy{Rules: []PolicyRule{}}
+	origins := map[string]string{}
+	claim := func(id, ref string) error {
+		if origin, ok := origins[id]; ok {
+			return fmt.Errorf("%w: rule %q is defined by both %s and %s", ErrPackDependency, id, origin, ref)
+		}
+		origins[id] = ref
+		return nil
+	}
+	merge := func(ref string, source PublishedPack) error {
+		for _, rule := range source.Rules {
+			if err := claim(rule.ID, ref); err != nil {
+				return err
+			}
+			resolved.Rules = append(resolved.Rules, rule)
+		}
+		for _, match := range source.Match {
+			if err := claim(match.ID, ref); err != nil {
+				return err
+			}
+			resolved.Match = append(resolved.Match, match)
+		}
+		resolved.Freshness = stricterFreshness(resolved.Freshness, source.Freshness)
+		return nil
+	}
+	for _, ref := range pack.Includes {
+		id, version := splitPackRef(ref)
+		dep, err := store.Get(ctx, id, version)
+		if errors.Is(err, ErrPackNotFound) {
+			return ResolvedPolicy{}, fmt.Errorf("%w: %s is not in the registry", ErrPackDependency, ref)
+		}
+		if err != nil {
+			return ResolvedPolicy{}, err
+		}
+		if err := merge(ref, dep.PublishedPack); err != nil {
+			return ResolvedPolicy{}, err
+		}
+	}
+	if err := merge(pack.ID+"@"+pack.Version, pack); err != nil {
+		return ResolvedPolicy{}, err
+	}
+	return resolved, nil
+}
+
+// stricterFreshness keeps the shorter of each freshness limit
+func stricterFreshness(a, b *FreshnessPolicy) *FreshnessPolicy {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &FreshnessPolicy{
+		MaxCredentialAge:   shorterDuration(a.MaxCredentialAge, b.MaxCredentialAge),
+		MaxVerificationAge: shorterDuration(a.MaxVerificationAge, b.MaxVerificationAge),
+		MaxClockSkew:       shorterDuration(a.MaxClockSkew, b.MaxClockSkew),
+	}
+}
+
+// shorterDuration compares two validated durations; empty means no limit
+func shorterDuration(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	da, _ := time.ParseDuration(a)
+	db, _ := time.ParseDuration(b)
+	if db < da {
+		return b
+	}
+	return a
+}
+
+// resolvePack resolves a draft's dependency graph for publication and
+// checks it flattens, returning the pinned includes
+func (s *Server) resolvePack(ctx context.Context, pack PublishedPack) ([]string, error) {
+	includes, err := resolveDependencies(ctx, s.packs, pack)
+	if err != nil {
+		return nil, err
+	}
+	pack.Includes = includes
+	if _, err := flattenPack(ctx, s.packs, pack); err != nil {
+		return nil, err
+	}
+	return includes, nil
+}
+
+// handleGetResolvedPack serves a pack flattened with its dependency graph:
+// the rules a verifier evaluates for it. Drafts preview what publishing
+// them would pin.
+func (s *Server) handleGetResolvedPack(w http.ResponseWriter, r *http.Request) {
+	pack, ok := s.lookupPack(w, r)
+	if !ok {
+		return
+	}
+	lastModified := pack.UpdatedAt
+	if pack.unpublished() {
+		// Drafts resolve against the packs published now, as publishing would
+		includes, err := resolveDependencies(r.Context(), s.packs, pack.PublishedPack)
+		if err != nil {
+			writePackStoreError(w, r, err)
+			return
+		}
+		pack.Includes, lastModified = includes, time.Time{}
+	}
+	policy, err := flattenPack(r.Context(), s.packs, pack.PublishedPack)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	resolved := ResolvedPack{
+		PackSummary:    pack.PackSummary,
+		Kind:           pack.Kind,
+		Includes:       append([]string{}, pack.Includes...),
+		ResolvedPolicy: policy,
+	}
+	log.Info().Str("pack_id", pack.Ref()).Int("include_count", len(pack.Includes)).Msg("Resolved pack requested")
+	writeCachedJSON(w, r, resolved, lastModified, cacheRevalidate)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// identityLibrary is a shared predicate library packs build on
+func identityLibrary(version string) PublishedPack {
+	return PublishedPack{
+		PackSummary: PackSummary{ID: "lib.identity.base", Version: version, Name: "Base Identity"},
+		Kind:        PackKindLibrary,
+		Rules:       []PolicyRule{{ID: "identity.verified", Expr: "identity_liveness == true"}},
+		Freshness:   &FreshnessPolicy{MaxCredentialAge: "2160h", MaxClockSkew: "5m"},
+	}
+}
+
+// sellerPack depends on the identity library
+func sellerPack(version string, deps ...PackDependency) PublishedPack {
+	return PublishedPack{
+		PackSummary:  PackSummary{ID: "pack.seller.plus", Version: version, Name: "Safe Seller Plus"},
+		Rules:        []PolicyRule{{ID: "platform.tenure", Expr: "platform_tenure_months_max >= 6"}},
+		Freshness:    &FreshnessPolicy{MaxCredentialAge: "4320h", MaxClockSkew: "2m"},
+		Dependencies: deps,
+	}
+}
+
+// publishPack creates a draft, has it approved and publishes it, returning
+// the publish response
+func publishPack(t *testing.T, server *Server, pack PublishedPack) *httptest.ResponseRecorder {
+	t.Helper()
+	w := packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, pack)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	approvePack(t, server, pack.ID+"@"+pack.Version)
+	return packRequest(t, server, http.MethodPut, "/packs/"+pack.ID+"@"+pack.Version, testOperatorToken, PackUpdate{Status: PackStatusPublished})
+}
+
+func TestVersionConstraints(t *testing.T) {
+	for constraint, cases := range map[string]map[string]bool{
+		"1.2.0":  {"1.2.0": true, "1.2.0+build.1": true, "1.2.1": false},
+		"^1.2.0": {"1.2.0": true, "1.9.3": true, "1.1.9": false, "2.0.0": false, "1.3.0-rc.1": false},
+		"^0.2.1": {"0.2.1": true, "0.2.9": true, "0.3.0": false},
+		"^0.0.3": {"0.0.3": true, "0.0.4": false},
+		"~1.2.0": {"1.2.7": true, "1.3.0": false},
+	} {
+		parsed, err := parseConstraint(constraint)
+		require.NoError(t, err, constraint)
+		for version, want := range cases {
+			v, err := parseSemver(version)
+			require.NoError(t, err)
+			assert.Equal(t, want, parsed.allows(v), "%s allows %s", constraint, version)
+		}
+	}
+	for _, invalid := range []string{"", ">=1.0.0", "^1.0", "1.x"} {
+		_, err := parseConstraint(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPackDependencies_ResolvedAtPublish(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("1.0.0")).Code)
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("1.1.0")).Code)
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("2.0.0")).Code)
+
+	resp := publishPack(t, server, sellerPack("1.0.0", PackDependency{Pack: "lib.identity.base", Version: "^1.0.0"}))
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var published StoredPack
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &published))
+	assert.Equal(t, []string{"lib.identity.base@1.1.0"}, published.Includes, "the highest matching published version is pinned")
+
+	// Publishing a newer library does not move a published pack's pins
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("1.2.0")).Code)
+	w := packRequest(t, server, http.MethodGet, "/packs/pack.seller.plus@1.0.0/resolved", "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resolved ResolvedPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resolved))
+	assert.Equal(t, []string{"lib.identity.base@1.1.0"}, resolved.Includes)
+	require.Len(t, resolved.Rules, 2)
+	assert.Equal(t, "identity.verified", resolved.Rules[0].ID, "dependencies come first")
+	assert.Equal(t, "platform.tenure", resolved.Rules[1].ID)
+	assert.Equal(t, &FreshnessPolicy{MaxCredentialAge: "2160h", MaxClockSkew: "2m"}, resolved.Freshness, "the strictest limits apply")
+
+	// The authored pack keeps its own rules only
+	w = packRequest(t, server, http.MethodGet, "/packs/pack.seller.plus@1.0.0", "", nil)
+	var authored StoredPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &authored))
+	assert.Len(t, authored.Rules, 1)
+
+	// Verifiers get the flattened rules from the manifest and policy endpoint
+	w = packRequest(t, server, http.MethodGet, "/policy/manifest", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var claims ManifestClaims
+	_, err := jwt.ParseWithClaims(w.Body.String(), &claims, func(*jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	})
+	require.NoError(t, err)
+	for _, pack := range claims.Manifest.Packs {
+		if pack.ID != "pack.seller.plus" {
+			assert.Nil(t, pack.Resolved, "packs without dependencies are served as authored")
+			continue
+		}
+		require.NotNil(t, pack.Resolved)
+		assert.Equal(t, resolved.ResolvedPolicy, *pack.Resolved)
+	}
+	w = packRequest(t, server, http.MethodGet, "/packs/pack.seller.plus@1.0.0/policy", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var policy PackPolicy
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &policy))
+	assert.Len(t, policy.Rules, 2)
+
+	// Libraries are not compiled into wallet bundles
+	summaries, err := server.publishedPackSummaries(httptest.NewRequest(http.MethodGet, "/bundles", nil))
+	require.NoError(t, err)
+	for _, summary := range summaries {
+		assert.NotEqual(t, "lib.identity.base", summary.ID)
+	}
+}
+
+func TestPackDependencies_RejectsUnresolvableGraphs(t *testing.T) {
+	server := newAdminServer()
+	dep := func(id, version string) PackDependency { return PackDependency{Pack: id, Version: version} }
+
+	// Invalid declarations are refused when the draft is saved
+	for name, pack := range map[string]PublishedPack{
+		"bad constraint": sellerPack("0.1.0", dep("lib.identity.base", ">=1.0.0")),
+		"self":           sellerPack("0.1.0", dep("pack.seller.plus", "^1.0.0")),
+		"duplicate":      sellerPack("0.1.0", dep("lib.identity.base", "^1.0.0"), dep("lib.identity.base", "~1.0.0")),
+		"versioned id":   sellerPack("0.1.0", dep("lib.identity.base@1.0.0", "1.0.0")),
+		"unknown kind":   {PackSummary: PackSummary{ID: "lib.x", Version: "1.0.0", Name: "X"}, Kind: "module", Rules: []PolicyRule{{ID: "x", Expr: "x"}}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, pack).Code, name)
+	}
+
+	// Only published versions resolve
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, identityLibrary("1.0.0")).Code)
+	resp := publishPack(t, server, sellerPack("1.0.0", dep("lib.identity.base", "^1.0.0")))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "no published version of lib.identity.base matches ^1.0.0")
+	approvePack(t, server, "lib.identity.base@1.0.0")
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/lib.identity.base@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code)
+	w := packRequest(t, server, http.MethodGet, "/packs/pack.seller.plus@1.0.0/resolved", testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, "approved packs preview their resolution")
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.seller.plus@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code)
+
+	// Two packs defining the same rule id
+	clash := sellerPack("2.0.0", dep("lib.identity.base", "1.0.0"))
+	clash.Rules = append(clash.Rules, PolicyRule{ID: "identity.verified", Expr: "true"})
+	resp = publishPack(t, server, clash)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, decodeProblem(t, resp).Detail, `rule "identity.verified" is defined by both lib.identity.base@1.0.0 and pack.seller.plus@2.0.0`)
+
+	// A diamond reaching two versions of the library
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("2.0.0")).Code)
+	diamond := PublishedPack{
+		PackSummary:  PackSummary{ID: "pack.market.trust", Version: "1.0.0", Name: "Market Trust"},
+		Rules:        []PolicyRule{{ID: "chargeback.risk.low", Expr: "chargeback_ratio < 0.01"}},
+		Dependencies: []PackDependency{dep("pack.seller.plus", "^1.0.0"), dep("lib.identity.base", "^2.0.0")},
+	}
+	resp = publishPack(t, server, diamond)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "lib.identity.base is required at both 1.0.0 and 2.0.0")
+
+	// Libraries build on libraries only
+	library := identityLibrary("3.0.0")
+	library.ID, library.Rules = "lib.seller", []PolicyRule{{ID: "seller.active", Expr: "active == true"}}
+	library.Dependencies = []PackDependency{dep("pack.seller.plus", "^1.0.0")}
+	assert.Equal(t, http.StatusConflict, publishPack(t, server, library).Code)
+}
+
+func TestFederation_ImportsDependenciesFirst(t *testing.T) {
+	peer, peerURL := newPeerRegistry(t)
+	require.Equal(t, http.StatusOK, publishPack(t, peer, identityLibrary("1.0.0")).Code)
+	require.Equal(t, http.StatusOK, publishPack(t, peer, sellerPack("1.0.0", PackDependency{Pack: "lib.identity.base", Version: "^1.0.0"})).Code)
+
+	// Without the library's namespace, the dependent pack cannot be imported
+	partial := newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, Packs: []string{"pack.seller."}})
+	statuses := syncPeers(t, partial)
+	assert.Equal(t, 0, statuses[0].Packs.Imported)
+	require.Len(t, statuses[0].Conflicts, 1)
+	assert.Contains(t, statuses[0].Conflicts[0].Reason, "lib.identity.base@1.0.0")
+
+	server := newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, Packs: []string{"pack.seller.", "lib."}})
+	statuses = syncPeers(t, server)
+	assert.Equal(t, 2, statuses[0].Packs.Imported)
+	assert.Empty(t, statuses[0].Conflicts)
+	w := packRequest(t, server, http.MethodGet, "/packs/pack.seller.plus@1.0.0/resolved", "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resolved ResolvedPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resolved))
+	assert.Len(t, resolved.Rules, 2)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// hostedDIDNamePattern keeps names usable as a did:web path segment
+	hostedDIDNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	didKeyIDPattern      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+)
+
+// didContext is the JSON-LD context of the documents the registry serves
+var didContext = []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/suites/jws-2020/v1"}
+
+// DIDDocument is a did:web document built from a hosted DID's keys
+type DIDDocument struct {
+	Context            []string                         `json:"@context"`
+	ID                 string                           `json:"id"`
+	VerificationMethod []didresolver.VerificationMethod `json:"verificationMethod"`
+	AssertionMethod    []string                         `json:"assertionMethod"`
+	Authentication     []string                         `json:"authentication"`
+}
+
+// DIDKeyRequest registers a public key. ID defaults to the key's RFC 7638
+// thumbprint; Rotate retires every other active key.
+type DIDKeyRequest struct {
+	ID           string          `json:"id,omitempty"`
+	PublicKeyJwk json.RawMessage `json:"publicKeyJwk"`
+	Rotate       bool            `json:"rotate,omitempty"`
+}
+
+// DIDKeyUpdate retires or revokes a key
+type DIDKeyUpdate struct {
+	Status string `json:"status"`
+}
+
+// hostedDIDFor names the did:web identifier of a hosted DID: the platform
+// DID is did:web:cachet.id, an issuer's is did:web:cachet.id:dids:<name>
+func hostedDIDFor(name string) string {
+	if name == platformDIDName {
+		return registryIssuer
+	}
+	return registryIssuer + ":dids:" + name
+}
+
+// didPath is where a hosted DID's document is served
+func didPath(name string) string {
+	if name == platformDIDName {
+		return "/.well-known/did.json"
+	}
+	return "/dids/" + name + "/did.json"
+}
+
+// parsePublicJWK decodes a JWK to register, refusing private key material
+func parsePublicJWK(raw json.RawMessage) (didresolver.JWK, error) {
+	var members map[string]interface{}
+	if err := json.Unmarshal(raw, &members); err != nil || members == nil {
+		return didresolver.JWK{}, errors.New("publicKeyJwk must be a JWK object")
+	}
+	if _, ok := members["d"]; ok {
+		return didresolver.JWK{}, errors.New("publicKeyJwk must not contain private key material")
+	}
+	var jwk didresolver.JWK
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return didresolver.JWK{}, errors.New("publicKeyJwk must be a JWK object")
+	}
+	if _, err := jwk.PublicKey(); err != nil {
+		return didresolver.JWK{}, fmt.Errorf("publicKeyJwk: %w", err)
+	}
+	return jwk, nil
+}
+
+// verificationMethod lists a key in did's document
+func verificationMethod(did, id string, jwk didresolver.JWK) didresolver.VerificationMethod {
+	jwk.Kid = id
+	return didresolver.VerificationMethod{ID: did + "#" + id, Type: "JsonWebKey2020", Controller: did, PublicKeyJwk: &jwk}
+}
+
+// didDocument builds the document for did. Active keys authenticate and
+// assert; retired keys only assert, so credentials they signed still
+// verify; revoked keys are left out. The platform document also lists the
+// registry's own signing key, which signs manifests and bundles.
+func (s *Server) didDocument(did HostedDID) DIDDocument {
+	doc := DIDDocument{
+		Context:            didContext,
+		ID:                 did.DID,
+		VerificationMethod: []didresolver.VerificationMethod{},
+		AssertionMethod:    []string{},
+		Authentication:     []string{},
+	}
+	if did.Name == platformDIDName {
+		jwk := s.signer.PublicJWK()
+		jwk.Kid, jwk.Use = "", ""
+		signer := verificationMethod(did.DID, s.signer.KeyID(), jwk)
+		doc.VerificationMethod = append(doc.VerificationMethod, signer)
+		doc.AssertionMethod = append(doc.AssertionMethod, signer.ID)
+		doc.Authentication = append(doc.Authentication, signer.ID)
+	}
+	for _, key := range did.Keys {
+		if key.Status == DIDKeyStatusRevoked || (did.Name == platformDIDName && key.ID == s.signer.KeyID()) {
+			continue
+		}
+		method := verificationMethod(did.DID, key.ID, key.PublicKeyJwk)
+		doc.VerificationMethod = append(doc.VerificationMethod, method)
+		doc.AssertionMethod = append(doc.AssertionMethod, method.ID)
+		if key.Status == DIDKeyStatusActive {
+			doc.Authentication = append(doc.Authentication, method.ID)
+		}
+	}
+	return doc
+}
+
+// writeDIDStoreError answers a failed DID store call
+func writeDIDStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrDIDNotFound):
+		problem.Write(w, r, http.StatusNotFound, "did_not_found", "Not found")
+	case errors.Is(err, ErrDIDKeyNotFound):
+		problem.Write(w, r, http.StatusNotFound, "did_key_not_found", "Not found")
+	case errors.Is(err, ErrDIDExists), errors.Is(err, ErrDIDKeyExists):
+		problem.Write(w, r, http.StatusConflict, "did_exists", err.Error())
+	case errors.Is(err, ErrDIDDeactivated):
+		problem.Write(w, r, http.StatusConflict, "did_deactivated", err.Error())
+	case errors.Is(err, ErrDIDKeyTransition):
+		problem.Write(w, r, http.StatusConflict, "did_key_transition", err.Error())
+	default:
+		log.Error().Err(err).Msg("DID store request failed")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// hostedDIDName reads the hosted DID a request addresses; routes without a
+// {name} address the platform DID
+func hostedDIDName(r *http.Request) string {
+	return chi.URLParam(r, "name")
+}
+
+// handleDIDDocument serves the did:web document of the platform or of a
+// hosted issuer DID; deactivated DIDs are gone
+func (s *Server) handleDIDDocument(w http.ResponseWriter, r *http.Request) {
+	did, err := s.dids.Get(r.Context(), hostedDIDName(r))
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	if did.DeactivatedAt != nil {
+		problem.Error(w, r, "DID deactivated", http.StatusGone)
+		return
+	}
+	lastModified := did.UpdatedAt
+	if did.Name == platformDIDName {
+		// The registry signing key is not stored, so only the ETag tracks it
+		lastModified = time.Time{}
+	}
+	writeCachedJSON(w, r, s.didDocument(did), lastModified, cacheShort)
+}
+
+// handleListDIDKeys serves a hosted DID's key rotation history, including
+// revoked keys
+func (s *Server) handleListDIDKeys(w http.ResponseWriter, r *http.Request) {
+	did, err := s.dids.Get(r.Context(), hostedDIDName(r))
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	writeCachedJSON(w, r, did, did.UpdatedAt, cacheShort)
+}
+
+// handleListDIDs lists the issuer DIDs the registry hosts
+func (s *Server) handleListDIDs(w http.ResponseWriter, r *http.Request) {
+	dids, err := s.dids.List(r.Context())
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	hosted := make([]HostedDID, 0, len(dids))
+	for _, did := range dids {
+		if did.Name != platformDIDName {
+			hosted = append(hosted, did)
+		}
+	}
+	writeCachedJSON(w, r, map[string]interface{}{"dids": hosted}, time.Time{}, cacheShort)
+}
+
+// handleCreateDID onboards an issuer DID, did:web:cachet.id:dids:<name>;
+// its document lists no keys until one is registered
+func (s *Server) handleCreateDID(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !hostedDIDNamePattern.MatchString(req.Name) {
+		problem.Error(w, r, "name must be lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	did := HostedDID{Name: req.Name, DID: hostedDIDFor(req.Name), Keys: []DIDKey{}, CreatedAt: now, UpdatedAt: now}
+	if err := s.dids.Create(r.Context(), did); err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", did.DID).Msg("Hosted DID created")
+	w.Header().Set("Location", didPath(did.Name))
+	writeJSON(w, http.StatusCreated, did)
+}
+
+// handleDeactivateDID deactivates a hosted issuer DID. The name stays taken
+// and the key history stays readable, but the document is no longer served.
+func (s *Server) handleDeactivateDID(w http.ResponseWriter, r *http.Request) {
+	_, err := s.dids.Update(r.Context(), hostedDIDName(r), func(did *HostedDID) error {
+		if did.DeactivatedAt == nil {
+			now := time.Now().UTC()
+			did.DeactivatedAt, did.UpdatedAt = &now, now
+		}
+		return nil
+	})
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", hostedDIDFor(hostedDIDName(r))).Msg("Hosted DID deactivated")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddDIDKey registers a public key for a hosted DID, optionally
+// rotating out the keys it replaces
+func (s *Server) handleAddDIDKey(w http.ResponseWriter, r *http.Request) {
+	var req DIDKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	jwk, err := parsePublicJWK(req.PublicKeyJwk)
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		req.ID = thumbprint
+	}
+	if !didKeyIDPattern.MatchString(req.ID) {
+		problem.Error(w, r, "id must be 1 to 128 base64url characters", http.StatusBadRequest)
+		return
+	}
+	jwk.Kid = req.ID
+
+	now := time.Now().UTC()
+	key := DIDKey{ID: req.ID, PublicKeyJwk: jwk, Status: DIDKeyStatusActive, CreatedAt: now}
+	var retired []string
+	did, err := s.dids.Update(r.Context(), hostedDIDName(r), func(did *HostedDID) error {
+		if did.DeactivatedAt != nil {
+			return ErrDIDDeactivated
+		}
+		for _, existing := range did.Keys {
+			if existing.ID == key.ID {
+				return ErrDIDKeyExists
+			}
+			// A key is registered once, even under another id
+			if existingThumbprint, _ := existing.PublicKeyJwk.Thumbprint(); existingThumbprint == thumbprint {
+				return ErrDIDKeyExists
+			}
+		}
+		if req.Rotate {
+			for i := range did.Keys {
+				if did.Keys[i].Status == DIDKeyStatusActive {
+					_ = did.Keys[i].setStatus(DIDKeyStatusRetired, now)
+					retired = append(retired, did.Keys[i].ID)
+				}
+			}
+		}
+		did.Keys = append(did.Keys, key)
+		did.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{
+		Type:   audit.TypeKeyRotation,
+		Action: "did_key.registered",
+		Actor:  principalFrom(r.Context()).Subject,
+		Target: did.DID + "#" + key.ID,
+		Detail: strings.Join(retired, ","),
+	})
+	log.Info().Str("did", did.DID).Str("kid", key.ID).Strs("retired", retired).Msg("DID key registered")
+	w.Header().Set("Location", didPath(did.Name))
+	writeJSON(w, http.StatusCreated, key)
+}
+
+// handleUpdateDIDKey retires or revokes one of a hosted DID's keys
+func (s *Server) handleUpdateDIDKey(w http.ResponseWriter, r *http.Request) {
+	var update DIDKeyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if update.Status != DIDKeyStatusRetired && update.Status != DIDKeyStatusRevoked {
+		problem.Error(w, r, "status must be retired or revoked", http.StatusBadRequest)
+		return
+	}
+	kid := chi.URLParam(r, "kid")
+	var key DIDKey
+	did, err := s.dids.Update(r.Context(), hostedDIDName(r), func(did *HostedDID) error {
+		if did.DeactivatedAt != nil {
+			return ErrDIDDeactivated
+		}
+		stored := did.key(kid)
+		if stored == nil {
+			return ErrDIDKeyNotFound
+		}
+		now := time.Now().UTC()
+		if err := stored.setStatus(update.Status, now); err != nil {
+			return err
+		}
+		did.UpdatedAt = now
+		key = *stored
+		return nil
+	})
+	if err != nil {
+		writeDIDStoreError(w, r, err)
+		return
+	}
+	event := audit.Event{Type: audit.TypeKeyRotation, Action: "did_key.retired", Actor: principalFrom(r.Context()).Subject, Target: did.DID + "#" + kid}
+	if key.Status == DIDKeyStatusRevoked {
+		event.Type, event.Action = audit.TypeRevocation, "did_key.revoked"
+	}
+	s.security.Record(r.Context(), event)
+	log.Info().Str("did", did.DID).Str("kid", kid).Str("status", key.Status).Msg("DID key updated")
+	writeJSON(w, http.StatusOK, key)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDIDKey generates an issuer key and its public JWK members
+func testDIDKey(t *testing.T) (*ecdsa.PrivateKey, map[string]string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key, map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// resolveDocument fetches a hosted DID document the way a did:web resolver
+// reads it
+func resolveDocument(t *testing.T, server *Server, path string) didresolver.Document {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, path, "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var doc didresolver.Document
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	return doc
+}
+
+func addDIDKey(t *testing.T, server *Server, path string, req interface{}) DIDKey {
+	t.Helper()
+	w := packRequest(t, server, http.MethodPost, path, testOperatorToken, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var key DIDKey
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &key))
+	return key
+}
+
+func TestDIDs_PlatformDocumentResolves(t *testing.T) {
+	server := newAdminServer()
+
+	doc := resolveDocument(t, server, "/.well-known/did.json")
+	assert.Equal(t, registryIssuer, doc.ID)
+
+	// Manifests signed by the registry verify against its DID document
+	manifest := packRequest(t, server, http.MethodGet, "/trust/manifest", "", nil)
+	require.Equal(t, http.StatusOK, manifest.Code)
+	_, err := jwt.Parse(manifest.Body.String(), func(token *jwt.Token) (interface{}, error) {
+		jwk, err := doc.AssertionKey(token.Header["kid"].(string))
+		if err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	})
+	require.NoError(t, err)
+
+	// Other platform keys, such as the issuance gateway's, are registered
+	_, jwk := testDIDKey(t)
+	key := addDIDKey(t, server, "/did/keys", map[string]interface{}{"id": "gateway-1", "publicKeyJwk": jwk})
+	assert.Equal(t, DIDKeyStatusActive, key.Status)
+	_, err = resolveDocument(t, server, "/.well-known/did.json").AssertionKey("gateway-1")
+	assert.NoError(t, err)
+	_, err = resolveDocument(t, server, "/.well-known/did.json").AssertionKey(server.signer.KeyID())
+	assert.NoError(t, err, "registering keys keeps the registry signing key")
+}
+
+func TestDIDs_IssuerKeyRotation(t *testing.T) {
+	server := newAdminServer()
+	trail := audit.NewMemory()
+	var err error
+	server.security, err = audit.New("registry", trail, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/dids", testOperatorToken, map[string]string{"name": "acme"}).Code)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/dids", testOperatorToken, map[string]string{"name": "acme"}).Code)
+
+	first, firstJWK := testDIDKey(t)
+	firstKey := addDIDKey(t, server, "/dids/acme/keys", map[string]interface{}{"publicKeyJwk": firstJWK})
+	thumbprint, err := didresolver.JWK{Kty: "EC", Crv: "P-256", X: firstJWK["x"], Y: firstJWK["y"]}.Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, thumbprint, firstKey.ID, "kid defaults to the RFC 7638 thumbprint")
+
+	// A credential signed before the rotation keeps verifying afterwards
+	credential, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": "did:web:cachet.id:dids:acme"}).SignedString(first)
+	require.NoError(t, err)
+	_, secondJWK := testDIDKey(t)
+	addDIDKey(t, server, "/dids/acme/keys", map[string]interface{}{"id": "2026-10", "publicKeyJwk": secondJWK, "rotate": true})
+
+	doc := resolveDocument(t, server, "/dids/acme/did.json")
+	assert.Equal(t, "did:web:cachet.id:dids:acme", doc.ID)
+	assert.Equal(t, []string{doc.ID + "#" + firstKey.ID, doc.ID + "#2026-10"}, doc.AssertionMethod)
+	assert.Equal(t, []string{doc.ID + "#2026-10"}, doc.Authentication, "retired keys no longer authenticate")
+	retired, err := doc.AssertionKey(firstKey.ID)
+	require.NoError(t, err)
+	_, err = jwt.Parse(credential, func(*jwt.Token) (interface{}, error) { return retired.PublicKey() })
+	assert.NoError(t, err)
+
+	// Revoking takes the key out of the document but not the history
+	w := packRequest(t, server, http.MethodPut, "/dids/acme/keys/"+firstKey.ID, testOperatorToken, DIDKeyUpdate{Status: DIDKeyStatusRevoked})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = resolveDocument(t, server, "/dids/acme/did.json").AssertionKey(firstKey.ID)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPut, "/dids/acme/keys/"+firstKey.ID, testOperatorToken, DIDKeyUpdate{Status: DIDKeyStatusRetired}).Code)
+
+	history := packRequest(t, server, http.MethodGet, "/dids/acme/keys", "", nil)
+	require.Equal(t, http.StatusOK, history.Code)
+	var hosted HostedDID
+	require.NoError(t, json.Unmarshal(history.Body.Bytes(), &hosted))
+	require.Len(t, hosted.Keys, 2)
+	assert.Equal(t, DIDKeyStatusRevoked, hosted.Keys[0].Status)
+	assert.NotNil(t, hosted.Keys[0].RetiredAt)
+	assert.NotNil(t, hosted.Keys[0].RevokedAt)
+	assert.Equal(t, DIDKeyStatusActive, hosted.Keys[1].Status)
+
+	// Rotations and revocations are kept in the security audit trail, next
+	// to the admin calls making them
+	events, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	var keyEvents []audit.Event
+	for _, event := range events {
+		if event.Type != audit.TypeAdminAction {
+			keyEvents = append(keyEvents, event)
+		}
+	}
+	require.Len(t, keyEvents, 3)
+	assert.Equal(t, audit.TypeKeyRotation, keyEvents[1].Type)
+	assert.Equal(t, doc.ID+"#2026-10", keyEvents[1].Target)
+	assert.Equal(t, firstKey.ID, keyEvents[1].Detail, "the rotation names the keys it retired")
+	assert.Equal(t, audit.TypeRevocation, keyEvents[2].Type)
+	assert.Equal(t, "did_key.revoked", keyEvents[2].Action)
+	assert.Len(t, events, 9, "every admin call is kept too, failed ones included")
+
+	// Deactivated DIDs are gone, and their keys frozen
+	assert.Equal(t, http.StatusNoContent, packRequest(t, server, http.MethodDelete, "/dids/acme", testOperatorToken, nil).Code)
+	assert.Equal(t, http.StatusGone, packRequest(t, server, http.MethodGet, "/dids/acme/did.json", "", nil).Code)
+	_, thirdJWK := testDIDKey(t)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/dids/acme/keys", testOperatorToken, map[string]interface{}{"publicKeyJwk": thirdJWK}).Code)
+	assert.Equal(t, http.StatusOK, packRequest(t, server, http.MethodGet, "/dids/acme/keys", "", nil).Code)
+}
+
+func TestDIDs_RejectsInvalidRequests(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/dids", testOperatorToken, map[string]string{"name": "acme"}).Code)
+	_, jwk := testDIDKey(t)
+	private := map[string]string{"d": "c2VjcmV0"}
+	for name, value := range jwk {
+		private[name] = value
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		"bad name":        {"/dids", testOperatorToken, map[string]string{"name": "Acme Corp"}, http.StatusBadRequest},
+		"unknown did":     {"/dids/globex/keys", testOperatorToken, map[string]interface{}{"publicKeyJwk": jwk}, http.StatusNotFound},
+		"private key":     {"/dids/acme/keys", testOperatorToken, map[string]interface{}{"publicKeyJwk": private}, http.StatusBadRequest},
+		"symmetric key":   {"/dids/acme/keys", testOperatorToken, map[string]interface{}{"publicKeyJwk": map[string]string{"kty": "oct", "k": "c2VjcmV0"}}, http.StatusBadRequest},
+		"off-curve point": {"/dids/acme/keys", testOperatorToken, map[string]interface{}{"publicKeyJwk": map[string]string{"kty": "EC", "crv": "P-256", "x": jwk["y"], "y": jwk["x"]}}, http.StatusBadRequest},
+		"bad key id":      {"/dids/acme/keys", testOperatorToken, map[string]interface{}{"id": "key#1", "publicKeyJwk": jwk}, http.StatusBadRequest},
+		"no credentials":  {"/dids/acme/keys", "", map[string]interface{}{"publicKeyJwk": jwk}, http.StatusUnauthorized},
+	} {
+		assert.Equal(t, tc.status, packRequest(t, server, http.MethodPost, tc.path, tc.token, tc.body).Code, name)
+	}
+
+	// Ed25519 keys are accepted, and a key is registered only once
+	okp := map[string]string{"kty": "OKP", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))}
+	addDIDKey(t, server, "/dids/acme/keys", map[string]interface{}{"publicKeyJwk": okp})
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/dids/acme/keys", testOperatorToken, map[string]interface{}{"id": "again", "publicKeyJwk": okp}).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodPut, "/dids/acme/keys/missing", testOperatorToken, DIDKeyUpdate{Status: DIDKeyStatusRetired}).Code)
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPut, "/did/keys/any", testOperatorToken, DIDKeyUpdate{Status: DIDKeyStatusActive}).Code)
+}
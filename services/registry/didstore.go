@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+)
+
+// DID key states. Retired keys no longer sign but stay in the DID document,
+// so credentials issued before a rotation keep verifying; revoked keys are
+// compromised or withdrawn and are removed from the document.
+const (
+	DIDKeyStatusActive  = "active"
+	DIDKeyStatusRetired = "retired"
+	DIDKeyStatusRevoked = "revoked"
+)
+
+// platformDIDName names the platform DID, did:web:cachet.id, in the store
+const platformDIDName = ""
+
+var (
+	ErrDIDNotFound      = errors.New("hosted DID not found")
+	ErrDIDExists        = errors.New("hosted DID already exists")
+	ErrDIDDeactivated   = errors.New("hosted DID is deactivated")
+	ErrDIDKeyNotFound   = errors.New("DID key not found")
+	ErrDIDKeyExists     = errors.New("DID key already registered")
+	ErrDIDKeyTransition = errors.New("invalid DID key status transition")
+)
+
+// DIDKey is public key material registered for a hosted DID, with its
+// rotation history
+type DIDKey struct {
+	ID           string          `json:"id"` // fragment of the verification method
+	PublicKeyJwk didresolver.JWK `json:"publicKeyJwk"`
+	Status       string          `json:"status"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	RetiredAt    *time.Time      `json:"retiredAt,omitempty"`
+	RevokedAt    *time.Time      `json:"revokedAt,omitempty"`
+}
+
+// HostedDID is a did:web identifier whose document the registry serves
+type HostedDID struct {
+	Name          string     `json:"name"` // empty for the platform DID
+	DID           string     `json:"did"`
+	Keys          []DIDKey   `json:"keys"` // in registration order
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+	DeactivatedAt *time.Time `json:"deactivatedAt,omitempty"`
+}
+
+// key returns the key with the given fragment
+func (d *HostedDID) key(id string) *DIDKey {
+	for i := range d.Keys {
+		if d.Keys[i].ID == id {
+			return &d.Keys[i]
+		}
+	}
+	return nil
+}
+
+// setStatus moves a key along active -> retired -> revoked
+func (k *DIDKey) setStatus(status string, now time.Time) error {
+	switch {
+	case k.Status == status:
+		return nil
+	case status == DIDKeyStatusRetired && k.Status == DIDKeyStatusActive:
+		k.RetiredAt = &now
+	case status == DIDKeyStatusRevoked && k.Status != DIDKeyStatusRevoked:
+		k.RevokedAt = &now
+	default:
+		return ErrDIDKeyTransition
+	}
+	k.Status = status
+	return nil
+}
+
+// DIDStore persists hosted DIDs and their keys
+type DIDStore interface {
+	List(ctx context.Context) ([]HostedDID, error)
+	Get(ctx context.Context, name string) (HostedDID, error)
+	Create(ctx context.Context, did HostedDID) error
+	// Update applies fn to the stored DID atomically and saves the result
+	Update(ctx context.Context, name string, fn func(*HostedDID) error) (HostedDID, error)
+}
+
+// memoryDIDStore keeps hosted DIDs in memory (production should use the
+// Postgres store, so registered keys survive restarts)
+type memoryDIDStore struct {
+	mu   sync.RWMutex
+	dids map[string]HostedDID
+}
+
+func newMemoryDIDStore() *memoryDIDStore {
+	return &memoryDIDStore{dids: make(map[string]HostedDID)}
+}
+
+func (m *memoryDIDStore) List(ctx context.Context) ([]HostedDID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dids := make([]HostedDID, 0, len(m.dids))
+	for _, did := range m.dids {
+		dids = append(dids, did)
+	}
+	sort.Slice(dids, func(i, j int) bool { return dids[i].Name < dids[j].Name })
+	return dids, nil
+}
+
+func (m *memoryDIDStore) Get(ctx context.Context, name string) (HostedDID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	did, ok := m.dids[name]
+	if !ok {
+		return HostedDID{}, ErrDIDNotFound
+	}
+	return did, nil
+}
+
+func (m *memoryDIDStore) Create(ctx context.Context, did HostedDID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dids[did.Name]; ok {
+		return ErrDIDExists
+	}
+	m.dids[did.Name] = did
+	return nil
+}
+
+func (m *memoryDIDStore) Update(ctx context.Context, name string, fn func(*HostedDID) error) (HostedDID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	did, ok := m.dids[name]
+	if !ok {
+		return HostedDID{}, ErrDIDNotFound
+	}
+	// Copy the keys so a failed fn leaves the stored DID untouched
+	did.Keys = append([]DIDKey(nil), did.Keys...)
+	if err := fn(&did); err != nil {
+		return HostedDID{}, err
+	}
+	m.dids[name] = did
+	return did, nil
+}
+
+// seedPlatformDID creates the platform DID unless the store already holds it
+func seedPlatformDID(ctx context.Context, store DIDStore) error {
+	now := time.Now().UTC()
+	err := store.Create(ctx, HostedDID{Name: platformDIDName, DID: hostedDIDFor(platformDIDName), Keys: []DIDKey{}, CreatedAt: now, UpdatedAt: now})
+	if errors.Is(err, ErrDIDExists) {
+		return nil
+	}
+	return err
+}
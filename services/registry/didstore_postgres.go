@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+)
+
+// postgresDIDStore keeps hosted DIDs in Postgres
+type postgresDIDStore struct {
+	db *sql.DB
+}
+
+// newPostgresDIDStore uses the tables of the registry migrations
+func newPostgresDIDStore(db *sql.DB) *postgresDIDStore {
+	return &postgresDIDStore{db: db}
+}
+
+func scanHostedDID(row rowScanner) (HostedDID, error) {
+	var document []byte
+	if err := row.Scan(&document); err != nil {
+		return HostedDID{}, err
+	}
+	var did HostedDID
+	if err := json.Unmarshal(document, &did); err != nil {
+		return HostedDID{}, fmt.Errorf("decoding hosted DID: %w", err)
+	}
+	return did, nil
+}
+
+func (p *postgresDIDStore) List(ctx context.Context) ([]HostedDID, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT document FROM hosted_dids ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dids []HostedDID
+	for rows.Next() {
+		did, err := scanHostedDID(rows)
+		if err != nil {
+			return nil, err
+		}
+		dids = append(dids, did)
+	}
+	return dids, rows.Err()
+}
+
+func (p *postgresDIDStore) Get(ctx context.Context, name string) (HostedDID, error) {
+	did, err := scanHostedDID(p.db.QueryRowContext(ctx, `SELECT document FROM hosted_dids WHERE name = $1`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return HostedDID{}, ErrDIDNotFound
+	}
+	return did, err
+}
+
+func (p *postgresDIDStore) Create(ctx context.Context, did HostedDID) error {
+	document, err := json.Marshal(did)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO hosted_dids (name, document, updated_at) VALUES ($1, $2, $3)`, did.Name, document, did.UpdatedAt)
+	if store.IsUniqueViolation(err) {
+		return ErrDIDExists
+	}
+	return err
+}
+
+// Update locks the row for the duration of fn, so concurrent key rotations
+// serialize
+func (p *postgresDIDStore) Update(ctx context.Context, name string, fn func(*HostedDID) error) (HostedDID, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return HostedDID{}, err
+	}
+	defer tx.Rollback()
+
+	did, err := scanHostedDID(tx.QueryRowContext(ctx, `SELECT document FROM hosted_dids WHERE name = $1 FOR UPDATE`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return HostedDID{}, ErrDIDNotFound
+	}
+	if err != nil {
+		return HostedDID{}, err
+	}
+	if err := fn(&did); err != nil {
+		return HostedDID{}, err
+	}
+	document, err := json.Marshal(did)
+	if err != nil {
+		return HostedDID{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE hosted_dids SET document = $2, updated_at = $3 WHERE name = $1`, name, document, did.UpdatedAt); err != nil {
+		return HostedDID{}, err
+	}
+	return did, tx.Commit()
+}
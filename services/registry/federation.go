@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultFederationInterval = 15 * time.Minute
+	federationSyncTimeout     = time.Minute
+	// maxPeerManifestSize bounds the manifests fetched from peers
+	maxPeerManifestSize = 4 << 20
+	// namespaceAll matches every pack id or DID
+	namespaceAll = "*"
+)
+
+// ErrFederatedEntry means an entry imported from a peer registry was edited
+// locally; the peer it came from is its only source of truth
+var ErrFederatedEntry = errors.New("entry is imported from a federation peer and managed there")
+
+var errPeerNotModified = errors.New("peer manifest not modified")
+
+// Provenance records which peer registry an entry was imported from
+type Provenance struct {
+	Peer       string    `json:"peer"`     // peer name from the federation config
+	Registry   string    `json:"registry"` // peer base URL
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+// FederationConfig is the FEDERATION_CONFIG file, e.g.
+//
+//	interval: 15m
+//	peers:
+//	  - name: cachet
+//	    url: https://registry.cachet.id
+//	    packs: [pack.]
+//	    issuers: [did:web:cachet.id]
+//
+// Peers are pulled in order. Each imports only the pack ids and DIDs under
+// its namespaces (prefixes, or "*" for everything).
+type FederationConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Peers    []PeerConfig  `yaml:"peers"`
+}
+
+// PeerConfig names an upstream registry and the namespaces it is trusted for
+type PeerConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// JWKSURL pins where the peer's manifest signing keys are fetched from;
+	// defaults to the peer's /.well-known/jwks.json
+	JWKSURL   string   `yaml:"jwksUrl"`
+	Packs     []string `yaml:"packs"`
+	Issuers   []string `yaml:"issuers"`
+	Verifiers []string `yaml:"verifiers"`
+}
+
+// LoadFederationConfigFromEnv reads the file named by FEDERATION_CONFIG; nil
+// means the registry does not federate
+func LoadFederationConfigFromEnv() (*FederationConfig, error) {
+	path := os.Getenv("FEDERATION_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseFederationConfig(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func parseFederationConfig(raw []byte) (*FederationConfig, error) {
+	var config FederationConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultFederationInterval
+	}
+	if config.Interval < 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	if len(config.Peers) == 0 {
+		return nil, errors.New("no peers configured")
+	}
+	names := map[string]bool{}
+	for i, peer := range config.Peers {
+		if peer.Name == "" || names[peer.Name] {
+			return nil, fmt.Errorf("peer %d needs a unique name", i+1)
+		}
+		names[peer.Name] = true
+		parsed, err := url.Parse(peer.URL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return nil, fmt.Errorf("peer %s: url %q is not an http(s) URL", peer.Name, peer.URL)
+		}
+		if len(peer.Packs)+len(peer.Issuers)+len(peer.Verifiers) == 0 {
+			return nil, fmt.Errorf("peer %s imports nothing; list pack or DID namespaces", peer.Name)
+		}
+	}
+	return &config, nil
+}
+
+// inNamespace reports whether key falls under one of the prefixes
+func inNamespace(namespaces []string, key string) bool {
+	for _, namespace := range namespaces {
+		if namespace == namespaceAll || strings.HasPrefix(key, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncConflict is an upstream entry that was not imported
+type SyncConflict struct {
+	Kind   string `json:"kind"` // pack, issuer or verifier
+	Key    string `json:"key"`  // pack id@version or DID
+	Reason string `json:"reason"`
+}
+
+// SyncCounts tallies the changes one sync made to one kind of entry
+type SyncCounts struct {
+	Imported int `json:"imported"`
+	Updated  int `json:"updated"`
+	Removed  int `json:"removed"` // retired, for packs
+}
+
+// PeerStatus is the outcome of the last sync with a peer
+type PeerStatus struct {
+	Name          string         `json:"name"`
+	URL           string         `json:"url"`
+	LastAttemptAt *time.Time     `json:"lastAttemptAt,omitempty"`
+	LastSuccessAt *time.Time     `json:"lastSuccessAt,omitempty"`
+	LastError     string         `json:"lastError,omitempty"`
+	Packs         SyncCounts     `json:"packs"`
+	Issuers       SyncCounts     `json:"issuers"`
+	Verifiers     SyncCounts     `json:"verifiers"`
+	Conflicts     []SyncConflict `json:"conflicts,omitempty"`
+}
+
+// federationPeer is an upstream registry and what was last pulled from it
+type federationPeer struct {
+	PeerConfig
+	client *http.Client
+	keys   *jwksKeys
+
+	packsETag string
+	trustETag string
+	status    PeerStatus
+}
+
+// federation pulls signed pack and trust manifests from peer registries and
+// merges them into the local stores. An entry belongs to its first source:
+// locally authored entries are never overwritten, an entry imported from one
+// peer is not replaced by another, and pack versions stay immutable. Entries
+// a peer stops publishing are retired (packs) or removed (trust entries).
+type federation struct {
+	packs    PackStore
+	trust    TrustStore
+	interval time.Duration
+
+	mu    sync.Mutex // serializes syncs
+	peers []*federationPeer
+}
+
+func newFederation(config *FederationConfig, packs PackStore, trust TrustStore) *federation {
+	f := &federation{packs: packs, trust: trust, interval: config.Interval}
+	for _, peer := range config.Peers {
+		peer.URL = strings.TrimSuffix(peer.URL, "/")
+		jwksURL := peer.JWKSURL
+		if jwksURL == "" {
+			jwksURL = peer.URL + "/.well-known/jwks.json"
+		}
+		client := deadline.NewClient("registry-peer")
+		f.peers = append(f.peers, &federationPeer{
+			PeerConfig: peer,
+			client:     client,
+			keys:       newJWKSKeys(jwksURL, client),
+			status:     PeerStatus{Name: peer.Name, URL: peer.URL},
+		})
+	}
+	return f
+}
+
+// Sync pulls every peer in order and returns their status
+func (f *federation) Sync(ctx context.Context) []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make([]PeerStatus, 0, len(f.peers))
+	for _, peer := range f.peers {
+		f.syncPeer(ctx, peer)
+		statuses = append(statuses, peer.status)
+	}
+	return statuses
+}
+
+// Status returns the outcome of the last sync with each peer
+func (f *federation) Status() []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make([]PeerStatus, 0, len(f.peers))
+	for _, peer := range f.peers {
+		statuses = append(statuses, peer.status)
+	}
+	return statuses
+}
+
+func (f *federation) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), federationSyncTimeout)
+		f.Sync(ctx)
+		cancel()
+		<-ticker.C
+	}
+}
+
+func (f *federation) syncPeer(ctx context.Context, peer *federationPeer) {
+	now := time.Now().UTC()
+	status := PeerStatus{Name: peer.Name, URL: peer.URL, LastAttemptAt: &now, LastSuccessAt: peer.status.LastSuccessAt}
+	provenance := &Provenance{Peer: peer.Name, Registry: peer.URL, ImportedAt: now}
+
+	err := f.syncPacks(ctx, peer, provenance, &status)
+	if err == nil {
+		err = f.syncTrust(ctx, peer, provenance, &status)
+	}
+	if err != nil {
+		status.LastError = err.Error()
+		log.Warn().Err(err).Str("peer", peer.Name).Msg("Federation sync failed, keeping entries last imported")
+	} else {
+		status.LastSuccessAt = &now
+	}
+	for _, conflict := range status.Conflicts {
+		log.Warn().Str("peer", peer.Name).Str("kind", conflict.Kind).Str("key", conflict.Key).Str("reason", conflict.Reason).Msg("Federated entry not imported")
+	}
+	log.Info().
+		Str("peer", peer.Name).
+		Interface("packs", status.Packs).
+		Interface("issuers", status.Issuers).
+		Interface("verifiers", status.Verifiers).
+		Int("conflict_count", len(status.Conflicts)).
+		Msg("Federation sync finished")
+	peer.status = status
+}
+
+// ownedBy reports whether an existing entry was imported from peer; a
+// conflict is recorded when it came from anywhere else
+func ownedBy(existing *Provenance, peer string, kind, key string, status *PeerStatus) bool {
+	switch {
+	case existing == nil:
+		status.Conflicts = append(status.Conflicts, SyncConflict{Kind: kind, Key: key, Reason: "authored locally"})
+		return false
+	case existing.Peer != peer:
+		status.Conflicts = append(status.Conflicts, SyncConflict{Kind: kind, Key: key, Reason: "imported from peer " + existing.Peer})
+		return false
+	}
+	return true
+}
+
+// missingInclude names the first pack in a pack's pinned dependency graph
+// that is not in the registry, if any
+func (f *federation) missingInclude(ctx context.Context, pack PublishedPack) (string, error) {
+	for _, ref := range pack.Includes {
+		id, version := splitPackRef(ref)
+		_, err := f.packs.Get(ctx, id, version)
+		if errors.Is(err, ErrPackNotFound) {
+			return ref, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// syncPacks imports the published packs of the peer's policy manifest.
+// Unchanged manifests (304) leave the previous import in place; a manifest
+// with conflicts is refetched next time, so they clear once resolved.
+func (f *federation) syncPacks(ctx context.Context, peer *federationPeer, provenance *Provenance, status *PeerStatus) error {
+	if len(peer.Packs) == 0 {
+		return nil
+	}
+	conflicts := len(status.Conflicts)
+	var manifest PolicyManifest
+	etag, err := peer.fetchManifest(ctx, "/policy/manifest", manifestType, peer.packsETag, &manifest)
+	if errors.Is(err, errPeerNotModified) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("policy manifest: %w", err)
+	}
+
+	// A pack includes the whole graph of each dependency, so importing in
+	// order of graph size imports dependencies before the packs needing them
+	entries := manifest.Packs
+	sort.SliceStable(entries, func(i, j int) bool { return len(entries[i].Includes) < len(entries[j].Includes) })
+	upstream := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		published := entry.PublishedPack
+		if !inNamespace(peer.Packs, published.ID) {
+			continue
+		}
+		if err := validatePack(published); err != nil {
+			status.Conflicts = append(status.Conflicts, SyncConflict{Kind: "pack", Key: published.ID + "@" + published.Version, Reason: err.Error()})
+			continue
+		}
+		published.Provenance = nil
+		ref := published.ID + "@" + published.Version
+		upstream[ref] = true
+
+		existing, err := f.packs.Get(ctx, published.ID, published.Version)
+		if errors.Is(err, ErrPackNotFound) {
+			missing, err := f.missingInclude(ctx, published)
+			if err != nil {
+				return err
+			}
+			if missing != "" {
+				status.Conflicts = append(status.Conflicts, SyncConflict{Kind: "pack", Key: ref, Reason: "depends on " + missing + ", which is not in the registry"})
+				continue
+			}
+			imported := published
+			imported.Provenance = provenance
+			pack := StoredPack{
+				PublishedPack: imported,
+				Status:        PackStatusPublished,
+				CreatedAt:     provenance.ImportedAt,
+				UpdatedAt:     provenance.ImportedAt,
+				PublishedAt:   &provenance.ImportedAt,
+			}
+			if err := f.packs.Create(ctx, pack); err != nil {
+				return fmt.Errorf("importing pack %s: %w", ref, err)
+			}
+			status.Packs.Imported++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ownedBy(existing.Provenance, peer.Name, "pack", ref, status) {
+			continue
+		}
+		existing.Provenance = nil
+		if !reflect.DeepEqual(existing.PublishedPack, published) {
+			status.Conflicts = append(status.Conflicts, SyncConflict{Kind: "pack", Key: ref, Reason: "changed upstream, but published pack versions are immutable"})
+		}
+	}
+
+	// Retire what the peer no longer publishes
+	local, err := f.packs.List(ctx, PackFilter{Status: PackStatusPublished})
+	if err != nil {
+		return err
+	}
+	for _, pack := range local {
+		if pack.Provenance == nil || pack.Provenance.Peer != peer.Name || upstream[pack.Ref()] {
+			continue
+		}
+		if _, err := f.packs.Update(ctx, pack.ID, pack.Version, func(pack *StoredPack) error {
+			return transitionPack(pack, PackStatusRetired, provenance.ImportedAt)
+		}); err != nil {
+			return fmt.Errorf("retiring pack %s: %w", pack.Ref(), err)
+		}
+		status.Packs.Removed++
+	}
+	if len(status.Conflicts) == conflicts {
+		peer.packsETag = etag
+	}
+	return nil
+}
+
+// syncTrust imports the issuers and verifiers of the peer's trust manifest,
+// following their status changes upstream
+func (f *federation) syncTrust(ctx context.Context, peer *federationPeer, provenance *Provenance, status *PeerStatus) error {
+	if len(peer.Issuers)+len(peer.Verifiers) == 0 {
+		return nil
+	}
+	conflicts := len(status.Conflicts)
+	var manifest TrustManifest
+	etag, err := peer.fetchManifest(ctx, "/trust/manifest", trustManifestType, peer.trustETag, &manifest)
+	if errors.Is(err, errPeerNotModified) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("trust manifest: %w", err)
+	}
+	if err := f.syncIssuers(ctx, peer, manifest.Issuers, provenance, status); err != nil {
+		return err
+	}
+	if err := f.syncVerifiers(ctx, peer, manifest.Verifiers, provenance, status); err != nil {
+		return err
+	}
+	if len(status.Conflicts) == conflicts {
+		peer.trustETag = etag
+	}
+	return nil
+}
+
+func (f *federation) syncIssuers(ctx context.Context, peer *federationPeer, issuers []TrustedIssuer, provenance *Provenance, status *PeerStatus) error {
+	upstream := make(map[string]bool, len(issuers))
+	for _, issuer := range issuers {
+		if !inNamespace(peer.Issuers, issuer.DID) {
+			continue
+		}
+		if err := validateIssuer(issuer); err != nil {
+			status.Conflicts = append(status.Conflicts, SyncConflict{Kind: "issuer", Key: issuer.DID, Reason: err.Error()})
+			continue
+		}
+		upstream[issuer.DID] = true
+		issuer.Provenance = nil
+
+		existing, err := f.trust.GetIssuer(ctx, issuer.DID)
+		if errors.Is(err, ErrTrustEntryNotFound) {
+			issuer.Provenance = provenance
+			if err := f.trust.CreateIssuer(ctx, issuer); err != nil {
+				return fmt.Errorf("importing issuer %s: %w", issuer.DID, err)
+			}
+			status.Issuers.Imported++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ownedBy(existing.Provenance, peer.Name, "issuer", issuer.DID, status) {
+			continue
+		}
+		existing.Provenance = nil
+		if reflect.DeepEqual(existing, issuer) {
+			continue
+		}
+		issuer.Provenance = provenance
+		if err := f.trust.ReplaceIssuer(ctx, issuer); err != nil {
+			return fmt.Errorf("updating issuer %s: %w", issuer.DID, err)
+		}
+		status.Issuers.Updated++
+	}
+
+	local, err := f.trust.ListIssuers(ctx, IssuerFilter{})
+	if err != nil {
+		return err
+	}
+	for _, issuer := range local {
+		if issuer.Provenance == nil || issuer.Provenance.Peer != peer.Name || upstream[issuer.DID] {
+			continue
+		}
+		if err := f.trust.DeleteIssuer(ctx, issuer.DID); err != nil && !errors.Is(err, ErrTrustEntryNotFound) {
+			return fmt.Errorf("removing issuer %s: %w", issuer.DID, err)
+		}
+		status.Issuers.Removed++
+	}
+	return nil
+}
+
+func (f *federation) syncVerifiers(ctx context.Context, peer *federationPeer, verifiers []AccreditedVerifier, provenance *Provenance, status *PeerStatus) error {
+	upstream := make(map[string]bool, len(verifiers))
+	for _, verifier := range verifiers {
+		if !inNamespace(peer.Verifiers, verifier.DID) {
+			continue
+		}
+		if err := validateVerifier(verifier); err != nil {
+			status.Conflicts = append(status.Conflicts, SyncConflict{Kind: "verifier", Key: verifier.DID, Reason: err.Error()})
+			continue
+		}
+		upstream[verifier.DID] = true
+		verifier.Provenance = nil
+
+		existing, err := f.trust.GetVerifier(ctx, verifier.DID)
+		if errors.Is(err, ErrTrustEntryNotFound) {
+			verifier.Provenance = provenance
+			if err := f.trust.CreateVerifier(ctx, verifier); err != nil {
+				return fmt.Errorf("importing verifier %s: %w", verifier.DID, err)
+			}
+			status.Verifiers.Imported++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ownedBy(existing.Provenance, peer.Name, "verifier", verifier.DID, status) {
+			continue
+		}
+		existing.Provenance = nil
+		if reflect.DeepEqual(existing, verifier) {
+			continue
+		}
+		verifier.Provenance = provenance
+		if err := f.trust.ReplaceVerifier(ctx, verifier); err != nil {
+			return fmt.Errorf("updating verifier %s: %w", verifier.DID, err)
+		}
+		status.Verifiers.Updated++
+	}
+
+	local, err := f.trust.ListVerifiers(ctx, VerifierFilter{})
+	if err != nil {
+		return err
+	}
+	for _, verifier := range local {
+		if verifier.Provenance == nil || verifier.Provenance.Peer != peer.Name || upstream[verifier.DID] {
+			continue
+		}
+		if err := f.trust.DeleteVerifier(ctx, verifier.DID); err != nil && !errors.Is(err, ErrTrustEntryNotFound) {
+			return fmt.Errorf("removing verifier %s: %w", verifier.DID, err)
+		}
+		status.Verifiers.Removed++
+	}
+	return nil
+}
+
+// fetchManifest downloads a signed manifest from the peer unless it still
+// matches etag, verifies its signature and decodes its manifest claim
+func (p *federationPeer) fetchManifest(ctx context.Context, path, typ, etag string, manifest interface{}) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set(apiversion.Header, "1")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return "", errPeerNotModified
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("peer returned %d for %s", resp.StatusCode, path)
+	}
+	jws, err := io.ReadAll(io.LimitReader(resp.Body, maxPeerManifestSize))
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Manifest json.RawMessage `json:"manifest"`
+		jwt.RegisteredClaims
+	}
+	if _, err := jwt.ParseWithClaims(strings.TrimSpace(string(jws)), &claims, func(token *jwt.Token) (interface{}, error) {
+		if got, _ := token.Header["typ"].(string); got != typ {
+			return nil, fmt.Errorf("typ %q is not %s", got, typ)
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"ES256", "ES384", "ES512"})); err != nil {
+		return "", fmt.Errorf("signature of %s does not verify: %w", path, err)
+	}
+	if len(claims.Manifest) == 0 {
+		return "", fmt.Errorf("%s has no manifest claim", path)
+	}
+	if err := json.Unmarshal(claims.Manifest, manifest); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// handleFederationPeers reports the last sync with each peer
+func (s *Server) handleFederationPeers(w http.ResponseWriter, r *http.Request) {
+	if s.federation == nil {
+		problem.Error(w, r, "federation is not configured; set FEDERATION_CONFIG", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"peers": s.federation.Status()})
+}
+
+// handleFederationSync pulls every peer now rather than at the next interval
+func (s *Server) handleFederationSync(w http.ResponseWriter, r *http.Request) {
+	if s.federation == nil {
+		problem.Error(w, r, "federation is not configured; set FEDERATION_CONFIG", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"peers": s.federation.Sync(r.Context())})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPeerRegistry serves a registry with the built-in packs and issuers, as
+// the core Cachet registry a national deployment federates from
+func newPeerRegistry(t *testing.T) (*Server, string) {
+	t.Helper()
+	peer := newAdminServer()
+	ts := httptest.NewServer(peer.router)
+	t.Cleanup(ts.Close)
+	return peer, ts.URL
+}
+
+// newFederatedServer is a registry with empty stores pulling from peers
+func newFederatedServer(peers ...PeerConfig) *Server {
+	server := newAdminServer()
+	server.packs, server.trust = newMemoryPackStore(), newMemoryTrustStore()
+	server.federation = newFederation(&FederationConfig{Interval: time.Minute, Peers: peers}, server.packs, server.trust)
+	return server
+}
+
+func syncPeers(t *testing.T, server *Server) []PeerStatus {
+	t.Helper()
+	statuses := server.federation.Sync(context.Background())
+	for _, status := range statuses {
+		require.Empty(t, status.LastError, status.Name)
+	}
+	return statuses
+}
+
+func TestParseFederationConfig(t *testing.T) {
+	config, err := parseFederationConfig([]byte(`
+peers:
+  - name: cachet
+    url: https://registry.cachet.id
+    packs: [pack.]
+    issuers: ["*"]
+`))
+	require.NoError(t, err)
+	assert.Equal(t, defaultFederationInterval, config.Interval)
+	assert.Equal(t, []string{"pack."}, config.Peers[0].Packs)
+
+	for name, raw := range map[string]string{
+		"no peers":       `interval: 5m`,
+		"duplicate name": "peers:\n- {name: a, url: 'https://a', packs: ['*']}\n- {name: a, url: 'https://b', packs: ['*']}",
+		"bad url":        "peers:\n- {name: a, url: 'registry', packs: ['*']}",
+		"no namespaces":  "peers:\n- {name: a, url: 'https://a'}",
+	} {
+		_, err := parseFederationConfig([]byte(raw))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestFederation_ImportsPeerNamespaces(t *testing.T) {
+	_, peerURL := newPeerRegistry(t)
+	server := newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, Packs: []string{"pack.safe."}, Issuers: []string{namespaceAll}})
+
+	statuses := syncPeers(t, server)
+	assert.Equal(t, SyncCounts{Imported: 1}, statuses[0].Packs)
+	assert.Equal(t, SyncCounts{Imported: 1}, statuses[0].Issuers)
+	assert.NotNil(t, statuses[0].LastSuccessAt)
+
+	packs := listPacks(t, server, "", "")
+	require.Len(t, packs, 1, "only packs under the peer's namespaces are imported")
+	assert.Equal(t, "pack.safe.seller@0.1.0", packs[0].Ref())
+	require.NotNil(t, packs[0].Provenance)
+	assert.Equal(t, "cachet", packs[0].Provenance.Peer)
+	assert.Equal(t, peerURL, packs[0].Provenance.Registry)
+	assert.NotEmpty(t, packs[0].Rules)
+
+	issuer, err := server.trust.GetIssuer(context.Background(), "did:web:cachet.id")
+	require.NoError(t, err)
+	require.NotNil(t, issuer.Provenance)
+
+	// Imported entries are re-served, and managed by the peer only
+	w := packRequest(t, server, http.MethodGet, "/policy/manifest", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.safe.seller@0.1.0", testOperatorToken, PackUpdate{Status: PackStatusRetired})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	issuer.Status = TrustStatusRevoked
+	w = packRequest(t, server, http.MethodPut, "/trust/issuers/did:web:cachet.id", testOperatorToken, issuer)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = packRequest(t, server, http.MethodDelete, "/trust/issuers/did:web:cachet.id", testOperatorToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestFederation_FollowsPeerChanges(t *testing.T) {
+	peer, peerURL := newPeerRegistry(t)
+	server := newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, Packs: []string{namespaceAll}, Issuers: []string{namespaceAll}, Verifiers: []string{namespaceAll}})
+	verifier := AccreditedVerifier{DID: "did:web:market.example", Name: "Market", Packs: []string{"pack.safe.seller"}}
+	require.Equal(t, http.StatusCreated, packRequest(t, peer, http.MethodPost, "/trust/verifiers", testOperatorToken, verifier).Code)
+
+	statuses := syncPeers(t, server)
+	assert.Equal(t, 2, statuses[0].Packs.Imported)
+	assert.Equal(t, 1, statuses[0].Verifiers.Imported)
+
+	// Nothing changed upstream: the manifests answer 304
+	statuses = syncPeers(t, server)
+	assert.Equal(t, SyncCounts{}, statuses[0].Packs)
+	assert.Equal(t, SyncCounts{}, statuses[0].Issuers)
+
+	issuer, err := peer.trust.GetIssuer(context.Background(), "did:web:cachet.id")
+	require.NoError(t, err)
+	issuer.Status = TrustStatusRevoked
+	require.Equal(t, http.StatusOK, packRequest(t, peer, http.MethodPut, "/trust/issuers/did:web:cachet.id", testOperatorToken, issuer).Code)
+	require.Equal(t, http.StatusNoContent, packRequest(t, peer, http.MethodDelete, "/trust/verifiers/did:web:market.example", testOperatorToken, nil).Code)
+	require.Equal(t, http.StatusOK, packRequest(t, peer, http.MethodPut, "/packs/pack.childcare.readiness@0.1.0", testOperatorToken, PackUpdate{Status: PackStatusRetired}).Code)
+
+	statuses = syncPeers(t, server)
+	assert.Equal(t, SyncCounts{Removed: 1}, statuses[0].Packs)
+	assert.Equal(t, SyncCounts{Updated: 1}, statuses[0].Issuers)
+	assert.Equal(t, SyncCounts{Removed: 1}, statuses[0].Verifiers)
+
+	retired, err := server.packs.Get(context.Background(), "pack.childcare.readiness", "0.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, PackStatusRetired, retired.Status)
+	imported, err := server.trust.GetIssuer(context.Background(), "did:web:cachet.id")
+	require.NoError(t, err)
+	assert.Equal(t, TrustStatusRevoked, imported.Status)
+	_, err = server.trust.GetVerifier(context.Background(), "did:web:market.example")
+	assert.ErrorIs(t, err, ErrTrustEntryNotFound)
+}
+
+func TestFederation_Conflicts(t *testing.T) {
+	_, coreURL := newPeerRegistry(t)
+	_, partnerURL := newPeerRegistry(t)
+	server := newFederatedServer(
+		PeerConfig{Name: "core", URL: coreURL, Packs: []string{"pack.safe."}},
+		PeerConfig{Name: "partner", URL: partnerURL, Packs: []string{namespaceAll}},
+	)
+	// A locally authored version of a pack the partner also publishes
+	local := StoredPack{
+		PublishedPack: PublishedPack{
+			PackSummary: PackSummary{ID: "pack.childcare.readiness", Version: "0.1.0", Name: "Local Childcare"},
+			Rules:       []PolicyRule{{ID: "identity.verified", Expr: "identity_liveness == true"}},
+		},
+		Status: PackStatusPublished,
+	}
+	require.NoError(t, server.packs.Create(context.Background(), local))
+
+	statuses := syncPeers(t, server)
+	assert.Equal(t, 1, statuses[0].Packs.Imported)
+	assert.Equal(t, 0, statuses[1].Packs.Imported)
+	assert.ElementsMatch(t, []SyncConflict{
+		{Kind: "pack", Key: "pack.childcare.readiness@0.1.0", Reason: "authored locally"},
+		{Kind: "pack", Key: "pack.safe.seller@0.1.0", Reason: "imported from peer core"},
+	}, statuses[1].Conflicts)
+
+	kept, err := server.packs.Get(context.Background(), "pack.childcare.readiness", "0.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "Local Childcare", kept.Name)
+	assert.Nil(t, kept.Provenance)
+
+	w := packRequest(t, server, http.MethodGet, "/federation/peers", testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "imported from peer core")
+}
+
+func TestFederation_RejectsUnverifiedManifests(t *testing.T) {
+	_, peerURL := newPeerRegistry(t)
+	_, otherURL := newPeerRegistry(t)
+	// Keys pinned to another registry, as if the peer were impersonated
+	server := newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, JWKSURL: otherURL + "/.well-known/jwks.json", Packs: []string{namespaceAll}})
+
+	statuses := server.federation.Sync(context.Background())
+	assert.Contains(t, statuses[0].LastError, "signature")
+	assert.Nil(t, statuses[0].LastSuccessAt)
+	assert.Empty(t, listPacks(t, server, "", ""))
+}
+
+func TestFederation_Endpoints(t *testing.T) {
+	server := newAdminServer()
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/federation/sync", "", nil).Code)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/federation/sync", testOperatorToken, nil).Code)
+
+	_, peerURL := newPeerRegistry(t)
+	server = newFederatedServer(PeerConfig{Name: "cachet", URL: peerURL, Packs: []string{namespaceAll}})
+	w := packRequest(t, server, http.MethodPost, "/federation/sync", testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, listPacks(t, server, "", ""), 2)
+
+	w = packRequest(t, server, http.MethodGet, "/trust/manifest", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/jwt", w.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusNotModified, conditionalGet(server, "/trust/manifest", map[string]string{"If-None-Match": w.Header().Get("ETag")}).Code)
+}
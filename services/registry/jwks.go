@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+)
+
+// maxJWKSSize bounds the key sets fetched from peers and OIDC providers
+const maxJWKSSize = 1 << 20
+
+// jwksKeys holds the keys of a remote JWKS (a peer registry's manifest keys,
+// an OIDC provider's token keys), refetched when a signature names a key not
+// seen yet (rotation)
+type jwksKeys struct {
+	jwksURL string
+	client  *http.Client
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey // kid -> key
+}
+
+func newJWKSKeys(jwksURL string, client *http.Client) *jwksKeys {
+	return &jwksKeys{jwksURL: jwksURL, client: client}
+}
+
+func (k *jwksKeys) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if err := k.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", k.jwksURL, err)
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %q is not in %s", kid, k.jwksURL)
+}
+
+func (k *jwksKeys) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS request returned %d", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []didresolver.JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&jwks); err != nil {
+		return fmt.Errorf("JWKS is malformed: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil || jwk.Kid == "" {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	k.keys = keys
+	return nil
+}
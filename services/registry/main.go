@@ -1,26 +1,155 @@
 package main
 
 import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"os"
 )
 
 func main() {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
 	// Configure structured logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if os.Getenv("ENVIRONMENT") == "development" {
+	if cfg.Development() {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8082"
+	exporting, err := tracing.Init(context.Background(), "registry")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
 	}
 
 	server := NewServer()
-	log.Info().Str("port", port).Msg("Starting registry service")
-	if err := server.Start(":" + port); err != nil {
+	server.operatorToken = cfg.OperatorToken
+	if cfg.SigningKey != "" {
+		if server.signer, err = signing.Load(cfg.SigningKey); err != nil {
+			log.Fatal().Err(err).Msg("Invalid REGISTRY_SIGNING_KEY")
+		}
+	} else {
+		log.Warn().Msg("REGISTRY_SIGNING_KEY is unset, so manifests, bundles and packs are signed with a key generated at startup")
+	}
+	log.Info().Str("kid", server.signer.KeyID()).Msg("Signing with the registry key")
+	server.openapi.ValidateResponses = cfg.Development()
+	server.cors.Set(cfg.CORS)
+	server.versions.Set(cfg.APIVersion)
+	auth, err := serviceauth.New("registry", cfg.ServiceAuth)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
+	}
+	oidcConfig, err := LoadOIDCConfigFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid admin OIDC configuration")
+	}
+	if oidcConfig != nil {
+		server.adminTokens = newAdminTokenVerifier(*oidcConfig)
+		log.Info().Str("issuer", oidcConfig.Issuer).Str("audience", oidcConfig.Audience).Msg("Accepting OIDC access tokens for the admin APIs")
+	} else if server.operatorToken == "" {
+		log.Warn().Msg("Neither ADMIN_OIDC_ISSUER nor OPERATOR_API_TOKEN is set, so packs and trust registry entries cannot be managed")
+	}
+	dbConfig, err := store.ConfigFromEnv(databaseSchema)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid database configuration")
+	}
+	var db *store.DB
+	if dbConfig != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		stores, err := openStores(ctx, *dbConfig, server.catalog.policies)
+		cancel()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the Postgres stores")
+		}
+		server.health.Require("database", stores.db)
+		db = stores.db
+		server.packs, server.trust, server.audit, server.dids, server.bundles = stores.packs, stores.trust, stores.audit, stores.dids, stores.bundles
+		log.Info().Str("schema", stores.db.Schema()).Msg("Serving packs, the trust registry, hosted DIDs, config bundles and the admin audit log from Postgres")
+	} else {
+		log.Warn().Msg("DATABASE_URL is unset, packs, the trust registry, hosted DIDs, config bundles and the admin audit log are kept in memory and lost on restart")
+	}
+	if server.security, err = audit.Open("registry", cfg.SecurityAudit, auth, db); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the security audit trail")
+	}
+	if cfg.SecurityAudit.AnchorURL == "" {
+		log.Warn().Msg("SECURITY_AUDIT_ANCHOR_URL is unset, so security audit batches are sealed but not anchored")
+	}
+	tenants, err := tenant.Load[struct{}](cfg.Tenants)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load tenants")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = server.setTenants(ctx, tenant.Tenants(tenants))
+	cancel()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to seed the tenants' packs")
+	}
+	if len(tenants) > 0 {
+		log.Info().Int("tenants", len(tenants)).Msg("Serving packs for the tenants of TENANTS_CONFIG")
+	}
+	federationConfig, err := LoadFederationConfigFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid FEDERATION_CONFIG")
+	}
+	if federationConfig != nil {
+		server.federation = newFederation(federationConfig, server.packs, server.trust)
+		log.Info().Int("peer_count", len(federationConfig.Peers)).Dur("interval", federationConfig.Interval).Msg("Federating packs and trust entries from peer registries")
+	}
+	log.Info().Int("port", cfg.Port).Msg("Starting registry service")
+	if err := server.Start(cfg.Addr()); err != nil {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
 }
+
+// registryStores are the Postgres-backed stores, sharing one connection pool
+type registryStores struct {
+	db      *store.DB
+	packs   PackStore
+	trust   TrustStore
+	audit   AuditStore
+	dids    DIDStore
+	bundles BundleStore
+}
+
+// openStores opens the Postgres pack, trust, audit, DID and bundle stores and
+// seeds them with the built-in packs, issuers and platform DID
+func openStores(ctx context.Context, config store.Config, policies map[string][]byte) (*registryStores, error) {
+	db, err := openDatabase(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	stores := &registryStores{
+		db:      db,
+		packs:   newPostgresPackStore(db.DB),
+		trust:   newPostgresTrustStore(db.DB),
+		audit:   newPostgresAuditStore(db.DB),
+		dids:    newPostgresDIDStore(db.DB),
+		bundles: newPostgresBundleStore(db.DB),
+	}
+	err = seedPacks(ctx, stores.packs, builtinPacks(), policies)
+	if err == nil {
+		err = seedTrust(ctx, stores.trust, builtinTrustedIssuers())
+	}
+	if err == nil {
+		err = seedPlatformDID(ctx, stores.dids)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return stores, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Signed policy and trust manifests
+const (
+	manifestID = "policy.cachet.manifest"
+	// manifestVersion is the version of the manifest formats
+	manifestVersion   = "0.1.0"
+	manifestType      = "policy-manifest+jwt"
+	trustManifestID   = "trust.cachet.manifest"
+	trustManifestType = "trust-manifest+jwt"
+)
+
+// PolicyManifest lists the published packs and their rules. It is served as
+// a JWS signed with the registry key (published at /.well-known/jwks.json), so
+// verifiers and wallets can check pack definitions came from the registry.
+type PolicyManifest struct {
+	ID         string         `json:"id"`
+	Version    string         `json:"version"`
+	IssuedAt   time.Time      `json:"issuedAt"` // when a pack last changed
+	SigningDID string         `json:"signingDid"`
+	Packs      []ManifestPack `json:"packs"`
+}
+
+// ManifestPack is a published pack as authored, which peer registries
+// import, with the flattened rules verifiers evaluate when it has
+// dependencies. Each pack carries its digest and the registry's signature
+// of it, so verifiers can check packs one by one, including those they
+// cached.
+type ManifestPack struct {
+	PublishedPack
+	Resolved  *ResolvedPolicy `json:"resolved,omitempty"`
+	Digest    string          `json:"digest,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// ManifestClaims is the JWS payload of the policy manifest
+type ManifestClaims struct {
+	Manifest PolicyManifest `json:"manifest"`
+	jwt.RegisteredClaims
+}
+
+// TrustManifest lists the trusted issuers and accredited verifiers, signed
+// like the policy manifest so peer registries can federate them
+type TrustManifest struct {
+	ID         string               `json:"id"`
+	Version    string               `json:"version"`
+	SigningDID string               `json:"signingDid"`
+	Issuers    []TrustedIssuer      `json:"issuers"`
+	Verifiers  []AccreditedVerifier `json:"verifiers"`
+}
+
+// TrustManifestClaims is the JWS payload of the trust manifest
+type TrustManifestClaims struct {
+	Manifest TrustManifest `json:"manifest"`
+	jwt.RegisteredClaims
+}
+
+// buildManifest lists every published pack version from the store
+func (s *Server) buildManifest(r *http.Request) (PolicyManifest, error) {
+	packs, err := s.packs.List(r.Context(), PackFilter{Status: PackStatusPublished})
+	if err != nil {
+		return PolicyManifest{}, err
+	}
+	manifest := PolicyManifest{
+		ID:         manifestID,
+		Version:    manifestVersion,
+		SigningDID: registryIssuer + "#" + s.signer.KeyID(),
+		Packs:      make([]ManifestPack, 0, len(packs)),
+	}
+	for _, pack := range packs {
+		entry := ManifestPack{PublishedPack: pack.PublishedPack}
+		if len(pack.Includes) > 0 {
+			resolved, err := flattenPack(r.Context(), s.packs, pack.PublishedPack)
+			if err != nil {
+				return PolicyManifest{}, fmt.Errorf("pack %s: %w", pack.Ref(), err)
+			}
+			entry.Resolved = &resolved
+		}
+		if entry.Digest, err = packDigest(entry); err != nil {
+			return PolicyManifest{}, fmt.Errorf("pack %s: %w", pack.Ref(), err)
+		}
+		manifest.Packs = append(manifest.Packs, entry)
+		if pack.UpdatedAt.After(manifest.IssuedAt) {
+			manifest.IssuedAt = pack.UpdatedAt.UTC()
+		}
+	}
+	return manifest, nil
+}
+
+// handlePolicyManifest serves the manifest as a compact JWS. The ETag is a
+// digest of the manifest rather than the JWS, whose ECDSA signature differs
+// on every request.
+func (s *Server) handlePolicyManifest(w http.ResponseWriter, r *http.Request) {
+	manifest, err := s.buildManifest(r)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode policy manifest")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	lastModified, err := s.packsLastModified(r)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	if notModified(w, r, cacheValidators{ETag: strongETag(payload), LastModified: lastModified}, cacheRevalidate) {
+		return
+	}
+	// Packs are signed after the ETag is taken: their digests already
+	// cover them, and ECDSA signatures differ on every request
+	now := time.Now()
+	for i, pack := range manifest.Packs {
+		ref := pack.ID + "@" + pack.Version
+		if manifest.Packs[i].Signature, err = s.signPackDigest(ref, pack.Digest, now); err != nil {
+			log.Error().Err(err).Str("pack_id", ref).Msg("Failed to sign pack")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	jws, err := s.signer.SignTyped(manifestType, ManifestClaims{
+		Manifest: manifest,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   registryIssuer,
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign policy manifest")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Int("pack_count", len(manifest.Packs)).Msg("Policy manifest requested")
+	w.Header().Set("Content-Type", "application/jwt")
+	if _, err := w.Write([]byte(jws)); err != nil {
+		log.Error().Err(err).Msg("Failed to write policy manifest response")
+	}
+}
+
+// handleTrustManifest serves every trust registry entry as a compact JWS,
+// with an ETag over the manifest as for the policy manifest
+func (s *Server) handleTrustManifest(w http.ResponseWriter, r *http.Request) {
+	issuers, err := s.trust.ListIssuers(r.Context(), IssuerFilter{})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	verifiers, err := s.trust.ListVerifiers(r.Context(), VerifierFilter{})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	manifest := TrustManifest{
+		ID:         trustManifestID,
+		Version:    manifestVersion,
+		SigningDID: registryIssuer + "#" + s.signer.KeyID(),
+		Issuers:    issuers,
+		Verifiers:  verifiers,
+	}
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode trust manifest")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if notModified(w, r, cacheValidators{ETag: strongETag(payload)}, cacheRevalidate) {
+		return
+	}
+	jws, err := s.signer.SignTyped(trustManifestType, TrustManifestClaims{
+		Manifest: manifest,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   registryIssuer,
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign trust manifest")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Int("issuer_count", len(issuers)).Int("verifier_count", len(verifiers)).Msg("Trust manifest requested")
+	w.Header().Set("Content-Type", "application/jwt")
+	if _, err := w.Write([]byte(jws)); err != nil {
+		log.Error().Err(err).Msg("Failed to write trust manifest response")
+	}
+}
@@ -0,0 +1,14 @@
+-- The registry created its tables in the public schema before each service
+-- had a schema of its own. Move any that exist into the registry schema so
+-- deployments keep their packs, trust entries, hosted DIDs and audit log.
+DO $$
+DECLARE
+	t text;
+BEGIN
+	FOREACH t IN ARRAY ARRAY['packs', 'trusted_issuers', 'accredited_verifiers', 'admin_audit', 'hosted_dids'] LOOP
+		IF to_regclass(format('public.%I', t)) IS NOT NULL AND to_regclass(format('%I.%I', current_schema(), t)) IS NULL THEN
+			EXECUTE format('ALTER TABLE public.%I SET SCHEMA %I', t, current_schema());
+		END IF;
+	END LOOP;
+END
+$$;
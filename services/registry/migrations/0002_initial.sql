@@ -0,0 +1,46 @@
+-- Packs: the pack document (name, rules, freshness, match rules) is stored
+-- as JSON next to its lifecycle columns, and the review history next to the
+-- signature applied on publish
+CREATE TABLE IF NOT EXISTS packs (
+	id           text        NOT NULL,
+	version      text        NOT NULL,
+	status       text        NOT NULL,
+	document     jsonb       NOT NULL,
+	created_at   timestamptz NOT NULL,
+	updated_at   timestamptz NOT NULL,
+	published_at timestamptz,
+	PRIMARY KEY (id, version)
+);
+CREATE INDEX IF NOT EXISTS packs_status_idx ON packs (status);
+ALTER TABLE packs ADD COLUMN IF NOT EXISTS workflow jsonb;
+ALTER TABLE packs ADD COLUMN IF NOT EXISTS signature text NOT NULL DEFAULT '';
+
+-- The trust registry
+CREATE TABLE IF NOT EXISTS trusted_issuers (
+	did        text        PRIMARY KEY,
+	status     text        NOT NULL,
+	document   jsonb       NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS accredited_verifiers (
+	did        text        PRIMARY KEY,
+	status     text        NOT NULL,
+	document   jsonb       NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- The append-only admin audit log
+CREATE TABLE IF NOT EXISTS admin_audit (
+	seq         bigserial   PRIMARY KEY,
+	actor       text        NOT NULL,
+	outcome     text        NOT NULL,
+	recorded_at timestamptz NOT NULL,
+	document    jsonb       NOT NULL
+);
+
+-- Hosted DIDs; the platform DID is the row with an empty name
+CREATE TABLE IF NOT EXISTS hosted_dids (
+	name       text        PRIMARY KEY,
+	document   jsonb       NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+-- Packs belong to a tenant, and tenants may publish the same pack id and
+-- version independently; packs from before tenancy belong to the default
+-- tenant.
+ALTER TABLE packs ADD COLUMN IF NOT EXISTS tenant text NOT NULL DEFAULT 'default';
+ALTER TABLE packs DROP CONSTRAINT IF EXISTS packs_pkey;
+ALTER TABLE packs ADD PRIMARY KEY (tenant, id, version);
@@ -0,0 +1,10 @@
+-- Compiled config bundles, numbered per tenant. Clients cache numbered
+-- versions forever, so a version is written once and never renumbered.
+CREATE TABLE IF NOT EXISTS config_bundles (
+	tenant     text        NOT NULL,
+	version    integer     NOT NULL,
+	digest     text        NOT NULL,
+	contents   jsonb       NOT NULL,
+	created_at timestamptz NOT NULL,
+	PRIMARY KEY (tenant, version)
+);
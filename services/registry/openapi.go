@@ -0,0 +1,10 @@
+package main
+
+import _ "embed"
+
+// openapiDocument describes the service's API. It is a copy of
+// api/openapi.registry.yaml, kept in step by TestOpenAPIDocument, since embedded files
+// cannot live outside the module.
+//
+//go:embed openapi.yaml
+var openapiDocument []byte
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// packStatusAll lists packs in every lifecycle state
+const packStatusAll = "all"
+
+// PackUpdate is the body of PUT /packs/{id}@{version}: a full replacement
+// of a draft's content, optionally with a lifecycle transition. A body with
+// only a status moves a pack through its lifecycle without editing it.
+type PackUpdate struct {
+	PublishedPack
+	Status string `json:"status,omitempty"`
+}
+
+func (u PackUpdate) statusOnly() bool {
+	return u.Name == "" && u.Purpose == "" && u.Jurisdictions == nil && u.Kind == "" &&
+		u.Rules == nil && u.Freshness == nil && u.Match == nil && u.Dependencies == nil
+}
+
+// splitPackRef splits id@version; the version is empty for a bare pack id
+func splitPackRef(ref string) (string, string) {
+	id, version, _ := strings.Cut(ref, "@")
+	return id, version
+}
+
+// writePackStoreError answers a failed pack store call
+func writePackStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrPackNotFound):
+		problem.Write(w, r, http.StatusNotFound, "pack_not_found", "Pack not found")
+	case errors.Is(err, ErrPackExists):
+		problem.Write(w, r, http.StatusConflict, "pack_exists", err.Error())
+	case errors.Is(err, ErrPackImmutable):
+		problem.Write(w, r, http.StatusConflict, "pack_immutable", err.Error())
+	case errors.Is(err, ErrFederatedEntry):
+		problem.Write(w, r, http.StatusConflict, "federated_entry", err.Error())
+	case errors.Is(err, ErrPackDependency):
+		problem.Write(w, r, http.StatusConflict, "pack_dependency", err.Error())
+	case errors.Is(err, ErrSelfReview):
+		problem.Write(w, r, http.StatusForbidden, "self_review", err.Error())
+	default:
+		log.Error().Err(err).Msg("Pack store request failed")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// publishedPackSummaries are the latest published version of each pack, as
+// compiled into config bundles. Libraries are left out; wallets are never
+// asked for them.
+func (s *Server) publishedPackSummaries(r *http.Request) ([]PackSummary, error) {
+	packs, err := s.packs.List(r.Context(), PackFilter{Status: PackStatusPublished, Latest: true})
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]PackSummary, 0, len(packs))
+	for _, pack := range packs {
+		if pack.Kind == PackKindLibrary {
+			continue
+		}
+		summaries = append(summaries, pack.PackSummary)
+	}
+	return summaries, nil
+}
+
+// handleListPacks serves the packs verifiers load: every published version
+// unless filtered. Unpublished and retired packs are listed for operators
+// only.
+// Pollers get 304 Not Modified until a pack changes.
+func (s *Server) handleListPacks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := PackFilter{
+		ID:           query.Get("id"),
+		Status:       query.Get("status"),
+		Jurisdiction: query.Get("jurisdiction"),
+		Latest:       query.Get("latest") == "true",
+	}
+	switch filter.Status {
+	case "":
+		filter.Status = PackStatusPublished
+	case PackStatusPublished:
+	case PackStatusDraft, PackStatusInReview, PackStatusApproved, PackStatusRetired, packStatusAll:
+		if !s.authorizeRole(r, RoleReadOnly) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if filter.Status == packStatusAll {
+			filter.Status = ""
+		}
+	default:
+		problem.Error(w, r, "status must be draft, in_review, approved, published, retired or all", http.StatusBadRequest)
+		return
+	}
+
+	packs, err := s.packs.List(r.Context(), filter)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	lastModified, err := s.packsLastModified(r)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Int("pack_count", len(packs)).Str("status", filter.Status).Msg("Packs requested")
+	writeCachedJSON(w, r, map[string]interface{}{"packs": packs}, lastModified, cacheRevalidate)
+}
+
+// packsLastModified is when any pack last changed. It is the Last-Modified
+// of pack listings, since retiring a pack drops it from the published list
+// without changing any pack still listed.
+func (s *Server) packsLastModified(r *http.Request) (time.Time, error) {
+	packs, err := s.packs.List(r.Context(), PackFilter{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest time.Time
+	for _, pack := range packs {
+		if pack.UpdatedAt.After(latest) {
+			latest = pack.UpdatedAt
+		}
+	}
+	return latest, nil
+}
+
+// lookupPack finds the pack version {ref} names, or the latest published
+// version for a bare pack id. Unpublished packs are visible to operators
+// only; retired versions stay readable, immutably, by their reference.
+func (s *Server) lookupPack(w http.ResponseWriter, r *http.Request) (StoredPack, bool) {
+	id, version := splitPackRef(chi.URLParam(r, "ref"))
+	if version == "" {
+		packs, err := s.packs.List(r.Context(), PackFilter{ID: id, Status: PackStatusPublished, Latest: true})
+		if err != nil {
+			writePackStoreError(w, r, err)
+			return StoredPack{}, false
+		}
+		if len(packs) == 0 {
+			writePackStoreError(w, r, ErrPackNotFound)
+			return StoredPack{}, false
+		}
+		return packs[0], true
+	}
+	pack, err := s.packs.Get(r.Context(), id, version)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return StoredPack{}, false
+	}
+	if pack.unpublished() && !s.authorizeRole(r, RoleReadOnly) {
+		writePackStoreError(w, r, ErrPackNotFound)
+		return StoredPack{}, false
+	}
+	return pack, true
+}
+
+// handleGetPack serves one pack version as authored, with its pinned
+// includes once published
+func (s *Server) handleGetPack(w http.ResponseWriter, r *http.Request) {
+	pack, ok := s.lookupPack(w, r)
+	if !ok {
+		return
+	}
+	writeCachedJSON(w, r, pack, pack.UpdatedAt, cacheRevalidate)
+}
+
+// PackChanges is the compact delta served at GET /packs/changes: the packs
+// published and retired since a cursor, so pollers skip unchanged packs
+type PackChanges struct {
+	// Cursor is passed as since on the next poll
+	Cursor    time.Time       `json:"cursor"`
+	Published []PublishedPack `json:"published"`
+	Retired   []string        `json:"retired"` // id@version
+}
+
+// handleListPackChanges answers which packs were published or retired after
+// ?since= (RFC 3339, normally the previous cursor). Without since it lists
+// every published pack, for a first sync.
+func (s *Server) handleListPackChanges(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			problem.Error(w, r, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	packs, err := s.packs.List(r.Context(), PackFilter{UpdatedSince: since})
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+
+	changes := PackChanges{Cursor: since, Published: []PublishedPack{}, Retired: []string{}}
+	for _, pack := range packs {
+		switch {
+		case pack.Status == PackStatusPublished:
+			changes.Published = append(changes.Published, pack.PublishedPack)
+		case pack.Status == PackStatusRetired && !since.IsZero():
+			changes.Retired = append(changes.Retired, pack.Ref())
+		default:
+			continue // unpublished packs are invisible to pollers
+		}
+		if pack.UpdatedAt.After(changes.Cursor) {
+			changes.Cursor = pack.UpdatedAt
+		}
+	}
+	log.Info().
+		Time("since", since).
+		Int("published", len(changes.Published)).
+		Int("retired", len(changes.Retired)).
+		Msg("Pack changes requested")
+	writeCachedJSON(w, r, changes, changes.Cursor, cacheRevalidate)
+}
+
+// handleCreatePack stores a new pack version as a draft
+func (s *Server) handleCreatePack(w http.ResponseWriter, r *http.Request) {
+	var doc PublishedPack
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validatePack(doc); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc.Provenance, doc.Includes = nil, nil
+	now := time.Now().UTC()
+	pack := StoredPack{PublishedPack: doc, Status: PackStatusDraft, CreatedAt: now, UpdatedAt: now}
+	if err := s.packs.Create(r.Context(), pack); err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("pack_id", pack.Ref()).Msg("Pack draft created")
+	w.Header().Set("Location", "/packs/"+pack.Ref())
+	writeJSON(w, http.StatusCreated, pack)
+}
+
+// handleUpdatePack edits a draft and/or moves a pack through its lifecycle:
+// draft to in_review (submitting it), back to draft (withdrawing it),
+// approved to published, published to retired. Approval goes through
+// POST /packs/{ref}/review instead. Publishing signs the pack.
+func (s *Server) handleUpdatePack(w http.ResponseWriter, r *http.Request) {
+	id, version := splitPackRef(chi.URLParam(r, "ref"))
+	if version == "" {
+		problem.Error(w, r, "pack reference must be id@version", http.StatusBadRequest)
+		return
+	}
+	var update PackUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	editing := !update.statusOnly()
+	if editing {
+		if (update.ID != "" && update.ID != id) || (update.Version != "" && update.Version != version) {
+			problem.Error(w, r, "id and version cannot be changed; create a new version instead", http.StatusBadRequest)
+			return
+		}
+		update.ID, update.Version, update.Provenance, update.Includes = id, version, nil, nil
+		if err := validatePack(update.PublishedPack); err != nil {
+			problem.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if update.Status == "" {
+		problem.Error(w, r, "nothing to update", http.StatusBadRequest)
+		return
+	}
+	if update.Status == PackStatusApproved {
+		problem.Error(w, r, "packs are approved with POST /packs/{ref}/review", http.StatusBadRequest)
+		return
+	}
+
+	// Publishing pins the dependency graph. It is resolved before the update
+	// since the store is locked during it, so the update checks the pack
+	// it resolved is still the one being published.
+	var approved *PublishedPack
+	var includes []string
+	if update.Status == PackStatusPublished {
+		current, err := s.packs.Get(r.Context(), id, version)
+		if err != nil {
+			writePackStoreError(w, r, err)
+			return
+		}
+		if current.Status == PackStatusApproved && current.Provenance == nil {
+			approved = &current.PublishedPack
+			if includes, err = s.resolvePack(r.Context(), *approved); err != nil {
+				writePackStoreError(w, r, err)
+				return
+			}
+		}
+	}
+
+	author := principalFrom(r.Context())
+	now := time.Now().UTC()
+	pack, err := s.packs.Update(r.Context(), id, version, func(pack *StoredPack) error {
+		if pack.Provenance != nil {
+			return ErrFederatedEntry
+		}
+		if editing {
+			if pack.Status != PackStatusDraft {
+				return ErrPackImmutable
+			}
+			pack.PublishedPack, pack.UpdatedAt = update.PublishedPack, now
+		}
+		if update.Status == "" || update.Status == pack.Status {
+			return nil
+		}
+		switch {
+		case update.Status == PackStatusInReview && pack.Status == PackStatusDraft:
+			workflow := workflowOf(*pack)
+			workflow.SubmittedBy, workflow.SubmittedAt = author.Subject, now
+			pack.Workflow = &workflow
+		case update.Status == PackStatusPublished && pack.Status == PackStatusApproved:
+			if approved == nil || !reflect.DeepEqual(pack.PublishedPack, *approved) {
+				return fmt.Errorf("%w: the pack changed while it was being published", ErrPackDependency)
+			}
+			pack.Includes = includes
+			signature, err := s.signPack(*pack, now)
+			if err != nil {
+				return err
+			}
+			pack.Signature = signature
+		}
+		return transitionPack(pack, update.Status, now)
+	})
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("pack_id", pack.Ref()).Str("status", pack.Status).Bool("edited", editing).Msg("Pack updated")
+	writeJSON(w, http.StatusOK, pack)
+}
+
+// handleDeletePack removes a draft; published packs are retired instead
+func (s *Server) handleDeletePack(w http.ResponseWriter, r *http.Request) {
+	id, version := splitPackRef(chi.URLParam(r, "ref"))
+	if version == "" {
+		problem.Error(w, r, "pack reference must be id@version", http.StatusBadRequest)
+		return
+	}
+	if err := s.packs.Delete(r.Context(), id, version); err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("pack_id", id+"@"+version).Msg("Pack draft deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
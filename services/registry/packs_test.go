@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const testOperatorToken = "operator-secret"
+
+func newAdminServer() *Server {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	return server
+}
+
+// packRequest calls the pack API, as an operator when token is set
+func packRequest(t *testing.T, server *Server, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func tenantPack(version string) PublishedPack {
+	return PublishedPack{
+		PackSummary: PackSummary{ID: "pack.tenant.ready", Version: version, Name: "Tenant Ready", Jurisdictions: []string{"UK"}},
+		Rules:       []PolicyRule{{ID: "identity.verified", Expr: "identity_liveness == true"}},
+	}
+}
+
+func listPacks(t *testing.T, server *Server, query, token string) []StoredPack {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, "/packs"+query, token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Packs []StoredPack `json:"packs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Packs
+}
+
+// approvePack submits a draft for review and approves it, with the operator
+// token standing in for both author and reviewer
+func approvePack(t *testing.T, server *Server, ref string) {
+	t.Helper()
+	w := packRequest(t, server, http.MethodPut, "/packs/"+ref, testOperatorToken, PackUpdate{Status: PackStatusInReview})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = packRequest(t, server, http.MethodPost, "/packs/"+ref+"/review", testOperatorToken, PackReviewRequest{Decision: PackReviewApprove})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestPackLifecycle(t *testing.T) {
+	server := newAdminServer()
+
+	w := packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack("1.0.0"))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "/packs/pack.tenant.ready@1.0.0", w.Header().Get("Location"))
+	var pack StoredPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pack))
+	assert.Equal(t, PackStatusDraft, pack.Status)
+
+	// Drafts are invisible to verifiers
+	assert.Len(t, listPacks(t, server, "", ""), 2)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0", "", nil).Code)
+	assert.Equal(t, http.StatusOK, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, nil).Code)
+	assert.Len(t, listPacks(t, server, "?status=draft", testOperatorToken), 1)
+
+	edited := tenantPack("1.0.0")
+	edited.Rules = append(edited.Rules, PolicyRule{ID: "age.ge.18", Expr: "age >= 18"})
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{PublishedPack: edited})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code, "drafts are reviewed before publication")
+	approvePack(t, server, "pack.tenant.ready@1.0.0")
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pack))
+	assert.Equal(t, PackStatusPublished, pack.Status)
+	assert.NotNil(t, pack.PublishedAt)
+	assert.Len(t, pack.Rules, 2)
+
+	// Published packs are immutable and served to verifiers
+	assert.Len(t, listPacks(t, server, "", ""), 3)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{PublishedPack: edited}).Code)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodDelete, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, nil).Code)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusDraft}).Code)
+
+	w = packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0/policy", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var policy PackPolicy
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &policy))
+	assert.Equal(t, "age >= 18", policy.Rules[1].Expr)
+
+	w = packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusRetired})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, listPacks(t, server, "", ""), 2)
+	assert.Len(t, listPacks(t, server, "?status=all", testOperatorToken), 3)
+}
+
+func TestDeletePackDraft(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack("1.0.0")).Code)
+
+	assert.Equal(t, http.StatusNoContent, packRequest(t, server, http.MethodDelete, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodDelete, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, nil).Code)
+}
+
+func TestPackAdminRequiresOperator(t *testing.T) {
+	server := newAdminServer()
+
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/packs", "", tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/packs", "wrong", tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodGet, "/packs?status=draft", "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodDelete, "/packs/pack.safe.seller@0.1.0", "", nil).Code)
+}
+
+func TestCreatePack_Validation(t *testing.T) {
+	server := newAdminServer()
+
+	invalid := map[string]PublishedPack{
+		"version":    tenantPack("1.0"),
+		"leading 0":  tenantPack("01.0.0"),
+		"no rules":   {PackSummary: PackSummary{ID: "pack.x", Version: "1.0.0", Name: "X"}},
+		"id with @":  {PackSummary: PackSummary{ID: "pack@x", Version: "1.0.0", Name: "X"}, Rules: tenantPack("1.0.0").Rules},
+		"duplicates": {PackSummary: PackSummary{ID: "pack.x", Version: "1.0.0", Name: "X"}, Rules: []PolicyRule{{ID: "a", Expr: "x"}, {ID: "a", Expr: "y"}}},
+	}
+	for name, pack := range invalid {
+		assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, pack).Code, name)
+	}
+
+	seller := tenantPack("0.1.0")
+	seller.ID = "pack.safe.seller"
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, seller).Code)
+}
+
+func TestListPacks_Filters(t *testing.T) {
+	server := newAdminServer()
+	for _, version := range []string{"1.0.0", "1.10.0", "1.2.0"} {
+		require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack(version)).Code)
+		approvePack(t, server, "pack.tenant.ready@"+version)
+		require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@"+version, testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code)
+	}
+
+	versions := func(packs []StoredPack) []string {
+		var out []string
+		for _, pack := range packs {
+			out = append(out, pack.Ref())
+		}
+		return out
+	}
+	assert.Equal(t, []string{"pack.tenant.ready@1.0.0", "pack.tenant.ready@1.2.0", "pack.tenant.ready@1.10.0"}, versions(listPacks(t, server, "?id=pack.tenant.ready", "")))
+	assert.Equal(t, []string{"pack.tenant.ready@1.10.0"}, versions(listPacks(t, server, "?jurisdiction=UK&latest=true", "")))
+	assert.Len(t, listPacks(t, server, "?jurisdiction=EU", ""), 2)
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodGet, "/packs?status=pending", "", nil).Code)
+
+	w := packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var latest StoredPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &latest))
+	assert.Equal(t, "1.10.0", latest.Version)
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{"0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10.0", "2.0.0"}
+	for i := 0; i+1 < len(ordered); i++ {
+		assert.Equal(t, -1, compareVersions(ordered[i], ordered[i+1]), "%s < %s", ordered[i], ordered[i+1])
+		assert.Equal(t, 1, compareVersions(ordered[i+1], ordered[i]))
+	}
+	assert.Equal(t, 0, compareVersions("1.0.0+build.5", "1.0.0"))
+
+	_, err := parseSemver("1.0.0-")
+	assert.Error(t, err)
+}
+
+func TestPolicyManifest_FollowsPackStore(t *testing.T) {
+	server := newAdminServer()
+	manifestETag := func() string {
+		w := packRequest(t, server, http.MethodGet, "/policy/manifest", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("ETag")
+	}
+	before := manifestETag()
+
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack("1.0.0")).Code)
+	assert.Equal(t, before, manifestETag(), "drafts are not in the manifest")
+	approvePack(t, server, "pack.tenant.ready@1.0.0")
+	assert.Equal(t, before, manifestETag(), "approved packs are not in the manifest until published")
+
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code)
+	assert.NotEqual(t, before, manifestETag())
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"gopkg.in/yaml.v3"
+)
+
+// Pack lifecycle states. Drafts are editable and invisible to verifiers.
+// Authors submit a draft for review, a reviewer approves it (or sends it
+// back to draft) and the author publishes it. Packs in review or approved
+// are frozen; published packs are immutable; retired packs stay readable
+// but are no longer served to verifiers.
+const (
+	PackStatusDraft     = "draft"
+	PackStatusInReview  = "in_review"
+	PackStatusApproved  = "approved"
+	PackStatusPublished = "published"
+	PackStatusRetired   = "retired"
+)
+
+var (
+	ErrPackNotFound  = errors.New("pack not found")
+	ErrPackExists    = errors.New("pack version already exists")
+	ErrPackImmutable = errors.New("only draft packs can be edited or deleted")
+	ErrSelfReview    = errors.New("packs must be reviewed by someone other than their submitter")
+)
+
+// StoredPack is a pack version as kept by the registry
+type StoredPack struct {
+	PublishedPack
+	// Tenant owns the pack; stores set it from the context they are
+	// called with, and only show a tenant its own packs
+	Tenant      string     `json:"tenant,omitempty"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	PublishedAt *time.Time `json:"publishedAt,omitempty"`
+	// Workflow records the submissions and reviews of an authored pack
+	Workflow *PackWorkflow `json:"workflow,omitempty"`
+	// Signature is the registry's JWS over the pack as published; see
+	// signPack. Built-in and federated packs are not signed on publish, only
+	// in the policy manifest.
+	Signature string `json:"signature,omitempty"`
+}
+
+// PackWorkflow is the review history of a pack version
+type PackWorkflow struct {
+	SubmittedBy string       `json:"submittedBy"`
+	SubmittedAt time.Time    `json:"submittedAt"`
+	Reviews     []PackReview `json:"reviews,omitempty"`
+}
+
+// PackReview is one reviewer decision
+type PackReview struct {
+	Reviewer   string    `json:"reviewer"`
+	Decision   string    `json:"decision"`
+	Comment    string    `json:"comment,omitempty"`
+	ReviewedAt time.Time `json:"reviewedAt"`
+}
+
+// Ref is the versioned pack id verifiers use, e.g. pack.safe.seller@0.1.0
+func (p StoredPack) Ref() string {
+	return p.ID + "@" + p.Version
+}
+
+// unpublished reports whether the pack is still in the publication
+// workflow: a draft, in review or approved
+func (p StoredPack) unpublished() bool {
+	switch p.Status {
+	case PackStatusDraft, PackStatusInReview, PackStatusApproved:
+		return true
+	}
+	return false
+}
+
+// PackFilter narrows a pack listing; zero fields match everything
+type PackFilter struct {
+	ID           string
+	Status       string
+	Jurisdiction string
+	// Latest keeps only the highest version of each pack
+	Latest bool
+	// UpdatedSince keeps packs changed strictly after it
+	UpdatedSince time.Time
+}
+
+// PackStore persists packs and their lifecycle, for the tenant of each
+// call's context
+type PackStore interface {
+	List(ctx context.Context, filter PackFilter) ([]StoredPack, error)
+	Get(ctx context.Context, id, version string) (StoredPack, error)
+	Create(ctx context.Context, pack StoredPack) error
+	// Update applies fn to the stored pack atomically; fn's error aborts it
+	Update(ctx context.Context, id, version string, fn func(*StoredPack) error) (StoredPack, error)
+	Delete(ctx context.Context, id, version string) error
+}
+
+// validatePack checks a pack document before it is stored
+func validatePack(pack PublishedPack) error {
+	if pack.ID == "" || strings.ContainsAny(pack.ID, "@/ ") {
+		return fmt.Errorf("pack id %q is invalid", pack.ID)
+	}
+	if _, err := parseSemver(pack.Version); err != nil {
+		return err
+	}
+	if strings.TrimSpace(pack.Name) == "" {
+		return errors.New("pack name is required")
+	}
+	if len(pack.Rules) == 0 {
+		return errors.New("pack needs at least one rule")
+	}
+	seen := map[string]bool{}
+	for _, rule := range pack.Rules {
+		if rule.ID == "" || strings.TrimSpace(rule.Expr) == "" {
+			return errors.New("rules need an id and an expr")
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("duplicate rule %q", rule.ID)
+		}
+		seen[rule.ID] = true
+	}
+	for _, match := range pack.Match {
+		if match.ID == "" || len(match.Claims) == 0 {
+			return errors.New("match rules need an id and at least one claim")
+		}
+		if seen[match.ID] {
+			return fmt.Errorf("duplicate rule %q", match.ID)
+		}
+		seen[match.ID] = true
+	}
+	if pack.Freshness != nil {
+		if err := pack.Freshness.validate(); err != nil {
+			return err
+		}
+	}
+	for _, category := range pack.Categories {
+		if !validCategory(category) {
+			return fmt.Errorf("unknown category %q", category)
+		}
+	}
+	return validateDependencies(pack)
+}
+
+// transitionPack moves a pack through its lifecycle
+func transitionPack(pack *StoredPack, status string, now time.Time) error {
+	switch {
+	case status == pack.Status:
+		return nil
+	case pack.Status == PackStatusDraft && status == PackStatusInReview:
+	case pack.Status == PackStatusInReview && (status == PackStatusApproved || status == PackStatusDraft):
+	case pack.Status == PackStatusApproved && status == PackStatusDraft:
+	case pack.Status == PackStatusApproved && status == PackStatusPublished:
+		pack.PublishedAt = &now
+	case pack.Status == PackStatusPublished && status == PackStatusRetired:
+	default:
+		return fmt.Errorf("%w: cannot move a %s pack to %q", ErrPackImmutable, pack.Status, status)
+	}
+	pack.Status, pack.UpdatedAt = status, now
+	return nil
+}
+
+// filterPacks applies filter and sorts by id, then version precedence
+func filterPacks(packs []StoredPack, filter PackFilter) []StoredPack {
+	out := make([]StoredPack, 0, len(packs))
+	for _, pack := range packs {
+		if filter.ID != "" && pack.ID != filter.ID {
+			continue
+		}
+		if filter.Status != "" && pack.Status != filter.Status {
+			continue
+		}
+		if filter.Jurisdiction != "" && !slices.Contains(pack.Jurisdictions, filter.Jurisdiction) {
+			continue
+		}
+		if !filter.UpdatedSince.IsZero() && !pack.UpdatedAt.After(filter.UpdatedSince) {
+			continue
+		}
+		out = append(out, pack)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].ID != out[j].ID {
+			return out[i].ID < out[j].ID
+		}
+		return compareVersions(out[i].Version, out[j].Version) < 0
+	})
+	if !filter.Latest {
+		return out
+	}
+	latest := out[:0]
+	for i, pack := range out {
+		if i+1 < len(out) && out[i+1].ID == pack.ID {
+			continue
+		}
+		latest = append(latest, pack)
+	}
+	return latest
+}
+
+// memoryPackStore keeps packs in memory (production should use the Postgres
+// store, so packs survive restarts and are shared across replicas)
+type memoryPackStore struct {
+	mu    sync.RWMutex
+	packs map[string]StoredPack // tenant/id@version
+}
+
+// packKey keys a pack version of the context's tenant
+func packKey(ctx context.Context, id, version string) string {
+	return tenant.FromContext(ctx).ID + "/" + id + "@" + version
+}
+
+func newMemoryPackStore() *memoryPackStore {
+	return &memoryPackStore{packs: make(map[string]StoredPack)}
+}
+
+func (m *memoryPackStore) List(ctx context.Context, filter PackFilter) ([]StoredPack, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tenantID := tenant.FromContext(ctx).ID
+	packs := make([]StoredPack, 0, len(m.packs))
+	for _, pack := range m.packs {
+		if pack.Tenant == tenantID {
+			packs = append(packs, pack)
+		}
+	}
+	return filterPacks(packs, filter), nil
+}
+
+func (m *memoryPackStore) Get(ctx context.Context, id, version string) (StoredPack, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pack, ok := m.packs[packKey(ctx, id, version)]
+	if !ok {
+		return StoredPack{}, ErrPackNotFound
+	}
+	return pack, nil
+}
+
+func (m *memoryPackStore) Create(ctx context.Context, pack StoredPack) error {
+	pack.Tenant = tenant.FromContext(ctx).ID
+	key := packKey(ctx, pack.ID, pack.Version)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.packs[key]; ok {
+		return ErrPackExists
+	}
+	m.packs[key] = pack
+	return nil
+}
+
+func (m *memoryPackStore) Update(ctx context.Context, id, version string, fn func(*StoredPack) error) (StoredPack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pack, ok := m.packs[packKey(ctx, id, version)]
+	if !ok {
+		return StoredPack{}, ErrPackNotFound
+	}
+	if err := fn(&pack); err != nil {
+		return StoredPack{}, err
+	}
+	m.packs[packKey(ctx, pack.ID, pack.Version)] = pack
+	return pack, nil
+}
+
+func (m *memoryPackStore) Delete(ctx context.Context, id, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pack, ok := m.packs[packKey(ctx, id, version)]
+	if !ok {
+		return ErrPackNotFound
+	}
+	if pack.Status != PackStatusDraft {
+		return ErrPackImmutable
+	}
+	delete(m.packs, packKey(ctx, id, version))
+	return nil
+}
+
+// seedPacks publishes the packs the registry ships with (docs/PACKS) to the
+// context's tenant unless the store already holds them
+func seedPacks(ctx context.Context, store PackStore, summaries []PackSummary, policies map[string][]byte) error {
+	now := time.Now().UTC()
+	for _, summary := range summaries {
+		pack := StoredPack{
+			PublishedPack: PublishedPack{PackSummary: summary},
+			Status:        PackStatusPublished,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			PublishedAt:   &now,
+		}
+		if raw, ok := policies[pack.Ref()]; ok {
+			var policy PackPolicy
+			if err := yaml.Unmarshal(raw, &policy); err != nil {
+				return fmt.Errorf("pack %s: %w", pack.Ref(), err)
+			}
+			pack.Rules, pack.Freshness, pack.Match = policy.Rules, policy.Freshness, policy.Match
+		}
+		if err := validatePack(pack.PublishedPack); err != nil {
+			return fmt.Errorf("pack %s: %w", pack.Ref(), err)
+		}
+		if err := store.Create(ctx, pack); err != nil && !errors.Is(err, ErrPackExists) {
+			return fmt.Errorf("pack %s: %w", pack.Ref(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// postgresPackStore keeps packs in Postgres
+type postgresPackStore struct {
+	db *sql.DB
+}
+
+// newPostgresPackStore uses the tables of the registry migrations
+func newPostgresPackStore(db *sql.DB) *postgresPackStore {
+	return &postgresPackStore{db: db}
+}
+
+func scanPack(row rowScanner) (StoredPack, error) {
+	var pack StoredPack
+	var document []byte
+	var workflow []byte
+	var publishedAt sql.NullTime
+	if err := row.Scan(&pack.Tenant, &pack.Status, &document, &pack.CreatedAt, &pack.UpdatedAt, &publishedAt, &workflow, &pack.Signature); err != nil {
+		return StoredPack{}, err
+	}
+	if err := json.Unmarshal(document, &pack.PublishedPack); err != nil {
+		return StoredPack{}, fmt.Errorf("decoding pack document: %w", err)
+	}
+	if workflow != nil {
+		if err := json.Unmarshal(workflow, &pack.Workflow); err != nil {
+			return StoredPack{}, fmt.Errorf("decoding pack workflow: %w", err)
+		}
+	}
+	if publishedAt.Valid {
+		at := publishedAt.Time.UTC()
+		pack.PublishedAt = &at
+	}
+	pack.CreatedAt, pack.UpdatedAt = pack.CreatedAt.UTC(), pack.UpdatedAt.UTC()
+	return pack, nil
+}
+
+const packColumns = `tenant, status, document, created_at, updated_at, published_at, workflow, signature`
+
+// encodePack splits a pack into its document and workflow columns
+func encodePack(pack StoredPack) (document, workflow []byte, err error) {
+	if document, err = json.Marshal(pack.PublishedPack); err != nil {
+		return nil, nil, err
+	}
+	if pack.Workflow != nil {
+		if workflow, err = json.Marshal(pack.Workflow); err != nil {
+			return nil, nil, err
+		}
+	}
+	return document, workflow, nil
+}
+
+func (p *postgresPackStore) List(ctx context.Context, filter PackFilter) ([]StoredPack, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT `+packColumns+` FROM packs WHERE tenant = $1 AND ($2 = '' OR id = $2) AND ($3 = '' OR status = $3)`,
+		tenant.FromContext(ctx).ID, filter.ID, filter.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var packs []StoredPack
+	for rows.Next() {
+		pack, err := scanPack(rows)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Jurisdiction and latest-version filtering need semver ordering
+	return filterPacks(packs, filter), nil
+}
+
+func (p *postgresPackStore) Get(ctx context.Context, id, version string) (StoredPack, error) {
+	pack, err := scanPack(p.db.QueryRowContext(ctx,
+		`SELECT `+packColumns+` FROM packs WHERE tenant = $1 AND id = $2 AND version = $3`, tenant.FromContext(ctx).ID, id, version))
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredPack{}, ErrPackNotFound
+	}
+	return pack, err
+}
+
+func (p *postgresPackStore) Create(ctx context.Context, pack StoredPack) error {
+	pack.Tenant = tenant.FromContext(ctx).ID
+	document, workflow, err := encodePack(pack)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO packs (tenant, id, version, status, document, created_at, updated_at, published_at, workflow, signature)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		pack.Tenant, pack.ID, pack.Version, pack.Status, document, pack.CreatedAt, pack.UpdatedAt, nullTime(pack.PublishedAt), workflow, pack.Signature)
+	if store.IsUniqueViolation(err) {
+		return ErrPackExists
+	}
+	return err
+}
+
+// Update locks the row for the duration of fn, so concurrent edits and
+// lifecycle transitions serialize
+func (p *postgresPackStore) Update(ctx context.Context, id, version string, fn func(*StoredPack) error) (StoredPack, error) {
+	tenantID := tenant.FromContext(ctx).ID
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StoredPack{}, err
+	}
+	defer tx.Rollback()
+
+	pack, err := scanPack(tx.QueryRowContext(ctx,
+		`SELECT `+packColumns+` FROM packs WHERE tenant = $1 AND id = $2 AND version = $3 FOR UPDATE`, tenantID, id, version))
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredPack{}, ErrPackNotFound
+	}
+	if err != nil {
+		return StoredPack{}, err
+	}
+	if err := fn(&pack); err != nil {
+		return StoredPack{}, err
+	}
+	document, workflow, err := encodePack(pack)
+	if err != nil {
+		return StoredPack{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE packs SET status = $4, document = $5, updated_at = $6, published_at = $7, workflow = $8, signature = $9
+		 WHERE tenant = $1 AND id = $2 AND version = $3`,
+		tenantID, id, version, pack.Status, document, pack.UpdatedAt, nullTime(pack.PublishedAt), workflow, pack.Signature); err != nil {
+		return StoredPack{}, err
+	}
+	return pack, tx.Commit()
+}
+
+func (p *postgresPackStore) Delete(ctx context.Context, id, version string) error {
+	result, err := p.db.ExecContext(ctx,
+		`DELETE FROM packs WHERE tenant = $1 AND id = $2 AND version = $3 AND status = $4`, tenant.FromContext(ctx).ID, id, version, PackStatusDraft)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted > 0 {
+		return err
+	}
+	// Nothing deleted: tell a missing pack from one past the draft stage
+	if _, err := p.Get(ctx, id, version); err != nil {
+		return err
+	}
+	return ErrPackImmutable
+}
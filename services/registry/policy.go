@@ -0,0 +1,166 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// policyFiles holds the rule sets verifiers evaluate for each pack
+//
+//go:embed policies/*.yaml
+var policyFiles embed.FS
+
+// PackPolicy is a pack's declarative rule set, e.g. `age >= 18`
+type PackPolicy struct {
+	Pack      string           `yaml:"pack"` // pack id including @version
+	Rules     []PolicyRule     `yaml:"rules"`
+	Freshness *FreshnessPolicy `yaml:"freshness,omitempty"`
+	Match     []MatchRule      `yaml:"match,omitempty"`
+}
+
+// MatchRule requires claims to agree across the credentials of a
+// multi-credential bundle, e.g. the names on an identity credential and a
+// background check
+type MatchRule struct {
+	ID          string   `yaml:"id" json:"id"`
+	Claims      []string `yaml:"claims" json:"claims"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Required    *bool    `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// FreshnessPolicy bounds how old the evidence behind a presentation may be,
+// as Go durations (e.g. 2160h); verifiers report each limit exceeded
+type FreshnessPolicy struct {
+	MaxCredentialAge   string `yaml:"maxCredentialAge,omitempty" json:"maxCredentialAge,omitempty"`
+	MaxVerificationAge string `yaml:"maxVerificationAge,omitempty" json:"maxVerificationAge,omitempty"`
+	MaxClockSkew       string `yaml:"maxClockSkew,omitempty" json:"maxClockSkew,omitempty"`
+}
+
+func (f FreshnessPolicy) validate() error {
+	for name, value := range map[string]string{
+		"maxCredentialAge":   f.MaxCredentialAge,
+		"maxVerificationAge": f.MaxVerificationAge,
+		"maxClockSkew":       f.MaxClockSkew,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("freshness %s: %q is not a positive duration", name, value)
+		}
+	}
+	return nil
+}
+
+type PolicyRule struct {
+	ID          string `yaml:"id" json:"id"`
+	Expr        string `yaml:"expr" json:"expr"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	Required    *bool  `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// PublishedPack is a pack together with the rules verifiers evaluate for it,
+// as served at GET /packs
+type PublishedPack struct {
+	PackSummary
+	// Kind is "library" for shared predicate libraries, empty for packs
+	Kind         string           `json:"kind,omitempty"`
+	Rules        []PolicyRule     `json:"rules"`
+	Freshness    *FreshnessPolicy `json:"freshness,omitempty"`
+	Match        []MatchRule      `json:"match,omitempty"`
+	Dependencies []PackDependency `json:"dependencies,omitempty"`
+	// Includes pins the dependency graph (id@version, dependencies first);
+	// the registry resolves it when the pack is published
+	Includes []string `json:"includes,omitempty"`
+	// Provenance is set on packs imported from a federation peer
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// loadPackPolicies indexes the embedded policy documents by pack id, keeping
+// the YAML as authored so comments survive distribution
+func loadPackPolicies() (map[string][]byte, error) {
+	entries, err := policyFiles.ReadDir("policies")
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		raw, err := policyFiles.ReadFile(path.Join("policies", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var policy PackPolicy
+		if err := yaml.Unmarshal(raw, &policy); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if policy.Pack == "" || len(policy.Rules) == 0 {
+			return nil, fmt.Errorf("%s: policy needs a pack id and at least one rule", entry.Name())
+		}
+		if policy.Freshness != nil {
+			if err := policy.Freshness.validate(); err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+		}
+		for _, match := range policy.Match {
+			if match.ID == "" || len(match.Claims) == 0 {
+				return nil, fmt.Errorf("%s: match rules need an id and at least one claim", entry.Name())
+			}
+		}
+		if _, dup := policies[policy.Pack]; dup {
+			return nil, fmt.Errorf("%s: duplicate policy for %s", entry.Name(), policy.Pack)
+		}
+		policies[policy.Pack] = raw
+	}
+	return policies, nil
+}
+
+// Policy returns the YAML rule set for a versioned pack id
+func (c *Catalog) Policy(packID string) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	policy, ok := c.policies[packID]
+	return policy, ok
+}
+
+// handlePackPolicy serves a published pack's rules as YAML: the authored
+// document for the packs the registry ships with, else one rendered from the
+// stored pack flattened with its dependencies
+func (s *Server) handlePackPolicy(w http.ResponseWriter, r *http.Request) {
+	packID := chi.URLParam(r, "id")
+	policy, ok := s.catalog.Policy(packID)
+	if !ok {
+		id, version, _ := strings.Cut(packID, "@")
+		pack, err := s.packs.Get(r.Context(), id, version)
+		if err != nil || pack.Status != PackStatusPublished {
+			problem.Error(w, r, "Pack policy not found", http.StatusNotFound)
+			return
+		}
+		resolved, err := flattenPack(r.Context(), s.packs, pack.PublishedPack)
+		if err != nil {
+			writePackStoreError(w, r, err)
+			return
+		}
+		if policy, err = yaml.Marshal(PackPolicy{Pack: packID, Rules: resolved.Rules, Freshness: resolved.Freshness, Match: resolved.Match}); err != nil {
+			log.Error().Err(err).Str("pack_id", packID).Msg("Failed to render pack policy")
+			problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Info().Str("pack_id", packID).Msg("Pack policy requested")
+	if notModified(w, r, cacheValidators{ETag: strongETag(policy)}, cacheRevalidate) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml")
+	if _, err := w.Write(policy); err != nil {
+		log.Error().Err(err).Msg("Failed to write pack policy response")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+// databaseSchema is the Postgres schema the registry keeps its tables in
+const databaseSchema = "registry"
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// openDatabase connects to the shared database and migrates the registry
+// schema; the pack, trust, audit, DID and bundle stores share its connection
+// pool
+func openDatabase(ctx context.Context, config store.Config) (*store.DB, error) {
+	db, err := store.Open(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.Migrate(ctx, migrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, migration := range applied {
+		log.Info().Str("schema", db.Schema()).Int("version", migration.Version).Str("name", migration.Name).Msg("Applied database migration")
+	}
+	return db, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
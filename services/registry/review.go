@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Reviewer decisions on a pack in review
+const (
+	PackReviewApprove = "approve"
+	PackReviewReject  = "reject"
+)
+
+// packSignatureType is the typ header of pack signatures
+const packSignatureType = "cachet-pack+jwt"
+
+// PackReviewRequest is the body of POST /packs/{ref}/review
+type PackReviewRequest struct {
+	Decision string `json:"decision"`
+	Comment  string `json:"comment,omitempty"` // required to reject
+}
+
+// PackSignatureClaims are signed on publish and in the policy manifest: the
+// pack reference and the digest of the pack document, includes pinned
+type PackSignatureClaims struct {
+	Digest string `json:"digest"`
+	jwt.RegisteredClaims
+}
+
+// packDigest hashes a pack document the way verifiers receive it in the
+// policy manifest, provenance, digest and signature aside. The document is
+// hashed with sorted keys, so verifiers can recompute it from the manifest.
+func packDigest(pack ManifestPack) (string, error) {
+	pack.Provenance = nil
+	pack.Digest, pack.Signature = "", ""
+	document, err := json.Marshal(pack)
+	if err != nil {
+		return "", err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return "", err
+	}
+	if document, err = json.Marshal(generic); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(document)
+	return "sha-256:" + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// signPackDigest signs the digest of the pack ref with the registry key
+func (s *Server) signPackDigest(ref, digest string, now time.Time) (string, error) {
+	return s.signer.SignTyped(packSignatureType, PackSignatureClaims{
+		Digest: digest,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   registryIssuer,
+			Subject:  ref,
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// signPack signs a pack being published with the registry key
+func (s *Server) signPack(pack StoredPack, now time.Time) (string, error) {
+	digest, err := packDigest(ManifestPack{PublishedPack: pack.PublishedPack})
+	if err != nil {
+		return "", err
+	}
+	return s.signPackDigest(pack.Ref(), digest, now)
+}
+
+// workflowOf copies a pack's review history, so changes made in a store
+// update do not leak into the stored pack if the update aborts
+func workflowOf(pack StoredPack) PackWorkflow {
+	if pack.Workflow == nil {
+		return PackWorkflow{}
+	}
+	workflow := *pack.Workflow
+	workflow.Reviews = slices.Clone(workflow.Reviews)
+	return workflow
+}
+
+// handleReviewPack records a reviewer's decision on a pack in review:
+// approve makes it publishable, reject sends it back to draft. Submitters
+// cannot review their own packs, except with the break-glass operator token.
+func (s *Server) handleReviewPack(w http.ResponseWriter, r *http.Request) {
+	id, version := splitPackRef(chi.URLParam(r, "ref"))
+	if version == "" {
+		problem.Error(w, r, "pack reference must be id@version", http.StatusBadRequest)
+		return
+	}
+	var req PackReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	status := PackStatusApproved
+	switch req.Decision {
+	case PackReviewApprove:
+	case PackReviewReject:
+		if strings.TrimSpace(req.Comment) == "" {
+			problem.Error(w, r, "a rejection needs a comment", http.StatusBadRequest)
+			return
+		}
+		status = PackStatusDraft
+	default:
+		problem.Error(w, r, "decision must be approve or reject", http.StatusBadRequest)
+		return
+	}
+
+	reviewer := principalFrom(r.Context())
+	now := time.Now().UTC()
+	pack, err := s.packs.Update(r.Context(), id, version, func(pack *StoredPack) error {
+		if pack.Status != PackStatusInReview {
+			return fmt.Errorf("%w: only packs in review can be reviewed, this one is %s", ErrPackImmutable, pack.Status)
+		}
+		workflow := workflowOf(*pack)
+		if workflow.SubmittedBy == reviewer.Subject && reviewer.Method != authMethodOperatorToken {
+			return ErrSelfReview
+		}
+		workflow.Reviews = append(workflow.Reviews, PackReview{
+			Reviewer:   reviewer.Subject,
+			Decision:   req.Decision,
+			Comment:    req.Comment,
+			ReviewedAt: now,
+		})
+		pack.Workflow = &workflow
+		return transitionPack(pack, status, now)
+	})
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("pack_id", pack.Ref()).Str("reviewer", reviewer.Subject).Str("decision", req.Decision).Msg("Pack reviewed")
+	writeJSON(w, http.StatusOK, pack)
+}
+
+// PackChangelog lists what changed in a pack between two versions
+type PackChangelog struct {
+	Pack    string       `json:"pack"`
+	From    string       `json:"from,omitempty"` // empty for a pack's first version
+	To      string       `json:"to"`
+	Changes []PackChange `json:"changes"`
+}
+
+// Changelog entry kinds
+const (
+	packChangeAdded   = "added"
+	packChangeRemoved = "removed"
+	packChangeChanged = "changed"
+)
+
+// PackChange is one difference between two versions of a pack. Path names
+// the field, e.g. purpose, freshness.maxCredentialAge or rules/age.ge.18.
+type PackChange struct {
+	Kind string      `json:"kind"`
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// diffPacks compares two versions of a pack field by field, and rules,
+// match rules and dependencies by id
+func diffPacks(from, to PublishedPack) []PackChange {
+	changes := []PackChange{}
+	field := func(path string, a, b interface{}, empty bool) {
+		switch {
+		case jsonEqual(a, b):
+		case empty:
+			changes = append(changes, PackChange{Kind: packChangeAdded, Path: path, To: b})
+		default:
+			changes = append(changes, PackChange{Kind: packChangeChanged, Path: path, From: a, To: b})
+		}
+	}
+	field("name", from.Name, to.Name, from.Name == "")
+	field("purpose", from.Purpose, to.Purpose, from.Purpose == "")
+	field("kind", from.Kind, to.Kind, from.Kind == "")
+	field("jurisdictions", from.Jurisdictions, to.Jurisdictions, len(from.Jurisdictions) == 0)
+	field("categories", from.Categories, to.Categories, len(from.Categories) == 0)
+	var fromFreshness, toFreshness FreshnessPolicy
+	if from.Freshness != nil {
+		fromFreshness = *from.Freshness
+	}
+	if to.Freshness != nil {
+		toFreshness = *to.Freshness
+	}
+	field("freshness.maxCredentialAge", fromFreshness.MaxCredentialAge, toFreshness.MaxCredentialAge, fromFreshness.MaxCredentialAge == "")
+	field("freshness.maxVerificationAge", fromFreshness.MaxVerificationAge, toFreshness.MaxVerificationAge, fromFreshness.MaxVerificationAge == "")
+	field("freshness.maxClockSkew", fromFreshness.MaxClockSkew, toFreshness.MaxClockSkew, fromFreshness.MaxClockSkew == "")
+
+	changes = append(changes, diffByID("rules", from.Rules, to.Rules, func(r PolicyRule) string { return r.ID })...)
+	changes = append(changes, diffByID("match", from.Match, to.Match, func(m MatchRule) string { return m.ID })...)
+	changes = append(changes, diffByID("dependencies", from.Dependencies, to.Dependencies, func(d PackDependency) string { return d.Pack })...)
+	field("includes", from.Includes, to.Includes, len(from.Includes) == 0)
+	// A field the new version leaves empty was removed
+	for i, change := range changes {
+		if change.Kind == packChangeChanged && isEmptyJSON(change.To) {
+			changes[i] = PackChange{Kind: packChangeRemoved, Path: change.Path, From: change.From}
+		}
+	}
+	return changes
+}
+
+// diffByID compares two lists keyed by id: entries in order of the new
+// version, then the ones it dropped
+func diffByID[T any](path string, from, to []T, id func(T) string) []PackChange {
+	var changes []PackChange
+	previous := map[string]T{}
+	for _, item := range from {
+		previous[id(item)] = item
+	}
+	kept := map[string]bool{}
+	for _, item := range to {
+		key := id(item)
+		kept[key] = true
+		old, ok := previous[key]
+		switch {
+		case !ok:
+			changes = append(changes, PackChange{Kind: packChangeAdded, Path: path + "/" + key, To: item})
+		case !jsonEqual(old, item):
+			changes = append(changes, PackChange{Kind: packChangeChanged, Path: path + "/" + key, From: old, To: item})
+		}
+	}
+	for _, item := range from {
+		if key := id(item); !kept[key] {
+			changes = append(changes, PackChange{Kind: packChangeRemoved, Path: path + "/" + key, From: item})
+		}
+	}
+	return changes
+}
+
+// jsonEqual compares values as they are served, so a nil and an empty list
+// are the same
+func jsonEqual(a, b interface{}) bool {
+	if isEmptyJSON(a) && isEmptyJSON(b) {
+		return true
+	}
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+func isEmptyJSON(v interface{}) bool {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	switch string(raw) {
+	case `""`, "null", "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// handlePackChangelog diffs two versions of a pack: ?to= defaults to the
+// latest published version, ?from= to the published or retired version
+// before it. Admins may diff unpublished versions, e.g. a draft in review
+// against what is live.
+func (s *Server) handlePackChangelog(w http.ResponseWriter, r *http.Request) {
+	id, version := splitPackRef(chi.URLParam(r, "ref"))
+	if version != "" {
+		problem.Error(w, r, "use a bare pack id, with ?from= and ?to= versions", http.StatusBadRequest)
+		return
+	}
+	versions, err := s.packs.List(r.Context(), PackFilter{ID: id})
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	admin := s.authorizeRole(r, RoleReadOnly)
+	visible := versions[:0]
+	for _, pack := range versions {
+		if admin || !pack.unpublished() {
+			visible = append(visible, pack)
+		}
+	}
+	find := func(version string) (int, bool) {
+		for i, pack := range visible {
+			if pack.Version == version {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	query := r.URL.Query()
+	to := -1
+	if v := query.Get("to"); v != "" {
+		i, ok := find(v)
+		if !ok {
+			writePackStoreError(w, r, ErrPackNotFound)
+			return
+		}
+		to = i
+	} else {
+		for i, pack := range visible {
+			if pack.Status == PackStatusPublished {
+				to = i
+			}
+		}
+		if to < 0 {
+			writePackStoreError(w, r, ErrPackNotFound)
+			return
+		}
+	}
+	var from *StoredPack
+	if v := query.Get("from"); v != "" {
+		i, ok := find(v)
+		if !ok {
+			writePackStoreError(w, r, ErrPackNotFound)
+			return
+		}
+		from = &visible[i]
+	} else {
+		// visible is sorted by version precedence
+		for i := to - 1; i >= 0; i-- {
+			if !visible[i].unpublished() {
+				from = &visible[i]
+				break
+			}
+		}
+	}
+
+	target := visible[to]
+	changelog := PackChangelog{Pack: id, To: target.Version}
+	lastModified := target.UpdatedAt
+	if from != nil {
+		changelog.From = from.Version
+		changelog.Changes = diffPacks(from.PublishedPack, target.PublishedPack)
+		if from.UpdatedAt.After(lastModified) {
+			lastModified = from.UpdatedAt
+		}
+	} else {
+		changelog.Changes = diffPacks(PublishedPack{}, target.PublishedPack)
+	}
+	log.Info().Str("pack_id", id).Str("from", changelog.From).Str("to", changelog.To).Int("change_count", len(changelog.Changes)).Msg("Pack changelog requested")
+	writeCachedJSON(w, r, changelog, lastModified, cacheRevalidate)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func packChangelog(t *testing.T, server *Server, path, token string) PackChangelog {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, path, token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var changelog PackChangelog
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &changelog))
+	return changelog
+}
+
+func TestPackReview_FourEyes(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	server := newOIDCServer(provider)
+	alice := provider.token(t, "alice", RolePackAuthor, RolePackReviewer)
+	bob := provider.token(t, "bob", RolePackReviewer)
+	review := func(token, decision, comment string) int {
+		return packRequest(t, server, http.MethodPost, "/packs/pack.tenant.ready@1.0.0/review", token, PackReviewRequest{Decision: decision, Comment: comment}).Code
+	}
+	status := func(s string) PackUpdate { return PackUpdate{Status: s} }
+
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", alice, tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusConflict, review(bob, PackReviewApprove, ""), "drafts must be submitted first")
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, status(PackStatusApproved)).Code)
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, status(PackStatusInReview)).Code)
+
+	// Packs in review are frozen, and their authors cannot approve them
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, PackUpdate{PublishedPack: tenantPack("1.0.0")}).Code)
+	assert.Equal(t, http.StatusForbidden, review(alice, PackReviewApprove, ""))
+	assert.Equal(t, http.StatusForbidden, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", bob, status(PackStatusPublished)).Code, "reviewers do not publish")
+	assert.Equal(t, http.StatusBadRequest, review(bob, PackReviewReject, ""), "rejections explain themselves")
+	assert.Equal(t, http.StatusBadRequest, review(bob, "maybe", ""))
+
+	// A rejection sends the pack back to its author
+	require.Equal(t, http.StatusOK, review(bob, PackReviewReject, "tenants need an age check"))
+	edited := tenantPack("1.0.0")
+	edited.Rules = append(edited.Rules, PolicyRule{ID: "age.ge.18", Expr: "age >= 18"})
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, PackUpdate{PublishedPack: edited}).Code)
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, status(PackStatusInReview)).Code)
+	require.Equal(t, http.StatusOK, review(bob, PackReviewApprove, "lgtm"))
+
+	w := packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", alice, status(PackStatusPublished))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var pack StoredPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pack))
+	require.NotNil(t, pack.Workflow)
+	assert.Equal(t, "alice", pack.Workflow.SubmittedBy)
+	require.Len(t, pack.Workflow.Reviews, 2)
+	assert.Equal(t, PackReview{Reviewer: "bob", Decision: PackReviewReject, Comment: "tenants need an age check"},
+		PackReview{Reviewer: pack.Workflow.Reviews[0].Reviewer, Decision: pack.Workflow.Reviews[0].Decision, Comment: pack.Workflow.Reviews[0].Comment})
+	assert.Equal(t, PackReviewApprove, pack.Workflow.Reviews[1].Decision)
+
+	// The signature covers the pack exactly as verifiers receive it
+	var claims PackSignatureClaims
+	token, err := jwt.ParseWithClaims(pack.Signature, &claims, func(*jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, packSignatureType, token.Header["typ"])
+	assert.Equal(t, "pack.tenant.ready@1.0.0", claims.Subject)
+	listed := listPacks(t, server, "?id=pack.tenant.ready", "")
+	require.Len(t, listed, 1)
+	digest, err := packDigest(ManifestPack{PublishedPack: listed[0].PublishedPack})
+	require.NoError(t, err)
+	assert.Equal(t, digest, claims.Digest)
+
+	audited := 0
+	for _, event := range auditEvents(t, server, "?actor=bob") {
+		if event.Path == "/packs/pack.tenant.ready@1.0.0/review" && event.Outcome == auditOutcomeSuccess {
+			audited++
+		}
+	}
+	assert.Equal(t, 2, audited, "review decisions are audited")
+}
+
+func TestPackChangelog(t *testing.T) {
+	server := newAdminServer()
+	require.Equal(t, http.StatusOK, publishPack(t, server, tenantPack("1.0.0")).Code)
+	next := tenantPack("1.1.0")
+	next.Purpose = "Screen tenants"
+	next.Rules[0].Expr = "identity_liveness == true && document_valid == true"
+	next.Rules = append(next.Rules, PolicyRule{ID: "age.ge.18", Expr: "age >= 18"})
+	next.Freshness = &FreshnessPolicy{MaxCredentialAge: "2160h"}
+	next.Jurisdictions = nil
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, next).Code)
+
+	// Reviewers compare a draft with what is live
+	changelog := packChangelog(t, server, "/packs/pack.tenant.ready/changelog?to=1.1.0", testOperatorToken)
+	assert.Equal(t, "1.0.0", changelog.From)
+	kinds := map[string]string{}
+	for _, change := range changelog.Changes {
+		kinds[change.Path] = change.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"purpose":                    packChangeAdded,
+		"jurisdictions":              packChangeRemoved,
+		"freshness.maxCredentialAge": packChangeAdded,
+		"rules/identity.verified":    packChangeChanged,
+		"rules/age.ge.18":            packChangeAdded,
+	}, kinds)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready/changelog?to=1.1.0", "", nil).Code, "drafts are not public")
+
+	// Once published, it is the default; retired versions stay retrievable
+	approvePack(t, server, "pack.tenant.ready@1.1.0")
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.1.0", testOperatorToken, PackUpdate{Status: PackStatusPublished}).Code)
+	require.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, PackUpdate{Status: PackStatusRetired}).Code)
+	changelog = packChangelog(t, server, "/packs/pack.tenant.ready/changelog", "")
+	assert.Equal(t, "1.0.0", changelog.From)
+	assert.Equal(t, "1.1.0", changelog.To)
+	assert.Len(t, changelog.Changes, 5)
+	w := packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var retired StoredPack
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &retired))
+	assert.Equal(t, tenantPack("1.0.0").Rules, retired.Rules)
+
+	// A first version diffs against nothing
+	changelog = packChangelog(t, server, "/packs/pack.tenant.ready/changelog?to=1.0.0", "")
+	assert.Empty(t, changelog.From)
+	assert.Equal(t, packChangeAdded, changelog.Changes[0].Kind)
+
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0/changelog", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready/changelog?from=0.9.0", "", nil).Code)
+}
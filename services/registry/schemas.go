@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaFiles holds the JSON Schemas of credential subjects, one file per
+// credential type and version, named type@version.json
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// schemaVersionLatest addresses the highest version of a credential type
+const schemaVersionLatest = "latest"
+
+// maxValidationDocument bounds the documents POST .../validate accepts
+const maxValidationDocument = 1 << 20
+
+// CredentialSchema describes one hosted schema version
+type CredentialSchema struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+
+	raw      []byte
+	compiled *jsonschema.Schema
+}
+
+// SchemaViolation is one reason a document does not match its schema
+type SchemaViolation struct {
+	Path    string `json:"path"` // JSON pointer into the document
+	Message string `json:"message"`
+}
+
+// SchemaValidation is the answer to POST /schemas/{type}/{version}/validate
+type SchemaValidation struct {
+	Type       string            `json:"type"`
+	Version    string            `json:"version"`
+	Valid      bool              `json:"valid"`
+	Violations []SchemaViolation `json:"violations,omitempty"`
+}
+
+// schemaRegistry indexes the embedded schemas by credential type, ordered
+// by version
+type schemaRegistry struct {
+	byType map[string][]*CredentialSchema
+}
+
+// loadSchemas compiles every embedded schema so a broken one fails startup
+func loadSchemas() (*schemaRegistry, error) {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		return nil, err
+	}
+	registry := &schemaRegistry{byType: make(map[string][]*CredentialSchema)}
+	for _, entry := range entries {
+		credentialType, version, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".json"), "@")
+		if !ok || credentialType == "" {
+			return nil, fmt.Errorf("%s: schema files are named type@version.json", entry.Name())
+		}
+		if _, err := parseSemver(version); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		raw, err := schemaFiles.ReadFile(path.Join("schemas", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		compiled, err := compileSchema(entry.Name(), raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		registry.byType[credentialType] = append(registry.byType[credentialType], &CredentialSchema{
+			Type:     credentialType,
+			Version:  version,
+			URL:      "/schemas/" + credentialType + "/" + version,
+			raw:      raw,
+			compiled: compiled,
+		})
+	}
+	for _, versions := range registry.byType {
+		sort.Slice(versions, func(i, j int) bool {
+			return compareVersions(versions[i].Version, versions[j].Version) < 0
+		})
+	}
+	return registry, nil
+}
+
+// compileSchema compiles a schema without following remote references, so
+// validation never reaches out to the network
+func compileSchema(name string, raw []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema references %s, which is not hosted by the registry", url)
+	}
+	if err := compiler.AddResource(name, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(name)
+}
+
+// List returns every hosted schema, by type then version
+func (r *schemaRegistry) List() []*CredentialSchema {
+	var schemas []*CredentialSchema
+	for _, versions := range r.byType {
+		schemas = append(schemas, versions...)
+	}
+	sort.SliceStable(schemas, func(i, j int) bool { return schemas[i].Type < schemas[j].Type })
+	return schemas
+}
+
+// Lookup finds a schema version, or the highest one for "latest"
+func (r *schemaRegistry) Lookup(credentialType, version string) (*CredentialSchema, bool) {
+	versions := r.byType[credentialType]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	if version == schemaVersionLatest {
+		return versions[len(versions)-1], true
+	}
+	for _, schema := range versions {
+		if schema.Version == version {
+			return schema, true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks a decoded JSON document against the schema
+func (c *CredentialSchema) Validate(document interface{}) SchemaValidation {
+	result := SchemaValidation{Type: c.Type, Version: c.Version, Valid: true}
+	err := c.compiled.Validate(document)
+	if err == nil {
+		return result
+	}
+	result.Valid = false
+	var invalid *jsonschema.ValidationError
+	if !errors.As(err, &invalid) {
+		result.Violations = []SchemaViolation{{Message: err.Error()}}
+		return result
+	}
+	result.Violations = schemaViolations(invalid)
+	return result
+}
+
+// schemaViolations flattens a validation error tree into its leaves, the
+// failures a caller can act on
+func schemaViolations(err *jsonschema.ValidationError) []SchemaViolation {
+	if len(err.Causes) == 0 {
+		return []SchemaViolation{{Path: err.InstanceLocation, Message: err.Message}}
+	}
+	var violations []SchemaViolation
+	for _, cause := range err.Causes {
+		violations = append(violations, schemaViolations(cause)...)
+	}
+	return violations
+}
+
+func (s *Server) lookupSchema(w http.ResponseWriter, r *http.Request) (*CredentialSchema, bool) {
+	credentialType, version := chi.URLParam(r, "type"), chi.URLParam(r, "version")
+	schema, ok := s.schemas.Lookup(credentialType, version)
+	if !ok {
+		problem.Error(w, r, "Schema not found", http.StatusNotFound)
+	}
+	return schema, ok
+}
+
+// handleListSchemas lists the hosted credential schemas
+func (s *Server) handleListSchemas(w http.ResponseWriter, r *http.Request) {
+	writeCachedJSON(w, r, map[string]interface{}{"schemas": s.schemas.List()}, time.Time{}, cacheShort)
+}
+
+// handleGetSchema serves a schema as authored. Versions are immutable, so
+// only "latest" must be revalidated.
+func (s *Server) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	schema, ok := s.lookupSchema(w, r)
+	if !ok {
+		return
+	}
+	cacheControl := cacheImmutable
+	if chi.URLParam(r, "version") == schemaVersionLatest {
+		cacheControl = cacheShort
+		w.Header().Set("Content-Location", schema.URL)
+	}
+	if notModified(w, r, cacheValidators{ETag: strongETag(schema.raw)}, cacheControl) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	if _, err := w.Write(schema.raw); err != nil {
+		log.Error().Err(err).Msg("Failed to write schema response")
+	}
+}
+
+// handleValidateSchema validates a credential subject (or any document) for
+// the issuance gateway before signing and for wallets after receipt. A
+// document that does not match is still a 200 with valid=false.
+func (s *Server) handleValidateSchema(w http.ResponseWriter, r *http.Request) {
+	schema, ok := s.lookupSchema(w, r)
+	if !ok {
+		return
+	}
+	var document interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValidationDocument))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	result := schema.Validate(document)
+	log.Info().
+		Str("credential_type", schema.Type).
+		Str("schema_version", schema.Version).
+		Bool("valid", result.Valid).
+		Int("violation_count", len(result.Violations)).
+		Msg("Document validated against schema")
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validateDocument(t *testing.T, server *Server, path string, document interface{}) SchemaValidation {
+	t.Helper()
+	w := packRequest(t, server, http.MethodPost, path, "", document)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result SchemaValidation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+func TestSchemas_Hosted(t *testing.T) {
+	server := NewServer()
+
+	w := packRequest(t, server, http.MethodGet, "/schemas", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Schemas []CredentialSchema `json:"schemas"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Schemas, 2)
+	assert.Equal(t, "AgeOverCredential", list.Schemas[0].Type)
+	assert.Equal(t, "/schemas/IdentityCredential/1.0.0", list.Schemas[1].URL)
+
+	w = packRequest(t, server, http.MethodGet, "/schemas/IdentityCredential/1.0.0", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/schema+json", w.Header().Get("Content-Type"))
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &schema))
+	assert.Equal(t, "https://cachet.id/schemas/IdentityCredential/1.0.0", schema["$id"])
+
+	w = packRequest(t, server, http.MethodGet, "/schemas/IdentityCredential/latest", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/schemas/IdentityCredential/1.0.0", w.Header().Get("Content-Location"))
+
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/schemas/IdentityCredential/9.0.0", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/schemas/DiplomaCredential/1.0.0", "", nil).Code)
+}
+
+func TestSchemas_Validate(t *testing.T) {
+	server := NewServer()
+	subject := map[string]interface{}{
+		"id":                 "did:example:holder",
+		"personalData":       map[string]interface{}{"age": 34, "nationality": "GB", "documentType": "PASSPORT"},
+		"verificationLevel":  "gold",
+		"verified":           true,
+		"verificationMethod": "veriff",
+		"evidence":           []interface{}{map[string]interface{}{"type": "VeriffVerification"}},
+	}
+	result := validateDocument(t, server, "/schemas/IdentityCredential/1.0.0/validate", subject)
+	assert.True(t, result.Valid, result.Violations)
+	assert.Equal(t, "1.0.0", result.Version)
+
+	subject["personalData"] = map[string]interface{}{"age": 34.5, "nationality": "gb"}
+	subject["verificationLevel"] = "platinum"
+	result = validateDocument(t, server, "/schemas/IdentityCredential/latest/validate", subject)
+	assert.False(t, result.Valid)
+	paths := map[string]bool{}
+	for _, violation := range result.Violations {
+		paths[violation.Path] = true
+	}
+	assert.Equal(t, map[string]bool{
+		"/personalData/age":         true,
+		"/personalData/nationality": true,
+		"/verificationLevel":        true,
+	}, paths)
+
+	// Age predicates only: a name is not allowed on an AgeOverCredential
+	result = validateDocument(t, server, "/schemas/AgeOverCredential/1.0.0/validate", map[string]interface{}{
+		"verificationLevel": "standard", "age_over_18": true, "age_over_21": false,
+	})
+	assert.True(t, result.Valid, result.Violations)
+	result = validateDocument(t, server, "/schemas/AgeOverCredential/1.0.0/validate", map[string]interface{}{
+		"verificationLevel": "standard", "age_over_18": true, "given_name": "Alice",
+	})
+	assert.False(t, result.Valid)
+
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPost, "/schemas/AgeOverCredential/1.0.0/validate", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodPost, "/schemas/DiplomaCredential/1.0.0/validate", "", subject).Code)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// PackCategory is an entry of the category taxonomy packs are filed under
+type PackCategory struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+// packCategories is the taxonomy integrator portals and the wallet's pack
+// browser navigate by
+var packCategories = []PackCategory{
+	{ID: "identity", Label: "Identity and age"},
+	{ID: "marketplace", Label: "Marketplaces and commerce"},
+	{ID: "care", Label: "Care and childcare"},
+	{ID: "housing", Label: "Housing and rentals"},
+	{ID: "employment", Label: "Employment"},
+	{ID: "finance", Label: "Finance"},
+}
+
+func validCategory(id string) bool {
+	return slices.ContainsFunc(packCategories, func(c PackCategory) bool { return c.ID == id })
+}
+
+func categoryLabel(id string) string {
+	for _, category := range packCategories {
+		if category.ID == id {
+			return category.Label
+		}
+	}
+	return ""
+}
+
+// PackSearchResult is a pack matching a search, best matches first
+type PackSearchResult struct {
+	PackSummary
+	Score int `json:"score"`
+}
+
+// Search weights: a term in the name counts most, then the id or a category,
+// then the purpose
+const (
+	searchWeightName     = 3
+	searchWeightID       = 2
+	searchWeightCategory = 2
+	searchWeightPurpose  = 1
+)
+
+// searchTerms lowercases text and splits it into words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matchesTerm reports whether any word starts with term, so "sell" finds
+// "Seller"
+func matchesTerm(words []string, term string) bool {
+	return slices.ContainsFunc(words, func(word string) bool { return strings.HasPrefix(word, term) })
+}
+
+// scorePack ranks a pack against the query terms; every term must match
+// somewhere, and zero means no match
+func scorePack(pack PackSummary, terms []string) int {
+	name, id, purpose := searchTerms(pack.Name), searchTerms(pack.ID), searchTerms(pack.Purpose)
+	var categories []string
+	for _, category := range pack.Categories {
+		categories = append(categories, category)
+		categories = append(categories, searchTerms(categoryLabel(category))...)
+	}
+	score := 0
+	for _, term := range terms {
+		termScore := 0
+		if matchesTerm(name, term) {
+			termScore += searchWeightName
+		}
+		if matchesTerm(id, term) {
+			termScore += searchWeightID
+		}
+		if matchesTerm(categories, term) {
+			termScore += searchWeightCategory
+		}
+		if matchesTerm(purpose, term) {
+			termScore += searchWeightPurpose
+		}
+		if termScore == 0 {
+			return 0
+		}
+		score += termScore
+	}
+	return score
+}
+
+// handleSearchPacks searches the latest published version of each pack by
+// name, id, category and purpose, narrowed by category and jurisdiction.
+// Without q every pack passing the filters is listed, by id.
+func (s *Server) handleSearchPacks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	category := query.Get("category")
+	if category != "" && !validCategory(category) {
+		problem.Error(w, r, fmt.Sprintf("unknown category %q", category), http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			problem.Error(w, r, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	terms := searchTerms(query.Get("q"))
+
+	packs, err := s.packs.List(r.Context(), PackFilter{
+		Status:       PackStatusPublished,
+		Jurisdiction: query.Get("jurisdiction"),
+		Latest:       true,
+	})
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	results := []PackSearchResult{}
+	for _, pack := range packs {
+		if pack.Kind == PackKindLibrary || (category != "" && !slices.Contains(pack.Categories, category)) {
+			continue
+		}
+		score := 1
+		if len(terms) > 0 {
+			if score = scorePack(pack.PackSummary, terms); score == 0 {
+				continue
+			}
+		}
+		results = append(results, PackSearchResult{PackSummary: pack.PackSummary, Score: score})
+	}
+	// List sorts by id, so equal scores stay in id order
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	lastModified, err := s.packsLastModified(r)
+	if err != nil {
+		writePackStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("q", query.Get("q")).Str("category", category).Int("total", total).Msg("Packs searched")
+	writeCachedJSON(w, r, map[string]interface{}{"results": results, "total": total}, lastModified, cacheRevalidate)
+}
+
+// handleListPackCategories serves the category taxonomy
+func (s *Server) handleListPackCategories(w http.ResponseWriter, r *http.Request) {
+	writeCachedJSON(w, r, map[string]interface{}{"categories": packCategories}, time.Time{}, cacheShort)
+}
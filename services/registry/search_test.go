@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type searchResponse struct {
+	Results []PackSearchResult `json:"results"`
+	Total   int                `json:"total"`
+}
+
+func searchPacks(t *testing.T, server *Server, query string) searchResponse {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, "/packs/search"+query, "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp searchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func resultIDs(resp searchResponse) []string {
+	ids := []string{}
+	for _, result := range resp.Results {
+		ids = append(ids, result.ID+"@"+result.Version)
+	}
+	return ids
+}
+
+func TestSearchPacks(t *testing.T) {
+	server := newAdminServer()
+	tenancy := PublishedPack{
+		PackSummary: PackSummary{
+			ID: "pack.tenant.screening", Version: "1.0.0", Name: "Tenant Screening",
+			Purpose:       "Check renters before signing a lease, including seller-verified references",
+			Jurisdictions: []string{"UK"}, Categories: []string{"housing"},
+		},
+		Rules: []PolicyRule{{ID: "tenant.income", Expr: "income_verified == true"}},
+	}
+	require.Equal(t, http.StatusOK, publishPack(t, server, tenancy).Code)
+	require.Equal(t, http.StatusOK, publishPack(t, server, identityLibrary("1.0.0")).Code)
+	tenancy.Version = "1.1.0"
+	require.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenancy).Code)
+
+	// Name matches outrank purpose matches, and words match by prefix
+	resp := searchPacks(t, server, "?q=Sell")
+	assert.Equal(t, []string{"pack.safe.seller@0.1.0", "pack.tenant.screening@1.0.0"}, resultIDs(resp))
+	assert.Greater(t, resp.Results[0].Score, resp.Results[1].Score)
+
+	// Every word must match, drafts and libraries are not listed
+	assert.Equal(t, []string{"pack.tenant.screening@1.0.0"}, resultIDs(searchPacks(t, server, "?q=tenant+lease")))
+	assert.Empty(t, searchPacks(t, server, "?q=tenant+childcare").Results)
+	assert.Empty(t, searchPacks(t, server, "?q=identity").Results)
+
+	// Category labels are searchable, and filters narrow the results
+	assert.Equal(t, []string{"pack.tenant.screening@1.0.0"}, resultIDs(searchPacks(t, server, "?q=rentals")))
+	assert.Equal(t, []string{"pack.childcare.readiness@0.1.0"}, resultIDs(searchPacks(t, server, "?category=care")))
+	assert.Equal(t, []string{"pack.tenant.screening@1.0.0"}, resultIDs(searchPacks(t, server, "?jurisdiction=UK")))
+	assert.Empty(t, searchPacks(t, server, "?q=seller&category=housing&jurisdiction=EU").Results)
+
+	resp = searchPacks(t, server, "?limit=2")
+	assert.Equal(t, 3, resp.Total)
+	assert.Equal(t, []string{"pack.childcare.readiness@0.1.0", "pack.safe.seller@0.1.0"}, resultIDs(resp))
+
+	for _, query := range []string{"?category=gaming", "?limit=0", "?limit=101", "?limit=ten"} {
+		assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodGet, "/packs/search"+query, "", nil).Code, query)
+	}
+}
+
+func TestPackCategories(t *testing.T) {
+	server := newAdminServer()
+	w := packRequest(t, server, http.MethodGet, "/packs/categories", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Categories []PackCategory `json:"categories"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, packCategories, resp.Categories)
+
+	pack := sellerPack("1.0.0")
+	pack.Categories = []string{"marketplace", "gaming"}
+	w = packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, pack)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, decodeProblem(t, w).Detail, `unknown category "gaming"`)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version (semver.org), e.g. 1.4.0-rc.1
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+func parseSemver(v string) (semver, error) {
+	core, prerelease, hasPrerelease := strings.Cut(strings.SplitN(v, "+", 2)[0], "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, fmt.Errorf("version %q is not MAJOR.MINOR.PATCH", v)
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (len(part) > 1 && part[0] == '0') {
+			return semver{}, fmt.Errorf("version %q has an invalid number %q", v, part)
+		}
+		numbers[i] = n
+	}
+	parsed := semver{major: numbers[0], minor: numbers[1], patch: numbers[2]}
+	if hasPrerelease {
+		parsed.prerelease = strings.Split(prerelease, ".")
+		for _, identifier := range parsed.prerelease {
+			if identifier == "" {
+				return semver{}, fmt.Errorf("version %q has an empty pre-release identifier", v)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// compare orders versions by precedence: -1, 0 or 1. Pre-releases come before
+// the release they precede.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		an, aErr := strconv.Atoi(a)
+		bn, bErr := strconv.Atoi(b)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aErr == nil: // numeric identifiers sort first
+			return -1
+		case bErr == nil:
+			return 1
+		case a != b:
+			return strings.Compare(a, b)
+		}
+	}
+	return sign(len(v.prerelease) - len(o.prerelease))
+}
+
+// compareVersions orders two version strings, sorting invalid ones first
+func compareVersions(a, b string) int {
+	va, errA := parseSemver(a)
+	vb, errB := parseSemver(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.compare(vb)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// versionConstraint is a dependency's version requirement: an exact version,
+// ^1.2.3 (same major, or same minor below 1.0.0) or ~1.2.3 (same minor), at
+// or above the base version. Ranges never match pre-releases.
+type versionConstraint struct {
+	op   byte // 0 for an exact version, '^' or '~'
+	base semver
+}
+
+func parseConstraint(c string) (versionConstraint, error) {
+	var constraint versionConstraint
+	if strings.HasPrefix(c, "^") || strings.HasPrefix(c, "~") {
+		constraint.op, c = c[0], c[1:]
+	}
+	base, err := parseSemver(c)
+	if err != nil {
+		return versionConstraint{}, err
+	}
+	constraint.base = base
+	return constraint, nil
+}
+
+func (c versionConstraint) allows(v semver) bool {
+	if c.op == 0 {
+		return v.compare(c.base) == 0
+	}
+	if len(v.prerelease) > 0 || v.compare(c.base) < 0 {
+		return false
+	}
+	switch {
+	case c.op == '~':
+		return v.major == c.base.major && v.minor == c.base.minor
+	case c.base.major > 0:
+		return v.major == c.base.major
+	case c.base.minor > 0:
+		return v.major == 0 && v.minor == c.base.minor
+	}
+	return v.major == 0 && v.minor == 0 && v.patch == c.base.patch
+}
@@ -1,26 +1,98 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"net/http"
 	"time"
 
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog/log"
 )
 
-const policyManifest = `id: policy.cachet.manifest
-version: 0.1.0
-issuedAt: 2025-08-31T00:00:00Z
-signingDid: did:web:cachet.id#keys-1`
-
 type Server struct {
-	router *chi.Mux
+	router  *chi.Mux
+	signer  *signing.Signer
+	catalog *Catalog
+	bundles BundleStore
+	packs   PackStore
+	trust   TrustStore
+	schemas *schemaRegistry
+	// federation pulls packs and trust entries from peer registries; nil
+	// unless FEDERATION_CONFIG is set
+	federation *federation
+	// operatorToken is a break-glass credential holding every admin role;
+	// empty disables it
+	operatorToken string
+	// adminTokens verifies OIDC access tokens for the admin APIs; nil unless
+	// ADMIN_OIDC_ISSUER is set
+	adminTokens *adminTokenVerifier
+	audit       AuditStore
+	// security keeps the tamper-evident trail of auth failures, admin
+	// calls, key rotations and revocations; nil records nothing
+	security *audit.Logger
+	// dids holds the did:web identifiers the registry hosts documents for
+	dids DIDStore
+	// health checks the Postgres pool behind the stores, when they are not
+	// kept in memory
+	health  *health.Monitor
+	metrics *metrics.Metrics
+	// cors lets the configured origins call the API from browsers
+	cors cors.Policy
+	// versions serves the API under /v1 and its legacy unversioned aliases
+	versions apiversion.Policy
+	// openapi refuses requests that do not match the API document
+	openapi *openapi.Validator
+	// tenants resolves requests to the tenants served, whose packs are
+	// stored apart
+	tenants tenant.Directory
 }
 
 func NewServer() *Server {
+	catalog := defaultCatalog()
+	packs := newMemoryPackStore()
+	if err := seedPacks(context.Background(), packs, builtinPacks(), catalog.policies); err != nil {
+		log.Fatal().Err(err).Msg("Failed to seed built-in packs")
+	}
+	trust := newMemoryTrustStore()
+	if err := seedTrust(context.Background(), trust, builtinTrustedIssuers()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to seed built-in trusted issuers")
+	}
+	dids := newMemoryDIDStore()
+	if err := seedPlatformDID(context.Background(), dids); err != nil {
+		log.Fatal().Err(err).Msg("Failed to seed the platform DID")
+	}
+	schemas, err := loadSchemas()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load credential schemas")
+	}
 	s := &Server{
-		router: chi.NewRouter(),
+		router:  chi.NewRouter(),
+		signer:  newSigner(),
+		catalog: catalog,
+		bundles: newMemoryBundleStore(),
+		packs:   packs,
+		trust:   trust,
+		schemas: schemas,
+		audit:   newMemoryAuditStore(),
+		dids:    dids,
+		health:  health.New("registry"),
+		metrics: metrics.New("registry"),
+	}
+	if s.openapi, err = openapi.New(openapiDocument); err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
 	}
 	s.setupMiddleware()
 	s.setupRoutes()
@@ -28,36 +100,106 @@ func NewServer() *Server {
 }
 
 func (s *Server) setupMiddleware() {
+	s.router.Use(tracing.Middleware("registry"))
+	s.router.Use(s.metrics.Middleware)
 	s.router.Use(middleware.RequestID)
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
+	s.router.Use(s.tenants.Middleware)
+	s.router.Use(s.cors.Middleware)
+	s.router.Use(s.versions.Middleware)
+	s.router.Use(s.openapi.Middleware)
+	s.router.Use(deadline.Middleware(deadline.BudgetFromEnv()))
 }
 
 func (s *Server) setupRoutes() {
+	s.router.NotFound(problem.NotFound)
+	s.router.MethodNotAllowed(problem.MethodNotAllowed)
 	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	s.router.Get("/health", s.handleHealth)
+	s.router.Get("/health", s.health.Health)
+	s.router.Get("/livez", s.health.Live)
+	s.router.Get("/readyz", s.health.Ready)
+	s.router.Handle("/debug/vars", expvar.Handler())
+	s.router.Handle("/metrics", s.metrics.Handler())
 	s.router.Get("/policy/manifest", s.handlePolicyManifest)
-}
+	s.router.Get("/packs", s.handleListPacks)
+	s.router.Get("/packs/changes", s.handleListPackChanges)
+	s.router.Get("/packs/search", s.handleSearchPacks)
+	s.router.Get("/packs/categories", s.handleListPackCategories)
+	s.router.Get("/packs/{ref}", s.handleGetPack)
+	s.router.Get("/packs/{ref}/resolved", s.handleGetResolvedPack)
+	s.router.Get("/packs/{ref}/changelog", s.handlePackChangelog)
+	s.router.Get("/packs/{id}/policy", s.handlePackPolicy)
+	s.router.Get("/trusted-issuers", s.handleTrustedIssuers)
+	s.router.Get("/trust/issuers", s.handleListIssuers)
+	s.router.Get("/trust/issuers/{did}", s.handleGetIssuer)
+	s.router.Get("/trust/verifiers", s.handleListVerifiers)
+	s.router.Get("/trust/verifiers/{did}", s.handleGetVerifier)
+	s.router.Get("/trust/manifest", s.handleTrustManifest)
+	s.router.Get("/.well-known/jwks.json", s.handleJWKS)
 
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	log.Debug().Msg("Health check requested")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("ok")); err != nil {
-		log.Error().Err(err).Msg("Failed to write health check response")
-	}
-}
+	// did:web documents for the platform and hosted issuer DIDs, and the
+	// schemas issued credentials name, are unversioned as resolvers and
+	// credentials find them
+	s.versions.Unversioned("/dids/*/did.json", "/schemas/*/*")
+	s.router.Get("/.well-known/did.json", s.handleDIDDocument)
+	s.router.Get("/did/keys", s.handleListDIDKeys)
+	s.router.Get("/dids", s.handleListDIDs)
+	s.router.Get("/dids/{name}/did.json", s.handleDIDDocument)
+	s.router.Get("/dids/{name}/keys", s.handleListDIDKeys)
 
-func (s *Server) handlePolicyManifest(w http.ResponseWriter, r *http.Request) {
-	log.Info().Msg("Policy manifest requested")
-	w.Header().Set("Content-Type", "text/yaml")
-	if _, err := w.Write([]byte(policyManifest)); err != nil {
-		log.Error().Err(err).Msg("Failed to write policy manifest response")
-	}
+	// Credential subject schemas
+	s.router.Get("/schemas", s.handleListSchemas)
+	s.router.Get("/schemas/{type}/{version}", s.handleGetSchema)
+	s.router.Post("/schemas/{type}/{version}/validate", s.handleValidateSchema)
+
+	// Signed configuration bundles for wallet releases, compiled by trust
+	// admins
+	s.router.Get("/bundles/{version}", s.handleGetBundle)
+	s.router.Get("/bundles/{version}/delta", s.handleGetBundleDelta)
+
+	// Admin APIs, per role (Bearer OIDC access token or OPERATOR_API_TOKEN)
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireRole(RolePackAuthor))
+		r.Post("/packs", s.handleCreatePack)
+		r.Put("/packs/{ref}", s.handleUpdatePack)
+		r.Delete("/packs/{ref}", s.handleDeletePack)
+	})
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireRole(RolePackReviewer))
+		r.Post("/packs/{ref}/review", s.handleReviewPack)
+	})
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireRole(RoleTrustAdmin))
+		r.Post("/trust/issuers", s.handleCreateIssuer)
+		r.Put("/trust/issuers/{did}", s.handleReplaceIssuer)
+		r.Delete("/trust/issuers/{did}", s.handleDeleteIssuer)
+		r.Post("/trust/verifiers", s.handleCreateVerifier)
+		r.Put("/trust/verifiers/{did}", s.handleReplaceVerifier)
+		r.Delete("/trust/verifiers/{did}", s.handleDeleteVerifier)
+		r.Post("/federation/sync", s.handleFederationSync)
+		r.Post("/bundles", s.handleCompileBundle)
+		r.Post("/did/keys", s.handleAddDIDKey)
+		r.Put("/did/keys/{kid}", s.handleUpdateDIDKey)
+		r.Post("/dids", s.handleCreateDID)
+		r.Delete("/dids/{name}", s.handleDeactivateDID)
+		r.Post("/dids/{name}/keys", s.handleAddDIDKey)
+		r.Put("/dids/{name}/keys/{kid}", s.handleUpdateDIDKey)
+	})
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.requireRole(RoleReadOnly))
+		r.Get("/federation/peers", s.handleFederationPeers)
+		r.Get("/admin/audit", s.handleListAuditEvents)
+	})
 }
 
 func (s *Server) Start(addr string) error {
 	log.Info().Str("addr", addr).Msg("Registry server starting")
+	if s.federation != nil {
+		go s.federation.run()
+	}
+	go s.security.Run()
 
 	server := &http.Server{
 		Addr:         addr,
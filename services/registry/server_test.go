@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestNewServer(t *testing.T) {
@@ -26,6 +34,36 @@ func TestHealthCheck(t *testing.T) {
 	assert.Equal(t, "ok", w.Body.String())
 }
 
+// downDatabase is a database that does not answer
+type downDatabase struct{}
+
+func (downDatabase) Check(context.Context) error { return errors.New("connection refused") }
+
+func TestHealthCheck_DatabaseDown(t *testing.T) {
+	server := NewServer()
+	server.health.Require("database", downDatabase{})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "database unavailable", decodeProblem(t, w).Detail)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report health.Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, health.StatusDown, report.Status)
+	assert.Equal(t, "connection refused", report.Checks["database"].Error)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
 func TestPolicyManifest(t *testing.T) {
 	server := NewServer()
 
@@ -35,10 +73,44 @@ func TestPolicyManifest(t *testing.T) {
 	server.router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
-	assert.Equal(t, "text/yaml", w.Header().Get("Content-Type"))
-	assert.Contains(t, w.Body.String(), "id: policy.cachet.manifest")
-	assert.Contains(t, w.Body.String(), "version: 0.1.0")
-	assert.Contains(t, w.Body.String(), "did:web:cachet.id#keys-1")
+	assert.Equal(t, "application/jwt", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	var claims ManifestClaims
+	token, err := jwt.ParseWithClaims(w.Body.String(), &claims, func(token *jwt.Token) (interface{}, error) {
+		return server.signer.PublicKey(), nil
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	require.NoError(t, err)
+	assert.Equal(t, manifestType, token.Header["typ"])
+	assert.Equal(t, server.signer.KeyID(), token.Header["kid"])
+	assert.Equal(t, "policy.cachet.manifest", claims.Manifest.ID)
+	assert.Equal(t, "0.1.0", claims.Manifest.Version)
+	assert.Equal(t, "did:web:cachet.id#"+server.signer.KeyID(), claims.Manifest.SigningDID)
+	require.Len(t, claims.Manifest.Packs, 2)
+	assert.Equal(t, "identity_liveness == true", claims.Manifest.Packs[1].Rules[0].Expr)
+
+	// Each pack is signed on its own, built-in ones included
+	for _, pack := range claims.Manifest.Packs {
+		digest, err := packDigest(pack)
+		require.NoError(t, err)
+		assert.Equal(t, digest, pack.Digest)
+		var packClaims PackSignatureClaims
+		token, err := jwt.ParseWithClaims(pack.Signature, &packClaims, func(*jwt.Token) (interface{}, error) {
+			return server.signer.PublicKey(), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, packSignatureType, token.Header["typ"])
+		assert.Equal(t, pack.ID+"@"+pack.Version, packClaims.Subject)
+		assert.Equal(t, pack.Digest, packClaims.Digest)
+	}
+
+	// Unchanged packs keep the ETag even though every signature differs
+	req = httptest.NewRequest(http.MethodGet, "/policy/manifest", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
 }
 
 func TestRouteNotFound(t *testing.T) {
@@ -50,4 +122,78 @@ func TestRouteNotFound(t *testing.T) {
 	server.router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, problem.CodeNotFound, decodeProblem(t, w).Code)
+}
+
+// decodeProblem reads a problem details response
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) problem.Details {
+	t.Helper()
+	require.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+	var details problem.Details
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	return details
+}
+
+func TestPackPolicy(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/packs/pack.safe.seller@0.1.0/policy", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/yaml", w.Header().Get("Content-Type"))
+	var policy PackPolicy
+	assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &policy))
+	assert.Equal(t, "pack.safe.seller@0.1.0", policy.Pack)
+	assert.Equal(t, "identity.verified", policy.Rules[0].ID)
+	assert.Equal(t, "identity_liveness == true", policy.Rules[0].Expr)
+
+	req = httptest.NewRequest(http.MethodGet, "/packs/pack.safe.seller/policy", nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestListPacks(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/packs", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	var resp struct {
+		Packs []PublishedPack `json:"packs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Packs, 2)
+	assert.Equal(t, "pack.safe.seller", resp.Packs[1].ID)
+	assert.Equal(t, "identity_liveness == true", resp.Packs[1].Rules[0].Expr)
+	assert.Equal(t, &FreshnessPolicy{MaxCredentialAge: "4320h", MaxClockSkew: "2m"}, resp.Packs[1].Freshness)
+	if assert.Len(t, resp.Packs[0].Match, 1) {
+		assert.Equal(t, []string{"family_name", "given_name"}, resp.Packs[0].Match[0].Claims)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/packs", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/trusted-issuers", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var issuers []TrustedIssuer
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &issuers))
+	assert.Equal(t, builtinTrustedIssuers(), issuers)
 }
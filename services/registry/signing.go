@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/rs/zerolog/log"
+)
+
+const registryIssuer = "did:web:cachet.id"
+
+// newSigner signs with a key generated at startup, until main loads
+// REGISTRY_SIGNING_KEY
+func newSigner() *signing.Signer {
+	signer, err := signing.Generate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate registry signing key")
+	}
+	return signer
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("JWKS requested")
+	writeCachedJSON(w, r, map[string]interface{}{
+		"keys": []didresolver.JWK{s.signer.PublicJWK()},
+	}, time.Time{}, cacheShort)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
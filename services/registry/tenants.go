@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// setTenants serves the tenants of TENANTS_CONFIG. Each gets its own pack
+// storage, seeded with the built-in packs; the trust registry and hosted
+// DIDs stay shared across tenants.
+func (s *Server) setTenants(ctx context.Context, tenants []tenant.Tenant) error {
+	if err := s.tenants.Set(tenants); err != nil {
+		return err
+	}
+	for _, t := range s.tenants.All() {
+		if err := seedPacks(tenant.NewContext(ctx, t), s.packs, builtinPacks(), s.catalog.policies); err != nil {
+			return fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+	}
+	return nil
+}
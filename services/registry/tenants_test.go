@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listAcmePacks lists the packs of the acme tenant
+func listAcmePacks(t *testing.T, server *Server, query, token string) []StoredPack {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, "/t/acme/packs"+query, token, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Packs []StoredPack `json:"packs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Packs
+}
+
+func TestTenants_PackStorage(t *testing.T) {
+	server := newAdminServer()
+	require.NoError(t, server.setTenants(context.Background(), []tenant.Tenant{{ID: "acme"}}))
+
+	// Every tenant starts from the built-in packs
+	builtin := listAcmePacks(t, server, "", "")
+	require.Len(t, builtin, len(listPacks(t, server, "", "")))
+	assert.Equal(t, "acme", builtin[0].Tenant)
+
+	w := packRequest(t, server, http.MethodPost, "/t/acme/packs", testOperatorToken, tenantPack("1.0.0"))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Len(t, listAcmePacks(t, server, "?status=draft", testOperatorToken), 1)
+	assert.Empty(t, listPacks(t, server, "?status=draft", testOperatorToken), "acme's draft is not the default tenant's")
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/packs/pack.tenant.ready@1.0.0", testOperatorToken, nil).Code)
+
+	// The same id and version are free in another tenant
+	assert.Equal(t, http.StatusCreated, packRequest(t, server, http.MethodPost, "/packs", testOperatorToken, tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/t/acme/packs", testOperatorToken, tenantPack("1.0.0")).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/t/globex/packs", "", nil).Code)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// writeTrustStoreError answers a failed trust store call
+func writeTrustStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrTrustEntryNotFound):
+		problem.Write(w, r, http.StatusNotFound, "trust_entry_not_found", "Not found")
+	case errors.Is(err, ErrTrustEntryExists):
+		problem.Write(w, r, http.StatusConflict, "trust_entry_exists", err.Error())
+	case errors.Is(err, ErrFederatedEntry):
+		problem.Write(w, r, http.StatusConflict, "federated_entry", err.Error())
+	default:
+		log.Error().Err(err).Msg("Trust store request failed")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// trustStatusFilter reads ?status=, which must be a trust status if set
+func trustStatusFilter(w http.ResponseWriter, r *http.Request) (string, bool) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !validTrustStatus(status) {
+		problem.Error(w, r, "status must be active, suspended or revoked", http.StatusBadRequest)
+		return "", false
+	}
+	return status, true
+}
+
+// checkIssuerLocal refuses admin edits to issuers imported from a peer
+func (s *Server) checkIssuerLocal(ctx context.Context, did string) error {
+	issuer, err := s.trust.GetIssuer(ctx, did)
+	if err != nil {
+		return err
+	}
+	if issuer.Provenance != nil {
+		return ErrFederatedEntry
+	}
+	return nil
+}
+
+// checkVerifierLocal refuses admin edits to verifiers imported from a peer
+func (s *Server) checkVerifierLocal(ctx context.Context, did string) error {
+	verifier, err := s.trust.GetVerifier(ctx, did)
+	if err != nil {
+		return err
+	}
+	if verifier.Provenance != nil {
+		return ErrFederatedEntry
+	}
+	return nil
+}
+
+// handleListIssuers answers which issuers are trusted, optionally for one
+// credential type (a type name or a vct ending in it) or jurisdiction.
+// Suspended and revoked issuers are listed unless filtered out by status.
+func (s *Server) handleListIssuers(w http.ResponseWriter, r *http.Request) {
+	status, ok := trustStatusFilter(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	issuers, err := s.trust.ListIssuers(r.Context(), IssuerFilter{
+		CredentialType: query.Get("credentialType"),
+		Jurisdiction:   query.Get("jurisdiction"),
+		Status:         status,
+	})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Int("issuer_count", len(issuers)).Str("credential_type", query.Get("credentialType")).Msg("Trusted issuers requested")
+	writeCachedJSON(w, r, map[string]interface{}{"issuers": issuers}, time.Time{}, cacheShort)
+}
+
+// handleTrustedIssuers serves the whole issuer list as a bare array.
+// Deprecated: verifiers and wallets should query /trust/issuers.
+func (s *Server) handleTrustedIssuers(w http.ResponseWriter, r *http.Request) {
+	issuers, err := s.trust.ListIssuers(r.Context(), IssuerFilter{})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	writeCachedJSON(w, r, issuers, time.Time{}, cacheShort)
+}
+
+func (s *Server) handleGetIssuer(w http.ResponseWriter, r *http.Request) {
+	issuer, err := s.trust.GetIssuer(r.Context(), chi.URLParam(r, "did"))
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	writeCachedJSON(w, r, issuer, time.Time{}, cacheShort)
+}
+
+func (s *Server) handleCreateIssuer(w http.ResponseWriter, r *http.Request) {
+	var issuer TrustedIssuer
+	if err := json.NewDecoder(r.Body).Decode(&issuer); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if issuer.Status == "" {
+		issuer.Status = TrustStatusActive
+	}
+	issuer.Provenance = nil
+	if err := validateIssuer(issuer); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.trust.CreateIssuer(r.Context(), issuer); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", issuer.DID).Strs("credential_types", issuer.CredentialTypes).Msg("Trusted issuer added")
+	w.Header().Set("Location", "/trust/issuers/"+issuer.DID)
+	writeJSON(w, http.StatusCreated, issuer)
+}
+
+// handleReplaceIssuer replaces an issuer entry; suspending or revoking an
+// issuer is a replacement with a new status
+func (s *Server) handleReplaceIssuer(w http.ResponseWriter, r *http.Request) {
+	did := chi.URLParam(r, "did")
+	var issuer TrustedIssuer
+	if err := json.NewDecoder(r.Body).Decode(&issuer); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if issuer.DID != "" && issuer.DID != did {
+		problem.Error(w, r, "did cannot be changed", http.StatusBadRequest)
+		return
+	}
+	issuer.DID, issuer.Provenance = did, nil
+	if err := validateIssuer(issuer); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkIssuerLocal(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	if err := s.trust.ReplaceIssuer(r.Context(), issuer); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", did).Str("status", issuer.Status).Msg("Trusted issuer updated")
+	writeJSON(w, http.StatusOK, issuer)
+}
+
+func (s *Server) handleDeleteIssuer(w http.ResponseWriter, r *http.Request) {
+	did := chi.URLParam(r, "did")
+	if err := s.checkIssuerLocal(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	if err := s.trust.DeleteIssuer(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeRevocation, Action: "trusted_issuer.removed", Actor: principalFrom(r.Context()).Subject, Target: did})
+	log.Info().Str("did", did).Msg("Trusted issuer removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListVerifiers answers which relying parties are accredited,
+// optionally for one pack or jurisdiction, so wallets can vet a verifier
+// before presenting to it
+func (s *Server) handleListVerifiers(w http.ResponseWriter, r *http.Request) {
+	status, ok := trustStatusFilter(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	verifiers, err := s.trust.ListVerifiers(r.Context(), VerifierFilter{
+		Pack:         query.Get("pack"),
+		Jurisdiction: query.Get("jurisdiction"),
+		Status:       status,
+	})
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Int("verifier_count", len(verifiers)).Str("pack_id", query.Get("pack")).Msg("Accredited verifiers requested")
+	writeCachedJSON(w, r, map[string]interface{}{"verifiers": verifiers}, time.Time{}, cacheShort)
+}
+
+func (s *Server) handleGetVerifier(w http.ResponseWriter, r *http.Request) {
+	verifier, err := s.trust.GetVerifier(r.Context(), chi.URLParam(r, "did"))
+	if err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	writeCachedJSON(w, r, verifier, time.Time{}, cacheShort)
+}
+
+func (s *Server) handleCreateVerifier(w http.ResponseWriter, r *http.Request) {
+	var verifier AccreditedVerifier
+	if err := json.NewDecoder(r.Body).Decode(&verifier); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if verifier.Status == "" {
+		verifier.Status = TrustStatusActive
+	}
+	verifier.Provenance = nil
+	if err := validateVerifier(verifier); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.trust.CreateVerifier(r.Context(), verifier); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", verifier.DID).Strs("packs", verifier.Packs).Msg("Verifier accredited")
+	w.Header().Set("Location", "/trust/verifiers/"+verifier.DID)
+	writeJSON(w, http.StatusCreated, verifier)
+}
+
+func (s *Server) handleReplaceVerifier(w http.ResponseWriter, r *http.Request) {
+	did := chi.URLParam(r, "did")
+	var verifier AccreditedVerifier
+	if err := json.NewDecoder(r.Body).Decode(&verifier); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if verifier.DID != "" && verifier.DID != did {
+		problem.Error(w, r, "did cannot be changed", http.StatusBadRequest)
+		return
+	}
+	verifier.DID, verifier.Provenance = did, nil
+	if err := validateVerifier(verifier); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkVerifierLocal(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	if err := s.trust.ReplaceVerifier(r.Context(), verifier); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	log.Info().Str("did", did).Str("status", verifier.Status).Msg("Accredited verifier updated")
+	writeJSON(w, http.StatusOK, verifier)
+}
+
+func (s *Server) handleDeleteVerifier(w http.ResponseWriter, r *http.Request) {
+	did := chi.URLParam(r, "did")
+	if err := s.checkVerifierLocal(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	if err := s.trust.DeleteVerifier(r.Context(), did); err != nil {
+		writeTrustStoreError(w, r, err)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeRevocation, Action: "accredited_verifier.removed", Actor: principalFrom(r.Context()).Subject, Target: did})
+	log.Info().Str("did", did).Msg("Accredited verifier removed")
+	w.WriteHeader(http.StatusNoContent)
+}
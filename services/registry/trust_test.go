@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listIssuers(t *testing.T, server *Server, query string) []TrustedIssuer {
+	t.Helper()
+	w := packRequest(t, server, http.MethodGet, "/trust/issuers"+query, "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Issuers []TrustedIssuer `json:"issuers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Issuers
+}
+
+func issuerDIDs(issuers []TrustedIssuer) []string {
+	dids := make([]string, 0, len(issuers))
+	for _, issuer := range issuers {
+		dids = append(dids, issuer.DID)
+	}
+	return dids
+}
+
+func TestTrustIssuers_CRUD(t *testing.T) {
+	server := newAdminServer()
+	university := TrustedIssuer{
+		DID:             "did:web:university.example",
+		Name:            "Example University",
+		CredentialTypes: []string{"DiplomaCredential"},
+		Jurisdictions:   []string{"UK"},
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/trust/issuers", "", university).Code)
+	w := packRequest(t, server, http.MethodPost, "/trust/issuers", testOperatorToken, university)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "/trust/issuers/did:web:university.example", w.Header().Get("Location"))
+	assert.Equal(t, http.StatusConflict, packRequest(t, server, http.MethodPost, "/trust/issuers", testOperatorToken, university).Code)
+
+	w = packRequest(t, server, http.MethodGet, "/trust/issuers/did:web:university.example", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stored TrustedIssuer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+	assert.Equal(t, TrustStatusActive, stored.Status, "new issuers are active")
+
+	// Suspension is a replacement with a new status
+	stored.Status = TrustStatusSuspended
+	w = packRequest(t, server, http.MethodPut, "/trust/issuers/did:web:university.example", testOperatorToken, stored)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"did:web:university.example"}, issuerDIDs(listIssuers(t, server, "?status=suspended")))
+	stored.DID = ""
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodPut, "/trust/issuers/did:web:unknown.example", testOperatorToken, stored).Code)
+
+	assert.Equal(t, http.StatusNoContent, packRequest(t, server, http.MethodDelete, "/trust/issuers/did:web:university.example", testOperatorToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/trust/issuers/did:web:university.example", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodDelete, "/trust/issuers/did:web:university.example", testOperatorToken, nil).Code)
+}
+
+func TestTrustIssuers_Query(t *testing.T) {
+	server := newAdminServer()
+	w := packRequest(t, server, http.MethodPost, "/trust/issuers", testOperatorToken, TrustedIssuer{
+		DID:             "did:web:localhost%3A8443",
+		CredentialTypes: []string{"IdentityCredential"},
+		Jurisdictions:   []string{"UK"},
+		Status:          TrustStatusRevoked,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	assert.Equal(t, []string{"did:web:cachet.id", "did:web:localhost%3A8443"}, issuerDIDs(listIssuers(t, server, "?credentialType=IdentityCredential")))
+	assert.Equal(t, []string{"did:web:cachet.id"}, issuerDIDs(listIssuers(t, server, "?credentialType=AgeOverCredential")))
+	// A vct URI matches the type name it ends in, as verifiers compare them
+	assert.Len(t, listIssuers(t, server, "?credentialType=https://cachet.id/credentials/IdentityCredential"), 2)
+	assert.Empty(t, listIssuers(t, server, "?credentialType=DiplomaCredential"))
+	assert.Equal(t, []string{"did:web:cachet.id"}, issuerDIDs(listIssuers(t, server, "?credentialType=IdentityCredential&status=active")))
+	assert.Equal(t, []string{"did:web:localhost%3A8443"}, issuerDIDs(listIssuers(t, server, "?jurisdiction=UK")))
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodGet, "/trust/issuers?status=pending", "", nil).Code)
+
+	assert.Equal(t, http.StatusOK, packRequest(t, server, http.MethodGet, "/trust/issuers/did:web:localhost%3A8443", "", nil).Code)
+}
+
+func TestTrustIssuers_Validation(t *testing.T) {
+	server := newAdminServer()
+	for name, issuer := range map[string]TrustedIssuer{
+		"not a DID":       {DID: "https://issuer.example", CredentialTypes: []string{"IdentityCredential"}},
+		"no method id":    {DID: "did:web:", CredentialTypes: []string{"IdentityCredential"}},
+		"no types":        {DID: "did:web:issuer.example"},
+		"unknown status":  {DID: "did:web:issuer.example", CredentialTypes: []string{"IdentityCredential"}, Status: "pending"},
+		"path in the DID": {DID: "did:web:issuer.example/users", CredentialTypes: []string{"IdentityCredential"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := packRequest(t, server, http.MethodPost, "/trust/issuers", testOperatorToken, issuer)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+
+	renamed := builtinTrustedIssuers()[0]
+	renamed.DID = "did:web:other.example"
+	w := packRequest(t, server, http.MethodPut, "/trust/issuers/did:web:cachet.id", testOperatorToken, renamed)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTrustVerifiers(t *testing.T) {
+	server := newAdminServer()
+	marketplace := AccreditedVerifier{
+		DID:           "did:web:marketplace.example",
+		Name:          "Example Marketplace",
+		Packs:         []string{"pack.safe.seller"},
+		Jurisdictions: []string{"EU"},
+	}
+	assert.Equal(t, http.StatusUnauthorized, packRequest(t, server, http.MethodPost, "/trust/verifiers", "", marketplace).Code)
+	w := packRequest(t, server, http.MethodPost, "/trust/verifiers", testOperatorToken, marketplace)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = packRequest(t, server, http.MethodPost, "/trust/verifiers", testOperatorToken, AccreditedVerifier{
+		DID:    "did:web:nursery.example",
+		Name:   "Example Nursery",
+		Packs:  []string{"pack.childcare.readiness"},
+		Status: TrustStatusSuspended,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, packRequest(t, server, http.MethodPost, "/trust/verifiers", testOperatorToken, AccreditedVerifier{DID: "did:web:anonymous.example"}).Code)
+
+	list := func(query string) []string {
+		w := packRequest(t, server, http.MethodGet, "/trust/verifiers"+query, "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Verifiers []AccreditedVerifier `json:"verifiers"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		dids := []string{}
+		for _, verifier := range resp.Verifiers {
+			dids = append(dids, verifier.DID)
+		}
+		return dids
+	}
+	assert.Equal(t, []string{"did:web:marketplace.example", "did:web:nursery.example"}, list(""))
+	assert.Equal(t, []string{"did:web:marketplace.example"}, list("?pack=pack.safe.seller"))
+	assert.Equal(t, []string{"did:web:marketplace.example"}, list("?status=active"))
+	assert.Empty(t, list("?jurisdiction=UK"))
+
+	// A wallet vets the party it is about to present to
+	w = packRequest(t, server, http.MethodGet, "/trust/verifiers/did:web:marketplace.example", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stored AccreditedVerifier
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+	assert.Equal(t, TrustStatusActive, stored.Status)
+
+	stored.Status = TrustStatusRevoked
+	assert.Equal(t, http.StatusOK, packRequest(t, server, http.MethodPut, "/trust/verifiers/did:web:marketplace.example", testOperatorToken, stored).Code)
+	assert.Equal(t, []string{"did:web:marketplace.example"}, list("?status=revoked"))
+	assert.Equal(t, http.StatusNoContent, packRequest(t, server, http.MethodDelete, "/trust/verifiers/did:web:nursery.example", testOperatorToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, packRequest(t, server, http.MethodGet, "/trust/verifiers/did:web:nursery.example", "", nil).Code)
+}
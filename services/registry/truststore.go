@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Trust entry states. Suspended issuers and verifiers are temporarily not
+// trusted; revoked ones are kept on the list so wallets and verifiers can
+// tell them from unknown parties.
+const (
+	TrustStatusActive    = "active"
+	TrustStatusSuspended = "suspended"
+	TrustStatusRevoked   = "revoked"
+)
+
+var (
+	ErrTrustEntryNotFound = errors.New("trust registry entry not found")
+	ErrTrustEntryExists   = errors.New("trust registry entry already exists")
+)
+
+// TrustedIssuer is an issuer wallets and verifiers may accept credentials from
+type TrustedIssuer struct {
+	DID             string   `json:"did"`
+	Name            string   `json:"name,omitempty"`
+	CredentialTypes []string `json:"credentialTypes"`
+	Jurisdictions   []string `json:"jurisdictions,omitempty"`
+	Status          string   `json:"status,omitempty"`
+	// Provenance is set on issuers imported from a federation peer
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// AccreditedVerifier is a relying party wallets may present credentials to
+type AccreditedVerifier struct {
+	DID           string   `json:"did"`
+	Name          string   `json:"name"`
+	Packs         []string `json:"packs,omitempty"` // pack ids it may request
+	Jurisdictions []string `json:"jurisdictions,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	// Provenance is set on verifiers imported from a federation peer
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// IssuerFilter narrows an issuer listing; zero fields match everything
+type IssuerFilter struct {
+	CredentialType string
+	Jurisdiction   string
+	Status         string
+}
+
+// VerifierFilter narrows a verifier listing; zero fields match everything
+type VerifierFilter struct {
+	Pack         string
+	Jurisdiction string
+	Status       string
+}
+
+// TrustStore persists the trust registry
+type TrustStore interface {
+	ListIssuers(ctx context.Context, filter IssuerFilter) ([]TrustedIssuer, error)
+	GetIssuer(ctx context.Context, did string) (TrustedIssuer, error)
+	CreateIssuer(ctx context.Context, issuer TrustedIssuer) error
+	ReplaceIssuer(ctx context.Context, issuer TrustedIssuer) error
+	DeleteIssuer(ctx context.Context, did string) error
+
+	ListVerifiers(ctx context.Context, filter VerifierFilter) ([]AccreditedVerifier, error)
+	GetVerifier(ctx context.Context, did string) (AccreditedVerifier, error)
+	CreateVerifier(ctx context.Context, verifier AccreditedVerifier) error
+	ReplaceVerifier(ctx context.Context, verifier AccreditedVerifier) error
+	DeleteVerifier(ctx context.Context, did string) error
+}
+
+func validTrustStatus(status string) bool {
+	switch status {
+	case TrustStatusActive, TrustStatusSuspended, TrustStatusRevoked:
+		return true
+	}
+	return false
+}
+
+// validateDID accepts a DID usable as a path segment
+func validateDID(did string) error {
+	method, id, ok := strings.Cut(strings.TrimPrefix(did, "did:"), ":")
+	if !strings.HasPrefix(did, "did:") || !ok || method == "" || id == "" || strings.ContainsAny(did, "/?# ") {
+		return fmt.Errorf("%q is not a DID", did)
+	}
+	return nil
+}
+
+func validateIssuer(issuer TrustedIssuer) error {
+	if err := validateDID(issuer.DID); err != nil {
+		return err
+	}
+	if len(issuer.CredentialTypes) == 0 {
+		return errors.New("issuer needs at least one credential type")
+	}
+	if !validTrustStatus(issuer.Status) {
+		return errors.New("status must be active, suspended or revoked")
+	}
+	return nil
+}
+
+func validateVerifier(verifier AccreditedVerifier) error {
+	if err := validateDID(verifier.DID); err != nil {
+		return err
+	}
+	if strings.TrimSpace(verifier.Name) == "" {
+		return errors.New("verifier name is required")
+	}
+	if !validTrustStatus(verifier.Status) {
+		return errors.New("status must be active, suspended or revoked")
+	}
+	return nil
+}
+
+// credentialTypeMatches compares a trusted type name with a queried vct or
+// type, which may be a URI ending in the name, as verifiers compare them
+func credentialTypeMatches(trusted, credentialType string) bool {
+	return credentialType == trusted || strings.HasSuffix(credentialType, "/"+trusted)
+}
+
+// filterIssuers applies filter and sorts by DID
+func filterIssuers(issuers []TrustedIssuer, filter IssuerFilter) []TrustedIssuer {
+	out := make([]TrustedIssuer, 0, len(issuers))
+	for _, issuer := range issuers {
+		if filter.Status != "" && issuer.Status != filter.Status {
+			continue
+		}
+		if filter.Jurisdiction != "" && !slices.Contains(issuer.Jurisdictions, filter.Jurisdiction) {
+			continue
+		}
+		if filter.CredentialType != "" && !slices.ContainsFunc(issuer.CredentialTypes, func(trusted string) bool {
+			return credentialTypeMatches(trusted, filter.CredentialType)
+		}) {
+			continue
+		}
+		out = append(out, issuer)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DID < out[j].DID })
+	return out
+}
+
+// filterVerifiers applies filter and sorts by DID
+func filterVerifiers(verifiers []AccreditedVerifier, filter VerifierFilter) []AccreditedVerifier {
+	out := make([]AccreditedVerifier, 0, len(verifiers))
+	for _, verifier := range verifiers {
+		if filter.Status != "" && verifier.Status != filter.Status {
+			continue
+		}
+		if filter.Jurisdiction != "" && !slices.Contains(verifier.Jurisdictions, filter.Jurisdiction) {
+			continue
+		}
+		if filter.Pack != "" && !slices.Contains(verifier.Packs, filter.Pack) {
+			continue
+		}
+		out = append(out, verifier)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DID < out[j].DID })
+	return out
+}
+
+// memoryTrustStore keeps the trust registry in memory (production should use
+// the Postgres store, so entries survive restarts and are shared across
+// replicas)
+type memoryTrustStore struct {
+	mu        sync.RWMutex
+	issuers   map[string]TrustedIssuer
+	verifiers map[string]AccreditedVerifier
+}
+
+func newMemoryTrustStore() *memoryTrustStore {
+	return &memoryTrustStore{
+		issuers:   make(map[string]TrustedIssuer),
+		verifiers: make(map[string]AccreditedVerifier),
+	}
+}
+
+func (m *memoryTrustStore) ListIssuers(ctx context.Context, filter IssuerFilter) ([]TrustedIssuer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	issuers := make([]TrustedIssuer, 0, len(m.issuers))
+	for _, issuer := range m.issuers {
+		issuers = append(issuers, issuer)
+	}
+	return filterIssuers(issuers, filter), nil
+}
+
+func (m *memoryTrustStore) GetIssuer(ctx context.Context, did string) (TrustedIssuer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	issuer, ok := m.issuers[did]
+	if !ok {
+		return TrustedIssuer{}, ErrTrustEntryNotFound
+	}
+	return issuer, nil
+}
+
+func (m *memoryTrustStore) CreateIssuer(ctx context.Context, issuer TrustedIssuer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.issuers[issuer.DID]; ok {
+		return ErrTrustEntryExists
+	}
+	m.issuers[issuer.DID] = issuer
+	return nil
+}
+
+func (m *memoryTrustStore) ReplaceIssuer(ctx context.Context, issuer TrustedIssuer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.issuers[issuer.DID]; !ok {
+		return ErrTrustEntryNotFound
+	}
+	m.issuers[issuer.DID] = issuer
+	return nil
+}
+
+func (m *memoryTrustStore) DeleteIssuer(ctx context.Context, did string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.issuers[did]; !ok {
+		return ErrTrustEntryNotFound
+	}
+	delete(m.issuers, did)
+	return nil
+}
+
+func (m *memoryTrustStore) ListVerifiers(ctx context.Context, filter VerifierFilter) ([]AccreditedVerifier, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	verifiers := make([]AccreditedVerifier, 0, len(m.verifiers))
+	for _, verifier := range m.verifiers {
+		verifiers = append(verifiers, verifier)
+	}
+	return filterVerifiers(verifiers, filter), nil
+}
+
+func (m *memoryTrustStore) GetVerifier(ctx context.Context, did string) (AccreditedVerifier, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	verifier, ok := m.verifiers[did]
+	if !ok {
+		return AccreditedVerifier{}, ErrTrustEntryNotFound
+	}
+	return verifier, nil
+}
+
+func (m *memoryTrustStore) CreateVerifier(ctx context.Context, verifier AccreditedVerifier) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.verifiers[verifier.DID]; ok {
+		return ErrTrustEntryExists
+	}
+	m.verifiers[verifier.DID] = verifier
+	return nil
+}
+
+func (m *memoryTrustStore) ReplaceVerifier(ctx context.Context, verifier AccreditedVerifier) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.verifiers[verifier.DID]; !ok {
+		return ErrTrustEntryNotFound
+	}
+	m.verifiers[verifier.DID] = verifier
+	return nil
+}
+
+func (m *memoryTrustStore) DeleteVerifier(ctx context.Context, did string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.verifiers[did]; !ok {
+		return ErrTrustEntryNotFound
+	}
+	delete(m.verifiers, did)
+	return nil
+}
+
+// seedTrust adds the issuers the registry ships with unless the store
+// already holds them
+func seedTrust(ctx context.Context, store TrustStore, issuers []TrustedIssuer) error {
+	for _, issuer := range issuers {
+		if err := validateIssuer(issuer); err != nil {
+			return fmt.Errorf("issuer %s: %w", issuer.DID, err)
+		}
+		if err := store.CreateIssuer(ctx, issuer); err != nil && !errors.Is(err, ErrTrustEntryExists) {
+			return fmt.Errorf("issuer %s: %w", issuer.DID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+)
+
+// postgresTrustStore keeps the trust registry in Postgres
+type postgresTrustStore struct {
+	db *sql.DB
+}
+
+// newPostgresTrustStore uses the tables of the registry migrations
+func newPostgresTrustStore(db *sql.DB) *postgresTrustStore {
+	return &postgresTrustStore{db: db}
+}
+
+// listDocuments decodes every document in table with the given status, or
+// all of them when status is empty
+func listDocuments[T any](ctx context.Context, db *sql.DB, table, status string) ([]T, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT document FROM `+table+` WHERE ($1 = '' OR status = $1)`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []T
+	for rows.Next() {
+		var document []byte
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		var entry T
+		if err := json.Unmarshal(document, &entry); err != nil {
+			return nil, fmt.Errorf("decoding %s entry: %w", table, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func getDocument[T any](ctx context.Context, db *sql.DB, table, did string) (T, error) {
+	var entry T
+	var document []byte
+	err := db.QueryRowContext(ctx, `SELECT document FROM `+table+` WHERE did = $1`, did).Scan(&document)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, ErrTrustEntryNotFound
+	}
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(document, &entry); err != nil {
+		return entry, fmt.Errorf("decoding %s entry: %w", table, err)
+	}
+	return entry, nil
+}
+
+func insertDocument(ctx context.Context, db *sql.DB, table, did, status string, entry interface{}) error {
+	document, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO `+table+` (did, status, document) VALUES ($1, $2, $3)`, did, status, document)
+	if store.IsUniqueViolation(err) {
+		return ErrTrustEntryExists
+	}
+	return err
+}
+
+func replaceDocument(ctx context.Context, db *sql.DB, table, did, status string, entry interface{}) error {
+	document, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx,
+		`UPDATE `+table+` SET status = $2, document = $3, updated_at = now() WHERE did = $1`, did, status, document)
+	return affectedOne(result, err)
+}
+
+func deleteDocument(ctx context.Context, db *sql.DB, table, did string) error {
+	result, err := db.ExecContext(ctx, `DELETE FROM `+table+` WHERE did = $1`, did)
+	return affectedOne(result, err)
+}
+
+// affectedOne maps a statement that touched no row to ErrTrustEntryNotFound
+func affectedOne(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTrustEntryNotFound
+	}
+	return nil
+}
+
+func (p *postgresTrustStore) ListIssuers(ctx context.Context, filter IssuerFilter) ([]TrustedIssuer, error) {
+	issuers, err := listDocuments[TrustedIssuer](ctx, p.db, "trusted_issuers", filter.Status)
+	if err != nil {
+		return nil, err
+	}
+	// Credential types match by suffix, so they are filtered in Go
+	return filterIssuers(issuers, filter), nil
+}
+
+func (p *postgresTrustStore) GetIssuer(ctx context.Context, did string) (TrustedIssuer, error) {
+	return getDocument[TrustedIssuer](ctx, p.db, "trusted_issuers", did)
+}
+
+func (p *postgresTrustStore) CreateIssuer(ctx context.Context, issuer TrustedIssuer) error {
+	return insertDocument(ctx, p.db, "trusted_issuers", issuer.DID, issuer.Status, issuer)
+}
+
+func (p *postgresTrustStore) ReplaceIssuer(ctx context.Context, issuer TrustedIssuer) error {
+	return replaceDocument(ctx, p.db, "trusted_issuers", issuer.DID, issuer.Status, issuer)
+}
+
+func (p *postgresTrustStore) DeleteIssuer(ctx context.Context, did string) error {
+	return deleteDocument(ctx, p.db, "trusted_issuers", did)
+}
+
+func (p *postgresTrustStore) ListVerifiers(ctx context.Context, filter VerifierFilter) ([]AccreditedVerifier, error) {
+	verifiers, err := listDocuments[AccreditedVerifier](ctx, p.db, "accredited_verifiers", filter.Status)
+	if err != nil {
+		return nil, err
+	}
+	return filterVerifiers(verifiers, filter), nil
+}
+
+func (p *postgresTrustStore) GetVerifier(ctx context.Context, did string) (AccreditedVerifier, error) {
+	return getDocument[AccreditedVerifier](ctx, p.db, "accredited_verifiers", did)
+}
+
+func (p *postgresTrustStore) CreateVerifier(ctx context.Context, verifier AccreditedVerifier) error {
+	return insertDocument(ctx, p.db, "accredited_verifiers", verifier.DID, verifier.Status, verifier)
+}
+
+func (p *postgresTrustStore) ReplaceVerifier(ctx context.Context, verifier AccreditedVerifier) error {
+	return replaceDocument(ctx, p.db, "accredited_verifiers", verifier.DID, verifier.Status, verifier)
+}
+
+func (p *postgresTrustStore) DeleteVerifier(ctx context.Context, did string) error {
+	return deleteDocument(ctx, p.db, "accredited_verifiers", did)
+}
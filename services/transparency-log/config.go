@@ -0,0 +1,13 @@
+package main
+
+import "github.com/cachet-id/cachet/services/common/pkg/config"
+
+// Config is the transparency log's configuration, documented in CONFIG.md
+type Config struct {
+	config.Base
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{Base: config.Base{Port: 8090}}
+}
@@ -1,29 +1,47 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
-	"github.com/rs/zerolog/log"
+	"context"
 	"net/http"
-	"os"
 	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	exporting, err := tracing.Init(context.Background(), "transparency-log")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+	monitor := health.New("transparency-log")
+	m := metrics.New("transparency-log")
 	r := chi.NewRouter()
+	r.Use(tracing.Middleware("transparency-log"))
+	r.Use(m.Middleware)
+	r.Use(deadline.Middleware(deadline.BudgetFromEnv()))
 	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		if _, err := w.Write([]byte("ok")); err != nil {
-			log.Error().Err(err).Msg("Failed to write health check response")
-		}
-	})
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8090"
-	}
-	log.Info().Str("port", port).Msg("Starting transparency-log")
+	r.Get("/health", monitor.Health)
+	r.Get("/livez", monitor.Live)
+	r.Get("/readyz", monitor.Ready)
+	r.Handle("/metrics", m.Handler())
+	log.Info().Int("port", cfg.Port).Msg("Starting transparency-log")
 
 	server := &http.Server{
-		Addr:         ":" + port,
+		Addr:         cfg.Addr(),
 		Handler:      r,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Signed verification badges
+const (
+	badgeType = "cachet-badge+jwt"
+	// badgeTTL bounds how long a relying party may relay a badge; it never
+	// outlives the credential it was derived from
+	badgeTTL = 24 * time.Hour
+)
+
+// Badge is the outcome of a verification, signed with the verifier's key
+// (published at /.well-known/jwks.json) so it can be relayed to third parties
+type Badge struct {
+	Label      string    `json:"label"`
+	PolicyID   string    `json:"policyId"`
+	Predicates []string  `json:"predicates"`
+	Satisfied  bool      `json:"satisfied"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	JWS        string    `json:"jws"`
+}
+
+// BadgeClaims is the JWS payload of a badge
+type BadgeClaims struct {
+	Label            string   `json:"badge"`
+	PolicyID         string   `json:"policy_id"`
+	Predicates       []string `json:"predicates"`
+	Satisfied        bool     `json:"satisfied"`
+	CredentialIssuer string   `json:"credential_issuer,omitempty"`
+	// CredentialIssuers lists every issuer of a multi-credential bundle
+	CredentialIssuers []string `json:"credential_issuers,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// issueBadge signs the verification result for policyID with the session
+// tenant's signer. The badge expires
+// with the first credential of the bundle to expire.
+func (s *Server) issueBadge(signer *requestSigner, label, policyID string, predicates []string, satisfied bool, credentials []VerifiedSDJWT, now time.Time) (Badge, error) {
+	expiresAt := now.Add(badgeTTL)
+	var issuers []string
+	for _, verified := range credentials {
+		if !verified.ExpiresAt.IsZero() && verified.ExpiresAt.Before(expiresAt) {
+			expiresAt = verified.ExpiresAt
+		}
+		if len(credentials) > 1 && !slices.Contains(issuers, verified.Issuer) {
+			issuers = append(issuers, verified.Issuer)
+		}
+	}
+	now, expiresAt = now.Truncate(time.Second), expiresAt.Truncate(time.Second)
+
+	jws, err := signer.SignTyped(badgeType, BadgeClaims{
+		Label:             label,
+		PolicyID:          policyID,
+		Predicates:        predicates,
+		Satisfied:         satisfied,
+		CredentialIssuer:  credentials[0].Issuer,
+		CredentialIssuers: issuers,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    s.baseURL,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return Badge{}, err
+	}
+	return Badge{
+		Label:      label,
+		PolicyID:   policyID,
+		Predicates: predicates,
+		Satisfied:  satisfied,
+		VerifiedAt: now,
+		ExpiresAt:  expiresAt,
+		JWS:        jws,
+	}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPresentation_SignedBadge(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"identity_liveness": true},
+		map[string]interface{}{"age_over_18": true})
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	body, err := json.Marshal(VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	badge := resp.Badge
+	assert.Equal(t, "Safe Seller", badge.Label)
+	assert.Equal(t, "pack.safe.seller@0.1.0", badge.PolicyID)
+	assert.Equal(t, resp.Predicates, badge.Predicates)
+	// The credential expires in an hour, so the badge cannot outlive it
+	assert.WithinDuration(t, time.Now().Add(time.Hour), badge.ExpiresAt, 2*time.Second)
+
+	// A third party checks the badge against the verifier's published JWKS
+	req = httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	publicKey, err := jwks.Keys[0].PublicKey()
+	require.NoError(t, err)
+
+	var claims BadgeClaims
+	token, err := jwt.ParseWithClaims(badge.JWS, &claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwks.Keys[0].Kid, token.Header["kid"])
+		assert.Equal(t, badgeType, token.Header["typ"])
+		return publicKey, nil
+	}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithIssuer(defaultVerifierBaseURL), jwt.WithExpirationRequired())
+	require.NoError(t, err)
+	require.True(t, token.Valid)
+	assert.Equal(t, "pack.safe.seller@0.1.0", claims.PolicyID)
+	assert.Equal(t, badge.Predicates, claims.Predicates)
+	assert.Equal(t, testIssuerDID, claims.CredentialIssuer)
+	assert.Equal(t, badge.ExpiresAt.Unix(), claims.ExpiresAt.Unix())
+	assert.NotEmpty(t, claims.ID)
+}
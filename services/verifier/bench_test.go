@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	stdlog "log"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+// quietLogs silences request and application logs for a benchmark, so
+// writing them neither floods the output nor skews the timings. Call it
+// before NewServer, which wires the request logger into the router.
+func quietLogs(b *testing.B) {
+	b.Helper()
+	requestLogger, level := middleware.DefaultLogger, zerolog.GlobalLevel()
+	middleware.DefaultLogger = middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: stdlog.New(io.Discard, "", 0)})
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	b.Cleanup(func() {
+		middleware.DefaultLogger = requestLogger
+		zerolog.SetGlobalLevel(level)
+	})
+}
+
+// BenchmarkVerifyPresentation measures verifying an SD-JWT presentation
+// against a pack, the verifier's hot path. Sessions are single use, so each
+// iteration opens one and presents to it outside the timer.
+func BenchmarkVerifyPresentation(b *testing.B) {
+	quietLogs(b)
+	server := NewServer()
+	issuer := newTestIssuer(b)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(b, nil, map[string]interface{}{"age_over_18": true})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		session := createSession(b, server, "pack.safe.seller@0.1.0")
+		presentation := issuer.present(b, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder)
+		b.StartTimer()
+
+		if w := verifyWithProfile(b, server, session, presentation); w.Code != http.StatusOK {
+			b.Fatalf("verify answered %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+// BenchmarkCreateSession measures opening a verification session
+func BenchmarkCreateSession(b *testing.B) {
+	quietLogs(b)
+	server := NewServer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		createSession(b, server, "pack.safe.seller@0.1.0")
+	}
+}
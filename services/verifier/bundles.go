@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MatchRule requires claims to agree across the credentials of a bundle,
+// e.g. that the background check names the person the identity credential
+// does. Claims are compared case- and whitespace-insensitively.
+type MatchRule struct {
+	ID          string   `json:"id" yaml:"id"`
+	Claims      []string `json:"claims" yaml:"claims"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    *bool    `json:"required,omitempty" yaml:"required,omitempty"` // defaults to true
+}
+
+func (r MatchRule) isRequired() bool {
+	return r.Required == nil || *r.Required
+}
+
+// CredentialResult reports one credential of the presented bundle
+type CredentialResult struct {
+	Index     int    `json:"index"`
+	Format    string `json:"format"`
+	Type      string `json:"type,omitempty"` // vct or mdoc doctype
+	Issuer    string `json:"issuer"`
+	KeyBound  bool   `json:"keyBound"`
+	Freshness string `json:"freshness"`
+	// FreshnessDiagnostics lists the pack freshness limits this credential exceeded
+	FreshnessDiagnostics []FreshnessDiagnostic `json:"freshnessDiagnostics,omitempty"`
+	Disclosed            []string              `json:"disclosed"`
+	// Satisfies lists the pack rules this credential passed
+	Satisfies []string `json:"satisfies"`
+}
+
+// bundleCredential is one verified credential of a bundle
+type bundleCredential struct {
+	envelope    PresentationEnvelope
+	verified    VerifiedSDJWT
+	freshness   string
+	diagnostics []FreshnessDiagnostic
+}
+
+// validateMatchRules rejects match rules that cannot be evaluated, or whose
+// IDs clash with the pack's other rules
+func validateMatchRules(matches []MatchRule, rules []compiledRule) error {
+	seen := make(map[string]bool, len(rules)+len(matches))
+	for _, rule := range rules {
+		seen[rule.ID] = true
+	}
+	for _, match := range matches {
+		if match.ID == "" {
+			return errors.New("match rule without an id")
+		}
+		if seen[match.ID] {
+			return fmt.Errorf("duplicate policy rule %q", match.ID)
+		}
+		seen[match.ID] = true
+		if len(match.Claims) == 0 {
+			return fmt.Errorf("match rule %q names no claims", match.ID)
+		}
+	}
+	return nil
+}
+
+// evaluateBundleRules runs each rule against every credential of the bundle:
+// a rule passes when any one credential satisfies it. When none does, the
+// reason comes from a credential that disclosed the claims involved, if any.
+func evaluateBundleRules(rules []compiledRule, credentials []bundleCredential, now time.Time) []PredicateResult {
+	results := make([]PredicateResult, 0, len(rules))
+	for _, rule := range rules {
+		result := PredicateResult{ID: rule.ID, Required: rule.isRequired()}
+		var withheld string
+		for i, credential := range credentials {
+			passed, reason := evaluateRule(rule.expr, policyEnv{claims: credential.verified.Claims, verified: credential.verified, now: now})
+			if passed {
+				index := i
+				result.Passed, result.Reason, result.Credential = true, reason, &index
+				break
+			}
+			if strings.HasSuffix(reason, " is not disclosed") {
+				if withheld == "" {
+					withheld = reason
+				}
+			} else if result.Reason == "" {
+				result.Reason = reason
+			}
+		}
+		if result.Reason == "" {
+			result.Reason = withheld
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// evaluateMatches checks each match rule across the bundle. A lone credential
+// has nothing to match against; otherwise every claim must be disclosed by at
+// least two credentials and agree wherever it is disclosed.
+func evaluateMatches(matches []MatchRule, credentials []bundleCredential) []PredicateResult {
+	results := make([]PredicateResult, 0, len(matches))
+	for _, match := range matches {
+		passed, reason := evaluateMatch(match, credentials)
+		results = append(results, PredicateResult{ID: match.ID, Passed: passed, Required: match.isRequired(), Reason: reason})
+	}
+	return results
+}
+
+func evaluateMatch(match MatchRule, credentials []bundleCredential) (bool, string) {
+	if len(credentials) < 2 {
+		return true, "a single credential was presented"
+	}
+	for _, claim := range match.Claims {
+		first, firstIndex := "", -1
+		disclosedBy := 0
+		for i, credential := range credentials {
+			value, ok := credentialClaim(credential.verified, claim)
+			if !ok {
+				continue
+			}
+			disclosedBy++
+			if firstIndex < 0 {
+				first, firstIndex = value, i
+				continue
+			}
+			if value != first {
+				return false, fmt.Sprintf("%s differs between credentials %d and %d", claim, firstIndex, i)
+			}
+		}
+		if disclosedBy < 2 {
+			return false, fmt.Sprintf("%s is disclosed by %d of %d credentials, at least 2 needed", claim, disclosedBy, len(credentials))
+		}
+	}
+	return true, fmt.Sprintf("%s match across credentials", strings.Join(match.Claims, ", "))
+}
+
+// credentialClaim is a disclosed claim in the form match rules compare
+func credentialClaim(verified VerifiedSDJWT, path string) (string, bool) {
+	for _, root := range []map[string]interface{}{verified.Claims, subjectClaims(verified.Claims)} {
+		value, ok := lookupClaim(root, path)
+		if !ok {
+			continue
+		}
+		switch v := normalizeClaim(value).(type) {
+		case time.Time:
+			return v.UTC().Format(time.RFC3339), true
+		case string:
+			return strings.ToLower(strings.Join(strings.Fields(v), " ")), true
+		default:
+			return fmt.Sprint(v), true
+		}
+	}
+	return "", false
+}
+
+// credentialResults reports each credential with the pack rules it passed
+func credentialResults(credentials []bundleCredential, results []PredicateResult) []CredentialResult {
+	out := make([]CredentialResult, len(credentials))
+	for i, credential := range credentials {
+		out[i] = CredentialResult{
+			Index:                i,
+			Format:               credential.envelope.Format,
+			Type:                 credential.envelope.CredentialType,
+			Issuer:               credential.verified.Issuer,
+			KeyBound:             credential.verified.KeyBound,
+			Freshness:            credential.freshness,
+			FreshnessDiagnostics: credential.diagnostics,
+			Disclosed:            append([]string{}, credential.verified.Disclosed...),
+			Satisfies:            []string{},
+		}
+		sort.Strings(out[i].Disclosed)
+	}
+	for _, result := range results {
+		if result.Credential != nil {
+			out[*result.Credential].Satisfies = append(out[*result.Credential].Satisfies, result.ID)
+		}
+	}
+	return out
+}
+
+// bundleFreshness folds per-credential status into one summary: the worst
+// status of any credential wins
+func bundleFreshness(credentials []bundleCredential) string {
+	rank := map[string]int{FreshnessOK: 0, FreshnessUnknown: 1, FreshnessStale: 2, FreshnessSuspended: 3}
+	summary := credentials[0].freshness
+	for _, credential := range credentials[1:] {
+		if rank[credential.freshness] > rank[summary] {
+			summary = credential.freshness
+		}
+	}
+	return summary
+}
+
+// bundlePredicates derives the predicates of every credential in the bundle
+func bundlePredicates(credentials []bundleCredential) []string {
+	predicates := []string{}
+	for _, credential := range credentials {
+		for _, predicate := range derivePredicates(credential.verified.Claims) {
+			if !slices.Contains(predicates, predicate) {
+				predicates = append(predicates, predicate)
+			}
+		}
+	}
+	sort.Strings(predicates)
+	return predicates
+}
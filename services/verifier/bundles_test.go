@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// childcareBundle presents an identity credential and a background check
+// naming the holder checkFamilyName
+func childcareBundle(t *testing.T, issuer *testIssuer, session VerificationSession, checkFamilyName string) []interface{} {
+	t.Helper()
+	identityJWT, identityDisclosures := issuer.issue(t, nil, map[string]interface{}{
+		"given_name": "Ada", "family_name": "Lovelace", "age": 36, "identity_liveness": true,
+	})
+	checkJWT, checkDisclosures := issuer.issue(t, map[string]interface{}{"vct": "https://checks.example/background"}, map[string]interface{}{
+		"given_name": " ada", "family_name": checkFamilyName, "criminal_record_clear": true, "references_count": 3,
+	})
+	return []interface{}{
+		issuer.present(t, identityJWT, identityDisclosures, session.Nonce, session.Audience, issuer.holder),
+		map[string]interface{}{
+			"format":       FormatSDJWTVC,
+			"presentation": issuer.present(t, checkJWT, checkDisclosures, session.Nonce, session.Audience, issuer.holder),
+		},
+	}
+}
+
+func resultByID(t *testing.T, results []PredicateResult, id string) PredicateResult {
+	t.Helper()
+	for _, result := range results {
+		if result.ID == id {
+			return result
+		}
+	}
+	t.Fatalf("no result for %s", id)
+	return PredicateResult{}
+}
+
+func TestVerifyPresentation_MultiCredentialBundle(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server, "https://cachet.id/identity", "https://checks.example/background")
+	session := createSession(t, server, "pack.childcare.readiness@0.1.0")
+
+	w := verifyWithProfile(t, server, session, childcareBundle(t, issuer, session, "LOVELACE"))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Satisfied)
+	assert.Equal(t, FreshnessOK, resp.Freshness)
+
+	// Each rule names the credential that satisfied it
+	require.NotNil(t, resultByID(t, resp.Results, "age.ge.18").Credential)
+	assert.Equal(t, 0, *resultByID(t, resp.Results, "age.ge.18").Credential)
+	require.NotNil(t, resultByID(t, resp.Results, "criminal.clear").Credential)
+	assert.Equal(t, 1, *resultByID(t, resp.Results, "criminal.clear").Credential)
+	consistent := resultByID(t, resp.Results, "holder.consistent")
+	assert.True(t, consistent.Passed, consistent.Reason)
+	assert.Nil(t, consistent.Credential)
+
+	require.Len(t, resp.Credentials, 2)
+	assert.Equal(t, "https://cachet.id/identity", resp.Credentials[0].Type)
+	assert.ElementsMatch(t, []string{"age.ge.18", "identity.verified"}, resp.Credentials[0].Satisfies)
+	assert.Equal(t, FormatSDJWTVC, resp.Credentials[1].Format)
+	assert.ElementsMatch(t, []string{"criminal.clear", "references.verified"}, resp.Credentials[1].Satisfies)
+	assert.Contains(t, resp.Receipt.Disclosed, "criminal_record_clear")
+	assert.Contains(t, resp.Receipt.Disclosed, "identity_liveness")
+	assert.True(t, resp.Badge.Satisfied)
+}
+
+func TestVerifyPresentation_BundleNamesMustMatch(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server, "https://cachet.id/identity", "https://checks.example/background")
+	session := createSession(t, server, "pack.childcare.readiness@0.1.0")
+
+	w := verifyWithProfile(t, server, session, childcareBundle(t, issuer, session, "Byron"))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	consistent := resultByID(t, resp.Results, "holder.consistent")
+	assert.False(t, consistent.Passed)
+	assert.Equal(t, "family_name differs between credentials 0 and 1", consistent.Reason)
+	assert.False(t, resp.Satisfied)
+}
+
+func TestVerifyPresentation_BundleRejectsAnyBadCredential(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server, "https://cachet.id/identity", "https://checks.example/background")
+	session := createSession(t, server, "pack.childcare.readiness@0.1.0")
+
+	bundle := childcareBundle(t, issuer, session, "Lovelace")
+	checkJWT, checkDisclosures := issuer.issue(t, nil, map[string]interface{}{"criminal_record_clear": true})
+	bundle[1] = issuer.present(t, checkJWT, checkDisclosures, "another-nonce", session.Audience, issuer.holder)
+
+	w := verifyWithProfile(t, server, session, bundle)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "credential 1")
+
+	w = verifyWithProfile(t, server, createSession(t, server, "pack.childcare.readiness@0.1.0"), []interface{}{})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestEvaluateMatches(t *testing.T) {
+	match := []MatchRule{{ID: "holder.consistent", Claims: []string{"family_name"}}}
+	credential := func(claims map[string]interface{}) bundleCredential {
+		return bundleCredential{verified: VerifiedSDJWT{Claims: claims}}
+	}
+
+	results := evaluateMatches(match, []bundleCredential{credential(map[string]interface{}{"family_name": "Lovelace"})})
+	assert.True(t, results[0].Passed, "a lone credential has nothing to match")
+
+	results = evaluateMatches(match, []bundleCredential{
+		credential(map[string]interface{}{"family_name": "Lovelace"}),
+		credential(map[string]interface{}{"criminal_record_clear": true}),
+	})
+	assert.False(t, results[0].Passed)
+	assert.Equal(t, "family_name is disclosed by 1 of 2 credentials, at least 2 needed", results[0].Reason)
+
+	results = evaluateMatches(match, []bundleCredential{
+		credential(map[string]interface{}{"family_name": "Lovelace"}),
+		credential(map[string]interface{}{"credentialSubject": map[string]interface{}{"family_name": "lovelace "}}),
+	})
+	assert.True(t, results[0].Passed, results[0].Reason)
+}
+
+func TestEUDIProfile_BundleNeedsOnePID(t *testing.T) {
+	profile := complianceProfiles[ProfileEUDIARF]
+	pid := fakeSDJWT(t, map[string]interface{}{"alg": "ES256"}, map[string]interface{}{"vct": EUDIPIDVct}, "kb")
+	other := fakeSDJWT(t, map[string]interface{}{"alg": "ES256"}, map[string]interface{}{"vct": "https://checks.example/background"}, "kb")
+
+	assert.Empty(t, profile.Check([]interface{}{pid, other}))
+	assert.Equal(t, []string{"no credential in the bundle is a PID"}, profile.Check([]interface{}{other, other}))
+	assert.Equal(t, []string{"credential 1: key binding JWT required"},
+		profile.Check([]interface{}{pid, fakeSDJWT(t, map[string]interface{}{"alg": "ES256"}, map[string]interface{}{}, "")}))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+)
+
+// Config is the verifier's configuration, documented in CONFIG.md
+type Config struct {
+	config.Base
+	ComplianceProfile   string        `env:"COMPLIANCE_PROFILE" default:"default" oneof:"default,eudi-arf" doc:"Presentation rules the deployment enforces"`
+	Audience            string        `env:"VERIFIER_AUDIENCE" doc:"Audience holders bind presentations to"`
+	BaseURL             string        `env:"VERIFIER_BASE_URL" doc:"Public URL of the verifier, used in request objects and links"`
+	SigningKey          string        `env:"REQUEST_SIGNING_KEY" doc:"PEM file of the P-256 key signing request objects and badges; a key is generated at startup without one"`
+	SigningCertificate  string        `env:"REQUEST_SIGNING_CERTIFICATE" doc:"PEM file of the X.509 chain of REQUEST_SIGNING_KEY, leaf first, valid for the host of VERIFIER_BASE_URL; request objects then carry it and use the x509_san_dns client_id scheme"`
+	OperatorToken       string        `env:"OPERATOR_API_TOKEN" secret:"true" doc:"Token operators present to register relying parties and manage the service"`
+	WebhookSecret       string        `env:"WEBHOOK_SIGNING_SECRET" secret:"true" doc:"Key signing verification result callbacks"`
+	RPAuthDisabled      bool          `env:"RP_AUTH_DISABLED" doc:"Accept requests from unregistered relying parties"`
+	StatusListFailOpen  bool          `env:"STATUS_LIST_FAIL_OPEN" doc:"Accept credentials whose status list cannot be fetched"`
+	StatusListCacheTTL  time.Duration `env:"STATUS_LIST_CACHE_TTL" doc:"How long fetched status lists are cached"`
+	ResultCacheTTL      time.Duration `env:"VERIFICATION_CACHE_TTL" doc:"How long a verified SD-JWT credential is reused when presented again, with only its key binding checked; 0 disables the cache"`
+	MdocIACARoots       string        `env:"MDOC_IACA_ROOTS" doc:"PEM file of IACA roots trusted for mdoc presentations"`
+	ReceiptsLogURL      string        `env:"RECEIPTS_LOG_URL" doc:"Receipts log that verification receipts are anchored in, when they are not anchored through the event bus"`
+	ReceiptsLogKey      string        `env:"RECEIPTS_LOG_PUBLIC_KEY" doc:"PEM file of the receipts log's public key, against which the inclusion proofs of receipt anchors are checked; anchors without a signed tree head and inclusion proof are refused when it is set"`
+	RegistryURL         string        `env:"REGISTRY_URL" doc:"Registry serving packs and the trust list; built-in packs are used without it"`
+	RegistryJWKSURL     string        `env:"REGISTRY_JWKS_URL" doc:"Pinned JWKS verifying pack manifests, instead of the registry's own"`
+	PackCachePath       string        `env:"PACK_CACHE_PATH" doc:"File keeping the last-known-good packs across restarts"`
+	PackRefreshInterval time.Duration `env:"PACK_REFRESH_INTERVAL" doc:"How often packs are refreshed from the registry"`
+	ServiceAuth         serviceauth.Config
+	CORS                cors.Config
+	APIVersion          apiversion.Config
+	SecurityAudit       audit.Config
+	RateLimit           ratelimit.Config
+	Events              events.Config
+	Tenants             tenant.Config
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{
+		Base:                config.Base{Port: 8081},
+		Audience:            defaultVerifierAudience,
+		BaseURL:             defaultVerifierBaseURL,
+		StatusListCacheTTL:  defaultStatusCacheTTL,
+		PackRefreshInterval: defaultPackRefreshInterval,
+	}
+}
+
+// Validate checks the service authentication, durations, signing
+// certificate, CORS origins, legacy API sunset, security audit, rate limit,
+// event bus and tenants file are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if c.StatusListCacheTTL <= 0 {
+		return errors.New("STATUS_LIST_CACHE_TTL must be positive")
+	}
+	if c.ResultCacheTTL < 0 {
+		return errors.New("VERIFICATION_CACHE_TTL must not be negative")
+	}
+	if c.PackRefreshInterval <= 0 {
+		return errors.New("PACK_REFRESH_INTERVAL must be positive")
+	}
+	if c.SigningCertificate != "" && c.SigningKey == "" {
+		return errors.New("REQUEST_SIGNING_CERTIFICATE needs REQUEST_SIGNING_KEY")
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if err := c.APIVersion.Validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityAudit.Validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Events.Validate(); err != nil {
+		return err
+	}
+	return c.Tenants.Validate()
+}
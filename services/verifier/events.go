@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+// publishTimeout bounds how long completing a session waits on the bus
+const publishTimeout = 5 * time.Second
+
+// publishOutcome announces a completed session on the event bus, with the
+// receipt hash for the receipts-log to anchor and the badge for the
+// connector-hub to push. When the event cannot be published the receipt's
+// anchor is marked unaccepted, as when the receipts-log is down.
+func (s *Server) publishOutcome(session VerificationSession, outcome VerificationOutcome) {
+	if s.events == nil {
+		return
+	}
+	data := events.VerificationCompleted{
+		SessionID: session.ID,
+		PolicyID:  session.PolicyID,
+		RPID:      session.RPID,
+		Status:    outcome.Status,
+		Error:     outcome.Error,
+	}
+	if result := outcome.Result; result != nil {
+		data.Satisfied = result.Satisfied
+		data.Badge = &events.BadgeIssued{Label: result.Badge.Label, ExpiresAt: result.Badge.ExpiresAt, JWS: result.Badge.JWS}
+		if result.ReceiptAnchor != nil {
+			data.ReceiptHash = result.ReceiptAnchor.Hash
+			data.ReceiptHolder = holderDigest(result.Receipt.Holder)
+		}
+	}
+	event, err := events.New("verifier", session.ID, data, outcome.CompletedAt)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err = s.events.Publish(ctx, event)
+		cancel()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to publish verification.completed")
+		if outcome.Result != nil && outcome.Result.ReceiptAnchor != nil {
+			outcome.Result.ReceiptAnchor.Accepted = false
+		}
+		return
+	}
+	log.Info().Str("session_id", session.ID).Str("event_id", event.ID).Str("receipt_hash", data.ReceiptHash).Msg("Verification completion published")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// sseHeartbeat keeps idle event streams from being closed by proxies
+const sseHeartbeat = 15 * time.Second
+
+// SessionLink is what a relying party page renders to start a presentation:
+// a deep link for a wallet on the same device, or a QR code for one on another
+type SessionLink struct {
+	SessionID string `json:"sessionId"`
+	// DeepLink and QRPayload are the same OpenID4VP authorization request;
+	// request_uri keeps it short enough for a scannable QR code
+	DeepLink   string    `json:"deepLink"`
+	QRPayload  string    `json:"qrPayload"`
+	RequestURI string    `json:"requestUri"`
+	StatusURI  string    `json:"statusUri"`
+	EventsURI  string    `json:"eventsUri"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+func (s *Server) handleSessionStatus(w http.ResponseWriter, r *http.Request) {
+	status, ok := s.sessions.Status(chi.URLParam(r, "sessionId"), time.Now())
+	if !ok {
+		problem.Error(w, r, "Verification session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleSessionLink returns the deep link and QR payload of a session still
+// waiting for the wallet
+func (s *Server) handleSessionLink(w http.ResponseWriter, r *http.Request) {
+	session, err := s.sessions.Get(chi.URLParam(r, "sessionId"), time.Now())
+	if err != nil || !inTenant(r.Context(), session) {
+		problem.Error(w, r, "Verification session not found", http.StatusNotFound)
+		return
+	}
+	session = s.withEntryPoints(session)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, SessionLink{
+		SessionID:  session.ID,
+		DeepLink:   session.AuthorizationRequest,
+		QRPayload:  session.AuthorizationRequest,
+		RequestURI: session.RequestURI,
+		StatusURI:  s.tenantURL(session.Tenant) + "/verification-sessions/" + session.ID,
+		EventsURI:  s.tenantURL(session.Tenant) + "/verification-sessions/" + session.ID + "/events",
+		ExpiresAt:  session.ExpiresAt,
+	})
+}
+
+// handleSessionEvents streams the session's state as Server-Sent Events until
+// it is verified, fails or expires
+func (s *Server) handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "sessionId")
+	status, updates, stop, ok := s.sessions.Watch(id, time.Now())
+	if !ok {
+		problem.Error(w, r, "Verification session not found", http.StatusNotFound)
+		return
+	}
+	defer stop()
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout; not every writer supports this
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(status SessionStatus) error {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	expiry := time.NewTimer(time.Until(status.ExpiresAt))
+	defer expiry.Stop()
+
+	for {
+		if err := send(status); err != nil {
+			log.Debug().Err(err).Str("session_id", id).Msg("Session event stream closed")
+			return
+		}
+		if status.Terminal() {
+			return
+		}
+
+		next := false
+		for !next {
+			select {
+			case <-r.Context().Done():
+				return
+			case status = <-updates:
+				next = true
+			case <-expiry.C:
+				// Only a session still waiting for the wallet expires
+				status, _ = s.sessions.Status(id, time.Now())
+				next = status.State == SessionExpired
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
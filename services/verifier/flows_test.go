@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getStatus(t *testing.T, server *Server, sessionID string) SessionStatus {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/verification-sessions/"+sessionID, nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status SessionStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+func verifySession(t testing.TB, server *Server, issuer *testIssuer, session VerificationSession) *httptest.ResponseRecorder {
+	t.Helper()
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	return verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+}
+
+func TestSessionStatus_StateMachine(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	status := getStatus(t, server, session.ID)
+	assert.Equal(t, SessionPending, status.State)
+	assert.Equal(t, "pack.safe.seller@0.1.0", status.PolicyID)
+
+	w := verifySession(t, server, issuer, session)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, SessionVerified, getStatus(t, server, session.ID).State)
+
+	// The result itself stays with the relying party
+	code, outcome := getOutcome(t, server, session.ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OutcomeVerified, outcome.Status)
+}
+
+func TestSessionStatus_FailedAndExpired(t *testing.T) {
+	server := NewServer()
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	w := verifyWithProfile(t, server, session, "a.b.c~")
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, SessionFailed, getStatus(t, server, session.ID).State)
+
+	expired, err := server.sessions.Create(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"}, tenant.DefaultID, "", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, SessionExpired, getStatus(t, server, expired.ID).State)
+
+	req := httptest.NewRequest(http.MethodGet, "/verification-sessions/unknown", nil)
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSessionLink(t *testing.T) {
+	server := NewServer()
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	req := httptest.NewRequest(http.MethodGet, "/verification-sessions/"+session.ID+"/link", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var link SessionLink
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, session.AuthorizationRequest, link.DeepLink)
+	assert.Equal(t, link.DeepLink, link.QRPayload)
+	assert.True(t, strings.HasPrefix(link.QRPayload, openID4VPScheme))
+	assert.Equal(t, defaultVerifierBaseURL+"/v1/verification-sessions/"+session.ID+"/events", link.EventsURI)
+
+	// Once the wallet has answered there is nothing left to scan
+	_, err := server.sessions.Consume(session.ID, time.Now())
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verification-sessions/"+session.ID+"/link", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSameDeviceFlow_RedirectsWalletBack(t *testing.T) {
+	server := NewServer()
+
+	body, err := json.Marshal(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", RedirectURI: "http://evil.example/back"})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	body, err = json.Marshal(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", RedirectURI: "https://shop.example/checkout"})
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+
+	w = postForm(t, server, "/openid4vp/response", url.Values{"state": {session.ID}, "error": {"access_denied"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "https://shop.example/checkout", resp["redirect_uri"])
+	assert.Equal(t, SessionFailed, getStatus(t, server, session.ID).State)
+}
+
+func TestSessionEvents_StreamsUntilVerified(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/verification-sessions/" + session.ID + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan SessionStatus)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var status SessionStatus
+			if json.Unmarshal([]byte(data), &status) == nil {
+				events <- status
+			}
+		}
+	}()
+
+	first := <-events
+	assert.Equal(t, SessionPending, first.State)
+
+	w := verifySession(t, server, issuer, session)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var last SessionStatus
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case status, open := <-events:
+			if !open {
+				done = true
+				break
+			}
+			last = status
+		case <-timeout:
+			t.Fatal("event stream did not end after verification")
+		}
+	}
+	assert.Equal(t, SessionVerified, last.State)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// FreshnessStale summarizes a presentation that broke its pack's freshness
+// policy; FreshnessDiagnostics says which limits
+const FreshnessStale = "stale"
+
+// Freshness diagnostic codes
+const (
+	DiagnosticStaleCredential = "stale_credential" // credential issued too long ago
+	DiagnosticOldVerification = "old_verification" // identity verified too long ago
+	DiagnosticClockSkew       = "clock_skew"       // KB-JWT iat too far from the verifier's clock
+)
+
+// idvTimestampClaim is where Cachet identity credentials record when the
+// IDV session behind them took place
+const idvTimestampClaim = "verificationMetrics.sessionTimestamp"
+
+// Duration is a time.Duration written as Go duration text ("2160h") in pack
+// definitions
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("duration %s is negative", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// FreshnessPolicy bounds how old the evidence behind a presentation may be.
+// A zero limit is not enforced.
+type FreshnessPolicy struct {
+	MaxCredentialAge   Duration `json:"maxCredentialAge,omitempty" yaml:"maxCredentialAge,omitempty"`
+	MaxVerificationAge Duration `json:"maxVerificationAge,omitempty" yaml:"maxVerificationAge,omitempty"`
+	MaxClockSkew       Duration `json:"maxClockSkew,omitempty" yaml:"maxClockSkew,omitempty"`
+}
+
+// FreshnessDiagnostic explains one freshness limit a presentation exceeded
+type FreshnessDiagnostic struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Limit   string `json:"limit"`
+	Actual  string `json:"actual,omitempty"` // empty when the time is unknown
+}
+
+// Evaluate checks a verified presentation against the policy
+func (p FreshnessPolicy) Evaluate(v VerifiedSDJWT, now time.Time) []FreshnessDiagnostic {
+	var diagnostics []FreshnessDiagnostic
+	if limit := time.Duration(p.MaxCredentialAge); limit > 0 {
+		switch {
+		case v.IssuedAt.IsZero():
+			diagnostics = append(diagnostics, unknownFreshness(DiagnosticStaleCredential, "credential has no issuance time", limit))
+		case now.Sub(v.IssuedAt) > limit:
+			diagnostics = append(diagnostics, staleFreshness(DiagnosticStaleCredential, "credential", now.Sub(v.IssuedAt), limit))
+		}
+	}
+	if limit := time.Duration(p.MaxVerificationAge); limit > 0 {
+		verifiedAt, ok := identityVerifiedAt(v)
+		switch {
+		case !ok:
+			diagnostics = append(diagnostics, unknownFreshness(DiagnosticOldVerification, "identity verification time is unknown", limit))
+		case now.Sub(verifiedAt) > limit:
+			diagnostics = append(diagnostics, staleFreshness(DiagnosticOldVerification, "identity verification", now.Sub(verifiedAt), limit))
+		}
+	}
+	// Only key-bound SD-JWTs carry a presentation time
+	if limit := time.Duration(p.MaxClockSkew); limit > 0 && !v.PresentedAt.IsZero() {
+		if skew := now.Sub(v.PresentedAt).Abs(); skew > limit {
+			diagnostics = append(diagnostics, FreshnessDiagnostic{
+				Code:    DiagnosticClockSkew,
+				Message: fmt.Sprintf("key binding JWT iat is %s away from the verifier clock", skew.Round(time.Second)),
+				Limit:   limit.String(),
+				Actual:  skew.Round(time.Second).String(),
+			})
+		}
+	}
+	return diagnostics
+}
+
+func staleFreshness(code, subject string, age, limit time.Duration) FreshnessDiagnostic {
+	return FreshnessDiagnostic{
+		Code:    code,
+		Message: fmt.Sprintf("%s is %s old, more than the %s the pack allows", subject, age.Round(time.Second), limit),
+		Limit:   limit.String(),
+		Actual:  age.Round(time.Second).String(),
+	}
+}
+
+func unknownFreshness(code, message string, limit time.Duration) FreshnessDiagnostic {
+	return FreshnessDiagnostic{Code: code, Message: message, Limit: limit.String()}
+}
+
+// identityVerifiedAt is when the IDV session behind the credential took place.
+// Without a disclosed session time the issuance time bounds it, as the
+// gateway issues as soon as the IDV session completes.
+func identityVerifiedAt(v VerifiedSDJWT) (time.Time, bool) {
+	for _, root := range []map[string]interface{}{v.Claims, subjectClaims(v.Claims)} {
+		if value, ok := lookupClaim(root, idvTimestampClaim); ok {
+			if at, ok := normalizeClaim(value).(time.Time); ok {
+				return at, true
+			}
+		}
+	}
+	return v.IssuedAt, !v.IssuedAt.IsZero()
+}
+
+// summarizeFreshness folds the pack's freshness diagnostics into the status
+// list result: revocation states win, then staleness
+func summarizeFreshness(status string, diagnostics []FreshnessDiagnostic) string {
+	if status == FreshnessSuspended || len(diagnostics) == 0 {
+		return status
+	}
+	return FreshnessStale
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreshnessPolicy_Evaluate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	policy := FreshnessPolicy{
+		MaxCredentialAge:   Duration(90 * 24 * time.Hour),
+		MaxVerificationAge: Duration(365 * 24 * time.Hour),
+		MaxClockSkew:       Duration(2 * time.Minute),
+	}
+	codes := func(diagnostics []FreshnessDiagnostic) []string {
+		var out []string
+		for _, d := range diagnostics {
+			out = append(out, d.Code)
+		}
+		return out
+	}
+
+	fresh := VerifiedSDJWT{IssuedAt: now.Add(-24 * time.Hour), PresentedAt: now.Add(-10 * time.Second)}
+	assert.Empty(t, policy.Evaluate(fresh, now))
+
+	stale := VerifiedSDJWT{IssuedAt: now.Add(-100 * 24 * time.Hour), PresentedAt: now}
+	diagnostics := policy.Evaluate(stale, now)
+	assert.Equal(t, []string{DiagnosticStaleCredential}, codes(diagnostics))
+	assert.Equal(t, "2160h0m0s", diagnostics[0].Limit)
+	assert.Equal(t, "2400h0m0s", diagnostics[0].Actual)
+
+	// The IDV session time is read from the credential when disclosed
+	oldIDV := VerifiedSDJWT{
+		IssuedAt: now.Add(-24 * time.Hour),
+		Claims: map[string]interface{}{"credentialSubject": map[string]interface{}{
+			"verificationMetrics": map[string]interface{}{"sessionTimestamp": "2024-09-01T10:00:00Z"},
+		}},
+	}
+	assert.Equal(t, []string{DiagnosticOldVerification}, codes(policy.Evaluate(oldIDV, now)))
+
+	skewed := VerifiedSDJWT{IssuedAt: now.Add(-time.Hour), PresentedAt: now.Add(10 * time.Minute)}
+	assert.Equal(t, []string{DiagnosticClockSkew}, codes(policy.Evaluate(skewed, now)))
+
+	// Unknown times cannot prove freshness; mdocs carry no presentation time
+	assert.Equal(t, []string{DiagnosticStaleCredential, DiagnosticOldVerification}, codes(policy.Evaluate(VerifiedSDJWT{}, now)))
+	assert.Empty(t, FreshnessPolicy{}.Evaluate(VerifiedSDJWT{}, now))
+}
+
+func TestFreshnessPolicy_JSON(t *testing.T) {
+	var policy FreshnessPolicy
+	require.NoError(t, json.Unmarshal([]byte(`{"maxCredentialAge":"2160h","maxClockSkew":"90s"}`), &policy))
+	assert.Equal(t, Duration(2160*time.Hour), policy.MaxCredentialAge)
+	assert.Equal(t, Duration(90*time.Second), policy.MaxClockSkew)
+
+	encoded, err := json.Marshal(policy)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"maxCredentialAge":"2160h0m0s","maxClockSkew":"1m30s"}`, string(encoded))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"maxClockSkew":"-1m"}`), &policy))
+	assert.Error(t, json.Unmarshal([]byte(`{"maxClockSkew":"soon"}`), &policy))
+}
+
+func TestVerifyPresentation_StaleCredential(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	issuedAt := time.Now().Add(-200 * 24 * time.Hour)
+	issuerJWT, disclosures := issuer.issue(t, map[string]interface{}{"iat": issuedAt.Unix()}, map[string]interface{}{
+		"identity_liveness": true, "platform_tenure_months_max": 12, "fulfilment_rate": 0.99,
+	})
+	w := verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, FreshnessStale, resp.Freshness)
+	require.Len(t, resp.FreshnessDiagnostics, 1)
+	assert.Equal(t, DiagnosticStaleCredential, resp.FreshnessDiagnostics[0].Code)
+	assert.Equal(t, "4320h0m0s", resp.FreshnessDiagnostics[0].Limit)
+
+	// Every rule passed, but the evidence is too old for the pack
+	for _, result := range resp.Results {
+		assert.True(t, result.Passed || !result.Required, result.ID)
+	}
+	assert.False(t, resp.Satisfied)
+	assert.False(t, resp.Badge.Satisfied)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+)
+
+var ErrIssuerKeyNotFound = errors.New("issuer key not found")
+
+// JWK is the subset of RFC 7517 needed for issuer and holder keys
+type JWK = didresolver.JWK
+
+// IssuerKeyResolver finds the public key an issuer signed a credential with
+type IssuerKeyResolver interface {
+	ResolveKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error)
+}
+
+// StaticKeyResolver serves pinned issuer keys, keyed by issuer then kid
+type StaticKeyResolver map[string]map[string]crypto.PublicKey
+
+func (r StaticKeyResolver) ResolveKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	keys := r[issuer]
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s#%s", ErrIssuerKeyNotFound, issuer, kid)
+}
+
+// didKeyResolver resolves issuers identified by a DID (did:web, did:jwk).
+// Only keys listed under assertionMethod may sign credentials.
+type didKeyResolver struct {
+	dids *didresolver.Resolver
+}
+
+func newDIDKeyResolver() *didKeyResolver {
+	return &didKeyResolver{dids: didresolver.New()}
+}
+
+func (r *didKeyResolver) ResolveKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	jwk, err := r.dids.ResolveKey(ctx, issuer, kid)
+	if errors.Is(err, didresolver.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s#%s", ErrIssuerKeyNotFound, issuer, kid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jwk.PublicKey()
+}
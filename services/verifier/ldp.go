@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+)
+
+// FormatLDPVC is a W3C credential secured with a data integrity proof. The
+// wallet presents a credential derived from the BBS-signed one for the
+// session, disclosing only the claims the pack needs: a fresh proof each
+// time, so presentations of the same credential cannot be linked.
+const FormatLDPVC = "ldp_vc"
+
+// bbsAlgorithm names BBS proofs among a presentation's algorithms
+const bbsAlgorithm = "BBS"
+
+// ldpRequiredStatements are disclosed by every derived credential: who
+// issued it, what it is and until when it is valid. Issuers round the
+// expiry down to the day so it does not single out the credential.
+var ldpRequiredStatements = []string{"issuer", "type", "expirationDate"}
+
+// ldpCorrelators are the statements unique to one credential. Disclosing any
+// of them links the presentation to every other one disclosing it.
+var ldpCorrelators = []string{"id", "issuanceDate", "credentialStatus", "evidence", "cnf"}
+
+// ldpEnvelope reads the type of a derived credential, given as a JSON object
+// or its encoding, without verifying it
+func ldpEnvelope(presentation interface{}) (PresentationEnvelope, error) {
+	var raw []byte
+	switch p := presentation.(type) {
+	case string:
+		raw = []byte(p)
+	case map[string]interface{}:
+		raw, _ = json.Marshal(p)
+	default:
+		return PresentationEnvelope{}, errUnrecognizedBundle
+	}
+	var credential struct {
+		Type []string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &credential); err != nil {
+		return PresentationEnvelope{}, fmt.Errorf("%w: %v", errUnrecognizedBundle, err)
+	}
+	return PresentationEnvelope{
+		Format:         FormatLDPVC,
+		Presentation:   string(raw),
+		Algorithm:      bbsAlgorithm,
+		CredentialType: ldpType(credential.Type),
+	}, nil
+}
+
+// ldpType is the most specific of a credential's types
+func ldpType(types []string) string {
+	for i := len(types) - 1; i >= 0; i-- {
+		if types[i] != "VerifiableCredential" {
+			return types[i]
+		}
+	}
+	return ""
+}
+
+// ldpPresentationHeader binds a derived proof to one session, as the KB-JWT
+// nonce and aud bind an SD-JWT presentation
+func ldpPresentationHeader(kb KeyBindingExpectations) []byte {
+	header, _ := json.Marshal(struct {
+		Aud   string `json:"aud"`
+		Nonce string `json:"nonce"`
+	}{kb.Audience, kb.Nonce})
+	return header
+}
+
+// VerifyLDP verifies a BBS-derived ldp_vc against its issuer's key and the
+// session it answers
+func VerifyLDP(ctx context.Context, presentation string, keys IssuerKeyResolver, kb KeyBindingExpectations, now time.Time) (VerifiedSDJWT, error) {
+	var credential map[string]interface{}
+	if err := json.Unmarshal([]byte(presentation), &credential); err != nil {
+		return VerifiedSDJWT{}, invalidf("ldp_vc is not a JSON object: %v", err)
+	}
+	proof, err := bbs.ProofOf(credential)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("%v", err)
+	}
+	if kb.Required {
+		// A derived proof proves the issuer's signature, not who presents it
+		return VerifiedSDJWT{}, invalidf("key binding JWT required")
+	}
+	for _, name := range ldpRequiredStatements {
+		if _, ok := credential[name]; !ok {
+			return VerifiedSDJWT{}, invalidf("%s is not disclosed", name)
+		}
+	}
+
+	issuer, _ := credential["issuer"].(string)
+	did, kid, _ := strings.Cut(proof.VerificationMethod, "#")
+	if issuer == "" || did != issuer {
+		return VerifiedSDJWT{}, invalidf("verification method %q is not the issuer's", proof.VerificationMethod)
+	}
+	key, err := keys.ResolveKey(ctx, issuer, kid)
+	if isTrustError(err) {
+		return VerifiedSDJWT{}, err
+	}
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("issuer signature: %v", err)
+	}
+	bbsKey, ok := key.(*bbs.PublicKey)
+	if !ok {
+		return VerifiedSDJWT{}, invalidf("issuer key %s is not a BBS key", proof.VerificationMethod)
+	}
+	if err := bbs.VerifyDerivedCredential(bbsKey, credential, ldpPresentationHeader(kb)); err != nil {
+		return VerifiedSDJWT{}, invalidf("issuer signature: %v", err)
+	}
+
+	verified := VerifiedSDJWT{
+		Issuer:     issuer,
+		Claims:     credential,
+		Algorithms: []string{bbsAlgorithm},
+		Unlinkable: true,
+	}
+	delete(verified.Claims, "proof")
+	if types, ok := credential["type"].([]interface{}); ok {
+		names := make([]string, 0, len(types))
+		for _, t := range types {
+			name, _ := t.(string)
+			names = append(names, name)
+		}
+		verified.Vct = ldpType(names)
+	}
+	expiry, _ := credential["expirationDate"].(string)
+	if verified.ExpiresAt, err = time.Parse(time.RFC3339, expiry); err != nil {
+		return VerifiedSDJWT{}, invalidf("expirationDate %q is not a time", expiry)
+	}
+	if now.After(verified.ExpiresAt.Add(issuerClockSkew)) {
+		return VerifiedSDJWT{}, invalidf("credential expired at %s", expiry)
+	}
+	if issued, ok := credential["issuanceDate"].(string); ok {
+		verified.IssuedAt, _ = time.Parse(time.RFC3339, issued)
+	}
+
+	for _, name := range ldpCorrelators {
+		if _, ok := credential[name]; ok {
+			verified.Unlinkable = false
+		}
+	}
+	subject, _ := credential["credentialSubject"].(map[string]interface{})
+	for name := range subject {
+		if name == "id" {
+			verified.Unlinkable = false
+		}
+		verified.Disclosed = append(verified.Disclosed, name)
+	}
+	sort.Strings(verified.Disclosed)
+	return verified, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bbsIssuer signs ldp_vc credentials as the test issuer
+type bbsIssuer struct {
+	key *bbs.PrivateKey
+}
+
+func newBBSIssuer(t testing.TB) *bbsIssuer {
+	t.Helper()
+	key, err := bbs.GenerateKey(nil)
+	require.NoError(t, err)
+	return &bbsIssuer{key: key}
+}
+
+func (i *bbsIssuer) resolver() StaticKeyResolver {
+	return StaticKeyResolver{testIssuerDID: {"bbs-1": i.key.Public()}}
+}
+
+// issue signs an AgeOverCredential for subject, expiring at expiry
+func (i *bbsIssuer) issue(t testing.TB, subject map[string]interface{}, expiry time.Time) map[string]interface{} {
+	t.Helper()
+	credential := map[string]interface{}{
+		"@context":          []interface{}{"https://www.w3.org/2018/credentials/v1"},
+		"id":                "urn:uuid:5b1e6c1e-8a57-4c38-9f0c-0d6a3c1f2b7e",
+		"type":              []interface{}{"VerifiableCredential", "AgeOverCredential"},
+		"issuer":            testIssuerDID,
+		"issuanceDate":      time.Now().UTC().Format(time.RFC3339),
+		"expirationDate":    expiry.UTC().Format(time.RFC3339),
+		"credentialSubject": subject,
+		"credentialStatus": []interface{}{map[string]interface{}{
+			"type": statusEntryType, "statusListIndex": "7", "statusListCredential": "https://cachet.id/status/1",
+		}},
+	}
+	proof, err := bbs.SignCredential(i.key, credential, bbs.Proof{VerificationMethod: testIssuerDID + "#bbs-1"})
+	require.NoError(t, err)
+	credential["proof"] = proof
+	return credential
+}
+
+// present derives a credential disclosing the given statements, for session
+func (i *bbsIssuer) present(t testing.TB, credential map[string]interface{}, session VerificationSession, disclose ...string) string {
+	t.Helper()
+	disclose = append([]string{"/issuer", "/type", "/expirationDate"}, disclose...)
+	header := ldpPresentationHeader(KeyBindingExpectations{Nonce: session.Nonce, Audience: session.Audience})
+	derived, err := bbs.DeriveCredential(i.key.Public(), credential, disclose, header)
+	require.NoError(t, err)
+	raw, err := json.Marshal(derived)
+	require.NoError(t, err)
+	return string(raw)
+}
+
+func TestVerifyLDP(t *testing.T) {
+	issuer := newBBSIssuer(t)
+	session := VerificationSession{Nonce: "nonce-1", Audience: defaultVerifierAudience}
+	kb := KeyBindingExpectations{Nonce: session.Nonce, Audience: session.Audience}
+	credential := issuer.issue(t, map[string]interface{}{
+		"id": "did:example:holder", "birthdate": "1990-04-01", "age_over_18": true,
+	}, time.Now().Add(24*time.Hour))
+
+	presentation := issuer.present(t, credential, session, "/credentialSubject/age_over_18")
+	verified, err := VerifyLDP(context.Background(), presentation, issuer.resolver(), kb, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, testIssuerDID, verified.Issuer)
+	assert.Equal(t, "AgeOverCredential", verified.Vct)
+	assert.Equal(t, []string{"age_over_18"}, verified.Disclosed)
+	assert.Equal(t, []string{bbsAlgorithm}, verified.Algorithms)
+	assert.True(t, verified.Unlinkable)
+	assert.NotContains(t, verified.Claims, "proof")
+
+	// Each of these is unique to the credential, so links its presentations
+	for _, pointer := range []string{"/id", "/credentialStatus", "/credentialSubject/id"} {
+		linked, err := VerifyLDP(context.Background(), issuer.present(t, credential, session, pointer), issuer.resolver(), kb, time.Now())
+		require.NoError(t, err, pointer)
+		assert.False(t, linked.Unlinkable, pointer)
+	}
+
+	tests := []struct {
+		name string
+		kb   KeyBindingExpectations
+		keys StaticKeyResolver
+		now  time.Time
+	}{
+		{"other session", KeyBindingExpectations{Nonce: "nonce-2", Audience: session.Audience}, issuer.resolver(), time.Now()},
+		{"other issuer key", kb, newBBSIssuer(t).resolver(), time.Now()},
+		{"expired", kb, issuer.resolver(), time.Now().Add(48 * time.Hour)},
+		{"key binding required", KeyBindingExpectations{Nonce: kb.Nonce, Audience: kb.Audience, Required: true}, issuer.resolver(), time.Now()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyLDP(context.Background(), presentation, tt.keys, tt.kb, tt.now)
+			assert.ErrorIs(t, err, ErrInvalidPresentation)
+		})
+	}
+
+	header := ldpPresentationHeader(kb)
+	derived, err := bbs.DeriveCredential(issuer.key.Public(), credential, []string{"/issuer", "/type", "/credentialSubject/age_over_18"}, header)
+	require.NoError(t, err)
+	raw, err := json.Marshal(derived)
+	require.NoError(t, err)
+	_, err = VerifyLDP(context.Background(), string(raw), issuer.resolver(), kb, time.Now())
+	assert.ErrorContains(t, err, "expirationDate is not disclosed")
+}
+
+func TestParsePresentationEnvelope_LDP(t *testing.T) {
+	issuer := newBBSIssuer(t)
+	credential := issuer.issue(t, map[string]interface{}{"age_over_18": true}, time.Now().Add(time.Hour))
+	presentation := issuer.present(t, credential, VerificationSession{Nonce: "n"}, "/credentialSubject/age_over_18")
+
+	var derived map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(presentation), &derived))
+	for _, given := range []interface{}{presentation, derived} {
+		envelope, err := parsePresentationEnvelope(map[string]interface{}{"format": FormatLDPVC, "presentation": given})
+		require.NoError(t, err)
+		assert.Equal(t, FormatLDPVC, envelope.Format)
+		assert.Equal(t, "AgeOverCredential", envelope.CredentialType)
+		assert.Equal(t, bbsAlgorithm, envelope.Algorithm)
+		assert.False(t, envelope.HasKeyBinding)
+	}
+}
+
+// zkAgePack requires an unlinkable proof of age over 18
+func zkAgePack(t *testing.T) []Pack {
+	t.Helper()
+	packs, err := compilePacks([]Pack{{
+		ID: "pack.age.zk@0.1.0", Version: "0.1.0", Name: "Age check",
+		Predicates: []PackPredicate{
+			{ID: "age.ge.18", Claim: "age", Operator: ">=", Value: 18, ProofType: ProofTypeBBS, ZK: true},
+		},
+	}})
+	require.NoError(t, err)
+	return packs
+}
+
+func TestVerifyPresentation_ZKPredicate(t *testing.T) {
+	server := NewServer()
+	server.packs.Replace(zkAgePack(t))
+	issuer := newBBSIssuer(t)
+	server.issuerKeys = issuer.resolver()
+	server.trust = newStaticTrustList([]TrustedIssuer{{DID: testIssuerDID, CredentialTypes: []string{"AgeOverCredential"}, Status: IssuerStatusActive}})
+	credential := issuer.issue(t, map[string]interface{}{"birthdate": "1990-04-01", "age_over_18": true}, time.Now().Add(24*time.Hour))
+
+	session := createSession(t, server, "pack.age.zk@0.1.0")
+	w := verifyWithProfile(t, server, session, map[string]interface{}{
+		"format": FormatLDPVC, "presentation": issuer.present(t, credential, session, "/credentialSubject/age_over_18"),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Satisfied, resp.Results)
+
+	// The same claim disclosed alongside the credential id makes the
+	// presentation linkable
+	session = createSession(t, server, "pack.age.zk@0.1.0")
+	w = verifyWithProfile(t, server, session, map[string]interface{}{
+		"format": FormatLDPVC, "presentation": issuer.present(t, credential, session, "/credentialSubject/age_over_18", "/id"),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Satisfied)
+	assert.Equal(t, "age_over_18 == true needs an unlinkable proof", resp.Results[0].Reason)
+}
+
+func TestVerifyPresentation_ZKPredicateRejectsSDJWT(t *testing.T) {
+	server := NewServer()
+	server.packs.Replace(zkAgePack(t))
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	session := createSession(t, server, "pack.age.zk@0.1.0")
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	w := verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Satisfied)
+	assert.Equal(t, "age_over_18 == true needs an unlinkable proof", resp.Results[0].Reason)
+}
+
+func TestPackDefinition_ZKPredicate(t *testing.T) {
+	server := NewServer()
+	def := server.packDefinition(zkAgePack(t)[0])
+	descriptor := def.InputDescriptors[0]
+	assert.Equal(t, zkFormats(), descriptor.Format)
+	assert.Equal(t, "required", descriptor.Constraints.LimitDisclosure)
+	assert.Equal(t, []string{"$.age_over_18", "$.credentialSubject.age_over_18"}, descriptor.Constraints.Fields[0].Path)
+	assert.Equal(t, map[string]interface{}{"type": "boolean", "const": true}, descriptor.Constraints.Fields[0].Filter)
+}
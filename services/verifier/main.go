@@ -1,26 +1,157 @@
 package main
 
 import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"os"
 )
 
 func main() {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
 	// Configure structured logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if os.Getenv("ENVIRONMENT") == "development" {
+	if cfg.Development() {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
+	exporting, err := tracing.Init(context.Background(), "verifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+
+	profile, err := LookupProfile(cfg.ComplianceProfile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid compliance profile")
+	}
+
+	auth, err := serviceauth.New("verifier", cfg.ServiceAuth)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
 	}
 
-	server := NewServer()
-	log.Info().Str("port", port).Msg("Starting verifier service")
-	if err := server.Start(":" + port); err != nil {
+	server := NewServerWithProfile(profile)
+	server.audience = cfg.Audience
+	server.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if cfg.SigningKey != "" {
+		key, err := signing.LoadKey(cfg.SigningKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid REQUEST_SIGNING_KEY")
+		}
+		if server.requestSigner, err = newRequestSignerWithKey(key); err != nil {
+			log.Fatal().Err(err).Msg("Invalid REQUEST_SIGNING_KEY")
+		}
+		if cfg.SigningCertificate != "" {
+			if err := server.certifySigner(server.requestSigner, cfg.SigningCertificate); err != nil {
+				log.Fatal().Err(err).Msg("Invalid REQUEST_SIGNING_CERTIFICATE")
+			}
+			log.Info().Str("client_id", server.requestSigner.clientID).Msg("Authenticating request objects under the x509_san_dns client_id scheme")
+		}
+	}
+	server.status.failOpen = cfg.StatusListFailOpen
+	server.status.ttl = cfg.StatusListCacheTTL
+	server.operatorToken = cfg.OperatorToken
+	server.openapi.ValidateResponses = cfg.Development()
+	server.cors.Set(cfg.CORS)
+	server.versions.Set(cfg.APIVersion)
+	if server.security, err = audit.Open("verifier", cfg.SecurityAudit, auth, nil); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the security audit trail")
+	}
+	if cfg.SecurityAudit.AnchorURL == "" {
+		log.Warn().Msg("SECURITY_AUDIT_ANCHOR_URL is unset, so security audit batches are sealed but not anchored")
+	}
+	limits, err := ratelimit.Open(cfg.RateLimit, "verifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid rate limit configuration")
+	}
+	server.rateLimit.Set(limits, cfg.RateLimit.Limit(), ratelimit.ByClient(server.rateLimitClient, cfg.RateLimit.TrustedProxies))
+	server.callbackSigningSecret = []byte(cfg.WebhookSecret)
+	server.requireRPAuth = !cfg.RPAuthDisabled
+	if server.requireRPAuth && server.operatorToken == "" {
+		log.Warn().Msg("RP authentication is required but OPERATOR_API_TOKEN is unset, so no relying party can be registered")
+	}
+	if cfg.MdocIACARoots != "" {
+		if server.mdocRoots, err = LoadIACARoots(cfg.MdocIACARoots); err != nil {
+			log.Fatal().Err(err).Msg("Invalid MDOC_IACA_ROOTS")
+		}
+	}
+	if server.events, err = events.Open(cfg.Events); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the event bus")
+	}
+	if server.results = newResultCache(cfg.ResultCacheTTL); server.results != nil {
+		if server.events == nil {
+			log.Warn().Msg("EVENT_BUS_URL is unset, so cached verification results only see revocations once status lists are fetched again")
+		} else if err := server.events.Subscribe(resultCacheGroup(), credentialStatusEvents, server.consumeCredentialStatus); err != nil {
+			log.Fatal().Err(err).Msg("Failed to subscribe to credential status events")
+		}
+	}
+	tenants, err := tenant.Load[tenantSettings](cfg.Tenants)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load tenants")
+	}
+	if err := server.setTenants(tenants); err != nil {
+		log.Fatal().Err(err).Msg("Invalid tenant verifier settings")
+	}
+	if len(tenants) > 0 {
+		log.Info().Int("tenants", len(tenants)).Msg("Verifying for the tenants of TENANTS_CONFIG")
+	}
+	if err := server.checkProfile(); err != nil {
+		log.Fatal().Err(err).Msg("Request objects do not meet the compliance profile")
+	}
+	if cfg.ReceiptsLogURL != "" {
+		server.receipts = newReceiptsLog(cfg.ReceiptsLogURL, auth)
+		if cfg.ReceiptsLogKey != "" {
+			data, err := os.ReadFile(cfg.ReceiptsLogKey)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to read RECEIPTS_LOG_PUBLIC_KEY")
+			}
+			if server.receipts.key, err = logproof.ParsePublicKey(data); err != nil {
+				log.Fatal().Err(err).Msg("Invalid RECEIPTS_LOG_PUBLIC_KEY")
+			}
+		}
+		server.health.Observe("receipts-log", health.HTTP(server.receipts.url+"/health"))
+	}
+	if cfg.RegistryURL != "" {
+		server.trust = newRegistryTrustList(cfg.RegistryURL)
+		server.health.Observe("registry", health.HTTP(strings.TrimSuffix(cfg.RegistryURL, "/")+"/health"))
+		server.packSource = newRegistryPacks(cfg.RegistryURL, cfg.PackCachePath)
+		// Pinning the JWKS elsewhere keeps a compromised registry host from
+		// vouching for its own manifests
+		if cfg.RegistryJWKSURL != "" {
+			server.packSource.keys = newRegistryKeys(cfg.RegistryJWKSURL)
+		}
+		server.packRefreshInterval = cfg.PackRefreshInterval
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := server.refreshPacks(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to load packs from registry")
+			if err := server.loadCachedPacks(); err != nil {
+				log.Warn().Err(err).Msg("No last-known-good packs, using built-in packs")
+			}
+		}
+		cancel()
+	}
+	log.Info().Int("port", cfg.Port).Str("profile", profile.Name).Msg("Starting verifier service")
+	if err := server.Start(cfg.Addr()); err != nil {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// policyManifestType is the typ of the registry's signed policy manifest
+	policyManifestType = "policy-manifest+jwt"
+	// packSignatureType is the typ of the registry's signature of one pack
+	packSignatureType = "cachet-pack+jwt"
+	maxJWKSSize       = 1 << 20
+)
+
+var (
+	ErrManifestSignature = errors.New("policy manifest signature is invalid")
+	ErrPackIntegrity     = errors.New("pack is unsigned or does not match its signature")
+)
+
+// registryKeys holds the registry's manifest signing keys, fetched from its
+// JWKS and refetched when a manifest names a key not seen yet (rotation)
+type registryKeys struct {
+	jwksURL string
+	client  *http.Client
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey // kid -> key
+	jwks []JWK                       // the keys as published
+}
+
+func newRegistryKeys(jwksURL string) *registryKeys {
+	return &registryKeys{jwksURL: jwksURL, client: deadline.NewClient("registry")}
+}
+
+func (k *registryKeys) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if err := k.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("fetching registry keys: %w", err)
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("registry key %q is not in %s", kid, k.jwksURL)
+}
+
+func (k *registryKeys) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %d for its JWKS", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&jwks); err != nil {
+		return fmt.Errorf("registry JWKS is malformed: %w", err)
+	}
+	k.set(jwks.Keys)
+	return nil
+}
+
+func (k *registryKeys) set(jwks []JWK) {
+	k.keys = make(map[string]crypto.PublicKey, len(jwks))
+	k.jwks = k.jwks[:0:0]
+	for _, jwk := range jwks {
+		key, err := jwk.PublicKey()
+		if err != nil || jwk.Kid == "" {
+			continue
+		}
+		k.keys[jwk.Kid] = key
+		k.jwks = append(k.jwks, jwk)
+	}
+}
+
+// known returns the keys last fetched, to cache them with the packs
+func (k *registryKeys) known() []JWK {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]JWK(nil), k.jwks...)
+}
+
+// seed uses cached keys until the registry's JWKS is fetched
+func (k *registryKeys) seed(jwks []JWK) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.set(jwks)
+	}
+}
+
+type manifestClaims struct {
+	Manifest json.RawMessage `json:"manifest"`
+	jwt.RegisteredClaims
+}
+
+// verifyManifest checks the manifest JWS against the registry keys and
+// returns the manifest it carries
+func (k *registryKeys) verifyManifest(ctx context.Context, jws string) (json.RawMessage, error) {
+	var claims manifestClaims
+	_, err := jwt.ParseWithClaims(jws, &claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != policyManifestType {
+			return nil, fmt.Errorf("typ %q is not %s", typ, policyManifestType)
+		}
+		kid, _ := token.Header["kid"].(string)
+		return k.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"ES256", "ES384", "ES512"}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrManifestSignature, err)
+	}
+	if len(claims.Manifest) == 0 {
+		return nil, fmt.Errorf("%w: no manifest claim", ErrManifestSignature)
+	}
+	return claims.Manifest, nil
+}
+
+type packSignatureClaims struct {
+	Digest string `json:"digest"`
+	jwt.RegisteredClaims
+}
+
+// verifyManifestPacks checks every pack of a policy manifest before any is
+// applied: its digest must be that of the pack as received, and signed by
+// the registry for that pack. Unsigned or altered packs fail the whole set.
+func (k *registryKeys) verifyManifestPacks(ctx context.Context, manifest []byte) error {
+	var list struct {
+		Packs []json.RawMessage `json:"packs"`
+	}
+	if err := json.Unmarshal(manifest, &list); err != nil {
+		return fmt.Errorf("policy manifest is not valid JSON: %w", err)
+	}
+	for _, entry := range list.Packs {
+		var pack RegistryPack
+		if err := json.Unmarshal(entry, &pack); err != nil {
+			return fmt.Errorf("policy manifest is not valid JSON: %w", err)
+		}
+		ref := pack.ID + "@" + pack.Version
+		if pack.Signature == "" {
+			return fmt.Errorf("%w: %s is not signed", ErrPackIntegrity, ref)
+		}
+		digest, err := manifestPackDigest(entry)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrPackIntegrity, ref, err)
+		}
+		if digest != pack.Digest {
+			return fmt.Errorf("%w: %s does not match its digest", ErrPackIntegrity, ref)
+		}
+		var claims packSignatureClaims
+		_, err = jwt.ParseWithClaims(pack.Signature, &claims, func(token *jwt.Token) (interface{}, error) {
+			if typ, _ := token.Header["typ"].(string); typ != packSignatureType {
+				return nil, fmt.Errorf("typ %q is not %s", typ, packSignatureType)
+			}
+			kid, _ := token.Header["kid"].(string)
+			return k.key(ctx, kid)
+		}, jwt.WithValidMethods([]string{"ES256", "ES384", "ES512"}), jwt.WithSubject(ref))
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrPackIntegrity, ref, err)
+		}
+		if claims.Digest != digest {
+			return fmt.Errorf("%w: %s is signed with another digest", ErrPackIntegrity, ref)
+		}
+	}
+	return nil
+}
+
+// manifestPackDigest is the registry's digest of a manifest pack: the
+// SHA-256 of the entry with sorted keys, provenance, digest and signature
+// aside
+func manifestPackDigest(entry json.RawMessage) (string, error) {
+	var pack map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(entry))
+	decoder.UseNumber()
+	if err := decoder.Decode(&pack); err != nil {
+		return "", err
+	}
+	delete(pack, "provenance")
+	delete(pack, "digest")
+	delete(pack, "signature")
+	document, err := json.Marshal(pack)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(document)
+	return "sha-256:" + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ISO/IEC 18013-5 mdoc presentations: a CBOR DeviceResponse, base64url
+// encoded in the bundle's presentation (or the OpenID4VP vp_token)
+const (
+	MDLDoctype   = "org.iso.18013.5.1.mDL"
+	mdlNamespace = "org.iso.18013.5.1"
+
+	cborTagEncodedCBOR = 24
+	cborTagFullDate    = 1004
+
+	coseHeaderAlg     = 1
+	coseHeaderX5Chain = 33
+	coseKeyTypeEC2    = 2
+)
+
+type coseAlgorithm struct {
+	name  string
+	hash  crypto.Hash
+	curve elliptic.Curve
+}
+
+// coseAlgorithms are the COSE signature algorithms accepted on mdocs
+var coseAlgorithms = map[int64]coseAlgorithm{
+	-7:  {"ES256", crypto.SHA256, elliptic.P256()},
+	-35: {"ES384", crypto.SHA384, elliptic.P384()},
+	-36: {"ES512", crypto.SHA512, elliptic.P521()},
+}
+
+var coseCurves = map[int64]elliptic.Curve{1: elliptic.P256(), 2: elliptic.P384(), 3: elliptic.P521()}
+
+// mdocClaimNames renames data elements to the claims packs and predicates
+// use; other elements keep their identifiers
+var mdocClaimNames = map[string]string{
+	"age_in_years": "age",
+	"birth_date":   "birthdate",
+}
+
+// identityDoctypes are documents only issued after identity proofing, so a
+// device-authenticated presentation of one verifies the holder's identity
+var identityDoctypes = []string{MDLDoctype, EUDIPIDDoctype}
+
+// elementDecoding renders element values as JSON-like claims; tdate values
+// become RFC 3339 strings the policy language reads as times
+var elementDecoding = func() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		TimeTagToAny:   cbor.TimeTagToRFC3339,
+		DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// coseSign1 is a COSE_Sign1 structure; Payload is nil when detached
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int64]cbor.RawMessage
+	Payload     []byte
+	Signature   []byte
+}
+
+// DeviceResponse is the subset of an ISO 18013-5 DeviceResponse we verify
+type DeviceResponse struct {
+	Version   string         `cbor:"version"`
+	Documents []mdocDocument `cbor:"documents"`
+	Status    uint64         `cbor:"status"`
+}
+
+type mdocDocument struct {
+	DocType      string `cbor:"docType"`
+	IssuerSigned struct {
+		NameSpaces map[string][]cbor.RawMessage `cbor:"nameSpaces"` // IssuerSignedItemBytes
+		IssuerAuth coseSign1                    `cbor:"issuerAuth"`
+	} `cbor:"issuerSigned"`
+	DeviceSigned *struct {
+		NameSpaces cbor.RawMessage `cbor:"nameSpaces"` // DeviceNameSpacesBytes
+		DeviceAuth struct {
+			DeviceSignature *coseSign1      `cbor:"deviceSignature"`
+			DeviceMac       cbor.RawMessage `cbor:"deviceMac"`
+		} `cbor:"deviceAuth"`
+	} `cbor:"deviceSigned"`
+}
+
+type issuerSignedItem struct {
+	DigestID          uint64          `cbor:"digestID"`
+	Random            []byte          `cbor:"random"`
+	ElementIdentifier string          `cbor:"elementIdentifier"`
+	ElementValue      cbor.RawMessage `cbor:"elementValue"`
+}
+
+// mobileSecurityObject is the issuer-signed MSO carried in issuerAuth
+type mobileSecurityObject struct {
+	Version         string                       `cbor:"version"`
+	DigestAlgorithm string                       `cbor:"digestAlgorithm"`
+	ValueDigests    map[string]map[uint64][]byte `cbor:"valueDigests"`
+	DeviceKeyInfo   struct {
+		DeviceKey map[int64]cbor.RawMessage `cbor:"deviceKey"`
+	} `cbor:"deviceKeyInfo"`
+	DocType      string `cbor:"docType"`
+	ValidityInfo struct {
+		Signed     time.Time `cbor:"signed"`
+		ValidFrom  time.Time `cbor:"validFrom"`
+		ValidUntil time.Time `cbor:"validUntil"`
+	} `cbor:"validityInfo"`
+}
+
+// MdocExpectations bind a device signature to the verification session
+type MdocExpectations struct {
+	ClientID    string
+	Nonce       string
+	ResponseURI string
+	Required    bool // reject documents without deviceAuth
+}
+
+// sessionTranscript is the OpenID4VP SessionTranscript the device signs:
+// [null, null, ["OpenID4VPHandover", sha-256(cbor([client_id, nonce, null, response_uri]))]]
+func (e MdocExpectations) sessionTranscript() ([]interface{}, error) {
+	info, err := cbor.Marshal([]interface{}{e.ClientID, e.Nonce, nil, e.ResponseURI})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(info)
+	return []interface{}{nil, nil, []interface{}{"OpenID4VPHandover", digest[:]}}, nil
+}
+
+// decodeDeviceResponse decodes a base64url (or base64) encoded DeviceResponse
+func decodeDeviceResponse(presentation string) (DeviceResponse, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(presentation, "="))
+	if err != nil {
+		if raw, err = base64.StdEncoding.DecodeString(presentation); err != nil {
+			return DeviceResponse{}, errors.New("device response is not base64")
+		}
+	}
+	var response DeviceResponse
+	if err := cbor.Unmarshal(raw, &response); err != nil {
+		return DeviceResponse{}, fmt.Errorf("decoding device response: %w", err)
+	}
+	if len(response.Documents) == 0 {
+		return DeviceResponse{}, errors.New("device response has no documents")
+	}
+	return response, nil
+}
+
+// unwrapEncodedCBOR returns the bytes embedded in a #6.24(bstr) item
+func unwrapEncodedCBOR(raw []byte) ([]byte, error) {
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(raw, &tag); err != nil {
+		return nil, err
+	}
+	if tag.Number != cborTagEncodedCBOR {
+		return nil, fmt.Errorf("expected tag 24, got tag %d", tag.Number)
+	}
+	var embedded []byte
+	if err := cbor.Unmarshal(tag.Content, &embedded); err != nil {
+		return nil, err
+	}
+	return embedded, nil
+}
+
+// verifyCOSESign1 checks msg over payload with key and returns the algorithm name
+func verifyCOSESign1(msg coseSign1, payload []byte, key *ecdsa.PublicKey) (string, error) {
+	var protected map[int64]interface{}
+	if err := cbor.Unmarshal(msg.Protected, &protected); err != nil {
+		return "", fmt.Errorf("protected header: %w", err)
+	}
+	label, _ := protected[coseHeaderAlg].(int64)
+	alg, ok := coseAlgorithms[label]
+	if !ok {
+		return "", fmt.Errorf("unsupported COSE algorithm %v", protected[coseHeaderAlg])
+	}
+	if key.Curve != alg.curve {
+		return "", fmt.Errorf("%s signature with a %s key", alg.name, key.Curve.Params().Name)
+	}
+
+	toBeSigned, err := cbor.Marshal([]interface{}{"Signature1", msg.Protected, []byte{}, payload})
+	if err != nil {
+		return "", err
+	}
+	h := alg.hash.New()
+	h.Write(toBeSigned)
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(msg.Signature) != 2*size {
+		return "", errors.New("malformed COSE signature")
+	}
+	r := new(big.Int).SetBytes(msg.Signature[:size])
+	s := new(big.Int).SetBytes(msg.Signature[size:])
+	if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+		return "", errors.New("COSE signature does not verify")
+	}
+	return alg.name, nil
+}
+
+// x5chain reads the certificate chain from a COSE header, leaf first
+func x5chain(raw cbor.RawMessage) ([]*x509.Certificate, error) {
+	var ders [][]byte
+	var single []byte
+	if err := cbor.Unmarshal(raw, &single); err == nil {
+		ders = [][]byte{single}
+	} else if err := cbor.Unmarshal(raw, &ders); err != nil {
+		return nil, errors.New("x5chain is neither a certificate nor a list of certificates")
+	}
+	certs := make([]*x509.Certificate, 0, len(ders))
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("x5chain: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("x5chain is empty")
+	}
+	return certs, nil
+}
+
+// coseKeyToECDSA converts an EC2 COSE_Key to a public key
+func coseKeyToECDSA(key map[int64]cbor.RawMessage) (*ecdsa.PublicKey, error) {
+	var kty, crv int64
+	var x, y []byte
+	if err := cbor.Unmarshal(key[1], &kty); err != nil || kty != coseKeyTypeEC2 {
+		return nil, errors.New("device key is not an EC2 key")
+	}
+	if err := cbor.Unmarshal(key[-1], &crv); err != nil {
+		return nil, errors.New("device key has no curve")
+	}
+	curve, ok := coseCurves[crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported device key curve %d", crv)
+	}
+	if cbor.Unmarshal(key[-2], &x) != nil || cbor.Unmarshal(key[-3], &y) != nil {
+		return nil, errors.New("device key coordinates are missing")
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("device key is not on its curve")
+	}
+	return pub, nil
+}
+
+func mdocDigest(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "SHA-256":
+		return sha256.New(), nil
+	case "SHA-384":
+		return sha512.New384(), nil
+	case "SHA-512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+}
+
+// LoadIACARoots reads the PEM bundle of issuing authority (IACA) certificates
+// mdoc document signers must chain to
+func LoadIACARoots(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return roots, nil
+}
+
+// VerifyMdoc verifies the first document of a DeviceResponse: the issuer's
+// MSO signature and certificate chain, the digests of the disclosed elements
+// and, when present, the device signature over the session transcript
+func VerifyMdoc(presentation string, roots *x509.CertPool, expect MdocExpectations, now time.Time) (VerifiedSDJWT, error) {
+	if roots == nil {
+		return VerifiedSDJWT{}, invalidf("no IACA trust anchors are configured for %s", FormatMsoMdoc)
+	}
+	response, err := decodeDeviceResponse(presentation)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("%v", err)
+	}
+	if response.Status != 0 {
+		return VerifiedSDJWT{}, invalidf("device response status %d", response.Status)
+	}
+	doc := response.Documents[0]
+
+	// Issuer authentication
+	chainHeader, ok := doc.IssuerSigned.IssuerAuth.Unprotected[coseHeaderX5Chain]
+	if !ok {
+		return VerifiedSDJWT{}, invalidf("issuerAuth has no x5chain")
+	}
+	chain, err := x5chain(chainHeader)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("%v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	signer := chain[0]
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return VerifiedSDJWT{}, invalidf("document signer certificate: %v", err)
+	}
+	signerKey, ok := signer.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return VerifiedSDJWT{}, invalidf("document signer key is not ECDSA")
+	}
+	issuerAlg, err := verifyCOSESign1(doc.IssuerSigned.IssuerAuth, doc.IssuerSigned.IssuerAuth.Payload, signerKey)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("issuerAuth: %v", err)
+	}
+
+	var mso mobileSecurityObject
+	msoBytes, err := unwrapEncodedCBOR(doc.IssuerSigned.IssuerAuth.Payload)
+	if err == nil {
+		err = cbor.Unmarshal(msoBytes, &mso)
+	}
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("mobile security object: %v", err)
+	}
+	if mso.DocType != doc.DocType {
+		return VerifiedSDJWT{}, invalidf("MSO is for %q, not %q", mso.DocType, doc.DocType)
+	}
+	if now.Add(issuerClockSkew).Before(mso.ValidityInfo.ValidFrom) || now.Add(-issuerClockSkew).After(mso.ValidityInfo.ValidUntil) {
+		return VerifiedSDJWT{}, invalidf("mdoc is not valid at %s", now.UTC().Format(time.RFC3339))
+	}
+
+	// Disclosed elements must match the digests the issuer signed
+	verified := VerifiedSDJWT{
+		Issuer:              signer.Subject.String(),
+		Vct:                 doc.DocType,
+		Claims:              map[string]interface{}{},
+		IssuedAt:            mso.ValidityInfo.Signed,
+		ExpiresAt:           mso.ValidityInfo.ValidUntil,
+		Algorithms:          []string{issuerAlg},
+		IssuerChainVerified: true,
+	}
+	namespaces := make([]string, 0, len(doc.IssuerSigned.NameSpaces))
+	for namespace := range doc.IssuerSigned.NameSpaces {
+		namespaces = append(namespaces, namespace)
+	}
+	// The mDL namespace takes precedence over extensions on name clashes
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i] == mdlNamespace || (namespaces[j] != mdlNamespace && namespaces[i] < namespaces[j])
+	})
+	for _, namespace := range namespaces {
+		for _, itemBytes := range doc.IssuerSigned.NameSpaces[namespace] {
+			item, err := verifyIssuerSignedItem(mso, namespace, itemBytes)
+			if err != nil {
+				return VerifiedSDJWT{}, invalidf("%s: %v", namespace, err)
+			}
+			name := item.ElementIdentifier
+			if renamed, ok := mdocClaimNames[name]; ok {
+				name = renamed
+			}
+			if _, clash := verified.Claims[name]; clash {
+				continue
+			}
+			var value interface{}
+			if err := elementDecoding.Unmarshal(item.ElementValue, &value); err != nil {
+				return VerifiedSDJWT{}, invalidf("%s/%s: %v", namespace, item.ElementIdentifier, err)
+			}
+			verified.Claims[name] = normalizeCBORValue(value)
+			verified.Disclosed = append(verified.Disclosed, name)
+		}
+	}
+
+	// Device authentication
+	if doc.DeviceSigned == nil || doc.DeviceSigned.DeviceAuth.DeviceSignature == nil {
+		if doc.DeviceSigned != nil && doc.DeviceSigned.DeviceAuth.DeviceMac != nil {
+			return VerifiedSDJWT{}, invalidf("deviceMac authentication is not supported")
+		}
+		if expect.Required {
+			return VerifiedSDJWT{}, invalidf("device authentication required")
+		}
+		return verified, nil
+	}
+	deviceKey, err := coseKeyToECDSA(mso.DeviceKeyInfo.DeviceKey)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("%v", err)
+	}
+	transcript, err := expect.sessionTranscript()
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	deviceNameSpaces := doc.DeviceSigned.NameSpaces
+	if deviceNameSpaces == nil {
+		return VerifiedSDJWT{}, invalidf("deviceSigned has no nameSpaces")
+	}
+	deviceAuthentication, err := cbor.Marshal([]interface{}{"DeviceAuthentication", transcript, doc.DocType, deviceNameSpaces})
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	deviceAuthenticationBytes, err := cbor.Marshal(cbor.Tag{Number: cborTagEncodedCBOR, Content: deviceAuthentication})
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	signature := *doc.DeviceSigned.DeviceAuth.DeviceSignature
+	if signature.Payload != nil && !bytes.Equal(signature.Payload, deviceAuthenticationBytes) {
+		return VerifiedSDJWT{}, invalidf("deviceSignature is over a different session transcript")
+	}
+	deviceAlg, err := verifyCOSESign1(signature, deviceAuthenticationBytes, deviceKey)
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("deviceSignature (wrong nonce or audience?): %v", err)
+	}
+	verified.KeyBound = true
+	verified.Algorithms = append(verified.Algorithms, deviceAlg)
+	if contains(identityDoctypes, doc.DocType) {
+		verified.Claims["identity_liveness"] = true
+	}
+	return verified, nil
+}
+
+// verifyIssuerSignedItem checks an IssuerSignedItemBytes against the MSO
+func verifyIssuerSignedItem(mso mobileSecurityObject, namespace string, itemBytes []byte) (issuerSignedItem, error) {
+	var item issuerSignedItem
+	embedded, err := unwrapEncodedCBOR(itemBytes)
+	if err == nil {
+		err = cbor.Unmarshal(embedded, &item)
+	}
+	if err != nil {
+		return item, fmt.Errorf("malformed issuer signed item: %w", err)
+	}
+	expected, ok := mso.ValueDigests[namespace][item.DigestID]
+	if !ok {
+		return item, fmt.Errorf("%s has no digest %d in the MSO", item.ElementIdentifier, item.DigestID)
+	}
+	h, err := mdocDigest(mso.DigestAlgorithm)
+	if err != nil {
+		return item, err
+	}
+	h.Write(itemBytes)
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return item, fmt.Errorf("%s does not match its MSO digest", item.ElementIdentifier)
+	}
+	return item, nil
+}
+
+// normalizeCBORValue maps decoded CBOR to the JSON types claims use elsewhere
+func normalizeCBORValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case uint64:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []byte:
+		return base64.RawURLEncoding.EncodeToString(v)
+	case cbor.Tag:
+		if v.Number == cborTagFullDate {
+			if date, ok := v.Content.(string); ok {
+				return date
+			}
+		}
+		return normalizeCBORValue(v.Content)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, entry := range v {
+			out[i] = normalizeCBORValue(entry)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			out[key] = normalizeCBORValue(entry)
+		}
+		return out
+	}
+	return value
+}
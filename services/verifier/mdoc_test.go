@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMdocIssuer is an IACA root, a document signer it certified, and a
+// holder device key
+type testMdocIssuer struct {
+	roots     *x509.CertPool
+	signer    *ecdsa.PrivateKey
+	signerDER []byte
+	device    *ecdsa.PrivateKey
+	enc       cbor.EncMode
+}
+
+func newTestMdocIssuer(t *testing.T) *testMdocIssuer {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Utopia IACA", Country: []string{"UT"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	rootCert, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+
+	signerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signerDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Utopia DS", Country: []string{"UT"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, rootCert, &signerKey.PublicKey, rootKey)
+	require.NoError(t, err)
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339, TimeTag: cbor.EncTagRequired}.EncMode()
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	return &testMdocIssuer{roots: roots, signer: signerKey, signerDER: signerDER, device: deviceKey, enc: enc}
+}
+
+func (m *testMdocIssuer) marshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	encoded, err := m.enc.Marshal(v)
+	require.NoError(t, err)
+	return encoded
+}
+
+func (m *testMdocIssuer) embed(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	return m.marshal(t, cbor.Tag{Number: cborTagEncodedCBOR, Content: m.marshal(t, v)})
+}
+
+func (m *testMdocIssuer) sign(t *testing.T, key *ecdsa.PrivateKey, protected, payload []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(m.marshal(t, []interface{}{"Signature1", protected, []byte{}, payload}))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+}
+
+// present builds a DeviceResponse for an mDL disclosing elements, with the
+// device signature bound to expect
+func (m *testMdocIssuer) present(t *testing.T, elements map[string]interface{}, expect MdocExpectations) string {
+	t.Helper()
+	var items []cbor.RawMessage
+	digests := map[uint64][]byte{}
+	var digestID uint64
+	for name, value := range elements {
+		item := m.embed(t, map[string]interface{}{
+			"digestID":          digestID,
+			"random":            []byte("0123456789abcdef"),
+			"elementIdentifier": name,
+			"elementValue":      value,
+		})
+		sum := sha256.Sum256(item)
+		digests[digestID] = sum[:]
+		items = append(items, item)
+		digestID++
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	mso := map[string]interface{}{
+		"version":         "1.0",
+		"digestAlgorithm": "SHA-256",
+		"valueDigests":    map[string]interface{}{mdlNamespace: digests},
+		"deviceKeyInfo": map[string]interface{}{"deviceKey": map[int64]interface{}{
+			1: coseKeyTypeEC2, -1: 1,
+			-2: m.device.X.FillBytes(make([]byte, 32)),
+			-3: m.device.Y.FillBytes(make([]byte, 32)),
+		}},
+		"docType": MDLDoctype,
+		"validityInfo": map[string]interface{}{
+			"signed": now, "validFrom": now.Add(-time.Minute), "validUntil": now.Add(time.Hour),
+		},
+	}
+	protected := m.marshal(t, map[int64]interface{}{coseHeaderAlg: -7})
+	msoBytes := m.embed(t, mso)
+
+	transcript, err := expect.sessionTranscript()
+	require.NoError(t, err)
+	deviceNameSpaces := m.embed(t, map[string]interface{}{})
+	deviceAuthentication := m.embed(t, []interface{}{"DeviceAuthentication", transcript, MDLDoctype, cbor.RawMessage(deviceNameSpaces)})
+
+	response := map[string]interface{}{
+		"version": "1.0",
+		"status":  0,
+		"documents": []interface{}{map[string]interface{}{
+			"docType": MDLDoctype,
+			"issuerSigned": map[string]interface{}{
+				"nameSpaces": map[string]interface{}{mdlNamespace: items},
+				"issuerAuth": []interface{}{protected, map[int64]interface{}{coseHeaderX5Chain: m.signerDER}, msoBytes, m.sign(t, m.signer, protected, msoBytes)},
+			},
+			"deviceSigned": map[string]interface{}{
+				"nameSpaces": cbor.RawMessage(deviceNameSpaces),
+				"deviceAuth": map[string]interface{}{
+					"deviceSignature": []interface{}{protected, map[int64]interface{}{}, nil, m.sign(t, m.device, protected, deviceAuthentication)},
+				},
+			},
+		}},
+	}
+	return base64.RawURLEncoding.EncodeToString(m.marshal(t, response))
+}
+
+func mdlElements() map[string]interface{} {
+	return map[string]interface{}{
+		"given_name":   "Ada",
+		"age_over_18":  true,
+		"age_in_years": 36,
+		"birth_date":   cbor.Tag{Number: cborTagFullDate, Content: "1990-01-01"},
+	}
+}
+
+func sessionMdocExpectations(server *Server, session VerificationSession) MdocExpectations {
+	return MdocExpectations{ClientID: session.Audience, Nonce: session.Nonce, ResponseURI: server.tenantURL(session.Tenant) + "/openid4vp/response"}
+}
+
+func TestVerifyMdoc(t *testing.T) {
+	issuer := newTestMdocIssuer(t)
+	expect := MdocExpectations{ClientID: defaultVerifierAudience, Nonce: "nonce-1", ResponseURI: defaultVerifierBaseURL + "/openid4vp/response", Required: true}
+
+	verified, err := VerifyMdoc(issuer.present(t, mdlElements(), expect), issuer.roots, expect, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, MDLDoctype, verified.Vct)
+	assert.Equal(t, "CN=Utopia DS,C=UT", verified.Issuer)
+	assert.True(t, verified.KeyBound)
+	assert.True(t, verified.IssuerChainVerified)
+	assert.Equal(t, []string{"ES256", "ES256"}, verified.Algorithms)
+	assert.Equal(t, "Ada", verified.Claims["given_name"])
+	assert.Equal(t, true, verified.Claims["age_over_18"])
+	assert.Equal(t, float64(36), verified.Claims["age"])
+	assert.Equal(t, "1990-01-01", verified.Claims["birthdate"])
+	assert.Equal(t, true, verified.Claims["identity_liveness"])
+	assert.ElementsMatch(t, []string{"given_name", "age_over_18", "age", "birthdate"}, verified.Disclosed)
+}
+
+func TestVerifyMdoc_Rejects(t *testing.T) {
+	issuer := newTestMdocIssuer(t)
+	expect := MdocExpectations{ClientID: defaultVerifierAudience, Nonce: "nonce-1", ResponseURI: defaultVerifierBaseURL + "/openid4vp/response"}
+	presentation := issuer.present(t, mdlElements(), expect)
+
+	t.Run("other nonce", func(t *testing.T) {
+		other := expect
+		other.Nonce = "nonce-2"
+		_, err := VerifyMdoc(presentation, issuer.roots, other, time.Now())
+		assert.ErrorIs(t, err, ErrInvalidPresentation)
+	})
+	t.Run("untrusted IACA", func(t *testing.T) {
+		_, err := VerifyMdoc(presentation, newTestMdocIssuer(t).roots, expect, time.Now())
+		assert.ErrorContains(t, err, "document signer certificate")
+	})
+	t.Run("no trust anchors", func(t *testing.T) {
+		_, err := VerifyMdoc(presentation, nil, expect, time.Now())
+		assert.ErrorIs(t, err, ErrInvalidPresentation)
+	})
+	t.Run("expired", func(t *testing.T) {
+		_, err := VerifyMdoc(presentation, issuer.roots, expect, time.Now().Add(2*time.Hour))
+		assert.ErrorIs(t, err, ErrInvalidPresentation)
+	})
+	t.Run("tampered element", func(t *testing.T) {
+		raw, err := base64.RawURLEncoding.DecodeString(presentation)
+		require.NoError(t, err)
+		var response DeviceResponse
+		require.NoError(t, cbor.Unmarshal(raw, &response))
+		item := issuer.embed(t, map[string]interface{}{
+			"digestID": 0, "random": []byte("0123456789abcdef"), "elementIdentifier": "age_over_21", "elementValue": true,
+		})
+		response.Documents[0].IssuerSigned.NameSpaces[mdlNamespace][0] = item
+		_, err = VerifyMdoc(base64.RawURLEncoding.EncodeToString(issuer.marshal(t, response)), issuer.roots, expect, time.Now())
+		assert.ErrorContains(t, err, "does not match its MSO digest")
+	})
+}
+
+func TestVerifyPresentation_MdocProvesSafeSellerIdentity(t *testing.T) {
+	server := NewServer()
+	issuer := newTestMdocIssuer(t)
+	server.mdocRoots = issuer.roots
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	w := verifyWithProfile(t, server, session, map[string]interface{}{
+		"format":       FormatMsoMdoc,
+		"presentation": issuer.present(t, mdlElements(), sessionMdocExpectations(server, session)),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.KeyBound)
+	assert.Contains(t, resp.Predicates, PredicateIdentityVerified)
+	assert.Contains(t, resp.Predicates, "age.ge.18")
+	assert.Equal(t, "CN=Utopia DS,C=UT", resp.Issuer)
+	// The mDL covers the identity rule; platform history needs its own credential
+	require.NotEmpty(t, resp.Results)
+	assert.Equal(t, "identity.verified", resp.Results[0].ID)
+	assert.True(t, resp.Results[0].Passed)
+}
+
+func TestVerifyPresentation_MdocBoundToSession(t *testing.T) {
+	server := NewServer()
+	issuer := newTestMdocIssuer(t)
+	server.mdocRoots = issuer.roots
+	answered := createSession(t, server, "pack.safe.seller@0.1.0")
+	replayed := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	w := verifyWithProfile(t, server, replayed, map[string]interface{}{
+		"format":       FormatMsoMdoc,
+		"presentation": issuer.present(t, mdlElements(), sessionMdocExpectations(server, answered)),
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "deviceSignature")
+}
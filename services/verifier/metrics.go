@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Verification results as counted by metrics and /stats
+const (
+	ResultSatisfied   = "satisfied"   // verified and every required rule passed
+	ResultUnsatisfied = "unsatisfied" // verified, but the pack is not met
+	ResultFailed      = "failed"      // rejected; the reason says why
+)
+
+// unknownPackLabel stands in for policy IDs that match no pack, so callers
+// cannot grow the label set
+const unknownPackLabel = "unknown"
+
+// latencySamples bounds the recent latencies kept per pack for /stats
+const latencySamples = 1024
+
+// verifierMetrics adds verification counters and latencies to the service's
+// Prometheus registry and keeps the in-memory summary served at /stats
+type verifierMetrics struct {
+	*metrics.Metrics
+	verifications *prometheus.CounterVec
+	failures      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+
+	mu    sync.Mutex
+	since time.Time
+	packs map[string]*packStats
+}
+
+type packStats struct {
+	results   map[string]int
+	reasons   map[string]int
+	latencies []time.Duration // ring of the most recent evaluations
+	next      int
+}
+
+func newVerifierMetrics() *verifierMetrics {
+	m := &verifierMetrics{
+		Metrics: metrics.New("verifier"),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cachet_verifier_verifications_total",
+			Help: "Verification sessions completed, by pack and result.",
+		}, []string{"pack", "result"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cachet_verifier_verification_failures_total",
+			Help: "Rejected verifications, by pack and error code.",
+		}, []string{"pack", "reason"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cachet_verifier_verification_duration_seconds",
+			Help:    "Time to verify and evaluate a presentation, by pack.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"pack"}),
+		since: time.Now().UTC(),
+		packs: make(map[string]*packStats),
+	}
+	m.MustRegister(m.verifications, m.failures, m.latency)
+	return m
+}
+
+func (m *verifierMetrics) stats(pack string) *packStats {
+	stats, ok := m.packs[pack]
+	if !ok {
+		stats = &packStats{results: make(map[string]int), reasons: make(map[string]int)}
+		m.packs[pack] = stats
+	}
+	return stats
+}
+
+// ObserveOutcome counts a completed session
+func (m *verifierMetrics) ObserveOutcome(pack string, outcome VerificationOutcome) {
+	result := ResultFailed
+	if outcome.Status == OutcomeVerified {
+		result = ResultUnsatisfied
+		if outcome.Result != nil && outcome.Result.Satisfied {
+			result = ResultSatisfied
+		}
+	}
+	m.verifications.WithLabelValues(pack, result).Inc()
+	if result == ResultFailed {
+		m.failures.WithLabelValues(pack, outcome.Error).Inc()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats(pack)
+	stats.results[result]++
+	if result == ResultFailed {
+		stats.reasons[outcome.Error]++
+	}
+}
+
+// ObserveLatency records how long evaluating a presentation took
+func (m *verifierMetrics) ObserveLatency(pack string, elapsed time.Duration) {
+	m.latency.WithLabelValues(pack).Observe(elapsed.Seconds())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats(pack)
+	if len(stats.latencies) < latencySamples {
+		stats.latencies = append(stats.latencies, elapsed)
+		return
+	}
+	stats.latencies[stats.next] = elapsed
+	stats.next = (stats.next + 1) % latencySamples
+}
+
+// VerificationCounts are the results of a set of verifications
+type VerificationCounts struct {
+	Verifications int     `json:"verifications"`
+	Satisfied     int     `json:"satisfied"`
+	Unsatisfied   int     `json:"unsatisfied"`
+	Failed        int     `json:"failed"`
+	PassRate      float64 `json:"passRate"` // satisfied / verifications
+}
+
+func (c *VerificationCounts) add(results map[string]int) {
+	c.Satisfied += results[ResultSatisfied]
+	c.Unsatisfied += results[ResultUnsatisfied]
+	c.Failed += results[ResultFailed]
+	c.Verifications = c.Satisfied + c.Unsatisfied + c.Failed
+	if c.Verifications > 0 {
+		c.PassRate = float64(c.Satisfied) / float64(c.Verifications)
+	}
+}
+
+// LatencySummary gives percentiles over recent evaluations, in milliseconds
+type LatencySummary struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+func summarizeLatency(samples []time.Duration) LatencySummary {
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) float64 {
+		return float64(sorted[int(q*float64(len(sorted)-1))]) / float64(time.Millisecond)
+	}
+	return LatencySummary{Samples: len(sorted), P50: at(.50), P95: at(.95), P99: at(.99)}
+}
+
+// PackStats summarizes the verifications requested for one pack
+type PackStats struct {
+	PolicyID string `json:"policyId"`
+	VerificationCounts
+	FailureReasons map[string]int `json:"failureReasons"`
+	LatencyMs      LatencySummary `json:"latencyMs"`
+}
+
+// StatsResponse is the admin dashboard summary served at GET /stats
+type StatsResponse struct {
+	Since  time.Time          `json:"since"`
+	Totals VerificationCounts `json:"totals"`
+	Packs  []PackStats        `json:"packs"`
+}
+
+// Snapshot summarizes everything observed since the server started
+func (m *verifierMetrics) Snapshot() StatsResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := StatsResponse{Since: m.since, Packs: []PackStats{}}
+	for pack, stats := range m.packs {
+		summary := PackStats{PolicyID: pack, FailureReasons: make(map[string]int, len(stats.reasons)), LatencyMs: summarizeLatency(stats.latencies)}
+		summary.add(stats.results)
+		for reason, count := range stats.reasons {
+			summary.FailureReasons[reason] = count
+		}
+		resp.Totals.add(stats.results)
+		resp.Packs = append(resp.Packs, summary)
+	}
+	sort.Slice(resp.Packs, func(i, j int) bool { return resp.Packs[i].PolicyID < resp.Packs[j].PolicyID })
+	return resp
+}
+
+// packLabel is the pack a session is counted under
+func (s *Server) packLabel(policyID string) string {
+	if _, ok := s.findPack(policyID); ok {
+		return policyID
+	}
+	return unknownPackLabel
+}
+
+// evaluationErrorCode is the error code an evaluatePresentation failure is
+// reported with
+func evaluationErrorCode(err error) string {
+	var violation *ProfileViolationError
+	var untrusted *UntrustedIssuerError
+	switch {
+	case errors.As(err, &untrusted):
+		return "untrusted_issuer"
+	case errors.As(err, &violation):
+		return "profile_violation"
+	case errors.Is(err, ErrTrustListUnavailable):
+		return "trust_list_unavailable"
+	case errors.Is(err, ErrCredentialRevoked):
+		return "credential_revoked"
+	case errors.Is(err, ErrReplayedPresentation):
+		return "replayed_presentation"
+	case errors.Is(err, ErrStatusUnavailable):
+		return "status_unavailable"
+	}
+	return "invalid_presentation"
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.metrics.Snapshot())
+}
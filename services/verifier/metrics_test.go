@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsAndStats(t *testing.T) {
+	server := newRPServer(t)
+	server.requireRPAuth = false
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	require.Equal(t, http.StatusOK, verifySession(t, server, issuer, session).Code)
+	session = createSession(t, server, "pack.safe.seller@0.1.0")
+	require.Equal(t, http.StatusUnprocessableEntity, verifyWithProfile(t, server, session, "a.b.c~").Code)
+	session = createSession(t, server, "pack.unknown@9.9.9")
+	require.Equal(t, http.StatusUnprocessableEntity, verifyWithProfile(t, server, session, "a.b.c~").Code)
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics := w.Body.String()
+	assert.Contains(t, metrics, `cachet_verifier_verifications_total{pack="pack.safe.seller@0.1.0",result="unsatisfied"} 1`)
+	assert.Contains(t, metrics, `cachet_verifier_verifications_total{pack="pack.safe.seller@0.1.0",result="failed"} 1`)
+	assert.Contains(t, metrics, `cachet_verifier_verification_failures_total{pack="unknown",reason="invalid_presentation"} 1`)
+	assert.Contains(t, metrics, `cachet_verifier_verification_duration_seconds_count{pack="pack.safe.seller@0.1.0"} 2`)
+	assert.Contains(t, metrics, `cachet_http_requests_total{code="201",method="POST",route="/verification-sessions",service="verifier"} 3`)
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats StatsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, VerificationCounts{Verifications: 3, Unsatisfied: 1, Failed: 2}, stats.Totals)
+	require.Len(t, stats.Packs, 2)
+	seller := stats.Packs[0]
+	assert.Equal(t, "pack.safe.seller@0.1.0", seller.PolicyID)
+	assert.Equal(t, map[string]int{"invalid_presentation": 1}, seller.FailureReasons)
+	assert.Equal(t, 2, seller.LatencyMs.Samples)
+	assert.Equal(t, unknownPackLabel, stats.Packs[1].PolicyID)
+}
+
+func TestSummarizeLatency(t *testing.T) {
+	var samples []time.Duration
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	summary := summarizeLatency(samples)
+	assert.Equal(t, LatencySummary{Samples: 100, P50: 50, P95: 95, P99: 99}, summary)
+	assert.Equal(t, LatencySummary{}, summarizeLatency(nil))
+}
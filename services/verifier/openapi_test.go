@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPIDocument keeps the embedded document in step with
+// api/openapi.verifier.yaml; run it with UPDATE_OPENAPI=1 to copy the document over
+func TestOpenAPIDocument(t *testing.T) {
+	source, err := os.ReadFile("../../api/openapi.verifier.yaml")
+	require.NoError(t, err)
+	if os.Getenv("UPDATE_OPENAPI") != "" {
+		require.NoError(t, os.WriteFile("openapi.yaml", source, 0o644))
+		return
+	}
+	assert.Equal(t, string(source), string(openapiDocument), "openapi.yaml is stale; copy it over with UPDATE_OPENAPI=1 go test -run TestOpenAPIDocument")
+}
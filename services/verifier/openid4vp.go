@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// OpenID for Verifiable Presentations (relying party side)
+const (
+	openID4VPScheme        = "openid4vp://"
+	requestObjectType      = "oauth-authz-req+jwt"
+	selfIssuedAudience     = "https://self-issued.me/v2"
+	responseModeDirectPost = "direct_post"
+	defaultVerifierBaseURL = "https://verifier.cachet.id"
+)
+
+// Outcome statuses recorded for direct_post responses
+const (
+	OutcomeVerified = "verified"
+	OutcomeFailed   = "failed"
+)
+
+// requestSigner holds the verifier's signing key, used for OpenID4VP request
+// objects and verification badges
+type requestSigner struct {
+	*signing.Signer
+	// chain certifies the key, leaf first, once certify has checked it;
+	// clientID is then the DNS name wallets authenticate request objects under
+	chain    []*x509.Certificate
+	clientID string
+}
+
+func newRequestSigner() *requestSigner {
+	// Generate an ECDSA key for request objects (in production, load from secure storage)
+	signer, err := signing.Generate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate request signing key")
+	}
+	return &requestSigner{Signer: signer}
+}
+
+// newRequestSignerWithKey signs with a key loaded from storage
+func newRequestSignerWithKey(key *ecdsa.PrivateKey) (*requestSigner, error) {
+	signer, err := signing.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &requestSigner{Signer: signer}, nil
+}
+
+// certify attaches the X.509 chain of the signing key, leaf first. The leaf
+// must be valid for host, the verifier's public hostname, which becomes the
+// client_id of request objects under the x509_san_dns scheme.
+func (s *requestSigner) certify(chain []*x509.Certificate, host string) error {
+	if len(chain) == 0 {
+		return errors.New("certificate chain is empty")
+	}
+	leaf := chain[0]
+	if !s.PublicKey().Equal(leaf.PublicKey) {
+		return errors.New("leaf certificate does not certify the signing key")
+	}
+	if len(leaf.DNSNames) == 0 {
+		return errors.New("leaf certificate has no DNS subject alternative name")
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		return fmt.Errorf("leaf certificate is not valid for the verifier's host: %w", err)
+	}
+	for i, cert := range chain[1:] {
+		if err := chain[i].CheckSignatureFrom(cert); err != nil {
+			return fmt.Errorf("certificate %d is not issued by the next in the chain: %w", i, err)
+		}
+	}
+	s.chain, s.clientID = chain, host
+	return nil
+}
+
+// clientIDScheme is the OpenID4VP client identifier scheme wallets
+// authenticate the signer's request objects under, empty when the key is not
+// certified and wallets must know the verifier beforehand
+func (s *requestSigner) clientIDScheme() string {
+	if s.chain == nil {
+		return ""
+	}
+	return ClientIDSchemeX509SANDNS
+}
+
+// Sign signs a request object, carrying the certificate chain in x5c when
+// the key is certified
+func (s *requestSigner) Sign(claims jwt.MapClaims) (string, error) {
+	token := s.Token(requestObjectType, claims)
+	if s.chain != nil {
+		x5c := make([]string, len(s.chain))
+		for i, cert := range s.chain {
+			x5c[i] = base64.StdEncoding.EncodeToString(cert.Raw)
+		}
+		token.Header["x5c"] = x5c
+	}
+	return s.SignToken(token)
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("JWKS requested")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []didresolver.JWK{s.verifier(r.Context()).signer.PublicJWK()},
+	})
+}
+
+// handleRequestObject serves the signed authorization request a wallet
+// fetches from request_uri
+func (s *Server) handleRequestObject(w http.ResponseWriter, r *http.Request) {
+	session, err := s.sessions.Get(chi.URLParam(r, "sessionId"), time.Now())
+	if err != nil || !inTenant(r.Context(), session) {
+		problem.Error(w, r, "Verification session not found", http.StatusNotFound)
+		return
+	}
+
+	signer := s.verifierOf(sessionTenant(session)).signer
+	claims := jwt.MapClaims{
+		"iss":                     session.Audience,
+		"aud":                     selfIssuedAudience,
+		"client_id":               session.Audience,
+		"response_type":           "vp_token",
+		"response_mode":           responseModeDirectPost,
+		"response_uri":            s.tenantURL(session.Tenant) + "/openid4vp/response",
+		"nonce":                   session.Nonce,
+		"state":                   session.ID,
+		"presentation_definition": s.presentationDefinition(session.PolicyID),
+		"client_metadata": map[string]interface{}{
+			"vp_formats": s.sdJWTFormats(),
+		},
+		"iat": time.Now().Unix(),
+		"exp": session.ExpiresAt.Unix(),
+	}
+	// Sessions of a certified signer have its client_id as their audience
+	if scheme := signer.clientIDScheme(); scheme != "" {
+		claims["client_id_scheme"] = scheme
+	}
+	requestObject, err := signer.Sign(claims)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign request object")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str("session_id", session.ID).Msg("OpenID4VP request object served")
+	w.Header().Set("Content-Type", "application/"+requestObjectType)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write([]byte(requestObject)); err != nil {
+		log.Error().Err(err).Msg("Failed to write request object")
+	}
+}
+
+// submittedPresentation picks the presentations out of a vp_token, which is
+// either a single presentation or a JSON array addressed by the submission.
+// A submission mapping several descriptors yields a multi-credential bundle.
+func submittedPresentation(vpToken, submission string) (interface{}, error) {
+	mappings := []SubmissionMapping{{Format: FormatDCSDJWT, Path: "$"}}
+	if submission != "" {
+		var sub PresentationSubmission
+		if err := json.Unmarshal([]byte(submission), &sub); err != nil {
+			return nil, fmt.Errorf("presentation_submission is not valid JSON: %w", err)
+		}
+		if len(sub.DescriptorMap) == 0 {
+			return nil, errors.New("presentation_submission has no descriptor_map")
+		}
+		if len(sub.DescriptorMap) > maxBundleCredentials {
+			return nil, fmt.Errorf("presentation_submission maps %d descriptors, more than %d", len(sub.DescriptorMap), maxBundleCredentials)
+		}
+		mappings = sub.DescriptorMap
+	}
+
+	var tokens []string
+	if strings.HasPrefix(strings.TrimSpace(vpToken), "[") {
+		if err := json.Unmarshal([]byte(vpToken), &tokens); err != nil {
+			return nil, fmt.Errorf("vp_token array is malformed: %w", err)
+		}
+	}
+	bundle := make([]interface{}, 0, len(mappings))
+	for _, mapping := range mappings {
+		presentation, err := addressedPresentation(vpToken, tokens, mapping.Path)
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, map[string]interface{}{"format": mapping.Format, "presentation": presentation})
+	}
+	if len(bundle) == 1 {
+		return bundle[0], nil
+	}
+	return bundle, nil
+}
+
+// addressedPresentation resolves a descriptor path against the vp_token;
+// tokens holds the vp_token array, if it is one
+func addressedPresentation(vpToken string, tokens []string, path string) (string, error) {
+	if tokens == nil {
+		if path != "$" {
+			return "", fmt.Errorf("descriptor path %q does not address a single vp_token", path)
+		}
+		return vpToken, nil
+	}
+	index := 0
+	if path != "$" {
+		i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "$["), "]"))
+		if err != nil {
+			return "", fmt.Errorf("unsupported descriptor path %q", path)
+		}
+		index = i
+	}
+	if index < 0 || index >= len(tokens) {
+		return "", fmt.Errorf("descriptor path %q is out of range", path)
+	}
+	return tokens[index], nil
+}
+
+// handleDirectPost is the response_uri wallets post vp_token to
+func (s *Server) handleDirectPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		return
+	}
+
+	session, err := s.sessions.Consume(r.PostForm.Get("state"), time.Now())
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	outcome := VerificationOutcome{SessionID: session.ID, RPID: session.RPID, Status: OutcomeFailed, CompletedAt: time.Now()}
+
+	// The wallet declined or failed to build a presentation
+	if walletErr := r.PostForm.Get("error"); walletErr != "" {
+		outcome.Error, outcome.Message = walletErr, r.PostForm.Get("error_description")
+		s.completeSession(session, outcome)
+		log.Info().Str("session_id", session.ID).Str("error", walletErr).Msg("Wallet returned an OpenID4VP error")
+		writeJSON(w, http.StatusOK, directPostResponse(session))
+		return
+	}
+
+	bundle, err := submittedPresentation(r.PostForm.Get("vp_token"), r.PostForm.Get("presentation_submission"))
+	if err != nil {
+		outcome.Error, outcome.Message = "invalid_request", err.Error()
+		s.completeSession(session, outcome)
+		problem.Write(w, r, http.StatusBadRequest, outcome.Error, outcome.Message)
+		return
+	}
+
+	resp, err := s.evaluatePresentation(r.Context(), bundle, session)
+	s.recordVerification(session, err)
+	if err != nil {
+		outcome.Error, outcome.Message = evaluationErrorCode(err), err.Error()
+		s.completeSession(session, outcome)
+		writeEvaluationError(w, r, err)
+		return
+	}
+
+	outcome.Status, outcome.Result = OutcomeVerified, &resp
+	s.completeSession(session, outcome)
+	log.Info().Str("session_id", session.ID).Str("policy_id", session.PolicyID).Str("rp_id", session.RPID).Msg("OpenID4VP presentation verified")
+	writeJSON(w, http.StatusOK, directPostResponse(session))
+}
+
+// directPostResponse sends same-device wallets back to the relying party
+func directPostResponse(session VerificationSession) map[string]string {
+	if session.RedirectURI == "" {
+		return map[string]string{}
+	}
+	return map[string]string{"redirect_uri": session.RedirectURI}
+}
+
+// handleSessionOutcome lets the relying party collect a direct_post result
+func (s *Server) handleSessionOutcome(w http.ResponseWriter, r *http.Request) {
+	outcome, ok := s.sessions.Outcome(chi.URLParam(r, "sessionId"))
+	if !ok || !ownsSession(r.Context(), outcome.RPID) || outcome.tenant != tenant.FromContext(r.Context()).ID {
+		problem.Error(w, r, "No outcome recorded for this session", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, outcome)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postForm(t *testing.T, server *Server, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func getOutcome(t *testing.T, server *Server, sessionID string) (int, VerificationOutcome) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/verification-sessions/"+sessionID+"/result", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	var outcome VerificationOutcome
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &outcome))
+	}
+	return w.Code, outcome
+}
+
+func TestOpenID4VP_DirectPostFlow(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	// The wallet follows the authorization request to the signed request object
+	invocation, err := url.Parse(session.AuthorizationRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "openid4vp", invocation.Scheme)
+	requestURI, err := url.Parse(invocation.Query().Get("request_uri"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, requestURI.Path, nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/oauth-authz-req+jwt", w.Header().Get("Content-Type"))
+
+	var claims struct {
+		ClientID               string                 `json:"client_id"`
+		ResponseMode           string                 `json:"response_mode"`
+		ResponseURI            string                 `json:"response_uri"`
+		Nonce                  string                 `json:"nonce"`
+		State                  string                 `json:"state"`
+		PresentationDefinition PresentationDefinition `json:"presentation_definition"`
+		jwt.RegisteredClaims
+	}
+	_, err = jwt.ParseWithClaims(w.Body.String(), &claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, server.requestSigner.KeyID(), token.Header["kid"])
+		return server.requestSigner.PublicKey(), nil
+	}, jwt.WithAudience(selfIssuedAudience))
+	require.NoError(t, err)
+	assert.Equal(t, session.Audience, claims.ClientID)
+	assert.Equal(t, responseModeDirectPost, claims.ResponseMode)
+	assert.Equal(t, defaultVerifierBaseURL+"/v1/openid4vp/response", claims.ResponseURI)
+	assert.Equal(t, session.Nonce, claims.Nonce)
+	assert.Equal(t, "pack.safe.seller@0.1.0", claims.PresentationDefinition.ID)
+	require.NotEmpty(t, claims.PresentationDefinition.InputDescriptors)
+
+	// Nothing to collect until the wallet responds
+	code, _ := getOutcome(t, server, session.ID)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	presentation := issuer.present(t, issuerJWT, disclosures, claims.Nonce, claims.ClientID, issuer.holder)
+	submission, err := json.Marshal(PresentationSubmission{
+		ID:            "submission-1",
+		DefinitionID:  claims.PresentationDefinition.ID,
+		DescriptorMap: []SubmissionMapping{{ID: "cachet-credential", Format: FormatDCSDJWT, Path: "$"}},
+	})
+	require.NoError(t, err)
+	form := url.Values{
+		"vp_token":                {presentation},
+		"presentation_submission": {string(submission)},
+		"state":                   {claims.State},
+	}
+
+	w = postForm(t, server, "/openid4vp/response", form)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	code, outcome := getOutcome(t, server, session.ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OutcomeVerified, outcome.Status)
+	require.NotNil(t, outcome.Result)
+	assert.Equal(t, "Safe Seller", outcome.Result.Badge.Label)
+	assert.Contains(t, outcome.Result.Predicates, "age.ge.18")
+
+	// The state, and with it the nonce, cannot be replayed
+	w = postForm(t, server, "/openid4vp/response", form)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOpenID4VP_WalletError(t *testing.T) {
+	server := NewServer()
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	w := postForm(t, server, "/openid4vp/response", url.Values{
+		"error":             {"access_denied"},
+		"error_description": {"user declined"},
+		"state":             {session.ID},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, outcome := getOutcome(t, server, session.ID)
+	assert.Equal(t, OutcomeFailed, outcome.Status)
+	assert.Equal(t, "access_denied", outcome.Error)
+}
+
+func TestOpenID4VP_UnknownSessionRequest(t *testing.T) {
+	server := NewServer()
+	req := httptest.NewRequest(http.MethodGet, "/openid4vp/request/missing", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSubmittedPresentation_SelectsArrayEntry(t *testing.T) {
+	bundle, err := submittedPresentation(`["first~","second~"]`, `{"descriptor_map":[{"id":"x","format":"vc+sd-jwt","path":"$[1]"}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"format": FormatSDJWTVC, "presentation": "second~"}, bundle)
+
+	_, err = submittedPresentation(`["first~"]`, `{"descriptor_map":[{"id":"x","format":"vc+sd-jwt","path":"$[3]"}]}`)
+	assert.Error(t, err)
+}
+
+func TestSubmittedPresentation_MapsEveryDescriptor(t *testing.T) {
+	bundle, err := submittedPresentation(`["first~","second~"]`, `{"descriptor_map":[
+		{"id":"identity","format":"dc+sd-jwt","path":"$[0]"},
+		{"id":"background","format":"vc+sd-jwt","path":"$[1]"}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"format": FormatDCSDJWT, "presentation": "first~"},
+		map[string]interface{}{"format": FormatSDJWTVC, "presentation": "second~"},
+	}, bundle)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Proof types a pack predicate can be satisfied with
+const (
+	ProofTypeSDJWT = "sd-jwt"
+	ProofTypeBBS   = "vc-bbs"
+	ProofTypeZK    = "zk-snark"
+)
+
+type Pack struct {
+	ID         string          `json:"id"`
+	Version    string          `json:"version"`
+	Name       string          `json:"name"`
+	Purpose    string          `json:"purpose,omitempty"`
+	Predicates []PackPredicate `json:"predicates,omitempty"`
+	// Rules override the rules derived from Predicates, e.g. when loaded
+	// from the registry
+	Rules []PolicyRule `json:"rules,omitempty"`
+	// Freshness bounds the age of the evidence; nil accepts any age
+	Freshness *FreshnessPolicy `json:"freshness,omitempty"`
+	// Match rules check claims agree across the credentials of a bundle
+	Match []MatchRule `json:"match,omitempty"`
+
+	compiled []compiledRule
+	// digest is the registry's digest of the pack it was loaded from
+	digest string
+}
+
+// policyRules are the rules evaluated for the pack
+func (p Pack) policyRules() []PolicyRule {
+	if len(p.Rules) > 0 {
+		return p.Rules
+	}
+	rules := make([]PolicyRule, 0, len(p.Predicates))
+	for _, predicate := range p.Predicates {
+		rules = append(rules, PolicyRule{ID: predicate.ID, Expr: predicate.expr(), Required: predicate.Required})
+	}
+	return rules
+}
+
+// compilePacks parses every pack's rules, failing on the first malformed one
+func compilePacks(packs []Pack) ([]Pack, error) {
+	compiled := make([]Pack, len(packs))
+	for i, pack := range packs {
+		rules, err := compileRules(pack.policyRules())
+		if err != nil {
+			return nil, fmt.Errorf("pack %s: %w", pack.ID, err)
+		}
+		if err := validateMatchRules(pack.Match, rules); err != nil {
+			return nil, fmt.Errorf("pack %s: %w", pack.ID, err)
+		}
+		pack.compiled = rules
+		compiled[i] = pack
+	}
+	return compiled, nil
+}
+
+// PackPredicate is one requirement of a trust pack, as in docs/PACKS
+type PackPredicate struct {
+	ID              string      `json:"id"`
+	Claim           string      `json:"claim"`
+	Operator        string      `json:"operator"`
+	Value           interface{} `json:"value"`
+	IssuersAccepted []string    `json:"issuersAccepted,omitempty"`
+	CredentialTypes []string    `json:"credentialTypes,omitempty"`
+	ProofType       string      `json:"proofType"`
+	// ZK requires an unlinkable proof of the predicate, such as an
+	// age_over_N claim disclosed from a BBS-signed ldp_vc
+	ZK       bool  `json:"zk,omitempty"`
+	Required *bool `json:"required,omitempty"` // defaults to true
+}
+
+func (p PackPredicate) isRequired() bool {
+	return p.Required == nil || *p.Required
+}
+
+// expr renders the predicate in the rule language. A disclosed age_over_N
+// claim satisfies an age threshold just as the age itself does; a ZK
+// threshold is only met by that claim, as the age would reveal more.
+func (p PackPredicate) expr() string {
+	if p.Operator == "boolean" {
+		return p.zk(fmt.Sprintf("%s == %v", p.Claim, p.Value))
+	}
+	value := fmt.Sprint(p.Value)
+	if s, ok := p.Value.(string); ok {
+		value = strconv.Quote(s)
+	}
+	if p.Claim == "age" && p.Operator == ">=" {
+		over := fmt.Sprintf("age_over_%s == true", value)
+		if p.ZK {
+			return p.zk(over)
+		}
+		return fmt.Sprintf("%s %s %s || %s", p.Claim, p.Operator, value, over)
+	}
+	return p.zk(fmt.Sprintf("%s %s %s", p.Claim, p.Operator, value))
+}
+
+func (p PackPredicate) zk(expr string) string {
+	if p.ZK {
+		return "zk(" + expr + ")"
+	}
+	return expr
+}
+
+func optional() *bool {
+	required := false
+	return &required
+}
+
+// defaultPacks mirrors the base pack definitions in docs/PACKS
+func defaultPacks() []Pack {
+	return []Pack{
+		{
+			ID:      "pack.childcare.readiness@0.1.0",
+			Version: "0.1.0",
+			Name:    "Childcare Readiness",
+			Purpose: "Assess suitability for paid childcare work in private homes",
+			Freshness: &FreshnessPolicy{
+				MaxCredentialAge:   Duration(90 * 24 * time.Hour),
+				MaxVerificationAge: Duration(365 * 24 * time.Hour),
+				MaxClockSkew:       Duration(2 * time.Minute),
+			},
+			Match: []MatchRule{
+				{ID: "holder.consistent", Claims: []string{"family_name", "given_name"}, Description: "Every credential names the same person"},
+			},
+			Predicates: []PackPredicate{
+				{ID: "age.ge.18", Claim: "age", Operator: ">=", Value: 18, IssuersAccepted: []string{"did:veriff:*", "did:web:cachet.id"}, CredentialTypes: []string{"IdentityCredential"}, ProofType: ProofTypeSDJWT},
+				{ID: "identity.verified", Claim: "identity_liveness", Operator: "boolean", Value: true, IssuersAccepted: []string{"did:veriff:*", "did:web:cachet.id"}, CredentialTypes: []string{"IdentityCredential"}, ProofType: ProofTypeSDJWT},
+				{ID: "criminal.clear", Claim: "criminal_record_clear", Operator: "boolean", Value: true, IssuersAccepted: []string{"did:checks:*-eu"}, ProofType: ProofTypeBBS},
+				{ID: "firstaid.valid", Claim: "first_aid_cert_valid", Operator: "boolean", Value: true, IssuersAccepted: []string{"did:edu:*", "did:cert:*"}, ProofType: ProofTypeBBS, Required: optional()},
+				{ID: "references.verified", Claim: "references_count", Operator: ">=", Value: 2, IssuersAccepted: []string{"did:cachet:vouch"}, ProofType: ProofTypeZK},
+			},
+		},
+		{
+			ID:      "pack.safe.seller@0.1.0",
+			Version: "0.1.0",
+			Name:    "Safe Seller",
+			Purpose: "Reduce counterparty and fraud risk in peer-to-peer sales",
+			Freshness: &FreshnessPolicy{
+				MaxCredentialAge: Duration(180 * 24 * time.Hour),
+				MaxClockSkew:     Duration(2 * time.Minute),
+			},
+			Predicates: []PackPredicate{
+				{ID: "identity.verified", Claim: "identity_liveness", Operator: "boolean", Value: true, IssuersAccepted: []string{"did:veriff:*", "did:web:cachet.id"}, CredentialTypes: []string{"IdentityCredential"}, ProofType: ProofTypeSDJWT},
+				{ID: "platform.tenure", Claim: "platform_tenure_months_max", Operator: ">=", Value: 6, IssuersAccepted: []string{"did:platform:*"}, ProofType: ProofTypeZK},
+				{ID: "platform.fulfilment", Claim: "fulfilment_rate", Operator: ">=", Value: 0.95, IssuersAccepted: []string{"did:platform:*"}, ProofType: ProofTypeZK},
+				{ID: "chargeback.risk.low", Claim: "chargeback_ratio", Operator: "<", Value: 0.01, IssuersAccepted: []string{"did:payments:*"}, ProofType: ProofTypeBBS, Required: optional()},
+			},
+		},
+	}
+}
+
+// packSet holds the compiled packs the verifier evaluates. Reloads swap the
+// whole set, so a verification sees either the old packs or the new ones.
+type packSet struct {
+	mu    sync.RWMutex
+	packs []Pack
+}
+
+func newPackSet(packs []Pack) *packSet {
+	return &packSet{packs: packs}
+}
+
+func (p *packSet) All() []Pack {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]Pack(nil), p.packs...)
+}
+
+func (p *packSet) Find(id string) (Pack, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, pack := range p.packs {
+		if pack.ID == id {
+			return pack, true
+		}
+	}
+	return Pack{}, false
+}
+
+func (p *packSet) Replace(packs []Pack) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.packs = packs
+}
+
+func (s *Server) findPack(id string) (Pack, bool) {
+	return s.packs.Find(id)
+}
+
+func (s *Server) handlePresentationDefinition(w http.ResponseWriter, r *http.Request) {
+	pack, ok := s.findPack(chi.URLParam(r, "id"))
+	if !ok || !s.verifier(r.Context()).offers(pack.ID) {
+		problem.Error(w, r, "Pack not found", http.StatusNotFound)
+		return
+	}
+	log.Debug().Str("pack_id", pack.ID).Msg("Presentation definition requested")
+	writeJSON(w, http.StatusOK, s.packDefinition(pack))
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Pack rules are written in a small CEL-like expression language, e.g.
+//
+//	age >= 18
+//	verificationLevel in ["gold", "platinum"]
+//	credential.expiry > now + 30d
+//	identity_liveness && !(country in ["KP", "IR"])
+//
+// Identifiers are dotted claim paths looked up in the disclosed claims (at the
+// top level, then under credentialSubject). The credential.* namespace exposes
+// the verified envelope: issuer, vct, issuedAt, expiry, keyBound and
+// unlinkable.
+//
+// zk(expr) holds when expr does and the credential proves it without being
+// linkable to its other presentations, e.g. zk(age_over_18 == true) with an
+// age_over_18 claim disclosed from a BBS-signed ldp_vc, whose birthdate stays
+// hidden.
+
+// PolicyRule is one named rule of a pack policy
+type PolicyRule struct {
+	ID          string `json:"id" yaml:"id"`
+	Expr        string `json:"expr" yaml:"expr"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    *bool  `json:"required,omitempty" yaml:"required,omitempty"` // defaults to true
+}
+
+func (r PolicyRule) isRequired() bool {
+	return r.Required == nil || *r.Required
+}
+
+// PredicateResult is the outcome of evaluating one rule against a presentation
+type PredicateResult struct {
+	ID       string `json:"id"`
+	Passed   bool   `json:"passed"`
+	Required bool   `json:"required"`
+	Reason   string `json:"reason"`
+	// Credential is the index in the bundle of the credential that passed
+	// the rule; nil for failed rules and match rules
+	Credential *int `json:"credential,omitempty"`
+}
+
+// policyEnv is what rule identifiers resolve against
+type policyEnv struct {
+	claims   map[string]interface{}
+	verified VerifiedSDJWT
+	now      time.Time
+}
+
+// errNotDisclosed marks a rule that references a claim the holder withheld
+type errNotDisclosed struct{ path string }
+
+func (e errNotDisclosed) Error() string { return e.path + " is not disclosed" }
+
+// compiledRule is a parsed rule ready for evaluation
+type compiledRule struct {
+	PolicyRule
+	expr policyExpr
+}
+
+// compileRules parses every rule up front so malformed packs are rejected at load
+func compileRules(rules []PolicyRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if rule.ID == "" {
+			return nil, errors.New("policy rule without an id")
+		}
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("duplicate policy rule %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		expr, err := parsePolicyExpr(rule.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+		compiled = append(compiled, compiledRule{PolicyRule: rule, expr: expr})
+	}
+	return compiled, nil
+}
+
+// evaluateRules runs each rule against the verified presentation
+func evaluateRules(rules []compiledRule, env policyEnv) []PredicateResult {
+	results := make([]PredicateResult, 0, len(rules))
+	for _, rule := range rules {
+		passed, reason := evaluateRule(rule.expr, env)
+		results = append(results, PredicateResult{
+			ID:       rule.ID,
+			Passed:   passed,
+			Required: rule.isRequired(),
+			Reason:   reason,
+		})
+	}
+	return results
+}
+
+func evaluateRule(expr policyExpr, env policyEnv) (bool, string) {
+	passed, reason, err := truthy(expr, env)
+	if err != nil {
+		return false, err.Error()
+	}
+	return passed, reason
+}
+
+// truthy evaluates a boolean expression, treating withheld claims as a
+// failed condition rather than an error so || can fall through
+func truthy(expr policyExpr, env policyEnv) (bool, string, error) {
+	result, err := expr.eval(env)
+	var missing errNotDisclosed
+	if errors.As(err, &missing) {
+		return false, missing.Error(), nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	b, ok := result.value.(bool)
+	if !ok {
+		return false, "", fmt.Errorf("%s is %s, not a boolean", expr, formatPolicyValue(result.value))
+	}
+	if result.reason == "" {
+		result.reason = fmt.Sprintf("%s is %t", expr, b)
+	}
+	return b, result.reason, nil
+}
+
+// policyResult is an evaluated value with an explanation for boolean results
+type policyResult struct {
+	value  interface{}
+	reason string
+}
+
+type policyExpr interface {
+	eval(env policyEnv) (policyResult, error)
+	String() string
+}
+
+type literalExpr struct {
+	value interface{}
+	src   string
+}
+
+func (e literalExpr) eval(policyEnv) (policyResult, error) { return policyResult{value: e.value}, nil }
+func (e literalExpr) String() string                       { return e.src }
+
+type nowExpr struct{}
+
+func (nowExpr) eval(env policyEnv) (policyResult, error) { return policyResult{value: env.now}, nil }
+func (nowExpr) String() string                           { return "now" }
+
+type listExpr []policyExpr
+
+func (e listExpr) eval(env policyEnv) (policyResult, error) {
+	items := make([]interface{}, len(e))
+	for i, item := range e {
+		r, err := item.eval(env)
+		if err != nil {
+			return policyResult{}, err
+		}
+		items[i] = r.value
+	}
+	return policyResult{value: items}, nil
+}
+
+func (e listExpr) String() string {
+	items := make([]string, len(e))
+	for i, item := range e {
+		items[i] = item.String()
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+type pathExpr string
+
+func (e pathExpr) String() string { return string(e) }
+
+func (e pathExpr) eval(env policyEnv) (policyResult, error) {
+	path := string(e)
+	if field, ok := strings.CutPrefix(path, "credential."); ok {
+		if value, ok := credentialField(env.verified, field); ok {
+			return policyResult{value: value}, nil
+		}
+		return policyResult{}, errNotDisclosed{path: path}
+	}
+	for _, root := range []map[string]interface{}{env.claims, subjectClaims(env.claims)} {
+		if value, ok := lookupClaim(root, path); ok {
+			return policyResult{value: normalizeClaim(value)}, nil
+		}
+	}
+	return policyResult{}, errNotDisclosed{path: path}
+}
+
+// credentialField exposes the verified envelope to rules
+func credentialField(v VerifiedSDJWT, field string) (interface{}, bool) {
+	switch field {
+	case "issuer":
+		return v.Issuer, v.Issuer != ""
+	case "vct", "type":
+		return v.Vct, v.Vct != ""
+	case "issuedAt":
+		return v.IssuedAt, !v.IssuedAt.IsZero()
+	case "expiry", "expiresAt":
+		return v.ExpiresAt, !v.ExpiresAt.IsZero()
+	case "keyBound":
+		return v.KeyBound, true
+	case "unlinkable":
+		return v.Unlinkable, true
+	}
+	return nil, false
+}
+
+func subjectClaims(claims map[string]interface{}) map[string]interface{} {
+	subject, _ := claims["credentialSubject"].(map[string]interface{})
+	return subject
+}
+
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = claims
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[segment]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// normalizeClaim converts JSON claim values to the types rules compare
+func normalizeClaim(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+		if t, err := time.Parse(time.DateOnly, v); err == nil {
+			return t
+		}
+	}
+	return value
+}
+
+type notExpr struct{ operand policyExpr }
+
+func (e notExpr) String() string { return "!" + e.operand.String() }
+
+// eval lets a withheld claim propagate: negating it must not pass the rule
+func (e notExpr) eval(env policyEnv) (policyResult, error) {
+	result, err := e.operand.eval(env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	passed, ok := result.value.(bool)
+	if !ok {
+		return policyResult{}, fmt.Errorf("%s is %s, not a boolean", e.operand, formatPolicyValue(result.value))
+	}
+	if result.reason == "" {
+		result.reason = fmt.Sprintf("%s is %t", e.operand, passed)
+	}
+	return policyResult{value: !passed, reason: "not (" + result.reason + ")"}, nil
+}
+
+// zkExpr requires its operand to hold on an unlinkable proof
+type zkExpr struct{ operand policyExpr }
+
+func (e zkExpr) String() string { return "zk(" + e.operand.String() + ")" }
+
+// eval fails before looking at the operand: a linkable credential does not
+// satisfy the rule even when it discloses the claims
+func (e zkExpr) eval(env policyEnv) (policyResult, error) {
+	if !env.verified.Unlinkable {
+		return policyResult{value: false, reason: e.operand.String() + " needs an unlinkable proof"}, nil
+	}
+	passed, reason, err := truthy(e.operand, env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	return policyResult{value: passed, reason: reason}, nil
+}
+
+type logicalExpr struct {
+	and         bool
+	left, right policyExpr
+}
+
+func (e logicalExpr) String() string {
+	op := "||"
+	if e.and {
+		op = "&&"
+	}
+	return "(" + e.left.String() + " " + op + " " + e.right.String() + ")"
+}
+
+func (e logicalExpr) eval(env policyEnv) (policyResult, error) {
+	left, leftReason, err := truthy(e.left, env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	// Short-circuit: the left operand alone decides the result
+	if left != e.and {
+		return policyResult{value: left, reason: leftReason}, nil
+	}
+	right, rightReason, err := truthy(e.right, env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	if e.and || !right {
+		return policyResult{value: right, reason: leftReason + "; " + rightReason}, nil
+	}
+	return policyResult{value: right, reason: rightReason}, nil
+}
+
+type arithmeticExpr struct {
+	op          byte // '+' or '-'
+	left, right policyExpr
+}
+
+func (e arithmeticExpr) String() string {
+	return e.left.String() + " " + string(e.op) + " " + e.right.String()
+}
+
+func (e arithmeticExpr) eval(env policyEnv) (policyResult, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	sign := 1.0
+	if e.op == '-' {
+		sign = -1
+	}
+	switch l := left.value.(type) {
+	case time.Time:
+		if d, ok := right.value.(time.Duration); ok {
+			return policyResult{value: l.Add(time.Duration(sign) * d)}, nil
+		}
+	case float64:
+		if r, ok := right.value.(float64); ok {
+			return policyResult{value: l + sign*r}, nil
+		}
+	}
+	return policyResult{}, fmt.Errorf("cannot evaluate %s", e)
+}
+
+type compareExpr struct {
+	op          string
+	left, right policyExpr
+}
+
+func (e compareExpr) String() string {
+	return e.left.String() + " " + e.op + " " + e.right.String()
+}
+
+func (e compareExpr) eval(env policyEnv) (policyResult, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return policyResult{}, err
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return policyResult{}, err
+	}
+
+	var passed bool
+	switch e.op {
+	case "in", "not in":
+		items, ok := right.value.([]interface{})
+		if !ok {
+			return policyResult{}, fmt.Errorf("%s: right-hand side of %s is not a list", e, e.op)
+		}
+		for _, item := range items {
+			if c, ok := comparePolicyValues(left.value, item); ok && c == 0 {
+				passed = true
+				break
+			}
+		}
+		if e.op == "not in" {
+			passed = !passed
+		}
+	default:
+		c, ok := comparePolicyValues(left.value, right.value)
+		if !ok {
+			return policyResult{}, fmt.Errorf("%s: cannot compare %s with %s", e, formatPolicyValue(left.value), formatPolicyValue(right.value))
+		}
+		switch e.op {
+		case "==":
+			passed = c == 0
+		case "!=":
+			passed = c != 0
+		case ">=":
+			passed = c >= 0
+		case ">":
+			passed = c > 0
+		case "<=":
+			passed = c <= 0
+		case "<":
+			passed = c < 0
+		}
+	}
+
+	reason := fmt.Sprintf("%s is %s", e.left, formatPolicyValue(left.value))
+	if passed {
+		reason += fmt.Sprintf(" (%s %s)", e.op, e.right)
+	} else {
+		reason += fmt.Sprintf(", not %s %s", e.op, e.right)
+	}
+	return policyResult{value: passed, reason: reason}, nil
+}
+
+// comparePolicyValues orders two values of the same kind; ok is false when
+// they cannot be compared (ordering of booleans only supports equality)
+func comparePolicyValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func formatPolicyValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprint(v)
+}
+
+// Parsing
+
+type policyToken struct {
+	kind string // ident, number, duration, string, or the operator itself
+	text string
+}
+
+// durationUnits are the suffixes accepted on duration literals such as 30d
+var durationUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+func tokenizePolicy(src string) ([]policyToken, error) {
+	var tokens []policyToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, policyToken{kind: "string", text: src[i+1 : i+1+end]})
+			i += end + 2
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			kind := "number"
+			if i < len(src) && durationUnits[src[i]] != 0 && (i+1 == len(src) || !isIdentByte(src[i+1])) {
+				kind = "duration"
+				i++
+			}
+			tokens = append(tokens, policyToken{kind: kind, text: src[start:i]})
+		case isIdentByte(c):
+			start := i
+			for i < len(src) && (isIdentByte(src[i]) || src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, policyToken{kind: "ident", text: src[start:i]})
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", ">=", "<=", ">", "<", "!", "(", ")", "[", "]", ",", "+", "-"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, policyToken{kind: op, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c < unicode.MaxASCII && unicode.IsLetter(rune(c))
+}
+
+// policyKeywords cannot be used as claim names
+var policyKeywords = map[string]bool{"true": true, "false": true, "now": true, "in": true, "not": true, "and": true, "or": true}
+
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+// parsePolicyExpr parses a rule expression
+func parsePolicyExpr(src string) (policyExpr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, errors.New("empty expression")
+	}
+	tokens, err := tokenizePolicy(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &policyParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+func (p *policyParser) peek() policyToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return policyToken{}
+}
+
+// accept consumes the next token if it is one of the given operators or keywords
+func (p *policyParser) accept(kinds ...string) (string, bool) {
+	next := p.peek()
+	for _, kind := range kinds {
+		if next.kind == kind || next.kind == "ident" && next.text == kind {
+			p.pos++
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+func (p *policyParser) expect(kind string) error {
+	if _, ok := p.accept(kind); !ok {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at end of expression", kind)
+		}
+		return fmt.Errorf("expected %q, found %q", kind, p.peek().text)
+	}
+	return nil
+}
+
+func (p *policyParser) parseOr() (policyExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		var right policyExpr
+		if right, err = p.parseAnd(); err == nil {
+			left = logicalExpr{left: left, right: right}
+		}
+	}
+	return nil, err
+}
+
+func (p *policyParser) parseAnd() (policyExpr, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		var right policyExpr
+		if right, err = p.parseUnary(); err == nil {
+			left = logicalExpr{and: true, left: left, right: right}
+		}
+	}
+	return nil, err
+}
+
+func (p *policyParser) parseUnary() (policyExpr, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *policyParser) parseComparison() (policyExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", ">=", "<=", ">", "<", "in")
+	if !ok {
+		if next := p.tokens[min(p.pos+1, len(p.tokens)-1)]; p.peek().text == "not" && next.text == "in" {
+			p.pos += 2
+			op, ok = "not in", true
+		}
+	}
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return compareExpr{op: op, left: left, right: right}, nil
+}
+
+func (p *policyParser) parseAdditive() (policyExpr, error) {
+	left, err := p.parsePrimary()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		var right policyExpr
+		if right, err = p.parsePrimary(); err == nil {
+			left = arithmeticExpr{op: op[0], left: left, right: right}
+		}
+	}
+	return nil, err
+}
+
+func (p *policyParser) parsePrimary() (policyExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case "number":
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		return literalExpr{value: n, src: token.text}, nil
+	case "duration":
+		n, err := strconv.ParseFloat(token.text[:len(token.text)-1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q", token.text)
+		}
+		unit := durationUnits[token.text[len(token.text)-1]]
+		return literalExpr{value: time.Duration(n * float64(unit)), src: token.text}, nil
+	case "string":
+		return literalExpr{value: token.text, src: strconv.Quote(token.text)}, nil
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case "[":
+		var items listExpr
+		for p.peek().kind != "]" {
+			// Bare words in a list are enum values: level in [gold, platinum]
+			if next := p.peek(); next.kind == "ident" && !strings.Contains(next.text, ".") && !policyKeywords[next.text] {
+				p.pos++
+				items = append(items, literalExpr{value: next.text, src: next.text})
+			} else {
+				item, err := p.parseAdditive()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		return items, p.expect("]")
+	case "ident":
+		switch token.text {
+		case "true", "false":
+			return literalExpr{value: token.text == "true", src: token.text}, nil
+		case "now":
+			return nowExpr{}, nil
+		case "zk":
+			if p.peek().kind == "(" {
+				p.pos++
+				operand, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				return zkExpr{operand: operand}, p.expect(")")
+			}
+		}
+		if policyKeywords[token.text] {
+			return nil, fmt.Errorf("unexpected %q", token.text)
+		}
+		if strings.HasSuffix(token.text, ".") || strings.Contains(token.text, "..") {
+			return nil, fmt.Errorf("invalid claim path %q", token.text)
+		}
+		return pathExpr(token.text), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
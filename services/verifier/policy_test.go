@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func evalRule(t *testing.T, expr string, env policyEnv) (bool, string) {
+	t.Helper()
+	parsed, err := parsePolicyExpr(expr)
+	require.NoError(t, err, expr)
+	return evaluateRule(parsed, env)
+}
+
+func TestPolicyRules_Evaluate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	env := policyEnv{
+		now: now,
+		claims: map[string]interface{}{
+			"age":               float64(34),
+			"verificationLevel": "gold",
+			"identity_liveness": true,
+			"address":           map[string]interface{}{"country": "FR"},
+			"credentialSubject": map[string]interface{}{"licenceExpiry": "2026-06-30"},
+		},
+		verified: VerifiedSDJWT{Issuer: "did:web:cachet.id", ExpiresAt: now.Add(90 * 24 * time.Hour)},
+	}
+
+	tests := []struct {
+		expr   string
+		passed bool
+	}{
+		{"age >= 18", true},
+		{"age > 34", false},
+		{"age != 34", false},
+		{"verificationLevel in [gold, platinum]", true},
+		{"verificationLevel in ['silver']", false},
+		{`address.country not in ["KP", "IR"]`, true},
+		{"credential.expiry > now + 30d", true},
+		{"credential.expiry > now + 1y", false},
+		{"licenceExpiry >= now + 4w", true},
+		{`credential.issuer == "did:web:cachet.id"`, true},
+		{"identity_liveness && age < 65", true},
+		{"!identity_liveness || age >= 21", true},
+		{"age_over_18 == true || age >= 18", true},
+		{"age_over_18 == true && age >= 18", false},
+		{"not (age >= 18 and identity_liveness)", false},
+	}
+	for _, tt := range tests {
+		passed, reason := evalRule(t, tt.expr, env)
+		assert.Equal(t, tt.passed, passed, "%s: %s", tt.expr, reason)
+		assert.NotEmpty(t, reason, tt.expr)
+	}
+}
+
+func TestPolicyRules_Reasons(t *testing.T) {
+	env := policyEnv{claims: map[string]interface{}{"age": float64(17)}, now: time.Now()}
+
+	_, reason := evalRule(t, "age >= 18", env)
+	assert.Equal(t, "age is 17, not >= 18", reason)
+
+	_, reason = evalRule(t, "country in [FR, DE]", env)
+	assert.Equal(t, "country is not disclosed", reason)
+
+	_, reason = evalRule(t, `age == "17"`, env)
+	assert.Contains(t, reason, "cannot compare")
+}
+
+func TestPolicyRules_NegatingWithheldClaimFails(t *testing.T) {
+	env := policyEnv{claims: map[string]interface{}{}, now: time.Now()}
+	passed, reason := evalRule(t, "!(country in [KP, IR])", env)
+	assert.False(t, passed)
+	assert.Equal(t, "country is not disclosed", reason)
+}
+
+func TestPolicyRules_ParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "age >=", "age >= 18)", "(age >= 18", "level in [gold", "name == 'open", "age # 3", "in >= 2"} {
+		_, err := parsePolicyExpr(expr)
+		assert.Error(t, err, expr)
+	}
+
+	_, err := compileRules([]PolicyRule{{ID: "a", Expr: "x == 1"}, {ID: "a", Expr: "y == 1"}})
+	assert.ErrorContains(t, err, "duplicate")
+}
+
+func TestPackPredicateExpr(t *testing.T) {
+	assert.Equal(t, "identity_liveness == true", PackPredicate{Claim: "identity_liveness", Operator: "boolean", Value: true}.expr())
+	assert.Equal(t, "chargeback_ratio < 0.01", PackPredicate{Claim: "chargeback_ratio", Operator: "<", Value: 0.01}.expr())
+	assert.Equal(t, "age >= 18 || age_over_18 == true", PackPredicate{Claim: "age", Operator: ">=", Value: 18}.expr())
+	assert.Equal(t, "zk(age_over_18 == true)", PackPredicate{Claim: "age", Operator: ">=", Value: 18, ZK: true}.expr())
+	assert.Equal(t, "zk(references_count >= 2)", PackPredicate{Claim: "references_count", Operator: ">=", Value: 2, ZK: true}.expr())
+}
+
+func TestPolicyRules_ZK(t *testing.T) {
+	claims := map[string]interface{}{"credentialSubject": map[string]interface{}{"age_over_18": true}}
+	linkable := policyEnv{claims: claims, now: time.Now()}
+	unlinkable := policyEnv{claims: claims, verified: VerifiedSDJWT{Unlinkable: true}, now: time.Now()}
+
+	passed, reason := evalRule(t, "zk(age_over_18 == true)", unlinkable)
+	assert.True(t, passed, reason)
+	passed, reason = evalRule(t, "zk(age_over_18 == true)", linkable)
+	assert.False(t, passed)
+	assert.Equal(t, "age_over_18 == true needs an unlinkable proof", reason)
+	passed, reason = evalRule(t, "zk(age_over_21 == true)", unlinkable)
+	assert.False(t, passed)
+	assert.Equal(t, "age_over_21 is not disclosed", reason)
+	passed, _ = evalRule(t, "zk(age_over_18 == true) || credential.unlinkable", linkable)
+	assert.False(t, passed)
+
+	// zk is still a claim name when not called
+	passed, _ = evalRule(t, "zk == 1", policyEnv{claims: map[string]interface{}{"zk": float64(1)}, now: time.Now()})
+	assert.True(t, passed)
+	_, err := parsePolicyExpr("zk(age_over_18 == true")
+	assert.Error(t, err)
+}
+
+func TestVerifyPresentation_ReportsRuleResults(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{
+		"identity_liveness":          true,
+		"platform_tenure_months_max": 4,
+		"fulfilment_rate":            0.99,
+	})
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	body, err := json.Marshal(VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Satisfied)
+	require.Len(t, resp.Results, 4)
+	first := 0
+	assert.Equal(t, PredicateResult{ID: "identity.verified", Passed: true, Required: true, Reason: "identity_liveness is true (== true)", Credential: &first}, resp.Results[0])
+	assert.Equal(t, PredicateResult{ID: "platform.tenure", Passed: false, Required: true, Reason: "platform_tenure_months_max is 4, not >= 6"}, resp.Results[1])
+	assert.True(t, resp.Results[2].Passed)
+	assert.Equal(t, PredicateResult{ID: "chargeback.risk.low", Passed: false, Required: false, Reason: "chargeback_ratio is not disclosed"}, resp.Results[3])
+	assert.Equal(t, []string{"identity.verified", "platform.fulfilment"}, resp.Predicates)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Predicate identifiers derived from disclosed claims
+const (
+	PredicateIdentityVerified = "identity.verified"
+	predicateAgePrefix        = "age.ge."
+)
+
+// ageThresholds are the age.ge.N predicates derivable from a disclosed age
+var ageThresholds = []int{16, 18, 21, 65}
+
+// derivePredicates maps disclosed claims to the predicates they prove.
+// Claims may sit at the top level (SD-JWT VC) or under credentialSubject.
+func derivePredicates(claims map[string]interface{}) []string {
+	found := map[string]bool{}
+	collectPredicates(claims, found)
+	if subject, ok := claims["credentialSubject"].(map[string]interface{}); ok {
+		collectPredicates(subject, found)
+	}
+
+	predicates := make([]string, 0, len(found))
+	for predicate := range found {
+		predicates = append(predicates, predicate)
+	}
+	sort.Strings(predicates)
+	return predicates
+}
+
+func collectPredicates(claims map[string]interface{}, found map[string]bool) {
+	for name, value := range claims {
+		switch {
+		case name == "verified" || name == "identity_liveness":
+			if v, ok := value.(bool); ok && v {
+				found[PredicateIdentityVerified] = true
+			}
+		case strings.HasPrefix(name, "age_over_"):
+			threshold, err := strconv.Atoi(strings.TrimPrefix(name, "age_over_"))
+			if v, ok := value.(bool); ok && v && err == nil {
+				found[agePredicate(threshold)] = true
+			}
+		case name == "age":
+			addAgePredicates(value, found)
+		case name == "personalData":
+			if personal, ok := value.(map[string]interface{}); ok {
+				addAgePredicates(personal["age"], found)
+			}
+		}
+	}
+}
+
+func addAgePredicates(value interface{}, found map[string]bool) {
+	age, ok := value.(float64)
+	if !ok {
+		return
+	}
+	for _, threshold := range ageThresholds {
+		if int(age) >= threshold {
+			found[agePredicate(threshold)] = true
+		}
+	}
+}
+
+func agePredicate(threshold int) string {
+	return fmt.Sprintf("%s%d", predicateAgePrefix, threshold)
+}
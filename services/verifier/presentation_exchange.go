@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/bbs"
+)
+
+// DIF Presentation Exchange 2.0 structures used in OpenID4VP requests
+
+type PresentationDefinition struct {
+	ID                     string                  `json:"id"`
+	Name                   string                  `json:"name,omitempty"`
+	Purpose                string                  `json:"purpose,omitempty"`
+	SubmissionRequirements []SubmissionRequirement `json:"submission_requirements,omitempty"`
+	InputDescriptors       []InputDescriptor       `json:"input_descriptors"`
+}
+
+type SubmissionRequirement struct {
+	Name string `json:"name,omitempty"`
+	Rule string `json:"rule"` // all or pick
+	Min  *int   `json:"min,omitempty"`
+	From string `json:"from"`
+}
+
+type InputDescriptor struct {
+	ID          string                         `json:"id"`
+	Name        string                         `json:"name,omitempty"`
+	Purpose     string                         `json:"purpose,omitempty"`
+	Group       []string                       `json:"group,omitempty"`
+	Format      map[string]map[string][]string `json:"format,omitempty"`
+	Constraints Constraints                    `json:"constraints"`
+}
+
+type Constraints struct {
+	LimitDisclosure string  `json:"limit_disclosure,omitempty"`
+	Fields          []Field `json:"fields,omitempty"`
+}
+
+type Field struct {
+	Path     []string               `json:"path"`
+	Filter   map[string]interface{} `json:"filter,omitempty"`
+	Optional bool                   `json:"optional,omitempty"`
+}
+
+// PresentationSubmission maps vp_token entries to input descriptors
+type PresentationSubmission struct {
+	ID            string              `json:"id"`
+	DefinitionID  string              `json:"definition_id"`
+	DescriptorMap []SubmissionMapping `json:"descriptor_map"`
+}
+
+type SubmissionMapping struct {
+	ID     string `json:"id"`
+	Format string `json:"format"`
+	Path   string `json:"path"`
+}
+
+// sdJWTFormats advertises the SD-JWT VC formats and algorithms the verifier
+// accepts, narrowed by the compliance profile
+func (s *Server) sdJWTFormats() map[string]map[string][]string {
+	algs := issuerSigningMethods
+	if len(s.profile.AllowedAlgorithms) > 0 {
+		algs = s.profile.AllowedAlgorithms
+	}
+	params := map[string][]string{"sd-jwt_alg_values": algs, "kb-jwt_alg_values": algs}
+	return map[string]map[string][]string{FormatDCSDJWT: params, FormatSDJWTVC: params}
+}
+
+// Submission requirement groups for required and optional pack predicates
+const (
+	groupRequired = "required"
+	groupOptional = "optional"
+)
+
+// proofFormats maps a pack proof type to the Presentation Exchange formats
+// that can carry it; nil means any format
+func (s *Server) proofFormats(proofType string) map[string]map[string][]string {
+	switch proofType {
+	case ProofTypeSDJWT:
+		return s.sdJWTFormats()
+	case ProofTypeBBS:
+		return map[string]map[string][]string{
+			FormatLDPVC: {"proof_type": {bbs.ProofType, "BbsBlsSignature2020"}},
+		}
+	}
+	return nil
+}
+
+// zkFormats is the only format that proves a ZK predicate: an ldp_vc derived
+// from a BBS signature
+func zkFormats() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		FormatLDPVC: {"proof_type": {bbs.ProofType}, "cryptosuite": {bbs.Cryptosuite}},
+	}
+}
+
+// predicateFilter translates a pack operator into a JSON Schema filter
+func predicateFilter(p PackPredicate) map[string]interface{} {
+	switch p.Operator {
+	case "boolean":
+		return map[string]interface{}{"type": "boolean", "const": p.Value}
+	case ">=":
+		return map[string]interface{}{"type": "number", "minimum": p.Value}
+	case ">":
+		return map[string]interface{}{"type": "number", "exclusiveMinimum": p.Value}
+	case "<=":
+		return map[string]interface{}{"type": "number", "maximum": p.Value}
+	case "<":
+		return map[string]interface{}{"type": "number", "exclusiveMaximum": p.Value}
+	case "==":
+		return map[string]interface{}{"const": p.Value}
+	}
+	return nil
+}
+
+// issuerPattern turns accepted issuer globs such as did:veriff:* into a regex
+func issuerPattern(globs []string) string {
+	alternatives := make([]string, len(globs))
+	for i, glob := range globs {
+		alternatives[i] = strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*")
+	}
+	return "^(" + strings.Join(alternatives, "|") + ")$"
+}
+
+// packDefinition generates one input descriptor per pack predicate, grouping
+// them so optional predicates may be left out of the submission
+func (s *Server) packDefinition(pack Pack) PresentationDefinition {
+	def := PresentationDefinition{ID: pack.ID, Name: pack.Name, Purpose: pack.Purpose}
+	hasOptional := false
+	for _, predicate := range pack.Predicates {
+		group := groupRequired
+		if !predicate.isRequired() {
+			group, hasOptional = groupOptional, true
+		}
+
+		claim, filter := predicate.Claim, predicateFilter(predicate)
+		if predicate.ZK && claim == "age" && predicate.Operator == ">=" {
+			// The threshold claim is disclosed rather than the age
+			claim, filter = fmt.Sprintf("age_over_%v", predicate.Value), map[string]interface{}{"type": "boolean", "const": true}
+		}
+		fields := []Field{{
+			Path:   []string{"$." + claim, "$.credentialSubject." + claim},
+			Filter: filter,
+		}}
+		if len(predicate.CredentialTypes) > 0 {
+			fields = append(fields, Field{
+				Path:   []string{"$.vct", "$.type"},
+				Filter: map[string]interface{}{"type": "string", "pattern": "(^|/)(" + strings.Join(predicate.CredentialTypes, "|") + ")$"},
+			})
+		}
+		if len(predicate.IssuersAccepted) > 0 {
+			fields = append(fields, Field{
+				Path:   []string{"$.iss", "$.issuer"},
+				Filter: map[string]interface{}{"type": "string", "pattern": issuerPattern(predicate.IssuersAccepted)},
+			})
+		}
+
+		constraints := Constraints{Fields: fields}
+		if predicate.ProofType == ProofTypeSDJWT || predicate.ZK {
+			constraints.LimitDisclosure = "required"
+		}
+		format := s.proofFormats(predicate.ProofType)
+		if predicate.ZK {
+			format = zkFormats()
+		}
+		def.InputDescriptors = append(def.InputDescriptors, InputDescriptor{
+			ID:          predicate.ID,
+			Name:        predicate.ID,
+			Purpose:     pack.Purpose,
+			Group:       []string{group},
+			Format:      format,
+			Constraints: constraints,
+		})
+	}
+
+	def.SubmissionRequirements = []SubmissionRequirement{{Name: "Required predicates", Rule: "all", From: groupRequired}}
+	if hasOptional {
+		none := 0
+		def.SubmissionRequirements = append(def.SubmissionRequirements,
+			SubmissionRequirement{Name: "Optional predicates", Rule: "pick", Min: &none, From: groupOptional})
+	}
+	return def
+}
+
+// presentationDefinition describes what a holder must present for a policy,
+// falling back to any Cachet credential for policies without a pack
+func (s *Server) presentationDefinition(policyID string) PresentationDefinition {
+	if pack, ok := s.findPack(policyID); ok {
+		return s.packDefinition(pack)
+	}
+	return PresentationDefinition{
+		ID:   policyID,
+		Name: policyID,
+		InputDescriptors: []InputDescriptor{{
+			ID:     "cachet-credential",
+			Format: s.sdJWTFormats(),
+			Constraints: Constraints{
+				LimitDisclosure: "required",
+				Fields:          []Field{{Path: []string{"$.vct"}}},
+			},
+		}},
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresentationDefinition_FromPack(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/packs/pack.childcare.readiness@0.1.0/presentation-definition", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var def PresentationDefinition
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &def))
+	assert.Equal(t, "pack.childcare.readiness@0.1.0", def.ID)
+	require.Len(t, def.InputDescriptors, 5)
+
+	age := def.InputDescriptors[0]
+	assert.Equal(t, "age.ge.18", age.ID)
+	assert.Equal(t, []string{groupRequired}, age.Group)
+	assert.Equal(t, "required", age.Constraints.LimitDisclosure)
+	assert.Contains(t, age.Format, FormatDCSDJWT)
+	assert.Equal(t, []string{"$.age", "$.credentialSubject.age"}, age.Constraints.Fields[0].Path)
+	assert.Equal(t, map[string]interface{}{"type": "number", "minimum": float64(18)}, age.Constraints.Fields[0].Filter)
+
+	firstAid := def.InputDescriptors[3]
+	assert.Equal(t, []string{groupOptional}, firstAid.Group)
+	assert.Contains(t, firstAid.Format, "ldp_vc")
+
+	require.Len(t, def.SubmissionRequirements, 2)
+	assert.Equal(t, "all", def.SubmissionRequirements[0].Rule)
+	assert.Equal(t, "pick", def.SubmissionRequirements[1].Rule)
+	require.NotNil(t, def.SubmissionRequirements[1].Min)
+	assert.Zero(t, *def.SubmissionRequirements[1].Min)
+}
+
+func TestPresentationDefinition_UnknownPack(t *testing.T) {
+	server := NewServer()
+	req := httptest.NewRequest(http.MethodGet, "/packs/pack.unknown@1.0.0/presentation-definition", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestIssuerPattern(t *testing.T) {
+	pattern := regexp.MustCompile(issuerPattern([]string{"did:veriff:*", "did:checks:*-eu"}))
+	assert.True(t, pattern.MatchString("did:veriff:production"))
+	assert.True(t, pattern.MatchString("did:checks:police-eu"))
+	assert.False(t, pattern.MatchString("did:checks:police-us"))
+	assert.False(t, pattern.MatchString("did:web:veriff.example"))
+}
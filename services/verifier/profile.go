@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+// Compliance profile names selectable per deployment
+const (
+	ProfileDefault = "default"
+	ProfileEUDIARF = "eudi-arf"
+)
+
+// EUDI PID identifiers from the ARF PID rulebook
+const (
+	EUDIPIDVct     = "urn:eu.europa.ec.eudi:pid:1"
+	EUDIPIDDoctype = "eu.europa.ec.eudi.pid.1"
+)
+
+// ClientIDSchemeX509SANDNS authenticates request objects with an X.509
+// chain in x5c whose leaf names the client_id as a DNS subject alternative
+// name (OpenID4VP client identifier schemes)
+const ClientIDSchemeX509SANDNS = "x509_san_dns"
+
+// Presentation formats understood by the verifier
+const (
+	FormatSDJWTVC = "vc+sd-jwt"
+	FormatDCSDJWT = "dc+sd-jwt"
+	FormatMsoMdoc = "mso_mdoc"
+)
+
+// ComplianceProfile captures the presentation rules a deployment enforces.
+// RequireSignedRequest and ClientIDSchemes govern the verifier rather than
+// presentations: it refuses to start unless wallets can authenticate its
+// request objects, under one of ClientIDSchemes if any (see CheckSigner).
+type ComplianceProfile struct {
+	Name                 string   `json:"name"`
+	AcceptedFormats      []string `json:"acceptedFormats,omitempty"`
+	AllowedAlgorithms    []string `json:"allowedAlgorithms,omitempty"`
+	AcceptedPIDTypes     []string `json:"acceptedPidTypes,omitempty"`
+	RequireKeyBinding    bool     `json:"requireKeyBinding"`
+	RequireSignedRequest bool     `json:"requireSignedRequest"`
+	ClientIDSchemes      []string `json:"clientIdSchemes,omitempty"`
+}
+
+var complianceProfiles = map[string]ComplianceProfile{
+	// The default profile keeps the verifier permissive for Cachet-native flows
+	ProfileDefault: {
+		Name: ProfileDefault,
+	},
+	// EUDI Wallet Architecture and Reference Framework requirements
+	ProfileEUDIARF: {
+		Name:                 ProfileEUDIARF,
+		AcceptedFormats:      []string{FormatDCSDJWT, FormatSDJWTVC, FormatMsoMdoc},
+		AllowedAlgorithms:    []string{"ES256", "ES384", "ES512"},
+		AcceptedPIDTypes:     []string{EUDIPIDVct, EUDIPIDDoctype},
+		RequireKeyBinding:    true,
+		RequireSignedRequest: true,
+		ClientIDSchemes:      []string{ClientIDSchemeX509SANDNS},
+	},
+}
+
+// LookupProfile returns the named compliance profile
+func LookupProfile(name string) (ComplianceProfile, error) {
+	if name == "" {
+		name = ProfileDefault
+	}
+	profile, ok := complianceProfiles[name]
+	if !ok {
+		return ComplianceProfile{}, fmt.Errorf("unknown compliance profile %q", name)
+	}
+	return profile, nil
+}
+
+// CheckSigner reports why wallets would refuse the request objects of
+// signer under the profile
+func (p ComplianceProfile) CheckSigner(signer *requestSigner) error {
+	scheme := signer.clientIDScheme()
+	if p.RequireSignedRequest && scheme == "" {
+		return fmt.Errorf("profile %s requires request objects signed with a certified key", p.Name)
+	}
+	if len(p.ClientIDSchemes) > 0 && !contains(p.ClientIDSchemes, scheme) {
+		return fmt.Errorf("profile %s accepts the client_id schemes %s, not %q", p.Name, strings.Join(p.ClientIDSchemes, ", "), scheme)
+	}
+	return nil
+}
+
+// PresentationEnvelope is the format-level view of a presented credential
+type PresentationEnvelope struct {
+	Format         string
+	Presentation   string // compact SD-JWT, mdoc DeviceResponse or ldp_vc JSON
+	Algorithm      string
+	CredentialType string
+	HasKeyBinding  bool
+}
+
+var errUnrecognizedBundle = errors.New("bundle is not a recognized presentation")
+
+// maxBundleCredentials bounds the credentials presented in one bundle
+const maxBundleCredentials = 8
+
+// parsePresentationBundle extracts the presentations of a bundle, which is a
+// single presentation or a JSON array of them (e.g. an identity credential,
+// a background check and a first-aid certificate)
+func parsePresentationBundle(bundle interface{}) ([]PresentationEnvelope, error) {
+	items, ok := bundle.([]interface{})
+	if !ok {
+		envelope, err := parsePresentationEnvelope(bundle)
+		if err != nil {
+			return nil, err
+		}
+		return []PresentationEnvelope{envelope}, nil
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: bundle is empty", errUnrecognizedBundle)
+	}
+	if len(items) > maxBundleCredentials {
+		return nil, fmt.Errorf("%w: bundle holds %d credentials, more than %d", errUnrecognizedBundle, len(items), maxBundleCredentials)
+	}
+	envelopes := make([]PresentationEnvelope, 0, len(items))
+	for i, item := range items {
+		envelope, err := parsePresentationEnvelope(item)
+		if err != nil {
+			return nil, fmt.Errorf("credential %d: %w", i, err)
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes, nil
+}
+
+// parsePresentationEnvelope extracts format metadata from a bundle, which may
+// be a compact SD-JWT string or an object of the form
+// {"format": "...", "presentation": "..."}; an ldp_vc presentation may be
+// the derived credential itself rather than its encoding
+func parsePresentationEnvelope(bundle interface{}) (PresentationEnvelope, error) {
+	var format, presentation string
+	switch b := bundle.(type) {
+	case string:
+		format, presentation = FormatDCSDJWT, b
+	case map[string]interface{}:
+		format, _ = b["format"].(string)
+		if format == FormatLDPVC {
+			return ldpEnvelope(b["presentation"])
+		}
+		presentation, _ = b["presentation"].(string)
+		if format == FormatMsoMdoc {
+			return mdocEnvelope(presentation)
+		}
+	default:
+		return PresentationEnvelope{}, errUnrecognizedBundle
+	}
+	if presentation == "" {
+		return PresentationEnvelope{}, errUnrecognizedBundle
+	}
+
+	parts := strings.Split(presentation, "~")
+	segments := strings.Split(parts[0], ".")
+	if len(segments) != 3 {
+		return PresentationEnvelope{}, fmt.Errorf("%w: issuer JWT is malformed", errUnrecognizedBundle)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+	}
+	if err := decodeSegment(segments[0], &header); err != nil {
+		return PresentationEnvelope{}, fmt.Errorf("%w: %v", errUnrecognizedBundle, err)
+	}
+	var payload struct {
+		Vct string `json:"vct"`
+	}
+	if err := decodeSegment(segments[1], &payload); err != nil {
+		return PresentationEnvelope{}, fmt.Errorf("%w: %v", errUnrecognizedBundle, err)
+	}
+	if header.Typ != "" && format == "" {
+		format = header.Typ
+	}
+
+	return PresentationEnvelope{
+		Format:         format,
+		Presentation:   presentation,
+		Algorithm:      header.Alg,
+		CredentialType: payload.Vct,
+		// An SD-JWT with key binding ends in a KB-JWT rather than a trailing "~"
+		HasKeyBinding: len(parts) > 1 && parts[len(parts)-1] != "",
+	}, nil
+}
+
+// mdocEnvelope reads the doctype and device authentication of an mdoc
+// DeviceResponse without verifying it
+func mdocEnvelope(presentation string) (PresentationEnvelope, error) {
+	if presentation == "" {
+		return PresentationEnvelope{}, errUnrecognizedBundle
+	}
+	response, err := decodeDeviceResponse(presentation)
+	if err != nil {
+		return PresentationEnvelope{}, fmt.Errorf("%w: %v", errUnrecognizedBundle, err)
+	}
+	doc := response.Documents[0]
+	return PresentationEnvelope{
+		Format:         FormatMsoMdoc,
+		Presentation:   presentation,
+		CredentialType: doc.DocType,
+		HasKeyBinding:  doc.DeviceSigned != nil && doc.DeviceSigned.DeviceAuth.DeviceSignature != nil,
+	}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Check returns every rule of the profile the bundle violates. In a
+// multi-credential bundle each credential must meet the format rules, and at
+// least one must be a PID.
+func (p ComplianceProfile) Check(bundle interface{}) []string {
+	if p.isPermissive() {
+		return nil
+	}
+
+	envelopes, err := parsePresentationBundle(bundle)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var violations []string
+	pidPresented := false
+	for i, envelope := range envelopes {
+		prefix := ""
+		if len(envelopes) > 1 {
+			prefix = fmt.Sprintf("credential %d: ", i)
+		}
+		if len(p.AcceptedFormats) > 0 && !contains(p.AcceptedFormats, envelope.Format) {
+			violations = append(violations, fmt.Sprintf("%sformat %q not accepted", prefix, envelope.Format))
+		}
+		if envelope.Format != FormatMsoMdoc && len(p.AllowedAlgorithms) > 0 && !contains(p.AllowedAlgorithms, envelope.Algorithm) {
+			violations = append(violations, fmt.Sprintf("%salgorithm %q not allowed", prefix, envelope.Algorithm))
+		}
+		if p.RequireKeyBinding && !envelope.HasKeyBinding {
+			violations = append(violations, prefix+"key binding JWT required")
+		}
+		pidPresented = pidPresented || contains(p.AcceptedPIDTypes, envelope.CredentialType)
+	}
+	if len(p.AcceptedPIDTypes) > 0 && !pidPresented {
+		if len(envelopes) == 1 {
+			violations = append(violations, fmt.Sprintf("credential type %q is not a PID", envelopes[0].CredentialType))
+		} else {
+			violations = append(violations, "no credential in the bundle is a PID")
+		}
+	}
+	return violations
+}
+
+func (p ComplianceProfile) isPermissive() bool {
+	return len(p.AcceptedFormats) == 0 && len(p.AllowedAlgorithms) == 0 &&
+		len(p.AcceptedPIDTypes) == 0 && !p.RequireKeyBinding
+}
+
+func contains(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Str("profile", s.profile.Name).Msg("Compliance profile requested")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.profile); err != nil {
+		log.Error().Err(err).Msg("Failed to encode profile response")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
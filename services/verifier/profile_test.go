@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeSDJWT(t *testing.T, header, payload map[string]interface{}, kbJWT string) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	p, err := json.Marshal(payload)
+	require.NoError(t, err)
+	jwt := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p) + ".sig"
+	return jwt + "~disclosure~" + kbJWT
+}
+
+func verifyWithProfile(t testing.TB, server *Server, session VerificationSession, bundle interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(VerifyRequest{PolicyID: session.PolicyID, Bundle: bundle, SessionID: session.ID})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLookupProfile(t *testing.T) {
+	profile, err := LookupProfile("")
+	require.NoError(t, err)
+	assert.Equal(t, ProfileDefault, profile.Name)
+
+	_, err = LookupProfile("unknown")
+	assert.Error(t, err)
+}
+
+func TestEUDIProfile_AcceptsConformantPID(t *testing.T) {
+	server := NewServerWithProfile(complianceProfiles[ProfileEUDIARF])
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server, EUDIPIDVct)
+
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"vct": EUDIPIDVct},
+		map[string]interface{}{"age_over_18": true})
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	presentation := issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder)
+
+	w := verifyWithProfile(t, server, session, presentation)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestEUDIProfile_RejectsNonConformantPresentation(t *testing.T) {
+	server := NewServerWithProfile(complianceProfiles[ProfileEUDIARF])
+
+	presentation := fakeSDJWT(t,
+		map[string]interface{}{"alg": "RS256"},
+		map[string]interface{}{"vct": "https://cachet.id/identity"},
+		"")
+
+	w := verifyWithProfile(t, server, createSession(t, server, "pack.safe.seller@0.1.0"),
+		map[string]interface{}{"format": FormatSDJWTVC, "presentation": presentation})
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	resp := decodeProblem(t, w)
+	assert.Equal(t, "profile_violation", resp.Code)
+	assert.Equal(t, ProfileEUDIARF, resp.Extensions["profile"])
+	assert.Len(t, resp.Extensions["violations"], 3)
+}
+
+func TestEUDIProfile_RejectsUnparseableBundle(t *testing.T) {
+	server := NewServerWithProfile(complianceProfiles[ProfileEUDIARF])
+
+	w := verifyWithProfile(t, server, createSession(t, server, "pack.safe.seller@0.1.0"), map[string]interface{}{"test": "data"})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestGetProfile(t *testing.T) {
+	server := NewServerWithProfile(complianceProfiles[ProfileEUDIARF])
+
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var profile ComplianceProfile
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &profile))
+	assert.Equal(t, complianceProfiles[ProfileEUDIARF], profile)
+}
+
+// writeSigningCertificate certifies key for host under a fresh root, and
+// writes the chain, leaf first, as PEM
+func writeSigningCertificate(t *testing.T, key *ecdsa.PrivateKey, host string) (string, *x509.CertPool) {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Utopia Access CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	rootCert, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, rootCert, &key.PublicKey, rootKey)
+	require.NoError(t, err)
+
+	var chain []byte
+	for _, der := range [][]byte{leafDER, rootDER} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	path := filepath.Join(t.TempDir(), "chain.pem")
+	require.NoError(t, os.WriteFile(path, chain, 0o600))
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	return path, roots
+}
+
+func TestEUDIProfile_AuthenticatesRequestObjects(t *testing.T) {
+	server := NewServerWithProfile(complianceProfiles[ProfileEUDIARF])
+	assert.ErrorContains(t, server.checkProfile(), "certified key", "an uncertified key does not meet the profile")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	server.requestSigner, err = newRequestSignerWithKey(key)
+	require.NoError(t, err)
+	otherHost, _ := writeSigningCertificate(t, key, "rp.example.com")
+	assert.ErrorContains(t, server.certifySigner(server.requestSigner, otherHost), "not valid for the verifier's host")
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKeyChain, _ := writeSigningCertificate(t, otherKey, "verifier.cachet.id")
+	assert.ErrorContains(t, server.certifySigner(server.requestSigner, otherKeyChain), "does not certify the signing key")
+
+	chain, roots := writeSigningCertificate(t, key, "verifier.cachet.id")
+	require.NoError(t, server.certifySigner(server.requestSigner, chain))
+	require.NoError(t, server.checkProfile())
+
+	// Sessions are bound to the client_id the certificate names
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	assert.Equal(t, "verifier.cachet.id", session.Audience)
+	invocation, err := url.Parse(session.AuthorizationRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "verifier.cachet.id", invocation.Query().Get("client_id"))
+	body, err := json.Marshal(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", Audience: "https://rp.example.com"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A wallet authenticates the request object as x509_san_dns prescribes:
+	// the x5c chain leads to a trusted root, its leaf names the client_id,
+	// and the leaf key signed the request
+	req = httptest.NewRequest(http.MethodGet, "/openid4vp/request/"+session.ID, nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var claims struct {
+		ClientID       string `json:"client_id"`
+		ClientIDScheme string `json:"client_id_scheme"`
+		jwt.RegisteredClaims
+	}
+	_, err = jwt.ParseWithClaims(w.Body.String(), &claims, func(token *jwt.Token) (interface{}, error) {
+		x5c, ok := token.Header["x5c"].([]interface{})
+		require.True(t, ok, "request object has no x5c")
+		certs := make([]*x509.Certificate, len(x5c))
+		for i, entry := range x5c {
+			der, err := base64.StdEncoding.DecodeString(entry.(string))
+			require.NoError(t, err)
+			if certs[i], err = x509.ParseCertificate(der); err != nil {
+				return nil, err
+			}
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: claims.ClientID}); err != nil {
+			return nil, err
+		}
+		return certs[0].PublicKey, nil
+	}, jwt.WithAudience(selfIssuedAudience))
+	require.NoError(t, err)
+	assert.Equal(t, "verifier.cachet.id", claims.ClientID)
+	assert.Equal(t, ClientIDSchemeX509SANDNS, claims.ClientIDScheme)
+}
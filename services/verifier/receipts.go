@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// consentReceiptContext is the schema of receipts in docs/RECEIPTS
+const consentReceiptContext = "https://schemas.cachet.id/consent-receipt/v1"
+
+// ConsentReceipt records what a relying party asked for, what the holder
+// disclosed and under which policy, as in docs/RECEIPTS
+type ConsentReceipt struct {
+	Context          string    `json:"@context"`
+	ID               string    `json:"id"`
+	Holder           string    `json:"holder,omitempty"` // did:jwk of the bound holder key
+	RP               string    `json:"rp"`
+	RPID             string    `json:"rpId,omitempty"` // registered relying party, when authenticated
+	Purpose          string    `json:"purpose,omitempty"`
+	PolicyID         string    `json:"policyId"`
+	Timestamp        time.Time `json:"timestamp"`
+	Requested        []string  `json:"requested"`
+	Disclosed        []string  `json:"disclosed"`
+	PredicatesProven []string  `json:"predicatesProven"`
+	Issuers          []string  `json:"issuers"`
+}
+
+// ReceiptAnchor is the receipts-log's acknowledgement of a receipt hash
+type ReceiptAnchor struct {
+	Hash     string `json:"hash"`
+	Accepted bool   `json:"accepted"`
+	Anchored bool   `json:"anchored"`
+	// TreeHead and InclusionProof prove the hash is in the log; Verified
+	// is set once they are checked against the log's key. With the key set,
+	// anchors without them are refused.
+	TreeHead       *logproof.TreeHead       `json:"treeHead,omitempty"`
+	InclusionProof *logproof.InclusionProof `json:"inclusionProof,omitempty"`
+	Verified       bool                     `json:"verified,omitempty"`
+}
+
+// Hash is the urn:sha256 digest of the receipt's JSON encoding, which is
+// what gets logged; the receipt itself never leaves the verifier
+func (r ConsentReceipt) Hash() (string, error) {
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return "urn:sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// receiptsLog submits receipt hashes to the receipts-log service
+type receiptsLog struct {
+	client *http.Client
+	url    string
+	key    crypto.PublicKey // the log's key; nil leaves inclusion proofs unchecked
+}
+
+// newReceiptsLog submits to the receipts-log at url, authenticating as the
+// verifier with auth when it is set
+func newReceiptsLog(url string, auth *serviceauth.Authenticator) *receiptsLog {
+	client := deadline.NewClient("receipts-log")
+	client.Transport = auth.Transport("receipts-log", client.Transport)
+	return &receiptsLog{client: client, url: strings.TrimSuffix(url, "/")}
+}
+
+// Submit logs a receipt hash, with holder, the digest of the holder's DID,
+// when the receipt names one
+func (l *receiptsLog) Submit(ctx context.Context, hash, holder string) (ReceiptAnchor, error) {
+	submission := map[string]string{"receiptHash": hash}
+	if holder != "" {
+		submission["holder"] = holder
+	}
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return ReceiptAnchor{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url+"/receipts/hash", bytes.NewReader(body))
+	if err != nil {
+		return ReceiptAnchor{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return ReceiptAnchor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ReceiptAnchor{}, fmt.Errorf("receipts-log returned %d", resp.StatusCode)
+	}
+	var anchor ReceiptAnchor
+	if err := json.NewDecoder(resp.Body).Decode(&anchor); err != nil {
+		return ReceiptAnchor{}, fmt.Errorf("decoding receipts-log response: %w", err)
+	}
+	if anchor.Hash != hash {
+		return ReceiptAnchor{}, fmt.Errorf("receipts-log acknowledged %q instead of %q", anchor.Hash, hash)
+	}
+	if l.key != nil {
+		// An anchor without its proof could be any log's word
+		if anchor.TreeHead == nil || anchor.InclusionProof == nil {
+			return ReceiptAnchor{}, errors.New("receipts-log anchor carries no signed tree head and inclusion proof")
+		}
+		if err := logproof.VerifyReceipt(l.key, *anchor.TreeHead, hash, *anchor.InclusionProof); err != nil {
+			return ReceiptAnchor{}, fmt.Errorf("receipts-log anchor: %w", err)
+		}
+		anchor.Verified = true
+	}
+	return anchor, nil
+}
+
+// buildReceipt records a successful verification made in answer to session
+// with the credentials of the bundle
+func (s *Server) buildReceipt(session VerificationSession, credentials []VerifiedSDJWT, predicates []string, now time.Time) ConsentReceipt {
+	receipt := ConsentReceipt{
+		Context:          consentReceiptContext,
+		ID:               "receipt-" + uuid.NewString(),
+		RP:               session.Audience,
+		RPID:             session.RPID,
+		PolicyID:         session.PolicyID,
+		Timestamp:        now.UTC().Truncate(time.Second),
+		Requested:        []string{},
+		Disclosed:        []string{},
+		PredicatesProven: predicates,
+		Issuers:          []string{},
+	}
+	for _, verified := range credentials {
+		if receipt.Holder == "" {
+			receipt.Holder = holderDID(verified.Claims)
+		}
+		if !slices.Contains(receipt.Issuers, verified.Issuer) {
+			receipt.Issuers = append(receipt.Issuers, verified.Issuer)
+		}
+		for _, claim := range verified.Disclosed {
+			if !slices.Contains(receipt.Disclosed, claim) {
+				receipt.Disclosed = append(receipt.Disclosed, claim)
+			}
+		}
+	}
+	sort.Strings(receipt.Disclosed)
+	if pack, ok := s.findPack(session.PolicyID); ok {
+		receipt.Purpose = pack.Purpose
+		for _, rule := range pack.policyRules() {
+			receipt.Requested = append(receipt.Requested, rule.ID)
+		}
+	}
+	return receipt
+}
+
+// holderDID identifies the holder by the did:jwk of their cnf key, if any
+func holderDID(claims map[string]interface{}) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jwk, ok := cnf["jwk"]
+	if !ok {
+		return ""
+	}
+	encoded, err := json.Marshal(jwk)
+	if err != nil {
+		return ""
+	}
+	return "did:jwk:" + base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// holderDigest is the urn:sha256 digest of a holder's DID, which the
+// receipts-log keeps in its stead so it can find a holder's receipts when
+// they ask to be erased; it is empty when the holder is unknown
+func holderDigest(did string) string {
+	if did == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(did))
+	return "urn:sha256:" + hex.EncodeToString(sum[:])
+}
+
+// issueReceipt builds and hashes the receipt and has the hash anchored:
+// through the verification.completed event when there is an event bus, or
+// by submitting it to the receipts-log. Anchoring failures are logged, not
+// fatal.
+func (s *Server) issueReceipt(ctx context.Context, session VerificationSession, credentials []VerifiedSDJWT, predicates []string, now time.Time) (ConsentReceipt, *ReceiptAnchor) {
+	receipt := s.buildReceipt(session, credentials, predicates, now)
+	if s.receipts == nil && s.events == nil {
+		return receipt, nil
+	}
+	hash, err := receipt.Hash()
+	if err != nil {
+		log.Error().Err(err).Str("receipt_id", receipt.ID).Msg("Failed to hash consent receipt")
+		return receipt, nil
+	}
+	if s.events != nil {
+		// publishOutcome takes the acceptance back if the event is not published
+		return receipt, &ReceiptAnchor{Hash: hash, Accepted: true}
+	}
+	anchor, err := s.receipts.Submit(ctx, hash, holderDigest(receipt.Holder))
+	if err != nil {
+		log.Warn().Err(err).Str("receipt_id", receipt.ID).Msg("Failed to submit consent receipt hash")
+		return receipt, &ReceiptAnchor{Hash: hash}
+	}
+	log.Info().Str("receipt_id", receipt.ID).Str("rp_id", receipt.RPID).Str("hash", hash).Bool("anchored", anchor.Anchored).Msg("Consent receipt submitted")
+	return receipt, &anchor
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/logproof"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPresentation_AnchorsConsentReceipt(t *testing.T) {
+	var submitted, holders []string
+	receiptsLog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ReceiptHash string `json:"receiptHash"`
+			Holder      string `json:"holder"`
+		}
+		if r.URL.Path != "/receipts/hash" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		submitted = append(submitted, body.ReceiptHash)
+		holders = append(holders, body.Holder)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"accepted": true, "hash": body.ReceiptHash, "anchored": false})
+	}))
+	defer receiptsLog.Close()
+
+	server := NewServer()
+	server.receipts = newReceiptsLog(receiptsLog.URL, nil)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+
+	w := verifyIssued(t, server, issuer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	receipt := resp.Receipt
+	assert.Equal(t, consentReceiptContext, receipt.Context)
+	assert.Equal(t, defaultVerifierAudience, receipt.RP)
+	assert.Equal(t, "pack.safe.seller@0.1.0", receipt.PolicyID)
+	assert.Equal(t, "Reduce counterparty and fraud risk in peer-to-peer sales", receipt.Purpose)
+	assert.Equal(t, []string{"identity.verified", "platform.tenure", "platform.fulfilment", "chargeback.risk.low"}, receipt.Requested)
+	assert.Equal(t, []string{"age_over_18"}, receipt.Disclosed)
+	assert.Equal(t, resp.Predicates, receipt.PredicatesProven)
+	assert.Equal(t, []string{testIssuerDID}, receipt.Issuers)
+	assert.True(t, strings.HasPrefix(receipt.Holder, "did:jwk:"))
+
+	// The anchored hash is the hash of the returned receipt
+	hash, err := receipt.Hash()
+	require.NoError(t, err)
+	require.NotNil(t, resp.ReceiptAnchor)
+	assert.Equal(t, ReceiptAnchor{Hash: hash, Accepted: true}, *resp.ReceiptAnchor)
+	assert.Equal(t, []string{hash}, submitted)
+	// The log can find the holder's receipts without learning their DID
+	assert.Equal(t, []string{holderDigest(receipt.Holder)}, holders)
+	assert.Regexp(t, `^urn:sha256:[0-9a-f]{64}$`, holders[0])
+}
+
+func TestVerifyPresentation_ReceiptsLogDown(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	server := NewServer()
+	server.receipts = newReceiptsLog(down.URL, nil)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+
+	// Verification still succeeds; the receipt is returned unacknowledged
+	w := verifyIssued(t, server, issuer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotNil(t, resp.ReceiptAnchor)
+	assert.False(t, resp.ReceiptAnchor.Accepted)
+	assert.NotEmpty(t, resp.ReceiptAnchor.Hash)
+}
+
+func TestVerifyPresentation_AnchorsThroughEventBus(t *testing.T) {
+	bus := events.NewMemory()
+	var published []events.Event
+	require.NoError(t, bus.Subscribe("receipts-log", []string{events.TypeVerificationCompleted}, func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	}))
+
+	server := NewServer()
+	server.events = bus
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+
+	w := verifyIssued(t, server, issuer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NoError(t, bus.Close())
+
+	hash, err := resp.Receipt.Hash()
+	require.NoError(t, err)
+	assert.Equal(t, &ReceiptAnchor{Hash: hash, Accepted: true}, resp.ReceiptAnchor)
+	require.Len(t, published, 1)
+	assert.Equal(t, "verifier", published[0].Source)
+	var completed events.VerificationCompleted
+	require.NoError(t, published[0].Decode(&completed))
+	assert.Equal(t, published[0].Subject, completed.SessionID)
+	assert.Equal(t, OutcomeVerified, completed.Status)
+	assert.Equal(t, hash, completed.ReceiptHash)
+	assert.Equal(t, holderDigest(resp.Receipt.Holder), completed.ReceiptHolder)
+	require.NotNil(t, completed.Badge)
+	assert.Equal(t, resp.Badge.JWS, completed.Badge.JWS)
+}
+
+func TestVerifyPresentation_EventBusDown(t *testing.T) {
+	bus := events.NewMemory()
+	require.NoError(t, bus.Close())
+
+	server := NewServer()
+	server.events = bus
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+
+	// As with the receipts-log down, the receipt is returned unacknowledged
+	w := verifyIssued(t, server, issuer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotNil(t, resp.ReceiptAnchor)
+	assert.False(t, resp.ReceiptAnchor.Accepted)
+}
+
+// provingReceiptsLog anchors each receipt hash in a fresh one-leaf tree,
+// answering with the tree head signed by key and the inclusion proof, or
+// with neither when key is nil
+func provingReceiptsLog(t *testing.T, key ed25519.PrivateKey) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ReceiptHash string `json:"receiptHash"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		anchor := ReceiptAnchor{Hash: body.ReceiptHash, Accepted: true, Anchored: true}
+		if key != nil {
+			head := logproof.TreeHead{TreeSize: 1, RootHash: hex.EncodeToString(logproof.LeafHash([]byte(body.ReceiptHash))), Timestamp: time.Now().UTC().Format(time.RFC3339)}
+			head.Signature = base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, head.SignedData()))
+			anchor.TreeHead, anchor.InclusionProof = &head, &logproof.InclusionProof{TreeSize: 1, Hashes: []string{}}
+		}
+		_ = json.NewEncoder(w).Encode(anchor)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerifyPresentation_VerifiesReceiptAnchor(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	issuer := newTestIssuer(t)
+
+	server := NewServer()
+	server.receipts = newReceiptsLog(provingReceiptsLog(t, private).URL, nil)
+	server.receipts.key = public
+	issuer.trustedBy(server)
+	w := verifyIssued(t, server, issuer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotNil(t, resp.ReceiptAnchor)
+	assert.True(t, resp.ReceiptAnchor.Accepted)
+	assert.True(t, resp.ReceiptAnchor.Verified)
+
+	// An anchor whose tree head is not signed by the log's key is not one
+	_, impostor, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	// Nor is an anchor without its proof
+	for _, key := range []ed25519.PrivateKey{impostor, nil} {
+		server.receipts = newReceiptsLog(provingReceiptsLog(t, key).URL, nil)
+		server.receipts.key = public
+		w = verifyIssued(t, server, issuer)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		resp = VerifyResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, resp.ReceiptAnchor)
+		assert.False(t, resp.ReceiptAnchor.Accepted)
+		assert.False(t, resp.ReceiptAnchor.Verified)
+	}
+}
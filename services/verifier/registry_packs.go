@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxPackListSize bounds the policy manifest fetched from the registry
+	maxPackListSize            = 4 << 20
+	defaultPackRefreshInterval = 5 * time.Minute
+	packRefreshTimeout         = 30 * time.Second
+)
+
+var packReloads = expvar.NewMap("pack_reloads_total")
+
+// errPacksNotModified means the registry's packs match the ETag last applied
+var errPacksNotModified = errors.New("registry packs not modified")
+
+// RegistryPack is a pack as the registry publishes it in its policy manifest
+type RegistryPack struct {
+	ID      string       `json:"id"` // without @version
+	Version string       `json:"version"`
+	Name    string       `json:"name"`
+	Purpose string       `json:"purpose,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+	// Freshness replaces the built-in freshness policy when published
+	Freshness *FreshnessPolicy `json:"freshness,omitempty"`
+	// Match replaces the built-in match rules when published
+	Match []MatchRule `json:"match,omitempty"`
+	// Status is the registry lifecycle state; only published packs are applied
+	Status string `json:"status,omitempty"`
+	// Kind is "library" for shared predicate libraries, which only reach
+	// verifiers through the packs depending on them
+	Kind string `json:"kind,omitempty"`
+	// Resolved holds the pack's rules merged with its dependencies'; it is
+	// what the verifier evaluates when present
+	Resolved *ResolvedPolicy `json:"resolved,omitempty"`
+	// Digest and Signature let each pack be checked on its own; see
+	// verifyManifestPacks
+	Digest    string `json:"digest,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// ResolvedPolicy is a pack flattened with its dependency graph by the registry
+type ResolvedPolicy struct {
+	Rules     []PolicyRule     `json:"rules"`
+	Freshness *FreshnessPolicy `json:"freshness,omitempty"`
+	Match     []MatchRule      `json:"match,omitempty"`
+}
+
+// packCache is the last pack list applied, kept on disk so a restart while
+// the registry is down still serves the last-known-good packs. The registry
+// keys are kept with it, so the packs are checked again when loaded.
+type packCache struct {
+	ETag      string          `json:"etag"`
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Body      json.RawMessage `json:"body"`
+	Keys      []JWK           `json:"keys,omitempty"`
+}
+
+// registryPacks polls the registry's signed policy manifest for packs,
+// remembering the ETag of the set last applied so unchanged packs cost a 304
+type registryPacks struct {
+	registryURL string
+	client      *http.Client
+	keys        *registryKeys
+	cachePath   string // empty keeps the last-known-good set in memory only
+
+	mu        sync.Mutex // serializes refreshes
+	etag      string
+	fetchedAt time.Time
+}
+
+func newRegistryPacks(registryURL, cachePath string) *registryPacks {
+	registryURL = strings.TrimSuffix(registryURL, "/")
+	return &registryPacks{
+		registryURL: registryURL,
+		client:      deadline.NewClient("registry"),
+		keys:        newRegistryKeys(registryURL + "/.well-known/jwks.json"),
+		cachePath:   cachePath,
+	}
+}
+
+// fetch downloads the policy manifest unless it still matches the last ETag,
+// and returns the manifest once its signature verifies
+func (r *registryPacks) fetch(ctx context.Context) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.registryURL+"/policy/manifest", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/jwt")
+	req.Header.Set(apiversion.Header, "1")
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, "", errPacksNotModified
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("registry returned %d for the policy manifest", resp.StatusCode)
+	}
+	jws, err := io.ReadAll(io.LimitReader(resp.Body, maxPackListSize))
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := r.keys.verifyManifest(ctx, strings.TrimSpace(string(jws)))
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, resp.Header.Get("ETag"), nil
+}
+
+func (r *registryPacks) save(cache packCache) error {
+	if r.cachePath == "" {
+		return nil
+	}
+	raw, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.cachePath), ".packs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.cachePath)
+}
+
+// buildRegistryPacks compiles the packs of a verified policy manifest. Packs the verifier
+// ships with keep their presentation predicates; a published pack without
+// rules keeps the built-in ones. Nothing is applied unless every pack compiles.
+func buildRegistryPacks(raw []byte, builtin []Pack) ([]Pack, error) {
+	var list struct {
+		Packs []RegistryPack `json:"packs"`
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("policy manifest is not valid JSON: %w", err)
+	}
+
+	known := make(map[string]Pack, len(builtin))
+	for _, pack := range builtin {
+		known[pack.ID] = pack
+	}
+	seen := make(map[string]bool, len(list.Packs))
+	packs := make([]Pack, 0, len(list.Packs))
+	for _, published := range list.Packs {
+		if (published.Status != "" && published.Status != "published") || published.Kind == "library" {
+			continue
+		}
+		if resolved := published.Resolved; resolved != nil {
+			published.Rules, published.Freshness, published.Match = resolved.Rules, resolved.Freshness, resolved.Match
+		}
+		if published.ID == "" || published.Version == "" {
+			return nil, errors.New("registry published a pack without an id and version")
+		}
+		id := published.ID + "@" + published.Version
+		if seen[id] {
+			return nil, fmt.Errorf("registry published %s twice", id)
+		}
+		seen[id] = true
+
+		pack, ok := known[id]
+		if !ok {
+			pack = Pack{ID: id, Version: published.Version}
+		}
+		pack.Name, pack.Purpose, pack.digest = published.Name, published.Purpose, published.Digest
+		if published.Freshness != nil {
+			pack.Freshness = published.Freshness
+		}
+		if published.Match != nil {
+			pack.Match = published.Match
+		}
+		if len(published.Rules) > 0 {
+			pack.Rules = published.Rules
+		} else if len(pack.policyRules()) == 0 {
+			return nil, fmt.Errorf("pack %s has no rules", id)
+		}
+		packs = append(packs, pack)
+	}
+	if len(packs) == 0 {
+		return nil, errors.New("registry published no packs")
+	}
+	return compilePacks(packs)
+}
+
+// refreshPacks applies the registry's packs if they changed since the last
+// refresh, reporting whether they did. On any failure the packs in use (the
+// last-known-good set) are kept.
+func (s *Server) refreshPacks(ctx context.Context) (bool, error) {
+	source := s.packSource
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	raw, etag, err := source.fetch(ctx)
+	if errors.Is(err, errPacksNotModified) {
+		packReloads.Add("not_modified", 1)
+		return false, nil
+	}
+	if err == nil {
+		err = source.keys.verifyManifestPacks(ctx, raw)
+	}
+	if err == nil {
+		var packs []Pack
+		if packs, err = buildRegistryPacks(raw, defaultPacks()); err == nil {
+			s.packs.Replace(packs)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrManifestSignature):
+		packReloads.Add("rejected_signature", 1)
+	case errors.Is(err, ErrPackIntegrity):
+		packReloads.Add("rejected_integrity", 1)
+	}
+	if err != nil {
+		packReloads.Add("failed", 1)
+		return false, err
+	}
+
+	source.etag, source.fetchedAt = etag, time.Now()
+	if err := source.save(packCache{ETag: etag, FetchedAt: source.fetchedAt, Body: raw, Keys: source.keys.known()}); err != nil {
+		log.Warn().Err(err).Str("path", source.cachePath).Msg("Failed to cache packs")
+	}
+	packReloads.Add("updated", 1)
+	log.Info().Int("pack_count", len(s.packs.All())).Str("etag", etag).Str("registry", source.registryURL).Msg("Loaded packs from registry")
+	return true, nil
+}
+
+// loadCachedPacks applies the packs saved by the last successful refresh,
+// once they verify against the registry keys cached with them
+func (s *Server) loadCachedPacks() error {
+	source := s.packSource
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if source.cachePath == "" {
+		return errors.New("no pack cache configured")
+	}
+	raw, err := os.ReadFile(source.cachePath)
+	if err != nil {
+		return err
+	}
+	var cache packCache
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return fmt.Errorf("pack cache %s: %w", source.cachePath, err)
+	}
+	source.keys.seed(cache.Keys)
+	ctx, cancel := context.WithTimeout(context.Background(), packRefreshTimeout)
+	defer cancel()
+	if err := source.keys.verifyManifestPacks(ctx, cache.Body); err != nil {
+		return fmt.Errorf("pack cache %s: %w", source.cachePath, err)
+	}
+	packs, err := buildRegistryPacks(cache.Body, defaultPacks())
+	if err != nil {
+		return fmt.Errorf("pack cache %s: %w", source.cachePath, err)
+	}
+	s.packs.Replace(packs)
+	source.etag, source.fetchedAt = cache.ETag, cache.FetchedAt
+	log.Info().Int("pack_count", len(packs)).Time("fetched_at", cache.FetchedAt).Msg("Loaded last-known-good packs from cache")
+	return nil
+}
+
+func (s *Server) runPackRefresher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), packRefreshTimeout)
+		if _, err := s.refreshPacks(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to refresh packs from registry, keeping last-known-good packs")
+		}
+		cancel()
+	}
+}
+
+func (s *Server) handleRefreshPacks(w http.ResponseWriter, r *http.Request) {
+	if s.packSource == nil {
+		problem.Write(w, r, http.StatusConflict, "no_registry", "the verifier serves built-in packs; set REGISTRY_URL to load them from the registry")
+		return
+	}
+	updated, err := s.refreshPacks(r.Context())
+	if err != nil {
+		log.Warn().Err(err).Msg("Pack refresh failed, keeping last-known-good packs")
+		problem.Write(w, r, http.StatusBadGateway, "pack_refresh_failed", err.Error())
+		return
+	}
+	s.packSource.mu.Lock()
+	etag, fetchedAt := s.packSource.etag, s.packSource.fetchedAt
+	s.packSource.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"updated":   updated,
+		"packCount": len(s.packs.All()),
+		"etag":      etag,
+		"fetchedAt": fetchedAt,
+	})
+}
+
+// handlePackDigests lists the registry digest of every pack in use, for
+// operators to compare with what the registry published
+func (s *Server) handlePackDigests(w http.ResponseWriter, r *http.Request) {
+	if s.packSource == nil {
+		problem.Write(w, r, http.StatusConflict, "no_registry", "the verifier serves built-in packs; set REGISTRY_URL to load them from the registry")
+		return
+	}
+	digests := make(map[string]string)
+	for _, pack := range s.packs.All() {
+		if pack.digest != "" {
+			digests[pack.ID] = pack.digest
+		}
+	}
+	s.packSource.mu.Lock()
+	etag, fetchedAt := s.packSource.etag, s.packSource.fetchedAt
+	s.packSource.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"digests":   digests,
+		"etag":      etag,
+		"fetchedAt": fetchedAt,
+	})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePackRegistry serves a signed policy manifest with an ETag, and the
+// JWKS to check it with, like the registry does
+type fakePackRegistry struct {
+	mu          sync.Mutex
+	key         *ecdsa.PrivateKey
+	signer      *ecdsa.PrivateKey // signs manifests; a key other than key forges them
+	body        string
+	etag        string
+	status      int // non-zero fails every request
+	notModified int
+	unsigned    bool                         // serves packs without their signatures
+	alter       func(map[string]interface{}) // changes packs once signed
+}
+
+func newFakePackRegistry(t *testing.T) *fakePackRegistry {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &fakePackRegistry{key: key, signer: key}
+}
+
+func (f *fakePackRegistry) publish(etag, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.etag, f.body, f.status = etag, body, 0
+}
+
+func (f *fakePackRegistry) fail(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakePackRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/.well-known/jwks.json" {
+		jwk := ecJWK(&f.key.PublicKey)
+		jwk["kid"] = "registry-key"
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{jwk}})
+		return
+	}
+	if r.URL.Path != "/policy/manifest" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	if r.Header.Get("If-None-Match") == f.etag {
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	manifest, err := f.signPacks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":      "did:web:cachet.id",
+		"manifest": json.RawMessage(manifest),
+	})
+	token.Header["kid"] = "registry-key"
+	token.Header["typ"] = policyManifestType
+	jws, err := token.SignedString(f.signer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(jws))
+}
+
+// signPacks adds the digest and signature of each published pack, as the
+// registry does when it serves its manifest
+func (f *fakePackRegistry) signPacks() ([]byte, error) {
+	var manifest map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(f.body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, err
+	}
+	packs, _ := manifest["packs"].([]interface{})
+	for _, entry := range packs {
+		pack := entry.(map[string]interface{})
+		raw, err := json.Marshal(pack)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := manifestPackDigest(raw)
+		if err != nil {
+			return nil, err
+		}
+		pack["digest"] = digest
+		if !f.unsigned {
+			token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+				"iss": "did:web:cachet.id", "sub": fmt.Sprintf("%s@%s", pack["id"], pack["version"]), "digest": digest,
+			})
+			token.Header["kid"] = "registry-key"
+			token.Header["typ"] = packSignatureType
+			if pack["signature"], err = token.SignedString(f.signer); err != nil {
+				return nil, err
+			}
+		}
+		if f.alter != nil {
+			f.alter(pack)
+		}
+	}
+	return json.Marshal(manifest)
+}
+
+const registryPacksV1 = `{"packs":[
+	{"id":"pack.childcare.readiness","version":"0.1.0","name":"Childcare Readiness","rules":[]},
+	{"id":"pack.safe.seller","version":"0.1.0","name":"Safe Seller","rules":[{"id":"level.gold","expr":"verificationLevel in [gold, platinum]"}]},
+	{"id":"pack.tenant.ready","version":"0.1.0","name":"Tenant Ready","rules":[{"id":"age.ge.18","expr":"age >= 18"}],"freshness":{"maxCredentialAge":"720h"}},
+	{"id":"pack.tenant.ready","version":"0.2.0","name":"Tenant Ready","rules":[{"id":"age.ge.21","expr":"age >= 21"}],"status":"draft"}
+]}`
+
+func newPackRegistryServer(t *testing.T, cachePath string) (*Server, *fakePackRegistry) {
+	t.Helper()
+	registry := newFakePackRegistry(t)
+	registry.publish(`"v1"`, registryPacksV1)
+	ts := httptest.NewServer(registry)
+	t.Cleanup(ts.Close)
+
+	server := NewServer()
+	server.packSource = newRegistryPacks(ts.URL, cachePath)
+	return server, registry
+}
+
+func TestRefreshPacks_AppliesRegistryPacks(t *testing.T) {
+	server, registry := newPackRegistryServer(t, "")
+
+	updated, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+	assert.True(t, updated)
+	assert.Len(t, server.packs.All(), 3)
+
+	seller, _ := server.findPack("pack.safe.seller@0.1.0")
+	require.Len(t, seller.compiled, 1)
+	assert.Equal(t, "level.gold", seller.compiled[0].ID)
+	assert.Len(t, seller.Predicates, 4, "built-in presentation predicates are kept")
+
+	// The registry publishes no rules for childcare, so its built-in rules stay
+	childcare, _ := server.findPack("pack.childcare.readiness@0.1.0")
+	assert.Len(t, childcare.compiled, 5)
+
+	// A pack the verifier has never shipped with
+	tenant, ok := server.findPack("pack.tenant.ready@0.1.0")
+	require.True(t, ok)
+	assert.Equal(t, "Tenant Ready", tenant.Name)
+	require.NotNil(t, tenant.Freshness)
+	assert.Equal(t, Duration(720*time.Hour), tenant.Freshness.MaxCredentialAge)
+	_, ok = server.findPack("pack.tenant.ready@0.2.0")
+	assert.False(t, ok, "drafts are not applied")
+
+	// Unchanged packs are not downloaded again
+	updated, err = server.refreshPacks(context.Background())
+	require.NoError(t, err)
+	assert.False(t, updated)
+	assert.Equal(t, 1, registry.notModified)
+}
+
+func TestRefreshPacks_AppliesResolvedRules(t *testing.T) {
+	server, registry := newPackRegistryServer(t, "")
+	registry.publish(`"v2"`, `{"packs":[
+		{"id":"lib.identity.base","version":"1.0.0","name":"Base Identity","kind":"library","rules":[{"id":"age.ge.18","expr":"age >= 18"}]},
+		{"id":"pack.tenant.ready","version":"1.0.0","name":"Tenant Ready","rules":[{"id":"income.ok","expr":"income_ratio <= 0.4"}],
+		 "includes":["lib.identity.base@1.0.0"],
+		 "resolved":{"rules":[{"id":"age.ge.18","expr":"age >= 18"},{"id":"income.ok","expr":"income_ratio <= 0.4"}],"freshness":{"maxCredentialAge":"720h"}}}
+	]}`)
+
+	_, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+	_, ok := server.findPack("lib.identity.base@1.0.0")
+	assert.False(t, ok, "libraries are not requestable packs")
+	tenant, ok := server.findPack("pack.tenant.ready@1.0.0")
+	require.True(t, ok)
+	require.Len(t, tenant.compiled, 2, "the registry's flattened rules are evaluated")
+	assert.Equal(t, "age.ge.18", tenant.compiled[0].ID)
+	require.NotNil(t, tenant.Freshness)
+	assert.Equal(t, Duration(720*time.Hour), tenant.Freshness.MaxCredentialAge)
+}
+
+func TestRefreshPacks_KeepsLastKnownGood(t *testing.T) {
+	server, registry := newPackRegistryServer(t, "")
+	_, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+
+	registry.publish(`"v2"`, `{"packs":[{"id":"pack.safe.seller","version":"0.1.0","rules":[{"id":"broken","expr":"age >="}]}]}`)
+	_, err = server.refreshPacks(context.Background())
+	require.Error(t, err)
+
+	registry.publish(`"v3"`, `{"packs":[]}`)
+	_, err = server.refreshPacks(context.Background())
+	require.Error(t, err)
+
+	registry.fail(http.StatusServiceUnavailable)
+	_, err = server.refreshPacks(context.Background())
+	require.Error(t, err)
+
+	assert.Len(t, server.packs.All(), 3)
+	seller, _ := server.findPack("pack.safe.seller@0.1.0")
+	assert.Equal(t, "level.gold", seller.compiled[0].ID)
+}
+
+func TestRefreshPacks_RejectsUnsignedManifest(t *testing.T) {
+	server, registry := newPackRegistryServer(t, "")
+	_, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	registry.mu.Lock()
+	registry.signer = forger
+	registry.mu.Unlock()
+	registry.publish(`"v2"`, `{"packs":[{"id":"pack.safe.seller","version":"0.1.0","name":"Safe Seller","rules":[{"id":"anyone","expr":"true"}]}]}`)
+
+	_, err = server.refreshPacks(context.Background())
+	require.ErrorIs(t, err, ErrManifestSignature)
+	seller, _ := server.findPack("pack.safe.seller@0.1.0")
+	assert.Equal(t, "level.gold", seller.compiled[0].ID, "the forged manifest is not applied")
+}
+
+func TestRefreshPacks_RejectsUnsignedOrTamperedPacks(t *testing.T) {
+	lenient := func(pack map[string]interface{}) {
+		if pack["id"] == "pack.safe.seller" {
+			pack["rules"] = []interface{}{map[string]interface{}{"id": "anyone", "expr": "true"}}
+		}
+	}
+	tests := []struct {
+		name     string
+		unsigned bool
+		alter    func(map[string]interface{})
+	}{
+		{"unsigned", true, nil},
+		{"changed after signing", false, lenient},
+		{"digest recomputed", false, func(pack map[string]interface{}) {
+			lenient(pack)
+			delete(pack, "digest")
+			raw, _ := json.Marshal(pack)
+			pack["digest"], _ = manifestPackDigest(raw)
+		}},
+		{"signature of another pack", false, func(pack map[string]interface{}) {
+			if pack["id"] == "pack.safe.seller" {
+				pack["version"] = "0.9.0"
+				raw, _ := json.Marshal(pack)
+				pack["digest"], _ = manifestPackDigest(raw)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, registry := newPackRegistryServer(t, "")
+			_, err := server.refreshPacks(context.Background())
+			require.NoError(t, err)
+
+			registry.mu.Lock()
+			registry.unsigned, registry.alter = tt.unsigned, tt.alter
+			registry.mu.Unlock()
+			registry.publish(`"v2"`, registryPacksV1)
+			_, err = server.refreshPacks(context.Background())
+			require.ErrorIs(t, err, ErrPackIntegrity)
+			seller, _ := server.findPack("pack.safe.seller@0.1.0")
+			assert.Equal(t, "level.gold", seller.compiled[0].ID, "the last-known-good packs are kept")
+			assert.Equal(t, `"v1"`, server.packSource.etag)
+		})
+	}
+}
+
+func TestManifestPackDigest(t *testing.T) {
+	// The registry hashes packs with sorted keys, leaving out what it adds
+	// to the manifest entry
+	digest, err := manifestPackDigest([]byte(`{
+		"version":"0.1.0","id":"pack.safe.seller","name":"Safe Seller",
+		"rules":[{"id":"level.gold","expr":"verificationLevel in [gold, platinum]"}],
+		"freshness":{"maxCredentialAge":"720h"},
+		"provenance":{"peer":"eu"},"digest":"sha-256:x","signature":"x.y.z"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "sha-256:QDqfGJfWp9HxfPomkstsMrDAYQDSqu6LVobTzf7sIbo", digest)
+}
+
+func TestVerifyManifest_RejectsOtherTokens(t *testing.T) {
+	registry := newFakePackRegistry(t)
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	keys := newRegistryKeys(ts.URL + "/.well-known/jwks.json")
+
+	sign := func(typ, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"manifest": map[string]interface{}{"packs": []interface{}{}}})
+		token.Header["kid"], token.Header["typ"] = kid, typ
+		jws, err := token.SignedString(registry.key)
+		require.NoError(t, err)
+		return jws
+	}
+	_, err := keys.verifyManifest(context.Background(), sign(policyManifestType, "registry-key"))
+	require.NoError(t, err)
+
+	// A badge or bundle signed with the same key is not a manifest
+	_, err = keys.verifyManifest(context.Background(), sign("JWT", "registry-key"))
+	assert.ErrorIs(t, err, ErrManifestSignature)
+	_, err = keys.verifyManifest(context.Background(), sign(policyManifestType, "unknown-key"))
+	assert.ErrorIs(t, err, ErrManifestSignature)
+}
+
+func TestLoadCachedPacks(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "packs.json")
+	server, _ := newPackRegistryServer(t, cachePath)
+	_, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+
+	// A restart while the registry is unreachable
+	restarted := NewServer()
+	restarted.packSource = newRegistryPacks("http://127.0.0.1:0", cachePath)
+	_, err = restarted.refreshPacks(context.Background())
+	require.Error(t, err)
+	require.NoError(t, restarted.loadCachedPacks())
+
+	_, ok := restarted.findPack("pack.tenant.ready@0.1.0")
+	assert.True(t, ok)
+	assert.Equal(t, `"v1"`, restarted.packSource.etag)
+
+	// A pack edited in the cache is refused like one from the registry
+	raw, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `age \u003e= 18`)
+	require.NoError(t, os.WriteFile(cachePath, []byte(strings.Replace(string(raw), `age \u003e= 18`, `age \u003e= 0`, 1)), 0o600))
+	tampered := NewServer()
+	tampered.packSource = newRegistryPacks("http://127.0.0.1:0", cachePath)
+	assert.ErrorIs(t, tampered.loadCachedPacks(), ErrPackIntegrity)
+	_, ok = tampered.findPack("pack.tenant.ready@0.1.0")
+	assert.False(t, ok)
+}
+
+func refreshPacksRequest(server *Server, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/packs/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefreshPacksEndpoint(t *testing.T) {
+	server := newRPServer(t)
+	w := refreshPacksRequest(server, testOperatorToken)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	registry := newFakePackRegistry(t)
+	registry.publish(`"v1"`, registryPacksV1)
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	server.packSource = newRegistryPacks(ts.URL, "")
+
+	w = refreshPacksRequest(server, "not-the-operator")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = refreshPacksRequest(server, testOperatorToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, true, resp["updated"])
+	assert.Equal(t, float64(3), resp["packCount"])
+	assert.Equal(t, `"v1"`, resp["etag"])
+
+	registry.fail(http.StatusInternalServerError)
+	w = refreshPacksRequest(server, testOperatorToken)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestPackDigestsEndpoint(t *testing.T) {
+	server := newRPServer(t)
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/packs/digests", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusConflict, get(testOperatorToken).Code)
+
+	registry := newFakePackRegistry(t)
+	registry.publish(`"v1"`, registryPacksV1)
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	server.packSource = newRegistryPacks(ts.URL, "")
+	_, err := server.refreshPacks(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, get("not-the-operator").Code)
+	w := get(testOperatorToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Digests map[string]string `json:"digests"`
+		ETag    string            `json:"etag"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, `"v1"`, resp.ETag)
+	require.Len(t, resp.Digests, 3)
+	seller, _ := server.findPack("pack.safe.seller@0.1.0")
+	assert.Equal(t, seller.digest, resp.Digests["pack.safe.seller@0.1.0"])
+	assert.True(t, strings.HasPrefix(resp.Digests["pack.safe.seller@0.1.0"], "sha-256:"))
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultRPRateLimit is the per-minute request allowance of a relying party
+// registered without an explicit rate limit
+const defaultRPRateLimit = 60
+
+// apiKeyPrefix marks verifier API keys so leaked keys are easy to grep for
+const apiKeyPrefix = "cvk_"
+
+var ErrUnknownRelyingParty = errors.New("relying party not found")
+
+// RelyingParty is a registered caller of the verification APIs
+type RelyingParty struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Tenant    string    `json:"tenant"`
+	RateLimit int       `json:"rateLimit"` // requests per minute
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RPUsage counts a relying party's calls since it was registered
+type RPUsage struct {
+	Sessions      int64     `json:"sessions"`
+	Verifications int64     `json:"verifications"`
+	Verified      int64     `json:"verified"`
+	Failed        int64     `json:"failed"`
+	RateLimited   int64     `json:"rateLimited"`
+	LastSeen      time.Time `json:"lastSeen,omitempty"`
+}
+
+type RegisterRPRequest struct {
+	Name      string `json:"name"`
+	RateLimit int    `json:"rateLimit,omitempty"`
+}
+
+// RegisterRPResponse carries the API key and the webhook secret, which are
+// only ever shown once
+type RegisterRPResponse struct {
+	RelyingParty
+	APIKey        string `json:"apiKey"`
+	WebhookSecret string `json:"webhookSecret"`
+}
+
+type RelyingPartyResponse struct {
+	RelyingParty
+	Usage RPUsage `json:"usage"`
+}
+
+type rpEntry struct {
+	rp      RelyingParty
+	keyHash string
+	usage   RPUsage
+	// webhookSecret signs callbacks and so, unlike the API key, is kept as is
+	webhookSecret []byte
+
+	// token bucket refilled at rp.RateLimit per minute
+	tokens     float64
+	refilledAt time.Time
+}
+
+// rpRegistry holds relying parties and their hashed API keys in memory
+// (production should persist them in a database)
+type rpRegistry struct {
+	mu    sync.Mutex
+	byID  map[string]*rpEntry
+	byKey map[string]*rpEntry // by API key hash
+}
+
+func newRPRegistry() *rpRegistry {
+	return &rpRegistry{
+		byID:  make(map[string]*rpEntry),
+		byKey: make(map[string]*rpEntry),
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Register creates a relying party of tenant tenantID and returns its API key
+// and webhook secret
+func (r *rpRegistry) Register(tenantID, name string, rateLimit int, now time.Time) (RelyingParty, string, string, error) {
+	key, err := newAPIKey()
+	if err != nil {
+		return RelyingParty{}, "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return RelyingParty{}, "", "", err
+	}
+	encodedSecret := "whsec_" + base64.RawURLEncoding.EncodeToString(secret)
+	if rateLimit <= 0 {
+		rateLimit = defaultRPRateLimit
+	}
+	entry := &rpEntry{
+		rp: RelyingParty{
+			ID:        "rp-" + uuid.NewString(),
+			Name:      name,
+			Tenant:    tenantID,
+			RateLimit: rateLimit,
+			CreatedAt: now.UTC(),
+		},
+		keyHash:       hashAPIKey(key),
+		webhookSecret: []byte(encodedSecret),
+		tokens:        float64(rateLimit),
+		refilledAt:    now,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[entry.rp.ID] = entry
+	r.byKey[entry.keyHash] = entry
+	return entry.rp, key, encodedSecret, nil
+}
+
+// WebhookSecret returns the key the relying party's callbacks are signed with
+func (r *rpRegistry) WebhookSecret(id string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.webhookSecret, true
+}
+
+// Authenticate returns the relying party owning key
+func (r *rpRegistry) Authenticate(key string) (RelyingParty, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return RelyingParty{}, false
+	}
+	hash := hashAPIKey(key)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byKey[hash]
+	if !ok {
+		return RelyingParty{}, false
+	}
+	return entry.rp, true
+}
+
+// Allow spends one request from the relying party's bucket. When the bucket
+// is empty it returns how long until the next request is allowed.
+func (r *rpRegistry) Allow(id string, now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byID[id]
+	if !ok {
+		return false, 0
+	}
+	perSecond := float64(entry.rp.RateLimit) / 60
+	elapsed := now.Sub(entry.refilledAt).Seconds()
+	if elapsed > 0 {
+		entry.tokens = math.Min(float64(entry.rp.RateLimit), entry.tokens+elapsed*perSecond)
+		entry.refilledAt = now
+	}
+	entry.usage.LastSeen = now.UTC()
+	if entry.tokens < 1 {
+		entry.usage.RateLimited++
+		wait := time.Duration((1 - entry.tokens) / perSecond * float64(time.Second))
+		return false, wait
+	}
+	entry.tokens--
+	return true, 0
+}
+
+// Usage outcomes counted by Record
+const (
+	usageSession  = "session"
+	usageVerified = "verified"
+	usageFailed   = "failed"
+)
+
+// Record counts a session or a verification outcome against a relying party
+func (r *rpRegistry) Record(id, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byID[id]
+	if !ok {
+		return
+	}
+	switch kind {
+	case usageSession:
+		entry.usage.Sessions++
+	case usageVerified:
+		entry.usage.Verifications++
+		entry.usage.Verified++
+	case usageFailed:
+		entry.usage.Verifications++
+		entry.usage.Failed++
+	}
+}
+
+// Get returns a relying party of tenant tenantID
+func (r *rpRegistry) Get(tenantID, id string) (RelyingPartyResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byID[id]
+	if !ok || entry.rp.Tenant != tenantID {
+		return RelyingPartyResponse{}, ErrUnknownRelyingParty
+	}
+	return RelyingPartyResponse{RelyingParty: entry.rp, Usage: entry.usage}, nil
+}
+
+// List returns the relying parties of tenant tenantID
+func (r *rpRegistry) List(tenantID string) []RelyingPartyResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]RelyingPartyResponse, 0, len(r.byID))
+	for _, entry := range r.byID {
+		if entry.rp.Tenant != tenantID {
+			continue
+		}
+		out = append(out, RelyingPartyResponse{RelyingParty: entry.rp, Usage: entry.usage})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Delete removes a relying party of tenant tenantID, revoking its API key
+func (r *rpRegistry) Delete(tenantID, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.byID[id]
+	if !ok || entry.rp.Tenant != tenantID {
+		return ErrUnknownRelyingParty
+	}
+	delete(r.byID, id)
+	delete(r.byKey, entry.keyHash)
+	return nil
+}
+
+type rpContextKey struct{}
+
+// rpFromContext returns the relying party authenticated for the request, if any
+func rpFromContext(ctx context.Context) (RelyingParty, bool) {
+	rp, ok := ctx.Value(rpContextKey{}).(RelyingParty)
+	return rp, ok
+}
+
+// rpIDFromContext is the authenticated relying party's ID, or empty
+func rpIDFromContext(ctx context.Context) string {
+	rp, _ := rpFromContext(ctx)
+	return rp.ID
+}
+
+// apiKeyFromRequest reads the key from X-API-Key or a Bearer Authorization header
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme == "Bearer" {
+		return token
+	}
+	return ""
+}
+
+// rateLimitClient names the relying party of a valid API key for the rate
+// limiter, which keys everyone else by IP
+func (s *Server) rateLimitClient(r *http.Request, credential string) (string, bool) {
+	rp, ok := s.relyingParties.Authenticate(credential)
+	if !ok || rp.Tenant != tenant.FromContext(r.Context()).ID {
+		return "", false
+	}
+	return "rp:" + rp.ID, true
+}
+
+// authenticateRP requires a relying party API key and applies its rate limit.
+// It lets every request through when RP authentication is disabled.
+func (s *Server) authenticateRP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRPAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Keys only open the API of their own tenant
+		rp, ok := s.relyingParties.Authenticate(apiKeyFromRequest(r))
+		if !ok || rp.Tenant != tenant.FromContext(r.Context()).ID {
+			log.Warn().Str("path", r.URL.Path).Msg("Request without a valid relying party API key")
+			s.security.AuthFailure(r, "verifier")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="verifier"`)
+			problem.Write(w, r, http.StatusUnauthorized, "invalid_api_key", "A valid relying party API key is required")
+			return
+		}
+		if allowed, wait := s.relyingParties.Allow(rp.ID, time.Now()); !allowed {
+			log.Warn().Str("rp_id", rp.ID).Str("path", r.URL.Path).Msg("Relying party rate limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			problem.Write(w, r, http.StatusTooManyRequests, "rate_limited",
+				"Rate limit of "+strconv.Itoa(rp.RateLimit)+" requests per minute exceeded")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rpContextKey{}, rp)))
+	})
+}
+
+// ownsSession reports whether the calling relying party may act on a session;
+// sessions created without RP authentication are open to anyone
+func ownsSession(ctx context.Context, sessionRPID string) bool {
+	return sessionRPID == "" || sessionRPID == rpIDFromContext(ctx)
+}
+
+// recordVerification counts a verification outcome against the session's
+// relying party
+func (s *Server) recordVerification(session VerificationSession, err error) {
+	if session.RPID == "" {
+		return
+	}
+	if err != nil {
+		s.relyingParties.Record(session.RPID, usageFailed)
+		return
+	}
+	s.relyingParties.Record(session.RPID, usageVerified)
+}
+
+// authorizeOperator checks the bearer token for the admin APIs, which are
+// closed unless OPERATOR_API_TOKEN is configured
+func (s *Server) authorizeOperator(r *http.Request) bool {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return s.operatorToken != "" && scheme == "Bearer" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1
+}
+
+// requireOperator guards the admin routes
+func (s *Server) requireOperator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorizeOperator(r) {
+			s.security.AuthFailure(r, "admin")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleRegisterRP(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		problem.Error(w, r, "name is required", http.StatusBadRequest)
+		return
+	}
+	if req.RateLimit < 0 {
+		problem.Error(w, r, "rateLimit must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	rp, key, secret, err := s.relyingParties.Register(tenant.FromContext(r.Context()).ID, req.Name, req.RateLimit, time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to register relying party")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeAdminAction, Action: "relying_party.registered", Actor: "operator", Target: rp.ID})
+	log.Info().Str("rp_id", rp.ID).Str("name", rp.Name).Str("tenant", rp.Tenant).Int("rate_limit", rp.RateLimit).Msg("Relying party registered")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, RegisterRPResponse{RelyingParty: rp, APIKey: key, WebhookSecret: secret})
+}
+
+func (s *Server) handleListRPs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.relyingParties.List(tenant.FromContext(r.Context()).ID))
+}
+
+func (s *Server) handleGetRP(w http.ResponseWriter, r *http.Request) {
+	rp, err := s.relyingParties.Get(tenant.FromContext(r.Context()).ID, chi.URLParam(r, "id"))
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rp)
+}
+
+func (s *Server) handleDeleteRP(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := s.relyingParties.Delete(tenant.FromContext(r.Context()).ID, id); err != nil {
+		problem.Error(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.security.Record(r.Context(), audit.Event{Type: audit.TypeRevocation, Action: "relying_party.deleted", Actor: "operator", Target: id})
+	log.Info().Str("rp_id", id).Msg("Relying party deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
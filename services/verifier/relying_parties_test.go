@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOperatorToken = "operator-secret"
+
+func rpRequest(t *testing.T, server *Server, method, path, apiKey string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func newRPServer(t *testing.T) *Server {
+	t.Helper()
+	server := NewServer()
+	server.requireRPAuth = true
+	server.operatorToken = testOperatorToken
+	return server
+}
+
+func registerRP(t *testing.T, server *Server, name string, rateLimit int) RegisterRPResponse {
+	t.Helper()
+	body, err := json.Marshal(RegisterRPRequest{Name: name, RateLimit: rateLimit})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/admin/relying-parties", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var resp RegisterRPResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestAdminAPI_RequiresOperatorToken(t *testing.T) {
+	server := newRPServer(t)
+
+	w := rpRequest(t, server, http.MethodPost, "/admin/relying-parties", "", RegisterRPRequest{Name: "shop"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	server.operatorToken = ""
+	req := httptest.NewRequest(http.MethodGet, "/admin/relying-parties", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminAPI_KeepsSecurityAuditTrail(t *testing.T) {
+	server := newRPServer(t)
+	trail := audit.NewMemory()
+	var err error
+	server.security, err = audit.New("verifier", trail, nil)
+	require.NoError(t, err)
+
+	shop := registerRP(t, server, "Example Shop", 0)
+	req := httptest.NewRequest(http.MethodDelete, "/admin/relying-parties/"+shop.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, rpRequest(t, server, http.MethodGet, "/admin/relying-parties", "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"}).Code)
+
+	events, err := trail.Events(context.Background(), 0)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, "relying_party.registered", events[0].Action)
+	assert.Equal(t, shop.ID, events[0].Target)
+	assert.Equal(t, audit.TypeRevocation, events[1].Type)
+	assert.Equal(t, shop.ID, events[1].Target)
+	assert.Equal(t, audit.TypeAuthFailure, events[2].Type)
+	assert.Equal(t, "admin", events[2].Detail)
+	assert.Equal(t, "POST /verification-sessions", events[3].Action)
+	assert.NoError(t, server.security.Verify(context.Background()))
+}
+
+func TestRelyingParty_APIKeyRequired(t *testing.T) {
+	server := newRPServer(t)
+
+	w := rpRequest(t, server, http.MethodPost, "/verification-sessions", "", CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+
+	w = rpRequest(t, server, http.MethodPost, "/verification-sessions", "cvk_not-a-key", CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Wallet-facing routes stay open
+	w = rpRequest(t, server, http.MethodGet, "/packs", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRelyingParty_VerifiesAndCountsUsage(t *testing.T) {
+	server := newRPServer(t)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	shop := registerRP(t, server, "Example Shop", 0)
+	assert.Equal(t, defaultRPRateLimit, shop.RateLimit)
+
+	w := rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, shop.ID, session.RPID)
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	w = rpRequest(t, server, http.MethodPost, "/presentations/verify", shop.APIKey, VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, shop.ID, resp.Receipt.RPID)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/relying-parties/"+shop.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var got RelyingPartyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "Example Shop", got.Name)
+	assert.Equal(t, int64(1), got.Usage.Sessions)
+	assert.Equal(t, int64(1), got.Usage.Verifications)
+	assert.Equal(t, int64(1), got.Usage.Verified)
+	assert.Equal(t, int64(0), got.Usage.Failed)
+}
+
+func TestRelyingParty_CannotUseAnotherRPsSession(t *testing.T) {
+	server := newRPServer(t)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	shop := registerRP(t, server, "Example Shop", 0)
+	other := registerRP(t, server, "Other Shop", 0)
+
+	w := rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	w = rpRequest(t, server, http.MethodPost, "/presentations/verify", other.APIKey, VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_session")
+}
+
+func TestRelyingParty_RateLimited(t *testing.T) {
+	server := newRPServer(t)
+	shop := registerRP(t, server, "Example Shop", 1)
+
+	w := rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	usage, err := server.relyingParties.Get(tenant.DefaultID, shop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Usage.RateLimited)
+}
+
+func TestRelyingParty_DeleteRevokesKey(t *testing.T) {
+	server := newRPServer(t)
+	shop := registerRP(t, server, "Example Shop", 0)
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/relying-parties/"+shop.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = rpRequest(t, server, http.MethodPost, "/verification-sessions", shop.APIKey, CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// replayWindow is how long presentations are remembered: a replay after it
+// fails the nonce check of the (by then expired) session anyway
+const replayWindow = verificationSessionTTL
+
+var ErrReplayedPresentation = errors.New("presentation has already been submitted")
+
+var presentationReplays = expvar.NewInt("presentation_replays_total")
+
+type replayEntry struct {
+	sessionID string
+	expiresAt time.Time
+}
+
+// replayCache remembers recently accepted presentations per relying party
+// in memory (production should use a shared store with TTLs, e.g. Redis, so
+// replays are caught across replicas)
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]replayEntry
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]replayEntry)}
+}
+
+// Seen reports the session that first presented any of keys, if it is still
+// within the replay window
+func (c *replayCache) Seen(rpID string, keys []string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if entry, ok := c.seen[rpID+"|"+key]; ok && now.Before(entry.expiresAt) {
+			return entry.sessionID, true
+		}
+	}
+	return "", false
+}
+
+// Record remembers keys as presented in sessionID for the replay window
+func (c *replayCache) Record(rpID, sessionID string, keys []string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.seen[rpID+"|"+key] = replayEntry{sessionID: sessionID, expiresAt: now.Add(replayWindow)}
+	}
+}
+
+// PurgeExpired drops entries past the replay window and reports how many
+func (c *replayCache) PurgeExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for key, entry := range c.seen {
+		if !now.Before(entry.expiresAt) {
+			delete(c.seen, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// presentationDigest identifies the exact bytes presented. The KB-JWT inside
+// an SD-JWT (or the device signature inside an mdoc) makes it unique to one
+// answer, so an identical digest is a replay.
+func presentationDigest(envelope PresentationEnvelope) string {
+	sum := sha256.Sum256([]byte(envelope.Format + "\n" + envelope.Presentation))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// replayKeys are the identifiers remembered for a verified presentation: its
+// digest, and the KB-JWT jti when the wallet sets one
+func replayKeys(envelope PresentationEnvelope, verified VerifiedSDJWT) []string {
+	keys := []string{presentationDigest(envelope)}
+	if verified.PresentationID != "" {
+		keys = append(keys, "jti:"+verified.PresentationID)
+	}
+	return keys
+}
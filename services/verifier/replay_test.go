@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayCache(t *testing.T) {
+	cache := newReplayCache()
+	now := time.Now()
+	cache.Record("rp-1", "session-1", []string{"digest-a", "jti:1"}, now)
+
+	first, ok := cache.Seen("rp-1", []string{"jti:1"}, now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, "session-1", first)
+
+	// Scoped per relying party, and forgotten after the window
+	_, ok = cache.Seen("rp-2", []string{"digest-a"}, now)
+	assert.False(t, ok)
+	_, ok = cache.Seen("rp-1", []string{"digest-a"}, now.Add(replayWindow))
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, cache.PurgeExpired(now.Add(replayWindow)))
+	assert.Empty(t, cache.seen)
+}
+
+func TestVerifyPresentation_RejectsReplay(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	first := createSession(t, server, "pack.safe.seller@0.1.0")
+	second := createSession(t, server, "pack.safe.seller@0.1.0")
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	presentation := issuer.present(t, issuerJWT, disclosures, first.Nonce, first.Audience, issuer.holder)
+	w := verifyWithProfile(t, server, first, presentation)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	replays := presentationReplays.Value()
+	w = verifyWithProfile(t, server, second, presentation)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "replayed_presentation", decodeProblem(t, w).Code)
+	assert.Equal(t, replays+1, presentationReplays.Value())
+
+	code, outcome := getOutcome(t, server, second.ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OutcomeFailed, outcome.Status)
+}
+
+func TestVerifyPresentation_RejectsReusedJTI(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+
+	first := createSession(t, server, "pack.safe.seller@0.1.0")
+	w := verifyWithProfile(t, server, first, issuer.presentWithClaims(t, issuerJWT, disclosures,
+		jwt.MapClaims{"aud": first.Audience, "nonce": first.Nonce, "jti": "kb-1"}, issuer.holder))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// A fresh KB-JWT for the new nonce, but reusing the jti
+	second := createSession(t, server, "pack.safe.seller@0.1.0")
+	w = verifyWithProfile(t, server, second, issuer.presentWithClaims(t, issuerJWT, disclosures,
+		jwt.MapClaims{"aud": second.Audience, "nonce": second.Nonce, "jti": "kb-1"}, issuer.holder))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	third := createSession(t, server, "pack.safe.seller@0.1.0")
+	w = verifyWithProfile(t, server, third, issuer.presentWithClaims(t, issuerJWT, disclosures,
+		jwt.MapClaims{"aud": third.Audience, "nonce": third.Nonce, "jti": "kb-2"}, issuer.holder))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
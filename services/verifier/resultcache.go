@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+var verificationCacheLookups = expvar.NewMap("verification_cache_total")
+
+// credentialStatusEvents change whether a credential verifies
+var credentialStatusEvents = []string{events.TypeCredentialRevoked, events.TypeCredentialSuspended, events.TypeCredentialReinstated}
+
+// resultCacheGroup is this instance's own consumer group: every instance
+// holds its own cache, so each must see every status event
+func resultCacheGroup() string {
+	host, _ := os.Hostname()
+	group := "verifier-cache-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(host))
+	if len(group) > 63 {
+		group = group[:63]
+	}
+	return strings.TrimRight(group, "-")
+}
+
+// resultEntry is an SD-JWT credential whose issuer signature, disclosures
+// and status checked out, without the key binding of the presentation
+type resultEntry struct {
+	verified      VerifiedSDJWT
+	statusLists   []string
+	statusVersion string
+	expiresAt     time.Time
+	refs          []string // the credential id and status indexes
+}
+
+// resultCache remembers verified SD-JWT credentials for a short TTL, so a
+// holder presenting the same credential again, as the wallets of
+// high-traffic relying parties do, only has the new key binding checked.
+// Entries are keyed by the credential as issued and the policy it was
+// presented for, and only hit while its status lists keep the version they
+// had when it verified. Status events from the issuer drop entries at once.
+type resultCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]resultEntry
+	byRef   map[string]map[string]bool // credential id or status index -> keys
+}
+
+// newResultCache returns nil, which caches nothing, when ttl is not positive
+func newResultCache(ttl time.Duration) *resultCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &resultCache{ttl: ttl, entries: make(map[string]resultEntry), byRef: make(map[string]map[string]bool)}
+}
+
+// resultKey identifies the credential of an SD-JWT presentation for
+// policyID: everything before the KB-JWT. mdocs and BBS-derived credentials
+// are proven anew by every presentation, so they are not cached.
+func resultKey(envelope PresentationEnvelope, sd SDJWT, policyID string) string {
+	if envelope.Format == FormatMsoMdoc || envelope.Format == FormatLDPVC {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(envelope.Format + "\n" + sd.SigningInput + "\n" + policyID))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the credential verified under key, if its status lists
+// are still at the version it was checked against
+func (c *resultCache) lookup(key string, status *statusChecker, now time.Time) (VerifiedSDJWT, bool) {
+	if c == nil || key == "" {
+		return VerifiedSDJWT{}, false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || !now.Before(entry.expiresAt) {
+		verificationCacheLookups.Add("miss", 1)
+		return VerifiedSDJWT{}, false
+	}
+	if version, ok := status.versions(entry.statusLists, now); !ok || version != entry.statusVersion {
+		verificationCacheLookups.Add("miss", 1)
+		return VerifiedSDJWT{}, false
+	}
+	verificationCacheLookups.Add("hit", 1)
+	return entry.verified, true
+}
+
+// store remembers a credential that verified with its status current. It
+// expires with the TTL or the credential, whichever comes first.
+func (c *resultCache) store(key string, verified VerifiedSDJWT, status *statusChecker, now time.Time) {
+	if c == nil || key == "" {
+		return
+	}
+	statusEntries, err := credentialStatusEntries(verified.Claims)
+	if err != nil {
+		return
+	}
+	entry := resultEntry{expiresAt: now.Add(c.ttl)}
+	for _, statusEntry := range statusEntries {
+		entry.statusLists = append(entry.statusLists, statusEntry.StatusListCredential)
+		entry.refs = append(entry.refs, "status:"+statusEntry.StatusListIndex)
+	}
+	var ok bool
+	if entry.statusVersion, ok = status.versions(entry.statusLists, now); !ok {
+		return
+	}
+	if !verified.ExpiresAt.IsZero() && verified.ExpiresAt.Before(entry.expiresAt) {
+		entry.expiresAt = verified.ExpiresAt
+	}
+	for _, claim := range []string{"id", "jti"} {
+		if id, _ := verified.Claims[claim].(string); id != "" {
+			entry.refs = append(entry.refs, "id:"+id)
+		}
+	}
+	// The presentation's key binding is checked anew on every hit
+	verified.KeyBound, verified.PresentedAt, verified.PresentationID = false, time.Time{}, ""
+	verified.Algorithms = slices.Clip(verified.Algorithms[:1])
+	entry.verified = verified
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+	for _, ref := range entry.refs {
+		if c.byRef[ref] == nil {
+			c.byRef[ref] = make(map[string]bool)
+		}
+		c.byRef[ref][key] = true
+	}
+}
+
+// invalidate drops the entries of the credential with the given id or
+// status list index, returning the status lists they were checked against.
+// Indexes are not unique across status lists, so other credentials may be
+// dropped too; they verify again on their next presentation.
+func (c *resultCache) invalidate(credentialID, statusIndex string) []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lists []string
+	for _, ref := range []string{"id:" + credentialID, "status:" + statusIndex} {
+		if ref == "id:" || ref == "status:" {
+			continue
+		}
+		for key := range c.byRef[ref] {
+			if entry, ok := c.entries[key]; ok {
+				lists = append(lists, entry.statusLists...)
+				c.drop(key, entry)
+				verificationCacheLookups.Add("invalidated", 1)
+			}
+		}
+	}
+	return lists
+}
+
+// PurgeExpired drops entries past their expiry and reports how many
+func (c *resultCache) PurgeExpired(now time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			c.drop(key, entry)
+			purged++
+		}
+	}
+	return purged
+}
+
+// drop removes an entry and its references; c.mu must be held
+func (c *resultCache) drop(key string, entry resultEntry) {
+	delete(c.entries, key)
+	for _, ref := range entry.refs {
+		delete(c.byRef[ref], key)
+		if len(c.byRef[ref]) == 0 {
+			delete(c.byRef, ref)
+		}
+	}
+}
+
+// consumeCredentialStatus drops the cached results of a credential the
+// issuer revoked, suspended or reinstated, along with the status lists they
+// were checked against, so its next presentation sees the new status
+func (s *Server) consumeCredentialStatus(_ context.Context, event events.Event) error {
+	var credentialID, statusIndex string
+	var err error
+	switch event.Type {
+	case events.TypeCredentialRevoked:
+		var data events.CredentialRevoked
+		err = event.Decode(&data)
+		credentialID, statusIndex = data.CredentialID, data.StatusListIndex
+	case events.TypeCredentialSuspended:
+		var data events.CredentialSuspended
+		err = event.Decode(&data)
+		credentialID, statusIndex = data.CredentialID, data.StatusListIndex
+	case events.TypeCredentialReinstated:
+		var data events.CredentialReinstated
+		err = event.Decode(&data)
+		credentialID, statusIndex = data.CredentialID, data.StatusListIndex
+	default:
+		return nil
+	}
+	if err != nil {
+		// Delivering it again would not make it decode
+		log.Warn().Err(err).Str("event_id", event.ID).Msg("Dropping malformed credential status event")
+		return nil
+	}
+	if lists := s.results.invalidate(credentialID, statusIndex); len(lists) > 0 {
+		s.status.evict(lists)
+		log.Info().Str("event_type", event.Type).Str("credential_id", credentialID).Msg("Invalidated cached verification results")
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// revocableStatusList serves a revocation list signed by issuer whose bits
+// can be set while the test runs
+type revocableStatusList struct {
+	*httptest.Server
+	mu      sync.Mutex
+	revoked []int
+	fetches int32
+}
+
+func newRevocableStatusList(t *testing.T, issuer *testIssuer) *revocableStatusList {
+	t.Helper()
+	list := &revocableStatusList{}
+	list.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&list.fetches, 1)
+		list.mu.Lock()
+		revoked := append([]int(nil), list.revoked...)
+		list.mu.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": testIssuerDID,
+			"iat": time.Now().Unix(),
+			"vc": map[string]interface{}{
+				"issuer": testIssuerDID,
+				"credentialSubject": map[string]interface{}{
+					"type": "StatusList2021", "statusPurpose": "revocation", "encodedList": encodeStatusList(t, revoked...),
+				},
+			},
+		})
+		token.Header["kid"] = "key-1"
+		signed, err := token.SignedString(issuer.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(signed))
+	}))
+	t.Cleanup(list.Close)
+	return list
+}
+
+func (l *revocableStatusList) revoke(index int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revoked = append(l.revoked, index)
+}
+
+func cacheLookups(result string) int64 {
+	if v, ok := verificationCacheLookups.Get(result).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestResultCache_ChecksKeyBindingOnHits(t *testing.T) {
+	server := NewServer()
+	server.results = newResultCache(time.Minute)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	list := newRevocableStatusList(t, issuer)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"credentialStatus": statusEntry(list.URL, "revocation", 6)},
+		map[string]interface{}{"age_over_18": true})
+
+	hits := cacheLookups("hit")
+	for i := 0; i < 3; i++ {
+		session := createSession(t, server, "pack.safe.seller@0.1.0")
+		w := verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp VerifyResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.KeyBound)
+		assert.Equal(t, FreshnessOK, resp.Freshness)
+	}
+	assert.Equal(t, hits+2, cacheLookups("hit"))
+
+	// A cached credential still has to be bound to the session it answers
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	w := verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, "another-nonce", session.Audience, issuer.holder))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+
+	// Another pack caches the credential on its own
+	session = createSession(t, server, "pack.tenant.ready@0.1.0")
+	hits = cacheLookups("hit")
+	w = verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, hits, cacheLookups("hit"))
+}
+
+func TestResultCache_InvalidatedByRevocationEvents(t *testing.T) {
+	server := NewServer()
+	server.results = newResultCache(time.Minute)
+	bus := events.NewMemory()
+	t.Cleanup(func() { _ = bus.Close() })
+	require.NoError(t, bus.Subscribe(resultCacheGroup(), credentialStatusEvents, server.consumeCredentialStatus))
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	list := newRevocableStatusList(t, issuer)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"credentialStatus": statusEntry(list.URL, "revocation", 6), "jti": "urn:uuid:credential-6"},
+		map[string]interface{}{"age_over_18": true})
+	verify := func() *httptest.ResponseRecorder {
+		session := createSession(t, server, "pack.safe.seller@0.1.0")
+		return verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+	}
+	require.Equal(t, http.StatusOK, verify().Code)
+	require.Equal(t, http.StatusOK, verify().Code)
+	require.EqualValues(t, 1, atomic.LoadInt32(&list.fetches))
+
+	// The issuer revokes it within the status list cache TTL
+	list.revoke(6)
+	event, err := events.New("issuance-gateway", "urn:uuid:credential-6", events.CredentialRevoked{
+		CredentialID: "urn:uuid:credential-6", StatusListIndex: "6", Reason: "superseded", RevokedAt: time.Now(),
+	}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, bus.Publish(context.Background(), event))
+	require.Eventually(t, func() bool {
+		server.results.mu.Lock()
+		defer server.results.mu.Unlock()
+		return len(server.results.entries) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	w := verify()
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), ErrCredentialRevoked.Error())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&list.fetches), "the status list is fetched again")
+}
+
+func TestResultCache_MissesOnNewStatusListVersion(t *testing.T) {
+	server := NewServer()
+	server.results = newResultCache(time.Minute)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	list := newRevocableStatusList(t, issuer)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"credentialStatus": statusEntry(list.URL, "revocation", 6)},
+		map[string]interface{}{"age_over_18": true})
+	verify := func() *httptest.ResponseRecorder {
+		session := createSession(t, server, "pack.safe.seller@0.1.0")
+		return verifyWithProfile(t, server, session, issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder))
+	}
+	require.Equal(t, http.StatusOK, verify().Code)
+
+	// Without an event, the revocation shows once the list is fetched again
+	list.revoke(6)
+	server.status.mu.Lock()
+	for url, cached := range server.status.cache {
+		cached.fetchedAt = cached.fetchedAt.Add(-defaultStatusCacheTTL)
+		server.status.cache[url] = cached
+	}
+	server.status.mu.Unlock()
+	assert.Equal(t, http.StatusUnprocessableEntity, verify().Code)
+}
+
+func TestResultCacheGroup(t *testing.T) {
+	assert.Regexp(t, `^verifier-cache(-[a-z0-9-]*[a-z0-9])?$`, resultCacheGroup())
+	assert.LessOrEqual(t, len(resultCacheGroup()), 63)
+}
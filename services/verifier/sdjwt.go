@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SD-JWT (RFC 9901) presentation verification
+const (
+	sdClaim         = "_sd"
+	sdAlgClaim      = "_sd_alg"
+	sdArrayClaim    = "..."
+	kbJWTType       = "kb+jwt"
+	kbMaxAge        = 5 * time.Minute
+	kbClockSkew     = 30 * time.Second
+	issuerClockSkew = 30 * time.Second
+)
+
+var ErrInvalidPresentation = errors.New("invalid presentation")
+
+// issuerSigningMethods are the JWS algorithms accepted on issuer-signed JWTs;
+// compliance profiles may narrow them further
+var issuerSigningMethods = []string{"ES256", "ES384", "ES512", "RS256", "PS256", "EdDSA"}
+
+// SDJWT is a compact SD-JWT presentation split into its parts
+type SDJWT struct {
+	IssuerJWT   string
+	Disclosures []Disclosure
+	KBJWT       string
+	// SigningInput is everything before the KB-JWT, which sd_hash covers
+	SigningInput string
+}
+
+// Disclosure is one decoded selectively disclosable claim
+type Disclosure struct {
+	Encoded string
+	Salt    string
+	Name    string // empty for array element disclosures
+	Value   interface{}
+	digest  string
+}
+
+// KeyBindingExpectations are what the holder's KB-JWT must commit to
+type KeyBindingExpectations struct {
+	Nonce    string
+	Audience string
+	Required bool
+}
+
+// VerifiedSDJWT is a presentation whose signatures and disclosures checked out
+type VerifiedSDJWT struct {
+	Issuer   string
+	Vct      string
+	Claims   map[string]interface{} // with disclosed claims filled in
+	KeyBound bool
+	IssuedAt time.Time
+	// PresentedAt is the KB-JWT iat; zero without key binding or for mdocs,
+	// whose device signature carries no time
+	PresentedAt time.Time
+	// PresentationID is the KB-JWT jti, when the wallet sets one
+	PresentationID string
+	ExpiresAt      time.Time
+	Disclosed      []string // names of disclosed object claims
+	Algorithms     []string
+	// IssuerChainVerified is set for mdocs, whose issuer is trusted through
+	// its certificate chain to an IACA root rather than the trust list
+	IssuerChainVerified bool
+	// Unlinkable is set for BBS-derived credentials disclosing nothing unique
+	// to the credential, whose presentations cannot be told apart
+	Unlinkable bool
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPresentation, fmt.Sprintf(format, args...))
+}
+
+// ParseSDJWT splits a compact presentation and decodes its disclosures
+func ParseSDJWT(presentation string) (SDJWT, error) {
+	parts := strings.Split(presentation, "~")
+	if len(parts) < 2 {
+		return SDJWT{}, invalidf("missing disclosure separator")
+	}
+	sd := SDJWT{
+		IssuerJWT: parts[0],
+		KBJWT:     parts[len(parts)-1],
+	}
+	sd.SigningInput = strings.Join(parts[:len(parts)-1], "~") + "~"
+
+	for _, encoded := range parts[1 : len(parts)-1] {
+		if encoded == "" {
+			return SDJWT{}, invalidf("empty disclosure")
+		}
+		disclosure, err := decodeDisclosure(encoded)
+		if err != nil {
+			return SDJWT{}, err
+		}
+		sd.Disclosures = append(sd.Disclosures, disclosure)
+	}
+	return sd, nil
+}
+
+func decodeDisclosure(encoded string) (Disclosure, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Disclosure{}, invalidf("disclosure is not base64url: %v", err)
+	}
+	var elements []interface{}
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return Disclosure{}, invalidf("disclosure is not a JSON array: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(encoded))
+	d := Disclosure{Encoded: encoded, digest: base64.RawURLEncoding.EncodeToString(sum[:])}
+	var ok bool
+	switch len(elements) {
+	case 2:
+		d.Salt, ok = elements[0].(string)
+		d.Value = elements[1]
+	case 3:
+		d.Salt, ok = elements[0].(string)
+		d.Name, _ = elements[1].(string)
+		d.Value = elements[2]
+		if d.Name == "" || d.Name == sdClaim || d.Name == sdArrayClaim {
+			return Disclosure{}, invalidf("disclosure has an invalid claim name")
+		}
+	default:
+		return Disclosure{}, invalidf("disclosure has %d elements", len(elements))
+	}
+	if !ok {
+		return Disclosure{}, invalidf("disclosure salt must be a string")
+	}
+	return d, nil
+}
+
+// Verify checks the issuer signature, resolves disclosures against the
+// signed digests and validates key binding
+func (sd SDJWT) Verify(ctx context.Context, keys IssuerKeyResolver, kb KeyBindingExpectations, now time.Time) (VerifiedSDJWT, error) {
+	var alg string
+	var resolveErr error
+	token, err := jwt.Parse(sd.IssuerJWT, func(token *jwt.Token) (interface{}, error) {
+		alg = token.Method.Alg()
+		issuer, _ := token.Claims.(jwt.MapClaims)["iss"].(string)
+		if issuer == "" {
+			return nil, errors.New("issuer-signed JWT has no iss claim")
+		}
+		kid, _ := token.Header["kid"].(string)
+		var key crypto.PublicKey
+		key, resolveErr = keys.ResolveKey(ctx, issuer, kid)
+		return key, resolveErr
+	},
+		jwt.WithValidMethods(issuerSigningMethods),
+		jwt.WithLeeway(issuerClockSkew),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if isTrustError(resolveErr) {
+		return VerifiedSDJWT{}, resolveErr
+	}
+	if err != nil {
+		return VerifiedSDJWT{}, invalidf("issuer signature: %v", err)
+	}
+	claims := map[string]interface{}(token.Claims.(jwt.MapClaims))
+
+	if sdAlg, ok := claims[sdAlgClaim]; ok && sdAlg != "sha-256" {
+		return VerifiedSDJWT{}, invalidf("unsupported _sd_alg %v", sdAlg)
+	}
+	delete(claims, sdAlgClaim)
+
+	resolver := disclosureResolver{byDigest: make(map[string]*Disclosure), used: make(map[string]bool)}
+	for i := range sd.Disclosures {
+		d := &sd.Disclosures[i]
+		if _, dup := resolver.byDigest[d.digest]; dup {
+			return VerifiedSDJWT{}, invalidf("duplicate disclosure")
+		}
+		resolver.byDigest[d.digest] = d
+	}
+	resolved, err := resolver.resolve(claims)
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	if len(resolver.used) != len(sd.Disclosures) {
+		return VerifiedSDJWT{}, invalidf("disclosure not referenced by the issuer-signed JWT")
+	}
+
+	verified := VerifiedSDJWT{
+		Claims:     resolved.(map[string]interface{}),
+		Disclosed:  resolver.names,
+		Algorithms: []string{alg},
+	}
+	verified.Issuer, _ = verified.Claims["iss"].(string)
+	verified.Vct, _ = verified.Claims["vct"].(string)
+	if iat, err := token.Claims.GetIssuedAt(); err == nil && iat != nil {
+		verified.IssuedAt = iat.Time
+	}
+	if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+		verified.ExpiresAt = exp.Time
+	}
+
+	return sd.bindHolder(verified, kb, now)
+}
+
+// bindHolder checks the KB-JWT of a presentation whose issuer-signed part
+// verified, against the holder key of the credential's cnf claim
+func (sd SDJWT) bindHolder(verified VerifiedSDJWT, kb KeyBindingExpectations, now time.Time) (VerifiedSDJWT, error) {
+	cnf, holderBound := verified.Claims["cnf"].(map[string]interface{})
+	if sd.KBJWT == "" {
+		if kb.Required || holderBound {
+			return VerifiedSDJWT{}, invalidf("key binding JWT required")
+		}
+		return verified, nil
+	}
+	if !holderBound {
+		return VerifiedSDJWT{}, invalidf("key binding JWT present but credential has no cnf claim")
+	}
+	holderKey, err := cnfKey(cnf)
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	binding, err := sd.verifyKeyBinding(holderKey, kb, now)
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	verified.KeyBound, verified.PresentedAt, verified.PresentationID = true, binding.IssuedAt, binding.ID
+	verified.Algorithms = append(verified.Algorithms, binding.Alg)
+	return verified, nil
+}
+
+func cnfKey(cnf map[string]interface{}) (crypto.PublicKey, error) {
+	raw, err := json.Marshal(cnf["jwk"])
+	if err != nil {
+		return nil, invalidf("cnf.jwk: %v", err)
+	}
+	var jwk JWK
+	if err := json.Unmarshal(raw, &jwk); err != nil || jwk.Kty == "" {
+		return nil, invalidf("cnf claim has no usable jwk")
+	}
+	key, err := jwk.PublicKey()
+	if err != nil {
+		return nil, invalidf("cnf.jwk: %v", err)
+	}
+	return key, nil
+}
+
+type kbClaims struct {
+	Nonce  string `json:"nonce"`
+	SDHash string `json:"sd_hash"`
+	jwt.RegisteredClaims
+}
+
+// keyBinding is what a verified KB-JWT tells about the presentation
+type keyBinding struct {
+	Alg      string
+	IssuedAt time.Time
+	ID       string // jti, when the wallet sets one
+}
+
+// verifyKeyBinding validates the KB-JWT against the holder key in cnf
+func (sd SDJWT) verifyKeyBinding(holderKey crypto.PublicKey, kb KeyBindingExpectations, now time.Time) (keyBinding, error) {
+	var claims kbClaims
+	token, err := jwt.ParseWithClaims(sd.KBJWT, &claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != kbJWTType {
+			return nil, fmt.Errorf("typ must be %s", kbJWTType)
+		}
+		return holderKey, nil
+	},
+		jwt.WithValidMethods(issuerSigningMethods),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(kbClockSkew),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil {
+		return keyBinding{}, invalidf("key binding JWT: %v", err)
+	}
+
+	if claims.IssuedAt == nil || now.Sub(claims.IssuedAt.Time) > kbMaxAge {
+		return keyBinding{}, invalidf("key binding JWT is too old")
+	}
+	if kb.Nonce == "" || claims.Nonce != kb.Nonce {
+		return keyBinding{}, invalidf("key binding JWT nonce mismatch")
+	}
+	if kb.Audience != "" && !contains(claims.Audience, kb.Audience) {
+		return keyBinding{}, invalidf("key binding JWT audience mismatch")
+	}
+	sum := sha256.Sum256([]byte(sd.SigningInput))
+	if claims.SDHash != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		return keyBinding{}, invalidf("key binding JWT sd_hash mismatch")
+	}
+	return keyBinding{Alg: token.Method.Alg(), IssuedAt: claims.IssuedAt.Time, ID: claims.ID}, nil
+}
+
+// disclosureResolver replaces digests in the issuer claims with the
+// matching disclosed values
+type disclosureResolver struct {
+	byDigest map[string]*Disclosure
+	used     map[string]bool
+	names    []string
+}
+
+func (r *disclosureResolver) claim(digest string) (*Disclosure, error) {
+	d, ok := r.byDigest[digest]
+	if !ok {
+		return nil, nil // undisclosed or decoy digest
+	}
+	if r.used[digest] {
+		return nil, invalidf("digest referenced more than once")
+	}
+	r.used[digest] = true
+	return d, nil
+}
+
+func (r *disclosureResolver) resolve(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for name, child := range v {
+			if name == sdClaim {
+				continue
+			}
+			resolved, err := r.resolve(child)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = resolved
+		}
+
+		digests, _ := v[sdClaim].([]interface{})
+		for _, entry := range digests {
+			digest, ok := entry.(string)
+			if !ok {
+				return nil, invalidf("_sd entries must be strings")
+			}
+			d, err := r.claim(digest)
+			if err != nil {
+				return nil, err
+			}
+			if d == nil {
+				continue
+			}
+			if d.Name == "" {
+				return nil, invalidf("array element disclosure used for an object claim")
+			}
+			if _, exists := out[d.Name]; exists {
+				return nil, invalidf("disclosed claim %q already present", d.Name)
+			}
+			resolved, err := r.resolve(d.Value)
+			if err != nil {
+				return nil, err
+			}
+			out[d.Name] = resolved
+			r.names = append(r.names, d.Name)
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if ref, ok := element.(map[string]interface{}); ok && len(ref) == 1 {
+				if digest, ok := ref[sdArrayClaim].(string); ok {
+					d, err := r.claim(digest)
+					if err != nil {
+						return nil, err
+					}
+					if d == nil {
+						continue
+					}
+					if d.Name != "" {
+						return nil, invalidf("object claim disclosure used for an array element")
+					}
+					element = d.Value
+				}
+			}
+			resolved, err := r.resolve(element)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, resolved)
+		}
+		return out, nil
+	}
+	return value, nil
+}
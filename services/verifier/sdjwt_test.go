@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuerDID = "did:web:issuer.example"
+
+// testIssuer signs SD-JWT VCs with a fresh ES256 key
+type testIssuer struct {
+	key    *ecdsa.PrivateKey
+	holder *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t testing.TB) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	holder, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &testIssuer{key: key, holder: holder}
+}
+
+func (i *testIssuer) resolver() StaticKeyResolver {
+	return StaticKeyResolver{testIssuerDID: {"key-1": &i.key.PublicKey}}
+}
+
+// trustedBy makes server resolve the issuer's keys and trust it for the
+// given credential types, by default the vct issue uses
+func (i *testIssuer) trustedBy(server *Server, credentialTypes ...string) {
+	if len(credentialTypes) == 0 {
+		credentialTypes = []string{"https://cachet.id/identity"}
+	}
+	server.issuerKeys = i.resolver()
+	server.trust = newStaticTrustList([]TrustedIssuer{{
+		DID:             testIssuerDID,
+		CredentialTypes: credentialTypes,
+		Status:          IssuerStatusActive,
+	}})
+}
+
+func ecJWK(key *ecdsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func makeDisclosure(t testing.TB, elements ...interface{}) (string, string) {
+	t.Helper()
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	raw, err := json.Marshal(append([]interface{}{base64.RawURLEncoding.EncodeToString(salt)}, elements...))
+	require.NoError(t, err)
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(encoded))
+	return encoded, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// issue signs a credential whose disclosable claims are hidden behind
+// digests, returning the issuer JWT and every disclosure
+func (i *testIssuer) issue(t testing.TB, claims, disclosable map[string]interface{}) (string, []string) {
+	t.Helper()
+	payload := jwt.MapClaims{
+		"iss":     testIssuerDID,
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"vct":     "https://cachet.id/identity",
+		"_sd_alg": "sha-256",
+		"cnf":     map[string]interface{}{"jwk": ecJWK(&i.holder.PublicKey)},
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	var disclosures, digests []string
+	for name, value := range disclosable {
+		encoded, digest := makeDisclosure(t, name, value)
+		disclosures = append(disclosures, encoded)
+		digests = append(digests, digest)
+	}
+	payload["_sd"] = append(digests, "decoy-digest")
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, payload)
+	token.Header["kid"] = "key-1"
+	token.Header["typ"] = "dc+sd-jwt"
+	signed, err := token.SignedString(i.key)
+	require.NoError(t, err)
+	return signed, disclosures
+}
+
+// present assembles a presentation with a KB-JWT signed by the holder
+func (i *testIssuer) present(t testing.TB, issuerJWT string, disclosures []string, nonce, aud string, holder crypto.Signer) string {
+	t.Helper()
+	return i.presentWithClaims(t, issuerJWT, disclosures, jwt.MapClaims{"aud": aud, "nonce": nonce}, holder)
+}
+
+// presentWithClaims is present with extra or overridden KB-JWT claims
+func (i *testIssuer) presentWithClaims(t testing.TB, issuerJWT string, disclosures []string, claims jwt.MapClaims, holder crypto.Signer) string {
+	t.Helper()
+	prefix := issuerJWT + "~" + strings.Join(disclosures, "~")
+	if len(disclosures) > 0 {
+		prefix += "~"
+	}
+	sum := sha256.Sum256([]byte(prefix))
+	kbClaims := jwt.MapClaims{
+		"iat":     time.Now().Unix(),
+		"sd_hash": base64.RawURLEncoding.EncodeToString(sum[:]),
+	}
+	for name, value := range claims {
+		kbClaims[name] = value
+	}
+	kb := jwt.NewWithClaims(jwt.SigningMethodES256, kbClaims)
+	kb.Header["typ"] = kbJWTType
+	signed, err := kb.SignedString(holder)
+	require.NoError(t, err)
+	return prefix + signed
+}
+
+// withoutDisclosures drops every disclosure but keeps the original KB-JWT
+func withoutDisclosures(presentation string) string {
+	parts := strings.Split(presentation, "~")
+	return parts[0] + "~" + parts[len(parts)-1]
+}
+
+func verifyPresentation(t *testing.T, issuer *testIssuer, presentation, nonce string) (VerifiedSDJWT, error) {
+	t.Helper()
+	sd, err := ParseSDJWT(presentation)
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	return sd.Verify(context.Background(), issuer.resolver(), KeyBindingExpectations{
+		Nonce:    nonce,
+		Audience: defaultVerifierAudience,
+	}, time.Now())
+}
+
+func TestSDJWT_VerifiesDisclosedClaims(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"verified": true},
+		map[string]interface{}{"age_over_18": true, "given_name": "Alice"})
+
+	// Only disclose the age predicate
+	var ageOnly []string
+	for _, d := range disclosures {
+		raw, _ := base64.RawURLEncoding.DecodeString(d)
+		if strings.Contains(string(raw), "age_over_18") {
+			ageOnly = append(ageOnly, d)
+		}
+	}
+	presentation := issuer.present(t, issuerJWT, ageOnly, "n-1", defaultVerifierAudience, issuer.holder)
+
+	verified, err := verifyPresentation(t, issuer, presentation, "n-1")
+	require.NoError(t, err)
+	assert.True(t, verified.KeyBound)
+	assert.Equal(t, testIssuerDID, verified.Issuer)
+	assert.Equal(t, true, verified.Claims["age_over_18"])
+	assert.NotContains(t, verified.Claims, "given_name")
+	assert.NotContains(t, verified.Claims, sdClaim)
+	assert.Equal(t, []string{"age.ge.18", "identity.verified"}, derivePredicates(verified.Claims))
+}
+
+func TestSDJWT_RejectsTampering(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	forged, _ := makeDisclosure(t, "age_over_21", true)
+	stranger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		presentation string
+		nonce        string
+	}{
+		"wrong nonce":         {issuer.present(t, issuerJWT, disclosures, "n-1", defaultVerifierAudience, issuer.holder), "n-2"},
+		"wrong audience":      {issuer.present(t, issuerJWT, disclosures, "n-1", "https://evil.example", issuer.holder), "n-1"},
+		"foreign holder key":  {issuer.present(t, issuerJWT, disclosures, "n-1", defaultVerifierAudience, stranger), "n-1"},
+		"unknown disclosure":  {issuer.present(t, issuerJWT, append(disclosures, forged), "n-1", defaultVerifierAudience, issuer.holder), "n-1"},
+		"missing key binding": {issuerJWT + "~" + strings.Join(disclosures, "~") + "~", "n-1"},
+		"sd_hash mismatch":    {withoutDisclosures(issuer.present(t, issuerJWT, disclosures, "n-1", defaultVerifierAudience, issuer.holder)), "n-1"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifyPresentation(t, issuer, tc.presentation, tc.nonce)
+			assert.ErrorIs(t, err, ErrInvalidPresentation)
+		})
+	}
+
+	other := newTestIssuer(t)
+	presentation := issuer.present(t, issuerJWT, disclosures, "n-1", defaultVerifierAudience, issuer.holder)
+	_, err = verifyPresentation(t, other, presentation, "n-1")
+	assert.ErrorIs(t, err, ErrInvalidPresentation, "signature from an unresolved key must fail")
+}
+
+func TestSDJWT_ResolvesNestedAndArrayDisclosures(t *testing.T) {
+	issuer := newTestIssuer(t)
+	age, ageDigest := makeDisclosure(t, "age", 34)
+	country, countryDigest := makeDisclosure(t, "EE")
+	issuerJWT, _ := issuer.issue(t, map[string]interface{}{
+		"personalData": map[string]interface{}{"_sd": []interface{}{ageDigest}},
+		"nationalities": []interface{}{
+			map[string]interface{}{"...": countryDigest},
+			map[string]interface{}{"...": "undisclosed"},
+		},
+	}, nil)
+
+	presentation := issuer.present(t, issuerJWT, []string{age, country}, "n-1", defaultVerifierAudience, issuer.holder)
+	verified, err := verifyPresentation(t, issuer, presentation, "n-1")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"EE"}, verified.Claims["nationalities"])
+	assert.Equal(t, []string{"age.ge.16", "age.ge.18", "age.ge.21"}, derivePredicates(verified.Claims))
+}
+
+func TestDIDWebResolver_FetchesAssertionKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	var did string
+	host := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/.well-known/did.json", r.URL.Path)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": did,
+			"verificationMethod": []map[string]interface{}{{
+				"id":           did + "#key-1",
+				"type":         "JsonWebKey2020",
+				"controller":   did,
+				"publicKeyJwk": ecJWK(&issuer.key.PublicKey),
+			}},
+			"assertionMethod": []string{did + "#key-1"},
+		})
+	}))
+	defer host.Close()
+	did = "did:web:" + strings.ReplaceAll(strings.TrimPrefix(host.URL, "https://"), ":", "%3A")
+
+	resolver := newDIDKeyResolver()
+	resolver.dids.Register("web", didresolver.NewWebMethod(host.Client()))
+	key, err := resolver.ResolveKey(context.Background(), did, "key-1")
+	require.NoError(t, err)
+	assert.True(t, issuer.key.PublicKey.Equal(key))
+
+	_, err = resolver.ResolveKey(context.Background(), did, "key-2")
+	assert.ErrorIs(t, err, ErrIssuerKeyNotFound)
+}
@@ -1,44 +1,142 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"net/http"
 	"time"
 
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/audit"
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog/log"
 )
 
-type Pack struct {
-	ID      string `json:"id"`
-	Version string `json:"version"`
-	Name    string `json:"name"`
-}
-
 type VerifyRequest struct {
-	PolicyID string      `json:"policyId"`
-	Bundle   interface{} `json:"bundle"`
+	PolicyID  string      `json:"policyId"`
+	Bundle    interface{} `json:"bundle"`
+	SessionID string      `json:"sessionId"` // from POST /verification-sessions
 }
 
 type VerifyResponse struct {
-	Badge      string   `json:"badge"`
+	Badge      Badge    `json:"badge"`
 	Predicates []string `json:"predicates"`
-	Freshness  string   `json:"freshness"`
+	// Freshness summarizes credential status and the pack's freshness policy
+	// (ok, stale, suspended or unknown); FreshnessDiagnostics lists each
+	// freshness limit exceeded
+	Freshness            string                `json:"freshness"`
+	FreshnessDiagnostics []FreshnessDiagnostic `json:"freshnessDiagnostics,omitempty"`
+	Issuer               string                `json:"issuer,omitempty"`
+	KeyBound             bool                  `json:"keyBound"`
+	// Satisfied reports whether every required pack rule passed; Results
+	// explains each rule of the requested pack
+	Satisfied bool              `json:"satisfied"`
+	Results   []PredicateResult `json:"results,omitempty"`
+	// StepUp lists what else meets the pack's unmet required rules
+	StepUp *StepUp `json:"stepUp,omitempty"`
+	// Credentials reports each credential of the bundle, in presentation order
+	Credentials []CredentialResult `json:"credentials"`
+	// Receipt records the exchange; its hash is anchored in the receipts-log
+	// when one is configured, directly or through the event bus
+	Receipt       ConsentReceipt `json:"receipt"`
+	ReceiptAnchor *ReceiptAnchor `json:"receiptAnchor,omitempty"`
 }
 
 type Server struct {
-	router *chi.Mux
-	packs  []Pack
+	router     *chi.Mux
+	packs      *packSet
+	profile    ComplianceProfile
+	issuerKeys IssuerKeyResolver
+	mdocRoots  *x509.CertPool // IACA roots mdoc document signers chain to
+	trust      *trustedIssuerList
+	status     *statusChecker
+	results    *resultCache // verified credentials presented again; nil caches none
+	receipts   *receiptsLog // nil when no receipts-log is configured
+	// events announces completed sessions to the other services; nil when
+	// no event bus is configured
+	events events.Bus
+	// Packs published by the registry, reloaded every packRefreshInterval;
+	// nil serves the built-in packs
+	packSource          *registryPacks
+	packRefreshInterval time.Duration
+	sessions            *sessionStore
+	replays             *replayCache
+	metrics             *verifierMetrics
+	health              *health.Monitor // observes the registry and receipts-log when they are configured
+	// Relying party API keys; requireRPAuth closes the RP-facing routes to
+	// callers without one. operatorToken guards the admin API.
+	relyingParties *rpRegistry
+	requireRPAuth  bool
+	operatorToken  string
+	// Signed result callbacks to relying parties; callbackSigningSecret signs
+	// those of sessions created without RP authentication
+	callbacks             *callbackQueue
+	callbackClient        *http.Client
+	callbackSigningSecret []byte
+	// OpenID4VP request object signing and the public base URL wallets post to
+	requestSigner *requestSigner
+	baseURL       string
+	// tenants resolves requests to the tenants served; verifiers holds their
+	// signing keys and packs, falling back to the service's own
+	tenants   tenant.Directory
+	verifiers map[string]*tenantVerifier
+	audience  string // expected KB-JWT aud; empty skips the check
+	// cors lets the configured origins call the API from browsers
+	cors cors.Policy
+	// versions serves the API under /v1 and its legacy unversioned aliases
+	versions apiversion.Policy
+	// security keeps the tamper-evident trail of auth failures and
+	// operator actions; nil records nothing
+	security *audit.Logger
+	// rateLimit limits each client's calls to the public routes, on top of
+	// the relying parties' own limits
+	rateLimit ratelimit.Limiter
+	// openapi refuses requests that do not match the API document
+	openapi *openapi.Validator
 }
 
 func NewServer() *Server {
+	return NewServerWithProfile(complianceProfiles[ProfileDefault])
+}
+
+// NewServerWithProfile creates a verifier enforcing the given compliance profile
+func NewServerWithProfile(profile ComplianceProfile) *Server {
+	packs, err := compilePacks(defaultPacks())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Built-in pack rules do not compile")
+	}
 	s := &Server{
-		router: chi.NewRouter(),
-		packs: []Pack{
-			{ID: "pack.childcare.readiness@0.1.0", Version: "0.1.0", Name: "Childcare Readiness"},
-			{ID: "pack.safe.seller@0.1.0", Version: "0.1.0", Name: "Safe Seller"},
-		},
+		router:         chi.NewRouter(),
+		profile:        profile,
+		issuerKeys:     newDIDKeyResolver(),
+		trust:          newStaticTrustList(defaultTrustedIssuers()),
+		status:         newStatusChecker(),
+		audience:       defaultVerifierAudience,
+		sessions:       newSessionStore(verificationSessionTTL),
+		replays:        newReplayCache(),
+		metrics:        newVerifierMetrics(),
+		health:         health.New("verifier"),
+		relyingParties: newRPRegistry(),
+		callbacks:      newCallbackQueue(),
+		callbackClient: deadline.NewClient("rp-callback"),
+		requestSigner:  newRequestSigner(),
+		baseURL:        defaultVerifierBaseURL,
+		packs:          newPackSet(packs),
+	}
+	if s.openapi, err = openapi.New(openapiDocument); err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
 	}
 	s.setupMiddleware()
 	s.setupRoutes()
@@ -46,34 +144,93 @@ func NewServer() *Server {
 }
 
 func (s *Server) setupMiddleware() {
+	s.router.Use(tracing.Middleware("verifier"))
+	s.router.Use(s.metrics.Middleware)
 	s.router.Use(middleware.RequestID)
+	s.router.Use(ratelimit.Peer)
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
+	s.router.Use(s.tenants.Middleware)
+	s.router.Use(s.cors.Middleware)
+	s.router.Use(s.versions.Middleware)
+	s.router.Use(s.openapi.Middleware)
 }
 
 func (s *Server) setupRoutes() {
-	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	s.router.Get("/health", s.handleHealth) // Alternative health endpoint
-	s.router.Get("/packs", s.handleListPacks)
-	s.router.Post("/presentations/verify", s.handleVerifyPresentation)
-}
+	s.router.NotFound(problem.NotFound)
+	s.router.MethodNotAllowed(problem.MethodNotAllowed)
+	// Event streams stay open until the session settles, so they are not
+	// bounded by the request budget
+	s.router.With(s.rateLimit.Middleware).Get("/verification-sessions/{sessionId}/events", s.handleSessionEvents)
 
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	log.Debug().Msg("Health check requested")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("ok")); err != nil {
-		log.Error().Err(err).Msg("Failed to write health check response")
-	}
+	s.router.Group(func(r chi.Router) {
+		r.Use(deadline.Middleware(deadline.BudgetFromEnv()))
+
+		// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
+		r.Get("/health", s.health.Health)
+		r.Get("/livez", s.health.Live)
+		r.Get("/readyz", s.health.Ready)
+		r.Handle("/debug/vars", expvar.Handler()) // Alternative health endpoint
+		r.Handle("/metrics", s.metrics.Handler())
+
+		// Public routes, limited per client
+		r.Group(func(r chi.Router) {
+			r.Use(s.rateLimit.Middleware)
+			r.Get("/packs", s.handleListPacks)
+			r.Get("/packs/{id}/presentation-definition", s.handlePresentationDefinition)
+			r.Get("/profile", s.handleGetProfile)
+			r.Get("/.well-known/jwks.json", s.handleJWKS)
+			r.Get("/openid4vp/request/{sessionId}", s.handleRequestObject)
+			r.Post("/openid4vp/response", s.handleDirectPost)
+
+			// Session state and entry points for the page showing the QR code;
+			// they reveal no result, and session IDs are unguessable
+			r.Get("/verification-sessions/{sessionId}", s.handleSessionStatus)
+			r.Get("/verification-sessions/{sessionId}/link", s.handleSessionLink)
+
+			// Relying party routes
+			r.Group(func(r chi.Router) {
+				r.Use(s.authenticateRP)
+				r.Post("/verification-sessions", s.handleCreateSession)
+				r.Get("/verification-sessions/{sessionId}/result", s.handleSessionOutcome)
+				r.Post("/presentations/verify", s.handleVerifyPresentation)
+			})
+		})
+
+		// Admin API
+		r.Route("/admin/relying-parties", func(r chi.Router) {
+			r.Use(s.requireOperator)
+			r.Get("/", s.handleListRPs)
+			r.Post("/", s.handleRegisterRP)
+			r.Get("/{id}", s.handleGetRP)
+			r.Delete("/{id}", s.handleDeleteRP)
+		})
+		r.With(s.requireOperator).Get("/admin/callbacks/dead-letters", s.handleListCallbackDeadLetters)
+		r.With(s.requireOperator).Get("/stats", s.handleStats)
+		// Lets the registry (or an operator) push a pack release instead of
+		// waiting for the next poll
+		r.With(s.requireOperator).Post("/admin/packs/refresh", s.handleRefreshPacks)
+		r.With(s.requireOperator).Get("/admin/packs/digests", s.handlePackDigests)
+	})
 }
 
 func (s *Server) handleListPacks(w http.ResponseWriter, r *http.Request) {
-	log.Info().Int("pack_count", len(s.packs)).Msg("Listing packs")
+	verifier := s.verifier(r.Context())
+	packs := s.packs.All()
+	offered := packs[:0:0]
+	for _, pack := range packs {
+		if verifier.offers(pack.ID) {
+			offered = append(offered, pack)
+		}
+	}
+	packs = offered
+	log.Info().Int("pack_count", len(packs)).Msg("Listing packs")
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(s.packs); err != nil {
+	if err := json.NewEncoder(w).Encode(packs); err != nil {
 		log.Error().Err(err).Msg("Failed to encode packs response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
@@ -82,31 +239,100 @@ func (s *Server) handleVerifyPresentation(w http.ResponseWriter, r *http.Request
 	var req VerifyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Error().Err(err).Msg("Failed to decode verify request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// The session's nonce is spent whether or not verification succeeds
+	session, err := s.sessions.Consume(req.SessionID, time.Now())
+	if err != nil {
+		log.Warn().Str("session_id", req.SessionID).Msg("Presentation without a live verification session")
+		problem.Write(w, r, http.StatusBadRequest, "invalid_session", err.Error())
+		return
+	}
+	if req.PolicyID == "" {
+		req.PolicyID = session.PolicyID
+	}
+	outcome := VerificationOutcome{SessionID: session.ID, RPID: session.RPID, Status: OutcomeFailed}
+	if !ownsSession(r.Context(), session.RPID) || !inTenant(r.Context(), session) {
+		log.Warn().Str("session_id", session.ID).Str("rp_id", rpIDFromContext(r.Context())).Msg("Presentation for another relying party's session")
+		outcome.Error, outcome.Message, outcome.CompletedAt = "invalid_session", ErrSessionInvalid.Error(), time.Now()
+		s.completeSession(session, outcome)
+		problem.Write(w, r, http.StatusBadRequest, outcome.Error, outcome.Message)
+		return
+	}
+	if req.PolicyID != session.PolicyID {
+		outcome.Error, outcome.Message, outcome.CompletedAt = "invalid_session", "policyId does not match the verification session", time.Now()
+		s.completeSession(session, outcome)
+		problem.Write(w, r, http.StatusBadRequest, outcome.Error, outcome.Message)
 		return
 	}
 
 	log.Info().
 		Str("policy_id", req.PolicyID).
+		Str("session_id", session.ID).
+		Str("rp_id", session.RPID).
+		Str("profile", s.profile.Name).
 		Msg("Verifying presentation")
 
-	// Stub implementation
-	resp := VerifyResponse{
-		Badge:      "Demo Badge (stub)",
-		Predicates: []string{"age.ge.18", "identity.verified"},
-		Freshness:  "ok",
+	resp, err := s.evaluatePresentation(r.Context(), req.Bundle, session)
+	s.recordVerification(session, err)
+	outcome.CompletedAt = time.Now()
+	if err != nil {
+		outcome.Error, outcome.Message = evaluationErrorCode(err), err.Error()
+		s.completeSession(session, outcome)
+		writeEvaluationError(w, r, err)
+		return
 	}
+	outcome.Status, outcome.Result = OutcomeVerified, &resp
+	s.completeSession(session, outcome)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Error().Err(err).Msg("Failed to encode verify response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
 
+// writeEvaluationError maps an evaluatePresentation failure to a problem;
+// untrusted issuers and profile violations say which issuer or rules
+func writeEvaluationError(w http.ResponseWriter, r *http.Request, err error) {
+	var violation *ProfileViolationError
+	var untrusted *UntrustedIssuerError
+	status := http.StatusUnprocessableEntity
+	switch {
+	case errors.Is(err, ErrTrustListUnavailable), errors.Is(err, ErrStatusUnavailable):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrReplayedPresentation):
+		status = http.StatusConflict
+	}
+	details := problem.New(status, evaluationErrorCode(err), err.Error())
+	switch {
+	case errors.As(err, &untrusted):
+		details.With("issuer", untrusted.Issuer).With("reason", untrusted.Reason)
+	case errors.As(err, &violation):
+		details.With("profile", violation.Profile).With("violations", violation.Violations)
+	}
+	details.Write(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
+
 func (s *Server) Start(addr string) error {
 	log.Info().Str("addr", addr).Msg("Server starting")
+	go s.reapExpiredSessions(time.Minute)
+	go s.runCallbackWorker(callbackWorkerInterval)
+	go s.security.Run()
+	if s.packSource != nil && s.packRefreshInterval > 0 {
+		go s.runPackRefresher(s.packRefreshInterval)
+	}
 
 	server := &http.Server{
 		Addr:         addr,
@@ -7,6 +7,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cachet-id/cachet/services/common/pkg/cors"
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -15,7 +18,7 @@ func TestNewServer(t *testing.T) {
 	server := NewServer()
 	assert.NotNil(t, server)
 	assert.NotNil(t, server.router)
-	assert.Len(t, server.packs, 2)
+	assert.Len(t, server.packs.All(), 2)
 }
 
 func TestHealthCheck(t *testing.T) {
@@ -52,10 +55,18 @@ func TestListPacks(t *testing.T) {
 
 func TestVerifyPresentation_Success(t *testing.T) {
 	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"verified": true},
+		map[string]interface{}{"age_over_18": true})
+
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
 
 	reqBody := VerifyRequest{
-		PolicyID: "test.policy",
-		Bundle:   map[string]interface{}{"test": "data"},
+		PolicyID:  "pack.safe.seller@0.1.0",
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
 	}
 
 	body, err := json.Marshal(reqBody)
@@ -74,10 +85,34 @@ func TestVerifyPresentation_Success(t *testing.T) {
 	err = json.Unmarshal(w.Body.Bytes(), &resp)
 	require.NoError(t, err)
 
-	assert.Equal(t, "Demo Badge (stub)", resp.Badge)
+	assert.Equal(t, "Safe Seller", resp.Badge.Label)
 	assert.Contains(t, resp.Predicates, "age.ge.18")
 	assert.Contains(t, resp.Predicates, "identity.verified")
 	assert.Equal(t, "ok", resp.Freshness)
+	assert.True(t, resp.KeyBound)
+}
+
+func TestVerifyPresentation_RejectsUnsignedBundle(t *testing.T) {
+	server := NewServer()
+
+	session := createSession(t, server, "test.policy")
+	body, err := json.Marshal(VerifyRequest{PolicyID: "test.policy", Bundle: map[string]interface{}{"test": "data"}, SessionID: session.ID})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "invalid_presentation", decodeProblem(t, w).Code)
+}
+
+// decodeProblem reads a problem details response
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) problem.Details {
+	t.Helper()
+	require.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+	var details problem.Details
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	return details
 }
 
 func TestVerifyPresentation_InvalidJSON(t *testing.T) {
@@ -103,3 +138,47 @@ func TestRouteNotFound(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
+
+func TestCORS(t *testing.T) {
+	server := NewServer()
+
+	req := httptest.NewRequest(http.MethodOptions, "/presentations/verify", nil)
+	req.Header.Set("Origin", "https://rp.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "cross-origin calls are refused by default")
+
+	server.cors.Set(cors.Config{AllowedOrigins: []string{"https://rp.example"}, AllowedMethods: []string{"POST"}})
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://rp.example", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "POST", w.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestRateLimit(t *testing.T) {
+	server := NewServer()
+	server.rateLimit.Set(ratelimit.NewMemory(), ratelimit.PerMinute(2), nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/packs").Code)
+	w := get("/.well-known/jwks.json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = get("/packs")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, "rate_limited", decodeProblem(t, w).Code)
+
+	// Probes, metrics and the admin API are not limited
+	w = get("/health")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/relying-parties").Code)
+}
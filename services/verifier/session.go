@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/problem"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// verificationSessionTTL bounds how long a holder has to answer a challenge
+const verificationSessionTTL = 5 * time.Minute
+
+var ErrSessionInvalid = errors.New("verification session is unknown, expired or already used")
+
+// VerificationSession is a one-shot challenge a verifier issues before
+// requesting a presentation
+type VerificationSession struct {
+	ID        string    `json:"sessionId"`
+	Nonce     string    `json:"nonce"`
+	Audience  string    `json:"audience"`
+	PolicyID  string    `json:"policyId"`
+	RPID      string    `json:"rpId,omitempty"` // relying party that created the session
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// RedirectURI is returned to same-device wallets after direct_post;
+	// CallbackURL is POSTed the outcome
+	RedirectURI string `json:"redirectUri,omitempty"`
+	CallbackURL string `json:"callbackUrl,omitempty"`
+
+	// OpenID4VP entry points for wallets answering this session
+	RequestURI           string `json:"requestUri,omitempty"`
+	AuthorizationRequest string `json:"authorizationRequest,omitempty"`
+}
+
+// VerificationOutcome is the result of a presentation delivered out of band
+// (OpenID4VP direct_post), kept for the relying party to collect
+type VerificationOutcome struct {
+	SessionID   string          `json:"sessionId"`
+	RPID        string          `json:"rpId,omitempty"`
+	Status      string          `json:"status"` // verified or failed
+	Result      *VerifyResponse `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	CompletedAt time.Time       `json:"completedAt"`
+
+	tenant string // the session's, so other tenants cannot collect it
+}
+
+type CreateSessionRequest struct {
+	PolicyID string `json:"policyId"`
+	Audience string `json:"audience,omitempty"`
+	// RedirectURI is where a same-device wallet sends the user back to once
+	// it has posted the presentation
+	RedirectURI string `json:"redirectUri,omitempty"`
+	// CallbackURL receives the signed outcome once the session completes
+	CallbackURL string `json:"callbackUrl,omitempty"`
+}
+
+// Session states, in the order a session moves through them
+const (
+	SessionPending  = "pending"  // waiting for the wallet
+	SessionReceived = "received" // presentation received, being verified
+	SessionVerified = OutcomeVerified
+	SessionFailed   = OutcomeFailed
+	SessionExpired  = "expired" // nobody answered in time
+)
+
+// SessionStatus is the public state of a verification session. It carries no
+// verification result, which only the relying party may collect.
+type SessionStatus struct {
+	SessionID string    `json:"sessionId"`
+	State     string    `json:"state"`
+	PolicyID  string    `json:"policyId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Terminal reports whether the session can no longer change state
+func (st SessionStatus) Terminal() bool {
+	return st.State == SessionVerified || st.State == SessionFailed || st.State == SessionExpired
+}
+
+// sessionStore holds outstanding challenges (production should use a shared
+// store such as Redis so any replica can consume a session)
+type sessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]VerificationSession
+	outcomes map[string]VerificationOutcome
+	statuses map[string]SessionStatus
+	watchers map[string][]chan SessionStatus
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]VerificationSession),
+		outcomes: make(map[string]VerificationOutcome),
+		statuses: make(map[string]SessionStatus),
+		watchers: make(map[string][]chan SessionStatus),
+	}
+}
+
+func newNonce() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Create starts a session with a fresh nonce on behalf of relying party rpID
+// of tenant tenantID
+func (s *sessionStore) Create(req CreateSessionRequest, tenantID, rpID string, now time.Time) (VerificationSession, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return VerificationSession{}, err
+	}
+	session := VerificationSession{
+		ID:          uuid.NewString(),
+		Nonce:       nonce,
+		Audience:    req.Audience,
+		PolicyID:    req.PolicyID,
+		RPID:        rpID,
+		Tenant:      tenantID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.ttl),
+		RedirectURI: req.RedirectURI,
+		CallbackURL: req.CallbackURL,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	s.statuses[session.ID] = SessionStatus{
+		SessionID: session.ID,
+		State:     SessionPending,
+		PolicyID:  session.PolicyID,
+		ExpiresAt: session.ExpiresAt,
+		UpdatedAt: now,
+	}
+	return session, nil
+}
+
+// transition moves a session to state and wakes its watchers. Callers hold s.mu.
+func (s *sessionStore) transition(id, state string, now time.Time) {
+	status, ok := s.statuses[id]
+	if !ok {
+		return
+	}
+	status.State, status.UpdatedAt = state, now
+	s.statuses[id] = status
+	for _, ch := range s.watchers[id] {
+		// Watchers only need the latest state, so replace any unread one
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
+
+// Status returns the current state of a session
+func (s *sessionStore) Status(id string, now time.Time) (SessionStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(id, now)
+}
+
+func (s *sessionStore) status(id string, now time.Time) (SessionStatus, bool) {
+	status, ok := s.statuses[id]
+	if ok && status.State == SessionPending && !now.Before(status.ExpiresAt) {
+		status.State, status.UpdatedAt = SessionExpired, status.ExpiresAt
+	}
+	return status, ok
+}
+
+// Watch returns the session's current state and a channel receiving later
+// state changes; stop must be called once the caller is done watching
+func (s *sessionStore) Watch(id string, now time.Time) (status SessionStatus, updates <-chan SessionStatus, stop func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok = s.status(id, now)
+	if !ok {
+		return SessionStatus{}, nil, func() {}, false
+	}
+	ch := make(chan SessionStatus, 1)
+	s.watchers[id] = append(s.watchers[id], ch)
+	stop = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		watchers := s.watchers[id]
+		for i, watcher := range watchers {
+			if watcher == ch {
+				s.watchers[id] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(s.watchers[id]) == 0 {
+			delete(s.watchers, id)
+		}
+	}
+	return status, ch, stop, true
+}
+
+// Get returns a live session without consuming it
+func (s *sessionStore) Get(id string, now time.Time) (VerificationSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || !now.Before(session.ExpiresAt) {
+		return VerificationSession{}, ErrSessionInvalid
+	}
+	return session, nil
+}
+
+// Complete records the outcome of a consumed session
+func (s *sessionStore) Complete(outcome VerificationOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes[outcome.SessionID] = outcome
+	s.transition(outcome.SessionID, outcome.Status, outcome.CompletedAt)
+}
+
+// Outcome returns the recorded outcome of a session, if any
+func (s *sessionStore) Outcome(id string) (VerificationOutcome, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outcome, ok := s.outcomes[id]
+	return outcome, ok
+}
+
+// Consume removes and returns a live session; each nonce is usable once
+func (s *sessionStore) Consume(id string, now time.Time) (VerificationSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return VerificationSession{}, ErrSessionInvalid
+	}
+	delete(s.sessions, id)
+	if !now.Before(session.ExpiresAt) {
+		return VerificationSession{}, ErrSessionInvalid
+	}
+	s.transition(id, SessionReceived, now)
+	return session, nil
+}
+
+// PurgeExpired drops sessions nobody answered, and outcomes the relying
+// party never collected
+func (s *sessionStore) PurgeExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for id, session := range s.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.sessions, id)
+			purged++
+		}
+	}
+	for id, outcome := range s.outcomes {
+		if now.Sub(outcome.CompletedAt) >= s.ttl {
+			delete(s.outcomes, id)
+		}
+	}
+	for id, status := range s.statuses {
+		if now.Sub(status.UpdatedAt) >= s.ttl && now.Sub(status.ExpiresAt) >= s.ttl {
+			delete(s.statuses, id)
+		}
+	}
+	return purged
+}
+
+func (s *Server) reapExpiredSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		if purged := s.sessions.PurgeExpired(now); purged > 0 {
+			log.Debug().Int("purged", purged).Msg("Purged expired verification sessions")
+		}
+		s.replays.PurgeExpired(now)
+		s.results.PurgeExpired(now)
+	}
+}
+
+// withEntryPoints fills in the OpenID4VP request_uri and the authorization
+// request wallets open, as a same-device deep link or a cross-device QR code
+func (s *Server) withEntryPoints(session VerificationSession) VerificationSession {
+	session.RequestURI = s.tenantURL(session.Tenant) + "/openid4vp/request/" + session.ID
+	session.AuthorizationRequest = openID4VPScheme + "?" + url.Values{
+		"client_id":   {session.Audience},
+		"request_uri": {session.RequestURI},
+	}.Encode()
+	return session
+}
+
+// validRPURL accepts https URLs, and http ones on loopback for development
+func validRPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req CreateSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to decode verification session request")
+		problem.Error(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.PolicyID == "" {
+		problem.Error(w, r, "policyId is required", http.StatusBadRequest)
+		return
+	}
+	if !s.verifier(r.Context()).offers(req.PolicyID) {
+		problem.Write(w, r, http.StatusBadRequest, "unsupported_pack", "This tenant does not offer pack "+req.PolicyID)
+		return
+	}
+	// Wallets bind presentations to the client_id a certified key
+	// authenticates, so sessions of such a tenant have it as their audience
+	clientID := s.verifier(r.Context()).signer.clientID
+	switch {
+	case req.Audience == "" && clientID != "":
+		req.Audience = clientID
+	case req.Audience == "":
+		req.Audience = s.audience
+	case clientID != "" && req.Audience != clientID:
+		problem.Error(w, r, "audience must be the verifier's client_id, "+clientID, http.StatusBadRequest)
+		return
+	}
+	if req.RedirectURI != "" && !validRPURL(req.RedirectURI) {
+		problem.Error(w, r, "redirectUri must be an absolute https URL", http.StatusBadRequest)
+		return
+	}
+	if req.CallbackURL != "" {
+		if !validRPURL(req.CallbackURL) {
+			problem.Error(w, r, "callbackUrl must be an absolute https URL", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.callbackSecret(rpIDFromContext(r.Context())); !ok {
+			problem.Error(w, r, "callbackUrl needs a relying party API key or a configured signing secret", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session, err := s.sessions.Create(req, tenant.FromContext(r.Context()).ID, rpIDFromContext(r.Context()), time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create verification session")
+		problem.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	session = s.withEntryPoints(session)
+
+	log.Info().
+		Str("session_id", session.ID).
+		Str("policy_id", session.PolicyID).
+		Str("rp_id", session.RPID).
+		Str("tenant", session.Tenant).
+		Msg("Verification session created")
+	if session.RPID != "" {
+		s.relyingParties.Record(session.RPID, usageSession)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		log.Error().Err(err).Msg("Failed to encode verification session")
+	}
+}
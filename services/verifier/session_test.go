@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createSession(t testing.TB, server *Server, policyID string) VerificationSession {
+	t.Helper()
+	body, err := json.Marshal(CreateSessionRequest{PolicyID: policyID})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	return session
+}
+
+func TestCreateSession(t *testing.T) {
+	server := NewServer()
+
+	first := createSession(t, server, "pack.safe.seller@0.1.0")
+	second := createSession(t, server, "pack.safe.seller@0.1.0")
+	assert.NotEqual(t, first.Nonce, second.Nonce)
+	assert.Equal(t, defaultVerifierAudience, first.Audience)
+	assert.WithinDuration(t, time.Now().Add(verificationSessionTTL), first.ExpiresAt, time.Second)
+
+	req := httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader([]byte(`{}`)))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestVerifyPresentation_NonceIsSingleUse(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	presentation := issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder)
+
+	w := verifyWithProfile(t, server, session, presentation)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = verifyWithProfile(t, server, session, presentation)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_session")
+}
+
+func TestVerifyPresentation_RequiresLiveSession(t *testing.T) {
+	server := NewServer()
+
+	w := verifyWithProfile(t, server, VerificationSession{PolicyID: "pack.safe.seller@0.1.0"}, "a.b.c~")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	w = verifyWithProfile(t, server, VerificationSession{ID: session.ID, PolicyID: "pack.childcare.readiness@0.1.0"}, "a.b.c~")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "policy must match the session")
+
+	expired, err := server.sessions.Create(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", Audience: defaultVerifierAudience}, tenant.DefaultID, "", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	_, err = server.sessions.Consume(expired.ID, time.Now())
+	assert.ErrorIs(t, err, ErrSessionInvalid)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// StatusList2021 revocation and suspension checking
+const (
+	statusEntryType       = "StatusList2021Entry"
+	statusPurposeSuspend  = "suspension"
+	defaultStatusCacheTTL = 5 * time.Minute
+	maxStatusListSize     = 1 << 20
+)
+
+// Freshness values reported in VerifyResponse
+const (
+	FreshnessOK        = "ok"
+	FreshnessSuspended = "suspended"
+	FreshnessUnknown   = "unknown" // status host unreachable and failing open
+)
+
+var (
+	ErrCredentialRevoked = errors.New("credential has been revoked")
+	// ErrStatusUnavailable is returned when failing closed on an unreachable status list
+	ErrStatusUnavailable = errors.New("credential status could not be checked")
+)
+
+// StatusEntry is a credentialStatus entry of the StatusList2021 kind
+type StatusEntry struct {
+	ID                   string `json:"id"`
+	Type                 string `json:"type"`
+	StatusPurpose        string `json:"statusPurpose"`
+	StatusListIndex      string `json:"statusListIndex"`
+	StatusListCredential string `json:"statusListCredential"`
+}
+
+// statusList is a decoded status list bitstring
+type statusList struct {
+	issuer    string
+	purpose   string
+	bits      []byte
+	fetchedAt time.Time
+	// version is a digest of the bits, which changes with any revocation
+	version string
+}
+
+// set reports whether the bit at index is set; index 0 is the most
+// significant bit of the first byte
+func (l statusList) set(index int) (bool, error) {
+	if index < 0 || index/8 >= len(l.bits) {
+		return false, fmt.Errorf("status list index %d is out of range", index)
+	}
+	return l.bits[index/8]&(0x80>>(index%8)) != 0, nil
+}
+
+// statusChecker fetches status list credentials and caches them in memory
+// for ttl. With failOpen, an unreachable status host degrades Freshness to
+// unknown instead of failing the verification.
+type statusChecker struct {
+	client   *http.Client
+	ttl      time.Duration
+	failOpen bool
+
+	mu    sync.Mutex
+	cache map[string]statusList // by status list credential URL
+}
+
+func newStatusChecker() *statusChecker {
+	return &statusChecker{
+		client: deadline.NewClient("status-list"),
+		ttl:    defaultStatusCacheTTL,
+		cache:  make(map[string]statusList),
+	}
+}
+
+// credentialStatusEntries reads credentialStatus, which may be a single entry
+// or a list (e.g. one for revocation and one for suspension)
+func credentialStatusEntries(claims map[string]interface{}) ([]StatusEntry, error) {
+	raw, ok := claims["credentialStatus"]
+	if !ok {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, isList := raw.([]interface{}); isList {
+		var entries []StatusEntry
+		err = json.Unmarshal(encoded, &entries)
+		return entries, err
+	}
+	var entry StatusEntry
+	err = json.Unmarshal(encoded, &entry)
+	return []StatusEntry{entry}, err
+}
+
+// Check looks up every status entry of the credential and returns the
+// resulting Freshness, or an error when the credential must be rejected.
+// JWT-secured status lists are verified with the issuer's keys.
+func (c *statusChecker) Check(ctx context.Context, keys IssuerKeyResolver, verified VerifiedSDJWT, now time.Time) (string, error) {
+	entries, err := credentialStatusEntries(verified.Claims)
+	if err != nil {
+		return "", invalidf("malformed credentialStatus: %v", err)
+	}
+
+	freshness := FreshnessOK
+	for _, entry := range entries {
+		if entry.Type != statusEntryType {
+			return "", invalidf("unsupported credentialStatus type %q", entry.Type)
+		}
+		index, err := strconv.Atoi(entry.StatusListIndex)
+		if err != nil {
+			return "", invalidf("statusListIndex %q is not a number", entry.StatusListIndex)
+		}
+
+		list, err := c.list(ctx, keys, entry.StatusListCredential, now)
+		if err != nil {
+			log.Warn().Err(err).Str("status_list", entry.StatusListCredential).Bool("fail_open", c.failOpen).Msg("Status list unavailable")
+			if c.failOpen {
+				freshness = FreshnessUnknown
+				continue
+			}
+			return "", fmt.Errorf("%w: %v", ErrStatusUnavailable, err)
+		}
+		if list.issuer != verified.Issuer {
+			return "", invalidf("status list %s is not issued by %s", entry.StatusListCredential, verified.Issuer)
+		}
+		if list.purpose != "" && entry.StatusPurpose != "" && list.purpose != entry.StatusPurpose {
+			return "", invalidf("status list purpose %q does not match entry purpose %q", list.purpose, entry.StatusPurpose)
+		}
+		set, err := list.set(index)
+		if err != nil {
+			return "", invalidf("%v", err)
+		}
+		if !set {
+			continue
+		}
+		if entry.StatusPurpose == statusPurposeSuspend {
+			freshness = FreshnessSuspended
+			continue
+		}
+		return "", ErrCredentialRevoked
+	}
+	return freshness, nil
+}
+
+// list returns the decoded status list at url, fetching it when the cached
+// copy is older than the TTL
+func (c *statusChecker) list(ctx context.Context, keys IssuerKeyResolver, url string, now time.Time) (statusList, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[url]
+	c.mu.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < c.ttl {
+		return cached, nil
+	}
+
+	list, err := c.fetch(ctx, keys, url)
+	if err != nil {
+		return statusList{}, err
+	}
+	list.fetchedAt = now
+
+	c.mu.Lock()
+	c.cache[url] = list
+	c.mu.Unlock()
+	return list, nil
+}
+
+// versions reports the versions of the cached status lists at urls, or
+// false when one of them is missing or due to be fetched again
+func (c *statusChecker) versions(urls []string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := make([]string, len(urls))
+	for i, url := range urls {
+		cached, ok := c.cache[url]
+		if !ok || now.Sub(cached.fetchedAt) >= c.ttl {
+			return "", false
+		}
+		versions[i] = cached.version
+	}
+	return strings.Join(versions, ","), true
+}
+
+// evict drops the cached status lists at urls, so the next check fetches
+// them again
+func (c *statusChecker) evict(urls []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, url := range urls {
+		delete(c.cache, url)
+	}
+}
+
+// statusListCredential is the part of a StatusList2021Credential we read
+type statusListCredential struct {
+	Issuer            json.RawMessage `json:"issuer"`
+	CredentialSubject struct {
+		Type          string `json:"type"`
+		StatusPurpose string `json:"statusPurpose"`
+		EncodedList   string `json:"encodedList"`
+	} `json:"credentialSubject"`
+}
+
+func (c *statusChecker) fetch(ctx context.Context, keys IssuerKeyResolver, url string) (statusList, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return statusList{}, fmt.Errorf("unsupported status list URL %q", url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return statusList{}, err
+	}
+	req.Header.Set("Accept", "application/vc+jwt, application/vc+ld+json, application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return statusList{}, fmt.Errorf("fetching status list: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusList{}, fmt.Errorf("fetching status list: status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusListSize))
+	if err != nil {
+		return statusList{}, fmt.Errorf("reading status list: %w", err)
+	}
+
+	credential, err := decodeStatusListCredential(ctx, keys, bytes.TrimSpace(body))
+	if err != nil {
+		return statusList{}, err
+	}
+	if credential.CredentialSubject.Type != "StatusList2021" {
+		return statusList{}, fmt.Errorf("status list credential subject has type %q", credential.CredentialSubject.Type)
+	}
+	bits, err := decodeStatusBitstring(credential.CredentialSubject.EncodedList)
+	if err != nil {
+		return statusList{}, err
+	}
+	version := sha256.Sum256(bits)
+	return statusList{
+		issuer:  credentialIssuer(credential.Issuer),
+		purpose: credential.CredentialSubject.StatusPurpose,
+		bits:    bits,
+		version: hex.EncodeToString(version[:]),
+	}, nil
+}
+
+// decodeStatusListCredential accepts a status list credential secured as a JWT, whose
+// signature is checked against the issuer's keys, or as plain JSON
+func decodeStatusListCredential(ctx context.Context, keys IssuerKeyResolver, body []byte) (statusListCredential, error) {
+	var credential statusListCredential
+	if len(body) > 0 && body[0] == '{' {
+		// Data Integrity proofs are not checked; issuers should serve the JWT form
+		if err := json.Unmarshal(body, &credential); err != nil {
+			return credential, fmt.Errorf("decoding status list credential: %w", err)
+		}
+		return credential, nil
+	}
+
+	token, err := jwt.Parse(string(body), func(token *jwt.Token) (interface{}, error) {
+		issuer, _ := token.Claims.(jwt.MapClaims)["iss"].(string)
+		if issuer == "" {
+			return nil, errors.New("status list JWT has no iss claim")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.ResolveKey(ctx, issuer, kid)
+	}, jwt.WithValidMethods(issuerSigningMethods), jwt.WithLeeway(issuerClockSkew))
+	if err != nil {
+		return credential, fmt.Errorf("status list signature: %w", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	vc, ok := claims["vc"]
+	if !ok {
+		return credential, errors.New("status list JWT has no vc claim")
+	}
+	encoded, err := json.Marshal(vc)
+	if err != nil {
+		return credential, err
+	}
+	if err := json.Unmarshal(encoded, &credential); err != nil {
+		return credential, fmt.Errorf("decoding status list credential: %w", err)
+	}
+	// The signed iss is authoritative over whatever the vc claim says
+	credential.Issuer, _ = json.Marshal(claims["iss"])
+	return credential, nil
+}
+
+// credentialIssuer reads a VC issuer given as a string or as {"id": ...}
+func credentialIssuer(raw json.RawMessage) string {
+	var issuer string
+	if err := json.Unmarshal(raw, &issuer); err == nil {
+		return issuer
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(raw, &object)
+	return object.ID
+}
+
+// decodeStatusBitstring decodes a base64url, GZIP-compressed bitstring
+func decodeStatusBitstring(encoded string) ([]byte, error) {
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("status list encodedList is not base64url: %w", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("status list encodedList is not gzip: %w", err)
+	}
+	defer reader.Close()
+	bits, err := io.ReadAll(io.LimitReader(reader, maxStatusListSize))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing status list: %w", err)
+	}
+	return bits, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeStatusList gzips and base64url-encodes a 16 KiB bitstring with the
+// given indexes set
+func encodeStatusList(t *testing.T, set ...int) string {
+	t.Helper()
+	bits := make([]byte, 16*1024)
+	for _, index := range set {
+		bits[index/8] |= 0x80 >> (index % 8)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(bits)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// statusListHost serves a JWT-secured StatusList2021Credential signed by issuer
+func statusListHost(t *testing.T, issuer *testIssuer, purpose string, set ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var fetches int32
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": testIssuerDID,
+		"iat": time.Now().Unix(),
+		"vc": map[string]interface{}{
+			"type":   []string{"VerifiableCredential", "StatusList2021Credential"},
+			"issuer": testIssuerDID,
+			"credentialSubject": map[string]interface{}{
+				"type":          "StatusList2021",
+				"statusPurpose": purpose,
+				"encodedList":   encodeStatusList(t, set...),
+			},
+		},
+	})
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(issuer.key)
+	require.NoError(t, err)
+
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/vc+jwt")
+		_, _ = w.Write([]byte(signed))
+	}))
+	t.Cleanup(host.Close)
+	return host, &fetches
+}
+
+func statusEntry(listURL, purpose string, index int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                   listURL + "#" + strconv.Itoa(index),
+		"type":                 statusEntryType,
+		"statusPurpose":        purpose,
+		"statusListIndex":      strconv.Itoa(index),
+		"statusListCredential": listURL,
+	}
+}
+
+// verifyWithStatus runs a presentation carrying credentialStatus through
+// POST /presentations/verify
+func verifyWithStatus(t *testing.T, server *Server, issuer *testIssuer, status interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	issuerJWT, disclosures := issuer.issue(t,
+		map[string]interface{}{"credentialStatus": status},
+		map[string]interface{}{"age_over_18": true})
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	body, err := json.Marshal(VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestStatusList_ActiveCredential(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	host, fetches := statusListHost(t, issuer, "revocation", 7)
+
+	for i := 0; i < 2; i++ {
+		w := verifyWithStatus(t, server, issuer, statusEntry(host.URL, "revocation", 6))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp VerifyResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, FreshnessOK, resp.Freshness)
+	}
+	// The second verification is served from the cache
+	assert.EqualValues(t, 1, atomic.LoadInt32(fetches))
+}
+
+func TestStatusList_RevokedCredential(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	host, _ := statusListHost(t, issuer, "revocation", 42)
+
+	w := verifyWithStatus(t, server, issuer, statusEntry(host.URL, "revocation", 42))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"credential_revoked"`)
+}
+
+func TestStatusList_SuspendedCredential(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	revocations, _ := statusListHost(t, issuer, "revocation")
+	suspensions, _ := statusListHost(t, issuer, "suspension", 3)
+
+	w := verifyWithStatus(t, server, issuer, []interface{}{
+		statusEntry(revocations.URL, "revocation", 3),
+		statusEntry(suspensions.URL, "suspension", 3),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, FreshnessSuspended, resp.Freshness)
+	assert.False(t, resp.Satisfied)
+	require.Len(t, resp.Credentials, 1)
+	assert.Equal(t, FreshnessSuspended, resp.Credentials[0].Freshness)
+}
+
+func TestStatusList_ForeignIssuerRejected(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":            "did:web:elsewhere.example",
+			"credentialSubject": map[string]interface{}{"type": "StatusList2021", "encodedList": encodeStatusList(t)},
+		})
+	}))
+	defer host.Close()
+
+	w := verifyWithStatus(t, server, issuer, statusEntry(host.URL, "revocation", 1))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "not issued by")
+}
+
+func TestStatusList_UnreachableHost(t *testing.T) {
+	issuer := newTestIssuer(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	entry := statusEntry(down.URL, "revocation", 1)
+
+	// Fail closed by default
+	server := NewServer()
+	issuer.trustedBy(server)
+	w := verifyWithStatus(t, server, issuer, entry)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"status_unavailable"`)
+
+	server = NewServer()
+	issuer.trustedBy(server)
+	server.status.failOpen = true
+	w = verifyWithStatus(t, server, issuer, entry)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, FreshnessUnknown, resp.Freshness)
+}
+
+func TestStatusList_BitOrder(t *testing.T) {
+	list := statusList{bits: []byte{0x80, 0x01}}
+	for index, want := range map[int]bool{0: true, 1: false, 7: false, 15: true} {
+		got, err := list.set(index)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "index %d", index)
+	}
+	_, err := list.set(16)
+	assert.Error(t, err)
+}
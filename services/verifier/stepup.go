@@ -0,0 +1,135 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Step-up actions that meet an unmet pack rule
+const (
+	// StepUpDisclose asks the wallet to disclose claims of a credential it
+	// already presented
+	StepUpDisclose = "disclose"
+	// StepUpPresent asks the wallet for another credential
+	StepUpPresent = "present"
+)
+
+// StepUp tells the wallet what else a presentation that fell short of the
+// pack needs, so it can guide the holder rather than fail
+type StepUp struct {
+	PolicyID string `json:"policyId"`
+	// Satisfied lists the pack rules the presentation already meets
+	Satisfied []string `json:"satisfied"`
+	// Requirements lists each required rule it does not, with what meets it
+	Requirements []StepUpRequirement `json:"requirements"`
+}
+
+// StepUpRequirement is an unmet required rule and how to meet it
+type StepUpRequirement struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// Claims are the claims to disclose, or to present a credential with
+	Claims []string `json:"claims,omitempty"`
+	// Credential is the index of the presented credential to disclose from
+	Credential *int `json:"credential,omitempty"`
+	// What another credential must be to meet the rule, as the pack accepts
+	CredentialTypes []string `json:"credentialTypes,omitempty"`
+	IssuersAccepted []string `json:"issuersAccepted,omitempty"`
+	ProofType       string   `json:"proofType,omitempty"`
+}
+
+// stepUpFor lists what the presentation needs to meet the pack's required
+// rules; nil when it meets them all
+func stepUpFor(pack Pack, credentials []bundleCredential, results []PredicateResult) *StepUp {
+	predicates := make(map[string]PackPredicate, len(pack.Predicates))
+	for _, predicate := range pack.Predicates {
+		predicates[predicate.ID] = predicate
+	}
+	matches := make(map[string]MatchRule, len(pack.Match))
+	for _, match := range pack.Match {
+		matches[match.ID] = match
+	}
+
+	stepUp := &StepUp{PolicyID: pack.ID, Satisfied: []string{}}
+	for _, result := range results {
+		switch {
+		case result.Passed:
+			stepUp.Satisfied = append(stepUp.Satisfied, result.ID)
+		case !result.Required:
+			// Optional rules are never needed
+		case matches[result.ID].ID != "":
+			stepUp.Requirements = append(stepUp.Requirements, matchStepUp(matches[result.ID], result))
+		default:
+			predicate, known := predicates[result.ID]
+			stepUp.Requirements = append(stepUp.Requirements, ruleStepUp(predicate, known, credentials, result))
+		}
+	}
+	if len(stepUp.Requirements) == 0 {
+		return nil
+	}
+	sort.Strings(stepUp.Satisfied)
+	return stepUp
+}
+
+// ruleStepUp meets a failed rule. A claim withheld by a presented
+// credential of a kind the rule accepts is disclosed from it; otherwise
+// another credential is needed, as is one whose disclosed value falls short.
+// Rules the pack gives only as expressions say no more than the claim they
+// miss.
+func ruleStepUp(predicate PackPredicate, known bool, credentials []bundleCredential, result PredicateResult) StepUpRequirement {
+	requirement := StepUpRequirement{Rule: result.ID, Action: StepUpPresent, Reason: result.Reason}
+	withheld := strings.TrimSuffix(result.Reason, " is not disclosed")
+	isWithheld := withheld != result.Reason
+	if !known {
+		if isWithheld {
+			requirement.Action = StepUpDisclose
+			requirement.Claims = []string{withheld}
+		}
+		return requirement
+	}
+
+	requirement.Claims = []string{predicate.Claim}
+	requirement.CredentialTypes = predicate.CredentialTypes
+	requirement.IssuersAccepted = predicate.IssuersAccepted
+	requirement.ProofType = predicate.ProofType
+	if !isWithheld {
+		return requirement
+	}
+	for i, credential := range credentials {
+		if predicate.accepts(credential) {
+			index := i
+			requirement.Action = StepUpDisclose
+			requirement.Credential = &index
+			break
+		}
+	}
+	return requirement
+}
+
+// matchStepUp meets a failed match rule: claims disclosed by too few
+// credentials can be disclosed; claims that differ need credentials that
+// agree
+func matchStepUp(match MatchRule, result PredicateResult) StepUpRequirement {
+	action := StepUpPresent
+	if strings.Contains(result.Reason, " is disclosed by ") {
+		action = StepUpDisclose
+	}
+	return StepUpRequirement{Rule: match.ID, Action: action, Reason: result.Reason, Claims: match.Claims}
+}
+
+// accepts reports whether a presented credential is of a type, and from an
+// issuer, the predicate accepts
+func (p PackPredicate) accepts(credential bundleCredential) bool {
+	if len(p.CredentialTypes) > 0 {
+		types := regexp.MustCompile("(^|/)(" + strings.Join(p.CredentialTypes, "|") + ")$")
+		if !types.MatchString(credential.envelope.CredentialType) {
+			return false
+		}
+	}
+	if len(p.IssuersAccepted) > 0 {
+		return regexp.MustCompile(issuerPattern(p.IssuersAccepted)).MatchString(credential.verified.Issuer)
+	}
+	return true
+}
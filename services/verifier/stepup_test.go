@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepUpFor(t *testing.T) {
+	pack := Pack{
+		ID:    "pack.childcare.readiness@0.1.0",
+		Match: []MatchRule{{ID: "holder.consistent", Claims: []string{"family_name"}}},
+		Predicates: []PackPredicate{
+			{ID: "age.ge.18", Claim: "age", Operator: ">=", Value: 18, IssuersAccepted: []string{"did:web:cachet.id"}, CredentialTypes: []string{"IdentityCredential"}, ProofType: ProofTypeSDJWT},
+			{ID: "criminal.clear", Claim: "criminal_record_clear", Operator: "boolean", Value: true, IssuersAccepted: []string{"did:checks:*-eu"}, ProofType: ProofTypeBBS},
+			{ID: "references.verified", Claim: "references_count", Operator: ">=", Value: 2, IssuersAccepted: []string{"did:cachet:vouch"}, ProofType: ProofTypeZK},
+			{ID: "firstaid.valid", Claim: "first_aid_cert_valid", Operator: "boolean", Value: true, Required: optional()},
+		},
+	}
+	credentials := []bundleCredential{
+		{envelope: PresentationEnvelope{CredentialType: "https://cachet.id/IdentityCredential"}, verified: VerifiedSDJWT{Issuer: "did:web:cachet.id"}},
+		{envelope: PresentationEnvelope{CredentialType: "https://vouch.example/references"}, verified: VerifiedSDJWT{Issuer: "did:cachet:vouch"}},
+	}
+	results := []PredicateResult{
+		{ID: "age.ge.18", Required: true, Reason: "age is not disclosed"},
+		{ID: "criminal.clear", Required: true, Reason: "criminal_record_clear is not disclosed"},
+		{ID: "references.verified", Required: true, Reason: "references_count is 1, at least 2 required"},
+		{ID: "firstaid.valid", Reason: "first_aid_cert_valid is not disclosed"},
+		{ID: "holder.consistent", Required: true, Reason: "family_name is disclosed by 1 of 2 credentials, at least 2 needed"},
+		{ID: "registry.rule", Required: true, Reason: "nationality is not disclosed"},
+		{ID: "identity.verified", Required: true, Passed: true},
+	}
+
+	stepUp := stepUpFor(pack, credentials, results)
+	require.NotNil(t, stepUp)
+	assert.Equal(t, pack.ID, stepUp.PolicyID)
+	assert.Equal(t, []string{"identity.verified"}, stepUp.Satisfied)
+	require.Len(t, stepUp.Requirements, 5, "optional rules are never asked for")
+
+	// The identity credential withheld the age it could disclose
+	age := stepUp.Requirements[0]
+	assert.Equal(t, StepUpDisclose, age.Action)
+	assert.Equal(t, []string{"age"}, age.Claims)
+	require.NotNil(t, age.Credential)
+	assert.Equal(t, 0, *age.Credential)
+
+	// No background check was presented
+	criminal := stepUp.Requirements[1]
+	assert.Equal(t, StepUpPresent, criminal.Action)
+	assert.Nil(t, criminal.Credential)
+	assert.Equal(t, []string{"did:checks:*-eu"}, criminal.IssuersAccepted)
+	assert.Equal(t, ProofTypeBBS, criminal.ProofType)
+
+	// Disclosing a value that falls short does not help
+	assert.Equal(t, StepUpPresent, stepUp.Requirements[2].Action)
+	assert.Equal(t, []string{"did:cachet:vouch"}, stepUp.Requirements[2].IssuersAccepted)
+
+	assert.Equal(t, StepUpRequirement{
+		Rule: "holder.consistent", Action: StepUpDisclose, Reason: results[4].Reason, Claims: []string{"family_name"},
+	}, stepUp.Requirements[3])
+	assert.Equal(t, StepUpRequirement{
+		Rule: "registry.rule", Action: StepUpDisclose, Reason: results[5].Reason, Claims: []string{"nationality"},
+	}, stepUp.Requirements[4])
+
+	assert.Nil(t, stepUpFor(pack, credentials, []PredicateResult{{ID: "age.ge.18", Required: true, Passed: true}, results[3]}))
+}
+
+func TestVerifyPresentation_StepUp(t *testing.T) {
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server, "https://cachet.id/identity")
+	session := createSession(t, server, "pack.childcare.readiness@0.1.0")
+
+	// The identity credential alone falls short of the background check
+	identityJWT, identityDisclosures := issuer.issue(t, nil, map[string]interface{}{
+		"given_name": "Ada", "family_name": "Lovelace", "age": 36, "identity_liveness": true,
+	})
+	w := verifyWithProfile(t, server, session, []interface{}{
+		issuer.present(t, identityJWT, identityDisclosures, session.Nonce, session.Audience, issuer.holder),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp VerifyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Satisfied)
+	require.NotNil(t, resp.StepUp)
+	assert.ElementsMatch(t, []string{"age.ge.18", "holder.consistent", "identity.verified"}, resp.StepUp.Satisfied)
+	var rules []string
+	for _, requirement := range resp.StepUp.Requirements {
+		rules = append(rules, requirement.Rule)
+		assert.Equal(t, StepUpPresent, requirement.Action)
+		assert.NotEmpty(t, requirement.IssuersAccepted)
+	}
+	assert.ElementsMatch(t, []string{"criminal.clear", "references.verified"}, rules)
+}
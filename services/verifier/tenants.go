@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/rs/zerolog/log"
+)
+
+// tenantSettings is the verifier's section of a tenant in TENANTS_CONFIG
+type tenantSettings struct {
+	Verifier struct {
+		// Packs the tenant's relying parties may verify against, by id with
+		// or without its @version; all of them without
+		Packs []string `yaml:"packs"`
+		// SigningKey is a PEM file holding the tenant's P-256 key for request
+		// objects and badges; a key is generated at startup without one
+		SigningKey string `yaml:"signingKey"`
+		// Certificate is a PEM file holding the X.509 chain of SigningKey,
+		// leaf first, so request objects use the x509_san_dns scheme
+		Certificate string `yaml:"certificate"`
+	} `yaml:"verifier"`
+}
+
+// tenantVerifier is the verifier a tenant presents to wallets and relying
+// parties: the key its request objects and badges are signed with and the
+// packs it offers
+type tenantVerifier struct {
+	signer *requestSigner
+	packs  map[string]bool // nil offers every pack
+}
+
+// offers reports whether the tenant verifies against a pack, listed either
+// by its full id or by the id without the version
+func (v *tenantVerifier) offers(packID string) bool {
+	if v.packs == nil || v.packs[packID] {
+		return true
+	}
+	name, _, _ := strings.Cut(packID, "@")
+	return v.packs[name]
+}
+
+// verifier returns the verifier of the tenant a request belongs to
+func (s *Server) verifier(ctx context.Context) *tenantVerifier {
+	return s.verifierOf(tenant.FromContext(ctx).ID)
+}
+
+// verifierOf returns the verifier of a tenant, the service's own for the
+// default tenant and tenants the verifier has no settings for
+func (s *Server) verifierOf(tenantID string) *tenantVerifier {
+	if v, ok := s.verifiers[tenantID]; ok {
+		return v
+	}
+	return &tenantVerifier{signer: s.requestSigner}
+}
+
+// tenantURL is the base URL wallets reach a tenant's endpoints under, in
+// the current API version
+func (s *Server) tenantURL(tenantID string) string {
+	if tenantID == "" || tenantID == tenant.DefaultID {
+		return s.baseURL + apiversion.Path("")
+	}
+	return s.baseURL + tenant.PathPrefix + tenantID + apiversion.Path("")
+}
+
+// inTenant reports whether a session belongs to the request's tenant
+func inTenant(ctx context.Context, session VerificationSession) bool {
+	return sessionTenant(session) == tenant.FromContext(ctx).ID
+}
+
+// sessionTenant is the tenant a session was created for
+func sessionTenant(session VerificationSession) string {
+	if session.Tenant == "" {
+		return tenant.DefaultID
+	}
+	return session.Tenant
+}
+
+// setTenants serves the tenants of TENANTS_CONFIG, each with its own
+// signing key and packs
+func (s *Server) setTenants(entries []tenant.Entry[tenantSettings]) error {
+	verifiers := make(map[string]*tenantVerifier, len(entries))
+	for _, entry := range entries {
+		settings := entry.Settings.Verifier
+		v := &tenantVerifier{signer: s.requestSigner}
+		switch {
+		case settings.SigningKey != "":
+			key, err := signing.LoadKey(settings.SigningKey)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %w", entry.ID, err)
+			}
+			if v.signer, err = newRequestSignerWithKey(key); err != nil {
+				return fmt.Errorf("tenant %s: %w", entry.ID, err)
+			}
+			if settings.Certificate != "" {
+				if err := s.certifySigner(v.signer, settings.Certificate); err != nil {
+					return fmt.Errorf("tenant %s: %w", entry.ID, err)
+				}
+			}
+		case settings.Certificate != "":
+			return fmt.Errorf("tenant %s: verifier.certificate needs verifier.signingKey", entry.ID)
+		case entry.ID != tenant.DefaultID:
+			// Badges of one tenant must never verify under another's key
+			log.Warn().Str("tenant", entry.ID).Msg("Tenant has no verifier.signingKey, so its badges do not verify after restarts")
+			v.signer = newRequestSigner()
+		}
+		if len(settings.Packs) > 0 {
+			v.packs = map[string]bool{}
+			for _, id := range settings.Packs {
+				v.packs[id] = true
+			}
+		}
+		verifiers[entry.ID] = v
+	}
+	if err := s.tenants.Set(tenant.Tenants(entries)); err != nil {
+		return err
+	}
+	s.verifiers = verifiers
+	return nil
+}
+
+// certifySigner attaches the certificate chain in the PEM file at path to
+// signer, for the verifier's public hostname
+func (s *Server) certifySigner(signer *requestSigner, path string) error {
+	chain, err := loadCertificateChain(path)
+	if err != nil {
+		return err
+	}
+	base, err := url.Parse(s.baseURL)
+	if err != nil {
+		return fmt.Errorf("parsing the verifier's base URL: %w", err)
+	}
+	return signer.certify(chain, base.Hostname())
+}
+
+// loadCertificateChain reads PEM-encoded certificates, leaf first
+func loadCertificateChain(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate chain: %w", err)
+	}
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate chain: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return chain, nil
+}
+
+// checkProfile reports the tenants whose request objects wallets would
+// refuse under the compliance profile
+func (s *Server) checkProfile() error {
+	if err := s.profile.CheckSigner(s.requestSigner); err != nil {
+		return err
+	}
+	for id, v := range s.verifiers {
+		if err := s.profile.CheckSigner(v.signer); err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	return nil
+}
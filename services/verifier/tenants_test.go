@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTenantServer serves the default tenant and acme, which verifies against
+// the safe seller pack only
+func newTenantServer(t *testing.T) *Server {
+	t.Helper()
+	server := newRPServer(t)
+	acme := tenant.Entry[tenantSettings]{Tenant: tenant.Tenant{ID: "acme"}}
+	acme.Settings.Verifier.Packs = []string{"pack.safe.seller"}
+	require.NoError(t, server.setTenants([]tenant.Entry[tenantSettings]{acme}))
+	return server
+}
+
+// jwksKeyID returns the key ID a tenant publishes
+func jwksKeyID(t *testing.T, server *Server, path string) string {
+	t.Helper()
+	w := rpRequest(t, server, http.MethodGet, path, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	return jwks.Keys[0]["kid"]
+}
+
+func TestTenants_PacksAndKeys(t *testing.T) {
+	server := newTenantServer(t)
+
+	var packs []Pack
+	w := rpRequest(t, server, http.MethodGet, "/t/acme/packs", "", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &packs))
+	require.Len(t, packs, 1)
+	assert.Equal(t, "pack.safe.seller@0.1.0", packs[0].ID)
+	w = rpRequest(t, server, http.MethodGet, "/packs", "", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &packs))
+	assert.Greater(t, len(packs), 1, "the default tenant offers every pack")
+	assert.Equal(t, http.StatusNotFound, rpRequest(t, server, http.MethodGet, "/t/acme/packs/pack.childcare.readiness@0.1.0/presentation-definition", "", nil).Code)
+
+	acmeKey := jwksKeyID(t, server, "/t/acme/.well-known/jwks.json")
+	assert.NotEqual(t, jwksKeyID(t, server, "/.well-known/jwks.json"), acmeKey, "tenants sign with their own keys")
+
+	server.requireRPAuth = false
+	w = rpRequest(t, server, http.MethodPost, "/t/acme/verification-sessions", "", CreateSessionRequest{PolicyID: "pack.childcare.readiness@0.1.0"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "unsupported_pack", decodeProblem(t, w).Code)
+
+	w = rpRequest(t, server, http.MethodPost, "/t/acme/verification-sessions", "", CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "acme", session.Tenant)
+	assert.Equal(t, defaultVerifierBaseURL+"/t/acme/v1/openid4vp/request/"+session.ID, session.RequestURI)
+
+	// The request object is only served, and signed, as acme
+	assert.Equal(t, http.StatusNotFound, rpRequest(t, server, http.MethodGet, "/openid4vp/request/"+session.ID, "", nil).Code)
+	w = rpRequest(t, server, http.MethodGet, "/t/acme/v1/openid4vp/request/"+session.ID, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	rawHeader, _, _ := strings.Cut(w.Body.String(), ".")
+	decoded, err := base64.RawURLEncoding.DecodeString(rawHeader)
+	require.NoError(t, err)
+	var header map[string]string
+	require.NoError(t, json.Unmarshal(decoded, &header))
+	assert.Equal(t, acmeKey, header["kid"])
+}
+
+func TestTenants_ScopedRelyingParties(t *testing.T) {
+	server := newTenantServer(t)
+	shop := registerRP(t, server, "shop", 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/t/acme/admin/relying-parties", strings.NewReader(`{"name":"acme shop"}`))
+	req.Header.Set("Authorization", "Bearer "+testOperatorToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var acmeShop RegisterRPResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &acmeShop))
+	assert.Equal(t, "acme", acmeShop.Tenant)
+
+	// Keys open their own tenant's API only
+	create := CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0"}
+	assert.Equal(t, http.StatusUnauthorized, rpRequest(t, server, http.MethodPost, "/verification-sessions", acmeShop.APIKey, create).Code)
+	assert.Equal(t, http.StatusUnauthorized, rpRequest(t, server, http.MethodPost, "/t/acme/verification-sessions", shop.APIKey, create).Code)
+	assert.Equal(t, http.StatusCreated, rpRequest(t, server, http.MethodPost, "/t/acme/verification-sessions", acmeShop.APIKey, create).Code)
+
+	_, err := server.relyingParties.Get(tenant.DefaultID, acmeShop.ID)
+	assert.ErrorIs(t, err, ErrUnknownRelyingParty)
+	assert.Len(t, server.relyingParties.List("acme"), 1)
+	assert.ErrorIs(t, server.relyingParties.Delete(tenant.DefaultID, acmeShop.ID), ErrUnknownRelyingParty)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/apiversion"
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/rs/zerolog/log"
+)
+
+// trustListTTL bounds how long the registry's trusted issuer list is reused
+const trustListTTL = 5 * time.Minute
+
+// Trusted issuer statuses published by the registry
+const (
+	IssuerStatusActive    = "active"
+	IssuerStatusSuspended = "suspended"
+	IssuerStatusRevoked   = "revoked"
+)
+
+// Reasons an issuer is not trusted, reported in UntrustedIssuerResponse
+const (
+	UntrustedUnknownIssuer   = "unknown_issuer"
+	UntrustedIssuerSuspended = "issuer_suspended"
+	UntrustedIssuerRevoked   = "issuer_revoked"
+	UntrustedCredentialType  = "credential_type_not_trusted"
+)
+
+// ErrTrustListUnavailable means no trusted issuer list could be obtained
+var ErrTrustListUnavailable = errors.New("trusted issuer list unavailable")
+
+// TrustedIssuer mirrors the registry's GET /trust/issuers entries
+type TrustedIssuer struct {
+	DID             string   `json:"did"`
+	CredentialTypes []string `json:"credentialTypes"`
+	Status          string   `json:"status"`
+}
+
+// UntrustedIssuerError rejects a presentation whose issuer the trust list
+// does not vouch for
+type UntrustedIssuerError struct {
+	Issuer string
+	Reason string
+}
+
+func (e *UntrustedIssuerError) Error() string {
+	return fmt.Sprintf("issuer %s is not trusted: %s", e.Issuer, e.Reason)
+}
+
+// defaultTrustedIssuers mirrors the registry's built-in catalog and is used
+// when no registry is configured
+func defaultTrustedIssuers() []TrustedIssuer {
+	return []TrustedIssuer{{
+		DID:             "did:web:cachet.id",
+		CredentialTypes: []string{"IdentityCredential", "AgeOverCredential"},
+		Status:          IssuerStatusActive,
+	}}
+}
+
+// trustedIssuerList checks issuers against a list fetched from the registry
+// and cached for ttl. When a refresh fails the last list keeps being used.
+type trustedIssuerList struct {
+	client      *http.Client
+	registryURL string // empty serves the static list
+	ttl         time.Duration
+
+	mu        sync.Mutex
+	issuers   map[string]TrustedIssuer
+	fetchedAt time.Time
+}
+
+func newStaticTrustList(issuers []TrustedIssuer) *trustedIssuerList {
+	l := &trustedIssuerList{}
+	l.replace(issuers, time.Now())
+	return l
+}
+
+func newRegistryTrustList(registryURL string) *trustedIssuerList {
+	return &trustedIssuerList{
+		client:      deadline.NewClient("registry"),
+		registryURL: strings.TrimSuffix(registryURL, "/"),
+		ttl:         trustListTTL,
+	}
+}
+
+func (l *trustedIssuerList) replace(issuers []TrustedIssuer, now time.Time) {
+	byDID := make(map[string]TrustedIssuer, len(issuers))
+	for _, issuer := range issuers {
+		byDID[issuer.DID] = issuer
+	}
+	l.mu.Lock()
+	l.issuers, l.fetchedAt = byDID, now
+	l.mu.Unlock()
+}
+
+// lookup returns the current entry for did, refreshing a stale list first
+func (l *trustedIssuerList) lookup(ctx context.Context, did string, now time.Time) (TrustedIssuer, bool, error) {
+	l.mu.Lock()
+	stale := l.registryURL != "" && (l.issuers == nil || now.Sub(l.fetchedAt) >= l.ttl)
+	l.mu.Unlock()
+
+	if stale {
+		issuers, err := l.fetch(ctx)
+		if err == nil {
+			l.replace(issuers, now)
+		} else {
+			log.Warn().Err(err).Str("registry", l.registryURL).Msg("Failed to refresh trusted issuers")
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.issuers == nil {
+		return TrustedIssuer{}, false, ErrTrustListUnavailable
+	}
+	issuer, ok := l.issuers[did]
+	return issuer, ok, nil
+}
+
+func (l *trustedIssuerList) fetch(ctx context.Context) ([]TrustedIssuer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.registryURL+"/trust/issuers", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(apiversion.Header, "1")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry returned %d for trusted issuers", resp.StatusCode)
+	}
+	var body struct {
+		Issuers []TrustedIssuer `json:"issuers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding trusted issuers: %w", err)
+	}
+	return body.Issuers, nil
+}
+
+// Admit returns the trust list entry of an issuer that is active in it,
+// before anything the issuer signed is verified
+func (l *trustedIssuerList) Admit(ctx context.Context, issuer string, now time.Time) (TrustedIssuer, error) {
+	entry, ok, err := l.lookup(ctx, issuer, now)
+	switch {
+	case err != nil:
+		return TrustedIssuer{}, err
+	case !ok:
+		return TrustedIssuer{}, &UntrustedIssuerError{Issuer: issuer, Reason: UntrustedUnknownIssuer}
+	case entry.Status == IssuerStatusRevoked:
+		return TrustedIssuer{}, &UntrustedIssuerError{Issuer: issuer, Reason: UntrustedIssuerRevoked}
+	case entry.Status != IssuerStatusActive:
+		return TrustedIssuer{}, &UntrustedIssuerError{Issuer: issuer, Reason: UntrustedIssuerSuspended}
+	}
+	return entry, nil
+}
+
+// Check accepts a verified credential only if its issuer is active in the
+// trust list and trusted for the credential's type
+func (l *trustedIssuerList) Check(ctx context.Context, verified VerifiedSDJWT, now time.Time) error {
+	entry, err := l.Admit(ctx, verified.Issuer, now)
+	if err != nil {
+		return err
+	}
+	types := credentialTypes(verified)
+	for _, trusted := range entry.CredentialTypes {
+		for _, credentialType := range types {
+			if credentialTypeMatches(trusted, credentialType) {
+				return nil
+			}
+		}
+	}
+	return &UntrustedIssuerError{Issuer: verified.Issuer, Reason: UntrustedCredentialType}
+}
+
+// isTrustError reports whether err refuses an issuer for not being trusted,
+// rather than for what it signed
+func isTrustError(err error) bool {
+	var untrusted *UntrustedIssuerError
+	return errors.As(err, &untrusted) || errors.Is(err, ErrTrustListUnavailable)
+}
+
+// trustedKeyResolver resolves the keys of issuers the trust list admits
+// only, so the DID document of an issuer named by an unverified credential
+// is never fetched unless the issuer is trusted
+type trustedKeyResolver struct {
+	keys  IssuerKeyResolver
+	trust *trustedIssuerList
+}
+
+func (r trustedKeyResolver) ResolveKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	if _, err := r.trust.Admit(ctx, issuer, time.Now()); err != nil {
+		return nil, err
+	}
+	return r.keys.ResolveKey(ctx, issuer, kid)
+}
+
+// credentialTypes collects the vct and any VC-style type claim
+func credentialTypes(verified VerifiedSDJWT) []string {
+	var types []string
+	if verified.Vct != "" {
+		types = append(types, verified.Vct)
+	}
+	switch t := verified.Claims["type"].(type) {
+	case string:
+		types = append(types, t)
+	case []interface{}:
+		for _, entry := range t {
+			if s, ok := entry.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	return types
+}
+
+// credentialTypeMatches compares a trusted type name with a vct or type, which
+// may be a URI ending in the name, as in presentation definitions
+func credentialTypeMatches(trusted, credentialType string) bool {
+	return credentialType == trusted || strings.HasSuffix(credentialType, "/"+trusted)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func verifyIssued(t *testing.T, server *Server, issuer *testIssuer) *httptest.ResponseRecorder {
+	t.Helper()
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	session := createSession(t, server, "pack.safe.seller@0.1.0")
+	body, err := json.Marshal(VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/presentations/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+// countingKeyResolver counts the issuer keys resolved through it
+type countingKeyResolver struct {
+	IssuerKeyResolver
+	resolved int32
+}
+
+func (r *countingKeyResolver) ResolveKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	atomic.AddInt32(&r.resolved, 1)
+	return r.IssuerKeyResolver.ResolveKey(ctx, issuer, kid)
+}
+
+func TestTrustedIssuers_Rejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		trust  []TrustedIssuer
+		reason string
+		// resolved is whether the issuer's key is resolved before the
+		// rejection, which only an issuer the list admits gets to
+		resolved bool
+	}{
+		{"unknown issuer", defaultTrustedIssuers(), UntrustedUnknownIssuer, false},
+		{"suspended issuer", []TrustedIssuer{{DID: testIssuerDID, CredentialTypes: []string{"identity"}, Status: IssuerStatusSuspended}}, UntrustedIssuerSuspended, false},
+		{"revoked issuer", []TrustedIssuer{{DID: testIssuerDID, CredentialTypes: []string{"identity"}, Status: IssuerStatusRevoked}}, UntrustedIssuerRevoked, false},
+		{"other credential type", []TrustedIssuer{{DID: testIssuerDID, CredentialTypes: []string{"AgeOverCredential"}, Status: IssuerStatusActive}}, UntrustedCredentialType, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			issuer := newTestIssuer(t)
+			keys := &countingKeyResolver{IssuerKeyResolver: issuer.resolver()}
+			server.issuerKeys = keys
+			server.trust = newStaticTrustList(tt.trust)
+
+			w := verifyIssued(t, server, issuer)
+			require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+			resp := decodeProblem(t, w)
+			assert.Equal(t, "untrusted_issuer", resp.Code)
+			assert.Equal(t, testIssuerDID, resp.Extensions["issuer"])
+			assert.Equal(t, tt.reason, resp.Extensions["reason"])
+			assert.Equal(t, tt.resolved, atomic.LoadInt32(&keys.resolved) > 0)
+		})
+	}
+}
+
+func TestTrustedIssuers_FromRegistry(t *testing.T) {
+	var fetches int32
+	var status atomic.Value
+	status.Store(IssuerStatusActive)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trust/issuers" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuers": []TrustedIssuer{{DID: testIssuerDID, CredentialTypes: []string{"identity"}, Status: status.Load().(string)}},
+		})
+	}))
+	defer registry.Close()
+
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	server.issuerKeys = issuer.resolver()
+	server.trust = newRegistryTrustList(registry.URL)
+
+	assert.Equal(t, http.StatusOK, verifyIssued(t, server, issuer).Code)
+	assert.Equal(t, http.StatusOK, verifyIssued(t, server, issuer).Code)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fetches), "list is cached")
+
+	// A suspension is picked up once the cached list expires
+	status.Store(IssuerStatusSuspended)
+	later := time.Now().Add(trustListTTL)
+	err := server.trust.Check(context.Background(), VerifiedSDJWT{Issuer: testIssuerDID, Vct: "https://cachet.id/identity"}, later)
+	var untrusted *UntrustedIssuerError
+	require.ErrorAs(t, err, &untrusted)
+	assert.Equal(t, UntrustedIssuerSuspended, untrusted.Reason)
+
+	// The last good list survives a registry outage
+	registry.Close()
+	err = server.trust.Check(context.Background(), VerifiedSDJWT{Issuer: testIssuerDID, Vct: "https://cachet.id/identity"}, later.Add(trustListTTL))
+	assert.ErrorAs(t, err, &untrusted)
+}
+
+func TestTrustedIssuers_RegistryUnavailable(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	server := NewServer()
+	issuer := newTestIssuer(t)
+	server.issuerKeys = issuer.resolver()
+	server.trust = newRegistryTrustList(down.URL)
+
+	w := verifyIssued(t, server, issuer)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "trust_list_unavailable")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultVerifierAudience is the aud holders must bind presentations to
+const defaultVerifierAudience = "https://verifier.cachet.id"
+
+// ProfileViolationError lists the compliance profile rules a presentation breaks
+type ProfileViolationError struct {
+	Profile    string
+	Violations []string
+}
+
+func (e *ProfileViolationError) Error() string {
+	return fmt.Sprintf("presentation violates the %s profile: %s", e.Profile, strings.Join(e.Violations, "; "))
+}
+
+// evaluatePresentation checks a presentation made in answer to session
+// against the compliance profile, verifies it and derives its badge
+func (s *Server) evaluatePresentation(ctx context.Context, bundle interface{}, session VerificationSession) (VerifyResponse, error) {
+	defer func(started time.Time) {
+		s.metrics.ObserveLatency(s.packLabel(session.PolicyID), time.Since(started))
+	}(time.Now())
+
+	if violations := s.profile.Check(bundle); len(violations) > 0 {
+		log.Warn().
+			Str("profile", s.profile.Name).
+			Strs("violations", violations).
+			Msg("Presentation rejected by compliance profile")
+		return VerifyResponse{}, &ProfileViolationError{Profile: s.profile.Name, Violations: violations}
+	}
+
+	envelopes, err := parsePresentationBundle(bundle)
+	if err != nil {
+		return VerifyResponse{}, fmt.Errorf("%w: %v", ErrInvalidPresentation, err)
+	}
+	// Checked before verification so replays show up as such rather than as
+	// nonce mismatches
+	digests := make([]string, len(envelopes))
+	for i, envelope := range envelopes {
+		digests[i] = presentationDigest(envelope)
+	}
+	if first, replayed := s.replays.Seen(session.RPID, digests, time.Now()); replayed {
+		return VerifyResponse{}, s.rejectReplay(session, first)
+	}
+
+	// Every credential must verify; one bad credential rejects the bundle
+	credentials := make([]bundleCredential, len(envelopes))
+	var keys []string
+	for i, envelope := range envelopes {
+		credential, err := s.verifyCredential(ctx, envelope, session)
+		if err != nil {
+			if len(envelopes) > 1 {
+				err = fmt.Errorf("credential %d: %w", i, err)
+			}
+			return VerifyResponse{}, err
+		}
+		credentials[i] = credential
+		keys = append(keys, replayKeys(envelope, credential.verified)...)
+	}
+	if first, replayed := s.replays.Seen(session.RPID, keys, time.Now()); replayed {
+		return VerifyResponse{}, s.rejectReplay(session, first)
+	}
+
+	now := time.Now()
+	s.replays.Record(session.RPID, session.ID, keys, now)
+	verified := make([]VerifiedSDJWT, len(credentials))
+	keyBound := true
+	for i, credential := range credentials {
+		verified[i] = credential.verified
+		keyBound = keyBound && credential.verified.KeyBound
+	}
+	resp := VerifyResponse{
+		Predicates: bundlePredicates(credentials),
+		Issuer:     verified[0].Issuer,
+		KeyBound:   keyBound,
+		Satisfied:  true,
+	}
+	if pack, ok := s.findPack(session.PolicyID); ok {
+		resp.Results = append(evaluateBundleRules(pack.compiled, credentials, now), evaluateMatches(pack.Match, credentials)...)
+		resp.Predicates, resp.Satisfied = mergeRuleResults(resp.Predicates, resp.Results)
+		resp.StepUp = stepUpFor(pack, credentials, resp.Results)
+		if pack.Freshness != nil {
+			for i := range credentials {
+				diagnostics := pack.Freshness.Evaluate(credentials[i].verified, now)
+				credentials[i].diagnostics = diagnostics
+				credentials[i].freshness = summarizeFreshness(credentials[i].freshness, diagnostics)
+				resp.FreshnessDiagnostics = append(resp.FreshnessDiagnostics, diagnostics...)
+			}
+		}
+	}
+	resp.Freshness = bundleFreshness(credentials)
+	resp.Credentials = credentialResults(credentials, resp.Results)
+	if len(resp.FreshnessDiagnostics) > 0 {
+		log.Info().Str("policy_id", session.PolicyID).Interface("diagnostics", resp.FreshnessDiagnostics).Msg("Presentation fails the pack's freshness policy")
+		resp.Satisfied = false
+	}
+	if resp.Freshness == FreshnessSuspended {
+		// A suspended credential is on hold, not revoked: the presentation
+		// verifies but cannot satisfy the pack until the issuer reinstates it
+		log.Info().Str("policy_id", session.PolicyID).Msg("Presentation carries a suspended credential")
+		resp.Satisfied = false
+	}
+
+	resp.Receipt, resp.ReceiptAnchor = s.issueReceipt(ctx, session, verified, resp.Predicates, now)
+	resp.Badge, err = s.issueBadge(s.verifierOf(sessionTenant(session)).signer, s.badgeLabel(session.PolicyID, verified[0]), session.PolicyID, resp.Predicates, resp.Satisfied, verified, now)
+	if err != nil {
+		return VerifyResponse{}, fmt.Errorf("signing badge: %w", err)
+	}
+	return resp, nil
+}
+
+// verifyCredential verifies one credential of a bundle and checks its issuer
+// is trusted and its status current
+func (s *Server) verifyCredential(ctx context.Context, envelope PresentationEnvelope, session VerificationSession) (bundleCredential, error) {
+	verified, key, cached, err := s.verifyCachedBundle(ctx, envelope, session)
+	if err != nil {
+		log.Warn().Err(err).Str("policy_id", session.PolicyID).Msg("Presentation failed verification")
+		return bundleCredential{}, err
+	}
+
+	if verified.IssuerChainVerified {
+		log.Debug().Str("issuer", verified.Issuer).Msg("Issuer trusted through its IACA certificate chain")
+	} else if err := s.trust.Check(ctx, verified, time.Now()); err != nil {
+		log.Warn().Err(err).Str("policy_id", session.PolicyID).Str("issuer", verified.Issuer).Msg("Presentation from untrusted issuer")
+		return bundleCredential{}, err
+	}
+
+	if cached {
+		return bundleCredential{envelope: envelope, verified: verified, freshness: FreshnessOK}, nil
+	}
+	freshness, err := s.status.Check(ctx, s.trustedIssuerKeys(), verified, time.Now())
+	if err != nil {
+		log.Warn().Err(err).Str("policy_id", session.PolicyID).Str("issuer", verified.Issuer).Msg("Credential status check failed")
+		return bundleCredential{}, err
+	}
+	if freshness == FreshnessOK {
+		s.results.store(key, verified, s.status, time.Now())
+	}
+	return bundleCredential{envelope: envelope, verified: verified, freshness: freshness}, nil
+}
+
+// verifyCachedBundle verifies a presentation like verifyBundle, but only
+// checks the key binding of an SD-JWT credential whose verification is
+// cached. It returns the credential's cache key and whether it hit.
+func (s *Server) verifyCachedBundle(ctx context.Context, envelope PresentationEnvelope, session VerificationSession) (VerifiedSDJWT, string, bool, error) {
+	if s.results == nil || envelope.Format == FormatMsoMdoc || envelope.Format == FormatLDPVC {
+		verified, err := s.verifyBundle(ctx, envelope, session)
+		return verified, "", false, err
+	}
+	sd, err := ParseSDJWT(envelope.Presentation)
+	if err != nil {
+		return VerifiedSDJWT{}, "", false, err
+	}
+	key := resultKey(envelope, sd, session.PolicyID)
+	if cached, ok := s.results.lookup(key, s.status, time.Now()); ok {
+		verified, err := sd.bindHolder(cached, s.keyBindingExpectations(session), time.Now())
+		return verified, key, err == nil, err
+	}
+	verified, err := sd.Verify(ctx, s.trustedIssuerKeys(), s.keyBindingExpectations(session), time.Now())
+	return verified, key, false, err
+}
+
+// rejectReplay logs a presentation already accepted in another session, for
+// fraud monitoring, and returns the error to answer it with
+func (s *Server) rejectReplay(session VerificationSession, firstSessionID string) error {
+	presentationReplays.Add(1)
+	log.Warn().
+		Str("session_id", session.ID).
+		Str("first_session_id", firstSessionID).
+		Str("rp_id", session.RPID).
+		Str("policy_id", session.PolicyID).
+		Msg("Suspected presentation replay")
+	return ErrReplayedPresentation
+}
+
+// mergeRuleResults adds the passed pack rules to the derived predicates and
+// reports whether every required rule passed
+func mergeRuleResults(predicates []string, results []PredicateResult) ([]string, bool) {
+	satisfied := true
+	for _, result := range results {
+		if !result.Passed {
+			satisfied = satisfied && !result.Required
+			continue
+		}
+		if !slices.Contains(predicates, result.ID) {
+			predicates = append(predicates, result.ID)
+		}
+	}
+	sort.Strings(predicates)
+	return predicates, satisfied
+}
+
+// verifyBundle cryptographically verifies a presentation made in answer to
+// the given verification session
+func (s *Server) verifyBundle(ctx context.Context, envelope PresentationEnvelope, session VerificationSession) (VerifiedSDJWT, error) {
+	if envelope.Format == FormatMsoMdoc {
+		return VerifyMdoc(envelope.Presentation, s.mdocRoots, MdocExpectations{
+			ClientID:    session.Audience,
+			Nonce:       session.Nonce,
+			ResponseURI: s.tenantURL(session.Tenant) + "/openid4vp/response",
+			Required:    s.profile.RequireKeyBinding,
+		}, time.Now())
+	}
+
+	kb := s.keyBindingExpectations(session)
+	if envelope.Format == FormatLDPVC {
+		return VerifyLDP(ctx, envelope.Presentation, s.trustedIssuerKeys(), kb, time.Now())
+	}
+
+	sd, err := ParseSDJWT(envelope.Presentation)
+	if err != nil {
+		return VerifiedSDJWT{}, err
+	}
+	return sd.Verify(ctx, s.trustedIssuerKeys(), kb, time.Now())
+}
+
+// trustedIssuerKeys resolves issuer keys once the trust list admits the
+// issuer, so untrusted issuers are refused before their keys are fetched
+func (s *Server) trustedIssuerKeys() IssuerKeyResolver {
+	return trustedKeyResolver{keys: s.issuerKeys, trust: s.trust}
+}
+
+// keyBindingExpectations are what presentations answering session must be
+// bound to
+func (s *Server) keyBindingExpectations(session VerificationSession) KeyBindingExpectations {
+	return KeyBindingExpectations{
+		Nonce:    session.Nonce,
+		Audience: session.Audience,
+		Required: s.profile.RequireKeyBinding,
+	}
+}
+
+// badgeLabel names the badge after the requested pack, falling back to the
+// verified credential type
+func (s *Server) badgeLabel(policyID string, verified VerifiedSDJWT) string {
+	if pack, ok := s.findPack(policyID); ok {
+		return pack.Name
+	}
+	if verified.Vct != "" {
+		return verified.Vct
+	}
+	return "Verified credential"
+}
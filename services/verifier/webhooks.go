@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	callbackMaxAttempts    = 8
+	callbackBaseBackoff    = 2 * time.Second
+	callbackMaxBackoff     = 10 * time.Minute
+	callbackWorkerInterval = time.Second
+	callbackTimeout        = 10 * time.Second
+
+	// CallbackSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC-SHA256>"
+	// over "<t>.<body>", so receivers can reject replayed deliveries
+	CallbackSignatureHeader = "Cachet-Signature"
+	CallbackIDHeader        = "Cachet-Webhook-Id"
+
+	EventVerificationCompleted = "verification.completed"
+)
+
+var callbackDeliveries = expvar.NewMap("rp_callbacks_total")
+
+// CallbackEvent is the body POSTed to a session's callback URL
+type CallbackEvent struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	CreatedAt time.Time           `json:"createdAt"`
+	Outcome   VerificationOutcome `json:"outcome"`
+}
+
+// CallbackDelivery is a callback awaiting (re)delivery
+type CallbackDelivery struct {
+	ID           string          `json:"id"`
+	URL          string          `json:"url"`
+	RPID         string          `json:"rpId,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+	Attempts     int             `json:"attempts"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	NextAttempt  time.Time       `json:"nextAttempt"`
+	LastError    string          `json:"lastError,omitempty"`
+	DeadLettered bool            `json:"deadLettered"`
+
+	secret   []byte
+	inFlight bool
+}
+
+// callbackQueue holds pending deliveries in memory (production should use a
+// durable queue so callbacks survive restarts)
+type callbackQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]*CallbackDelivery
+}
+
+func newCallbackQueue() *callbackQueue {
+	return &callbackQueue{deliveries: make(map[string]*CallbackDelivery)}
+}
+
+func (q *callbackQueue) Enqueue(delivery CallbackDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deliveries[delivery.ID] = &delivery
+}
+
+// Claim returns the oldest delivery that is due and marks it in flight
+func (q *callbackQueue) Claim(now time.Time) (CallbackDelivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *CallbackDelivery
+	for _, delivery := range q.deliveries {
+		if delivery.inFlight || delivery.DeadLettered || delivery.NextAttempt.After(now) {
+			continue
+		}
+		if next == nil || delivery.CreatedAt.Before(next.CreatedAt) {
+			next = delivery
+		}
+	}
+	if next == nil {
+		return CallbackDelivery{}, false
+	}
+	next.inFlight = true
+	return *next, true
+}
+
+func (q *callbackQueue) Ack(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.deliveries, id)
+}
+
+// Fail schedules a retry with exponential backoff, or dead-letters the
+// delivery once attempts are exhausted
+func (q *callbackQueue) Fail(id string, cause error, now time.Time) (CallbackDelivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delivery, ok := q.deliveries[id]
+	if !ok {
+		return CallbackDelivery{}, false
+	}
+	delivery.inFlight = false
+	delivery.Attempts++
+	delivery.LastError = cause.Error()
+	if delivery.Attempts >= callbackMaxAttempts {
+		delivery.DeadLettered = true
+	} else {
+		delivery.NextAttempt = now.Add(callbackBackoff(delivery.Attempts))
+	}
+	return *delivery, true
+}
+
+// DeadLetters lists deliveries that exhausted their retries, oldest first
+func (q *callbackQueue) DeadLetters() []CallbackDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dead := []CallbackDelivery{}
+	for _, delivery := range q.deliveries {
+		if delivery.DeadLettered {
+			dead = append(dead, *delivery)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].CreatedAt.Before(dead[j].CreatedAt) })
+	return dead
+}
+
+func callbackBackoff(attempts int) time.Duration {
+	backoff := callbackBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > callbackMaxBackoff {
+		return callbackMaxBackoff
+	}
+	return backoff
+}
+
+// SignCallback computes the Cachet-Signature header value for body
+func SignCallback(secret, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackSecret is the HMAC key for a session's callbacks: the relying
+// party's webhook secret, or the verifier-wide one for anonymous sessions
+func (s *Server) callbackSecret(rpID string) ([]byte, bool) {
+	if rpID != "" {
+		return s.relyingParties.WebhookSecret(rpID)
+	}
+	return s.callbackSigningSecret, len(s.callbackSigningSecret) > 0
+}
+
+// completeSession records a session's outcome, announces it on the event
+// bus and queues the callback the relying party asked for, if any
+func (s *Server) completeSession(session VerificationSession, outcome VerificationOutcome) {
+	outcome.tenant = sessionTenant(session)
+	s.sessions.Complete(outcome)
+	s.metrics.ObserveOutcome(s.packLabel(session.PolicyID), outcome)
+	s.publishOutcome(session, outcome)
+	if session.CallbackURL == "" {
+		return
+	}
+	secret, ok := s.callbackSecret(session.RPID)
+	if !ok {
+		log.Error().Str("session_id", session.ID).Str("rp_id", session.RPID).Msg("No webhook secret to sign the callback with")
+		return
+	}
+
+	event := CallbackEvent{
+		ID:        "evt-" + uuid.NewString(),
+		Type:      EventVerificationCompleted,
+		CreatedAt: outcome.CompletedAt.UTC(),
+		Outcome:   outcome,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to encode callback event")
+		return
+	}
+	s.callbacks.Enqueue(CallbackDelivery{
+		ID:          event.ID,
+		URL:         session.CallbackURL,
+		RPID:        session.RPID,
+		Payload:     payload,
+		CreatedAt:   event.CreatedAt,
+		NextAttempt: event.CreatedAt,
+		secret:      secret,
+	})
+	callbackDeliveries.Add("queued", 1)
+}
+
+// deliverCallback POSTs one signed delivery; any 2xx acknowledges it
+func (s *Server) deliverCallback(ctx context.Context, delivery CallbackDelivery, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackIDHeader, delivery.ID)
+	req.Header.Set(CallbackSignatureHeader, SignCallback(delivery.secret, delivery.Payload, now))
+	resp, err := s.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// drainCallbacks attempts every delivery that is due
+func (s *Server) drainCallbacks(ctx context.Context, now time.Time) {
+	for {
+		delivery, ok := s.callbacks.Claim(now)
+		if !ok {
+			return
+		}
+		err := s.deliverCallback(ctx, delivery, now)
+		if err == nil {
+			s.callbacks.Ack(delivery.ID)
+			callbackDeliveries.Add("delivered", 1)
+			log.Info().Str("event_id", delivery.ID).Str("rp_id", delivery.RPID).Msg("Callback delivered")
+			continue
+		}
+		failed, _ := s.callbacks.Fail(delivery.ID, err, now)
+		if failed.DeadLettered {
+			callbackDeliveries.Add("dead_lettered", 1)
+			log.Error().Err(err).Str("event_id", delivery.ID).Str("rp_id", delivery.RPID).Int("attempts", failed.Attempts).Msg("Callback dead-lettered")
+			continue
+		}
+		callbackDeliveries.Add("retried", 1)
+		log.Warn().Err(err).Str("event_id", delivery.ID).Time("next_attempt", failed.NextAttempt).Msg("Callback queued for retry")
+	}
+}
+
+func (s *Server) runCallbackWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		s.drainCallbacks(ctx, time.Now())
+		cancel()
+	}
+}
+
+func (s *Server) handleListCallbackDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": s.callbacks.DeadLetters()})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type callbackReceiver struct {
+	mu       sync.Mutex
+	statuses []int // responses to give, in order; 200 once exhausted
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (c *callbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies = append(c.bodies, body)
+	c.headers = append(c.headers, r.Header.Clone())
+	status := http.StatusOK
+	if len(c.statuses) > 0 {
+		status, c.statuses = c.statuses[0], c.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func createCallbackSession(t *testing.T, server *Server, apiKey, callbackURL string) *httptest.ResponseRecorder {
+	t.Helper()
+	return rpRequest(t, server, http.MethodPost, "/verification-sessions", apiKey,
+		CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", CallbackURL: callbackURL})
+}
+
+func TestCallback_SignedResultDelivered(t *testing.T) {
+	receiver := &callbackReceiver{}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+
+	server := newRPServer(t)
+	issuer := newTestIssuer(t)
+	issuer.trustedBy(server)
+	shop := registerRP(t, server, "Example Shop", 0)
+	require.NotEmpty(t, shop.WebhookSecret)
+
+	w := createCallbackSession(t, server, shop.APIKey, hook.URL+"/cachet")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session VerificationSession
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+
+	issuerJWT, disclosures := issuer.issue(t, nil, map[string]interface{}{"age_over_18": true})
+	w = rpRequest(t, server, http.MethodPost, "/presentations/verify", shop.APIKey, VerifyRequest{
+		Bundle:    issuer.present(t, issuerJWT, disclosures, session.Nonce, session.Audience, issuer.holder),
+		SessionID: session.ID,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	now := time.Now()
+	server.drainCallbacks(context.Background(), now)
+	require.Len(t, receiver.bodies, 1)
+
+	body, header := receiver.bodies[0], receiver.headers[0]
+	assert.Equal(t, SignCallback([]byte(shop.WebhookSecret), body, now), header.Get(CallbackSignatureHeader))
+	var event CallbackEvent
+	require.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, event.ID, header.Get(CallbackIDHeader))
+	assert.Equal(t, EventVerificationCompleted, event.Type)
+	assert.Equal(t, session.ID, event.Outcome.SessionID)
+	assert.Equal(t, OutcomeVerified, event.Outcome.Status)
+	require.NotNil(t, event.Outcome.Result)
+	assert.NotEmpty(t, event.Outcome.Result.Badge.JWS)
+
+	// Delivered callbacks are not sent again
+	server.drainCallbacks(context.Background(), now.Add(time.Hour))
+	assert.Len(t, receiver.bodies, 1)
+}
+
+func TestCallback_RetriesWithBackoff(t *testing.T) {
+	receiver := &callbackReceiver{statuses: []int{http.StatusInternalServerError}}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+
+	server := NewServer()
+	server.callbackSigningSecret = []byte("verifier-secret")
+	session := createCallbackSession(t, server, "", hook.URL)
+	require.Equal(t, http.StatusCreated, session.Code, session.Body.String())
+	var created VerificationSession
+	require.NoError(t, json.Unmarshal(session.Body.Bytes(), &created))
+
+	w := verifyWithProfile(t, server, created, "a.b.c~")
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	now := time.Now()
+	server.drainCallbacks(context.Background(), now)
+	require.Len(t, receiver.bodies, 1)
+
+	// Not due again before the backoff has elapsed
+	server.drainCallbacks(context.Background(), now.Add(time.Second))
+	require.Len(t, receiver.bodies, 1)
+
+	server.drainCallbacks(context.Background(), now.Add(callbackBaseBackoff))
+	require.Len(t, receiver.bodies, 2)
+	var event CallbackEvent
+	require.NoError(t, json.Unmarshal(receiver.bodies[1], &event))
+	assert.Equal(t, OutcomeFailed, event.Outcome.Status)
+	assert.Empty(t, server.callbacks.DeadLetters())
+}
+
+func TestCallback_DeadLettersAfterMaxAttempts(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+
+	server := NewServer()
+	server.callbackSigningSecret = []byte("verifier-secret")
+	server.completeSession(VerificationSession{ID: "session-1", CallbackURL: hook.URL},
+		VerificationOutcome{SessionID: "session-1", Status: OutcomeFailed, CompletedAt: time.Now()})
+
+	now := time.Now()
+	for i := 0; i < callbackMaxAttempts; i++ {
+		server.drainCallbacks(context.Background(), now)
+		now = now.Add(callbackMaxBackoff)
+	}
+	dead := server.callbacks.DeadLetters()
+	require.Len(t, dead, 1)
+	assert.Equal(t, callbackMaxAttempts, dead[0].Attempts)
+	assert.Equal(t, "callback returned 503", dead[0].LastError)
+}
+
+func TestCallback_RequiresSigningSecret(t *testing.T) {
+	server := NewServer()
+
+	w := createCallbackSession(t, server, "", "https://shop.example/hooks")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	body, err := json.Marshal(CreateSessionRequest{PolicyID: "pack.safe.seller@0.1.0", CallbackURL: "ftp://shop.example"})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/verification-sessions", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrClusterNotFound = errors.New("cluster not found")
+	// ErrClusterReviewed means a cluster already has a review decision
+	ErrClusterReviewed = errors.New("cluster already reviewed")
+)
+
+// Kinds of suspicious cluster
+const (
+	// ClusterReciprocalRing is a cycle of holders vouching for one another
+	ClusterReciprocalRing = "reciprocal_ring"
+	// ClusterNewAccountBurst is a subject vouched for by many new holders
+	// in a short window
+	ClusterNewAccountBurst = "new_account_burst"
+	// ClusterSharedDevice and ClusterSharedNetwork are vouchers of a subject
+	// who were verified from the same device or network
+	ClusterSharedDevice  = "shared_device"
+	ClusterSharedNetwork = "shared_network"
+)
+
+// Review statuses of a suspicious cluster
+const (
+	ClusterOpen      = "open"
+	ClusterConfirmed = "confirmed"
+	ClusterDismissed = "dismissed"
+)
+
+// DeviceSignal is what the issuance-gateway saw of a holder's device when
+// it verified them. Device and Network are hashes, of the device
+// fingerprint and of the IP prefix, so no raw identifier reaches this service.
+type DeviceSignal struct {
+	HolderJKT  string    `json:"holderJkt"`
+	Device     string    `json:"device,omitempty"`
+	Network    string    `json:"network,omitempty"`
+	ObservedAt time.Time `json:"observedAt"`
+}
+
+// SuspiciousCluster is a group of holders whose vouches look collusive,
+// flagged for review
+type SuspiciousCluster struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Subject    string     `json:"subject,omitempty"` // the holder vouched for, except in rings
+	Members    []string   `json:"members"`
+	VouchIDs   []string   `json:"vouchIds"`
+	Evidence   string     `json:"evidence"`
+	Status     string     `json:"status"`
+	DetectedAt time.Time  `json:"detectedAt"`
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty"`
+	Note       string     `json:"note,omitempty"`
+	// key identifies the pattern, so repeat detections update one cluster
+	key string
+}
+
+// AbuseStore persists device signals and flagged clusters
+type AbuseStore interface {
+	RecordSignal(ctx context.Context, signal DeviceSignal) error
+	Signals(ctx context.Context, holderJKT string) ([]DeviceSignal, error)
+	// Flag stores a cluster, merging it into the open cluster with the same
+	// key if there is one. A cluster already reviewed is flagged again only
+	// when new members joined it. It reports whether anything changed.
+	Flag(ctx context.Context, cluster SuspiciousCluster) (bool, error)
+	// ListClusters returns flagged clusters, newest first, of status when set
+	ListClusters(ctx context.Context, status string) ([]SuspiciousCluster, error)
+	GetCluster(ctx context.Context, id string) (SuspiciousCluster, error)
+	// ReviewCluster records the decision on an open cluster
+	ReviewCluster(ctx context.Context, id, status, note string, at time.Time) (SuspiciousCluster, error)
+}
+
+// memoryAbuseStore keeps signals and clusters in memory (production should
+// use a database)
+type memoryAbuseStore struct {
+	mu       sync.RWMutex
+	signals  map[string][]DeviceSignal
+	clusters map[string]SuspiciousCluster
+	byKey    map[string]string // key to the latest cluster flagged for it
+}
+
+func newMemoryAbuseStore() *memoryAbuseStore {
+	return &memoryAbuseStore{
+		signals:  make(map[string][]DeviceSignal),
+		clusters: make(map[string]SuspiciousCluster),
+		byKey:    make(map[string]string),
+	}
+}
+
+func (m *memoryAbuseStore) RecordSignal(ctx context.Context, signal DeviceSignal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signals[signal.HolderJKT] = append(m.signals[signal.HolderJKT], signal)
+	return nil
+}
+
+func (m *memoryAbuseStore) Signals(ctx context.Context, holderJKT string) ([]DeviceSignal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]DeviceSignal{}, m.signals[holderJKT]...), nil
+}
+
+func (m *memoryAbuseStore) Flag(ctx context.Context, cluster SuspiciousCluster) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.byKey[cluster.key]; ok {
+		existing := m.clusters[id]
+		members, grew := union(existing.Members, cluster.Members)
+		if existing.Status == ClusterOpen {
+			vouches, more := union(existing.VouchIDs, cluster.VouchIDs)
+			if !grew && !more {
+				return false, nil
+			}
+			existing.Members, existing.VouchIDs, existing.Evidence = members, vouches, cluster.Evidence
+			m.clusters[id] = existing
+			return true, nil
+		}
+		if !grew {
+			return false, nil
+		}
+	}
+	m.clusters[cluster.ID] = cluster
+	m.byKey[cluster.key] = cluster.ID
+	return true, nil
+}
+
+func (m *memoryAbuseStore) ListClusters(ctx context.Context, status string) ([]SuspiciousCluster, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	clusters := []SuspiciousCluster{}
+	for _, cluster := range m.clusters {
+		if status == "" || cluster.Status == status {
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].DetectedAt.After(clusters[j].DetectedAt) })
+	return clusters, nil
+}
+
+func (m *memoryAbuseStore) GetCluster(ctx context.Context, id string) (SuspiciousCluster, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cluster, ok := m.clusters[id]
+	if !ok {
+		return SuspiciousCluster{}, ErrClusterNotFound
+	}
+	return cluster, nil
+}
+
+func (m *memoryAbuseStore) ReviewCluster(ctx context.Context, id, status, note string, at time.Time) (SuspiciousCluster, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cluster, ok := m.clusters[id]
+	if !ok {
+		return SuspiciousCluster{}, ErrClusterNotFound
+	}
+	if cluster.Status != ClusterOpen {
+		return SuspiciousCluster{}, ErrClusterReviewed
+	}
+	cluster.Status, cluster.Note, cluster.ReviewedAt = status, note, &at
+	m.clusters[id] = cluster
+	return cluster, nil
+}
+
+// union merges b into a, sorted, reporting whether b added anything
+func union(a, b []string) ([]string, bool) {
+	seen := make(map[string]bool, len(a))
+	merged := append([]string{}, a...)
+	for _, s := range a {
+		seen[s] = true
+	}
+	grew := false
+	for _, s := range b {
+		if !seen[s] {
+			seen[s], grew = true, true
+			merged = append(merged, s)
+		}
+	}
+	sort.Strings(merged)
+	return merged, grew
+}
+
+// AbuseRules configures what the detector flags
+type AbuseRules struct {
+	// MaxRingSize is the most holders a reciprocal ring is searched for with
+	MaxRingSize int
+	// BurstSize new holders vouching for one subject within BurstWindow is
+	// a burst; holders are new until NewAccountAge after their first vouch
+	BurstSize     int
+	BurstWindow   time.Duration
+	NewAccountAge time.Duration
+}
+
+// DefaultAbuseRules returns the built-in detection rules
+func DefaultAbuseRules() AbuseRules {
+	return AbuseRules{
+		MaxRingSize:   4,
+		BurstSize:     5,
+		BurstWindow:   time.Hour,
+		NewAccountAge: 7 * 24 * time.Hour,
+	}
+}
+
+// abuseDetector inspects the trust graph around each new vouch for rings,
+// bursts and vouchers sharing a device or network
+type abuseDetector struct {
+	graph TrustGraph
+	store AbuseStore
+	rules AbuseRules
+	now   func() time.Time
+}
+
+// Inspect flags the suspicious clusters a new vouch forms. Detection is
+// best effort: a failure is logged and never rejects the vouch.
+func (d *abuseDetector) Inspect(ctx context.Context, edge TrustEdge) {
+	for _, detect := range []func(context.Context, TrustEdge) ([]SuspiciousCluster, error){
+		d.detectRings, d.detectBurst, d.detectSharedSignals,
+	} {
+		clusters, err := detect(ctx, edge)
+		if err != nil {
+			log.Error().Err(err).Str("vouch_id", edge.VouchID).Msg("Vouch abuse detection failed")
+			continue
+		}
+		for _, cluster := range clusters {
+			cluster.ID = "cluster-" + uuid.NewString()
+			cluster.Status = ClusterOpen
+			cluster.DetectedAt = d.now().UTC()
+			flagged, err := d.store.Flag(ctx, cluster)
+			if err != nil {
+				log.Error().Err(err).Str("kind", cluster.Kind).Msg("Failed to flag suspicious cluster")
+				continue
+			}
+			if flagged {
+				log.Warn().Str("kind", cluster.Kind).Strs("members", cluster.Members).Msg("Suspicious vouch cluster flagged")
+			}
+		}
+	}
+}
+
+// detectRings finds the cycles the vouch closes: paths of vouches from its
+// subject back to its voucher
+func (d *abuseDetector) detectRings(ctx context.Context, edge TrustEdge) ([]SuspiciousCluster, error) {
+	var clusters []SuspiciousCluster
+	path := []TrustEdge{edge}
+	onPath := map[string]bool{edge.Voucher: true, edge.Subject: true}
+	var walk func(holder string) error
+	walk = func(holder string) error {
+		if len(path) >= d.rules.MaxRingSize {
+			return nil
+		}
+		out, err := d.graph.OutEdges(ctx, holder)
+		if err != nil {
+			return err
+		}
+		visited := map[string]bool{}
+		for _, next := range out {
+			if visited[next.Subject] {
+				continue
+			}
+			visited[next.Subject] = true
+			if next.Subject == edge.Voucher {
+				clusters = append(clusters, ringCluster(append(path, next)))
+				continue
+			}
+			if onPath[next.Subject] {
+				continue
+			}
+			onPath[next.Subject] = true
+			path = append(path, next)
+			if err := walk(next.Subject); err != nil {
+				return err
+			}
+			path = path[:len(path)-1]
+			delete(onPath, next.Subject)
+		}
+		return nil
+	}
+	if err := walk(edge.Subject); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+func ringCluster(ring []TrustEdge) SuspiciousCluster {
+	members, vouches := make([]string, 0, len(ring)), make([]string, 0, len(ring))
+	for _, edge := range ring {
+		members = append(members, edge.Voucher)
+		vouches = append(vouches, edge.VouchID)
+	}
+	sort.Strings(members)
+	sort.Strings(vouches)
+	return SuspiciousCluster{
+		Kind:     ClusterReciprocalRing,
+		Members:  members,
+		VouchIDs: vouches,
+		Evidence: fmt.Sprintf("%d holders vouch for one another in a cycle", len(members)),
+		key:      ClusterReciprocalRing + "|" + strings.Join(members, "|"),
+	}
+}
+
+// detectBurst flags a subject that new holders vouched for in a burst
+func (d *abuseDetector) detectBurst(ctx context.Context, edge TrustEdge) ([]SuspiciousCluster, error) {
+	in, err := d.graph.InEdges(ctx, edge.Subject, "")
+	if err != nil {
+		return nil, err
+	}
+	since := edge.VouchedAt.Add(-d.rules.BurstWindow)
+	newVouchers := map[string]string{} // voucher to vouch ID
+	for _, vouch := range in {
+		if vouch.VouchedAt.Before(since) || vouch.VouchedAt.After(edge.VouchedAt) || newVouchers[vouch.Voucher] != "" {
+			continue
+		}
+		firstSeen, err := d.firstSeen(ctx, vouch.Voucher)
+		if err != nil {
+			return nil, err
+		}
+		if vouch.VouchedAt.Sub(firstSeen) <= d.rules.NewAccountAge {
+			newVouchers[vouch.Voucher] = vouch.VouchID
+		}
+	}
+	if len(newVouchers) < d.rules.BurstSize {
+		return nil, nil
+	}
+	members, vouches := []string{edge.Subject}, []string{}
+	for voucher, vouchID := range newVouchers {
+		members = append(members, voucher)
+		vouches = append(vouches, vouchID)
+	}
+	sort.Strings(members)
+	sort.Strings(vouches)
+	return []SuspiciousCluster{{
+		Kind:     ClusterNewAccountBurst,
+		Subject:  edge.Subject,
+		Members:  members,
+		VouchIDs: vouches,
+		Evidence: fmt.Sprintf("%d new holders vouched within %s", len(newVouchers), d.rules.BurstWindow),
+		key:      ClusterNewAccountBurst + "|" + edge.Subject,
+	}}, nil
+}
+
+// firstSeen is when the holder first took part in a vouch
+func (d *abuseDetector) firstSeen(ctx context.Context, holder string) (time.Time, error) {
+	out, err := d.graph.OutEdges(ctx, holder)
+	if err != nil {
+		return time.Time{}, err
+	}
+	in, err := d.graph.InEdges(ctx, holder, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var first time.Time
+	for _, edge := range append(out, in...) {
+		if first.IsZero() || edge.VouchedAt.Before(first) {
+			first = edge.VouchedAt
+		}
+	}
+	return first, nil
+}
+
+// detectSharedSignals flags a subject whose vouchers, or the subject and a
+// voucher, were verified from the same device or network
+func (d *abuseDetector) detectSharedSignals(ctx context.Context, edge TrustEdge) ([]SuspiciousCluster, error) {
+	in, err := d.graph.InEdges(ctx, edge.Subject, "")
+	if err != nil {
+		return nil, err
+	}
+	// The subject's key is known once they have vouched themselves
+	out, err := d.graph.OutEdges(ctx, edge.Subject)
+	if err != nil {
+		return nil, err
+	}
+	holders := map[string]map[string]bool{} // holder to the keys they signed with
+	vouchIDs := map[string]string{}         // voucher to a vouch for the subject
+	for _, e := range in {
+		if holders[e.Voucher] == nil {
+			holders[e.Voucher] = map[string]bool{}
+		}
+		holders[e.Voucher][e.VoucherKey] = true
+		vouchIDs[e.Voucher] = e.VouchID
+	}
+	for _, e := range out {
+		if holders[e.Voucher] == nil {
+			holders[e.Voucher] = map[string]bool{}
+		}
+		holders[e.Voucher][e.VoucherKey] = true
+	}
+
+	// Group holders by the hashed devices and networks they were seen on
+	groups := map[string]map[string]bool{} // kind|hash to holders
+	for holder, keys := range holders {
+		for key := range keys {
+			if key == "" {
+				continue
+			}
+			signals, err := d.store.Signals(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			for _, signal := range signals {
+				for kind, hash := range map[string]string{ClusterSharedDevice: signal.Device, ClusterSharedNetwork: signal.Network} {
+					if hash == "" {
+						continue
+					}
+					if groups[kind+"|"+hash] == nil {
+						groups[kind+"|"+hash] = map[string]bool{}
+					}
+					groups[kind+"|"+hash][holder] = true
+				}
+			}
+		}
+	}
+
+	var clusters []SuspiciousCluster
+	for group, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		kind, _, _ := strings.Cut(group, "|")
+		cluster := SuspiciousCluster{Kind: kind, Subject: edge.Subject, Members: []string{}, VouchIDs: []string{}, key: group + "|" + edge.Subject}
+		for holder := range members {
+			cluster.Members = append(cluster.Members, holder)
+			if id := vouchIDs[holder]; id != "" {
+				cluster.VouchIDs = append(cluster.VouchIDs, id)
+			}
+		}
+		sort.Strings(cluster.Members)
+		sort.Strings(cluster.VouchIDs)
+		what := "device"
+		if kind == ClusterSharedNetwork {
+			what = "network"
+		}
+		cluster.Evidence = fmt.Sprintf("%d holders around %s were verified from the same %s", len(members), edge.Subject, what)
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// authorizeOperator checks the bearer token for the review API, which is
+// closed unless OPERATOR_API_TOKEN is configured
+func (s *Server) authorizeOperator(r *http.Request) bool {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return s.operatorToken != "" && scheme == "Bearer" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1
+}
+
+// writeAbuseError answers a failed review operation
+func writeAbuseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrClusterNotFound):
+		writeVouchError(w, http.StatusNotFound, ErrCodeNotFound, "Cluster not found")
+	case errors.Is(err, ErrClusterReviewed):
+		writeVouchError(w, http.StatusConflict, ErrCodeAlreadyReviewed, "Cluster already reviewed")
+	default:
+		log.Error().Err(err).Msg("Cluster review request failed")
+		writeVouchError(w, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+	}
+}
+
+// handleRecordDeviceSignal takes the device signals the issuance-gateway
+// reports when it verifies a holder, with its CREDENTIAL_API_TOKEN
+func (s *Server) handleRecordDeviceSignal(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeIssuer(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="issuer"`)
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	var signal DeviceSignal
+	if err := json.NewDecoder(r.Body).Decode(&signal); err != nil || signal.HolderJKT == "" || (signal.Device == "" && signal.Network == "") {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "holderJkt and a device or network are required")
+		return
+	}
+	signal.ObservedAt = s.now().UTC()
+	if err := s.abuse.store.RecordSignal(r.Context(), signal); err != nil {
+		writeAbuseError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListClusters(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", ClusterOpen, ClusterConfirmed, ClusterDismissed:
+	default:
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Unknown status "+status)
+		return
+	}
+	clusters, err := s.abuse.store.ListClusters(r.Context(), status)
+	if err != nil {
+		writeAbuseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(clusters), "clusters": clusters})
+}
+
+func (s *Server) handleGetCluster(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	cluster, err := s.abuse.store.GetCluster(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeAbuseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cluster)
+}
+
+// ReviewClusterRequest records an operator's decision on a flagged cluster
+type ReviewClusterRequest struct {
+	Status string `json:"status"` // confirmed or dismissed
+	Note   string `json:"note,omitempty"`
+}
+
+func (s *Server) handleReviewCluster(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeOperator(r) {
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	var req ReviewClusterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Status != ClusterConfirmed && req.Status != ClusterDismissed) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "status must be confirmed or dismissed")
+		return
+	}
+	cluster, err := s.abuse.store.ReviewCluster(r.Context(), chi.URLParam(r, "id"), req.Status, req.Note, s.now().UTC())
+	if err != nil {
+		writeAbuseError(w, err)
+		return
+	}
+	log.Info().Str("cluster_id", cluster.ID).Str("status", cluster.Status).Msg("Suspicious cluster reviewed")
+	// The note is for operators; members hear only the outcome
+	for _, member := range cluster.Members {
+		s.notifyUser(member, notify.TopicReviewOutcome, map[string]any{"Item": "vouching activity", "Outcome": cluster.Status})
+	}
+	writeJSON(w, http.StatusOK, cluster)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOperatorToken = "ops-secret"
+
+func operatorRequest(t *testing.T, server *Server, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func listClusters(t *testing.T, server *Server, status string) []SuspiciousCluster {
+	t.Helper()
+	w := operatorRequest(t, server, http.MethodGet, "/abuse/clusters?status="+status, testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Clusters []SuspiciousCluster `json:"clusters"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Clusters
+}
+
+func mustSubmit(t *testing.T, server *Server, voucher holder, subject, vouchType string) Vouch {
+	t.Helper()
+	code, vouch, _ := submit(t, server, voucher.sign(t, subject, vouchType, nil))
+	require.Equal(t, http.StatusCreated, code)
+	return vouch
+}
+
+func TestAbuse_ReciprocalRings(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	alice, bob, carol, dave := newHolder(t), newHolder(t), newHolder(t), newHolder(t)
+
+	ab := mustSubmit(t, server, alice, bob.did, "known_personally")
+	assert.Empty(t, listClusters(t, server, ""))
+	ba := mustSubmit(t, server, bob, alice.did, "known_personally")
+	clusters := listClusters(t, server, ClusterOpen)
+	require.Len(t, clusters, 1)
+	assert.Equal(t, ClusterReciprocalRing, clusters[0].Kind)
+	assert.ElementsMatch(t, []string{alice.did, bob.did}, clusters[0].Members)
+	assert.ElementsMatch(t, []string{ab.ID, ba.ID}, clusters[0].VouchIDs)
+
+	// Closing the same ring with another claim is the same cluster
+	mustSubmit(t, server, bob, alice.did, "trustworthy_seller")
+	assert.Len(t, listClusters(t, server, ""), 1)
+
+	// Longer cycles are rings too
+	mustSubmit(t, server, carol, dave.did, "known_personally")
+	mustSubmit(t, server, dave, alice.did, "known_personally")
+	mustSubmit(t, server, alice, carol.did, "known_personally")
+	clusters = listClusters(t, server, "")
+	require.Len(t, clusters, 2)
+	assert.ElementsMatch(t, []string{alice.did, carol.did, dave.did}, clusters[0].Members)
+}
+
+func TestAbuse_NewAccountBurst(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	carol := newHolder(t)
+	for i := 0; i < server.abuse.rules.BurstSize-1; i++ {
+		mustSubmit(t, server, newHolder(t), carol.did, "trustworthy_seller")
+	}
+	assert.Empty(t, listClusters(t, server, ""))
+
+	mustSubmit(t, server, newHolder(t), carol.did, "trustworthy_seller")
+	clusters := listClusters(t, server, "")
+	require.Len(t, clusters, 1)
+	assert.Equal(t, ClusterNewAccountBurst, clusters[0].Kind)
+	assert.Equal(t, carol.did, clusters[0].Subject)
+	assert.Len(t, clusters[0].Members, server.abuse.rules.BurstSize+1)
+	assert.Len(t, clusters[0].VouchIDs, server.abuse.rules.BurstSize)
+
+	// The burst growing updates its cluster
+	mustSubmit(t, server, newHolder(t), carol.did, "trustworthy_seller")
+	clusters = listClusters(t, server, "")
+	require.Len(t, clusters, 1)
+	assert.Len(t, clusters[0].VouchIDs, server.abuse.rules.BurstSize+1)
+}
+
+func TestAbuse_SharedDevice(t *testing.T) {
+	server := NewServer()
+	server.operatorToken = testOperatorToken
+	server.issuerToken = testIssuerToken
+	alice, bob, mallory, carol := newHolder(t), newHolder(t), newHolder(t), newHolder(t)
+
+	for h, signal := range map[holder]DeviceSignal{
+		alice:   {Device: "device-1", Network: "net-1"},
+		bob:     {Device: "device-2", Network: "net-2"},
+		mallory: {Device: "device-1", Network: "net-3"},
+	} {
+		signal.HolderJKT = h.thumbprint(t)
+		require.Equal(t, http.StatusNoContent, operatorRequest(t, server, http.MethodPost, "/device-signals", testIssuerToken, signal).Code)
+	}
+	assert.Equal(t, http.StatusUnauthorized, operatorRequest(t, server, http.MethodPost, "/device-signals", "wrong", DeviceSignal{HolderJKT: "x", Device: "d"}).Code)
+	assert.Equal(t, http.StatusBadRequest, operatorRequest(t, server, http.MethodPost, "/device-signals", testIssuerToken, DeviceSignal{HolderJKT: "x"}).Code)
+
+	mustSubmit(t, server, alice, carol.did, "good_tenant")
+	mustSubmit(t, server, bob, carol.did, "good_tenant")
+	assert.Empty(t, listClusters(t, server, ""))
+
+	vouch := mustSubmit(t, server, mallory, carol.did, "good_tenant")
+	clusters := listClusters(t, server, "")
+	require.Len(t, clusters, 1)
+	assert.Equal(t, ClusterSharedDevice, clusters[0].Kind)
+	assert.Equal(t, carol.did, clusters[0].Subject)
+	assert.ElementsMatch(t, []string{alice.did, mallory.did}, clusters[0].Members)
+	assert.Contains(t, clusters[0].VouchIDs, vouch.ID)
+}
+
+func TestAbuse_Review(t *testing.T) {
+	server := NewServer()
+	alice, bob := newHolder(t), newHolder(t)
+	mustSubmit(t, server, alice, bob.did, "known_personally")
+	mustSubmit(t, server, bob, alice.did, "known_personally")
+
+	// Closed until the operator token is configured
+	assert.Equal(t, http.StatusUnauthorized, operatorRequest(t, server, http.MethodGet, "/abuse/clusters", testOperatorToken, nil).Code)
+	server.operatorToken = testOperatorToken
+	assert.Equal(t, http.StatusUnauthorized, operatorRequest(t, server, http.MethodGet, "/abuse/clusters", "wrong", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, operatorRequest(t, server, http.MethodGet, "/abuse/clusters?status=pending", testOperatorToken, nil).Code)
+
+	clusters := listClusters(t, server, ClusterOpen)
+	require.Len(t, clusters, 1)
+	path := "/abuse/clusters/" + clusters[0].ID
+	w := operatorRequest(t, server, http.MethodGet, path, testOperatorToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusBadRequest, operatorRequest(t, server, http.MethodPost, path+"/review", testOperatorToken, ReviewClusterRequest{Status: ClusterOpen}).Code)
+	w = operatorRequest(t, server, http.MethodPost, path+"/review", testOperatorToken, ReviewClusterRequest{Status: ClusterDismissed, Note: "siblings"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var reviewed SuspiciousCluster
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reviewed))
+	assert.Equal(t, ClusterDismissed, reviewed.Status)
+	assert.Equal(t, "siblings", reviewed.Note)
+	assert.NotNil(t, reviewed.ReviewedAt)
+	assert.Equal(t, http.StatusConflict, operatorRequest(t, server, http.MethodPost, path+"/review", testOperatorToken, ReviewClusterRequest{Status: ClusterConfirmed}).Code)
+	assert.Equal(t, http.StatusNotFound, operatorRequest(t, server, http.MethodGet, "/abuse/clusters/cluster-missing", testOperatorToken, nil).Code)
+
+	// A dismissed ring is not flagged again unless it gains members
+	mustSubmit(t, server, bob, alice.did, "reliable_tradesperson")
+	assert.Empty(t, listClusters(t, server, ClusterOpen))
+	assert.Len(t, listClusters(t, server, ClusterDismissed), 1)
+}
+
+func TestAbuseStore_Flag(t *testing.T) {
+	store := newMemoryAbuseStore()
+	ctx := context.Background()
+	cluster := SuspiciousCluster{ID: "cluster-1", Kind: ClusterSharedNetwork, Status: ClusterOpen, Members: []string{"did:example:a", "did:example:b"}, key: "k"}
+	flagged, err := store.Flag(ctx, cluster)
+	require.NoError(t, err)
+	assert.True(t, flagged)
+	flagged, err = store.Flag(ctx, cluster)
+	require.NoError(t, err)
+	assert.False(t, flagged)
+
+	_, err = store.ReviewCluster(ctx, "cluster-1", ClusterConfirmed, "", cluster.DetectedAt)
+	require.NoError(t, err)
+	grown := cluster
+	grown.ID, grown.Members = "cluster-2", []string{"did:example:a", "did:example:c"}
+	flagged, err = store.Flag(ctx, grown)
+	require.NoError(t, err)
+	assert.True(t, flagged)
+	open, err := store.ListClusters(ctx, ClusterOpen)
+	require.NoError(t, err)
+	require.Len(t, open, 1)
+	assert.Equal(t, "cluster-2", open[0].ID)
+}
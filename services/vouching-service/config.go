@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+)
+
+// Config is the vouching service's configuration, documented in CONFIG.md.
+// The database keeps its own variables, read by its loader.
+type Config struct {
+	config.Base
+	CredentialToken string `env:"CREDENTIAL_API_TOKEN" secret:"true" doc:"Token the issuance gateway presents to issue vouch credentials; none can be issued without it"`
+	OperatorToken   string `env:"OPERATOR_API_TOKEN" secret:"true" doc:"Token operators present for the review API; it is disabled without it"`
+	BaseURL         string `env:"VOUCHING_BASE_URL" doc:"Public URL of the vouching service, used in deep links"`
+	TrustScoring    TrustScoringConfig
+	VouchPolicy     VouchPolicyConfig
+	ServiceAuth     serviceauth.Config
+	Events          events.Config
+	Notify          notify.Config
+}
+
+// defaultConfig is the configuration before any source is read
+func defaultConfig() Config {
+	return Config{Base: config.Base{Port: 8090}, BaseURL: defaultBaseURL}
+}
+
+// Validate checks the port, service authentication, trust scoring, vouch
+// policy, event bus and notification channels are usable
+func (c Config) Validate() error {
+	if err := c.Base.Validate(); err != nil {
+		return err
+	}
+	if err := c.ServiceAuth.Validate(c.Development()); err != nil {
+		return err
+	}
+	if err := c.TrustScoring.Validate(); err != nil {
+		return err
+	}
+	if err := c.VouchPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := c.Events.Validate(); err != nil {
+		return err
+	}
+	return c.Notify.Validate()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrHolderMismatch means the key asking for a vouch credential is not the
+// vouch subject's
+var ErrHolderMismatch = errors.New("holder key does not match the vouch subject")
+
+const (
+	// VouchCredentialVCT is the SD-JWT VC type of vouch credentials
+	VouchCredentialVCT    = "https://schemas.cachet.id/vouch/v1"
+	VouchCredentialFormat = "vc+sd-jwt"
+	sdJWTType             = "vc+sd-jwt"
+
+	vouchCredentialLifetime = 365 * 24 * time.Hour
+)
+
+// VouchCredentialRequest asks for a vouch as a credential bound to the
+// holder's key, given by its RFC 7638 thumbprint
+type VouchCredentialRequest struct {
+	HolderJKT string `json:"holderJkt"`
+}
+
+// VouchCredential is a vouch packaged as an SD-JWT VC for the subject's
+// wallet. The service countersigns it; the voucher's own signed vouch is a
+// disclosure, so verifiers can check the voucher signed it too.
+type VouchCredential struct {
+	CredentialID string    `json:"credentialId"`
+	Format       string    `json:"format"`
+	Credential   string    `json:"credential"` // issuer-signed JWT and disclosures, ~-separated
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// sdDisclosure encodes an object claim disclosure and its digest
+func sdDisclosure(name string, value interface{}) (encoded, digest string, err error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", err
+	}
+	raw, err := json.Marshal([]interface{}{base64.RawURLEncoding.EncodeToString(salt), name, value})
+	if err != nil {
+		return "", "", err
+	}
+	encoded = base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(encoded))
+	return encoded, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// issueVouchCredential packages vouch for the holder of holderJKT, who
+// must control the subject's DID key; the credential is bound to that key
+func (s *Server) issueVouchCredential(ctx context.Context, vouch Vouch, holderJKT string) (VouchCredential, error) {
+	doc, err := s.dids.Resolve(ctx, vouch.Subject)
+	if err != nil {
+		return VouchCredential{}, fmt.Errorf("resolving the subject: %w", err)
+	}
+	var holderKey interface{}
+	for _, method := range doc.VerificationMethod {
+		if method.PublicKeyJwk == nil {
+			continue
+		}
+		if jkt, err := method.PublicKeyJwk.Thumbprint(); err == nil && subtle.ConstantTimeCompare([]byte(jkt), []byte(holderJKT)) == 1 {
+			holderKey = method.PublicKeyJwk
+			break
+		}
+	}
+	if holderKey == nil {
+		return VouchCredential{}, ErrHolderMismatch
+	}
+
+	// Who vouched, what they said and their signature are disclosed at the
+	// holder's choice; the claim type is always visible
+	now := s.now().UTC()
+	claims := jwt.MapClaims{
+		"iss":        vouchIssuer,
+		"sub":        vouch.Subject,
+		"vct":        VouchCredentialVCT,
+		"jti":        "urn:uuid:" + uuid.NewString(),
+		"iat":        now.Unix(),
+		"exp":        now.Add(vouchCredentialLifetime).Unix(),
+		"vouch_type": vouch.Type,
+		"cnf":        map[string]interface{}{"jwk": holderKey},
+		"_sd_alg":    "sha-256",
+	}
+	disclosed := map[string]interface{}{
+		"voucher":    vouch.Voucher,
+		"vouched_at": vouch.IssuedAt.Format(time.RFC3339),
+		"vouch":      vouch.JWS,
+	}
+	if vouch.Statement != "" {
+		disclosed["statement"] = vouch.Statement
+	}
+	var disclosures, digests []string
+	for name, value := range disclosed {
+		encoded, digest, err := sdDisclosure(name, value)
+		if err != nil {
+			return VouchCredential{}, err
+		}
+		disclosures, digests = append(disclosures, encoded), append(digests, digest)
+	}
+	claims["_sd"] = digests
+
+	issuerJWT, err := s.signer.SignTyped(sdJWTType, claims)
+	if err != nil {
+		return VouchCredential{}, err
+	}
+	return VouchCredential{
+		CredentialID: claims["jti"].(string),
+		Format:       VouchCredentialFormat,
+		Credential:   issuerJWT + "~" + strings.Join(disclosures, "~") + "~",
+		ExpiresAt:    now.Add(vouchCredentialLifetime),
+	}, nil
+}
+
+// authorizeIssuer checks the issuance-gateway's service token, or the bearer
+// token it fetches vouch credentials with; the endpoint is closed without
+// SERVICE_AUTH_PEER_KEYS or CREDENTIAL_API_TOKEN
+func (s *Server) authorizeIssuer(r *http.Request) bool {
+	if s.serviceAuth != nil {
+		if _, err := s.serviceAuth.Authenticate(r, "issuance-gateway"); err == nil {
+			return true
+		}
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return s.issuerToken != "" && scheme == "Bearer" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.issuerToken)) == 1
+}
+
+func (s *Server) handleIssueVouchCredential(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeIssuer(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="issuer"`)
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	var req VouchCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HolderJKT == "" {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "holderJkt is required")
+		return
+	}
+	vouch, err := s.vouches.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if vouch.RevokedAt != nil {
+		writeStoreError(w, ErrVouchRevoked)
+		return
+	}
+	credential, err := s.issueVouchCredential(r.Context(), vouch, req.HolderJKT)
+	if errors.Is(err, ErrHolderMismatch) {
+		writeVouchError(w, http.StatusForbidden, ErrCodeHolderMismatch, err.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Str("vouch_id", vouch.ID).Str("credential_id", credential.CredentialID).Msg("Vouch credential issued")
+	writeJSON(w, http.StatusOK, credential)
+}
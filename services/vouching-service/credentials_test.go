@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuerToken = "gateway-token"
+
+func (h holder) thumbprint(t *testing.T) string {
+	t.Helper()
+	doc, err := didresolver.ResolveJWK(context.Background(), h.did)
+	require.NoError(t, err)
+	jkt, err := doc.VerificationMethod[0].PublicKeyJwk.Thumbprint()
+	require.NoError(t, err)
+	return jkt
+}
+
+func requestCredential(t *testing.T, server *Server, vouchID, holderJKT, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	raw, err := json.Marshal(VouchCredentialRequest{HolderJKT: holderJKT})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/vouches/"+vouchID+"/credential", bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestVouchCredential_Issue(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	alice, carol := newHolder(t), newHolder(t)
+	code, vouch, _ := submit(t, server, alice.sign(t, carol.did, "reliable_childminder", func(c jwt.MapClaims) {
+		c["statement"] = "Three years with our twins"
+	}))
+	require.Equal(t, http.StatusCreated, code)
+
+	w := requestCredential(t, server, vouch.ID, carol.thumbprint(t), testIssuerToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var issued VouchCredential
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &issued))
+	assert.Equal(t, VouchCredentialFormat, issued.Format)
+
+	// The service countersigns the credential with the key in its DID document
+	parts := strings.Split(issued.Credential, "~")
+	require.Len(t, parts, 6) // issuer JWT, four disclosures and the empty KB-JWT slot
+	assert.Empty(t, parts[5])
+	w = vouchRequest(t, server, http.MethodGet, "/.well-known/did.json", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var doc didresolver.Document
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	issuerKey, err := doc.AssertionKey("")
+	require.NoError(t, err)
+	publicKey, err := issuerKey.PublicKey()
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(parts[0], claims, func(*jwt.Token) (interface{}, error) { return publicKey, nil })
+	require.NoError(t, err)
+	assert.Equal(t, sdJWTType, token.Header["typ"])
+	assert.Equal(t, vouchIssuer, claims["iss"])
+	assert.Equal(t, carol.did, claims["sub"])
+	assert.Equal(t, VouchCredentialVCT, claims["vct"])
+	assert.Equal(t, "reliable_childminder", claims["vouch_type"])
+	assert.Equal(t, issued.CredentialID, claims["jti"])
+
+	// It is bound to the subject's key
+	cnf := claims["cnf"].(map[string]interface{})
+	carolDoc, err := didresolver.ResolveJWK(context.Background(), carol.did)
+	require.NoError(t, err)
+	assert.Equal(t, carolDoc.VerificationMethod[0].PublicKeyJwk.X, cnf["jwk"].(map[string]interface{})["x"])
+
+	// Each disclosure matches a signed digest, and carries the voucher's own signed vouch
+	digests := map[string]bool{}
+	for _, digest := range claims["_sd"].([]interface{}) {
+		digests[digest.(string)] = true
+	}
+	disclosed := map[string]interface{}{}
+	for _, encoded := range parts[1:5] {
+		sum := sha256.Sum256([]byte(encoded))
+		assert.True(t, digests[base64.RawURLEncoding.EncodeToString(sum[:])])
+		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		require.NoError(t, err)
+		var disclosure []interface{}
+		require.NoError(t, json.Unmarshal(raw, &disclosure))
+		require.Len(t, disclosure, 3)
+		disclosed[disclosure[1].(string)] = disclosure[2]
+	}
+	assert.Equal(t, alice.did, disclosed["voucher"])
+	assert.Equal(t, "Three years with our twins", disclosed["statement"])
+	assert.Equal(t, vouch.JWS, disclosed["vouch"])
+	_, err = server.verifyVouch(context.Background(), disclosed["vouch"].(string))
+	assert.NoError(t, err)
+}
+
+func TestVouchCredential_Refused(t *testing.T) {
+	server := NewServer()
+	alice, carol := newHolder(t), newHolder(t)
+	code, vouch, _ := submit(t, server, alice.sign(t, carol.did, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+
+	// Closed until the gateway's token is configured
+	assert.Equal(t, http.StatusUnauthorized, requestCredential(t, server, vouch.ID, carol.thumbprint(t), testIssuerToken).Code)
+	server.issuerToken = testIssuerToken
+	assert.Equal(t, http.StatusUnauthorized, requestCredential(t, server, vouch.ID, carol.thumbprint(t), "wrong").Code)
+
+	// Only the subject's key can receive it: not the voucher's
+	w := requestCredential(t, server, vouch.ID, alice.thumbprint(t), testIssuerToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeHolderMismatch)
+
+	assert.Equal(t, http.StatusNotFound, requestCredential(t, server, "vouch-missing", carol.thumbprint(t), testIssuerToken).Code)
+	assert.Equal(t, http.StatusBadRequest, requestCredential(t, server, vouch.ID, "", testIssuerToken).Code)
+}
+
+// writeServiceKeys gives each service a P-256 key in dir and files its
+// public half under dir/peers, returning the peer directory
+func writeServiceKeys(t *testing.T, dir string, services ...string) string {
+	t.Helper()
+	peers := filepath.Join(dir, "peers")
+	require.NoError(t, os.MkdirAll(peers, 0o700))
+	for _, service := range services {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		private, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, service+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: private}), 0o600))
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(peers, service+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0o600))
+	}
+	return peers
+}
+
+func TestVouchCredential_ServiceToken(t *testing.T) {
+	dir := t.TempDir()
+	peers := writeServiceKeys(t, dir, "vouching-service", "issuance-gateway", "verifier")
+	server := NewServer()
+	var err error
+	server.serviceAuth, err = serviceauth.New("vouching-service", serviceauth.Config{PeerKeys: peers})
+	require.NoError(t, err)
+	alice, carol := newHolder(t), newHolder(t)
+	code, vouch, _ := submit(t, server, alice.sign(t, carol.did, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+
+	withServiceToken := func(caller string) int {
+		auth, err := serviceauth.New(caller, serviceauth.Config{Key: filepath.Join(dir, caller+".key")})
+		require.NoError(t, err)
+		token, err := auth.Token("vouching-service")
+		require.NoError(t, err)
+		raw, err := json.Marshal(VouchCredentialRequest{HolderJKT: carol.thumbprint(t)})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/vouches/"+vouch.ID+"/credential", bytes.NewReader(raw))
+		req.Header.Set(serviceauth.Header, token)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, withServiceToken("issuance-gateway"))
+	assert.Equal(t, http.StatusUnauthorized, withServiceToken("verifier"), "only the gateway fetches credentials")
+}
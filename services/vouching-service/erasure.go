@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// SubjectExport is what the vouching-service holds on a DID, for the
+// issuance-gateway's subject export
+type SubjectExport struct {
+	Subject  string  `json:"subject"`
+	Received []Vouch `json:"received"`
+	Given    []Vouch `json:"given"`
+}
+
+// SubjectErasure reports the vouches erased with a DID
+type SubjectErasure struct {
+	Subject string `json:"subject"`
+	Erased  int    `json:"erased"`
+	// Revoked counts the erased vouches that were still standing
+	Revoked int `json:"revoked"`
+}
+
+// handleExportSubject returns the vouches a DID gave and received. Only
+// the issuance-gateway may call it, on the subject's behalf.
+func (s *Server) handleExportSubject(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeIssuer(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="issuer"`)
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	subject := chi.URLParam(r, "id")
+	if !didPattern.MatchString(subject) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Subject must be a DID")
+		return
+	}
+	received, err := s.vouches.ListBySubject(r.Context(), subject, "")
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	given, err := s.vouches.ListByVoucher(r.Context(), subject, time.Time{})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, SubjectExport{Subject: subject, Received: received, Given: given})
+}
+
+// handleEraseSubject deletes every vouch a DID gave or received. Standing
+// vouches leave the trust graph and are announced as revoked, so the
+// subject's trust score and anything derived from the vouches go with
+// them. Only the issuance-gateway may call it, on the subject's behalf.
+func (s *Server) handleEraseSubject(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeIssuer(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="issuer"`)
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	subject := chi.URLParam(r, "id")
+	if !didPattern.MatchString(subject) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Subject must be a DID")
+		return
+	}
+	erased, err := s.vouches.Erase(r.Context(), subject)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	now := s.now().UTC()
+	result := SubjectErasure{Subject: subject, Erased: len(erased)}
+	for _, vouch := range erased {
+		if vouch.RevokedAt != nil {
+			continue
+		}
+		result.Revoked++
+		if err := s.trust.graph.RemoveEdge(r.Context(), vouchEdge(vouch)); err != nil {
+			log.Error().Err(err).Str("vouch_id", vouch.ID).Msg("Failed to remove erased vouch from the trust graph")
+		}
+		s.publish(r.Context(), vouch.ID, events.VouchRevoked{
+			VouchID:   vouch.ID,
+			Voucher:   vouch.Voucher,
+			Subject:   vouch.Subject,
+			RevokedAt: now,
+		})
+	}
+	if err := s.notifier.Preferences().Delete(r.Context(), subject); err != nil {
+		log.Error().Err(err).Msg("Failed to erase the subject's notification preferences")
+	}
+	log.Info().Int("erased", result.Erased).Int("revoked", result.Revoked).Msg("Subject's vouches erased")
+	writeJSON(w, http.StatusOK, result)
+}
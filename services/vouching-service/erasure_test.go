@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectErasure(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	bus := events.NewMemory()
+	var revoked []events.VouchRevoked
+	require.NoError(t, bus.Subscribe("test", []string{events.TypeVouchRevoked}, func(ctx context.Context, event events.Event) error {
+		var data events.VouchRevoked
+		require.NoError(t, event.Decode(&data))
+		revoked = append(revoked, data)
+		return nil
+	}))
+	server.events = bus
+	alice, bob, carol := newHolder(t), newHolder(t), newHolder(t)
+
+	given := mustSubmit(t, server, carol, alice.did, "known_personally")
+	received := mustSubmit(t, server, alice, carol.did, "reliable_childminder")
+	withdrawn := mustSubmit(t, server, bob, carol.did, "known_personally")
+	_, err := server.vouches.Revoke(context.Background(), withdrawn.ID, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, server.trust.graph.RemoveEdge(context.Background(), vouchEdge(withdrawn)))
+	unrelated := mustSubmit(t, server, bob, alice.did, "known_personally")
+
+	// The export carries both directions, revoked vouches included
+	w := operatorRequest(t, server, http.MethodGet, "/subjects/"+carol.did+"/export", testIssuerToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var export SubjectExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	assert.Equal(t, carol.did, export.Subject)
+	assert.ElementsMatch(t, []string{received.ID, withdrawn.ID}, vouchIDs(export.Received))
+	assert.Equal(t, []string{given.ID}, vouchIDs(export.Given))
+
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/"+carol.did, testIssuerToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var erasure SubjectErasure
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.Equal(t, SubjectErasure{Subject: carol.did, Erased: 3, Revoked: 2}, erasure)
+	require.NoError(t, bus.Close())
+	require.Len(t, revoked, 2, "the standing vouches are announced as revoked")
+
+	for _, id := range []string{given.ID, received.ID, withdrawn.ID} {
+		assert.Equal(t, http.StatusNotFound, vouchRequest(t, server, http.MethodGet, "/vouches/"+id, nil).Code)
+	}
+	assert.Equal(t, http.StatusOK, vouchRequest(t, server, http.MethodGet, "/vouches/"+unrelated.ID, nil).Code)
+	assert.Zero(t, trustScore(t, server, carol.did, "").VouchCount)
+	assert.Equal(t, 1, trustScore(t, server, alice.did, "").VouchCount, "vouches the subject gave leave the graph")
+
+	// Erasing again finds nothing
+	w = operatorRequest(t, server, http.MethodDelete, "/subjects/"+carol.did, testIssuerToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &erasure))
+	assert.Zero(t, erasure.Erased)
+}
+
+func TestSubjectErasure_Refused(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	alice := newHolder(t)
+
+	assert.Equal(t, http.StatusUnauthorized, operatorRequest(t, server, http.MethodDelete, "/subjects/"+alice.did, "wrong", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, operatorRequest(t, server, http.MethodGet, "/subjects/"+alice.did+"/export", "wrong", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, operatorRequest(t, server, http.MethodDelete, "/subjects/alice", testIssuerToken, nil).Code)
+}
+
+func vouchIDs(vouches []Vouch) []string {
+	ids := make([]string, len(vouches))
+	for i, vouch := range vouches {
+		ids[i] = vouch.ID
+	}
+	return ids
+}
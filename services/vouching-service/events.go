@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/rs/zerolog/log"
+)
+
+// publishTimeout bounds how long vouching waits on the event bus
+const publishTimeout = 5 * time.Second
+
+// publish announces a change to a vouch on the event bus. Failures are
+// logged: the vouch stands whether or not others hear of it.
+func (s *Server) publish(ctx context.Context, vouchID string, data events.Data) {
+	if s.events == nil {
+		return
+	}
+	event, err := events.New("vouching-service", vouchID, data, s.now())
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), publishTimeout)
+		err = s.events.Publish(ctx, event)
+		cancel()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("vouch_id", vouchID).Str("type", data.EventType()).Msg("Failed to publish vouch event")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVouches_PublishEvents(t *testing.T) {
+	bus := events.NewMemory()
+	var published []events.Event
+	require.NoError(t, bus.Subscribe("connector-hub", nil, func(ctx context.Context, event events.Event) error {
+		published = append(published, event)
+		return nil
+	}))
+	server := NewServer()
+	server.events = bus
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	alice, carol := newHolder(t), newHolder(t)
+
+	vouch := mustSubmit(t, server, alice, carol.did, "good_tenant")
+	w := vouchRequest(t, server, http.MethodPost, "/vouches/"+vouch.ID+"/revoke", RevokeVouchRequest{Revocation: alice.signRevocation(t, vouch.ID, now)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, bus.Close())
+
+	require.Len(t, published, 2)
+	var created events.VouchCreated
+	require.NoError(t, published[0].Decode(&created))
+	assert.Equal(t, events.VouchCreated{VouchID: vouch.ID, Voucher: alice.did, Subject: carol.did, VouchType: "good_tenant"}, created)
+	assert.Equal(t, "vouching-service", published[0].Source)
+	assert.Equal(t, vouch.ID, published[0].Subject)
+
+	var revoked events.VouchRevoked
+	require.NoError(t, published[1].Decode(&revoked))
+	assert.Equal(t, vouch.ID, revoked.VouchID)
+	assert.Equal(t, carol.did, revoked.Subject)
+	assert.False(t, revoked.RevokedAt.IsZero())
+}
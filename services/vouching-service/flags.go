@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/rs/zerolog/log"
+)
+
+// Flag severities, as partners rate the disputes and fraud they report
+const (
+	FlagSeverityLow    = "low"
+	FlagSeverityMedium = "medium"
+	FlagSeverityHigh   = "high"
+)
+
+var flagSeverities = []string{FlagSeverityLow, FlagSeverityMedium, FlagSeverityHigh}
+
+// flagEvents raise and clear the partner flags that lower trust scores
+var flagEvents = []string{events.TypeSubjectFlagged, events.TypeSubjectFlagCleared}
+
+// flagGroup is this instance's own consumer group: every instance scores
+// from its own ledger, so each must see every flag event
+func flagGroup() string {
+	host, _ := os.Hostname()
+	group := "vouching-flags-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(host))
+	if len(group) > 63 {
+		group = group[:63]
+	}
+	return strings.TrimRight(group, "-")
+}
+
+// flagLedger keeps the severities of the partner flags standing against
+// each subject, as the connector-hub announces them, in memory (like the
+// trust graph, production should rebuild it from the hub on start)
+type flagLedger struct {
+	mu    sync.RWMutex
+	flags map[string]map[string]string // subject -> flag -> severity
+	// cleared remembers cleared flags, so a redelivered or late
+	// subject.flagged cannot raise them again
+	cleared map[string]bool
+}
+
+func newFlagLedger() *flagLedger {
+	return &flagLedger{flags: make(map[string]map[string]string), cleared: make(map[string]bool)}
+}
+
+// Raise records a flag standing against subject
+func (l *flagLedger) Raise(subject, flag, severity string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cleared[flag] {
+		return
+	}
+	flags, ok := l.flags[subject]
+	if !ok {
+		flags = make(map[string]string)
+		l.flags[subject] = flags
+	}
+	flags[flag] = severity
+}
+
+// Clear drops a flag that no longer stands
+func (l *flagLedger) Clear(subject, flag string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleared[flag] = true
+	delete(l.flags[subject], flag)
+	if len(l.flags[subject]) == 0 {
+		delete(l.flags, subject)
+	}
+}
+
+// Severities returns the severities of the flags standing against subject
+func (l *flagLedger) Severities(subject string) []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	severities := make([]string, 0, len(l.flags[subject]))
+	for _, severity := range l.flags[subject] {
+		severities = append(severities, severity)
+	}
+	return severities
+}
+
+// consumeFlag applies the connector-hub's flag events to the ledger
+func (s *Server) consumeFlag(_ context.Context, event events.Event) error {
+	switch event.Type {
+	case events.TypeSubjectFlagged:
+		var data events.SubjectFlagged
+		if err := event.Decode(&data); err != nil || !didPattern.MatchString(data.Subject) {
+			// Delivering it again would not make it decode
+			log.Warn().Err(err).Str("event_id", event.ID).Msg("Dropping malformed flag event")
+			return nil
+		}
+		s.trust.flags.Raise(data.Subject, data.FlagID, data.Severity)
+		log.Info().Str("flag_id", data.FlagID).Str("partner", data.Partner).Str("severity", data.Severity).Msg("Subject flagged")
+	case events.TypeSubjectFlagCleared:
+		var data events.SubjectFlagCleared
+		if err := event.Decode(&data); err != nil {
+			log.Warn().Err(err).Str("event_id", event.ID).Msg("Dropping malformed flag event")
+			return nil
+		}
+		s.trust.flags.Clear(data.Subject, data.FlagID)
+		log.Info().Str("flag_id", data.FlagID).Str("outcome", data.Outcome).Msg("Subject flag cleared")
+		s.notifyUser(data.Subject, notify.TopicReviewOutcome, map[string]any{"Item": "partner flag", "Outcome": data.Outcome})
+	}
+	return nil
+}
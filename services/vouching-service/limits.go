@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// ErrRateLimited means a voucher vouched too often, or again too soon
+	// after revoking a vouch for the subject
+	ErrRateLimited = errors.New("vouch rate limited")
+	// ErrInsufficientTier means the voucher's quality tier is below what
+	// the vouch type requires
+	ErrInsufficientTier = errors.New("voucher tier too low")
+)
+
+// Limits a voucher can hit, named in rate limited error responses
+const (
+	LimitDaily              = "daily"
+	LimitPerSubject         = "per_subject"
+	LimitRevocationCooldown = "revocation_cooldown"
+)
+
+const vouchLimitWindow = 24 * time.Hour
+
+// RateLimitError names the limit a vouch hit and when the voucher may try
+// again
+type RateLimitError struct {
+	Limit      string
+	Max        int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Limit == LimitRevocationCooldown {
+		return fmt.Sprintf("%v: the voucher revoked a vouch for this subject; retry in %s", ErrRateLimited, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("%v: %s limit of %d vouches a day reached; retry in %s", ErrRateLimited, e.Limit, e.Max, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitError) Unwrap() error { return ErrRateLimited }
+
+// TierError is a vouch refused because its voucher's tier is too low for
+// its type
+type TierError struct {
+	VouchType string
+	Required  string
+	Tier      string
+}
+
+func (e *TierError) Error() string {
+	return fmt.Sprintf("%v: %s vouches need a %s voucher, not %s", ErrInsufficientTier, e.VouchType, e.Required, e.Tier)
+}
+
+func (e *TierError) Unwrap() error { return ErrInsufficientTier }
+
+// VouchPolicy limits how much a voucher can vouch: MaxPerDay vouches in
+// any 24 hours, MaxPerSubjectPerDay of them for one subject, none for a
+// subject within RevocationCooldownDays of revoking a vouch for them, and
+// only vouch types whose MinTier their quality tier reaches
+type VouchPolicy struct {
+	MaxPerDay              int               `json:"maxPerDay"`
+	MaxPerSubjectPerDay    int               `json:"maxPerSubjectPerDay"`
+	RevocationCooldownDays float64           `json:"revocationCooldownDays"`
+	MinTier                map[string]string `json:"minTier"` // vouch type to tier
+}
+
+// DefaultVouchPolicy returns the built-in limits. No vouch type requires a
+// tier unless configured.
+func DefaultVouchPolicy() VouchPolicy {
+	return VouchPolicy{
+		MaxPerDay:              10,
+		MaxPerSubjectPerDay:    2,
+		RevocationCooldownDays: 30,
+		MinTier:                map[string]string{},
+	}
+}
+
+// Validate rejects policies that are out of range or name unknown vouch
+// types or tiers
+func (p VouchPolicy) Validate() error {
+	switch {
+	case p.MaxPerDay <= 0:
+		return errors.New("maxPerDay must be positive")
+	case p.MaxPerSubjectPerDay <= 0:
+		return errors.New("maxPerSubjectPerDay must be positive")
+	case p.RevocationCooldownDays < 0:
+		return errors.New("revocationCooldownDays must not be negative")
+	}
+	for vouchType, tier := range p.MinTier {
+		if _, ok := findVouchType(vouchType); !ok {
+			return fmt.Errorf("minTier names unknown vouch type %q", vouchType)
+		}
+		if !isQualityTier(tier) {
+			return fmt.Errorf("minTier.%s: %w %q", vouchType, ErrUnknownTier, tier)
+		}
+	}
+	return nil
+}
+
+// ParseVouchPolicy decodes a policy document. Fields it omits keep their
+// default values.
+func ParseVouchPolicy(data []byte) (VouchPolicy, error) {
+	policy := DefaultVouchPolicy()
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return VouchPolicy{}, fmt.Errorf("decoding vouch policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return VouchPolicy{}, fmt.Errorf("invalid vouch policy: %w", err)
+	}
+	return policy, nil
+}
+
+// VouchPolicyConfig names the vouch policy, inline or in a file; the
+// defaults apply without either
+type VouchPolicyConfig struct {
+	Inline string `env:"VOUCH_POLICY" doc:"Vouch policy as inline JSON"`
+	File   string `env:"VOUCH_POLICY_FILE" doc:"JSON file of the vouch policy, when VOUCH_POLICY is unset; the built-in policy applies without either"`
+}
+
+// Validate checks an inline policy parses
+func (c VouchPolicyConfig) Validate() error {
+	if c.Inline == "" {
+		return nil
+	}
+	if _, err := ParseVouchPolicy([]byte(c.Inline)); err != nil {
+		return fmt.Errorf("VOUCH_POLICY: %w", err)
+	}
+	return nil
+}
+
+// LoadVouchPolicy reads the policy c names
+func LoadVouchPolicy(c VouchPolicyConfig) (VouchPolicy, error) {
+	if c.Inline != "" {
+		return ParseVouchPolicy([]byte(c.Inline))
+	}
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return VouchPolicy{}, fmt.Errorf("reading vouch policy: %w", err)
+		}
+		return ParseVouchPolicy(data)
+	}
+	return DefaultVouchPolicy(), nil
+}
+
+// tierRank orders quality tiers from unverified up
+func tierRank(tier string) int {
+	for i, t := range qualityTiers {
+		if t == tier {
+			return i
+		}
+	}
+	return -1
+}
+
+// enforceVouchPolicy refuses a vouch its voucher is not allowed to give
+// yet. It is checked before the vouch is stored, so concurrent vouches
+// from one voucher may overshoot a limit by one (production should count
+// in the same transaction).
+func (s *Server) enforceVouchPolicy(ctx context.Context, vouch Vouch) error {
+	if required := s.policy.MinTier[vouch.Type]; required != "" {
+		tier, err := s.trust.graph.Tier(ctx, vouch.Voucher)
+		if err != nil {
+			return err
+		}
+		if tierRank(tier) < tierRank(required) {
+			return &TierError{VouchType: vouch.Type, Required: required, Tier: tier}
+		}
+	}
+
+	now := s.now()
+	cooldown := time.Duration(s.policy.RevocationCooldownDays * float64(24*time.Hour))
+	received, err := s.vouches.ListBySubject(ctx, vouch.Subject, "")
+	if err != nil {
+		return err
+	}
+	for _, previous := range received {
+		if previous.Voucher != vouch.Voucher || previous.RevokedAt == nil {
+			continue
+		}
+		if until := previous.RevokedAt.Add(cooldown); now.Before(until) {
+			return &RateLimitError{Limit: LimitRevocationCooldown, RetryAfter: until.Sub(now)}
+		}
+	}
+
+	// Revoked vouches still count: revoking does not make room for more
+	given, err := s.vouches.ListByVoucher(ctx, vouch.Voucher, now.Add(-vouchLimitWindow))
+	if err != nil {
+		return err
+	}
+	if len(given) >= s.policy.MaxPerDay {
+		oldest := given[s.policy.MaxPerDay-1]
+		return &RateLimitError{Limit: LimitDaily, Max: s.policy.MaxPerDay, RetryAfter: oldest.CreatedAt.Add(vouchLimitWindow).Sub(now)}
+	}
+	var forSubject []Vouch
+	for _, previous := range given {
+		if previous.Subject == vouch.Subject {
+			forSubject = append(forSubject, previous)
+		}
+	}
+	if len(forSubject) >= s.policy.MaxPerSubjectPerDay {
+		oldest := forSubject[s.policy.MaxPerSubjectPerDay-1]
+		return &RateLimitError{Limit: LimitPerSubject, Max: s.policy.MaxPerSubjectPerDay, RetryAfter: oldest.CreatedAt.Add(vouchLimitWindow).Sub(now)}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// at signs claims as of a given time
+func at(when time.Time) func(jwt.MapClaims) {
+	return func(c jwt.MapClaims) { c["iat"] = when.Unix() }
+}
+
+// signRevocation signs the revocation of vouchID
+func (h holder) signRevocation(t *testing.T, vouchID string, when time.Time) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":      h.did,
+		"vouch_id": vouchID,
+		"iat":      when.Unix(),
+		"jti":      uuid.NewString(),
+	})
+	token.Header["typ"] = VouchRevocationJWTType
+	token.Header["kid"] = h.did + "#0"
+	signed, err := token.SignedString(h.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestVouchPolicy_DailyLimit(t *testing.T) {
+	server := NewServer()
+	server.policy.MaxPerDay = 3
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	alice := newHolder(t)
+	for i := 0; i < 3; i++ {
+		mustSubmit(t, server, alice, newHolder(t).did, "known_personally")
+	}
+
+	w := vouchRequest(t, server, http.MethodPost, "/vouches", SubmitVouchRequest{Vouch: alice.sign(t, newHolder(t).did, "known_personally", nil)})
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	var refused VouchErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refused))
+	assert.Equal(t, ErrCodeRateLimited, refused.Error)
+	assert.Equal(t, LimitDaily, refused.Limit)
+	assert.Equal(t, int(vouchLimitWindow.Seconds()), refused.RetryAfter)
+	assert.Equal(t, strconv.Itoa(refused.RetryAfter), w.Header().Get("Retry-After"))
+
+	// The window rolls
+	now = now.Add(vouchLimitWindow + time.Minute)
+	code, _, _ := submit(t, server, alice.sign(t, newHolder(t).did, "known_personally", at(now)))
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestVouchPolicy_PerSubjectLimit(t *testing.T) {
+	server := NewServer()
+	alice, carol := newHolder(t), newHolder(t)
+	mustSubmit(t, server, alice, carol.did, "known_personally")
+	mustSubmit(t, server, alice, carol.did, "good_tenant")
+	code, _, refused := submit(t, server, alice.sign(t, carol.did, "reliable_tradesperson", nil))
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, LimitPerSubject, refused.Limit)
+
+	// Other subjects are unaffected
+	mustSubmit(t, server, alice, newHolder(t).did, "reliable_tradesperson")
+}
+
+func TestVouchPolicy_MinTier(t *testing.T) {
+	server := NewServer()
+	server.policy.MinTier = map[string]string{"reliable_childminder": TierStandard}
+	alice, carol := newHolder(t), newHolder(t)
+
+	code, _, refused := submit(t, server, alice.sign(t, carol.did, "reliable_childminder", nil))
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, ErrCodeInsufficientTier, refused.Error)
+	assert.Equal(t, TierStandard, refused.RequiredTier)
+	assert.Equal(t, TierUnverified, refused.Tier)
+	mustSubmit(t, server, alice, carol.did, "known_personally")
+
+	require.NoError(t, server.trust.graph.SetTier(context.Background(), alice.did, TierPremium))
+	mustSubmit(t, server, alice, carol.did, "reliable_childminder")
+}
+
+func TestVouchRevocation(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	alice, bob, carol := newHolder(t), newHolder(t), newHolder(t)
+	vouch := mustSubmit(t, server, alice, carol.did, "good_tenant")
+	require.Positive(t, trustScore(t, server, carol.did, "").Score)
+	path := "/vouches/" + vouch.ID + "/revoke"
+
+	// Only the voucher can revoke, with a revocation naming the vouch
+	w := vouchRequest(t, server, http.MethodPost, path, RevokeVouchRequest{Revocation: bob.signRevocation(t, vouch.ID, now)})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = vouchRequest(t, server, http.MethodPost, path, RevokeVouchRequest{Revocation: alice.signRevocation(t, "vouch-other", now)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = vouchRequest(t, server, http.MethodPost, path, RevokeVouchRequest{Revocation: alice.sign(t, carol.did, "good_tenant", nil)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = vouchRequest(t, server, http.MethodPost, path, RevokeVouchRequest{Revocation: alice.signRevocation(t, vouch.ID, now)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var revoked Vouch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &revoked))
+	require.NotNil(t, revoked.RevokedAt)
+	assert.Equal(t, http.StatusGone, vouchRequest(t, server, http.MethodPost, path, RevokeVouchRequest{Revocation: alice.signRevocation(t, vouch.ID, now)}).Code)
+
+	// A revoked vouch no longer counts, nor becomes a credential
+	assert.Zero(t, trustScore(t, server, carol.did, "").Score)
+	assert.Equal(t, http.StatusGone, requestCredential(t, server, vouch.ID, carol.thumbprint(t), testIssuerToken).Code)
+
+	// The voucher cools down before vouching for the subject again
+	code, _, refused := submit(t, server, alice.sign(t, carol.did, "good_tenant", nil))
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, LimitRevocationCooldown, refused.Limit)
+	assert.Equal(t, int(30*24*time.Hour/time.Second), refused.RetryAfter)
+	mustSubmit(t, server, alice, bob.did, "good_tenant")
+
+	now = now.Add(31 * 24 * time.Hour)
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "good_tenant", at(now)))
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestParseVouchPolicy(t *testing.T) {
+	policy, err := ParseVouchPolicy([]byte(`{"maxPerDay":5,"minTier":{"reliable_childminder":"premium"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, 5, policy.MaxPerDay)
+	assert.Equal(t, DefaultVouchPolicy().MaxPerSubjectPerDay, policy.MaxPerSubjectPerDay)
+	assert.Equal(t, TierPremium, policy.MinTier["reliable_childminder"])
+
+	for _, doc := range []string{
+		`{"maxPerDay":0}`,
+		`{"maxPerSubjectPerDay":-1}`,
+		`{"revocationCooldownDays":-1}`,
+		`{"minTier":{"best_friend":"gold"}}`,
+		`{"minTier":{"good_tenant":"platinum"}}`,
+		`not json`,
+	} {
+		_, err := ParseVouchPolicy([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestLoadVouchPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"maxPerDay":7}`), 0o600))
+	policy, err := LoadVouchPolicy(VouchPolicyConfig{File: path})
+	require.NoError(t, err)
+	assert.Equal(t, 7, policy.MaxPerDay)
+
+	// Inline JSON wins over the file and is checked when the config loads
+	config := VouchPolicyConfig{Inline: `{"maxPerDay":3}`, File: path}
+	require.NoError(t, config.Validate())
+	policy, err = LoadVouchPolicy(config)
+	require.NoError(t, err)
+	assert.Equal(t, 3, policy.MaxPerDay)
+	assert.ErrorContains(t, VouchPolicyConfig{Inline: `{"maxPerDay":0}`}.Validate(), "VOUCH_POLICY")
+
+	policy, err = LoadVouchPolicy(VouchPolicyConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultVouchPolicy(), policy)
+}
@@ -1,36 +1,98 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
-	"github.com/rs/zerolog/log"
-	"net/http"
+	"context"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/config"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	r := chi.NewRouter()
-	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		if _, err := w.Write([]byte("ok")); err != nil {
-			log.Error().Err(err).Msg("Failed to write health check response")
-		}
-	})
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8090"
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
 	}
-	log.Info().Str("port", port).Msg("Starting vouching-service")
 
-	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// Configure structured logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if cfg.Development() {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
-	if err := server.ListenAndServe(); err != nil {
+	exporting, err := tracing.Init(context.Background(), "vouching-service")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure tracing")
+	}
+	if exporting {
+		log.Info().Msg("Exporting traces over OTLP")
+	}
+
+	server := NewServer()
+	server.issuerToken = cfg.CredentialToken
+	if server.serviceAuth, err = serviceauth.New("vouching-service", cfg.ServiceAuth); err != nil {
+		log.Fatal().Err(err).Msg("Invalid service authentication keys")
+	}
+	if server.issuerToken == "" && server.serviceAuth == nil {
+		log.Warn().Msg("Neither CREDENTIAL_API_TOKEN nor SERVICE_AUTH_PEER_KEYS is set; vouch credentials cannot be issued")
+	}
+	server.operatorToken = cfg.OperatorToken
+	if server.events, err = events.Open(cfg.Events); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the event bus")
+	}
+	if server.events == nil {
+		log.Warn().Msg("EVENT_BUS_URL is unset, so partner flags do not lower trust scores")
+	} else if err := server.events.Subscribe(flagGroup(), flagEvents, server.consumeFlag); err != nil {
+		log.Fatal().Err(err).Msg("Failed to subscribe to flag events")
+	}
+	if server.notifier, err = notify.Open(cfg.Notify, notify.NewMemoryStore()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure notifications")
+	}
+	if channels := server.notifier.Channels(); len(channels) == 0 {
+		log.Warn().Msg("No notification channel is configured, so subjects are not notified")
+	} else {
+		log.Info().Strs("channels", channels).Msg("Notifying subjects")
+	}
+	server.openapi.ValidateResponses = cfg.Development()
+	server.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	scoring, err := LoadTrustScoring(cfg.TrustScoring)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load trust scoring")
+	}
+	server.trust.scoring = scoring
+	policy, err := LoadVouchPolicy(cfg.VouchPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load vouch policy")
+	}
+	server.policy = policy
+	db, err := OpenDatabaseFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open the database")
+	}
+	if db != nil {
+		vouches := newPostgresVouchStore(db.DB)
+		server.vouches = vouches
+		server.health.Require("database", db)
+		server.vouchRequests = newPostgresVouchRequestStore(db.DB)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		edges, err := loadTrustGraph(ctx, server.trust.graph, vouches)
+		cancel()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to rebuild the trust graph")
+		}
+		log.Info().Str("schema", db.Schema()).Int("edges", edges).Msg("Keeping vouches and vouch requests in Postgres")
+	} else {
+		log.Warn().Msg("DATABASE_URL is unset, so vouches and vouch requests are kept in memory and lost on restart")
+	}
+	log.Info().Int("port", cfg.Port).Msg("Starting vouching-service")
+	if err := server.Start(cfg.Addr()); err != nil {
 		log.Fatal().Err(err).Msg("Server failed to start")
 	}
 }
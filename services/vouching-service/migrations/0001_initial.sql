@@ -0,0 +1,25 @@
+-- Accepted vouches. A voucher makes a claim (subject and type) once until
+-- they revoke it, and never reuses a jti.
+CREATE TABLE IF NOT EXISTS vouches (
+	id          text        PRIMARY KEY,
+	voucher     text        NOT NULL,
+	subject     text        NOT NULL,
+	type        text        NOT NULL,
+	nonce       text        NOT NULL,
+	voucher_key text        NOT NULL DEFAULT '',
+	created_at  timestamptz NOT NULL,
+	revoked_at  timestamptz,
+	document    jsonb       NOT NULL,
+	UNIQUE (voucher, nonce)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS vouches_claim_idx ON vouches (voucher, subject, type) WHERE revoked_at IS NULL;
+CREATE INDEX IF NOT EXISTS vouches_subject_idx ON vouches (subject, created_at);
+CREATE INDEX IF NOT EXISTS vouches_voucher_idx ON vouches (voucher, created_at);
+
+-- Subjects' requests for vouches
+CREATE TABLE IF NOT EXISTS vouch_requests (
+	id         text        PRIMARY KEY,
+	status     text        NOT NULL,
+	expires_at timestamptz NOT NULL,
+	document   jsonb       NOT NULL
+);
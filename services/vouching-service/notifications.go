@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// NotificationPreferencesJWTType is the typ header of the bearer JWS a
+// subject manages their notification preferences with
+const NotificationPreferencesJWTType = "notification-preferences+jwt"
+
+// notifyTimeout bounds sending one notification on every channel
+const notifyTimeout = 30 * time.Second
+
+// notificationClaims are the payload of a preferences token: iss is the
+// subject's DID and htm the HTTP method it authorizes, so a token read
+// from a GET cannot erase the preferences
+type notificationClaims struct {
+	jwt.RegisteredClaims
+	Method string `json:"htm"`
+}
+
+// NotificationPreferencesRequest is the body of a PUT: the subject's
+// addresses and the channels they want each topic on
+type NotificationPreferencesRequest struct {
+	Email     string              `json:"email,omitempty"`
+	Phone     string              `json:"phone,omitempty"`
+	PushToken string              `json:"pushToken,omitempty"`
+	Topics    map[string][]string `json:"topics,omitempty"`
+}
+
+// authorizeSubject checks the request carries a recent bearer JWS the
+// subject in the path signed for its method, returning the subject
+func (s *Server) authorizeSubject(r *http.Request) (string, error) {
+	subject := chi.URLParam(r, "id")
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", fmt.Errorf("%w: a bearer token is required", ErrVouchSignature)
+	}
+	var claims notificationClaims
+	if _, err := s.verifyHolderSigned(r.Context(), token, NotificationPreferencesJWTType, &claims); err != nil {
+		return "", err
+	}
+	switch {
+	case claims.IssuedAt == nil:
+		return "", fmt.Errorf("%w: iat is required", ErrInvalidVouch)
+	case s.now().Sub(claims.IssuedAt.Time) > vouchMaxAge:
+		return "", fmt.Errorf("%w: signed more than %s ago", ErrInvalidVouch, vouchMaxAge)
+	case claims.Method != r.Method:
+		return "", fmt.Errorf("%w: the token is for %q, not %s", ErrVouchSignature, claims.Method, r.Method)
+	case claims.Issuer != subject:
+		return "", fmt.Errorf("%w: only the subject may manage their notification preferences", ErrVouchSignature)
+	}
+	return subject, nil
+}
+
+func (s *Server) handleGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	subject, err := s.authorizeSubject(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subject"`)
+		writeStoreError(w, err)
+		return
+	}
+	prefs, err := s.notifier.Preferences().Get(r.Context(), subject)
+	if errors.Is(err, notify.ErrNoPreferences) {
+		writeVouchError(w, http.StatusNotFound, ErrCodeNotFound, "No notification preferences")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// handlePutNotificationPreferences replaces the subject's preferences
+func (s *Server) handlePutNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	subject, err := s.authorizeSubject(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subject"`)
+		writeStoreError(w, err)
+		return
+	}
+	var req NotificationPreferencesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVouchSize)).Decode(&req); err != nil {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Body must be notification preferences")
+		return
+	}
+	prefs := notify.Preferences{
+		User:      subject,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		PushToken: req.PushToken,
+		Topics:    req.Topics,
+		UpdatedAt: s.now().UTC(),
+	}
+	if err := prefs.Validate(); err != nil {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := s.notifier.Preferences().Put(r.Context(), prefs); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Msg("Notification preferences updated")
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// handleDeleteNotificationPreferences stops every notification to the
+// subject
+func (s *Server) handleDeleteNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	subject, err := s.authorizeSubject(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subject"`)
+		writeStoreError(w, err)
+		return
+	}
+	if err := s.notifier.Preferences().Delete(r.Context(), subject); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Msg("Notification preferences deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyUser notifies a subject about topic in the background, on the
+// channels they picked. Failures are logged: what they are notified about
+// stands either way.
+func (s *Server) notifyUser(user, topic string, data map[string]any) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		deliveries, err := s.notifier.Notify(ctx, user, topic, data)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Msg("Failed to notify user")
+			return
+		}
+		for _, delivery := range deliveries {
+			if delivery.Error != "" {
+				log.Warn().Str("topic", topic).Str("channel", delivery.Channel).Str("error", delivery.Error).Msg("Notification not delivered")
+			}
+		}
+	}()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signPreferencesToken signs a token for managing the holder's notification
+// preferences with method; edit adjusts the claims before signing
+func (h holder) signPreferencesToken(t *testing.T, method string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	claims := jwt.MapClaims{"iss": h.did, "htm": method, "iat": time.Now().Unix()}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = NotificationPreferencesJWTType
+	token.Header["kid"] = h.did + "#0"
+	signed, err := token.SignedString(h.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func preferencesRequest(t *testing.T, server *Server, method, subject, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	require.NoError(t, err)
+	if body == nil {
+		raw = nil
+	}
+	req := httptest.NewRequest(method, "/subjects/"+subject+"/notification-preferences", bytes.NewReader(raw))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+// recordingChannel is a notification channel keeping what it was sent
+type recordingChannel struct {
+	mu   sync.Mutex
+	sent map[string][]notify.Message // by address
+}
+
+func (c *recordingChannel) Name() string { return notify.ChannelEmail }
+
+func (c *recordingChannel) Send(_ context.Context, address string, message notify.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent[address] = append(c.sent[address], message)
+	return nil
+}
+
+func (c *recordingChannel) received(address string) []notify.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]notify.Message(nil), c.sent[address]...)
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	server := NewServer()
+	alice, mallory := newHolder(t), newHolder(t)
+	get := func(token string) *httptest.ResponseRecorder {
+		return preferencesRequest(t, server, http.MethodGet, alice.did, token, nil)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusNotFound, get(alice.signPreferencesToken(t, http.MethodGet, nil)).Code)
+
+	prefs := NotificationPreferencesRequest{
+		Email:  "alice@example.com",
+		Phone:  "+447700900123",
+		Topics: map[string][]string{notify.TopicReviewOutcome: {notify.ChannelSMS}},
+	}
+	w := preferencesRequest(t, server, http.MethodPut, alice.did, alice.signPreferencesToken(t, http.MethodPut, nil), prefs)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = get(alice.signPreferencesToken(t, http.MethodGet, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stored notify.Preferences
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stored))
+	assert.Equal(t, alice.did, stored.User)
+	assert.Equal(t, "alice@example.com", stored.Email)
+	assert.Equal(t, []string{notify.ChannelSMS}, stored.Topics[notify.TopicReviewOutcome])
+
+	// Tokens are bound to the subject, the method and a recent time
+	assert.Equal(t, http.StatusUnauthorized, get(mallory.signPreferencesToken(t, http.MethodGet, nil)).Code)
+	assert.Equal(t, http.StatusUnauthorized, preferencesRequest(t, server, http.MethodDelete, alice.did, alice.signPreferencesToken(t, http.MethodGet, nil), nil).Code)
+	assert.Equal(t, http.StatusBadRequest, get(alice.signPreferencesToken(t, http.MethodGet, func(c jwt.MapClaims) {
+		c["iat"] = time.Now().Add(-time.Hour).Unix()
+	})).Code)
+
+	// Channels need an address
+	prefs.Phone = ""
+	w = preferencesRequest(t, server, http.MethodPut, alice.did, alice.signPreferencesToken(t, http.MethodPut, nil), prefs)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "no address for sms")
+
+	assert.Equal(t, http.StatusNoContent, preferencesRequest(t, server, http.MethodDelete, alice.did, alice.signPreferencesToken(t, http.MethodDelete, nil), nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(alice.signPreferencesToken(t, http.MethodGet, nil)).Code)
+}
+
+func TestNotifications_Flows(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	channel := &recordingChannel{sent: make(map[string][]notify.Message)}
+	server.notifier = notify.New(notify.NewMemoryStore(), notify.DefaultTemplates(), channel)
+	alice, bob := newHolder(t), newHolder(t)
+	for address, h := range map[string]holder{"alice@example.com": alice, "bob@example.com": bob} {
+		w := preferencesRequest(t, server, http.MethodPut, h.did, h.signPreferencesToken(t, http.MethodPut, nil), NotificationPreferencesRequest{Email: address})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	receives := func(address string, count int) notify.Message {
+		t.Helper()
+		require.Eventually(t, func() bool { return len(channel.received(address)) == count }, time.Second, 10*time.Millisecond)
+		return channel.received(address)[count-1]
+	}
+
+	// The contact named hears of the request, and the requester of its answer
+	code, req := createVouchRequest(t, server, alice.signRequest(t, "known_personally", func(c jwt.MapClaims) {
+		c["contact"] = bob.did
+		c["message"] = "We met at the climbing club."
+	}))
+	require.Equal(t, http.StatusCreated, code)
+	asked := receives("bob@example.com", 1)
+	assert.Equal(t, notify.TopicVouchRequest, asked.Topic)
+	assert.Contains(t, asked.Body, "We met at the climbing club.")
+	assert.Contains(t, asked.Body, req.DeepLink)
+	require.Equal(t, http.StatusOK, vouchRequest(t, server, http.MethodPost, "/vouch-requests/"+req.ID+"/decline", nil).Code)
+	answered := receives("alice@example.com", 1)
+	assert.Equal(t, "Your vouch request was declined", answered.Subject)
+
+	// Cleared partner flags are review outcomes
+	event, err := events.New("connector-hub", "flg_1", events.SubjectFlagCleared{FlagID: "flg_1", Subject: alice.did, Outcome: "dismissed", ClearedAt: time.Now()}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, server.consumeFlag(context.Background(), event))
+	assert.Equal(t, "Cachet reviewed your partner flag: dismissed.", receives("alice@example.com", 2).Body)
+
+	// Erasure forgets the addresses
+	w := operatorRequest(t, server, http.MethodDelete, "/subjects/"+alice.did, testIssuerToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = server.notifier.Preferences().Get(context.Background(), alice.did)
+	assert.ErrorIs(t, err, notify.ErrNoPreferences)
+}
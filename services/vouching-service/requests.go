@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrVouchRequestNotFound = errors.New("vouch request not found")
+	// ErrVouchRequestClosed means a vouch request was already answered or
+	// has expired
+	ErrVouchRequestClosed = errors.New("vouch request closed")
+)
+
+const (
+	// VouchRequestJWTType is the typ header of a signed vouch request
+	VouchRequestJWTType = "vouch-request+jwt"
+	// VouchRequestEventJWTType is the typ header of the notifications the
+	// service signs for requesters
+	VouchRequestEventJWTType = "vouch-request-event+jwt"
+
+	vouchRequestTTL = 7 * 24 * time.Hour
+	// vouchLinkScheme is the wallet's deep link for answering a request
+	vouchLinkScheme = "cachet://vouch"
+
+	notifyAttempts = 3
+)
+
+// Vouch request states
+const (
+	RequestPending   = "pending"
+	RequestCompleted = "completed"
+	RequestDeclined  = "declined"
+	RequestExpired   = "expired"
+)
+
+// VouchRequest is a subject asking a contact to vouch for them. The contact
+// opens its deep link in their wallet, which answers with a vouch carrying
+// the request's ID in vouch_request, or declines.
+type VouchRequest struct {
+	ID        string `json:"id"`
+	Requester string `json:"requester"`         // the subject's DID
+	Contact   string `json:"contact,omitempty"` // the DID asked, when the requester named one
+	Type      string `json:"type"`
+	Message   string `json:"message,omitempty"`
+	Status    string `json:"status"`
+	// VouchID is the vouch that completed the request
+	VouchID     string     `json:"vouchId,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	AnsweredAt  *time.Time `json:"answeredAt,omitempty"`
+	DeepLink    string     `json:"deepLink"`
+	QRPayload   string     `json:"qrPayload"`
+	CallbackURL string     `json:"callbackUrl,omitempty"`
+}
+
+// statusAt is the request's state at now, which expires it once past
+// ExpiresAt without an answer
+func (r VouchRequest) statusAt(now time.Time) string {
+	if r.Status == RequestPending && now.After(r.ExpiresAt) {
+		return RequestExpired
+	}
+	return r.Status
+}
+
+// vouchRequestClaims is the payload of a signed vouch request
+type vouchRequestClaims struct {
+	jwt.RegisteredClaims
+	VouchType   string `json:"vouch_type"`
+	Contact     string `json:"contact,omitempty"`
+	Message     string `json:"message,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// CreateVouchRequestRequest carries a vouch request signed by the subject:
+// a compact JWS with typ vouch-request+jwt, a kid naming the subject's DID
+// key, and claims iss (the subject's DID), vouch_type, iat and jti, with
+// optional contact, message and callback_url
+type CreateVouchRequestRequest struct {
+	Request string `json:"request"`
+}
+
+// VouchRequestStore persists vouch requests
+type VouchRequestStore interface {
+	Create(ctx context.Context, req VouchRequest) error
+	Get(ctx context.Context, id string) (VouchRequest, error)
+	// Answer moves a pending request to status, completed with vouchID or
+	// declined, returning ErrVouchRequestClosed when it is no longer pending
+	// at at
+	Answer(ctx context.Context, id, status, vouchID string, at time.Time) (VouchRequest, error)
+}
+
+// memoryVouchRequestStore keeps vouch requests in memory (production should
+// use a database)
+type memoryVouchRequestStore struct {
+	mu       sync.Mutex
+	requests map[string]VouchRequest
+}
+
+func newMemoryVouchRequestStore() *memoryVouchRequestStore {
+	return &memoryVouchRequestStore{requests: make(map[string]VouchRequest)}
+}
+
+func (m *memoryVouchRequestStore) Create(ctx context.Context, req VouchRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[req.ID] = req
+	return nil
+}
+
+func (m *memoryVouchRequestStore) Get(ctx context.Context, id string) (VouchRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req, ok := m.requests[id]
+	if !ok {
+		return VouchRequest{}, ErrVouchRequestNotFound
+	}
+	return req, nil
+}
+
+func (m *memoryVouchRequestStore) Answer(ctx context.Context, id, status, vouchID string, at time.Time) (VouchRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req, ok := m.requests[id]
+	if !ok {
+		return VouchRequest{}, ErrVouchRequestNotFound
+	}
+	if req.statusAt(at) != RequestPending {
+		return VouchRequest{}, ErrVouchRequestClosed
+	}
+	req.Status, req.VouchID, req.AnsweredAt = status, vouchID, &at
+	m.requests[id] = req
+	return req, nil
+}
+
+// verifyVouchRequest checks a vouch request signed by its subject
+func (s *Server) verifyVouchRequest(ctx context.Context, signed string) (VouchRequest, error) {
+	var claims vouchRequestClaims
+	if _, err := s.verifyHolderSigned(ctx, signed, VouchRequestJWTType, &claims); err != nil {
+		return VouchRequest{}, err
+	}
+	now := s.now()
+	switch {
+	case claims.IssuedAt == nil || claims.ID == "":
+		return VouchRequest{}, fmt.Errorf("%w: iat and jti are required", ErrInvalidVouch)
+	case now.Sub(claims.IssuedAt.Time) > vouchMaxAge:
+		return VouchRequest{}, fmt.Errorf("%w: signed more than %s ago", ErrInvalidVouch, vouchMaxAge)
+	case claims.Contact != "" && !didPattern.MatchString(claims.Contact):
+		return VouchRequest{}, fmt.Errorf("%w: contact must be a DID", ErrInvalidVouch)
+	case claims.Contact == claims.Issuer:
+		return VouchRequest{}, fmt.Errorf("%w: holders cannot vouch for themselves", ErrInvalidVouch)
+	case len(claims.Message) > maxStatementSize:
+		return VouchRequest{}, fmt.Errorf("%w: message over %d bytes", ErrInvalidVouch, maxStatementSize)
+	case claims.CallbackURL != "" && !validCallbackURL(claims.CallbackURL):
+		return VouchRequest{}, fmt.Errorf("%w: callback_url must be an absolute https URL", ErrInvalidVouch)
+	}
+	if _, ok := findVouchType(claims.VouchType); !ok {
+		return VouchRequest{}, fmt.Errorf("%w: %q", ErrUnknownVouchType, claims.VouchType)
+	}
+	id := "vreq-" + uuid.NewString()
+	link := vouchLinkScheme + "?request_uri=" + url.QueryEscape(s.baseURL+"/vouch-requests/"+id)
+	return VouchRequest{
+		ID:          id,
+		Requester:   claims.Issuer,
+		Contact:     claims.Contact,
+		Type:        claims.VouchType,
+		Message:     claims.Message,
+		Status:      RequestPending,
+		CreatedAt:   now.UTC(),
+		ExpiresAt:   now.Add(vouchRequestTTL).UTC(),
+		DeepLink:    link,
+		QRPayload:   link,
+		CallbackURL: claims.CallbackURL,
+	}, nil
+}
+
+// validCallbackURL accepts absolute https URLs, and http on loopback for
+// local development
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// checkAnswersRequest checks that a vouch answers its request: from the
+// contact asked, if named, for the requester, with the claim requested
+func (s *Server) checkAnswersRequest(ctx context.Context, vouch Vouch) error {
+	req, err := s.vouchRequests.Get(ctx, vouch.RequestID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case req.statusAt(s.now()) != RequestPending:
+		return ErrVouchRequestClosed
+	case vouch.Subject != req.Requester:
+		return fmt.Errorf("%w: the request is for %s", ErrInvalidVouch, req.Requester)
+	case vouch.Type != req.Type:
+		return fmt.Errorf("%w: the request is for a %s vouch", ErrInvalidVouch, req.Type)
+	case req.Contact != "" && vouch.Voucher != req.Contact:
+		return fmt.Errorf("%w: the request was made to another contact", ErrInvalidVouch)
+	}
+	return nil
+}
+
+// completeVouchRequest records the vouch answering its request and notifies
+// the requester. The vouch stands even if another answer got there first.
+func (s *Server) completeVouchRequest(ctx context.Context, vouch Vouch) {
+	req, err := s.vouchRequests.Answer(ctx, vouch.RequestID, RequestCompleted, vouch.ID, s.now().UTC())
+	if err != nil {
+		log.Warn().Err(err).Str("request_id", vouch.RequestID).Str("vouch_id", vouch.ID).Msg("Vouch did not complete its request")
+		return
+	}
+	log.Info().Str("request_id", req.ID).Str("vouch_id", vouch.ID).Msg("Vouch request completed")
+	s.notifyRequester(req)
+}
+
+// notifyRequester tells the requester their request was answered, on the
+// channels they picked, and POSTs it to their callback URL as a JWS the
+// service signs, verifiable against its DID document. Delivery to the
+// callback is retried in the background and dropped after notifyAttempts.
+func (s *Server) notifyRequester(req VouchRequest) {
+	s.notifyUser(req.Requester, notify.TopicVouchRequestAnswered, map[string]any{"Type": req.Type, "Status": req.Status})
+	if req.CallbackURL == "" {
+		return
+	}
+	event, err := s.signer.SignTyped(VouchRequestEventJWTType, jwt.MapClaims{
+		"iss":        vouchIssuer,
+		"sub":        req.Requester,
+		"jti":        uuid.NewString(),
+		"iat":        s.now().Unix(),
+		"request_id": req.ID,
+		"status":     req.Status,
+		"vouch_id":   req.VouchID,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("request_id", req.ID).Msg("Failed to sign vouch request notification")
+		return
+	}
+	go func() {
+		backoff := s.notifyBackoff
+		for attempt := 1; ; attempt++ {
+			err := s.deliverNotification(req.CallbackURL, event)
+			if err == nil {
+				log.Info().Str("request_id", req.ID).Msg("Requester notified")
+				return
+			}
+			if attempt == notifyAttempts {
+				log.Error().Err(err).Str("request_id", req.ID).Msg("Giving up notifying the requester")
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+func (s *Server) deliverNotification(callbackURL, event string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader([]byte(event)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jwt")
+	resp, err := s.notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Server) handleCreateVouchRequest(w http.ResponseWriter, r *http.Request) {
+	var body CreateVouchRequestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVouchSize)).Decode(&body); err != nil || body.Request == "" {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Body must carry a signed vouch request")
+		return
+	}
+	req, err := s.verifyVouchRequest(r.Context(), body.Request)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := s.vouchRequests.Create(r.Context(), req); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Str("request_id", req.ID).Str("type", req.Type).Msg("Vouch requested")
+	if req.Contact != "" {
+		s.notifyUser(req.Contact, notify.TopicVouchRequest, map[string]any{"Type": req.Type, "Message": req.Message, "Link": req.DeepLink})
+	}
+	w.Header().Set("Location", "/vouch-requests/"+req.ID)
+	writeJSON(w, http.StatusCreated, req)
+}
+
+// handleGetVouchRequest shows a request to the contact opening its link and
+// its state to the requester; the unguessable ID is the invitation
+func (s *Server) handleGetVouchRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := s.vouchRequests.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	req.Status = req.statusAt(s.now())
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (s *Server) handleDeclineVouchRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := s.vouchRequests.Answer(r.Context(), chi.URLParam(r, "id"), RequestDeclined, "", s.now().UTC())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Str("request_id", req.ID).Msg("Vouch request declined")
+	s.notifyRequester(req)
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signRequest signs a request for a vouch of vouchType; edit adjusts the
+// claims before signing
+func (h holder) signRequest(t *testing.T, vouchType string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss":        h.did,
+		"vouch_type": vouchType,
+		"iat":        time.Now().Unix(),
+		"jti":        uuid.NewString(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = VouchRequestJWTType
+	token.Header["kid"] = h.did + "#0"
+	signed, err := token.SignedString(h.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func createVouchRequest(t *testing.T, server *Server, signed string) (int, VouchRequest) {
+	t.Helper()
+	w := vouchRequest(t, server, http.MethodPost, "/vouch-requests", CreateVouchRequestRequest{Request: signed})
+	var req VouchRequest
+	if w.Code == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &req))
+	}
+	return w.Code, req
+}
+
+func getVouchRequest(t *testing.T, server *Server, id string) VouchRequest {
+	t.Helper()
+	w := vouchRequest(t, server, http.MethodGet, "/vouch-requests/"+id, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var req VouchRequest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &req))
+	return req
+}
+
+func answering(requestID string) func(jwt.MapClaims) {
+	return func(c jwt.MapClaims) { c["vouch_request"] = requestID }
+}
+
+func TestVouchRequests_Completed(t *testing.T) {
+	events := make(chan string, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events <- string(body)
+	}))
+	defer callback.Close()
+
+	server := NewServer()
+	alice, bob, carol := newHolder(t), newHolder(t), newHolder(t)
+	code, req := createVouchRequest(t, server, carol.signRequest(t, "reliable_childminder", func(c jwt.MapClaims) {
+		c["contact"] = alice.did
+		c["message"] = "Could you vouch for my childminding?"
+		c["callback_url"] = callback.URL
+	}))
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, RequestPending, req.Status)
+	assert.Equal(t, carol.did, req.Requester)
+	assert.Equal(t, alice.did, req.Contact)
+	assert.WithinDuration(t, time.Now().Add(vouchRequestTTL), req.ExpiresAt, time.Minute)
+
+	// The deep link points the contact's wallet at the request
+	link, err := url.Parse(req.DeepLink)
+	require.NoError(t, err)
+	assert.Equal(t, "cachet", link.Scheme)
+	assert.Equal(t, defaultBaseURL+"/vouch-requests/"+req.ID, link.Query().Get("request_uri"))
+	assert.Equal(t, req.DeepLink, req.QRPayload)
+
+	// Only the contact asked can answer, with the claim asked for
+	code, _, _ = submit(t, server, bob.sign(t, carol.did, "reliable_childminder", answering(req.ID)))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "good_tenant", answering(req.ID)))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _, _ = submit(t, server, alice.sign(t, bob.did, "reliable_childminder", answering(req.ID)))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "reliable_childminder", answering("vreq-missing")))
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, vouch, _ := submit(t, server, alice.sign(t, carol.did, "reliable_childminder", answering(req.ID)))
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, req.ID, vouch.RequestID)
+	answered := getVouchRequest(t, server, req.ID)
+	assert.Equal(t, RequestCompleted, answered.Status)
+	assert.Equal(t, vouch.ID, answered.VouchID)
+	assert.NotNil(t, answered.AnsweredAt)
+
+	// The requester is notified with an event the service signs
+	select {
+	case event := <-events:
+		publicKey, err := server.signer.PublicJWK().PublicKey()
+		require.NoError(t, err)
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(event, claims, func(*jwt.Token) (interface{}, error) { return publicKey, nil })
+		require.NoError(t, err)
+		assert.Equal(t, VouchRequestEventJWTType, token.Header["typ"])
+		assert.Equal(t, carol.did, claims["sub"])
+		assert.Equal(t, req.ID, claims["request_id"])
+		assert.Equal(t, RequestCompleted, claims["status"])
+		assert.Equal(t, vouch.ID, claims["vouch_id"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("requester was not notified")
+	}
+
+	// A request is answered once
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "reliable_childminder", func(c jwt.MapClaims) {
+		c["vouch_request"] = req.ID
+		c["statement"] = "again"
+	}))
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, http.StatusConflict, vouchRequest(t, server, http.MethodPost, "/vouch-requests/"+req.ID+"/decline", nil).Code)
+}
+
+func TestVouchRequests_DeclinedAndExpired(t *testing.T) {
+	server := NewServer()
+	alice, carol := newHolder(t), newHolder(t)
+
+	// Without a named contact, anyone with the link may answer
+	code, declined := createVouchRequest(t, server, carol.signRequest(t, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+	w := vouchRequest(t, server, http.MethodPost, "/vouch-requests/"+declined.ID+"/decline", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, RequestDeclined, getVouchRequest(t, server, declined.ID).Status)
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "known_personally", answering(declined.ID)))
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, stale := createVouchRequest(t, server, carol.signRequest(t, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+	later := time.Now().Add(vouchRequestTTL + time.Hour)
+	server.now = func() time.Time { return later }
+	assert.Equal(t, RequestExpired, getVouchRequest(t, server, stale.ID).Status)
+	code, _, _ = submit(t, server, alice.sign(t, carol.did, "known_personally", func(c jwt.MapClaims) {
+		c["vouch_request"] = stale.ID
+		c["iat"] = later.Unix()
+	}))
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, http.StatusNotFound, vouchRequest(t, server, http.MethodGet, "/vouch-requests/vreq-missing", nil).Code)
+}
+
+func TestVouchRequests_Rejected(t *testing.T) {
+	server := NewServer()
+	carol := newHolder(t)
+	for name, signed := range map[string]string{
+		"unknown type":     carol.signRequest(t, "best_friend", nil),
+		"self contact":     carol.signRequest(t, "known_personally", func(c jwt.MapClaims) { c["contact"] = carol.did }),
+		"contact not DID":  carol.signRequest(t, "known_personally", func(c jwt.MapClaims) { c["contact"] = "alice" }),
+		"plain callback":   carol.signRequest(t, "known_personally", func(c jwt.MapClaims) { c["callback_url"] = "http://example.com/hook" }),
+		"long message":     carol.signRequest(t, "known_personally", func(c jwt.MapClaims) { c["message"] = strings.Repeat("x", maxStatementSize+1) }),
+		"stale":            carol.signRequest(t, "known_personally", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-time.Hour).Unix() }),
+		"signed as vouch":  carol.sign(t, newHolder(t).did, "known_personally", nil),
+		"not a JWS at all": "request",
+	} {
+		code, _ := createVouchRequest(t, server, signed)
+		assert.Contains(t, []int{http.StatusBadRequest, http.StatusUnauthorized}, code, name)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNotVoucher means someone other than its voucher tried to revoke a vouch
+var ErrNotVoucher = errors.New("only the voucher can revoke a vouch")
+
+// VouchRevocationJWTType is the typ header of a signed revocation
+const VouchRevocationJWTType = "vouch-revocation+jwt"
+
+// vouchRevocationClaims is the payload of a signed revocation
+type vouchRevocationClaims struct {
+	jwt.RegisteredClaims
+	VouchID string `json:"vouch_id"`
+}
+
+// RevokeVouchRequest carries a revocation signed by the voucher: a compact
+// JWS with typ vouch-revocation+jwt and claims iss (the voucher's DID),
+// vouch_id, iat and jti
+type RevokeVouchRequest struct {
+	Revocation string `json:"revocation"`
+}
+
+// handleRevokeVouch withdraws a vouch at its voucher's request. The claim
+// can be made again once the revocation cooldown has passed.
+func (s *Server) handleRevokeVouch(w http.ResponseWriter, r *http.Request) {
+	var req RevokeVouchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVouchSize)).Decode(&req); err != nil || req.Revocation == "" {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Body must carry a signed revocation")
+		return
+	}
+	vouch, err := s.vouches.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	var claims vouchRevocationClaims
+	if _, err := s.verifyHolderSigned(r.Context(), req.Revocation, VouchRevocationJWTType, &claims); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	switch {
+	case claims.IssuedAt == nil || claims.ID == "":
+		err = fmt.Errorf("%w: iat and jti are required", ErrInvalidVouch)
+	case s.now().Sub(claims.IssuedAt.Time) > vouchMaxAge:
+		err = fmt.Errorf("%w: signed more than %s ago", ErrInvalidVouch, vouchMaxAge)
+	case claims.VouchID != vouch.ID:
+		err = fmt.Errorf("%w: the revocation is for another vouch", ErrInvalidVouch)
+	case claims.Issuer != vouch.Voucher:
+		err = ErrNotVoucher
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	revoked, err := s.vouches.Revoke(r.Context(), vouch.ID, s.now().UTC())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	edge := TrustEdge{VouchID: vouch.ID, Voucher: vouch.Voucher, Subject: vouch.Subject}
+	if err := s.trust.graph.RemoveEdge(r.Context(), edge); err != nil {
+		log.Error().Err(err).Str("vouch_id", vouch.ID).Msg("Failed to remove revoked vouch from the trust graph")
+	}
+	log.Info().Str("vouch_id", vouch.ID).Msg("Vouch revoked")
+	if revoked.RevokedAt != nil {
+		s.publish(r.Context(), vouch.ID, events.VouchRevoked{
+			VouchID:   vouch.ID,
+			Voucher:   vouch.Voucher,
+			Subject:   vouch.Subject,
+			RevokedAt: *revoked.RevokedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, revoked)
+}
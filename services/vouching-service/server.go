@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/deadline"
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/cachet-id/cachet/services/common/pkg/health"
+	"github.com/cachet-id/cachet/services/common/pkg/metrics"
+	"github.com/cachet-id/cachet/services/common/pkg/notify"
+	"github.com/cachet-id/cachet/services/common/pkg/openapi"
+	"github.com/cachet-id/cachet/services/common/pkg/serviceauth"
+	"github.com/cachet-id/cachet/services/common/pkg/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultBaseURL is the service's public URL, under its did:web
+const defaultBaseURL = "https://vouching.cachet.id"
+
+type Server struct {
+	router *chi.Mux
+	// vouches are the accepted vouches; dids resolves vouchers' keys to
+	// check the vouches' signatures
+	vouches VouchStore
+	dids    *didresolver.Resolver
+	// policy limits how much and what holders may vouch
+	policy VouchPolicy
+	// signer countersigns vouch credentials, which the issuance-gateway
+	// fetches with issuerToken; empty disables credential issuance
+	signer      *Signer
+	issuerToken string
+	// serviceAuth, when set, also lets the issuance-gateway in with its
+	// service token
+	serviceAuth *serviceauth.Authenticator
+	// trust scores subjects over the graph of accepted vouches, less the
+	// partner flags the connector-hub announces against them, and abuse
+	// flags collusive clusters in it for operators, who review them with
+	// operatorToken; empty disables the review API
+	trust         *trustScorer
+	abuse         *abuseDetector
+	operatorToken string
+	// vouchRequests are subjects' requests for vouches, answered through
+	// deep links under baseURL; requesters are notified with notifyClient
+	vouchRequests VouchRequestStore
+	baseURL       string
+	notifyClient  *http.Client
+	notifyBackoff time.Duration
+	// notifier tells subjects of requests, answers and reviews by email,
+	// SMS or push, as their notification preferences ask
+	notifier *notify.Notifier
+	// health checks the Postgres pool behind the vouch and request stores,
+	// when they are not kept in memory
+	health  *health.Monitor
+	metrics *metrics.Metrics
+	now     func() time.Time
+	// openapi refuses requests that do not match the API document
+	openapi *openapi.Validator
+	// events announces accepted and revoked vouches to the other services;
+	// nil when no event bus is configured
+	events events.Bus
+}
+
+func NewServer() *Server {
+	s := &Server{
+		router:  chi.NewRouter(),
+		vouches: newMemoryVouchStore(),
+		dids:    didresolver.New(),
+		signer:  NewSigner(),
+		policy:  DefaultVouchPolicy(),
+		// Requests and notifications
+		vouchRequests: newMemoryVouchRequestStore(),
+		baseURL:       defaultBaseURL,
+		notifyClient:  deadline.NewClient("requester-callback"),
+		notifyBackoff: time.Second,
+		notifier:      notify.New(notify.NewMemoryStore(), notify.DefaultTemplates()),
+		health:        health.New("vouching-service"),
+		metrics:       metrics.New("vouching-service"),
+		now:           time.Now,
+	}
+	graph := newMemoryTrustGraph()
+	s.trust = &trustScorer{graph: graph, flags: newFlagLedger(), scoring: DefaultTrustScoring(), now: func() time.Time { return s.now() }}
+	s.abuse = &abuseDetector{graph: graph, store: newMemoryAbuseStore(), rules: DefaultAbuseRules(), now: func() time.Time { return s.now() }}
+	validator, err := openapi.New(openapiDocument)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Embedded OpenAPI document is invalid")
+	}
+	s.openapi = validator
+	s.setupMiddleware()
+	s.setupRoutes()
+	return s
+}
+
+func (s *Server) setupMiddleware() {
+	s.router.Use(tracing.Middleware("vouching-service"))
+	s.router.Use(s.metrics.Middleware)
+	s.router.Use(middleware.RequestID)
+	s.router.Use(middleware.RealIP)
+	s.router.Use(middleware.Logger)
+	s.router.Use(middleware.Recoverer)
+	s.router.Use(s.openapi.Middleware)
+	s.router.Use(deadline.Middleware(deadline.BudgetFromEnv()))
+}
+
+func (s *Server) setupRoutes() {
+	// Note: /healthz is reserved by Cloud Run infrastructure - use /health instead
+	s.router.Get("/health", s.health.Health)
+	s.router.Get("/livez", s.health.Live)
+	s.router.Get("/readyz", s.health.Ready)
+	s.router.Handle("/metrics", s.metrics.Handler())
+
+	s.router.Get("/vouch-types", s.handleListVouchTypes)
+	// Holders vouch for one another with vouches signed by their DID key
+	s.router.Post("/vouches", s.handleSubmitVouch)
+	s.router.Get("/vouches/{id}", s.handleGetVouch)
+	s.router.Post("/vouches/{id}/revoke", s.handleRevokeVouch)
+	s.router.Get("/subjects/{id}/vouches", s.handleListSubjectVouches)
+	// The issuance-gateway exports and erases subjects' vouches for them
+	s.router.Get("/subjects/{id}/export", s.handleExportSubject)
+	s.router.Delete("/subjects/{id}", s.handleEraseSubject)
+
+	// Subjects ask contacts for vouches through a deep link to the request
+	s.router.Post("/vouch-requests", s.handleCreateVouchRequest)
+	s.router.Get("/vouch-requests/{id}", s.handleGetVouchRequest)
+	s.router.Post("/vouch-requests/{id}/decline", s.handleDeclineVouchRequest)
+
+	// Trust scores for verifier pack predicates, weighted by the vouchers'
+	// quality tiers, which the issuance-gateway records
+	s.router.Get("/subjects/{id}/trust-score", s.handleTrustScore)
+	s.router.Put("/subjects/{id}/tier", s.handleSetTier)
+
+	// Subjects pick where they are notified, with tokens their DID key signs
+	s.router.Get("/subjects/{id}/notification-preferences", s.handleGetNotificationPreferences)
+	s.router.Put("/subjects/{id}/notification-preferences", s.handlePutNotificationPreferences)
+	s.router.Delete("/subjects/{id}/notification-preferences", s.handleDeleteNotificationPreferences)
+
+	// Anti-abuse: the issuance-gateway reports device signals, and operators
+	// review the clusters flagged as collusive
+	s.router.Post("/device-signals", s.handleRecordDeviceSignal)
+	s.router.Get("/abuse/clusters", s.handleListClusters)
+	s.router.Get("/abuse/clusters/{id}", s.handleGetCluster)
+	s.router.Post("/abuse/clusters/{id}/review", s.handleReviewCluster)
+
+	// Vouches as credentials, delivered to subjects' wallets by the issuance-gateway
+	s.router.Get("/.well-known/did.json", s.handleDIDDocument)
+	s.router.Post("/vouches/{id}/credential", s.handleIssueVouchCredential)
+}
+
+func (s *Server) Start(addr string) error {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      s.router,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
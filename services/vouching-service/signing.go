@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cachet-id/cachet/services/common/pkg/didresolver"
+	"github.com/cachet-id/cachet/services/common/pkg/signing"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// vouchIssuer identifies the vouching-service as the issuer countersigning
+// vouch credentials. Under did:web it resolves to
+// https://vouching.cachet.id/.well-known/did.json.
+const vouchIssuer = "did:web:vouching.cachet.id"
+
+// Signer produces JWS signatures with the service's key, naming it by its
+// DID URL
+type Signer struct {
+	*signing.Signer
+}
+
+func NewSigner() *Signer {
+	// Generate an ECDSA key for JWS signing (in production, load from secure storage)
+	signer, err := signing.Generate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate vouching signing key")
+	}
+	return &Signer{Signer: signer}
+}
+
+// SignTyped returns a compact JWS over claims with the given typ header,
+// naming the key by its DID URL
+func (s *Signer) SignTyped(typ string, claims jwt.Claims) (string, error) {
+	token := s.Token(typ, claims)
+	token.Header["kid"] = vouchIssuer + "#" + s.KeyID()
+	return s.SignToken(token)
+}
+
+// handleDIDDocument publishes the key verifiers check vouch credentials with
+func (s *Server) handleDIDDocument(w http.ResponseWriter, r *http.Request) {
+	jwk := s.signer.PublicJWK()
+	id := vouchIssuer + "#" + jwk.Kid
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, didresolver.Document{
+		ID:                 vouchIssuer,
+		VerificationMethod: []didresolver.VerificationMethod{{ID: id, Type: "JsonWebKey2020", Controller: vouchIssuer, PublicKeyJwk: &jwk}},
+		AssertionMethod:    []string{id},
+	})
+}
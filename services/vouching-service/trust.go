@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownTier means a quality tier is not one the issuance-gateway assigns
+var ErrUnknownTier = errors.New("unknown quality tier")
+
+// Quality tiers, as the issuance-gateway assigns them to verified holders.
+// Holders it has not verified are TierUnverified.
+const (
+	TierUnverified = "unverified"
+	TierBasic      = "basic"
+	TierStandard   = "standard"
+	TierPremium    = "premium"
+	TierGold       = "gold"
+)
+
+var qualityTiers = []string{TierUnverified, TierBasic, TierStandard, TierPremium, TierGold}
+
+func isQualityTier(tier string) bool {
+	for _, t := range qualityTiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// Trust scoring algorithms
+const (
+	// AlgorithmTierWeighted weighs each voucher by their own quality tier
+	AlgorithmTierWeighted = "tier_weighted"
+	// AlgorithmPropagated also lets a voucher who is well vouched for weigh
+	// more than their tier alone, following the graph up to maxDepth hops
+	AlgorithmPropagated = "propagated"
+)
+
+// TrustEdge is a vouch in the trust graph, from voucher to subject
+type TrustEdge struct {
+	VouchID    string
+	Voucher    string
+	VoucherKey string // thumbprint of the key the voucher signed with
+	Subject    string
+	Type       string
+	VouchedAt  time.Time
+}
+
+// TrustGraph persists the vouch edges between holders and the quality tier
+// of each holder, which weighs the vouches they give
+type TrustGraph interface {
+	AddEdge(ctx context.Context, edge TrustEdge) error
+	// RemoveEdge drops a revoked vouch from the graph
+	RemoveEdge(ctx context.Context, edge TrustEdge) error
+	// InEdges returns the vouches subject received, of vouchType when set
+	InEdges(ctx context.Context, subject, vouchType string) ([]TrustEdge, error)
+	// OutEdges returns the vouches voucher gave
+	OutEdges(ctx context.Context, voucher string) ([]TrustEdge, error)
+	SetTier(ctx context.Context, holder, tier string) error
+	// Tier returns the holder's quality tier, TierUnverified when unknown
+	Tier(ctx context.Context, holder string) (string, error)
+}
+
+// memoryTrustGraph keeps the graph in memory (production should use a
+// database with indexes on both ends of an edge)
+type memoryTrustGraph struct {
+	mu    sync.RWMutex
+	in    map[string][]TrustEdge
+	out   map[string][]TrustEdge
+	tiers map[string]string
+}
+
+func newMemoryTrustGraph() *memoryTrustGraph {
+	return &memoryTrustGraph{
+		in:    make(map[string][]TrustEdge),
+		out:   make(map[string][]TrustEdge),
+		tiers: make(map[string]string),
+	}
+}
+
+func (m *memoryTrustGraph) AddEdge(ctx context.Context, edge TrustEdge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.in[edge.Subject] = append(m.in[edge.Subject], edge)
+	m.out[edge.Voucher] = append(m.out[edge.Voucher], edge)
+	return nil
+}
+
+func (m *memoryTrustGraph) RemoveEdge(ctx context.Context, edge TrustEdge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	without := func(edges []TrustEdge) []TrustEdge {
+		kept := edges[:0:0]
+		for _, e := range edges {
+			if e.VouchID != edge.VouchID {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	}
+	m.in[edge.Subject] = without(m.in[edge.Subject])
+	m.out[edge.Voucher] = without(m.out[edge.Voucher])
+	return nil
+}
+
+func (m *memoryTrustGraph) InEdges(ctx context.Context, subject, vouchType string) ([]TrustEdge, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	edges := []TrustEdge{}
+	for _, edge := range m.in[subject] {
+		if vouchType == "" || edge.Type == vouchType {
+			edges = append(edges, edge)
+		}
+	}
+	return edges, nil
+}
+
+func (m *memoryTrustGraph) OutEdges(ctx context.Context, voucher string) ([]TrustEdge, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]TrustEdge{}, m.out[voucher]...), nil
+}
+
+func (m *memoryTrustGraph) SetTier(ctx context.Context, holder, tier string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tiers[holder] = tier
+	return nil
+}
+
+func (m *memoryTrustGraph) Tier(ctx context.Context, holder string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if tier, ok := m.tiers[holder]; ok {
+		return tier, nil
+	}
+	return TierUnverified, nil
+}
+
+// TrustScoring configures how vouches add up to a trust score. A vouch
+// weighs its voucher's tier weight, halved every HalfLifeDays since it was
+// given; a voucher's several vouches for a subject count once, at their
+// heaviest. The score is the weights' sum over Saturation, capped at 1,
+// less the FlagPenalties of the partner flags standing against the subject.
+type TrustScoring struct {
+	Algorithm    string             `json:"algorithm"`
+	TierWeights  map[string]float64 `json:"tierWeights"`
+	HalfLifeDays float64            `json:"halfLifeDays"` // 0 disables decay
+	Saturation   float64            `json:"saturation"`
+	// Damping scales a voucher's own score when it propagates, and MaxDepth
+	// bounds how far; both apply to AlgorithmPropagated only
+	Damping  float64 `json:"damping"`
+	MaxDepth int     `json:"maxDepth"`
+	// FlagPenalties is what a standing flag takes off, by severity
+	FlagPenalties map[string]float64 `json:"flagPenalties"`
+}
+
+// DefaultTrustScoring returns the built-in scoring rules
+func DefaultTrustScoring() TrustScoring {
+	return TrustScoring{
+		Algorithm: AlgorithmTierWeighted,
+		TierWeights: map[string]float64{
+			TierUnverified: 0.25,
+			TierBasic:      0.5,
+			TierStandard:   0.75,
+			TierPremium:    0.9,
+			TierGold:       1,
+		},
+		HalfLifeDays: 365,
+		Saturation:   5,
+		Damping:      0.5,
+		MaxDepth:     2,
+		FlagPenalties: map[string]float64{
+			FlagSeverityLow:    0.05,
+			FlagSeverityMedium: 0.15,
+			FlagSeverityHigh:   0.3,
+		},
+	}
+}
+
+// Validate rejects scoring rules that are out of range
+func (c TrustScoring) Validate() error {
+	if c.Algorithm != AlgorithmTierWeighted && c.Algorithm != AlgorithmPropagated {
+		return fmt.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+	for _, tier := range qualityTiers {
+		weight, ok := c.TierWeights[tier]
+		if !ok {
+			return fmt.Errorf("tierWeights.%s is required", tier)
+		}
+		if weight < 0 || weight > 1 {
+			return fmt.Errorf("tierWeights.%s must be between 0 and 1", tier)
+		}
+	}
+	for _, severity := range flagSeverities {
+		penalty, ok := c.FlagPenalties[severity]
+		if !ok {
+			return fmt.Errorf("flagPenalties.%s is required", severity)
+		}
+		if penalty < 0 || penalty > 1 {
+			return fmt.Errorf("flagPenalties.%s must be between 0 and 1", severity)
+		}
+	}
+	switch {
+	case c.HalfLifeDays < 0:
+		return errors.New("halfLifeDays must not be negative")
+	case c.Saturation <= 0:
+		return errors.New("saturation must be positive")
+	case c.Damping < 0 || c.Damping > 1:
+		return errors.New("damping must be between 0 and 1")
+	case c.MaxDepth < 0:
+		return errors.New("maxDepth must not be negative")
+	}
+	return nil
+}
+
+// ParseTrustScoring decodes a scoring document. Fields it omits keep their
+// default values.
+func ParseTrustScoring(data []byte) (TrustScoring, error) {
+	scoring := DefaultTrustScoring()
+	if err := json.Unmarshal(data, &scoring); err != nil {
+		return TrustScoring{}, fmt.Errorf("decoding trust scoring: %w", err)
+	}
+	if err := scoring.Validate(); err != nil {
+		return TrustScoring{}, fmt.Errorf("invalid trust scoring: %w", err)
+	}
+	return scoring, nil
+}
+
+// TrustScoringConfig names the trust scoring rules, inline or in a file;
+// the defaults apply without either
+type TrustScoringConfig struct {
+	Inline string `env:"TRUST_SCORING" doc:"Trust scoring rules as inline JSON"`
+	File   string `env:"TRUST_SCORING_FILE" doc:"JSON file of trust scoring rules, when TRUST_SCORING is unset; the built-in rules apply without either"`
+}
+
+// Validate checks inline rules parse
+func (c TrustScoringConfig) Validate() error {
+	if c.Inline == "" {
+		return nil
+	}
+	if _, err := ParseTrustScoring([]byte(c.Inline)); err != nil {
+		return fmt.Errorf("TRUST_SCORING: %w", err)
+	}
+	return nil
+}
+
+// LoadTrustScoring reads the scoring rules c names
+func LoadTrustScoring(c TrustScoringConfig) (TrustScoring, error) {
+	if c.Inline != "" {
+		return ParseTrustScoring([]byte(c.Inline))
+	}
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return TrustScoring{}, fmt.Errorf("reading trust scoring: %w", err)
+		}
+		return ParseTrustScoring(data)
+	}
+	return DefaultTrustScoring(), nil
+}
+
+// TrustScore is a subject's trust score, between 0 and 1
+type TrustScore struct {
+	Subject      string  `json:"subject"`
+	Type         string  `json:"type,omitempty"`
+	Algorithm    string  `json:"algorithm"`
+	Score        float64 `json:"score"`
+	VouchCount   int     `json:"vouchCount"`
+	VoucherCount int     `json:"voucherCount"`
+	// FlagCount is the partner flags standing against the subject, which
+	// took FlagPenalty off the score
+	FlagCount   int       `json:"flagCount"`
+	FlagPenalty float64   `json:"flagPenalty"`
+	ComputedAt  time.Time `json:"computedAt"`
+}
+
+// trustScorer computes trust scores over a graph, less the flags standing
+// against the subject
+type trustScorer struct {
+	graph   TrustGraph
+	flags   *flagLedger
+	scoring TrustScoring
+	now     func() time.Time
+}
+
+// Score computes subject's trust score from the vouches of vouchType it
+// received, or from all of them when vouchType is empty
+func (t *trustScorer) Score(ctx context.Context, subject, vouchType string) (TrustScore, error) {
+	depth := 0
+	if t.scoring.Algorithm == AlgorithmPropagated {
+		depth = t.scoring.MaxDepth
+	}
+	score, edges, vouchers, err := t.score(ctx, subject, vouchType, depth, map[string]bool{subject: true})
+	if err != nil {
+		return TrustScore{}, err
+	}
+	// Flags weigh on the subject's own score only, not on what they lend
+	// their vouchees
+	flags := t.flags.Severities(subject)
+	penalty := 0.0
+	for _, severity := range flags {
+		penalty += t.scoring.FlagPenalties[severity]
+	}
+	return TrustScore{
+		Subject:      subject,
+		Type:         vouchType,
+		Algorithm:    t.scoring.Algorithm,
+		Score:        math.Max(0, score-penalty),
+		VouchCount:   edges,
+		VoucherCount: vouchers,
+		FlagCount:    len(flags),
+		FlagPenalty:  penalty,
+		ComputedAt:   t.now().UTC(),
+	}, nil
+}
+
+// score sums the weights of subject's vouchers; path holds the holders
+// already on the walk, so a cycle cannot raise its own members' scores
+func (t *trustScorer) score(ctx context.Context, subject, vouchType string, depth int, path map[string]bool) (float64, int, int, error) {
+	edges, err := t.graph.InEdges(ctx, subject, vouchType)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	weights := map[string]float64{}
+	for _, edge := range edges {
+		weight := t.decay(edge.VouchedAt)
+		if weight > weights[edge.Voucher] {
+			weights[edge.Voucher] = weight
+		}
+	}
+	total := 0.0
+	for voucher, decay := range weights {
+		weight, err := t.voucherWeight(ctx, voucher, depth, path)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		total += weight * decay
+	}
+	return math.Min(1, total/t.scoring.Saturation), len(edges), len(weights), nil
+}
+
+// voucherWeight is the weight of the voucher's tier or, when propagating,
+// of their own damped score if that is higher
+func (t *trustScorer) voucherWeight(ctx context.Context, voucher string, depth int, path map[string]bool) (float64, error) {
+	tier, err := t.graph.Tier(ctx, voucher)
+	if err != nil {
+		return 0, err
+	}
+	weight := t.scoring.TierWeights[tier]
+	if depth == 0 || path[voucher] {
+		return weight, nil
+	}
+	path[voucher] = true
+	defer delete(path, voucher)
+	// A voucher's standing comes from all the vouches they received
+	own, _, _, err := t.score(ctx, voucher, "", depth-1, path)
+	if err != nil {
+		return 0, err
+	}
+	return math.Max(weight, t.scoring.Damping*own), nil
+}
+
+func (t *trustScorer) decay(vouchedAt time.Time) float64 {
+	if t.scoring.HalfLifeDays == 0 {
+		return 1
+	}
+	age := t.now().Sub(vouchedAt).Hours() / 24
+	if age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, age/t.scoring.HalfLifeDays)
+}
+
+// SetTierRequest records a holder's quality tier
+type SetTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+func (s *Server) handleTrustScore(w http.ResponseWriter, r *http.Request) {
+	subject := chi.URLParam(r, "id")
+	if !didPattern.MatchString(subject) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Subject must be a DID")
+		return
+	}
+	vouchType := r.URL.Query().Get("type")
+	if _, ok := findVouchType(vouchType); vouchType != "" && !ok {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeUnknownVouchType, "Unknown vouch type "+vouchType)
+		return
+	}
+	score, err := s.trust.Score(r.Context(), subject, vouchType)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, score)
+}
+
+// handleSetTier records the tier the issuance-gateway verified a holder at,
+// with the same token it fetches vouch credentials with
+func (s *Server) handleSetTier(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeIssuer(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="issuer"`)
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+	holder := chi.URLParam(r, "id")
+	if !didPattern.MatchString(holder) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Holder must be a DID")
+		return
+	}
+	var req SetTierRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if !isQualityTier(req.Tier) {
+		writeStoreError(w, fmt.Errorf("%w: %q", ErrUnknownTier, req.Tier))
+		return
+	}
+	if err := s.trust.graph.SetTier(r.Context(), holder, req.Tier); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	log.Info().Str("holder", holder).Str("tier", req.Tier).Msg("Holder tier recorded")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setTier(t *testing.T, server *Server, holder, tier, token string) int {
+	t.Helper()
+	raw, err := json.Marshal(SetTierRequest{Tier: tier})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPut, "/subjects/"+holder+"/tier", bytes.NewReader(raw))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func trustScore(t *testing.T, server *Server, subject, query string) TrustScore {
+	t.Helper()
+	w := vouchRequest(t, server, http.MethodGet, "/subjects/"+subject+"/trust-score"+query, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var score TrustScore
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &score))
+	return score
+}
+
+func TestTrustScore_WeightedByVoucherTier(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	gold, anon, carol := newHolder(t), newHolder(t), newHolder(t)
+	require.Equal(t, http.StatusNoContent, setTier(t, server, gold.did, TierGold, testIssuerToken))
+
+	assert.Zero(t, trustScore(t, server, carol.did, "").Score)
+	code, _, _ := submit(t, server, gold.sign(t, carol.did, "reliable_childminder", nil))
+	require.Equal(t, http.StatusCreated, code)
+	score := trustScore(t, server, carol.did, "")
+	assert.Equal(t, AlgorithmTierWeighted, score.Algorithm)
+	assert.InDelta(t, 1.0/5, score.Score, 1e-9)
+
+	// An unverified voucher counts for a quarter of a gold one
+	code, _, _ = submit(t, server, anon.sign(t, carol.did, "reliable_childminder", nil))
+	require.Equal(t, http.StatusCreated, code)
+	assert.InDelta(t, 1.25/5, trustScore(t, server, carol.did, "").Score, 1e-9)
+
+	// Several claims by one voucher count once
+	code, _, _ = submit(t, server, gold.sign(t, carol.did, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+	score = trustScore(t, server, carol.did, "")
+	assert.InDelta(t, 1.25/5, score.Score, 1e-9)
+	assert.Equal(t, 3, score.VouchCount)
+	assert.Equal(t, 2, score.VoucherCount)
+
+	score = trustScore(t, server, carol.did, "?type=known_personally")
+	assert.Equal(t, "known_personally", score.Type)
+	assert.InDelta(t, 1.0/5, score.Score, 1e-9)
+	assert.Equal(t, http.StatusBadRequest, vouchRequest(t, server, http.MethodGet, "/subjects/"+carol.did+"/trust-score?type=unknown", nil).Code)
+}
+
+func TestTrustScore_Decay(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	for i, age := range []time.Duration{0, 365 * 24 * time.Hour, 730 * 24 * time.Hour} {
+		require.NoError(t, server.trust.graph.AddEdge(ctx, TrustEdge{
+			Voucher:   "did:example:voucher" + string(rune('a'+i)),
+			Subject:   "did:example:carol",
+			Type:      "known_personally",
+			VouchedAt: now.Add(-age),
+		}))
+	}
+	// Unverified vouchers, halved each year
+	assert.InDelta(t, 0.25*(1+0.5+0.25)/5, trustScore(t, server, "did:example:carol", "").Score, 1e-9)
+
+	server.trust.scoring.HalfLifeDays = 0
+	assert.InDelta(t, 0.25*3/5, trustScore(t, server, "did:example:carol", "").Score, 1e-9)
+}
+
+func TestTrustScore_Propagated(t *testing.T) {
+	server := NewServer()
+	ctx := context.Background()
+	server.trust.scoring.Algorithm = AlgorithmPropagated
+	server.trust.scoring.Saturation = 1
+	server.trust.scoring.Damping = 1
+	vouch := func(voucher, subject string) {
+		require.NoError(t, server.trust.graph.AddEdge(ctx, TrustEdge{Voucher: voucher, Subject: subject, Type: "known_personally", VouchedAt: time.Now()}))
+	}
+	require.NoError(t, server.trust.graph.SetTier(ctx, "did:example:gold1", TierGold))
+	require.NoError(t, server.trust.graph.SetTier(ctx, "did:example:gold2", TierGold))
+	vouch("did:example:gold1", "did:example:bob")
+	vouch("did:example:gold2", "did:example:bob")
+	vouch("did:example:bob", "did:example:carol")
+
+	// Bob is unverified but well vouched for, so their vouch carries their score
+	assert.InDelta(t, 1, trustScore(t, server, "did:example:carol", "").Score, 1e-9)
+	server.trust.scoring.Algorithm = AlgorithmTierWeighted
+	assert.InDelta(t, 0.25, trustScore(t, server, "did:example:carol", "").Score, 1e-9)
+
+	// A ring of unverified holders cannot lift itself
+	server.trust.scoring.Algorithm = AlgorithmPropagated
+	vouch("did:example:x", "did:example:y")
+	vouch("did:example:y", "did:example:z")
+	vouch("did:example:z", "did:example:x")
+	assert.InDelta(t, 0.25, trustScore(t, server, "did:example:x", "").Score, 1e-9)
+}
+
+func TestTrustScore_SetTier(t *testing.T) {
+	server := NewServer()
+	carol := newHolder(t)
+	assert.Equal(t, http.StatusUnauthorized, setTier(t, server, carol.did, TierGold, testIssuerToken))
+	server.issuerToken = testIssuerToken
+	assert.Equal(t, http.StatusUnauthorized, setTier(t, server, carol.did, TierGold, "wrong"))
+	assert.Equal(t, http.StatusBadRequest, setTier(t, server, carol.did, "platinum", testIssuerToken))
+	assert.Equal(t, http.StatusBadRequest, setTier(t, server, "carol", TierGold, testIssuerToken))
+	assert.Equal(t, http.StatusNoContent, setTier(t, server, carol.did, TierPremium, testIssuerToken))
+	tier, err := server.trust.graph.Tier(context.Background(), carol.did)
+	require.NoError(t, err)
+	assert.Equal(t, TierPremium, tier)
+}
+
+func TestTrustScore_PartnerFlags(t *testing.T) {
+	server := NewServer()
+	server.issuerToken = testIssuerToken
+	bus := events.NewMemory()
+	t.Cleanup(func() { _ = bus.Close() })
+	require.NoError(t, bus.Subscribe(flagGroup(), flagEvents, server.consumeFlag))
+	gold, carol := newHolder(t), newHolder(t)
+	require.Equal(t, http.StatusNoContent, setTier(t, server, gold.did, TierGold, testIssuerToken))
+	code, _, _ := submit(t, server, gold.sign(t, carol.did, "reliable_childminder", nil))
+	require.Equal(t, http.StatusCreated, code)
+	publish := func(data events.Data) {
+		event, err := events.New("connector-hub", "flg_1", data, time.Now())
+		require.NoError(t, err)
+		require.NoError(t, bus.Publish(context.Background(), event))
+	}
+	scoreIs := func(want float64, flags int) {
+		require.Eventually(t, func() bool {
+			score := trustScore(t, server, carol.did, "")
+			return math.Abs(score.Score-want) < 1e-9 && score.FlagCount == flags
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	dispute := events.SubjectFlagged{FlagID: "flg_1", Subject: carol.did, Partner: "market.example", Kind: "dispute", Severity: FlagSeverityMedium, FlaggedAt: time.Now()}
+	publish(dispute)
+	scoreIs(1.0/5-0.15, 1)
+	publish(dispute)
+	scoreIs(1.0/5-0.15, 1)
+	publish(events.SubjectFlagged{FlagID: "flg_2", Subject: carol.did, Partner: "market.example", Kind: "fraud", Severity: FlagSeverityHigh, FlaggedAt: time.Now()})
+	scoreIs(0, 2)
+	assert.InDelta(t, 0.45, trustScore(t, server, carol.did, "").FlagPenalty, 1e-9)
+
+	// Cleared flags stop counting, even if they are delivered again
+	publish(events.SubjectFlagCleared{FlagID: "flg_2", Subject: carol.did, Outcome: "dismissed", ClearedAt: time.Now()})
+	publish(events.SubjectFlagCleared{FlagID: "flg_1", Subject: carol.did, Outcome: "withdrawn", ClearedAt: time.Now()})
+	scoreIs(1.0/5, 0)
+	publish(dispute)
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, trustScore(t, server, carol.did, "").FlagCount)
+}
+
+func TestParseTrustScoring(t *testing.T) {
+	scoring, err := ParseTrustScoring([]byte(`{"algorithm":"propagated","tierWeights":{"unverified":0}}`))
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmPropagated, scoring.Algorithm)
+	assert.Zero(t, scoring.TierWeights[TierUnverified])
+	assert.Equal(t, 1.0, scoring.TierWeights[TierGold])
+
+	for _, doc := range []string{
+		`{"algorithm":"pagerank"}`,
+		`{"tierWeights":{"gold":2}}`,
+		`{"saturation":0}`,
+		`{"halfLifeDays":-1}`,
+		`{"flagPenalties":{"high":1.5}}`,
+		`not json`,
+	} {
+		_, err := ParseTrustScoring([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrVouchNotFound = errors.New("vouch not found")
+	// ErrInvalidVouch means a vouch is malformed or makes an invalid claim
+	ErrInvalidVouch = errors.New("invalid vouch")
+	// ErrVouchSignature means a vouch is not signed by its voucher's DID key
+	ErrVouchSignature   = errors.New("vouch signature invalid")
+	ErrUnknownVouchType = errors.New("unknown vouch type")
+	// ErrDuplicateVouch means the voucher already vouched for the subject
+	// with that claim, or replayed a vouch
+	ErrDuplicateVouch = errors.New("duplicate vouch")
+	ErrVouchRevoked   = errors.New("vouch revoked")
+)
+
+// VouchJWTType is the typ header of a signed vouch
+const VouchJWTType = "vouch+jwt"
+
+const (
+	// vouchMaxAge bounds how long after signing a vouch may be submitted, so
+	// a leaked vouch cannot be posted long after the voucher signed it
+	vouchMaxAge      = 5 * time.Minute
+	vouchClockSkew   = time.Minute
+	maxStatementSize = 280
+	maxVouchSize     = 16 << 10
+)
+
+// vouchSigningMethods are the algorithms holder keys sign with
+var vouchSigningMethods = []string{"ES256", "ES384", "EdDSA"}
+
+var didPattern = regexp.MustCompile(`^did:[a-z0-9]+:[A-Za-z0-9._:%-]+$`)
+
+// VouchType is a claim one holder may make about another
+type VouchType struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+}
+
+// vouchTypes are the claims vouches can make
+var vouchTypes = []VouchType{
+	{ID: "known_personally", Label: "Known personally", Description: "The voucher knows the subject in person and vouches for their identity"},
+	{ID: "reliable_childminder", Label: "Reliable childminder", Description: "The subject has looked after the voucher's children reliably"},
+	{ID: "trustworthy_seller", Label: "Trustworthy seller", Description: "The voucher bought from the subject and the sale went as agreed"},
+	{ID: "reliable_tradesperson", Label: "Reliable tradesperson", Description: "The subject did work for the voucher to a good standard"},
+	{ID: "good_tenant", Label: "Good tenant", Description: "The subject rented from the voucher and kept to the tenancy"},
+}
+
+func findVouchType(id string) (VouchType, bool) {
+	for _, t := range vouchTypes {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return VouchType{}, false
+}
+
+// Vouch is one holder's signed claim about another subject. The JWS is
+// kept so anyone can check the voucher's signature.
+type Vouch struct {
+	ID        string    `json:"id"`
+	Voucher   string    `json:"voucher"` // the voucher's DID, whose key signed it
+	Subject   string    `json:"subject"` // the DID vouched for
+	Type      string    `json:"type"`
+	Statement string    `json:"statement,omitempty"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	JWS       string    `json:"jws"`
+	// RequestID is the vouch request the vouch answers, if any
+	RequestID string     `json:"requestId,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	nonce     string     // the vouch's jti, for replay detection
+	// voucherKey is the thumbprint of the key that signed it, which joins
+	// the voucher to the device signals the issuance-gateway reports
+	voucherKey string
+}
+
+// vouchClaims is the payload of a signed vouch
+type vouchClaims struct {
+	jwt.RegisteredClaims
+	VouchType    string `json:"vouch_type"`
+	Statement    string `json:"statement,omitempty"`
+	VouchRequest string `json:"vouch_request,omitempty"`
+}
+
+// SubmitVouchRequest carries a vouch signed by the voucher: a compact JWS
+// with typ vouch+jwt, a kid naming the voucher's DID key, and claims iss
+// (the voucher's DID), sub, vouch_type, statement, iat and jti, and
+// vouch_request when it answers a vouch request
+type SubmitVouchRequest struct {
+	Vouch string `json:"vouch"`
+}
+
+// verifyHolderSigned checks a JWS of type typ that a holder signed with a
+// key their DID document lists for assertions, named in kid, and returns
+// that key's thumbprint
+func (s *Server) verifyHolderSigned(ctx context.Context, signed, typ string, claims jwt.Claims) (string, error) {
+	var keyThumbprint string
+	_, err := jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		if got, _ := token.Header["typ"].(string); got != typ {
+			return nil, fmt.Errorf("unexpected typ %q", got)
+		}
+		kid, _ := token.Header["kid"].(string)
+		did, _, _ := strings.Cut(kid, "#")
+		issuer, _ := token.Claims.GetIssuer()
+		if kid == "" || did != issuer {
+			return nil, errors.New("kid must be a key of the issuer's DID")
+		}
+		jwk, err := s.dids.ResolveKey(ctx, issuer, kid)
+		if err != nil {
+			return nil, err
+		}
+		if keyThumbprint, err = jwk.Thumbprint(); err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	}, jwt.WithValidMethods(vouchSigningMethods), jwt.WithIssuedAt(), jwt.WithLeeway(vouchClockSkew), jwt.WithTimeFunc(s.now))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrVouchSignature, err)
+	}
+	return keyThumbprint, nil
+}
+
+// verifyVouch checks a signed vouch: the voucher authenticates by signing
+// it with a key their DID document lists for assertions
+func (s *Server) verifyVouch(ctx context.Context, signed string) (Vouch, error) {
+	var claims vouchClaims
+	voucherKey, err := s.verifyHolderSigned(ctx, signed, VouchJWTType, &claims)
+	if err != nil {
+		return Vouch{}, err
+	}
+
+	now := s.now()
+	switch {
+	case claims.IssuedAt == nil || claims.ID == "":
+		return Vouch{}, fmt.Errorf("%w: iat and jti are required", ErrInvalidVouch)
+	case now.Sub(claims.IssuedAt.Time) > vouchMaxAge:
+		return Vouch{}, fmt.Errorf("%w: signed more than %s ago", ErrInvalidVouch, vouchMaxAge)
+	case !didPattern.MatchString(claims.Subject):
+		return Vouch{}, fmt.Errorf("%w: sub must be a DID", ErrInvalidVouch)
+	case claims.Subject == claims.Issuer:
+		return Vouch{}, fmt.Errorf("%w: holders cannot vouch for themselves", ErrInvalidVouch)
+	case len(claims.Statement) > maxStatementSize:
+		return Vouch{}, fmt.Errorf("%w: statement over %d bytes", ErrInvalidVouch, maxStatementSize)
+	}
+	if _, ok := findVouchType(claims.VouchType); !ok {
+		return Vouch{}, fmt.Errorf("%w: %q", ErrUnknownVouchType, claims.VouchType)
+	}
+	return Vouch{
+		ID:         "vouch-" + uuid.NewString(),
+		Voucher:    claims.Issuer,
+		Subject:    claims.Subject,
+		Type:       claims.VouchType,
+		Statement:  claims.Statement,
+		IssuedAt:   claims.IssuedAt.UTC(),
+		CreatedAt:  now.UTC(),
+		JWS:        signed,
+		RequestID:  claims.VouchRequest,
+		nonce:      claims.ID,
+		voucherKey: voucherKey,
+	}, nil
+}
+
+// vouchEdge is the trust graph edge of an accepted vouch
+func vouchEdge(vouch Vouch) TrustEdge {
+	return TrustEdge{VouchID: vouch.ID, Voucher: vouch.Voucher, VoucherKey: vouch.voucherKey, Subject: vouch.Subject, Type: vouch.Type, VouchedAt: vouch.CreatedAt}
+}
+
+// VouchStore persists accepted vouches
+type VouchStore interface {
+	// Create stores a vouch, returning ErrDuplicateVouch when its voucher
+	// already vouched for the subject with that type or reused its jti
+	Create(ctx context.Context, vouch Vouch) error
+	Get(ctx context.Context, id string) (Vouch, error)
+	// ListBySubject returns the vouches a subject received, newest first,
+	// of vouchType when set
+	ListBySubject(ctx context.Context, subject, vouchType string) ([]Vouch, error)
+	// ListByVoucher returns the vouches a voucher gave since a time,
+	// revoked ones included, newest first
+	ListByVoucher(ctx context.Context, voucher string, since time.Time) ([]Vouch, error)
+	// Revoke withdraws a vouch, freeing its claim to be made again
+	Revoke(ctx context.Context, id string, at time.Time) (Vouch, error)
+	// Erase deletes every vouch a DID gave or received, for its erasure,
+	// and returns them
+	Erase(ctx context.Context, did string) ([]Vouch, error)
+}
+
+// memoryVouchStore keeps vouches in memory (production should use a
+// database with unique constraints on voucher, subject and type)
+type memoryVouchStore struct {
+	mu        sync.RWMutex
+	vouches   map[string]Vouch
+	bySubject map[string][]string
+	byVoucher map[string][]string
+	claims    map[string]bool // voucher|subject|type
+	nonces    map[string]bool // voucher|jti
+}
+
+func newMemoryVouchStore() *memoryVouchStore {
+	return &memoryVouchStore{
+		vouches:   make(map[string]Vouch),
+		bySubject: make(map[string][]string),
+		byVoucher: make(map[string][]string),
+		claims:    make(map[string]bool),
+		nonces:    make(map[string]bool),
+	}
+}
+
+func (m *memoryVouchStore) Create(ctx context.Context, vouch Vouch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claim := vouch.Voucher + "|" + vouch.Subject + "|" + vouch.Type
+	nonce := vouch.Voucher + "|" + vouch.nonce
+	if m.claims[claim] || m.nonces[nonce] {
+		return ErrDuplicateVouch
+	}
+	m.claims[claim], m.nonces[nonce] = true, true
+	m.vouches[vouch.ID] = vouch
+	m.bySubject[vouch.Subject] = append(m.bySubject[vouch.Subject], vouch.ID)
+	m.byVoucher[vouch.Voucher] = append(m.byVoucher[vouch.Voucher], vouch.ID)
+	return nil
+}
+
+func (m *memoryVouchStore) Get(ctx context.Context, id string) (Vouch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vouch, ok := m.vouches[id]
+	if !ok {
+		return Vouch{}, ErrVouchNotFound
+	}
+	return vouch, nil
+}
+
+func (m *memoryVouchStore) ListBySubject(ctx context.Context, subject, vouchType string) ([]Vouch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vouches := []Vouch{}
+	for _, id := range m.bySubject[subject] {
+		if vouch := m.vouches[id]; vouchType == "" || vouch.Type == vouchType {
+			vouches = append(vouches, vouch)
+		}
+	}
+	sort.SliceStable(vouches, func(i, j int) bool { return vouches[i].CreatedAt.After(vouches[j].CreatedAt) })
+	return vouches, nil
+}
+
+func (m *memoryVouchStore) ListByVoucher(ctx context.Context, voucher string, since time.Time) ([]Vouch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vouches := []Vouch{}
+	for _, id := range m.byVoucher[voucher] {
+		if vouch := m.vouches[id]; !vouch.CreatedAt.Before(since) {
+			vouches = append(vouches, vouch)
+		}
+	}
+	sort.SliceStable(vouches, func(i, j int) bool { return vouches[i].CreatedAt.After(vouches[j].CreatedAt) })
+	return vouches, nil
+}
+
+func (m *memoryVouchStore) Revoke(ctx context.Context, id string, at time.Time) (Vouch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vouch, ok := m.vouches[id]
+	if !ok {
+		return Vouch{}, ErrVouchNotFound
+	}
+	if vouch.RevokedAt != nil {
+		return Vouch{}, ErrVouchRevoked
+	}
+	vouch.RevokedAt = &at
+	m.vouches[id] = vouch
+	delete(m.claims, vouch.Voucher+"|"+vouch.Subject+"|"+vouch.Type)
+	return vouch, nil
+}
+
+func (m *memoryVouchStore) Erase(ctx context.Context, did string) ([]Vouch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	erased := []Vouch{}
+	for _, id := range slices.Concat(m.byVoucher[did], m.bySubject[did]) {
+		vouch, ok := m.vouches[id]
+		if !ok {
+			continue // a vouch the DID gave itself, already erased
+		}
+		delete(m.vouches, id)
+		delete(m.claims, vouch.Voucher+"|"+vouch.Subject+"|"+vouch.Type)
+		delete(m.nonces, vouch.Voucher+"|"+vouch.nonce)
+		m.bySubject[vouch.Subject] = slices.DeleteFunc(m.bySubject[vouch.Subject], func(v string) bool { return v == id })
+		m.byVoucher[vouch.Voucher] = slices.DeleteFunc(m.byVoucher[vouch.Voucher], func(v string) bool { return v == id })
+		erased = append(erased, vouch)
+	}
+	delete(m.bySubject, did)
+	delete(m.byVoucher, did)
+	return erased, nil
+}
+
+// Error codes of VouchErrorResponse
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeInvalidVouch     = "invalid_vouch"
+	ErrCodeInvalidSignature = "invalid_signature"
+	ErrCodeUnknownVouchType = "unknown_vouch_type"
+	ErrCodeDuplicateVouch   = "duplicate_vouch"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeHolderMismatch   = "holder_mismatch"
+	ErrCodeAlreadyReviewed  = "already_reviewed"
+	ErrCodeRequestClosed    = "request_closed"
+	ErrCodeVouchRevoked     = "vouch_revoked"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeInsufficientTier = "insufficient_tier"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeServerError      = "server_error"
+)
+
+// VouchErrorResponse is the JSON error body of the vouching API. Refused
+// vouches say which limit they hit and when to retry, or which tier their
+// type requires.
+type VouchErrorResponse struct {
+	Error        string `json:"error"`
+	Message      string `json:"message"`
+	Limit        string `json:"limit,omitempty"`
+	RetryAfter   int    `json:"retryAfter,omitempty"` // seconds
+	RequiredTier string `json:"requiredTier,omitempty"`
+	Tier         string `json:"tier,omitempty"`
+}
+
+func writeVouchError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, VouchErrorResponse{Error: code, Message: message})
+}
+
+// writeStoreError answers a failed vouch operation
+func writeStoreError(w http.ResponseWriter, err error) {
+	var limited *RateLimitError
+	var tier *TierError
+	switch {
+	case errors.As(err, &limited):
+		retryAfter := int(math.Ceil(limited.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeJSON(w, http.StatusTooManyRequests, VouchErrorResponse{Error: ErrCodeRateLimited, Message: err.Error(), Limit: limited.Limit, RetryAfter: retryAfter})
+	case errors.As(err, &tier):
+		writeJSON(w, http.StatusForbidden, VouchErrorResponse{Error: ErrCodeInsufficientTier, Message: err.Error(), RequiredTier: tier.Required, Tier: tier.Tier})
+	case errors.Is(err, ErrNotVoucher):
+		writeVouchError(w, http.StatusForbidden, ErrCodeForbidden, err.Error())
+	case errors.Is(err, ErrVouchRevoked):
+		writeVouchError(w, http.StatusGone, ErrCodeVouchRevoked, "The vouch was revoked")
+	case errors.Is(err, ErrVouchNotFound):
+		writeVouchError(w, http.StatusNotFound, ErrCodeNotFound, "Vouch not found")
+	case errors.Is(err, ErrVouchRequestNotFound):
+		writeVouchError(w, http.StatusNotFound, ErrCodeNotFound, "Vouch request not found")
+	case errors.Is(err, ErrVouchRequestClosed):
+		writeVouchError(w, http.StatusConflict, ErrCodeRequestClosed, "The vouch request was already answered or has expired")
+	case errors.Is(err, ErrVouchSignature):
+		writeVouchError(w, http.StatusUnauthorized, ErrCodeInvalidSignature, err.Error())
+	case errors.Is(err, ErrUnknownVouchType):
+		writeVouchError(w, http.StatusBadRequest, ErrCodeUnknownVouchType, err.Error())
+	case errors.Is(err, ErrUnknownTier):
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+	case errors.Is(err, ErrInvalidVouch):
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidVouch, err.Error())
+	case errors.Is(err, ErrDuplicateVouch):
+		writeVouchError(w, http.StatusConflict, ErrCodeDuplicateVouch, "The voucher already vouched for this subject with this claim")
+	default:
+		log.Error().Err(err).Msg("Vouch request failed")
+		writeVouchError(w, http.StatusInternalServerError, ErrCodeServerError, "Internal server error")
+	}
+}
+
+func (s *Server) handleListVouchTypes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"types": vouchTypes})
+}
+
+func (s *Server) handleSubmitVouch(w http.ResponseWriter, r *http.Request) {
+	var req SubmitVouchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVouchSize)).Decode(&req); err != nil || req.Vouch == "" {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Body must carry a signed vouch")
+		return
+	}
+	vouch, err := s.verifyVouch(r.Context(), req.Vouch)
+	if err != nil {
+		if errors.Is(err, ErrVouchSignature) {
+			log.Warn().Err(err).Msg("Vouch failed signature verification")
+		}
+		writeStoreError(w, err)
+		return
+	}
+	if vouch.RequestID != "" {
+		if err := s.checkAnswersRequest(r.Context(), vouch); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if err := s.enforceVouchPolicy(r.Context(), vouch); err != nil {
+		if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrInsufficientTier) {
+			log.Warn().Err(err).Str("voucher", vouch.Voucher).Msg("Vouch refused by policy")
+		}
+		writeStoreError(w, err)
+		return
+	}
+	if err := s.vouches.Create(r.Context(), vouch); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if vouch.RequestID != "" {
+		s.completeVouchRequest(r.Context(), vouch)
+	}
+	edge := vouchEdge(vouch)
+	if err := s.trust.graph.AddEdge(r.Context(), edge); err != nil {
+		// The vouch stands; the subject's score misses it until the graph is rebuilt
+		log.Error().Err(err).Str("vouch_id", vouch.ID).Msg("Failed to add vouch to the trust graph")
+	} else {
+		s.abuse.Inspect(r.Context(), edge)
+	}
+	log.Info().Str("vouch_id", vouch.ID).Str("type", vouch.Type).Msg("Vouch accepted")
+	s.publish(r.Context(), vouch.ID, events.VouchCreated{
+		VouchID:   vouch.ID,
+		Voucher:   vouch.Voucher,
+		Subject:   vouch.Subject,
+		VouchType: vouch.Type,
+		RequestID: vouch.RequestID,
+	})
+	w.Header().Set("Location", "/vouches/"+vouch.ID)
+	writeJSON(w, http.StatusCreated, vouch)
+}
+
+func (s *Server) handleGetVouch(w http.ResponseWriter, r *http.Request) {
+	vouch, err := s.vouches.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, vouch)
+}
+
+func (s *Server) handleListSubjectVouches(w http.ResponseWriter, r *http.Request) {
+	subject := chi.URLParam(r, "id")
+	if !didPattern.MatchString(subject) {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Subject must be a DID")
+		return
+	}
+	vouchType := r.URL.Query().Get("type")
+	if _, ok := findVouchType(vouchType); vouchType != "" && !ok {
+		writeVouchError(w, http.StatusBadRequest, ErrCodeUnknownVouchType, "Unknown vouch type "+vouchType)
+		return
+	}
+	vouches, err := s.vouches.ListBySubject(r.Context(), subject, vouchType)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"subject": subject, "count": len(vouches), "vouches": vouches})
+}
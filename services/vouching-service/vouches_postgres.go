@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cachet-id/cachet/services/common/pkg/store"
+)
+
+// postgresVouchStore keeps vouches in Postgres, whose unique indexes refuse
+// a repeated claim or jti
+type postgresVouchStore struct {
+	db *sql.DB
+}
+
+func newPostgresVouchStore(db *sql.DB) *postgresVouchStore {
+	return &postgresVouchStore{db: db}
+}
+
+const vouchColumns = `document, nonce, voucher_key, revoked_at`
+
+func scanVouch(row rowScanner) (Vouch, error) {
+	var document []byte
+	var nonce, voucherKey string
+	var revokedAt sql.NullTime
+	if err := row.Scan(&document, &nonce, &voucherKey, &revokedAt); errors.Is(err, sql.ErrNoRows) {
+		return Vouch{}, ErrVouchNotFound
+	} else if err != nil {
+		return Vouch{}, err
+	}
+	var vouch Vouch
+	if err := json.Unmarshal(document, &vouch); err != nil {
+		return Vouch{}, fmt.Errorf("decoding vouch: %w", err)
+	}
+	vouch.nonce, vouch.voucherKey = nonce, voucherKey
+	if revokedAt.Valid {
+		at := revokedAt.Time.UTC()
+		vouch.RevokedAt = &at
+	}
+	return vouch, nil
+}
+
+func (p *postgresVouchStore) list(ctx context.Context, query string, args ...interface{}) ([]Vouch, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vouches := []Vouch{}
+	for rows.Next() {
+		vouch, err := scanVouch(rows)
+		if err != nil {
+			return nil, err
+		}
+		vouches = append(vouches, vouch)
+	}
+	return vouches, rows.Err()
+}
+
+func (p *postgresVouchStore) Create(ctx context.Context, vouch Vouch) error {
+	vouch.RevokedAt = nil
+	document, err := json.Marshal(vouch)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO vouches (id, voucher, subject, type, nonce, voucher_key, created_at, document) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		vouch.ID, vouch.Voucher, vouch.Subject, vouch.Type, vouch.nonce, vouch.voucherKey, vouch.CreatedAt, document)
+	if store.IsUniqueViolation(err) {
+		return ErrDuplicateVouch
+	}
+	return err
+}
+
+func (p *postgresVouchStore) Get(ctx context.Context, id string) (Vouch, error) {
+	return scanVouch(p.db.QueryRowContext(ctx, `SELECT `+vouchColumns+` FROM vouches WHERE id = $1`, id))
+}
+
+func (p *postgresVouchStore) ListBySubject(ctx context.Context, subject, vouchType string) ([]Vouch, error) {
+	return p.list(ctx, `SELECT `+vouchColumns+` FROM vouches WHERE subject = $1 AND ($2 = '' OR type = $2) ORDER BY created_at DESC`, subject, vouchType)
+}
+
+func (p *postgresVouchStore) ListByVoucher(ctx context.Context, voucher string, since time.Time) ([]Vouch, error) {
+	return p.list(ctx, `SELECT `+vouchColumns+` FROM vouches WHERE voucher = $1 AND created_at >= $2 ORDER BY created_at DESC`, voucher, since)
+}
+
+func (p *postgresVouchStore) Revoke(ctx context.Context, id string, at time.Time) (Vouch, error) {
+	vouch, err := scanVouch(p.db.QueryRowContext(ctx,
+		`UPDATE vouches SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL RETURNING `+vouchColumns, id, at))
+	if !errors.Is(err, ErrVouchNotFound) {
+		return vouch, err
+	}
+	if _, err := p.Get(ctx, id); err != nil {
+		return Vouch{}, err
+	}
+	return Vouch{}, ErrVouchRevoked
+}
+
+func (p *postgresVouchStore) Erase(ctx context.Context, did string) ([]Vouch, error) {
+	return p.list(ctx, `DELETE FROM vouches WHERE voucher = $1 OR subject = $1 RETURNING `+vouchColumns, did)
+}
+
+// listActive returns every vouch not revoked, oldest first, to rebuild the
+// trust graph from on start
+func (p *postgresVouchStore) listActive(ctx context.Context) ([]Vouch, error) {
+	return p.list(ctx, `SELECT `+vouchColumns+` FROM vouches WHERE revoked_at IS NULL ORDER BY created_at`)
+}
+
+// postgresVouchRequestStore keeps vouch requests in Postgres
+type postgresVouchRequestStore struct {
+	db *sql.DB
+}
+
+func newPostgresVouchRequestStore(db *sql.DB) *postgresVouchRequestStore {
+	return &postgresVouchRequestStore{db: db}
+}
+
+func scanVouchRequest(row rowScanner) (VouchRequest, error) {
+	var document []byte
+	if err := row.Scan(&document); errors.Is(err, sql.ErrNoRows) {
+		return VouchRequest{}, ErrVouchRequestNotFound
+	} else if err != nil {
+		return VouchRequest{}, err
+	}
+	var req VouchRequest
+	if err := json.Unmarshal(document, &req); err != nil {
+		return VouchRequest{}, fmt.Errorf("decoding vouch request: %w", err)
+	}
+	return req, nil
+}
+
+func (p *postgresVouchRequestStore) Create(ctx context.Context, req VouchRequest) error {
+	document, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO vouch_requests (id, status, expires_at, document) VALUES ($1, $2, $3, $4)`,
+		req.ID, req.Status, req.ExpiresAt, document)
+	return err
+}
+
+func (p *postgresVouchRequestStore) Get(ctx context.Context, id string) (VouchRequest, error) {
+	return scanVouchRequest(p.db.QueryRowContext(ctx, `SELECT document FROM vouch_requests WHERE id = $1`, id))
+}
+
+func (p *postgresVouchRequestStore) Answer(ctx context.Context, id, status, vouchID string, at time.Time) (VouchRequest, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return VouchRequest{}, err
+	}
+	defer tx.Rollback()
+	req, err := scanVouchRequest(tx.QueryRowContext(ctx, `SELECT document FROM vouch_requests WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return VouchRequest{}, err
+	}
+	if req.statusAt(at) != RequestPending {
+		return VouchRequest{}, ErrVouchRequestClosed
+	}
+	req.Status, req.VouchID, req.AnsweredAt = status, vouchID, &at
+	document, err := json.Marshal(req)
+	if err != nil {
+		return VouchRequest{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE vouch_requests SET status = $2, document = $3 WHERE id = $1`, id, status, document); err != nil {
+		return VouchRequest{}, err
+	}
+	return req, tx.Commit()
+}
+
+// loadTrustGraph adds the edges of every active vouch to graph, which is
+// kept in memory and so starts empty
+func loadTrustGraph(ctx context.Context, graph TrustGraph, vouches *postgresVouchStore) (int, error) {
+	active, err := vouches.listActive(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, vouch := range active {
+		if err := graph.AddEdge(ctx, vouchEdge(vouch)); err != nil {
+			return 0, err
+		}
+	}
+	return len(active), nil
+}
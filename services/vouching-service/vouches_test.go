@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// holder is a credential holder identified by the did:jwk of their key
+type holder struct {
+	key *ecdsa.PrivateKey
+	did string
+}
+
+func newHolder(t *testing.T) holder {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwk, err := json.Marshal(map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	require.NoError(t, err)
+	return holder{key: key, did: "did:jwk:" + base64.RawURLEncoding.EncodeToString(jwk)}
+}
+
+// sign signs a vouch for subject; edit adjusts the claims before signing
+func (h holder) sign(t *testing.T, subject, vouchType string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss":        h.did,
+		"sub":        subject,
+		"vouch_type": vouchType,
+		"iat":        time.Now().Unix(),
+		"jti":        uuid.NewString(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = VouchJWTType
+	token.Header["kid"] = h.did + "#0"
+	signed, err := token.SignedString(h.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func vouchRequest(t *testing.T, server *Server, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func submit(t *testing.T, server *Server, signed string) (int, Vouch, VouchErrorResponse) {
+	t.Helper()
+	w := vouchRequest(t, server, http.MethodPost, "/vouches", SubmitVouchRequest{Vouch: signed})
+	var vouch Vouch
+	var errResp VouchErrorResponse
+	if w.Code == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vouch))
+	} else {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	}
+	return w.Code, vouch, errResp
+}
+
+func TestHealthCheck(t *testing.T) {
+	w := vouchRequest(t, NewServer(), http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestVouches_SubmitAndList(t *testing.T) {
+	server := NewServer()
+	alice, bob, carol := newHolder(t), newHolder(t), newHolder(t)
+
+	code, vouch, _ := submit(t, server, alice.sign(t, carol.did, "reliable_childminder", func(c jwt.MapClaims) {
+		c["statement"] = "Looked after our two for a year"
+	}))
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, alice.did, vouch.Voucher)
+	assert.Equal(t, carol.did, vouch.Subject)
+	assert.Equal(t, "reliable_childminder", vouch.Type)
+	assert.Equal(t, "Looked after our two for a year", vouch.Statement)
+	assert.NotEmpty(t, vouch.JWS)
+
+	w := vouchRequest(t, server, http.MethodGet, "/vouches/"+vouch.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	code, _, _ = submit(t, server, bob.sign(t, carol.did, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+	code, _, _ = submit(t, server, bob.sign(t, alice.did, "known_personally", nil))
+	require.Equal(t, http.StatusCreated, code)
+
+	var listed struct {
+		Subject string  `json:"subject"`
+		Count   int     `json:"count"`
+		Vouches []Vouch `json:"vouches"`
+	}
+	w = vouchRequest(t, server, http.MethodGet, "/subjects/"+carol.did+"/vouches", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Equal(t, carol.did, listed.Subject)
+	assert.Equal(t, 2, listed.Count)
+
+	w = vouchRequest(t, server, http.MethodGet, "/subjects/"+carol.did+"/vouches?type=reliable_childminder", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Vouches, 1)
+	assert.Equal(t, alice.did, listed.Vouches[0].Voucher)
+
+	assert.Equal(t, http.StatusBadRequest, vouchRequest(t, server, http.MethodGet, "/subjects/"+carol.did+"/vouches?type=nope", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, vouchRequest(t, server, http.MethodGet, "/subjects/carol/vouches", nil).Code)
+	assert.Equal(t, http.StatusNotFound, vouchRequest(t, server, http.MethodGet, "/vouches/vouch-missing", nil).Code)
+}
+
+func TestVouches_Rejected(t *testing.T) {
+	server := NewServer()
+	alice, bob := newHolder(t), newHolder(t)
+
+	// A vouch signed with someone else's key does not authenticate
+	forged := bob.sign(t, bob.did, "known_personally", func(c jwt.MapClaims) { c["iss"] = alice.did })
+	code, _, errResp := submit(t, server, forged)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, ErrCodeInvalidSignature, errResp.Error)
+
+	stolen := newHolder(t)
+	stolen.did = alice.did
+	code, _, _ = submit(t, server, stolen.sign(t, bob.did, "known_personally", nil))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	for name, tc := range map[string]struct {
+		signed string
+		code   string
+	}{
+		"self vouch":   {alice.sign(t, alice.did, "known_personally", nil), ErrCodeInvalidVouch},
+		"stale":        {alice.sign(t, bob.did, "known_personally", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-time.Hour).Unix() }), ErrCodeInvalidVouch},
+		"no jti":       {alice.sign(t, bob.did, "known_personally", func(c jwt.MapClaims) { delete(c, "jti") }), ErrCodeInvalidVouch},
+		"subject":      {alice.sign(t, "bob", "known_personally", nil), ErrCodeInvalidVouch},
+		"unknown type": {alice.sign(t, bob.did, "great_friend", nil), ErrCodeUnknownVouchType},
+		"long statement": {alice.sign(t, bob.did, "known_personally", func(c jwt.MapClaims) {
+			c["statement"] = string(bytes.Repeat([]byte("a"), maxStatementSize+1))
+		}), ErrCodeInvalidVouch},
+	} {
+		code, _, errResp := submit(t, server, tc.signed)
+		assert.Equal(t, http.StatusBadRequest, code, name)
+		assert.Equal(t, tc.code, errResp.Error, name)
+	}
+
+	// A voucher makes each claim about a subject once, and vouches cannot be replayed
+	signed := alice.sign(t, bob.did, "known_personally", nil)
+	code, _, _ = submit(t, server, signed)
+	require.Equal(t, http.StatusCreated, code)
+	code, _, errResp = submit(t, server, signed)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, ErrCodeDuplicateVouch, errResp.Error)
+	code, _, _ = submit(t, server, alice.sign(t, bob.did, "known_personally", nil))
+	assert.Equal(t, http.StatusConflict, code)
+	code, _, _ = submit(t, server, alice.sign(t, bob.did, "good_tenant", nil))
+	assert.Equal(t, http.StatusCreated, code)
+
+	assert.Equal(t, http.StatusBadRequest, vouchRequest(t, server, http.MethodPost, "/vouches", map[string]string{}).Code)
+}
@@ -0,0 +1,122 @@
+// k6 load profile for Cachet's hot paths: token issuance, credential
+// issuance, verification sessions and receipt submission.
+//
+//   k6 run tests/load/hot-paths.js
+//
+// Targets default to the docker compose ports (infra/docker-compose.yaml);
+// override them with ISSUANCE_URL, VERIFIER_URL and RECEIPTS_URL. Receipt
+// submission needs a service token the receipts-log accepts from the
+// verifier, passed as RECEIPTS_SERVICE_TOKEN; without one that scenario is
+// skipped. RATE scales every scenario's arrival rate (default 1).
+import http from 'k6/http';
+import { check, fail } from 'k6';
+import exec from 'k6/execution';
+
+const issuanceURL = __ENV.ISSUANCE_URL || 'http://localhost:8090';
+const verifierURL = __ENV.VERIFIER_URL || 'http://localhost:8081';
+const receiptsURL = __ENV.RECEIPTS_URL || 'http://localhost:8083';
+const receiptsToken = __ENV.RECEIPTS_SERVICE_TOKEN || '';
+const rate = Number(__ENV.RATE || 1);
+const duration = __ENV.DURATION || '1m';
+
+const json = { headers: { 'Content-Type': 'application/json' } };
+
+function scenario(exec, perSecond) {
+  return {
+    executor: 'constant-arrival-rate',
+    exec,
+    rate: Math.max(1, Math.round(perSecond * rate)),
+    timeUnit: '1s',
+    duration,
+    preAllocatedVUs: 10,
+    maxVUs: 100,
+  };
+}
+
+const scenarios = {
+  tokens: scenario('tokens', 50),
+  credentials: scenario('credentials', 10),
+  verification: scenario('verification', 30),
+};
+if (receiptsToken) {
+  scenarios.receipts = scenario('receipts', 30);
+}
+
+// Budgets per release; a run breaching them fails, see tests/load/README.md
+export const options = {
+  scenarios,
+  thresholds: {
+    'http_req_failed': ['rate<0.01'],
+    'http_req_duration{scenario:tokens}': ['p(95)<150'],
+    'http_req_duration{scenario:credentials}': ['p(95)<300'],
+    'http_req_duration{scenario:verification}': ['p(95)<200'],
+    'http_req_duration{scenario:receipts}': ['p(95)<100'],
+  },
+};
+
+function token(sessionID) {
+  const body = { grant_type: 'client_credentials', client_id: 'load-wallet', scope: 'credential_issuance' };
+  if (sessionID) {
+    body.session_id = sessionID;
+  }
+  const res = http.post(`${issuanceURL}/oauth/token`, JSON.stringify(body), json);
+  check(res, { 'token issued': (r) => r.status === 200 });
+  return res.status === 200 ? res.json('access_token') : '';
+}
+
+export function tokens() {
+  token();
+}
+
+// credentials verifies an identity session through the Veriff webhook, then
+// redeems it for a credential the way a wallet would
+export function credentials() {
+  const sessionID = `load-${exec.scenario.iterationInTest}-${Date.now()}`;
+  const session = {
+    session_id: sessionID,
+    status: 'approved',
+    person: { firstName: 'Load', lastName: 'Test', dateOfBirth: '1990-01-01', confidence: 0.97 },
+    document: { number: 'LT0000000', type: 'PASSPORT', country: 'GB', authenticity: 0.99 },
+    verification: { liveness_score: 0.94, overall_confidence: 0.98, risk_score: 0.02 },
+  };
+  const webhook = http.post(`${issuanceURL}/webhooks/veriff`, JSON.stringify(session), json);
+  if (!check(webhook, { 'session verified': (r) => r.status === 200 })) {
+    return;
+  }
+  const accessToken = token(sessionID);
+  if (!accessToken) {
+    return;
+  }
+  const res = http.post(
+    `${issuanceURL}/credential`,
+    JSON.stringify({ format: 'jwt_vc', types: ['VerifiableCredential', 'IdentityCredential'] }),
+    { headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${accessToken}` } },
+  );
+  check(res, { 'credential issued': (r) => r.status === 200 });
+}
+
+// verification opens a session and polls it, as a relying party's page
+// does while the wallet presents. Checking the presentation itself needs a
+// holder-bound SD-JWT; BenchmarkVerifyPresentation in the verifier covers it.
+export function verification() {
+  const res = http.post(`${verifierURL}/verification-sessions`, JSON.stringify({ policyId: 'pack.safe.seller@0.1.0' }), json);
+  if (!check(res, { 'session created': (r) => r.status === 201 })) {
+    return;
+  }
+  const status = http.get(`${verifierURL}/verification-sessions/${res.json('sessionId')}`);
+  check(status, { 'session pending': (r) => r.status === 200 });
+}
+
+export function receipts() {
+  const hash = `urn:sha256:${exec.scenario.iterationInTest.toString(16).padStart(64, '0')}`;
+  const res = http.post(`${receiptsURL}/receipts/hash`, JSON.stringify({ receiptHash: hash }), {
+    headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${receiptsToken}` },
+  });
+  check(res, { 'receipt accepted': (r) => r.status === 200 });
+}
+
+export function setup() {
+  if (!token()) {
+    fail(`issuance-gateway at ${issuanceURL} does not issue tokens`);
+  }
+}